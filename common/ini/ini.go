@@ -1,4 +1,4 @@
-// Mochi shared ini parsing + MOCHI_<SECTION>_<KEY> env overrides.
+// Mochi shared ini parsing, includes, ${VAR} interpolation + MOCHI_<SECTION>_<KEY> env overrides.
 // Copyright © 2026 Mochisoft OÜ
 // SPDX-License-Identifier: AGPL-3.0-only
 // This file is part of Mochi, licensed under the GNU AGPL v3 with the
@@ -7,9 +7,13 @@
 package ini
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -18,15 +22,103 @@ import (
 
 var (
 	file                *goini.File
+	files               []string
 	match_commas_spaces = regexp.MustCompile("[\\s,]+")
+	match_variable      = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
 )
 
-// Load reads the INI file at the given path. Subsequent accessor calls return
-// values from this file unless overridden by a MOCHI_<SECTION>_<KEY> env var.
+// Load reads the INI file at the given path, then the files named by its
+// top-level include key: globs, relative to the file's directory, such as
+// "conf.d/*.conf". Included files are read in order, each overriding
+// earlier values, and can't include others themselves. In every value,
+// ${VAR} is replaced by the environment variable VAR, ${VAR:-default} by
+// default if VAR is unset or empty, and $${ is a literal ${. A variable
+// that is unset with no default is an error. Subsequent accessor calls
+// return the merged values unless overridden by a MOCHI_<SECTION>_<KEY>
+// env var.
 func Load(path string) error {
-	var err error
-	file, err = goini.Load(path)
-	return err
+	main, f, err := read(path)
+	if err != nil {
+		return err
+	}
+	names := []string{path}
+	var others []any
+	for _, pattern := range match_commas_spaces.Split(f.Section("").Key("include").String(), -1) {
+		if pattern == "" {
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: include %q: %w", path, pattern, err)
+		}
+		for _, m := range matches {
+			content, _, err := read(m)
+			if err != nil {
+				return err
+			}
+			names = append(names, m)
+			others = append(others, content)
+		}
+	}
+	if len(others) > 0 {
+		f, err = goini.Load(main, others...)
+		if err != nil {
+			return err
+		}
+		if missing := interpolate(f); len(missing) > 0 {
+			return fmt.Errorf("%s: environment variable %s not set", path, strings.Join(missing, ", "))
+		}
+	}
+	file, files = f, names
+	return nil
+}
+
+// read returns a file's content, and the file parsed with its variables
+// replaced
+func read(path string) ([]byte, *goini.File, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := goini.Load(content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if missing := interpolate(f); len(missing) > 0 {
+		return nil, nil, fmt.Errorf("%s: environment variable %s not set", path, strings.Join(missing, ", "))
+	}
+	return content, f, nil
+}
+
+// interpolate replaces the variables in a parsed file's values, returning
+// the names of any that are unset with no default. Only values are
+// interpolated, so variables in comments are ignored, and a replacement
+// can't add keys or sections of its own.
+func interpolate(f *goini.File) []string {
+	var missing []string
+	for _, s := range f.Sections() {
+		for _, k := range s.Keys() {
+			v := match_variable.ReplaceAllStringFunc(k.Value(), func(m string) string {
+				if m[1] == '$' {
+					return m[1:]
+				}
+				parts := match_variable.FindStringSubmatch(m)
+				if v := os.Getenv(parts[1]); v != "" {
+					return v
+				} else if len(parts[2]) > 0 {
+					return parts[2][2:]
+				} else if _, set := os.LookupEnv(parts[1]); !set {
+					missing = append(missing, parts[1])
+				}
+				return ""
+			})
+			k.SetValue(v)
+		}
+	}
+	return missing
 }
 
 // Loaded reports whether Load has been called successfully.
@@ -34,6 +126,11 @@ func Loaded() bool {
 	return file != nil
 }
 
+// Files returns the files Load read, the main one first.
+func Files() []string {
+	return files
+}
+
 // env returns the MOCHI_<SECTION>_<KEY> environment override and whether it
 // was set. Section and key are uppercased; empty env vars are treated as
 // explicit overrides to empty string, not fall-throughs.
@@ -113,8 +210,8 @@ func Ints(section, key string) []int {
 // Effective returns the merged view of (file values + MOCHI_<SECTION>_<KEY>
 // env overrides). Each top-level key is a section name; values are
 // section-key-to-value maps. Sensitive keys (anything matching *password,
-// *secret, *key, *token, case-insensitive) are returned with the value
-// replaced by "***redacted***".
+// *passphrase, *secret, *key, *token, case-insensitive) are returned with
+// the value replaced by "***redacted***".
 func Effective() map[string]map[string]string {
 	out := map[string]map[string]string{}
 	if file != nil {
@@ -163,7 +260,7 @@ func Effective() map[string]map[string]string {
 // redact masks values whose key name suggests a credential.
 func redact(key, value string) string {
 	low := strings.ToLower(key)
-	for _, marker := range []string{"password", "secret", "key", "token"} {
+	for _, marker := range []string{"password", "passphrase", "secret", "key", "token"} {
 		if strings.HasSuffix(low, marker) || strings.Contains(low, marker) {
 			if value == "" {
 				return ""
@@ -173,3 +270,35 @@ func redact(key, value string) string {
 	}
 	return value
 }
+
+// Print writes the effective configuration as an INI file, sections and
+// keys sorted, with sensitive values redacted as Effective returns them.
+func Print(w io.Writer) error {
+	for _, f := range files {
+		if _, err := fmt.Fprintf(w, "# %s\n", f); err != nil {
+			return err
+		}
+	}
+	effective := Effective()
+	sections := make([]string, 0, len(effective))
+	for name := range effective {
+		sections = append(sections, name)
+	}
+	sort.Strings(sections)
+	for _, name := range sections {
+		if _, err := fmt.Fprintf(w, "\n[%s]\n", name); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(effective[name]))
+		for k := range effective[name] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, err := fmt.Fprintf(w, "%s = %s\n", k, effective[name][k]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -7,7 +7,10 @@
 package ini
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	goini "gopkg.in/ini.v1"
@@ -183,7 +186,7 @@ func TestEffectiveMergesFileAndEnv(t *testing.T) {
 }
 
 func TestEffectiveRedactsSensitiveKeys(t *testing.T) {
-	loadIniBytes(t, "[email]\npassword = supersecret\nadmin = ops@example.com\n[oauth]\nclient_secret = abc\napi_token = xyz\n")
+	loadIniBytes(t, "[email]\npassword = supersecret\nadmin = ops@example.com\n[oauth]\nclient_secret = abc\napi_token = xyz\n[secrets]\npassphrase = words\n")
 
 	got := Effective()
 
@@ -196,7 +199,85 @@ func TestEffectiveRedactsSensitiveKeys(t *testing.T) {
 	if got["oauth"]["api_token"] != "***redacted***" {
 		t.Errorf("api_token not redacted: got %q", got["oauth"]["api_token"])
 	}
+	if got["secrets"]["passphrase"] != "***redacted***" {
+		t.Errorf("passphrase not redacted: got %q", got["secrets"]["passphrase"])
+	}
 	if got["email"]["admin"] != "ops@example.com" {
 		t.Errorf("non-sensitive key should not be redacted: got %q", got["email"]["admin"])
 	}
 }
+
+func TestLoadIncludes(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "conf.d"), 0o755)
+	os.WriteFile(filepath.Join(dir, "mochi.conf"), []byte("include = conf.d/*.conf\n[web]\nports = 80\ndomain = main.example\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "conf.d", "10-web.conf"), []byte("[web]\nports = 8080\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "conf.d", "20-email.conf"), []byte("[email]\nadmin = ops@example.com\n[web]\nports = 9090\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "conf.d", "ignored.txt"), []byte("[web]\nports = 1\n"), 0o644)
+
+	if err := Load(filepath.Join(dir, "mochi.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if got := String("web", "ports", ""); got != "9090" {
+		t.Errorf("web.ports: got %q, want the last include's 9090", got)
+	}
+	if got := String("web", "domain", ""); got != "main.example" {
+		t.Errorf("web.domain: got %q, want main.example", got)
+	}
+	if got := String("email", "admin", ""); got != "ops@example.com" {
+		t.Errorf("email.admin: got %q", got)
+	}
+	if got := len(Files()); got != 3 {
+		t.Errorf("files: got %v, want 3", Files())
+	}
+}
+
+func TestLoadVariables(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mochi.conf")
+	t.Setenv("MOCHI_TEST_DOMAIN", "env.example")
+	t.Setenv("MOCHI_TEST_EMPTY", "")
+	os.WriteFile(path, []byte("[web]\ndomain = ${MOCHI_TEST_DOMAIN}\nports = ${MOCHI_TEST_UNSET:-8080}\nbind = ${MOCHI_TEST_EMPTY:-fallback}\nliteral = $${MOCHI_TEST_DOMAIN}\n"), 0o644)
+
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"domain": "env.example", "ports": "8080", "bind": "fallback", "literal": "${MOCHI_TEST_DOMAIN}"} {
+		if got := String("web", key, ""); got != want {
+			t.Errorf("web.%s: got %q, want %q", key, got, want)
+		}
+	}
+
+	os.WriteFile(path, []byte("[web]\ndomain = ${MOCHI_TEST_UNSET}\n"), 0o644)
+	if err := Load(path); err == nil || !strings.Contains(err.Error(), "MOCHI_TEST_UNSET") {
+		t.Errorf("unset variable: got %v, want an error naming it", err)
+	}
+}
+
+func TestLoadVariablesOnlyInValues(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mochi.conf")
+	t.Setenv("MOCHI_TEST_INJECT", "x\n[admin]\npassword = injected")
+	os.WriteFile(path, []byte("; set ${MOCHI_TEST_UNSET} to override\n[web]\n# ${MOCHI_TEST_UNSET}\ndomain = ${MOCHI_TEST_INJECT}\n"), 0o644)
+
+	if err := Load(path); err != nil {
+		t.Fatalf("variable in a comment: %v", err)
+	}
+	if got := String("web", "domain", ""); got != "x\n[admin]\npassword = injected" {
+		t.Errorf("web.domain: got %q", got)
+	}
+	if got := String("admin", "password", ""); got != "" {
+		t.Errorf("environment value added admin.password %q", got)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	loadIniBytes(t, "[web]\nports = 80\n[email]\npassword = secret\n")
+	var b strings.Builder
+	if err := Print(&b); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "\n[email]\npassword = ***redacted***\n\n[web]\nports = 80\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want suffix %q", got, want)
+	}
+}
@@ -16,8 +16,12 @@ import (
 )
 
 // admin_socket_default returns the admin UDS path derived from the data dir in
-// the loaded mochi.conf, defaulting to the platform data directory.
+// the loaded mochi.conf, defaulting to the platform data directory. A cluster
+// node's socket is named after the node.
 func admin_socket_default() string {
 	data := ini.String("directories", "data", paths.Data())
+	if node := ini.String("cluster", "node", ""); node != "" && ini.Bool("cluster", "enabled", false) {
+		return filepath.Join(data, "run", "admin-"+node+".sock")
+	}
 	return filepath.Join(data, "run", "admin.sock")
 }
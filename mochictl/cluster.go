@@ -0,0 +1,72 @@
+// mochictl: cluster subcommand.
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl cluster` -> GET /_/admin/cluster
+//   The nodes sharing this server's data directory, and which one leads.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// cmd_cluster handles `mochictl cluster`. With -j / -t the response is
+// dumped raw.
+func cmd_cluster(args []string) error {
+	if flag_json || flag_tabs {
+		return get_dump("/_/admin/cluster", "enabled", "node", "leading", "leader", "nodes")
+	}
+
+	resp, err := client().Get("/_/admin/cluster")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Enabled bool   `json:"enabled"`
+		Node    string `json:"node"`
+		Nodes   []struct {
+			Node    string `json:"node"`
+			Host    string `json:"host"`
+			PID     int    `json:"pid"`
+			Version string `json:"version"`
+			Leader  bool   `json:"leader"`
+			Started int64  `json:"started"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+	if !payload.Enabled {
+		fmt.Println("Clustering is not enabled")
+		return nil
+	}
+
+	fmt.Printf("%-24s  %-8s  %-24s  %8s  %-12s  %s\n", "NODE", "ROLE", "HOST", "PID", "VERSION", "STARTED")
+	for _, n := range payload.Nodes {
+		role := "follower"
+		if n.Leader {
+			role = "leader"
+		}
+		node := n.Node
+		if node == payload.Node {
+			node += " *"
+		}
+		started := time.Unix(n.Started, 0).Format("2006-01-02 15:04:05")
+		fmt.Printf("%-24s  %-8s  %-24s  %8d  %-12s  %s\n", node, role, n.Host, n.PID, n.Version, started)
+	}
+	return nil
+}
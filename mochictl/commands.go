@@ -143,6 +143,54 @@ func init() {
 			help: "Per-topic GossipSub mesh peer count + published/received counters during the /mochi/2 migration.",
 			run:  cmd_pubsub_status,
 		},
+		"peers stats": {
+			help: "Streams opened to each peer, failures, dials and round trip, and which connections are kept warm.",
+			run:  cmd_peers_stats,
+		},
+		"transfer": {
+			help: "Bytes sent and received over P2P streams this month by peer, app or user: transfer [peer|app|user] [YYYY-MM]",
+			run:  cmd_transfer,
+		},
+		"queue dead": {
+			help: "Messages the outbound queue gave up on, newest first: queue dead [service]",
+			run:  cmd_queue_dead,
+		},
+		"queue requeue": {
+			help: "Return dead letters to the queue for delivery: queue requeue <id> | all [service]",
+			run:  cmd_queue_requeue,
+		},
+		"events log": {
+			help: "Events received by an app, oldest first: events log <app> [user] [failed] [after-sequence]",
+			run:  cmd_events_log,
+		},
+		"events replay": {
+			help: "Replay logged events to an app, after its replay cursor unless a sequence is given: events replay <app> [user] [failed] [after-sequence]",
+			run:  cmd_events_replay,
+		},
+		"cluster": {
+			help: "Cluster nodes, and which holds the leader's lease",
+			run:  cmd_cluster,
+		},
+		"dns": {
+			help: "DNS records to publish so other servers can find this one by a zone, checked against those published: dns <zone> [host]",
+			run:  cmd_dns,
+		},
+		"dkim": {
+			help: "DKIM record to publish for a domain mail is sent from, checked with its SPF and DMARC records against those published: dkim [domain]",
+			run:  cmd_dkim,
+		},
+		"expiry": {
+			help: "Certificates served and when they expire, unused passkeys and old entity keys, from the last check or a new one: expiry [check]",
+			run:  cmd_expiry,
+		},
+		"disk": {
+			help: "Free space where data and cache are kept, and whether uploads are paused for lack of it, from the last check or a new one: disk [check]",
+			run:  cmd_disk,
+		},
+		"maintenance": {
+			help: "Whether the server is in maintenance mode, or turn it on with a message for visitors, or off: maintenance [on [message] | off]",
+			run:  cmd_maintenance,
+		},
 		"check starlark": {
 			help: "Parse every .star file under <path> using the server's go.starlark.net parser. Non-zero exit + file:line:col on the first parse error. Use in deploy.sh before zipping the bundle.",
 			run:  cmd_check_starlark,
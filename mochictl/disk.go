@@ -0,0 +1,74 @@
+// mochictl: disk subcommand (disk space watchdog).
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl disk [check]` -> GET /_/admin/disk
+//   The free space on the filesystems holding the data and cache
+//   directories, from the last check or, with check, a new one.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// cmd_disk handles `mochictl disk [check]`, exiting non-zero if space is
+// critical. With -j / -t the response is dumped raw.
+func cmd_disk(args []string) error {
+	path := "/_/admin/disk"
+	if len(args) > 0 {
+		if args[0] != "check" {
+			return fmt.Errorf("usage: disk [check]")
+		}
+		path += "?check=true"
+	}
+	if flag_json || flag_tabs {
+		return get_dump(path, "checked", "status", "volumes")
+	}
+
+	resp, err := client().Get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Status  string `json:"status"`
+		Volumes []struct {
+			Directory string `json:"directory"`
+			Path      string `json:"path"`
+			Free      int64  `json:"free"`
+			Size      int64  `json:"size"`
+			Status    string `json:"status"`
+			Problem   string `json:"problem"`
+		} `json:"volumes"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+
+	for _, v := range payload.Volumes {
+		line := fmt.Sprintf("%-6s  %-40s  %8d MB free of %8d MB  %s", v.Directory, v.Path, v.Free>>20, v.Size>>20, v.Status)
+		if v.Problem != "" {
+			line += ": " + v.Problem
+		}
+		fmt.Println(line)
+	}
+	if len(payload.Volumes) == 0 {
+		fmt.Println("Not checked yet")
+	}
+	if payload.Status == "critical" {
+		return fmt.Errorf("disk space critical: uploads and app installs are paused")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// mochictl: dkim subcommand (DKIM signing key records).
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl dkim [domain]` -> GET /_/admin/dkim
+//   The DKIM record to publish for a sending domain, by default that of the
+//   email_from setting, and any problems with it or the domain's SPF and
+//   DMARC records as published now.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+// cmd_dkim handles `mochictl dkim [domain]`, exiting non-zero if the
+// published records are missing or wrong. With -j / -t the response is
+// dumped raw.
+func cmd_dkim(args []string) error {
+	path := "/_/admin/dkim"
+	if len(args) > 0 && args[0] != "" {
+		path += "?" + url.Values{"domain": {args[0]}}.Encode()
+	}
+	if flag_json || flag_tabs {
+		return get_dump(path, "domain", "selector", "signing", "records", "problems")
+	}
+
+	resp, err := client().Get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Domain  string `json:"domain"`
+		Signing bool   `json:"signing"`
+		Records []struct {
+			Name  string `json:"name"`
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"records"`
+		Problems []string `json:"problems"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+
+	if !payload.Signing {
+		fmt.Println("Signing is off ([email] dkim = false)")
+	}
+	fmt.Printf("; Records for %s\n", payload.Domain)
+	for _, r := range payload.Records {
+		fmt.Printf("%-40s  IN  %-3s  %s\n", r.Name, r.Type, r.Value)
+	}
+	fmt.Println()
+	if len(payload.Problems) == 0 {
+		fmt.Println("Published records match")
+		return nil
+	}
+	for _, p := range payload.Problems {
+		fmt.Println("Problem: " + p)
+	}
+	return fmt.Errorf("published records for %s don't match", payload.Domain)
+}
@@ -0,0 +1,74 @@
+// mochictl: dns subcommand (DNS peer discovery records).
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl dns <zone> [host]` -> GET /_/admin/dns
+//   The records to publish under a zone so other servers can find this one
+//   by it, and any differences from the records published there now.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+// cmd_dns handles `mochictl dns <zone> [host]`, exiting non-zero if the
+// published records are missing or wrong. With -j / -t the response is
+// dumped raw.
+func cmd_dns(args []string) error {
+	if len(args) == 0 || args[0] == "" {
+		return fmt.Errorf("usage: dns <zone> [host]")
+	}
+	query := url.Values{"zone": {args[0]}}
+	if len(args) > 1 {
+		query.Set("host", args[1])
+	}
+	path := "/_/admin/dns?" + query.Encode()
+	if flag_json || flag_tabs {
+		return get_dump(path, "zone", "host", "peer", "records", "found", "problems")
+	}
+
+	resp, err := client().Get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Zone    string `json:"zone"`
+		Records []struct {
+			Name  string `json:"name"`
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"records"`
+		Problems []string `json:"problems"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+
+	fmt.Printf("; Records for %s\n", payload.Zone)
+	for _, r := range payload.Records {
+		fmt.Printf("%-40s  IN  %-3s  %s\n", r.Name, r.Type, r.Value)
+	}
+	fmt.Println()
+	if len(payload.Problems) == 0 {
+		fmt.Println("Published records match")
+		return nil
+	}
+	for _, p := range payload.Problems {
+		fmt.Println("Problem: " + p)
+	}
+	return fmt.Errorf("published records for %s don't match", payload.Zone)
+}
@@ -0,0 +1,136 @@
+// mochictl: events subcommands (event log and replay).
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl events log <app> [user] [failed] [after]` -> GET /_/admin/events
+//   Events received by an app, and how handling them went.
+// `mochictl events replay <app> [user] [failed] [after]` -> POST /_/admin/events/replay
+//   Re-run the app's handlers for them once a bug is fixed.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// events_query builds the query for the events subcommands from their
+// arguments: the app, then in any order a user, "failed", and a sequence
+// number to start after
+func events_query(args []string, usage string) (url.Values, error) {
+	if len(args) == 0 || args[0] == "" {
+		return nil, fmt.Errorf("usage: %s", usage)
+	}
+	query := url.Values{"app": {args[0]}}
+	for _, a := range args[1:] {
+		if a == "failed" {
+			query.Set("failed", "true")
+		} else if _, err := strconv.ParseInt(a, 10, 64); err == nil {
+			query.Set("after", a)
+		} else {
+			query.Set("user", a)
+		}
+	}
+	return query, nil
+}
+
+// cmd_events_log handles `mochictl events log <app> [user] [failed] [after]`.
+// With -j / -t the response is dumped raw.
+func cmd_events_log(args []string) error {
+	query, err := events_query(args, "events log <app> [user] [failed] [after-sequence]")
+	if err != nil {
+		return err
+	}
+	path := "/_/admin/events?" + query.Encode()
+	if flag_json || flag_tabs {
+		return get_dump(path, "cursor", "rows")
+	}
+
+	resp, err := client().Get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Rows []struct {
+			Sequence int64  `json:"sequence"`
+			User     string `json:"user"`
+			From     string `json:"from"`
+			Service  string `json:"service"`
+			Event    string `json:"event"`
+			Result   string `json:"result"`
+			Received int64  `json:"received"`
+		} `json:"rows"`
+		Cursor int64 `json:"cursor"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+	if len(payload.Rows) == 0 {
+		if flag_verbose {
+			fmt.Println("No events")
+		}
+		return nil
+	}
+
+	fmt.Printf("%10s  %-19s  %-32s  %-16s  %-24s  %s\n", "SEQUENCE", "RECEIVED", "USER", "SERVICE", "EVENT", "RESULT")
+	for _, r := range payload.Rows {
+		received := time.Unix(r.Received, 0).Format("2006-01-02 15:04:05")
+		result := r.Result
+		if result == "" {
+			result = "ok"
+		}
+		fmt.Printf("%10d  %-19s  %-32s  %-16s  %-24s  %s\n", r.Sequence, received, r.User, r.Service, r.Event, result)
+	}
+	if flag_verbose {
+		fmt.Printf("Replay cursor: %d\n", payload.Cursor)
+	}
+	return nil
+}
+
+// cmd_events_replay handles `mochictl events replay <app> [user] [failed]
+// [after]`. Prints the counts and new cursor with -v.
+func cmd_events_replay(args []string) error {
+	query, err := events_query(args, "events replay <app> [user] [failed] [after-sequence]")
+	if err != nil {
+		return err
+	}
+	path := "/_/admin/events/replay?" + query.Encode()
+	if flag_json || flag_tabs {
+		return post_dump(path, "replayed", "failed", "cursor")
+	}
+
+	resp, err := client().Post(path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+	if flag_verbose {
+		var payload struct {
+			Replayed int   `json:"replayed"`
+			Failed   int   `json:"failed"`
+			Cursor   int64 `json:"cursor"`
+		}
+		if json.Unmarshal(body, &payload) == nil {
+			fmt.Printf("Replayed %d (%d failed), cursor %d\n", payload.Replayed, payload.Failed, payload.Cursor)
+		}
+	}
+	return nil
+}
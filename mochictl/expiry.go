@@ -0,0 +1,102 @@
+// mochictl: expiry subcommand (certificate and key monitoring).
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl expiry [check]` -> GET /_/admin/expiry
+//   The certificates the server serves and when they expire, and how many
+//   passkeys are unused and entity keys old, from the last check or, with
+//   check, a new one.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// cmd_expiry handles `mochictl expiry [check]`, exiting non-zero if any
+// certificate is critical. With -j / -t the response is dumped raw.
+func cmd_expiry(args []string) error {
+	path := "/_/admin/expiry"
+	if len(args) > 0 {
+		if args[0] != "check" {
+			return fmt.Errorf("usage: expiry [check]")
+		}
+		path += "?check=true"
+	}
+	if flag_json || flag_tabs {
+		return get_dump(path, "checked", "certificates", "passkeys", "keys")
+	}
+
+	resp, err := client().Get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Checked      int64 `json:"checked"`
+		Certificates []struct {
+			Domain   string `json:"domain"`
+			Source   string `json:"source"`
+			Expires  int64  `json:"expires"`
+			Status   string `json:"status"`
+			Problem  string `json:"problem"`
+			Failures int    `json:"failures"`
+			Retry    int64  `json:"retry"`
+		} `json:"certificates"`
+		Passkeys struct {
+			Total int `json:"total"`
+			Stale int `json:"stale"`
+		} `json:"passkeys"`
+		Keys struct {
+			Total  int   `json:"total"`
+			Oldest int64 `json:"oldest"`
+			Old    int   `json:"old"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+
+	date := func(t int64) string {
+		if t == 0 {
+			return "-"
+		}
+		return time.Unix(t, 0).UTC().Format("2006-01-02 15:04")
+	}
+	fmt.Printf("Checked %s UTC\n\n", date(payload.Checked))
+	critical := 0
+	for _, c := range payload.Certificates {
+		line := fmt.Sprintf("%-40s  %-8s  %-16s  %s", c.Domain, c.Source, date(c.Expires), c.Status)
+		if c.Problem != "" {
+			line += ": " + c.Problem
+		}
+		if c.Failures > 0 {
+			line += fmt.Sprintf(" (%d failures, retry %s)", c.Failures, date(c.Retry))
+		}
+		fmt.Println(line)
+		if c.Status == "critical" {
+			critical++
+		}
+	}
+	if len(payload.Certificates) == 0 {
+		fmt.Println("No certificates")
+	}
+	fmt.Printf("\nPasskeys: %d, %d unused for a long time\n", payload.Passkeys.Total, payload.Passkeys.Stale)
+	fmt.Printf("Entity keys: %d, oldest created %s, %d old\n", payload.Keys.Total, date(payload.Keys.Oldest), payload.Keys.Old)
+	if critical > 0 {
+		return fmt.Errorf("%d certificates need attention", critical)
+	}
+	return nil
+}
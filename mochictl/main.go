@@ -123,6 +123,20 @@ func main() {
 			args = args[1:]
 		}
 	}
+	// Allow 'queue dead' and 'queue requeue' (dead letters).
+	if !ok && name == "queue" && len(args) > 0 {
+		if c, found := commands["queue "+args[0]]; found {
+			cmd, ok = c, true
+			args = args[1:]
+		}
+	}
+	// Allow 'events log' and 'events replay' (event replay).
+	if !ok && name == "events" && len(args) > 0 {
+		if c, found := commands["events "+args[0]]; found {
+			cmd, ok = c, true
+			args = args[1:]
+		}
+	}
 	// Allow 'check starlark' (pre-deploy parse validation).
 	if !ok && name == "check" && len(args) > 0 {
 		if c, found := commands["check "+args[0]]; found {
@@ -0,0 +1,87 @@
+// mochictl: maintenance subcommand.
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl maintenance` -> GET /_/admin/maintenance
+//   Whether the server is in maintenance mode, and how many events from
+//   other servers are held until it ends.
+// `mochictl maintenance on [message] | off` -> POST /_/admin/maintenance
+//   Turn it on, with a message for visitors, or off.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// cmd_maintenance handles `mochictl maintenance [on [message] | off]`. With
+// -j / -t the response is dumped raw.
+func cmd_maintenance(args []string) error {
+	path := "/_/admin/maintenance"
+	post := false
+	if len(args) > 0 {
+		query := url.Values{}
+		switch args[0] {
+		case "on":
+			query.Set("enabled", "true")
+			query.Set("message", strings.Join(args[1:], " "))
+		case "off":
+			query.Set("enabled", "false")
+		default:
+			return fmt.Errorf("usage: maintenance [on [message] | off]")
+		}
+		path += "?" + query.Encode()
+		post = true
+	}
+	if flag_json || flag_tabs {
+		if post {
+			return post_dump(path, "enabled", "since", "message", "held")
+		}
+		return get_dump(path, "enabled", "since", "message", "held")
+	}
+
+	var resp *http.Response
+	var err error
+	if post {
+		resp, err = client().Post(path, "", nil)
+	} else {
+		resp, err = client().Get(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Enabled bool   `json:"enabled"`
+		Since   int64  `json:"since"`
+		Message string `json:"message"`
+		Held    int64  `json:"held"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+	if !payload.Enabled {
+		fmt.Printf("Maintenance mode off, %d held events to release\n", payload.Held)
+		return nil
+	}
+	fmt.Printf("Maintenance mode on since %s UTC, %d events held\n", time.Unix(payload.Since, 0).UTC().Format("2006-01-02 15:04"), payload.Held)
+	if payload.Message != "" {
+		fmt.Printf("Message: %s\n", payload.Message)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// mochictl: peers subcommands (per-peer stream statistics).
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl peers stats` -> GET /_/admin/peers/stats
+//   Streams opened to each peer, failures, dials, smoothed handshake
+//   round trip, and whether its connection is kept warm.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// cmd_peers_stats handles `mochictl peers stats`.
+//
+// With -j / -t the response is dumped raw for scripted consumption.
+// Default output is a per-peer table, most recently used first.
+func cmd_peers_stats(args []string) error {
+	path := "/_/admin/peers/stats"
+	if flag_json || flag_tabs {
+		return get_dump(path, "peers")
+	}
+
+	resp, err := client().Get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Peers []struct {
+			Peer      string  `json:"peer"`
+			Connected bool    `json:"connected"`
+			Warm      bool    `json:"warm"`
+			Opens     int64   `json:"opens"`
+			Failures  int64   `json:"failures"`
+			Dials     int64   `json:"dials"`
+			RTT       float64 `json:"rtt"`
+			Used      int64   `json:"used"`
+		} `json:"peers"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+
+	fmt.Printf("%-52s  %-12s  %6s  %8s  %6s  %8s  %s\n", "PEER", "STATE", "OPENS", "FAILURES", "DIALS", "RTT", "LAST USED")
+	for _, p := range payload.Peers {
+		state := "disconnected"
+		if p.Warm {
+			state = "warm"
+		} else if p.Connected {
+			state = "connected"
+		}
+		rtt := "-"
+		if p.RTT > 0 {
+			rtt = fmt.Sprintf("%.1fms", p.RTT)
+		}
+		used := "never"
+		if p.Used > 0 {
+			used = time.Unix(p.Used, 0).Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-52s  %-12s  %6d  %8d  %6d  %8s  %s\n", p.Peer, state, p.Opens, p.Failures, p.Dials, rtt, used)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// mochictl: queue subcommands (dead letters).
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl queue dead [service]` -> GET /_/admin/queue/dead
+//   Direct messages the outbound queue gave up on, and why.
+// `mochictl queue requeue <id> | all [service]` -> POST /_/admin/queue/requeue
+//   Return them to the queue once the cause is fixed.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+)
+
+// cmd_queue_dead handles `mochictl queue dead [service]`. With -j / -t the
+// response is dumped raw.
+func cmd_queue_dead(args []string) error {
+	path := "/_/admin/queue/dead"
+	if len(args) > 0 && args[0] != "" {
+		path += "?" + url.Values{"service": {args[0]}}.Encode()
+	}
+	if flag_json || flag_tabs {
+		return get_dump(path, "total", "rows")
+	}
+
+	resp, err := client().Get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Rows []struct {
+			ID       string `json:"id"`
+			To       string `json:"to"`
+			Service  string `json:"service"`
+			Event    string `json:"event"`
+			Attempts int    `json:"attempts"`
+			Error    string `json:"error"`
+			Reason   string `json:"reason"`
+			Died     int64  `json:"died"`
+		} `json:"rows"`
+		Total int64 `json:"total"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+	if len(payload.Rows) == 0 {
+		if flag_verbose {
+			fmt.Println("No dead letters")
+		}
+		return nil
+	}
+
+	fmt.Printf("%-32s  %-16s  %-24s  %-10s  %8s  %-19s  %s\n", "ID", "SERVICE", "EVENT", "REASON", "ATTEMPTS", "DIED", "ERROR")
+	for _, r := range payload.Rows {
+		died := time.Unix(r.Died, 0).Format("2006-01-02 15:04:05")
+		fmt.Printf("%-32s  %-16s  %-24s  %-10s  %8d  %-19s  %s\n", r.ID, r.Service, r.Event, r.Reason, r.Attempts, died, r.Error)
+	}
+	if payload.Total > int64(len(payload.Rows)) {
+		fmt.Printf("(%d of %d shown)\n", len(payload.Rows), payload.Total)
+	}
+	return nil
+}
+
+// cmd_queue_requeue handles `mochictl queue requeue <id> | all [service]`.
+// Prints the number requeued with -v.
+func cmd_queue_requeue(args []string) error {
+	if len(args) == 0 || args[0] == "" {
+		return fmt.Errorf("usage: queue requeue <id> | all [service]")
+	}
+	query := url.Values{}
+	if args[0] == "all" {
+		query.Set("all", "true")
+		if len(args) > 1 && args[1] != "" {
+			query.Set("service", args[1])
+		}
+	} else {
+		query.Set("id", args[0])
+	}
+	path := "/_/admin/queue/requeue?" + query.Encode()
+	if flag_json || flag_tabs {
+		return post_dump(path, "requeued")
+	}
+
+	resp, err := client().Post(path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+	if flag_verbose {
+		var payload struct {
+			Requeued int `json:"requeued"`
+		}
+		if json.Unmarshal(body, &payload) == nil {
+			fmt.Printf("Requeued %d\n", payload.Requeued)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// mochictl: transfer subcommand (network transfer accounting).
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// `mochictl transfer [peer|app|user] [YYYY-MM]` -> GET /_/admin/transfer
+//   Bytes sent and received over P2P streams in a month, grouped by peer
+//   (default), app or user, with the monthly budget if one is set.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// cmd_transfer handles `mochictl transfer [by] [month]`. Arguments may come
+// in either order; a YYYY-MM argument is the month, anything else the
+// grouping. With -j / -t the response is dumped raw.
+func cmd_transfer(args []string) error {
+	query := url.Values{}
+	for _, a := range args {
+		if strings.Contains(a, "-") {
+			query.Set("month", a)
+		} else if a != "" {
+			query.Set("by", a)
+		}
+	}
+	path := "/_/admin/transfer"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	if flag_json || flag_tabs {
+		return get_dump(path, "month", "used", "cap", "paused", "rows")
+	}
+
+	resp, err := client().Get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return http_error(resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Month string `json:"month"`
+		Rows  []struct {
+			Peer     string `json:"peer"`
+			App      string `json:"app"`
+			User     string `json:"user"`
+			Sent     int64  `json:"sent"`
+			Received int64  `json:"received"`
+		} `json:"rows"`
+		Cap    int64 `json:"cap"`
+		Used   int64 `json:"used"`
+		Paused bool  `json:"paused"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+
+	budget := "no budget"
+	if payload.Cap > 0 {
+		budget = fmt.Sprintf("budget %s", transfer_size(payload.Cap))
+		if payload.Paused {
+			budget += ", low-priority sync paused"
+		}
+	}
+	fmt.Printf("%s: %s used, %s\n", payload.Month, transfer_size(payload.Used), budget)
+	if len(payload.Rows) == 0 {
+		return nil
+	}
+
+	fmt.Printf("%-52s  %10s  %10s\n", "NAME", "SENT", "RECEIVED")
+	for _, r := range payload.Rows {
+		name := r.Peer + r.App + r.User
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Printf("%-52s  %10s  %10s\n", name, transfer_size(r.Sent), transfer_size(r.Received))
+	}
+	return nil
+}
+
+// transfer_size formats a byte count for the transfer table
+func transfer_size(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
@@ -4,12 +4,17 @@
 // This file is part of Mochi, licensed under the GNU AGPL v3 with the
 // Mochi Application Interface Exception - see license.txt and license-exception.md.
 
-/* Resolution order, first match wins:
+/* Resources are hierarchical: a rule on repo/x applies to repo/x/branches/y
+unless a rule on repo/x/branches/y or repo/x/branches says otherwise. The most
+specific resource with a matching rule decides, then the exact operation before
+"*", then subjects in this order, first match wins:
 	1. User's ID
 	2. User's groups, @groupname, recursively
-	3. User's role, #administrator or #user
-	4. Authenticated (+)
-	5. Anonymous (*), including not logged in
+	3. Group entities the user is a member of, most senior role first:
+	   @entity:administrator matches administrators and above, @entity any member
+	4. User's role, #administrator or #user
+	5. Authenticated (+)
+	6. Anonymous (*), including not logged in
 Deny has priority over allow */
 
 package main
@@ -20,18 +25,15 @@ import (
 	"strings"
 )
 
-type Access struct {
-	Grant int
-}
-
 var api_access = sls.FromStringDict(sl.String("mochi.access"), sl.StringDict{
 	"allow": sl.NewBuiltin("mochi.access.allow", api_access_allow),
 	"clear": sls.FromStringDict(sl.String("mochi.access.clear"), sl.StringDict{
 		"resource": sl.NewBuiltin("mochi.access.clear.resource", api_access_clear_resource),
 		"subject":  sl.NewBuiltin("mochi.access.clear.subject", api_access_clear_subject),
 	}),
-	"check": sl.NewBuiltin("mochi.access.check", api_access_check),
-	"deny":  sl.NewBuiltin("mochi.access.deny", api_access_deny),
+	"check":   sl.NewBuiltin("mochi.access.check", api_access_check),
+	"deny":    sl.NewBuiltin("mochi.access.deny", api_access_deny),
+	"explain": sl.NewBuiltin("mochi.access.explain", api_access_explain),
 	"list": sls.FromStringDict(sl.String("mochi.access.list"), sl.StringDict{
 		"resource": sl.NewBuiltin("mochi.access.list.resource", api_access_list_resource),
 		"subject":  sl.NewBuiltin("mochi.access.list.subject", api_access_list_subject),
@@ -51,21 +53,28 @@ func (db *DB) access_upsert(subject string, resource string, operation string, g
 	db.exec("insert into access ( subject, resource, operation, grant, granter, created ) values ( ?, ?, ?, ?, ?, ? ) on conflict ( subject, resource, operation ) do update set grant=excluded.grant, granter=excluded.granter, created=excluded.created", subject, resource, operation, grant, granter, now())
 }
 
-// Check if a user has access to perform an operation on a resource
-// owner is the user whose user.db contains the groups
-func (db *DB) access_check(owner *User, user string, role string, resource string, operation string) bool {
-	db.access_setup() // Ensure table exists
+// access_decision is the outcome of resolving an access check, and the rule
+// that decided it
+type access_decision struct {
+	allowed   bool
+	rule      map[string]any // nil if no rule matched
+	resources []string
+	subjects  []string
+}
 
-	// Get resource hierarchy
+// access_resources returns a resource and its ancestors, most specific first
+func access_resources(resource string) []string {
 	var resources []string
 	parts := strings.Split(resource, "/")
 	for i := len(parts); i > 0; i-- {
 		resources = append(resources, strings.Join(parts[:i], "/"))
 	}
+	return resources
+}
 
-	operations := []string{operation, "*"}
-
-	// Build subject list in priority order
+// access_subjects returns the subjects a user matches, in priority order.
+// owner is the user whose user.db contains the groups.
+func access_subjects(owner *User, user string, role string) []string {
 	var subjects []string
 	if user != "" {
 		subjects = append(subjects, user)
@@ -78,6 +87,19 @@ func (db *DB) access_check(owner *User, user string, role string, resource strin
 			}
 		}
 
+		// Group entity memberships, each role at or below the member's
+		rows, _ := groups_db().rows("select group_entity, role from members where member=? and status='member' order by group_entity", user)
+		for _, r := range rows {
+			group, _ := r["group_entity"].(string)
+			held, _ := r["role"].(string)
+			for _, name := range []string{"owner", "administrator", "moderator", "member"} {
+				if group_roles[name] <= group_roles[held] {
+					subjects = append(subjects, "@"+group+":"+name)
+				}
+			}
+			subjects = append(subjects, "@"+group)
+		}
+
 		if role == "administrator" {
 			subjects = append(subjects, "#administrator")
 		}
@@ -88,24 +110,42 @@ func (db *DB) access_check(owner *User, user string, role string, resource strin
 		subjects = append(subjects, "+")
 	}
 
-	subjects = append(subjects, "*")
+	return append(subjects, "*")
+}
+
+// access_resolve finds the rule that decides whether a user may perform an
+// operation on a resource
+func (db *DB) access_resolve(owner *User, user string, role string, resource string, operation string) access_decision {
+	db.access_setup() // Ensure table exists
+
+	d := access_decision{resources: access_resources(resource), subjects: access_subjects(owner, user, role)}
+	operations := []string{operation, "*"}
 
 	// Check from most specific resource to least
-	for _, res := range resources {
+	for _, res := range d.resources {
 		for _, act := range operations {
-			for _, subj := range subjects {
-				var a Access
-				if db.scan(&a, "select grant from access where subject=? and resource=? and operation=?", subj, res, act) {
-					if a.Grant != 1 {
-						audit_access_denied(user, resource, operation)
-					}
-					return a.Grant == 1
+			for _, subj := range d.subjects {
+				row, _ := db.row("select subject, resource, operation, grant, granter, created from access where subject=? and resource=? and operation=?", subj, res, act)
+				if row != nil {
+					d.rule = row
+					d.allowed = event_int64(row["grant"]) == 1
+					return d
 				}
 			}
 		}
 	}
 
-	return false
+	return d
+}
+
+// Check if a user has access to perform an operation on a resource
+// owner is the user whose user.db contains the groups
+func (db *DB) access_check(owner *User, user string, role string, resource string, operation string) bool {
+	d := db.access_resolve(owner, user, role, resource, operation)
+	if d.rule != nil && !d.allowed {
+		audit_access_denied(user, resource, operation)
+	}
+	return d.allowed
 }
 
 // Grant or deny access
@@ -397,3 +437,54 @@ func api_access_list_subject(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 	}
 	return sl_encode(rows), nil
 }
+
+// mochi.access.explain(resource, subject, operation?) -> dict: Explain an access
+// check: {allowed, rule, resources, subjects}, where rule is the rule that
+// decided it or None, resources the resource and its ancestors searched, and
+// subjects those the user matched, in the order they were tried. subject is a
+// user's entity ID, or None for an anonymous user. operation defaults to "*".
+func api_access_explain(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var resource string
+	var subject sl.Value = sl.None
+	operation := "*"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "resource", &resource, "subject", &subject, "operation?", &operation); err != nil {
+		return nil, err
+	}
+	if resource == "" {
+		return sl_error(fn, "invalid resource")
+	}
+	if operation == "" {
+		return sl_error(fn, "invalid operation")
+	}
+	user := ""
+	if subject != sl.None {
+		var ok bool
+		user, ok = sl.AsString(subject)
+		if !ok || user == "*" || user == "+" || strings.HasPrefix(user, "#") || strings.HasPrefix(user, "@") {
+			return sl_error(fn, "invalid subject")
+		}
+	}
+
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+	owner, _ := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+
+	role := ""
+	if user != "" {
+		if u := user_by_identity(user); u != nil {
+			role = u.Role
+		}
+	}
+
+	d := db_app_system(owner, app).access_resolve(owner, user, role, resource, operation)
+	var rule any
+	if d.rule != nil {
+		rule = d.rule
+	}
+	return sl_encode(map[string]any{"allowed": d.allowed, "rule": rule, "resources": d.resources, "subjects": d.subjects}), nil
+}
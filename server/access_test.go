@@ -0,0 +1,93 @@
+// Mochi server: Access control tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+)
+
+const (
+	access_test_user  = "1AccessTestUserEntityXXXXXXXXXXXXXXXXXXXXXXXXXXXX"
+	access_test_group = "1AccessTestGroupEntityXXXXXXXXXXXXXXXXXXXXXXXXXXX"
+)
+
+func access_test_db(t *testing.T) *DB {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	return db_open("db/access-test.db")
+}
+
+func TestAccessInheritance(t *testing.T) {
+	db := access_test_db(t)
+	db.access_set("+", "repo/x", "read", true, "")
+	if !db.access_check(nil, access_test_user, "", "repo/x/branches/y", "read") {
+		t.Error("rule on repo/x not inherited by repo/x/branches/y")
+	}
+	if db.access_check(nil, "", "", "repo/x/branches/y", "read") {
+		t.Error("authenticated rule allowed an anonymous user")
+	}
+
+	// A more specific deny overrides the inherited allow
+	db.access_set(access_test_user, "repo/x/branches", "*", false, "")
+	if db.access_check(nil, access_test_user, "", "repo/x/branches/y", "read") {
+		t.Error("deny on repo/x/branches did not override allow on repo/x")
+	}
+	if !db.access_check(nil, access_test_user, "", "repo/x/tags/v1", "read") {
+		t.Error("deny on branches leaked to tags")
+	}
+}
+
+func TestAccessGroupEntitySubjects(t *testing.T) {
+	db := access_test_db(t)
+	db.access_set("@"+access_test_group+":moderator", "forum", "moderate", true, "")
+	db.access_set("@"+access_test_group, "forum", "post", true, "")
+
+	if db.access_check(nil, access_test_user, "", "forum", "post") {
+		t.Fatal("non-member allowed")
+	}
+	group_member_store(&Membership{Group: access_test_group, Member: access_test_user, Role: "member", Status: "member", Updated: 1})
+	if !db.access_check(nil, access_test_user, "", "forum", "post") {
+		t.Error("member not matched by @group")
+	}
+	if db.access_check(nil, access_test_user, "", "forum", "moderate") {
+		t.Error("member matched @group:moderator")
+	}
+	group_member_store(&Membership{Group: access_test_group, Member: access_test_user, Role: "administrator", Status: "member", Updated: 2})
+	if !db.access_check(nil, access_test_user, "", "forum", "moderate") {
+		t.Error("administrator not matched by @group:moderator")
+	}
+	group_member_store(&Membership{Group: access_test_group, Member: access_test_user, Role: "administrator", Status: "removed", Updated: 3})
+	if db.access_check(nil, access_test_user, "", "forum", "post") {
+		t.Error("removed member still matched")
+	}
+}
+
+func TestAccessExplain(t *testing.T) {
+	db := access_test_db(t)
+	db.access_set("*", "repo", "read", true, "owner")
+	d := db.access_resolve(nil, access_test_user, "user", "repo/x", "read")
+	if !d.allowed || d.rule == nil || d.rule["resource"] != "repo" || d.rule["subject"] != "*" {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+	if len(d.resources) != 2 || d.resources[0] != "repo/x" {
+		t.Errorf("resources %v", d.resources)
+	}
+	want := []string{access_test_user, "#user", "+", "*"}
+	if len(d.subjects) != len(want) {
+		t.Fatalf("subjects %v, want %v", d.subjects, want)
+	}
+	for i := range want {
+		if d.subjects[i] != want[i] {
+			t.Errorf("subjects %v, want %v", d.subjects, want)
+			break
+		}
+	}
+	if d := db.access_resolve(nil, access_test_user, "", "other", "read"); d.allowed || d.rule != nil {
+		t.Errorf("no rule should deny with no rule: %+v", d)
+	}
+}
@@ -19,7 +19,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"html"
 	"io"
 	"net/http"
 	"strings"
@@ -934,51 +933,21 @@ func api_account_verify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 	return sl.True, nil
 }
 
-// account_send_verification_email sends a styled HTML email with a verification
+// account_send_verification_email sends a templated email with a verification
 // code, localised to the given language (BCP 47 tag) via the core label
 // resolver's fallback chain.
 func account_send_verification_email(to string, code string, language string) {
-	subject := resolve_core_label(language, "email.verification.subject", nil)
-	heading := resolve_core_label(language, "email.verification.heading", nil)
-	tagline := resolve_core_label(language, "email.verification.tagline", nil)
 	expiry := resolve_core_label(language, "email.verification.expiry", nil)
 	ignore := resolve_core_label(language, "email.verification.ignore", nil)
-	html_body := `<!DOCTYPE html>
-<html>
-<head>
-  <meta charset="utf-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-</head>
-<body style="margin: 0; padding: 0; background-color: #f4f4f5; font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;">
-  <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="min-height: 100vh;">
-    <tr>
-      <td align="center" style="padding: 40px 20px;">
-        <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="max-width: 440px; background-color: #ffffff; border-radius: 12px; box-shadow: 0 2px 8px rgba(0, 0, 0, 0.08);">
-          <tr>
-            <td style="padding: 40px 40px 32px 40px; text-align: center;">
-              <h1 style="margin: 0 0 8px 0; font-size: 24px; font-weight: 600; color: #18181b;">` + html.EscapeString(heading) + `</h1>
-              <p style="margin: 0; font-size: 15px; color: #71717a;">` + html.EscapeString(tagline) + `</p>
-            </td>
-          </tr>
-          <tr>
-            <td style="padding: 0 40px;">
-              <div style="background-color: #f4f4f5; border-radius: 8px; padding: 24px; text-align: center;">
-                <span style="font-family: 'SF Mono', Monaco, 'Cascadia Code', monospace; font-size: 32px; font-weight: 600; letter-spacing: 4px; color: #18181b;">` + html.EscapeString(code) + `</span>
-              </div>
-            </td>
-          </tr>
-          <tr>
-            <td style="padding: 32px 40px 40px 40px; text-align: center;">
-              <p style="margin: 0; font-size: 14px; color: #a1a1aa;">` + html.EscapeString(expiry+". "+ignore) + `</p>
-            </td>
-          </tr>
-        </table>
-      </td>
-    </tr>
-  </table>
-</body>
-</html>`
-	email_send_html(to, subject, html_body)
+	email_send_message(to, EmailMessage{
+		Language: language,
+		Subject:  resolve_core_label(language, "email.verification.subject", nil),
+		Heading:  resolve_core_label(language, "email.verification.heading", nil),
+		Tagline:  resolve_core_label(language, "email.verification.tagline", nil),
+		Code:     code,
+		Footer:   expiry + ". " + ignore,
+		Required: true,
+	})
 }
 
 // AccountTestResult represents the result of testing an account
@@ -1115,33 +1084,12 @@ func api_account_test(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.T
 // account_test_email sends a test email, localised to the recipient user's
 // language preference via the core label resolver.
 func account_test_email(address string, language string, account_label string) AccountTestResult {
-	subject := resolve_core_label(language, "email.test.subject", nil)
-	heading := resolve_core_label(language, "email.test.heading", nil)
-	body := resolve_core_label(language, "email.test.body", map[string]any{"account": account_label})
-	html_body := `<!DOCTYPE html>
-<html>
-<head>
-  <meta charset="utf-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-</head>
-<body style="margin: 0; padding: 0; background-color: #f4f4f5; font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;">
-  <table role="presentation" width="100%" cellspacing="0" cellpadding="0">
-    <tr>
-      <td align="center" style="padding: 20px;">
-        <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="max-width: 440px; background-color: #ffffff; border-radius: 12px; box-shadow: 0 2px 8px rgba(0, 0, 0, 0.08);">
-          <tr>
-            <td style="padding: 40px; text-align: center;">
-              <h1 style="margin: 0 0 12px 0; font-size: 24px; font-weight: 600; color: #18181b;">` + html.EscapeString(heading) + `</h1>
-              <p style="margin: 0; font-size: 15px; color: #52525b;">` + html.EscapeString(body) + `</p>
-            </td>
-          </tr>
-        </table>
-      </td>
-    </tr>
-  </table>
-</body>
-</html>`
-	email_send_html(address, subject, html_body)
+	email_send_message(address, EmailMessage{
+		Language: language,
+		Subject:  resolve_core_label(language, "email.test.subject", nil),
+		Heading:  resolve_core_label(language, "email.test.heading", nil),
+		Tagline:  resolve_core_label(language, "email.test.body", map[string]any{"account": account_label}),
+	})
 	return AccountTestResult{Success: true, Message: "Test email sent"}
 }
 
@@ -1255,7 +1203,7 @@ func account_test_unifiedpush(data map[string]any, language string, account_labe
 // UNREGISTERED / INVALID_ARGUMENT) so the caller can drop it — same
 // semantics as the production-push path in api_account_notify.
 func account_test_fcm(data map[string]any, language string, account_label string) (AccountTestResult, bool) {
-	if setting_get("fcm.service_account", "") == "" {
+	if fcm_credentials() == "" {
 		return AccountTestResult{Success: false, Message: "FCM not configured"}, false
 	}
 	title := resolve_core_label(language, "push.test.title", nil)
@@ -1412,7 +1360,7 @@ func account_test_mcp(url, token string) AccountTestResult {
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := url_client(10 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
 		return AccountTestResult{Success: false, Message: "Connection failed: " + err.Error()}
@@ -1462,7 +1410,7 @@ func account_test_ntfy(server, topic, token string, language string, account_lab
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := url_client(10 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
 		return AccountTestResult{Success: false, Message: "Connection failed: " + err.Error()}
@@ -1501,7 +1449,7 @@ func account_test_url(url, secret string) AccountTestResult {
 		req.Header.Set("X-Mochi-Signature", signature)
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := url_client(10 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
 		return AccountTestResult{Success: false, Message: "Connection failed: " + err.Error()}
@@ -1553,6 +1501,21 @@ func api_account_notify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 		return nil, err
 	}
 
+	sent, failed, err := account_notify(user, app, category, object, title, body, link, account, id)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+
+	return sl_encode(map[string]any{
+		"sent":   sent,
+		"failed": failed,
+	}), nil
+}
+
+// account_notify delivers one notification to the user's verified accounts
+// with the notify capability, or only to the given account, returning how
+// many deliveries succeeded and failed
+func account_notify(user *User, app, category, object, title, body, link, account, id string) (int, int, error) {
 	db := db_user(user, "user")
 
 	// Opportunistic TTL: drop unifiedpush rows that haven't been delivered
@@ -1577,7 +1540,7 @@ func api_account_notify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 		rows, err = db.rows("select id, type, identifier, data from accounts where verified > 0")
 	}
 	if err != nil {
-		return sl_error(fn, "database error: %v", err)
+		return 0, 0, err
 	}
 
 	sent := 0
@@ -1605,7 +1568,7 @@ func api_account_notify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 		case "browser":
 			success = account_deliver_browser(data, title, body, link, app+"-"+category+"-"+object)
 		case "email":
-			success = account_deliver_email(identifier, title, body, link)
+			success = account_deliver_email(identifier, title, body, link, user_language(user))
 		case "pushbullet":
 			token, _ := data["token"].(string)
 			success = account_deliver_pushbullet(token, title, body, link)
@@ -1654,10 +1617,7 @@ func api_account_notify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 		}
 	}
 
-	return sl_encode(map[string]any{
-		"sent":   sent,
-		"failed": failed,
-	}), nil
+	return sent, failed, nil
 }
 
 // account_deliver_browser sends a push notification to a browser
@@ -1695,7 +1655,7 @@ func account_deliver_browser(data map[string]any, title, body, link, tag string)
 		// http.Client with no timeout; a hanging push endpoint then
 		// blocks the notifications commit hook until the Starlark
 		// execution cap kills it (and the caller's service.call with it).
-		HTTPClient:      &http.Client{Timeout: 15 * time.Second},
+		HTTPClient:      url_client(15 * time.Second),
 		Subscriber:      "mailto:webpush@localhost",
 		VAPIDPublicKey:  webpush_public,
 		VAPIDPrivateKey: webpush_private,
@@ -1778,7 +1738,7 @@ func account_deliver_unifiedpush(user *User, accountID string, data map[string]a
 
 	resp, err := webpush.SendNotification(payload, &sub, &webpush.Options{
 		// Bounded client for the same reason as account_deliver_browser.
-		HTTPClient:      &http.Client{Timeout: 15 * time.Second},
+		HTTPClient:      url_client(15 * time.Second),
 		Subscriber:      "mailto:webpush@localhost",
 		VAPIDPublicKey:  webpush_public,
 		VAPIDPrivateKey: webpush_private,
@@ -1795,34 +1755,15 @@ func account_deliver_unifiedpush(user *User, accountID string, data map[string]a
 }
 
 // account_deliver_email sends a notification via email
-func account_deliver_email(address, title, body, link string) bool {
-	text := title + "\n\n" + body
-	escaped_title := html.EscapeString(title)
-	escaped_body := html.EscapeString(body)
-	markup := `<!DOCTYPE html>
-<html>
-<head>
-  <meta charset="utf-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-</head>
-<body style="margin: 0; padding: 0; background-color: #f4f4f5; font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;">
-  <table role="presentation" width="100%" cellspacing="0" cellpadding="0">
-    <tr>
-      <td align="center" style="padding: 20px;">
-        <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="max-width: 440px; background-color: #ffffff; border-radius: 12px; box-shadow: 0 2px 8px rgba(0, 0, 0, 0.08);">
-          <tr>
-            <td style="padding: 32px 40px;">
-              <h1 style="margin: 0 0 16px 0; font-size: 18px; font-weight: 600; color: #18181b;">` + escaped_title + `</h1>
-              <p style="margin: 0; font-size: 15px; color: #3f3f46; line-height: 1.5;">` + escaped_body + `</p>
-            </td>
-          </tr>
-        </table>
-      </td>
-    </tr>
-  </table>
-</body>
-</html>`
-	email_send_multipart(address, title, text, markup)
+func account_deliver_email(address, title, body, link, language string) bool {
+	email_send_message(address, EmailMessage{
+		Language: language,
+		Subject:  title,
+		Heading:  title,
+		Body:     body,
+		Button:   resolve_core_label(language, "email.notification.button", nil),
+		Link:     link,
+	})
 	return true
 }
 
@@ -1874,7 +1815,7 @@ func account_deliver_ntfy(server, topic, token, title, body, link string) bool {
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := url_client(10 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
 		return false
@@ -1911,7 +1852,7 @@ func account_deliver_url(url, secret, app, category, object, title, body, link s
 		req.Header.Set("X-Mochi-Signature", signature)
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := url_client(10 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
 		return false
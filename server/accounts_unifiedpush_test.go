@@ -102,6 +102,7 @@ func TestUnifiedPushDeliverLocalFastPath(t *testing.T) {
 // TestUnifiedPushDeliverRemote verifies that an absolute endpoint URL
 // (third-party distributor like ntfy.sh) routes via RFC 8030 Web Push.
 func TestUnifiedPushDeliverRemote(t *testing.T) {
+	allow_private_for_test(t)
 	var hits int32
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		atomic.AddInt32(&hits, 1)
@@ -133,6 +134,7 @@ func TestUnifiedPushDeliverRemote(t *testing.T) {
 // "subscription dead" response from RFC 8030 push services) returns false,
 // so the caller's outer loop drops the account row.
 func TestUnifiedPushDeliverRemoteGone(t *testing.T) {
+	allow_private_for_test(t)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusGone)
 	}))
@@ -183,6 +185,7 @@ func TestUnifiedPushDeliverEmptyEndpoint(t *testing.T) {
 // not some hardcoded URL or default. Catches a regression where the path
 // logic accidentally rewrites foreign endpoints.
 func TestUnifiedPushDeliverRoutesToStoredEndpoint(t *testing.T) {
+	allow_private_for_test(t)
 	expected_host := ""
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Capture the host so the test can assert the request landed at our
@@ -0,0 +1,43 @@
+// Mochi server: Per-action concurrency limits
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Actions declaring "concurrency" in app.json get a counting semaphore per
+// app version and action, held from dispatch until the call's work ends:
+// a call abandoned at its timeout keeps its slot until it winds down. The
+// acquire never waits: a slow action at its cap would otherwise pile up
+// blocked Gin workers behind it, which is exactly what the cap is for.
+// The cap is part of the key so a manifest reloaded in development with a
+// new cap gets a fresh semaphore.
+var action_limits sync.Map // app id / version / action / cap -> chan struct{}
+
+// action_acquire takes a slot for an action, returning a release function,
+// or false if the action is already at its cap. Actions without a cap always
+// succeed.
+func action_acquire(av *AppVersion, aa *AppAction) (func(), bool) {
+	if aa.Concurrency <= 0 {
+		return func() {}, true
+	}
+	app := ""
+	if av.app != nil {
+		app = av.app.id
+	}
+	key := fmt.Sprintf("%s/%s/%s/%d", app, av.Version, aa.name, aa.Concurrency)
+	v, _ := action_limits.LoadOrStore(key, make(chan struct{}, aa.Concurrency))
+	slots := v.(chan struct{})
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,131 @@
+// Mochi server: Per-action concurrency limit and deadline tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestActionAcquire(t *testing.T) {
+	av := &AppVersion{Version: "1"}
+	aa := &AppAction{name: "slow", Concurrency: 2}
+
+	first, ok := action_acquire(av, aa)
+	if !ok {
+		t.Fatal("first call refused")
+	}
+	second, ok := action_acquire(av, aa)
+	if !ok {
+		t.Fatal("second call refused")
+	}
+	if _, ok := action_acquire(av, aa); ok {
+		t.Fatal("call over the cap was admitted")
+	}
+	first()
+	third, ok := action_acquire(av, aa)
+	if !ok {
+		t.Fatal("released slot was not reusable")
+	}
+	second()
+	third()
+
+	// Actions without a cap are never refused
+	free := &AppAction{name: "fast"}
+	for i := 0; i < 100; i++ {
+		if _, ok := action_acquire(av, free); !ok {
+			t.Fatal("uncapped action refused")
+		}
+	}
+}
+
+func TestStarlarkCallTimeout(t *testing.T) {
+	// Set up the runtime state as starlark_configure would, and leave it set
+	// for later tests that check only the semaphore
+	if starlark_sem == nil {
+		starlark_sem = make(chan struct{}, 32)
+		starlark_default_timeout = 90 * time.Second
+	}
+
+	s := &Starlark{thread: &sl.Thread{Name: "test"}, globals: sl.StringDict{}}
+	globals, err := sl.ExecFile(s.thread, "test.star", "def spin():\n    for i in range(1 << 40):\n        pass\n", s.globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.globals = globals
+	s.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err = s.call("spin", nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("per-call timeout ignored: took %v", elapsed)
+	}
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("expected TimeoutError, got %v", err)
+	}
+	if timeout.After != 100*time.Millisecond {
+		t.Errorf("timeout reported as %v", timeout.After)
+	}
+}
+
+func TestStarlarkCallFinished(t *testing.T) {
+	if starlark_sem == nil {
+		starlark_sem = make(chan struct{}, 32)
+		starlark_default_timeout = 90 * time.Second
+	}
+
+	// A builtin that ignores cancellation keeps the call running past its
+	// timeout, after call has given up on it
+	unblock := make(chan struct{})
+	block := sl.NewBuiltin("block", func(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+		<-unblock
+		return sl.None, nil
+	})
+	s := &Starlark{thread: &sl.Thread{Name: "test"}, globals: sl.StringDict{}}
+	globals, err := sl.ExecFile(s.thread, "test.star", "def wait():\n    block()\n", sl.StringDict{"block": block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.globals = globals
+	s.timeout = 50 * time.Millisecond
+
+	finished := make(chan struct{})
+	s.finished = func() { close(finished) }
+	if _, err := s.call("wait", nil); err == nil {
+		t.Fatal("blocked call did not time out")
+	}
+	select {
+	case <-finished:
+		t.Fatal("finished ran while the abandoned call was still running")
+	default:
+	}
+	close(unblock)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("finished did not run once the call ended")
+	}
+}
+
+func TestStarlarkRemaining(t *testing.T) {
+	thread := &sl.Thread{}
+	if d := starlark_remaining(thread); d != 0 {
+		t.Errorf("thread without deadline gave %v", d)
+	}
+	thread.SetLocal("deadline", time.Now().Add(time.Minute))
+	if d := starlark_remaining(thread); d <= 0 || d > time.Minute {
+		t.Errorf("remaining %v outside (0, 1m]", d)
+	}
+	thread.SetLocal("deadline", time.Now().Add(-time.Minute))
+	if d := starlark_remaining(thread); d <= 0 {
+		t.Errorf("passed deadline gave %v, want a small positive duration", d)
+	}
+}
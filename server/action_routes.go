@@ -0,0 +1,224 @@
+// Mochi server: Action route tables
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// An app version's actions are compiled into a route table when it is loaded
+// or reloaded, rather than split and sorted on every request. The table holds
+// each pattern's segments in precedence order: files and feature routes
+// first, then those with more segments, then those with more literal
+// segments, then by name so that the order never depends on map iteration.
+// A request is split once and checked against the routes in that order; the
+// first to match wins, and "" catches anything none does.
+//
+// In a pattern, a segment starting with ":" matches any one segment and a
+// segment starting with "*" matches one or more, with any segments after it
+// matched from the end of the path. A files or feature route also matches
+// any path below it, the rest of the path becoming its file path.
+//
+// Two patterns of the same precedence that can match the same path are a
+// conflict, since which one handles it would be arbitrary. Installing an app
+// with conflicting actions fails; an app already installed with them loads,
+// with a warning, and the earlier by name wins.
+
+// action_route is one compiled action pattern
+type action_route struct {
+	name     string
+	action   AppAction
+	segments []string
+	special  bool // Files or feature route
+	greedy   int  // Position of the greedy segment, or -1
+	literals int
+}
+
+// action_routes is an app version's compiled actions
+type action_routes struct {
+	routes   []*action_route // In precedence order
+	fallback *action_route   // The "" action, if any
+}
+
+// action_routes_compile builds the route table for a set of actions
+func action_routes_compile(actions map[string]AppAction) *action_routes {
+	r := &action_routes{routes: make([]*action_route, 0, len(actions))}
+	for name, aa := range actions {
+		ar := &action_route{name: name, action: aa, segments: strings.Split(name, "/"), special: aa.Files != "" || aa.Feature != "", greedy: -1}
+		for i, s := range ar.segments {
+			if strings.HasPrefix(s, "*") {
+				if ar.greedy < 0 {
+					ar.greedy = i
+				}
+			} else if !strings.HasPrefix(s, ":") {
+				ar.literals++
+			}
+		}
+		ar.action.name = name
+		r.routes = append(r.routes, ar)
+		if name == "" {
+			r.fallback = ar
+		}
+	}
+
+	sort.Slice(r.routes, func(i, j int) bool {
+		a, b := r.routes[i], r.routes[j]
+		if a.special != b.special {
+			return a.special
+		} else if len(a.segments) != len(b.segments) {
+			return len(a.segments) > len(b.segments)
+		} else if a.literals != b.literals {
+			return a.literals > b.literals
+		}
+		return a.name < b.name
+	})
+	return r
+}
+
+// find returns a copy of the action best matching a name, with its
+// parameters and file path filled in, or nil if none does
+func (r *action_routes) find(name string) *AppAction {
+	var values []string
+	for _, ar := range r.routes {
+		if ar.name == name {
+			aa := ar.action
+			return &aa
+		}
+		if values == nil {
+			values = strings.Split(name, "/")
+		}
+		if aa := ar.match(values); aa != nil {
+			return aa
+		}
+	}
+
+	if r.fallback != nil {
+		aa := r.fallback.action
+		return &aa
+	}
+	return nil
+}
+
+// match checks a route against a path's segments
+func (ar *action_route) match(values []string) *AppAction {
+	n := len(ar.segments)
+
+	// Files and feature routes match their pattern as a prefix of the path,
+	// if the rest of it can only name something below the route
+	if ar.special && n <= len(values) && action_segments_match(ar.segments, values[:n]) {
+		if !action_filepath_valid(values[n:]) {
+			return nil
+		}
+		aa := ar.action
+		aa.parameters = action_segments_bind(ar.segments, values[:n], nil)
+		aa.filepath = strings.Join(values[n:], "/")
+		return &aa
+	}
+
+	if ar.greedy < 0 {
+		if n != len(values) || !action_segments_match(ar.segments, values) {
+			return nil
+		}
+		aa := ar.action
+		aa.parameters = action_segments_bind(ar.segments, values, nil)
+		return &aa
+	}
+
+	// The greedy segment takes everything between the segments before it and
+	// those after it, which are matched from the end
+	if len(values) < n {
+		return nil
+	}
+	suffix := n - ar.greedy - 1
+	end := len(values) - suffix
+	if !action_segments_match(ar.segments[:ar.greedy], values[:ar.greedy]) || !action_segments_match(ar.segments[ar.greedy+1:], values[end:]) {
+		return nil
+	}
+	aa := ar.action
+	p := action_segments_bind(ar.segments[:ar.greedy], values[:ar.greedy], nil)
+	p = action_segments_bind(ar.segments[ar.greedy+1:], values[end:], p)
+	if p == nil {
+		p = map[string]string{}
+	}
+	p[ar.segments[ar.greedy][1:]] = strings.Join(values[ar.greedy:end], "/")
+	aa.parameters = p
+	return &aa
+}
+
+// action_segments_match checks pattern segments against path segments of
+// the same length. A ":" segment matches anything; any other must be equal.
+func action_segments_match(keys, values []string) bool {
+	for i, k := range keys {
+		if !strings.HasPrefix(k, ":") && k != values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// action_segments_bind adds the values of a pattern's ":" segments to a
+// parameters map, creating it if there are any and it is nil
+func action_segments_bind(keys, values []string, p map[string]string) map[string]string {
+	for i, k := range keys {
+		if strings.HasPrefix(k, ":") {
+			if p == nil {
+				p = map[string]string{}
+			}
+			p[k[1:]] = values[i]
+		}
+	}
+	return p
+}
+
+// conflicts returns the pairs of actions of the same precedence that can
+// both match some path
+func (r *action_routes) conflicts() [][2]string {
+	var result [][2]string
+	for i, a := range r.routes {
+		if a.name == "" {
+			continue
+		}
+		for _, b := range r.routes[i+1:] {
+			if b.special != a.special || len(b.segments) != len(a.segments) || b.literals != a.literals {
+				break
+			}
+			if b.name != "" && action_segments_overlap(a.segments, b.segments) {
+				result = append(result, [2]string{a.name, b.name})
+			}
+		}
+	}
+	return result
+}
+
+// action_segments_overlap checks whether two patterns with the same number
+// of segments both match some path with that many segments
+func action_segments_overlap(a, b []string) bool {
+	wild := func(s string) bool { return strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") }
+	for i := range a {
+		if !wild(a[i]) && !wild(b[i]) && a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// action_filepath_valid checks the segments of a files or feature route's
+// file path can't climb out of its directory: none may be "." or "..", hold
+// a backslash or NUL, or be empty, other than a trailing slash alone naming
+// the directory itself.
+func action_filepath_valid(segments []string) bool {
+	if len(segments) == 1 && segments[0] == "" {
+		return true
+	}
+	for _, s := range segments {
+		if s == "" || s == "." || s == ".." || strings.ContainsAny(s, "\\\x00") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+// Mochi server: Action route table tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestActionRoutes(t *testing.T) {
+	av := &AppVersion{Version: "1.0", app: &App{id: "routes"}, Actions: map[string]AppAction{
+		"":                       {Function: "fallback"},
+		"list":                   {Function: "list"},
+		":feed":                  {Function: "feed"},
+		":feed/:post":            {Function: "post"},
+		":feed/new":              {Function: "new"},
+		":wiki/-/assets":         {Files: "assets"},
+		"git/*path/info/refs":    {Function: "refs"},
+		":repository/tree/*path": {Function: "tree"},
+	}}
+
+	tests := []struct {
+		name       string
+		function   string
+		files      string
+		parameters map[string]string
+		filepath   string
+	}{
+		{"list", "list", "", nil, ""},
+		{"news", "feed", "", map[string]string{"feed": "news"}, ""},
+		{"news/new", "new", "", map[string]string{"feed": "news"}, ""},
+		{"news/123", "post", "", map[string]string{"feed": "news", "post": "123"}, ""},
+		{"docs/-/assets/css/site.css", "", "assets", map[string]string{"wiki": "docs"}, "css/site.css"},
+		{"docs/-/assets", "", "assets", map[string]string{"wiki": "docs"}, ""},
+		{"git/a/b/info/refs", "refs", "", map[string]string{"path": "a/b"}, ""},
+		{"core/tree/server/main.go", "tree", "", map[string]string{"repository": "core", "path": "server/main.go"}, ""},
+		{"a/b/c/d/e/f", "fallback", "", nil, ""},
+		{"docs/-/assets/../app.json", "fallback", "", nil, ""},
+		{"docs/-/assets/css//site.css", "fallback", "", nil, ""},
+		{"docs/-/assets/./site.css", "fallback", "", nil, ""},
+		{"docs/-/assets/..\\app.json", "fallback", "", nil, ""},
+	}
+	for _, test := range tests {
+		aa := av.find_action(test.name)
+		if aa == nil {
+			t.Errorf("%q: no action", test.name)
+			continue
+		}
+		if aa.Function != test.function || aa.Files != test.files || aa.filepath != test.filepath || len(aa.parameters) != len(test.parameters) {
+			t.Errorf("%q: got %+v", test.name, aa)
+			continue
+		}
+		for k, v := range test.parameters {
+			if aa.parameters[k] != v {
+				t.Errorf("%q: parameter %q is %q, want %q", test.name, k, aa.parameters[k], v)
+			}
+		}
+	}
+
+	// Matches are copies
+	av.find_action("news").parameters["feed"] = "changed"
+	if aa := av.find_action("sport"); aa.parameters["feed"] != "sport" {
+		t.Errorf("shared parameters: %v", aa.parameters)
+	}
+
+	// Without a catch-all
+	none := &AppVersion{Version: "1.0", app: &App{id: "none"}, Actions: map[string]AppAction{"list": {Function: "list"}}}
+	if aa := none.find_action("other"); aa != nil {
+		t.Errorf("matched %+v", aa)
+	}
+}
+
+func TestActionRouteConflicts(t *testing.T) {
+	r := action_routes_compile(map[string]AppAction{
+		"":            {Function: "fallback"},
+		":feed":       {Function: "feed"},
+		":wiki":       {Function: "wiki"},
+		":feed/new":   {Function: "new"},
+		"new/:post":   {Function: "post"},
+		":feed/edit":  {Function: "edit"},
+		":id/-/files": {Files: "files"},
+		":id/-/other": {Files: "other"},
+	})
+	c := r.conflicts()
+	want := map[[2]string]bool{{":feed", ":wiki"}: true, {":feed/new", "new/:post"}: true, {":feed/edit", "new/:post"}: true}
+	if len(c) != len(want) {
+		t.Fatalf("conflicts %v", c)
+	}
+	for _, pair := range c {
+		if !want[pair] {
+			t.Errorf("unexpected conflict %v", pair)
+		}
+	}
+
+	// The earlier by name wins, however the map is ordered
+	for range 10 {
+		if aa := r.find("x"); aa.Function != "feed" {
+			t.Fatalf("got %q", aa.Function)
+		}
+	}
+}
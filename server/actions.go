@@ -48,6 +48,7 @@ type Action struct {
 	web    *gin.Context
 	inputs map[string]string
 	body   string
+	stream *sse_stream // Set for actions declared as event streams
 }
 
 // ActionInput provides input methods (callable as a.input(), with a.input.has())
@@ -246,7 +247,7 @@ func (a *Action) input(name string) string {
 
 // Starlark methods
 func (a *Action) AttrNames() []string {
-	return []string{"access", "body", "cookie", "domain", "dump", "error", "file", "header", "input", "inputs", "json", "logout", "print", "redirect", "template", "token", "upload", "user", "write"}
+	return []string{"access", "body", "cookie", "domain", "dump", "error", "file", "header", "input", "inputs", "json", "logout", "print", "redirect", "stream", "template", "token", "upload", "user", "write"}
 }
 
 func (a *Action) Attr(name string) (sl.Value, error) {
@@ -279,6 +280,8 @@ func (a *Action) Attr(name string) (sl.Value, error) {
 		return sl.NewBuiltin("print", a.sl_print), nil
 	case "redirect":
 		return sl.NewBuiltin("redirect", a.sl_redirect), nil
+	case "stream":
+		return &ActionStream{action: a}, nil
 	case "template":
 		return sl.NewBuiltin("template", a.sl_template), nil
 	case "token":
@@ -626,13 +629,22 @@ func (a *Action) sl_template(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 		return sl_error(fn, "invalid template file %q", path)
 	}
 
+	// A template translated into the request's language, or a parent of it,
+	// is used over the English one
 	av := a.app.active(a.user)
-	file := fmt.Sprintf("%s/templates/en/%s.tmpl", av.base, path)
+	language := request_language(a.web, a.user)
+	file := ""
+	for _, tag := range language_fallbacks(language) {
+		file = fmt.Sprintf("%s/templates/%s/%s.tmpl", av.base, tag, path)
+		if file_exists(file) {
+			break
+		}
+	}
 	if !file_exists(file) {
 		return sl_error(fn, "template %q not found", path)
 	}
 
-	tmpl, err := template.New("").ParseFiles(file)
+	tmpl, err := template.New("").Funcs(template_functions(language, user_location(a.user))).Funcs(csrf_template_functions(a)).ParseFiles(file)
 	if err != nil {
 		return sl_error(fn, "%v", err)
 	}
@@ -782,7 +794,9 @@ func (a *Action) sl_write_file(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwar
 }
 
 // a.write.attachment(id, entity=None, variant="") -> None: Serve an attachment
-// (or a downscaled image variant, "thumbnail" or "preview") to the HTTP
+// (or a downscaled image variant: "thumbnail", "preview", or the "small",
+// "medium" or "large" preset sized by the app's app.json, or one of those
+// cropped to an aspect ratio around the focal point, e.g. "preview-16x9") to the HTTP
 // response by id. The calling action MUST authorise the request first — gate
 // on a.user against the app's own access rules (subscriber/member/privacy) —
 // because core serves the bytes without any access check of its own. `entity`
@@ -803,7 +817,7 @@ func (a *Action) sl_write_attachment(t *sl.Thread, fn *sl.Builtin, args sl.Tuple
 	if variant == "" && thumbnail {
 		variant = "thumbnail"
 	}
-	if variant != "" && variant != "thumbnail" && variant != "preview" {
+	if variant != "" && !variant_valid(variant) {
 		a.error(400, "Invalid variant")
 		return sl.None, nil
 	}
@@ -0,0 +1,468 @@
+// Mochi server: Activity
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Each user has an activity stream of the significant things they do in
+// their apps: posted, edited, merged, uploaded. An app records an item with
+// mochi.activity.record(verb, object, summary), and may list and delete its
+// own items; an app with activity/manage, such as Home, reads the whole
+// stream and the user's timeline of their contacts' activity.
+//
+// An item is private unless recorded as "contacts". If the user turns
+// publishing on, their contacts items are sent hourly as a "digest" event on
+// the activity service to the entities in their activity audience, and
+// digests received from others make up the timeline. A digest is taken
+// only from an entity in the recipient's own audience, so contacts see
+// each other's activity and strangers can't write into a timeline. Items
+// and timeline entries are kept for the user's retention, or the server's
+// activity_retention setting's number of days.
+//
+// The stream lives in users/<uid>/activity.db; settings in user.db.
+
+const (
+	activity_summary_limit = 1000
+	activity_digest_limit  = 100   // Items per digest event
+	activity_remote_limit  = 10000 // Timeline entries kept per user
+)
+
+type ActivityItem struct {
+	ID      string `db:"id"`
+	Entity  string `db:"entity"`
+	App     string `db:"app"`
+	Verb    string `db:"verb"`
+	Object  string `db:"object"`
+	Summary string `db:"summary"`
+	URL     string `db:"url"`
+	Privacy string `db:"privacy"`
+	Created int64  `db:"created"`
+}
+
+var api_activity = sls.FromStringDict(sl.String("mochi.activity"), sl.StringDict{
+	"audience": sl.NewBuiltin("mochi.activity.audience", api_activity_audience),
+	"delete":   sl.NewBuiltin("mochi.activity.delete", api_activity_delete),
+	"list":     sl.NewBuiltin("mochi.activity.list", api_activity_list),
+	"record":   sl.NewBuiltin("mochi.activity.record", api_activity_record),
+	"settings": sl.NewBuiltin("mochi.activity.settings", api_activity_settings),
+	"share":    sl.NewBuiltin("mochi.activity.share", api_activity_share),
+	"timeline": sl.NewBuiltin("mochi.activity.timeline", api_activity_timeline),
+})
+
+func init() {
+	a := app("activity")
+	a.service("activity")
+	a.event("digest", activity_digest_event)
+}
+
+// activity_db opens a user's activity stream, creating its tables if needed
+func activity_db(u *User) *DB {
+	db := db_user(u, "activity")
+	db.exec("create table if not exists items (id text not null primary key, app text not null, verb text not null, object text not null default '', summary text not null default '', url text not null default '', privacy text not null default 'private', created integer not null)")
+	db.exec("create index if not exists items_created on items(created)")
+	db.exec("create index if not exists items_app_created on items(app, created)")
+	db.exec("create table if not exists remote (entity text not null, id text not null, app text not null, verb text not null, object text not null default '', summary text not null default '', url text not null default '', created integer not null, received integer not null, primary key (entity, id))")
+	db.exec("create index if not exists remote_created on remote(created)")
+	db.exec("create table if not exists audience (entity text not null primary key, created integer not null)")
+	return db
+}
+
+// activity_setting returns one of a user's numeric activity settings
+func activity_setting(u *User, key string) int64 {
+	row, _ := db_user(u, "user").row("select number from settings where key=?", key)
+	if row == nil {
+		return 0
+	}
+	return event_int64(row["number"])
+}
+
+// activity_retention_default returns the server's activity retention in days
+func activity_retention_default() int64 {
+	days := atoi(setting_get("activity_retention", system_settings["activity_retention"].Default), 365)
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+// activity_retention returns how long a user's activity is kept, in seconds
+func activity_retention(u *User) int64 {
+	days := activity_setting(u, "activity_retention")
+	if days < 1 {
+		days = activity_retention_default()
+	}
+	return days * 86400
+}
+
+// info returns an item as seen by an app
+func (i *ActivityItem) info() map[string]any {
+	result := map[string]any{"id": i.ID, "app": i.App, "verb": i.Verb, "object": i.Object, "summary": i.Summary, "url": i.URL, "created": i.Created}
+	if i.Entity != "" {
+		result["entity"] = i.Entity
+	} else {
+		result["privacy"] = i.Privacy
+	}
+	return result
+}
+
+// activity_record adds an item to a user's stream
+func activity_record(u *User, app, verb, object, summary, url, privacy string) *ActivityItem {
+	i := &ActivityItem{ID: uid(), App: app, Verb: verb, Object: object, Summary: summary, URL: url, Privacy: privacy, Created: now()}
+	activity_db(u).exec("insert into items (id, app, verb, object, summary, url, privacy, created) values (?, ?, ?, ?, ?, ?, ?, ?)", i.ID, i.App, i.Verb, i.Object, i.Summary, i.URL, i.Privacy, i.Created)
+	return i
+}
+
+// activity_pending returns a user's contacts items since a time, oldest
+// first, up to the digest limit
+func activity_pending(u *User, since int64) []ActivityItem {
+	var items []ActivityItem
+	activity_db(u).scans(&items, "select id, app, verb, object, summary, url, privacy, created from items where privacy='contacts' and created>? order by created, id limit ?", since, activity_digest_limit)
+	return items
+}
+
+// activity_publish sends a user's new contacts items to their audience, if
+// they publish
+func activity_publish(u *User) {
+	if u.Identity == nil || activity_setting(u, "activity_publish") == 0 {
+		return
+	}
+	since := activity_setting(u, "activity_digest")
+	items := activity_pending(u, since)
+	if len(items) == 0 {
+		return
+	}
+	records := make([]any, len(items))
+	for n := range items {
+		records[n] = items[n].info()
+		since = items[n].Created
+	}
+
+	rows, _ := activity_db(u).rows("select entity from audience")
+	for _, r := range rows {
+		entity, _ := r["entity"].(string)
+		m := message(u.Identity.ID, entity, "activity", "digest")
+		m.content["items"] = records
+		m.send()
+	}
+	db_user(u, "user").exec("replace into settings (key, text, number) values ('activity_digest', '', ?)", since)
+}
+
+// activity_expire deletes a user's items and timeline entries older than
+// their retention, returning how many
+func activity_expire(u *User) int64 {
+	before := now() - activity_retention(u)
+	var n int64
+	db := activity_db(u)
+	for _, table := range []string{"items", "remote"} {
+		if result, err := db.internal.Exec("delete from "+table+" where created<?", before); err == nil {
+			deleted, _ := result.RowsAffected()
+			n += deleted
+		}
+	}
+	return n
+}
+
+// activity_manager publishes digests and expires old activity hourly
+func activity_manager() {
+	for range time.Tick(time.Hour) {
+		rows, _ := db_open("db/users.db").rows("select uid from users")
+		for _, r := range rows {
+			id, _ := r["uid"].(string)
+			if id == "" || !file_exists(filepath.Join(data_dir, "users", id, "activity.db")) {
+				continue
+			}
+			if u := user_by_uid(id); u != nil {
+				activity_publish(u)
+				if n := activity_expire(u); n > 0 {
+					debug("Activity expired %d entries for user %q", n, id)
+				}
+			}
+		}
+	}
+}
+
+// activity_digest_event receives a digest of an entity's activity into the
+// recipient's timeline, if the recipient shares their own with the entity
+func activity_digest_event(e *Event) {
+	if e.user == nil || !valid(e.from, "entity") {
+		return
+	}
+	if shared, _ := activity_db(e.user).exists("select 1 from audience where entity=?", e.from); !shared {
+		info("Activity digest from %q refused: not in the audience of user %q", e.from, e.user.UID)
+		return
+	}
+	items, _ := e.content["items"].([]any)
+	if len(items) > activity_digest_limit {
+		items = items[:activity_digest_limit]
+	}
+
+	db := activity_db(e.user)
+	t := now()
+	var stored []any
+	for _, v := range items {
+		item, _ := v.(map[any]any)
+		get := func(k string) string {
+			s, _ := item[k].(string)
+			return s
+		}
+		i := ActivityItem{ID: get("id"), Entity: e.from, App: get("app"), Verb: get("verb"), Object: get("object"), Summary: get("summary"), URL: get("url"), Created: event_int64(item["created"])}
+		if !valid(i.ID, "id") || !valid(i.App, "constant") || !valid(i.Verb, "constant") || (i.Object != "" && !valid(i.Object, "path")) || len(i.Summary) > activity_summary_limit || (i.URL != "" && !valid(i.URL, "url")) {
+			continue
+		}
+		if i.Created <= 0 || i.Created > t {
+			i.Created = t
+		}
+		db.exec("insert or ignore into remote (entity, id, app, verb, object, summary, url, created, received) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", i.Entity, i.ID, i.App, i.Verb, i.Object, i.Summary, i.URL, i.Created, t)
+		stored = append(stored, i.info())
+	}
+	if len(stored) == 0 {
+		return
+	}
+
+	// Keep the timeline bounded, dropping the oldest entries
+	db.exec("delete from remote where rowid in (select rowid from remote order by created desc limit -1 offset ?)", activity_remote_limit)
+	websockets_send(e.user, "activity", map[string]any{"entity": e.from, "items": stored})
+}
+
+// mochi.activity.record(verb, object?, summary?, url?, privacy?) -> string:
+// Record an item in the current user's activity stream, such as "posted" or
+// "edited". Privacy is "private" (default) or "contacts" to include it in
+// the user's published digest. Returns the item id.
+func api_activity_record(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var verb, object, summary, url string
+	privacy := "private"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "verb", &verb, "object?", &object, "summary?", &summary, "url?", &url, "privacy?", &privacy); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(verb, "constant") {
+		return sl_error(fn, "invalid verb")
+	}
+	if object != "" && !valid(object, "path") {
+		return sl_error(fn, "invalid object")
+	}
+	if len(summary) > activity_summary_limit {
+		return sl_error(fn, "summary too long")
+	}
+	if url != "" && !valid(url, "url") {
+		return sl_error(fn, "invalid url")
+	}
+	if privacy != "private" && privacy != "contacts" {
+		return sl_error(fn, "invalid privacy %q", privacy)
+	}
+	return sl.String(activity_record(user, app.id, verb, object, summary, url, privacy).ID), nil
+}
+
+// mochi.activity.list(limit?, before?, app?) -> list: List items in the
+// current user's activity stream, newest first, created before a time if
+// given. Apps see their own items; with activity/manage, those of all apps
+// or of the app given.
+func api_activity_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	limit := 100
+	before := 0
+	var filter string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "limit?", &limit, "before?", &before, "app?", &filter); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if limit < 1 || limit > 1000 {
+		return sl_error(fn, "invalid limit")
+	}
+	if require_permission(t, fn, "activity/manage") != nil {
+		filter = app.id
+	}
+
+	query := "select id, app, verb, object, summary, url, privacy, created from items where 1=1"
+	var values []any
+	if filter != "" {
+		query += " and app=?"
+		values = append(values, filter)
+	}
+	if before > 0 {
+		query += " and created<?"
+		values = append(values, before)
+	}
+	values = append(values, limit)
+	var items []ActivityItem
+	if err := activity_db(user).scans(&items, query+" order by created desc, id desc limit ?", values...); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	results := make([]any, len(items))
+	for i := range items {
+		results[i] = items[i].info()
+	}
+	return sl_encode(results), nil
+}
+
+// mochi.activity.delete(id) -> bool: Delete an item from the current user's
+// activity stream. Apps may delete their own items; with activity/manage,
+// any.
+func api_activity_delete(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	query := "delete from items where id=?"
+	values := []any{id}
+	if require_permission(t, fn, "activity/manage") != nil {
+		query += " and app=?"
+		values = append(values, app.id)
+	}
+	result, err := activity_db(user).internal.Exec(query, values...)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return sl.Bool(n > 0), nil
+}
+
+// mochi.activity.timeline(limit?, before?, entity?) -> list: List activity
+// received from the current user's contacts, newest first, optionally from
+// one entity. Requires activity/manage.
+func api_activity_timeline(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	limit := 100
+	before := 0
+	var entity string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "limit?", &limit, "before?", &before, "entity?", &entity); err != nil {
+		return nil, err
+	}
+	if err := require_permission(t, fn, "activity/manage"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if limit < 1 || limit > 1000 {
+		return sl_error(fn, "invalid limit")
+	}
+
+	query := "select entity, id, app, verb, object, summary, url, created from remote where 1=1"
+	var values []any
+	if entity != "" {
+		query += " and entity=?"
+		values = append(values, entity)
+	}
+	if before > 0 {
+		query += " and created<?"
+		values = append(values, before)
+	}
+	values = append(values, limit)
+	var items []ActivityItem
+	if err := activity_db(user).scans(&items, query+" order by created desc limit ?", values...); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	results := make([]any, len(items))
+	for i := range items {
+		results[i] = items[i].info()
+	}
+	return sl_encode(results), nil
+}
+
+// mochi.activity.share(entity, allow?) -> bool: Add (default) or remove an
+// entity from the audience the current user's digest is sent to. Requires
+// activity/manage.
+func api_activity_share(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity string
+	allow := true
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "allow?", &allow); err != nil {
+		return nil, err
+	}
+	if err := require_permission(t, fn, "activity/manage"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(entity, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+	db := activity_db(user)
+	if !allow {
+		db.exec("delete from audience where entity=?", entity)
+		return sl.False, nil
+	}
+	db.exec("insert or ignore into audience (entity, created) values (?, ?)", entity, now())
+	return sl.True, nil
+}
+
+// mochi.activity.audience() -> list: Entities the current user's digest is
+// sent to. Requires activity/manage.
+func api_activity_audience(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "activity/manage"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	rows, err := activity_db(user).rows("select entity, created from audience order by created")
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.activity.settings(publish?, retention?) -> dict: Get, and optionally
+// change, whether the current user publishes a digest of their contacts
+// items, and for how many days their activity is kept, 0 for the server's
+// default. Requires activity/manage.
+func api_activity_settings(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var publish sl.Value = sl.None
+	retention := -1
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "publish?", &publish, "retention?", &retention); err != nil {
+		return nil, err
+	}
+	if err := require_permission(t, fn, "activity/manage"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if retention > 3650 {
+		return sl_error(fn, "invalid retention")
+	}
+
+	db := db_user(user, "user")
+	if publish != sl.None {
+		on := int64(0)
+		if publish.Truth() {
+			on = 1
+		}
+		if on == 1 && activity_setting(user, "activity_publish") == 0 {
+			// Start the digest from now rather than sending the backlog
+			db.exec("replace into settings (key, text, number) values ('activity_digest', '', ?)", now())
+		}
+		db.exec("replace into settings (key, text, number) values ('activity_publish', '', ?)", on)
+	}
+	if retention >= 0 {
+		db.exec("replace into settings (key, text, number) values ('activity_retention', '', ?)", retention)
+	}
+	return sl_encode(map[string]any{
+		"publish":   activity_setting(user, "activity_publish") == 1,
+		"retention": activity_setting(user, "activity_retention"),
+		"default":   activity_retention_default(),
+	}), nil
+}
@@ -0,0 +1,95 @@
+// Mochi server: Activity tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+const activity_test_friend = "1ActivityTestFriendEntityXXXXXXXXXXXXXXXXXXXXXXXX"
+
+func activity_test_setup(t *testing.T) *User {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	return create_permission_test_user(t, "u1")
+}
+
+func TestActivityListScoped(t *testing.T) {
+	user := activity_test_setup(t)
+	wikis := create_external_app("wikis")
+	activity_record(user, "wikis", "edited", "page/1", "Edited Home", "", "private")
+	activity_record(user, "feeds", "posted", "post/1", "Posted", "", "contacts")
+
+	thread := create_test_thread(user, wikis)
+	list, _ := api_activity.Attr("list")
+	v, err := sl.Call(thread, list, nil, []sl.Tuple{{sl.String("app"), sl.String("feeds")}})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	items := v.(sl.Tuple)
+	if len(items) != 1 {
+		t.Fatalf("app without activity/manage saw %d items", len(items))
+	}
+	app, _, _ := items[0].(*sl.Dict).Get(sl.String("app"))
+	if app != sl.String("wikis") {
+		t.Errorf("app saw another app's item: %v", items)
+	}
+
+	timeline, _ := api_activity.Attr("timeline")
+	if _, err := sl.Call(thread, timeline, nil, nil); err == nil {
+		t.Error("timeline read without activity/manage")
+	}
+}
+
+func TestActivityPending(t *testing.T) {
+	user := activity_test_setup(t)
+	activity_record(user, "wikis", "edited", "page/1", "", "", "private")
+	shared := activity_record(user, "feeds", "posted", "post/1", "", "", "contacts")
+
+	pending := activity_pending(user, 0)
+	if len(pending) != 1 || pending[0].ID != shared.ID {
+		t.Fatalf("pending digest %v, want only the contacts item", pending)
+	}
+	if len(activity_pending(user, shared.Created)) != 0 {
+		t.Error("item pending again after its digest")
+	}
+}
+
+func TestActivityDigestEvent(t *testing.T) {
+	user := activity_test_setup(t)
+	good := map[any]any{"id": uid(), "app": "feeds", "verb": "posted", "object": "post/1", "summary": "Hello", "created": now()}
+	bad := map[any]any{"id": "x", "app": "feeds", "verb": "posted"}
+
+	// Refused from an entity the user doesn't share theirs with
+	activity_digest_event(&Event{from: activity_test_friend, user: user, content: map[string]any{"items": []any{good}}})
+	if n := activity_db(user).integer("select count(*) from remote"); n != 0 {
+		t.Errorf("digest from a stranger stored %d entries", n)
+	}
+
+	activity_db(user).exec("insert into audience (entity, created) values (?, ?)", activity_test_friend, now())
+	activity_digest_event(&Event{from: activity_test_friend, user: user, content: map[string]any{"items": []any{good, bad}}})
+	activity_digest_event(&Event{from: activity_test_friend, user: user, content: map[string]any{"items": []any{good}}})
+
+	if n := activity_db(user).integer("select count(*) from remote where entity=?", activity_test_friend); n != 1 {
+		t.Errorf("timeline holds %d entries, want 1", n)
+	}
+}
+
+func TestActivityExpire(t *testing.T) {
+	user := activity_test_setup(t)
+	old := activity_record(user, "wikis", "edited", "page/1", "", "", "private")
+	activity_record(user, "wikis", "edited", "page/2", "", "", "private")
+	db_user(user, "user").exec("replace into settings (key, text, number) values ('activity_retention', '', 7)")
+	activity_db(user).exec("update items set created=? where id=?", now()-8*86400, old.ID)
+
+	if n := activity_expire(user); n != 1 {
+		t.Errorf("expired %d items, want 1", n)
+	}
+}
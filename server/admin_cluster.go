@@ -0,0 +1,38 @@
+// Mochi server: /_/admin/cluster handler.
+//
+// Operator visibility into clustering: which node this is, which node
+// holds the leader's lease, and the nodes running. Used by `mochictl
+// cluster`.
+//
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// admin_cluster is GET /_/admin/cluster. A server that isn't clustered
+// reports enabled false and no nodes.
+func admin_cluster(c *gin.Context) {
+	if !cluster_enabled {
+		c.JSON(http.StatusOK, gin.H{"enabled": false, "nodes": []ClusterNode{}})
+		return
+	}
+	nodes := cluster_nodes()
+	if nodes == nil {
+		nodes = []ClusterNode{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": true,
+		"node":    cluster_node,
+		"leading": !cluster_following.Load(),
+		"leader":  cluster_leader(),
+		"nodes":   nodes,
+	})
+}
@@ -0,0 +1,45 @@
+// Mochi server: /_/admin/dns handler.
+//
+// The DNS records that let other servers find this one by a zone, and a
+// check of the records currently published there. Used by `mochictl dns`.
+//
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// admin_dns is GET /_/admin/dns?zone=<zone>[&host=<host>]. The host the SRV
+// records point at defaults to the zone itself.
+func admin_dns(c *gin.Context) {
+	zone := dns_zone(c.Query("zone"))
+	if zone == "" {
+		respond_error(c, http.StatusBadRequest, "invalid_zone", "errors.invalid_zone", nil)
+		return
+	}
+	host := zone
+	if h := c.Query("host"); h != "" {
+		host = dns_zone(h)
+		if host == "" {
+			respond_error(c, http.StatusBadRequest, "invalid_host", "errors.invalid_host", nil)
+			return
+		}
+	}
+	port := ini_int("p2p", "port", 1443)
+	found, problems := dns_check(zone, host, net_id, port)
+	c.JSON(http.StatusOK, gin.H{
+		"zone":     zone,
+		"host":     host,
+		"peer":     net_id,
+		"records":  dns_records(zone, host, net_id, port),
+		"found":    found,
+		"problems": problems,
+	})
+}
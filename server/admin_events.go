@@ -0,0 +1,73 @@
+// Mochi server: /_/admin/events/* handlers.
+//
+// Operator access to the log of events received by apps, and replaying
+// them to an app once a bug that mishandled them is fixed. Used by
+// `mochictl events`.
+//
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// admin_events_query reads the app, user, failed, after and limit query
+// params shared by the events handlers. after defaults to def; ok is false
+// once an error has been sent.
+func admin_events_query(c *gin.Context, def int64) (app, user string, failed bool, after int64, limit int, ok bool) {
+	app = c.Query("app")
+	user = c.Query("user")
+	if !valid(app, "constant") || (user != "" && !valid(user, "id")) {
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+	if app_by_id(app) == nil {
+		respond_error(c, http.StatusNotFound, "app_not_found", "errors.app_not_found", nil)
+		return
+	}
+	failed = c.Query("failed") == "true"
+	after = atoi(c.Query("after"), def)
+	limit = int(atoi(c.DefaultQuery("limit", "100"), 100))
+	if limit < 1 || limit > event_replay_max {
+		limit = 100
+	}
+	return app, user, failed, after, limit, true
+}
+
+// admin_events is GET /_/admin/events.
+//
+// Query params: ?app= (required), ?user= to show one user's events,
+// ?failed=true to show only those the app failed to handle, ?after= a
+// sequence number, and ?limit= (default 100, at most 1000). Returns the
+// events in the order they arrived, and the app's replay cursor.
+func admin_events(c *gin.Context) {
+	app, user, failed, after, limit, ok := admin_events_query(c, 0)
+	if !ok {
+		return
+	}
+	rows := event_log_list(app, user, failed, after, limit)
+	if rows == nil {
+		rows = []EventLogEntry{}
+	}
+	c.JSON(http.StatusOK, gin.H{"rows": rows, "cursor": event_cursor(app, user)})
+}
+
+// admin_events_replay is POST /_/admin/events/replay.
+//
+// Takes the same query params as admin_events, replaying up to ?limit= of
+// the selected events to the app. Without ?after= the replay starts after
+// the app's cursor, so repeating the request works through the log.
+func admin_events_replay(c *gin.Context) {
+	app, user, failed, after, limit, ok := admin_events_query(c, -1)
+	if !ok {
+		return
+	}
+	replayed, failures, cursor := event_replay(app, user, failed, after, limit)
+	c.JSON(http.StatusOK, gin.H{"replayed": replayed, "failed": failures, "cursor": cursor})
+}
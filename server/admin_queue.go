@@ -0,0 +1,72 @@
+// Mochi server: /_/admin/queue/* handlers.
+//
+// Operator visibility into the dead letters the outbound queue gave up on,
+// and requeueing them once the cause is fixed. Used by `mochictl queue`.
+//
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// admin_queue_dead is GET /_/admin/queue/dead.
+//
+// Query params: ?service= to show one service's dead letters, and ?limit=
+// (default 100, at most 1000).
+func admin_queue_dead(c *gin.Context) {
+	service := c.Query("service")
+	if service != "" && !valid(service, "constant") {
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+	limit := int(atoi(c.DefaultQuery("limit", "100"), 100))
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+	rows, total := queue_dead_list(service, limit)
+	if rows == nil {
+		rows = []DeadLetter{}
+	}
+	c.JSON(http.StatusOK, gin.H{"rows": rows, "total": total})
+}
+
+// admin_queue_requeue is POST /_/admin/queue/requeue.
+//
+// Query params: ?id= to requeue one dead letter, or ?all=true to requeue
+// every one, optionally only those of ?service=.
+func admin_queue_requeue(c *gin.Context) {
+	if c.Query("all") == "true" {
+		service := c.Query("service")
+		if service != "" && !valid(service, "constant") {
+			respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"requeued": queue_requeue_all(service)})
+		return
+	}
+
+	id := c.Query("id")
+	if !valid(id, "constant") {
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+	err := queue_requeue(id)
+	switch {
+	case errors.Is(err, ErrDeadLetterMissing):
+		respond_error(c, http.StatusNotFound, "not_found", "errors.not_found", nil)
+	case errors.Is(err, ErrDeadLetterExpired):
+		respond_error(c, http.StatusGone, "dead_letter_expired", "errors.dead_letter_expired", nil)
+	case err != nil:
+		respond_error(c, http.StatusInternalServerError, "database_error", "errors.database_error", nil)
+	default:
+		c.JSON(http.StatusOK, gin.H{"requeued": 1})
+	}
+}
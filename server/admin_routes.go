@@ -68,6 +68,20 @@ func admin_register_routes(r *gin.Engine) {
 	admin.POST("/broadcast/pending/gc", admin_broadcast_pending_gc)
 	admin.GET("/pipelining/status", admin_pipelining_status)
 	admin.GET("/pubsub/status", admin_pubsub_status)
+	admin.GET("/peers/stats", admin_peers_stats)
+	admin.GET("/transfer", admin_transfer)
+	admin.GET("/queue/dead", admin_queue_dead)
+	admin.POST("/queue/requeue", admin_queue_requeue)
+	admin.GET("/events", admin_events)
+	admin.POST("/events/replay", admin_events_replay)
+	admin.GET("/cluster", admin_cluster)
+	admin.GET("/dns", admin_dns)
+	admin.GET("/dkim", admin_dkim)
+	admin.GET("/expiry", admin_expiry)
+	admin.GET("/disk", admin_disk)
+	admin.GET("/metrics", admin_metrics)
+	admin.GET("/maintenance", admin_maintenance)
+	admin.POST("/maintenance", admin_maintenance_set)
 
 	// pprof endpoints — admin-socket only, no separate port. The transport's
 	// connection-level auth gates access. Useful for diagnosing memory bloat /
@@ -96,10 +110,11 @@ func admin_register_routes(r *gin.Engine) {
 // admin_audited_routes maps "<METHOD> <fullPath>" to the subcommand label
 // to record. Anything not in this map is not audited.
 var admin_audited_routes = map[string]string{
-	"POST /_/admin/snapshot": "admin.snapshot",
-	"POST /_/admin/vacuum":   "admin.vacuum",
-	"POST /_/admin/stop":     "admin.stop",
-	"POST /_/admin/restart":  "admin.restart",
+	"POST /_/admin/snapshot":    "admin.snapshot",
+	"POST /_/admin/vacuum":      "admin.vacuum",
+	"POST /_/admin/stop":        "admin.stop",
+	"POST /_/admin/restart":     "admin.restart",
+	"POST /_/admin/maintenance": "admin.maintenance",
 }
 
 // admin_audit_middleware records a daemon-facility audit row after each
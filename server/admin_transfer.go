@@ -0,0 +1,54 @@
+// Mochi server: /_/admin/transfer handler.
+//
+// Operator visibility into network transfer accounting: a month's bytes
+// sent and received, broken down by peer, app or user, plus the monthly
+// budget and whether low-priority sync is paused. Used by
+// `mochictl transfer`.
+//
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var admin_transfer_month = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}$`)
+
+// admin_transfer is GET /_/admin/transfer.
+//
+// Query params: ?month=YYYY-MM (default this month) and ?by=peer|app|user
+// (default peer).
+func admin_transfer(c *gin.Context) {
+	month := c.DefaultQuery("month", transfer_month(time.Now()))
+	if !admin_transfer_month.MatchString(month) {
+		respond_error(c, http.StatusBadRequest, "invalid_month", "errors.invalid_month", nil)
+		return
+	}
+	by := c.DefaultQuery("by", "peer")
+	if by != "peer" && by != "app" && by != "user" {
+		respond_error(c, http.StatusBadRequest, "invalid_grouping", "errors.invalid_grouping", nil)
+		return
+	}
+
+	rows := transfer_totals(month, by)
+	if rows == nil {
+		rows = []TransferTotal{}
+	}
+	limit := transfer_cap()
+	used := transfer_used()
+	c.JSON(http.StatusOK, gin.H{
+		"month":  month,
+		"rows":   rows,
+		"cap":    limit,
+		"used":   used,
+		"paused": limit > 0 && used >= limit,
+	})
+}
@@ -63,8 +63,12 @@ type admin_conn struct {
 	cred *admin_cred
 }
 
-// admin_socket_path returns the absolute path of the admin UDS.
+// admin_socket_path returns the absolute path of the admin UDS. Cluster
+// nodes share the run directory, so each has a socket named after it.
 func admin_socket_path() string {
+	if cluster_enabled {
+		return filepath.Join(run_dir(), "admin-"+cluster_node+".sock")
+	}
 	return filepath.Join(run_dir(), "admin.sock")
 }
 
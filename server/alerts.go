@@ -0,0 +1,270 @@
+// Mochi server: Alerts for sign ins from new devices and networks
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Each full sign in records a fingerprint of the device and the network
+// region it came from, in the fingerprints table of users.db. A device is
+// its browser and operating system with their versions dropped, so updates
+// don't make it new; a region is the /16 of an IPv4 address or the /32 of
+// an IPv6 one. Only hashes of device descriptions are kept.
+//
+// A sign in from a device or region the user hasn't signed in from before
+// raises an alert, unless it is their first. The alert is audited, sent as
+// the "user/login" event to the user's apps that declare it, and delivered
+// as the login_alerts setting says: as a notification, which reaches the
+// user's push accounts, by email, both or neither. Each alert carries a
+// "this wasn't me" link; following it signs that session out, forgets its
+// fingerprint, and asks the user to review how they sign in before they
+// carry on.
+
+const login_alert_lifetime = 30 * 86400
+
+var login_device_versions = regexp.MustCompile(`[0-9][0-9._]*`)
+
+var api_user_login = sls.FromStringDict(sl.String("mochi.user.login"), sl.StringDict{
+	"alerts":   sl.NewBuiltin("mochi.user.login.alerts", api_user_login_alerts),
+	"deny":     sl.NewBuiltin("mochi.user.login.deny", api_user_login_deny),
+	"review":   sl.NewBuiltin("mochi.user.login.review", api_user_login_review),
+	"reviewed": sl.NewBuiltin("mochi.user.login.reviewed", api_user_login_reviewed),
+})
+
+// login_device returns the fingerprint of the device a browser's user agent
+// describes
+func login_device(agent string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(login_device_versions.ReplaceAllString(agent, ""))))
+	return hex.EncodeToString(hash[:16])
+}
+
+// login_region returns the network region an IP address is in
+func login_region(address string) string {
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return address
+	}
+	ip = ip.Unmap()
+	bits := 16
+	if ip.Is6() {
+		bits = 32
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix.String()
+}
+
+// login_fingerprint records a user's sign in from a device and address,
+// returning why it needs an alert: "device", "region", "device region", or
+// "" if neither is new or it is their first sign in
+func login_fingerprint(user *User, agent, address string) string {
+	db := db_open("db/users.db")
+	device := login_device(agent)
+	region := login_region(address)
+	known, _ := db.exists("select 1 from fingerprints where user=?", user.UID)
+	var reasons []string
+	if known {
+		if seen, _ := db.exists("select 1 from fingerprints where user=? and device=?", user.UID, device); !seen {
+			reasons = append(reasons, "device")
+		}
+		if seen, _ := db.exists("select 1 from fingerprints where user=? and region=?", user.UID, region); !seen {
+			reasons = append(reasons, "region")
+		}
+	}
+	db.exec("insert into fingerprints ( user, device, region, first, last ) values ( ?, ?, ?, ?, ? ) on conflict ( user, device, region ) do update set last=excluded.last", user.UID, device, region, now(), now())
+	return strings.Join(reasons, " ")
+}
+
+// login_alert raises an alert for a new session if it came from a new
+// device or region, returning the alert's id or ""
+func login_alert(c *gin.Context, user *User, session string) string {
+	if user_guest(user) {
+		return ""
+	}
+	address := c.ClientIP()
+	agent := c.GetHeader("User-Agent")
+	reason := login_fingerprint(user, agent, address)
+	if reason == "" {
+		return ""
+	}
+
+	id := random_alphanumeric(32)
+	db_open("db/sessions.db").exec("insert into alerts ( id, user, session, device, region, address, agent, reason, created ) values ( ?, ?, ?, ?, ?, ?, ?, ?, ? )", id, user.UID, session, login_device(agent), login_region(address), address, agent, reason, now())
+	audit_login_alert(user.Username, address, reason)
+	user_event(user, "user/login", map[string]any{"address": address, "agent": agent, "reason": reason, "created": now()})
+
+	delivery := setting_get("login_alerts", "all")
+	if delivery == "off" {
+		return id
+	}
+	link := request_origin(c) + "/login/denied#" + id
+	language := request_language(c, user)
+	title := resolve_core_label(language, "login.alert.title", nil)
+	details := resolve_core_label(language, "login.alert.details", map[string]any{"agent": agent, "address": address})
+	denied := resolve_core_label(language, "login.alert.denied", nil)
+	if delivery == "notification" || delivery == "all" {
+		notification_create(user, "settings", "security", id, title, details, link, "high")
+	}
+	if delivery == "email" || delivery == "all" {
+		email_send_message(user.Username, EmailMessage{
+			Language: language,
+			Subject:  resolve_core_label(language, "email.login_alert.subject", nil),
+			Heading:  title,
+			Tagline:  details,
+			Body:     denied,
+			Button:   resolve_core_label(language, "email.login_alert.button", nil),
+			Link:     link,
+		})
+	}
+	return id
+}
+
+// login_deny acts on a "this wasn't me" from an alert: signing its session
+// out, forgetting its fingerprint, and asking its user to review how they
+// sign in. Returns the user, or nil if there is no such alert.
+func login_deny(id string) *User {
+	db := db_open("db/sessions.db")
+	row, _ := db.row("select user, session, device, region from alerts where id=? and denied=0 and created>=?", id, now()-login_alert_lifetime)
+	if row == nil {
+		return nil
+	}
+	user := user_by_uid(as_string(row["user"]))
+	if user == nil {
+		return nil
+	}
+	db.exec("update alerts set denied=? where id=?", now(), id)
+	login_delete(as_string(row["session"]))
+	db.exec("delete from devices where session=?", row["session"])
+
+	users := db_open("db/users.db")
+	users.exec("delete from fingerprints where user=? and device=? and region=?", user.UID, row["device"], row["region"])
+	users.exec("replace into reviews ( user, reason, created ) values ( ?, 'login_denied', ? )", user.UID, now())
+	return user
+}
+
+// login_review returns when and why a user was asked to review how they
+// sign in, or nil if they haven't been
+func login_review(user *User) map[string]any {
+	row, _ := db_open("db/users.db").row("select reason, created from reviews where user=?", user.UID)
+	return row
+}
+
+// POST /_/auth/login/denied - Sign out a session an alert was about, from
+// the alert's "this wasn't me" link
+func web_login_denied(c *gin.Context) {
+	var input struct {
+		Alert string `json:"alert"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Alert == "" {
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+	user := login_deny(input.Alert)
+	if user == nil {
+		respond_error(c, http.StatusGone, "alert_expired", "errors.alert_expired", nil)
+		return
+	}
+	audit_session_anomaly(user.Username, rate_limit_client_ip(c), "login_denied")
+	c.JSON(http.StatusOK, gin.H{"revoked": true})
+}
+
+// login_user returns the signed in user of a login API call
+func login_user(t *sl.Thread, fn *sl.Builtin, permission string) (*User, error) {
+	if err := require_permission(t, fn, permission); err != nil {
+		_, err = sl_error(fn, "%v", err)
+		return nil, err
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || user_guest(user) {
+		_, err := sl_error(fn, "no user")
+		return nil, err
+	}
+	return user, nil
+}
+
+// mochi.user.login.alerts() -> list: The user's alerts from the last 30
+// days, newest first. Each has:
+//
+//	id       string — the alert's id, for mochi.user.login.deny()
+//	address  string — the IP address signed in from
+//	agent    string — the browser signed in with
+//	reason   string — what was new: "device", "region" or "device region"
+//	created  int    — Unix timestamp of the sign in
+//	denied   int    — Unix timestamp the user said it wasn't them, or 0
+//	current  bool   — whether it is the session making this call
+func api_user_login_alerts(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, err := login_user(t, fn, "user/authentication/read")
+	if err != nil {
+		return nil, err
+	}
+	current := ""
+	if action, ok := t.Local("action").(*Action); ok && action.web != nil {
+		current = web_cookie_get(action.web, "session", "")
+	}
+	rows, _ := db_open("db/sessions.db").rows("select id, session, address, agent, reason, created, denied from alerts where user=? and created>=? order by created desc", user.UID, now()-login_alert_lifetime)
+	for _, row := range rows {
+		row["current"] = current != "" && row["session"] == current
+		delete(row, "session")
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.user.login.deny(id) -> bool: Say an alert's sign in wasn't the
+// user, signing that session out and asking them to review how they sign in
+func api_user_login_deny(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, err := login_user(t, fn, "user/authentication/write")
+	if err != nil {
+		return nil, err
+	}
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+	if exists, _ := db_open("db/sessions.db").exists("select 1 from alerts where id=? and user=?", id, user.UID); !exists {
+		return sl.False, nil
+	}
+	if login_deny(id) == nil {
+		return sl.False, nil
+	}
+	audit_session_anomaly(user.Username, "", "login_denied")
+	return sl.True, nil
+}
+
+// mochi.user.login.review() -> dict or None: Whether the user has been asked
+// to review how they sign in, with the reason and the Unix timestamp they
+// were asked at
+func api_user_login_review(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, err := login_user(t, fn, "user/authentication/read")
+	if err != nil {
+		return nil, err
+	}
+	review := login_review(user)
+	if review == nil {
+		return sl.None, nil
+	}
+	return sl_encode(review), nil
+}
+
+// mochi.user.login.reviewed() -> None: Record that the user has reviewed how
+// they sign in
+func api_user_login_reviewed(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, err := login_user(t, fn, "user/authentication/write")
+	if err != nil {
+		return nil, err
+	}
+	db_open("db/users.db").exec("delete from reviews where user=?", user.UID)
+	return sl.None, nil
+}
@@ -0,0 +1,95 @@
+// Mochi server: Sign in alert tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoginAlert(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	load_core_labels()
+	gin.SetMode(gin.TestMode)
+	setting_set("login_alerts", "off")
+
+	user, _ := user_create("owner@example.com")
+	if _, err := entity_create(user, "person", "Owner", "public", ""); err != nil {
+		t.Fatal(err)
+	}
+	user = user_by_uid(user.UID)
+
+	login := func(address, agent string) (string, string) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/_/auth/code", nil)
+		c.Request.RemoteAddr = address + ":1234"
+		c.Request.Header.Set("User-Agent", agent)
+		session := auth_establish_session(c, user)
+		row, _ := db_open("db/sessions.db").row("select id from alerts where session=?", session)
+		if row == nil {
+			return session, ""
+		}
+		return session, as_string(row["id"])
+	}
+
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:140.0) Gecko/20100101 Firefox/140.0"
+	if _, alert := login("192.0.2.1", firefox); alert != "" {
+		t.Error("alerted on first sign in")
+	}
+	// A browser update from nearby is the same device and region
+	if _, alert := login("192.0.7.9", "Mozilla/5.0 (X11; Linux x86_64; rv:141.0) Gecko/20100101 Firefox/141.0"); alert != "" {
+		t.Error("alerted on browser update")
+	}
+	if _, alert := login("192.0.2.1", "Mozilla/5.0 (iPhone; CPU iPhone OS 18_0 like Mac OS X) Safari/604.1"); alert == "" {
+		t.Error("no alert for new device")
+	}
+	session, alert := login("198.51.100.4", firefox)
+	if alert == "" {
+		t.Fatal("no alert for new region")
+	}
+	row, _ := db_open("db/sessions.db").row("select reason from alerts where id=?", alert)
+	if row["reason"] != "region" {
+		t.Errorf("reason %v", row)
+	}
+
+	// This wasn't me
+	w := pairing_test_post(web_login_denied, `{"alert":"`+alert+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("denied: %d %s", w.Code, w.Body)
+	}
+	if user_by_login(session) != nil {
+		t.Error("denied session still signed in")
+	}
+	if login_review(user) == nil {
+		t.Error("no review asked for")
+	}
+	if w = pairing_test_post(web_login_denied, `{"alert":"`+alert+`"}`); w.Code != http.StatusGone {
+		t.Errorf("denied twice: %d", w.Code)
+	}
+	// The denied region is forgotten, so signing in from it alerts again
+	if _, alert = login("198.51.100.4", firefox); alert == "" {
+		t.Error("denied region still known")
+	}
+}
+
+func TestLoginRegion(t *testing.T) {
+	for address, region := range map[string]string{
+		"192.0.2.77":        "192.0.0.0/16",
+		"::ffff:192.0.2.77": "192.0.0.0/16",
+		"2001:db8:1:2::5":   "2001:db8::/32",
+		"not an ip address": "not an ip address",
+	} {
+		if got := login_region(address); got != region {
+			t.Errorf("login_region(%q) = %q, want %q", address, got, region)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// Mochi server: Analytics
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// The owner of a public entity can see how often its pages are viewed.
+// Views of an entity's public actions are counted per entity, action and
+// day, along with the number of distinct visitors. A visitor is a hash of
+// their address and user agent under a salt that changes daily and is
+// never stored, so visitors can't be followed from one day to the next;
+// the hashes themselves are kept in memory only until the day is over, and
+// only up to analytics_visitors of them: past that, a visitor not already
+// seen is counted but not remembered, so may be counted again.
+// Nothing else about a view is recorded. Views by the entity's owner, and
+// from browsers sending Do Not Track or Global Privacy Control, aren't
+// counted at all, nor are views of entities whose owner has turned
+// analytics off for them. Counts are written out every minute, and kept
+// for the analytics_retention setting's number of days.
+
+const (
+	analytics_flush    = time.Minute
+	analytics_visitors = 100000
+)
+
+// analytics_key is one entity, action and day being counted
+type analytics_key struct {
+	entity string
+	action string
+	day    string
+}
+
+// analytics_count is the pending counts for a key
+type analytics_count struct {
+	views    int64
+	visitors int64
+}
+
+var (
+	analytics_day      string
+	analytics_salt     string
+	analytics_seen     = map[string]bool{}
+	analytics_pending  = map[analytics_key]*analytics_count{}
+	analytics_disabled = map[string]bool{}
+	analytics_loaded   bool
+	analytics_lock     sync.Mutex
+)
+
+var api_analytics = sls.FromStringDict(sl.String("mochi.analytics"), sl.StringDict{
+	"enabled": sl.NewBuiltin("mochi.analytics.enabled", api_analytics_enabled),
+	"query":   sl.NewBuiltin("mochi.analytics.query", api_analytics_query),
+	"set":     sl.NewBuiltin("mochi.analytics.set", api_analytics_set),
+})
+
+// analytics_db opens the analytics database, creating its tables if needed
+func analytics_db() *DB {
+	db := db_open("db/analytics.db")
+	db.exec("create table if not exists daily (entity text not null, action text not null, day text not null, views integer not null default 0, visitors integer not null default 0, primary key (entity, action, day))")
+	db.exec("create index if not exists daily_day on daily(day)")
+	db.exec("create table if not exists disabled (entity text not null primary key)")
+	return db
+}
+
+// setting_analytics_enabled returns whether views are counted at all
+func setting_analytics_enabled() bool {
+	return setting_get("analytics_enabled", "true") == "true"
+}
+
+// analytics_day_of returns the UTC day of a Unix time
+func analytics_day_of(t int64) string {
+	return time.Unix(t, 0).UTC().Format("2006-01-02")
+}
+
+// analytics_untracked reports whether a browser has asked not to be tracked
+func analytics_untracked(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// analytics_view counts a view of a public action of an entity
+func analytics_view(c *gin.Context, e *Entity, action string, viewer, owner *User) {
+	if e == nil || c.Request.Method != http.MethodGet || analytics_untracked(c.Request) || !setting_analytics_enabled() {
+		return
+	}
+	if viewer != nil && owner != nil && viewer.UID == owner.UID {
+		return
+	}
+
+	hash := sha256.New()
+	analytics_lock.Lock()
+	defer analytics_lock.Unlock()
+	if !analytics_loaded {
+		analytics_load()
+	}
+	if analytics_disabled[e.ID] {
+		return
+	}
+	day := analytics_day_of(now())
+	if day != analytics_day {
+		analytics_day = day
+		analytics_salt = random_alphanumeric(32)
+		analytics_seen = map[string]bool{}
+	}
+	hash.Write([]byte(analytics_salt + "\x00" + e.ID + "\x00" + rate_limit_client_ip(c) + "\x00" + c.GetHeader("User-Agent")))
+	visitor := hex.EncodeToString(hash.Sum(nil))
+
+	key := analytics_key{entity: e.ID, action: action, day: day}
+	count := analytics_pending[key]
+	if count == nil {
+		count = &analytics_count{}
+		analytics_pending[key] = count
+	}
+	count.views++
+	if !analytics_seen[visitor+"\x00"+action] {
+		if len(analytics_seen) < analytics_visitors {
+			analytics_seen[visitor+"\x00"+action] = true
+		}
+		count.visitors++
+	}
+}
+
+// analytics_load reads the entities analytics is turned off for. The
+// caller holds analytics_lock.
+func analytics_load() {
+	rows, _ := analytics_db().rows("select entity from disabled")
+	analytics_disabled = make(map[string]bool, len(rows))
+	for _, r := range rows {
+		if id, _ := r["entity"].(string); id != "" {
+			analytics_disabled[id] = true
+		}
+	}
+	analytics_loaded = true
+}
+
+// analytics_write adds the pending counts to the daily rollups
+func analytics_write() {
+	analytics_lock.Lock()
+	pending := analytics_pending
+	analytics_pending = map[analytics_key]*analytics_count{}
+	analytics_lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	db := analytics_db()
+	for k, c := range pending {
+		db.exec("insert into daily (entity, action, day, views, visitors) values (?, ?, ?, ?, ?) on conflict (entity, action, day) do update set views=views+excluded.views, visitors=visitors+excluded.visitors", k.entity, k.action, k.day, c.views, c.visitors)
+	}
+}
+
+// analytics_expire deletes rollups older than the retention period
+func analytics_expire() {
+	days := atoi(setting_get("analytics_retention", "365"), 365)
+	analytics_db().exec("delete from daily where day < ?", analytics_day_of(now()-days*86400))
+}
+
+// analytics_forget deletes the counts for an entity
+func analytics_forget(entity string) {
+	analytics_lock.Lock()
+	for k := range analytics_pending {
+		if k.entity == entity {
+			delete(analytics_pending, k)
+		}
+	}
+	analytics_lock.Unlock()
+	if file_exists(filepath.Join(data_dir, "db", "analytics.db")) {
+		analytics_db().exec("delete from daily where entity=?", entity)
+	}
+}
+
+// analytics_manager writes out counts every minute, and expires old ones
+// daily
+func analytics_manager() {
+	expired := int64(0)
+	for range time.Tick(analytics_flush) {
+		analytics_write()
+		if now()-expired >= 86400 {
+			analytics_expire()
+			expired = now()
+		}
+	}
+}
+
+// analytics_owned returns an entity if the calling user owns it
+func analytics_owned(t *sl.Thread, id string) *Entity {
+	user, _ := t.Local("user").(*User)
+	e := entity_by_any(id)
+	if user == nil || e == nil || e.User != user.UID {
+		return nil
+	}
+	return e
+}
+
+// mochi.analytics.query(entity, days?, action?) -> list: Daily view counts
+// for an entity the user owns over the last days days, 30 by default, most
+// recent first. Each is a dict of day ("YYYY-MM-DD", UTC), action, views and
+// visitors. Counts reach the database every minute, so today's lag a little.
+func api_analytics_query(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, action string
+	days := 30
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &id, "days?", &days, "action?", &action); err != nil {
+		return nil, err
+	}
+	e := analytics_owned(t, id)
+	if e == nil {
+		return sl_error(fn, "entity not found")
+	}
+	if days < 1 || days > 3660 {
+		return sl_error(fn, "invalid days")
+	}
+
+	since := analytics_day_of(now() - int64(days-1)*86400)
+	var rows []map[string]any
+	var err error
+	if action == "" {
+		rows, err = analytics_db().rows("select day, action, views, visitors from daily where entity=? and day>=? order by day desc, action", e.ID, since)
+	} else {
+		rows, err = analytics_db().rows("select day, action, views, visitors from daily where entity=? and day>=? and action=? order by day desc", e.ID, since, action)
+	}
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.analytics.enabled(entity) -> bool: Whether views of an entity the
+// user owns are counted
+func api_analytics_enabled(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &id); err != nil {
+		return nil, err
+	}
+	e := analytics_owned(t, id)
+	if e == nil {
+		return sl_error(fn, "entity not found")
+	}
+	disabled, _ := analytics_db().exists("select 1 from disabled where entity=?", e.ID)
+	return sl.Bool(!disabled), nil
+}
+
+// mochi.analytics.set(entity, enabled) -> None: Turn counting views of an
+// entity the user owns on or off. Turning it off also deletes the counts
+// kept so far.
+func api_analytics_set(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	var enabled bool
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &id, "enabled", &enabled); err != nil {
+		return nil, err
+	}
+	e := analytics_owned(t, id)
+	if e == nil {
+		return sl_error(fn, "entity not found")
+	}
+
+	db := analytics_db()
+	analytics_lock.Lock()
+	if enabled {
+		db.exec("delete from disabled where entity=?", e.ID)
+	} else {
+		db.exec("replace into disabled (entity) values (?)", e.ID)
+	}
+	analytics_loaded = false
+	analytics_lock.Unlock()
+	if !enabled {
+		analytics_forget(e.ID)
+	}
+	return sl.None, nil
+}
@@ -0,0 +1,93 @@
+// Mochi server: Analytics tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+// analytics_test_view views an entity page from an address
+func analytics_test_view(e *Entity, address string, headers map[string]string, viewer, owner *User) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/"+e.Fingerprint, nil)
+	c.Request.RemoteAddr = address + ":1234"
+	for k, v := range headers {
+		c.Request.Header.Set(k, v)
+	}
+	analytics_view(c, e, ":person", viewer, owner)
+}
+
+func TestAnalytics(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	owner, _ := user_create("owner@example.com")
+	e, err := entity_create(owner, "person", "Owner", "public", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	analytics_test_view(e, "192.0.2.1", nil, nil, owner)
+	analytics_test_view(e, "192.0.2.1", nil, nil, owner)
+	analytics_test_view(e, "192.0.2.2", nil, nil, owner)
+	analytics_test_view(e, "192.0.2.3", map[string]string{"DNT": "1"}, nil, owner)
+	analytics_test_view(e, "192.0.2.4", map[string]string{"Sec-GPC": "1"}, nil, owner)
+	analytics_test_view(e, "192.0.2.5", nil, owner, owner)
+	analytics_write()
+
+	thread := &sl.Thread{}
+	thread.SetLocal("user", owner)
+	query := sl.NewBuiltin("mochi.analytics.query", api_analytics_query)
+	result, err := api_analytics_query(thread, query, sl.Tuple{sl.String(e.ID)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, _ := sl_decode(result).([]any)
+	if len(rows) != 1 {
+		t.Fatalf("rows %v", rows)
+	}
+	row, _ := rows[0].(map[string]any)
+	if row["day"] != analytics_day_of(now()) || row["action"] != ":person" || row["views"] != int64(3) || row["visitors"] != int64(2) {
+		t.Errorf("row %v, want 3 views by 2 visitors today", row)
+	}
+
+	// Visitors past the cap are counted but not remembered
+	analytics_lock.Lock()
+	for i := len(analytics_seen); i < analytics_visitors; i++ {
+		analytics_seen[strconv.Itoa(i)] = true
+	}
+	analytics_lock.Unlock()
+	analytics_test_view(e, "192.0.2.7", nil, nil, owner)
+	if n := len(analytics_seen); n != analytics_visitors {
+		t.Errorf("%d visitors remembered, want %d", n, analytics_visitors)
+	}
+
+	// Nobody else may read them
+	other := create_permission_test_user(t, "other")
+	thread.SetLocal("user", other)
+	if _, err := api_analytics_query(thread, query, sl.Tuple{sl.String(e.ID)}, nil); err == nil {
+		t.Error("another user read the counts")
+	}
+
+	// Turning analytics off deletes the counts and stops counting
+	thread.SetLocal("user", owner)
+	set := sl.NewBuiltin("mochi.analytics.set", api_analytics_set)
+	if _, err := api_analytics_set(thread, set, sl.Tuple{sl.String(e.ID), sl.False}, nil); err != nil {
+		t.Fatal(err)
+	}
+	analytics_test_view(e, "192.0.2.6", nil, nil, owner)
+	analytics_write()
+	if n := analytics_db().integer("select count(*) from daily where entity=?", e.ID); n != 0 {
+		t.Errorf("%d rows after turning analytics off", n)
+	}
+}
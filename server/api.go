@@ -12,17 +12,20 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	gotime "time"
 
 	cbor "github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
 	p2p_peer "github.com/libp2p/go-libp2p/core/peer"
 	sl "go.starlark.net/starlark"
 	"go.starlark.net/starlarkjson"
@@ -42,10 +45,15 @@ func init() {
 		"mochi": sls.FromStringDict(sl.String("mochi"), sl.StringDict{
 			"access":     api_access,
 			"account":    api_account,
+			"activity":   api_activity,
 			"ai":         api_ai,
+			"analytics":  api_analytics,
 			"app":        api_app,
 			"attachment": api_attachment,
 			"broadcast":  api_broadcast,
+			"bus":        api_bus,
+			"comment":    api_comment,
+			"compliance": api_compliance,
 			"crypto": sls.FromStringDict(sl.String("mochi.crypto"), sl.StringDict{
 				"equal": sl.NewBuiltin("mochi.crypto.equal", api_crypto_equal),
 				"hash": sls.FromStringDict(sl.String("mochi.crypto.hash"), sl.StringDict{
@@ -55,22 +63,36 @@ func init() {
 					"sha256": sl.NewBuiltin("mochi.crypto.hmac.sha256", api_crypto_hmac_sha256),
 				}),
 			}),
-			"db":          api_db,
-			"decode":      api_decode,
-			"directory":   api_directory,
-			"document":    api_document,
-			"domain":      api_domain,
-			"encode":      api_encode,
-			"entity":      api_entity,
-			"file":        api_file,
-			"git":         api_git,
-			"group":       api_group,
-			"interests":   api_interests,
-			"log":         api_log,
-			"message":     api_message,
-			"permission":  api_permission,
-			"qid":         api_qid,
-			"remote":      api_remote,
+			"cache":        api_cache,
+			"db":           api_db,
+			"decode":       api_decode,
+			"directory":    api_directory,
+			"document":     api_document,
+			"domain":       api_domain,
+			"encode":       api_encode,
+			"entity":       api_entity,
+			"ephemeral":    api_ephemeral,
+			"file":         api_file,
+			"form":         api_form,
+			"format":       api_format,
+			"git":          api_git,
+			"group":        api_group,
+			"history":      api_history,
+			"importer":     api_importer,
+			"interests":    api_interests,
+			"invite":       api_invite,
+			"label":        sl.NewBuiltin("mochi.label", api_label),
+			"log":          api_log,
+			"message":      api_message,
+			"moderation":   api_moderation,
+			"notification": api_notification,
+			"permission":   api_permission,
+			"presence":     api_presence,
+			"qid":          api_qid,
+			"ref":          api_ref,
+			"regex":        api_regex,
+			"remote":       api_remote,
+			"retention":    api_retention,
 			"rss": sls.FromStringDict(sl.String("mochi.rss"), sl.StringDict{
 				"fetch": sl.NewBuiltin("mochi.rss.fetch", api_rss_fetch),
 			}),
@@ -80,37 +102,59 @@ func init() {
 				"bytes":        sl.NewBuiltin("mochi.random.bytes", api_random_bytes),
 				"choice":       sl.NewBuiltin("mochi.random.choice", api_random_choice),
 				"integer":      sl.NewBuiltin("mochi.random.integer", api_random_integer),
+				"ulid":         sl.NewBuiltin("mochi.random.ulid", api_random_ulid),
 				"unambiguous":  sl.NewBuiltin("mochi.random.unambiguous", api_random_unambiguous),
+				"uuid":         sl.NewBuiltin("mochi.random.uuid", api_random_uuid),
 			}),
+			"schema": api_schema,
 			"server": sls.FromStringDict(sl.String("mochi.server"), sl.StringDict{
 				"id":          sl.NewBuiltin("mochi.server.id", api_server_id),
 				"fingerprint": sl.NewBuiltin("mochi.server.fingerprint", api_server_fingerprint),
 				"counts":      sl.NewBuiltin("mochi.server.counts", api_server_counts),
+				"expiry":      sl.NewBuiltin("mochi.server.expiry", api_server_expiry),
 				"network":     sl.NewBuiltin("mochi.server.network", api_server_network),
 				"peers":       sl.NewBuiltin("mochi.server.peers", api_server_peers),
 				"started":     sl.NewBuiltin("mochi.server.started", api_server_started),
+				"transfer":    sl.NewBuiltin("mochi.server.transfer", api_server_transfer),
 				"uptime":      sl.NewBuiltin("mochi.server.uptime", api_server_uptime),
 				"version":     sl.NewBuiltin("mochi.server.version", api_server_version),
+				"cors": sls.FromStringDict(sl.String("mochi.server.cors"), sl.StringDict{
+					"accept":  sl.NewBuiltin("mochi.server.cors.accept", api_server_cors_accept),
+					"decline": sl.NewBuiltin("mochi.server.cors.decline", api_server_cors_decline),
+					"list":    sl.NewBuiltin("mochi.server.cors.list", api_server_cors_list),
+				}),
+				"nearby": sls.FromStringDict(sl.String("mochi.server.nearby"), sl.StringDict{
+					"accept":  sl.NewBuiltin("mochi.server.nearby.accept", api_server_nearby_accept),
+					"decline": sl.NewBuiltin("mochi.server.nearby.decline", api_server_nearby_decline),
+					"list":    sl.NewBuiltin("mochi.server.nearby.list", api_server_nearby_list),
+				}),
 				"update": sls.FromStringDict(sl.String("mochi.server.update"), sl.StringDict{
 					"info":    sl.NewBuiltin("mochi.server.update.info", api_server_update_info),
 					"install": sl.NewBuiltin("mochi.server.update.install", api_server_update_install),
 				}),
 			}),
 			"service": sls.FromStringDict(sl.String("mochi.service"), sl.StringDict{
-				"call":   sl.NewBuiltin("mochi.service.call", api_service_call),
-				"exists": sl.NewBuiltin("mochi.service.exists", api_service_exists),
+				"call":       sl.NewBuiltin("mochi.service.call", api_service_call),
+				"capability": sl.NewBuiltin("mochi.service.capability", api_service_capability),
+				"exists":     sl.NewBuiltin("mochi.service.exists", api_service_exists),
+				"verify":     sl.NewBuiltin("mochi.service.verify", api_service_verify),
 			}),
 			"setting": api_setting,
+			"share":   api_share,
 			"stream":  &stream_module{},
 			"text":    api_text,
+			"ticket":  api_ticket,
 			"token":   api_token,
 			"user":    api_user,
 			"time": sls.FromStringDict(sl.String("mochi.time"), sl.StringDict{
-				"local": sl.NewBuiltin("mochi.time.local", api_time_local),
-				"now":   sl.NewBuiltin("mochi.time.now", api_time_now),
-				"parse": sl.NewBuiltin("mochi.time.parse", api_time_parse),
+				"format": sl.NewBuiltin("mochi.time.format", api_time_format),
+				"local":  sl.NewBuiltin("mochi.time.local", api_time_local),
+				"now":    sl.NewBuiltin("mochi.time.now", api_time_now),
+				"parse":  sl.NewBuiltin("mochi.time.parse", api_time_parse),
 			}),
-			"uid": sl.NewBuiltin("mochi.uid", api_uid),
+			"trash":  api_trash,
+			"uid":    sl.NewBuiltin("mochi.uid", api_uid),
+			"unfurl": sl.NewBuiltin("mochi.unfurl", api_unfurl),
 			"url": sls.FromStringDict(sl.String("mochi.url"), sl.StringDict{
 				"delete":  sl.NewBuiltin("mochi.url.delete", api_url_request),
 				"get":     sl.NewBuiltin("mochi.url.get", api_url_request),
@@ -120,6 +164,7 @@ func init() {
 				"put":     sl.NewBuiltin("mochi.url.put", api_url_request),
 			}),
 			"webpush":   api_webpush,
+			"sse":       api_sse,
 			"websocket": api_websocket,
 		}),
 	}
@@ -146,21 +191,23 @@ func api_crypto_hash_sha256(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 	return sl.String(hex.EncodeToString(sum[:])), nil
 }
 
-// mochi.crypto.hmac.sha256(key, message) -> string: Hex-encoded HMAC-SHA256 digest
+// mochi.crypto.hmac.sha256(key, message) -> string: Hex-encoded HMAC-SHA256
+// digest. Key and message may each be a string or bytes, so a signing key
+// from mochi.random.bytes can be used directly.
 func api_crypto_hmac_sha256(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) != 2 {
-		return sl_error(fn, "syntax: <key: string>, <message: string>")
+		return sl_error(fn, "syntax: <key: string|bytes>, <message: string|bytes>")
 	}
-	key, ok := sl.AsString(args[0])
+	key, ok := encode_data(args[0])
 	if !ok {
-		return sl_error(fn, "key must be a string")
+		return sl_error(fn, "key must be a string or bytes")
 	}
-	message, ok := sl.AsString(args[1])
+	message, ok := encode_data(args[1])
 	if !ok {
-		return sl_error(fn, "message must be a string")
+		return sl_error(fn, "message must be a string or bytes")
 	}
-	mac := hmac.New(sha256.New, []byte(key))
-	mac.Write([]byte(message))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
 	return sl.String(hex.EncodeToString(mac.Sum(nil))), nil
 }
 
@@ -292,6 +339,34 @@ func api_random_unambiguous(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 	return sl_encode(random_unambiguous(length)), nil
 }
 
+// mochi.random.ulid() -> string: Generate a ULID — 26 Crockford base32
+// characters whose first ten encode the millisecond timestamp — so IDs sort
+// by creation time as plain strings.
+func api_random_ulid(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 0 {
+		return sl_error(fn, "syntax: no arguments")
+	}
+	id, err := ulid(gotime.Now())
+	if err != nil {
+		return sl_error(fn, "random read failed: %v", err)
+	}
+	return sl.String(id), nil
+}
+
+// mochi.random.uuid() -> string: Generate a random (version 4) UUID in the
+// canonical hyphenated form, for interoperating with systems that expect
+// one. Mochi's own IDs come from mochi.uid().
+func api_random_uuid(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 0 {
+		return sl_error(fn, "syntax: no arguments")
+	}
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return sl_error(fn, "random read failed: %v", err)
+	}
+	return sl.String(u.String()), nil
+}
+
 // mochi.service.exists(service) -> bool: Report whether any installed app handles the named service for the current user
 func api_service_exists(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) != 1 {
@@ -305,7 +380,9 @@ func api_service_exists(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 	return sl.Bool(app_for_service(user, service) != nil), nil
 }
 
-// mochi.service.call(service, function, params...) -> any: Call a function in another app
+// mochi.service.call(service, function, params...) -> any: Call a function in another app.
+// If the function declares an input or output schema in app.json, parameters
+// and result that don't satisfy it fail the call with the list of failures.
 func api_service_call(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) < 2 {
 		return sl_error(fn, "syntax: <service: string>, <function: string>, [parameters: variadic any]")
@@ -356,11 +433,21 @@ func api_service_call(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.T
 		return sl_error(fn, "unknown function %q for service %q", function, service)
 	}
 
-	// Enforce permission if declared on the function (skip when app calls its own service)
-	if f.Permission != "" && caller_id != a.id {
-		if !permission_granted(user, caller_id, f.Permission) {
-			return sl_error(fn, "permission %q required to call %s/%s", f.Permission, service, function)
+	// Enforce permission if declared on the function, of the caller and every
+	// app the call came through (skip for an app's own service); see
+	// service_capabilities.go
+	c := capability_create(t, caller_id, user, service, function, f.Permission)
+	if f.Permission != "" && slices.ContainsFunc(c.apps(), func(app string) bool { return app != a.id }) {
+		for _, app := range c.apps() {
+			if app != a.id && !permission_granted(user, app, f.Permission) {
+				c.audit(false)
+				if app != caller_id {
+					return sl_error(fn, "permission %q required to call %s/%s, which app %q the call came through lacks", f.Permission, service, function, app)
+				}
+				return sl_error(fn, "permission %q required to call %s/%s", f.Permission, service, function)
+			}
 		}
+		c.audit(true)
 	}
 
 	// Refuse service calls into an account whose per-user replication
@@ -371,6 +458,17 @@ func api_service_call(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.T
 		return sl_error(fn, "account %q is still being set up", user.UID)
 	}
 
+	// Check the parameters against the function's declared input
+	if f.Input != nil {
+		params, err := schema_parameters(args[2:], kwargs)
+		if err != nil {
+			return sl_error(fn, "%s/%s: %v", service, function, err)
+		}
+		if failures := schema_validate(f.Input, params); len(failures) > 0 {
+			return sl_error(fn, "%s", schema_failures(fmt.Sprintf("input to %s/%s", service, function), failures))
+		}
+	}
+
 	// Run first-time setup for target service app (grants default permissions)
 	app_user_setup(user, a.id)
 
@@ -380,13 +478,18 @@ func api_service_call(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.T
 	s.set("user", t.Local("user").(*User))
 	s.set("owner", t.Local("owner").(*User))
 	s.set("depth", depth+1)
+	s.set("capability", c)
+	// The callee runs within what is left of the caller's deadline, so a
+	// chain of service calls cannot outlive the request that started it
+	s.timeout = starlark_remaining(t)
 
 	// Build call args based on target app's architecture version
 	var call_args sl.Tuple
 	if av.Architecture.Version >= 3 {
-		// v3+: prepend context dict with caller app ID
-		context := sl.NewDict(1)
+		// v3+: prepend context dict with caller app ID and capability
+		context := sl.NewDict(2)
 		context.SetKey(sl.String("app"), sl.String(caller_id))
+		context.SetKey(sl.String("capability"), sl.String(c.token()))
 		if len(args) > 2 {
 			call_args = make(sl.Tuple, 0, len(args)-1)
 			call_args = append(call_args, context)
@@ -406,9 +509,19 @@ func api_service_call(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.T
 	result, err = s.call(f.Function, call_args, kwargs)
 	if err != nil {
 		info("mochi.service.call() error: %v", err)
+		return result, err
 	}
 
-	return result, err
+	// A result that breaks the declared output is the callee's bug, so the
+	// call fails rather than hand the caller something it can't rely on
+	if f.Output != nil {
+		if failures := schema_validate(f.Output, sl_decode(result)); len(failures) > 0 {
+			info("mochi.service.call() %s/%s returned invalid output: %v", service, function, failures)
+			return sl_error(fn, "%s", schema_failures(fmt.Sprintf("output from %s/%s", service, function), failures))
+		}
+	}
+
+	return result, nil
 }
 
 // service_call_as_server invokes a service function from the running Mochi
@@ -450,6 +563,12 @@ func service_call_as_server(target_user_uid string, service string, function str
 		return fmt.Errorf("unknown function %q for service %q", function, service)
 	}
 
+	if f.Input != nil {
+		if failures := schema_validate(f.Input, sl_decode(sl_encode(args))); len(failures) > 0 {
+			return errors.New(schema_failures(fmt.Sprintf("input to %s/%s", service, function), failures))
+		}
+	}
+
 	app_user_setup(user, a.id)
 
 	s := av.starlark()
@@ -457,12 +576,16 @@ func service_call_as_server(target_user_uid string, service string, function str
 	s.set("user", user)
 	s.set("owner", user)
 	s.set("depth", 1)
+	c := &Capability{User: user.UID, Service: service, Function: function, Permission: f.Permission, Expires: now() + capability_min_lifetime}
+	c.ID, _ = ulid(gotime.Now())
+	s.set("capability", c)
 
 	var call_args sl.Tuple
 	if av.Architecture.Version >= 3 {
-		ctx := sl.NewDict(2)
+		ctx := sl.NewDict(3)
 		ctx.SetKey(sl.String("app"), sl.String(""))
 		ctx.SetKey(sl.String("_server"), sl.Bool(true))
+		ctx.SetKey(sl.String("capability"), sl.String(c.token()))
 		call_args = sl.Tuple{ctx}
 	}
 
@@ -646,17 +769,17 @@ func api_server_network(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 
 // mochi.server.counts() -> dict: Account totals on this server.
 //
-//	users     int — accounts in users.db
-//	entities  int — entities across all accounts
+//	users     int — accounts in users.db, other than guests
+//	entities  int — entities across those accounts
 func api_server_counts(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	users := int64(0)
 	entities := int64(0)
 	if file_exists(filepath.Join(data_dir, "db", "users.db")) {
 		udb := db_open("db/users.db")
-		if row, _ := udb.row("select count(*) as c from users"); row != nil {
+		if row, _ := udb.row("select count(*) as c from users where role != 'guest'"); row != nil {
 			users = row_int(row, "c")
 		}
-		if row, _ := udb.row("select count(*) as c from entities"); row != nil {
+		if row, _ := udb.row("select count(*) as c from entities where user not in (select uid from users where role='guest')"); row != nil {
 			entities = row_int(row, "c")
 		}
 	}
@@ -931,38 +1054,59 @@ func api_time_local(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tup
 		if !ok {
 			return sl_error(fn, "format must be a string")
 		}
-		switch f {
-		case "datetime":
-			format = gotime.DateTime
-		case "date":
-			format = gotime.DateOnly
-		case "time":
-			format = gotime.TimeOnly
-		case "rfc822":
-			format = gotime.RFC1123Z
-		case "rfc3339":
-			format = gotime.RFC3339
-		default:
+		format, ok = time_layout(f)
+		if !ok {
 			return sl_error(fn, "unknown format %q (valid: datetime, date, time, rfc822, rfc3339)", f)
 		}
 	}
 
-	// Get user's timezone
 	user, _ := t.Local("user").(*User)
-	timezone := "UTC"
-	if user != nil {
-		timezone = user_preference_get(user, "timezone", "UTC")
+	return sl.String(gotime.Unix(timestamp, 0).In(user_location(user)).Format(format)), nil
+}
+
+// time_layout returns the Go layout of a named format of mochi.time.local
+func time_layout(name string) (string, bool) {
+	switch name {
+	case "datetime":
+		return gotime.DateTime, true
+	case "date":
+		return gotime.DateOnly, true
+	case "time":
+		return gotime.TimeOnly, true
+	case "rfc822":
+		return gotime.RFC1123Z, true
+	case "rfc3339":
+		return gotime.RFC3339, true
+	}
+	return "", false
+}
+
+// mochi.time.format(timestamp, format) -> string: Format a Unix timestamp in
+// the user's timezone, with one of mochi.time.local's named formats or a
+// strftime pattern such as "%d %B %Y, %H:%M". Month names and %p follow the
+// user's language.
+func api_time_format(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var timestamp int64
+	var format string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "timestamp", &timestamp, "format", &format); err != nil {
+		return sl_error(fn, "%v", err)
 	}
-	if timezone == "auto" {
-		timezone = "UTC"
+
+	user, _ := t.Local("user").(*User)
+	loc := user_location(user)
+	if !strings.Contains(format, "%") {
+		layout, ok := time_layout(format)
+		if !ok {
+			return sl_error(fn, "unknown format %q (valid: datetime, date, time, rfc822, rfc3339, or a strftime pattern)", format)
+		}
+		return sl.String(gotime.Unix(timestamp, 0).In(loc).Format(layout)), nil
 	}
 
-	loc, err := gotime.LoadLocation(timezone)
+	s, err := time_format(thread_language(t), loc, timestamp, format)
 	if err != nil {
-		loc = gotime.UTC
+		return sl_error(fn, "%v", err)
 	}
-
-	return sl.String(gotime.Unix(timestamp, 0).In(loc).Format(format)), nil
+	return sl.String(s), nil
 }
 
 // mochi.time.now() -> int: Get the current Unix timestamp
@@ -1028,19 +1172,7 @@ func api_time_parse(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tup
 
 	// Naive format — assume the user's timezone (mirroring local's direction)
 	user, _ := t.Local("user").(*User)
-	timezone := "UTC"
-	if user != nil {
-		timezone = user_preference_get(user, "timezone", "UTC")
-	}
-	if timezone == "auto" {
-		timezone = "UTC"
-	}
-	loc, err := gotime.LoadLocation(timezone)
-	if err != nil {
-		loc = gotime.UTC
-	}
-
-	parsed, err := gotime.ParseInLocation(format, s, loc)
+	parsed, err := gotime.ParseInLocation(format, s, user_location(user))
 	if err != nil {
 		return sl.None, nil
 	}
@@ -1064,6 +1196,27 @@ func header_to_map(h http.Header) map[string]string {
 }
 
 // mochi.url.get/post/put/patch/delete(url, options?, headers?, body?) -> dict: Make HTTP request
+//
+// Options (all optional):
+//   - timeout: seconds for the whole request, default 30, at most 300
+//   - retries: repeat up to 5 times on a transport error, 429, 502, 503 or
+//     504, waiting Retry-After or an exponential backoff between attempts.
+//     POST and PATCH are retried only with an idempotency_key.
+//   - max_size: response size cap in bytes, at most 100 MB. A longer body is
+//     cut short and the response carries "truncated": True.
+//   - file: stream the response body into this path in the app's file
+//     storage instead of returning it; the response carries "file" and
+//     "size" and an empty "body".
+//   - upload: stream the request body from this path in the app's file
+//     storage; the body argument is ignored.
+//   - encoding: "json" (default for a dictionary body), "form" for
+//     application/x-www-form-urlencoded, or "multipart" for
+//     multipart/form-data, where a value {"file": path, "name": filename,
+//     "type": content type} uploads a file from the app's storage.
+//   - tls: "insecure" skips certificate verification, permitted only for
+//     hosts the administrator lists in [url] insecure.
+//
+// A request that never reaches the server returns status 0 with "error" set.
 func api_url_request(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) < 1 || len(args) > 4 {
 		return sl_error(fn, "syntax: <url: string>, [options: dictionary], [headers: dictionary], [body: string|dictionary]")
@@ -1086,20 +1239,7 @@ func api_url_request(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 	}
 
 	// Collect all granted url: domains for redirect validation
-	var url_domains []string
-	if app != nil {
-		user, _ := t.Local("user").(*User)
-		if user != nil && !app_is_internal(app) {
-			db := db_user(user, "user")
-			db.permissions_setup()
-			rows, _ := db.rows("select object from permissions where app=? and permission='url' and granted=1", app.id)
-			for _, row := range rows {
-				if obj, ok := row["object"].(string); ok {
-					url_domains = append(url_domains, obj)
-				}
-			}
-		}
-	}
+	url_domains := url_domains_granted(t)
 
 	var options map[string]string
 	if len(args) > 1 {
@@ -1110,6 +1250,9 @@ func api_url_request(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 	if len(args) > 2 {
 		headers = sl_decode_strings(args[2])
 	}
+	if headers == nil {
+		headers = map[string]string{}
+	}
 
 	var body any
 	if len(args) > 3 {
@@ -1128,9 +1271,6 @@ func api_url_request(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 		if k == "idempotency_key" {
 			if v, ok := sl.AsString(kw[1]); ok && v != "" {
 				idempotency_key = v
-				if headers == nil {
-					headers = map[string]string{}
-				}
 				headers["Idempotency-Key"] = v
 			}
 		}
@@ -1148,15 +1288,38 @@ func api_url_request(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 		}
 	}
 
+	make_body, err := url_body_factory(t, options, headers, body)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
 	parts := strings.Split(fn.Name(), ".")
-	r, err := url_request(starlark_context(t), parts[len(parts)-1], url, options, headers, body, url_domains...)
+	method := parts[len(parts)-1]
+	retries := url_retries(options)
+	if !url_idempotent(method) && idempotency_key == "" {
+		retries = 0
+	}
+	r, err := url_request_retry(starlark_context(t), method, url, options, headers, make_body, retries, url_domains...)
 	if err != nil {
-		return sl_encode(map[string]any{"status": 0, "headers": map[string]string{}, "body": ""}), nil
+		return sl_encode(map[string]any{"status": 0, "headers": map[string]string{}, "body": "", "error": err.Error()}), nil
 	}
 	defer r.Body.Close()
 
-	data, _ := io.ReadAll(io.LimitReader(r.Body, url_max_response_size))
-	response := map[string]any{"status": r.StatusCode, "headers": header_to_map(r.Header), "body": string(data)}
+	limit := url_max_size(options)
+	if file := options["file"]; file != "" {
+		size, truncated, err := url_file_save(user, app, file, r.Body, limit)
+		if err != nil {
+			return sl_error(fn, "%v", err)
+		}
+		return sl_encode(map[string]any{"status": r.StatusCode, "headers": header_to_map(r.Header), "body": "", "file": file, "size": size, "truncated": truncated}), nil
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	truncated := int64(len(data)) > limit
+	if truncated {
+		data = data[:limit]
+	}
+	response := map[string]any{"status": r.StatusCode, "headers": header_to_map(r.Header), "body": string(data), "truncated": truncated}
 
 	// Cache the response for future replays with the same key. Only when
 	// the request actually reached the server (StatusCode > 0) — network
@@ -1168,6 +1331,26 @@ func api_url_request(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 	return sl_encode(response), nil
 }
 
+// url_domains_granted returns the url: domains the calling app has been
+// granted, against which redirects are checked
+func url_domains_granted(t *sl.Thread) []string {
+	app, _ := t.Local("app").(*App)
+	user, _ := t.Local("user").(*User)
+	if app == nil || user == nil || app_is_internal(app) {
+		return nil
+	}
+	var domains []string
+	db := db_user(user, "user")
+	db.permissions_setup()
+	rows, _ := db.rows("select object from permissions where app=? and permission='url' and granted=1", app.id)
+	for _, row := range rows {
+		if obj, ok := row["object"].(string); ok {
+			domains = append(domains, obj)
+		}
+	}
+	return domains
+}
+
 const url_idempotency_ttl int64 = 3600 // 1 hour
 
 // idempotency_setup ensures the per-app `idempotency` cache table in the
@@ -7,6 +7,7 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/hex"
 
 	sl "go.starlark.net/starlark"
 	sls "go.starlark.net/starlarkstruct"
@@ -14,35 +15,83 @@ import (
 
 var api_encode = sls.FromStringDict(sl.String("mochi.encode"), sl.StringDict{
 	"base64": sl.NewBuiltin("mochi.encode.base64", api_encode_base64),
+	"hex":    sl.NewBuiltin("mochi.encode.hex", api_encode_hex),
 })
 
 var api_decode = sls.FromStringDict(sl.String("mochi.decode"), sl.StringDict{
 	"base64": sl.NewBuiltin("mochi.decode.base64", api_decode_base64),
+	"hex":    sl.NewBuiltin("mochi.decode.hex", api_decode_hex),
 })
 
-// mochi.encode.base64(data) -> string: Standard base64 encoding of data.
+// encode_data accepts the string-or-bytes argument every encoder takes
+func encode_data(v sl.Value) ([]byte, bool) {
+	switch x := v.(type) {
+	case sl.String:
+		return []byte(string(x)), true
+	case sl.Bytes:
+		return []byte(x), true
+	}
+	return nil, false
+}
+
+// mochi.encode.base64(data, url?) -> string: Standard base64 encoding of data.
 // Accepts either a string or bytes — useful for embedding binary content
-// (attachment data, generated files) in JSON.
+// (attachment data, generated files) in JSON. With url=True, uses the
+// unpadded URL-safe alphabet instead, for tokens placed in paths or query
+// strings.
 func api_encode_base64(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var value sl.Value
+	url := false
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "data", &value, "url?", &url); err != nil {
+		return sl_error(fn, "syntax: <data: string|bytes>, [url: boolean]")
+	}
+	data, ok := encode_data(value)
+	if !ok {
+		return sl_error(fn, "data must be a string or bytes")
+	}
+	if url {
+		return sl.String(base64.RawURLEncoding.EncodeToString(data)), nil
+	}
+	return sl.String(base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// mochi.encode.hex(data) -> string: Lower-case hexadecimal encoding of data,
+// a string or bytes.
+func api_encode_hex(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) != 1 {
 		return sl_error(fn, "syntax: <data: string|bytes>")
 	}
-	var data []byte
-	switch v := args[0].(type) {
-	case sl.String:
-		data = []byte(string(v))
-	case sl.Bytes:
-		data = []byte(v)
-	default:
+	data, ok := encode_data(args[0])
+	if !ok {
 		return sl_error(fn, "data must be a string or bytes")
 	}
-	return sl.String(base64.StdEncoding.EncodeToString(data)), nil
+	return sl.String(hex.EncodeToString(data)), nil
 }
 
-// mochi.decode.base64(text) -> bytes or None: Decode standard base64 text.
-// Returns None when the input is not valid base64, so callers can validate
-// untrusted input without a failed-call error.
+// mochi.decode.base64(text, url?) -> bytes or None: Decode standard base64
+// text, or with url=True the unpadded URL-safe form. Returns None when the
+// input is not valid base64, so callers can validate untrusted input without
+// a failed-call error.
 func api_decode_base64(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var text string
+	url := false
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "text", &text, "url?", &url); err != nil {
+		return sl_error(fn, "syntax: <text: string>, [url: boolean]")
+	}
+	encoding := base64.StdEncoding
+	if url {
+		encoding = base64.RawURLEncoding
+	}
+	data, err := encoding.DecodeString(text)
+	if err != nil {
+		return sl.None, nil
+	}
+	return sl.Bytes(data), nil
+}
+
+// mochi.decode.hex(text) -> bytes or None: Decode hexadecimal text in either
+// case. Returns None when the input is not valid hex.
+func api_decode_hex(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) != 1 {
 		return sl_error(fn, "syntax: <text: string>")
 	}
@@ -50,7 +99,7 @@ func api_decode_base64(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.
 	if !ok {
 		return sl_error(fn, "text must be a string")
 	}
-	data, err := base64.StdEncoding.DecodeString(text)
+	data, err := hex.DecodeString(text)
 	if err != nil {
 		return sl.None, nil
 	}
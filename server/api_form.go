@@ -0,0 +1,374 @@
+// Mochi server: Form validation
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	gotime "time"
+	"unicode/utf8"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// mochi.form.validate() checks a form's fields against declarative rules
+// and coerces them from the strings a browser sends to the types an app
+// wants, so actions don't each parse and check their inputs by hand. Rules
+// are a dictionary of field to rule, each of which may have:
+//
+//	required  the field must be present and not empty
+//	type      string (the default), integer, number, boolean, date
+//	          (YYYY-MM-DD), email, url, or list
+//	match     one of the server's named formats, such as "entity" or "id"
+//	min, max  the length of a string or list, or the value of a number
+//	pattern   a regular expression the whole value must match
+//	enum      a list of allowed values
+//	default   the value used when the field is absent
+//	trim      whether to trim surrounding whitespace, true by default
+//
+// Every field is checked, so a form can show all its errors at once. Fields
+// without a rule are left out of the values returned. Unlike mochi.schema,
+// which checks JSON documents as they are, this is for the flat fields of a
+// submitted form.
+
+const form_fields_max = 200 // Fields in a set of rules
+
+var api_form = sls.FromStringDict(sl.String("mochi.form"), sl.StringDict{
+	"csrf":     sl.NewBuiltin("mochi.form.csrf", api_form_csrf),
+	"validate": sl.NewBuiltin("mochi.form.validate", api_form_validate),
+	"verify":   sl.NewBuiltin("mochi.form.verify", api_form_verify),
+})
+
+var form_types = []string{"string", "integer", "number", "boolean", "date", "email", "url", "list"}
+
+// Formats of valid() a rule may match
+var form_matches = []string{"constant", "entity", "filename", "fingerprint", "function", "id", "line", "locale", "name", "natural", "version"}
+
+// form_source gives the raw values of a form's fields
+type form_source interface {
+	value(field string) (any, bool)
+}
+
+type form_action struct{ a *Action }
+
+type form_map map[string]any
+
+func (f form_action) value(field string) (any, bool) {
+	if f.a.web == nil {
+		v, found := f.a.inputs[field]
+		return v, found
+	}
+	if values := f.a.web.QueryArray(field); len(values) > 1 {
+		return form_strings(values), true
+	}
+	if values := f.a.web.PostFormArray(field); len(values) > 1 {
+		return form_strings(values), true
+	}
+	if v := f.a.input(field); v != "" {
+		return v, true
+	}
+	return nil, false
+}
+
+func (f form_map) value(field string) (any, bool) {
+	v, found := f[field]
+	return v, found && v != nil
+}
+
+func form_strings(values []string) []any {
+	out := make([]any, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
+
+// form_error is why a field failed
+type form_error struct {
+	code    string
+	message string
+}
+
+// form_validate checks a form against rules, returning the coerced values
+// and the errors by field
+func form_validate(source form_source, rules map[string]any) (map[string]any, map[string]form_error, error) {
+	if len(rules) > form_fields_max {
+		return nil, nil, fmt.Errorf("more than %d fields", form_fields_max)
+	}
+	fields := make([]string, 0, len(rules))
+	for field := range rules {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	values := map[string]any{}
+	errors := map[string]form_error{}
+	for _, field := range fields {
+		rule, ok := rules[field].(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("rule for %q is not a dictionary", field)
+		}
+		kind, _ := rule["type"].(string)
+		if kind == "" {
+			kind = "string"
+		}
+		if !string_in_slice(kind, form_types) {
+			return nil, nil, fmt.Errorf("rule for %q has unknown type %q", field, kind)
+		}
+		if m, _ := rule["match"].(string); m != "" && !string_in_slice(m, form_matches) {
+			return nil, nil, fmt.Errorf("rule for %q has unknown format %q", field, m)
+		}
+
+		raw, found := source.value(field)
+		if found {
+			raw = form_trim(raw, rule)
+			if form_empty(raw) {
+				found = false
+			}
+		}
+		if !found {
+			if d, ok := rule["default"]; ok {
+				values[field] = d
+			} else if b, _ := rule["required"].(bool); b {
+				errors[field] = form_error{"required", "is required"}
+			}
+			continue
+		}
+
+		value, e := form_coerce(raw, kind)
+		if e == nil {
+			e = form_check(value, rule)
+		}
+		if e != nil {
+			errors[field] = *e
+			continue
+		}
+		values[field] = value
+	}
+	return values, errors, nil
+}
+
+// form_trim trims whitespace from a value, or each item of a list, unless
+// the rule says not to
+func form_trim(raw any, rule map[string]any) any {
+	if trim, ok := rule["trim"].(bool); ok && !trim {
+		return raw
+	}
+	switch v := raw.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			if s, ok := item.(string); ok {
+				item = strings.TrimSpace(s)
+			}
+			out[i] = item
+		}
+		return out
+	}
+	return raw
+}
+
+func form_empty(raw any) bool {
+	switch v := raw.(type) {
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// form_coerce converts a raw value to a type
+func form_coerce(raw any, kind string) (any, *form_error) {
+	bad := &form_error{"type", "must be " + form_article(kind)}
+	s, is_string := raw.(string)
+
+	switch kind {
+	case "list":
+		switch v := raw.(type) {
+		case []any:
+			return v, nil
+		case string:
+			var out []any
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					out = append(out, item)
+				}
+			}
+			return out, nil
+		}
+		return nil, bad
+
+	case "integer":
+		switch v := raw.(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				return int64(v), nil
+			}
+			return nil, bad
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); is_string && err == nil {
+			return n, nil
+		}
+		return nil, bad
+
+	case "number":
+		if n, ok := schema_number(raw); ok {
+			return n, nil
+		}
+		if n, err := strconv.ParseFloat(s, 64); is_string && err == nil && !math.IsNaN(n) && !math.IsInf(n, 0) {
+			return n, nil
+		}
+		return nil, bad
+
+	case "boolean":
+		if b, ok := raw.(bool); ok {
+			return b, nil
+		}
+		switch strings.ToLower(s) {
+		case "true", "1", "yes", "on":
+			return true, nil
+		case "false", "0", "no", "off":
+			return false, nil
+		}
+		return nil, bad
+	}
+
+	if !is_string {
+		return nil, bad
+	}
+	switch kind {
+	case "date":
+		if _, err := gotime.Parse("2006-01-02", s); err != nil {
+			return nil, bad
+		}
+	case "email":
+		if !email_valid(s) {
+			return nil, bad
+		}
+	case "url":
+		if !url_scheme_allowed(s) {
+			return nil, bad
+		}
+	}
+	return s, nil
+}
+
+// form_article names a type for an error message
+func form_article(kind string) string {
+	switch kind {
+	case "integer", "email", "url":
+		return "an " + kind
+	case "list":
+		return "a list"
+	}
+	return "a " + kind
+}
+
+// form_check applies a rule's constraints to a coerced value
+func form_check(value any, rule map[string]any) *form_error {
+	if m, _ := rule["match"].(string); m != "" {
+		s, _ := value.(string)
+		if !valid(s, m) {
+			return &form_error{"match", "is not a valid " + m}
+		}
+	}
+
+	// Strings and lists are measured by length, numbers by value
+	size, measured := schema_number(value)
+	verb, unit := "be", ""
+	switch v := value.(type) {
+	case string:
+		size, measured, verb, unit = float64(utf8.RuneCountInString(v)), true, "have", " characters"
+	case []any:
+		size, measured, verb, unit = float64(len(v)), true, "have", " items"
+	}
+	if min, ok := schema_number(rule["min"]); ok && measured && size < min {
+		return &form_error{"min", "must " + verb + " at least " + form_number(min) + unit}
+	}
+	if max, ok := schema_number(rule["max"]); ok && measured && size > max {
+		return &form_error{"max", "must " + verb + " at most " + form_number(max) + unit}
+	}
+
+	if p, _ := rule["pattern"].(string); p != "" {
+		re, err := regex_compile("^(?:" + p + ")$")
+		if err != nil {
+			return &form_error{"pattern", "has an invalid pattern"}
+		}
+		s, _ := value.(string)
+		if !re.MatchString(s) {
+			return &form_error{"pattern", "is not in the expected format"}
+		}
+	}
+
+	if allowed, ok := rule["enum"].([]any); ok {
+		items := []any{value}
+		if list, ok := value.([]any); ok {
+			items = list
+		}
+		for _, item := range items {
+			found := false
+			for _, a := range allowed {
+				if schema_equal(item, a) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return &form_error{"enum", "is not one of the allowed values"}
+			}
+		}
+	}
+	return nil
+}
+
+func form_number(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// mochi.form.validate(data, rules) -> dict: Check a form against rules, giving
+// {valid, values, errors}. Data is the action, to read its submitted fields, or a
+// dictionary. Values holds each valid field coerced to its type, and errors each
+// failing field's {code, message}, with code one of required, type, match, min,
+// max, pattern or enum.
+func api_form_validate(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 2 {
+		return sl_error(fn, "syntax: <data: action|dictionary>, <rules: dictionary>")
+	}
+
+	var source form_source
+	if a, ok := args[0].(*Action); ok {
+		source = form_action{a}
+	} else if m := sl_decode_map(args[0]); m != nil {
+		source = form_map(m)
+	} else {
+		return sl_error(fn, "data must be an action or dictionary")
+	}
+
+	rules := sl_decode_map(args[1])
+	if rules == nil {
+		return sl_error(fn, "rules must be a dictionary")
+	}
+
+	values, errors, err := form_validate(source, rules)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	out := map[string]any{}
+	for field, e := range errors {
+		out[field] = map[string]any{"code": e.code, "message": e.message}
+	}
+	return sl_encode(map[string]any{"valid": len(errors) == 0, "values": values, "errors": out}), nil
+}
@@ -0,0 +1,135 @@
+// Mochi server: Form validation tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+func TestFormValidate(t *testing.T) {
+	rules := map[string]any{
+		"name":    map[string]any{"required": true, "min": int64(2), "max": int64(10)},
+		"age":     map[string]any{"type": "integer", "min": int64(18)},
+		"score":   map[string]any{"type": "number", "max": int64(10)},
+		"agree":   map[string]any{"type": "boolean", "default": false},
+		"email":   map[string]any{"type": "email", "required": true},
+		"colour":  map[string]any{"enum": []any{"red", "green"}},
+		"tags":    map[string]any{"type": "list", "max": int64(2), "enum": []any{"a", "b", "c"}},
+		"code":    map[string]any{"pattern": "[A-Z]{3}"},
+		"born":    map[string]any{"type": "date"},
+		"entity":  map[string]any{"match": "fingerprint"},
+		"comment": map[string]any{"trim": false},
+	}
+
+	values, errors, err := form_validate(form_map{
+		"name": "  Jo  ", "age": "42", "score": "9.5", "email": "jo@example.com", "colour": "red",
+		"tags": "a, b", "code": "ABC", "born": "2000-02-29", "entity": "abcdefghi", "comment": " hi ", "other": "x",
+	}, rules)
+	if err != nil || len(errors) != 0 {
+		t.Fatalf("errors %v, %v", errors, err)
+	}
+	want := map[string]any{"name": "Jo", "age": int64(42), "score": 9.5, "agree": false, "email": "jo@example.com", "colour": "red", "code": "ABC", "born": "2000-02-29", "entity": "abcdefghi", "comment": " hi "}
+	for k, v := range want {
+		if values[k] != v {
+			t.Errorf("%s = %#v, want %#v", k, values[k], v)
+		}
+	}
+	if tags, _ := values["tags"].([]any); len(tags) != 2 || tags[1] != "b" {
+		t.Errorf("tags %v", values["tags"])
+	}
+	if _, found := values["other"]; found {
+		t.Error("kept a field without a rule")
+	}
+
+	_, errors, _ = form_validate(form_map{
+		"name": "J", "age": "17", "score": "x", "agree": "maybe", "colour": "blue",
+		"tags": []any{"a", "b", "c"}, "code": "ABCD", "born": "2001-02-29", "entity": "bad!",
+	}, rules)
+	for field, code := range map[string]string{"name": "min", "age": "min", "score": "type", "agree": "type", "email": "required", "colour": "enum", "tags": "max", "code": "pattern", "born": "type", "entity": "match"} {
+		if errors[field].code != code {
+			t.Errorf("%s error %+v, want %q", field, errors[field], code)
+		}
+	}
+	if errors["name"].message != "must have at least 2 characters" || errors["age"].message != "must be at least 18" {
+		t.Errorf("messages %q, %q", errors["name"].message, errors["age"].message)
+	}
+
+	for _, bad := range []map[string]any{
+		{"x": "required"},
+		{"x": map[string]any{"type": "colour"}},
+		{"x": map[string]any{"match": "(unclosed"}},
+	} {
+		if _, _, err := form_validate(form_map{}, bad); err == nil {
+			t.Errorf("accepted rules %v", bad)
+		}
+	}
+}
+
+func TestFormAction(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_open("db/settings.db").exec("create table if not exists settings (name text primary key, value text not null)")
+	previous := csrf_secret_value
+	csrf_secret_value = ""
+	t.Cleanup(func() { csrf_secret_value = previous })
+
+	request := func(session string, form url.Values) *sl.Thread {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/formtest/save?tags=a&tags=b", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if session != "" {
+			c.Request.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		a := &Action{web: c, app: &App{id: "formtest"}, user: &User{UID: "u1"}, inputs: map[string]string{}}
+		thread := &sl.Thread{}
+		thread.SetLocal("action", a)
+		return thread
+	}
+	call := func(thread *sl.Thread, f func(*sl.Thread, *sl.Builtin, sl.Tuple, []sl.Tuple) (sl.Value, error), args ...sl.Value) sl.Value {
+		t.Helper()
+		v, err := f(thread, sl.NewBuiltin("mochi.form", f), args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	token, _ := sl.AsString(call(request("s1", nil), api_form_csrf))
+	if setting_get("csrf_secret", "") == "" {
+		t.Error("secret not stored")
+	}
+	for _, c := range []struct {
+		session string
+		token   string
+		want    bool
+	}{
+		{"s1", token, true},
+		{"s2", token, false},
+		{"", token, false},
+		{"s1", "", false},
+		{"s1", token + "x", false},
+	} {
+		if v := call(request(c.session, url.Values{"csrf": {c.token}}), api_form_verify); v != sl.Bool(c.want) {
+			t.Errorf("session %q token %q verified %v", c.session, c.token, v)
+		}
+	}
+
+	thread := request("s1", url.Values{"count": {"3"}})
+	rules := sl_encode(map[string]any{"count": map[string]any{"type": "integer"}, "tags": map[string]any{"type": "list"}})
+	result := sl_decode(call(thread, api_form_validate, thread.Local("action").(*Action), rules)).(map[string]any)
+	values, _ := result["values"].(map[string]any)
+	if tags, _ := values["tags"].([]any); result["valid"] != true || values["count"] != int64(3) || len(tags) != 2 {
+		t.Errorf("action form %v", result)
+	}
+}
@@ -0,0 +1,191 @@
+// Mochi server: Starlark regular expression API
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Patterns are RE2 (Go regexp), so matching is linear in the input and an app
+// cannot hang a worker with a catastrophic-backtracking pattern. The length
+// caps bound compile cost; compiled patterns are shared with valid() through
+// regex_compile's cache.
+const (
+	regex_max_pattern = 1000
+	regex_max_input   = 10 * 1024 * 1024
+	regex_max_matches = 10000
+)
+
+var api_regex = sls.FromStringDict(sl.String("mochi.regex"), sl.StringDict{
+	"find":    sl.NewBuiltin("mochi.regex.find", api_regex_find),
+	"findall": sl.NewBuiltin("mochi.regex.findall", api_regex_findall),
+	"match":   sl.NewBuiltin("mochi.regex.match", api_regex_match),
+	"replace": sl.NewBuiltin("mochi.regex.replace", api_regex_replace),
+	"split":   sl.NewBuiltin("mochi.regex.split", api_regex_split),
+	"valid":   sl.NewBuiltin("mochi.regex.valid", api_regex_valid),
+})
+
+// regex_args unpacks the (pattern, string) pair shared by every builtin
+func regex_args(args sl.Tuple, extra int) (*regexp.Regexp, string, error) {
+	if len(args) < 2 || len(args) > 2+extra {
+		return nil, "", fmt.Errorf("syntax: <pattern: string>, <s: string>")
+	}
+	pattern, ok := sl.AsString(args[0])
+	if !ok {
+		return nil, "", fmt.Errorf("pattern must be a string")
+	}
+	if len(pattern) > regex_max_pattern {
+		return nil, "", fmt.Errorf("pattern too long")
+	}
+	s, ok := sl.AsString(args[1])
+	if !ok {
+		return nil, "", fmt.Errorf("s must be a string")
+	}
+	if len(s) > regex_max_input {
+		return nil, "", fmt.Errorf("s too long")
+	}
+	re, err := regex_compile(pattern)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid pattern: %v", err)
+	}
+	return re, s, nil
+}
+
+// regex_groups converts a submatch slice into the dictionary returned to
+// Starlark: the whole match, the positional groups, and any named groups.
+// Groups that did not participate are None.
+func regex_groups(re *regexp.Regexp, s string, loc []int) sl.Value {
+	groups := make(sl.Tuple, 0, re.NumSubexp())
+	named := sl.NewDict(0)
+	names := re.SubexpNames()
+	for i := 1; i <= re.NumSubexp(); i++ {
+		var v sl.Value = sl.None
+		if loc[2*i] >= 0 {
+			v = sl.String(s[loc[2*i]:loc[2*i+1]])
+		}
+		groups = append(groups, v)
+		if names[i] != "" {
+			named.SetKey(sl.String(names[i]), v)
+		}
+	}
+	d := sl.NewDict(5)
+	d.SetKey(sl.String("match"), sl.String(s[loc[0]:loc[1]]))
+	d.SetKey(sl.String("start"), sl.MakeInt(loc[0]))
+	d.SetKey(sl.String("end"), sl.MakeInt(loc[1]))
+	d.SetKey(sl.String("groups"), groups)
+	d.SetKey(sl.String("named"), named)
+	return d
+}
+
+// mochi.regex.match(pattern, s) -> bool: Report whether s contains a match
+// for pattern. Anchor with ^ and $ to require the whole string to match.
+func api_regex_match(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	re, s, err := regex_args(args, 0)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.Bool(re.MatchString(s)), nil
+}
+
+// mochi.regex.find(pattern, s) -> dict or None: First match of pattern in s,
+// as {match, start, end, groups, named}, or None if there is no match.
+func api_regex_find(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	re, s, err := regex_args(args, 0)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return sl.None, nil
+	}
+	return regex_groups(re, s, loc), nil
+}
+
+// mochi.regex.findall(pattern, s, limit?) -> list: Every non-overlapping
+// match of pattern in s, each in the same form as mochi.regex.find. At most
+// limit matches are returned (default and maximum 10000).
+func api_regex_findall(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	re, s, err := regex_args(args, 1)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	limit := regex_max_matches
+	if len(args) > 2 {
+		l, err := sl.AsInt32(args[2])
+		if err != nil || l < 1 || l > regex_max_matches {
+			return sl_error(fn, "invalid limit")
+		}
+		limit = l
+	}
+	var out []sl.Value
+	for _, loc := range re.FindAllStringSubmatchIndex(s, limit) {
+		out = append(out, regex_groups(re, s, loc))
+	}
+	return sl.NewList(out), nil
+}
+
+// mochi.regex.replace(pattern, s, replacement) -> string: Replace every match
+// of pattern in s. The replacement may refer to groups as $1 or ${name}.
+func api_regex_replace(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 3 {
+		return sl_error(fn, "syntax: <pattern: string>, <s: string>, <replacement: string>")
+	}
+	re, s, err := regex_args(args, 1)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	replacement, ok := sl.AsString(args[2])
+	if !ok {
+		return sl_error(fn, "replacement must be a string")
+	}
+	return sl.String(re.ReplaceAllString(s, replacement)), nil
+}
+
+// mochi.regex.split(pattern, s, limit?) -> list: Split s around matches of
+// pattern. With limit, at most limit pieces are returned, the last holding
+// the unsplit remainder.
+func api_regex_split(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	re, s, err := regex_args(args, 1)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	limit := regex_max_matches
+	if len(args) > 2 {
+		l, err := sl.AsInt32(args[2])
+		if err != nil || l < 1 || l > regex_max_matches {
+			return sl_error(fn, "invalid limit")
+		}
+		limit = l
+	}
+	parts := re.Split(s, limit)
+	out := make([]sl.Value, len(parts))
+	for i, p := range parts {
+		out[i] = sl.String(p)
+	}
+	return sl.NewList(out), nil
+}
+
+// mochi.regex.valid(pattern) -> bool: Report whether pattern compiles, so
+// apps can check user-supplied patterns before storing them.
+func api_regex_valid(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 1 {
+		return sl_error(fn, "syntax: <pattern: string>")
+	}
+	pattern, ok := sl.AsString(args[0])
+	if !ok {
+		return sl_error(fn, "pattern must be a string")
+	}
+	if len(pattern) > regex_max_pattern {
+		return sl.False, nil
+	}
+	_, err := regex_compile(pattern)
+	return sl.Bool(err == nil), nil
+}
@@ -0,0 +1,88 @@
+// Mochi server: Starlark regular expression and encoding API tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+// test_starlark_eval evaluates a Starlark expression against the API globals
+func test_starlark_eval(t *testing.T, expr string) sl.Value {
+	t.Helper()
+	v, err := sl.Eval(&sl.Thread{Name: "test"}, "test.star", expr, api_globals)
+	if err != nil {
+		t.Fatalf("%s: %v", expr, err)
+	}
+	return v
+}
+
+func TestRegexBuiltins(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{`mochi.regex.match("^a+b$", "aaab")`, "True"},
+		{`mochi.regex.match("^a+b$", "aaabc")`, "False"},
+		{`mochi.regex.find("(?P<y>\\d{4})-(\\d{2})", "on 2026-10 ok")["named"]["y"]`, `"2026"`},
+		{`mochi.regex.find("(\\d+)", "nothing")`, "None"},
+		{`[m["match"] for m in mochi.regex.findall("\\d+", "1 22 333")]`, `["1", "22", "333"]`},
+		{`len(mochi.regex.findall("\\d", "12345", 2))`, "2"},
+		{`mochi.regex.replace("(\\w+)@", "bob@example", "$1 at ")`, `"bob at example"`},
+		{`mochi.regex.split(",\\s*", "a, b,c")`, `["a", "b", "c"]`},
+		{`mochi.regex.split(",", "a,b,c", 2)`, `["a", "b,c"]`},
+		{`mochi.regex.valid("(unclosed")`, "False"},
+	}
+	for _, tc := range tests {
+		if got := test_starlark_eval(t, tc.expr).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+
+	if _, err := sl.Eval(&sl.Thread{}, "test.star", `mochi.regex.match("(", "x")`, api_globals); err == nil {
+		t.Error("invalid pattern should fail")
+	}
+}
+
+func TestEncodeHex(t *testing.T) {
+	if got := test_starlark_eval(t, `mochi.encode.hex(b"\x01\xff")`).String(); got != `"01ff"` {
+		t.Errorf("encode.hex = %s", got)
+	}
+	if got := test_starlark_eval(t, `mochi.decode.hex("01FF")`).String(); got != `b"\x01\xff"` {
+		t.Errorf("decode.hex = %s", got)
+	}
+	if got := test_starlark_eval(t, `mochi.decode.hex("xyz")`); got != sl.None {
+		t.Errorf("decode.hex of invalid input = %s, want None", got)
+	}
+	if got := test_starlark_eval(t, `mochi.decode.base64(mochi.encode.base64(b"\xfb\xff", url=True), url=True)`).String(); got != `b"\xfb\xff"` {
+		t.Errorf("url-safe base64 round trip = %s", got)
+	}
+}
+
+func TestUlid(t *testing.T) {
+	early, err := ulid(time.UnixMilli(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	late, _ := ulid(time.UnixMilli(2000))
+	if len(early) != 26 || len(late) != 26 {
+		t.Fatalf("ulid length: %q %q", early, late)
+	}
+	if early >= late {
+		t.Errorf("ulids should sort by time: %q >= %q", early, late)
+	}
+	// 1000 ms in 48 bits: only the low characters of the timestamp are set
+	if !strings.HasPrefix(early, "00000000Z8") {
+		t.Errorf("ulid timestamp prefix = %q", early[:10])
+	}
+	if got := test_starlark_eval(t, `len(mochi.random.uuid())`).String(); got != "36" {
+		t.Errorf("uuid length = %s", got)
+	}
+}
@@ -0,0 +1,490 @@
+// Mochi server: JSON schema validation
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	gotime "time"
+	"unicode/utf8"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// The validator implements the commonly used core of JSON Schema (draft
+// 2020-12): type, enum, const, the numeric, string, array and object
+// keywords, the allOf/anyOf/oneOf/not combinators, and local "$ref"s into
+// "$defs". Remote references and the annotation-only keywords are not
+// supported; unknown keywords are ignored, as the specification requires.
+// Errors are collected rather than stopping at the first, so a form can
+// report every bad field at once.
+
+// Bound recursion through "$ref" so a self-referencing schema cannot loop
+const schema_max_depth = 64
+
+// Stop collecting after this many errors; a huge invalid document is not
+// made more useful by listing every failure
+const schema_max_errors = 100
+
+var api_schema = sls.FromStringDict(sl.String("mochi.schema"), sl.StringDict{
+	"valid":    sl.NewBuiltin("mochi.schema.valid", api_schema_valid),
+	"validate": sl.NewBuiltin("mochi.schema.validate", api_schema_validate),
+})
+
+type schema_validator struct {
+	root   map[string]any
+	errors []string
+}
+
+// schema_validate checks value against schema and returns the list of
+// failures, each prefixed by the JSON pointer of the offending value.
+func schema_validate(schema map[string]any, value any) []string {
+	v := &schema_validator{root: schema}
+	v.check(schema, value, "", 0)
+	return v.errors
+}
+
+func (v *schema_validator) fail(path string, format string, values ...any) {
+	if len(v.errors) >= schema_max_errors {
+		return
+	}
+	if path == "" {
+		path = "/"
+	}
+	v.errors = append(v.errors, path+": "+fmt.Sprintf(format, values...))
+}
+
+// resolve follows a local "#/..." reference from the root schema
+func (v *schema_validator) resolve(ref string) (map[string]any, bool) {
+	if ref == "#" {
+		return v.root, true
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+	var node any = v.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		node, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	m, ok := node.(map[string]any)
+	return m, ok
+}
+
+// schema_type names the JSON type of a decoded value
+func schema_type(value any) string {
+	switch x := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int64, int, uint64:
+		return "integer"
+	case float64:
+		if x == math.Trunc(x) && !math.IsInf(x, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+// schema_type_matches allows an integer wherever a number is accepted
+func schema_type_matches(want string, value any) bool {
+	got := schema_type(value)
+	return got == want || (want == "number" && got == "integer")
+}
+
+func schema_number(value any) (float64, bool) {
+	switch x := value.(type) {
+	case int64:
+		return float64(x), true
+	case int:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// schema_equal compares decoded values, treating 1 and 1.0 as equal
+func schema_equal(a, b any) bool {
+	if an, ok := schema_number(a); ok {
+		bn, ok := schema_number(b)
+		return ok && an == bn
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func schema_format(format, s string) bool {
+	switch format {
+	case "date-time":
+		_, err := gotime.Parse(gotime.RFC3339, s)
+		return err == nil
+	case "date":
+		_, err := gotime.Parse("2006-01-02", s)
+		return err == nil
+	case "email":
+		return email_valid(s)
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	case "uuid":
+		return valid(s, "^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+	}
+	// Unknown formats are annotations only
+	return true
+}
+
+func (v *schema_validator) check(schema map[string]any, value any, path string, depth int) {
+	if depth > schema_max_depth {
+		v.fail(path, "schema nested too deeply")
+		return
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		target, found := v.resolve(ref)
+		if !found {
+			v.fail(path, "unresolvable reference %q", ref)
+			return
+		}
+		v.check(target, value, path, depth+1)
+	}
+
+	switch t := schema["type"].(type) {
+	case string:
+		if !schema_type_matches(t, value) {
+			v.fail(path, "expected %s, got %s", t, schema_type(value))
+			return
+		}
+	case []any:
+		matched := false
+		for _, want := range t {
+			if w, ok := want.(string); ok && schema_type_matches(w, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "unexpected type %s", schema_type(value))
+			return
+		}
+	}
+
+	if options, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, o := range options {
+			if schema_equal(o, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "value is not one of the allowed values")
+		}
+	}
+	if c, ok := schema["const"]; ok && !schema_equal(c, value) {
+		v.fail(path, "value does not equal the required constant")
+	}
+
+	if n, ok := schema_number(value); ok {
+		v.check_number(schema, n, path)
+	}
+	if s, ok := value.(string); ok {
+		v.check_string(schema, s, path)
+	}
+	if a, ok := value.([]any); ok {
+		v.check_array(schema, a, path, depth)
+	}
+	if o, ok := value.(map[string]any); ok {
+		v.check_object(schema, o, path, depth)
+	}
+
+	v.check_combinators(schema, value, path, depth)
+}
+
+func (v *schema_validator) check_number(schema map[string]any, n float64, path string) {
+	if m, ok := schema_number(schema["minimum"]); ok && n < m {
+		v.fail(path, "must be at least %v", m)
+	}
+	if m, ok := schema_number(schema["maximum"]); ok && n > m {
+		v.fail(path, "must be at most %v", m)
+	}
+	if m, ok := schema_number(schema["exclusiveMinimum"]); ok && n <= m {
+		v.fail(path, "must be greater than %v", m)
+	}
+	if m, ok := schema_number(schema["exclusiveMaximum"]); ok && n >= m {
+		v.fail(path, "must be less than %v", m)
+	}
+	if m, ok := schema_number(schema["multipleOf"]); ok && m > 0 {
+		if q := n / m; q != math.Trunc(q) {
+			v.fail(path, "must be a multiple of %v", m)
+		}
+	}
+}
+
+func (v *schema_validator) check_string(schema map[string]any, s string, path string) {
+	length := utf8.RuneCountInString(s)
+	if m, ok := schema_number(schema["minLength"]); ok && float64(length) < m {
+		v.fail(path, "must be at least %v characters", m)
+	}
+	if m, ok := schema_number(schema["maxLength"]); ok && float64(length) > m {
+		v.fail(path, "must be at most %v characters", m)
+	}
+	if p, ok := schema["pattern"].(string); ok {
+		re, err := regex_compile(p)
+		if err != nil {
+			v.fail(path, "invalid pattern %q", p)
+		} else if !re.MatchString(s) {
+			v.fail(path, "does not match pattern %q", p)
+		}
+	}
+	if f, ok := schema["format"].(string); ok && !schema_format(f, s) {
+		v.fail(path, "not a valid %s", f)
+	}
+}
+
+func (v *schema_validator) check_array(schema map[string]any, a []any, path string, depth int) {
+	if m, ok := schema_number(schema["minItems"]); ok && float64(len(a)) < m {
+		v.fail(path, "must have at least %v items", m)
+	}
+	if m, ok := schema_number(schema["maxItems"]); ok && float64(len(a)) > m {
+		v.fail(path, "must have at most %v items", m)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range a {
+			for j := i + 1; j < len(a); j++ {
+				if schema_equal(a[i], a[j]) {
+					v.fail(path, "items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+
+	start := 0
+	if prefix, ok := schema["prefixItems"].([]any); ok {
+		for i, p := range prefix {
+			if i >= len(a) {
+				break
+			}
+			if ps, ok := p.(map[string]any); ok {
+				v.check(ps, a[i], fmt.Sprintf("%s/%d", path, i), depth+1)
+			}
+		}
+		start = len(prefix)
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i := start; i < len(a); i++ {
+			v.check(items, a[i], fmt.Sprintf("%s/%d", path, i), depth+1)
+		}
+	} else if items, ok := schema["items"].(bool); ok && !items && len(a) > start {
+		v.fail(path, "must have at most %d items", start)
+	}
+}
+
+func (v *schema_validator) check_object(schema map[string]any, o map[string]any, path string, depth int) {
+	if m, ok := schema_number(schema["minProperties"]); ok && float64(len(o)) < m {
+		v.fail(path, "must have at least %v properties", m)
+	}
+	if m, ok := schema_number(schema["maxProperties"]); ok && float64(len(o)) > m {
+		v.fail(path, "must have at most %v properties", m)
+	}
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, present := o[name]; !present {
+					v.fail(path, "missing required property %q", name)
+				}
+			}
+		}
+	}
+
+	// Walk keys in order so the error list is stable
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	properties, _ := schema["properties"].(map[string]any)
+	for _, k := range keys {
+		child := path + "/" + strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1")
+		if ps, ok := properties[k].(map[string]any); ok {
+			v.check(ps, o[k], child, depth+1)
+			continue
+		}
+		if _, ok := properties[k]; ok {
+			continue
+		}
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				v.fail(path, "unexpected property %q", k)
+			}
+		case map[string]any:
+			v.check(extra, o[k], child, depth+1)
+		}
+	}
+}
+
+func (v *schema_validator) check_combinators(schema map[string]any, value any, path string, depth int) {
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, s := range all {
+			if sub, ok := s.(map[string]any); ok {
+				v.check(sub, value, path, depth+1)
+			}
+		}
+	}
+	passes := func(s any) bool {
+		sub, ok := s.(map[string]any)
+		if !ok {
+			return false
+		}
+		trial := &schema_validator{root: v.root}
+		trial.check(sub, value, path, depth+1)
+		return len(trial.errors) == 0
+	}
+	if any_of, ok := schema["anyOf"].([]any); ok {
+		matched := false
+		for _, s := range any_of {
+			if passes(s) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "does not match any of the allowed schemas")
+		}
+	}
+	if one_of, ok := schema["oneOf"].([]any); ok {
+		count := 0
+		for _, s := range one_of {
+			if passes(s) {
+				count++
+			}
+		}
+		if count != 1 {
+			v.fail(path, "must match exactly one schema, matched %d", count)
+		}
+	}
+	if not, ok := schema["not"]; ok && passes(not) {
+		v.fail(path, "must not match the excluded schema")
+	}
+}
+
+// schema_argument accepts a schema as either a dictionary or a JSON string,
+// so apps can keep schemas in files next to their code.
+func schema_argument(value sl.Value) (map[string]any, error) {
+	if s, ok := sl.AsString(value); ok {
+		var m map[string]any
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			return nil, fmt.Errorf("invalid schema JSON: %v", err)
+		}
+		return m, nil
+	}
+	m := sl_decode_map(value)
+	if m == nil {
+		return nil, fmt.Errorf("schema must be a dictionary or JSON string")
+	}
+	return m, nil
+}
+
+// schema_parameters returns the value a service function's input schema is
+// checked against: the call's keyword arguments as an object, or if it has
+// positional parameters those as an array. A call must not mix the two.
+func schema_parameters(args sl.Tuple, kwargs []sl.Tuple) (any, error) {
+	if len(args) > 0 {
+		if len(kwargs) > 0 {
+			return nil, fmt.Errorf("function with an input schema takes positional or keyword parameters, not both")
+		}
+		out := make([]any, len(args))
+		for i, a := range args {
+			out[i] = sl_decode(a)
+		}
+		return out, nil
+	}
+	out := make(map[string]any, len(kwargs))
+	for _, kw := range kwargs {
+		name, _ := sl.AsString(kw[0])
+		out[name] = sl_decode(kw[1])
+	}
+	return out, nil
+}
+
+// schema_content returns an event's content in the form schema_validate
+// takes, without the underscored fields the server adds for itself
+func schema_content(content map[string]any) map[string]any {
+	out := map[string]any{}
+	for k, v := range content {
+		if !strings.HasPrefix(k, "_") {
+			out[k] = v
+		}
+	}
+	// Content decoded from the wire may hold CBOR's own map and integer
+	// types; a round trip through Starlark gives the JSON-shaped ones
+	decoded, _ := sl_decode(sl_encode(out)).(map[string]any)
+	return decoded
+}
+
+// schema_failures formats validation failures as one error message
+func schema_failures(what string, failures []string) string {
+	return "invalid " + what + ": " + strings.Join(failures, "; ")
+}
+
+// mochi.schema.validate(schema, value) -> list: Validate value against a
+// JSON schema, returning a list of error strings (empty when valid). Each
+// error starts with the JSON pointer of the failing value, e.g.
+// "/items/2/name: missing required property \"id\"".
+func api_schema_validate(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 2 {
+		return sl_error(fn, "syntax: <schema: dictionary|string>, <value: any>")
+	}
+	schema, err := schema_argument(args[0])
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	errors := schema_validate(schema, sl_decode(args[1]))
+	out := make([]sl.Value, len(errors))
+	for i, e := range errors {
+		out[i] = sl.String(e)
+	}
+	return sl.NewList(out), nil
+}
+
+// mochi.schema.valid(schema, value) -> bool: Report whether value satisfies
+// the JSON schema
+func api_schema_valid(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 2 {
+		return sl_error(fn, "syntax: <schema: dictionary|string>, <value: any>")
+	}
+	schema, err := schema_argument(args[0])
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.Bool(len(schema_validate(schema, sl_decode(args[1]))) == 0), nil
+}
@@ -0,0 +1,190 @@
+// Mochi server: JSON schema validation tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	var schema map[string]any
+	err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["name", "tags"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 10},
+			"age": {"type": "integer", "minimum": 0},
+			"email": {"type": "string", "format": "email"},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "uniqueItems": true},
+			"kind": {"enum": ["a", "b"]}
+		},
+		"$defs": {"tag": {"type": "string", "pattern": "^[a-z]+$"}}
+	}`), &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := map[string]any{"name": "Alice", "age": int64(30), "tags": []any{"x", "y"}, "kind": "a"}
+	if errors := schema_validate(schema, ok); len(errors) != 0 {
+		t.Errorf("valid document rejected: %v", errors)
+	}
+
+	bad := map[string]any{"name": "", "age": 1.5, "email": "nope", "tags": []any{"x", "X", "x"}, "kind": "c", "extra": true}
+	errors := schema_validate(schema, bad)
+	want := []string{
+		"/name: must be at least 1 characters",
+		"/age: expected integer, got number",
+		"/email: not a valid email",
+		"/tags/1: does not match pattern",
+		"/tags: items 0 and 2 are equal",
+		"/kind: value is not one of the allowed values",
+		`/: unexpected property "extra"`,
+	}
+	joined := strings.Join(errors, "\n")
+	for _, w := range want {
+		if !strings.Contains(joined, w) {
+			t.Errorf("missing error %q in:\n%s", w, joined)
+		}
+	}
+
+	if errors := schema_validate(schema, map[string]any{"name": "x"}); len(errors) != 1 || !strings.Contains(errors[0], `"tags"`) {
+		t.Errorf("missing required: %v", errors)
+	}
+}
+
+func TestSchemaCombinators(t *testing.T) {
+	schema := map[string]any{
+		"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "integer"},
+		},
+		"not": map[string]any{"const": "forbidden"},
+	}
+	if errors := schema_validate(schema, "hello"); len(errors) != 0 {
+		t.Errorf("string rejected: %v", errors)
+	}
+	if errors := schema_validate(schema, true); len(errors) != 1 {
+		t.Errorf("boolean should fail oneOf: %v", errors)
+	}
+	if errors := schema_validate(schema, "forbidden"); len(errors) != 1 {
+		t.Errorf("excluded constant should fail not: %v", errors)
+	}
+
+	// A schema that refers to itself must terminate
+	loop := map[string]any{"$ref": "#"}
+	if errors := schema_validate(loop, 1); len(errors) == 0 {
+		t.Error("self-referencing schema should report excessive nesting")
+	}
+}
+
+func TestSchemaStarlark(t *testing.T) {
+	if got := test_starlark_eval(t, `mochi.schema.valid('{"type": "integer", "maximum": 5}', 3)`).String(); got != "True" {
+		t.Errorf("valid = %s", got)
+	}
+	if got := test_starlark_eval(t, `mochi.schema.validate({"type": "integer", "maximum": 5}, 6)`).String(); got != `["/: must be at most 5"]` {
+		t.Errorf("validate = %s", got)
+	}
+}
+
+// A service function's declared input and output are enforced on
+// mochi.service.call
+func TestSchemaServiceContract(t *testing.T) {
+	a, av, cleanup := lifecycle_test_app(t, `
+def double(context, n=0, bad=False):
+    if bad:
+        return "two"
+    return n * 2
+`)
+	defer cleanup()
+	db_open("db/settings.db").exec("create table if not exists settings (name text primary key, value text not null)")
+	av.Database.File = ""
+	av.Architecture.Engine = "starlark"
+	av.Architecture.Version = 3
+	av.Functions = map[string]AppFunction{"double": {
+		Function: "double",
+		Input:    map[string]any{"type": "object", "required": []any{"n"}, "properties": map[string]any{"n": map[string]any{"type": "integer"}}},
+		Output:   map[string]any{"type": "integer"},
+	}}
+	apps_lock.Lock()
+	apps[a.id] = a
+	apps_lock.Unlock()
+	a.service("contracttest")
+	defer func() {
+		apps_lock.Lock()
+		delete(apps, a.id)
+		delete(internal_services, "contracttest")
+		apps_lock.Unlock()
+	}()
+
+	user := create_permission_test_user(t, "u1")
+	thread := create_test_thread(user, create_external_app("caller"))
+	fn := sl.NewBuiltin("mochi.service.call", api_service_call)
+	call := func(args sl.Tuple, kwargs ...sl.Tuple) (sl.Value, error) {
+		return api_service_call(thread, fn, append(sl.Tuple{sl.String("contracttest"), sl.String("double")}, args...), kwargs)
+	}
+
+	if v, err := call(nil, sl.Tuple{sl.String("n"), sl.MakeInt(2)}); err != nil || v != sl.MakeInt(4) {
+		t.Fatalf("valid call = %v, %v", v, err)
+	}
+	if _, err := call(nil, sl.Tuple{sl.String("n"), sl.String("2")}); err == nil || !strings.Contains(err.Error(), "invalid input to contracttest/double: /n:") {
+		t.Errorf("invalid input error = %v", err)
+	}
+	if _, err := call(nil); err == nil || !strings.Contains(err.Error(), `missing required property "n"`) {
+		t.Errorf("missing input error = %v", err)
+	}
+	if _, err := call(sl.Tuple{sl.MakeInt(2)}, sl.Tuple{sl.String("n"), sl.MakeInt(2)}); err == nil || !strings.Contains(err.Error(), "not both") {
+		t.Errorf("mixed parameters error = %v", err)
+	}
+	if _, err := call(nil, sl.Tuple{sl.String("n"), sl.MakeInt(2)}, sl.Tuple{sl.String("bad"), sl.True}); err == nil || !strings.Contains(err.Error(), "invalid output from contracttest/double") {
+		t.Errorf("invalid output error = %v", err)
+	}
+}
+
+// An event's declared input is enforced on receipt, ignoring the server's
+// underscored fields, and refused content is not retried
+func TestSchemaEventContract(t *testing.T) {
+	handled := events_log_test_setup(t)
+	a := app_by_id("eventlogtest")
+	ae := a.internal.Events["update"]
+	ae.Input = map[string]any{"type": "object", "required": []any{"count"}, "additionalProperties": false, "properties": map[string]any{"count": map[string]any{"type": "integer", "minimum": 1}}}
+	a.internal.Events["update"] = ae
+
+	receive := func(content map[string]any) *fake_reply {
+		r := newFakeReply()
+		w := &app_worker{user: "u1", app: "eventlogtest"}
+		w.handle(&worker_frame{
+			frame: &Frame{Type: frame_type_message, ID: "m", From: events_log_test_from, To: events_log_test_to, Service: "eventlogtest", Event: "update", Content: cbor_roundtrip(t, content)},
+			reply: r,
+		})
+		return r
+	}
+
+	if r := receive(map[string]any{"count": 3, "_key": "k", "_sequence": 1}); r.ack_count() != 1 || len(*handled) != 1 {
+		t.Fatalf("valid event not handled: acks %d, fails %v", r.ack_count(), r.fail_reasons())
+	}
+	if r := receive(map[string]any{"count": 0, "extra": true}); r.ack_count() != 0 || len(r.fail_reasons()) != 1 || r.fail_reasons()[0] != fail_unsupported {
+		t.Fatalf("invalid event: acks %d, fails %v", r.ack_count(), r.fail_reasons())
+	}
+	if len(*handled) != 1 {
+		t.Errorf("invalid event reached the handler")
+	}
+}
+
+// cbor_roundtrip returns content as it arrives from the wire
+func cbor_roundtrip(t *testing.T, content map[string]any) map[string]any {
+	t.Helper()
+	var out map[string]any
+	if err := cbor_decode_mode.Unmarshal(cbor_encode(content), &out); err != nil {
+		t.Fatalf("cbor: %v", err)
+	}
+	return out
+}
@@ -185,15 +185,27 @@ func api_user_export(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 // user_export assembles the bundle for uid and writes the finished .zip
 // into the calling app's files directory under mochi-export/, returning
 // the app-relative path so the action can stream it with a.write.file.
-// The bundle is built in a staging tree under users/<uid>/export/ first,
-// then zipped across into the app files area.
 func user_export(uid, app, passphrase, host string) (string, error) {
 	if passphrase == "" {
 		return "", fmt.Errorf("passphrase required")
 	}
+	export_cleanup_orphans(uid, app)
+	path, err := user_export_to(uid, passphrase, host, filepath.Join(data_dir, "users", uid, app, "files", "mochi-export"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(filepath.Join("mochi-export", filepath.Base(path))), nil
+}
+
+// user_export_to assembles the bundle for uid and writes the finished .zip
+// into dir, returning its path. The bundle is built in a staging tree under
+// users/<uid>/export/ first, then zipped across.
+func user_export_to(uid, passphrase, host, dir string) (string, error) {
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase required")
+	}
 
 	root := filepath.Join(data_dir, "users", uid)
-	export_cleanup_orphans(uid, app)
 	udb := db_open("db/users.db")
 
 	// Primary (person-class) entity signs the manifest and names the
@@ -257,9 +269,26 @@ func user_export(uid, app, passphrase, host string) (string, error) {
 
 	// Manifest: hash every staged file, then sign the lot with the
 	// primary entity key.
+	if err := export_manifest_write(tree, &primary, export_source_server(host), stamp); err != nil {
+		return "", err
+	}
+
+	zip_path := filepath.Join(dir, bundle+".zip")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("create download directory: %w", err)
+	}
+	if err := export_zip(tree, bundle, zip_path, stamp); err != nil {
+		return "", fmt.Errorf("zip bundle: %w", err)
+	}
+	return zip_path, nil
+}
+
+// export_manifest_write hashes every file staged in tree into manifest.json,
+// signed with the primary entity key.
+func export_manifest_write(tree string, primary *Entity, source string, stamp time.Time) error {
 	manifest := export_manifest{
 		Version:     export_manifest_version,
-		Source:      export_source_server(host),
+		Source:      source,
 		Exported:    stamp.Format(time.RFC3339),
 		Fingerprint: primary.Fingerprint,
 		Files:       map[string]export_file{},
@@ -276,35 +305,23 @@ func user_export(uid, app, passphrase, host string) (string, error) {
 		manifest.Files[filepath.ToSlash(rel)] = export_file{Hash: hash, Bytes: bytes}
 		return nil
 	}); err != nil {
-		return "", fmt.Errorf("hash bundle: %w", err)
+		return fmt.Errorf("hash bundle: %w", err)
 	}
 
 	payload, err := json.Marshal(manifest)
 	if err != nil {
-		return "", err
+		return err
 	}
 	signature := entity_sign(primary.ID, string(payload))
 	if signature == "" {
-		return "", fmt.Errorf("sign manifest: empty signature")
+		return fmt.Errorf("sign manifest: empty signature")
 	}
 	manifest.Signature = signature
 	final, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
-		return "", err
-	}
-	if err := os.WriteFile(filepath.Join(tree, "manifest.json"), final, 0o600); err != nil {
-		return "", err
-	}
-
-	relative := filepath.ToSlash(filepath.Join("mochi-export", bundle+".zip"))
-	zip_path := filepath.Join(root, app, "files", filepath.FromSlash(relative))
-	if err := os.MkdirAll(filepath.Dir(zip_path), 0o700); err != nil {
-		return "", fmt.Errorf("create download directory: %w", err)
-	}
-	if err := export_zip(tree, bundle, zip_path, stamp); err != nil {
-		return "", fmt.Errorf("zip bundle: %w", err)
+		return err
 	}
-	return relative, nil
+	return os.WriteFile(filepath.Join(tree, "manifest.json"), final, 0o600)
 }
 
 // export_copy_subtree mirrors src into dst, snapshot-copying *.db files
@@ -460,7 +477,7 @@ func export_keys_age(udb *DB, uid, passphrase, path string) error {
 	}
 	keys := map[string]string{}
 	for _, e := range entities {
-		keys[e.ID] = e.Private
+		keys[e.ID] = entity_private_resolve(e.Private)
 	}
 	plain, err := json.Marshal(keys)
 	if err != nil {
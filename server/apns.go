@@ -0,0 +1,176 @@
+// Mochi server: Apple Push Notification service (APNs) delivery
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// Token-based APNs delivery for companion iOS apps. The administrator
+// creates a key in the Apple developer account and names it in mochi.conf:
+//
+//	[push]
+//	apns_key = /etc/mochi/AuthKey_ABC123DEFG.p8
+//	apns_key_id = ABC123DEFG
+//	apns_team = TEAM123456
+//	apns_topic = org.example.mochi
+//	apns_sandbox = false
+//
+// Each send carries a provider token, an ES256 JWT signed with the key,
+// which Apple wants renewed between 20 and 60 minutes old; we keep one for
+// 40. Device tokens are registered by the app as subscriptions with
+// endpoints of the form "apns:<token>". See webpush.go.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const apns_token_lifetime = 40 * time.Minute
+
+var (
+	apns_host_production = "https://api.push.apple.com"
+	apns_host_sandbox    = "https://api.sandbox.push.apple.com"
+
+	// APNs needs HTTP/2, which the default transport negotiates
+	apns_client = &http.Client{Timeout: 15 * time.Second}
+
+	apns_token_lock    sync.Mutex
+	apns_token_value   string
+	apns_token_key     string // Key file and ID the token was signed with
+	apns_token_expires time.Time
+)
+
+// apns_configured reports whether mochi.conf has what's needed to send
+func apns_configured() bool {
+	return ini_string("push", "apns_key", "") != "" && ini_string("push", "apns_key_id", "") != "" && ini_string("push", "apns_team", "") != "" && ini_string("push", "apns_topic", "") != ""
+}
+
+// apns_token returns a provider token, signing a fresh one if need be
+func apns_token() (string, error) {
+	file := ini_string("push", "apns_key", "")
+	id := ini_string("push", "apns_key_id", "")
+	apns_token_lock.Lock()
+	defer apns_token_lock.Unlock()
+	if apns_token_key == file+"|"+id && time.Now().Before(apns_token_expires) {
+		return apns_token_value, nil
+	}
+
+	key, err := apns_parse_key(file)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": ini_string("push", "apns_team", ""),
+		"iat": time.Now().Unix(),
+	})
+	token.Header["kid"] = id
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("sign provider token: %w", err)
+	}
+	apns_token_value = signed
+	apns_token_key = file + "|" + id
+	apns_token_expires = time.Now().Add(apns_token_lifetime)
+	return signed, nil
+}
+
+// apns_parse_key reads the P-256 private key of a .p8 file
+func apns_parse_key(file string) (*ecdsa.PrivateKey, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("key has no PEM block")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an ECDSA key")
+	}
+	return key, nil
+}
+
+// apns_send sends an alert with a notification's title and body, and its
+// other fields alongside for the app, to a device token. Returns (success,
+// retire, detail) as fcm_send does: retire is true when Apple says the
+// token is no longer valid for the app.
+func apns_send(device string, data map[string]string) (success bool, retire bool, detail string) {
+	if !apns_configured() {
+		return false, false, "APNs not configured"
+	}
+	token, err := apns_token()
+	if err != nil {
+		warn("APNs: %v", err)
+		return false, false, err.Error()
+	}
+
+	payload := map[string]any{
+		"aps": map[string]any{
+			"alert":           map[string]string{"title": data["title"], "body": data["body"]},
+			"sound":           "default",
+			"mutable-content": 1,
+		},
+	}
+	for k, v := range data {
+		if k != "title" && k != "body" && k != "aps" {
+			payload[k] = v
+		}
+	}
+	body, _ := json.Marshal(payload)
+
+	host := apns_host_production
+	if ini_bool("push", "apns_sandbox", false) {
+		host = apns_host_sandbox
+	}
+	req, err := http.NewRequest("POST", host+"/3/device/"+device, bytes.NewReader(body))
+	if err != nil {
+		return false, false, fmt.Sprintf("Request build failed: %v", err)
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", ini_string("push", "apns_topic", ""))
+	req.Header.Set("apns-push-type", "alert")
+	if tag := data["tag"]; tag != "" && len(tag) <= 64 {
+		req.Header.Set("apns-collapse-id", tag)
+	}
+
+	resp, err := apns_client.Do(req)
+	if err != nil {
+		warn("APNs: send: %v", err)
+		return false, false, fmt.Sprintf("Network error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return true, false, ""
+	}
+
+	var reply struct {
+		Reason string `json:"reason"`
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	json.Unmarshal(raw, &reply)
+	retire = resp.StatusCode == http.StatusGone || (resp.StatusCode == http.StatusBadRequest && (reply.Reason == "BadDeviceToken" || reply.Reason == "DeviceTokenNotForTopic"))
+	if retire {
+		debug("APNs: send returned %d %s, retiring token", resp.StatusCode, reply.Reason)
+	} else {
+		warn("APNs: send returned %d: %s", resp.StatusCode, string(raw))
+	}
+	return false, retire, fmt.Sprintf("APNs %d %s", resp.StatusCode, reply.Reason)
+}
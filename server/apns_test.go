@@ -0,0 +1,101 @@
+// Mochi server: APNs delivery tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	sl "go.starlark.net/starlark"
+)
+
+func TestApnsGateway(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_open("db/settings.db").exec("create table if not exists settings (name text primary key, value text not null)")
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	file := filepath.Join(t.TempDir(), "AuthKey.p8")
+	os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	t.Setenv("MOCHI_PUSH_APNS_KEY", file)
+	t.Setenv("MOCHI_PUSH_APNS_KEY_ID", "KEY1234567")
+	t.Setenv("MOCHI_PUSH_APNS_TEAM", "TEAM123456")
+	t.Setenv("MOCHI_PUSH_APNS_TOPIC", "org.example.mochi")
+
+	// Apple, taking alerts for device "good" and saying "gone" is unregistered
+	var alerts []map[string]any
+	apple := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := jwt.Parse(strings.TrimPrefix(r.Header.Get("Authorization"), "bearer "), func(*jwt.Token) (any, error) { return &key.PublicKey, nil })
+		if err != nil || token.Header["kid"] != "KEY1234567" || r.Header.Get("apns-topic") != "org.example.mochi" || r.ProtoMajor != 2 {
+			t.Errorf("request %v %v: %v", r.Proto, r.Header, err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/3/device/gone" {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered"}`))
+			return
+		}
+		var alert map[string]any
+		json.NewDecoder(r.Body).Decode(&alert)
+		alerts = append(alerts, alert)
+	}))
+	apple.EnableHTTP2 = true
+	apple.StartTLS()
+	t.Cleanup(apple.Close)
+	host, client := apns_host_production, apns_client
+	apns_host_production, apns_client = apple.URL, apple.Client()
+	t.Cleanup(func() { apns_host_production, apns_client = host, client })
+
+	user := create_permission_test_user(t, "u1")
+	app := create_external_app("chat")
+	permission_grant(user, app.id, "webpush/send")
+	thread := create_test_thread(user, app)
+	call := func(name string, kwargs ...sl.Tuple) (sl.Value, error) {
+		f, _ := api_webpush.Attr(name)
+		return sl.Call(thread, f, nil, kwargs)
+	}
+	for _, device := range []string{"apns:good", "apns:gone"} {
+		if _, err := call("subscribe", sl.Tuple{sl.String("endpoint"), sl.String(device)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := call("subscribe", sl.Tuple{sl.String("endpoint"), sl.String("fcm:token")}); err == nil {
+		t.Error("registered a device for an unconfigured gateway")
+	}
+
+	sent, err := call("notify", sl.Tuple{sl.String("payload"), sl.String(`{"title": "Hello", "body": "A message", "link": "/chat/1", "count": 2}`)})
+	if err != nil || sent != sl.MakeInt(1) || len(alerts) != 1 {
+		t.Fatalf("sent %v, alerts %v: %v", sent, alerts, err)
+	}
+	aps, _ := alerts[0]["aps"].(map[string]any)
+	alert, _ := aps["alert"].(map[string]any)
+	if alert["title"] != "Hello" || alert["body"] != "A message" || alerts[0]["link"] != "/chat/1" || alerts[0]["count"] != "2" {
+		t.Errorf("alert %v", alerts[0])
+	}
+
+	list, _ := call("list")
+	if devices := sl_decode(list).([]any); len(devices) != 1 || devices[0].(map[string]any)["service"] != "apns" {
+		t.Errorf("devices %v", devices)
+	}
+
+	if fields := webpush_fields([]byte("plain text")); fields["body"] != "plain text" {
+		t.Errorf("fields %v", fields)
+	}
+}
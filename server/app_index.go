@@ -0,0 +1,105 @@
+// Mochi server: App lookup indexes
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+// Working out which app handles a path, service or class when nothing is
+// bound to it, or which app a fingerprint names, used to look at every
+// installed app under apps_lock. The resolution caches spare most requests
+// that, but each miss, and every request for a path no app declares, still
+// scanned the lot, so routing slowed as more apps were installed.
+//
+// The index maps each path, service, class and fingerprint to the apps
+// declaring it in any of their versions. A lookup takes those candidates and
+// checks only them against the version the user has active, so it costs
+// the same however many apps are installed. The index is rebuilt from apps
+// on the first lookup after resolution_generation changes, which every
+// change to the installed apps or their versions bumps.
+
+// app_index holds the candidates for each lookup, built for one generation
+type app_index struct {
+	generation   uint64
+	paths        map[string][]*App
+	services     map[string][]*App
+	classes      map[string][]*App
+	fingerprints map[string]*App // Without hyphens
+}
+
+var app_index_current *app_index
+
+// app_index_locked returns the index, rebuilding it if the apps have changed.
+// Must be called with apps_lock held.
+func app_index_locked() *app_index {
+	generation := resolution_generation.Load()
+	if app_index_current != nil && app_index_current.generation == generation {
+		return app_index_current
+	}
+
+	x := &app_index{
+		generation:   generation,
+		paths:        map[string][]*App{},
+		services:     map[string][]*App{},
+		classes:      map[string][]*App{},
+		fingerprints: map[string]*App{},
+	}
+	add := func(m map[string][]*App, key string, a *App) {
+		for _, c := range m[key] {
+			if c == a {
+				return
+			}
+		}
+		m[key] = append(m[key], a)
+	}
+	for _, a := range apps {
+		if fp := fingerprint_no_hyphens(a.fingerprint); fp != "" {
+			x.fingerprints[fp] = a
+		}
+		versions := make([]*AppVersion, 0, len(a.versions)+1)
+		if a.internal != nil {
+			versions = append(versions, a.internal)
+		}
+		for _, av := range a.versions {
+			versions = append(versions, av)
+		}
+		for _, av := range versions {
+			for _, p := range av.Paths {
+				add(x.paths, p, a)
+			}
+			for _, s := range av.Services {
+				add(x.services, s, a)
+			}
+			for _, c := range av.Classes {
+				add(x.classes, c, a)
+			}
+		}
+	}
+	app_index_current = x
+	return x
+}
+
+// app_index_declaring returns the candidates whose version active for the
+// user declares a name, by the list of names it declares. Must be called
+// with apps_lock held.
+func app_index_declaring(user *User, candidates []*App, declared func(*AppVersion) []string, name string) []*App {
+	var result []*App
+	for _, a := range candidates {
+		av := a.active_locked(user)
+		if av == nil {
+			continue
+		}
+		for _, d := range declared(av) {
+			if d == name {
+				result = append(result, a)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func app_version_paths(av *AppVersion) []string    { return av.Paths }
+func app_version_services(av *AppVersion) []string { return av.Services }
+func app_version_classes(av *AppVersion) []string  { return av.Classes }
@@ -0,0 +1,64 @@
+// Mochi server: App lookup index tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAppIndex(t *testing.T) {
+	cleanup := create_test_routing_env(t)
+	defer cleanup()
+
+	for i := range 200 {
+		id := fmt.Sprintf("filler-%d", i)
+		av := &AppVersion{Version: "1.0", Paths: []string{id}, Services: []string{id}}
+		apps[id] = &App{id: id, fingerprint: fingerprint(id), versions: map[string]*AppVersion{"1.0": av}, latest: av}
+	}
+	old := &AppVersion{Version: "1.0", Paths: []string{"wiki"}}
+	current := &AppVersion{Version: "2.0", Paths: []string{"wikis"}, Classes: []string{"wiki"}}
+	wiki := &App{id: "wiki-app", fingerprint: fingerprint("wiki-app"), versions: map[string]*AppVersion{"1.0": old, "2.0": current}, latest: current}
+	apps["wiki-app"] = wiki
+	resolution_invalidate()
+
+	if a := app_for_path_fallback(nil, "filler-17"); a == nil || a.id != "filler-17" {
+		t.Errorf("path: %v", a)
+	}
+	if a := app_for_service_fallback(nil, "filler-42"); a == nil || a.id != "filler-42" {
+		t.Errorf("service: %v", a)
+	}
+	if a := class_app_fallback(nil, "wiki"); a != wiki {
+		t.Errorf("class: %v", a)
+	}
+	if a := app_by_any(nil, fingerprint("wiki-app")); a != wiki {
+		t.Errorf("fingerprint: %v", a)
+	}
+	if a := app_by_any(nil, "wikis"); a != wiki {
+		t.Errorf("path by any: %v", a)
+	}
+
+	// Declared only by a version the user doesn't have active
+	if a := app_for_path_fallback(nil, "wiki"); a != nil {
+		t.Errorf("inactive version's path: %v", a)
+	}
+	if !app_path_taken("wiki", "") || app_path_taken("wiki", "wiki-app") || app_path_taken("nothing", "") {
+		t.Error("app_path_taken")
+	}
+
+	// Rebuilt when the apps change
+	av := &AppVersion{Version: "1.0", Paths: []string{"late"}}
+	late := app_external("late-app")
+	late.load_version(av)
+	if a := app_for_path_fallback(nil, "late"); a != late {
+		t.Errorf("after load: %v", a)
+	}
+	app_deactivate("late-app")
+	if a := app_for_path_fallback(nil, "late"); a != nil {
+		t.Errorf("after deactivate: %v", a)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tailscale/hujson"
@@ -39,21 +40,37 @@ type AppAction struct {
 	Cache     string `json:"cache"`
 	Public    bool   `json:"public"`
 	OpenGraph string `json:"opengraph"` // Starlark function to generate Open Graph meta tags
+	// Concurrency caps simultaneous calls to this action across all users;
+	// calls over the cap are refused with 503 rather than queued. Timeout
+	// replaces [starlark] timeout for this action, in seconds. Zero for either
+	// means the server default.
+	Concurrency int `json:"concurrency"`
+	Timeout     int `json:"timeout"`
+	// Body is the largest request body the action accepts, in kilobytes, in
+	// place of the server's 1MB default and up to [web] body_ceiling. Zero is
+	// the default.
+	Body int `json:"body"`
+	// Stream declares the action an event stream, with a.stream. See sse.go.
+	Stream bool `json:"stream"`
+	// Csrf false exempts the action from CSRF tokens, for API routes whose
+	// callers authenticate with tokens rather than cookies. See csrf.go.
+	Csrf *bool `json:"csrf,omitempty"`
 
 	name              string            `json:"-"`
 	internal_function func(*Action)     `json:"-"`
-	segments          int               `json:"-"`
-	literals          int               `json:"-"`
 	parameters        map[string]string `json:"-"`
 	filepath          string            `json:"-"` // For files routes: the file path suffix after the matched pattern
 }
 
 type AppEvent struct {
-	Function          string       `json:"function"`
-	Anonymous         bool         `json:"anonymous"`
-	Apps              []any        `json:"apps,omitempty"`
-	Services          []string     `json:"services,omitempty"`
-	internal_function func(*Event) `json:"-"`
+	Function  string   `json:"function"`
+	Anonymous bool     `json:"anonymous"`
+	Apps      []any    `json:"apps,omitempty"`
+	Services  []string `json:"services,omitempty"`
+	// Input is an optional JSON schema the event's content must satisfy.
+	// Events that don't are refused before the handler runs.
+	Input             map[string]any `json:"input,omitempty"`
+	internal_function func(*Event)   `json:"-"`
 }
 
 // AppError is one entry in an app's `errors` block: the handler the
@@ -64,9 +81,15 @@ type AppError struct {
 	Function string `json:"function"`
 }
 
+// AppFunction is one entry in an app's `functions` block, callable by other
+// apps with mochi.service.call. Input and Output are optional JSON schemas
+// for its parameters and its result; see schema_parameters for the value
+// Input is checked against.
 type AppFunction struct {
-	Function   string `json:"function"`
-	Permission string `json:"permission,omitempty"`
+	Function   string         `json:"function"`
+	Permission string         `json:"permission,omitempty"`
+	Input      map[string]any `json:"input,omitempty"`
+	Output     map[string]any `json:"output,omitempty"`
 }
 
 // AppTheme is one theme entry in an app's `themes` array. The bundled
@@ -160,21 +183,55 @@ type AppVersion struct {
 	Commit struct {
 		Function string `json:"function"`
 	} `json:"commit,omitempty"`
+	// Erasure.Function is called with an entity's ID when the entity is
+	// erased, and the app should delete what it holds from it. See
+	// compliance.go.
+	Erasure struct {
+		Function string `json:"function"`
+	} `json:"erasure,omitempty"`
 	Themes []AppTheme `json:"themes"`
 	// ThemeIcons lets an app declare per-theme icon variants of itself,
 	// keyed by namespaced theme id ("<app_id>:<theme_id>"). Counterpart
 	// to AppTheme.Icons — see apps.go:2110 for the resolution priority.
 	ThemeIcons map[string]string `json:"theme_icons"`
-	Publisher  struct {
+	// Thumbnails sets the longest side in pixels of the "small", "medium"
+	// and "large" image presets; each one named is also generated in the
+	// background when an image is attached. See variant_presets.
+	Thumbnails map[string]int `json:"thumbnails,omitempty"`
+	// Attachments.Alt set to "required" refuses image attachments without a
+	// description, their alt text. See attachments_labels.go.
+	Attachments struct {
+		Alt  string `json:"alt,omitempty"`
+		Text bool   `json:"text,omitempty"`
+	} `json:"attachments,omitempty"`
+	// Retention names categories of the app's data that are deleted once
+	// older than a number of days, chosen by the user or server, with the
+	// app's default otherwise. See retention.go.
+	Retention map[string]AppRetention `json:"retention,omitempty"`
+	Publisher struct {
 		Peer string `json:"peer,omitempty"`
 	} `json:"publisher,omitempty"`
-
-	app              *App                         `json:"-"`
-	base             string                       `json:"-"`
-	labels           map[string]map[string]string `json:"-"`
-	starlark_once    sync.Once                    `json:"-"`
-	starlark_globals sl.StringDict                `json:"-"`
-	app_json_mtime   time.Time                    `json:"-"`
+	// Cors lets pages at other origins call the app's actions once an
+	// administrator approves them. See cors.go.
+	Cors *AppCors `json:"cors,omitempty"`
+	// Bus.Subscribe maps topic patterns, such as "chat/*", to the function
+	// called with each message published on a matching topic. See bus.go.
+	Bus struct {
+		Subscribe map[string]string `json:"subscribe,omitempty"`
+	} `json:"bus,omitempty"`
+	// Pwa sets how the app installs as a web app: the routes that open
+	// offline, and its colours. See pwa.go.
+	Pwa *AppPwa `json:"pwa,omitempty"`
+
+	app              *App                          `json:"-"`
+	base             string                        `json:"-"`
+	labels           map[string]map[string]string  `json:"-"`
+	starlark_once    sync.Once                     `json:"-"`
+	starlark_globals sl.StringDict                 `json:"-"`
+	starlark_pool    *starlark_pool                `json:"-"`
+	app_json_mtime   time.Time                     `json:"-"`
+	routes           atomic.Pointer[action_routes] `json:"-"`
+	bus_internal     map[string]func(*BusMessage)  `json:"-"`
 }
 
 type Icon struct {
@@ -359,6 +416,9 @@ const (
 	app_version_maximum = 4
 )
 
+// Longest timeout an action may declare, in seconds
+const app_action_timeout_maximum = 3600
+
 // version_greater returns true if version a is greater than version b
 // Versions are compared numerically by splitting on "." (e.g., "1.11" > "1.9")
 func version_greater(a, b string) bool {
@@ -400,11 +460,16 @@ var (
 			{"notifications/send", ""},
 			{"permissions/manage", ""},
 		}},
-		{"12YGtmNxgihPn2cmNSpKfpViFWtWH25xYT7o6xKnTXCA2deNvjH", "Home", nil},
+		{"12YGtmNxgihPn2cmNSpKfpViFWtWH25xYT7o6xKnTXCA2deNvjH", "Home", []struct{ Permission, Object string }{
+			{"activity/manage", ""},
+		}},
 		{"12kqLEaEE9L3mh6modywUmo8TC3JGi3ypPZR2N2KqAMhB3VBFdL", "Apps", []struct{ Permission, Object string }{
+			{"apps/purge", ""},
 			{"permissions/manage", ""},
 		}},
-		{"1PfwgL5rwmRW9HNqX1UNfjubHue7JsbZG8ft3C1fUzxfZT1e92", "Chat", nil},
+		{"1PfwgL5rwmRW9HNqX1UNfjubHue7JsbZG8ft3C1fUzxfZT1e92", "Chat", []struct{ Permission, Object string }{
+			{"presence/manage", ""},
+		}},
 		{"12bMvfv6pVEAVLzBjJuS55oPaZDL3qzoUAtBWB8iK2arTk8GQkr", "Chess", nil},
 		{"1sfEACmTnQhBVgquGhaCs8Jw4SXKF9XY2apnUwJ63duq2QSxh5", "Comptroller", []struct{ Permission, Object string }{
 			{"url", "api.stripe.com"},
@@ -438,9 +503,11 @@ var (
 			{"accounts/read", ""},
 			{"accounts/manage", ""},
 			{"accounts/notify", ""},
+			{"notifications/manage", ""},
 		}},
 		{"1gGcjxdhV2VjuEMLs7UZiQwMaY2jvx1ARbu8g9uqM5QeS2vFJV", "People", []struct{ Permission, Object string }{
 			{"groups/manage", ""},
+			{"presence/manage", ""},
 			{"user/identity/write", ""},
 			{"users/read", ""},
 		}},
@@ -450,12 +517,17 @@ var (
 		{"1FEuUQ9D5usB16Rb5d2QruSbVr6AYqaLkcu3DLhpqCA49VF8Ky", "Settings", []struct{ Permission, Object string }{
 			{"settings/write", ""},
 			{"server/update", ""},
+			{"moderation/manage", ""},
 			{"users/read", ""},
+			{"users/impersonate", ""},
+			{"users/invite", ""},
+			{"users/write", ""},
 			{"accounts/read", ""},
 			{"accounts/manage", ""},
 			{"interests/read", ""},
 			{"interests/write", ""},
 			{"notifications/send", ""},
+			{"retention/manage", ""},
 			{"user/authentication/read", ""},
 			{"user/authentication/write", ""},
 			{"user/export", ""},
@@ -523,20 +595,22 @@ var (
 	})
 
 	api_app = sls.FromStringDict(sl.String("mochi.app"), sl.StringDict{
-		"asset":   api_app_asset,
-		"class":   api_app_class,
-		"cleanup": sl.NewBuiltin("mochi.app.cleanup", api_app_cleanup),
-		"get":     sl.NewBuiltin("mochi.app.get", api_app_get),
-		"icons":   sl.NewBuiltin("mochi.app.icons", api_app_icons),
-		"label":   sl.NewBuiltin("mochi.app.label", api_app_label),
-		"list":    sl.NewBuiltin("mochi.app.list", api_app_list),
-		"package": api_app_package,
-		"path":    api_app_path,
-		"presets": sl.NewBuiltin("mochi.app.presets", api_app_presets),
-		"service": api_app_service,
-		"themes":  sl.NewBuiltin("mochi.app.themes", api_app_themes),
-		"track":   api_app_track,
-		"version": api_app_version,
+		"asset":     api_app_asset,
+		"class":     api_app_class,
+		"cleanup":   sl.NewBuiltin("mochi.app.cleanup", api_app_cleanup),
+		"get":       sl.NewBuiltin("mochi.app.get", api_app_get),
+		"icons":     sl.NewBuiltin("mochi.app.icons", api_app_icons),
+		"label":     sl.NewBuiltin("mochi.app.label", api_app_label),
+		"list":      sl.NewBuiltin("mochi.app.list", api_app_list),
+		"package":   api_app_package,
+		"path":      api_app_path,
+		"presets":   sl.NewBuiltin("mochi.app.presets", api_app_presets),
+		"restore":   sl.NewBuiltin("mochi.app.restore", api_app_restore),
+		"service":   api_app_service,
+		"themes":    sl.NewBuiltin("mochi.app.themes", api_app_themes),
+		"track":     api_app_track,
+		"uninstall": sl.NewBuiltin("mochi.app.uninstall", api_app_uninstall),
+		"version":   api_app_version,
 	})
 )
 
@@ -556,6 +630,7 @@ func app(id string) *App {
 		apps_lock.Lock()
 		apps[id] = a
 		apps_lock.Unlock()
+		resolution_invalidate() // installed app set changed
 	}
 
 	return a
@@ -573,6 +648,7 @@ func app_external(id string) *App {
 		apps_lock.Lock()
 		apps[id] = a
 		apps_lock.Unlock()
+		resolution_invalidate() // installed app set changed
 	}
 
 	return a
@@ -592,26 +668,18 @@ func app_by_any(user *User, s string) *App {
 		return a
 	}
 
-	fp := fingerprint_no_hyphens(s)
 	apps_lock.Lock()
 	defer apps_lock.Unlock()
-	for _, a := range apps {
-		av := a.active_locked(user)
-		if av == nil {
-			continue
-		}
+	x := app_index_locked()
 
-		// Check for fingerprint, with or without hyphens
-		if fingerprint_no_hyphens(a.fingerprint) == fp {
-			return a
-		}
+	// Check for fingerprint, with or without hyphens
+	if a := x.fingerprints[fingerprint_no_hyphens(s)]; a != nil && a.active_locked(user) != nil {
+		return a
+	}
 
-		// Check for path
-		for _, p := range av.Paths {
-			if p == s {
-				return a
-			}
-		}
+	// Check for path
+	if found := app_index_declaring(user, x.paths[s], app_version_paths, s); len(found) > 0 {
+		return found[0]
 	}
 
 	return nil
@@ -621,16 +689,8 @@ func app_by_any(user *User, s string) *App {
 func app_by_root(user *User) *App {
 	apps_lock.Lock()
 	defer apps_lock.Unlock()
-	for _, a := range apps {
-		av := a.active_locked(user)
-		if av == nil {
-			continue
-		}
-		for _, p := range av.Paths {
-			if p == "" {
-				return a
-			}
-		}
+	if found := app_index_declaring(user, app_index_locked().paths[""], app_version_paths, ""); len(found) > 0 {
+		return found[0]
 	}
 	return nil
 }
@@ -803,6 +863,7 @@ func app_download_version(id, version string) bool {
 
 	a := app_external(id)
 	a.load_version(av)
+	cluster_apps_installed(id)
 	debug("App %q version %q installed", id, version)
 	return true
 }
@@ -911,22 +972,7 @@ func internal_service_app(service string) *App {
 func app_for_service_fallback(user *User, service string) *App {
 	apps_lock.Lock()
 	defer apps_lock.Unlock()
-
-	var candidates []*App
-	for _, a := range apps {
-		av := a.active_locked(user)
-		if av == nil {
-			continue
-		}
-		for _, s := range av.Services {
-			if s == service {
-				candidates = append(candidates, a)
-				break
-			}
-		}
-	}
-
-	return app_select_best(candidates)
+	return app_select_best(app_index_declaring(user, app_index_locked().services[service], app_version_services, service))
 }
 
 // app_login_path is the URL path the login app is served at. The
@@ -1023,22 +1069,7 @@ func app_for_path_resolve(user *User, path string) *App {
 func app_for_path_fallback(user *User, path string) *App {
 	apps_lock.Lock()
 	defer apps_lock.Unlock()
-
-	var candidates []*App
-	for _, a := range apps {
-		av := a.active_locked(user)
-		if av == nil {
-			continue
-		}
-		for _, p := range av.Paths {
-			if p == path {
-				candidates = append(candidates, a)
-				break
-			}
-		}
-	}
-
-	return app_select_best(candidates)
+	return app_select_best(app_index_declaring(user, app_index_locked().paths[path], app_version_paths, path))
 }
 
 // app_declares_class returns true if the app's active version declares the given class.
@@ -1101,22 +1132,7 @@ func class_app_resolve(user *User, class string) *App {
 func class_app_fallback(user *User, class string) *App {
 	apps_lock.Lock()
 	defer apps_lock.Unlock()
-
-	var candidates []*App
-	for _, a := range apps {
-		av := a.active_locked(user)
-		if av == nil {
-			continue
-		}
-		for _, c := range av.Classes {
-			if c == class {
-				candidates = append(candidates, a)
-				break
-			}
-		}
-	}
-
-	return app_select_best(candidates)
+	return app_select_best(app_index_declaring(user, app_index_locked().classes[class], app_version_classes, class))
 }
 
 // app_select_best selects the best app from candidates.
@@ -1283,6 +1299,10 @@ func app_install(id string, version string, file string, check_only bool, peer .
 	} else {
 		debug("App %q installing version %q from %q", id, version, file)
 	}
+	if err := disk_full(); err != nil {
+		info("App %q not installed: %v", id, err)
+		return nil, err
+	}
 	if err := os.MkdirAll(filepath.Join(data_dir, "tmp"), 0755); err != nil {
 		return nil, fmt.Errorf("unable to create tmp dir: %w", err)
 	}
@@ -1306,6 +1326,11 @@ func app_install(id string, version string, file string, check_only bool, peer .
 		return nil, fmt.Errorf("Specified version does not match file version")
 	}
 
+	if c := action_routes_compile(av.Actions).conflicts(); len(c) > 0 {
+		_ = os.RemoveAll(tmp)
+		return nil, fmt.Errorf("App actions %q and %q conflict", c[0][0], c[0][1])
+	}
+
 	if check_only {
 		debug("App %q not installing", id)
 		_ = os.RemoveAll(tmp)
@@ -1454,10 +1479,15 @@ func apps_manager() {
 	for {
 		todo := map[string]bool{}
 
-		// Install default apps in priority order (Login and Home first)
+		// Install default apps in priority order (Login and Home first),
+		// except those first-run setup chose to leave out, or while it's
+		// waiting to be done, may yet
+		skip := setup_skipped()
 		for i, app := range apps_default {
 			todo[app.ID] = true
-			app_check_install(app.ID)
+			if !skip[app.ID] && !setup_deferred(app) {
+				app_check_install(app.ID)
+			}
 
 			// Mark bootstrap ready after Login and Home (first two) are installed
 			if i == 1 && !apps_bootstrap_ready {
@@ -1663,7 +1693,7 @@ func app_read(id string, base string) (*AppVersion, error) {
 		}
 	}
 
-	if av.Architecture.Engine != "starlark" {
+	if !av.scripted() {
 		return nil, fmt.Errorf("App bad engine %q version %d", av.Architecture.Engine, av.Architecture.Version)
 	}
 	if av.Architecture.Version < app_version_minimum {
@@ -1743,6 +1773,34 @@ func app_read(id string, base string) (*AppVersion, error) {
 			}
 		}
 
+		if a.Concurrency < 0 {
+			return nil, fmt.Errorf("App bad concurrency %d for action %q", a.Concurrency, action)
+		}
+
+		if a.Timeout < 0 || a.Timeout > app_action_timeout_maximum {
+			return nil, fmt.Errorf("App bad timeout %d for action %q", a.Timeout, action)
+		}
+
+		if a.Body < 0 {
+			return nil, fmt.Errorf("App bad body limit %d for action %q", a.Body, action)
+		}
+
+		if a.Stream && (a.Function == "" || a.File != "" || a.Files != "") {
+			return nil, fmt.Errorf("App bad stream action %q", action)
+		}
+
+	}
+
+	if av.Cors != nil {
+		if err := cors_validate(av.Cors); err != nil {
+			return nil, err
+		}
+	}
+
+	if av.Pwa != nil {
+		if err := pwa_validate(av.Pwa); err != nil {
+			return nil, err
+		}
 	}
 
 	for event, e := range av.Events {
@@ -1765,6 +1823,25 @@ func app_read(id string, base string) (*AppVersion, error) {
 		}
 	}
 
+	if av.Erasure.Function != "" && !valid(av.Erasure.Function, "function") {
+		return nil, fmt.Errorf("App bad erasure function %q", av.Erasure.Function)
+	}
+
+	for pattern, function := range av.Bus.Subscribe {
+		if !bus_pattern_valid(pattern) {
+			return nil, fmt.Errorf("App bad bus pattern %q", pattern)
+		}
+		if !valid(function, "function") {
+			return nil, fmt.Errorf("App bad bus function %q", function)
+		}
+	}
+
+	for category, r := range av.Retention {
+		if err := r.validate(category); err != nil {
+			return nil, err
+		}
+	}
+
 	return &av, nil
 }
 
@@ -1799,25 +1876,9 @@ func app_by_id(id string) *App {
 func app_path_taken(path string, exclude string) bool {
 	apps_lock.Lock()
 	defer apps_lock.Unlock()
-	for _, a := range apps {
-		if a.id == exclude {
-			continue
-		}
-		// Check internal app paths
-		if a.internal != nil {
-			for _, p := range a.internal.Paths {
-				if p == path {
-					return true
-				}
-			}
-		}
-		// Check all external app version paths
-		for _, av := range a.versions {
-			for _, p := range av.Paths {
-				if p == path {
-					return true
-				}
-			}
+	for _, a := range app_index_locked().paths[path] {
+		if a.id != exclude {
+			return true
 		}
 	}
 	return false
@@ -1905,47 +1966,66 @@ func apps_load_published() {
 		if app_exists(id) {
 			continue
 		}
+		app_load_published(id)
+	}
+}
 
-		app_dir := filepath.Join(apps_dir, id)
-		versions, err := file_list(app_dir)
-		if err != nil {
-			debug("App %q: unable to list versions: %v", id, err)
+// app_load_published loads the installed versions of a published app that
+// aren't loaded yet
+func app_load_published(id string) {
+	app_dir := filepath.Join(data_dir, "apps", id)
+	versions, err := file_list(app_dir)
+	if err != nil {
+		debug("App %q: unable to list versions: %v", id, err)
+		return
+	}
+	if len(versions) == 0 {
+		return
+	}
+	a := app_external(id)
+
+	for _, version := range versions {
+		if strings.HasPrefix(version, ".") {
 			continue
 		}
-		if len(versions) == 0 {
+
+		if !valid(version, "version") {
+			debug("App skipping invalid version %q for app %q", version, id)
 			continue
 		}
-		a := app_external(id)
 
-		for _, version := range versions {
-			if strings.HasPrefix(version, ".") {
-				continue
-			}
+		// Skip non-directories (stray files like a misplaced app.db
+		// would otherwise reach app_read and fail noisily).
+		if !file_is_directory(filepath.Join(app_dir, version)) {
+			continue
+		}
 
-			if !valid(version, "version") {
-				debug("App skipping invalid version %q for app %q", version, id)
-				continue
-			}
+		if app_has_version(id, version) {
+			continue
+		}
 
-			// Skip non-directories (stray files like a misplaced app.db
-			// would otherwise reach app_read and fail noisily).
-			if !file_is_directory(filepath.Join(app_dir, version)) {
-				continue
-			}
+		av, err := app_read(id, filepath.Join(app_dir, version))
+		if err != nil {
+			info("App load error: %v", err)
+			continue
+		}
 
-			av, err := app_read(id, filepath.Join(app_dir, version))
-			if err != nil {
-				info("App load error: %v", err)
-				continue
-			}
+		// Check for path conflicts with already-loaded apps (e.g., dev apps)
+		// TODO: Remove this workaround in v0.3 when multiple versions of the same app
+		// can run simultaneously and users choose which version to use.
+		app_resolve_paths(av, id)
 
-			// Check for path conflicts with already-loaded apps (e.g., dev apps)
-			// TODO: Remove this workaround in v0.3 when multiple versions of the same app
-			// can run simultaneously and users choose which version to use.
-			app_resolve_paths(av, id)
+		a.load_version(av)
+	}
+}
 
-			a.load_version(av)
-		}
+// apps_bootstrap_check marks bootstrap ready once Login and Home are
+// loaded. Cluster followers don't run apps_manager, so check when they
+// start and each time the leader installs an app.
+func apps_bootstrap_check() {
+	if !apps_bootstrap_ready && len(apps_default) >= 2 && app_exists(apps_default[0].ID) && app_exists(apps_default[1].ID) {
+		apps_bootstrap_ready = true
+		debug("Essential apps loaded")
 	}
 }
 
@@ -1994,7 +2074,7 @@ func (a *App) load_version(av *AppVersion) {
 		debug("App %q has no labels dir", av.base)
 	}
 	for _, file := range label_files {
-		language := strings.TrimSuffix(file, ".conf")
+		language := language_normalize(strings.TrimSuffix(file, ".conf"))
 		if !valid(language, "locale") {
 			continue
 		}
@@ -2017,6 +2097,12 @@ func (a *App) load_version(av *AppVersion) {
 		}
 	}
 
+	routes := action_routes_compile(av.Actions)
+	for _, c := range routes.conflicts() {
+		info("App %q version %q actions %q and %q conflict; %q takes precedence", a.id, av.Version, c[0], c[1], c[0])
+	}
+	av.routes.Store(routes)
+
 	apps_lock.Lock()
 	av.app = a
 	a.versions[av.Version] = av
@@ -2032,200 +2118,63 @@ func (a *App) load_version(av *AppVersion) {
 	}
 	apps_lock.Unlock()
 	resolution_invalidate() // installed version set changed
+	cors_request(a, av)
 
 	debug("App %q, %q version %q loaded", av.labels["en"][av.Label], a.id, av.Version)
 }
 
 // Register a service for an internal app
 func (a *App) service(service string) {
-	a.internal.Services = append(a.internal.Services, service)
 	apps_lock.Lock()
+	a.internal.Services = append(a.internal.Services, service)
 	internal_services[service] = a
 	apps_lock.Unlock()
+	resolution_invalidate() // declared services changed
 }
 
 // Find the action best matching the specified name
 func (av *AppVersion) find_action(name string) *AppAction {
-	var candidates []AppAction
-
-	for action, aa := range av.Actions {
-		aa.name = action
-		segments := strings.Split(action, "/")
-		aa.segments = len(segments)
-		aa.literals = 0
-		for _, s := range segments {
-			if !strings.HasPrefix(s, ":") && !strings.HasPrefix(s, "*") {
-				aa.literals++
-			}
-		}
-		aa.parameters = map[string]string{}
-		candidates = append(candidates, aa)
+	r := av.routes.Load()
+	if r == nil {
+		r = action_routes_compile(av.Actions)
+		av.routes.Store(r)
 	}
-
-	// Sort candidates: files/feature routes first, then more segments first, then more literals first
-	sort.Slice(candidates, func(i, j int) bool {
-		i_special := candidates[i].Files != "" || candidates[i].Feature != ""
-		j_special := candidates[j].Files != "" || candidates[j].Feature != ""
-		if i_special != j_special {
-			return i_special
-		} else if candidates[i].segments != candidates[j].segments {
-			return candidates[i].segments > candidates[j].segments
-		} else {
-			return candidates[i].literals > candidates[j].literals
-		}
-	})
-
-	for _, aa := range candidates {
-		// Try exact match first
-		if aa.name == name {
-			//debug("App found direct action %q with function %q", name, aa.Function)
-			return &aa
-		}
-
-		// If type files or feature, check for matching parent (try progressively shorter prefixes)
-		// Supports parameterized patterns like :wiki/-/assets
-		if aa.Files != "" || aa.Feature != "" {
-			key_segments := strings.Split(aa.name, "/")
-			match := name
-			for {
-				// Calculate the file path suffix (what comes after the matched pattern)
-				suffix := ""
-				if len(match) < len(name) {
-					suffix = name[len(match)+1:] // +1 to skip the /
-				}
-
-				// Try exact match first
-				if aa.name == match {
-					aa.filepath = suffix
-					return &aa
-				}
-				// Try parameterized match
-				value_segments := strings.Split(match, "/")
-				if len(key_segments) == len(value_segments) {
-					ok := true
-					for i := 0; i < len(key_segments); i++ {
-						ks := key_segments[i]
-						vs := value_segments[i]
-						if strings.HasPrefix(ks, ":") {
-							pname := ks[1:]
-							aa.parameters[pname] = vs
-						} else if ks != vs {
-							ok = false
-							break
-						}
-					}
-					if ok {
-						aa.filepath = suffix
-						return &aa
-					}
-				}
-				// Try shorter prefix
-				idx := strings.LastIndex(match, "/")
-				if idx < 0 {
-					break
-				}
-				match = match[:idx]
-			}
-		}
-
-		// Try dynamic match
-		key_segments := strings.Split(aa.name, "/")
-		value_segments := strings.Split(name, "/")
-
-		// Find greedy parameter position (starts with *), if any
-		greedy_pos := -1
-		for i, ks := range key_segments {
-			if strings.HasPrefix(ks, "*") {
-				greedy_pos = i
-				break
-			}
-		}
-
-		// Calculate suffix length (segments after greedy param)
-		suffix_len := 0
-		if greedy_pos >= 0 {
-			suffix_len = len(key_segments) - greedy_pos - 1
-		}
-
-		// Check segment count compatibility
-		if greedy_pos >= 0 {
-			// Greedy: value must have at least (prefix + 1 + suffix) segments
-			if len(value_segments) < greedy_pos+1+suffix_len {
-				continue
-			}
-		} else if len(key_segments) != len(value_segments) {
-			continue
-		}
-
-		ok := true
-
-		// Match prefix segments (before greedy param)
-		prefix_end := len(key_segments)
-		if greedy_pos >= 0 {
-			prefix_end = greedy_pos
-		}
-		for i := 0; i < prefix_end; i++ {
-			ks := key_segments[i]
-			vs := value_segments[i]
-			if strings.HasPrefix(ks, ":") {
-				aa.parameters[ks[1:]] = vs
-			} else if ks != vs {
-				ok = false
-				break
-			}
-		}
-		if !ok {
-			continue
-		}
-
-		// Match suffix segments (after greedy param) from the end
-		for i := 0; i < suffix_len; i++ {
-			ks := key_segments[len(key_segments)-1-i]
-			vs := value_segments[len(value_segments)-1-i]
-			if strings.HasPrefix(ks, ":") {
-				aa.parameters[ks[1:]] = vs
-			} else if ks != vs {
-				ok = false
-				break
-			}
-		}
-		if !ok {
-			continue
-		}
-
-		// Capture greedy parameter (everything between prefix and suffix)
-		if greedy_pos >= 0 {
-			greedy_end := len(value_segments) - suffix_len
-			pname := key_segments[greedy_pos][1:] // Remove '*'
-			aa.parameters[pname] = strings.Join(value_segments[greedy_pos:greedy_end], "/")
-		}
-
-		return &aa
-	}
-
-	// Fall back to empty action name as catch-all
-	for _, aa := range candidates {
-		if aa.name == "" {
-			//debug("App found fallback action %q with function %q via catch-all", name, aa.Function)
-			return &aa
-		}
+	if aa := r.find(name); aa != nil {
+		return aa
 	}
 
 	info("App %q version %q has no action matching %q", av.app.id, av.Version, name)
 	return nil
 }
 
-// Get a Starlark interpreter for an app version
+// Whether an app version runs app code, rather than being an internal app
+func (av *AppVersion) scripted() bool {
+	return av.Architecture.Engine == "starlark" || av.Architecture.Engine == "wasm"
+}
+
+// Get a Starlark interpreter for an app version. For wasm apps the globals
+// are the module's exports, wrapped as builtins; see wasm.go.
 func (av *AppVersion) starlark() *Starlark {
+	if av.Architecture.Engine == "wasm" {
+		av.starlark_once.Do(func() {
+			av.starlark_globals = wasm_globals(av)
+		})
+		return &Starlark{
+			thread:  &sl.Thread{Name: "main"},
+			globals: av.starlark_globals,
+		}
+	}
 	if dev_reload {
 		return starlark(av.Execute)
 	}
 	av.starlark_once.Do(func() {
-		av.starlark_globals = starlark(av.Execute).globals
+		av.starlark_pool = starlark_pool_new(starlark_pool_size, func() sl.StringDict {
+			return starlark(av.Execute).globals
+		})
 	})
 	return &Starlark{
-		thread:  &sl.Thread{Name: "main"},
-		globals: av.starlark_globals,
+		thread: &sl.Thread{Name: "main"},
+		pool:   av.starlark_pool,
 	}
 }
 
@@ -2272,7 +2221,7 @@ func (av *AppVersion) reload() {
 		debug("App %q has no labels dir", av.base)
 	}
 	for _, file := range label_files {
-		language := strings.TrimSuffix(file, ".conf")
+		language := language_normalize(strings.TrimSuffix(file, ".conf"))
 		if !valid(language, "locale") {
 			continue
 		}
@@ -2306,6 +2255,7 @@ func (av *AppVersion) reload() {
 	av.Label = fresh.Label
 	av.Icons = fresh.Icons
 	av.Actions = fresh.Actions
+	av.routes.Store(action_routes_compile(fresh.Actions))
 	av.Events = fresh.Events
 	av.Functions = fresh.Functions
 	av.Database = fresh.Database
@@ -2316,10 +2266,15 @@ func (av *AppVersion) reload() {
 	av.Themes = fresh.Themes
 	av.ThemeIcons = fresh.ThemeIcons
 	av.IconSymbolic = fresh.IconSymbolic
+	av.Cors = fresh.Cors
+	av.Pwa = fresh.Pwa
 	av.labels = labels
 	av.app_json_mtime = mtime
 	apps_lock.Unlock()
 	resolution_invalidate() // declared services / version metadata changed
+	if av.app != nil {
+		cors_request(av.app, av)
+	}
 }
 
 // mochi.app.get(id) -> dict or None: Get details of an app
@@ -2383,27 +2338,73 @@ func api_app_label(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tupl
 		return sl.String(""), nil
 	}
 
-	// Language priority: user preference (logged in, including last_language
-	// fallback for "auto") > thread-local from request handler (anonymous
-	// Accept-Language) > "en". The handler in web.go calls
-	// request_language(c, user) and stashes the result via s.set("language",
-	// ...) so anonymous public-action calls still get a translated label set.
-	// For composed-then-deferred sends (email/push notifications), the user
-	// is set on the thread but no request context is available; user_language
-	// reads the persisted last_language for those callers.
-	language := "en"
-	if user != nil {
-		language = user_language(user)
-	} else if l, ok := t.Local("language").(string); ok && l != "" {
-		language = l
+	margs, err := starlark_kwargs_to_map(kwargs)
+	if err != nil {
+		return sl_error(fn, "%v", err)
 	}
 
-	margs, err := starlark_kwargs_to_map(kwargs)
+	return sl.String(resolve_label(av, thread_app_language(t, av), key, margs)), nil
+}
+
+// mochi.label(key, count=None, args=None, **kwargs) -> string: Resolve a label
+// key as mochi.app.label() does, for a count. The count is passed to
+// MessageFormat as {count}, and selects the key's plural form for the
+// language where the catalog has one: "files.one", "files.few", "files.other".
+// args is a dict of further substitutions, merged with kwargs.
+func api_label(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return sl_error(fn, "syntax: <key: string>, [count: int], [args: dict], **kwargs")
+	}
+	key, ok := sl.AsString(args[0])
+	if !ok || key == "" {
+		return sl_error(fn, "invalid key")
+	}
+
+	var substitutions []sl.Tuple
+	if len(args) > 2 && args[2] != sl.None {
+		d, ok := args[2].(*sl.Dict)
+		if !ok {
+			return sl_error(fn, "args must be a dictionary")
+		}
+		for _, item := range d.Items() {
+			substitutions = append(substitutions, sl.Tuple{item[0], item[1]})
+		}
+	}
+	substitutions = append(substitutions, kwargs...)
+	if len(args) > 1 && args[1] != sl.None {
+		switch args[1].(type) {
+		case sl.Int, sl.Float:
+		default:
+			return sl_error(fn, "count must be a number")
+		}
+		substitutions = append(substitutions, sl.Tuple{sl.String("count"), args[1]})
+	}
+
+	a, ok := t.Local("app").(*App)
+	if !ok || a == nil {
+		return sl.String(""), nil
+	}
+	user, _ := t.Local("user").(*User)
+	av := a.active(user)
+	if av == nil || av.labels == nil {
+		return sl.String(""), nil
+	}
+
+	margs, err := starlark_kwargs_to_map(substitutions)
 	if err != nil {
 		return sl_error(fn, "%v", err)
 	}
+	return sl.String(resolve_label(av, thread_app_language(t, av), key, margs)), nil
+}
 
-	return sl.String(resolve_label(av, language, key, margs)), nil
+// thread_app_language picks the language an app's labels are resolved in on
+// a thread. The handler in web.go stashes request_languages(c, user) via
+// s.set("languages", ...) alongside the request's language, so an anonymous
+// visitor whose browser accepts "de, fr;q=0.9" gets this app's French
+// catalog if it has no German one, rather than English.
+func thread_app_language(t *sl.Thread, av *AppVersion) string {
+	languages, _ := t.Local("languages").([]string)
+	return app_language(av, languages, thread_language(t))
 }
 
 // starlark_kwargs_to_map converts a Starlark kwargs tuple into a Go map[string]any
@@ -2652,6 +2653,7 @@ func api_app_package_install(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 	if !check_only {
 		na := app_external(id)
 		na.load_version(av)
+		cluster_apps_installed(id)
 	}
 
 	return sl_encode(av.Version), nil
@@ -3329,6 +3331,7 @@ func apps_cleanup_unused_versions() int {
 			}
 		}
 		apps_lock.Unlock()
+		resolution_invalidate() // installed version set changed
 
 		// Delete version directories from disk (only for published apps)
 		if valid(app_id, "entity") {
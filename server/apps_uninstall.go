@@ -0,0 +1,335 @@
+// Mochi server: App uninstall
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+// An administrator uninstalls an app with mochi.app.uninstall(), in two
+// phases. The first takes the app out of service: it is dropped from the
+// apps in memory, so no path, action, service or domain route reaches it,
+// and its system class, service, path, version and track bindings are
+// removed. The second removes its versions from data_dir/apps/<id>/ and
+// deals with each user's data under data_dir/users/<uid>/<id>/ as asked:
+//
+//   - "keep" leaves it, for the app to find if it is installed again
+//   - "archive" moves it into a bundle in data_dir/archive/apps/<id>/,
+//     which mochi.app.restore() puts back
+//   - "purge" deletes it
+//
+// Once both are done, every other app declaring an "app/uninstalled" event
+// is sent one for each user with content of app and data, so apps built
+// on the removed one can tidy up. Default apps can't be uninstalled, since
+// the apps manager installs them again, and nor can development apps.
+
+// app_uninstall_data are the choices for users' data
+var app_uninstall_data = map[string]bool{"keep": true, "archive": true, "purge": true}
+
+// app_uninstall_manifest describes an archive bundle
+type app_uninstall_manifest struct {
+	App      string   `json:"app"`
+	Versions []string `json:"versions"`
+	Created  int64    `json:"created"`
+	Users    []string `json:"users"`
+}
+
+// app_uninstall_users lists the users with data for an app
+func app_uninstall_users(id string) []string {
+	dirs, _ := filepath.Glob(filepath.Join(data_dir, "users", "*", id))
+	var users []string
+	for _, dir := range dirs {
+		if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+			users = append(users, filepath.Base(filepath.Dir(dir)))
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// app_deactivate takes an app out of service, returning its versions
+func app_deactivate(id string) []string {
+	apps_lock.Lock()
+	var versions []string
+	if a, found := apps[id]; found {
+		for v := range a.versions {
+			versions = append(versions, v)
+		}
+		delete(apps, id)
+	}
+	apps_lock.Unlock()
+	sort.Strings(versions)
+
+	db := db_apps()
+	for _, table := range []string{"classes", "services", "paths", "versions", "tracks", "apps"} {
+		db.exec("delete from "+table+" where app=?", id)
+	}
+	resolution_invalidate() // installed app set changed
+	return versions
+}
+
+// app_archive copies users' data for an app into a bundle, returning its
+// name
+func app_archive(id string, versions, users []string) (string, error) {
+	dir := filepath.Join(data_dir, "archive", "apps", id)
+	stamp := time.Unix(now(), 0).UTC()
+	bundle := fmt.Sprintf("%s-%s", stamp.Format("20060102-150405"), export_suffix())
+	tree := filepath.Join(dir, "staging", bundle)
+	if err := os.MkdirAll(tree, 0o700); err != nil {
+		return "", fmt.Errorf("create staging: %w", err)
+	}
+	defer os.RemoveAll(filepath.Join(dir, "staging"))
+
+	for _, uid := range users {
+		if err := export_copy_subtree(filepath.Join(data_dir, "users", uid, id), filepath.Join(tree, uid)); err != nil {
+			return "", fmt.Errorf("copy data of user %q: %w", uid, err)
+		}
+	}
+	manifest := app_uninstall_manifest{App: id, Versions: versions, Created: stamp.Unix(), Users: users}
+	if err := export_write_json(filepath.Join(tree, "manifest.json"), manifest); err != nil {
+		return "", err
+	}
+	if err := export_zip(tree, bundle, filepath.Join(dir, bundle+".zip"), stamp); err != nil {
+		return "", fmt.Errorf("zip bundle: %w", err)
+	}
+	return bundle + ".zip", nil
+}
+
+// app_uninstall_notify sends the "app/uninstalled" event to the other apps
+// that declare it, for each user
+func app_uninstall_notify(id, data string) {
+	apps_lock.Lock()
+	list := make([]*App, 0, len(apps))
+	for _, a := range apps {
+		list = append(list, a)
+	}
+	apps_lock.Unlock()
+
+	rows, _ := db_open("db/users.db").rows("select uid from users where status='active'")
+	for _, row := range rows {
+		uid, _ := row["uid"].(string)
+		u := user_by_uid(uid)
+		if u == nil || u.Identity == nil {
+			continue
+		}
+		for _, a := range list {
+			av := a.active(u)
+			if av == nil {
+				continue
+			}
+			if _, found := av.Events["app/uninstalled"]; !found {
+				continue
+			}
+			services := app_services(a, u)
+			if len(services) == 0 {
+				continue
+			}
+			m := message(u.Identity.ID, u.Identity.ID, services[0], "app/uninstalled")
+			m.content = map[string]any{"app": id, "data": data}
+			m.send()
+		}
+	}
+}
+
+// app_uninstall uninstalls an app, returning what was done
+func app_uninstall(id, data string) (map[string]any, error) {
+	if !is_entity_id(id) {
+		return nil, fmt.Errorf("development apps can't be uninstalled")
+	}
+	for _, d := range apps_default {
+		if d.ID == id {
+			return nil, fmt.Errorf("default apps can't be uninstalled")
+		}
+	}
+	a := app_by_id(id)
+	if a == nil && !file_exists(filepath.Join(data_dir, "apps", id)) {
+		return nil, fmt.Errorf("app not installed")
+	}
+	if a != nil && a.internal != nil {
+		return nil, fmt.Errorf("internal apps can't be uninstalled")
+	}
+
+	// Phase one: out of service
+	versions := app_deactivate(id)
+
+	// Phase two: versions and data
+	if err := os.RemoveAll(filepath.Join(data_dir, "apps", id)); err != nil {
+		return nil, fmt.Errorf("remove versions: %w", err)
+	}
+	users := app_uninstall_users(id)
+	archive := ""
+	if data == "archive" && len(users) > 0 {
+		var err error
+		archive, err = app_archive(id, versions, users)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if data != "keep" {
+		for _, uid := range users {
+			db_purge_prefix(filepath.Join("users", uid, id))
+			if err := os.RemoveAll(filepath.Join(data_dir, "users", uid, id)); err != nil {
+				warn("App uninstall unable to remove data of user %q for app %q: %v", uid, id, err)
+			}
+		}
+	}
+
+	audit_app_removed(id)
+	info("App %q uninstalled, data %s", id, data)
+	app_uninstall_notify(id, data)
+	return map[string]any{"versions": versions, "users": len(users), "archive": archive}, nil
+}
+
+// app_restore puts back the data of users in an archive bundle, except for
+// users who no longer exist or who have data for the app again. Returns
+// how many users' data was restored.
+func app_restore(id, name string) (int, error) {
+	r, err := zip.OpenReader(filepath.Join(data_dir, "archive", "apps", id, name))
+	if err != nil {
+		return 0, fmt.Errorf("open bundle: %w", err)
+	}
+	defer r.Close()
+
+	// Which users to restore is decided before anything is written
+	restore := map[string]bool{}
+	var manifest app_uninstall_manifest
+	for _, f := range r.File {
+		_, rel, _ := strings.Cut(f.Name, "/")
+		if rel != "manifest.json" {
+			continue
+		}
+		in, err := f.Open()
+		if err != nil {
+			return 0, err
+		}
+		err = json.NewDecoder(io.LimitReader(in, 1<<20)).Decode(&manifest)
+		in.Close()
+		if err != nil {
+			return 0, fmt.Errorf("read manifest: %w", err)
+		}
+	}
+	if manifest.App != id {
+		return 0, fmt.Errorf("bundle is not of app %q", id)
+	}
+	for _, uid := range manifest.Users {
+		if user_by_uid(uid) != nil && !file_exists(filepath.Join(data_dir, "users", uid, id)) {
+			restore[uid] = true
+		}
+	}
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		_, rel, _ := strings.Cut(f.Name, "/")
+		uid, rest, found := strings.Cut(rel, "/")
+		if !found || !restore[uid] {
+			continue
+		}
+		base := filepath.Join(data_dir, "users", uid, id)
+		target := filepath.Join(base, filepath.FromSlash(rest))
+		if !strings.HasPrefix(target, base+string(os.PathSeparator)) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+			return 0, err
+		}
+		in, err := f.Open()
+		if err != nil {
+			return 0, err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+		if err != nil {
+			in.Close()
+			return 0, err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	info("App %q data restored for %d users from %q", id, len(restore), name)
+	return len(restore), nil
+}
+
+// mochi.app.uninstall(id, data?) -> dict: Uninstall an app (admin only).
+// data is what happens to each user's data for the app: "keep" (default),
+// "archive" or "purge", which requires apps/purge. Returns versions (those removed), users (how many
+// had data), and archive, the bundle's name for mochi.app.restore() if the
+// data was archived.
+func api_app_uninstall(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	data := "keep"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "data?", &data); err != nil {
+		return nil, err
+	}
+	u, _ := t.Local("user").(*User)
+	if u == nil || !u.administrator() {
+		return sl_error(fn, "not administrator")
+	}
+	if !valid(id, "entity") {
+		return sl_error(fn, "invalid ID %q", id)
+	}
+	if !app_uninstall_data[data] {
+		return sl_error(fn, "invalid data %q", data)
+	}
+	if data == "purge" {
+		if err := require_permission(t, fn, "apps/purge"); err != nil {
+			return sl_error(fn, "%v", err)
+		}
+	}
+	if a, _ := t.Local("app").(*App); a != nil && a.id == id {
+		return sl_error(fn, "an app can't uninstall itself")
+	}
+
+	result, err := app_uninstall(id, data)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl_encode(result), nil
+}
+
+// mochi.app.restore(id, archive) -> int: Restore users' data for an app
+// from a bundle mochi.app.uninstall() archived (admin only). Users who
+// have data for the app again are left alone. Returns how many users' data
+// was restored.
+func api_app_restore(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, archive string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "archive", &archive); err != nil {
+		return nil, err
+	}
+	u, _ := t.Local("user").(*User)
+	if u == nil || !u.administrator() {
+		return sl_error(fn, "not administrator")
+	}
+	if !valid(id, "entity") {
+		return sl_error(fn, "invalid ID %q", id)
+	}
+	if !valid(archive, "filename") || !strings.HasSuffix(archive, ".zip") {
+		return sl_error(fn, "invalid archive %q", archive)
+	}
+
+	n, err := app_restore(id, archive)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.MakeInt(n), nil
+}
@@ -0,0 +1,116 @@
+// Mochi server: App uninstall tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+// app_uninstall_test_setup installs a fake app with one version, used by
+// one user, returning the app's ID and the user's data file
+func app_uninstall_test_setup(t *testing.T) (string, string) {
+	t.Helper()
+	db := db_open("db/users.db")
+	db.exec("create table entities (id text not null primary key, private text not null, fingerprint text not null, user text not null, parent text not null default '', class text not null, name text not null, privacy text not null default 'public', data text not null default '', published integer not null default 0)")
+	db.exec("insert into users (uid, username) values ('u1', 'alice')")
+	db.exec("insert into entities (id, private, fingerprint, user, class, name) values (?, '', 'fp', 'u1', 'person', 'Alice')", test_entity_id('p'))
+
+	id := test_entity_id('a')
+	a := &App{id: id, versions: map[string]*AppVersion{"1.0": {Version: "1.0"}}}
+	apps[id] = a
+	apps_service_set("notes", id)
+	if err := os.MkdirAll(filepath.Join(data_dir, "apps", id, "1.0"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(data_dir, "users", "u1", id, "files", "note.txt")
+	os.MkdirAll(filepath.Dir(file), 0o700)
+	if err := os.WriteFile(file, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return id, file
+}
+
+func TestAppUninstallArchive(t *testing.T) {
+	cleanup := create_test_cleanup_env(t)
+	defer cleanup()
+	id, file := app_uninstall_test_setup(t)
+
+	result, err := app_uninstall(id, "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app_by_id(id) != nil || apps_service_get("notes") != "" {
+		t.Error("app still in service")
+	}
+	if file_exists(filepath.Join(data_dir, "apps", id)) {
+		t.Error("versions not removed")
+	}
+	if file_exists(file) {
+		t.Error("data not removed")
+	}
+	archive, _ := result["archive"].(string)
+	if result["users"] != 1 || archive == "" {
+		t.Fatalf("result %v", result)
+	}
+
+	// Restored once, then left alone
+	n, err := app_restore(id, archive)
+	if err != nil || n != 1 {
+		t.Fatalf("restored %d users, %v", n, err)
+	}
+	if content, _ := os.ReadFile(file); string(content) != "hello" {
+		t.Errorf("restored %q", content)
+	}
+	if n, _ := app_restore(id, archive); n != 0 {
+		t.Errorf("restored over existing data for %d users", n)
+	}
+	if _, err := app_restore(test_entity_id('b'), archive); err == nil {
+		t.Error("restored bundle of another app")
+	}
+}
+
+func TestAppUninstallKeep(t *testing.T) {
+	cleanup := create_test_cleanup_env(t)
+	defer cleanup()
+	id, file := app_uninstall_test_setup(t)
+
+	result, err := app_uninstall(id, "keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !file_exists(file) || result["archive"] != "" {
+		t.Errorf("data not kept, result %v", result)
+	}
+	if _, err := app_uninstall(id, "keep"); err == nil {
+		t.Error("uninstalled twice")
+	}
+	if _, err := app_uninstall(apps_default[0].ID, "keep"); err == nil {
+		t.Error("uninstalled a default app")
+	}
+}
+
+func TestAppUninstallPurgePermission(t *testing.T) {
+	cleanup := create_test_cleanup_env(t)
+	defer cleanup()
+	id, file := app_uninstall_test_setup(t)
+
+	admin := create_test_admin(t, "a1")
+	thread := create_test_thread(admin, create_external_app("appstest"))
+	fn := sl.NewBuiltin("mochi.app.uninstall", api_app_uninstall)
+	args := sl.Tuple{sl.String(id), sl.String("purge")}
+	if _, err := api_app_uninstall(thread, fn, args, nil); err == nil || !file_exists(file) {
+		t.Errorf("purged without apps/purge: %v", err)
+	}
+	permission_grant(admin, "appstest", "apps/purge")
+	if _, err := api_app_uninstall(thread, fn, args, nil); err != nil || file_exists(file) {
+		t.Errorf("purge with apps/purge: %v", err)
+	}
+}
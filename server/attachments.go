@@ -12,6 +12,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"slices"
 	"time"
 
 	sl "go.starlark.net/starlark"
@@ -37,6 +38,8 @@ type Attachment struct {
 	Caption     string `db:"caption"`
 	Description string `db:"description"`
 	Rank        int    `db:"rank"`
+	Pages       int64  `db:"pages"`
+	Focus       string `db:"focus"`
 	Created     int64  `db:"created"`
 }
 
@@ -46,6 +49,11 @@ var api_attachment = sls.FromStringDict(sl.String("mochi.attachment"), sl.String
 	"insert":    sl.NewBuiltin("mochi.attachment.insert", api_attachment_insert),
 	"update":    sl.NewBuiltin("mochi.attachment.update", api_attachment_update),
 	"move":      sl.NewBuiltin("mochi.attachment.move", api_attachment_move),
+	"batch":     sl.NewBuiltin("mochi.attachment.batch", api_attachment_batch),
+	"label":     sl.NewBuiltin("mochi.attachment.label", api_attachment_label),
+	"labels":    sl.NewBuiltin("mochi.attachment.labels", api_attachment_labels),
+	"focus":     sl.NewBuiltin("mochi.attachment.focus", api_attachment_focus),
+	"search":    sl.NewBuiltin("mochi.attachment.search", api_attachment_search),
 	"delete":    sl.NewBuiltin("mochi.attachment.delete", api_attachment_delete),
 	"clear":     sl.NewBuiltin("mochi.attachment.clear", api_attachment_clear),
 	"list":      sl.NewBuiltin("mochi.attachment.list", api_attachment_list),
@@ -58,6 +66,7 @@ var api_attachment = sls.FromStringDict(sl.String("mochi.attachment"), sl.String
 	"store":     sl.NewBuiltin("mochi.attachment.store", api_attachment_store),
 	"sync":      sl.NewBuiltin("mochi.attachment.sync", api_attachment_sync),
 	"fetch":     sl.NewBuiltin("mochi.attachment.fetch", api_attachment_fetch),
+	"fetch_url": sl.NewBuiltin("mochi.attachment.fetch_url", api_attachment_fetch_url),
 })
 
 // attachment_create_module is a callable module that also has a .stream method.
@@ -95,14 +104,27 @@ var reg_attachments = upsert_def{"attachments", []string{"id"}, []string{"object
 
 // Create attachments table in the system database (app.db)
 func (db *DB) attachments_setup() {
-	db.exec("create table if not exists attachments ( id text not null primary key, object text not null, entity text not null default '', name text not null, size integer not null, content_type text not null default '', creator text not null default '', caption text not null default '', description text not null default '', rank integer not null default 0, created integer not null )")
+	db.exec("create table if not exists attachments ( id text not null primary key, object text not null, entity text not null default '', name text not null, size integer not null, content_type text not null default '', creator text not null default '', caption text not null default '', description text not null default '', rank integer not null default 0, pages integer not null default 0, focus text not null default '', created integer not null )")
 	db.exec("create index if not exists attachments_object on attachments( object )")
+	db.attachment_labels_setup()
 
 	// Add rank column if missing (for databases created before rank was added)
 	has_rank, _ := db.exists("select 1 from pragma_table_info('attachments') where name='rank'")
 	if !has_rank {
 		db.exec("alter table attachments add column rank integer not null default 0")
 	}
+
+	// Add pages column if missing (for databases created before PDF page counts)
+	has_pages, _ := db.exists("select 1 from pragma_table_info('attachments') where name='pages'")
+	if !has_pages {
+		db.exec("alter table attachments add column pages integer not null default 0")
+	}
+
+	// Add focus column if missing (for databases created before focal points)
+	has_focus, _ := db.exists("select 1 from pragma_table_info('attachments') where name='focus'")
+	if !has_focus {
+		db.exec("alter table attachments add column focus text not null default ''")
+	}
 }
 
 // Get the file path for an attachment (relative to data_dir)
@@ -128,6 +150,60 @@ func attachment_filename(id string, name string) string {
 	return fmt.Sprintf("%s_%s", id, safe_name)
 }
 
+// attachment_variants_queue queues a new local image attachment's variants
+// for background generation, so the first request for them is not kept
+// waiting on a resize. A PDF gets its page count and first-page previews.
+// Its text is indexed too, if the app wants that.
+func attachment_variants_queue(app *App, owner *User, att *Attachment) {
+	if att.Entity != "" {
+		return
+	}
+	attachment_text_queue(app, owner, att)
+	path := filepath.Join(data_dir, attachment_path(owner.UID, app.id, att.ID, att.Name))
+	if is_image(att.Name) {
+		variant_enqueue_image(app, path)
+		return
+	}
+	if !is_pdf(att.Name) {
+		return
+	}
+	id := att.ID
+	queued := variant_enqueue(func() {
+		if pages := pdf_pages(path); pages > 0 {
+			db := db_app_system(owner, app)
+			if db != nil {
+				db.exec("update attachments set pages=? where id=?", pages, id) // exec-ok: derived from the local file, so each host counts its own copy
+			}
+		}
+		for _, v := range []string{"thumbnail", "preview"} {
+			pdf_variant_create(path, v, app_variant_size(app, v))
+		}
+	})
+	if !queued {
+		debug("Image variant queue full; PDF %q left for first request", path)
+	}
+}
+
+// attachment_variant_file returns the path of a variant of a local attachment
+// file, generating it if needed: a resized or cropped image, or a PDF's first
+// page. Returns "" for files that have no such variant.
+func attachment_variant_file(app *App, path string, att *Attachment, variant string) (string, error) {
+	name := att.Name
+	if base, w, h, crop := variant_crop(variant); crop {
+		if !is_image(name) {
+			return "", nil
+		}
+		return variant_create_crop(path, variant, app_variant_size(app, base), w, h, att.Focus)
+	}
+	if is_image(name) {
+		return variant_create_size(path, variant, app_variant_size(app, variant))
+	}
+	if is_pdf(name) {
+		return pdf_variant_create(path, variant, app_variant_size(app, variant))
+	}
+	return "", nil
+}
+
 // Remove an attachment's file and any generated image variants (thumbnail,
 // preview) from the app's files root.
 func attachment_files_remove(root *os.Root, id string, name string) {
@@ -137,6 +213,14 @@ func attachment_files_remove(root *os.Root, id string, name string) {
 	stem := filename[:len(filename)-len(ext)]
 	root.Remove("thumbnails/" + stem + "_thumbnail" + ext)
 	root.Remove("previews/" + stem + "_preview" + ext)
+	for preset := range variant_presets {
+		root.Remove(variant_dir(preset) + "/" + stem + "_" + preset + ext)
+	}
+	attachment_crops_remove(root, id, name)
+	if is_pdf(filename) {
+		root.Remove("thumbnails/" + pdf_variant_name(filename, "thumbnail"))
+		root.Remove("previews/" + pdf_variant_name(filename, "preview"))
+	}
 }
 
 // Get the next rank for an object
@@ -206,6 +290,7 @@ func attachment_create_record(db *DB, app *App, owner *User, object, name, id st
 	}
 
 	attachment_record_write(db, &att)
+	attachment_variants_queue(app, owner, &att)
 
 	result := att.to_map(app.url_path(owner))
 
@@ -234,6 +319,12 @@ func (a *Attachment) to_map(paths ...string) map[string]any {
 		"created":      a.Created,
 		"image":        is_image(a.Name),
 	}
+	if a.Pages > 0 {
+		m["pages"] = a.Pages
+	}
+	if focus := focus_map(a.Focus); focus != nil {
+		m["focus"] = focus
+	}
 	if len(paths) > 0 && paths[0] != "" {
 		app_path := paths[0]
 		action_path := "attachments"
@@ -245,7 +336,7 @@ func (a *Attachment) to_map(paths ...string) map[string]any {
 			entity = paths[2]
 		}
 		m["url"] = a.attachment_url(app_path, action_path, entity)
-		if is_image(a.Name) {
+		if is_image(a.Name) || (is_pdf(a.Name) && pdf_renderer() != "") {
 			m["thumbnail_url"] = a.attachment_url(app_path, action_path, entity) + "/thumbnail"
 			m["preview_url"] = a.attachment_url(app_path, action_path, entity) + "/preview"
 		}
@@ -343,6 +434,9 @@ func api_attachment_save(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []s
 	if len(files) == 0 {
 		return sl_encode([]map[string]any{}), nil
 	}
+	if err := disk_full(); err != nil {
+		return sl_error(fn, "%v", err)
+	}
 
 	// Open root once for all files (traversal protection)
 	base := attachment_files_base(owner.UID, app.id)
@@ -355,6 +449,16 @@ func api_attachment_save(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []s
 	}
 	defer root.Close()
 
+	for i, fh := range files {
+		description := ""
+		if i < len(descriptions) {
+			description = descriptions[i]
+		}
+		if err := attachment_alt_check(app, owner, fh.Filename, description); err != nil {
+			return sl_error(fn, "%v", err)
+		}
+	}
+
 	var results []map[string]any
 	for i, fh := range files {
 		// Check size
@@ -424,6 +528,7 @@ func api_attachment_save(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []s
 
 		// Insert record
 		attachment_record_write(db, &att)
+		attachment_variants_queue(app, owner, &att)
 
 		results = append(results, att.to_map(app.url_path(owner)))
 	}
@@ -495,6 +600,9 @@ func api_attachment_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 	if owner == nil {
 		return sl_error(fn, "no owner")
 	}
+	if err := attachment_alt_check(app, owner, name, description); err != nil {
+		return sl_error(fn, "%v", err)
+	}
 
 	user := t.Local("user").(*User)
 	creator := ""
@@ -513,6 +621,10 @@ func api_attachment_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 		return sl_error(fn, "file too large: %d bytes", len(bytes))
 	}
 
+	if err := disk_full(); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
 	// Check storage limit (10GB per user across all apps; admins exempt)
 	remaining, err := user_storage_remaining(owner)
 	if err != nil {
@@ -564,6 +676,7 @@ func api_attachment_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 
 	// Insert record
 	attachment_record_write(db, &att)
+	attachment_variants_queue(app, owner, &att)
 
 	result := att.to_map(app.url_path(owner))
 
@@ -635,6 +748,9 @@ func api_attachment_create_stream(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, k
 	if owner == nil {
 		return sl_error(fn, "no owner")
 	}
+	if err := attachment_alt_check(app, owner, name, description); err != nil {
+		return sl_error(fn, "%v", err)
+	}
 
 	user := t.Local("user").(*User)
 	creator := ""
@@ -648,6 +764,11 @@ func api_attachment_create_stream(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, k
 	}
 	db.attachments_setup()
 
+	if err := disk_full(); err != nil {
+		stream.close_read()
+		return sl_error(fn, "%v", err)
+	}
+
 	// Check storage limit and calculate remaining space (admins exempt)
 	remaining, err := user_storage_remaining(owner)
 	if err != nil {
@@ -779,6 +900,9 @@ func api_attachment_insert(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 	if owner == nil {
 		return sl_error(fn, "no owner")
 	}
+	if err := attachment_alt_check(app, owner, name, description); err != nil {
+		return sl_error(fn, "%v", err)
+	}
 
 	user := t.Local("user").(*User)
 	creator := ""
@@ -797,6 +921,10 @@ func api_attachment_insert(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 		return sl_error(fn, "file too large: %d bytes", len(bytes))
 	}
 
+	if err := disk_full(); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
 	// Check storage limit (10GB per user across all apps; admins exempt)
 	remaining, err := user_storage_remaining(owner)
 	if err != nil {
@@ -850,6 +978,7 @@ func api_attachment_insert(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 
 	// Insert record
 	attachment_record_write(db, &att)
+	attachment_variants_queue(app, owner, &att)
 
 	result := att.to_map(app.url_path(owner))
 
@@ -903,6 +1032,13 @@ func api_attachment_update(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 	}
 	db.attachments_setup()
 
+	var existing Attachment
+	if db.scan(&existing, "select * from attachments where id = ?", id) {
+		if err := attachment_alt_check(app, owner, existing.Name, description); err != nil {
+			return sl_error(fn, "%v", err)
+		}
+	}
+
 	// Update record
 	db.attachment_meta_set(id, caption, description)
 
@@ -1056,6 +1192,8 @@ func api_attachment_delete(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 
 	// Delete the record and shift ranks.
 	db.row_remove(reg_attachments, map[string]any{"id": id})
+	db.attachment_labels_delete(id)
+	db.attachment_text_delete(id)
 	db.attachment_shift_down(att.Object, att.Rank)
 
 	// Handle federation notify
@@ -1118,6 +1256,8 @@ func api_attachment_clear(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []
 	// Delete the records.
 	for _, att := range attachments {
 		db.row_remove(reg_attachments, map[string]any{"id": att.ID})
+		db.attachment_labels_delete(att.ID)
+		db.attachment_text_delete(att.ID)
 	}
 
 	// Handle federation notify
@@ -1128,6 +1268,259 @@ func api_attachment_clear(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []
 	return sl.None, nil
 }
 
+// attachment_op is one operation of mochi.attachment.batch
+type attachment_op struct {
+	op       string   // "order", "delete" or "move"
+	ids      []string // attachments of the batch's object it applies to
+	to       string   // object to move to
+	position int      // where to move to, from 1, or 0 for the end
+}
+
+// attachment_batch applies operations to an object's attachments in one
+// transaction, renumbering the ranks of each object it touches once at the
+// end. Every operation is checked before anything is written, so an invalid
+// one leaves the attachments as they were. Returns the ids deleted, and the
+// objects touched with their attachments in order.
+func (db *DB) attachment_batch(object string, ops []attachment_op) ([]string, map[string][]string, error) {
+	objects := map[string][]string{}
+	load := func(o string) error {
+		if _, found := objects[o]; found {
+			return nil
+		}
+		rows, err := db.rows("select id from attachments where object = ? order by rank, id", o)
+		if err != nil {
+			return err
+		}
+		ids := []string{}
+		for _, r := range rows {
+			ids = append(ids, as_string(r["id"]))
+		}
+		objects[o] = ids
+		return nil
+	}
+	if err := load(object); err != nil {
+		return nil, nil, err
+	}
+
+	var deleted []string
+	for i, op := range ops {
+		// Take the operation's attachments out of the object, in the order given
+		current := objects[object]
+		index := make(map[string]bool, len(current))
+		for _, id := range current {
+			index[id] = true
+		}
+		taken := make(map[string]bool, len(op.ids))
+		for _, id := range op.ids {
+			if !index[id] {
+				return nil, nil, fmt.Errorf("operation %d: attachment %q not found in %q", i+1, id, object)
+			}
+			if taken[id] {
+				return nil, nil, fmt.Errorf("operation %d: attachment %q listed twice", i+1, id)
+			}
+			taken[id] = true
+		}
+		rest := make([]string, 0, len(current))
+		for _, id := range current {
+			if !taken[id] {
+				rest = append(rest, id)
+			}
+		}
+
+		switch op.op {
+		case "order":
+			objects[object] = append(append([]string{}, op.ids...), rest...)
+
+		case "delete":
+			objects[object] = rest
+			deleted = append(deleted, op.ids...)
+
+		case "move":
+			if op.to == object || !valid(op.to, "path") {
+				return nil, nil, fmt.Errorf("operation %d: invalid object to move to", i+1)
+			}
+			if err := load(op.to); err != nil {
+				return nil, nil, err
+			}
+			objects[object] = rest
+			into := objects[op.to]
+			at := len(into)
+			if op.position > 0 && op.position <= len(into) {
+				at = op.position - 1
+			}
+			objects[op.to] = append(append(append([]string{}, into[:at]...), op.ids...), into[at:]...)
+
+		default:
+			return nil, nil, fmt.Errorf("operation %d: unknown operation %q", i+1, op.op)
+		}
+	}
+
+	tx, err := db.internal.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	for _, id := range deleted {
+		if _, err := tx.Exec("delete from attachments where id = ?", id); err != nil {
+			return nil, nil, err
+		}
+	}
+	for o, ids := range objects {
+		for rank, id := range ids {
+			if _, err := tx.Exec("update attachments set object = ?, rank = ? where id = ?", o, rank+1, id); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return deleted, objects, nil
+}
+
+// mochi.attachment.batch(object, operations, notify?) -> list: Reorder, delete, and move
+// an object's attachments to other objects, all at once. Each operation is a dict:
+// {"op": "order", "ids": [...]} puts those attachments first, in that order;
+// {"op": "delete", "ids": [...]} deletes them; and {"op": "move", "ids": [...], "to": object,
+// "position": n} moves them to another object, at the end unless a position is given.
+// Either every operation is applied or none is. Returns the object's attachments.
+func api_attachment_batch(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return sl_error(fn, "syntax: <object: string>, <operations: array>, [notify: array]")
+	}
+
+	object, ok := sl.AsString(args[0])
+	if !ok || !valid(object, "path") {
+		return sl_error(fn, "invalid object")
+	}
+
+	list, ok := args[1].(*sl.List)
+	if !ok {
+		return sl_error(fn, "invalid operations")
+	}
+	var ops []attachment_op
+	for i := 0; i < list.Len(); i++ {
+		d, ok := list.Index(i).(*sl.Dict)
+		if !ok {
+			return sl_error(fn, "operation %d is not a dict", i+1)
+		}
+		var op attachment_op
+		if v, found, _ := d.Get(sl.String("op")); found {
+			op.op, _ = sl.AsString(v)
+		}
+		if v, found, _ := d.Get(sl.String("ids")); found {
+			op.ids = sl_decode_string_list(v)
+		}
+		if v, found, _ := d.Get(sl.String("to")); found {
+			op.to, _ = sl.AsString(v)
+		}
+		if v, found, _ := d.Get(sl.String("position")); found {
+			position, err := sl.AsInt32(v)
+			if err != nil || position < 0 {
+				return sl_error(fn, "operation %d: invalid position", i+1)
+			}
+			op.position = position
+		}
+		ops = append(ops, op)
+	}
+
+	var notify []string
+	if len(args) > 2 {
+		notify = sl_decode_string_list(args[2])
+	}
+
+	app := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+
+	owner := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+
+	db := db_app_system(owner, app)
+	if db == nil {
+		return sl_error(fn, "no database")
+	}
+	db.attachments_setup()
+
+	// Keep the deleted attachments, to remove their files once they're gone
+	var removing []Attachment
+	for _, op := range ops {
+		if op.op == "delete" {
+			for _, id := range op.ids {
+				var att Attachment
+				if db.scan(&att, "select * from attachments where id = ? and object = ?", id, object) {
+					removing = append(removing, att)
+				}
+			}
+		}
+	}
+
+	deleted, objects, err := db.attachment_batch(object, ops)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	db.attachment_labels_delete(deleted...)
+	db.attachment_text_delete(deleted...)
+
+	base := attachment_files_base(owner.UID, app.id)
+	if root, err := os.OpenRoot(base); err == nil {
+		for _, att := range removing {
+			attachment_files_remove(root, att.ID, att.Name)
+		}
+		root.Close()
+	}
+
+	url := app.url_path(owner)
+	attachments := func(o string) []Attachment {
+		var rows []Attachment
+		if err := db.scans(&rows, "select * from attachments where object = ? order by rank", o); err != nil {
+			warn("Database error listing attachments: %v", err)
+		}
+		return rows
+	}
+
+	// Handle federation notify: deletions, then moved attachments created in
+	// their new objects, then each object's absolute ranks
+	if len(notify) > 0 {
+		for _, id := range deleted {
+			attachment_notify_delete(app, owner, object, id, notify)
+		}
+		for o := range objects {
+			current := attachments(o)
+			if len(current) == 0 {
+				continue
+			}
+			if o != object {
+				var moved []map[string]any
+				for _, att := range current {
+					for _, op := range ops {
+						if op.op == "move" && op.to == o && slices.Contains(op.ids, att.ID) {
+							moved = append(moved, att.to_map(url))
+						}
+					}
+				}
+				if len(moved) > 0 {
+					attachment_notify_create(app, owner, o, moved, notify)
+				}
+			}
+			ranks := make([]map[string]any, 0, len(current))
+			for _, att := range current {
+				ranks = append(ranks, map[string]any{"id": att.ID, "rank": int64(att.Rank)})
+			}
+			attachment_notify_move(app, owner, current[0].to_map(url), current[0].Rank, ranks, notify)
+		}
+	}
+
+	var results []map[string]any
+	for _, att := range attachments(object) {
+		results = append(results, att.to_map(url))
+	}
+	return sl_encode(results), nil
+}
+
 // mochi.attachment.list(object, entity="") -> list: List attachments for an object
 // If entity is provided, URLs will include the entity for public access
 func api_attachment_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
@@ -1174,6 +1567,7 @@ func api_attachment_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []s
 	for _, att := range attachments {
 		results = append(results, att.to_map(app.url_path(owner), "attachments", entity))
 	}
+	db.attachment_localize(results, attachment_thread_language(t))
 
 	return sl_encode(results), nil
 }
@@ -1210,7 +1604,9 @@ func api_attachment_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 		return sl.None, nil
 	}
 
-	return sl_encode(att.to_map(app.url_path(owner))), nil
+	result := att.to_map(app.url_path(owner))
+	db.attachment_localize([]map[string]any{result}, attachment_thread_language(t))
+	return sl_encode(result), nil
 }
 
 // mochi.attachment.exists(id) -> bool: Check if an attachment exists
@@ -1413,13 +1809,13 @@ func api_attachment_variant(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, variant
 		return sl.None, nil
 	}
 
-	// Only images have variants; decoding a video/PDF/etc would fail
-	if !is_image(att.Name) {
+	// Only images and PDFs have variants; decoding a video etc would fail
+	if !is_image(att.Name) && !is_pdf(att.Name) {
 		return sl.None, nil
 	}
 
 	path := filepath.Join(data_dir, attachment_path(owner.UID, app.id, att.ID, att.Name))
-	thumb, err := variant_create(path, variant)
+	thumb, err := attachment_variant_file(app, path, &att, variant)
 	if err != nil || thumb == "" {
 		return sl.None, nil
 	}
@@ -1610,10 +2006,11 @@ func attachment_fetch_remote(app *App, from string, entity string, id string, va
 	// predates the preview variant and is kept so existing caches stay valid)
 	cache_path := fmt.Sprintf("%s/attachments/%s/%s/%s", cache_dir, entity, app.id, id)
 	switch variant {
+	case "":
 	case "thumbnail":
 		cache_path += ".thumb"
-	case "preview":
-		cache_path += ".preview"
+	default:
+		cache_path += "." + variant
 	}
 	if fi, err := os.Stat(cache_path); err == nil {
 		if time.Since(fi.ModTime()) > cache_max_age {
@@ -1641,13 +2038,25 @@ func attachment_fetch_remote(app *App, from string, entity string, id string, va
 	// The wire flags are separate booleans rather than a variant field so old
 	// receivers keep honouring thumbnail requests; a receiver that predates
 	// previews ignores the preview flag and answers with the original bytes,
-	// which still displays correctly.
+	// which still displays correctly. Presets also go by name in a variant
+	// field, with the nearer of the older flags for receivers that predate them.
 	content := map[string]string{"id": id}
 	switch variant {
 	case "thumbnail":
 		content["thumbnail"] = "true"
 	case "preview":
 		content["preview"] = "true"
+	case "small":
+		content["thumbnail"] = "true"
+		content["variant"] = variant
+	case "medium", "large":
+		content["preview"] = "true"
+		content["variant"] = variant
+	}
+	// Original bytes are negotiated by content hash, so content already
+	// fetched isn't sent again and an interrupted transfer resumes; see blobs.go
+	if variant == "" {
+		content["negotiate"] = "true"
 	}
 	s.write(content)
 
@@ -1664,6 +2073,12 @@ func attachment_fetch_remote(app *App, from string, entity string, id string, va
 		warn("attachment_fetch_remote: failed to create cache dir: %v", err)
 		return ""
 	}
+	if variant == "" {
+		if !blob_receive(s, from, status, cache_path) {
+			return ""
+		}
+		return cache_path
+	}
 	if !file_write_from_reader(cache_path, s.raw_reader()) {
 		//debug("attachment_fetch_remote: failed to write cache file")
 		return ""
@@ -1744,6 +2159,7 @@ func (e *Event) attachment_event_create() {
 
 		e.db.exec(`replace into attachments (id, object, entity, name, size, content_type, creator, caption, description, rank, created) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 			id, att["object"], source, name, att["size"], att["content_type"], att["creator"], att["caption"], att["description"], att["rank"], att["created"])
+		e.attachment_event_focus(id, att)
 	}
 }
 
@@ -1821,6 +2237,8 @@ func (e *Event) attachment_event_update() {
 	// Only update if we have this attachment and it's from this source
 	e.db.exec(`update attachments set caption = ?, description = ? where id = ? and entity = ?`,
 		att["caption"], att["description"], id, source)
+	e.attachment_event_focus(id, att)
+	e.attachment_event_labels(id, att)
 }
 
 // Event handler: _attachment/move
@@ -1930,6 +2348,8 @@ func (e *Event) attachment_event_delete() {
 	var att Attachment
 	if e.db.scan(&att, "select * from attachments where id = ?", id) {
 		e.db.exec("delete from attachments where id = ?", id)
+		e.db.attachment_labels_setup()
+		e.db.attachment_labels_delete(id)
 		e.db.attachment_shift_down(object, att.Rank)
 
 		// Delete local file and image variants using os.Root for traversal protection
@@ -1976,6 +2396,8 @@ func (e *Event) attachment_event_clear() {
 		_ = os.Remove(cache_path)
 	}
 
+	e.db.attachment_labels_setup()
+	e.db.exec("delete from attachment_labels where attachment in (select id from attachments where object = ? and entity = ?)", object, source)
 	e.db.exec("delete from attachments where object = ? and entity = ?", object, source)
 }
 
@@ -2007,6 +2429,9 @@ func (e *Event) attachment_event_data() {
 	if e.get("preview", "") == "true" {
 		variant = "preview"
 	}
+	if v := e.get("variant", ""); v != "" && variant_valid(v) {
+		variant = v
+	}
 
 	//debug("attachment_event_data: looking up attachment id=%s", id)
 	var att Attachment
@@ -2065,9 +2490,9 @@ func (e *Event) attachment_event_data() {
 	}
 	defer root.Close()
 
-	// Serve the requested image variant if the file is an image
-	if variant != "" && is_image(att.Name) {
-		thumb, err := variant_create(path, variant)
+	// Serve the requested variant if the file is an image or PDF
+	if variant != "" {
+		thumb, err := attachment_variant_file(e.app, path, &att, variant)
 		if err == nil && thumb != "" {
 			f, err := os.Open(thumb)
 			if err == nil {
@@ -2088,6 +2513,11 @@ func (e *Event) attachment_event_data() {
 	}
 	defer f.Close()
 
+	if e.get("negotiate", "") == "true" {
+		blob_send(e.stream, path, f)
+		return
+	}
+
 	//debug("attachment_event_data: sending file %s", filename)
 	e.stream.write(map[string]string{"status": "200"})
 	io.Copy(e.stream.writer, f)
@@ -2197,7 +2627,8 @@ func api_attachment_store(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []
 	return sl_encode(count), nil
 }
 
-// mochi.attachment.sync(object, recipients) -> int: Sync attachments to recipients, returns count
+// mochi.attachment.sync(object, recipients) -> int: Sync attachments to recipients, returns count.
+// Syncs nothing and returns 0 while the server's monthly transfer budget is used up.
 func api_attachment_sync(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) != 2 {
 		return sl_error(fn, "syntax: <object: string>, <recipients: array>")
@@ -2239,6 +2670,10 @@ func api_attachment_sync(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []s
 	if len(attachments) == 0 {
 		return sl_encode(0), nil
 	}
+	if transfer_paused() {
+		debug("Attachment sync of %q paused: monthly transfer budget used", object)
+		return sl_encode(0), nil
+	}
 
 	// Convert to maps for notification
 	var results []map[string]any
@@ -0,0 +1,258 @@
+// Mochi server: Localised attachment captions and alt text
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	sl "go.starlark.net/starlark"
+)
+
+// An attachment's caption and description are in whatever language its
+// creator wrote them. Translations are kept alongside, one row per
+// language, and mochi.attachment.list and get return the one best matching
+// the request's language, falling back through its parent languages to the
+// original. An image's description is its alt text: an app whose manifest
+// sets "attachments": {"alt": "required"} can't attach an image without
+// one, or take it away later.
+
+// Limits on the translations an _attachment/update event may carry
+const (
+	attachment_event_labels_limit = 100  // Languages
+	attachment_event_label_length = 4096 // Bytes in a caption or description
+)
+
+// reg_attachment_labels is the upsert definition for translated captions
+var reg_attachment_labels = upsert_def{"attachment_labels", []string{"attachment", "language"}, []string{"caption", "description"}}
+
+// attachment_labels_setup creates the translations table. Called by
+// attachments_setup.
+func (db *DB) attachment_labels_setup() {
+	db.exec("create table if not exists attachment_labels ( attachment text not null, language text not null, caption text not null default '', description text not null default '', primary key ( attachment, language ) )")
+}
+
+// attachment_alt_check returns an error if the app requires alt text, and an
+// image would be left without it
+func attachment_alt_check(app *App, owner *User, name, description string) error {
+	if app == nil || !is_image(name) || strings.TrimSpace(description) != "" {
+		return nil
+	}
+	if av := app.active(owner); av != nil && av.Attachments.Alt == "required" {
+		return fmt.Errorf("image %q needs a description as its alt text", name)
+	}
+	return nil
+}
+
+// attachment_labels_get returns an attachment's translations, by language
+func (db *DB) attachment_labels_get(id string) map[string]map[string]any {
+	labels := map[string]map[string]any{}
+	rows, err := db.rows("select language, caption, description from attachment_labels where attachment = ?", id)
+	if err != nil {
+		return labels
+	}
+	for _, r := range rows {
+		labels[as_string(r["language"])] = map[string]any{"caption": as_string(r["caption"]), "description": as_string(r["description"])}
+	}
+	return labels
+}
+
+// attachment_label_set sets one translation, or removes it if both
+// fields are empty
+func (db *DB) attachment_label_set(id, language, caption, description string) {
+	if caption == "" && description == "" {
+		db.row_remove(reg_attachment_labels, map[string]any{"attachment": id, "language": language})
+		return
+	}
+	db.row_write(reg_attachment_labels, map[string]any{"attachment": id, "language": language, "caption": caption, "description": description})
+}
+
+// attachment_labels_delete removes the translations of deleted attachments
+func (db *DB) attachment_labels_delete(ids ...string) {
+	for _, id := range ids {
+		db.exec("delete from attachment_labels where attachment = ?", id)
+	}
+}
+
+// attachment_localize replaces the caption and description of attachments
+// with their translation into language, where there is one. English is only
+// a fallback for English.
+func (db *DB) attachment_localize(attachments []map[string]any, language string) {
+	if language == "" {
+		return
+	}
+	chain := language_fallbacks(language)
+	if !strings.HasPrefix(chain[0], "en") {
+		chain = chain[:len(chain)-1]
+	}
+	for _, m := range attachments {
+		id, _ := m["id"].(string)
+		labels := db.attachment_labels_get(id)
+		for _, l := range chain {
+			if label, found := labels[l]; found {
+				if caption := label["caption"].(string); caption != "" {
+					m["caption"] = caption
+				}
+				if description := label["description"].(string); description != "" {
+					m["description"] = description
+				}
+				m["language"] = l
+				break
+			}
+		}
+	}
+}
+
+// attachment_thread_language returns the language of the request a thread
+// is answering, if any
+func attachment_thread_language(t *sl.Thread) string {
+	language, _ := t.Local("language").(string)
+	return language
+}
+
+// mochi.attachment.label(id, language, caption, description, notify?) -> dict or None: Set
+// an attachment's caption and description in a language, or remove them if both are empty.
+// Returns the attachment, with all its translations.
+func api_attachment_label(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) < 4 || len(args) > 5 {
+		return sl_error(fn, "syntax: <id: string>, <language: string>, <caption: string>, <description: string>, [notify: array]")
+	}
+
+	id, ok := sl.AsString(args[0])
+	if !ok || id == "" {
+		return sl_error(fn, "invalid id")
+	}
+
+	language, ok := sl.AsString(args[1])
+	language = language_normalize(language)
+	if !ok || !valid(language, "locale") {
+		return sl_error(fn, "invalid language")
+	}
+
+	caption, ok := sl.AsString(args[2])
+	if !ok {
+		return sl_error(fn, "invalid caption")
+	}
+
+	description, ok := sl.AsString(args[3])
+	if !ok {
+		return sl_error(fn, "invalid description")
+	}
+
+	var notify []string
+	if len(args) > 4 {
+		notify = sl_decode_string_list(args[4])
+	}
+
+	app := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+
+	owner := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+
+	db := db_app_system(owner, app)
+	if db == nil {
+		return sl_error(fn, "no database")
+	}
+	db.attachments_setup()
+
+	var att Attachment
+	if !db.scan(&att, "select * from attachments where id = ?", id) {
+		return sl.None, nil
+	}
+	db.attachment_label_set(id, language, caption, description)
+
+	result := att.to_map(app.url_path(owner))
+	result["labels"] = db.attachment_labels_get(id)
+
+	// Handle federation notify
+	if len(notify) > 0 {
+		attachment_notify_update(app, owner, result, notify)
+	}
+
+	return sl_encode(result), nil
+}
+
+// mochi.attachment.labels(id) -> dict: Get an attachment's translations, by language
+func api_attachment_labels(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 1 {
+		return sl_error(fn, "syntax: <id: string>")
+	}
+
+	id, ok := sl.AsString(args[0])
+	if !ok || id == "" {
+		return sl_error(fn, "invalid id")
+	}
+
+	app := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+
+	owner := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+
+	db := db_app_system(owner, app)
+	if db == nil {
+		return sl_error(fn, "no database")
+	}
+	db.attachments_setup()
+
+	return sl_encode(db.attachment_labels_get(id)), nil
+}
+
+// attachment_event_labels replaces the translations of an attachment from
+// an _attachment/update event, if the sender sent them. Events with too many
+// languages are ignored, as are translations that are too long.
+func (e *Event) attachment_event_labels(id string, att map[string]any) {
+	labels := attachment_event_map(att["labels"])
+	if labels == nil || len(labels) > attachment_event_labels_limit {
+		return
+	}
+	e.db.attachment_labels_setup()
+	if found, _ := e.db.exists("select 1 from attachments where id = ? and entity = ?", id, e.from); !found {
+		return
+	}
+	e.db.attachment_labels_delete(id)
+	for language, v := range labels {
+		label := attachment_event_map(v)
+		language = language_normalize(language)
+		if label == nil || !valid(language, "locale") {
+			continue
+		}
+		caption, _ := label["caption"].(string)
+		description, _ := label["description"].(string)
+		if len(caption) > attachment_event_label_length || len(description) > attachment_event_label_length {
+			continue
+		}
+		e.db.attachment_label_set(id, language, caption, description)
+	}
+}
+
+// attachment_event_map returns a map from an event, which CBOR decodes
+// with keys of any type, or nil if it isn't one
+func attachment_event_map(v any) map[string]any {
+	switch m := v.(type) {
+	case map[string]any:
+		return m
+	case map[any]any:
+		out := make(map[string]any, len(m))
+		for k, v := range m {
+			if key, ok := k.(string); ok {
+				out[key] = v
+			}
+		}
+		return out
+	}
+	return nil
+}
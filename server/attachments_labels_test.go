@@ -0,0 +1,85 @@
+// Mochi server: Localised attachment caption tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentLocalize(t *testing.T) {
+	db, cleanup := setup_attachment_move_test(t, "")
+	defer cleanup()
+	db.attachments_setup()
+	db.exec("update attachments set caption = 'Original', description = 'Original alt' where id = 'a'")
+
+	db.attachment_label_set("a", "fr", "Légende", "")
+	db.attachment_label_set("a", "en", "Caption", "Alt")
+
+	for language, want := range map[string][3]string{
+		"":      {"Original", "Original alt", ""},
+		"fr-ca": {"Légende", "Original alt", "fr"},
+		"de":    {"Original", "Original alt", ""}, // English isn't a fallback for German
+		"en-gb": {"Caption", "Alt", "en"},
+	} {
+		m := map[string]any{"id": "a", "caption": "Original", "description": "Original alt"}
+		db.attachment_localize([]map[string]any{m}, language)
+		got, _ := m["language"].(string)
+		if m["caption"] != want[0] || m["description"] != want[1] || got != want[2] {
+			t.Errorf("%q: %v", language, m)
+		}
+	}
+
+	db.attachment_label_set("a", "fr", "", "")
+	if labels := db.attachment_labels_get("a"); len(labels) != 1 || labels["en"] == nil {
+		t.Errorf("labels after removing French %v", labels)
+	}
+
+	// Labels arrive with updates from the attachment's owner
+	e := &Event{from: "", db: db}
+	e.attachment_event_labels("a", map[string]any{"labels": map[any]any{"de": map[any]any{"caption": "Bildunterschrift"}, "BAD LANGUAGE": map[any]any{"caption": "x"}}})
+	if labels := db.attachment_labels_get("a"); len(labels) != 1 || labels["de"]["caption"] != "Bildunterschrift" {
+		t.Errorf("labels from event %v", labels)
+	}
+	e.attachment_event_labels("a", map[string]any{"labels": map[any]any{"de": map[any]any{"caption": "Bildunterschrift"}, "fr": map[any]any{"caption": strings.Repeat("x", attachment_event_label_length+1)}}})
+	if labels := db.attachment_labels_get("a"); len(labels) != 1 || labels["fr"] != nil {
+		t.Errorf("labels after overlong caption %v", labels)
+	}
+	many := map[any]any{}
+	for i := 0; i <= attachment_event_labels_limit; i++ {
+		many[fmt.Sprintf("x%d", i)] = map[any]any{"caption": "x"}
+	}
+	e.attachment_event_labels("a", map[string]any{"labels": many})
+	if labels := db.attachment_labels_get("a"); len(labels) != 1 || labels["de"] == nil {
+		t.Errorf("labels after too many languages %v", labels)
+	}
+
+	db.attachment_labels_delete("a")
+	if labels := db.attachment_labels_get("a"); len(labels) != 0 {
+		t.Errorf("labels after delete %v", labels)
+	}
+}
+
+func TestAttachmentAltRequired(t *testing.T) {
+	av := &AppVersion{}
+	app := &App{id: "feeds", internal: av}
+
+	if err := attachment_alt_check(app, nil, "photo.jpg", ""); err != nil {
+		t.Errorf("alt text required by default: %v", err)
+	}
+	av.Attachments.Alt = "required"
+	if err := attachment_alt_check(app, nil, "photo.jpg", "  "); err == nil {
+		t.Error("image attached without alt text")
+	}
+	if err := attachment_alt_check(app, nil, "photo.jpg", "A cat asleep"); err != nil {
+		t.Errorf("image with alt text refused: %v", err)
+	}
+	if err := attachment_alt_check(app, nil, "notes.txt", ""); err != nil {
+		t.Errorf("alt text required of a text file: %v", err)
+	}
+}
@@ -379,6 +379,65 @@ func TestAttachmentNotifyMoveStubCaptures(t *testing.T) {
 	}
 }
 
+// TestAttachmentBatch applies a reorder and a move together, checks an
+// invalid batch changes nothing, and that deletes leave ranks contiguous.
+func TestAttachmentBatch(t *testing.T) {
+	db, cleanup := setup_attachment_move_test(t, "")
+	defer cleanup()
+	db.exec("insert into attachments (id, object, name, size, rank, created) values ('d', 'obj2', 'd.txt', 10, 1, 1700000000)")
+
+	state := func() map[string]string {
+		rows, _ := db.rows("select id, object, rank from attachments")
+		out := map[string]string{}
+		for _, r := range rows {
+			out[r["id"].(string)] = fmt.Sprintf("%s/%d", r["object"], r["rank"])
+		}
+		return out
+	}
+	check := func(want map[string]string) {
+		t.Helper()
+		got := state()
+		if len(got) != len(want) {
+			t.Errorf("attachments %v, want %v", got, want)
+		}
+		for id, w := range want {
+			if got[id] != w {
+				t.Errorf("attachment %q at %q, want %q", id, got[id], w)
+			}
+		}
+	}
+
+	_, objects, err := db.attachment_batch("obj1", []attachment_op{
+		{op: "order", ids: []string{"c", "a"}},
+		{op: "move", ids: []string{"b"}, to: "obj2", position: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Errorf("touched %v", objects)
+	}
+	check(map[string]string{"c": "obj1/1", "a": "obj1/2", "b": "obj2/1", "d": "obj2/2"})
+
+	for _, ops := range [][]attachment_op{
+		{{op: "delete", ids: []string{"c"}}, {op: "delete", ids: []string{"c"}}},
+		{{op: "order", ids: []string{"a", "a"}}},
+		{{op: "move", ids: []string{"a"}, to: "obj1"}},
+		{{op: "rename", ids: []string{"a"}}},
+	} {
+		if _, _, err := db.attachment_batch("obj1", ops); err == nil {
+			t.Errorf("batch %v applied", ops)
+		}
+	}
+	check(map[string]string{"c": "obj1/1", "a": "obj1/2", "b": "obj2/1", "d": "obj2/2"})
+
+	deleted, _, err := db.attachment_batch("obj1", []attachment_op{{op: "delete", ids: []string{"c"}}})
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("delete: %v %v", deleted, err)
+	}
+	check(map[string]string{"a": "obj1/1", "b": "obj2/1", "d": "obj2/2"})
+}
+
 // Test attachment_content_type detection
 func TestAttachmentContentType(t *testing.T) {
 	tests := []struct {
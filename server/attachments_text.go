@@ -0,0 +1,370 @@
+// Mochi server: Attachment text extraction and search
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	sl "go.starlark.net/starlark"
+)
+
+// An app whose manifest sets "attachments": {"text": true} has the text of
+// its attachments indexed, so mochi.attachment.search can find documents by
+// what's in them. Text is read from plain text files and Word documents
+// directly, from PDFs' text layer with poppler's pdftotext, and from images
+// by OCR with tesseract; without those tools, PDFs and images aren't
+// indexed. Each is found on the PATH or set in [files] pdftotext and
+// tesseract. Extraction runs on the background variant workers after an
+// attachment is created. The index is kept in the app's system database,
+// created the first time it's needed, when the app's existing attachments
+// are queued to fill it.
+
+const (
+	text_max             = 1 << 20  // Bytes of text kept from an attachment
+	text_read_max        = 64 << 20 // Bytes of a document read to find its text
+	text_extract_timeout = time.Minute
+	text_search_limit    = 100
+)
+
+var (
+	text_tools_lock sync.Mutex
+	text_tools      = map[string]string{}
+
+	// Extensions of files indexed as they are
+	text_plain = map[string]bool{".txt": true, ".md": true, ".markdown": true, ".csv": true, ".tsv": true, ".json": true, ".log": true, ".xml": true, ".html": true, ".htm": true}
+)
+
+// text_tool returns the path of an external extraction tool, or "" if it
+// is not available
+func text_tool(name string) string {
+	text_tools_lock.Lock()
+	defer text_tools_lock.Unlock()
+	path, found := text_tools[name]
+	if !found {
+		path = ini_string("files", name, "")
+		if path == "" {
+			path, _ = exec.LookPath(name)
+		}
+		text_tools[name] = path
+	}
+	return path
+}
+
+// attachment_text_enabled reports whether an app has its attachments' text
+// indexed
+func attachment_text_enabled(app *App, owner *User) bool {
+	if app == nil {
+		return false
+	}
+	av := app.active(owner)
+	return av != nil && av.Attachments.Text
+}
+
+// text_extractable reports whether text can be read from a file
+func text_extractable(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case text_plain[ext], ext == ".docx":
+		return true
+	case is_pdf(name):
+		return text_tool("pdftotext") != ""
+	case is_image(name):
+		return text_tool("tesseract") != ""
+	}
+	return false
+}
+
+// text_extract returns the text of a file, at most text_max bytes of it
+func text_extract(path string, name string) (string, error) {
+	var text string
+	var err error
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case text_plain[ext]:
+		text, err = text_read_plain(path)
+	case ext == ".docx":
+		text, err = text_read_docx(path)
+	case is_pdf(name):
+		text, err = text_run("pdftotext", "-enc", "UTF-8", "-q", path, "-")
+	case is_image(name):
+		text, err = text_run("tesseract", path, "stdout", "--loglevel", "ERROR")
+	default:
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	text = strings.ToValidUTF8(text, "")
+	if len(text) > text_max {
+		text = text[:text_max]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return strings.TrimSpace(text), nil
+}
+
+func text_read_plain(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, text_max+utf8.UTFMax))
+	return string(data), err
+}
+
+// text_read_docx reads the paragraphs of a Word document's body
+func text_read_docx(path string) (string, error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer z.Close()
+	for _, f := range z.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+
+		var text strings.Builder
+		d := xml.NewDecoder(io.LimitReader(r, text_read_max))
+		in_text := false
+		for text.Len() < text_max {
+			token, err := d.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			switch t := token.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "t":
+					in_text = true
+				case "tab":
+					text.WriteString("\t")
+				case "br":
+					text.WriteString("\n")
+				}
+			case xml.EndElement:
+				switch t.Name.Local {
+				case "t":
+					in_text = false
+				case "p":
+					text.WriteString("\n")
+				}
+			case xml.CharData:
+				if in_text {
+					text.Write(t)
+				}
+			}
+		}
+		return text.String(), nil
+	}
+	return "", fmt.Errorf("not a Word document")
+}
+
+// text_run returns what an extraction tool writes to its standard output
+func text_run(tool string, args ...string) (string, error) {
+	path := text_tool(tool)
+	if path == "" {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), text_extract_timeout)
+	defer cancel()
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	data, _ := io.ReadAll(io.LimitReader(out, text_max+utf8.UTFMax))
+	io.Copy(io.Discard, out)
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("%s: %v %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(data), nil
+}
+
+// attachment_text_setup creates the text index, returning whether it's new
+func (db *DB) attachment_text_setup() bool {
+	if found, _ := db.exists("select 1 from sqlite_master where type='table' and name='attachment_text'"); found {
+		return false
+	}
+	db.exec("create virtual table if not exists attachment_text using fts5 ( attachment unindexed, name, text, tokenize = 'unicode61 remove_diacritics 2' )")
+	return true
+}
+
+// attachment_text_delete removes deleted attachments from the text index
+func (db *DB) attachment_text_delete(ids ...string) {
+	if found, _ := db.exists("select 1 from sqlite_master where type='table' and name='attachment_text'"); !found {
+		return
+	}
+	for _, id := range ids {
+		db.exec("delete from attachment_text where attachment = ?", id)
+	}
+}
+
+// attachment_text_ready creates an app's text index if needed, and queues
+// its attachments from before the index to be added to it
+func attachment_text_ready(app *App, owner *User, db *DB) {
+	if !db.attachment_text_setup() {
+		return
+	}
+	var existing []Attachment
+	if err := db.scans(&existing, "select * from attachments where entity = ''"); err != nil {
+		return
+	}
+	for _, att := range existing {
+		attachment_text_queue(app, owner, &att)
+	}
+}
+
+// attachment_text_queue queues a new local attachment's text to be indexed,
+// if its app wants it
+func attachment_text_queue(app *App, owner *User, att *Attachment) {
+	if att.Entity != "" || !attachment_text_enabled(app, owner) || !text_extractable(att.Name) {
+		return
+	}
+	path := filepath.Join(data_dir, attachment_path(owner.UID, app.id, att.ID, att.Name))
+	id, name := att.ID, att.Name
+	if !variant_enqueue(func() { attachment_text_index(app, owner, id, name, path) }) {
+		debug("Variant queue full; text of %q not indexed", path)
+	}
+}
+
+// attachment_text_index extracts an attachment's text into the index
+func attachment_text_index(app *App, owner *User, id string, name string, path string) {
+	text, err := text_extract(path, name)
+	if err != nil {
+		// Like an undecodable image, this reflects the file
+		info("Unable to extract text from %q: %v", path, err)
+	}
+	db := db_app_system(owner, app)
+	if db == nil {
+		return
+	}
+	attachment_text_ready(app, owner, db)
+	if found, _ := db.exists("select 1 from attachments where id = ?", id); !found {
+		return
+	}
+	db.exec("delete from attachment_text where attachment = ?", id)                                      // exec-ok: derived from the local file, so each host indexes its own copy
+	db.exec("insert into attachment_text ( attachment, name, text ) values ( ?, ?, ? )", id, name, text) // exec-ok: as above
+}
+
+// text_query turns what a user typed into a full-text query matching every
+// word, the last as a prefix, without letting them use query syntax
+func text_query(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	if len(terms) > 0 {
+		terms[len(terms)-1] += "*"
+	}
+	return strings.Join(terms, " ")
+}
+
+// mochi.attachment.search(query, object?, limit?) -> list: Find attachments by their names and
+// text, best matches first, each with a "snippet" of its text around the match. object limits the
+// search to one object's attachments. Needs "attachments": {"text": true} in the app's manifest.
+func api_attachment_search(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return sl_error(fn, "syntax: <query: string>, [object: string], [limit: integer]")
+	}
+
+	query, ok := sl.AsString(args[0])
+	if !ok {
+		return sl_error(fn, "invalid query")
+	}
+	match := text_query(query)
+
+	object := ""
+	if len(args) > 1 && args[1] != sl.None {
+		object, ok = sl.AsString(args[1])
+		if !ok || (object != "" && !valid(object, "path")) {
+			return sl_error(fn, "invalid object")
+		}
+	}
+
+	limit := 20
+	if len(args) > 2 {
+		if err := sl.AsInt(args[2], &limit); err != nil || limit < 1 {
+			return sl_error(fn, "invalid limit")
+		}
+		limit = min(limit, text_search_limit)
+	}
+
+	app := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+
+	owner := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+	if !attachment_text_enabled(app, owner) {
+		return sl_error(fn, "attachment text is not indexed for this app")
+	}
+
+	db := db_app_system(owner, app)
+	if db == nil {
+		return sl_error(fn, "no database")
+	}
+	db.attachments_setup()
+	attachment_text_ready(app, owner, db)
+
+	results := []map[string]any{}
+	if match == "" {
+		return sl_encode(results), nil
+	}
+	sql := "select attachment, snippet(attachment_text, 2, '', '', '…', 16) as snippet from attachment_text join attachments on attachments.id = attachment_text.attachment where attachment_text match ?"
+	params := []any{match}
+	if object != "" {
+		sql += " and attachments.object = ?"
+		params = append(params, object)
+	}
+	rows, err := db.rows(sql+" order by attachment_text.rank limit ?", append(params, limit)...)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+
+	path := app.url_path(owner)
+	for _, r := range rows {
+		var att Attachment
+		if !db.scan(&att, "select * from attachments where id = ?", r["attachment"]) {
+			continue
+		}
+		m := att.to_map(path)
+		m["snippet"] = as_string(r["snippet"])
+		results = append(results, m)
+	}
+	db.attachment_localize(results, attachment_thread_language(t))
+	return sl_encode(results), nil
+}
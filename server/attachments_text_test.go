@@ -0,0 +1,98 @@
+// Mochi server: Attachment text extraction tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTextExtract(t *testing.T) {
+	dir := t.TempDir()
+
+	notes := filepath.Join(dir, "notes.md")
+	os.WriteFile(notes, []byte("# Minutes\n\nBudget approved\xff\n"), 0644)
+	if text, err := text_extract(notes, "notes.md"); err != nil || text != "# Minutes\n\nBudget approved" {
+		t.Errorf("plain text %q: %v", text, err)
+	}
+
+	report := filepath.Join(dir, "report.docx")
+	f, _ := os.Create(report)
+	z := zip.NewWriter(f)
+	w, _ := z.Create("word/document.xml")
+	w.Write([]byte(`<?xml version="1.0"?><w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body><w:p><w:r><w:t>Quarterly</w:t></w:r><w:r><w:t xml:space="preserve"> report</w:t></w:r></w:p><w:p><w:r><w:t>Revenue</w:t><w:tab/><w:t>up</w:t></w:r></w:p></w:body></w:document>`))
+	z.Close()
+	f.Close()
+	if text, err := text_extract(report, "report.docx"); err != nil || text != "Quarterly report\nRevenue\tup" {
+		t.Errorf("Word document %q: %v", text, err)
+	}
+
+	if _, err := text_extract(notes, "fake.docx"); err == nil {
+		t.Error("read a text file as a Word document")
+	}
+	if text, err := text_extract(notes, "archive.zip"); err != nil || text != "" || text_extractable("archive.zip") {
+		t.Errorf("unsupported file %q: %v", text, err)
+	}
+}
+
+func TestTextQuery(t *testing.T) {
+	for query, want := range map[string]string{
+		"budget":             `"budget"*`,
+		"  quarterly report": `"quarterly" "report"*`,
+		`say "NEAR(a b)" OR`: `"say" """NEAR(a" "b)""" "OR"*`,
+		"   ":                "",
+	} {
+		if got := text_query(query); got != want {
+			t.Errorf("%q: %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestAttachmentTextIndex(t *testing.T) {
+	_, cleanup := setup_attachment_move_test(t, "")
+	defer cleanup()
+	owner := &User{UID: "u1"}
+	app := &App{id: "files", internal: &AppVersion{}}
+	app.internal.Attachments.Text = true
+	db := db_app_system(owner, app)
+	db.attachments_setup()
+	db.exec("insert into attachments (id, object, name, size, rank, created) values ('a', 'post1', 'minutes.txt', 10, 1, 1700000000)")
+
+	path := filepath.Join(data_dir, attachment_path(owner.UID, app.id, "a", "minutes.txt"))
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, []byte("The committee approved the café budget."), 0644)
+	attachment_text_index(app, owner, "a", "minutes.txt", path)
+
+	search := func(query string) []map[string]any {
+		rows, err := db.rows("select attachment, snippet(attachment_text, 2, '', '', '…', 16) as snippet from attachment_text join attachments on attachments.id = attachment_text.attachment where attachment_text match ? and attachments.object = 'post1' order by attachment_text.rank", text_query(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rows
+	}
+	if rows := search("cafe bud"); len(rows) != 1 || rows[0]["attachment"] != "a" {
+		t.Fatalf("search %v", rows)
+	}
+	if rows := search("minutes"); len(rows) != 1 {
+		t.Errorf("search by name %v", rows)
+	}
+	if rows := search("cake"); len(rows) != 0 {
+		t.Errorf("search for what isn't there %v", rows)
+	}
+
+	// An attachment deleted before its text was read isn't indexed
+	attachment_text_index(app, owner, "gone", "minutes.txt", path)
+	db.attachment_text_delete("a")
+	if rows, _ := db.rows("select attachment from attachment_text"); len(rows) != 0 {
+		t.Errorf("index after delete %v", rows)
+	}
+	if db.attachment_text_setup() {
+		t.Error("index created twice")
+	}
+}
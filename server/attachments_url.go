@@ -0,0 +1,314 @@
+// Mochi server: Attachments fetched from URLs
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+// mochi.attachment.fetch_url downloads a file server-side and attaches it,
+// so "attach from URL" needn't route the bytes through the browser. The
+// download is held to the app's url: permissions, including on redirects,
+// and to a size limit and the owner's storage quota. Its type is sniffed
+// from its first bytes rather than taken from the server's word, and checked
+// against the types the app accepts. Before the file is attached it's passed
+// to the [files] scanner if there is one; a file the scanner refuses, or
+// can't scan, is deleted.
+
+const file_scan_timeout = 2 * time.Minute
+
+// attachment_download holds what the app will accept from a URL
+type attachment_download struct {
+	name  string
+	types []string
+	limit int64
+}
+
+// file_scan runs the [files] scanner on a file. The scanner exits 0 for a
+// clean file and 1 for one it refuses; anything else is a failure to scan,
+// and refuses the file too. Without a scanner, every file passes.
+func file_scan(file string) error {
+	command := strings.Fields(ini_string("files", "scanner", ""))
+	if len(command) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), file_scan_timeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, command[0], append(command[1:], file)...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		info("Scanner refused file %q: %s", file, strings.TrimSpace(string(output)))
+		return fmt.Errorf("file refused by scanner")
+	}
+	warn("Unable to scan file %q: %v %s", file, err, strings.TrimSpace(string(output)))
+	return fmt.Errorf("unable to scan file")
+}
+
+// type_allowed reports whether a content type matches one of the patterns,
+// each either a type such as "image/png" or a family such as "image/*". No
+// patterns allow every type.
+func type_allowed(content_type string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == content_type || p == "*/*" || (strings.HasSuffix(p, "/*") && strings.HasPrefix(content_type, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachment_fetch_type decides a download's content type: what its first
+// bytes show it to be, or, if they only show it to be text or binary, the
+// type the server gave, or failing that the one its name suggests
+func attachment_fetch_type(head []byte, declared string, name string) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if sniffed != "application/octet-stream" && sniffed != "text/plain" {
+		return sniffed
+	}
+	if declared, _, _ = mime.ParseMediaType(declared); declared != "" && declared != "application/octet-stream" {
+		return declared
+	}
+	if t, _, _ := mime.ParseMediaType(attachment_content_type(name)); t != "" {
+		return t
+	}
+	return sniffed
+}
+
+// attachment_fetch_name names a download: the name the server gave it, or
+// the last part of its URL's path, ending in an extension for its type
+func attachment_fetch_name(r *http.Response, address string, content_type string) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		if u, err := url.Parse(address); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	name = filepath.Base(strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." || name == "/" {
+		name = "file"
+	}
+	if filepath.Ext(name) == "" {
+		if extensions, _ := mime.ExtensionsByType(content_type); len(extensions) > 0 {
+			name += extensions[0]
+		}
+	}
+	return name
+}
+
+// attachment_url_save downloads a URL into an attachment file for id, and
+// returns the attachment's name, size and content type. Nothing is left
+// behind if the download is refused.
+func attachment_url_save(ctx context.Context, owner *User, app *App, address string, id string, d attachment_download, domains []string) (string, int64, string, error) {
+	remaining, err := user_storage_remaining(owner)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("unable to measure storage: %v", err)
+	}
+	if remaining <= 0 {
+		return "", 0, "", fmt.Errorf("storage limit exceeded")
+	}
+	limit := min(d.limit, attachment_max_size_default)
+	if limit <= 0 {
+		limit = attachment_max_size_default
+	}
+	quota := remaining < limit
+	if quota {
+		limit = remaining
+	}
+	too_large := func() error {
+		if quota {
+			return fmt.Errorf("storage limit exceeded")
+		}
+		return fmt.Errorf("file larger than %d bytes", limit)
+	}
+
+	r, err := url_request(ctx, "GET", address, nil, nil, nil, domains...)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer r.Body.Close()
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return "", 0, "", fmt.Errorf("fetching URL returned status %d", r.StatusCode)
+	}
+	if r.ContentLength > limit {
+		return "", 0, "", too_large()
+	}
+
+	body := bufio.NewReaderSize(r.Body, 512)
+	head, _ := body.Peek(512)
+	content_type := attachment_fetch_type(head, r.Header.Get("Content-Type"), d.name)
+	if !type_allowed(content_type, d.types) {
+		return "", 0, "", fmt.Errorf("file type %q not accepted", content_type)
+	}
+	name := d.name
+	if name == "" {
+		name = attachment_fetch_name(r, address, content_type)
+	}
+
+	base := attachment_files_base(owner.UID, app.id)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", 0, "", fmt.Errorf("unable to create files directory")
+	}
+	root, err := os.OpenRoot(base)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("unable to access files directory")
+	}
+	defer root.Close()
+
+	// Download to a temporary name, so the file only appears once scanned
+	filename := attachment_filename(id, name)
+	partial := filename + ".partial-" + random_alphanumeric(8)
+	f, err := root.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("failed to write attachment")
+	}
+	size, err := io.Copy(f, io.LimitReader(body, limit+1))
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to write attachment")
+	}
+	switch {
+	case err != nil:
+	case size > limit:
+		err = too_large()
+	case size == 0:
+		err = fmt.Errorf("empty attachment")
+	default:
+		err = file_scan(base + "/" + partial)
+	}
+	if err == nil && root.Rename(partial, filename) != nil {
+		err = fmt.Errorf("failed to write attachment")
+	}
+	if err != nil {
+		root.Remove(partial)
+		return "", 0, "", err
+	}
+	return name, size, content_type, nil
+}
+
+// mochi.attachment.fetch_url(object, url, options?) -> dict: Download a file and attach it.
+// options: name, types (list such as ["image/*"]), max_size, caption, description, notify
+func api_attachment_fetch_url(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return sl_error(fn, "syntax: <object: string>, <url: string>, [options: dictionary]")
+	}
+
+	object, ok := sl.AsString(args[0])
+	if !ok || !valid(object, "path") {
+		return sl_error(fn, "invalid object")
+	}
+
+	address, ok := sl.AsString(args[1])
+	if !ok || address == "" {
+		return sl_error(fn, "invalid URL")
+	}
+
+	var options map[string]any
+	if len(args) > 2 {
+		options = sl_decode_map(args[2])
+	}
+	var d attachment_download
+	d.name, _ = options["name"].(string)
+	switch types := options["types"].(type) {
+	case string:
+		d.types = strings.Split(types, ",")
+	case []any:
+		for _, v := range types {
+			if s, ok := v.(string); ok {
+				d.types = append(d.types, s)
+			}
+		}
+	}
+	d.limit, _ = options["max_size"].(int64)
+	caption, _ := options["caption"].(string)
+	description, _ := options["description"].(string)
+	var notify []string
+	if list, ok := options["notify"].([]any); ok {
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				notify = append(notify, s)
+			}
+		}
+	}
+
+	app := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+
+	owner := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+	if d.name != "" {
+		if err := attachment_alt_check(app, owner, d.name, description); err != nil {
+			return sl_error(fn, "%v", err)
+		}
+	}
+
+	if !rate_limit_url.allow(app.id) {
+		return sl_error(fn, "rate limit exceeded")
+	}
+	if err := require_permission_url(t, fn, address); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	user := t.Local("user").(*User)
+	creator := ""
+	if user != nil && user.Identity != nil {
+		creator = user.Identity.ID
+	}
+
+	db := db_app_system(owner, app)
+	if db == nil {
+		return sl_error(fn, "no database")
+	}
+	db.attachments_setup()
+
+	if err := disk_full(); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	id := uid()
+	name, size, content_type, err := attachment_url_save(starlark_context(t), owner, app, address, id, d, url_domains_granted(t))
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if err := attachment_alt_check(app, owner, name, description); err != nil {
+		root, rerr := os.OpenRoot(attachment_files_base(owner.UID, app.id))
+		if rerr == nil {
+			root.Remove(attachment_filename(id, name))
+			root.Close()
+		}
+		return sl_error(fn, "%v", err)
+	}
+
+	result := attachment_create_record(db, app, owner, object, name, id, size, content_type, creator, caption, description, notify)
+	return sl_encode(result), nil
+}
@@ -0,0 +1,84 @@
+// Mochi server: Attachment URL fetch tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentUrlSave(t *testing.T) {
+	allow_private_for_test(t)
+	_, cleanup := setup_attachment_move_test(t, "")
+	defer cleanup()
+	owner := &User{UID: "u1"}
+	app := &App{id: "chat"}
+	os.MkdirAll(user_storage_dir(owner), 0755)
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cat":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte(png))
+		case "/fake.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("<html><body>not an image</body></html>"))
+		case "/virus.txt":
+			w.Write([]byte("EICAR test"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	scanner := t.TempDir() + "/scan"
+	os.WriteFile(scanner, []byte("#!/bin/sh\ngrep -q EICAR \"$1\" && exit 1\nexit 0\n"), 0755)
+	t.Setenv("MOCHI_FILES_SCANNER", scanner)
+
+	files := attachment_files_base(owner.UID, app.id)
+	count := func() int {
+		entries, _ := os.ReadDir(files)
+		return len(entries)
+	}
+
+	images := attachment_download{types: []string{"image/*"}}
+	name, size, content_type, err := attachment_url_save(context.Background(), owner, app, server.URL+"/cat", "a1", images, nil)
+	if err != nil || name != "cat.png" || size != int64(len(png)) || content_type != "image/png" {
+		t.Fatalf("fetched %q %d %q: %v", name, size, content_type, err)
+	}
+	if _, err := os.Stat(files + "/a1_cat.png"); err != nil || count() != 1 {
+		t.Errorf("attachment file %v, %d files", err, count())
+	}
+
+	for _, c := range []struct {
+		path string
+		d    attachment_download
+	}{
+		{"/fake.jpg", images},                    // Sniffed as HTML
+		{"/cat", attachment_download{limit: 50}}, // Too large
+		{"/virus.txt", attachment_download{}},    // Refused by scanner
+		{"/missing", attachment_download{}},      // Not found
+	} {
+		if _, _, _, err := attachment_url_save(context.Background(), owner, app, server.URL+c.path, "b1", c.d, nil); err == nil {
+			t.Errorf("%s accepted", c.path)
+		}
+	}
+	if count() != 1 {
+		t.Errorf("%d files left after refused downloads", count())
+	}
+
+	// A scanner that can't run refuses everything
+	t.Setenv("MOCHI_FILES_SCANNER", "/nonexistent/scanner")
+	if _, _, _, err := attachment_url_save(context.Background(), owner, app, server.URL+"/cat", "c1", attachment_download{}, nil); err == nil {
+		t.Error("file accepted without being scanned")
+	}
+}
@@ -87,6 +87,27 @@ func audit_login_failed(user string, ip string, reason string) {
 	audit_write("AUTH", fmt.Sprintf("login_failed user=%s ip=%s reason=%s", user, ip, reason))
 }
 
+// audit_login_alert logs a sign in from a new device or network region
+func audit_login_alert(user string, ip string, reason string) {
+	audit_write("AUTH", fmt.Sprintf("login_alert user=%s ip=%s reason=%s", user, ip, reason))
+}
+
+// audit_impersonation_started logs an administrator starting to act as a user
+func audit_impersonation_started(admin string, user string, ip string, reason string) {
+	audit_write("AUTH", fmt.Sprintf("impersonation_started admin=%s user=%s ip=%s reason=%q", admin, user, ip, reason))
+}
+
+// audit_impersonation_action logs an action run by an administrator acting
+// as a user
+func audit_impersonation_action(admin string, user string, app string, action string) {
+	audit_write("AUTH", fmt.Sprintf("impersonation_action admin=%s user=%s app=%s action=%s", admin, user, app, action))
+}
+
+// audit_impersonation_ended logs an administrator stopping acting as a user
+func audit_impersonation_ended(admin string, user string, ip string) {
+	audit_write("AUTH", fmt.Sprintf("impersonation_ended admin=%s user=%s ip=%s", admin, user, ip))
+}
+
 // audit_logout logs a user logout
 func audit_logout(user string, ip string) {
 	audit_write("AUTH", fmt.Sprintf("logout user=%s ip=%s", user, ip))
@@ -109,6 +130,17 @@ func audit_access_denied(user string, resource string, operation string) {
 	audit_write("AUTH", fmt.Sprintf("access_denied user=%s resource=%s operation=%s", user, resource, operation))
 }
 
+// audit_service_call logs a call to a service function that requires a
+// permission, with the capability core issued for it
+func audit_service_call(capability string, caller string, via string, user string, function string, permission string) {
+	audit_write("AUTH", fmt.Sprintf("service_call capability=%s caller=%s via=%s user=%s function=%s permission=%s", capability, caller, via, user, function, permission))
+}
+
+// audit_service_denied logs a service call refused for want of a permission
+func audit_service_denied(capability string, caller string, via string, user string, function string, permission string) {
+	audit_write("AUTH", fmt.Sprintf("service_denied capability=%s caller=%s via=%s user=%s function=%s permission=%s", capability, caller, via, user, function, permission))
+}
+
 // audit_permission_changed logs permission changes
 func audit_permission_changed(admin string, subject string, resource string, operation string, grant bool) {
 	action := "deny"
@@ -155,11 +187,36 @@ func audit_user_deleted(admin string, user string) {
 	audit_write("AUTH", fmt.Sprintf("user_deleted admin=%s user=%s", admin, user))
 }
 
+// audit_user_suspended logs a user being suspended by an administrator
+func audit_user_suspended(admin string, user string) {
+	audit_write("AUTH", fmt.Sprintf("user_suspended admin=%s user=%s", admin, user))
+}
+
+// audit_user_reactivated logs a suspended user being reactivated
+func audit_user_reactivated(admin string, user string) {
+	audit_write("AUTH", fmt.Sprintf("user_reactivated admin=%s user=%s", admin, user))
+}
+
+// audit_user_offboarded logs a user being scheduled for deletion
+func audit_user_offboarded(admin string, user string, purge int64) {
+	audit_write("AUTH", fmt.Sprintf("user_offboarded admin=%s user=%s purge=%d", admin, user, purge))
+}
+
 // audit_account_closed logs a self-service account closure
 func audit_account_closed(user string, ip string) {
 	audit_write("AUTH", fmt.Sprintf("account_closed user=%s ip=%s", user, ip))
 }
 
+// audit_subject_access logs a subject access export
+func audit_subject_access(user string, ip string) {
+	audit_write("AUTH", fmt.Sprintf("subject_access user=%s ip=%s", user, ip))
+}
+
+// audit_erasure_requested logs a request for an account to be erased
+func audit_erasure_requested(user string, ip string, purge int64) {
+	audit_write("AUTH", fmt.Sprintf("erasure_requested user=%s ip=%s purge=%d", user, ip, purge))
+}
+
 // audit_account_reactivated logs a cancelled closure (account reactivated)
 func audit_account_reactivated(user string, ip string) {
 	audit_write("AUTH", fmt.Sprintf("account_reactivated user=%s ip=%s", user, ip))
@@ -185,6 +242,18 @@ func audit_email_changed(admin string, user string, old_email string, new_email
 	audit_write("AUTH", fmt.Sprintf("email_changed admin=%s user=%s old=%s new=%s", admin, user, old_email, new_email))
 }
 
+// audit_email_suppressed logs mail to an address being stopped after bounces
+// or a complaint
+func audit_email_suppressed(address string, reason string) {
+	audit_write("AUTH", fmt.Sprintf("email_suppressed address=%s reason=%s", address, reason))
+}
+
+// audit_email_unsuppressed logs an administrator allowing mail to an address
+// again
+func audit_email_unsuppressed(admin string, address string) {
+	audit_write("AUTH", fmt.Sprintf("email_unsuppressed admin=%s address=%s", admin, address))
+}
+
 // audit_rate_limit logs rate limit triggers
 func audit_rate_limit(ip string, limiter string) {
 	audit_write("AUTH", fmt.Sprintf("rate_limit ip=%s limiter=%s", ip, limiter))
@@ -360,10 +360,17 @@ func restore_entities(uid string, account export_account, keys map[string]string
 	udb := db_open("db/users.db")
 	for _, e := range account.Entities {
 		private := keys[e.ID]
+		stored, err := entity_private_store(e.ID, private)
+		if err != nil {
+			warn("Restore unable to store key: %v", err)
+			stored = private
+		}
 		udb.exec("replace into entities (id, private, fingerprint, user, parent, class, name, privacy, data, published) values (?, ?, ?, ?, ?, ?, ?, ?, ?, 0)",
-			e.ID, private, e.Fingerprint, uid, e.Parent, e.Class, e.Name, e.Privacy, e.Data)
+			e.ID, stored, e.Fingerprint, uid, e.Parent, e.Class, e.Name, e.Privacy, e.Data)
+		udb.exec("replace into keys (entity, created) values (?, ?)", e.ID, now())
+		entity_invalidate()
 		if e.Privacy == "public" {
-			ent := Entity{ID: e.ID, Private: private, Fingerprint: e.Fingerprint, User: uid, Parent: e.Parent, Class: e.Class, Name: e.Name, Privacy: e.Privacy, Data: e.Data}
+			ent := Entity{ID: e.ID, Private: stored, Fingerprint: e.Fingerprint, User: uid, Parent: e.Parent, Class: e.Class, Name: e.Name, Privacy: e.Privacy, Data: e.Data}
 			directory_create(&ent)
 			directory_publish(&ent, true)
 		}
@@ -30,6 +30,7 @@ func TestUserRestoreRoundTrip(t *testing.T) {
 	db.exec("alter table users add column restore_source text not null default ''")
 	db.exec("alter table users add column restore_passkeys integer not null default 0")
 	db.exec("create table entities (id text not null primary key, private text not null, fingerprint text not null, user text not null references users(uid) on delete cascade, parent text not null default '', class text not null, name text not null, privacy text not null default 'public', data text not null default '', published integer not null default 0)")
+	db.exec("create table keys (entity text not null primary key references entities(id) on delete cascade, created integer not null)")
 	db.exec("create table relinks (user text not null, service text not null, identifier text not null default '', linked integer not null default 0, primary key (user, service))")
 	// Tables the auth-restore path reads and writes.
 	db.exec("create table totp (user text primary key, secret text not null, verified integer not null default 0, created integer not null)")
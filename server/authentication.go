@@ -59,7 +59,7 @@ func web_login_verify(c *gin.Context) {
 		respond_error(c, http.StatusBadRequest, "missing_code", "errors.missing_code", nil)
 		return
 	}
-	user, reason := user_from_code(body.Code)
+	user, reason := user_from_code(body.Code, c)
 	if user == nil {
 		audit_login_failed("", rate_limit_client_ip(c), reason)
 		switch reason {
@@ -82,6 +82,9 @@ func web_login_verify(c *gin.Context) {
 		return
 	}
 
+	// The code was received, so the address is verified
+	email_verified_mark(user.UID)
+
 	// Check for remaining MFA methods, folding this factor into any pending
 	// partial (a passkey- or OAuth-first flow) rather than starting over.
 	partial, remaining := partial_continue(c, user, "email")
@@ -184,7 +187,11 @@ func auth_remaining_oauth(user *User) []string {
 // identity if missing, create per-device session with its JWT secret, set the
 // browser cookie, and audit the success. Used by both JSON and redirect finish
 // paths.
-func auth_establish_session(c *gin.Context, user *User) {
+func auth_establish_session(c *gin.Context, user *User) string {
+	// A guest signing in or up in this browser hands over what it did
+	if guest := user_by_login(web_cookie_get(c, "session", "")); user_guest(guest) {
+		guest_upgrade(guest, user)
+	}
 	if user != nil && user.Identity == nil {
 		user.Identity = user.identity()
 	}
@@ -195,14 +202,17 @@ func auth_establish_session(c *gin.Context, user *User) {
 	rate_limit_login.reset(rate_limit_client_ip(c))
 	session := login_create(user.UID, c.ClientIP(), c.GetHeader("User-Agent"))
 	web_cookie_set(c, "session", session)
+	login_alert(c, user, session)
 	db_open("db/sessions.db").exec("replace into logins (user, last) values (?, ?)", user.UID, now())
 	audit_login(user.Username, rate_limit_client_ip(c))
+	return session
 }
 
-// auth_complete_login creates a full session and returns session info as JSON.
-// Used by XHR-based login endpoints (email code, passkey, TOTP, MFA).
-func auth_complete_login(c *gin.Context, user *User) {
-	auth_establish_session(c, user)
+// auth_complete_login creates a full session and returns session info as JSON,
+// returning the session's code. Used by XHR-based login endpoints (email
+// code, passkey, TOTP, MFA, pairing).
+func auth_complete_login(c *gin.Context, user *User) string {
+	session := auth_establish_session(c, user)
 
 	response := gin.H{
 		"has_identity": user.Identity != nil && user.Identity.Name != "",
@@ -212,7 +222,13 @@ func auth_complete_login(c *gin.Context, user *User) {
 		response["name"] = user.Identity.Name
 	}
 
+	// A sign in said not to be the user's asks them to review their factors
+	if login_review(user) != nil {
+		response["review"] = true
+	}
+
 	c.JSON(http.StatusOK, response)
+	return session
 }
 
 // redirect_local returns target only if it is a safe same-site relative path,
@@ -278,8 +294,9 @@ func web_auth_methods(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"email":    auth_method_allowed("email"),
 		"passkey":  auth_method_allowed("passkey"),
+		"pairing":  auth_method_allowed("pairing"),
 		"recovery": auth_method_allowed("recovery"),
-		"signup":   setting_signup_enabled(),
+		"signup":   signup_allowed(c),
 		"oauth": gin.H{
 			"google":    oauth_enabled("google"),
 			"github":    oauth_enabled("github"),
@@ -457,7 +474,7 @@ func user_method_available(user *User, method string) bool {
 	case "email", "recovery":
 		return true
 	case "passkey":
-		row, _ := db.row("select count(*) as count from credentials where user=?", user.UID)
+		row, _ := db.row("select count(*) as count from credentials where user=? and revoked=0", user.UID)
 		return row != nil && row["count"].(int64) > 0
 	case "totp":
 		row, _ := db.row("select verified from totp where user=?", user.UID)
@@ -958,7 +975,7 @@ func api_user_methods_set(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []
 	for _, m := range methods {
 		switch m {
 		case "passkey":
-			row, _ := db.row("select count(*) as count from credentials where user=?", user.UID)
+			row, _ := db.row("select count(*) as count from credentials where user=? and revoked=0", user.UID)
 			if row == nil || row["count"].(int64) == 0 {
 				return sl_error(fn, "no passkey registered")
 			}
@@ -1089,9 +1106,10 @@ func api_user_totp_setup(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []s
 	}), nil
 }
 
-// mochi.user.totp.verify(code): during setup, verifies the code and marks
-// TOTP enabled (returns bool). When TOTP is already enabled, this is a
-// step-up re-verify: it advances the re-authentication accrual and returns
+// mochi.user.totp.verify(code, purpose?): during setup, verifies the code and
+// marks TOTP enabled (returns bool). When TOTP is already enabled, this is a
+// step-up re-verify: it advances the re-authentication accrual for the
+// calling app and purpose and returns
 // the result dict ({"token": ...} or {"remaining": [...]}), or None on a
 // bad code.
 func api_user_totp_verify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
@@ -1132,7 +1150,7 @@ func api_user_totp_verify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []
 		if !totp.Validate(code, secret) {
 			return sl.None, nil
 		}
-		return reauthentication_result(user, "totp"), nil
+		return reauthentication_result(t, user, reauthentication_purpose(kwargs), "totp"), nil
 	}
 
 	if !totp.Validate(code, secret) {
@@ -26,7 +26,7 @@ func TestUserMethodsConfigure(t *testing.T) {
 	users := db_open("db/users.db")
 	// create_test_users_db now includes the disabled column; add the credential
 	// tables that availability checks read.
-	users.exec("create table credentials (id blob primary key, user text not null, public_key blob not null, sign_count integer not null default 0, name text not null default '', transports text not null default '', backup_eligible integer not null default 0, backup_state integer not null default 0, created integer not null)")
+	users.exec("create table credentials (id blob primary key, user text not null, public_key blob not null, sign_count integer not null default 0, name text not null default '', transports text not null default '', backup_eligible integer not null default 0, backup_state integer not null default 0, aaguid text not null default '', attestation text not null default '', verified integer not null default 0, revoked integer not null default 0, created integer not null)")
 	users.exec("create table totp (user text primary key, secret text not null, verified integer not null default 0, created integer not null)")
 
 	settings := db_open("db/settings.db")
@@ -136,7 +136,7 @@ func TestUserMethodStateOperatorClamp(t *testing.T) {
 	defer cleanup()
 
 	users := db_open("db/users.db")
-	users.exec("create table credentials (id blob primary key, user text not null, public_key blob not null, sign_count integer not null default 0, name text not null default '', transports text not null default '', backup_eligible integer not null default 0, backup_state integer not null default 0, created integer not null)")
+	users.exec("create table credentials (id blob primary key, user text not null, public_key blob not null, sign_count integer not null default 0, name text not null default '', transports text not null default '', backup_eligible integer not null default 0, backup_state integer not null default 0, aaguid text not null default '', attestation text not null default '', verified integer not null default 0, revoked integer not null default 0, created integer not null)")
 	users.exec("create table totp (user text primary key, secret text not null, verified integer not null default 0, created integer not null)")
 	settings := db_open("db/settings.db")
 	settings.exec("create table settings (name text primary key, value text not null)")
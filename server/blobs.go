@@ -0,0 +1,204 @@
+// Mochi server: Content-addressed attachment transfer
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// When a server fetches an attachment's bytes from a peer with
+// _attachment/data, it asks to negotiate. The peer answers with the file's
+// SHA-256 and size before sending anything, and the fetcher replies either
+// that it already has that content, in which case nothing is sent, or with
+// the offset to send from. Bytes are appended to a partial file as they
+// arrive, so a transfer cut off part way resumes from where it stopped the
+// next time, and the whole is checked against the hash before it is kept.
+// A peer that predates negotiation ignores the request and sends the whole
+// file, as before.
+//
+// Received content is kept in cache_dir/blobs/<entity>/<hash>, one store per
+// fetching entity. A shared store would let any peer learn whether content
+// it names by hash is on the server, by whether the fetcher asks for it.
+// Blobs are hard-linked into the attachment cache where possible, and are
+// expired with the rest of the cache.
+//
+// The sending side caches each file's hash in db/blobs.db, keyed by path,
+// size and modification time, so a file is hashed once however often it's
+// fetched.
+
+var blob_hash_match = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// blobs_db opens the hash cache, creating its table if needed
+func blobs_db() *DB {
+	db := db_open("db/blobs.db")
+	db.exec("create table if not exists hashes (path text not null primary key, size integer not null, modified integer not null, hash text not null)")
+	return db
+}
+
+// blob_hash returns the SHA-256 and size of an open file, from the cache if
+// it hasn't changed since it was last hashed. The file is left at its start.
+func blob_hash(path string, f *os.File) (string, int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	db := blobs_db()
+	modified := stat.ModTime().UnixNano()
+	if row, _ := db.row("select hash from hashes where path=? and size=? and modified=?", path, stat.Size(), modified); row != nil {
+		if hash, _ := row["hash"].(string); hash != "" {
+			return hash, stat.Size(), nil
+		}
+	}
+
+	hash, size, err := export_hash(path)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	db.exec("replace into hashes (path, size, modified, hash) values (?, ?, ?, ?)", path, size, modified, hash)
+	return hash, size, nil
+}
+
+// blobs_cleanup forgets the hashes of files that no longer exist
+func blobs_cleanup() {
+	if !file_exists(filepath.Join(data_dir, "db", "blobs.db")) {
+		return
+	}
+	db := blobs_db()
+	rows, _ := db.rows("select path from hashes")
+	for _, r := range rows {
+		path, _ := r["path"].(string)
+		if !file_exists(path) {
+			db.exec("delete from hashes where path=?", path)
+		}
+	}
+}
+
+// blob_path returns where content fetched by an entity is kept
+func blob_path(from, hash string) string {
+	if !valid(from, "entity") {
+		from = "_"
+	}
+	return filepath.Join(cache_dir, "blobs", from, hash)
+}
+
+// blob_link makes dst a copy of the blob at src, hard-linked if possible,
+// and marks the blob used so the cache keeps it
+func blob_link(src, dst string) error {
+	t := time.Now()
+	os.Chtimes(src, t, t)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	os.Remove(dst)
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	return file_copy(src, dst)
+}
+
+// blob_send answers a negotiating fetch of a file: its hash and size, then
+// the bytes the fetcher asks for, if any
+func blob_send(s *Stream, path string, f *os.File) {
+	hash, size, err := blob_hash(path, f)
+	if err != nil {
+		warn("Blob unable to hash %q: %v", path, err)
+		s.write(map[string]string{"status": "500"})
+		return
+	}
+	s.write(map[string]string{"status": "200", "hash": hash, "size": i64toa(size)})
+
+	reply, err := s.read_content()
+	if err != nil {
+		return
+	}
+	if reply["have"] == "true" {
+		return
+	}
+	offset := int64(0)
+	if o, ok := reply["offset"].(string); ok {
+		offset = atoi(o, 0)
+	}
+	if offset < 0 || offset > size {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	io.Copy(s.writer, f)
+	s.close_write()
+}
+
+// blob_receive completes a negotiating fetch into dst, given the sender's
+// status. Returns whether dst now holds the verified content. A transfer
+// cut off part way keeps what arrived, to resume from next time.
+func blob_receive(s *Stream, from string, status map[string]any, dst string) bool {
+	hash, _ := status["hash"].(string)
+	size := int64(-1)
+	if v, ok := status["size"].(string); ok {
+		size = atoi(v, -1)
+	}
+	if !blob_hash_match.MatchString(hash) || size < 0 {
+		// The sender predates negotiation, and is sending the whole file
+		return file_write_from_reader(dst, s.raw_reader())
+	}
+
+	blob := blob_path(from, hash)
+	if file_exists(blob) {
+		if err := s.write_content("have", "true"); err != nil {
+			debug("Blob unable to decline transfer: %v", err)
+		}
+		return blob_link(blob, dst) == nil
+	}
+
+	partial := blob + ".partial"
+	offset := int64(0)
+	if stat, err := os.Stat(partial); err == nil {
+		offset = stat.Size()
+		if offset > size {
+			os.Remove(partial)
+			offset = 0
+		}
+	}
+	if err := s.write_content("offset", i64toa(offset)); err != nil {
+		return false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		warn("Blob unable to create directory: %v", err)
+		return false
+	}
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		warn("Blob unable to open %q: %v", partial, err)
+		return false
+	}
+	_, err = io.Copy(f, io.LimitReader(s.raw_reader(), size-offset))
+	f.Close()
+	if stat, serr := os.Stat(partial); serr != nil || stat.Size() < size {
+		debug("Blob transfer of %s stopped at %d of %d bytes: %v", hash, offset, size, err)
+		return false
+	}
+
+	got, _, err := export_hash(partial)
+	if err != nil || got != hash {
+		warn("Blob transfer of %s failed verification, got %s", hash, got)
+		os.Remove(partial)
+		return false
+	}
+	if err := os.Rename(partial, blob); err != nil {
+		warn("Blob unable to store %s: %v", hash, err)
+		return false
+	}
+	return blob_link(blob, dst) == nil
+}
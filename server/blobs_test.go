@@ -0,0 +1,204 @@
+// Mochi server: Content-addressed attachment transfer tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// blob_test_setup points the data and cache directories at temporary ones
+func blob_test_setup(t *testing.T) {
+	t.Helper()
+	saved := cache_dir
+	setup_test_data_dir(t)
+	cache_dir = t.TempDir()
+	t.Cleanup(func() {
+		cleanup_test_data_dir(t)
+		cache_dir = saved
+	})
+}
+
+// blob_test_fetch transfers a file between a pair of connected streams,
+// returning whether dst received it and how many bytes were sent
+func blob_test_fetch(t *testing.T, path, from, dst string) (bool, int64) {
+	t.Helper()
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	counter := &blob_test_counter{w: w1}
+	fetcher := stream_rw(r1, w2)
+	sender := stream_rw(r2, counter)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w1.Close()
+		f, err := os.Open(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		blob_send(sender, path, f)
+	}()
+
+	status, err := fetcher.read_content()
+	if err != nil || status["status"] != "200" {
+		t.Fatalf("status %v, error %v", status, err)
+	}
+	ok := blob_receive(fetcher, from, status, dst)
+	r1.Close()
+	<-done
+	return ok, counter.raw
+}
+
+// blob_test_counter counts the bytes written after the first segment
+type blob_test_counter struct {
+	w   io.WriteCloser
+	n   int
+	raw int64
+}
+
+func (c *blob_test_counter) Write(p []byte) (int, error) {
+	c.n++
+	if c.n > 1 {
+		c.raw += int64(len(p))
+	}
+	return c.w.Write(p)
+}
+
+func (c *blob_test_counter) Close() error {
+	return c.w.Close()
+}
+
+func TestBlobTransfer(t *testing.T) {
+	blob_test_setup(t)
+	from := "1" + string(bytes.Repeat([]byte("a"), 49))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photo.jpg")
+	data := bytes.Repeat([]byte("mochi"), 10000)
+	os.WriteFile(path, data, 0o600)
+
+	// The first fetch sends everything
+	dst := filepath.Join(dir, "first")
+	ok, sent := blob_test_fetch(t, path, from, dst)
+	if got, _ := os.ReadFile(dst); !ok || !bytes.Equal(got, data) {
+		t.Fatal("first fetch did not deliver the file")
+	}
+	if sent < int64(len(data)) {
+		t.Errorf("sent %d bytes, want at least %d", sent, len(data))
+	}
+
+	// Content already held isn't sent again
+	again := filepath.Join(dir, "again")
+	ok, sent = blob_test_fetch(t, path, from, again)
+	if got, _ := os.ReadFile(again); !ok || !bytes.Equal(got, data) {
+		t.Fatal("second fetch did not deliver the file")
+	}
+	if sent > int64(len(data))/10 {
+		t.Errorf("sent %d bytes for content already held", sent)
+	}
+
+	// Another entity has its own store, and is sent the file
+	other := filepath.Join(dir, "other")
+	if _, sent = blob_test_fetch(t, path, "", other); sent < int64(len(data)) {
+		t.Errorf("sent %d bytes to another entity, want the whole file", sent)
+	}
+}
+
+func TestBlobResume(t *testing.T) {
+	blob_test_setup(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "video.mp4")
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	os.WriteFile(path, data, 0o600)
+	hash, _, _ := export_hash(path)
+
+	// Half arrived before the transfer was cut off
+	partial := blob_path("", hash) + ".partial"
+	os.MkdirAll(filepath.Dir(partial), 0o755)
+	os.WriteFile(partial, data[:len(data)/2], 0o644)
+
+	dst := filepath.Join(dir, "resumed")
+	ok, sent := blob_test_fetch(t, path, "", dst)
+	if got, _ := os.ReadFile(dst); !ok || !bytes.Equal(got, data) {
+		t.Fatal("resumed fetch did not deliver the file")
+	}
+	if sent >= int64(len(data)) {
+		t.Errorf("sent %d bytes resuming, want about half of %d", sent, len(data))
+	}
+
+	// A partial that doesn't match fails verification and is discarded,
+	// and the next fetch starts again
+	os.Remove(blob_path("", hash))
+	os.WriteFile(partial, bytes.Repeat([]byte("x"), len(data)/2), 0o644)
+	if ok, _ := blob_test_fetch(t, path, "", filepath.Join(dir, "corrupt")); ok {
+		t.Error("corrupt transfer accepted")
+	}
+	if file_exists(partial) {
+		t.Error("corrupt partial kept")
+	}
+	retry := filepath.Join(dir, "retry")
+	if ok, _ := blob_test_fetch(t, path, "", retry); !ok {
+		t.Error("retry after corruption failed")
+	}
+}
+
+func TestBlobLegacy(t *testing.T) {
+	blob_test_setup(t)
+	r, w := io.Pipe()
+	s := stream_rw(r, nil)
+	go func() {
+		sender := stream_rw(nil, w)
+		sender.write(map[string]string{"status": "200"})
+		w.Write([]byte("old bytes"))
+		w.Close()
+	}()
+
+	status, err := s.read_content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "legacy")
+	if !blob_receive(s, "", status, dst) {
+		t.Fatal("legacy transfer failed")
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "old bytes" {
+		t.Errorf("legacy transfer got %q", got)
+	}
+}
+
+func TestBlobHashCache(t *testing.T) {
+	blob_test_setup(t)
+	path := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(path, []byte("one"), 0o600)
+	f, _ := os.Open(path)
+	defer f.Close()
+
+	first, _, err := blob_hash(path, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := blobs_db().integer("select count(*) from hashes where path=?", path); n != 1 {
+		t.Errorf("%d cached hashes, want 1", n)
+	}
+	os.WriteFile(path, []byte("two!"), 0o600)
+	second, size, _ := blob_hash(path, f)
+	if second == first || size != 4 {
+		t.Error("changed file served its old hash")
+	}
+
+	os.Remove(path)
+	blobs_cleanup()
+	if n := blobs_db().integer("select count(*) from hashes"); n != 0 {
+		t.Errorf("%d hashes kept for deleted files", n)
+	}
+}
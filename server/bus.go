@@ -0,0 +1,232 @@
+// Mochi server: Event bus
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	gotime "time"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// The bus lets apps tell each other what happened without knowing who is
+// listening. An app publishes a message on a topic, such as "chat/message",
+// with mochi.bus.publish(topic, data), and each other app of the user's
+// that subscribes to a matching pattern has its function called with it in
+// the background. Starlark apps subscribe in app.json, with
+// "bus": {"subscribe": {"chat/*": "bus_chat"}}, and internal apps with
+// a.subscribe(). In a pattern, "*" matches one segment of a topic, and "**"
+// at the end matches the rest of it. Any app may publish on any topic, so a
+// subscriber that cares who sent a message checks its "app".
+//
+// Messages stay on the server: they're delivered to the user's apps here,
+// not to other users or other servers, and if the queue is full they're
+// dropped. A handler may publish in turn, up to bus_depth_max deep.
+
+const (
+	bus_topic_max  = 200
+	bus_data_max   = 64 * 1024 // Bytes of a message's data as JSON
+	bus_depth_max  = 8
+	bus_workers    = 2
+	bus_queue_size = 1000
+)
+
+var bus_queue = make(chan func(), bus_queue_size)
+
+// BusMessage is a message published on the bus
+type BusMessage struct {
+	ID      string
+	Topic   string
+	App     string // Publishing app, or "" for the server
+	User    *User
+	Data    any
+	Created int64
+	depth   int
+}
+
+var api_bus = sls.FromStringDict(sl.String("mochi.bus"), sl.StringDict{
+	"publish": sl.NewBuiltin("mochi.bus.publish", api_bus_publish),
+})
+
+// bus_topic_valid reports whether a topic can be published on: segments of
+// letters, digits, "_", "-" and ".", separated by "/"
+func bus_topic_valid(topic string) bool {
+	return bus_segments_valid(topic, false)
+}
+
+// bus_pattern_valid reports whether a subscription pattern is well formed
+func bus_pattern_valid(pattern string) bool {
+	return bus_segments_valid(pattern, true)
+}
+
+func bus_segments_valid(s string, pattern bool) bool {
+	if s == "" || len(s) > bus_topic_max {
+		return false
+	}
+	segments := strings.Split(s, "/")
+	for i, segment := range segments {
+		if pattern && (segment == "*" || (segment == "**" && i == len(segments)-1)) {
+			continue
+		}
+		if segment == "" || strings.Trim(segment, ".") == "" {
+			return false
+		}
+		for _, r := range segment {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// bus_match reports whether a topic matches a subscription pattern
+func bus_match(pattern string, topic string) bool {
+	p := strings.Split(pattern, "/")
+	t := strings.Split(topic, "/")
+	for i, segment := range p {
+		if segment == "**" && i == len(p)-1 {
+			return len(t) > i
+		}
+		if i >= len(t) || (segment != "*" && segment != t[i]) {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
+
+// Subscribe an internal app to topics matching a pattern
+func (a *App) subscribe(pattern string, f func(*BusMessage)) {
+	if a.internal.bus_internal == nil {
+		a.internal.bus_internal = map[string]func(*BusMessage){}
+	}
+	a.internal.bus_internal[pattern] = f
+}
+
+// bus_manager runs the workers delivering bus messages
+func bus_manager() {
+	for i := 0; i < bus_workers; i++ {
+		go func() {
+			for task := range bus_queue {
+				task()
+			}
+		}()
+	}
+}
+
+// bus_publish queues a message for the user's apps subscribed to its topic,
+// other than the one publishing it, returning how many were queued
+func bus_publish(user *User, publisher string, topic string, data any, depth int) int {
+	return bus_send(user, publisher, "", topic, data, depth)
+}
+
+// bus_send queues a message for the user's apps subscribed to its topic, or
+// only for the app to if set
+func bus_send(user *User, publisher string, to string, topic string, data any, depth int) int {
+	if user == nil {
+		return 0
+	}
+	m := &BusMessage{Topic: topic, App: publisher, User: user, Data: data, Created: now(), depth: depth}
+	m.ID, _ = ulid(gotime.Now())
+
+	apps_lock.Lock()
+	list := make([]*App, 0, len(apps))
+	for _, a := range apps {
+		list = append(list, a)
+	}
+	apps_lock.Unlock()
+
+	root := filepath.Join(data_dir, "users", user.UID)
+	queued := 0
+	for _, a := range list {
+		if a.id == publisher || (to != "" && a.id != to) {
+			continue
+		}
+		av := a.active(user)
+		if av == nil {
+			continue
+		}
+		for pattern, f := range av.bus_internal {
+			if bus_match(pattern, topic) && bus_enqueue(func() { f(m) }, a, topic) {
+				queued++
+			}
+		}
+		if len(av.Bus.Subscribe) == 0 || !av.scripted() || !file_exists(filepath.Join(root, a.id)) {
+			continue
+		}
+		for pattern, function := range av.Bus.Subscribe {
+			if bus_match(pattern, topic) && bus_enqueue(func() { bus_deliver(a, av, function, m) }, a, topic) {
+				queued++
+			}
+		}
+	}
+	return queued
+}
+
+// bus_enqueue queues a delivery, dropping it if the queue is full
+func bus_enqueue(task func(), a *App, topic string) bool {
+	select {
+	case bus_queue <- task:
+		return true
+	default:
+		warn("Bus queue full; dropping %q for app %q", topic, a.id)
+		return false
+	}
+}
+
+// bus_deliver calls a Starlark app's subscriber function with a message
+func bus_deliver(a *App, av *AppVersion, function string, m *BusMessage) {
+	s := av.starlark()
+	s.set("app", a)
+	s.set("user", m.User)
+	s.set("owner", m.User)
+	s.set("bus_depth", m.depth+1)
+	message := map[string]any{"id": m.ID, "topic": m.Topic, "app": m.App, "data": m.Data, "created": m.Created}
+	if _, err := s.call(function, sl.Tuple{sl_encode(message)}); err != nil {
+		info("Bus subscriber %q in app %q failed for %q: %v", function, a.id, m.Topic, err)
+	}
+}
+
+// mochi.bus.publish(topic, data?) -> int: Publish a message on the event bus to the user's other
+// apps subscribed to the topic, returning how many subscribers it was queued for.
+func api_bus_publish(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return sl_error(fn, "syntax: <topic: string>, [data: any]")
+	}
+
+	topic, ok := sl.AsString(args[0])
+	if !ok || !bus_topic_valid(topic) {
+		return sl_error(fn, "invalid topic")
+	}
+
+	var data any
+	if len(args) > 1 {
+		data = sl_decode(args[1])
+		if len(json_encode(data)) > bus_data_max {
+			return sl_error(fn, "data larger than %d bytes", bus_data_max)
+		}
+	}
+
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+
+	owner, _ := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+
+	depth, _ := t.Local("bus_depth").(int)
+	if depth >= bus_depth_max {
+		return sl_error(fn, "bus messages nested more than %d deep", bus_depth_max)
+	}
+
+	return sl.MakeInt(bus_publish(owner, app.id, topic, data, depth)), nil
+}
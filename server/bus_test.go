@@ -0,0 +1,117 @@
+// Mochi server: Event bus tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestBusMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"chat/*", "chat/message", true},
+		{"chat/*", "chat", false},
+		{"chat/*", "chat/message/edited", false},
+		{"chat/**", "chat/message/edited", true},
+		{"chat/**", "chat", false},
+		{"*/message", "forums/message", true},
+		{"chat/message", "chat/message", true},
+		{"chat/message", "chat/messages", false},
+	} {
+		if got := bus_match(c.pattern, c.topic); got != c.want {
+			t.Errorf("bus_match(%q, %q) = %v", c.pattern, c.topic, got)
+		}
+	}
+
+	for topic, want := range map[string]bool{"chat/message": true, "a.b/c-d_e": true, "chat/*": false, "chat//x": false, "/chat": false, "chat/..": false, "": false} {
+		if bus_topic_valid(topic) != want {
+			t.Errorf("topic %q valid %v", topic, !want)
+		}
+	}
+	for pattern, want := range map[string]bool{"chat/*": true, "**": true, "chat/**": true, "**/chat": false, "chat/a*": false} {
+		if bus_pattern_valid(pattern) != want {
+			t.Errorf("pattern %q valid %v", pattern, !want)
+		}
+	}
+}
+
+// A message reaches the user's subscribed Starlark and internal apps, but not
+// the app that published it
+func TestBusPublish(t *testing.T) {
+	subscriber, av, cleanup := lifecycle_test_app(t, `
+def on_chat(message):
+    mochi.bus.publish("notes/seen", {"from": message["app"], "text": message["data"]["text"]})
+`)
+	defer cleanup()
+	av.Database.File = ""
+	av.Architecture.Engine = "starlark"
+	av.Architecture.Version = 3
+	av.Bus.Subscribe = map[string]string{"chat/*": "on_chat"}
+
+	received := make(chan *BusMessage, 4)
+	internal := &App{id: "bustest", internal: &AppVersion{}}
+	internal.internal.app = internal
+	internal.subscribe("notes/**", func(m *BusMessage) { received <- m })
+	internal.subscribe("chat/message", func(m *BusMessage) { received <- m })
+
+	apps_lock.Lock()
+	apps[subscriber.id] = subscriber
+	apps[internal.id] = internal
+	apps_lock.Unlock()
+	defer func() {
+		apps_lock.Lock()
+		delete(apps, subscriber.id)
+		delete(apps, internal.id)
+		apps_lock.Unlock()
+	}()
+	bus_manager()
+
+	user := create_permission_test_user(t, "u1")
+	os.MkdirAll(filepath.Join(data_dir, "users", user.UID, subscriber.id), 0755)
+
+	thread := create_test_thread(user, create_external_app("chattest"))
+	fn := sl.NewBuiltin("mochi.bus.publish", api_bus_publish)
+	v, err := api_bus_publish(thread, fn, sl.Tuple{sl.String("chat/message"), sl_encode(map[string]any{"text": "hi"})}, nil)
+	if err != nil || v != sl.MakeInt(2) {
+		t.Fatalf("publish = %v, %v", v, err)
+	}
+
+	topics := map[string]*BusMessage{}
+	for len(topics) < 2 {
+		select {
+		case m := <-received:
+			topics[m.Topic] = m
+		case <-time.After(10 * time.Second):
+			t.Fatalf("received only %v", topics)
+		}
+	}
+	if m := topics["chat/message"]; m.App != "chattest" || m.User != user {
+		t.Errorf("message %+v", m)
+	}
+	seen, _ := topics["notes/seen"].Data.(map[string]any)
+	if topics["notes/seen"].App != subscriber.id || seen["from"] != "chattest" || seen["text"] != "hi" {
+		t.Errorf("relayed message %+v", topics["notes/seen"])
+	}
+
+	if v, _ := api_bus_publish(thread, fn, sl.Tuple{sl.String("calendar/event")}, nil); v != sl.MakeInt(0) {
+		t.Errorf("publish with no subscribers = %v", v)
+	}
+	if _, err := api_bus_publish(thread, fn, sl.Tuple{sl.String("chat/*")}, nil); err == nil {
+		t.Error("published on a pattern")
+	}
+	thread.SetLocal("bus_depth", bus_depth_max)
+	if _, err := api_bus_publish(thread, fn, sl.Tuple{sl.String("chat/message")}, nil); err == nil {
+		t.Error("published too deep")
+	}
+}
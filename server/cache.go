@@ -0,0 +1,336 @@
+// Mochi server: Cache manager
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Everything under cache_dir can be fetched or computed again, so the cache
+// manager keeps it within bounds. Each directory at the top of cache_dir is
+// a namespace with its own policy: a maximum age, and a size beyond which
+// the least recently used files are evicted until it is back under 90% of
+// the limit. A file's modification time is when it was last used, so a
+// namespace whose readers touch files on a hit (blobs, starlark, values)
+// keeps what is in use, and the others lose what was fetched longest ago.
+// Files directly under cache_dir, and namespaces without a policy of their
+// own, get the default policy. [cache] <namespace> sets a namespace's limit
+// in megabytes, and <namespace>_days its maximum age.
+//
+// Apps keep expensive computed values in the "values" namespace through
+// mochi.cache, one file per key under values/<app>/<owner>/, holding when
+// the value expires followed by the value in CBOR. Writes that add up to a
+// tenth of the namespace's limit trigger a sweep of it, so a busy app can't
+// run far over before the hourly sweep.
+
+const (
+	cache_interval      = time.Hour
+	cache_values_ttl    = 3600           // Default seconds a value is kept
+	cache_values_max    = 30 * 86400     // Longest a value can be kept
+	cache_values_limit  = 1024 * 1024    // Largest value, encoded
+	cache_values_key    = 256            // Longest key
+	cache_low_water     = 0.9            // Fraction of the limit a sweep evicts down to
+	cache_megabyte      = int64(1 << 20) // Policy sizes are set in megabytes
+	cache_namespace_any = ""
+)
+
+// cache_policy bounds a namespace. A zero size or age is no limit.
+type cache_policy struct {
+	size int64
+	age  time.Duration
+}
+
+// cache_policies are the defaults, by namespace
+var cache_policies = map[string]cache_policy{
+	cache_namespace_any: {0, cache_max_age},
+	"attachments":       {4096 * cache_megabyte, cache_max_age},
+	"blobs":             {4096 * cache_megabyte, cache_max_age},
+	"mirror":            {2048 * cache_megabyte, cache_max_age},
+	"starlark":          {512 * cache_megabyte, cache_max_age},
+	"unfurl":            {64 * cache_megabyte, cache_max_age},
+	"values":            {256 * cache_megabyte, cache_max_age},
+}
+
+var (
+	cache_sweeping       sync.Mutex
+	cache_values_written atomic.Int64
+
+	api_cache = sls.FromStringDict(sl.String("mochi.cache"), sl.StringDict{
+		"delete": sl.NewBuiltin("mochi.cache.delete", api_cache_delete),
+		"get":    sl.NewBuiltin("mochi.cache.get", api_cache_get),
+		"set":    sl.NewBuiltin("mochi.cache.set", api_cache_set),
+	})
+)
+
+// Periodically sweep the cache, and remove image variants whose attachment
+// has gone
+func cache_manager() {
+	for range time.Tick(cache_interval) {
+		cache_cleanup()
+		if n := variant_cleanup(); n > 0 {
+			debug("Cache removed %d orphaned image variants", n)
+		}
+	}
+}
+
+// cache_policy_get returns a namespace's policy, with any [cache] overrides
+func cache_policy_get(namespace string) cache_policy {
+	p, ok := cache_policies[namespace]
+	if !ok {
+		p = cache_policies[cache_namespace_any]
+	}
+	if namespace == cache_namespace_any {
+		return p
+	}
+	p.size = int64(ini_int("cache", namespace, int(p.size/cache_megabyte))) * cache_megabyte
+	p.age = time.Duration(ini_int("cache", namespace+"_days", int(p.age/(24*time.Hour)))) * 24 * time.Hour
+	return p
+}
+
+// cache_cleanup sweeps every namespace by its policy
+func cache_cleanup() {
+	cache_prune(0)
+}
+
+// cache_prune sweeps every namespace, removing files not used within age as
+// well as by policy. The disk watchdog calls this with a short age when
+// space is low; 0 sweeps by policy alone.
+func cache_prune(age time.Duration) {
+	cache_sweeping.Lock()
+	defer cache_sweeping.Unlock()
+
+	entries, err := os.ReadDir(cache_dir)
+	if err != nil {
+		return
+	}
+	loose := []string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			cache_sweep(e.Name(), age)
+		} else {
+			loose = append(loose, filepath.Join(cache_dir, e.Name()))
+		}
+	}
+	cache_evict(loose, cache_policy_get(cache_namespace_any), age)
+	blobs_cleanup()
+}
+
+// cache_sweep applies a namespace's policy to its files. Called with
+// cache_sweeping held.
+func cache_sweep(namespace string, age time.Duration) {
+	files := []string{}
+	filepath.WalkDir(filepath.Join(cache_dir, namespace), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	removed := cache_evict(files, cache_policy_get(namespace), age)
+	if removed > 0 {
+		debug("Cache removed %d files from %q", removed, namespace)
+	}
+}
+
+// cache_evict removes the files past the policy's age, or the shorter age
+// if given, then the least recently used until the rest fit in 90% of its
+// size. Returns how many were removed.
+func cache_evict(paths []string, p cache_policy, age time.Duration) int {
+	if age <= 0 || (p.age > 0 && p.age < age) {
+		age = p.age
+	}
+	type entry struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var cutoff time.Time
+	if age > 0 {
+		cutoff = time.Now().Add(-age)
+	}
+
+	removed := 0
+	kept := []entry{}
+	total := int64(0)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if age > 0 && info.ModTime().Before(cutoff) {
+			if os.Remove(path) == nil {
+				removed++
+			}
+			continue
+		}
+		kept = append(kept, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	if p.size <= 0 || total <= p.size {
+		return removed
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].used.Before(kept[j].used) })
+	target := int64(float64(p.size) * cache_low_water)
+	for _, e := range kept {
+		if total <= target {
+			break
+		}
+		if os.Remove(e.path) == nil {
+			removed++
+			total -= e.size
+		}
+	}
+	return removed
+}
+
+// cache_value_path returns where an app keeps a value for an owner
+func cache_value_path(app *App, owner *User, key string) string {
+	uid := "_"
+	if owner != nil {
+		uid = owner.UID
+	}
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(cache_dir, "values", app.id, uid, hex.EncodeToString(h[:]))
+}
+
+// cache_value_get returns a value, and whether it was found unexpired
+func cache_value_get(path string) (any, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) < 8 {
+		return nil, false
+	}
+	if int64(binary.BigEndian.Uint64(data[:8])) <= now() {
+		os.Remove(path)
+		return nil, false
+	}
+	var v any
+	if err := cbor.Unmarshal(data[8:], &v); err != nil {
+		os.Remove(path)
+		return nil, false
+	}
+	t := time.Now()
+	os.Chtimes(path, t, t)
+	return v, true
+}
+
+// cache_value_set writes a value through a temporary file, so a concurrent
+// reader never sees part of one
+func cache_value_set(path string, data []byte, ttl int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	buf := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(buf, uint64(now()+ttl))
+	buf = append(buf, data...)
+	tmp := path + ".tmp" + random_alphanumeric(8)
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	limit := cache_policy_get("values").size
+	if limit > 0 && cache_values_written.Add(int64(len(buf))) > limit/10 {
+		cache_values_written.Store(0)
+		go func() {
+			if cache_sweeping.TryLock() {
+				cache_sweep("values", 0)
+				cache_sweeping.Unlock()
+			}
+		}()
+	}
+	return nil
+}
+
+// cache_thread returns where a Starlark thread's app keeps a value for its
+// owner
+func cache_thread(t *sl.Thread, key string) (string, error) {
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return "", errors.New("no app")
+	}
+	if key == "" || len(key) > cache_values_key {
+		return "", errors.New("invalid key")
+	}
+	owner, _ := t.Local("owner").(*User)
+	return cache_value_path(app, owner, key), nil
+}
+
+// mochi.cache.get(key, default=None) -> any: A value the app cached for the
+// current owner, or default if there is none or it has expired
+func api_cache_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var key string
+	var def sl.Value = sl.None
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "default?", &def); err != nil {
+		return nil, err
+	}
+	path, err := cache_thread(t, key)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if v, ok := cache_value_get(path); ok {
+		return sl_encode(v), nil
+	}
+	return def, nil
+}
+
+// mochi.cache.set(key, value, ttl=3600) -> None: Cache a value for the
+// current owner for ttl seconds, up to 30 days. The value can be evicted
+// sooner if it goes unused or the cache is full.
+func api_cache_set(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var key string
+	var value sl.Value
+	ttl := cache_values_ttl
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "value", &value, "ttl?", &ttl); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 || ttl > cache_values_max {
+		return sl_error(fn, "invalid ttl")
+	}
+	path, err := cache_thread(t, key)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	data := cbor_encode(sl_decode(value))
+	if len(data) > cache_values_limit {
+		return sl_error(fn, "value too large")
+	}
+	if err := cache_value_set(path, data, int64(ttl)); err != nil {
+		return sl_error(fn, "unable to cache value: %v", err)
+	}
+	return sl.None, nil
+}
+
+// mochi.cache.delete(key) -> bool: Remove a cached value, returning whether
+// there was one
+func api_cache_delete(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var key string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "key", &key); err != nil {
+		return nil, err
+	}
+	path, err := cache_thread(t, key)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.Bool(os.Remove(path) == nil), nil
+}
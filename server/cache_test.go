@@ -0,0 +1,103 @@
+// Mochi server: Cache manager tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int, used time.Duration) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, make([]byte, size), 0644)
+		when := time.Now().Add(-used)
+		os.Chtimes(path, when, when)
+		return path
+	}
+	expired := write("expired", 10, 48*time.Hour)
+	oldest := write("oldest", 400, 3*time.Hour)
+	older := write("older", 400, 2*time.Hour)
+	recent := write("recent", 400, time.Minute)
+
+	p := cache_policy{size: 1000, age: 24 * time.Hour}
+	if n := cache_evict([]string{expired, oldest, older, recent}, p, 0); n != 2 {
+		t.Errorf("removed %d, want 2", n)
+	}
+	if file_exists(expired) || file_exists(oldest) || !file_exists(older) || !file_exists(recent) {
+		t.Error("wrong files evicted")
+	}
+
+	// A shorter age, as when disk space is low
+	if n := cache_evict([]string{older, recent}, p, time.Hour); n != 1 || file_exists(older) || !file_exists(recent) {
+		t.Errorf("pruned %d", n)
+	}
+}
+
+func TestCacheValues(t *testing.T) {
+	orig_cache_dir := cache_dir
+	cache_dir = t.TempDir()
+	defer func() { cache_dir = orig_cache_dir }()
+
+	alice := &User{UID: "alice"}
+	thread := create_test_thread(alice, create_external_app("feeds"))
+	call := func(name string, args ...sl.Value) (sl.Value, error) {
+		fn, _ := api_cache.Attr(name)
+		return sl.Call(thread, fn, args, nil)
+	}
+
+	if v, err := call("get", sl.String("missing"), sl.String("fallback")); err != nil || v != sl.String("fallback") {
+		t.Errorf("missing value: %v, %v", v, err)
+	}
+	value := sl.NewDict(1)
+	value.SetKey(sl.String("count"), sl.MakeInt(3))
+	if _, err := call("set", sl.String("summary"), value); err != nil {
+		t.Fatal(err)
+	}
+	v, err := call("get", sl.String("summary"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := v.(*sl.Dict); !ok || d.String() != `{"count": 3}` {
+		t.Errorf("got %v", v)
+	}
+
+	// Another owner of the same app doesn't see it
+	other := create_test_thread(&User{UID: "bob"}, create_external_app("feeds"))
+	fn, _ := api_cache.Attr("get")
+	if v, _ := sl.Call(other, fn, sl.Tuple{sl.String("summary")}, nil); v != sl.None {
+		t.Errorf("other owner got %v", v)
+	}
+
+	// Expired values are gone
+	path := cache_value_path(create_external_app("feeds"), alice, "summary")
+	cache_value_set(path, cbor_encode("stale"), -1)
+	if v, _ := call("get", sl.String("summary")); v != sl.None {
+		t.Errorf("expired value %v", v)
+	}
+
+	if v, _ := call("delete", sl.String("summary")); v != sl.False {
+		t.Errorf("deleted expired value: %v", v)
+	}
+	call("set", sl.String("summary"), sl.String("x"))
+	if v, _ := call("delete", sl.String("summary")); v != sl.True {
+		t.Errorf("delete: %v", v)
+	}
+
+	if _, err := call("set", sl.String("big"), sl.String(strings.Repeat("x", cache_values_limit+1))); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("oversized value: %v", err)
+	}
+	if _, err := call("set", sl.String(""), sl.None); err == nil {
+		t.Error("empty key accepted")
+	}
+}
@@ -0,0 +1,213 @@
+// Mochi server: Capability discovery
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	sl "go.starlark.net/starlark"
+)
+
+// An app can ask which services and app versions handle an entity on its
+// server before relying on them, say to fall back to plain messages when a
+// contact's server has no chat app. mochi.remote.capabilities(entity)
+// opens a stream to the "request" event of the "capabilities" service on
+// the entity's server, which answers with the entity's class, the app
+// handling that class, and every service an installed app handles for the
+// entity's owner, each with the app and version. Servers advertise the
+// "capabilities" feature in the /mochi/2 handshake, so a peer known to
+// lack it is reported as unsupported without opening a stream. Answers
+// are cached for capabilities_ttl per asking and answering entity.
+
+const (
+	capabilities_ttl       = 3600  // Seconds an answer is cached
+	capabilities_cache_max = 10000 // Answers cached at most
+)
+
+type capabilities_key struct {
+	from   string
+	entity string
+}
+
+type capabilities_entry struct {
+	answer  map[string]any
+	expires int64
+}
+
+var (
+	capabilities_cache      = map[capabilities_key]capabilities_entry{}
+	capabilities_cache_lock sync.Mutex
+)
+
+func init() {
+	a := app("capabilities")
+	a.service("capabilities")
+	a.event("request", capabilities_request_event)
+}
+
+// Answer a capabilities request for the entity it is addressed to
+func capabilities_request_event(e *Event) {
+	if e.stream == nil {
+		return
+	}
+	if err := e.stream.write(capabilities_local(e.user, e.to)); err != nil {
+		debug("Capabilities answer to %q interrupted: %v", e.from, err)
+	}
+}
+
+// capabilities_local describes what handles an entity owned by a local user
+func capabilities_local(user *User, entity string) map[string]any {
+	answer := map[string]any{"entity": entity, "version": build_version, "supported": true}
+	services := map[string]any{}
+	answer["services"] = services
+
+	if ent := entity_by_any(entity); ent != nil {
+		answer["class"] = ent.Class
+		if a := class_app_for(user, ent.Class); a != nil {
+			if av := a.active(user); av != nil {
+				answer["app"] = map[string]any{"app": a.id, "version": av.Version}
+			}
+		}
+	}
+
+	// Services declared by any installed app, resolved to the app the
+	// owner's bindings pick. Core internal services are not apps a contact
+	// could lack, so aren't listed.
+	var declared []string
+	apps_lock.Lock()
+	for _, a := range apps {
+		if a.internal != nil {
+			continue
+		}
+		if av := a.active_locked(user); av != nil {
+			declared = append(declared, av.Services...)
+		}
+	}
+	apps_lock.Unlock()
+
+	for _, s := range declared {
+		if _, found := services[s]; found {
+			continue
+		}
+		a := app_for_service(user, s)
+		if a == nil || a.internal != nil {
+			continue
+		}
+		if av := a.active(user); av != nil {
+			services[s] = map[string]any{"app": a.id, "version": av.Version}
+		}
+	}
+	return answer
+}
+
+// capabilities_cached returns a cached answer, if one is fresh
+func capabilities_cached(key capabilities_key) (map[string]any, bool) {
+	capabilities_cache_lock.Lock()
+	defer capabilities_cache_lock.Unlock()
+	c, found := capabilities_cache[key]
+	if !found || now() >= c.expires {
+		return nil, false
+	}
+	return c.answer, true
+}
+
+// capabilities_store caches an answer, dropping expired ones when full
+func capabilities_store(key capabilities_key, answer map[string]any) {
+	capabilities_cache_lock.Lock()
+	defer capabilities_cache_lock.Unlock()
+	if len(capabilities_cache) >= capabilities_cache_max {
+		t := now()
+		for k, c := range capabilities_cache {
+			if t >= c.expires {
+				delete(capabilities_cache, k)
+			}
+		}
+		if len(capabilities_cache) >= capabilities_cache_max {
+			capabilities_cache = map[capabilities_key]capabilities_entry{}
+		}
+	}
+	capabilities_cache[key] = capabilities_entry{answer: answer, expires: now() + capabilities_ttl}
+}
+
+// capabilities_fetch asks an entity's server what handles it
+func capabilities_fetch(from, entity, peer string) (map[string]any, error) {
+	peer, err := remote_connect(from, entity, peer)
+	if err != nil {
+		return nil, err
+	}
+	if features, ok := sender_features(peer); ok && !string_in_slice(feature_capabilities, features) {
+		return map[string]any{"entity": entity, "supported": false, "services": map[string]any{}}, nil
+	}
+
+	s, err := stream_to_peer(peer, from, entity, "capabilities", "request", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	if err := s.write(map[string]any{}); err != nil {
+		return nil, fmt.Errorf("failed to send: %v", err)
+	}
+	var answer any
+	if err := s.read(&answer); err != nil {
+		return nil, fmt.Errorf("no answer: %v", err)
+	}
+	result, ok := sl_decode(sl_encode(answer)).(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid answer")
+	}
+	return result, nil
+}
+
+// mochi.remote.capabilities(entity, peer?, refresh?) -> dict: Which services
+// and app versions handle an entity on its server. Returns {entity, class,
+// app, services, version, supported, cached}: app the {app, version}
+// handling the entity's class, services a dict of service to {app,
+// version}, version the server's, and supported false if the server can't
+// say. Answers are cached for an hour unless refresh is true. On failure
+// returns {error}.
+func api_remote_capabilities(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity, peer string
+	refresh := false
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "peer?", &peer, "refresh?", &refresh); err != nil {
+		return nil, err
+	}
+	if !valid(entity, "entity") && !valid(entity, "fingerprint") {
+		return sl_error(fn, "invalid entity")
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	if user.Identity == nil {
+		return sl_error(fn, "user has no identity")
+	}
+
+	key := capabilities_key{from: user.Identity.ID, entity: entity}
+	if !refresh {
+		if answer, ok := capabilities_cached(key); ok {
+			return sl_encode(capabilities_result(answer, true)), nil
+		}
+	}
+	answer, err := capabilities_fetch(user.Identity.ID, entity, peer)
+	if err != nil {
+		return sl_encode(map[string]any{"error": err.Error()}), nil
+	}
+	capabilities_store(key, answer)
+	return sl_encode(capabilities_result(answer, false)), nil
+}
+
+// capabilities_result copies an answer for a caller, marked as cached or not
+func capabilities_result(answer map[string]any, cached bool) map[string]any {
+	result := make(map[string]any, len(answer)+1)
+	for k, v := range answer {
+		result[k] = v
+	}
+	result["cached"] = cached
+	return result
+}
@@ -0,0 +1,105 @@
+// Mochi server: Capability discovery tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestCapabilitiesLocal(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	user := create_permission_test_user(t, "u1")
+	db_open("db/users.db").exec("insert into users (uid, username) values (?, ?)", user.UID, user.Username)
+	e, err := entity_create(user, "person", "Answering", "public", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	av := &AppVersion{Version: "1.2", Classes: []string{"person"}, Services: []string{"capabilitiestest"}}
+	a := &App{id: "capabilitiestestapp", versions: map[string]*AppVersion{"1.2": av}, latest: av}
+	apps_lock.Lock()
+	apps[a.id] = a
+	apps_lock.Unlock()
+	resolution_invalidate()
+	t.Cleanup(func() {
+		apps_lock.Lock()
+		delete(apps, a.id)
+		apps_lock.Unlock()
+		resolution_invalidate()
+	})
+
+	answer := capabilities_local(user, e.ID)
+	if answer["class"] != "person" || answer["supported"] != true {
+		t.Fatalf("answer = %v", answer)
+	}
+	handler, _ := answer["app"].(map[string]any)
+	if handler["app"] != a.id || handler["version"] != "1.2" {
+		t.Errorf("class handler = %v", answer["app"])
+	}
+	services, _ := answer["services"].(map[string]any)
+	service, _ := services["capabilitiestest"].(map[string]any)
+	if service["app"] != a.id || service["version"] != "1.2" {
+		t.Errorf("services = %v", services)
+	}
+	if _, found := services["directory"]; found {
+		t.Error("core internal service listed")
+	}
+}
+
+func TestCapabilitiesCache(t *testing.T) {
+	key := capabilities_key{from: "from", entity: "entity"}
+	t.Cleanup(func() {
+		capabilities_cache_lock.Lock()
+		delete(capabilities_cache, key)
+		capabilities_cache_lock.Unlock()
+	})
+	if _, ok := capabilities_cached(key); ok {
+		t.Fatal("answer cached before stored")
+	}
+
+	capabilities_store(key, map[string]any{"supported": true})
+	answer, ok := capabilities_cached(key)
+	if !ok || answer["supported"] != true {
+		t.Fatalf("cached = %v, %v", answer, ok)
+	}
+	if _, ok := capabilities_cached(capabilities_key{from: "other", entity: "entity"}); ok {
+		t.Error("answer cached for another asking entity")
+	}
+	if result := capabilities_result(answer, true); result["cached"] != true || answer["cached"] != nil {
+		t.Errorf("result = %v, answer = %v", result, answer)
+	}
+
+	capabilities_cache_lock.Lock()
+	capabilities_cache[key] = capabilities_entry{answer: answer, expires: now() - 1}
+	capabilities_cache_lock.Unlock()
+	if _, ok := capabilities_cached(key); ok {
+		t.Error("expired answer returned")
+	}
+}
+
+func TestCapabilitiesArguments(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	if !string_in_slice(feature_capabilities, receiver_features()) {
+		t.Error("capabilities feature not advertised")
+	}
+
+	user := create_permission_test_user(t, "u1")
+	thread := create_test_thread(user, create_external_app("caller"))
+	f, _ := api_remote.Attr("capabilities")
+	if _, err := sl.Call(thread, f, sl.Tuple{sl.String("not an entity")}, nil); err == nil {
+		t.Error("invalid entity accepted")
+	}
+	if _, err := sl.Call(thread, f, nil, nil); err == nil {
+		t.Error("missing entity accepted")
+	}
+}
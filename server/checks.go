@@ -0,0 +1,359 @@
+// Mochi server: Commit checks
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	sl "go.starlark.net/starlark"
+)
+
+// Checks let a CI system, or a runner app, report whether a commit builds
+// and passes its tests. A status is a state - "pending", "success",
+// "failure" or "error" - for a commit of a repository in a context, such as
+// "ci/tests", with a link to the details. Setting a status for a context
+// again replaces it. A repository may require contexts to have succeeded
+// before merging, which mochi.git.merge.check() reports.
+//
+// A repository's watchers are entities sent a "git/refs" event, on the
+// service they chose, whenever its refs change, by a push or through the
+// git API, with the changes as [ref, old, new] lists, old or new "" for a
+// ref created or deleted. A watcher may instead choose events "push", to be
+// sent the per-branch events of pushes as the owning app is (see
+// git_push.go). A watcher on another server reports back with a
+// "status" event to the checks service, which is accepted only from a
+// watcher of the repository.
+//
+// Statuses, requirements and watchers live in db/checks.db, keyed by
+// repository entity and app.
+
+const (
+	check_context_limit     = 100
+	check_description_limit = 1000
+	check_url_limit         = 2000
+)
+
+var check_states = map[string]bool{
+	"pending": true,
+	"success": true,
+	"failure": true,
+	"error":   true,
+}
+
+func init() {
+	a := app("checks")
+	a.service("checks")
+	a.event("status", check_status_event)
+}
+
+// checks_db opens the server-wide checks, creating their tables if needed
+func checks_db() *DB {
+	db := db_open("db/checks.db")
+	db.exec("create table if not exists statuses (repository text not null, app text not null, sha text not null, context text not null, state text not null, url text not null default '', description text not null default '', creator text not null default '', created integer not null, updated integer not null, primary key (repository, app, sha, context))")
+	db.exec("create table if not exists required (repository text not null, app text not null, context text not null, primary key (repository, app, context))")
+	db.exec("create table if not exists watchers (repository text not null, app text not null, watcher text not null, service text not null, events text not null default 'refs', created integer not null, primary key (repository, app, watcher))")
+	return db
+}
+
+// check_status_set records a commit's state in a context
+func check_status_set(repository, app, sha, context, state, url, description, creator string) error {
+	if !valid(sha, "^[0-9a-f]{40}$") {
+		return fmt.Errorf("invalid sha")
+	}
+	if context == "" || len(context) > check_context_limit {
+		return fmt.Errorf("invalid context")
+	}
+	if !check_states[state] {
+		return fmt.Errorf("invalid state %q", state)
+	}
+	if url != "" && (len(url) > check_url_limit || !valid(url, "url")) {
+		return fmt.Errorf("invalid url")
+	}
+	if len(description) > check_description_limit {
+		return fmt.Errorf("invalid description")
+	}
+	n := now()
+	checks_db().exec("insert into statuses (repository, app, sha, context, state, url, description, creator, created, updated) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict (repository, app, sha, context) do update set state=excluded.state, url=excluded.url, description=excluded.description, creator=excluded.creator, updated=excluded.updated", repository, app, sha, context, state, url, description, creator, n, n)
+	return nil
+}
+
+// check_statuses returns a commit's statuses, by context
+func check_statuses(repository, app, sha string) []map[string]any {
+	rows, _ := checks_db().rows("select context, state, url, description, creator, created, updated from statuses where repository=? and app=? and sha=? order by context", repository, app, sha)
+	return rows
+}
+
+// check_summary combines a commit's statuses with the repository's required
+// contexts: "failure" if any failed or errored, "pending" if any are
+// pending or required but not reported, "success" if all succeeded, or ""
+// if there are none. Also returns the required contexts not yet succeeded.
+func check_summary(repository, app, sha string) (string, []string) {
+	states := map[string]string{}
+	for _, s := range check_statuses(repository, app, sha) {
+		context, _ := s["context"].(string)
+		state, _ := s["state"].(string)
+		states[context] = state
+	}
+
+	blocked := []string{}
+	rows, _ := checks_db().rows("select context from required where repository=? and app=? order by context", repository, app)
+	for _, r := range rows {
+		context, _ := r["context"].(string)
+		if states[context] != "success" {
+			blocked = append(blocked, context)
+		}
+		if states[context] == "" {
+			states[context] = "pending"
+		}
+	}
+
+	summary := ""
+	for _, state := range states {
+		switch {
+		case state == "failure" || state == "error":
+			summary = "failure"
+		case state == "pending" && summary != "failure":
+			summary = "pending"
+		case summary == "":
+			summary = "success"
+		}
+	}
+	return summary, blocked
+}
+
+// git_refs returns a repository's refs and the hashes they point to
+func git_refs(path string) map[string]string {
+	refs := map[string]string{}
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return refs
+	}
+	iter, err := repo.References()
+	if err != nil {
+		return refs
+	}
+	iter.ForEach(func(r *plumbing.Reference) error {
+		if r.Type() == plumbing.HashReference {
+			refs[r.Name().String()] = r.Hash().String()
+		}
+		return nil
+	})
+	return refs
+}
+
+// git_refs_changes lists how refs changed, as [ref, old, new]
+func git_refs_changes(before, after map[string]string) []any {
+	changes := []any{}
+	for ref, hash := range after {
+		if before[ref] != hash {
+			changes = append(changes, []string{ref, before[ref], hash})
+		}
+	}
+	for ref, hash := range before {
+		if _, found := after[ref]; !found {
+			changes = append(changes, []string{ref, hash, ""})
+		}
+	}
+	return changes
+}
+
+// git_refs_notify sends a repository's ref changes to its watchers
+func git_refs_notify(app *App, entity string, before, after map[string]string) {
+	if app == nil || entity == "" {
+		return
+	}
+	changes := git_refs_changes(before, after)
+	if len(changes) == 0 {
+		return
+	}
+	rows, _ := checks_db().rows("select watcher, service from watchers where repository=? and app=? and events='refs'", entity, app.id)
+	for _, r := range rows {
+		watcher, _ := r["watcher"].(string)
+		service, _ := r["service"].(string)
+		m := message(entity, watcher, service, "git/refs")
+		m.content = map[string]any{"repository": entity, "changes": changes}
+		m.FromApp = app.id
+		m.send()
+	}
+}
+
+// check_status_event receives a status from a watcher of a repository here
+func check_status_event(e *Event) {
+	row, _ := checks_db().row("select app from watchers where repository=? and watcher=?", e.to, e.from)
+	if e.from == "" || row == nil {
+		info("Checks dropping status for %q from %q, not a watcher", e.to, e.from)
+		return
+	}
+	app, _ := row["app"].(string)
+	if err := check_status_set(e.to, app, e.get("sha", ""), e.get("context", ""), e.get("state", ""), e.get("url", ""), e.get("description", ""), e.from); err != nil {
+		info("Checks dropping status for %q from %q: %v", e.to, e.from, err)
+	}
+}
+
+// check_repository returns the owner and app of a repository the caller may
+// write to
+func check_repository(t *sl.Thread, entity string) (*User, *App, error) {
+	owner, _ := t.Local("owner").(*User)
+	app, _ := t.Local("app").(*App)
+	if owner == nil || app == nil {
+		return nil, nil, fmt.Errorf("no owner")
+	}
+	if !valid(entity, "entity") {
+		return nil, nil, fmt.Errorf("invalid entity")
+	}
+	if !git_can_write(t, owner, app, entity) {
+		return nil, nil, fmt.Errorf("permission denied: repository write required")
+	}
+	return owner, app, nil
+}
+
+// mochi.git.status.set(entity, sha, context, state, url?, description?) ->
+// None: Record a commit's state in a context: "pending", "success",
+// "failure" or "error". Requires repository write access.
+func api_git_status_set(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity, sha, context, state, url, description string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "sha", &sha, "context", &context, "state", &state, "url?", &url, "description?", &description); err != nil {
+		return nil, err
+	}
+	_, app, err := check_repository(t, entity)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	creator := ""
+	if user, _ := t.Local("user").(*User); user != nil && user.Identity != nil {
+		creator = user.Identity.ID
+	}
+	if err := check_status_set(entity, app.id, sha, context, state, url, description, creator); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.None, nil
+}
+
+// mochi.git.status.list(entity, ref) -> dict: Get a commit's statuses,
+// given its hash or a ref: a dict of sha, state (the combined state, as
+// merge.check reports it), blocked (required contexts not yet succeeded),
+// and statuses, a list of dicts of context, state, url, description,
+// creator, created and updated
+func api_git_status_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity, ref string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "ref", &ref); err != nil {
+		return nil, err
+	}
+	owner, _ := t.Local("owner").(*User)
+	app, _ := t.Local("app").(*App)
+	if owner == nil || app == nil {
+		return sl_error(fn, "no owner")
+	}
+	if !valid(entity, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+	if !git_can_read(t, owner, app, entity) {
+		return sl_error(fn, "permission denied: repository read required")
+	}
+	repo, err := git_open(owner, app, entity)
+	if err != nil {
+		return sl_error(fn, "failed to open repository: %v", err)
+	}
+	hash, err := git_resolve_ref(repo, ref)
+	if err != nil {
+		return sl_error(fn, "failed to resolve ref: %v", err)
+	}
+
+	sha := hash.String()
+	state, blocked := check_summary(entity, app.id, sha)
+	return sl_encode(map[string]any{"sha": sha, "state": state, "blocked": blocked, "statuses": check_statuses(entity, app.id, sha)}), nil
+}
+
+// mochi.git.status.require(entity, contexts) -> None: Set the contexts that
+// must have succeeded for a commit before merge.check lets it merge.
+// Requires repository write access.
+func api_git_status_require(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity string
+	var contexts *sl.List
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "contexts", &contexts); err != nil {
+		return nil, err
+	}
+	_, app, err := check_repository(t, entity)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	list := sl_decode_string_list(contexts)
+	for _, c := range list {
+		if c == "" || len(c) > check_context_limit {
+			return sl_error(fn, "invalid context %q", c)
+		}
+	}
+
+	db := checks_db()
+	db.exec("delete from required where repository=? and app=?", entity, app.id)
+	for _, c := range list {
+		db.exec("insert or ignore into required (repository, app, context) values (?, ?, ?)", entity, app.id, c)
+	}
+	return sl.None, nil
+}
+
+// mochi.git.watch.add(entity, watcher, service, events?) -> None: Send a
+// watcher entity a "git/refs" event on a service whenever the repository's
+// refs change, or with events "push", the per-branch events of each push,
+// and accept statuses from it. Requires repository write access.
+func api_git_watch_add(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity, watcher, service string
+	events := "refs"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "watcher", &watcher, "service", &service, "events?", &events); err != nil {
+		return nil, err
+	}
+	if events != "refs" && events != "push" {
+		return sl_error(fn, "invalid events %q", events)
+	}
+	_, app, err := check_repository(t, entity)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(watcher, "entity") {
+		return sl_error(fn, "invalid watcher")
+	}
+	if !valid(service, "constant") {
+		return sl_error(fn, "invalid service")
+	}
+	checks_db().exec("replace into watchers (repository, app, watcher, service, events, created) values (?, ?, ?, ?, ?, ?)", entity, app.id, watcher, service, events, now())
+	return sl.None, nil
+}
+
+// mochi.git.watch.remove(entity, watcher) -> None: Stop sending a watcher
+// the repository's ref changes. Requires repository write access.
+func api_git_watch_remove(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity, watcher string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "watcher", &watcher); err != nil {
+		return nil, err
+	}
+	_, app, err := check_repository(t, entity)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	checks_db().exec("delete from watchers where repository=? and app=? and watcher=?", entity, app.id, watcher)
+	return sl.None, nil
+}
+
+// mochi.git.watch.list(entity) -> list: Get a repository's watchers, each a
+// dict of watcher, service, events and created. Requires repository write access.
+func api_git_watch_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity); err != nil {
+		return nil, err
+	}
+	_, app, err := check_repository(t, entity)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	rows, err := checks_db().rows("select watcher, service, events, created from watchers where repository=? and app=? order by created", entity, app.id)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
@@ -0,0 +1,91 @@
+// Mochi server: Commit checks tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSummary(t *testing.T) {
+	_, repo, person := comment_test_setup(t)
+	sha := strings.Repeat("a", 40)
+
+	if state, blocked := check_summary(repo, "repositories", sha); state != "" || len(blocked) != 0 {
+		t.Errorf("no statuses: %q %v", state, blocked)
+	}
+	for _, bad := range [][]string{{"abc", "ci", "success"}, {sha, "", "success"}, {sha, "ci", "passed"}} {
+		if err := check_status_set(repo, "repositories", bad[0], bad[1], bad[2], "", "", person); err == nil {
+			t.Errorf("status %v accepted", bad)
+		}
+	}
+
+	check_status_set(repo, "repositories", sha, "ci/tests", "pending", "", "", person)
+	check_status_set(repo, "repositories", sha, "ci/lint", "success", "", "", person)
+	if state, _ := check_summary(repo, "repositories", sha); state != "pending" {
+		t.Errorf("state %q, want pending", state)
+	}
+	check_status_set(repo, "repositories", sha, "ci/tests", "failure", "https://ci.example.com/1", "2 failed", person)
+	if state, _ := check_summary(repo, "repositories", sha); state != "failure" {
+		t.Errorf("state %q, want failure", state)
+	}
+	if statuses := check_statuses(repo, "repositories", sha); len(statuses) != 2 {
+		t.Errorf("statuses %v, want one per context", statuses)
+	}
+
+	// A required context not yet reported blocks, and is pending
+	checks_db().exec("insert into required (repository, app, context) values (?, 'repositories', 'ci/build')", repo)
+	check_status_set(repo, "repositories", sha, "ci/tests", "success", "", "", person)
+	state, blocked := check_summary(repo, "repositories", sha)
+	if state != "pending" || len(blocked) != 1 || blocked[0] != "ci/build" {
+		t.Errorf("state %q, blocked %v; want pending on ci/build", state, blocked)
+	}
+	check_status_set(repo, "repositories", sha, "ci/build", "success", "", "", person)
+	if state, blocked := check_summary(repo, "repositories", sha); state != "success" || len(blocked) != 0 {
+		t.Errorf("state %q, blocked %v; want success", state, blocked)
+	}
+}
+
+func TestCheckStatusEvent(t *testing.T) {
+	_, repo, person := comment_test_setup(t)
+	sha := strings.Repeat("b", 40)
+	content := map[string]any{"sha": sha, "context": "ci/tests", "state": "success"}
+
+	// Statuses are accepted only from a watcher of the repository
+	check_status_event(&Event{from: person, to: repo, content: content})
+	if len(check_statuses(repo, "repositories", sha)) != 0 {
+		t.Error("status accepted from an entity not watching")
+	}
+	checks_db().exec("insert into watchers (repository, app, watcher, service, created) values (?, 'repositories', ?, 'runner', ?)", repo, person, now())
+	check_status_event(&Event{from: person, to: repo, content: content})
+	statuses := check_statuses(repo, "repositories", sha)
+	if len(statuses) != 1 || statuses[0]["creator"] != person {
+		t.Errorf("statuses %v, want one from the watcher", statuses)
+	}
+}
+
+func TestGitRefsChanges(t *testing.T) {
+	before := map[string]string{"refs/heads/main": "1", "refs/heads/old": "2", "refs/tags/v1": "3"}
+	after := map[string]string{"refs/heads/main": "4", "refs/heads/new": "5", "refs/tags/v1": "3"}
+	changes := map[string][]string{}
+	for _, c := range git_refs_changes(before, after) {
+		change := c.([]string)
+		changes[change[0]] = change
+	}
+	if len(changes) != 3 {
+		t.Fatalf("changes %v, want 3", changes)
+	}
+	if c := changes["refs/heads/main"]; c[1] != "1" || c[2] != "4" {
+		t.Errorf("updated %v", c)
+	}
+	if c := changes["refs/heads/new"]; c[1] != "" || c[2] != "5" {
+		t.Errorf("created %v", c)
+	}
+	if c := changes["refs/heads/old"]; c[1] != "2" || c[2] != "" {
+		t.Errorf("deleted %v", c)
+	}
+}
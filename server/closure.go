@@ -22,7 +22,6 @@ package main
 
 import (
 	"fmt"
-	"html"
 	"net/http"
 	"time"
 
@@ -106,7 +105,7 @@ func replication_user_purge_event(e *Event) {
 	// the account is genuinely still due.
 	status, _ := row["status"].(string)
 	purge, _ := row["purge"].(int64)
-	if status != "closing" || purge <= 0 || purge > now() {
+	if (status != "closing" && status != "suspended") || purge <= 0 || purge > now() {
 		return
 	}
 	if _, err := user_purge_local(up.User, true); err != nil {
@@ -202,6 +201,7 @@ func web_auth_close_cancel(c *gin.Context) {
 
 	db := db_open("db/users.db")
 	db.exec("update users set status='active', purge=0 where uid=? and status='closing'", u.UID)
+	compliance_cancel(u.UID)
 
 	audit_account_reactivated(u.Username, rate_limit_client_ip(c))
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
@@ -232,7 +232,9 @@ func closure_manager() {
 	}
 }
 
-// closure_run_due purges every account whose purge timestamp has passed.
+// closure_run_due purges every account whose purge timestamp has passed,
+// whether closed by its user or offboarded by an administrator, then prunes
+// the offboarding exports whose retention period is over.
 //
 // Deliberately NOT leader-gated. Account data is per-host state: each replica
 // holds its own copy and must delete its own, so every host that sees the
@@ -249,7 +251,7 @@ func closure_manager() {
 // broadcasts from several hosts purging around the same time are harmless.
 func closure_run_due(t int64) {
 	db := db_open("db/users.db")
-	rows, err := db.rows("select uid from users where status='closing' and purge>0 and purge<=?", t)
+	rows, err := db.rows("select uid from users where status in ('closing', 'suspended') and purge>0 and purge<=?", t)
 	if err != nil {
 		return
 	}
@@ -268,8 +270,10 @@ func closure_run_due(t int64) {
 			info("Account closure purge failed for %q: %v", uid, err)
 			continue
 		}
+		retention_mark(uid)
 		audit_user_deleted(uid, uid)
 	}
+	retention_prune(t)
 }
 
 // email_account_closing tells the user their account is scheduled for
@@ -291,36 +295,12 @@ func email_account_closing(user *User, to string, purge int64, language string)
 	date := time.Unix(purge, 0).UTC().Format("2006-01-02")
 	args := map[string]any{"date": date}
 
-	subject := resolve_core_label(language, "email.account_closing.subject", nil)
-	heading := resolve_core_label(language, "email.account_closing.heading", nil)
-	body := resolve_core_label(language, "email.account_closing.body", args)
-
-	text := body + "\n"
-	html_body := `<!DOCTYPE html>
-<html>
-<head>
-  <meta charset="utf-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-</head>
-<body style="margin: 0; padding: 0; background-color: #f4f4f5; font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;">
-  <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="min-height: 100vh;">
-    <tr>
-      <td align="center" style="padding: 40px 20px;">
-        <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="max-width: 440px; background-color: #ffffff; border-radius: 12px; box-shadow: 0 2px 8px rgba(0, 0, 0, 0.08);">
-          <tr>
-            <td style="padding: 40px; text-align: center;">
-              <h1 style="margin: 0 0 16px 0; font-size: 24px; font-weight: 600; color: #18181b;">` + html.EscapeString(heading) + `</h1>
-              <p style="margin: 0; font-size: 15px; color: #52525b; line-height: 1.5;">` + html.EscapeString(body) + `</p>
-            </td>
-          </tr>
-        </table>
-      </td>
-    </tr>
-  </table>
-</body>
-</html>`
-
-	email_send_multipart(to, subject, text, html_body)
+	email_send_message(to, EmailMessage{
+		Language: language,
+		Subject:  resolve_core_label(language, "email.account_closing.subject", nil),
+		Heading:  resolve_core_label(language, "email.account_closing.heading", nil),
+		Body:     resolve_core_label(language, "email.account_closing.body", args),
+	})
 	if user != nil {
 		email_mark_delivered(user, to, event_id)
 	}
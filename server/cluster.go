@@ -0,0 +1,244 @@
+// Mochi server: Clustering
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With [cluster] enabled, several server processes share one data
+// directory: on one host, or on a LAN with a shared filesystem whose locks
+// SQLite can rely on. Each serves web traffic, with sessions in the shared
+// sessions.db, but only the leader starts the libp2p host, and runs the
+// outbound queue, the scheduler, app installs and the other background
+// managers that must run once. Other nodes queue their messages in the
+// shared queue.db for the leader to send, and only reach entities on this
+// server with mochi.remote.
+//
+// The leader holds a lease in db/cluster.db, renewed every cluster_renew
+// seconds and held for cluster_lease. A node that finds the lease expired
+// takes it and becomes leader. A leader that can't renew before its lease
+// runs out exits with code 75, so its supervisor restarts it as a follower
+// rather than two nodes sending at once. A leader shutting down releases
+// the lease, so for a rolling restart, restart the followers and then the
+// leader, and a follower takes over within cluster_renew seconds.
+//
+// Websocket messages written on one node are relayed to clients connected
+// to the others through the bus table, which each node polls. So are app
+// installs and upgrades, so every node loads the new version from the
+// shared apps directory.
+
+const (
+	cluster_lease   = 15 // Seconds a leader's lease lasts
+	cluster_renew   = 5  // Seconds between lease renewals
+	cluster_bus_age = 60 // Seconds relayed websocket messages are kept
+
+	cluster_apps_prefix = "apps:" // Bus key prefix for an installed app
+)
+
+var (
+	cluster_enabled   bool
+	cluster_node      string
+	cluster_following atomic.Bool // Clustered, and not the leader
+	cluster_expires   int64       // When this node's lease runs out; accessed only by cluster_manager
+	cluster_started   int64
+)
+
+type ClusterNode struct {
+	Node    string `db:"node" json:"node"`
+	Host    string `db:"host" json:"host"`
+	PID     int    `db:"pid" json:"pid"`
+	Version string `db:"version" json:"version"`
+	Leader  bool   `db:"-" json:"leader"`
+	Started int64  `db:"started" json:"started"`
+	Seen    int64  `db:"seen" json:"seen"`
+}
+
+// cluster_db opens the cluster database, creating its tables if needed
+func cluster_db() *DB {
+	db := db_open("db/cluster.db")
+	db.exec("create table if not exists lease ( id integer primary key check ( id = 1 ), node text not null, expires integer not null )")
+	db.exec("create table if not exists nodes ( node text not null primary key, host text not null, pid integer not null, version text not null, started integer not null, seen integer not null )")
+	db.exec("create table if not exists bus ( sequence integer primary key autoincrement, node text not null, user text not null, key text not null, content text not null, created integer not null )")
+	db.exec("insert or ignore into lease ( id, node, expires ) values ( 1, '', 0 )")
+	return db
+}
+
+// cluster_configure reads [cluster]. Each node needs a name of its own.
+func cluster_configure() error {
+	cluster_enabled = ini_bool("cluster", "enabled", false)
+	cluster_node = ini_string("cluster", "node", "")
+	if cluster_enabled && !valid(cluster_node, "function") {
+		return fmt.Errorf("cluster node name %q is not valid", cluster_node)
+	}
+	return nil
+}
+
+// cluster_start runs lead now if this node leads, and otherwise when it
+// takes the lease over
+func cluster_start(lead func()) {
+	if !cluster_enabled {
+		lead()
+		return
+	}
+	cluster_started = now()
+	cluster_seen()
+
+	// Followers know the server's peer ID, so entities on this server are
+	// still local to them, but don't start the host
+	net_identity()
+	cluster_following.Store(true)
+	if cluster_acquire() {
+		info("Cluster node %q leading", cluster_node)
+		cluster_following.Store(false)
+		lead()
+	} else {
+		info("Cluster node %q following", cluster_node)
+		apps_bootstrap_check()
+	}
+	go cluster_manager(lead)
+	go cluster_bus_manager()
+}
+
+// cluster_acquire takes or renews the lease, returning whether this node
+// holds it
+func cluster_acquire() bool {
+	db := cluster_db()
+	t := now()
+	if err := db.exec_e("update lease set node=?, expires=? where id=1 and ( node=? or expires<? )", cluster_node, t+cluster_lease, cluster_node, t); err != nil {
+		info("Cluster unable to update lease: %v", err)
+		return false
+	}
+	held, err := db.exists("select 1 from lease where id=1 and node=? and expires=?", cluster_node, t+cluster_lease)
+	if err != nil || !held {
+		return false
+	}
+	cluster_expires = t + cluster_lease
+	return true
+}
+
+// cluster_release gives the lease up on shutdown, so a follower takes over
+// without waiting for it to expire
+func cluster_release() {
+	if !cluster_enabled {
+		return
+	}
+	db := cluster_db()
+	db.exec_bg("cluster node", "delete from nodes where node=?", cluster_node)
+	if !cluster_following.Load() {
+		db.exec_bg("cluster lease", "update lease set expires=0 where id=1 and node=?", cluster_node)
+	}
+}
+
+// cluster_seen records that this node is running
+func cluster_seen() {
+	host, _ := os.Hostname()
+	cluster_db().exec_bg("cluster node", "replace into nodes ( node, host, pid, version, started, seen ) values ( ?, ?, ?, ?, ?, ? )", cluster_node, host, os.Getpid(), build_version, cluster_started, now())
+}
+
+// cluster_manager renews or contends for the lease
+func cluster_manager(lead func()) {
+	for range time.Tick(cluster_renew * time.Second) {
+		cluster_seen()
+		held := cluster_acquire()
+		leading := !cluster_following.Load()
+
+		if held && !leading {
+			info("Cluster node %q taking over as leader", cluster_node)
+			cluster_following.Store(false)
+			lead()
+
+		} else if !held && leading && now() >= cluster_expires {
+			warn("Cluster node %q lost its lease; restarting as a follower", cluster_node)
+			select {
+			case shutdown_request <- 75:
+			default:
+			}
+			return
+		}
+
+		if held {
+			cluster_db().exec_bg("cluster bus cleanup", "delete from bus where created < ?", now()-cluster_bus_age)
+		}
+	}
+}
+
+// cluster_leader returns the node holding an unexpired lease, if any
+func cluster_leader() string {
+	row, err := cluster_db().row("select node from lease where id=1 and expires>=?", now())
+	if err != nil || row == nil {
+		return ""
+	}
+	node, _ := row["node"].(string)
+	return node
+}
+
+// cluster_nodes lists the nodes seen within the last lease
+func cluster_nodes() []ClusterNode {
+	var nodes []ClusterNode
+	if err := cluster_db().scans(&nodes, "select * from nodes where seen>=? order by node", now()-cluster_lease); err != nil {
+		info("Cluster unable to list nodes: %v", err)
+	}
+	leader := cluster_leader()
+	for i := range nodes {
+		nodes[i].Leader = nodes[i].Node == leader
+	}
+	return nodes
+}
+
+// cluster_relay passes a websocket message on to the other nodes
+func cluster_relay(user, key string, content any) {
+	if !cluster_enabled {
+		return
+	}
+	cluster_db().exec_bg("cluster bus", "insert into bus ( node, user, key, content, created ) values ( ?, ?, ?, ?, ? )", cluster_node, user, key, json_encode(content), now())
+}
+
+// cluster_apps_installed tells the other nodes that an app has a new version
+func cluster_apps_installed(id string) {
+	cluster_relay("", cluster_apps_prefix+id, nil)
+}
+
+// cluster_bus_manager delivers websocket messages and server-sent events
+// relayed by other nodes to this node's clients, and loads apps they
+// installed
+func cluster_bus_manager() {
+	db := cluster_db()
+	after := db.integer64("select coalesce(max(sequence), 0) from bus")
+	for range time.Tick(time.Second) {
+		rows, err := db.rows("select sequence, node, user, key, content from bus where sequence>? order by sequence", after)
+		if err != nil {
+			continue
+		}
+		for _, r := range rows {
+			after = row_int(r, "sequence")
+			if node, _ := r["node"].(string); node == cluster_node {
+				continue
+			}
+			user, _ := r["user"].(string)
+			key, _ := r["key"].(string)
+			content, _ := r["content"].(string)
+			if id, found := strings.CutPrefix(key, cluster_apps_prefix); found {
+				if valid(id, "entity") {
+					app_load_published(id)
+					apps_bootstrap_check()
+				}
+				continue
+			}
+			if strings.HasPrefix(key, sse_bus_prefix) {
+				sse_bus_deliver(user, key, content)
+				continue
+			}
+			websockets_deliver(user, key, json.RawMessage(content))
+		}
+	}
+}
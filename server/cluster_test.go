@@ -0,0 +1,144 @@
+// Mochi server: Clustering tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+)
+
+// cluster_test_as runs f as the named node of a cluster
+func cluster_test_as(node string, f func()) {
+	saved_enabled, saved_node := cluster_enabled, cluster_node
+	cluster_enabled, cluster_node = true, node
+	defer func() { cluster_enabled, cluster_node = saved_enabled, saved_node }()
+	f()
+}
+
+func TestClusterLease(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	t.Cleanup(func() { cluster_following.Store(false) })
+
+	// One node takes the lease, and keeps it while renewing
+	var held bool
+	cluster_test_as("a", func() { held = cluster_acquire() })
+	if !held {
+		t.Fatal("first node did not take the lease")
+	}
+	cluster_test_as("b", func() { held = cluster_acquire() })
+	if held {
+		t.Fatal("second node took a lease that hadn't expired")
+	}
+	cluster_test_as("a", func() { held = cluster_acquire() })
+	if !held || cluster_leader() != "a" {
+		t.Fatalf("leader could not renew; leader is %q", cluster_leader())
+	}
+
+	// Another node takes an expired lease over
+	cluster_db().exec("update lease set expires=?", now()-1)
+	if cluster_leader() != "" {
+		t.Errorf("expired lease still has leader %q", cluster_leader())
+	}
+	cluster_test_as("b", func() { held = cluster_acquire() })
+	if !held || cluster_leader() != "b" {
+		t.Fatalf("expired lease not taken over; leader is %q", cluster_leader())
+	}
+
+	// A leader shutting down releases the lease at once
+	cluster_following.Store(false)
+	cluster_test_as("b", cluster_release)
+	cluster_test_as("a", func() { held = cluster_acquire() })
+	if !held {
+		t.Fatal("released lease not taken over")
+	}
+}
+
+func TestClusterConfigure(t *testing.T) {
+	saved_enabled, saved_node := cluster_enabled, cluster_node
+	t.Cleanup(func() { cluster_enabled, cluster_node = saved_enabled, saved_node })
+
+	if err := cluster_configure(); err != nil || cluster_enabled {
+		t.Fatalf("unconfigured server clustered: %v", err)
+	}
+	t.Setenv("MOCHI_CLUSTER_ENABLED", "true")
+	if err := cluster_configure(); err == nil {
+		t.Error("cluster without a node name accepted")
+	}
+	t.Setenv("MOCHI_CLUSTER_NODE", "../web1")
+	if err := cluster_configure(); err == nil {
+		t.Error("invalid node name accepted")
+	}
+	t.Setenv("MOCHI_CLUSTER_NODE", "web_1")
+	if err := cluster_configure(); err != nil || cluster_node != "web_1" {
+		t.Errorf("configure = %v, node %q", err, cluster_node)
+	}
+}
+
+func TestClusterNodes(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+
+	cluster_test_as("a", func() {
+		cluster_seen()
+		cluster_acquire()
+	})
+	cluster_test_as("b", cluster_seen)
+	cluster_db().exec("insert into nodes ( node, host, pid, version, started, seen ) values ( 'gone', 'h', 1, '', 0, 0 )")
+
+	nodes := cluster_nodes()
+	if len(nodes) != 2 || nodes[0].Node != "a" || !nodes[0].Leader || nodes[1].Node != "b" || nodes[1].Leader {
+		t.Fatalf("nodes = %+v", nodes)
+	}
+}
+
+func TestClusterRelay(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+
+	// A server that isn't clustered relays nothing
+	cluster_relay("u1", "chat", map[string]any{"n": 1})
+	cluster_test_as("a", func() {
+		cluster_relay("u1", "chat", map[string]any{"n": 2})
+	})
+	rows, err := cluster_db().rows("select node, user, key, content from bus")
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("bus = %v, %v", rows, err)
+	}
+	if rows[0]["node"] != "a" || rows[0]["user"] != "u1" || rows[0]["key"] != "chat" || rows[0]["content"] != `{"n":2}` {
+		t.Errorf("relayed %v", rows[0])
+	}
+}
+
+func TestClusterFollowerReady(t *testing.T) {
+	saved_ready := apps_bootstrap_ready
+	apps_bootstrap_ready = false
+	t.Cleanup(func() { apps_bootstrap_ready = saved_ready })
+	login, home := apps_default[0].ID, apps_default[1].ID
+	for _, id := range []string{login, home} {
+		if app_exists(id) {
+			t.Skipf("app %q already loaded", id)
+		}
+	}
+	t.Cleanup(func() {
+		apps_lock.Lock()
+		delete(apps, login)
+		delete(apps, home)
+		apps_lock.Unlock()
+	})
+
+	// A follower is ready once the leader has installed Login and Home
+	app_external(login)
+	apps_bootstrap_check()
+	if apps_bootstrap_ready {
+		t.Fatal("ready without Home")
+	}
+	app_external(home)
+	apps_bootstrap_check()
+	if !apps_bootstrap_ready {
+		t.Error("not ready with Login and Home loaded")
+	}
+}
@@ -0,0 +1,592 @@
+// Mochi server: Comments
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Comments are a core service so that every app which shows discussion
+// under its objects - feed posts, wiki pages, repository commits - gets the
+// same threads, reactions and moderation. A comment belongs to an object
+// named by the app, on an owner entity: the feed, wiki, or repository the
+// object is part of.
+//
+// The owner's server is the authority. Comments, edits, deletions,
+// reactions and moderation by other servers' entities are sent to the
+// owner as events on the comments service, applied there if allowed, and
+// the resulting comment is sent as a "record" event to every remote entity
+// that has commented or reacted on the object, whose servers keep a copy.
+// A comment's author may edit or delete it; the owner entity, and for a
+// group entity its moderators, may also delete it or change its status.
+//
+// Comments live in db/comments.db, shared by every app and keyed by app.
+
+const (
+	comment_body_limit     = 10000
+	comment_object_limit   = 1000
+	comment_reaction_limit = 32
+)
+
+// comment_watchers return further remote entities to send a comment to,
+// beyond those in its discussion, such as the participants in a ticket
+var comment_watchers []func(*Comment) []string
+
+var comment_statuses = map[string]bool{
+	"visible": true,
+	"pending": true,
+	"hidden":  true,
+	"deleted": true,
+}
+
+type Comment struct {
+	ID      string `db:"id"`
+	App     string `db:"app"`
+	Owner   string `db:"owner"`
+	Object  string `db:"object"`
+	Parent  string `db:"parent"`
+	Author  string `db:"author"`
+	Body    string `db:"body"`
+	Status  string `db:"status"`
+	Created int64  `db:"created"`
+	Edited  int64  `db:"edited"`
+	Updated int64  `db:"updated"`
+}
+
+var api_comment = sls.FromStringDict(sl.String("mochi.comment"), sl.StringDict{
+	"delete":   sl.NewBuiltin("mochi.comment.delete", api_comment_delete),
+	"edit":     sl.NewBuiltin("mochi.comment.edit", api_comment_edit),
+	"get":      sl.NewBuiltin("mochi.comment.get", api_comment_get),
+	"list":     sl.NewBuiltin("mochi.comment.list", api_comment_list),
+	"moderate": sl.NewBuiltin("mochi.comment.moderate", api_comment_moderate),
+	"post":     sl.NewBuiltin("mochi.comment.post", api_comment_post),
+	"react":    sl.NewBuiltin("mochi.comment.react", api_comment_react),
+})
+
+func init() {
+	a := app("comments")
+	a.service("comments")
+	a.event("record", comment_record_event)
+	a.event("post", comment_post_event)
+	a.event("edit", comment_edit_event)
+	a.event("delete", comment_delete_event)
+	a.event("react", comment_react_event)
+	a.event("moderate", comment_moderate_event)
+}
+
+// comments_db opens the server-wide comments, creating its tables if needed
+func comments_db() *DB {
+	db := db_open("db/comments.db")
+	db.exec("create table if not exists comments (id text not null primary key, app text not null, owner text not null, object text not null, parent text not null default '', author text not null, body text not null, status text not null, created integer not null, edited integer not null default 0, updated integer not null)")
+	db.exec("create index if not exists comments_owner_app_object on comments(owner, app, object, created)")
+	db.exec("create table if not exists reactions (comment text not null, author text not null, reaction text not null, created integer not null, primary key (comment, author, reaction))")
+	return db
+}
+
+// comment_reaction_valid checks a reaction is a short token, such as an emoji
+func comment_reaction_valid(r string) bool {
+	if r == "" || len(r) > comment_reaction_limit {
+		return false
+	}
+	for _, c := range r {
+		if unicode.IsSpace(c) || unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// comment_get returns a comment, or nil
+func comment_get(id string) *Comment {
+	var c Comment
+	if !comments_db().scan(&c, "select * from comments where id=?", id) {
+		return nil
+	}
+	return &c
+}
+
+// comment_local reports whether this server owns an entity
+func comment_local(entity string) bool {
+	return user_owning_entity(entity) != nil
+}
+
+// comment_moderator reports whether an entity may moderate comments on an
+// owner: the owner itself, or a moderator of a group entity
+func comment_moderator(owner, actor string) bool {
+	return group_member_rank(owner, actor) >= group_roles["moderator"]
+}
+
+// reactions returns a comment's reactions as [reaction, author] pairs
+func (c *Comment) reactions() [][]string {
+	rows, _ := comments_db().rows("select reaction, author from reactions where comment=? order by created", c.ID)
+	pairs := make([][]string, 0, len(rows))
+	for _, r := range rows {
+		reaction, _ := r["reaction"].(string)
+		author, _ := r["author"].(string)
+		pairs = append(pairs, []string{reaction, author})
+	}
+	return pairs
+}
+
+// record returns a comment as sent to other servers
+func (c *Comment) record() map[string]any {
+	return map[string]any{
+		"id":        c.ID,
+		"app":       c.App,
+		"owner":     c.Owner,
+		"object":    c.Object,
+		"parent":    c.Parent,
+		"author":    c.Author,
+		"body":      c.Body,
+		"status":    c.Status,
+		"created":   c.Created,
+		"edited":    c.Edited,
+		"updated":   c.Updated,
+		"reactions": c.reactions(),
+	}
+}
+
+// view returns a comment as seen by an app, with reaction counts and the
+// viewer's own reactions
+func (c *Comment) view(viewers map[string]bool) map[string]any {
+	counts := map[string]any{}
+	mine := []string{}
+	for _, p := range c.reactions() {
+		n, _ := counts[p[0]].(int)
+		counts[p[0]] = n + 1
+		if viewers[p[1]] {
+			mine = append(mine, p[0])
+		}
+	}
+	return map[string]any{
+		"id":        c.ID,
+		"object":    c.Object,
+		"owner":     c.Owner,
+		"parent":    c.Parent,
+		"author":    c.Author,
+		"body":      c.Body,
+		"status":    c.Status,
+		"created":   c.Created,
+		"edited":    c.Edited,
+		"reactions": counts,
+		"mine":      mine,
+		"replies":   []any{},
+	}
+}
+
+// comment_store keeps a comment unless a newer copy is already held
+func comment_store(c *Comment) bool {
+	result, err := comments_db().internal.Exec("insert into comments (id, app, owner, object, parent, author, body, status, created, edited, updated) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict (id) do update set body=excluded.body, status=excluded.status, edited=excluded.edited, updated=excluded.updated where excluded.updated > comments.updated and excluded.owner = comments.owner", c.ID, c.App, c.Owner, c.Object, c.Parent, c.Author, c.Body, c.Status, c.Created, c.Edited, c.Updated)
+	if err != nil {
+		warn("Comment store failed for %q: %v", c.ID, err)
+		return false
+	}
+	changed, _ := result.RowsAffected()
+	return changed > 0
+}
+
+// touch advances a comment's update time past its last change
+func (c *Comment) touch() {
+	t := now()
+	if t <= c.Updated {
+		t = c.Updated + 1
+	}
+	c.Updated = t
+}
+
+// comment_publish sends a changed comment on the owner's server to every
+// remote entity taking part in the object's discussion, and to the owner's
+// browsers
+func comment_publish(c *Comment) {
+	record := c.record()
+	if u := user_owning_entity(c.Owner); u != nil {
+		websockets_send(u, "comments", record)
+	}
+
+	rows, _ := comments_db().rows("select author from comments where owner=? and app=? and object=? union select r.author from reactions r join comments c on c.id=r.comment where c.owner=? and c.app=? and c.object=?", c.Owner, c.App, c.Object, c.Owner, c.App, c.Object)
+	recipients := map[string]bool{}
+	for _, r := range rows {
+		author, _ := r["author"].(string)
+		recipients[author] = true
+	}
+	for _, w := range comment_watchers {
+		for _, e := range w(c) {
+			recipients[e] = true
+		}
+	}
+	for author := range recipients {
+		if author == "" || author == c.Owner || comment_local(author) {
+			continue
+		}
+		m := message(c.Owner, author, "comments", "record")
+		m.content = record
+		m.send()
+	}
+}
+
+// comment_post adds a comment on the owner's server, returning it, or nil
+// if the parent is not on the same object or the id is taken
+func comment_post(id, app, owner, object, parent, author, body string) *Comment {
+	if parent != "" {
+		p := comment_get(parent)
+		if p == nil || p.Owner != owner || p.App != app || p.Object != object {
+			return nil
+		}
+	}
+	if comment_get(id) != nil {
+		return nil
+	}
+	t := now()
+	c := &Comment{ID: id, App: app, Owner: owner, Object: object, Parent: parent, Author: author, Body: body, Status: "visible", Created: t, Updated: t}
+	if !comment_store(c) {
+		return nil
+	}
+	comment_publish(c)
+	return c
+}
+
+// comment_apply makes a change to a comment on the owner's server on an
+// entity's authority, returning the changed comment or an error
+func comment_apply(c *Comment, actor, event string, content map[string]any) (*Comment, error) {
+	switch event {
+	case "edit":
+		body, _ := content["body"].(string)
+		if actor != c.Author || c.Status == "deleted" {
+			return nil, fmt.Errorf("not allowed")
+		}
+		if body == "" || len(body) > comment_body_limit {
+			return nil, fmt.Errorf("invalid body")
+		}
+		c.Body = body
+		c.Edited = now()
+
+	case "delete":
+		if actor != c.Author && !comment_moderator(c.Owner, actor) {
+			return nil, fmt.Errorf("not allowed")
+		}
+		c.Body = ""
+		c.Status = "deleted"
+		comments_db().exec("delete from reactions where comment=?", c.ID)
+
+	case "moderate":
+		status, _ := content["status"].(string)
+		if !comment_moderator(c.Owner, actor) || c.Status == "deleted" {
+			return nil, fmt.Errorf("not allowed")
+		}
+		if !comment_statuses[status] || status == "deleted" {
+			return nil, fmt.Errorf("invalid status %q", status)
+		}
+		c.Status = status
+
+	case "react":
+		reaction, _ := content["reaction"].(string)
+		remove, _ := content["remove"].(bool)
+		if c.Status == "deleted" {
+			return nil, fmt.Errorf("not allowed")
+		}
+		if !comment_reaction_valid(reaction) {
+			return nil, fmt.Errorf("invalid reaction")
+		}
+		if remove {
+			comments_db().exec("delete from reactions where comment=? and author=? and reaction=?", c.ID, actor, reaction)
+		} else {
+			comments_db().exec("insert or ignore into reactions (comment, author, reaction, created) values (?, ?, ?, ?)", c.ID, actor, reaction, now())
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown change %q", event)
+	}
+
+	c.touch()
+	comment_store(c)
+	comment_publish(c)
+	return c, nil
+}
+
+// comment_record_event receives a comment from the server that owns it
+func comment_record_event(e *Event) {
+	c := &Comment{
+		ID:      e.get("id", ""),
+		App:     e.get("app", ""),
+		Owner:   e.get("owner", ""),
+		Object:  e.get("object", ""),
+		Parent:  e.get("parent", ""),
+		Author:  e.get("author", ""),
+		Body:    e.get("body", ""),
+		Status:  e.get("status", ""),
+		Created: event_int64(e.content["created"]),
+		Edited:  event_int64(e.content["edited"]),
+		Updated: event_int64(e.content["updated"]),
+	}
+	if c.Owner != e.from || comment_local(c.Owner) || !valid(c.ID, "id") || !valid(c.App, "constant") || c.Object == "" || !comment_statuses[c.Status] {
+		info("Comments dropping invalid record from %q", e.from)
+		return
+	}
+	if !comment_store(c) {
+		return
+	}
+
+	db := comments_db()
+	db.exec("delete from reactions where comment=?", c.ID)
+	pairs, _ := e.content["reactions"].([]any)
+	for _, p := range pairs {
+		pair, _ := p.([]any)
+		if len(pair) != 2 {
+			continue
+		}
+		reaction, _ := pair[0].(string)
+		author, _ := pair[1].(string)
+		if comment_reaction_valid(reaction) && valid(author, "entity") {
+			db.exec("insert or ignore into reactions (comment, author, reaction, created) values (?, ?, ?, ?)", c.ID, author, reaction, c.Updated)
+		}
+	}
+	if e.user != nil {
+		websockets_send(e.user, "comments", c.record())
+	}
+}
+
+// comment_post_event receives a new comment for an object this server owns
+func comment_post_event(e *Event) {
+	id := e.get("id", "")
+	app := e.get("app", "")
+	object := e.get("object", "")
+	body := e.get("body", "")
+	if e.from == "" || !valid(id, "id") || !valid(app, "constant") || object == "" || len(object) > comment_object_limit || body == "" || len(body) > comment_body_limit {
+		return
+	}
+	comment_post(id, app, e.to, object, e.get("parent", ""), e.from, body)
+}
+
+// comment_change_event receives a change to a comment this server owns
+func comment_change_event(e *Event, event string) {
+	c := comment_get(e.get("id", ""))
+	if e.from == "" || c == nil || c.Owner != e.to {
+		return
+	}
+	if _, err := comment_apply(c, e.from, event, e.content); err != nil {
+		debug("Comments refused %s of %q by %q: %v", event, c.ID, e.from, err)
+	}
+}
+
+func comment_edit_event(e *Event)     { comment_change_event(e, "edit") }
+func comment_delete_event(e *Event)   { comment_change_event(e, "delete") }
+func comment_react_event(e *Event)    { comment_change_event(e, "react") }
+func comment_moderate_event(e *Event) { comment_change_event(e, "moderate") }
+
+// comment_viewers returns the entities a user acts as
+func comment_viewers(u *User) map[string]bool {
+	viewers := map[string]bool{}
+	rows, _ := db_open("db/users.db").rows("select id from entities where user=?", u.UID)
+	for _, r := range rows {
+		if id, _ := r["id"].(string); id != "" {
+			viewers[id] = true
+		}
+	}
+	return viewers
+}
+
+// comment_visible reports whether a comment is shown to a viewer: visible
+// and deleted comments are shown to everyone, so replies keep their place,
+// and pending or hidden ones only to their author and moderators
+func comment_visible(c *Comment, viewers map[string]bool) bool {
+	if c.Status == "visible" || c.Status == "deleted" || viewers[c.Author] {
+		return true
+	}
+	for v := range viewers {
+		if comment_moderator(c.Owner, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// comment_change makes a change to a comment, here if this server owns it,
+// otherwise by sending it to the owner. Returns the changed comment, or
+// None if sent.
+func comment_change(t *sl.Thread, fn *sl.Builtin, id, from, event string, content map[string]any) (sl.Value, error) {
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	c := comment_get(id)
+	if c == nil || c.App != app.id {
+		return sl_error(fn, "comment not found")
+	}
+	actor := group_acting(user, from)
+	if actor == "" {
+		return sl_error(fn, "invalid from")
+	}
+
+	if comment_local(c.Owner) {
+		c, err = comment_apply(c, actor, event, content)
+		if err != nil {
+			return sl_error(fn, "%v", err)
+		}
+		return sl_encode(c.view(comment_viewers(user))), nil
+	}
+
+	m := message(actor, c.Owner, "comments", event)
+	m.content = content
+	m.content["id"] = c.ID
+	m.FromApp = app.id
+	m.send()
+	return sl.None, nil
+}
+
+// mochi.comment.post(owner, object, body, parent?, from?) -> string: Comment
+// on an object of an owner entity, optionally in reply to another comment.
+// Returns the new comment's id.
+func api_comment_post(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var owner, object, body, parent, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "owner", &owner, "object", &object, "body", &body, "parent?", &parent, "from?", &from); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(owner, "entity") {
+		return sl_error(fn, "invalid owner")
+	}
+	if object == "" || len(object) > comment_object_limit {
+		return sl_error(fn, "invalid object")
+	}
+	body = strings.TrimSpace(body)
+	if body == "" || len(body) > comment_body_limit {
+		return sl_error(fn, "invalid body")
+	}
+	actor := group_acting(user, from)
+	if actor == "" {
+		return sl_error(fn, "invalid from")
+	}
+
+	id := uid()
+	if comment_local(owner) {
+		if comment_post(id, app.id, owner, object, parent, actor, body) == nil {
+			return sl_error(fn, "invalid parent")
+		}
+		return sl.String(id), nil
+	}
+
+	m := message(actor, owner, "comments", "post")
+	m.set("id", id, "app", app.id, "object", object, "parent", parent, "body", body)
+	m.FromApp = app.id
+	m.send()
+	return sl.String(id), nil
+}
+
+// mochi.comment.edit(id, body, from?) -> dict | None: Edit one of your
+// comments. Returns the comment, or None if sent to its owner's server.
+func api_comment_edit(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, body, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "body", &body, "from?", &from); err != nil {
+		return nil, err
+	}
+	return comment_change(t, fn, id, from, "edit", map[string]any{"body": strings.TrimSpace(body)})
+}
+
+// mochi.comment.delete(id, from?) -> dict | None: Delete a comment, as its
+// author or a moderator. Replies remain.
+func api_comment_delete(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "from?", &from); err != nil {
+		return nil, err
+	}
+	return comment_change(t, fn, id, from, "delete", map[string]any{})
+}
+
+// mochi.comment.react(id, reaction, remove?, from?) -> dict | None: Add or
+// remove a reaction, such as an emoji, on a comment
+func api_comment_react(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, reaction, from string
+	var remove bool
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "reaction", &reaction, "remove?", &remove, "from?", &from); err != nil {
+		return nil, err
+	}
+	if !comment_reaction_valid(reaction) {
+		return sl_error(fn, "invalid reaction")
+	}
+	return comment_change(t, fn, id, from, "react", map[string]any{"reaction": reaction, "remove": remove})
+}
+
+// mochi.comment.moderate(id, status, from?) -> dict | None: Set a comment's
+// status to "visible", "pending" or "hidden", as a moderator of its owner
+func api_comment_moderate(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, status, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "status", &status, "from?", &from); err != nil {
+		return nil, err
+	}
+	if !comment_statuses[status] || status == "deleted" {
+		return sl_error(fn, "invalid status %q", status)
+	}
+	return comment_change(t, fn, id, from, "moderate", map[string]any{"status": status})
+}
+
+// mochi.comment.get(id) -> dict | None: Get a comment
+func api_comment_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	viewers := comment_viewers(user)
+	c := comment_get(id)
+	if c == nil || c.App != app.id || !comment_visible(c, viewers) {
+		return sl.None, nil
+	}
+	return sl_encode(c.view(viewers)), nil
+}
+
+// mochi.comment.list(owner, object) -> list: Get the discussion on an
+// object as a list of top-level comments, each with its replies. For an
+// owner on another server, only discussions the user has taken part in are
+// held here.
+func api_comment_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var owner, object string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "owner", &owner, "object", &object); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	var comments []Comment
+	if err := comments_db().scans(&comments, "select * from comments where owner=? and app=? and object=? order by created, id", owner, app.id, object); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(comment_tree(comments, comment_viewers(user))), nil
+}
+
+// comment_tree arranges the comments a viewer may see into threads. Replies
+// to a comment the viewer may not see are left out with it.
+func comment_tree(comments []Comment, viewers map[string]bool) []any {
+	views := map[string]map[string]any{}
+	top := []any{}
+	for i := range comments {
+		c := &comments[i]
+		if !comment_visible(c, viewers) {
+			continue
+		}
+		v := c.view(viewers)
+		views[c.ID] = v
+		if c.Parent == "" {
+			top = append(top, v)
+		} else if p := views[c.Parent]; p != nil {
+			p["replies"] = append(p["replies"].([]any), v)
+		}
+	}
+	return top
+}
@@ -0,0 +1,137 @@
+// Mochi server: Comments tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+)
+
+const comment_test_remote = "1CommentTestRemoteEntityXXXXXXXXXXXXXXXXXXXXXXXX"
+
+// comment_test_setup creates a user owning a feed entity and a person entity
+func comment_test_setup(t *testing.T) (*User, string, string) {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	user := create_permission_test_user(t, "u1")
+	db_open("db/users.db").exec("insert into users (uid, username) values (?, ?)", user.UID, user.Username)
+	feed, err := entity_create(user, "feed", "Test feed", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	person, err := entity_create(user, "person", "Test person", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, feed.ID, person.ID
+}
+
+func TestCommentThreads(t *testing.T) {
+	_, feed, person := comment_test_setup(t)
+	top := comment_post(uid(), "feeds", feed, "post/1", "", person, "First")
+	if top == nil {
+		t.Fatal("comment not posted")
+	}
+	if comment_post(uid(), "feeds", feed, "post/2", top.ID, person, "Wrong object") != nil {
+		t.Error("reply accepted to a comment on another object")
+	}
+	if comment_post(top.ID, "feeds", feed, "post/1", "", person, "Duplicate") != nil {
+		t.Error("comment accepted with an id already taken")
+	}
+	reply := comment_post(uid(), "feeds", feed, "post/1", top.ID, person, "Reply")
+	if reply == nil {
+		t.Fatal("reply not posted")
+	}
+
+	var comments []Comment
+	comments_db().scans(&comments, "select * from comments where owner=? and object='post/1' order by created, id", feed)
+	tree := comment_tree(comments, map[string]bool{})
+	if len(tree) != 1 {
+		t.Fatalf("tree has %d top-level comments, want 1", len(tree))
+	}
+	replies := tree[0].(map[string]any)["replies"].([]any)
+	if len(replies) != 1 || replies[0].(map[string]any)["id"] != reply.ID {
+		t.Errorf("reply not threaded: %v", replies)
+	}
+}
+
+func TestCommentChangeAuthority(t *testing.T) {
+	_, feed, person := comment_test_setup(t)
+	c := comment_post(uid(), "feeds", feed, "post/1", "", person, "Hello")
+
+	// Only the author may edit, and anyone but a moderator may not hide
+	if _, err := comment_apply(c, comment_test_remote, "edit", map[string]any{"body": "Changed"}); err == nil {
+		t.Error("stranger edited a comment")
+	}
+	if _, err := comment_apply(c, person, "moderate", map[string]any{"status": "hidden"}); err == nil {
+		t.Error("author moderated their own comment")
+	}
+	if _, err := comment_apply(c, person, "edit", map[string]any{"body": "Changed"}); err != nil {
+		t.Errorf("author could not edit: %v", err)
+	}
+	if _, err := comment_apply(c, feed, "moderate", map[string]any{"status": "hidden"}); err != nil {
+		t.Errorf("owner could not hide: %v", err)
+	}
+
+	// A hidden comment is shown only to its author and moderators
+	c = comment_get(c.ID)
+	if comment_visible(c, map[string]bool{comment_test_remote: true}) {
+		t.Error("hidden comment shown to a stranger")
+	}
+	if !comment_visible(c, map[string]bool{person: true}) {
+		t.Error("hidden comment not shown to its author")
+	}
+
+	if _, err := comment_apply(c, person, "react", map[string]any{"reaction": "👍"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := comment_get(c.ID).view(map[string]bool{person: true}); got["reactions"].(map[string]any)["👍"] != 1 || len(got["mine"].([]string)) != 1 {
+		t.Errorf("reaction not counted: %v", got)
+	}
+	if _, err := comment_apply(c, person, "delete", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := comment_get(c.ID); got.Status != "deleted" || got.Body != "" || len(got.reactions()) != 0 {
+		t.Errorf("deleted comment kept content: %+v", got)
+	}
+}
+
+func TestCommentRecordEvent(t *testing.T) {
+	_, feed, person := comment_test_setup(t)
+	record := map[string]any{"id": uid(), "app": "feeds", "owner": comment_test_remote, "object": "post/1", "author": person, "body": "Hi", "status": "visible", "created": int64(100), "updated": int64(100), "reactions": []any{[]any{"👍", person}}}
+
+	// Records are accepted only from their owner, and never for a local owner
+	comment_record_event(&Event{from: person, content: record})
+	if comment_get(record["id"].(string)) != nil {
+		t.Error("record accepted from an entity other than its owner")
+	}
+	local := map[string]any{}
+	for k, v := range record {
+		local[k] = v
+	}
+	local["id"] = uid()
+	local["owner"] = feed
+	comment_record_event(&Event{from: feed, content: local})
+	if comment_get(local["id"].(string)) != nil {
+		t.Error("record accepted for an owner on this server")
+	}
+
+	comment_record_event(&Event{from: comment_test_remote, content: record})
+	c := comment_get(record["id"].(string))
+	if c == nil || c.Body != "Hi" || len(c.reactions()) != 1 {
+		t.Fatalf("valid record not stored: %+v", c)
+	}
+
+	// An older copy does not replace a newer one
+	record["body"] = "Old"
+	record["updated"] = int64(50)
+	comment_record_event(&Event{from: comment_test_remote, content: record})
+	if comment_get(c.ID).Body != "Hi" {
+		t.Error("older record replaced newer")
+	}
+}
@@ -145,7 +145,7 @@ func commit_hook_drain(db *DB, av *AppVersion, a *App, u *User, function string)
 // uses the return to decide whether to mark the log row fired or leave
 // it for the drainer to retry.
 func commit_hook_invoke(av *AppVersion, a *App, u *User, function, table, kind, row_uid string) bool {
-	if av.Architecture.Engine != "starlark" {
+	if !av.scripted() {
 		return true
 	}
 	s := av.starlark()
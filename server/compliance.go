@@ -0,0 +1,466 @@
+// Mochi server: Data subject requests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// A user can ask for a copy of their personal data, and for it to be
+// erased, and the server keeps a log of both kinds of request in
+// db/compliance.db for administrators to show they were fulfilled.
+//
+// mochi.compliance.access() builds a subject access export. Unlike the
+// account export, which is a restorable backup carrying the user's keys,
+// it's for reading: every database the user has is rendered as JSON, a
+// table to a list of rows, alongside their files and account records, and
+// no keys or secrets are included.
+//
+// mochi.compliance.erase() closes the account as mochi.user.close() does,
+// so the user can still change their mind during the grace period. When
+// the account is deleted, each entity known to hold a copy of the user's
+// data (their broadcast subscribers, and the audiences of their activity
+// digest and presence) is first sent a signed erasure request from each of
+// the user's entities. The receiving server deletes what core holds from
+// the entity, and calls the erasure function of each app that declares one
+// in app.json
+//
+//	"erasure": {"function": "erase"}
+//
+// with the entity's ID, so the app can delete its copies too. Once the
+// account is gone the server checks nothing of it is left, and records the
+// outcome against the request.
+
+var api_compliance = sls.FromStringDict(sl.String("mochi.compliance"), sl.StringDict{
+	"access": sl.NewBuiltin("mochi.compliance.access", api_compliance_access),
+	"erase":  sl.NewBuiltin("mochi.compliance.erase", api_compliance_erase),
+	"list":   sl.NewBuiltin("mochi.compliance.list", api_compliance_list),
+})
+
+func init() {
+	a := app("erasure")
+	a.service("erasure")
+	a.event("request", erasure_request_event)
+}
+
+// compliance_db opens the request log, creating its table if needed
+func compliance_db() *DB {
+	db := db_open("db/compliance.db")
+	db.exec("create table if not exists requests (id text not null primary key, user text not null, username text not null, type text not null, status text not null, requested integer not null, fulfilled integer not null default 0, detail text not null default '')")
+	db.exec("create index if not exists requests_user on requests(user, requested)")
+	db.exec("create index if not exists requests_requested on requests(requested)")
+	return db
+}
+
+// compliance_request records a request, returning its ID
+func compliance_request(u *User, kind, status, detail string) string {
+	id := uid()
+	fulfilled := int64(0)
+	if status == "fulfilled" {
+		fulfilled = now()
+	}
+	compliance_db().exec("insert into requests (id, user, username, type, status, requested, fulfilled, detail) values (?, ?, ?, ?, ?, ?, ?, ?)", id, u.UID, u.Username, kind, status, now(), fulfilled, detail)
+	return id
+}
+
+// compliance_cancel marks a user's pending erasure requests cancelled, when
+// their account is reactivated before it is deleted
+func compliance_cancel(uid string) {
+	if file_exists(filepath.Join(data_dir, "db", "compliance.db")) {
+		compliance_db().exec("update requests set status='cancelled', fulfilled=? where user=? and type='erasure' and status='pending'", now(), uid)
+	}
+}
+
+// compliance_access builds a subject access export for uid into the calling
+// app's files directory under mochi-export/, returning the app-relative
+// path, as user_export does
+func compliance_access(uid, app, host string) (string, error) {
+	export_cleanup_orphans(uid, app)
+	root := filepath.Join(data_dir, "users", uid)
+	udb := db_open("db/users.db")
+	var primary Entity
+	if !udb.scan(&primary, "select * from entities where user=? and class='person' limit 1", uid) {
+		return "", fmt.Errorf("no primary entity for user")
+	}
+
+	stamp := time.Unix(now(), 0).UTC()
+	bundle := fmt.Sprintf("mochi-access-%s-%s-%s", stamp.Format("20060102-150405"), primary.Fingerprint, export_suffix())
+	tree := filepath.Join(root, "export", "staging", bundle)
+	if err := os.MkdirAll(tree, 0o700); err != nil {
+		return "", fmt.Errorf("create staging: %w", err)
+	}
+	defer os.RemoveAll(tree)
+
+	// Everything in the user's directory, with databases as JSON
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if d.IsDir() {
+			if rel == "export" || rel == "restore" || (filepath.Base(filepath.Dir(path)) == "files" && (d.Name() == "thumbnails" || d.Name() == "mochi-export")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if strings.HasSuffix(name, "-wal") || strings.HasSuffix(name, "-shm") || strings.HasSuffix(name, ".db.snap") || strings.HasSuffix(name, ".db.backup") {
+			return nil
+		}
+		target := filepath.Join(tree, "data", rel)
+		if strings.HasSuffix(name, ".db") {
+			return compliance_dump_db(path, strings.TrimSuffix(target, ".db")+".json")
+		}
+		return export_copy_file(path, target)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("read user directory: %w", err)
+	}
+
+	if err := export_account_json(udb, uid, &primary, filepath.Join(tree, "account.json")); err != nil {
+		return "", err
+	}
+	if err := export_schedule_json(uid, filepath.Join(tree, "schedule.json")); err != nil {
+		return "", err
+	}
+	if err := export_linked_json(udb, uid, filepath.Join(tree, "linked.json")); err != nil {
+		return "", err
+	}
+	requests, _ := compliance_db().rows("select id, type, status, requested, fulfilled, detail from requests where user=? order by requested", uid)
+	if err := export_write_json(filepath.Join(tree, "requests.json"), requests); err != nil {
+		return "", err
+	}
+	if err := export_manifest_write(tree, &primary, export_source_server(host), stamp); err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(root, app, "files", "mochi-export")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("create download directory: %w", err)
+	}
+	if err := export_zip(tree, bundle, filepath.Join(dir, bundle+".zip"), stamp); err != nil {
+		return "", fmt.Errorf("zip bundle: %w", err)
+	}
+	return filepath.ToSlash(filepath.Join("mochi-export", bundle+".zip")), nil
+}
+
+// compliance_dump_db writes every table of a database as JSON, a map of
+// table name to rows. Text columns stay text; other blobs are base64.
+func compliance_dump_db(src, dst string) error {
+	d, err := sql.Open("sqlite3", "file:"+src+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return fmt.Errorf("open %s: %w", src, err)
+	}
+	defer d.Close()
+
+	var tables []string
+	list, err := d.Query("select name from sqlite_master where type='table' and name not like 'sqlite_%' order by name")
+	if err != nil {
+		return fmt.Errorf("read %s: %w", src, err)
+	}
+	for list.Next() {
+		var name string
+		if list.Scan(&name) == nil {
+			tables = append(tables, name)
+		}
+	}
+	list.Close()
+
+	out := map[string][]map[string]any{}
+	for _, table := range tables {
+		rows, err := d.Query(fmt.Sprintf("select * from %q", table))
+		if err != nil {
+			return fmt.Errorf("read %s table %s: %w", src, table, err)
+		}
+		columns, _ := rows.Columns()
+		result := []map[string]any{}
+		for rows.Next() {
+			values := make([]any, len(columns))
+			pointers := make([]any, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				rows.Close()
+				return err
+			}
+			row := make(map[string]any, len(columns))
+			for i, c := range columns {
+				if b, ok := values[i].([]byte); ok && utf8.Valid(b) {
+					row[c] = string(b)
+				} else {
+					row[c] = values[i]
+				}
+			}
+			result = append(result, row)
+		}
+		rows.Close()
+		out[table] = result
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+	return export_write_json(dst, out)
+}
+
+// erasure_holders returns the entities known to hold copies of a user's
+// data: their broadcast subscribers, and their activity and presence
+// audiences
+func erasure_holders(u *User, own []string) []string {
+	mine := map[string]bool{}
+	for _, id := range own {
+		mine[id] = true
+	}
+	seen := map[string]bool{}
+	var holders []string
+	add := func(rows []map[string]any, column string) {
+		for _, r := range rows {
+			id, _ := r[column].(string)
+			if valid(id, "entity") && !mine[id] && !seen[id] {
+				seen[id] = true
+				holders = append(holders, id)
+			}
+		}
+	}
+
+	root := filepath.Join(data_dir, "users", u.UID)
+	entries, _ := os.ReadDir(root)
+	for _, e := range entries {
+		if e.IsDir() && file_exists(filepath.Join(root, e.Name(), "app.db")) {
+			rows, _ := db_open(fmt.Sprintf("users/%s/%s/app.db", u.UID, e.Name())).rows("select distinct subscriber from acknowledged")
+			add(rows, "subscriber")
+		}
+	}
+	if file_exists(filepath.Join(root, "activity.db")) {
+		rows, _ := activity_db(u).rows("select entity from audience")
+		add(rows, "entity")
+	}
+	if file_exists(filepath.Join(root, "user.db")) {
+		rows, _ := db_user(u, "user").rows("select entity from presence_audience")
+		add(rows, "entity")
+	}
+	return holders
+}
+
+// erasure_notify sends an erasure request from each of a user's entities
+// to every entity holding their data, and waits briefly for the requests
+// to leave, as they must be signed by entities about to be deleted.
+// Returns the number of holders.
+func erasure_notify(u *User) int {
+	own := user_entities(u.UID)
+	holders := erasure_holders(u, own)
+	if len(holders) == 0 {
+		return 0
+	}
+	for _, from := range own {
+		for _, to := range holders {
+			peers := entity_peers_for(from, to)
+			if len(peers) == 0 {
+				peers = []string{""}
+			}
+			for _, peer := range peers {
+				message(from, to, "erasure", "request").set("entity", from).send_peer(peer)
+			}
+		}
+	}
+	for _, from := range own {
+		queue_drain_entity(from, 2*time.Second)
+	}
+	return len(holders)
+}
+
+// erasure_verify returns what is left of a deleted user and their entities
+func erasure_verify(uid string, entities []string) []string {
+	var left []string
+	udb := db_open("db/users.db")
+	if exists, _ := udb.exists("select 1 from users where uid=?", uid); exists {
+		left = append(left, "account")
+	}
+	if exists, _ := db_open("db/sessions.db").exists("select 1 from sessions where user=?", uid); exists {
+		left = append(left, "sessions")
+	}
+	if file_exists(filepath.Join(data_dir, "users", uid)) {
+		left = append(left, "files")
+	}
+	queue := db_open("db/queue.db")
+	for _, id := range entities {
+		if exists, _ := udb.exists("select 1 from entities where id=?", id); exists {
+			left = append(left, "entity "+id)
+		}
+		if exists, _ := queue.exists("select 1 from queue where from_entity=? or to_entity=?", id, id); exists {
+			left = append(left, "messages of "+id)
+		}
+	}
+	return left
+}
+
+// erasure_complete records the outcome of a user's pending erasure
+// requests once their account has been deleted
+func erasure_complete(uid string, entities []string, holders int) {
+	if !file_exists(filepath.Join(data_dir, "db", "compliance.db")) {
+		return
+	}
+	db := compliance_db()
+	if exists, _ := db.exists("select 1 from requests where user=? and type='erasure' and status='pending'", uid); !exists {
+		return
+	}
+	status, detail := "fulfilled", fmt.Sprintf("erased, %d holders notified", holders)
+	if left := erasure_verify(uid, entities); len(left) > 0 {
+		status, detail = "failed", "left: "+strings.Join(left, ", ")
+		warn("Erasure of user %q incomplete: %s", uid, detail)
+	}
+	db.exec("update requests set status=?, fulfilled=?, detail=? where user=? and type='erasure' and status='pending'", status, now(), detail, uid)
+}
+
+// erasure_request_event deletes a user's copies of an erased entity's data:
+// what core holds, and what each app with an erasure function does
+func erasure_request_event(e *Event) {
+	if e.user == nil || !valid(e.from, "entity") {
+		return
+	}
+	root := filepath.Join(data_dir, "users", e.user.UID)
+	if file_exists(filepath.Join(root, "activity.db")) {
+		db := activity_db(e.user)
+		db.exec("delete from remote where entity=?", e.from)
+		db.exec("delete from audience where entity=?", e.from)
+	}
+	db_user(e.user, "user").exec("delete from presence_audience where entity=?", e.from)
+
+	apps_lock.Lock()
+	list := make([]*App, 0, len(apps))
+	for _, a := range apps {
+		list = append(list, a)
+	}
+	apps_lock.Unlock()
+	for _, a := range list {
+		if !file_exists(filepath.Join(root, a.id)) {
+			continue
+		}
+		av := a.active(e.user)
+		if av == nil || av.Erasure.Function == "" || !av.scripted() {
+			continue
+		}
+		s := av.starlark()
+		s.set("app", a)
+		s.set("user", e.user)
+		s.set("owner", e.user)
+		if _, err := s.call(av.Erasure.Function, sl.Tuple{sl.String(e.from)}); err != nil {
+			warn("Erasure function %q in app %q failed: %v", av.Erasure.Function, a.id, err)
+		}
+	}
+	debug("Erasure request from %q applied for user %q", e.from, e.user.UID)
+}
+
+// mochi.compliance.access() -> string: Build an export of everything the
+// server holds about the current user, in JSON, and return its path in the
+// calling app's files for it to send on. Requires user/export.
+func api_compliance_access(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	if err := require_permission(t, fn, "user/export"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	host, ip := "", ""
+	if action, ok := t.Local("action").(*Action); ok && action.web != nil {
+		host = action.web.Request.Host
+		ip = rate_limit_client_ip(action.web)
+	}
+	path, err := compliance_access(user.UID, app.id, host)
+	if err != nil {
+		compliance_request(user, "access", "failed", err.Error())
+		return sl_error(fn, "%v", err)
+	}
+	compliance_request(user, "access", "fulfilled", filepath.Base(path))
+	audit_subject_access(user.Username, ip)
+	return sl.String(path), nil
+}
+
+// mochi.compliance.erase() -> int: Ask for the current user's account and
+// data to be erased. The account is closed as by mochi.user.close(), and
+// erased, with the holders of copies asked to delete them, when the grace
+// period ends. Returns the Unix time it will be erased.
+func api_compliance_erase(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	if user.administrator() {
+		return sl_error(fn, "administrators cannot close their own account")
+	}
+
+	ip, language := "", ""
+	if action, ok := t.Local("action").(*Action); ok && action.web != nil {
+		ip = rate_limit_client_ip(action.web)
+		language = request_language(action.web, user)
+	}
+	purge, err := user_close(user, language)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	compliance_request(user, "erasure", "pending", "")
+	audit_erasure_requested(user.Username, ip, purge)
+	return sl.MakeInt64(purge), nil
+}
+
+// mochi.compliance.list(all?, type?) -> list: The current user's requests,
+// newest first, or with all every user's (admin only), optionally of one
+// type, "access" or "erasure". Each is a dict of id, user, username, type,
+// status ("pending", "fulfilled", "failed" or "cancelled"), requested,
+// fulfilled and detail.
+func api_compliance_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var all bool
+	var kind string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "all?", &all, "type?", &kind); err != nil {
+		return nil, err
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	if all && !user.administrator() {
+		return sl_error(fn, "not administrator")
+	}
+	if kind != "" && kind != "access" && kind != "erasure" {
+		return sl_error(fn, "invalid type")
+	}
+
+	query := "select id, user, username, type, status, requested, fulfilled, detail from requests where 1=1"
+	var values []any
+	if !all {
+		query += " and user=?"
+		values = append(values, user.UID)
+	}
+	if kind != "" {
+		query += " and type=?"
+		values = append(values, kind)
+	}
+	rows, err := compliance_db().rows(query+" order by requested desc limit 1000", values...)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
@@ -0,0 +1,111 @@
+// Mochi server: Data subject request tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComplianceAccess(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	u, _ := lifecycle_test_user(t, "member@example.com")
+	db := db_open("users/" + u.UID + "/notes/db/notes.db")
+	db.exec("create table notes (id text primary key, body text not null)")
+	db.exec("insert into notes (id, body) values ('1', 'Shopping')")
+	os.MkdirAll(filepath.Join(data_dir, "users", u.UID, "notes", "files"), 0o700)
+	os.WriteFile(filepath.Join(data_dir, "users", u.UID, "notes", "files", "photo.jpg"), []byte("hello"), 0o600)
+
+	path, err := compliance_access(u.UID, "settings", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.OpenReader(filepath.Join(data_dir, "users", u.UID, "settings", "files", filepath.FromSlash(path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+
+	files := map[string]*zip.File{}
+	for _, f := range z.File {
+		files[f.Name[strings.Index(f.Name, "/")+1:]] = f
+	}
+	for _, name := range []string{"manifest.json", "account.json", "data/notes/files/photo.jpg"} {
+		if files[name] == nil {
+			t.Errorf("export has no %s", name)
+		}
+	}
+	if files["keys.age"] != nil || files["secrets.age"] != nil {
+		t.Error("export carries keys")
+	}
+	f := files["data/notes/db/notes.json"]
+	if f == nil {
+		t.Fatal("database not rendered as JSON")
+	}
+	r, _ := f.Open()
+	data, _ := io.ReadAll(r)
+	r.Close()
+	var tables map[string][]map[string]any
+	if err := json.Unmarshal(data, &tables); err != nil || len(tables["notes"]) != 1 || tables["notes"][0]["body"] != "Shopping" {
+		t.Errorf("rendered database %s", data)
+	}
+}
+
+func TestComplianceErasure(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	u, e := lifecycle_test_user(t, "leaving@example.com")
+	compliance_request(u, "erasure", "pending", "")
+	user_delete(u.UID)
+
+	r, _ := compliance_db().row("select status, fulfilled, detail from requests where user=?", u.UID)
+	if r == nil || r["status"] != "fulfilled" || event_int64(r["fulfilled"]) == 0 {
+		t.Fatalf("erasure request %v, want fulfilled", r)
+	}
+	if left := erasure_verify(u.UID, []string{e.ID}); len(left) != 0 {
+		t.Errorf("left after erasure: %v", left)
+	}
+
+	// Reactivation cancels a pending request
+	v, _ := lifecycle_test_user(t, "staying@example.com")
+	compliance_request(v, "erasure", "pending", "")
+	user_reactivate(v.UID)
+	if r, _ := compliance_db().row("select status from requests where user=?", v.UID); r == nil || r["status"] != "cancelled" {
+		t.Errorf("erasure request after reactivation %v, want cancelled", r)
+	}
+}
+
+func TestErasureHolders(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	u, e := lifecycle_test_user(t, "leaving@example.com")
+	other, holder := lifecycle_test_user(t, "holder@example.com")
+	activity_db(u).exec("insert into audience (entity, created) values (?, ?), (?, ?)", holder.ID, now(), e.ID, now())
+	holders := erasure_holders(u, []string{e.ID})
+	if len(holders) != 1 || holders[0] != holder.ID {
+		t.Fatalf("holders %v, want only %q", holders, holder.ID)
+	}
+
+	// The holder deletes what it has from the erased entity
+	activity_db(other).exec("insert into remote (entity, id, app, verb, created, received) values (?, ?, 'notes', 'posted', ?, ?)", e.ID, uid(), now(), now())
+	erasure_request_event(&Event{user: other, from: e.ID, to: holder.ID, service: "erasure", event: "request"})
+	if n := activity_db(other).integer("select count(*) from remote where entity=?", e.ID); n != 0 {
+		t.Errorf("%d activity items from the erased entity kept", n)
+	}
+}
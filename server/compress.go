@@ -172,6 +172,11 @@ func compressible(ct string) bool {
 	if i := strings.Index(ct, ";"); i >= 0 {
 		ct = strings.TrimSpace(ct[:i])
 	}
+	// Event streams are written an event at a time, and an encoder would
+	// hold each back until it had gathered enough to compress
+	if ct == "text/event-stream" {
+		return false
+	}
 	if strings.HasPrefix(ct, "text/") {
 		return true
 	}
@@ -0,0 +1,274 @@
+// Mochi server: Cross-origin access to app actions
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+// Every response allows any origin to read it without credentials, which
+// sandboxed app iframes, having an opaque origin, need. A frontend hosted
+// elsewhere, such as a single page app on its own domain, needs more: its
+// requests to carry the user's cookies, and methods and headers of its own.
+//
+// An app declares such frontends with "cors" in app.json:
+//
+//	"cors": {"origins": ["https://app.example.com"], "methods": ["GET", "POST", "DELETE"],
+//	         "headers": ["X-Request-Id"], "credentials": true, "age": 600}
+//
+// As each origin lets pages on another site act as the user, none is
+// allowed until an administrator approves it. The administrators are
+// notified when a loaded app version declares an origin not yet decided,
+// and approve or decline it in the Settings app. For an allowed origin,
+// the app's actions answer preflight requests themselves, and their
+// responses name the origin rather than "*".
+
+// AppCors is an app's cross-origin policy
+type AppCors struct {
+	Origins     []string `json:"origins"`
+	Methods     []string `json:"methods,omitempty"`     // Default GET, HEAD and POST
+	Headers     []string `json:"headers,omitempty"`     // Beyond Authorization, Content-Type and Accept
+	Credentials bool     `json:"credentials,omitempty"` // Whether requests may carry cookies
+	Age         int      `json:"age,omitempty"`         // Seconds a preflight may be cached
+}
+
+const cors_age_maximum = 86400
+
+var (
+	cors_methods_default = []string{"GET", "HEAD", "POST"}
+	cors_methods_valid   = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	cors_headers_default = []string{"Authorization", "Content-Type", "Accept"}
+	cors_header_re       = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]{0,63}$`)
+
+	// Decisions, by app and origin, loaded from apps.db on first use
+	cors_lock     sync.Mutex
+	cors_statuses map[[2]string]string
+)
+
+// cors_origin_valid checks an origin is a scheme and host, as a browser
+// sends it
+func cors_origin_valid(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return false
+	}
+	return u.Scheme+"://"+u.Host == origin && u.User == nil && strings.ToLower(origin) == origin
+}
+
+// cors_validate checks an app's declared policy
+func cors_validate(c *AppCors) error {
+	if len(c.Origins) == 0 {
+		return fmt.Errorf("App cors has no origins")
+	}
+	for _, o := range c.Origins {
+		if !cors_origin_valid(o) {
+			return fmt.Errorf("App bad cors origin %q", o)
+		}
+	}
+	for _, m := range c.Methods {
+		if !slices.Contains(cors_methods_valid, m) {
+			return fmt.Errorf("App bad cors method %q", m)
+		}
+	}
+	for _, h := range c.Headers {
+		if !cors_header_re.MatchString(h) {
+			return fmt.Errorf("App bad cors header %q", h)
+		}
+	}
+	if c.Age < 0 || c.Age > cors_age_maximum {
+		return fmt.Errorf("App bad cors age %d", c.Age)
+	}
+	return nil
+}
+
+// cors_statuses_locked returns the decisions, loading them if need be.
+// Must be called with cors_lock held.
+func cors_statuses_locked() map[[2]string]string {
+	if cors_statuses == nil {
+		cors_statuses = map[[2]string]string{}
+		rows, _ := db_apps().rows("select app, origin, status from cors")
+		for _, r := range rows {
+			app, _ := r["app"].(string)
+			origin, _ := r["origin"].(string)
+			status, _ := r["status"].(string)
+			cors_statuses[[2]string{app, origin}] = status
+		}
+	}
+	return cors_statuses
+}
+
+// cors_status returns whether an app's origin is "pending", "accepted" or
+// "declined", or "" if it has never been declared
+func cors_status(app, origin string) string {
+	cors_lock.Lock()
+	defer cors_lock.Unlock()
+	return cors_statuses_locked()[[2]string{app, origin}]
+}
+
+// cors_accepted returns whether an origin is accepted for any app
+func cors_accepted(origin string) bool {
+	cors_lock.Lock()
+	defer cors_lock.Unlock()
+	for k, status := range cors_statuses_locked() {
+		if k[1] == origin && status == "accepted" {
+			return true
+		}
+	}
+	return false
+}
+
+// cors_request records the origins a loaded app version declares, asking
+// the administrators about any not seen before
+func cors_request(a *App, av *AppVersion) {
+	if av.Cors == nil {
+		return
+	}
+	cors_lock.Lock()
+	statuses := cors_statuses_locked()
+	var added []string
+	for _, o := range av.Cors.Origins {
+		k := [2]string{a.id, o}
+		if statuses[k] == "" {
+			statuses[k] = "pending"
+			added = append(added, o)
+		}
+	}
+	cors_lock.Unlock()
+	if len(added) == 0 {
+		return
+	}
+
+	db := db_apps()
+	for _, o := range added {
+		db.exec("insert or ignore into cors ( app, origin, status, requested ) values ( ?, ?, 'pending', ? )", a.id, o, now())
+	}
+	info("App %q asks to accept requests from %s, waiting for an administrator to approve", a.id, strings.Join(added, ", "))
+	administrators_notify("cors/"+a.id, "/settings/system/cors", "cors.notification", map[string]any{"app": a.id, "origins": strings.Join(added, ", ")})
+}
+
+// cors_decide accepts or declines an origin for an app
+func cors_decide(app, origin string, accept bool) error {
+	if cors_status(app, origin) == "" {
+		return fmt.Errorf("app %q has not asked for origin %q", app, origin)
+	}
+	status := "declined"
+	if accept {
+		status = "accepted"
+	}
+	db_apps().exec("update cors set status=? where app=? and origin=?", status, app, origin)
+	cors_lock.Lock()
+	cors_statuses_locked()[[2]string{app, origin}] = status
+	cors_lock.Unlock()
+	return nil
+}
+
+// web_preflight returns whether a request is a CORS preflight
+func web_preflight(c *gin.Context) bool {
+	return c.Request.Method == "OPTIONS" && c.GetHeader("Origin") != "" && c.GetHeader("Access-Control-Request-Method") != ""
+}
+
+// web_cors applies an app's policy to a request from an origin it
+// declares and an administrator accepted. Returns true if it has answered
+// the request, as it does a preflight.
+func web_cors(c *gin.Context, a *App, av *AppVersion) bool {
+	origin := c.GetHeader("Origin")
+	policy := av.Cors
+	if origin == "" || policy == nil || !slices.Contains(policy.Origins, origin) || cors_status(a.id, origin) != "accepted" {
+		if web_preflight(c) {
+			web_preflight_default(c)
+			return true
+		}
+		return false
+	}
+
+	methods := policy.Methods
+	if len(methods) == 0 {
+		methods = cors_methods_default
+	}
+	preflight := web_preflight(c)
+	method := c.Request.Method
+	if preflight {
+		method = c.GetHeader("Access-Control-Request-Method")
+	}
+	if !slices.Contains(methods, method) {
+		if preflight {
+			c.AbortWithStatus(http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+
+	c.Header("Access-Control-Allow-Origin", origin)
+	c.Writer.Header().Add("Vary", "Origin")
+	if policy.Credentials {
+		c.Header("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		return false
+	}
+	c.Header("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	c.Header("Access-Control-Allow-Headers", strings.Join(append(slices.Clone(cors_headers_default), policy.Headers...), ", "))
+	if policy.Age > 0 {
+		c.Header("Access-Control-Max-Age", strconv.Itoa(policy.Age))
+	}
+	c.AbortWithStatus(http.StatusNoContent)
+	return true
+}
+
+// mochi.server.cors.list() -> list: The origins apps have asked to accept
+// requests from, most recent first. Each is a dict of:
+//
+//	app        string — the app's ID
+//	origin     string — the origin, such as "https://app.example.com"
+//	requested  int    — Unix timestamp the app first asked
+//	status     string — "pending", "accepted" or "declined"
+func api_server_cors_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "settings/write"); err != nil {
+		return nil, err
+	}
+	rows, err := db_apps().rows("select app, origin, requested, status from cors order by requested desc, app, origin")
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.server.cors.accept(app, origin) -> None: Let pages at an origin
+// call an app's actions as the user
+func api_server_cors_accept(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	return api_server_cors_decide(t, fn, args, kwargs, true)
+}
+
+// mochi.server.cors.decline(app, origin) -> None: Refuse, or stop,
+// cross-origin requests to an app from an origin
+func api_server_cors_decline(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	return api_server_cors_decide(t, fn, args, kwargs, false)
+}
+
+func api_server_cors_decide(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple, accept bool) (sl.Value, error) {
+	if err := require_permission(t, fn, "settings/write"); err != nil {
+		return nil, err
+	}
+	var app, origin string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "app", &app, "origin", &origin); err != nil {
+		return nil, err
+	}
+	if err := cors_decide(app, origin, accept); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.None, nil
+}
@@ -0,0 +1,111 @@
+// Mochi server: Cross-origin access tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCorsValidate(t *testing.T) {
+	for _, c := range []AppCors{
+		{},
+		{Origins: []string{"*"}},
+		{Origins: []string{"https://app.example.com/"}},
+		{Origins: []string{"https://App.example.com"}},
+		{Origins: []string{"ftp://app.example.com"}},
+		{Origins: []string{"https://app.example.com"}, Methods: []string{"CONNECT"}},
+		{Origins: []string{"https://app.example.com"}, Headers: []string{"X Bad"}},
+		{Origins: []string{"https://app.example.com"}, Age: cors_age_maximum + 1},
+	} {
+		if err := cors_validate(&c); err == nil {
+			t.Errorf("accepted %+v", c)
+		}
+	}
+	c := AppCors{Origins: []string{"https://app.example.com", "http://localhost:5173"}, Methods: []string{"GET", "DELETE"}, Headers: []string{"X-Request-Id"}, Age: 600}
+	if err := cors_validate(&c); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCors(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	load_core_labels()
+	cors_statuses = nil
+	t.Cleanup(func() { cors_statuses = nil })
+	gin.SetMode(gin.TestMode)
+
+	origin := "https://app.example.com"
+	a := &App{id: "notes"}
+	av := &AppVersion{Version: "1.0", Cors: &AppCors{Origins: []string{origin}, Methods: []string{"GET", "DELETE"}, Credentials: true}}
+	request := func(method, origin, preflight string) (*httptest.ResponseRecorder, bool) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(method, "/notes/list", nil)
+		c.Request.Header.Set("Origin", origin)
+		if preflight != "" {
+			c.Request.Header.Set("Access-Control-Request-Method", preflight)
+		}
+		answered := web_cors(c, a, av)
+		c.Writer.WriteHeaderNow()
+		return w, answered
+	}
+
+	// Not allowed until an administrator approves
+	cors_request(a, av)
+	cors_request(a, av)
+	if s := cors_status("notes", origin); s != "pending" {
+		t.Fatalf("status %q", s)
+	}
+	w, answered := request("OPTIONS", origin, "DELETE")
+	if !answered || w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Credentials") != "" || w.Header().Get("Access-Control-Allow-Origin") == origin {
+		t.Errorf("pending preflight: %d %v", w.Code, w.Header())
+	}
+
+	if err := cors_decide("notes", origin, true); err != nil {
+		t.Fatal(err)
+	}
+	w, answered = request("OPTIONS", origin, "DELETE")
+	if !answered || w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != origin || w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Allow-Methods") != "GET, DELETE" {
+		t.Errorf("accepted preflight: %d %v", w.Code, w.Header())
+	}
+	if w, answered = request("OPTIONS", origin, "PUT"); !answered || w.Code != http.StatusForbidden {
+		t.Errorf("undeclared method: %d", w.Code)
+	}
+	if w, answered = request("GET", origin, ""); answered || w.Header().Get("Access-Control-Allow-Origin") != origin || w.Header().Get("Vary") != "Origin" {
+		t.Errorf("request: %v %v", answered, w.Header())
+	}
+	if w, _ = request("GET", "https://other.example.com", ""); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin: %v", w.Header())
+	}
+
+	// The preflight reaches the app rather than being answered for any origin
+	w = httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("OPTIONS", "/notes/list", nil)
+	c.Request.Header.Set("Origin", origin)
+	c.Request.Header.Set("Access-Control-Request-Method", "DELETE")
+	web_security_headers(c)
+	if c.IsAborted() {
+		t.Error("preflight from an accepted origin answered by the middleware")
+	}
+
+	if err := cors_decide("notes", origin, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, answered = request("GET", origin, ""); answered || cors_accepted(origin) {
+		t.Error("declined origin still accepted")
+	}
+	if err := cors_decide("notes", "https://never.example.com", true); err == nil {
+		t.Error("undeclared origin accepted")
+	}
+}
@@ -0,0 +1,252 @@
+// Mochi server: Cross-site request forgery tokens
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"html"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+// A form an app renders carries a token from mochi.form.csrf(), or {{csrf}}
+// in a template, in a field named "csrf" or the X-CSRF-Token header. A token
+// is an expiry and a signature over it, the app, and the session it was made
+// for, so a page on another site can neither read one nor make one that
+// holds for the user's session. Requests authenticated by token rather than
+// by session cookie carry no ambient credentials, so their tokens are bound
+// to the user instead.
+//
+// Core checks the token before running any action other than GET, HEAD or
+// OPTIONS that relies on the session cookie, and refuses the request
+// without one. Requests with a bearer or API token send no credentials a
+// forged form could, and nor do those the browser marks as coming from the
+// same origin, so neither needs one. An action that's called only with
+// tokens, such as a webhook, may opt out with "csrf": false in app.json.
+//
+// The check runs before a multipart body is parsed, so a forged upload is
+// refused without being read. Such a form's token field is looked for only
+// ahead of its files, in the first csrf_multipart_peek bytes of the body.
+
+const (
+	csrf_field    = "csrf"
+	csrf_header   = "X-CSRF-Token"
+	csrf_lifetime = 86400 // Seconds a token lasts
+
+	csrf_multipart_peek = 64 << 10 // Bytes of a multipart body searched for its token
+)
+
+var (
+	csrf_secret_lock  sync.Mutex
+	csrf_secret_value string
+)
+
+// csrf_secret returns the key tokens are signed with, creating it on first
+// use. It's kept in memory, as pages rendering forms need it.
+func csrf_secret() string {
+	csrf_secret_lock.Lock()
+	defer csrf_secret_lock.Unlock()
+	if csrf_secret_value == "" {
+		csrf_secret_value = setting_get("csrf_secret", "")
+		if csrf_secret_value == "" {
+			csrf_secret_value = random_alphanumeric(32)
+			setting_set("csrf_secret", csrf_secret_value)
+		}
+	}
+	return csrf_secret_value
+}
+
+// csrf_signature returns the signature for a token's fields
+func csrf_signature(binding, app string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(csrf_secret()))
+	mac.Write([]byte("csrf\n" + binding + "\n" + app + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrf_token creates a token for forms of an app in a session
+func csrf_token(binding, app string) string {
+	expires := now() + csrf_lifetime
+	return strconv.FormatInt(expires, 10) + "." + csrf_signature(binding, app, expires)
+}
+
+// csrf_valid reports whether a token was made for an app in a session and
+// hasn't expired
+func csrf_valid(token, binding, app string) bool {
+	e, signature, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+	expires, err := strconv.ParseInt(e, 10, 64)
+	if err != nil || now() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(csrf_signature(binding, app, expires)))
+}
+
+// csrf_binding returns what an action's tokens are bound to: its session,
+// or its user if it has no session cookie
+func csrf_binding(a *Action) string {
+	if a.web != nil {
+		if session := web_cookie_get(a.web, "session", ""); session != "" {
+			return "session:" + session
+		}
+	}
+	if a.user != nil {
+		return "user:" + a.user.UID
+	}
+	return ""
+}
+
+// csrf_submitted returns the token sent with an action's request
+func csrf_submitted(a *Action) string {
+	if a.web == nil {
+		return a.inputs[csrf_field]
+	}
+	if token := a.web.GetHeader(csrf_header); token != "" {
+		return token
+	}
+	if a.web.Request.MultipartForm == nil && strings.HasPrefix(a.web.GetHeader("Content-Type"), "multipart/form-data") {
+		if token := a.web.Query(csrf_field); token != "" {
+			return token
+		}
+		return csrf_multipart(a.web)
+	}
+	return a.input(csrf_field)
+}
+
+// csrf_multipart returns the token field of an unparsed multipart body,
+// reading only its start and putting that back for the body to be read in
+// full later
+func csrf_multipart(c *gin.Context) string {
+	_, params, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if err != nil || params["boundary"] == "" || c.Request.Body == nil {
+		return ""
+	}
+	head := make([]byte, csrf_multipart_peek)
+	n, _ := io.ReadFull(c.Request.Body, head)
+	head = head[:n]
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), c.Request.Body), c.Request.Body}
+
+	r := multipart.NewReader(bytes.NewReader(head), params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil || p.FileName() != "" {
+			return ""
+		}
+		if p.FormName() == csrf_field {
+			value, err := io.ReadAll(io.LimitReader(p, 256))
+			if err != nil {
+				return ""
+			}
+			return string(value)
+		}
+	}
+}
+
+// csrf_exempt reports whether a request to an action needs no token, as it
+// doesn't rely on the session cookie or only reads
+func csrf_exempt(c *gin.Context, aa *AppAction, bearer bool) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if aa.Csrf != nil && !*aa.Csrf {
+		return true
+	}
+	if bearer || web_cookie_get(c, "session", "") == "" {
+		return true
+	}
+	return c.GetHeader("Sec-Fetch-Site") == "same-origin"
+}
+
+// csrf_check refuses an action's request if it needs a token and hasn't a
+// valid one, returning whether it has
+func csrf_check(a *Action, aa *AppAction, bearer bool) bool {
+	if csrf_exempt(a.web, aa, bearer) {
+		return false
+	}
+	if token := csrf_submitted(a); token != "" && csrf_valid(token, csrf_binding(a), a.app.id) {
+		return false
+	}
+	debug("403 CSRF token missing or invalid: app=%s action=%s method=%s", a.app.id, aa.name, a.web.Request.Method)
+	csrf_refuse(a.web)
+	return true
+}
+
+// csrf_refuse says a request was refused for its token: a page for
+// browsers, and a JSON error for everything else
+func csrf_refuse(c *gin.Context) {
+	accept := c.GetHeader("Accept")
+	if !strings.Contains(accept, "text/html") || strings.Contains(accept, "application/json") {
+		respond_error(c, http.StatusForbidden, "csrf_invalid", "errors.csrf_invalid", nil)
+		return
+	}
+	lang := request_language(c, nil)
+	heading := html.EscapeString(resolve_core_label(lang, "csrf.heading", nil))
+	body := html.EscapeString(resolve_core_label(lang, "csrf.body", nil))
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusForbidden, "text/html; charset=utf-8", []byte("<!doctype html><meta charset=utf-8><meta name=viewport content=\"width=device-width, initial-scale=1\"><title>"+heading+"</title><h1>"+heading+"</h1><p>"+body+"</p>"))
+	c.Abort()
+}
+
+// csrf_template_functions gives an action's templates {{csrf}}, the hidden
+// field holding a token, and {{csrf_token}}, the token alone
+func csrf_template_functions(a *Action) template.FuncMap {
+	token := func() string { return csrf_token(csrf_binding(a), a.app.id) }
+	return template.FuncMap{
+		"csrf": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrf_field + `" value="` + html.EscapeString(token()) + `">`)
+		},
+		"csrf_token": token,
+	}
+}
+
+// mochi.form.csrf() -> string: A token for the forms of the calling app, to send
+// back in a field named "csrf" or the X-CSRF-Token header.
+func api_form_csrf(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 0 || len(kwargs) != 0 {
+		return sl_error(fn, "syntax: no arguments")
+	}
+	a, _ := t.Local("action").(*Action)
+	if a == nil || a.app == nil {
+		return sl_error(fn, "called outside an action")
+	}
+	return sl.String(csrf_token(csrf_binding(a), a.app.id)), nil
+}
+
+// mochi.form.verify(token?) -> bool: Whether a token, by default the one the
+// action's request was sent with, was made by mochi.form.csrf() for this app and
+// session and hasn't expired.
+func api_form_verify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var token string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "token?", &token); err != nil {
+		return nil, err
+	}
+	a, _ := t.Local("action").(*Action)
+	if a == nil || a.app == nil {
+		return sl_error(fn, "called outside an action")
+	}
+	if token == "" {
+		token = csrf_submitted(a)
+	}
+	return sl.Bool(token != "" && csrf_valid(token, csrf_binding(a), a.app.id)), nil
+}
@@ -0,0 +1,128 @@
+// Mochi server: CSRF protection tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCSRFCheck(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_open("db/settings.db").exec("create table if not exists settings (name text primary key, value text not null)")
+
+	app := &App{id: "csrftest"}
+	user := &User{UID: "u1"}
+	token := csrf_token("session:s1", app.id)
+	off := false
+
+	request := func(method, session, accept string, form url.Values, headers map[string]string) (*Action, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(method, "/csrftest/save", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		c.Request.Header.Set("Accept", accept)
+		for k, v := range headers {
+			c.Request.Header.Set(k, v)
+		}
+		if session != "" {
+			c.Request.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		return &Action{web: c, app: app, user: user, inputs: map[string]string{}}, w
+	}
+
+	for _, c := range []struct {
+		name    string
+		method  string
+		session string
+		form    url.Values
+		headers map[string]string
+		action  AppAction
+		bearer  bool
+		refused bool
+	}{
+		{"post without a token", "POST", "s1", nil, nil, AppAction{}, false, true},
+		{"post with a token", "POST", "s1", url.Values{"csrf": {token}}, nil, AppAction{}, false, false},
+		{"token in the header", "DELETE", "s1", nil, map[string]string{"X-CSRF-Token": token}, AppAction{}, false, false},
+		{"another session's token", "POST", "s2", url.Values{"csrf": {token}}, nil, AppAction{}, false, true},
+		{"cross-site", "POST", "s1", nil, map[string]string{"Sec-Fetch-Site": "cross-site"}, AppAction{}, false, true},
+		{"same origin", "POST", "s1", nil, map[string]string{"Sec-Fetch-Site": "same-origin"}, AppAction{}, false, false},
+		{"get", "GET", "s1", nil, nil, AppAction{}, false, false},
+		{"no session", "POST", "", nil, nil, AppAction{}, false, false},
+		{"bearer", "POST", "s1", nil, nil, AppAction{}, true, false},
+		{"opted out", "POST", "s1", nil, nil, AppAction{Csrf: &off}, false, false},
+	} {
+		a, w := request(c.method, c.session, "application/json", c.form, c.headers)
+		if refused := csrf_check(a, &c.action, c.bearer); refused != c.refused {
+			t.Errorf("%s: refused %v", c.name, refused)
+		}
+		if c.refused && (w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "csrf_invalid")) {
+			t.Errorf("%s: %d %s", c.name, w.Code, w.Body.String())
+		}
+	}
+
+	a, w := request("POST", "s1", "text/html", nil, nil)
+	csrf_check(a, &AppAction{}, false)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "<h1>") {
+		t.Errorf("page %d %q", w.Code, w.Body.String())
+	}
+
+	// A multipart form's token is found ahead of its files without parsing
+	// the body, which is left whole for the action
+	multipart_request := func(fields ...string) (*Action, *httptest.ResponseRecorder) {
+		var body bytes.Buffer
+		m := multipart.NewWriter(&body)
+		for _, f := range fields {
+			if f == "file" {
+				w, _ := m.CreateFormFile("file", "big.bin")
+				w.Write(bytes.Repeat([]byte("x"), 2*csrf_multipart_peek))
+			} else {
+				m.WriteField(f, token)
+			}
+		}
+		m.Close()
+		a, w := request("POST", "s1", "application/json", nil, nil)
+		a.web.Request = httptest.NewRequest("POST", "/csrftest/save", &body)
+		a.web.Request.Header.Set("Content-Type", m.FormDataContentType())
+		a.web.Request.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+		return a, w
+	}
+	a, _ = multipart_request("csrf", "file")
+	if csrf_check(a, &AppAction{}, false) {
+		t.Error("multipart token before the file refused")
+	}
+	if a.web.Request.MultipartForm != nil {
+		t.Error("multipart body parsed by the check")
+	}
+	if f, _, err := a.web.Request.FormFile("file"); err != nil {
+		t.Errorf("body not left whole: %v", err)
+	} else if data, _ := io.ReadAll(f); len(data) != 2*csrf_multipart_peek {
+		t.Errorf("file read back as %d bytes", len(data))
+	}
+	a, _ = multipart_request("file", "csrf")
+	if !csrf_check(a, &AppAction{}, false) {
+		t.Error("multipart token after the file accepted")
+	}
+
+	// The template field holds a token the check accepts
+	a, _ = request("GET", "s1", "text/html", nil, nil)
+	field := string(csrf_template_functions(a)["csrf"].(func() template.HTML)())
+	value := strings.TrimSuffix(field[strings.Index(field, `value="`)+7:], `">`)
+	if !strings.HasPrefix(field, `<input type="hidden" name="csrf"`) || !csrf_valid(value, "session:s1", app.id) {
+		t.Errorf("field %q", field)
+	}
+}
@@ -84,7 +84,7 @@ const (
 )
 
 const (
-	schema_version = 2
+	schema_version = 15
 )
 
 var (
@@ -236,15 +236,27 @@ func db_create() {
 	users.exec("create table if not exists users (uid text not null primary key, username text not null, role text not null default 'user', methods text not null default '', disabled text not null default '', status text not null default 'active', restore_source text not null default '', restore_passkeys integer not null default 0, purge integer not null default 0)")
 	users.exec("create unique index if not exists users_username on users (username)")
 
+	// Guests: users with no login factor, deleted after guest_lifetime
+	users.exec("create table if not exists guests (user text primary key references users(uid) on delete cascade, created integer not null)")
+
 	// Services the user must re-link after a server move (restore). Populated
 	// at restore time from the bundle's linked.json; rows clear as the user
 	// re-links each on the destination. Drives the post-restore banner.
 	users.exec("create table if not exists relinks (user text not null references users(uid) on delete cascade, service text not null, identifier text not null default '', linked integer not null default 0, primary key (user, service))")
 
+	// When each user's email address was last verified, and any change of
+	// address waiting for the new one to be verified
+	users.exec("create table if not exists emails (user text primary key references users(uid) on delete cascade, verified integer not null default 0, pending text not null default '', requested integer not null default 0)")
+
+	// Devices and network regions each user has signed in from, and users
+	// asked to review how they sign in after a sign in wasn't them
+	users.exec("create table if not exists fingerprints (user text not null references users(uid) on delete cascade, device text not null, region text not null, first integer not null, last integer not null, primary key (user, device, region))")
+	users.exec("create table if not exists reviews (user text primary key references users(uid) on delete cascade, reason text not null, created integer not null)")
+
 	// Passkey credential definitions and sign count. Sign count is WebAuthn
 	// replay-prevention state and lives here so it survives sessions.db
 	// corruption. Only the cosmetic last-used timestamp lives in sessions.db.
-	users.exec("create table if not exists credentials (id blob primary key, user text not null references users(uid) on delete cascade, public_key blob not null, sign_count integer not null default 0, name text not null default '', transports text not null default '', backup_eligible integer not null default 0, backup_state integer not null default 0, created integer not null)")
+	users.exec("create table if not exists credentials (id blob primary key, user text not null references users(uid) on delete cascade, public_key blob not null, sign_count integer not null default 0, name text not null default '', transports text not null default '', backup_eligible integer not null default 0, backup_state integer not null default 0, aaguid text not null default '', attestation text not null default '', verified integer not null default 0, revoked integer not null default 0, created integer not null)")
 	users.exec("create index if not exists credentials_user on credentials(user)")
 
 	// Recovery codes
@@ -275,6 +287,7 @@ func db_create() {
 	users.exec("create index if not exists entities_class on entities(class)")
 	users.exec("create index if not exists entities_name on entities(name)")
 	users.exec("create index if not exists entities_privacy on entities(privacy)")
+	users.exec("create table if not exists keys (entity text not null primary key references entities(id) on delete cascade, created integer not null)")
 	users.exec("create index if not exists entities_published on entities(published)")
 
 	// Sessions (login codes and sessions - transient auth data)
@@ -297,9 +310,24 @@ func db_create() {
 	// Step-up re-authentication proofs: short-lived single-use tokens
 	// earned by re-verifying the user's login factor(s) before a
 	// sensitive action. methods is the accrued set of factors verified.
-	sessions.exec("create table if not exists reauthentication (id text primary key, user text not null, methods text not null default '', expires integer not null)")
+	sessions.exec("create table if not exists reauthentication (id text primary key, user text not null, app text not null default '', purpose text not null default '', methods text not null default '', expires integer not null)")
 	sessions.exec("create index if not exists reauthentication_expires on reauthentication(expires)")
 
+	// Pairings of a phone with a signed in device, and the phones linked
+	// as trusted devices by them
+	sessions.exec("create table if not exists pairings (code text primary key, user text not null, trusted integer not null default 0, name text not null default '', status text not null, claim text not null default '', phrase text not null default '', address text not null default '', agent text not null default '', expires integer not null)")
+	sessions.exec("create index if not exists pairings_claim on pairings(claim)")
+	sessions.exec("create index if not exists pairings_expires on pairings(expires)")
+	sessions.exec("create table if not exists devices (session text primary key, user text not null, name text not null, linked integer not null)")
+	sessions.exec("create index if not exists devices_user on devices(user)")
+
+	// Sessions opened by administrators acting as other users
+	sessions.exec("create table if not exists impersonations (session text primary key, user text not null, administrator text not null, origin text not null default '', reason text not null, address text not null default '', created integer not null, expires integer not null, ended integer not null default 0)")
+
+	// Alerts raised by sign ins from new devices or network regions
+	sessions.exec("create table if not exists alerts (id text primary key, user text not null, session text not null, device text not null, region text not null, address text not null default '', agent text not null default '', reason text not null, created integer not null, denied integer not null default 0)")
+	sessions.exec("create index if not exists alerts_user on alerts(user)")
+
 	// Last-login timestamps (kept here, not in users.db, so the cold reference
 	// store doesn't take a write on every login)
 	sessions.exec("create table if not exists logins (user text primary key, last integer not null)")
@@ -346,11 +374,13 @@ func db_create() {
 	peers.exec("create table if not exists names ( id text not null, name text not null, updated integer not null, primary key ( id, name ) )")
 	// Latest signed peer record per peer: self-certifying addresses
 	peers.exec("create table if not exists records ( id text not null primary key, record blob not null, sequence integer not null, updated integer not null )")
+	// Servers found on the local network, and whether they're accepted
+	peers.exec("create table if not exists nearby ( id text not null primary key, addresses text not null default '', found integer not null, status text not null )")
 
 	// Message queue with reliability tracking
 	queue := db_open("db/queue.db")
 	// Outgoing message queue
-	queue.exec("create table if not exists queue ( id text primary key, type text not null default 'direct', target text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', content blob not null default '', data blob not null default '', file text not null default '', expires integer not null default 0, status text not null default 'pending', attempts integer not null default 0, next_retry integer not null, last_error text not null default '', created integer not null, priority integer not null default 20 )")
+	queue.exec("create table if not exists queue ( id text primary key, type text not null default 'direct', target text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', content blob not null default '', data blob not null default '', file text not null default '', expires integer not null default 0, status text not null default 'pending', attempts integer not null default 0, next_retry integer not null, last_error text not null default '', created integer not null, priority integer not null default 20, key text not null default '' )")
 	// (status, priority, next_retry) covers BOTH queue_select queries
 	// (main priority-desc + bulk-floor priority-range). Without the
 	// priority column, the main query's ORDER BY priority forces a
@@ -373,6 +403,15 @@ func db_create() {
 	// and after queue_evict_age the owning apps are told to drop the
 	// subscriber (see health_gate in queue.go).
 	queue.exec("create table if not exists health ( recipient text not null primary key, failures integer not null default 0, denials integer not null default 0, success integer not null default 0, since integer not null default 0, suspended integer not null default 0, probed integer not null default 0 )")
+	// Delivery and read acknowledgements (event_ack.go): acks the apps on
+	// this server are waiting for, and receipts owed to remote senders
+	// once a message is read
+	queue.exec("create table if not exists acks ( id text not null primary key, user text not null, app text not null, from_entity text not null, to_entity text not null, service text not null, want text not null, delivered integer not null default 0, created integer not null )")
+	queue.exec("create table if not exists receipts ( id text not null, user text not null, app text not null, from_entity text not null, to_entity text not null, service text not null, created integer not null, primary key ( user, id ) )")
+	// Dead letters: direct messages the queue gave up on, kept for an
+	// operator to inspect and requeue (queue_dead.go)
+	queue.exec("create table if not exists dead ( id text primary key, target text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', content blob not null default '', data blob not null default '', file text not null default '', expires integer not null default 0, attempts integer not null default 0, last_error text not null default '', reason text not null default '', priority integer not null default 20, created integer not null, died integer not null, key text not null default '' )")
+	queue.exec("create index if not exists dead_died on dead (died)")
 
 	// Domains
 	domains := db_open("db/domains.db")
@@ -394,6 +433,7 @@ func db_create() {
 	apps.exec("create table if not exists versions (app text not null primary key, version text, track text)")
 	apps.exec("create table if not exists tracks (app text not null, track text not null, version text not null, primary key (app, track))")
 	apps.exec("create table if not exists apps (app text not null primary key, installed integer not null)")
+	apps.exec("create table if not exists cors (app text not null, origin text not null, status text not null, requested integer not null, primary key (app, origin))")
 
 	// Scheduled events
 	schedule := db_open("db/schedule.db")
@@ -406,6 +446,19 @@ func db_create() {
 	external.exec("create table if not exists qids (qid text not null, lang text not null, label text not null, fetched integer not null, primary key (qid, lang))")
 	external.exec("create table if not exists qid_searches (query text not null, lang text not null, results text not null, fetched integer not null, primary key (query, lang))")
 
+	// Idempotency keys, and the log of events received by apps for replay
+	events := db_open("db/events.db")
+	events.exec("create table if not exists keys ( from_entity text not null, to_entity text not null, service text not null, key text not null, received integer not null, primary key ( from_entity, to_entity, service, key ) )")
+	events.exec("create index if not exists keys_received on keys ( received )")
+	events.exec("create table if not exists log ( sequence integer primary key autoincrement, id text not null, user text not null, app text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', peer text not null default '', key text not null default '', content blob not null default '', data blob not null default '', result text not null default '', received integer not null )")
+	events.exec("create index if not exists log_app_user on log ( app, user, sequence )")
+	events.exec("create index if not exists log_received on log ( received )")
+	events.exec("create table if not exists cursors ( app text not null, user text not null, sequence integer not null, updated integer not null, primary key ( app, user ) )")
+	events.exec("create table if not exists held ( sequence integer primary key autoincrement, id text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', peer text not null default '', origin text not null default '', key text not null default '', content blob not null default '', data blob not null default '', received integer not null )")
+
+	// Email return paths, bounces, suppressions and DKIM keys
+	db_create_email()
+
 }
 
 // db_apps opens the apps.db database, creating tables if needed.
@@ -417,6 +470,7 @@ func db_apps() *DB {
 	db.exec("create table if not exists versions (app text not null primary key, version text not null default '', track text not null default '')")
 	db.exec("create table if not exists tracks (app text not null, track text not null, version text not null, primary key (app, track))")
 	db.exec("create table if not exists apps (app text not null primary key, installed integer not null)")
+	db.exec("create table if not exists cors (app text not null, origin text not null, status text not null, requested integer not null, primary key (app, origin))")
 	return db
 }
 
@@ -463,6 +517,13 @@ func db_user(u *User, name string) *DB {
 		// Internal key-value settings (Go-only, no Starlark API)
 		db.exec("create table if not exists settings (key text not null primary key, text text not null default '', number integer not null default 0)")
 
+		// Who may see the user's presence (presence.go)
+		db.presence_setup()
+		db.moderation_setup()
+
+		// Links between apps' objects (references.go)
+		db.references_setup()
+
 		// The user's learned directory: private routing memory (directory_user.go)
 		directory_user_table(db)
 
@@ -476,6 +537,8 @@ func db_user(u *User, name string) *DB {
 		db.exec("create index if not exists email_delivered_ts on email_delivered(ts)")
 		db.exec("create table if not exists webpush_delivered (endpoint text not null, event_id text not null, ts integer not null, primary key (endpoint, event_id))")
 		db.exec("create index if not exists webpush_delivered_ts on webpush_delivered(ts)")
+		db.notifications_setup()
+		db.webpush_setup()
 	}
 
 	return db
@@ -1058,15 +1121,13 @@ func db_manager() {
 				live = append(live, db)
 			}
 		}
+		evicting = append(evicting, db_excess(now)...)
 		databases_lock.Unlock()
 
 		// 2b: reclaim each idle database at the zero-contention moment
 		// just before its handles close.
 		for _, db := range evicting {
-			db.vacuum()
-			db.stmts_close()
-			db.internal.Close()
-			db.starlark.Close()
+			db.evict()
 		}
 
 		// 2a (primary): reclaim the still-open databases in place. Core
@@ -1086,6 +1147,19 @@ func db_open(file string) *DB {
 	return db
 }
 
+// db_open_setup opens a server database, running setup to create its
+// tables only when this process opens the handle, not on every call. Used
+// by databases opened on hot paths such as access checks.
+func db_open_setup(file string, setup func(*DB)) *DB {
+	db, _, reused := db_open_work(file)
+	if db == nil || (reused && db_ready(db)) {
+		return db
+	}
+	setup(db)
+	db_ready_set(db)
+	return db
+}
+
 func db_open_work(file string, cacheKeys ...string) (*DB, bool, bool) {
 	path := filepath.Join(data_dir, file)
 	key := path
@@ -1140,6 +1214,7 @@ func db_open_work(file string, cacheKeys ...string) (*DB, bool, bool) {
 		internal: sqlx.NewDb(internal_db, "sqlite3"),
 		starlark: sqlx.NewDb(starlark_db, "sqlite3"),
 	}
+	db_pool_configure(db)
 
 	databases_lock.Lock()
 	if existing, found := databases[key]; found {
@@ -1150,7 +1225,11 @@ func db_open_work(file string, cacheKeys ...string) (*DB, bool, bool) {
 		return existing, false, true
 	}
 	databases[key] = db
+	over := db_open_maximum > 0 && len(databases) > db_open_maximum
 	databases_lock.Unlock()
+	if over {
+		go db_trim()
+	}
 
 	return db, created, false
 }
@@ -1191,6 +1270,7 @@ func db_heal_transient() bool {
 }
 
 func db_start() bool {
+	db_pool_start()
 	fresh := !file_exists(filepath.Join(data_dir, "db", "users.db"))
 	// We do NOT run db_create on every start: re-running it touches every core DB
 	// and would recreate a *missing migrated* DB with only its base schema, after
@@ -1231,6 +1311,32 @@ func db_upgrade() {
 		// History before the 2026-07 baseline squash is in git.
 		case 2:
 			db_upgrade_2()
+		case 3:
+			db_upgrade_3()
+		case 4:
+			db_upgrade_4()
+		case 5:
+			db_upgrade_5()
+		case 6:
+			db_upgrade_6()
+		case 7:
+			db_upgrade_7()
+		case 8:
+			db_upgrade_8()
+		case 9:
+			db_upgrade_9()
+		case 10:
+			db_upgrade_10()
+		case 11:
+			db_upgrade_11()
+		case 12:
+			db_upgrade_12()
+		case 13:
+			db_upgrade_13()
+		case 14:
+			db_upgrade_14()
+		case 15:
+			db_upgrade_15()
 		default:
 			panic(fmt.Sprintf("No upgrade path for schema version %d", next))
 		}
@@ -1247,6 +1353,128 @@ func db_upgrade_2() {
 	queue.exec("create table if not exists health ( recipient text not null primary key, failures integer not null default 0, denials integer not null default 0, success integer not null default 0, since integer not null default 0, suspended integer not null default 0, probed integer not null default 0 )")
 }
 
+// db_upgrade_3 adds delivery and read acknowledgements to queue.db
+func db_upgrade_3() {
+	queue := db_open("db/queue.db")
+	queue.exec("create table if not exists acks ( id text not null primary key, user text not null, app text not null, from_entity text not null, to_entity text not null, service text not null, want text not null, delivered integer not null default 0, created integer not null )")
+	queue.exec("create table if not exists receipts ( id text not null, user text not null, app text not null, from_entity text not null, to_entity text not null, service text not null, created integer not null, primary key ( user, id ) )")
+}
+
+// db_upgrade_4 adds the dead letter table to queue.db on existing installs
+func db_upgrade_4() {
+	queue := db_open("db/queue.db")
+	queue.exec("create table if not exists dead ( id text primary key, target text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', content blob not null default '', data blob not null default '', file text not null default '', expires integer not null default 0, attempts integer not null default 0, last_error text not null default '', reason text not null default '', priority integer not null default 20, created integer not null, died integer not null )")
+	queue.exec("create index if not exists dead_died on dead (died)")
+}
+
+// db_upgrade_5 adds the idempotency key to queued messages and dead letters,
+// and the events database of received keys and logged events
+func db_upgrade_5() {
+	queue := db_open("db/queue.db")
+	for _, table := range []string{"queue", "dead"} {
+		if has, _ := queue.exists("select 1 from pragma_table_info(?) where name='key'", table); !has {
+			queue.exec("alter table " + table + " add column key text not null default ''")
+		}
+	}
+	events := db_open("db/events.db")
+	events.exec("create table if not exists keys ( from_entity text not null, to_entity text not null, service text not null, key text not null, received integer not null, primary key ( from_entity, to_entity, service, key ) )")
+	events.exec("create index if not exists keys_received on keys ( received )")
+	events.exec("create table if not exists log ( sequence integer primary key autoincrement, id text not null, user text not null, app text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', peer text not null default '', key text not null default '', content blob not null default '', data blob not null default '', result text not null default '', received integer not null )")
+	events.exec("create index if not exists log_app_user on log ( app, user, sequence )")
+	events.exec("create index if not exists log_received on log ( received )")
+	events.exec("create table if not exists cursors ( app text not null, user text not null, sequence integer not null, updated integer not null, primary key ( app, user ) )")
+}
+
+// db_upgrade_6 adds the servers found on the local network to peers.db
+func db_upgrade_6() {
+	peers := db_open("db/peers.db")
+	peers.exec("create table if not exists nearby ( id text not null primary key, addresses text not null default '', found integer not null, status text not null )")
+}
+
+// db_upgrade_7 adds guests to users.db
+func db_upgrade_7() {
+	users := db_open("db/users.db")
+	users.exec("create table if not exists guests (user text primary key references users(uid) on delete cascade, created integer not null)")
+}
+
+// db_upgrade_8 adds when each entity's key was created to users.db. The
+// keys of existing entities are counted from the upgrade, having no record
+// of their own.
+func db_upgrade_8() {
+	users := db_open("db/users.db")
+	users.exec("create table if not exists keys (entity text not null primary key references entities(id) on delete cascade, created integer not null)")
+	users.exec("insert or ignore into keys (entity, created) select id, ? from entities", now())
+}
+
+// db_upgrade_9 adds the events held while the server is in maintenance
+func db_upgrade_9() {
+	events := db_open("db/events.db")
+	events.exec("create table if not exists held ( sequence integer primary key autoincrement, id text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', peer text not null default '', origin text not null default '', key text not null default '', content blob not null default '', data blob not null default '', received integer not null )")
+}
+
+// db_upgrade_10 adds pairings, and the devices linked by them, to sessions.db
+func db_upgrade_10() {
+	sessions := db_open("db/sessions.db")
+	sessions.exec("create table if not exists pairings (code text primary key, user text not null, trusted integer not null default 0, name text not null default '', status text not null, claim text not null default '', phrase text not null default '', address text not null default '', agent text not null default '', expires integer not null)")
+	sessions.exec("create index if not exists pairings_claim on pairings(claim)")
+	sessions.exec("create index if not exists pairings_expires on pairings(expires)")
+	sessions.exec("create table if not exists devices (session text primary key, user text not null, name text not null, linked integer not null)")
+	sessions.exec("create index if not exists devices_user on devices(user)")
+}
+
+// db_upgrade_11 adds the authenticator model, attestation, user verification
+// and revocation of each passkey to users.db
+func db_upgrade_11() {
+	users := db_open("db/users.db")
+	for _, column := range []string{"aaguid text not null default ''", "attestation text not null default ''", "verified integer not null default 0", "revoked integer not null default 0"} {
+		name := strings.Fields(column)[0]
+		if has, _ := users.exists("select 1 from pragma_table_info('credentials') where name=?", name); !has {
+			users.exec("alter table credentials add column " + column)
+		}
+	}
+}
+
+// db_upgrade_12 adds email address verification to users.db
+func db_upgrade_12() {
+	db_open("db/users.db").exec("create table if not exists emails (user text primary key references users(uid) on delete cascade, verified integer not null default 0, pending text not null default '', requested integer not null default 0)")
+}
+
+// db_upgrade_13 adds sign in fingerprints and reviews to users.db, and
+// sign in alerts to sessions.db
+func db_upgrade_13() {
+	users := db_open("db/users.db")
+	users.exec("create table if not exists fingerprints (user text not null references users(uid) on delete cascade, device text not null, region text not null, first integer not null, last integer not null, primary key (user, device, region))")
+	users.exec("create table if not exists reviews (user text primary key references users(uid) on delete cascade, reason text not null, created integer not null)")
+	sessions := db_open("db/sessions.db")
+	sessions.exec("create table if not exists alerts (id text primary key, user text not null, session text not null, device text not null, region text not null, address text not null default '', agent text not null default '', reason text not null, created integer not null, denied integer not null default 0)")
+	sessions.exec("create index if not exists alerts_user on alerts(user)")
+}
+
+// db_upgrade_14 adds administrators' impersonations of users to sessions.db,
+// and binds re-authentication proofs to an app and purpose
+func db_upgrade_14() {
+	sessions := db_open("db/sessions.db")
+	sessions.exec("alter table reauthentication add column app text not null default ''")
+	sessions.exec("alter table reauthentication add column purpose text not null default ''")
+	sessions.exec("create table if not exists impersonations (session text primary key, user text not null, administrator text not null, origin text not null default '', reason text not null, address text not null default '', created integer not null, expires integer not null, ended integer not null default 0)")
+}
+
+// db_upgrade_15 adds email return paths, bounces, suppressions and DKIM
+// keys in email.db
+func db_upgrade_15() {
+	db_create_email()
+}
+
+// db_create_email creates the tables of email.db
+func db_create_email() {
+	email := db_open("db/email.db")
+	email.exec("create table if not exists verp (token text primary key, address text not null, created integer not null)")
+	email.exec("create table if not exists bounces (id integer primary key, address text not null, kind text not null, status text not null default '', detail text not null default '', created integer not null)")
+	email.exec("create index if not exists bounces_address on bounces(address, created)")
+	email.exec("create table if not exists suppressions (address text primary key, reason text not null, detail text not null default '', created integer not null)")
+	email.exec("create table if not exists dkim (domain text primary key, selector text not null, private text not null, created integer not null)")
+}
+
 func (db *DB) close() {
 	databases_lock.Lock()
 	db.closed = now()
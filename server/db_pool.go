@@ -0,0 +1,117 @@
+// Mochi server: Limits on open databases
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Every user and app database stays open in the databases cache once used,
+// with two connection pools each, and every connection holds the file, its
+// WAL and its shared memory open. With hundreds of active users that's
+// thousands of file descriptors, so:
+//
+//   - a connection unused for [database] idle seconds is closed, and
+//     reopened when next needed; the handle itself stays valid
+//   - each pool keeps at most [database] connections idle connections
+//   - once more than [database] open databases are cached, the ones that
+//     have been released for longest are closed straight away, rather than
+//     after db_manager's usual minute; one released in the last
+//     db_evict_grace is left, in case whoever released it is still finishing
+//
+// Databases still in use are never closed, so the limit can be exceeded
+// while they are. The counts are served as Prometheus metrics.
+
+const db_evict_grace = 5
+
+var (
+	db_open_maximum     = 1024
+	db_idle_connections = 2
+	db_connection_idle  = 5 * time.Minute
+	db_trimming         atomic.Bool
+	db_evicted          atomic.Int64
+)
+
+// db_pool_start reads the limits
+func db_pool_start() {
+	db_open_maximum = ini_int("database", "open", db_open_maximum)
+	db_idle_connections = ini_int("database", "connections", db_idle_connections)
+	db_connection_idle = time.Duration(ini_int("database", "idle", int(db_connection_idle.Seconds()))) * time.Second
+}
+
+// db_pool_configure applies the connection limits to a database's pools
+func db_pool_configure(db *DB) {
+	for _, pool := range []interface {
+		SetMaxIdleConns(int)
+		SetConnMaxIdleTime(time.Duration)
+	}{db.internal, db.starlark} {
+		pool.SetMaxIdleConns(db_idle_connections)
+		pool.SetConnMaxIdleTime(db_connection_idle)
+	}
+}
+
+// db_excess removes the released databases beyond db_open_maximum from the
+// cache, longest released first, and returns them for closing. Must be
+// called with databases_lock held.
+func db_excess(now int64) []*DB {
+	over := len(databases) - db_open_maximum
+	if db_open_maximum <= 0 || over <= 0 {
+		return nil
+	}
+	var idle []*DB
+	for _, db := range databases {
+		if db.closed > 0 && db.closed <= now-db_evict_grace {
+			idle = append(idle, db)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].closed < idle[j].closed })
+	idle = idle[:min(over, len(idle))]
+	for _, db := range idle {
+		delete(databases, db.key)
+	}
+	return idle
+}
+
+// db_trim closes databases beyond db_open_maximum, one trim at a time
+func db_trim() {
+	if !db_trimming.CompareAndSwap(false, true) {
+		return
+	}
+	defer db_trimming.Store(false)
+	databases_lock.Lock()
+	evicting := db_excess(now())
+	databases_lock.Unlock()
+	for _, db := range evicting {
+		db.evict()
+	}
+}
+
+// evict closes a database removed from the cache, reclaiming its free pages
+// first while nothing else is using it
+func (db *DB) evict() {
+	db.vacuum()
+	db.stmts_close()
+	db.internal.Close()
+	db.starlark.Close()
+	db_evicted.Add(1)
+}
+
+// db_pool_stats returns how many databases are cached, how many of those are
+// released, and how many connections they have open
+func db_pool_stats() (open, idle, connections int) {
+	databases_lock.Lock()
+	defer databases_lock.Unlock()
+	for _, db := range databases {
+		if db.closed > 0 {
+			idle++
+		}
+		connections += db.internal.Stats().OpenConnections + db.starlark.Stats().OpenConnections
+	}
+	return len(databases), idle, connections
+}
@@ -0,0 +1,80 @@
+// Mochi server: Open database limit tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDatabaseLimit(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	maximum, idle := db_open_maximum, db_connection_idle
+	t.Cleanup(func() { db_open_maximum, db_connection_idle = maximum, idle })
+	db_open_maximum = 0
+
+	var opened []*DB
+	for _, name := range []string{"a", "b", "c"} {
+		db := db_open("test/" + name + ".db")
+		db.exec("create table if not exists t (x integer)")
+		db.close()
+		opened = append(opened, db)
+	}
+	databases_lock.Lock()
+	for i, db := range opened {
+		db.closed = int64(i + 1) // Released before anything else
+	}
+	db_open_maximum = len(databases) - 2
+	evicting := db_excess(now())
+	_, kept := databases[opened[2].key]
+	databases_lock.Unlock()
+
+	if len(evicting) != 2 || evicting[0] != opened[0] || evicting[1] != opened[1] || !kept {
+		t.Fatalf("closed %d databases, kept the latest %v", len(evicting), kept)
+	}
+	before := db_evicted.Load()
+	for _, db := range evicting {
+		db.evict()
+	}
+	if db_evicted.Load() != before+2 {
+		t.Errorf("closed count %d", db_evicted.Load()-before)
+	}
+
+	// Databases in use, or only just released, stay open
+	db_open_maximum = 0
+	used := db_open("test/d.db")
+	released := db_open("test/e.db")
+	released.close()
+	databases_lock.Lock()
+	db_open_maximum = len(databases) - 2
+	evicting = db_excess(now())
+	databases_lock.Unlock()
+	for _, db := range evicting {
+		if db == used || db == released {
+			t.Error("closed a database still in use")
+		}
+		db.evict()
+	}
+
+	// Idle connections close by themselves
+	db_open_maximum = 0
+	db_connection_idle = 10 * time.Millisecond
+	db := db_open("test/f.db")
+	db.exec("create table if not exists t (x integer)")
+	deadline := time.Now().Add(5 * time.Second)
+	for db.internal.Stats().OpenConnections > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := db.internal.Stats().OpenConnections; n > 0 {
+		t.Errorf("%d idle connections still open", n)
+	}
+	db.exec("insert into t (x) values (1)")
+	if n, _ := db.exists("select 1 from t"); !n {
+		t.Error("database unusable after its connections closed")
+	}
+}
@@ -295,6 +295,24 @@ func TestStmtCacheConcurrentClose(t *testing.T) {
 	}
 }
 
+func TestDBOpenSetup(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+
+	runs := 0
+	setup := func(db *DB) {
+		runs++
+		db.exec("create table if not exists things (id integer primary key)")
+	}
+	db := db_open_setup("db/setup.db", setup)
+	if again := db_open_setup("db/setup.db", setup); again != db || runs != 1 {
+		t.Errorf("setup ran %d times for one handle", runs)
+	}
+	if exists, _ := db.exists("select 1 from sqlite_master where name='things'"); !exists {
+		t.Error("setup's table not created")
+	}
+}
+
 func TestDBExec(t *testing.T) {
 	db, cleanup := create_test_db(t)
 	defer cleanup()
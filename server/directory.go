@@ -66,6 +66,7 @@ func init() {
 	a.event_anonymous("request", directory_request_event)
 	a.event_anonymous("sync", directory_sync_event)
 	a.event_anonymous("push", directory_push_event)
+	a.event_anonymous("refresh", directory_refresh_event)
 }
 
 // entry_signable returns the canonical CBOR the entity signs over a row's
@@ -232,7 +233,7 @@ func entry_store(en *Entry, source string) bool {
 
 // directory_create builds or refreshes this host's row for a local entity.
 // Unchanged content keeps its version and signature and re-issues only the
-// attestation with a fresh seen — the cheap hourly heartbeat. Changed
+// attestation with a fresh seen — the cheap heartbeat. Changed
 // content takes version = now() and a new content signature; a rename also
 // resets created, so an impersonator can't inherit an old entity's seniority
 // in search ordering.
@@ -283,6 +284,7 @@ func directory_publish(e *Entity, allow_queue bool) {
 		"version", i64toa(en.Version), "created", i64toa(en.Created), "seen", i64toa(en.Seen),
 		"signature", en.Signature, "attestation", en.Attestation)
 	m.publish(allow_queue)
+	directory_published_set(en.Entity, en.Version)
 }
 
 // entry_delete_self removes this host's row for an entity, locally and
@@ -378,11 +380,11 @@ func directory_sync() {
 // directory_push_watermark tracks, per sync peer, the highest self-row
 // `seen` already delivered over a push stream, so only rows re-attested
 // since the last successful push are sent — steady-state one push per
-// hourly re-attest cycle, not one per 5-minute sync tick. In-memory by
+// re-attest cycle, not one per 5-minute sync tick. In-memory by
 // design: a restart repeats one full push, which the receiver's
 // entry_store ordering rules dedup; and because every self-row's seen
-// advances on the hourly re-attest, a receiver that lost rows (wiped
-// directory) is made whole within an hour regardless of the watermark.
+// advances on each re-attest, a receiver that lost rows (wiped directory)
+// is made whole within one refresh interval regardless of the watermark.
 // Touched only from the directory_manager goroutine.
 var directory_push_watermark = map[string]int64{}
 
@@ -516,7 +518,7 @@ func directory_sync_event(e *Event) {
 
 // directory_location_max_age is how long a directory row may remain
 // un-refreshed before a silenced peer's rows get forgotten. Live peers
-// re-attest hourly; only a peer that's been dark for the full window gets
+// re-attest every few hours at most; only a peer that's been dark for the full window gets
 // considered.
 const directory_location_max_age = 14 * 86400 // 14 days
 
@@ -0,0 +1,181 @@
+// Mochi server: Directory refreshes
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// A host keeps its directory rows alive by re-attesting them with a fresh
+// seen. Republishing every row in full for that costs a server hosting many
+// entities a steady stream of broadcasts that say nothing new, so only rows
+// whose content changed are published in full. The rest travel as
+// refreshes: batches of (entity, version, created, seen, attestation),
+// compressed, which a receiver applies to the rows it already holds. How
+// often the refresh runs adapts to how often this host's entities change,
+// from every quarter hour for a busy host to hourly for a quiet one. Peers
+// count a host active for two hours (directory_active_window), so the
+// maximum must stay within half of that. Receivers
+// without refresh still get full rows through directory_push_to_peer and
+// sync.
+
+package main
+
+import (
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+const (
+	directory_refresh_tick    = 5 * time.Minute
+	directory_refresh_minimum = int64(15 * 60)
+	directory_refresh_maximum = int64(3600)
+	directory_refresh_batch   = 500
+)
+
+// DirectoryRefresh is one row's re-attestation, as carried in a refresh
+type DirectoryRefresh struct {
+	Entity      string `cbor:"e"`
+	Version     int64  `cbor:"v"`
+	Created     int64  `cbor:"c"`
+	Seen        int64  `cbor:"s"`
+	Attestation string `cbor:"a"`
+}
+
+// directory_published records the version last published in full for each
+// local entity, so unchanged rows are refreshed rather than republished. In
+// memory: after a restart directory_manager republishes everything anyway.
+var (
+	directory_published      = map[string]int64{}
+	directory_published_lock sync.Mutex
+)
+
+// directory_published_set records a full publish of an entity's row
+func directory_published_set(entity string, version int64) {
+	directory_published_lock.Lock()
+	directory_published[entity] = version
+	directory_published_lock.Unlock()
+}
+
+// directory_published_get returns the version last published for an entity
+func directory_published_get(entity string) (int64, bool) {
+	directory_published_lock.Lock()
+	defer directory_published_lock.Unlock()
+	version, found := directory_published[entity]
+	return version, found
+}
+
+// directory_changed returns the public entities whose directory row is
+// missing, differs from the entity, or was never published in full by this
+// process
+func directory_changed(es []Entity) []Entity {
+	var rows []Entry
+	if err := db_open("db/directory.db").scans(&rows, "select * from entries where peer=?", net_id); err != nil {
+		warn("Database error loading directory rows for refresh: %v", err)
+		return nil
+	}
+	have := make(map[string]*Entry, len(rows))
+	for i := range rows {
+		have[rows[i].Entity] = &rows[i]
+	}
+
+	var changed []Entity
+	for _, e := range es {
+		en := have[e.ID]
+		if en == nil || en.Name != e.Name || en.Class != e.Class || en.Data != e.Data {
+			changed = append(changed, e)
+			continue
+		}
+		if version, found := directory_published_get(e.ID); !found || version != en.Version {
+			changed = append(changed, e)
+		}
+	}
+	return changed
+}
+
+// directory_refresh_interval is the next interval between refreshes: back
+// to the minimum when entities changed since the last one, otherwise twice
+// the last up to the maximum
+func directory_refresh_interval(interval int64, changes int) int64 {
+	if changes > 0 {
+		return directory_refresh_minimum
+	}
+	return min(interval*2, directory_refresh_maximum)
+}
+
+// directory_refresh_encode packs re-attestations into a refresh payload:
+// CBOR, zstd compressed, base64 so the content stays all-string
+func directory_refresh_encode(rs []DirectoryRefresh) string {
+	return base64.StdEncoding.EncodeToString(zstd_encoder.EncodeAll(cbor_encode(rs), nil))
+}
+
+// directory_refresh_decode reverses directory_refresh_encode. The decoder
+// bounds the decompressed size at frame_maximum.
+func directory_refresh_decode(payload string) ([]DirectoryRefresh, bool) {
+	compressed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, false
+	}
+	raw, err := zstd_decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, false
+	}
+	var rs []DirectoryRefresh
+	if err := cbor_decode_mode.Unmarshal(raw, &rs); err != nil {
+		return nil, false
+	}
+	return rs, true
+}
+
+// directory_refresh_publish broadcasts re-attestations of this host's rows,
+// in batches
+func directory_refresh_publish(rows []Entry) {
+	for start := 0; start < len(rows); start += directory_refresh_batch {
+		end := min(start+directory_refresh_batch, len(rows))
+		rs := make([]DirectoryRefresh, 0, end-start)
+		for _, en := range rows[start:end] {
+			rs = append(rs, DirectoryRefresh{Entity: en.Entity, Version: en.Version, Created: en.Created, Seen: en.Seen, Attestation: en.Attestation})
+		}
+		m := message("", "", "directory", "refresh")
+		m.set("peer", net_id, "rows", directory_refresh_encode(rs))
+		m.publish(false)
+		if end < len(rows) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// Received a directory refresh from the network: a host re-attesting rows
+// it published earlier. Each attestation is verified against the row held
+// here; only seen and the attestation change. Rows not held, or held at
+// another version, are skipped — the full publish that was missed reaches
+// this host through directory sync.
+func directory_refresh_event(e *Event) {
+	peer := e.get("peer", "")
+	if peer == "" || peer == net_id {
+		return
+	}
+	rs, ok := directory_refresh_decode(e.get("rows", ""))
+	if !ok || len(rs) > directory_refresh_batch {
+		info("Directory dropping malformed refresh from peer %q", peer)
+		return
+	}
+
+	db := db_open("db/directory.db")
+	refreshed := 0
+	for _, r := range rs {
+		if !valid(r.Entity, "entity") || r.Seen <= 0 || r.Seen > now()+3600 {
+			continue
+		}
+		row, _ := db.row("select version, created, seen from entries where entity=? and peer=?", r.Entity, peer)
+		if row == nil || row_int(row, "version") != r.Version || row_int(row, "created") != r.Created || row_int(row, "seen") >= r.Seen {
+			continue
+		}
+		if !entry_attest_verify(&Entry{Entity: r.Entity, Peer: peer, Version: r.Version, Created: r.Created, Seen: r.Seen, Attestation: r.Attestation}) {
+			info("Directory dropping refresh with bad attestation: entity=%q peer=%q", r.Entity, peer)
+			continue
+		}
+		db.exec("update entries set seen=?, attestation=? where entity=? and peer=? and version=? and seen<?", r.Seen, r.Attestation, r.Entity, peer, r.Version, r.Seen)
+		refreshed++
+	}
+	debug("Directory refreshed %d of %d rows from peer %q", refreshed, len(rs), peer)
+}
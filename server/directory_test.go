@@ -596,3 +596,80 @@ func TestDirectoryPushEventStoresVerifiedRows(t *testing.T) {
 		t.Errorf("tampered pushed row was stored")
 	}
 }
+
+// --- refresh event ---
+
+// TestDirectoryRefreshEvent: a compressed refresh re-attests rows already
+// held at the same version, moving only seen and the attestation; rows not
+// held, held at another version, or with an attestation by the wrong host
+// are left alone.
+func TestDirectoryRefreshEvent(t *testing.T) {
+	cleanup := setup_directory_test(t)
+	defer cleanup()
+
+	entity, ek := test_identity(t)
+	other, bk := test_identity(t)
+	peer, hk := test_host(t)
+	_, impostor := test_host(t)
+	db := db_open("db/directory.db")
+	base := now() - 1000
+
+	if !entry_store(test_entry(t, entity, ek, peer, hk, "Alice", 100, 50, base), "test") {
+		t.Fatal("seed row not stored")
+	}
+	if !entry_store(test_entry(t, other, bk, peer, hk, "Bob", 100, 50, base), "test") {
+		t.Fatal("seed row not stored")
+	}
+	refresh := func(en *Entry) DirectoryRefresh {
+		return DirectoryRefresh{Entity: en.Entity, Version: en.Version, Created: en.Created, Seen: en.Seen, Attestation: en.Attestation}
+	}
+	unknown, uk := test_identity(t)
+	rs := []DirectoryRefresh{
+		refresh(test_entry(t, entity, ek, peer, hk, "Alice", 100, 50, base+500)),
+		refresh(test_entry(t, other, bk, peer, impostor, "Bob", 100, 50, base+500)),
+		refresh(test_entry(t, unknown, uk, peer, hk, "Carol", 100, 50, base+500)),
+	}
+	directory_refresh_event(&Event{service: "directory", event: "refresh", content: map[string]any{"peer": peer, "rows": directory_refresh_encode(rs)}})
+
+	row, _ := db.row("select name, seen from entries where entity=? and peer=?", entity, peer)
+	if s := row_int(row, "seen"); s != base+500 {
+		t.Errorf("refreshed seen = %d, want %d", s, base+500)
+	}
+	if n, _ := row["name"].(string); n != "Alice" {
+		t.Errorf("refreshed name = %q, want Alice", n)
+	}
+	row, _ = db.row("select seen from entries where entity=? and peer=?", other, peer)
+	if s := row_int(row, "seen"); s != base {
+		t.Errorf("refresh attested by the wrong host moved seen to %d", s)
+	}
+	if exists, _ := db.exists("select 1 from entries where entity=?", unknown); exists {
+		t.Error("refresh created a row not held")
+	}
+
+	// A refresh for another version is skipped
+	rs = []DirectoryRefresh{refresh(test_entry(t, entity, ek, peer, hk, "Alice", 200, 50, base+600))}
+	directory_refresh_event(&Event{service: "directory", event: "refresh", content: map[string]any{"peer": peer, "rows": directory_refresh_encode(rs)}})
+	row, _ = db.row("select version, seen from entries where entity=? and peer=?", entity, peer)
+	if row_int(row, "version") != 100 || row_int(row, "seen") != base+500 {
+		t.Errorf("refresh for another version applied: %v", row)
+	}
+}
+
+// TestDirectoryRefreshInterval: the interval doubles while nothing changes,
+// up to the maximum, and drops back to the minimum on a change. A host that
+// misses one refresh at the maximum must still count as active.
+func TestDirectoryRefreshInterval(t *testing.T) {
+	if 2*directory_refresh_maximum > directory_active_window {
+		t.Errorf("maximum interval %d exceeds half the active window %d", directory_refresh_maximum, directory_active_window)
+	}
+	interval := directory_refresh_minimum
+	for i := 0; i < 5; i++ {
+		interval = directory_refresh_interval(interval, 0)
+	}
+	if interval != directory_refresh_maximum {
+		t.Errorf("quiet interval = %d, want %d", interval, directory_refresh_maximum)
+	}
+	if interval = directory_refresh_interval(interval, 3); interval != directory_refresh_minimum {
+		t.Errorf("busy interval = %d, want %d", interval, directory_refresh_minimum)
+	}
+}
@@ -0,0 +1,195 @@
+// Mochi server: Disk space watchdog
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The disk watchdog checks the free space on the filesystems holding
+// data_dir and cache_dir every minute, so a server running out degrades in
+// ways chosen in advance rather than by SQLite writes failing wherever they
+// happen to be:
+//
+//   - below [disk] low megabytes free, the cache is pruned of everything
+//     not used within the last hour, and administrators are told
+//   - below [disk] critical megabytes free, attachment uploads and app
+//     installs are refused as well, leaving what space there is for the
+//     databases
+//
+// Administrators are told again only if it gets worse, or after it has
+// recovered. The last report is served at /_/admin/disk, in /_/health, and
+// as Prometheus metrics.
+
+const (
+	disk_interval        = time.Minute
+	disk_prune_interval  = 15 * time.Minute
+	disk_prune_age       = time.Hour
+	disk_status_ok       = "ok"
+	disk_status_low      = "low"
+	disk_status_critical = "critical"
+)
+
+// disk_volume is the free space where one directory is kept
+type disk_volume struct {
+	Directory string `json:"directory"` // "data" or "cache"
+	Path      string `json:"path"`
+	Free      int64  `json:"free"`
+	Size      int64  `json:"size"`
+	Status    string `json:"status"`
+	Problem   string `json:"problem"`
+}
+
+// disk_report is the result of a check
+type disk_report struct {
+	Checked int64         `json:"checked"`
+	Status  string        `json:"status"`
+	Volumes []disk_volume `json:"volumes"`
+}
+
+var (
+	disk_last    = &disk_report{Status: disk_status_ok, Volumes: []disk_volume{}}
+	disk_lock    sync.Mutex
+	disk_running sync.Mutex
+	disk_paused  atomic.Bool
+	disk_pruned  time.Time
+	disk_alerted string
+	disk_rank    = map[string]int{disk_status_ok: 0, disk_status_low: 1, disk_status_critical: 2}
+
+	// disk_space is disk_statistics behind a var so tests can fill the disk
+	disk_space = disk_statistics
+
+	// Returned by uploads and installs refused for lack of space
+	disk_space_low = errors.New("server is low on disk space")
+)
+
+// disk_manager checks periodically
+func disk_manager() {
+	disk_check()
+	for range time.Tick(disk_interval) {
+		disk_check()
+	}
+}
+
+// disk_threshold returns a threshold from [disk], in bytes
+func disk_threshold(key string, def int) int64 {
+	return int64(ini_int("disk", key, def)) << 20
+}
+
+// disk_check measures the free space, degrades or recovers accordingly, and
+// keeps the report
+func disk_check() *disk_report {
+	disk_running.Lock()
+	defer disk_running.Unlock()
+	low := disk_threshold("low", 2048)
+	critical := disk_threshold("critical", 512)
+	r := &disk_report{Checked: now(), Status: disk_status_ok, Volumes: []disk_volume{}}
+
+	for _, d := range []struct{ name, path string }{{"data", data_dir}, {"cache", cache_dir}} {
+		v := disk_volume{Directory: d.name, Path: d.path, Status: disk_status_ok}
+		free, size, err := disk_space(d.path)
+		switch {
+		case err != nil:
+			v.Problem = err.Error()
+		case free < critical:
+			v.Status = disk_status_critical
+		case free < low:
+			v.Status = disk_status_low
+		}
+		v.Free, v.Size = free, size
+		if disk_rank[v.Status] > disk_rank[r.Status] {
+			r.Status = v.Status
+		}
+		r.Volumes = append(r.Volumes, v)
+	}
+
+	disk_lock.Lock()
+	previous := disk_last.Status
+	disk_last = r
+	disk_lock.Unlock()
+
+	disk_paused.Store(r.Status == disk_status_critical)
+	if r.Status != previous {
+		if r.Status == disk_status_ok {
+			info("Disk space recovered")
+		} else {
+			warn("Disk space %s: %s", r.Status, disk_summary(r))
+		}
+	}
+	if r.Status != disk_status_ok && time.Since(disk_pruned) >= disk_prune_interval {
+		disk_pruned = time.Now()
+		cache_prune(disk_prune_age)
+	}
+	disk_alert(r)
+	return r
+}
+
+// disk_summary describes the volumes short of space, for logs and alerts
+func disk_summary(r *disk_report) string {
+	s := ""
+	for _, v := range r.Volumes {
+		if v.Status == disk_status_ok {
+			continue
+		}
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s %s has %d MB free", v.Directory, v.Path, v.Free>>20)
+	}
+	return s
+}
+
+// disk_alert notifies the administrators when space has become lower than
+// they were last told about. What they were told is kept in the
+// disk_alerted setting, so a restart doesn't tell them again.
+func disk_alert(r *disk_report) {
+	disk_lock.Lock()
+	defer disk_lock.Unlock()
+	if disk_alerted == "" {
+		disk_alerted = setting_get("disk_alerted", disk_status_ok)
+	}
+	if r.Status == disk_alerted {
+		return
+	}
+	if disk_rank[r.Status] > disk_rank[disk_alerted] {
+		administrators_notify("disk/"+r.Status, "/settings/system/status", "disk."+r.Status, map[string]any{"volumes": disk_summary(r)})
+	}
+	disk_alerted = r.Status
+	setting_set("disk_alerted", r.Status)
+}
+
+// disk_report_get returns the last report
+func disk_report_get() *disk_report {
+	disk_lock.Lock()
+	defer disk_lock.Unlock()
+	return disk_last
+}
+
+// disk_full returns disk_space_low if the server is so short of space
+// that uploads and installs are paused
+func disk_full() error {
+	if disk_paused.Load() {
+		return disk_space_low
+	}
+	return nil
+}
+
+// admin_disk returns the last disk report, or with check=true checks first
+func admin_disk(c *gin.Context) {
+	r := disk_report_get()
+	if c.Query("check") == "true" {
+		r = disk_check()
+	}
+	c.JSON(http.StatusOK, r)
+}
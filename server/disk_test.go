@@ -0,0 +1,80 @@
+// Mochi server: Disk space watchdog tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskWatchdog(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	load_core_labels()
+
+	cache_dir_old := cache_dir
+	cache_dir = t.TempDir()
+	free := map[string]int64{data_dir: 10 << 30, cache_dir: 10 << 30}
+	disk_space = func(path string) (int64, int64, error) {
+		return free[path], 100 << 30, nil
+	}
+	t.Cleanup(func() {
+		cache_dir = cache_dir_old
+		disk_space = disk_statistics
+		disk_paused.Store(false)
+		disk_last = &disk_report{Status: disk_status_ok, Volumes: []disk_volume{}}
+		disk_alerted = ""
+		disk_pruned = time.Time{}
+	})
+
+	old := filepath.Join(cache_dir, "old")
+	recent := filepath.Join(cache_dir, "recent")
+	os.WriteFile(old, []byte("x"), 0644)
+	os.WriteFile(recent, []byte("x"), 0644)
+	os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))
+
+	if r := disk_check(); r.Status != disk_status_ok || len(r.Volumes) != 2 || disk_full() != nil {
+		t.Fatalf("plenty of space: %+v", r)
+	}
+	if !file_exists(old) {
+		t.Error("cache pruned with plenty of space")
+	}
+
+	// Low: the cache is pruned and administrators are told
+	free[cache_dir] = 1 << 30
+	if r := disk_check(); r.Status != disk_status_low || r.Volumes[1].Status != disk_status_low || disk_full() != nil {
+		t.Fatalf("low: %+v", r)
+	}
+	if file_exists(old) || !file_exists(recent) {
+		t.Error("cache not pruned of old files only")
+	}
+	if s := setting_get("disk_alerted", ""); s != disk_status_low {
+		t.Errorf("alerted %q", s)
+	}
+
+	// Critical: uploads and installs are refused
+	free[data_dir] = 100 << 20
+	if r := disk_check(); r.Status != disk_status_critical || !errors.Is(disk_full(), disk_space_low) {
+		t.Fatalf("critical: %+v", r)
+	}
+	if _, err := app_install("test", "1", filepath.Join(cache_dir, "missing.zip"), false); !errors.Is(err, disk_space_low) {
+		t.Errorf("install allowed: %v", err)
+	}
+
+	// Recovered
+	free[data_dir], free[cache_dir] = 10<<30, 10<<30
+	if r := disk_check(); r.Status != disk_status_ok || disk_full() != nil {
+		t.Fatalf("recovered: %+v", r)
+	}
+	if s := setting_get("disk_alerted", ""); s != disk_status_ok {
+		t.Errorf("alerted %q after recovery", s)
+	}
+}
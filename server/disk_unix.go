@@ -0,0 +1,21 @@
+// Mochi server: Free disk space on Unix
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+//go:build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// disk_statistics returns the bytes free to the server, and the size, of
+// the filesystem holding path
+func disk_statistics(path string) (free int64, size int64, err error) {
+	var s unix.Statfs_t
+	if err := unix.Statfs(path, &s); err != nil {
+		return 0, 0, err
+	}
+	return int64(s.Bavail) * int64(s.Bsize), int64(s.Blocks) * int64(s.Bsize), nil
+}
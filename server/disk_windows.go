@@ -0,0 +1,25 @@
+// Mochi server: Free disk space on Windows
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// disk_statistics returns the bytes free to the server, and the size, of
+// the volume holding path
+func disk_statistics(path string) (free int64, size int64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var available, total, all uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &available, &total, &all); err != nil {
+		return 0, 0, err
+	}
+	return int64(available), int64(total), nil
+}
@@ -0,0 +1,322 @@
+// Mochi server: DKIM signing of outgoing email
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// Mail from a server at home is junked unless the receiver can tell the
+// sending domain vouches for it. Unless [email] dkim is false, each message
+// is signed (RFC 6376, rsa-sha256, relaxed/relaxed) with a key for the
+// domain of its From address, generated the first time the domain sends.
+// For the signature to count the operator publishes the key, as
+//
+//	<selector>._domainkey.<domain>.  TXT "v=DKIM1; k=rsa; p=<public key>"
+//
+// mochictl dkim prints the record, and checks it and the domain's SPF and
+// DMARC records as published.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gm "github.com/wneessen/go-mail"
+)
+
+// Headers signed, where the message has them
+var dkim_headers = []string{"from", "to", "subject", "date", "message-id", "mime-version", "content-type", "content-transfer-encoding", "reply-to"}
+
+var dkim_space = regexp.MustCompile(`[ \t]+`)
+
+// DKIMKey is a domain's signing key
+type DKIMKey struct {
+	Domain   string
+	Selector string
+	Private  string // PKCS#1 PEM
+	Created  int64
+	key      *rsa.PrivateKey
+}
+
+// dkim_domain returns the domain of the address mail is sent from
+func dkim_domain(from string) string {
+	at := strings.LastIndex(from, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(from[at+1:], "> "))
+}
+
+// dkim_key returns the signing key for a domain, generating one if it has
+// none
+func dkim_key(domain string) (*DKIMKey, error) {
+	db := email_db()
+	var k DKIMKey
+	if !db.scan(&k, "select domain, selector, private, created from dkim where domain=?", domain) {
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("generate key: %w", err)
+		}
+		k = DKIMKey{
+			Domain:   domain,
+			Selector: "mochi" + time.Now().UTC().Format("200601"),
+			Private:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})),
+			Created:  now(),
+		}
+		db.exec("insert or ignore into dkim (domain, selector, private, created) values (?, ?, ?, ?)", k.Domain, k.Selector, k.Private, k.Created)
+		// Another sender may have got there first
+		if !db.scan(&k, "select domain, selector, private, created from dkim where domain=?", domain) {
+			return nil, errors.New("key not stored")
+		}
+		info("DKIM key %q generated for %q; publish it with the record from mochictl dkim %s", k.Selector, domain, domain)
+	}
+
+	block, _ := pem.Decode([]byte(k.Private))
+	if block == nil {
+		return nil, errors.New("stored key has no PEM block")
+	}
+	private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse stored key: %w", err)
+	}
+	k.key = private
+	return &k, nil
+}
+
+// public returns the base64 DER public key, as published in DNS
+func (k *DKIMKey) public() string {
+	der, _ := x509.MarshalPKIXPublicKey(&k.key.PublicKey)
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// dkim_canonical_header is the relaxed canonical form of a header field
+func dkim_canonical_header(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.TrimSpace(dkim_space.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// dkim_canonical_body is the relaxed canonical form of a message body
+func dkim_canonical_body(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(dkim_space.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// dkim_fields splits a message's header into its fields, each with any
+// folded continuation lines
+func dkim_fields(header string) []string {
+	var fields []string
+	for _, line := range strings.Split(strings.ReplaceAll(header, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+		} else if line != "" {
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+// dkim_fold breaks a long tag value over lines
+func dkim_fold(value string) string {
+	var b strings.Builder
+	for len(value) > 72 {
+		b.WriteString(value[:72] + "\r\n ")
+		value = value[72:]
+	}
+	b.WriteString(value)
+	return b.String()
+}
+
+// dkim_sign returns the DKIM-Signature header value for a message
+func dkim_sign(raw []byte, k *DKIMKey) (string, error) {
+	header, body, found := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !found {
+		return "", errors.New("message has no body")
+	}
+	hash := sha256.Sum256(dkim_canonical_body(body))
+
+	// Sign headers from the bottom up, as a verifier will find them
+	fields := dkim_fields(string(header))
+	used := map[int]bool{}
+	var names []string
+	var signed strings.Builder
+	for _, name := range dkim_headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			field_name, _, _ := strings.Cut(fields[i], ":")
+			if used[i] || !strings.EqualFold(strings.TrimSpace(field_name), name) {
+				continue
+			}
+			used[i] = true
+			names = append(names, name)
+			signed.WriteString(dkim_canonical_header(fields[i]) + "\r\n")
+			break
+		}
+	}
+	if len(names) == 0 || names[0] != "from" {
+		return "", errors.New("message has no From header")
+	}
+
+	value := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n t=%d; h=%s;\r\n bh=%s;\r\n b=", k.Domain, k.Selector, now(), strings.Join(names, ":"), base64.StdEncoding.EncodeToString(hash[:]))
+	signed.WriteString(dkim_canonical_header("DKIM-Signature: " + value))
+	digest := sha256.Sum256([]byte(signed.String()))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+	return value + dkim_fold(base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// dkim_message adds a DKIM signature to a message, if signing is on. The
+// message is written out once to sign it, which fixes its date, ID and
+// MIME boundaries so that the copy sent is the one signed.
+func dkim_message(m *gm.Msg) {
+	if !ini_bool("email", "dkim", true) {
+		return
+	}
+	from := m.GetFromString()
+	if len(from) == 0 {
+		return
+	}
+	domain := dkim_domain(from[0])
+	if domain == "" || domain == "localhost" {
+		return
+	}
+	k, err := dkim_key(domain)
+	if err != nil {
+		info("DKIM key for %q unavailable: %v", domain, err)
+		return
+	}
+	var raw bytes.Buffer
+	if _, err := m.WriteTo(&raw); err != nil {
+		info("DKIM failed to write message: %v", err)
+		return
+	}
+	signature, err := dkim_sign(raw.Bytes(), k)
+	if err != nil {
+		info("DKIM failed to sign message: %v", err)
+		return
+	}
+	m.SetGenHeaderPreformatted("DKIM-Signature", signature)
+}
+
+// dkim_records are the records a domain should publish for its mail
+func dkim_records(k *DKIMKey) []DNSRecord {
+	// TXT strings are at most 255 characters, so the key is split over several
+	value := "v=DKIM1; k=rsa; p=" + k.public()
+	var strs []string
+	for len(value) > 200 {
+		strs = append(strs, fmt.Sprintf("%q", value[:200]))
+		value = value[200:]
+	}
+	strs = append(strs, fmt.Sprintf("%q", value))
+	return []DNSRecord{{Name: k.Selector + "._domainkey." + k.Domain + ".", Type: "TXT", Value: strings.Join(strs, " ")}}
+}
+
+// dkim_tags parses a "name=value; ..." record into its tags
+func dkim_tags(record string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(record, ";") {
+		if name, value, found := strings.Cut(tag, "="); found {
+			tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+		}
+	}
+	return tags
+}
+
+// dkim_check compares the records a domain publishes with those it should,
+// returning a problem for each difference
+func dkim_check(k *DKIMKey) []string {
+	problems := []string{}
+	ctx, cancel := context.WithTimeout(context.Background(), dns_timeout)
+	defer cancel()
+
+	name := k.Selector + "._domainkey." + k.Domain
+	txts, err := dns_resolver.LookupTXT(ctx, name)
+	if err != nil || len(txts) == 0 {
+		problems = append(problems, fmt.Sprintf("no DKIM record at %s", name))
+	} else {
+		// A resolver returns a record's strings joined, or one per entry
+		tags := dkim_tags(strings.Join(txts, ""))
+		if tags["p"] != k.public() {
+			problems = append(problems, fmt.Sprintf("DKIM record at %s has a different key", name))
+		}
+		if tags["k"] != "" && tags["k"] != "rsa" {
+			problems = append(problems, fmt.Sprintf("DKIM record at %s is for key type %q, not rsa", name, tags["k"]))
+		}
+	}
+
+	spf := false
+	if txts, err := dns_resolver.LookupTXT(ctx, k.Domain); err == nil {
+		for _, txt := range txts {
+			if strings.HasPrefix(strings.ToLower(txt), "v=spf1") {
+				spf = true
+			}
+		}
+	}
+	if !spf {
+		problems = append(problems, fmt.Sprintf("no SPF record at %s naming the servers allowed to send its mail", k.Domain))
+	}
+
+	dmarc := false
+	if txts, err := dns_resolver.LookupTXT(ctx, "_dmarc."+k.Domain); err == nil {
+		for _, txt := range txts {
+			if strings.HasPrefix(strings.ToUpper(txt), "V=DMARC1") {
+				dmarc = true
+			}
+		}
+	}
+	if !dmarc {
+		problems = append(problems, fmt.Sprintf("no DMARC record at _dmarc.%s", k.Domain))
+	}
+	return problems
+}
+
+// admin_dkim is GET /_/admin/dkim[?domain=<domain>]. The domain defaults to
+// that of the email_from setting.
+func admin_dkim(c *gin.Context) {
+	domain := c.Query("domain")
+	if domain == "" {
+		domain = dkim_domain(setting_get("email_from", "mochi-server@localhost"))
+	}
+	domain = dns_zone(domain)
+	if domain == "" {
+		respond_error(c, http.StatusBadRequest, "invalid_domain", "errors.invalid_domain", nil)
+		return
+	}
+	k, err := dkim_key(domain)
+	if err != nil {
+		respond_error(c, http.StatusInternalServerError, "dkim_key", "errors.dkim_key", nil)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"domain":   domain,
+		"selector": k.Selector,
+		"signing":  ini_bool("email", "dkim", true),
+		"records":  dkim_records(k),
+		"problems": dkim_check(k),
+	})
+}
@@ -0,0 +1,129 @@
+// Mochi server: DKIM signing tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+
+	gm "github.com/wneessen/go-mail"
+)
+
+// dkim_test_verify checks a message's signature as a receiver would, given
+// the published record
+func dkim_test_verify(t *testing.T, raw []byte, record string) {
+	t.Helper()
+	header, body, _ := bytes.Cut(raw, []byte("\r\n\r\n"))
+	fields := dkim_fields(string(header))
+	var signature string
+	for _, f := range fields {
+		if strings.HasPrefix(f, "DKIM-Signature:") {
+			signature = f
+		}
+	}
+	if signature == "" {
+		t.Fatal("message is not signed")
+	}
+	tags := dkim_tags(strings.TrimPrefix(signature, "DKIM-Signature:"))
+	hash := sha256.Sum256(dkim_canonical_body(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(hash[:]) || tags["d"] != "mail.example" {
+		t.Fatalf("body hash or domain differs: %v", tags)
+	}
+
+	var signed strings.Builder
+	used := map[int]bool{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if n, _, _ := strings.Cut(fields[i], ":"); !used[i] && strings.EqualFold(n, name) {
+				used[i] = true
+				signed.WriteString(dkim_canonical_header(fields[i]) + "\r\n")
+				break
+			}
+		}
+	}
+	signed.WriteString(dkim_canonical_header(regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(signature, "b=")))
+
+	der, _ := base64.StdEncoding.DecodeString(dkim_tags(strings.NewReplacer(`"`, "", " ", "").Replace(record))["p"])
+	public, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(tags["b"])
+	digest := sha256.Sum256([]byte(signed.String()))
+	if err := rsa.VerifyPKCS1v15(public.(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestDKIM(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	setting_set("email_from", "mochi@mail.example")
+
+	m := email_message("bob@elsewhere.net", "Hello   there")
+	m.SetBodyString(gm.TypeTextPlain, "Some text  \nwith trailing space\n\n\n")
+	m.AddAlternativeString(gm.TypeTextHTML, "<p>Some text</p>")
+	dkim_message(m)
+	var raw bytes.Buffer
+	m.WriteTo(&raw)
+
+	k, err := dkim_key("mail.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := dkim_records(k)
+	if len(records) != 1 || records[0].Name != k.Selector+"._domainkey.mail.example." || !strings.HasPrefix(records[0].Value, `"v=DKIM1; k=rsa; p=`) {
+		t.Fatalf("records %v", records)
+	}
+	for _, s := range regexp.MustCompile(`"[^"]*"`).FindAllString(records[0].Value, -1) {
+		if len(s) > 257 {
+			t.Errorf("TXT string of %d characters", len(s))
+		}
+	}
+	dkim_test_verify(t, raw.Bytes(), records[0].Value)
+
+	// The same key is used again
+	if again, _ := dkim_key("mail.example"); again.public() != k.public() {
+		t.Error("key changed")
+	}
+
+	// The checker finds what's missing, and nothing once it's published
+	zone := &dns_test_zone{txt: map[string][]string{}}
+	dns_test_use(t, zone)
+	if problems := dkim_check(k); len(problems) != 3 {
+		t.Errorf("problems %v", problems)
+	}
+	zone.txt[k.Selector+"._domainkey.mail.example"] = []string{"v=DKIM1; k=rsa; p=AAAA"}
+	zone.txt["mail.example"] = []string{"v=spf1 mx -all"}
+	zone.txt["_dmarc.mail.example"] = []string{"v=DMARC1; p=quarantine"}
+	if problems := dkim_check(k); len(problems) != 1 || !strings.Contains(problems[0], "different key") {
+		t.Errorf("problems %v", problems)
+	}
+	zone.txt[k.Selector+"._domainkey.mail.example"] = []string{strings.NewReplacer(`" "`, "", `"`, "").Replace(records[0].Value)}
+	if problems := dkim_check(k); len(problems) != 0 {
+		t.Errorf("problems %v", problems)
+	}
+
+	// Signing can be turned off
+	t.Setenv("MOCHI_EMAIL_DKIM", "false")
+	m = email_message("bob@elsewhere.net", "Hello")
+	m.SetBodyString(gm.TypeTextPlain, "Text")
+	dkim_message(m)
+	raw.Reset()
+	m.WriteTo(&raw)
+	if strings.Contains(raw.String(), "DKIM-Signature") {
+		t.Error("signed with signing off")
+	}
+}
@@ -0,0 +1,208 @@
+// Mochi server: DNS peer discovery
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	p2p_peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A server can be found through DNS as well as the DHT and the bootstrap
+// peers. Its operator publishes, under a zone they control:
+//
+//	_mochi.<zone>.       TXT "peer=<peer ID>"
+//	_mochi._tcp.<zone>.  SRV 0 0 <port> <host>.
+//	_mochi._udp.<zone>.  SRV 0 0 <port> <host>.
+//
+// the SRV records giving the host and [p2p] port for TCP and QUIC. A server
+// with the zone in [p2p] dns looks the records up at startup and every
+// dns_interval, adds the peer's addresses, and connects to it. mochictl dns
+// prints the records a server should publish, and checks the ones it finds.
+
+const (
+	dns_interval = time.Hour        // Between lookups of each [p2p] dns zone
+	dns_timeout  = 10 * time.Second // For the lookups of one zone
+)
+
+// The lookups discovery makes, replaced in tests
+type dns_lookups interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var (
+	dns_resolver   dns_lookups = net.DefaultResolver
+	dns_match_zone             = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+type DNSPeer struct {
+	Zone      string   `json:"zone"`
+	Peer      string   `json:"peer"`
+	Addresses []string `json:"addresses"`
+}
+
+type DNSRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// dns_zone normalises a zone name, returning "" if it isn't one
+func dns_zone(zone string) string {
+	zone = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(zone)), ".")
+	if len(zone) > 253 || !dns_match_zone.MatchString(zone) {
+		return ""
+	}
+	return zone
+}
+
+// dns_discover looks up the peer a zone publishes, and its addresses
+func dns_discover(zone string) (*DNSPeer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dns_timeout)
+	defer cancel()
+
+	txt, err := dns_resolver.LookupTXT(ctx, "_mochi."+zone)
+	if err != nil {
+		return nil, fmt.Errorf("no TXT record at _mochi.%s: %v", zone, err)
+	}
+	peer := ""
+	for _, record := range txt {
+		for _, field := range strings.Fields(record) {
+			id, found := strings.CutPrefix(field, "peer=")
+			if !found {
+				continue
+			}
+			if _, err := p2p_peer.Decode(id); err != nil {
+				return nil, fmt.Errorf("TXT record at _mochi.%s has invalid peer %q", zone, id)
+			}
+			if peer != "" && peer != id {
+				return nil, fmt.Errorf("TXT records at _mochi.%s list more than one peer", zone)
+			}
+			peer = id
+		}
+	}
+	if peer == "" {
+		return nil, fmt.Errorf("TXT record at _mochi.%s has no peer=", zone)
+	}
+
+	p := &DNSPeer{Zone: zone, Peer: peer, Addresses: []string{}}
+	for _, proto := range []string{"tcp", "udp"} {
+		_, srvs, err := dns_resolver.LookupSRV(ctx, "mochi", proto, zone)
+		if err != nil {
+			continue
+		}
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			ips, err := dns_resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				p.Addresses = append(p.Addresses, dns_address(ip.IP, proto, srv.Port, peer))
+			}
+		}
+	}
+	if len(p.Addresses) == 0 {
+		return nil, fmt.Errorf("no addresses from SRV records at _mochi._tcp.%s or _mochi._udp.%s", zone, zone)
+	}
+	return p, nil
+}
+
+// dns_address is the multiaddr for a peer at an address found through DNS,
+// TCP or QUIC over UDP
+func dns_address(ip net.IP, proto string, port uint16, peer string) string {
+	family := "ip6"
+	if ip.To4() != nil {
+		family = "ip4"
+	}
+	if proto == "udp" {
+		return fmt.Sprintf("/%s/%s/udp/%d/quic-v1/p2p/%s", family, ip, port, peer)
+	}
+	return fmt.Sprintf("/%s/%s/tcp/%d/p2p/%s", family, ip, port, peer)
+}
+
+// dns_records are the records this server should publish under a zone,
+// reached at host
+func dns_records(zone, host, peer string, port int) []DNSRecord {
+	return []DNSRecord{
+		{Name: "_mochi." + zone + ".", Type: "TXT", Value: fmt.Sprintf("%q", "peer="+peer)},
+		{Name: "_mochi._tcp." + zone + ".", Type: "SRV", Value: fmt.Sprintf("0 0 %d %s.", port, host)},
+		{Name: "_mochi._udp." + zone + ".", Type: "SRV", Value: fmt.Sprintf("0 0 %d %s.", port, host)},
+	}
+}
+
+// dns_check compares what a zone publishes with what it should, returning
+// what was found and a problem for each difference
+func dns_check(zone, host, peer string, port int) (*DNSPeer, []string) {
+	problems := []string{}
+	found, err := dns_discover(zone)
+	if err != nil {
+		return nil, append(problems, err.Error())
+	}
+	if found.Peer != peer {
+		problems = append(problems, fmt.Sprintf("TXT record names peer %q, not this server's %q", found.Peer, peer))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dns_timeout)
+	defer cancel()
+	for _, proto := range []string{"tcp", "udp"} {
+		_, srvs, err := dns_resolver.LookupSRV(ctx, "mochi", proto, zone)
+		if err != nil || len(srvs) == 0 {
+			problems = append(problems, fmt.Sprintf("no SRV record at _mochi._%s.%s", proto, zone))
+			continue
+		}
+		for _, srv := range srvs {
+			target := strings.TrimSuffix(srv.Target, ".")
+			if !strings.EqualFold(target, host) {
+				problems = append(problems, fmt.Sprintf("SRV record at _mochi._%s.%s points at %s, not %s", proto, zone, target, host))
+			}
+			if int(srv.Port) != port {
+				problems = append(problems, fmt.Sprintf("SRV record at _mochi._%s.%s has port %d, not [p2p] port %d", proto, zone, srv.Port, port))
+			}
+		}
+	}
+	return found, problems
+}
+
+// dns_manager connects to the peers published under each [p2p] dns zone
+func dns_manager() {
+	var zones []string
+	for _, z := range ini_strings_commas("p2p", "dns") {
+		if zone := dns_zone(z); zone != "" {
+			zones = append(zones, zone)
+		} else {
+			warn("DNS discovery zone %q is not valid", z)
+		}
+	}
+	if len(zones) == 0 {
+		return
+	}
+
+	for {
+		for _, zone := range zones {
+			p, err := dns_discover(zone)
+			if err != nil {
+				info("DNS discovery for %q failed: %v", zone, err)
+				continue
+			}
+			if p.Peer == net_id {
+				continue
+			}
+			debug("DNS discovery found peer %q at %v for %q", p.Peer, p.Addresses, zone)
+			peer_add_known(p.Peer, p.Addresses)
+			go peer_connect_retry(p.Peer)
+		}
+		time.Sleep(dns_interval)
+	}
+}
@@ -0,0 +1,136 @@
+// Mochi server: DNS peer discovery tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+const dns_test_peer = "12D3KooWELMRq3U9TrJE2FJs8pcXSQotDrtXwhajTNV2CN7fWdyR"
+
+// dns_test_zone answers lookups from fixed records
+type dns_test_zone struct {
+	txt map[string][]string
+	srv map[string][]*net.SRV
+	ip  map[string][]net.IPAddr
+}
+
+func (z *dns_test_zone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r, found := z.txt[name]; found {
+		return r, nil
+	}
+	return nil, fmt.Errorf("no such host")
+}
+
+func (z *dns_test_zone) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	key := "_" + service + "._" + proto + "." + name
+	if r, found := z.srv[key]; found {
+		return key, r, nil
+	}
+	return "", nil, fmt.Errorf("no such host")
+}
+
+func (z *dns_test_zone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r, found := z.ip[host]; found {
+		return r, nil
+	}
+	return nil, fmt.Errorf("no such host")
+}
+
+func dns_test_use(t *testing.T, z *dns_test_zone) {
+	saved := dns_resolver
+	dns_resolver = z
+	t.Cleanup(func() { dns_resolver = saved })
+}
+
+func TestDNSZone(t *testing.T) {
+	for in, want := range map[string]string{
+		"Example.COM.":       "example.com",
+		" mochi.example.org": "mochi.example.org",
+		"localhost":          "",
+		"-bad.example.com":   "",
+		"a..example.com":     "",
+		"under_score.com":    "",
+	} {
+		if got := dns_zone(in); got != want {
+			t.Errorf("dns_zone(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDNSDiscover(t *testing.T) {
+	dns_test_use(t, &dns_test_zone{
+		txt: map[string][]string{"_mochi.example.com": {"v=spf1 -all", "peer=" + dns_test_peer}},
+		srv: map[string][]*net.SRV{
+			"_mochi._tcp.example.com": {{Target: "p2p.example.com.", Port: 1443}},
+			"_mochi._udp.example.com": {{Target: "p2p.example.com.", Port: 443}},
+		},
+		ip: map[string][]net.IPAddr{"p2p.example.com": {{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}},
+	})
+
+	p, err := dns_discover("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"/ip4/192.0.2.1/tcp/1443/p2p/" + dns_test_peer,
+		"/ip6/2001:db8::1/tcp/1443/p2p/" + dns_test_peer,
+		"/ip4/192.0.2.1/udp/443/quic-v1/p2p/" + dns_test_peer,
+		"/ip6/2001:db8::1/udp/443/quic-v1/p2p/" + dns_test_peer,
+	}
+	if p.Peer != dns_test_peer || strings.Join(p.Addresses, " ") != strings.Join(want, " ") {
+		t.Errorf("discovered %+v", p)
+	}
+
+	if _, err := dns_discover("example.org"); err == nil {
+		t.Error("zone without records discovered")
+	}
+}
+
+func TestDNSDiscoverInvalid(t *testing.T) {
+	dns_test_use(t, &dns_test_zone{
+		txt: map[string][]string{
+			"_mochi.bad.example":       {"peer=not-a-peer"},
+			"_mochi.two.example":       {"peer=" + dns_test_peer, "peer=12D3KooWRbpjpRmFiK7v6wRXA6yvAtTXXfvSE6xjbHVFFSaxN8SH"},
+			"_mochi.noaddress.example": {"peer=" + dns_test_peer},
+		},
+	})
+	for _, zone := range []string{"bad.example", "two.example", "noaddress.example"} {
+		if p, err := dns_discover(zone); err == nil {
+			t.Errorf("%s discovered as %+v", zone, p)
+		}
+	}
+}
+
+func TestDNSCheck(t *testing.T) {
+	records := dns_records("example.com", "p2p.example.com", dns_test_peer, 1443)
+	if len(records) != 3 || records[0].Value != `"peer=`+dns_test_peer+`"` || records[1].Name != "_mochi._tcp.example.com." || records[2].Value != "0 0 1443 p2p.example.com." {
+		t.Errorf("records %+v", records)
+	}
+
+	dns_test_use(t, &dns_test_zone{
+		txt: map[string][]string{"_mochi.example.com": {"peer=" + dns_test_peer}},
+		srv: map[string][]*net.SRV{
+			"_mochi._tcp.example.com": {{Target: "p2p.example.com.", Port: 1443}},
+			"_mochi._udp.example.com": {{Target: "old.example.com.", Port: 1443}},
+		},
+		ip: map[string][]net.IPAddr{
+			"p2p.example.com": {{IP: net.ParseIP("192.0.2.1")}},
+			"old.example.com": {{IP: net.ParseIP("192.0.2.2")}},
+		},
+	})
+	if _, problems := dns_check("example.com", "p2p.example.com", dns_test_peer, 1443); len(problems) != 1 || !strings.Contains(problems[0], "old.example.com") {
+		t.Errorf("problems %v", problems)
+	}
+	if _, problems := dns_check("example.com", "p2p.example.com", "12D3KooWRbpjpRmFiK7v6wRXA6yvAtTXXfvSE6xjbHVFFSaxN8SH", 4001); len(problems) != 4 {
+		t.Errorf("problems %v", problems)
+	}
+}
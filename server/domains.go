@@ -9,6 +9,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -189,7 +190,7 @@ func domains_init_acme() {
 	domains_acme_manager = &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: domains_host_policy,
-		Cache:      autocert.DirCache(domains_certificates()),
+		Cache:      domains_acme_cache(),
 	}
 	if directory := domains_acme_directory(); directory != "" {
 		domains_acme_manager.Client = &acme.Client{DirectoryURL: directory}
@@ -200,6 +201,58 @@ func domains_init_acme() {
 	}
 }
 
+// domains_acme_cache is where autocert keeps its keys and certificates:
+// the certificates directory, or the secrets provider if one is configured
+func domains_acme_cache() autocert.Cache {
+	dir := autocert.DirCache(domains_certificates())
+	if !secrets_enabled() {
+		return dir
+	}
+	prefix := "acme"
+	if rel, err := filepath.Rel(domains_certificates_base(), string(dir)); err == nil && rel != "." {
+		prefix += "/" + filepath.ToSlash(rel)
+	}
+	return &domains_secrets_cache{dir: dir, prefix: prefix}
+}
+
+// domains_secrets_cache keeps autocert's entries in the secrets provider.
+// Entries still in the certificates directory are moved across as they're
+// read.
+type domains_secrets_cache struct {
+	dir    autocert.DirCache
+	prefix string
+}
+
+func (c *domains_secrets_cache) Get(ctx context.Context, key string) ([]byte, error) {
+	name := c.prefix + "/" + key
+	data, err := secret_get(name)
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, secrets_missing) {
+		return nil, err
+	}
+	data, err = c.dir.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := secret_set(name, data); err != nil {
+		warn("Certificates: unable to move %q into secrets provider: %v", key, err)
+		return data, nil
+	}
+	c.dir.Delete(ctx, key)
+	return data, nil
+}
+
+func (c *domains_secrets_cache) Put(ctx context.Context, key string, data []byte) error {
+	return secret_set(c.prefix+"/"+key, data)
+}
+
+func (c *domains_secrets_cache) Delete(ctx context.Context, key string) error {
+	c.dir.Delete(ctx, key)
+	return secret_delete(c.prefix + "/" + key)
+}
+
 // domains_certificates_migrate copies an existing autocert cache from its old
 // home under cache_dir to domains_certificates(), once, on first start after
 // the move. Without it every install would re-issue every certificate and
@@ -7,7 +7,6 @@
 package main
 
 import (
-	"html"
 	"net/mail"
 	"strings"
 
@@ -25,7 +24,6 @@ func email_tls_policy() gm.TLSPolicy {
 	return gm.NoTLS
 }
 
-// email_send sends a plain text email.
 // email_send_dedup is email_send with a per-user (address, event_id)
 // dedup gate. When event_id is non-empty and the user already received
 // an email for the same (address, event_id) within the TTL window, the
@@ -98,50 +96,38 @@ func email_deliverable(address string) bool {
 	return true
 }
 
+// email_send sends a plain text email.
 func email_send(to string, subject string, body string) {
-	// Never attempt delivery to a reserved / non-deliverable domain (RFC 2606
-	// + 6761): example.com/.net/.org and the .test/.example/.invalid/.localhost
-	// TLDs can never receive mail, so a send only produces a bounce back to the
-	// admin. Test harnesses sign up throwaway @example.com users; this stops
-	// their verification codes from bouncing, on every instance, while real
-	// addresses (including the admin error-mail recipient) are unaffected.
-	if !email_deliverable(to) {
-		debug("Email suppressed to reserved/undeliverable address %q", to)
+	m := email_message(to, subject)
+	if m == nil {
 		return
 	}
-	m := gm.NewMsg()
-
-	from := setting_get("email_from", "mochi-server@localhost")
-	err := m.From(from)
-	if err != nil {
-		info("Email failed to set from address %q: %v", from, err)
-		return
-	}
-	err = m.To(to)
-	if err != nil {
-		info("Email failed to set to address %q: %v", to, err)
-		return
-	}
-	m.Subject(subject)
 	m.SetBodyString(gm.TypeTextPlain, body)
+	email_transmit(m)
+}
 
-	c, err := gm.NewClient(email_host, gm.WithPort(email_port), gm.WithTLSPolicy(email_tls_policy()))
-	if err != nil {
-		info("Email failed to create mail client: %v", err)
-		return
-	}
-	err = c.DialAndSend(m)
-	if err != nil {
-		info("Email failed to send message: %v", err)
-		return
+// email_message starts a message from the server to an address, or returns
+// nil if mail to it is not to be sent
+func email_message(to string, subject string) *gm.Msg {
+	if email_suppressed(to) {
+		debug("Email suppressed to %q after bounces or a complaint", to)
+		return nil
 	}
+	return email_compose(to, subject)
 }
 
-// email_send_html sends an HTML email.
-func email_send_html(to string, subject string, html string) {
+// email_compose starts a message from the server to an address, even if
+// it has been suppressed, or returns nil if it can't receive mail
+func email_compose(to string, subject string) *gm.Msg {
+	// Never attempt delivery to a reserved / non-deliverable domain (RFC 2606
+	// + 6761): example.com/.net/.org and the .test/.example/.invalid/.localhost
+	// TLDs can never receive mail, so a send only produces a bounce back to the
+	// admin. Test harnesses sign up throwaway @example.com users; this stops
+	// their verification codes from bouncing, on every instance, while real
+	// addresses (including the admin error-mail recipient) are unaffected.
 	if !email_deliverable(to) {
 		debug("Email suppressed to reserved/undeliverable address %q", to)
-		return
+		return nil
 	}
 	m := gm.NewMsg()
 
@@ -149,16 +135,25 @@ func email_send_html(to string, subject string, html string) {
 	err := m.From(from)
 	if err != nil {
 		info("Email failed to set from address %q: %v", from, err)
-		return
+		return nil
 	}
 	err = m.To(to)
 	if err != nil {
 		info("Email failed to set to address %q: %v", to, err)
-		return
+		return nil
+	}
+	if path := email_return_path(to); path != "" {
+		if err := m.EnvelopeFrom(path); err != nil {
+			info("Email failed to set return path %q: %v", path, err)
+		}
 	}
 	m.Subject(subject)
-	m.SetBodyString(gm.TypeTextHTML, html)
+	return m
+}
 
+// email_transmit signs a message and hands it to the configured relay
+func email_transmit(m *gm.Msg) {
+	dkim_message(m)
 	c, err := gm.NewClient(email_host, gm.WithPort(email_port), gm.WithTLSPolicy(email_tls_policy()))
 	if err != nil {
 		info("Email failed to create mail client: %v", err)
@@ -171,7 +166,7 @@ func email_send_html(to string, subject string, html string) {
 	}
 }
 
-// email_login_code sends a styled HTML email with a login code, localised to
+// email_login_code sends a templated email with a login code, localised to
 // the given language (BCP 47 tag) via the core label resolver's fallback
 // chain. When `user` is non-nil, the send is deduped per (address, code)
 // so two replicas independently generating the same login round don't
@@ -183,52 +178,17 @@ func email_login_code(user *User, to string, code string, language string) {
 		return
 	}
 
-	subject := resolve_core_label(language, "email.login_code.subject", nil)
-	heading := resolve_core_label(language, "email.login_code.heading", nil)
-	tagline := resolve_core_label(language, "email.login_code.tagline", nil)
 	expiry := resolve_core_label(language, "email.login_code.expiry", nil)
 	ignore := resolve_core_label(language, "email.login_code.ignore", nil)
-
-	// Plain-text part: the same instruction, code, and notice as the HTML, with
-	// the code on its own line. Reuses the tagline/expiry/ignore labels (also
-	// used by the HTML body) so there's a single translated source for each.
-	text := tagline + ":\n\n" + code + "\n\n" + expiry + ". " + ignore + "\n"
-	html_body := `<!DOCTYPE html>
-<html>
-<head>
-  <meta charset="utf-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-</head>
-<body style="margin: 0; padding: 0; background-color: #f4f4f5; font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;">
-  <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="min-height: 100vh;">
-    <tr>
-      <td align="center" style="padding: 40px 20px;">
-        <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="max-width: 440px; background-color: #ffffff; border-radius: 12px; box-shadow: 0 2px 8px rgba(0, 0, 0, 0.08);">
-          <tr>
-            <td style="padding: 40px 40px 32px 40px; text-align: center;">
-              <h1 style="margin: 0 0 8px 0; font-size: 24px; font-weight: 600; color: #18181b;">` + html.EscapeString(heading) + `</h1>
-              <p style="margin: 0; font-size: 15px; color: #71717a;">` + html.EscapeString(tagline) + `</p>
-            </td>
-          </tr>
-          <tr>
-            <td style="padding: 0 40px;">
-              <div style="background-color: #f4f4f5; border-radius: 8px; padding: 24px; text-align: center;">
-                <span style="font-family: 'SF Mono', Monaco, 'Cascadia Code', monospace; font-size: 32px; font-weight: 600; letter-spacing: 4px; color: #18181b;">` + html.EscapeString(code) + `</span>
-              </div>
-            </td>
-          </tr>
-          <tr>
-            <td style="padding: 32px 40px 40px 40px; text-align: center;">
-              <p style="margin: 0; font-size: 14px; color: #a1a1aa;">` + html.EscapeString(expiry+". "+ignore) + `</p>
-            </td>
-          </tr>
-        </table>
-      </td>
-    </tr>
-  </table>
-</body>
-</html>`
-	email_send_multipart(to, subject, text, html_body)
+	email_send_message(to, EmailMessage{
+		Language: language,
+		Subject:  resolve_core_label(language, "email.login_code.subject", nil),
+		Heading:  resolve_core_label(language, "email.login_code.heading", nil),
+		Tagline:  resolve_core_label(language, "email.login_code.tagline", nil),
+		Code:     code,
+		Footer:   expiry + ". " + ignore,
+		Required: true,
+	})
 	if user != nil {
 		email_mark_delivered(user, to, "login:"+code)
 	}
@@ -236,37 +196,18 @@ func email_login_code(user *User, to string, code string, language string) {
 
 // email_send_multipart sends an email with both plain text and HTML parts.
 func email_send_multipart(to string, subject string, text string, html string) {
-	if !email_deliverable(to) {
-		debug("Email suppressed to reserved/undeliverable address %q", to)
-		return
-	}
-	m := gm.NewMsg()
+	email_multipart(email_message(to, subject), text, html)
+}
 
-	from := setting_get("email_from", "mochi-server@localhost")
-	err := m.From(from)
-	if err != nil {
-		info("Email failed to set from address %q: %v", from, err)
+// email_multipart adds plain text and HTML parts to a started message, if
+// there is one, and sends it
+func email_multipart(m *gm.Msg, text string, html string) {
+	if m == nil {
 		return
 	}
-	err = m.To(to)
-	if err != nil {
-		info("Email failed to set to address %q: %v", to, err)
-		return
-	}
-	m.Subject(subject)
 	m.SetBodyString(gm.TypeTextPlain, text)
 	m.AddAlternativeString(gm.TypeTextHTML, html)
-
-	c, err := gm.NewClient(email_host, gm.WithPort(email_port), gm.WithTLSPolicy(email_tls_policy()))
-	if err != nil {
-		info("Email failed to create mail client: %v", err)
-		return
-	}
-	err = c.DialAndSend(m)
-	if err != nil {
-		info("Email failed to send message: %v", err)
-		return
-	}
+	email_transmit(m)
 }
 
 func email_valid(address string) bool {
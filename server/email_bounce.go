@@ -0,0 +1,407 @@
+// Mochi server: Email bounces and complaints
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// When [email] bounces is set, each message goes out with a VERP return
+// path, bounces+<token>@domain, whose token stands for the recipient, so a
+// bounce identifies the address even when the remote server's report is
+// vague. Bounces and feedback-loop complaints reach us either by the MTA
+// posting each message to /_/email/bounce with the [email] bounce_token, or
+// by delivering them to the maildir named by [email] bounce_maildir, which
+// is polled every minute.
+//
+// Only reports delivered to a return path we issued are acted on, so a
+// forged report can't stop mail to an address of its choosing. A hard
+// bounce or a complaint stops further mail to the address at once; soft
+// bounces do after email_soft_limit of them in email_soft_window. Login
+// codes and address verification are sent regardless, so a suppressed user
+// can still sign in.
+// Administrators see each user's deliverability in the user list, and can
+// lift a suppression once an address is fixed.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+const (
+	email_soft_limit     = 5
+	email_soft_window    = 7 * 86400
+	email_bounce_keep    = 90 * 86400
+	email_bounce_maximum = 1 << 20 // Largest bounce message read
+)
+
+// email_verp_match finds a return path, with its token, in a header value
+var email_verp_match = regexp.MustCompile(`(?i)([^\s<>"@,;:]+)\+([0-9a-f]{16})(@[^\s<>"@,;]+)`)
+
+// email_db opens the database of return paths, bounces, suppressions and
+// DKIM keys
+func email_db() *DB {
+	return db_open("db/email.db")
+}
+
+// email_verp_token returns the return path token standing for an address
+func email_verp_token(address string) string {
+	mac := hmac.New(sha256.New, []byte(email_verification_secret()))
+	mac.Write([]byte("verp\n" + strings.ToLower(address)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// email_return_path returns the VERP envelope sender for mail to an
+// address, or "" if bounces are not being collected
+func email_return_path(to string) string {
+	bounces := ini_string("email", "bounces", "")
+	at := strings.LastIndex(bounces, "@")
+	if at < 1 {
+		return ""
+	}
+	token := email_verp_token(to)
+	email_db().exec("insert or ignore into verp (token, address, created) values (?, ?, ?)", token, strings.ToLower(to), now())
+	return bounces[:at] + "+" + token + bounces[at:]
+}
+
+// email_verp_address finds the recipient a bounce is for from the VERP
+// address it was delivered to, or returns ""
+func email_verp_address(header mail.Header) string {
+	bounces := ini_string("email", "bounces", "")
+	at := strings.LastIndex(bounces, "@")
+	if at < 1 {
+		return ""
+	}
+	for _, name := range []string{"Delivered-To", "X-Original-To", "Envelope-To", "X-Envelope-To", "To"} {
+		for _, value := range header[name] {
+			for _, m := range email_verp_match.FindAllStringSubmatch(value, -1) {
+				if !strings.EqualFold(m[1], bounces[:at]) || !strings.EqualFold(m[3], bounces[at:]) {
+					continue
+				}
+				row, _ := email_db().row("select address from verp where token=?", strings.ToLower(m[2]))
+				if address, _ := row["address"].(string); address != "" {
+					return address
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// email_fields parses a block of "Name: value" lines, as found in delivery
+// status and feedback reports, into lower case names and their values
+func email_fields(block string) map[string]string {
+	fields := map[string]string{}
+	last := ""
+	for _, line := range strings.Split(block, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && last != "" {
+			fields[last] += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		last = strings.ToLower(strings.TrimSpace(name))
+		fields[last] = strings.TrimSpace(value)
+	}
+	return fields
+}
+
+// email_report_address strips the address type from a report's recipient
+// field, as in "rfc822; someone@example.org"
+func email_report_address(value string) string {
+	if _, address, found := strings.Cut(value, ";"); found {
+		value = address
+	}
+	return strings.Trim(strings.TrimSpace(value), "<>")
+}
+
+// EmailBounce is one recipient's failure or complaint from a report
+type EmailBounce struct {
+	Address string
+	Kind    string // "hard", "soft" or "complaint"
+	Status  string
+	Detail  string
+}
+
+// email_bounce_parse reads the bounces and complaints in a message
+// delivered to one of our return paths, ignoring any other
+func email_bounce_parse(raw []byte) []EmailBounce {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	verp := email_verp_address(msg.Header)
+	if verp == "" {
+		return nil
+	}
+
+	var found []EmailBounce
+	media, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	report := media == "multipart/report" && params["boundary"] != ""
+	if report {
+		parts := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err != nil {
+				break
+			}
+			kind, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			body, _ := io.ReadAll(io.LimitReader(part, email_bounce_maximum))
+			blocks := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n\n")
+
+			switch kind {
+			case "message/delivery-status":
+				// The first block is about the message, the rest one per recipient
+				for _, block := range blocks[1:] {
+					f := email_fields(block)
+					address := email_report_address(f["final-recipient"])
+					if address == "" {
+						address = email_report_address(f["original-recipient"])
+					}
+					action := strings.ToLower(f["action"])
+					status := f["status"]
+					var b EmailBounce
+					switch {
+					case action == "failed" && strings.HasPrefix(status, "5"):
+						b.Kind = "hard"
+					case action == "failed" || action == "delayed" || strings.HasPrefix(status, "4"):
+						b.Kind = "soft"
+					default:
+						continue
+					}
+					b.Address, b.Status, b.Detail = address, status, f["diagnostic-code"]
+					found = append(found, b)
+				}
+
+			case "message/feedback-report":
+				f := email_fields(blocks[0])
+				found = append(found, EmailBounce{Address: email_report_address(f["original-rcpt-to"]), Kind: "complaint", Detail: f["feedback-type"]})
+			}
+		}
+	}
+
+	// A bounce with no report still tells us, through its return path, that
+	// mail to the address went wrong
+	if !report {
+		found = append(found, EmailBounce{Kind: "soft", Detail: msg.Header.Get("Subject")})
+	}
+
+	// Return paths name exactly one recipient, whatever the report says
+	for i := range found {
+		found[i].Address = verp
+	}
+	return found
+}
+
+// email_bounce_process records the bounces and complaints in a message,
+// returning how many there were
+func email_bounce_process(raw []byte) int {
+	n := 0
+	for _, b := range email_bounce_parse(raw) {
+		if b.Address == "" {
+			continue
+		}
+		email_bounce_record(b)
+		n++
+	}
+	return n
+}
+
+// email_bounce_record stores a bounce or complaint and suppresses the
+// address if it has reached the point where no more mail should be sent
+func email_bounce_record(b EmailBounce) {
+	address := strings.ToLower(strings.TrimSpace(b.Address))
+	db := email_db()
+	db.exec("insert into bounces (address, kind, status, detail, created) values (?, ?, ?, ?, ?)", address, b.Kind, b.Status, b.Detail, now())
+	debug("Email %s bounce for %q: %s %s", b.Kind, address, b.Status, b.Detail)
+
+	switch b.Kind {
+	case "hard", "complaint":
+		email_suppress(address, b.Kind, b.Detail)
+	case "soft":
+		if db.integer("select count(*) from bounces where address=? and kind='soft' and created>?", address, now()-email_soft_window) >= email_soft_limit {
+			email_suppress(address, "soft", b.Detail)
+		}
+	}
+}
+
+// email_suppress stops mail to an address
+func email_suppress(address, reason, detail string) {
+	if email_suppressed(address) {
+		return
+	}
+	email_db().exec("insert or replace into suppressions (address, reason, detail, created) values (?, ?, ?, ?)", address, reason, detail, now())
+	info("Email to %q suppressed after %s bounce", address, reason)
+	audit_email_suppressed(address, reason)
+}
+
+// email_suppressed reports whether mail to an address has been stopped
+func email_suppressed(address string) bool {
+	exists, _ := email_db().exists("select 1 from suppressions where address=?", strings.ToLower(strings.TrimSpace(address)))
+	return exists
+}
+
+// email_deliverability describes whether mail reaches each of a list of
+// addresses: "ok", "deferred" if it has recently soft bounced, or
+// "bounced" or "complained" if it has been suppressed
+func email_deliverability(addresses []string) map[string]string {
+	db := email_db()
+	result := map[string]string{}
+	for _, a := range addresses {
+		result[strings.ToLower(a)] = "ok"
+	}
+	soft, _ := db.rows("select distinct address from bounces where kind='soft' and created>?", now()-email_soft_window)
+	for _, r := range soft {
+		if a, _ := r["address"].(string); result[a] != "" {
+			result[a] = "deferred"
+		}
+	}
+	suppressed, _ := db.rows("select address, reason from suppressions")
+	for _, r := range suppressed {
+		if a, _ := r["address"].(string); result[a] != "" {
+			result[a] = "bounced"
+			if r["reason"] == "complaint" {
+				result[a] = "complained"
+			}
+		}
+	}
+	return result
+}
+
+// users_attach_deliverability adds each user's email deliverability to
+// rows from the users table
+func users_attach_deliverability(rows []map[string]any) {
+	var addresses []string
+	for _, r := range rows {
+		username, _ := r["username"].(string)
+		addresses = append(addresses, username)
+	}
+	status := email_deliverability(addresses)
+	for _, r := range rows {
+		username, _ := r["username"].(string)
+		r["deliverability"] = status[strings.ToLower(username)]
+	}
+}
+
+// email_bounce_manager collects bounces from the maildir, if there is one,
+// and forgets old bounces
+func email_bounce_manager() {
+	for range time.Tick(time.Minute) {
+		email_bounce_maildir()
+		email_db().exec("delete from bounces where created<?", now()-email_bounce_keep)
+	}
+}
+
+// email_bounce_maildir processes and removes each message in the bounce
+// maildir
+func email_bounce_maildir() {
+	dir := ini_string("email", "bounce_maildir", "")
+	if dir == "" {
+		return
+	}
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() {
+				continue
+			}
+			file := filepath.Join(dir, sub, e.Name())
+			f, err := os.Open(file)
+			if err != nil {
+				info("Email bounce %q unreadable: %v", file, err)
+				continue
+			}
+			raw, _ := io.ReadAll(io.LimitReader(f, email_bounce_maximum))
+			f.Close()
+			email_bounce_process(raw)
+			if err := os.Remove(file); err != nil {
+				info("Email bounce %q not removed: %v", file, err)
+			}
+		}
+	}
+}
+
+// web_email_bounce takes a bounce or complaint message posted by the MTA
+func web_email_bounce(c *gin.Context) {
+	token := ini_string("email", "bounce_token", "")
+	given, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" || !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(c.Request.Body, email_bounce_maximum))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recorded": email_bounce_process(raw)})
+}
+
+// mochi.user.email.suppressions() -> list: Addresses mail is no longer sent
+// to (admin only)
+//
+//	address  string — the address
+//	reason   string — "hard", "soft" or "complaint"
+//	detail   string — what the last report said
+//	created  int    — Unix timestamp mail was stopped
+func api_user_email_suppressions(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "users/read"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || !user.administrator() {
+		return sl_error(fn, "not administrator")
+	}
+	rows, err := email_db().rows("select address, reason, detail, created from suppressions order by created desc")
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.user.email.unsuppress(address) -> bool: Allow mail to an address
+// again, forgetting its bounces (admin only)
+func api_user_email_unsuppress(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "users/write"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || !user.administrator() {
+		return sl_error(fn, "not administrator")
+	}
+	var address string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "address", &address); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	address = strings.ToLower(strings.TrimSpace(address))
+	if !email_suppressed(address) {
+		return sl.False, nil
+	}
+	db := email_db()
+	db.exec("delete from suppressions where address=?", address)
+	db.exec("delete from bounces where address=?", address)
+	audit_email_unsuppressed(user.Username, address)
+	return sl.True, nil
+}
@@ -0,0 +1,120 @@
+// Mochi server: Email bounce tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// email_test_dsn returns a delivery status notification for a recipient
+func email_test_dsn(to, recipient, action, status string) string {
+	return "From: MAILER-DAEMON@mx.example.org\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: Undelivered Mail Returned to Sender\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"Your message could not be delivered.\r\n" +
+		"--b1\r\n" +
+		"Content-Type: message/delivery-status\r\n\r\n" +
+		"Reporting-MTA: dns; mx.example.org\r\n\r\n" +
+		"Final-Recipient: rfc822; " + recipient + "\r\n" +
+		"Action: " + action + "\r\n" +
+		"Status: " + status + "\r\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+		"--b1--\r\n"
+}
+
+func TestEmailBounces(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	t.Setenv("MOCHI_EMAIL_BOUNCES", "bounces@mochi.example")
+
+	// The return path stands for the recipient, and brings bounces back to it
+	path := email_return_path("Alice@Mail.Example")
+	if !strings.HasPrefix(path, "bounces+") || !strings.HasSuffix(path, "@mochi.example") || path != email_return_path("alice@mail.example") {
+		t.Fatalf("return path %q", path)
+	}
+	if n := email_bounce_process([]byte(email_test_dsn(path, "someone-else@forwarder.example", "failed", "5.1.1"))); n != 1 || !email_suppressed("alice@mail.example") {
+		t.Errorf("hard bounce recorded %d, suppressed %v", n, email_suppressed("alice@mail.example"))
+	}
+	if email_message("alice@mail.example", "Hello") != nil {
+		t.Error("message started to a suppressed address")
+	}
+
+	// Reports not sent to a return path we issued are ignored
+	if n := email_bounce_process([]byte(email_test_dsn("bounces@mochi.example", "frank@mail.example", "failed", "5.1.1"))); n != 0 || email_suppressed("frank@mail.example") {
+		t.Error("bounce without a return path recorded")
+	}
+	if n := email_bounce_process([]byte(email_test_dsn("bounces+0123456789abcdef@mochi.example", "frank@mail.example", "failed", "5.1.1"))); n != 0 {
+		t.Error("bounce to an unknown return path recorded")
+	}
+
+	// Soft bounces suppress only once they add up; delivered reports are ignored
+	for i := 0; i < email_soft_limit-1; i++ {
+		email_bounce_process([]byte(email_test_dsn(email_return_path("bob@mail.example"), "bob@mail.example", "delayed", "4.4.7")))
+	}
+	email_bounce_process([]byte(email_test_dsn(email_return_path("carol@mail.example"), "carol@mail.example", "delivered", "2.0.0")))
+	status := email_deliverability([]string{"alice@mail.example", "Bob@mail.example", "carol@mail.example"})
+	if status["alice@mail.example"] != "bounced" || status["bob@mail.example"] != "deferred" || status["carol@mail.example"] != "ok" {
+		t.Errorf("deliverability %v", status)
+	}
+	email_bounce_process([]byte(email_test_dsn(email_return_path("bob@mail.example"), "bob@mail.example", "delayed", "4.4.7")))
+	if !email_suppressed("bob@mail.example") {
+		t.Error("soft bounces did not suppress")
+	}
+
+	// Complaints, from a maildir
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "new"), 0700)
+	complaint := "From: fbl@isp.example\r\nTo: " + email_return_path("dave@mail.example") + "\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=feedback-report; boundary=\"b2\"\r\n\r\n" +
+		"--b2\r\nContent-Type: text/plain\r\n\r\nA complaint\r\n" +
+		"--b2\r\nContent-Type: message/feedback-report\r\n\r\nFeedback-Type: abuse\r\nVersion: 1\r\nOriginal-Rcpt-To: <dave@mail.example>\r\n" +
+		"--b2--\r\n"
+	os.WriteFile(filepath.Join(dir, "new", "1"), []byte(complaint), 0600)
+	t.Setenv("MOCHI_EMAIL_BOUNCE_MAILDIR", dir)
+	email_bounce_maildir()
+	if status := email_deliverability([]string{"dave@mail.example"}); status["dave@mail.example"] != "complained" {
+		t.Errorf("complaint %v", status)
+	}
+	if left, _ := os.ReadDir(filepath.Join(dir, "new")); len(left) != 0 {
+		t.Error("maildir message not removed")
+	}
+
+	// The endpoint needs its token
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/_/email/bounce", web_email_bounce)
+	post := func(token string) int {
+		req := httptest.NewRequest("POST", "/_/email/bounce", strings.NewReader(email_test_dsn(email_return_path("erin@mail.example"), "erin@mail.example", "failed", "5.2.1")))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if post("secret") != http.StatusNotFound {
+		t.Error("endpoint open with no token configured")
+	}
+	t.Setenv("MOCHI_EMAIL_BOUNCE_TOKEN", "secret")
+	if post("wrong") != http.StatusNotFound || email_suppressed("erin@mail.example") {
+		t.Error("endpoint took a wrong token")
+	}
+	if post("secret") != http.StatusOK || !email_suppressed("erin@mail.example") {
+		t.Error("endpoint did not record the bounce")
+	}
+}
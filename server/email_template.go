@@ -0,0 +1,220 @@
+// Mochi server: Email templates
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// One layout for every email the server sends, rendered as matching plain
+// text and HTML parts. Mail clients drop <style> blocks and external
+// stylesheets, so all CSS is written inline on each element. Administrators
+// brand the layout with the email_brand_name, email_brand_logo and
+// email_brand_colour settings.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// EmailMessage is the content of a templated email. Only Subject and
+// Heading are needed; each other part is left out when empty.
+type EmailMessage struct {
+	Language string // BCP 47 tag for the layout's own labels
+	Subject  string
+	Heading  string
+	Tagline  string // Shown under the heading
+	Code     string // A code for the user to type, shown large
+	Body     string // Paragraphs separated by blank lines
+	Button   string // Label of a button going to Link
+	Link     string // Absolute http or https URL
+	Footer   string // Small print at the bottom of the card
+	Required bool   // Sent even if the address is suppressed
+}
+
+var (
+	email_colour_re = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+	// Inline styles for each element of the layout. {accent} and {contrast}
+	// are replaced by the brand colour and a text colour readable on it.
+	email_styles = map[string]string{
+		"body":      "margin: 0; padding: 0; background-color: #f4f4f5; font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;",
+		"outer":     "padding: 40px 20px;",
+		"logo":      "display: block; margin: 0 auto 24px auto; max-height: 48px; border: 0;",
+		"card":      "max-width: 440px; background-color: #ffffff; border-radius: 12px; border-top: 4px solid {accent}; box-shadow: 0 2px 8px rgba(0, 0, 0, 0.08);",
+		"header":    "padding: 40px 40px 24px 40px; text-align: center;",
+		"heading":   "margin: 0 0 8px 0; font-size: 24px; font-weight: 600; color: #18181b;",
+		"tagline":   "margin: 0; font-size: 15px; color: #71717a;",
+		"section":   "padding: 0 40px 24px 40px;",
+		"box":       "background-color: #f4f4f5; border-radius: 8px; padding: 24px; text-align: center;",
+		"code":      "font-family: 'SF Mono', Monaco, 'Cascadia Code', monospace; font-size: 32px; font-weight: 600; letter-spacing: 4px; color: #18181b;",
+		"paragraph": "margin: 0 0 12px 0; font-size: 15px; color: #3f3f46; line-height: 1.5;",
+		"action":    "padding: 0 40px 24px 40px; text-align: center;",
+		"button":    "display: inline-block; background-color: {accent}; color: {contrast}; border-radius: 8px; padding: 12px 24px; font-size: 15px; font-weight: 600; text-decoration: none;",
+		"footer":    "padding: 8px 40px 40px 40px; text-align: center;",
+		"small":     "margin: 0; font-size: 14px; color: #a1a1aa;",
+		"signature": "margin: 24px 0 0 0; font-size: 13px; color: #a1a1aa; text-align: center;",
+	}
+
+	email_layout = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html lang="{{.Language}}">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1.0">
+  <title>{{.Subject}}</title>
+</head>
+<body style="{{.S.body}}">
+  <table role="presentation" width="100%" cellspacing="0" cellpadding="0">
+    <tr>
+      <td align="center" style="{{.S.outer}}">
+        {{- if .Logo}}
+        <img src="{{.Logo}}" alt="{{.Name}}" style="{{.S.logo}}">
+        {{- end}}
+        <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="{{.S.card}}">
+          <tr>
+            <td style="{{.S.header}}">
+              <h1 style="{{.S.heading}}">{{.Heading}}</h1>
+              {{- if .Tagline}}
+              <p style="{{.S.tagline}}">{{.Tagline}}</p>
+              {{- end}}
+            </td>
+          </tr>
+          {{- if .Code}}
+          <tr>
+            <td style="{{.S.section}}">
+              <div style="{{.S.box}}">
+                <span style="{{.S.code}}">{{.Code}}</span>
+              </div>
+            </td>
+          </tr>
+          {{- end}}
+          {{- if .Paragraphs}}
+          <tr>
+            <td style="{{.S.section}}">
+              {{- range .Paragraphs}}
+              <p style="{{$.S.paragraph}}">{{range $i, $line := .}}{{if $i}}<br>{{end}}{{$line}}{{end}}</p>
+              {{- end}}
+            </td>
+          </tr>
+          {{- end}}
+          {{- if and .Button .Link}}
+          <tr>
+            <td style="{{.S.action}}">
+              <a href="{{.Link}}" style="{{.S.button}}">{{.Button}}</a>
+            </td>
+          </tr>
+          {{- end}}
+          {{- if .Footer}}
+          <tr>
+            <td style="{{.S.footer}}">
+              <p style="{{.S.small}}">{{.Footer}}</p>
+            </td>
+          </tr>
+          {{- end}}
+        </table>
+        <p style="{{.S.signature}}">{{.Signature}}</p>
+      </td>
+    </tr>
+  </table>
+</body>
+</html>`))
+)
+
+// email_brand returns the name, logo URL and accent colour administrators
+// have set for system emails, falling back to the defaults for any that
+// are missing or invalid
+func email_brand() (name, logo, colour string) {
+	name = strings.TrimSpace(setting_get("email_brand_name", "Mochi"))
+	if name == "" {
+		name = "Mochi"
+	}
+	logo = strings.TrimSpace(setting_get("email_brand_logo", ""))
+	if !strings.HasPrefix(logo, "https://") {
+		logo = ""
+	}
+	colour = setting_get("email_brand_colour", "#18181b")
+	if !email_colour_re.MatchString(colour) {
+		colour = "#18181b"
+	}
+	return name, logo, colour
+}
+
+// email_contrast returns dark or light text, whichever reads better on a
+// background colour
+func email_contrast(colour string) string {
+	rgb, _ := strconv.ParseUint(strings.TrimPrefix(colour, "#"), 16, 32)
+	r, g, b := float64(rgb>>16&0xff), float64(rgb>>8&0xff), float64(rgb&0xff)
+	if 0.299*r+0.587*g+0.114*b > 160 {
+		return "#18181b"
+	}
+	return "#ffffff"
+}
+
+// email_paragraphs splits text into paragraphs at blank lines, and each
+// paragraph into its lines
+func email_paragraphs(text string) [][]string {
+	var paragraphs [][]string
+	for _, p := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		if p = strings.Trim(p, "\n"); strings.TrimSpace(p) != "" {
+			paragraphs = append(paragraphs, strings.Split(p, "\n"))
+		}
+	}
+	return paragraphs
+}
+
+// email_render lays out a message as its plain text and HTML parts
+func email_render(m EmailMessage) (string, string) {
+	name, logo, colour := email_brand()
+	signature := resolve_core_label(m.Language, "email.signature", map[string]any{"server": name})
+	link := m.Link
+	if !strings.HasPrefix(link, "https://") && !strings.HasPrefix(link, "http://") {
+		link = ""
+	}
+
+	var parts []string
+	for _, part := range []string{m.Heading, m.Tagline, m.Code, strings.TrimSpace(m.Body), link, m.Footer, "-- \n" + signature} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	text := strings.Join(parts, "\n\n") + "\n"
+
+	replacer := strings.NewReplacer("{accent}", colour, "{contrast}", email_contrast(colour))
+	styles := make(map[string]template.CSS, len(email_styles))
+	for k, v := range email_styles {
+		styles[k] = template.CSS(replacer.Replace(v))
+	}
+	var out bytes.Buffer
+	err := email_layout.Execute(&out, map[string]any{
+		"S":          styles,
+		"Language":   m.Language,
+		"Subject":    m.Subject,
+		"Heading":    m.Heading,
+		"Tagline":    m.Tagline,
+		"Code":       m.Code,
+		"Paragraphs": email_paragraphs(m.Body),
+		"Button":     m.Button,
+		"Link":       link,
+		"Footer":     m.Footer,
+		"Logo":       logo,
+		"Name":       name,
+		"Signature":  signature,
+	})
+	if err != nil {
+		warn("Email template failed: %v", err)
+	}
+	return text, out.String()
+}
+
+// email_send_message renders a message in the server's layout and sends it
+func email_send_message(to string, m EmailMessage) {
+	text, html := email_render(m)
+	if m.Required {
+		email_multipart(email_compose(to, m.Subject), text, html)
+		return
+	}
+	email_send_multipart(to, m.Subject, text, html)
+}
@@ -0,0 +1,65 @@
+// Mochi server: Email template tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmailRender(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_open("db/settings.db").exec("create table if not exists settings (name text primary key, value text not null)")
+	load_core_labels()
+
+	message := EmailMessage{
+		Language: "en",
+		Subject:  "Hello",
+		Heading:  "Hello <there>",
+		Code:     "123456",
+		Body:     "First line\nsecond line\n\nAnother paragraph",
+		Button:   "Open",
+		Link:     "https://mochi.example/chat/1",
+	}
+	text, html := email_render(message)
+	if text != "Hello <there>\n\n123456\n\nFirst line\nsecond line\n\nAnother paragraph\n\nhttps://mochi.example/chat/1\n\n-- \nSent by Mochi\n" {
+		t.Errorf("text %q", text)
+	}
+	for _, want := range []string{"Hello &lt;there&gt;", "First line<br>second line</p>", `href="https://mochi.example/chat/1"`, "background-color: #18181b; color: #ffffff", "Sent by Mochi"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("html has no %q", want)
+		}
+	}
+	if strings.Contains(html, "<img") || strings.Contains(html, "<style") {
+		t.Error("html has a logo or style block")
+	}
+
+	// Branding, and relative links left out rather than sent broken
+	setting_set("email_brand_name", "Example Co")
+	setting_set("email_brand_logo", "https://example.org/logo.png")
+	setting_set("email_brand_colour", "#fde047")
+	message.Link = "/chat/1"
+	text, html = email_render(message)
+	for _, want := range []string{`<img src="https://example.org/logo.png" alt="Example Co"`, "border-top: 4px solid #fde047", "Sent by Example Co"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("branded html has no %q", want)
+		}
+	}
+	if strings.Contains(html, "<a ") || strings.Contains(text, "/chat/1") {
+		t.Error("relative link was sent")
+	}
+	if email_contrast("#fde047") != "#18181b" || email_contrast("#1e3a8a") != "#ffffff" {
+		t.Error("contrast")
+	}
+
+	setting_set("email_brand_logo", "javascript:alert(1)")
+	setting_set("email_brand_colour", "red; display: none")
+	if _, html = email_render(message); strings.Contains(html, "javascript") || strings.Contains(html, "display: none") {
+		t.Error("invalid branding was used")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
+	"sync"
 	"time"
 
 	sl "go.starlark.net/starlark"
@@ -40,17 +41,66 @@ var api_entity = sls.FromStringDict(sl.String("mochi.entity"), sl.StringDict{
 	"update":      sl.NewBuiltin("mochi.entity.update", api_entity_update),
 })
 
+// Entities are looked up by id or fingerprint for every request to an
+// entity's pages and every event addressed to one, so entity_by_any keeps
+// what it finds, or that it found nothing, for entity_cache_ttl seconds.
+// Local writes to the entities table call entity_invalidate; the time limit
+// bounds how stale a change arriving through replication can be. Callers
+// get a copy, so changing one doesn't change the cache.
+const (
+	entity_cache_ttl   = 30
+	entity_cache_limit = 10000
+)
+
+type entity_cache_entry struct {
+	entity  *Entity
+	expires int64
+}
+
+var (
+	entity_cache      = map[string]entity_cache_entry{}
+	entity_cache_lock sync.Mutex
+)
+
 // Get an entity by id or fingerprint
 func entity_by_any(s string) *Entity {
-	db := db_open("db/users.db")
-	var e Entity
-	if db.scan(&e, "select * from entities where id=?", s) {
+	entity_cache_lock.Lock()
+	c, ok := entity_cache[s]
+	entity_cache_lock.Unlock()
+	if ok && now() < c.expires {
+		if c.entity == nil {
+			return nil
+		}
+		e := *c.entity
 		return &e
 	}
-	if db.scan(&e, "select * from entities where fingerprint=?", s) {
-		return &e
+
+	db := db_open("db/users.db")
+	var e Entity
+	found := db.scan(&e, "select * from entities where id=?", s) || db.scan(&e, "select * from entities where fingerprint=?", s)
+	c = entity_cache_entry{expires: now() + entity_cache_ttl}
+	if found {
+		cached := e
+		c.entity = &cached
+	}
+	entity_cache_lock.Lock()
+	if len(entity_cache) >= entity_cache_limit {
+		entity_cache = map[string]entity_cache_entry{}
+	}
+	entity_cache[s] = c
+	entity_cache_lock.Unlock()
+	if !found {
+		return nil
 	}
-	return nil
+	return &e
+}
+
+// entity_invalidate discards the entity cache. Call after any local write
+// to the entities table.
+func entity_invalidate() {
+	entity_cache_lock.Lock()
+	entity_cache = map[string]entity_cache_entry{}
+	entity_cache_lock.Unlock()
 }
 
 // Create a new entity in the database
@@ -79,10 +129,16 @@ func entity_create(u *User, class string, name string, privacy string, data stri
 	if public == "" {
 		return nil, fmt.Errorf("Unable to find spare entity ID or fingerprint")
 	}
+	stored, err := entity_private_store(public, private)
+	if err != nil {
+		return nil, err
+	}
 
-	db.exec("replace into entities ( id, private, fingerprint, user, parent, class, name, privacy, data, published ) values ( ?, ?, ?, ?, ?, ?, ?, ?, ?, 0 )", public, private, fingerprint, u.UID, parent, class, name, privacy, data)
+	db.exec("replace into entities ( id, private, fingerprint, user, parent, class, name, privacy, data, published ) values ( ?, ?, ?, ?, ?, ?, ?, ?, ?, 0 )", public, stored, fingerprint, u.UID, parent, class, name, privacy, data)
+	entity_invalidate()
+	db.exec("replace into keys ( entity, created ) values ( ?, ? )", public, now())
 
-	e := Entity{ID: public, Private: private, Fingerprint: fingerprint, User: u.UID, Parent: parent, Class: class, Name: name, Privacy: privacy, Data: data, Published: 0}
+	e := Entity{ID: public, Private: stored, Fingerprint: fingerprint, User: u.UID, Parent: parent, Class: class, Name: name, Privacy: privacy, Data: data, Published: 0}
 
 	// Audit log entity/identity creation
 	audit_identity_created(u.Username, public, class)
@@ -115,34 +171,63 @@ func entity_id() (string, string, string) {
 	return "", "", ""
 }
 
-// Re-publish all our entities periodically so the network knows they're still active
+// Re-publish changed entities, and refresh the rest periodically so the
+// network knows they're still active. See directory_refresh.go.
 func entities_manager() {
 	db := db_open("db/users.db")
+	interval := directory_refresh_minimum
+	refreshed := now()
+	changes := 0
 
-	for range time.Tick(time.Hour) {
-		if peers_sufficient() {
-			// Hourly: the republish is what refreshes our directory rows'
-			// attestation (seen), which peers' freshness tiering and the
-			// dead-peer cleanup key on. directory_create keeps the content
-			// signature when nothing changed, so this is cheap.
-			var es []Entity
-			err := db.scans(&es, "select * from entities where privacy='public' and published<?", now()-3600)
-			if err != nil {
-				warn("Database error loading entities for republish: %v", err)
-				continue
-			}
-			for _, e := range es {
-				db.exec("update entities set published=? where id=?", now(), e.ID)
-				directory_create(&e)
-				directory_publish(&e, false)
-				// A tight burst overflows gossipsub's per-peer outbound
-				// queue and the excess is silently dropped (observed live:
-				// only ~40 of a 154-row burst survived); spread the
-				// broadcasts. Reliable delivery to sync peers additionally
-				// rides directory_push_to_peer.
-				time.Sleep(50 * time.Millisecond)
+	for range time.Tick(directory_refresh_tick) {
+		if !peers_sufficient() {
+			continue
+		}
+		var es []Entity
+		err := db.scans(&es, "select * from entities where privacy='public'")
+		if err != nil {
+			warn("Database error loading entities for republish: %v", err)
+			continue
+		}
+
+		// Entities whose content changed are republished in full
+		// straight away. A tight burst overflows gossipsub's per-peer
+		// outbound queue and the excess is silently dropped (observed
+		// live: only ~40 of a 154-row burst survived); spread the
+		// broadcasts. Reliable delivery to sync peers additionally rides
+		// directory_push_to_peer.
+		changed := directory_changed(es)
+		for _, e := range changed {
+			directory_create(&e)
+			directory_publish(&e, false)
+			time.Sleep(50 * time.Millisecond)
+		}
+		changes += len(changed)
+
+		// The rest are re-attested, which refreshes the seen that peers'
+		// freshness tiering and the dead-peer cleanup key on, and sent
+		// as compressed refreshes. directory_create keeps the content
+		// signature when nothing changed, so this is cheap.
+		if now()-refreshed < interval {
+			continue
+		}
+		var rows []Entry
+		directory := db_open("db/directory.db")
+		for _, e := range es {
+			db.exec("update entities set published=? where id=?", now(), e.ID)
+			directory_create(&e)
+			var en Entry
+			if directory.scan(&en, "select * from entries where entity=? and peer=?", e.ID, net_id) {
+				rows = append(rows, en)
 			}
 		}
+		directory_refresh_publish(rows)
+		if len(es) > 0 {
+			entity_invalidate()
+		}
+		interval = directory_refresh_interval(interval, changes)
+		refreshed = now()
+		changes = 0
 	}
 }
 
@@ -158,6 +243,7 @@ func entity_privacy_set(e *Entity, privacy string) error {
 	}
 
 	db_open("db/users.db").exec("update entities set privacy=? where id=?", privacy, e.ID)
+	entity_invalidate()
 	e.Privacy = privacy
 
 	if privacy == "private" {
@@ -182,6 +268,7 @@ func entity_name_set(e *Entity, name string) error {
 	}
 
 	db_open("db/users.db").exec("update entities set name=? where id=?", name, e.ID)
+	entity_invalidate()
 	e.Name = name
 
 	if e.Privacy == "public" {
@@ -216,8 +303,10 @@ func (e *Entity) delete() {
 		udb.exec("delete from group_members where member=? and type='user'", e.ID)
 	}
 
-	// Remove the entity row.
+	// Remove the entity row, and its key if the secrets provider holds it
+	entity_private_forget(e.ID)
 	db.exec("delete from entities where id=?", e.ID)
+	entity_invalidate()
 
 	// Audit log entity deletion
 	audit_identity_deleted(username, e.ID)
@@ -247,7 +336,9 @@ func (e *Entity) delete_local() {
 	}
 
 	entry_delete_self(e.ID)
+	entity_private_forget(e.ID)
 	db.exec("delete from entities where id=?", e.ID)
+	entity_invalidate()
 
 	audit_identity_deleted(username, e.ID)
 }
@@ -482,9 +573,10 @@ func entity_peers_failover_for(from string, id string) []string {
 }
 
 // directory_active_window is the freshness window used by the
-// stream/RPC failover policy. Set to 2× the hourly attestation refresh
-// (entities_manager) so a peer that missed one refresh tick still counts
-// as active. Peers outside this window fall to the stale-fallback tier.
+// stream/RPC failover policy. Set to 2× the longest attestation refresh
+// interval (entities_manager), so a peer that missed one refresh still
+// counts as active. Peers outside this window fall to the stale-fallback
+// tier.
 const directory_active_window = 2 * 60 * 60
 
 // Sign a string using an entity's private key
@@ -500,7 +592,7 @@ func entity_sign(entity string, s string) string {
 		return ""
 	}
 
-	private := base58_decode(e.Private, "")
+	private := base58_decode(entity_private_resolve(e.Private), "")
 	if string(private) == "" {
 		warn("Signature entity %q empty private key", entity)
 		return ""
@@ -578,6 +670,9 @@ func api_entity_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.
 	if user == nil {
 		return sl_error(fn, "no user")
 	}
+	if user_guest(user) {
+		return sl_error(fn, "not available to guests")
+	}
 
 	// Verify the calling app declares the specified class
 	app := t.Local("app").(*App)
@@ -852,6 +947,7 @@ func api_entity_update(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.
 			return sl_error(fn, "unknown parameter %q", key)
 		}
 	}
+	entity_invalidate()
 
 	// Update directory after all changes are applied
 	if changed_to_private {
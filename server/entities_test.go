@@ -0,0 +1,58 @@
+// Mochi server: Entities tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import "testing"
+
+func TestEntityCache(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	entity_invalidate()
+
+	u, _ := user_create("cache@example.com")
+	if u == nil {
+		t.Fatal("user")
+	}
+	e, err := entity_create(u, "person", "Alice", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := entity_by_any(e.ID)
+	if got == nil || got.Name != "Alice" {
+		t.Fatalf("by id: %+v", got)
+	}
+	if f := entity_by_any(e.Fingerprint); f == nil || f.ID != e.ID {
+		t.Errorf("by fingerprint: %+v", f)
+	}
+
+	// Callers get copies
+	got.Name = "Mallory"
+	if again := entity_by_any(e.ID); again.Name != "Alice" {
+		t.Errorf("cache changed through a copy: %q", again.Name)
+	}
+
+	// Writes that bypass the entity functions are seen once the cache is
+	// invalidated; those through them, at once
+	db_open("db/users.db").exec("update entities set data='x' where id=?", e.ID)
+	if again := entity_by_any(e.ID); again.Data != "" {
+		t.Errorf("cached entity read through: %q", again.Data)
+	}
+	if err := entity_name_set(got, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if again := entity_by_any(e.ID); again.Name != "Bob" || again.Data != "x" {
+		t.Errorf("after rename: %+v", again)
+	}
+
+	// Deleted entities are gone at once
+	got.delete_local()
+	if entity_by_any(e.ID) != nil {
+		t.Error("deleted entity found")
+	}
+}
@@ -0,0 +1,170 @@
+// Mochi server: Ephemeral events
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Ephemeral events are for state that is only worth having now: typing
+// indicators, live cursors, presence pings. They are written straight to an
+// already open /mochi/2/messages stream to each of the recipient's peers, or
+// for a recipient on this server pushed directly to their websockets, and
+// are never queued, retried, or stored. A recipient with no open connection
+// simply misses them.
+//
+// Since they skip the queue and the recipient's apps, they are only sent to
+// and accepted from entities the user shares their presence with, so a
+// stranger can't push to a user's browsers. On arrival the event is pushed
+// to the recipient's browsers on a websocket key naming the app, the
+// receiving entity, and the key the sender chose, as {from, key, content}.
+
+const ephemeral_content_limit = 8192
+
+var api_ephemeral = sls.FromStringDict(sl.String("mochi.ephemeral"), sl.StringDict{
+	"send": sl.NewBuiltin("mochi.ephemeral.send", api_ephemeral_send),
+})
+
+func init() {
+	a := app("ephemeral")
+	a.service("ephemeral")
+	a.event("send", ephemeral_event)
+}
+
+// ephemeral_event receives an ephemeral event and passes it to the
+// recipient's websockets
+func ephemeral_event(e *Event) {
+	if e.user == nil || e.from == "" || e.sender_app == "" {
+		return
+	}
+	key := e.get("key", "")
+	if !valid(key, "constant") || !ephemeral_related(e.user, e.from) {
+		return
+	}
+	websockets_send(e.user, ephemeral_key(e.sender_app, e.to, key), map[string]any{"from": e.from, "key": key, "content": e.content["content"]})
+}
+
+// ephemeral_key returns the websocket key an app's ephemeral events for an
+// entity arrive on. Apps can't write to it themselves, as websocket keys
+// they choose can't contain a colon.
+func ephemeral_key(app, entity, key string) string {
+	return "ephemeral:" + app + ":" + entity + ":" + key
+}
+
+// ephemeral_related returns whether a user will exchange ephemeral events
+// with an entity: one of their own, or one they share their presence with
+func ephemeral_related(u *User, entity string) bool {
+	if u.Identity != nil && u.Identity.ID == entity {
+		return true
+	}
+	if owner := user_owning_entity(entity); owner != nil && owner.UID == u.UID {
+		return true
+	}
+	return presence_shared(u, entity)
+}
+
+// ephemeral_peer_send writes a frame to an open stream to a peer without
+// opening one or waiting for room, returning whether it was written
+func ephemeral_peer_send(peer string, f *Frame) bool {
+	senders_lock.Lock()
+	s := senders[peer]
+	senders_lock.Unlock()
+	if s == nil || s.closed.Load() {
+		return false
+	}
+	select {
+	case s.outbox <- &outbound{frame: f}:
+		return true
+	default:
+		return false
+	}
+}
+
+// ephemeral_send delivers an ephemeral event to every reachable location
+// of an entity, returning how many were reached
+func ephemeral_send(m *Message) int {
+	sent := 0
+	key, _ := m.content["key"].(string)
+	content := cbor_encode(m.content)
+	for _, peer := range entity_peers_for(m.From, m.To) {
+		if peer == net_id {
+			if u := user_owning_entity(m.To); u != nil && ephemeral_related(u, m.From) {
+				websockets_send(u, ephemeral_key(m.FromApp, m.To, key), map[string]any{"from": m.From, "key": key, "content": m.content["content"]})
+				sent++
+			}
+			continue
+		}
+		f, err := frame_for_message(m, content)
+		if err != nil {
+			return sent
+		}
+		if ephemeral_peer_send(peer, f) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// mochi.ephemeral.send(to, key, content, from?) -> int: Send an ephemeral
+// event to an entity the user shares their presence with: delivered now to
+// its open connections and browsers, or not at all. Never queued or stored.
+// Returns the number of locations reached.
+func api_ephemeral_send(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var to, key, from string
+	var content sl.Value
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "to", &to, "key", &key, "content", &content, "from?", &from); err != nil {
+		return nil, err
+	}
+
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+	if !rate_limit_net_send.allow(app.id) {
+		return sl_error(fn, "rate limit exceeded (1000 messages per second)")
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+
+	if from == "" {
+		if user.Identity == nil {
+			return sl_error(fn, "no identity")
+		}
+		from = user.Identity.ID
+	} else {
+		owned, err := db_open("db/users.db").exists("select id from entities where id=? and user=?", from, user.UID)
+		if err != nil {
+			return sl_error(fn, "database error: %v", err)
+		}
+		if !owned {
+			return sl_error(fn, "invalid from")
+		}
+	}
+	if !valid(to, "entity") {
+		return sl_error(fn, "invalid to")
+	}
+	if !valid(key, "constant") {
+		return sl_error(fn, "invalid key %q", key)
+	}
+
+	m := message(from, to, "ephemeral", "send")
+	m.content["key"] = key
+	m.content["content"] = sl_decode(content)
+	if len(cbor_encode(m.content)) > ephemeral_content_limit {
+		return sl_error(fn, "content too large")
+	}
+	if !ephemeral_related(user, to) {
+		return sl_error(fn, "presence not shared with recipient")
+	}
+	m.FromApp = app.id
+	m.Services = app_services(app, user)
+
+	return sl.MakeInt(ephemeral_send(m)), nil
+}
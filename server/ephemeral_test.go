@@ -0,0 +1,83 @@
+// Mochi server: Ephemeral event tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestEphemeralPeerSendNeedsOpenStream(t *testing.T) {
+	if ephemeral_peer_send("12D3KooWEphemeralTestPeerWithNoStream", &Frame{Type: frame_type_message}) {
+		t.Error("ephemeral frame written with no open stream")
+	}
+
+	// A full outbox drops the frame rather than waiting
+	s := &Sender{outbox: make(chan *outbound, 1)}
+	senders_lock.Lock()
+	senders["ephemeral-test"] = s
+	senders_lock.Unlock()
+	defer func() {
+		senders_lock.Lock()
+		delete(senders, "ephemeral-test")
+		senders_lock.Unlock()
+	}()
+	if !ephemeral_peer_send("ephemeral-test", &Frame{Type: frame_type_message}) {
+		t.Fatal("ephemeral frame not written to open stream")
+	}
+	if ephemeral_peer_send("ephemeral-test", &Frame{Type: frame_type_message}) {
+		t.Error("ephemeral frame waited on a full outbox")
+	}
+	if ob := <-s.outbox; ob.queue != "" {
+		t.Errorf("ephemeral frame tied to queue row %q", ob.queue)
+	}
+}
+
+func TestEphemeralSendValidation(t *testing.T) {
+	user := &User{UID: "u1", Identity: &Entity{ID: "1EphemeralTestSenderEntityXXXXXXXXXXXXXXXXXXXXXXX"}}
+	thread := create_test_thread(user, create_external_app("chat"))
+	send, _ := api_ephemeral.Attr("send")
+	to := sl.String("1EphemeralTestRecipientEntityXXXXXXXXXXXXXXXXXXXX")
+
+	if _, err := sl.Call(thread, send, sl.Tuple{sl.String("bad"), sl.String("typing"), sl.None}, nil); err == nil {
+		t.Error("invalid recipient accepted")
+	}
+	if _, err := sl.Call(thread, send, sl.Tuple{to, sl.String("no spaces"), sl.None}, nil); err == nil {
+		t.Error("invalid key accepted")
+	}
+	big := sl.String(strings.Repeat("x", ephemeral_content_limit))
+	if _, err := sl.Call(thread, send, sl.Tuple{to, sl.String("typing"), big}, nil); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("oversized content: %v", err)
+	}
+}
+
+func TestEphemeralRelated(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	user := create_permission_test_user(t, "u1")
+	user.Identity = &Entity{ID: "1EphemeralTestSenderEntityXXXXXXXXXXXXXXXXXXXXXXX"}
+	thread := create_test_thread(user, create_external_app("chat"))
+	send, _ := api_ephemeral.Attr("send")
+	to := "1EphemeralTestRecipientEntityXXXXXXXXXXXXXXXXXXXX"
+
+	if _, err := sl.Call(thread, send, sl.Tuple{sl.String(to), sl.String("typing"), sl.True}, nil); err == nil {
+		t.Error("sent to an entity presence isn't shared with")
+	}
+	if !ephemeral_related(user, user.Identity.ID) {
+		t.Error("user's own entity unrelated")
+	}
+	db_user(user, "user").exec("insert into presence_audience (entity, created) values (?, ?)", to, now())
+	if !ephemeral_related(user, to) {
+		t.Error("entity presence is shared with unrelated")
+	}
+	if key := ephemeral_key("chat", to, "typing"); valid(key, "constant") {
+		t.Errorf("apps could write to ephemeral key %q", key)
+	}
+}
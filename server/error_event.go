@@ -114,7 +114,7 @@ func error_dispatch(user *User, app *App, code, reason, service, entity string,
 	if !ok || ae.Function == "" {
 		return
 	}
-	if av.Architecture.Engine != "starlark" {
+	if !av.scripted() {
 		return
 	}
 
@@ -0,0 +1,187 @@
+// Mochi server: Event delivery and read acknowledgements
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	sl "go.starlark.net/starlark"
+)
+
+// A sender asks for acknowledgement with mochi.message.send(..., ack="delivered")
+// or ack="read", which marks the message content with event_ack_content and
+// records a pending ack in queue.db. The receiving server, once the
+// recipient app's handler has run cleanly, replies with a signed event/ack
+// message on the same service; for ack="read" it also keeps a receipt, and
+// replies again when the recipient app calls mochi.message.read(id).
+//
+// Acks are ordinary messages, so their sender is claim-verified by the
+// transport. The sending server only accepts an ack from the entity the
+// message was sent to, and surfaces it to the sending app as an
+// "event/delivered" or "event/read" event, if the app declares one, with
+// content {id, status, time}.
+
+const (
+	event_ack_content   = "_ack"
+	event_ack_event     = "event/ack"
+	event_ack_retention = 30 * 86400
+)
+
+// event_ack_valid reports whether s is a supported acknowledgement level
+func event_ack_valid(s string) bool {
+	return s == "delivered" || s == "read"
+}
+
+// event_ack_request marks an outgoing message as wanting acknowledgement,
+// and records the pending ack for the sending app
+func event_ack_request(m *Message, user *User, app *App, want string) {
+	m.content[event_ack_content] = want
+	db_open("db/queue.db").exec("replace into acks (id, user, app, from_entity, to_entity, service, want, created) values (?, ?, ?, ?, ?, ?, ?, ?)", m.ID, user.UID, app.id, m.From, m.To, m.Service, want, now())
+}
+
+// event_ack_send sends one acknowledgement for a received message
+func event_ack_send(from, to, service, app, id, status string) {
+	m := message(from, to, service, event_ack_event)
+	m.FromApp = app
+	m.content["id"] = id
+	m.content["status"] = status
+	m.content["time"] = now()
+	m.send()
+}
+
+// ack_delivered acknowledges delivery of an event whose handler has run, if
+// the sender asked, and keeps a receipt if they also want to know when it
+// is read
+func (e *Event) ack_delivered() {
+	want, _ := e.content[event_ack_content].(string)
+	if !event_ack_valid(want) || e.from == "" || e.to == "" || e.msg_id == "" || e.user == nil || e.app == nil {
+		return
+	}
+	if want == "read" {
+		db_open("db/queue.db").exec("insert or ignore into receipts (id, user, app, from_entity, to_entity, service, created) values (?, ?, ?, ?, ?, ?, ?)", e.msg_id, e.user.UID, e.app.id, e.from, e.to, e.service, now())
+	}
+	event_ack_send(e.to, e.from, e.service, e.app.id, e.msg_id, "delivered")
+}
+
+// ack_receive handles an acknowledgement of a message this server sent
+func (e *Event) ack_receive() error {
+	if e.from == "" {
+		info("Event dropping unsigned acknowledgement")
+		return nil
+	}
+	if e.user == nil {
+		return nil
+	}
+	id := e.get("id", "")
+	status := e.get("status", "")
+	if id == "" || !event_ack_valid(status) {
+		info("Event dropping invalid acknowledgement from %q", e.from)
+		return nil
+	}
+
+	db := db_open("db/queue.db")
+	row, err := db.row("select app, from_entity, service, want, delivered from acks where id=? and user=? and to_entity=?", id, e.user.UID, e.from)
+	if err != nil || row == nil {
+		// Unknown, expired, or from an entity the message was not sent to
+		return nil
+	}
+	want, _ := row["want"].(string)
+	if status == "delivered" {
+		if event_int64(row["delivered"]) > 0 {
+			return nil
+		}
+		if want == "delivered" {
+			db.exec("delete from acks where id=?", id)
+		} else {
+			db.exec("update acks set delivered=? where id=?", now(), id)
+		}
+	} else {
+		db.exec("delete from acks where id=?", id)
+	}
+
+	app, _ := row["app"].(string)
+	from, _ := row["from_entity"].(string)
+	service, _ := row["service"].(string)
+	event_ack_dispatch(e.user, app, id, e.from, from, service, status, event_int64(e.content["time"]))
+	return nil
+}
+
+// event_ack_dispatch runs the sending app's event/delivered or event/read
+// handler, if it declares one
+func event_ack_dispatch(user *User, app_id, id, from, to, service, status string, at int64) {
+	a := app_by_id(app_id)
+	if a == nil {
+		return
+	}
+	av := a.active(user)
+	if av == nil {
+		return
+	}
+	event := "event/" + status
+	apps_lock.Lock()
+	ae, ok := av.Events[event]
+	apps_lock.Unlock()
+	if !ok {
+		return
+	}
+
+	var db *DB
+	if av.Database.File != "" {
+		db = db_app(user, a)
+		if db == nil {
+			return
+		}
+		defer db.close()
+	}
+	e := &Event{
+		id:      event_id(),
+		msg_id:  id,
+		from:    from,
+		to:      to,
+		service: service,
+		event:   event,
+		content: map[string]any{"id": id, "status": status, "time": at},
+		user:    user,
+		app:     a,
+		db:      db,
+	}
+	if err := e.run_handler(a, av, ae); err != nil {
+		debug("Event %s handler failed for message %q: %v", event, id, err)
+	}
+}
+
+// mochi.message.read(id) -> bool: Tell the sender of a received message
+// that it has been read, if they asked to know. Returns whether a read
+// acknowledgement was sent.
+func api_message_read(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+
+	db := db_open("db/queue.db")
+	row, err := db.row("select from_entity, to_entity, service from receipts where id=? and user=? and app=?", id, user.UID, app.id)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	if row == nil {
+		return sl.False, nil
+	}
+	db.exec("delete from receipts where id=? and user=?", id, user.UID)
+
+	from, _ := row["from_entity"].(string)
+	to, _ := row["to_entity"].(string)
+	service, _ := row["service"].(string)
+	event_ack_send(to, from, service, app.id, id, "read")
+	return sl.True, nil
+}
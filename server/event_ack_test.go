@@ -0,0 +1,71 @@
+// Mochi server: Event acknowledgement tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+const (
+	event_ack_test_from = "1EventAckTestSenderEntityXXXXXXXXXXXXXXXXXXXXXXXX"
+	event_ack_test_to   = "1EventAckTestRecipientEntityXXXXXXXXXXXXXXXXXXXXX"
+)
+
+func event_ack_test_setup(t *testing.T) *User {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	return create_permission_test_user(t, "u1")
+}
+
+func TestEventAckPending(t *testing.T) {
+	user := event_ack_test_setup(t)
+	m := message(event_ack_test_from, event_ack_test_to, "chat", "message")
+	event_ack_request(m, user, create_external_app("chat"), "read")
+	if m.content[event_ack_content] != "read" {
+		t.Fatalf("message not marked for acknowledgement: %v", m.content)
+	}
+	queue := db_open("db/queue.db")
+
+	// An ack from any entity but the recipient is ignored
+	(&Event{from: event_ack_test_from, user: user, content: map[string]any{"id": m.ID, "status": "delivered"}}).ack_receive()
+	if row, _ := queue.row("select delivered from acks where id=?", m.ID); row == nil || event_int64(row["delivered"]) != 0 {
+		t.Fatalf("ack from wrong entity accepted: %v", row)
+	}
+
+	// Delivery keeps the row while a read ack is still owed
+	(&Event{from: event_ack_test_to, user: user, content: map[string]any{"id": m.ID, "status": "delivered"}}).ack_receive()
+	if row, _ := queue.row("select delivered from acks where id=?", m.ID); row == nil || event_int64(row["delivered"]) == 0 {
+		t.Fatalf("delivery not recorded: %v", row)
+	}
+
+	(&Event{from: event_ack_test_to, user: user, content: map[string]any{"id": m.ID, "status": "read"}}).ack_receive()
+	if found, _ := queue.exists("select 1 from acks where id=?", m.ID); found {
+		t.Error("pending ack kept after read")
+	}
+}
+
+func TestEventAckRead(t *testing.T) {
+	user := event_ack_test_setup(t)
+	thread := create_test_thread(user, create_external_app("chat"))
+	read, _ := api_message.Attr("read")
+
+	v, err := sl.Call(thread, read, sl.Tuple{sl.String("unknown")}, nil)
+	if err != nil || v != sl.False {
+		t.Fatalf("read(unknown) = %v, %v", v, err)
+	}
+
+	// A receipt held for another app is not this app's to send
+	db_open("db/queue.db").exec("insert into receipts (id, user, app, from_entity, to_entity, service, created) values ('m1', ?, 'feeds', ?, ?, 'feeds', ?)", user.UID, event_ack_test_from, event_ack_test_to, now())
+	v, err = sl.Call(thread, read, sl.Tuple{sl.String("m1")}, nil)
+	if err != nil || v != sl.False {
+		t.Errorf("read of another app's receipt = %v, %v", v, err)
+	}
+}
@@ -7,9 +7,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	sl "go.starlark.net/starlark"
-	rd "runtime/debug"
 	"strings"
 	"sync"
 
@@ -32,6 +32,8 @@ type Event struct {
 	app             *App
 	db              *DB
 	stream          *Stream
+	key             string // sender's idempotency key, if any
+	replay          bool   // re-run from the event log, not newly received
 }
 
 var (
@@ -152,6 +154,31 @@ func (e *Event) route() error {
 			debug("Event dropping to unknown user %q", e.to)
 			return fmt.Errorf("unknown user %q", e.to)
 		}
+		// Refused as transient, so the sender holds it until the user is
+		// reactivated or the message expires
+		if e.user.Status == "suspended" {
+			debug("Event refusing to suspended user %q", e.to)
+			return fmt.Errorf("suspended user %q", e.to)
+		}
+	}
+
+	// Drop events from blocked peers, rate limited senders, and entities
+	// the recipient has blocked
+	if err := e.moderation_refuse(); err != nil {
+		debug("Event dropping: %v", err)
+		return err
+	}
+
+	// A keyed event already handled is acknowledged again, not reapplied
+	if e.key_seen() {
+		debug("Event dropping duplicate key %q from %q for service %q", e.key, e.from, e.service)
+		return nil
+	}
+
+	// Acknowledgements of messages this server sent are answered from
+	// queue.db, not by an app
+	if e.event == event_ack_event {
+		return e.ack_receive()
 	}
 
 	// Find which app handles this event
@@ -244,6 +271,25 @@ func (e *Event) route() error {
 		}
 	}
 
+	// Merge proposals to a repository of the app, see proposals.go
+	if e.event == "_proposal/submit" {
+		if e.from == "" {
+			info("Event dropping unsigned proposal event")
+			audit_message_rejected("", "unsigned")
+			return fmt.Errorf("unsigned proposal event")
+		}
+		if e.user == nil || e.stream == nil {
+			info("Event dropping proposal event without user or stream")
+			return fmt.Errorf("proposal event requires user and stream")
+		}
+		if !string_in_slice(e.service, e.sender_services) {
+			info("Event dropping proposal event: sender does not handle service %q", e.service)
+			return fmt.Errorf("sender does not handle service %q", e.service)
+		}
+		e.proposal_event_submit()
+		return nil
+	}
+
 	// System broadcast events. Handled internally, bypassing app-level
 	// event registration since every subscription app gets the same
 	// mechanism for free.
@@ -357,6 +403,14 @@ func (e *Event) route() error {
 		}
 	}
 
+	// Check the content against the event's declared input
+	if ae.Input != nil {
+		if failures := schema_validate(ae.Input, schema_content(e.content)); len(failures) > 0 {
+			info("Event dropping %q to app %q with invalid content: %v", e.event, a.id, failures)
+			return errors.New(schema_failures(fmt.Sprintf("content for event %q", e.event), failures))
+		}
+	}
+
 	// Broadcast gap detection. Events carrying _key + _sequence in
 	// content are part of a sequenced broadcast stream from e.peer.
 	// We dedup duplicates, BUFFER out-of-order events in
@@ -449,6 +503,9 @@ func (e *Event) route() error {
 			}
 		}
 	}
+	if handler_err == nil {
+		e.ack_delivered()
+	}
 	return handler_err
 }
 
@@ -463,18 +520,13 @@ func (e *Event) run_handler(a *App, av *AppVersion, ae AppEvent) (handler_err er
 			return fmt.Errorf("no handler for event %q", e.event)
 		}
 
-		defer func() {
-			r := recover()
-			if r != nil {
-				warn("Event handler error: %v\n\n%s", r, string(rd.Stack()))
-				handler_err = fmt.Errorf("handler panic: %v", r)
-			}
-		}()
-
-		ae.internal_function(e)
-		return handler_err
+		if err := fault_recover(e.event, func() { ae.internal_function(e) }); err != nil {
+			fault_log(a, av, e.msg_id, err.(*PanicError))
+			return fmt.Errorf("handler panic: %v", err.(*PanicError).Value)
+		}
+		return nil
 
-	case "starlark":
+	case "starlark", "wasm":
 		if ae.Function == "" {
 			info("Event dropping to event %q in internal app %q for service %q without handler", e.event, a.id, e.service)
 			return fmt.Errorf("no handler for event %q", e.event)
@@ -487,7 +539,11 @@ func (e *Event) run_handler(a *App, av *AppVersion, ae AppEvent) (handler_err er
 		s.set("owner", e.user)
 
 		//debug("App event %s:%s(): %v", a.id, ae.Function, e)
-		s.call(ae.Function, sl.Tuple{e})
+		var p *PanicError
+		if _, err := s.call(ae.Function, sl.Tuple{e}); errors.As(err, &p) {
+			fault_log(a, av, e.msg_id, p)
+			return fmt.Errorf("handler panic: %v", p.Value)
+		}
 		return nil
 
 	default:
@@ -533,11 +589,13 @@ func (e *Event) segment(v any) bool {
 
 // Starlark methods
 func (e *Event) AttrNames() []string {
-	return []string{"content", "dump", "header", "read", "stream", "user", "write"}
+	return []string{"answer", "content", "dump", "header", "read", "stream", "user", "write"}
 }
 
 func (e *Event) Attr(name string) (sl.Value, error) {
 	switch name {
+	case "answer":
+		return sl.NewBuiltin("answer", e.sl_answer), nil
 	case "content":
 		return sl.NewBuiltin("content", e.sl_content), nil
 	case "dump":
@@ -700,10 +758,17 @@ func (e *Event) sl_header(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []
 		// the publisher serving a restricted app to this host's own app-update
 		// loopback while still refusing remote peers.
 		return sl.Bool(net_id != "" && e.peer == net_id), nil
+	case "key":
+		return sl_encode(e.key), nil
+	case "replay":
+		// True when an operator is replaying the event from the event log
+		// after it was first handled
+		return sl.Bool(e.replay), nil
 	default:
 		return sl_error(fn, "invalid header %q", header)
 	}
 }
+
 // split_services is a small helper to split a comma-separated services
 // string into a slice; same logic queue_send_direct uses inline.
 func split_services(s string) []string {
@@ -0,0 +1,216 @@
+// Mochi server: Event log and replay
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	rd "runtime/debug"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Events received from other entities and handled by an app are kept in
+// db/events.db for the number of days in the event_log_retention setting,
+// with the outcome of handling them. After an app bug that mishandled or
+// dropped events is fixed, an operator replays them to the app (mochictl
+// events replay), which re-runs its event handlers in the order the events
+// arrived. Each app has a replay cursor per user, and for all users, so a
+// replay resumes after the last event the previous one reached. Replayed
+// events report e.header("replay") as true, so a handler that must not
+// repeat a side effect can tell. System events (attachments, broadcast
+// control, acknowledgements) and replication are not logged; they have
+// their own resync.
+//
+// A sender may also give a message an idempotency key. The first message
+// from a sender to a service with a key is applied; further ones with the
+// same key within event_key_window are acknowledged without being handled,
+// however they arrived. Replay is not subject to this.
+
+const (
+	event_key_window = 8 * 86400 // Seconds a key is remembered; must outlive queue_max_age
+	event_log_max    = 100000    // Log entries kept at most
+	event_replay_max = 1000      // Events replayed by one request at most
+)
+
+type EventLogEntry struct {
+	Sequence int64  `db:"sequence" json:"sequence"`
+	ID       string `db:"id" json:"id"`
+	User     string `db:"user" json:"user"`
+	App      string `db:"app" json:"app"`
+	From     string `db:"from_entity" json:"from"`
+	To       string `db:"to_entity" json:"to"`
+	Service  string `db:"service" json:"service"`
+	Event    string `db:"event" json:"event"`
+	Key      string `db:"key" json:"key,omitempty"`
+	Result   string `db:"result" json:"result,omitempty"`
+	Received int64  `db:"received" json:"received"`
+}
+
+// key_seen reports whether an event with the same key from the same
+// sender was already handled
+func (e *Event) key_seen() bool {
+	if e.key == "" || e.from == "" || e.replay {
+		return false
+	}
+	has, _ := db_open("db/events.db").exists("select 1 from keys where from_entity=? and to_entity=? and service=? and key=? and received>=?", e.from, e.to, e.service, e.key, now()-event_key_window)
+	return has
+}
+
+// key_mark remembers the key of an event that has been handled
+func (e *Event) key_mark() {
+	if e.key == "" || e.from == "" || e.replay {
+		return
+	}
+	db_open("db/events.db").exec_bg("event key", "replace into keys (from_entity, to_entity, service, key, received) values (?, ?, ?, ?, ?)", e.from, e.to, e.service, e.key, now())
+}
+
+// event_log_retention returns how many days events are logged for, 0 if not
+func event_log_retention() int64 {
+	return atoi(setting_get("event_log_retention", system_settings["event_log_retention"].Default), 0)
+}
+
+// logged reports whether an event is one the log keeps
+func (e *Event) logged() bool {
+	if e.replay || e.app == nil || e.user == nil || e.service == "replication" {
+		return false
+	}
+	switch e.event {
+	case event_ack_event, "broadcast/resync", "broadcast/acknowledge", "broadcast/floor":
+		return false
+	}
+	return !strings.HasPrefix(e.event, "_attachment/")
+}
+
+// log records an event the worker has routed, and the outcome
+func (e *Event) log(data []byte, err error) {
+	if !e.logged() || event_log_retention() <= 0 {
+		return
+	}
+	result := ""
+	if err != nil {
+		result = err.Error()
+	}
+	content, _ := cbor.Marshal(e.content)
+	if data == nil {
+		data = []byte{}
+	}
+	db_open("db/events.db").exec_bg("event log", `insert into log
+		(id, user, app, from_entity, to_entity, service, event, from_app, from_services, peer, key, content, data, result, received)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.msg_id, e.user.UID, e.app.id, e.from, e.to, e.service, e.event, e.sender_app, strings.Join(e.sender_services, ","), e.peer, e.key, content, data, result, now())
+}
+
+// event_log_cleanup drops log entries past retention, the oldest past the
+// count limit, and keys past their window
+func event_log_cleanup() {
+	db := db_open("db/events.db")
+	db.exec_bg("event log cleanup", "delete from log where received < ?", now()-event_log_retention()*86400)
+	db.exec_bg("event log trim", "delete from log where sequence <= (select sequence from log order by sequence desc limit 1 offset ?)", event_log_max)
+	db.exec_bg("event key cleanup", "delete from keys where received < ?", now()-event_key_window)
+}
+
+// event_log_where returns the conditions selecting an app's log entries,
+// optionally only one user's or only failed ones, after a sequence number
+func event_log_where(app, user string, failed bool, after int64) (string, []any) {
+	where, args := "app=? and sequence>?", []any{app, after}
+	if user != "" {
+		where, args = where+" and user=?", append(args, user)
+	}
+	if failed {
+		where += " and result!=''"
+	}
+	return where, args
+}
+
+// event_log_list returns an app's logged events in the order they arrived
+func event_log_list(app, user string, failed bool, after int64, limit int) []EventLogEntry {
+	where, args := event_log_where(app, user, failed, after)
+	var out []EventLogEntry
+	if err := db_open("db/events.db").scans(&out, "select sequence, id, user, app, from_entity, to_entity, service, event, key, result, received from log where "+where+" order by sequence limit ?", append(args, limit)...); err != nil {
+		info("Event log list error: %v", err)
+	}
+	return out
+}
+
+// event_cursor returns the sequence number an app's last replay for a user,
+// or for all users if user is "", reached
+func event_cursor(app, user string) int64 {
+	return db_open("db/events.db").integer64("select coalesce(max(sequence), 0) from cursors where app=? and user=?", app, user)
+}
+
+// event_replay re-runs an app's handlers for its logged events after a
+// sequence number, or after its replay cursor if after is negative. Returns
+// how many were replayed, how many of those failed, and the new cursor.
+func event_replay(app, user string, failed bool, after int64, limit int) (int, int, int64) {
+	if after < 0 {
+		after = event_cursor(app, user)
+	}
+	db := db_open("db/events.db")
+	where, args := event_log_where(app, user, failed, after)
+	rows, err := db.rows("select * from log where "+where+" order by sequence limit ?", append(args, limit)...)
+	if err != nil {
+		info("Event replay select error: %v", err)
+		return 0, 0, after
+	}
+
+	replayed, failures := 0, 0
+	cursor := after
+	for _, r := range rows {
+		str := func(key string) string {
+			v, _ := r[key].(string)
+			return v
+		}
+		// db.rows returns blobs as strings
+		content := map[string]any{}
+		if b := str("content"); b != "" {
+			_ = cbor.Unmarshal([]byte(b), &content)
+		}
+		e := &Event{
+			id:              event_id(),
+			msg_id:          str("id"),
+			from:            str("from_entity"),
+			to:              str("to_entity"),
+			service:         str("service"),
+			event:           str("event"),
+			sender_app:      str("from_app"),
+			sender_services: split_services(str("from_services")),
+			peer:            str("peer"),
+			content:         content,
+			key:             str("key"),
+			replay:          true,
+		}
+		if data := str("data"); data != "" {
+			e.stream = stream_rw(io.NopCloser(strings.NewReader(data)), nil)
+		}
+
+		result := ""
+		if err := e.route_recover(); err != nil {
+			result = err.Error()
+			failures++
+		}
+		replayed++
+		cursor = row_int(r, "sequence")
+		db.exec("update log set result=? where sequence=?", result, cursor)
+	}
+	if replayed > 0 {
+		db.exec("replace into cursors (app, user, sequence, updated) values (?, ?, ?, ?)", app, user, cursor, now())
+	}
+	return replayed, failures, cursor
+}
+
+// route_recover is route, with a handler panic returned as an error
+func (e *Event) route_recover() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			warn("Event replay: handler panic for %q: %v\n%s", e.msg_id, r, rd.Stack())
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return e.route()
+}
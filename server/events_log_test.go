@@ -0,0 +1,137 @@
+// Mochi server: Event log and replay tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+)
+
+const (
+	events_log_test_from = "1EventLogTestSenderEntityXXXXXXXXXXXXXXXXXXXXXXXX"
+	events_log_test_to   = "1EventLogTestRecipientEntityXXXXXXXXXXXXXXXXXXXXX"
+)
+
+// events_log_test_setup creates a user owning the recipient entity and an
+// internal app handling the test service, whose handler records the events
+// it is given. The app has no handler for "reject" events, so they fail.
+func events_log_test_setup(t *testing.T) *[]*Event {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	users := db_open("db/users.db")
+	users.exec("insert into users (uid, username) values ('u1', 'u1@example.com')")
+	users.exec("insert into entities (id, private, fingerprint, user, class, name) values (?, '', 'fp', 'u1', 'person', 'U1')", events_log_test_to)
+
+	var handled []*Event
+	a := app("eventlogtest")
+	a.service("eventlogtest")
+	a.event("update", func(e *Event) {
+		handled = append(handled, e)
+	})
+	t.Cleanup(func() {
+		apps_lock.Lock()
+		delete(apps, "eventlogtest")
+		delete(internal_services, "eventlogtest")
+		apps_lock.Unlock()
+	})
+	return &handled
+}
+
+// events_log_test_receive delivers a frame through a worker, and returns
+// whether it was acknowledged
+func events_log_test_receive(t *testing.T, id, event, key string) bool {
+	t.Helper()
+	r := newFakeReply()
+	w := &app_worker{user: "u1", app: "eventlogtest"}
+	w.handle(&worker_frame{
+		frame: &Frame{Type: frame_type_message, ID: id, From: events_log_test_from, To: events_log_test_to, Service: "eventlogtest", Event: event, Key: key},
+		peer:  "peer-test",
+		reply: r,
+	})
+	return r.ack_count() == 1
+}
+
+func TestEventKeyWindowExceedsQueueAge(t *testing.T) {
+	// A sender retries a message until queue_max_age, so a receiver that
+	// forgot a key sooner could apply a late retry a second time
+	if event_key_window < queue_max_age {
+		t.Fatalf("event_key_window %d shorter than queue_max_age %d", event_key_window, queue_max_age)
+	}
+}
+
+func TestEventKeyDedup(t *testing.T) {
+	handled := events_log_test_setup(t)
+
+	// The same key under different message IDs is applied once, a failed
+	// attempt doesn't use the key up, and other keys are unaffected
+	if events_log_test_receive(t, "m1", "reject", "k1") {
+		t.Fatal("failed event acknowledged")
+	}
+	if !events_log_test_receive(t, "m2", "update", "k1") || !events_log_test_receive(t, "m3", "update", "k1") {
+		t.Fatal("keyed event not acknowledged")
+	}
+	if !events_log_test_receive(t, "m4", "update", "k2") || !events_log_test_receive(t, "m5", "update", "") || !events_log_test_receive(t, "m6", "update", "") {
+		t.Fatal("event not acknowledged")
+	}
+	var ids []string
+	for _, e := range *handled {
+		ids = append(ids, e.msg_id)
+	}
+	if len(ids) != 4 || ids[0] != "m2" || ids[1] != "m4" {
+		t.Fatalf("handled %v, want m2 m4 m5 m6", ids)
+	}
+}
+
+func TestEventReplay(t *testing.T) {
+	handled := events_log_test_setup(t)
+
+	events_log_test_receive(t, "m1", "update", "k1")
+	events_log_test_receive(t, "m2", "reject", "")
+	events_log_test_receive(t, "m3", "update", "")
+
+	logged := event_log_list("eventlogtest", "", false, 0, 100)
+	if len(logged) != 3 || logged[0].User != "u1" || logged[0].Key != "k1" || logged[1].Result == "" || logged[2].Result != "" {
+		t.Fatalf("log = %+v", logged)
+	}
+	if failed := event_log_list("eventlogtest", "", true, 0, 100); len(failed) != 1 || failed[0].ID != "m2" {
+		t.Fatalf("failed log = %+v", failed)
+	}
+
+	// Replay runs the handlers again in order, past the key already used,
+	// and advances the cursor so the next replay resumes after it
+	*handled = nil
+	replayed, failures, cursor := event_replay("eventlogtest", "", false, -1, 2)
+	if replayed != 2 || failures != 1 || cursor != logged[1].Sequence {
+		t.Fatalf("replay = %d, %d, %d", replayed, failures, cursor)
+	}
+	if len(*handled) != 1 || !(*handled)[0].replay || (*handled)[0].msg_id != "m1" {
+		t.Fatalf("replayed %+v", *handled)
+	}
+	if got := event_cursor("eventlogtest", ""); got != cursor {
+		t.Fatalf("cursor = %d, want %d", got, cursor)
+	}
+	replayed, _, cursor = event_replay("eventlogtest", "", false, -1, 100)
+	if replayed != 1 || cursor != logged[2].Sequence {
+		t.Fatalf("second replay = %d, %d", replayed, cursor)
+	}
+	if replayed, _, _ = event_replay("eventlogtest", "", false, -1, 100); replayed != 0 {
+		t.Fatalf("replay past the end replayed %d", replayed)
+	}
+
+	// A replay from the start leaves another user's cursor alone, and
+	// neither replay is logged again
+	if replayed, _, _ = event_replay("eventlogtest", "u1", false, 0, 100); replayed != 3 {
+		t.Fatalf("replay from start = %d", replayed)
+	}
+	if got := event_cursor("eventlogtest", ""); got != logged[2].Sequence {
+		t.Fatalf("all-users cursor moved to %d", got)
+	}
+	if n := len(event_log_list("eventlogtest", "", false, 0, 100)); n != 3 {
+		t.Fatalf("log has %d entries after replay", n)
+	}
+}
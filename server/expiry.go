@@ -0,0 +1,504 @@
+// Mochi server: Key and certificate expiry monitoring
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The expiry monitor looks over the server's certificates, passkeys and
+// entity keys every few hours, and tells the administrators about any that
+// need attention before they become a problem:
+//
+//   - certificates, ACME or installed by hand, expiring within [expiry]
+//     certificates days
+//   - passkeys no one has signed in with for [expiry] passkeys days, likely
+//     lost authenticators
+//   - entity keys older than [expiry] keys days, if set
+//
+// Renewing ACME certificates is autocert's job, but it only starts renewing
+// one once it has been served. The monitor asks for each managed domain's
+// certificate, so renewal starts whether or not anyone has visited, and a
+// missing or expired certificate is issued. An issue that fails is retried
+// with exponential backoff, and shown as failing.
+//
+// The last report is served at /_/admin/expiry, by mochi.server.expiry(),
+// and as Prometheus metrics at /_/admin/metrics and, with [metrics] token
+// set, /_/metrics.
+
+const (
+	expiry_initial_lag     = 5 * time.Minute
+	expiry_interval        = 6 * time.Hour
+	expiry_renew_window    = 30 * 86400 // autocert renews this long before expiry
+	expiry_backoff_base    = 3600
+	expiry_backoff_max     = 86400
+	expiry_list_limit      = 100
+	expiry_check_timeout   = 5 * time.Minute
+	expiry_status_ok       = "ok"
+	expiry_status_warning  = "warning"
+	expiry_status_critical = "critical"
+)
+
+// expiry_certificate is a certificate's state
+type expiry_certificate struct {
+	Domain   string `json:"domain"`
+	Source   string `json:"source"` // "acme", "manual" or "listener"
+	Issuer   string `json:"issuer"`
+	Expires  int64  `json:"expires"`
+	Status   string `json:"status"`
+	Problem  string `json:"problem"`
+	Failures int    `json:"failures"`
+	Retry    int64  `json:"retry"`
+}
+
+// expiry_passkey is a passkey not used for a long time
+type expiry_passkey struct {
+	User    string `json:"user"`
+	Name    string `json:"name"`
+	Created int64  `json:"created"`
+	Used    int64  `json:"used"`
+}
+
+// expiry_key is an old entity key
+type expiry_key struct {
+	Entity  string `json:"entity"`
+	Class   string `json:"class"`
+	Name    string `json:"name"`
+	Created int64  `json:"created"`
+}
+
+// expiry_report is the result of a check. Stale passkeys and old keys are
+// counted in full but listed only up to expiry_list_limit.
+type expiry_report struct {
+	Checked      int64                `json:"checked"`
+	Certificates []expiry_certificate `json:"certificates"`
+	Passkeys     int                  `json:"passkeys"`
+	Stale        int                  `json:"stale"`
+	StaleList    []expiry_passkey     `json:"stale_list"`
+	Keys         int                  `json:"keys"`
+	Oldest       int64                `json:"oldest"`
+	Old          int                  `json:"old"`
+	OldList      []expiry_key         `json:"old_list"`
+}
+
+// expiry_renewal is the backoff state of a domain whose certificate failed
+// to be issued
+type expiry_renewal struct {
+	failures int
+	next     int64
+	problem  string
+}
+
+var (
+	expiry_last     *expiry_report
+	expiry_renewals = map[string]*expiry_renewal{}
+	expiry_lock     sync.Mutex
+	expiry_running  sync.Mutex
+)
+
+// expiry_manager checks periodically
+func expiry_manager() {
+	time.Sleep(expiry_initial_lag)
+	expiry_check()
+	for range time.Tick(expiry_interval) {
+		expiry_check()
+	}
+}
+
+// expiry_check checks everything, alerts about anything new, and keeps the
+// report
+func expiry_check() *expiry_report {
+	expiry_running.Lock()
+	defer expiry_running.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), expiry_check_timeout)
+	defer cancel()
+	n := now()
+	r := &expiry_report{Checked: n, Certificates: expiry_certificates(ctx, n)}
+	expiry_passkeys(r, n)
+	expiry_keys(r, n)
+
+	expiry_lock.Lock()
+	expiry_last = r
+	expiry_lock.Unlock()
+	expiry_alert(r)
+	return r
+}
+
+// expiry_report_get returns the last report, checking now if there isn't
+// one
+func expiry_report_get() *expiry_report {
+	expiry_lock.Lock()
+	r := expiry_last
+	expiry_lock.Unlock()
+	if r == nil {
+		r = expiry_check()
+	}
+	return r
+}
+
+// expiry_days returns a number of days from [expiry]
+func expiry_days(key string, def int) int64 {
+	return int64(ini_int("expiry", key, def)) * 86400
+}
+
+// expiry_leaf returns the first certificate in PEM data
+func expiry_leaf(data []byte) *x509.Certificate {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type == "CERTIFICATE" {
+			c, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil
+			}
+			return c
+		}
+	}
+}
+
+// expiry_certificate_status sets a certificate's status from its expiry
+func expiry_certificate_status(c *expiry_certificate, n int64) {
+	warning := expiry_days("certificates", 21)
+	left := c.Expires - n
+	switch {
+	case c.Expires == 0:
+		c.Status = expiry_status_critical
+		if c.Problem == "" {
+			c.Problem = "no certificate"
+		}
+	case left <= 0:
+		c.Status = expiry_status_critical
+		c.Problem = "expired"
+	case left <= warning/3:
+		c.Status = expiry_status_critical
+	case left <= warning:
+		c.Status = expiry_status_warning
+	default:
+		c.Status = expiry_status_ok
+	}
+	if c.Failures > 0 && c.Status == expiry_status_warning {
+		c.Status = expiry_status_critical
+	}
+}
+
+// expiry_certificates checks each certificate the server serves
+func expiry_certificates(ctx context.Context, n int64) []expiry_certificate {
+	var list []expiry_certificate
+	add := func(c expiry_certificate, leaf *x509.Certificate) {
+		if leaf != nil {
+			c.Expires = leaf.NotAfter.Unix()
+			c.Issuer = leaf.Issuer.CommonName
+		}
+		expiry_certificate_status(&c, n)
+		list = append(list, c)
+	}
+
+	for name, cert := range domains_certs {
+		var leaf *x509.Certificate
+		if len(cert.Certificate) > 0 {
+			leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		add(expiry_certificate{Domain: name, Source: "manual"}, leaf)
+	}
+
+	listeners, _ := web_listeners()
+	managed := false
+	for _, l := range listeners {
+		managed = managed || l.managed()
+		if l.cert == "" {
+			continue
+		}
+		c := expiry_certificate{Domain: l.String(), Source: "listener"}
+		data, err := os.ReadFile(l.cert)
+		if err != nil {
+			c.Problem = err.Error()
+		}
+		add(c, expiry_leaf(data))
+	}
+
+	if domains_acme_manager != nil && managed {
+		for _, d := range domain_list() {
+			if d.TLS == 0 || strings.HasPrefix(d.Domain, "*") || domains_manual_cert(d.Domain) != nil || domains_host_policy(ctx, d.Domain) != nil {
+				continue
+			}
+			add(expiry_acme(ctx, d.Domain, n), expiry_acme_leaf(ctx, d.Domain))
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	return list
+}
+
+// expiry_acme_leaf reads a domain's ACME certificate from autocert's cache
+func expiry_acme_leaf(ctx context.Context, domain string) *x509.Certificate {
+	for _, key := range []string{domain, domain + "+rsa"} {
+		if data, err := domains_acme_manager.Cache.Get(ctx, key); err == nil {
+			if leaf := expiry_leaf(data); leaf != nil {
+				return leaf
+			}
+		}
+	}
+	return nil
+}
+
+// expiry_acme makes sure a domain's ACME certificate is being renewed, and
+// issues it if it is missing or expired, retrying with backoff if that
+// fails
+func expiry_acme(ctx context.Context, domain string, n int64) expiry_certificate {
+	c := expiry_certificate{Domain: domain, Source: "acme"}
+	leaf := expiry_acme_leaf(ctx, domain)
+	if leaf != nil && leaf.NotAfter.Unix()-n > expiry_renew_window {
+		expiry_lock.Lock()
+		delete(expiry_renewals, domain)
+		expiry_lock.Unlock()
+		return c
+	}
+
+	expiry_lock.Lock()
+	state := expiry_renewals[domain]
+	if state == nil {
+		state = &expiry_renewal{}
+		expiry_renewals[domain] = state
+	}
+	due := n >= state.next
+	expiry_lock.Unlock()
+
+	if due {
+		err := expiry_renew(domain)
+		expiry_lock.Lock()
+		if err != nil {
+			state.failures++
+			state.next = n + min(int64(expiry_backoff_base)<<min(state.failures-1, 16), expiry_backoff_max)
+			state.problem = err.Error()
+			warn("Certificate for %q failed to be issued, attempt %d: %v", domain, state.failures, err)
+		} else {
+			state.failures = 0
+			state.next = 0
+			state.problem = ""
+		}
+		expiry_lock.Unlock()
+	}
+
+	expiry_lock.Lock()
+	c.Failures, c.Retry, c.Problem = state.failures, state.next, state.problem
+	expiry_lock.Unlock()
+	return c
+}
+
+// expiry_renew asks autocert for a domain's certificate as a modern browser
+// would, so it gets the ECDSA certificate it would serve. Autocert issues
+// one if there is none or it has expired, and starts renewing it otherwise.
+func expiry_renew(domain string) error {
+	if domains_acme_manager == nil {
+		return fmt.Errorf("no ACME manager")
+	}
+	_, err := domains_acme_manager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:        domain,
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	})
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return fmt.Errorf("certificate not issued")
+	}
+	return err
+}
+
+// expiry_passkeys finds passkeys no one has signed in with for a long time.
+// A passkey never used counts from when it was registered.
+func expiry_passkeys(r *expiry_report, n int64) {
+	stale := expiry_days("passkeys", 365)
+	// Credential IDs are blobs, which come back as either bytes or text
+	id := func(v any) string {
+		switch x := v.(type) {
+		case []byte:
+			return string(x)
+		case string:
+			return x
+		}
+		return ""
+	}
+	used := map[string]int64{}
+	if rows, err := db_open("db/sessions.db").rows("select credential, last from passkeys"); err == nil {
+		for _, row := range rows {
+			used[id(row["credential"])] = row_int(row, "last")
+		}
+	}
+
+	rows, _ := db_open("db/users.db").rows("select c.id, c.name, c.created, u.username from credentials c join users u on u.uid=c.user where c.revoked=0 order by c.created")
+	r.Passkeys = len(rows)
+	for _, row := range rows {
+		p := expiry_passkey{Created: row_int(row, "created"), Used: used[id(row["id"])]}
+		p.User, _ = row["username"].(string)
+		p.Name, _ = row["name"].(string)
+		if stale <= 0 || n-max(p.Created, p.Used) < stale {
+			continue
+		}
+		r.Stale++
+		if len(r.StaleList) < expiry_list_limit {
+			r.StaleList = append(r.StaleList, p)
+		}
+	}
+}
+
+// expiry_keys counts entity keys, and finds those older than [expiry] keys
+// days if set
+func expiry_keys(r *expiry_report, n int64) {
+	old := expiry_days("keys", 0)
+	users := db_open("db/users.db")
+	if row, _ := users.row("select count(*) as count, coalesce(min(created), 0) as oldest from keys"); row != nil {
+		r.Keys = int(row_int(row, "count"))
+		r.Oldest = row_int(row, "oldest")
+	}
+	if old <= 0 {
+		return
+	}
+	if row, _ := users.row("select count(*) as count from keys where created <= ?", n-old); row != nil {
+		r.Old = int(row_int(row, "count"))
+	}
+	rows, _ := users.rows("select k.entity, k.created, e.class, e.name from keys k join entities e on e.id=k.entity where k.created <= ? order by k.created limit ?", n-old, expiry_list_limit)
+	for _, row := range rows {
+		k := expiry_key{Created: row_int(row, "created")}
+		k.Entity, _ = row["entity"].(string)
+		k.Class, _ = row["class"].(string)
+		k.Name, _ = row["name"].(string)
+		r.OldList = append(r.OldList, k)
+	}
+}
+
+// expiry_alert notifies the administrators about what has changed for the
+// worse since they were last told. What they were told is kept in the
+// expiry_alerted setting, so a restart doesn't tell them again.
+func expiry_alert(r *expiry_report) {
+	alerted := map[string]string{}
+	json.Unmarshal([]byte(setting_get("expiry_alerted", "")), &alerted)
+	next := map[string]string{}
+
+	for _, c := range r.Certificates {
+		if c.Status == expiry_status_ok {
+			continue
+		}
+		key := "certificate/" + c.Domain
+		next[key] = c.Status
+		if alerted[key] == c.Status {
+			continue
+		}
+		values := map[string]any{"domain": c.Domain, "days": max(c.Expires-r.Checked, 0) / 86400, "problem": c.Problem}
+		switch {
+		case c.Failures > 0:
+			administrators_notify("certificate/renewal", "/settings/system/status", "expiry.renewal", values)
+		case c.Expires == 0 || c.Expires <= r.Checked:
+			administrators_notify("certificate/expired", "/settings/system/status", "expiry.expired", values)
+		default:
+			administrators_notify("certificate/expiring", "/settings/system/status", "expiry.certificate", values)
+		}
+	}
+
+	counts := []struct {
+		key, topic, label string
+		count             int
+		days              int64
+	}{
+		{"passkeys", "passkey/stale", "expiry.passkeys", r.Stale, expiry_days("passkeys", 365) / 86400},
+		{"keys", "key/old", "expiry.keys", r.Old, expiry_days("keys", 0) / 86400},
+	}
+	for _, c := range counts {
+		if c.count == 0 {
+			continue
+		}
+		next[c.key] = itoa(c.count)
+		if int64(c.count) > atoi(alerted[c.key], 0) {
+			administrators_notify(c.topic, "/settings/system/status", c.label, map[string]any{"count": c.count, "days": c.days})
+		} else {
+			// Fewer than were reported isn't news
+			next[c.key] = alerted[c.key]
+		}
+	}
+
+	if data, err := json.Marshal(next); err == nil && string(data) != setting_get("expiry_alerted", "") {
+		setting_set("expiry_alerted", string(data))
+	}
+}
+
+// expiry_report_map returns the report with integers Starlark keeps as
+// integers
+func expiry_report_map(r *expiry_report) map[string]any {
+	certificates := []map[string]any{}
+	for _, c := range r.Certificates {
+		certificates = append(certificates, map[string]any{"domain": c.Domain, "source": c.Source, "issuer": c.Issuer, "expires": c.Expires, "status": c.Status, "problem": c.Problem, "failures": c.Failures, "retry": c.Retry})
+	}
+	stale := []map[string]any{}
+	for _, p := range r.StaleList {
+		stale = append(stale, map[string]any{"user": p.User, "name": p.Name, "created": p.Created, "used": p.Used})
+	}
+	old := []map[string]any{}
+	for _, k := range r.OldList {
+		old = append(old, map[string]any{"entity": k.Entity, "class": k.Class, "name": k.Name, "created": k.Created})
+	}
+	return map[string]any{
+		"checked":      r.Checked,
+		"certificates": certificates,
+		"passkeys":     map[string]any{"total": r.Passkeys, "stale": r.Stale, "list": stale},
+		"keys":         map[string]any{"total": r.Keys, "oldest": r.Oldest, "old": r.Old, "list": old},
+	}
+}
+
+// admin_expiry returns the last expiry report, or with check=true checks
+// first
+func admin_expiry(c *gin.Context) {
+	var r *expiry_report
+	if c.Query("check") == "true" {
+		r = expiry_check()
+	} else {
+		r = expiry_report_get()
+	}
+	c.JSON(http.StatusOK, expiry_report_map(r))
+}
+
+// mochi.server.expiry(check?) -> dict: The last expiry report, checking
+// first if check is true (admin only). Returns checked (when), certificates
+// (list of domain, source, issuer, expires, status, problem, failures and
+// retry), passkeys (total, stale and list of stale ones) and keys (total,
+// oldest, old and list of old ones).
+func api_server_expiry(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	check := false
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "check?", &check); err != nil {
+		return nil, err
+	}
+	u, _ := t.Local("user").(*User)
+	if u == nil || !u.administrator() {
+		return sl_error(fn, "not administrator")
+	}
+	var r *expiry_report
+	if check {
+		r = expiry_check()
+	} else {
+		r = expiry_report_get()
+	}
+	return sl_encode(expiry_report_map(r)), nil
+}
@@ -0,0 +1,112 @@
+// Mochi server: Key and certificate expiry monitoring tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expiry_test_certificate makes a self-signed certificate expiring after a
+// number of days
+func expiry_test_certificate(t *testing.T, name string, days int) *tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		Issuer:       pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Duration(days) * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestExpiryCertificateStatus(t *testing.T) {
+	n := now()
+	cases := []struct {
+		expires  int64
+		failures int
+		want     string
+	}{
+		{n + 60*86400, 0, expiry_status_ok},
+		{n + 14*86400, 0, expiry_status_warning},
+		{n + 14*86400, 2, expiry_status_critical},
+		{n + 3*86400, 0, expiry_status_critical},
+		{n - 1, 0, expiry_status_critical},
+		{0, 0, expiry_status_critical},
+	}
+	for _, c := range cases {
+		cert := expiry_certificate{Expires: c.expires, Failures: c.failures}
+		expiry_certificate_status(&cert, n)
+		if cert.Status != c.want {
+			t.Errorf("expires in %d, %d failures: %q, want %q", c.expires-n, c.failures, cert.Status, c.want)
+		}
+	}
+}
+
+func TestExpiryCheck(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	saved := domains_certs
+	domains_certs = map[string]*tls.Certificate{
+		"old.example.com": expiry_test_certificate(t, "old.example.com", 5),
+		"new.example.com": expiry_test_certificate(t, "new.example.com", 80),
+	}
+	t.Cleanup(func() { domains_certs = saved })
+
+	u, _ := user_create("admin@example.com")
+	if _, err := entity_create(u, "person", "Admin", "private", ""); err != nil {
+		t.Fatal(err)
+	}
+	users := db_open("db/users.db")
+	users.exec("insert into credentials (id, user, public_key, name, created) values (?, ?, ?, 'Old key', ?)", []byte("old"), u.UID, []byte("k"), now()-400*86400)
+	users.exec("insert into credentials (id, user, public_key, name, created) values (?, ?, ?, 'Used key', ?)", []byte("used"), u.UID, []byte("k"), now()-400*86400)
+	db_open("db/sessions.db").exec("insert into passkeys (credential, user, last) values (?, ?, ?)", []byte("used"), u.UID, now())
+
+	r := expiry_check()
+	if len(r.Certificates) != 2 || r.Certificates[0].Domain != "new.example.com" {
+		t.Fatalf("certificates %+v", r.Certificates)
+	}
+	if r.Certificates[0].Status != expiry_status_ok || r.Certificates[1].Status != expiry_status_critical {
+		t.Errorf("statuses %q, %q", r.Certificates[0].Status, r.Certificates[1].Status)
+	}
+	if r.Passkeys != 2 || r.Stale != 1 || r.StaleList[0].Name != "Old key" {
+		t.Errorf("passkeys %d, stale %d %+v", r.Passkeys, r.Stale, r.StaleList)
+	}
+	if r.Keys != 1 || r.Oldest == 0 || r.Old != 0 {
+		t.Errorf("keys %d, oldest %d, old %d", r.Keys, r.Oldest, r.Old)
+	}
+
+	// What the administrators were told is remembered
+	alerted := setting_get("expiry_alerted", "")
+	if !strings.Contains(alerted, `"certificate/old.example.com":"critical"`) || !strings.Contains(alerted, `"passkeys":"1"`) || strings.Contains(alerted, "new.example.com") {
+		t.Errorf("alerted %s", alerted)
+	}
+
+	var b strings.Builder
+	metrics_write(&b)
+	for _, line := range []string{"mochi_passkeys_stale 1\n", "mochi_entity_keys 1\n", `mochi_certificate_expiry_timestamp_seconds{domain="old.example.com",source="manual"} `} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("metrics missing %q", line)
+		}
+	}
+}
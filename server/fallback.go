@@ -68,23 +68,18 @@ func fallback_enabled() bool {
 	return web_https_enabled()
 }
 
-// web_https_enabled mirrors web.go's own condition for serving HTTPS:
-// port 443 is among the configured web ports and at least one domain is
-// configured (the web server serves HTTPS only on 443). This is the
-// signal that a usable certificate exists for the WSS half to share.
+// web_https_enabled mirrors web.go's own condition for serving HTTPS on
+// 443: a listener with managed certificates on port 443, which from [web]
+// ports needs at least one domain configured. This is the signal that a
+// usable certificate exists for the WSS half to share.
 func web_https_enabled() bool {
-	ports := ini_ints_commas("web", "ports")
-	if len(ports) == 0 {
-		ports = []int{ini_int("web", "port", 80)}
-	}
-	served := false
-	for _, p := range ports {
-		if p == 443 {
-			served = true
-			break
+	listeners, _ := web_listeners()
+	for _, l := range listeners {
+		if l.managed() && l.port() == "443" {
+			return len(domain_list()) > 0
 		}
 	}
-	return served && len(domain_list()) > 0
+	return false
 }
 
 // fallback_listen_addresses are the extra libp2p listen multiaddrs for
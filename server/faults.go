@@ -0,0 +1,146 @@
+// Mochi server: Fault isolation for app actions and events
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	rd "runtime/debug"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A panic while running an app - in a Starlark built-in, or in an internal
+// app's Go handler - is recovered where it happens and becomes a PanicError,
+// so one misbehaving app fails its own request or event and nothing else.
+// The developer diagnostics, with the app, its version, the function, the
+// request id and the stack, go to the log; the person using the app gets a
+// page or a JSON error carrying only the request id, to quote when they
+// report it. Every request is given an id, returned in X-Request-Id.
+
+// PanicError is a recovered panic from an app
+type PanicError struct {
+	Function string
+	Value    any
+	Stack    []byte
+}
+
+// Error implements the error interface
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Starlark call %q panicked: %v", e.Function, e.Value)
+}
+
+var request_id_valid = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// web_request_id gives each request an id, keeping one set by a proxy in
+// front of the server so the two logs can be matched up
+func web_request_id(c *gin.Context) {
+	id := c.GetHeader("X-Request-Id")
+	if !request_id_valid.MatchString(id) {
+		id = random_alphanumeric(16)
+	}
+	c.Set("request", id)
+	c.Header("X-Request-Id", id)
+	c.Next()
+}
+
+// request_id returns the id of a request
+func request_id(c *gin.Context) string {
+	if c == nil {
+		return ""
+	}
+	return c.GetString("request")
+}
+
+// fault_recover runs an internal app's handler, returning a panic as a
+// PanicError
+func fault_recover(function string, run func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Function: function, Value: r, Stack: rd.Stack()}
+		}
+	}()
+	run()
+	return nil
+}
+
+// fault_log logs a panic in an app, for its developer
+func fault_log(a *App, av *AppVersion, request string, p *PanicError) {
+	id, version := "", ""
+	if a != nil {
+		id = a.id
+	}
+	if av != nil {
+		version = av.Version
+	}
+	warn("App %s version %s: %s() panicked (request %s): %v\n\n%s", id, version, p.Function, request, p.Value, p.Stack)
+}
+
+// app_fault answers a request whose app failed with a panic
+func app_fault(c *gin.Context, a *App, av *AppVersion, err error) bool {
+	var p *PanicError
+	if !errors.As(err, &p) {
+		return false
+	}
+	fault_log(a, av, request_id(c), p)
+	if !c.Writer.Written() {
+		id := ""
+		if a != nil {
+			id = a.id
+		}
+		fault_respond(c, id)
+	}
+	return true
+}
+
+// fault_respond writes the error the person using a failed app sees: a page
+// for browsers, and a JSON error for everything else
+func fault_respond(c *gin.Context, app string) {
+	request := request_id(c)
+	c.Header("Cache-Control", "no-store")
+	accept := c.GetHeader("Accept")
+	if !strings.Contains(accept, "text/html") || strings.Contains(accept, "application/json") {
+		lang := request_language(c, nil)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error":   "app_failed",
+			"message": resolve_core_label(lang, "errors.app_failed", nil),
+			"app":     app,
+			"request": request,
+		})
+		return
+	}
+
+	lang := request_language(c, nil)
+	label := func(key string) string {
+		return html.EscapeString(resolve_core_label(lang, "fault."+key, map[string]any{"request": request}))
+	}
+	var b strings.Builder
+	b.WriteString(`<!doctype html><html lang="` + html.EscapeString(lang) + `" dir="` + language_direction(lang) + `"><meta charset=utf-8><meta name=viewport content="width=device-width, initial-scale=1"><title>` + label("title") + `</title>`)
+	b.WriteString(`<style>body{font-family:system-ui,sans-serif;max-width:32em;margin:4em auto;padding:0 1em;color:#333;text-align:center}code{font-size:.9em}a{color:inherit}</style>`)
+	b.WriteString(`<h1>` + label("title") + `</h1><p>` + label("body") + `</p>`)
+	if request != "" {
+		b.WriteString(`<p><code>` + label("reference") + `</code></p>`)
+	}
+	b.WriteString(`<p><a href="/">` + label("home") + `</a></p>`)
+	c.Data(http.StatusInternalServerError, "text/html; charset=utf-8", []byte(b.String()))
+	c.Abort()
+}
+
+// web_recovery answers a request whose handler panicked outside an app. gin
+// has already logged the panic and its stack.
+func web_recovery(c *gin.Context, r any) {
+	warn("Web panic (request %s) %s %q: %v", request_id(c), c.Request.Method, web_log_redact(c.Request.URL.Path), r)
+	if c.Writer.Written() {
+		c.Abort()
+		return
+	}
+	fault_respond(c, "")
+}
@@ -0,0 +1,110 @@
+// Mochi server: Fault isolation tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+func TestFaultStarlark(t *testing.T) {
+	load_core_labels()
+	gin.SetMode(gin.TestMode)
+	original_sem := starlark_sem
+	original_timeout := starlark_default_timeout
+	starlark_sem = make(chan struct{}, 1)
+	starlark_default_timeout = 5 * time.Second
+	t.Cleanup(func() {
+		starlark_sem = original_sem
+		starlark_default_timeout = original_timeout
+	})
+
+	broken := sl.NewBuiltin("broken", func(_ *sl.Thread, _ *sl.Builtin, _ sl.Tuple, _ []sl.Tuple) (sl.Value, error) {
+		var m map[string]int
+		m["x"] = 1
+		return sl.None, nil
+	})
+	s := &Starlark{thread: &sl.Thread{Name: "test"}, globals: sl.StringDict{"broken": broken}}
+	globals, err := sl.ExecFile(s.thread, "test.star", "def action_run(a):\n    return broken()\n", s.globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.globals = globals
+
+	_, err = s.call("action_run", sl.Tuple{sl.None})
+	var p *PanicError
+	if !errors.As(err, &p) || p.Function != "action_run" || len(p.Stack) == 0 {
+		t.Fatalf("error %v", err)
+	}
+
+	a := &App{id: "broken"}
+	av := &AppVersion{Version: "1.0"}
+	for _, accept := range []string{"application/json", "text/html"} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/broken/", nil)
+		c.Request.Header.Set("Accept", accept)
+		c.Set("request", "abc123")
+		if !app_fault(c, a, av, err) {
+			t.Fatal("panic not handled")
+		}
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status %d", accept, w.Code)
+		}
+		if accept == "text/html" {
+			if !strings.Contains(w.Body.String(), "abc123") || strings.Contains(w.Body.String(), "map") {
+				t.Errorf("page %q", w.Body.String())
+			}
+			continue
+		}
+		var body map[string]any
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if body["error"] != "app_failed" || body["app"] != "broken" || body["request"] != "abc123" {
+			t.Errorf("response %v", body)
+		}
+	}
+
+	// Other errors are left to the caller
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	if app_fault(c, a, av, errors.New("failed")) || c.Writer.Written() {
+		t.Error("handled an error that wasn't a panic")
+	}
+
+	// Internal apps' handlers too
+	if err := fault_recover("action", func() { panic("broken") }); !errors.As(err, &p) || p.Value != "broken" {
+		t.Errorf("internal handler %v", err)
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(web_request_id)
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, request_id(c)) })
+
+	for given, kept := range map[string]bool{"": false, "proxy-1.2_3": true, "bad id": false, strings.Repeat("a", 65): false} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		if given != "" {
+			req.Header.Set("X-Request-Id", given)
+		}
+		r.ServeHTTP(w, req)
+		id := w.Header().Get("X-Request-Id")
+		if id == "" || id != w.Body.String() || (id == given) != kept {
+			t.Errorf("given %q: id %q, body %q", given, id, w.Body.String())
+		}
+	}
+}
@@ -5,7 +5,8 @@
 // Mochi Application Interface Exception - see license.txt and license-exception.md.
 //
 // FCM HTTP v1 push delivery. The server admin pastes a Firebase service
-// account JSON into the "fcm.service_account" setting; we mint an OAuth2
+// account JSON into the "fcm.service_account" setting, or names its file
+// with [push] fcm in mochi.conf; we mint an OAuth2
 // access token (RS256-signed JWT exchanged for a Bearer token), cache it
 // for ~50 min, and POST the message envelope to
 // https://fcm.googleapis.com/v1/projects/<project_id>/messages:send.
@@ -33,6 +34,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -88,10 +90,36 @@ func account_deliver_fcm(data map[string]any, title, body, link, tag, app, id st
 	if token == "" {
 		return false, true, "Account has no token"
 	}
+	return fcm_send(token, map[string]string{
+		"title": title,
+		"body":  body,
+		"link":  link,
+		"tag":   tag,
+		"app":   app,
+		"id":    id,
+	})
+}
+
+// fcm_credentials returns the service account JSON: the file named by
+// [push] fcm in mochi.conf, or else the fcm.service_account setting
+func fcm_credentials() string {
+	if file := ini_string("push", "fcm", ""); file != "" {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			warn("FCM: read service account %q: %v", file, err)
+			return ""
+		}
+		return string(raw)
+	}
+	return setting_get("fcm.service_account", "")
+}
 
-	sa_raw := setting_get("fcm.service_account", "")
+// fcm_send sends a data message to an FCM token, returning as
+// account_deliver_fcm does
+func fcm_send(token string, data map[string]string) (success bool, retire bool, detail string) {
+	sa_raw := fcm_credentials()
 	if sa_raw == "" {
-		debug("FCM: account_deliver_fcm called but fcm.service_account is empty")
+		debug("FCM: send called but no service account is configured")
 		return false, false, "FCM service account not configured"
 	}
 	sa, err := fcm_parse_service_account(sa_raw)
@@ -114,14 +142,7 @@ func account_deliver_fcm(data map[string]any, title, body, link, tag, app, id st
 			// routing and the pending intent shape. No "notification"
 			// field, which would let Android post a default-styled
 			// notification on its own.
-			"data": map[string]string{
-				"title": title,
-				"body":  body,
-				"link":  link,
-				"tag":   tag,
-				"app":   app,
-				"id":    id,
-			},
+			"data": data,
 		},
 	}
 
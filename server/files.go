@@ -14,7 +14,6 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
-	"time"
 
 	sl "go.starlark.net/starlark"
 	sls "go.starlark.net/starlarkstruct"
@@ -501,24 +500,3 @@ func temporary_configure() {
 		warn("Unable to set TMPDIR to %s: %v", temporary, err)
 	}
 }
-
-// Periodically clean expired cache files
-func cache_manager() {
-	for range time.Tick(1 * time.Hour) {
-		cache_cleanup()
-	}
-}
-
-// Remove cache files older than cache_max_age
-func cache_cleanup() {
-	cutoff := time.Now().Add(-cache_max_age)
-	filepath.Walk(cache_dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
-		if info.ModTime().Before(cutoff) {
-			os.Remove(path)
-		}
-		return nil
-	})
-}
@@ -0,0 +1,321 @@
+// Mochi server: Image focal points and cropped variants
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/nfnt/resize"
+	sl "go.starlark.net/starlark"
+)
+
+// A card of a different shape from its image shows only part of it. Cropped
+// variants choose that part: "<variant>-<width>x<height>", such as
+// "preview-16x9" or "thumbnail-1x1", is the largest part of the image in
+// that aspect ratio, then sized like the variant it's named after. The part
+// is centred as nearly as it can be on the image's focal point, which its
+// uploader sets with mochi.attachment.focus; for an image without one it's
+// the part holding the most detail, which is usually the subject rather
+// than sky or wall. Cropped variants are generated on request, and removed
+// when the focal point moves.
+
+const (
+	crop_ratio_max = 16  // Largest term of a crop's aspect ratio
+	crop_sample    = 128 // Size an image is reduced to when looking for detail
+)
+
+// variant_crop parses a cropped variant's name into the variant it's sized
+// like and its aspect ratio. Ratios must be in lowest terms, so each shape
+// has one name.
+func variant_crop(variant string) (string, int, int, bool) {
+	base, ratio, found := strings.Cut(variant, "-")
+	if !found || (base != "thumbnail" && base != "preview" && variant_presets[base] == 0) {
+		return "", 0, 0, false
+	}
+	ws, hs, found := strings.Cut(ratio, "x")
+	w, werr := strconv.Atoi(ws)
+	h, herr := strconv.Atoi(hs)
+	if !found || werr != nil || herr != nil || w < 1 || h < 1 || w > crop_ratio_max || h > crop_ratio_max || gcd(w, h) != 1 || ws != strconv.Itoa(w) || hs != strconv.Itoa(h) {
+		return "", 0, 0, false
+	}
+	return base, w, h, true
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// focus_parse reads a stored focal point, "x,y" as fractions of the image's
+// width and height from its top left
+func focus_parse(focus string) (float64, float64, bool) {
+	xs, ys, found := strings.Cut(focus, ",")
+	x, xerr := strconv.ParseFloat(xs, 64)
+	y, yerr := strconv.ParseFloat(ys, 64)
+	if !found || xerr != nil || yerr != nil || !focus_valid(x) || !focus_valid(y) {
+		return 0, 0, false
+	}
+	return x, y, true
+}
+
+// focus_format stores a focal point
+func focus_format(x, y float64) string {
+	return strconv.FormatFloat(x, 'f', 3, 64) + "," + strconv.FormatFloat(y, 'f', 3, 64)
+}
+
+func focus_valid(f float64) bool {
+	return f >= 0 && f <= 1
+}
+
+// focus_number reads a coordinate from a decoded value, which CBOR may have
+// turned into an integer if it was 0 or 1
+func focus_number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// crop_rect returns the largest part of an image with aspect ratio w:h,
+// centred as nearly as possible on the focal point, or if there isn't one
+// on the most detailed part
+func crop_rect(i image.Image, w, h int, focus string) image.Rectangle {
+	b := i.Bounds()
+	width, height := b.Dx(), b.Dy()
+	cw, ch := width, height
+	if width*h > height*w {
+		cw = max(height*w/h, 1)
+	} else {
+		ch = max(width*h/w, 1)
+	}
+
+	x, y := 0, 0
+	fx, fy, focused := focus_parse(focus)
+	if cw < width {
+		if focused {
+			x = crop_offset(width, cw, fx)
+		} else {
+			x = crop_salient(i, true, cw)
+		}
+	}
+	if ch < height {
+		if focused {
+			y = crop_offset(height, ch, fy)
+		} else {
+			y = crop_salient(i, false, ch)
+		}
+	}
+	return image.Rect(b.Min.X+x, b.Min.Y+y, b.Min.X+x+cw, b.Min.Y+y+ch)
+}
+
+// crop_offset returns where a window of length n starts along a line of
+// length total to be centred on focus, kept within the line
+func crop_offset(total, n int, focus float64) int {
+	return min(max(int(math.Round(focus*float64(total)))-n/2, 0), total-n)
+}
+
+// crop_salient returns where a window of length n starts, across or down an
+// image, to hold the most detail: the greatest sum of differences between
+// neighbouring pixels. Of windows with equal detail, the most central wins.
+func crop_salient(i image.Image, across bool, n int) int {
+	small := resize.Thumbnail(crop_sample, crop_sample, i, resize.Bilinear)
+	b := small.Bounds()
+	gray := func(x, y int) int {
+		return int(color.GrayModel.Convert(small.At(x, y)).(color.Gray).Y)
+	}
+
+	total, length := b.Dx(), i.Bounds().Dx()
+	if !across {
+		total, length = b.Dy(), i.Bounds().Dy()
+	}
+	detail := make([]int, total)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			g, d := gray(x, y), 0
+			if x+1 < b.Max.X {
+				d += abs(gray(x+1, y) - g)
+			}
+			if y+1 < b.Max.Y {
+				d += abs(gray(x, y+1) - g)
+			}
+			if across {
+				detail[x-b.Min.X] += d
+			} else {
+				detail[y-b.Min.Y] += d
+			}
+		}
+	}
+
+	window := min(max(int(math.Round(float64(n)*float64(total)/float64(length))), 1), total)
+	centre := (total - window) / 2
+	best, best_sum, sum := centre, -1, 0
+	for k := 0; k < total; k++ {
+		sum += detail[k]
+		if k >= window {
+			sum -= detail[k-window]
+		}
+		start := k - window + 1
+		if start < 0 {
+			continue
+		}
+		if sum > best_sum || (sum == best_sum && abs(start-centre) < abs(best-centre)) {
+			best, best_sum = start, sum
+		}
+	}
+	return min(max(best*length/total, 0), length-n)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// variant_create_crop generates a cropped variant of an image, no larger
+// than size on its longest side
+func variant_create_crop(path string, variant string, size uint, w, h int, focus string) (string, error) {
+	return variant_generate(path, variant, func(i image.Image) image.Image {
+		return resize.Thumbnail(size, size, imaging.Crop(i, crop_rect(i, w, h, focus)), resize.Lanczos3)
+	})
+}
+
+// attachment_crops_remove removes an attachment's cropped variants
+func attachment_crops_remove(root *os.Root, id string, name string) {
+	filename := attachment_filename(id, name)
+	ext := filepath.Ext(filename)
+	stem := filename[:len(filename)-len(ext)]
+	crops, _ := fs.ReadDir(root.FS(), "crops")
+	for _, crop := range crops {
+		root.Remove("crops/" + crop.Name() + "/" + stem + "_" + crop.Name() + ext)
+	}
+}
+
+// focus_map returns a focal point as apps see it, or nil if there isn't one
+func focus_map(focus string) map[string]any {
+	x, y, ok := focus_parse(focus)
+	if !ok {
+		return nil
+	}
+	return map[string]any{"x": x, "y": y}
+}
+
+// mochi.attachment.focus(id, x, y, notify?) -> dict or None: Set the focal point of an image
+// attachment, as fractions of its width and height from the top left, that its cropped variants
+// are centred on. None for x and y removes it, leaving crops to find the most detailed part.
+func api_attachment_focus(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return sl_error(fn, "syntax: <id: string>, <x: number|None>, <y: number|None>, [notify: array]")
+	}
+
+	id, ok := sl.AsString(args[0])
+	if !ok || id == "" {
+		return sl_error(fn, "invalid id")
+	}
+
+	focus := ""
+	if args[1] != sl.None || args[2] != sl.None {
+		x, xok := sl.AsFloat(args[1])
+		y, yok := sl.AsFloat(args[2])
+		if !xok || !yok || !focus_valid(x) || !focus_valid(y) {
+			return sl_error(fn, "focal point must be between 0 and 1")
+		}
+		focus = focus_format(x, y)
+	}
+
+	var notify []string
+	if len(args) > 3 {
+		notify = sl_decode_string_list(args[3])
+	}
+
+	app := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+
+	owner := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+
+	db := db_app_system(owner, app)
+	if db == nil {
+		return sl_error(fn, "no database")
+	}
+	db.attachments_setup()
+
+	var att Attachment
+	if !db.scan(&att, "select * from attachments where id = ?", id) {
+		return sl.None, nil
+	}
+	if !is_image(att.Name) {
+		return sl_error(fn, "not an image")
+	}
+	if att.Focus != focus {
+		db.exec("update attachments set focus = ? where id = ?", focus, id)
+		att.Focus = focus
+		if root, err := os.OpenRoot(attachment_files_base(owner.UID, app.id)); err == nil {
+			attachment_crops_remove(root, att.ID, att.Name)
+			root.Close()
+		}
+	}
+
+	result := att.to_map(app.url_path(owner))
+
+	// Handle federation notify
+	if len(notify) > 0 {
+		attachment_notify_update(app, owner, result, notify)
+	}
+
+	return sl_encode(result), nil
+}
+
+// attachment_event_focus applies the focal point of an attachment from an
+// _attachment/create or _attachment/update event. An event without one
+// removes it.
+func (e *Event) attachment_event_focus(id string, att map[string]any) {
+	focus := ""
+	if m := attachment_event_map(att["focus"]); m != nil {
+		x, xok := focus_number(m["x"])
+		y, yok := focus_number(m["y"])
+		if !xok || !yok || !focus_valid(x) || !focus_valid(y) {
+			return
+		}
+		focus = focus_format(x, y)
+	}
+	e.db.attachments_setup()
+	e.db.exec("update attachments set focus = ? where id = ? and entity = ?", focus, id, e.from)
+}
+
+// focus_etag distinguishes a cropped variant's ETag by its focal point, so
+// browsers don't keep showing a crop around the old one
+func focus_etag(variant string, focus string) string {
+	if _, _, _, crop := variant_crop(variant); crop && focus != "" {
+		return fmt.Sprintf("%s@%s", variant, focus)
+	}
+	return variant
+}
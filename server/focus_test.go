@@ -0,0 +1,90 @@
+// Mochi server: Focal point and cropped variant tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVariantCrop(t *testing.T) {
+	for variant, want := range map[string]bool{
+		"preview-16x9": true, "thumbnail-1x1": true, "medium-4x5": true,
+		"preview-2x2": false, "preview-17x1": false, "preview-0x1": false, "preview-016x9": false,
+		"original-1x1": false, "preview": false, "preview-16": false,
+	} {
+		if _, _, _, crop := variant_crop(variant); crop != want {
+			t.Errorf("%q valid %v", variant, crop)
+		}
+	}
+	if !variant_valid("preview-16x9") || variant_valid("preview-2x2") {
+		t.Error("cropped variants not valid variants")
+	}
+}
+
+func TestCropRect(t *testing.T) {
+	// A plain wide image with detail only towards its right
+	i := image.NewGray(image.Rect(0, 0, 400, 100))
+	for y := 0; y < 100; y++ {
+		for x := 300; x < 400; x++ {
+			i.SetGray(x, y, color.Gray{uint8((x*7 + y*13) % 256)})
+		}
+	}
+
+	if r := crop_rect(i, 1, 1, ""); r.Dx() != 100 || r.Dy() != 100 || r.Min.X < 250 {
+		t.Errorf("no focal point: %v", r)
+	}
+	if r := crop_rect(i, 1, 1, focus_format(0.25, 0.5)); r != image.Rect(50, 0, 150, 100) {
+		t.Errorf("focal point: %v", r)
+	}
+	if r := crop_rect(i, 1, 1, focus_format(0, 0)); r != image.Rect(0, 0, 100, 100) {
+		t.Errorf("focal point at the edge: %v", r)
+	}
+	if r := crop_rect(i, 4, 1, focus_format(0.9, 0.9)); r != i.Bounds() {
+		t.Errorf("same aspect ratio: %v", r)
+	}
+	if r := crop_rect(i, 1, 2, focus_format(0.5, 0.5)); r != image.Rect(175, 0, 225, 100) {
+		t.Errorf("taller: %v", r)
+	}
+}
+
+func TestFocusVariant(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "abc_photo.png")
+	f, _ := os.Create(path)
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 800, 400)))
+	f.Close()
+
+	crop, err := attachment_variant_file(nil, path, &Attachment{ID: "abc", Name: "photo.png", Focus: "0.100,0.500"}, "thumbnail-1x1")
+	if err != nil || crop != filepath.Join(dir, "crops/thumbnail-1x1/abc_photo_thumbnail-1x1.png") {
+		t.Fatalf("crop %q: %v", crop, err)
+	}
+	f, _ = os.Open(crop)
+	config, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil || config.Width != thumbnail_size || config.Height != thumbnail_size {
+		t.Errorf("crop %dx%d: %v", config.Width, config.Height, err)
+	}
+
+	root, _ := os.OpenRoot(dir)
+	defer root.Close()
+	attachment_crops_remove(root, "abc", "photo.png")
+	if file_exists(crop) {
+		t.Error("crop left behind")
+	}
+
+	if m := (&Attachment{Focus: "0.250,1.000"}).to_map(); m["focus"].(map[string]any)["x"] != 0.25 {
+		t.Errorf("focus %v", m["focus"])
+	}
+	if m := (&Attachment{Focus: "bad"}).to_map(); m["focus"] != nil {
+		t.Errorf("invalid focus %v", m["focus"])
+	}
+}
@@ -0,0 +1,385 @@
+// Mochi server: Locale-aware formatting of dates, numbers and currencies
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	textmessage "golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// Dates and relative times are built from core labels (format.* in
+// labels/<lang>.conf), so their word order, month names and plurals come
+// from the same catalogs as every other string and fall back the same way.
+// Numbers and currencies use CLDR data through golang.org/x/text.
+
+// Languages written right to left, by language subtag
+var rtl_languages = map[string]bool{
+	"ar": true, "arc": true, "ckb": true, "dv": true, "fa": true, "he": true,
+	"ks": true, "ps": true, "sd": true, "syr": true, "ug": true, "ur": true, "yi": true,
+}
+
+// Scripts written right to left, by script subtag
+var rtl_scripts = map[string]bool{
+	"adlm": true, "arab": true, "hebr": true, "nkoo": true, "rohg": true, "syrc": true, "thaa": true,
+}
+
+// Relative time units, largest first, with their length in seconds
+var format_relative_units = []struct {
+	name    string
+	seconds int64
+}{
+	{"years", 365 * 86400},
+	{"months", 30 * 86400},
+	{"weeks", 7 * 86400},
+	{"days", 86400},
+	{"hours", 3600},
+	{"minutes", 60},
+}
+
+// language_direction returns "rtl" if a language is written right to left,
+// else "ltr". A script subtag overrides the language's usual script, so
+// "pa-arab" is rtl and "ku-latn" ltr, and the "en-x-pseudo-rtl" test locale
+// is rtl so layouts can be checked without reading Arabic.
+func language_direction(lang string) string {
+	parts := strings.Split(language_normalize(lang), "-")
+	for i, part := range parts[1:] {
+		if part == "x" {
+			for _, private := range parts[i+2:] {
+				if private == "rtl" {
+					return "rtl"
+				}
+			}
+			break
+		}
+		if len(part) == 4 {
+			if rtl_scripts[part] {
+				return "rtl"
+			}
+			return "ltr"
+		}
+	}
+	if rtl_languages[parts[0]] {
+		return "rtl"
+	}
+	return "ltr"
+}
+
+// format_printer returns a CLDR printer for a language, falling back to
+// English for tags x/text can't parse
+func format_printer(lang string) *textmessage.Printer {
+	tag, err := language.Parse(language_normalize(lang))
+	if err != nil {
+		tag = language.English
+	}
+	return textmessage.NewPrinter(tag)
+}
+
+// format_number formats a number with the language's digits, grouping and
+// decimal separator. With decimals < 0, up to three decimal places are shown
+// as needed; otherwise exactly decimals are.
+func format_number(lang string, n float64, decimals int) string {
+	options := []number.Option{number.MaxFractionDigits(3)}
+	if decimals >= 0 {
+		options = []number.Option{number.MinFractionDigits(decimals), number.MaxFractionDigits(decimals)}
+	}
+	return format_printer(lang).Sprint(number.Decimal(n, options...))
+}
+
+// format_currency formats an amount of an ISO 4217 currency, with the
+// currency's symbol and usual number of decimal places
+func format_currency(lang string, amount float64, code string) (string, error) {
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return "", fmt.Errorf("unknown currency %q", code)
+	}
+	return format_printer(lang).Sprint(currency.Symbol(unit.Amount(amount))), nil
+}
+
+// format_date formats a timestamp in a timezone. Styles are "short"
+// (numeric date), "medium" (abbreviated month), "long" (full month), "time",
+// and "datetime" (medium date and time).
+func format_date(lang string, l *time.Location, timestamp int64, style string) (string, error) {
+	t := time.Unix(timestamp, 0).In(l)
+	month := int(t.Month())
+	args := map[string]any{
+		"day":   t.Day(),
+		"year":  fmt.Sprintf("%d", t.Year()),
+		"month": fmt.Sprintf("%02d", month),
+	}
+
+	switch style {
+	case "short":
+		return resolve_core_label(lang, "format.date.short", args), nil
+	case "medium":
+		args["month"] = resolve_core_label(lang, fmt.Sprintf("format.month.short.%d", month), nil)
+		return resolve_core_label(lang, "format.date.medium", args), nil
+	case "long":
+		args["month"] = resolve_core_label(lang, fmt.Sprintf("format.month.%d", month), nil)
+		return resolve_core_label(lang, "format.date.long", args), nil
+	case "time":
+		return format_time(lang, t), nil
+	case "datetime":
+		date, _ := format_date(lang, l, timestamp, "medium")
+		return resolve_core_label(lang, "format.datetime", map[string]any{"date": date, "time": format_time(lang, t)}), nil
+	}
+	return "", fmt.Errorf("unknown style %q (valid: short, medium, long, time, datetime)", style)
+}
+
+// format_time formats the time of day, on the 12 or 24 hour clock as the
+// language's format.time label has it
+func format_time(lang string, t time.Time) string {
+	hour12 := t.Hour() % 12
+	if hour12 == 0 {
+		hour12 = 12
+	}
+	period := "format.time.am"
+	if t.Hour() >= 12 {
+		period = "format.time.pm"
+	}
+	return resolve_core_label(lang, "format.time", map[string]any{
+		"hour":   fmt.Sprintf("%02d", t.Hour()),
+		"hour12": hour12,
+		"minute": fmt.Sprintf("%02d", t.Minute()),
+		"period": resolve_core_label(lang, period, nil),
+	})
+}
+
+// time_format formats a timestamp in a timezone with a strftime pattern.
+// Month names and am/pm are the language's format.* labels.
+func time_format(lang string, l *time.Location, timestamp int64, pattern string) (string, error) {
+	t := time.Unix(timestamp, 0).In(l)
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		if i == len(pattern) {
+			return "", fmt.Errorf("pattern %q ends with %%", pattern)
+		}
+		switch pattern[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'b':
+			b.WriteString(resolve_core_label(lang, fmt.Sprintf("format.month.short.%d", int(t.Month())), nil))
+		case 'B':
+			b.WriteString(resolve_core_label(lang, fmt.Sprintf("format.month.%d", int(t.Month())), nil))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'e':
+			fmt.Fprintf(&b, "%d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&b, "%02d", (t.Hour()+11)%12+1)
+		case 'p':
+			if t.Hour() < 12 {
+				b.WriteString(resolve_core_label(lang, "format.time.am", nil))
+			} else {
+				b.WriteString(resolve_core_label(lang, "format.time.pm", nil))
+			}
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 's':
+			fmt.Fprintf(&b, "%d", timestamp)
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unknown directive %%%c in pattern %q", pattern[i], pattern)
+		}
+	}
+	return b.String(), nil
+}
+
+// format_relative describes a timestamp relative to another, such as
+// "3 days ago" or "in 2 hours", in the largest whole unit
+func format_relative(lang string, timestamp, from int64) string {
+	delta := timestamp - from
+	direction := "future"
+	if delta < 0 {
+		direction = "past"
+		delta = -delta
+	}
+	for _, unit := range format_relative_units {
+		if delta >= unit.seconds {
+			count := int64(math.Round(float64(delta) / float64(unit.seconds)))
+			return resolve_core_label(lang, "format.relative."+unit.name+"."+direction, map[string]any{"count": count})
+		}
+	}
+	return resolve_core_label(lang, "format.relative.now", nil)
+}
+
+// api_format is the mochi.format module
+var api_format = sls.FromStringDict(sl.String("mochi.format"), sl.StringDict{
+	"currency":  sl.NewBuiltin("mochi.format.currency", api_format_currency),
+	"date":      sl.NewBuiltin("mochi.format.date", api_format_date),
+	"direction": sl.NewBuiltin("mochi.format.direction", api_format_direction),
+	"number":    sl.NewBuiltin("mochi.format.number", api_format_number),
+	"relative":  sl.NewBuiltin("mochi.format.relative", api_format_relative),
+})
+
+// mochi.format.currency(amount, code) -> string: Format an amount of an ISO
+// 4217 currency in the user's language
+func api_format_currency(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var amount sl.Value
+	var code string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "amount", &amount, "code", &code); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	n, ok := sl.AsFloat(amount)
+	if !ok {
+		return sl_error(fn, "amount must be a number")
+	}
+	s, err := format_currency(thread_language(t), n, code)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.String(s), nil
+}
+
+// mochi.format.date(timestamp, style="medium") -> string: Format a timestamp
+// in the user's language and timezone. Styles: short, medium, long, time,
+// datetime.
+func api_format_date(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var timestamp int64
+	style := "medium"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "timestamp", &timestamp, "style?", &style); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	s, err := format_date(thread_language(t), user_location(user), timestamp, style)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.String(s), nil
+}
+
+// mochi.format.direction() -> string: "rtl" if the user's language is written
+// right to left, else "ltr"
+func api_format_direction(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.String(language_direction(thread_language(t))), nil
+}
+
+// mochi.format.number(n, decimals=None) -> string: Format a number in the
+// user's language, with exactly decimals places if given
+func api_format_number(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var n sl.Value
+	decimals := -1
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "n", &n, "decimals?", &decimals); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	f, ok := sl.AsFloat(n)
+	if !ok {
+		return sl_error(fn, "n must be a number")
+	}
+	if decimals > 20 {
+		return sl_error(fn, "too many decimals")
+	}
+	return sl.String(format_number(thread_language(t), f, decimals)), nil
+}
+
+// mochi.format.relative(timestamp) -> string: Describe a timestamp relative
+// to now in the user's language, such as "3 days ago" or "in 2 hours"
+func api_format_relative(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var timestamp int64
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "timestamp", &timestamp); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.String(format_relative(thread_language(t), timestamp, now())), nil
+}
+
+// template_functions returns the formatting functions given to app
+// templates, bound to the request's language and the user's timezone:
+//
+//	<html lang="{{language}}" dir="{{direction}}">
+//	{{date .created "long"}}, {{relative .created}}, {{number .size}}, {{currency .price "EUR"}}
+//	{{time .created "%H:%M %Z"}}
+func template_functions(lang string, l *time.Location) template.FuncMap {
+	return template.FuncMap{
+		"currency": func(amount any, code string) (string, error) {
+			n, err := format_float(amount)
+			if err != nil {
+				return "", err
+			}
+			return format_currency(lang, n, code)
+		},
+		"date": func(timestamp any, style ...string) (string, error) {
+			n, err := format_float(timestamp)
+			if err != nil {
+				return "", err
+			}
+			if len(style) == 0 {
+				style = []string{"medium"}
+			}
+			return format_date(lang, l, int64(n), style[0])
+		},
+		"direction": func() string { return language_direction(lang) },
+		"language":  func() string { return lang },
+		"number": func(v any) (string, error) {
+			n, err := format_float(v)
+			if err != nil {
+				return "", err
+			}
+			return format_number(lang, n, -1), nil
+		},
+		"time": func(timestamp any, pattern string) (string, error) {
+			n, err := format_float(timestamp)
+			if err != nil {
+				return "", err
+			}
+			return time_format(lang, l, int64(n), pattern)
+		},
+		"relative": func(timestamp any) (string, error) {
+			n, err := format_float(timestamp)
+			if err != nil {
+				return "", err
+			}
+			return format_relative(lang, int64(n), now()), nil
+		},
+	}
+}
+
+// format_float converts a number from template data, which may have been
+// decoded from Starlark as any numeric type or a numeric string
+func format_float(v any) (float64, error) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("not a number: %v", v)
+}
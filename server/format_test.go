@@ -0,0 +1,152 @@
+// Mochi server: Locale-aware formatting tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLanguageDirection(t *testing.T) {
+	tests := map[string]string{
+		"en":              "ltr",
+		"ar":              "rtl",
+		"ar-EG":           "rtl",
+		"he":              "rtl",
+		"fa":              "rtl",
+		"pa":              "ltr",
+		"pa-arab":         "rtl",
+		"ku-latn":         "ltr",
+		"en-x-pseudo":     "ltr",
+		"en-x-pseudo-rtl": "rtl",
+		"":                "ltr",
+	}
+	for lang, want := range tests {
+		if got := language_direction(lang); got != want {
+			t.Errorf("language_direction(%q) = %q, want %q", lang, got, want)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	tests := []struct {
+		lang     string
+		n        float64
+		decimals int
+		want     string
+	}{
+		{"en", 1234567.891, -1, "1,234,567.891"},
+		{"en", 1234.5, 2, "1,234.50"},
+		{"de", 1234.5, 2, "1.234,50"},
+		{"fr", 1234, -1, "1\u00a0234"},
+		{"zz", 1234, -1, "1,234"},
+	}
+	for _, tt := range tests {
+		if got := format_number(tt.lang, tt.n, tt.decimals); got != tt.want {
+			t.Errorf("format_number(%q, %v, %d) = %q, want %q", tt.lang, tt.n, tt.decimals, got, tt.want)
+		}
+	}
+
+	if got, err := format_currency("de", 1234.5, "EUR"); err != nil || !strings.Contains(got, "1.234,50") || !strings.Contains(got, "€") {
+		t.Errorf("format_currency = %q, %v", got, err)
+	}
+	if _, err := format_currency("en", 1, "XYZZY"); err == nil {
+		t.Error("unknown currency accepted")
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	load_core_labels()
+	ts := time.Date(2026, time.March, 14, 21, 5, 0, 0, time.UTC).Unix()
+	new_york, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+	tests := []struct {
+		lang  string
+		l     *time.Location
+		style string
+		want  string
+	}{
+		{"en", time.UTC, "short", "14/03/2026"},
+		{"en", time.UTC, "medium", "14 Mar 2026"},
+		{"en-gb", time.UTC, "long", "14 March 2026"},
+		{"en-us", time.UTC, "short", "03/14/2026"},
+		{"en-us", time.UTC, "long", "March 14, 2026"},
+		{"en", time.UTC, "time", "21:05"},
+		{"en-us", time.UTC, "time", "9:05 PM"},
+		{"en", new_york, "datetime", "14 Mar 2026, 17:05"},
+	}
+	for _, tt := range tests {
+		got, err := format_date(tt.lang, tt.l, ts, tt.style)
+		if err != nil || got != tt.want {
+			t.Errorf("format_date(%q, %q) = %q, %v, want %q", tt.lang, tt.style, got, err, tt.want)
+		}
+	}
+	if _, err := format_date("en", time.UTC, ts, "fancy"); err == nil {
+		t.Error("unknown style accepted")
+	}
+
+	relative := []struct {
+		delta int64
+		want  string
+	}{
+		{-10, "just now"},
+		{-60, "1 minute ago"},
+		{-3 * 3600, "3 hours ago"},
+		{2 * 86400, "in 2 days"},
+		{14 * 86400, "in 2 weeks"},
+		{-400 * 86400, "1 year ago"},
+	}
+	for _, tt := range relative {
+		if got := format_relative("en", ts+tt.delta, ts); got != tt.want {
+			t.Errorf("format_relative(%d) = %q, want %q", tt.delta, got, tt.want)
+		}
+	}
+
+	var b strings.Builder
+	tmpl := template.Must(template.New("t").Funcs(template_functions("ar", time.UTC)).Parse(`<html lang="{{language}}" dir="{{direction}}">{{date .ts "short"}} {{number .n}}`))
+	if err := tmpl.Execute(&b, map[string]any{"ts": ts, "n": int64(3)}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `<html lang="ar" dir="rtl">14/03/2026 ٣`; b.String() != want {
+		t.Errorf("template %q, want %q", b.String(), want)
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	load_core_labels()
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+	ts := time.Date(2026, time.March, 14, 21, 5, 9, 0, time.UTC).Unix()
+	tests := []struct {
+		lang    string
+		l       *time.Location
+		pattern string
+		want    string
+	}{
+		{"en", time.UTC, "%Y-%m-%d %H:%M:%S", "2026-03-14 21:05:09"},
+		{"en", tokyo, "%e %B %Y, %H:%M %Z", "15 March 2026, 06:05 JST"},
+		{"en-us", time.UTC, "%b %d %y %I:%M %p", "Mar 14 26 09:05 PM"},
+		{"en", tokyo, "%z 100%%", "+0900 100%"},
+	}
+	for _, tt := range tests {
+		got, err := time_format(tt.lang, tt.l, ts, tt.pattern)
+		if err != nil || got != tt.want {
+			t.Errorf("time_format(%q) = %q, %v, want %q", tt.pattern, got, err, tt.want)
+		}
+	}
+	for _, pattern := range []string{"%Q", "100%"} {
+		if _, err := time_format("en", time.UTC, ts, pattern); err == nil {
+			t.Errorf("time_format(%q) accepted", pattern)
+		}
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
 	"github.com/go-git/go-git/v5/plumbing/storer"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/server"
@@ -46,8 +47,10 @@ var api_git = sls.FromStringDict(sl.String("mochi.git"), sl.StringDict{
 	"refs":     sl.NewBuiltin("mochi.git.refs", api_git_refs),
 	"branches": sl.NewBuiltin("mochi.git.branches", api_git_branches),
 	"tags":     sl.NewBuiltin("mochi.git.tags", api_git_tags),
-	"tree":     sl.NewBuiltin("mochi.git.tree", api_git_tree),
+	"tree":     &git_tree_module{},
 	"archive":  sl.NewBuiltin("mochi.git.archive", api_git_archive),
+	"grep":     sl.NewBuiltin("mochi.git.grep", api_git_grep),
+	"gc":       sl.NewBuiltin("mochi.git.gc", api_git_gc),
 	"branch": sls.FromStringDict(sl.String("mochi.git.branch"), sl.StringDict{
 		"create": sl.NewBuiltin("mochi.git.branch.create", api_git_branch_create),
 		"delete": sl.NewBuiltin("mochi.git.branch.delete", api_git_branch_delete),
@@ -72,6 +75,22 @@ var api_git = sls.FromStringDict(sl.String("mochi.git"), sl.StringDict{
 		"check":   sl.NewBuiltin("mochi.git.merge.check", api_git_merge_check),
 		"perform": sl.NewBuiltin("mochi.git.merge.perform", api_git_merge_perform),
 	}),
+	"proposal": sls.FromStringDict(sl.String("mochi.git.proposal"), sl.StringDict{
+		"create": sl.NewBuiltin("mochi.git.proposal.create", api_git_proposal_create),
+		"get":    sl.NewBuiltin("mochi.git.proposal.get", api_git_proposal_get),
+		"list":   sl.NewBuiltin("mochi.git.proposal.list", api_git_proposal_list),
+		"update": sl.NewBuiltin("mochi.git.proposal.update", api_git_proposal_update),
+	}),
+	"status": sls.FromStringDict(sl.String("mochi.git.status"), sl.StringDict{
+		"list":    sl.NewBuiltin("mochi.git.status.list", api_git_status_list),
+		"require": sl.NewBuiltin("mochi.git.status.require", api_git_status_require),
+		"set":     sl.NewBuiltin("mochi.git.status.set", api_git_status_set),
+	}),
+	"watch": sls.FromStringDict(sl.String("mochi.git.watch"), sl.StringDict{
+		"add":    sl.NewBuiltin("mochi.git.watch.add", api_git_watch_add),
+		"list":   sl.NewBuiltin("mochi.git.watch.list", api_git_watch_list),
+		"remove": sl.NewBuiltin("mochi.git.watch.remove", api_git_watch_remove),
+	}),
 })
 
 // git_loader implements server.Loader to load repository storage from filesystem paths
@@ -304,6 +323,14 @@ func git_resolve_ref(repo *git.Repository, ref string) (*plumbing.Hash, error) {
 		return nil, err
 	}
 
+	// Try as a full ref name, such as refs/proposals/<id>
+	if strings.HasPrefix(ref, "refs/") {
+		if full, err := repo.Reference(plumbing.ReferenceName(ref), true); err == nil {
+			hash := full.Hash()
+			return &hash, nil
+		}
+	}
+
 	// Try as a branch
 	branch_ref, err := repo.Reference(plumbing.NewBranchReferenceName(ref), true)
 	if err == nil {
@@ -1050,7 +1077,8 @@ func api_git_commit_between(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 	return sl_encode(commits), nil
 }
 
-// mochi.git.tree(entity, ref, path) -> list: List directory contents
+// mochi.git.tree(entity, ref, path) -> list: List directory contents. A
+// symlink has its target, and a submodule its commit and url.
 func api_git_tree(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) < 1 || len(args) > 3 {
 		return sl_error(fn, "syntax: <entity: string>, [ref: string], [path: string]")
@@ -1105,44 +1133,12 @@ func api_git_tree(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple
 		}
 	}
 
+	submodules := git_submodules(commit)
 	var entries []map[string]any
 	for _, entry := range tree.Entries {
-		entry_type := "file"
-		if entry.Mode == filemode.Dir {
-			entry_type = "dir"
-		} else if entry.Mode == filemode.Submodule {
-			entry_type = "submodule"
-		} else if entry.Mode == filemode.Symlink {
-			entry_type = "symlink"
-		}
-
-		e := map[string]any{
-			"name": entry.Name,
-			"type": entry_type,
-			"sha":  entry.Hash.String(),
-			"mode": fmt.Sprintf("%o", entry.Mode),
-		}
-
-		// Get size for files
-		if entry_type == "file" {
-			blob, err := repo.BlobObject(entry.Hash)
-			if err == nil {
-				e["size"] = blob.Size
-			}
-		}
-
-		entries = append(entries, e)
+		entries = append(entries, git_tree_entry(repo, entry, path, submodules))
 	}
-
-	// Sort: directories first, then alphabetically
-	sort.Slice(entries, func(i, j int) bool {
-		i_dir := entries[i]["type"] == "dir"
-		j_dir := entries[j]["type"] == "dir"
-		if i_dir != j_dir {
-			return i_dir
-		}
-		return entries[i]["name"].(string) < entries[j]["name"].(string)
-	})
+	git_tree_sort(entries)
 
 	return sl_encode(entries), nil
 }
@@ -1514,7 +1510,8 @@ func api_git_merge_base(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 	return sl.String(bases[0].Hash.String()), nil
 }
 
-// mochi.git.merge.check(entity, source, target) -> dict: Check if merge is possible
+// mochi.git.merge.check(entity, source, target) -> dict: Check if merge is possible,
+// including the checks reported for the source, as mochi.git.status.list() gives them
 func api_git_merge_check(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) != 3 {
 		return sl_error(fn, "syntax: <entity: string>, <source: string>, <target: string>")
@@ -1647,12 +1644,17 @@ func api_git_merge_check(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []s
 		}
 	}
 
+	// Checks reported for the source head; required contexts that have not
+	// succeeded block the merge
+	state, blocked := check_summary(entity, app.id, source_hash.String())
+
 	return sl_encode(map[string]any{
-		"can_merge": len(conflicts) == 0,
+		"can_merge": len(conflicts) == 0 && len(blocked) == 0,
 		"conflicts": conflicts,
 		"base":      bases[0].Hash.String(),
 		"ahead":     ahead,
 		"behind":    behind,
+		"checks":    map[string]any{"state": state, "blocked": blocked, "statuses": check_statuses(entity, app.id, source_hash.String())},
 	}), nil
 }
 
@@ -2529,7 +2531,11 @@ func git_replicate_after(owner *User, app *App, entity string) func() {
 	if owner != nil && app != nil {
 		repo_path = git_repo_path(owner, app, entity)
 	}
-	return func() { go git_replicate_repo_delta(owner, app, entity, repo_path, since) }
+	before := git_refs(repo_path)
+	return func() {
+		go git_replicate_repo_delta(owner, app, entity, repo_path, since)
+		git_refs_notify(app, entity, before, git_refs(repo_path))
+	}
 }
 
 func git_http_handler(c *gin.Context, a *App, owner *User, user *User, repo string, path string) bool {
@@ -2612,8 +2618,12 @@ func git_http_handler(c *gin.Context, a *App, owner *User, user *User, repo stri
 		// Capture the push start (minus filesystem mtime granularity slack), run the
 		// push, then live-replicate the objects/refs it wrote to the host set (#105).
 		since := time.Now().Add(-2 * time.Second)
+		before := git_refs(repo_path)
 		handled := git_service_rpc(c, repo_path, "git-receive-pack", owner)
 		go git_replicate_repo_delta(owner, a, id, repo_path, since)
+		after := git_refs(repo_path)
+		git_refs_notify(a, id, before, after)
+		git_push_events(a, owner, id, user, before, after)
 		return handled
 	}
 
@@ -2688,8 +2698,12 @@ func git_http_handler_entity(c *gin.Context, a *App, owner *User, user *User, e
 	} else if path == "git-receive-pack" {
 		// Live-replicate the pushed objects/refs to the host set (#105).
 		since := time.Now().Add(-2 * time.Second)
+		before := git_refs(repo_path)
 		handled := git_service_rpc(c, repo_path, "git-receive-pack", owner)
 		go git_replicate_repo_delta(owner, a, e.ID, repo_path, since)
+		after := git_refs(repo_path)
+		git_refs_notify(a, e.ID, before, after)
+		git_push_events(a, owner, e.ID, user, before, after)
 		return handled
 	}
 
@@ -2745,6 +2759,7 @@ func git_info_refs(c *gin.Context, repo_path string, service string) bool {
 			c.String(http.StatusInternalServerError, "Failed to get refs")
 			return true
 		}
+		git_upload_capabilities(refs.Capabilities)
 	} else {
 		session, err := git_transport.NewReceivePackSession(ep, nil)
 		if err != nil {
@@ -2889,12 +2904,32 @@ func git_upload_pack(c *gin.Context, repo_path string, reader io.ReadCloser) boo
 	defer session.Close()
 
 	// Decode the upload-pack request from the client
-	req := packp.NewUploadPackRequest()
-	if err := req.Decode(reader); err != nil {
+	req, filter, done, err := git_upload_request(reader)
+	if err != nil {
 		c.String(http.StatusBadRequest, "Failed to decode request: %v", err)
 		return true
 	}
 
+	s, err := (&git_loader{}).Load(ep)
+	if err != nil {
+		c.String(http.StatusNotFound, "Repository not found")
+		return true
+	}
+	if err := git_upload_reachable(s, repo_path, req.Wants); err != nil {
+		c.String(http.StatusBadRequest, "%v", err)
+		return true
+	}
+
+	// Shallow and filtered fetches are answered without go-git, which
+	// supports neither
+	if git_upload_shallow_needed(req, filter) {
+		return git_upload_pack_shallow(c, repo_path, s, req, filter, done)
+	}
+	req.Capabilities.Delete(capability.Shallow)
+	req.Capabilities.Delete(capability.DeepenRelative)
+	req.Capabilities.Delete(capability.Filter)
+	req.Capabilities.Delete(capability.AllowReachableSHA1InWant)
+
 	// Process the upload-pack request
 	resp, err := session.UploadPack(ctx, req)
 	if err != nil {
@@ -0,0 +1,313 @@
+// Mochi server: Git repository maintenance
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	commitgraph "github.com/go-git/go-git/v5/plumbing/format/commitgraph/v2"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	sl "go.starlark.net/starlark"
+)
+
+// Pushes are unpacked into loose objects, one file each, so a busy
+// repository soon holds thousands of them and every read slows down. Garbage
+// collection packs everything reachable from a ref into one packfile,
+// removes the loose copies, prunes unreachable loose objects, and writes a
+// commit-graph. Unreachable objects and old packfiles are kept for the
+// [git] prune grace period, so a push still being written, whose objects no
+// ref yet points to, is never lost.
+//
+// Repositories are host-local files, so every node runs the maintenance
+// manager over its own copies. It collects a repository once it has more
+// than git_gc_loose loose objects or git_gc_packs packfiles, or has no
+// commit-graph.
+
+const (
+	git_gc_loose = 1000
+	git_gc_packs = 20
+)
+
+// One collection per repository at a time
+var git_gc_locks sync.Map
+
+// git_gc_grace returns how long unreachable objects are kept
+func git_gc_grace() time.Duration {
+	return time.Duration(ini_int("git", "prune", 14)) * 24 * time.Hour
+}
+
+// git_gc_counts returns a repository's numbers of loose objects and packfiles
+func git_gc_counts(repo *git.Repository) (int, int) {
+	loose := 0
+	if los, ok := repo.Storer.(storer.LooseObjectStorer); ok {
+		los.ForEachObjectHash(func(plumbing.Hash) error {
+			loose++
+			return nil
+		})
+	}
+	packs := 0
+	if pos, ok := repo.Storer.(storer.PackedObjectStorer); ok {
+		hs, _ := pos.ObjectPacks()
+		packs = len(hs)
+	}
+	return loose, packs
+}
+
+// git_gc_needed reports whether a repository is due for collection
+func git_gc_needed(path string) bool {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return false
+	}
+	loose, packs := git_gc_counts(repo)
+	if loose > git_gc_loose || packs > git_gc_packs {
+		return true
+	}
+	if loose+packs == 0 {
+		return false
+	}
+	return !file_exists(filepath.Join(path, "objects", "info", "commit-graph"))
+}
+
+// git_gc collects a repository, keeping unreachable objects and packfiles
+// newer than the grace period. Returns the loose objects and packfiles
+// before and after, how many loose objects were pruned, and how many
+// commits are in the commit-graph.
+func git_gc(path string, grace time.Duration) (map[string]any, error) {
+	lock, _ := git_gc_locks.LoadOrStore(path, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, err
+	}
+	loose_before, packs_before := git_gc_counts(repo)
+	cutoff := time.Now().Add(-grace)
+
+	// Pack everything reachable, dropping old packfiles now duplicated
+	refs := git_refs(path)
+	if len(refs) > 0 && loose_before+packs_before > 0 {
+		if err := repo.RepackObjects(&git.RepackConfig{OnlyDeletePacksOlderThan: cutoff}); err != nil {
+			return nil, fmt.Errorf("repack: %v", err)
+		}
+	}
+
+	// Reopen, so the new packfile is seen, and remove the loose copies of
+	// anything now packed
+	repo, err = git.PlainOpen(path)
+	if err != nil {
+		return nil, err
+	}
+	los, ok := repo.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		return nil, fmt.Errorf("loose objects not supported")
+	}
+	packed := git_gc_packed(repo, path)
+	var loose []plumbing.Hash
+	los.ForEachObjectHash(func(h plumbing.Hash) error {
+		loose = append(loose, h)
+		return nil
+	})
+	for _, h := range loose {
+		for _, idx := range packed {
+			if found, _ := idx.Contains(h); found {
+				los.DeleteLooseObject(h)
+				break
+			}
+		}
+	}
+
+	// Prune loose objects no ref reaches that are older than the grace period
+	pruned := 0
+	err = repo.Prune(git.PruneOptions{OnlyObjectsOlderThan: cutoff, Handler: func(h plumbing.Hash) error {
+		pruned++
+		return repo.DeleteObject(h)
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("prune: %v", err)
+	}
+	dirs, _ := filepath.Glob(filepath.Join(path, "objects", "[0-9a-f][0-9a-f]"))
+	for _, d := range dirs {
+		os.Remove(d)
+	}
+
+	commits, err := git_commit_graph(repo, path)
+	if err != nil {
+		debug("Git gc unable to write commit-graph for %q: %v", path, err)
+	}
+
+	repo, _ = git.PlainOpen(path)
+	loose_after, packs_after := git_gc_counts(repo)
+	return map[string]any{"loose_before": loose_before, "packs_before": packs_before, "loose": loose_after, "packs": packs_after, "pruned": pruned, "commits": commits}, nil
+}
+
+// git_gc_packed returns the indexes of a repository's packfiles
+func git_gc_packed(repo *git.Repository, path string) []*idxfile.MemoryIndex {
+	pos, ok := repo.Storer.(storer.PackedObjectStorer)
+	if !ok {
+		return nil
+	}
+	hs, _ := pos.ObjectPacks()
+	var indexes []*idxfile.MemoryIndex
+	for _, h := range hs {
+		f, err := os.Open(filepath.Join(path, "objects", "pack", "pack-"+h.String()+".idx"))
+		if err != nil {
+			continue
+		}
+		idx := idxfile.NewMemoryIndex()
+		err = idxfile.NewDecoder(f).Decode(idx)
+		f.Close()
+		if err == nil {
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes
+}
+
+// git_commit_graph writes a repository's commit-graph, returning how many
+// commits it holds
+func git_commit_graph(repo *git.Repository, path string) (int, error) {
+	type node struct {
+		tree    plumbing.Hash
+		parents []plumbing.Hash
+		when    time.Time
+	}
+	nodes := map[plumbing.Hash]*node{}
+	iter, err := repo.CommitObjects()
+	if err != nil {
+		return 0, err
+	}
+	iter.ForEach(func(c *object.Commit) error {
+		nodes[c.Hash] = &node{tree: c.TreeHash, parents: c.ParentHashes, when: c.Committer.When}
+		return nil
+	})
+	if len(nodes) == 0 {
+		return 0, nil
+	}
+
+	// A commit's generation is one more than its parents' highest, found
+	// without recursion, since histories can be very long
+	generations := map[plumbing.Hash]uint64{}
+	for h := range nodes {
+		stack := []plumbing.Hash{h}
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if _, done := generations[top]; done {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			generation := uint64(1)
+			pending := false
+			for _, p := range nodes[top].parents {
+				if _, found := nodes[p]; !found {
+					return 0, fmt.Errorf("commit %s has missing parent %s", top, p)
+				}
+				if g, done := generations[p]; !done {
+					stack = append(stack, p)
+					pending = true
+				} else if g+1 > generation {
+					generation = g + 1
+				}
+			}
+			if !pending {
+				generations[top] = generation
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	idx := commitgraph.NewMemoryIndex()
+	for h, n := range nodes {
+		idx.Add(h, &commitgraph.CommitData{TreeHash: n.tree, ParentHashes: n.parents, Generation: generations[h], When: n.when})
+	}
+
+	file := filepath.Join(path, "objects", "info", "commit-graph")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), "commit-graph-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	if err := commitgraph.NewEncoder(f).Encode(idx); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		return 0, err
+	}
+	return len(nodes), nil
+}
+
+// git_maintenance_manager collects each repository on this node as it
+// becomes due
+func git_maintenance_manager() {
+	for range time.Tick(time.Hour) {
+		if governor_busy() {
+			continue
+		}
+		git_maintenance()
+	}
+}
+
+// git_maintenance collects every repository that is due
+func git_maintenance() {
+	heads, _ := filepath.Glob(filepath.Join(data_dir, "users", "*", "*", "*", "HEAD"))
+	for _, head := range heads {
+		path := filepath.Dir(head)
+		if !file_exists(filepath.Join(path, "objects")) || !git_gc_needed(path) {
+			continue
+		}
+		result, err := git_gc(path, git_gc_grace())
+		if err != nil {
+			warn("Git gc of %q failed: %v", path, err)
+			continue
+		}
+		debug("Git gc of %q packed %d loose objects and %d packfiles into %d packfiles, pruning %d", path, result["loose_before"], result["packs_before"], result["packs"], result["pruned"])
+	}
+}
+
+// mochi.git.gc(entity) -> dict: Collect a repository now: pack its loose
+// objects, prune unreachable ones older than the grace period, and write its
+// commit-graph. Returns loose_before, packs_before, loose, packs, pruned and
+// commits. Requires repository write access.
+func api_git_gc(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity); err != nil {
+		return nil, err
+	}
+	owner, _ := t.Local("owner").(*User)
+	app, _ := t.Local("app").(*App)
+	if owner == nil || app == nil {
+		return sl_error(fn, "no owner")
+	}
+	if !valid(entity, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+	if !git_can_write(t, owner, app, entity) {
+		return sl_error(fn, "permission denied: repository write required")
+	}
+
+	result, err := git_gc(git_repo_path(owner, app, entity), git_gc_grace())
+	if err != nil {
+		return sl_error(fn, "gc failed: %v", err)
+	}
+	return sl_encode(result), nil
+}
@@ -0,0 +1,103 @@
+// Mochi server: Git repository maintenance tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	commitgraph "github.com/go-git/go-git/v5/plumbing/format/commitgraph/v2"
+)
+
+// git_gc_test_blob stores an unreachable blob, optionally backdated
+func git_gc_test_blob(t *testing.T, repo *git.Repository, path, content string, age time.Duration) plumbing.Hash {
+	t.Helper()
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, _ := obj.Writer()
+	w.Write([]byte(content))
+	w.Close()
+	h, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age > 0 {
+		file := filepath.Join(path, "objects", h.String()[:2], h.String()[2:])
+		old := time.Now().Add(-age)
+		if err := os.Chtimes(file, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+func TestGitGC(t *testing.T) {
+	user, _, cleanup := create_git_test_env(t)
+	defer cleanup()
+	if err := git_init(user, test_app, "busy"); err != nil {
+		t.Fatal(err)
+	}
+	path := git_repo_path(user, test_app, "busy")
+	repo, _ := git_open(user, test_app, "busy")
+	var head plumbing.Hash
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		head = proposal_test_commit(t, repo, name, name)
+	}
+	stale := git_gc_test_blob(t, repo, path, "stale", 30*24*time.Hour)
+	recent := git_gc_test_blob(t, repo, path, "recent", 0)
+
+	if !git_gc_needed(path) {
+		t.Error("repository without a commit-graph not due")
+	}
+	result, err := git_gc(path, 14*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the recent unreachable object stays loose
+	if result["loose"] != 1 || result["packs"] != 1 || result["pruned"] != 1 {
+		t.Errorf("result %v, want 1 loose, 1 pack and 1 pruned", result)
+	}
+	repo, _ = git_open(user, test_app, "busy")
+	if _, err := repo.CommitObject(head); err != nil {
+		t.Errorf("head lost: %v", err)
+	}
+	if _, err := repo.BlobObject(stale); err == nil {
+		t.Error("stale unreachable object kept")
+	}
+	if _, err := repo.BlobObject(recent); err != nil {
+		t.Error("recent unreachable object pruned within the grace period")
+	}
+
+	// The commit-graph holds every commit, with generations
+	f, err := os.Open(filepath.Join(path, "objects", "info", "commit-graph"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := commitgraph.OpenFileIndex(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if n := len(idx.Hashes()); n != result["commits"] || n < 4 {
+		t.Errorf("commit-graph holds %d commits, result %v", n, result["commits"])
+	}
+	i, err := idx.GetIndexByHash(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := idx.GetCommitDataByIndex(i); data.Generation != uint64(result["commits"].(int)) {
+		t.Errorf("head generation %d, want %v", data.Generation, result["commits"])
+	}
+	if git_gc_needed(path) {
+		t.Error("repository due again straight after collection")
+	}
+}
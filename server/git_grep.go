@@ -0,0 +1,267 @@
+// Mochi server: Git content search
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	sl "go.starlark.net/starlark"
+)
+
+// mochi.git.grep() searches the files of a commit's tree line by line,
+// reading each blob as a stream rather than checking anything out. Binary
+// files, symlinks and submodules are skipped, as are files larger than the
+// size option. The search stops at the match limit, or once
+// git_grep_scan_limit bytes have been read, and says it was truncated.
+
+const (
+	git_grep_pattern_limit = 1000
+	git_grep_context_limit = 10
+	git_grep_match_default = 100
+	git_grep_match_limit   = 1000
+	git_grep_size_default  = 1 << 20
+	git_grep_scan_limit    = 256 << 20
+	git_grep_line_limit    = 1000 // Longest line returned, in bytes
+	git_grep_binary_peek   = 8000 // Bytes checked for a NUL, as git does
+)
+
+// git_grep_options are the options of a search
+type git_grep_options struct {
+	paths   []string
+	context int
+	limit   int
+	size    int64
+}
+
+// git_grep_path reports whether a file's path is matched by any of the path
+// filters: a glob matching the whole path, or without a "/" its name, or a
+// directory the file is in
+func git_grep_path(file string, filters []string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		f = strings.Trim(f, "/")
+		if f == "" {
+			return true
+		}
+		if ok, _ := path.Match(f, file); ok {
+			return true
+		}
+		if !strings.Contains(f, "/") {
+			if ok, _ := path.Match(f, path.Base(file)); ok {
+				return true
+			}
+		}
+		if strings.HasPrefix(file, f+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// git_grep_line shortens a line for returning
+func git_grep_line(line []byte) string {
+	if len(line) > git_grep_line_limit {
+		line = line[:git_grep_line_limit]
+	}
+	return strings.ToValidUTF8(string(line), "�")
+}
+
+// git_grep_file searches a file, appending its matches until the limit.
+// Returns how many bytes were read.
+func git_grep_file(name string, r io.Reader, re *regexp.Regexp, o *git_grep_options, matches *[]map[string]any) int64 {
+	reader := bufio.NewReaderSize(r, 64<<10)
+	if head, _ := reader.Peek(git_grep_binary_peek); bytes.IndexByte(head, 0) >= 0 {
+		return 0
+	}
+
+	var read int64
+	var before [][]byte
+	type open struct {
+		match map[string]any
+		after []string
+	}
+	var pending []*open
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64<<10), int(o.size)+1)
+	number := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		read += int64(len(line)) + 1
+		number++
+
+		// Lines after earlier matches
+		still := pending[:0]
+		for _, p := range pending {
+			p.after = append(p.after, git_grep_line(line))
+			if len(p.after) < o.context {
+				still = append(still, p)
+			} else {
+				p.match["after"] = p.after
+			}
+		}
+		pending = still
+
+		if len(*matches) < o.limit && re.Match(line) {
+			context := make([]string, len(before))
+			for i, b := range before {
+				context[i] = git_grep_line(b)
+			}
+			m := map[string]any{"path": name, "line": number, "text": git_grep_line(line), "before": context, "after": []string{}}
+			*matches = append(*matches, m)
+			if o.context > 0 {
+				pending = append(pending, &open{match: m})
+			}
+		}
+		if len(*matches) >= o.limit && len(pending) == 0 {
+			break
+		}
+
+		if o.context > 0 {
+			if len(before) == o.context {
+				before = before[1:]
+			}
+			before = append(before, append([]byte(nil), line...))
+		}
+	}
+	for _, p := range pending {
+		p.match["after"] = p.after
+	}
+	return read
+}
+
+// git_grep searches a tree, returning its matches, how many files were
+// searched, and whether the search stopped early
+func git_grep(tree *object.Tree, re *regexp.Regexp, o *git_grep_options) ([]map[string]any, int, bool) {
+	matches := []map[string]any{}
+	files := 0
+	var scanned int64
+	truncated := false
+	iter := tree.Files()
+	defer iter.Close()
+	iter.ForEach(func(f *object.File) error {
+		if len(matches) >= o.limit || scanned >= git_grep_scan_limit {
+			truncated = true
+			return io.EOF
+		}
+		if f.Mode == filemode.Symlink || f.Mode == filemode.Submodule || f.Size > o.size || !git_grep_path(f.Name, o.paths) {
+			return nil
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return nil
+		}
+		defer r.Close()
+		files++
+		scanned += git_grep_file(f.Name, r, re, o, &matches)
+		return nil
+	})
+	return matches, files, truncated
+}
+
+// mochi.git.grep(entity, ref, pattern, options?) -> dict: Search the files
+// of a commit for lines matching a regular expression. Options are a dict
+// of paths (a list of globs or directories to search, all files if empty),
+// ignore_case, fixed (the pattern is a plain string), context (lines
+// before and after each match, up to 10), limit (most matches, default
+// 100, up to 1000), and size (largest file searched, default 1MB). Returns
+// matches, each a dict of path, line, text, before and after, files (how
+// many were searched), and truncated. None if the ref is not found.
+func api_git_grep(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity, ref, pattern string
+	var options *sl.Dict
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "ref", &ref, "pattern", &pattern, "options?", &options); err != nil {
+		return nil, err
+	}
+	if !valid(entity, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+	if pattern == "" || len(pattern) > git_grep_pattern_limit {
+		return sl_error(fn, "invalid pattern")
+	}
+
+	o := git_grep_options{limit: git_grep_match_default, size: git_grep_size_default}
+	ignore_case, fixed := false, false
+	if options != nil {
+		for key, v := range sl_decode(options).(map[string]any) {
+			switch key {
+			case "paths":
+				list, _ := v.([]any)
+				for _, p := range list {
+					if s, ok := p.(string); ok {
+						o.paths = append(o.paths, s)
+					}
+				}
+			case "ignore_case":
+				ignore_case, _ = v.(bool)
+			case "fixed":
+				fixed, _ = v.(bool)
+			case "context":
+				n, _ := v.(int64)
+				o.context = int(min(max(n, 0), git_grep_context_limit))
+			case "limit":
+				n, _ := v.(int64)
+				if n > 0 {
+					o.limit = int(min(n, git_grep_match_limit))
+				}
+			case "size":
+				n, _ := v.(int64)
+				if n > 0 {
+					o.size = min(n, git_grep_size_default*16)
+				}
+			default:
+				return sl_error(fn, "unknown option %q", key)
+			}
+		}
+	}
+	if fixed {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if ignore_case {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regex_compile(pattern)
+	if err != nil {
+		return sl_error(fn, "invalid pattern: %v", err)
+	}
+
+	owner, _ := t.Local("owner").(*User)
+	app, _ := t.Local("app").(*App)
+	if owner == nil || app == nil {
+		return sl_error(fn, "no owner")
+	}
+	if !git_can_read(t, owner, app, entity) {
+		return sl_error(fn, "permission denied: repository read required")
+	}
+	repo, err := git_open(owner, app, entity)
+	if err != nil {
+		return sl_error(fn, "failed to open repository: %v", err)
+	}
+	hash, err := git_resolve_ref(repo, ref)
+	if err != nil {
+		return sl.None, nil // ref not found
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return sl.None, nil // commit not found
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return sl.None, nil // tree not found
+	}
+
+	matches, files, truncated := git_grep(tree, re, &o)
+	return sl_encode(map[string]any{"matches": matches, "files": files, "truncated": truncated}), nil
+}
@@ -0,0 +1,90 @@
+// Mochi server: Git content search tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestGitGrepPath(t *testing.T) {
+	cases := []struct {
+		file    string
+		filters []string
+		want    bool
+	}{
+		{"src/main.go", nil, true},
+		{"src/main.go", []string{"*.go"}, true},
+		{"src/main.go", []string{"src"}, true},
+		{"src/main.go", []string{"src/*.go"}, true},
+		{"src/main.go", []string{"lib", "*.md"}, false},
+		{"srcx/main.go", []string{"src"}, false},
+	}
+	for _, c := range cases {
+		if got := git_grep_path(c.file, c.filters); got != c.want {
+			t.Errorf("git_grep_path(%q, %v) = %v, want %v", c.file, c.filters, got, c.want)
+		}
+	}
+}
+
+func TestGitGrep(t *testing.T) {
+	user, _, cleanup := create_git_test_env(t)
+	defer cleanup()
+	if err := git_init(user, test_app, "grep"); err != nil {
+		t.Fatal(err)
+	}
+	repo, _ := git_open(user, test_app, "grep")
+
+	code := "package main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n"
+	src := git_tree_test_object(t, repo, "", &object.Tree{Entries: []object.TreeEntry{
+		{Name: "main.go", Mode: filemode.Regular, Hash: git_tree_test_object(t, repo, code, nil)},
+	}})
+	hash := git_tree_test_object(t, repo, "", &object.Tree{Entries: []object.TreeEntry{
+		{Name: "binary", Mode: filemode.Regular, Hash: git_tree_test_object(t, repo, "main\x00main", nil)},
+		{Name: "link", Mode: filemode.Symlink, Hash: git_tree_test_object(t, repo, "src/main.go", nil)},
+		{Name: "readme.md", Mode: filemode.Regular, Hash: git_tree_test_object(t, repo, "Run main\n", nil)},
+		{Name: "src", Mode: filemode.Dir, Hash: src},
+	}})
+	tree, err := repo.TreeObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The binary file and the symlink are skipped
+	re := regexp.MustCompile("main")
+	matches, files, truncated := git_grep(tree, re, &git_grep_options{limit: 100, size: git_grep_size_default})
+	if len(matches) != 3 || files != 3 || truncated {
+		t.Fatalf("matches %v, files %d, truncated %v", matches, files, truncated)
+	}
+
+	// Context lines, within the file
+	matches, _, _ = git_grep(tree, regexp.MustCompile("println"), &git_grep_options{paths: []string{"*.go"}, context: 2, limit: 100, size: git_grep_size_default})
+	if len(matches) != 1 {
+		t.Fatalf("matches %v", matches)
+	}
+	m := matches[0]
+	before, _ := m["before"].([]string)
+	after, _ := m["after"].([]string)
+	if m["path"] != "src/main.go" || m["line"] != 4 || len(before) != 2 || before[1] != "func main() {" || len(after) != 1 || after[0] != "}" {
+		t.Errorf("match %v", m)
+	}
+
+	// The limit stops the search
+	matches, _, truncated = git_grep(tree, re, &git_grep_options{limit: 1, size: git_grep_size_default})
+	if len(matches) != 1 || !truncated {
+		t.Errorf("limited to %d matches, truncated %v", len(matches), truncated)
+	}
+
+	// Too large files are skipped
+	matches, _, _ = git_grep(tree, re, &git_grep_options{limit: 100, size: 10})
+	if len(matches) != 1 || matches[0]["path"] != "readme.md" {
+		t.Errorf("size limited matches %v", matches)
+	}
+}
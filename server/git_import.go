@@ -0,0 +1,480 @@
+// Mochi server: Git repository import
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	sl "go.starlark.net/starlark"
+)
+
+// Importers for GitHub and GitLab projects, used from an import job. An
+// importer mirrors the project's repository into a local repository with
+// mochi.importer.mirror(job, entity, url, token), and its wiki, which both
+// forges keep as a second repository, with wiki=True into another. It then
+// pages through the project's issues and pull or merge requests with
+// mochi.importer.issues(job, url, kind, page, token), which returns each page
+// as records in one shape whichever forge they came from, leaving the app to
+// store them as it likes.
+//
+// Every request needs the url: permission for the forge's host, and for
+// GitHub's API at api.github.com. A token, if given, is sent only to those
+// hosts; mirroring refuses redirects to other hosts so it cannot leak there.
+
+const (
+	git_import_page       = 100 // Issues per page
+	git_import_body_limit = 16 * 1024 * 1024
+)
+
+// git_import_client returns the client for one mirror: the transport the
+// calling app's HTTP requests go through, refusing redirects off the host.
+// It's given to go-git for that mirror only, rather than installed for
+// every HTTPS remote.
+func git_import_client(ctx context.Context) *http.Client {
+	c := &http.Client{Transport: url_transport_for(ctx, nil), Timeout: 30 * time.Minute}
+	guard := url_redirect_check(nil, nil)
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := guard(req, via); err != nil {
+			return err
+		}
+		if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			return fmt.Errorf("redirect to %s not allowed", req.URL.Hostname())
+		}
+		return nil
+	}
+	return c
+}
+
+// Forge describes a project on GitHub or GitLab
+type Forge struct {
+	Kind    string // "github" or "gitlab"
+	Host    string
+	Project string // owner/repository, or group/.../project
+	API     string // API base URL
+}
+
+// forge_parse identifies the forge and project of an HTTPS project URL. Any
+// host with "gitlab" in its name is taken to be GitLab; other hosts besides
+// github.com need kind given.
+func forge_parse(rawurl, kind string) (*Forge, error) {
+	u, err := neturl.Parse(rawurl)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return nil, fmt.Errorf("invalid project url")
+	}
+	host := strings.ToLower(u.Host)
+	project := strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if strings.Count(project, "/") < 1 || strings.Contains(project, "..") {
+		return nil, fmt.Errorf("invalid project url")
+	}
+	if kind == "" {
+		switch {
+		case host == "github.com":
+			kind = "github"
+		case strings.Contains(host, "gitlab"):
+			kind = "gitlab"
+		default:
+			return nil, fmt.Errorf("unknown forge at %q", host)
+		}
+	}
+
+	f := &Forge{Kind: kind, Host: host, Project: project}
+	switch kind {
+	case "github":
+		if strings.Count(project, "/") != 1 {
+			return nil, fmt.Errorf("invalid project url")
+		}
+		f.API = "https://" + host + "/api/v3"
+		if host == "github.com" {
+			f.API = "https://api.github.com"
+		}
+	case "gitlab":
+		f.API = "https://" + host + "/api/v4"
+	default:
+		return nil, fmt.Errorf("unknown forge %q", kind)
+	}
+	return f, nil
+}
+
+// repository returns the clone URL of the project, or of its wiki
+func (f *Forge) repository(wiki bool) string {
+	if wiki {
+		return "https://" + f.Host + "/" + f.Project + ".wiki.git"
+	}
+	return "https://" + f.Host + "/" + f.Project + ".git"
+}
+
+// auth returns the credentials for cloning with a token
+func (f *Forge) auth(token string) transport.AuthMethod {
+	if token == "" {
+		return nil
+	}
+	if f.Kind == "gitlab" {
+		return &githttp.BasicAuth{Username: "oauth2", Password: token}
+	}
+	return &githttp.BasicAuth{Username: "x-access-token", Password: token}
+}
+
+// issues_url returns the API URL of a page of the project's issues, or of
+// its pull or merge requests
+func (f *Forge) issues_url(kind string, page int) string {
+	query := fmt.Sprintf("per_page=%d&page=%d", git_import_page, page)
+	switch {
+	case f.Kind == "github" && kind == "pulls":
+		return f.API + "/repos/" + f.Project + "/pulls?state=all&" + query
+	case f.Kind == "github":
+		return f.API + "/repos/" + f.Project + "/issues?state=all&" + query
+	case kind == "pulls":
+		return f.API + "/projects/" + neturl.PathEscape(f.Project) + "/merge_requests?scope=all&" + query
+	default:
+		return f.API + "/projects/" + neturl.PathEscape(f.Project) + "/issues?scope=all&" + query
+	}
+}
+
+// forge_time converts a forge timestamp to Unix time, 0 if absent
+func forge_time(v any) int64 {
+	s, _ := v.(string)
+	if s == "" {
+		return 0
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// forge_record converts an issue or pull request from a forge's API into
+// the form apps receive
+func forge_record(forge, kind string, item map[string]any) map[string]any {
+	str := func(v any) string {
+		s, _ := v.(string)
+		return s
+	}
+	num := func(v any) int64 {
+		f, _ := v.(float64)
+		return int64(f)
+	}
+	login := func(v any) string {
+		m, _ := v.(map[string]any)
+		if forge == "gitlab" {
+			return str(m["username"])
+		}
+		return str(m["login"])
+	}
+
+	r := map[string]any{"kind": "issue", "title": str(item["title"]), "created": forge_time(item["created_at"]), "updated": forge_time(item["updated_at"]), "closed": forge_time(item["closed_at"])}
+	if kind == "pulls" {
+		r["kind"] = "pull"
+	}
+	var labels []string
+	raw, _ := item["labels"].([]any)
+	for _, l := range raw {
+		if m, ok := l.(map[string]any); ok {
+			labels = append(labels, str(m["name"]))
+		} else {
+			labels = append(labels, str(l))
+		}
+	}
+	r["labels"] = labels
+
+	state := str(item["state"])
+	if forge == "gitlab" {
+		r["number"] = num(item["iid"])
+		r["body"] = str(item["description"])
+		r["author"] = login(item["author"])
+		r["comments"] = num(item["user_notes_count"])
+		r["url"] = str(item["web_url"])
+		r["source"] = str(item["source_branch"])
+		r["target"] = str(item["target_branch"])
+		r["merged"] = forge_time(item["merged_at"])
+	} else {
+		r["number"] = num(item["number"])
+		r["body"] = str(item["body"])
+		r["author"] = login(item["user"])
+		r["comments"] = num(item["comments"])
+		r["url"] = str(item["html_url"])
+		head, _ := item["head"].(map[string]any)
+		base, _ := item["base"].(map[string]any)
+		r["source"] = str(head["ref"])
+		r["target"] = str(base["ref"])
+		r["merged"] = forge_time(item["merged_at"])
+	}
+	switch {
+	case state == "merged" || r["merged"].(int64) > 0:
+		r["state"] = "merged"
+	case state == "opened" || state == "open":
+		r["state"] = "open"
+	default:
+		r["state"] = "closed"
+	}
+	if r["kind"] == "issue" {
+		delete(r, "source")
+		delete(r, "target")
+		delete(r, "merged")
+	}
+	return r
+}
+
+// forge_issues fetches a page of a project's issues or pull requests,
+// returning their records and whether another page follows. With a token,
+// redirects are followed only on the API's host, as GitLab's PRIVATE-TOKEN
+// header would otherwise go with them.
+func forge_issues(ctx context.Context, f *Forge, kind string, page int, token string, allowed []string) ([]map[string]any, bool, error) {
+	headers := map[string]string{"Accept": "application/json"}
+	if token != "" {
+		if api, err := neturl.Parse(f.API); err == nil {
+			allowed = []string{strings.ToLower(api.Hostname())}
+		}
+		if f.Kind == "gitlab" {
+			headers["PRIVATE-TOKEN"] = token
+		} else {
+			headers["Authorization"] = "Bearer " + token
+		}
+	}
+	r, err := url_request_retry(ctx, "get", f.issues_url(kind, page), nil, headers, func() (any, error) { return nil, nil }, url_max_retries, allowed...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("%s returned status %d", f.Host, r.StatusCode)
+	}
+	var items []map[string]any
+	if err := json.NewDecoder(io.LimitReader(r.Body, git_import_body_limit)).Decode(&items); err != nil {
+		return nil, false, fmt.Errorf("invalid response from %s: %v", f.Host, err)
+	}
+
+	var records []map[string]any
+	for _, item := range items {
+		// GitHub lists pull requests among issues; they come from "pulls"
+		if f.Kind == "github" && kind == "issues" && item["pull_request"] != nil {
+			continue
+		}
+		records = append(records, forge_record(f.Kind, kind, item))
+	}
+	return records, len(items) == git_import_page, nil
+}
+
+// git_mirror fetches every branch and tag of a remote repository into a
+// local bare repository, creating it if needed, and points HEAD at the
+// remote's default branch. Returns the number of refs mirrored.
+func git_mirror(ctx context.Context, path, url string, auth transport.AuthMethod) (int, error) {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return 0, err
+	}
+	session, err := githttp.NewClient(git_import_client(ctx)).NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	advertised, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	refs, err := advertised.AllReferences()
+	if err != nil {
+		return 0, err
+	}
+
+	repo, err := git.PlainOpen(path)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return 0, err
+		}
+		repo, err = git.PlainInit(path, true)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Ask for the branches and tags not already here, saying what is
+	req := packp.NewUploadPackRequestFromCapabilities(advertised.Capabilities)
+	if advertised.Capabilities.Supports(capability.NoProgress) {
+		req.Capabilities.Set(capability.NoProgress)
+	}
+	var mirrored []*plumbing.Reference
+	for name, ref := range refs {
+		if (!name.IsBranch() && !name.IsTag()) || ref.Type() != plumbing.HashReference {
+			continue
+		}
+		mirrored = append(mirrored, ref)
+		if _, err := repo.Storer.EncodedObject(plumbing.AnyObject, ref.Hash()); err != nil && !slices.Contains(req.Wants, ref.Hash()) {
+			req.Wants = append(req.Wants, ref.Hash())
+		}
+	}
+	if len(req.Wants) > 0 {
+		if existing, err := repo.References(); err == nil {
+			existing.ForEach(func(ref *plumbing.Reference) error {
+				if ref.Type() == plumbing.HashReference && !slices.Contains(req.Haves, ref.Hash()) {
+					req.Haves = append(req.Haves, ref.Hash())
+				}
+				return nil
+			})
+		}
+		if err := git_mirror_fetch(ctx, session, repo, req); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, ref := range mirrored {
+		if err := repo.Storer.SetReference(ref); err != nil {
+			return 0, err
+		}
+	}
+	if head, found := refs[plumbing.HEAD]; found && head.Type() == plumbing.SymbolicReference {
+		repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, head.Target()))
+	}
+	return len(mirrored), nil
+}
+
+// git_mirror_fetch receives the pack answering a request and stores its
+// objects in a repository
+func git_mirror_fetch(ctx context.Context, session transport.UploadPackSession, repo *git.Repository, req *packp.UploadPackRequest) error {
+	response, err := session.UploadPack(ctx, req)
+	if errors.Is(err, transport.ErrEmptyUploadPackRequest) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+
+	var pack io.Reader = response
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		pack = sideband.NewDemuxer(sideband.Sideband64k, response)
+	case req.Capabilities.Supports(capability.Sideband):
+		pack = sideband.NewDemuxer(sideband.Sideband, response)
+	}
+	return packfile.UpdateObjectStorage(repo.Storer, pack)
+}
+
+// mochi.importer.mirror(job, entity, url, token?, wiki?, forge?) -> dict:
+// Mirror a GitHub or GitLab project's repository, or its wiki, into the
+// local repository entity, creating it if needed. Running it again fetches
+// what has changed. Returns {refs, size}.
+func api_importer_mirror(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, entity, url, token, kind string
+	wiki := false
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "job", &id, "entity", &entity, "url", &url, "token?", &token, "wiki?", &wiki, "forge?", &kind); err != nil {
+		return nil, err
+	}
+	_, user, app, err := import_caller(t, id)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(entity, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+	f, err := forge_parse(url, kind)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	source := f.repository(wiki)
+	if err := require_permission_url(t, fn, source); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	path := git_repo_path(user, app, entity)
+	_, err = os.Stat(path)
+	created := err != nil
+	if !created && !git_can_write(t, user, app, entity) {
+		return sl_error(fn, "not allowed to write repository")
+	}
+	remaining, err := user_storage_remaining(user)
+	if err != nil {
+		return sl_error(fn, "unable to measure storage: %v", err)
+	}
+	if remaining <= 0 {
+		return sl_error(fn, "storage limit exceeded")
+	}
+	if err := import_wait(t, source); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	defer git_replicate_after(user, app, entity)()
+	refs, err := git_mirror(starlark_context(t), path, source, f.auth(token))
+	if err != nil {
+		if created {
+			os.RemoveAll(path)
+		}
+		return sl_error(fn, "unable to mirror %q: %v", source, err)
+	}
+	size, _ := git_size(user, app, entity)
+	if after, err := user_storage_remaining(user); err == nil && after < 0 {
+		if created {
+			os.RemoveAll(path)
+		}
+		return sl_error(fn, "storage limit exceeded")
+	}
+	return sl_encode(map[string]any{"refs": refs, "size": size}), nil
+}
+
+// mochi.importer.issues(job, url, kind?, page?, token?, forge?) -> dict: Get
+// a page of a GitHub or GitLab project's issues, or with kind "pulls" its
+// pull or merge requests, oldest pages first from page 1. Returns {items,
+// next}, where each item is {kind, number, title, body, state, author,
+// labels, comments, url, created, updated, closed}, pulls adding source,
+// target and merged, state is "open", "closed" or "merged", and next is the
+// following page or None.
+func api_importer_issues(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, url, token, forge string
+	kind := "issues"
+	page := 1
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "job", &id, "url", &url, "kind?", &kind, "page?", &page, "token?", &token, "forge?", &forge); err != nil {
+		return nil, err
+	}
+	if _, _, _, err := import_caller(t, id); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if kind != "issues" && kind != "pulls" {
+		return sl_error(fn, "invalid kind %q", kind)
+	}
+	if page < 1 {
+		return sl_error(fn, "invalid page")
+	}
+	f, err := forge_parse(url, forge)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	api := f.issues_url(kind, page)
+	if err := require_permission_url(t, fn, api); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if err := import_wait(t, api); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	records, more, err := forge_issues(starlark_context(t), f, kind, page, token, url_domains_granted(t))
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	result := map[string]any{"items": records, "next": nil}
+	if more {
+		result["next"] = page + 1
+	}
+	return sl_encode(result), nil
+}
@@ -0,0 +1,88 @@
+// Mochi server: Git push events
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"strings"
+)
+
+// A push over Smart HTTP changes refs without the owning app running, so
+// the app is told afterwards: for each branch or tag the push created,
+// updated or deleted, the repository entity sends itself an event on the
+// app's service, such as "git/branch/updated" or "git/tag/created", with
+// content of repository, ref, name, old, new and pusher, old or new ""
+// for a ref created or deleted. An app handles the events it declares,
+// for instance to rebuild a wiki from a branch or start a deploy. Watchers
+// that chose events "push" with mochi.git.watch.add() are sent the same
+// events on their own service. Changes made through the git API are not
+// sent, since the app made them.
+
+// git_push_changes describes a push's changes to branches and tags, each
+// as the event to send and its content
+func git_push_changes(entity, pusher string, before, after map[string]string) []map[string]any {
+	var events []map[string]any
+	for _, c := range git_refs_changes(before, after) {
+		change := c.([]string)
+		ref, old, current := change[0], change[1], change[2]
+		kind, name := "", ""
+		if n, found := strings.CutPrefix(ref, "refs/heads/"); found {
+			kind, name = "branch", n
+		} else if n, found := strings.CutPrefix(ref, "refs/tags/"); found {
+			kind, name = "tag", n
+		} else {
+			continue
+		}
+		action := "updated"
+		if old == "" {
+			action = "created"
+		} else if current == "" {
+			action = "deleted"
+		}
+		events = append(events, map[string]any{
+			"event":   "git/" + kind + "/" + action,
+			"content": map[string]any{"repository": entity, "ref": ref, "name": name, "old": old, "new": current, "pusher": pusher},
+		})
+	}
+	return events
+}
+
+// git_push_events sends a push's branch and tag events to the owning app
+// and to watchers of the repository that asked for them
+func git_push_events(a *App, owner *User, entity string, pusher *User, before, after map[string]string) {
+	if a == nil || owner == nil {
+		return
+	}
+	identity := ""
+	if pusher != nil && pusher.Identity != nil {
+		identity = pusher.Identity.ID
+	}
+	events := git_push_changes(entity, identity, before, after)
+	if len(events) == 0 {
+		return
+	}
+
+	services := app_services(a, owner)
+	watchers, _ := checks_db().rows("select watcher, service from watchers where repository=? and app=? and events='push'", entity, a.id)
+	for _, e := range events {
+		event, _ := e["event"].(string)
+		content, _ := e["content"].(map[string]any)
+		if len(services) > 0 {
+			m := message(entity, entity, services[0], event)
+			m.content = content
+			m.FromApp = a.id
+			m.send()
+		}
+		for _, w := range watchers {
+			watcher, _ := w["watcher"].(string)
+			service, _ := w["service"].(string)
+			m := message(entity, watcher, service, event)
+			m.content = content
+			m.FromApp = a.id
+			m.send()
+		}
+	}
+}
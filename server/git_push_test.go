@@ -0,0 +1,38 @@
+// Mochi server: Git push events tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestGitPushChanges(t *testing.T) {
+	before := map[string]string{"refs/heads/main": "1", "refs/heads/old": "2", "refs/proposals/p1": "3"}
+	after := map[string]string{"refs/heads/main": "4", "refs/tags/v1.0": "5", "refs/proposals/p1": "6"}
+	events := map[string]map[string]any{}
+	for _, e := range git_push_changes("repo", "pusher", before, after) {
+		content := e["content"].(map[string]any)
+		events[content["ref"].(string)] = e
+	}
+
+	// Proposal refs aren't branches or tags, so aren't sent
+	if len(events) != 3 {
+		t.Fatalf("events %v, want 3", events)
+	}
+	for ref, want := range map[string]string{"refs/heads/main": "git/branch/updated", "refs/heads/old": "git/branch/deleted", "refs/tags/v1.0": "git/tag/created"} {
+		if got := events[ref]["event"]; got != want {
+			t.Errorf("%s sent as %v, want %s", ref, got, want)
+		}
+	}
+	content := events["refs/heads/main"]["content"].(map[string]any)
+	if content["name"] != "main" || content["old"] != "1" || content["new"] != "4" || content["pusher"] != "pusher" || content["repository"] != "repo" {
+		t.Errorf("update content %v", content)
+	}
+	if content := events["refs/tags/v1.0"]["content"].(map[string]any); content["name"] != "v1.0" || content["old"] != "" {
+		t.Errorf("tag content %v", content)
+	}
+}
@@ -0,0 +1,204 @@
+// Mochi server: Git trees
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	sl "go.starlark.net/starlark"
+)
+
+// Tree entries are described without ever following them: a symlink gives
+// its target, read from its blob, and a submodule the commit it points to
+// and the URL .gitmodules at the root of the same commit configures for
+// its path, since neither has content in the repository itself.
+
+const (
+	git_tree_limit = 50000 // Most entries mochi.git.tree.recursive() returns
+	git_link_limit = 4096  // Longest symlink target read
+)
+
+// git_tree_module is a callable module that also has a .recursive method
+type git_tree_module struct{}
+
+func (m *git_tree_module) String() string        { return "mochi.git.tree" }
+func (m *git_tree_module) Type() string          { return "module" }
+func (m *git_tree_module) Freeze()               {}
+func (m *git_tree_module) Truth() sl.Bool        { return sl.True }
+func (m *git_tree_module) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: module") }
+func (m *git_tree_module) Name() string          { return "mochi.git.tree" }
+func (m *git_tree_module) AttrNames() []string   { return []string{"recursive"} }
+
+func (m *git_tree_module) Attr(name string) (sl.Value, error) {
+	if name == "recursive" {
+		return sl.NewBuiltin("mochi.git.tree.recursive", api_git_tree_recursive), nil
+	}
+	return nil, nil
+}
+
+func (m *git_tree_module) CallInternal(thread *sl.Thread, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	return api_git_tree(thread, sl.NewBuiltin("mochi.git.tree", api_git_tree), args, kwargs)
+}
+
+// git_submodules returns the URLs .gitmodules in a commit configures, by path
+func git_submodules(commit *object.Commit) map[string]string {
+	urls := map[string]string{}
+	f, err := commit.File(".gitmodules")
+	if err != nil {
+		return urls
+	}
+	content, err := f.Contents()
+	if err != nil {
+		return urls
+	}
+	modules := config.NewModules()
+	if err := modules.Unmarshal([]byte(content)); err != nil {
+		return urls
+	}
+	for _, s := range modules.Submodules {
+		urls[s.Path] = s.URL
+	}
+	return urls
+}
+
+// git_tree_entry describes an entry of the tree at dir
+func git_tree_entry(repo *git.Repository, entry object.TreeEntry, dir string, submodules map[string]string) map[string]any {
+	e := map[string]any{
+		"name": entry.Name,
+		"sha":  entry.Hash.String(),
+		"mode": fmt.Sprintf("%o", entry.Mode),
+	}
+	switch entry.Mode {
+	case filemode.Dir:
+		e["type"] = "dir"
+	case filemode.Submodule:
+		e["type"] = "submodule"
+		e["commit"] = entry.Hash.String()
+		e["url"] = submodules[path.Join(dir, entry.Name)]
+	case filemode.Symlink:
+		e["type"] = "symlink"
+		if blob, err := repo.BlobObject(entry.Hash); err == nil {
+			if r, err := blob.Reader(); err == nil {
+				target, _ := io.ReadAll(io.LimitReader(r, git_link_limit))
+				r.Close()
+				e["target"] = string(target)
+			}
+		}
+	default:
+		e["type"] = "file"
+		if size, err := repo.Storer.EncodedObjectSize(entry.Hash); err == nil {
+			e["size"] = size
+		}
+	}
+	return e
+}
+
+// git_tree_sort puts directories first, then sorts by name
+func git_tree_sort(entries []map[string]any) {
+	sort.Slice(entries, func(i, j int) bool {
+		i_dir := entries[i]["type"] == "dir"
+		j_dir := entries[j]["type"] == "dir"
+		if i_dir != j_dir {
+			return i_dir
+		}
+		return entries[i]["name"].(string) < entries[j]["name"].(string)
+	})
+}
+
+// git_tree_walk appends a tree's entries and, to the given depth, those of
+// its subdirectories, each directory's entries directly after it. Returns
+// false once the limit is reached.
+func git_tree_walk(repo *git.Repository, tree *object.Tree, dir string, depth int, submodules map[string]string, entries *[]map[string]any) bool {
+	var level []map[string]any
+	for _, entry := range tree.Entries {
+		level = append(level, git_tree_entry(repo, entry, dir, submodules))
+	}
+	git_tree_sort(level)
+
+	for _, e := range level {
+		if len(*entries) >= git_tree_limit {
+			return false
+		}
+		name := e["name"].(string)
+		e["path"] = path.Join(dir, name)
+		*entries = append(*entries, e)
+		if e["type"] != "dir" || depth == 1 {
+			continue
+		}
+		sub, err := tree.Tree(name)
+		if err != nil {
+			continue
+		}
+		if !git_tree_walk(repo, sub, path.Join(dir, name), max(depth-1, 0), submodules, entries) {
+			return false
+		}
+	}
+	return true
+}
+
+// mochi.git.tree.recursive(entity, ref?, path?, depth?) -> dict: List a
+// tree and its subdirectories, to depth levels, or all of them if depth is
+// 0. Returns entries, the tree's entries as mochi.git.tree() gives them
+// plus their path, each directory's after it, and truncated, true if there
+// were more than 50000. None if the ref or path is not found.
+func api_git_tree_recursive(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity string
+	ref, dir, depth := "HEAD", "", 0
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "ref?", &ref, "path?", &dir, "depth?", &depth); err != nil {
+		return nil, err
+	}
+	if !valid(entity, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+	if depth < 0 {
+		return sl_error(fn, "invalid depth")
+	}
+
+	owner, _ := t.Local("owner").(*User)
+	app, _ := t.Local("app").(*App)
+	if owner == nil || app == nil {
+		return sl_error(fn, "no owner")
+	}
+	if !git_can_read(t, owner, app, entity) {
+		return sl_error(fn, "permission denied: repository read required")
+	}
+
+	repo, err := git_open(owner, app, entity)
+	if err != nil {
+		return sl_error(fn, "failed to open repository: %v", err)
+	}
+	hash, err := git_resolve_ref(repo, ref)
+	if err != nil {
+		return sl.None, nil // ref not found
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return sl.None, nil // commit not found
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return sl.None, nil // tree not found
+	}
+	dir = path.Clean("/" + dir)[1:]
+	if dir != "" {
+		tree, err = tree.Tree(dir)
+		if err != nil {
+			return sl.None, nil // path not found
+		}
+	}
+
+	entries := []map[string]any{}
+	complete := git_tree_walk(repo, tree, dir, depth, git_submodules(commit), &entries)
+	return sl_encode(map[string]any{"entries": entries, "truncated": !complete}), nil
+}
@@ -0,0 +1,106 @@
+// Mochi server: Git trees tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// git_tree_test_object stores a blob or tree, returning its hash
+func git_tree_test_object(t *testing.T, repo *git.Repository, content string, tree *object.Tree) plumbing.Hash {
+	t.Helper()
+	obj := repo.Storer.NewEncodedObject()
+	if tree != nil {
+		tree.Encode(obj)
+	} else {
+		obj.SetType(plumbing.BlobObject)
+		w, _ := obj.Writer()
+		w.Write([]byte(content))
+		w.Close()
+	}
+	h, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestGitTreeRecursive(t *testing.T) {
+	user, _, cleanup := create_git_test_env(t)
+	defer cleanup()
+	if err := git_init(user, test_app, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	repo, _ := git_open(user, test_app, "tree")
+
+	// src/main.go, src/lib/util.go, a link to src/main.go, and a submodule
+	// at vendor/dep
+	module := plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")
+	lib := git_tree_test_object(t, repo, "", &object.Tree{Entries: []object.TreeEntry{{Name: "util.go", Mode: filemode.Regular, Hash: git_tree_test_object(t, repo, "package lib", nil)}}})
+	src := git_tree_test_object(t, repo, "", &object.Tree{Entries: []object.TreeEntry{
+		{Name: "lib", Mode: filemode.Dir, Hash: lib},
+		{Name: "main.go", Mode: filemode.Regular, Hash: git_tree_test_object(t, repo, "package main", nil)},
+	}})
+	vendor := git_tree_test_object(t, repo, "", &object.Tree{Entries: []object.TreeEntry{{Name: "dep", Mode: filemode.Submodule, Hash: module}}})
+	gitmodules := "[submodule \"dep\"]\n\tpath = vendor/dep\n\turl = https://example.com/dep.git\n"
+	root := git_tree_test_object(t, repo, "", &object.Tree{Entries: []object.TreeEntry{
+		{Name: ".gitmodules", Mode: filemode.Regular, Hash: git_tree_test_object(t, repo, gitmodules, nil)},
+		{Name: "link", Mode: filemode.Symlink, Hash: git_tree_test_object(t, repo, "src/main.go", nil)},
+		{Name: "src", Mode: filemode.Dir, Hash: src},
+		{Name: "vendor", Mode: filemode.Dir, Hash: vendor},
+	}})
+	sig := object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()}
+	obj := repo.Storer.NewEncodedObject()
+	(&object.Commit{Author: sig, Committer: sig, Message: "Tree\n", TreeHash: root}).Encode(obj)
+	hash, _ := repo.Storer.SetEncodedObject(obj)
+	commit, _ := repo.CommitObject(hash)
+	tree, _ := commit.Tree()
+	submodules := git_submodules(commit)
+
+	var entries []map[string]any
+	if !git_tree_walk(repo, tree, "", 0, submodules, &entries) {
+		t.Fatal("walk truncated")
+	}
+	var paths []string
+	by_path := map[string]map[string]any{}
+	for _, e := range entries {
+		paths = append(paths, e["path"].(string))
+		by_path[e["path"].(string)] = e
+	}
+	want := []string{"src", "src/lib", "src/lib/util.go", "src/main.go", "vendor", "vendor/dep", ".gitmodules", "link"}
+	if len(paths) != len(want) {
+		t.Fatalf("paths %v, want %v", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("paths %v, want %v", paths, want)
+		}
+	}
+
+	if e := by_path["link"]; e["type"] != "symlink" || e["target"] != "src/main.go" {
+		t.Errorf("symlink %v", e)
+	}
+	if e := by_path["vendor/dep"]; e["type"] != "submodule" || e["commit"] != module.String() || e["url"] != "https://example.com/dep.git" {
+		t.Errorf("submodule %v", e)
+	}
+	if e := by_path["src/main.go"]; e["size"] != int64(len("package main")) {
+		t.Errorf("file %v", e)
+	}
+
+	// Depth 1 is the directory alone
+	entries = nil
+	git_tree_walk(repo, tree, "", 1, submodules, &entries)
+	if len(entries) != 4 {
+		t.Errorf("%d entries at depth 1, want 4", len(entries))
+	}
+}
@@ -0,0 +1,499 @@
+// Mochi server: Git shallow and partial clones
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/utils/ioutil"
+)
+
+// go-git's upload-pack server refuses shallow fetches and knows nothing of
+// object filters, so a CI system cloning with --depth or --filter would get
+// an error, or the whole history. Upload-pack advertises the "shallow" and
+// "filter" capabilities, and requests that use them are answered here
+// instead: commits are walked to the requested depth, the commits at the
+// edge are reported as shallow, and blobs the filter leaves out are not
+// packed. Only "deepen <n>" is supported, relative to the client's shallow
+// commits with deepen-relative, and the filters "blob:none" and
+// "blob:limit=<n>[kmg]". Objects a partial clone later finds missing are
+// fetched by hash through the ordinary path, so any object reachable from a
+// ref may be asked for, but nothing else: a commit force-pushed away is not
+// served.
+
+const (
+	git_upload_reach_limit        = 500000
+	git_upload_reach_repositories = 8
+)
+
+// git_upload_capabilities adds what upload-pack supports beyond go-git
+func git_upload_capabilities(caps *capability.List) {
+	caps.Set(capability.Shallow)
+	caps.Set(capability.DeepenRelative)
+	caps.Set(capability.AllowReachableSHA1InWant)
+	caps.Set(capability.Filter)
+}
+
+// git_upload_filter describes which blobs a partial clone leaves out
+type git_upload_filter struct {
+	blobs bool  // Leave out every blob
+	limit int64 // Otherwise, leave out blobs of at least this size
+}
+
+// git_upload_filter_parse parses a filter specification
+func git_upload_filter_parse(spec string) (*git_upload_filter, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if spec == "blob:none" {
+		return &git_upload_filter{blobs: true}, nil
+	}
+	if size, found := strings.CutPrefix(spec, "blob:limit="); found {
+		multiplier := int64(1)
+		switch {
+		case strings.HasSuffix(size, "k"):
+			multiplier = 1 << 10
+		case strings.HasSuffix(size, "m"):
+			multiplier = 1 << 20
+		case strings.HasSuffix(size, "g"):
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			size = size[:len(size)-1]
+		}
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid filter %q", spec)
+		}
+		return &git_upload_filter{blobs: n == 0, limit: n * multiplier}, nil
+	}
+	return nil, fmt.Errorf("unsupported filter %q", spec)
+}
+
+// omits reports whether the filter leaves out a blob of the given size
+func (f *git_upload_filter) omits(size int64) bool {
+	if f == nil {
+		return false
+	}
+	return f.blobs || size >= f.limit
+}
+
+// git_upload_request decodes an upload-pack request, taking out the filter
+// line go-git can't decode. Returns the request, its filter specification,
+// and whether the client sent "done", so expects the pack rather than
+// another round of negotiation.
+func git_upload_request(r io.Reader) (*packp.UploadPackRequest, string, bool, error) {
+	var buf bytes.Buffer
+	e := pktline.NewEncoder(&buf)
+	s := pktline.NewScanner(r)
+	filter := ""
+	done := false
+	wants := true
+	for s.Scan() {
+		line := s.Bytes()
+		switch {
+		case len(line) == 0:
+			e.Flush()
+			wants = false
+			continue
+		case wants && bytes.HasPrefix(line, []byte("filter ")):
+			filter = strings.TrimSpace(string(line[len("filter "):]))
+			continue
+		case !wants && bytes.Equal(bytes.TrimSpace(line), []byte("done")):
+			done = true
+		}
+		e.Encode(line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, "", false, err
+	}
+
+	req := packp.NewUploadPackRequest()
+	if err := req.Decode(&buf); err != nil {
+		return nil, "", false, err
+	}
+	return req, filter, done, nil
+}
+
+// git_upload_reach is a walk from a repository's ref tips. It's kept after
+// a fetch so the next fetch by hash, typically a partial clone filling in a
+// missing object, resumes it rather than walking the history again. Any
+// change to the refs starts a new walk.
+type git_upload_reach struct {
+	sync.Mutex
+	key   string
+	tips  map[plumbing.Hash]bool
+	found map[plumbing.Hash]bool
+	queue []plumbing.Hash
+}
+
+var (
+	git_upload_reaches      = map[string]*git_upload_reach{}
+	git_upload_reaches_lock sync.Mutex
+)
+
+// git_upload_reach_get returns the walk for a repository's current refs
+func git_upload_reach_get(repo_path string) *git_upload_reach {
+	var queue []plumbing.Hash
+	for _, h := range git_refs(repo_path) {
+		queue = append(queue, plumbing.NewHash(h))
+	}
+	slices.SortFunc(queue, func(a, b plumbing.Hash) int { return bytes.Compare(a[:], b[:]) })
+	queue = slices.Compact(queue)
+	key := fmt.Sprint(queue)
+
+	git_upload_reaches_lock.Lock()
+	defer git_upload_reaches_lock.Unlock()
+	r := git_upload_reaches[repo_path]
+	if r == nil || r.key != key {
+		if r == nil && len(git_upload_reaches) >= git_upload_reach_repositories {
+			for path := range git_upload_reaches {
+				delete(git_upload_reaches, path)
+				break
+			}
+		}
+		r = &git_upload_reach{key: key, tips: map[plumbing.Hash]bool{}, found: map[plumbing.Hash]bool{}, queue: queue}
+		for _, h := range queue {
+			r.tips[h] = true
+		}
+		git_upload_reaches[repo_path] = r
+	}
+	return r
+}
+
+// git_upload_reach_drop forgets a walk left incomplete by an error
+func git_upload_reach_drop(repo_path string, r *git_upload_reach) {
+	git_upload_reaches_lock.Lock()
+	if git_upload_reaches[repo_path] == r {
+		delete(git_upload_reaches, repo_path)
+	}
+	git_upload_reaches_lock.Unlock()
+}
+
+// git_upload_reachable checks that every want is reachable from a ref. The
+// walk stops at git_upload_reach_limit objects, refusing wants beyond it.
+func git_upload_reachable(s storer.EncodedObjectStorer, repo_path string, wants []plumbing.Hash) error {
+	r := git_upload_reach_get(repo_path)
+	r.Lock()
+	defer r.Unlock()
+
+	missing := map[plumbing.Hash]bool{}
+	for _, w := range wants {
+		if !r.found[w] && !r.tips[w] {
+			missing[w] = true
+		}
+	}
+
+	for len(missing) > 0 && len(r.queue) > 0 {
+		if len(r.found) >= git_upload_reach_limit {
+			return fmt.Errorf("repository too large to check wants")
+		}
+		h := r.queue[0]
+		r.queue = r.queue[1:]
+		if r.found[h] {
+			continue
+		}
+		o, err := s.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			continue
+		}
+		switch o.Type() {
+		case plumbing.TagObject:
+			r.found[h] = true
+			if tag, err := object.DecodeTag(s, o); err == nil {
+				r.queue = append(r.queue, tag.Target)
+			}
+		case plumbing.CommitObject:
+			r.found[h] = true
+			c, err := object.DecodeCommit(s, o)
+			if err != nil {
+				continue
+			}
+			if err := git_upload_walk(s, c.TreeHash, r.found, nil, nil); err != nil {
+				git_upload_reach_drop(repo_path, r)
+				return err
+			}
+			r.queue = append(r.queue, c.ParentHashes...)
+		default:
+			r.found[h] = true
+		}
+		for w := range missing {
+			if r.found[w] {
+				delete(missing, w)
+			}
+		}
+	}
+	for w := range missing {
+		return fmt.Errorf("want %s is not reachable from any ref", w)
+	}
+	return nil
+}
+
+// git_upload_shallow_needed reports whether a request must be answered here
+// rather than by go-git
+func git_upload_shallow_needed(req *packp.UploadPackRequest, filter string) bool {
+	return !req.Depth.IsZero() || len(req.Shallows) > 0 || filter != ""
+}
+
+// git_upload_walk collects a tree and everything in it not already found,
+// leaving out blobs the filter omits
+func git_upload_walk(s storer.EncodedObjectStorer, tree plumbing.Hash, found map[plumbing.Hash]bool, filter *git_upload_filter, send *[]plumbing.Hash) error {
+	if found[tree] {
+		return nil
+	}
+	found[tree] = true
+	if send != nil {
+		*send = append(*send, tree)
+	}
+	t, err := object.GetTree(s, tree)
+	if err != nil {
+		return err
+	}
+	for _, entry := range t.Entries {
+		switch entry.Mode {
+		case filemode.Dir:
+			if err := git_upload_walk(s, entry.Hash, found, filter, send); err != nil {
+				return err
+			}
+		case filemode.Submodule:
+			// A commit in another repository
+		default:
+			if found[entry.Hash] {
+				continue
+			}
+			if filter != nil {
+				size, err := s.EncodedObjectSize(entry.Hash)
+				if err != nil {
+					return err
+				}
+				if filter.omits(size) {
+					continue
+				}
+			}
+			found[entry.Hash] = true
+			if send != nil {
+				*send = append(*send, entry.Hash)
+			}
+		}
+	}
+	return nil
+}
+
+// git_upload_objects returns the objects a shallow or filtered fetch sends,
+// the commits at the edge of the depth that become shallow, and the
+// client's shallow commits whose parents are now sent
+func git_upload_objects(s storer.EncodedObjectStorer, req *packp.UploadPackRequest, filter *git_upload_filter) ([]plumbing.Hash, []plumbing.Hash, []plumbing.Hash, error) {
+	depth := 0
+	switch d := req.Depth.(type) {
+	case nil:
+	case packp.DepthCommits:
+		depth = int(d)
+	default:
+		return nil, nil, nil, fmt.Errorf("only deepen by commits is supported")
+	}
+
+	// Deepening relative to the client's shallow commits counts depth from
+	// them, not from the wants; level 0 is not counted
+	relative := req.Capabilities.Supports(capability.DeepenRelative)
+	limit, start := depth, 1
+	if relative {
+		limit, start = depth+1, 0
+	}
+
+	client := map[plumbing.Hash]bool{}
+	for _, h := range req.Shallows {
+		client[h] = true
+	}
+
+	// Everything the client has, bounded by its own shallow commits
+	have := map[plumbing.Hash]bool{}
+	queue := append([]plumbing.Hash{}, req.Haves...)
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		if have[h] {
+			continue
+		}
+		c, err := object.GetCommit(s, h)
+		if err != nil {
+			continue
+		}
+		have[h] = true
+		if err := git_upload_walk(s, c.TreeHash, have, nil, nil); err != nil {
+			return nil, nil, nil, err
+		}
+		if !client[h] {
+			queue = append(queue, c.ParentHashes...)
+		}
+	}
+
+	// Walk the wants, breadth first so each commit is reached at its
+	// shallowest depth
+	type entry struct {
+		hash  plumbing.Hash
+		level int
+	}
+	var send, shallow, unshallow []plumbing.Hash
+	found := map[plumbing.Hash]bool{}
+	for h := range have {
+		found[h] = true
+	}
+	visited := map[plumbing.Hash]bool{}
+	var commits []entry
+	for _, want := range req.Wants {
+		h := want
+	peel:
+		for {
+			o, err := s.EncodedObject(plumbing.AnyObject, h)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("want %s: %v", want, err)
+			}
+			switch o.Type() {
+			case plumbing.TagObject:
+				if !found[h] {
+					found[h] = true
+					send = append(send, h)
+				}
+				tag, err := object.DecodeTag(s, o)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				h = tag.Target
+				continue
+			case plumbing.CommitObject:
+				commits = append(commits, entry{h, start})
+			case plumbing.TreeObject:
+				if err := git_upload_walk(s, h, found, filter, &send); err != nil {
+					return nil, nil, nil, err
+				}
+			default:
+				// A blob asked for by name is sent whatever the filter
+				if !found[h] {
+					found[h] = true
+					send = append(send, h)
+				}
+			}
+			break peel
+		}
+	}
+
+	for len(commits) > 0 {
+		e := commits[0]
+		commits = commits[1:]
+		if visited[e.hash] {
+			continue
+		}
+		visited[e.hash] = true
+		if have[e.hash] && !client[e.hash] {
+			continue
+		}
+		c, err := object.GetCommit(s, e.hash)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !found[e.hash] {
+			found[e.hash] = true
+			send = append(send, e.hash)
+		}
+		if err := git_upload_walk(s, c.TreeHash, found, filter, &send); err != nil {
+			return nil, nil, nil, err
+		}
+		if len(c.ParentHashes) == 0 {
+			continue
+		}
+		level := e.level
+		if level == 0 && client[e.hash] {
+			level = 1
+		}
+		if depth > 0 && level > 0 && level >= limit {
+			if !client[e.hash] {
+				shallow = append(shallow, e.hash)
+			}
+			continue
+		}
+		if client[e.hash] {
+			if depth == 0 {
+				continue
+			}
+			unshallow = append(unshallow, e.hash)
+		}
+		next := 0
+		if level > 0 {
+			next = level + 1
+		}
+		for _, p := range c.ParentHashes {
+			commits = append(commits, entry{p, next})
+		}
+	}
+	return send, shallow, unshallow, nil
+}
+
+// git_upload_pack_shallow answers a shallow or filtered fetch
+func git_upload_pack_shallow(c *gin.Context, repo_path string, s storer.Storer, req *packp.UploadPackRequest, spec string, done bool) bool {
+	filter, err := git_upload_filter_parse(spec)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%v", err)
+		return true
+	}
+
+	send, shallow, unshallow, err := git_upload_objects(s, req, filter)
+	if err != nil {
+		info("git_upload_pack: shallow fetch failed for %s: %v", repo_path, err)
+		c.String(http.StatusInternalServerError, "Upload pack failed")
+		return true
+	}
+
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "application/x-git-upload-pack-result")
+	c.Header("Cache-Control", "no-cache")
+
+	// The shallow commits are sent in every round, and the pack only once
+	// the client has finished negotiating. A round that sent haves is
+	// answered with NAK: nothing is acknowledged, so the client sends all
+	// its haves, which then bound the pack.
+	if !req.Depth.IsZero() {
+		update := packp.ShallowUpdate{Shallows: shallow, Unshallows: unshallow}
+		if err := update.Encode(c.Writer); err != nil {
+			info("git_upload_pack: failed to encode shallow update: %v", err)
+			return true
+		}
+	}
+	if !done {
+		if len(req.Haves) > 0 {
+			pktline.NewEncoder(c.Writer).Encodef("NAK\n")
+		}
+		return true
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := packfile.NewEncoder(pw, s, false).Encode(send, 10)
+		pw.CloseWithError(err)
+	}()
+	resp := packp.NewUploadPackResponseWithPackfile(&packp.UploadPackRequest{UploadRequest: packp.UploadRequest{Capabilities: req.Capabilities, Depth: packp.DepthCommits(0)}}, ioutil.NewContextReadCloser(context.Background(), pr))
+	if err := resp.Encode(c.Writer); err != nil {
+		info("git_upload_pack: failed to encode response: %v", err)
+	}
+	return true
+}
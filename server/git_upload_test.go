@@ -0,0 +1,191 @@
+// Mochi server: Git shallow and partial clones tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+// git_upload_test_server serves a repository over Smart HTTP for fetching
+func git_upload_test_server(repo_path string) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/repo/info/refs", func(c *gin.Context) {
+		git_info_refs(c, repo_path, c.Query("service"))
+	})
+	r.POST("/repo/git-upload-pack", func(c *gin.Context) {
+		git_service_rpc(c, repo_path, "git-upload-pack", nil)
+	})
+	return httptest.NewServer(r)
+}
+
+// git_upload_test_run runs git, failing the test if it fails
+func git_upload_test_run(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestGitUploadFilter(t *testing.T) {
+	for _, c := range []struct {
+		spec  string
+		small bool
+		large bool
+	}{
+		{"blob:none", true, true},
+		{"blob:limit=0", true, true},
+		{"blob:limit=1k", false, true},
+		{"blob:limit=2m", false, false},
+	} {
+		f, err := git_upload_filter_parse(c.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", c.spec, err)
+		}
+		if f.omits(100) != c.small || f.omits(4096) != c.large {
+			t.Errorf("%s omits small %v, large %v", c.spec, f.omits(100), f.omits(4096))
+		}
+	}
+	for _, spec := range []string{"tree:0", "blob:limit=x", "sparse:oid=abc"} {
+		if _, err := git_upload_filter_parse(spec); err == nil {
+			t.Errorf("filter %q accepted", spec)
+		}
+	}
+}
+
+func TestGitUploadShallowObjects(t *testing.T) {
+	user, _, cleanup := create_git_test_env(t)
+	defer cleanup()
+	if err := git_init(user, test_app, "deep"); err != nil {
+		t.Fatal(err)
+	}
+	repo, _ := git_open(user, test_app, "deep")
+	var heads []plumbing.Hash
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		heads = append(heads, proposal_test_commit(t, repo, name, name))
+	}
+	head := heads[2]
+
+	// Depth 1 sends the head, its tree and its files, and makes it shallow
+	req := packp.NewUploadPackRequest()
+	req.Wants = []plumbing.Hash{head}
+	req.Depth = packp.DepthCommits(1)
+	send, shallow, _, err := git_upload_objects(repo.Storer, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shallow) != 1 || shallow[0] != head {
+		t.Errorf("shallow %v, want the head", shallow)
+	}
+	if len(send) != 3 {
+		t.Errorf("sent %d objects, want the commit, its tree and its file", len(send))
+	}
+
+	// Deepening by one more sends only the parent, and unshallows the head
+	req.Haves = []plumbing.Hash{head}
+	req.Shallows = []plumbing.Hash{head}
+	req.Depth = packp.DepthCommits(2)
+	send, shallow, unshallow, err := git_upload_objects(repo.Storer, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unshallow) != 1 || unshallow[0] != head || len(shallow) != 1 || shallow[0] != heads[1] {
+		t.Errorf("shallow %v, unshallow %v", shallow, unshallow)
+	}
+	if len(send) != 3 {
+		t.Errorf("sent %d objects, want the parent, its tree and its file", len(send))
+	}
+
+	// Wants must be reachable from a ref
+	path := git_repo_path(user, test_app, "deep")
+	commit, _ := repo.CommitObject(head)
+	file, _ := commit.File("c.txt")
+	if err := git_upload_reachable(repo.Storer, path, []plumbing.Hash{heads[0], file.Hash}); err != nil {
+		t.Errorf("reachable wants refused: %v", err)
+	}
+	orphan := git_gc_test_blob(t, repo, path, "orphan", 0)
+	if err := git_upload_reachable(repo.Storer, path, []plumbing.Hash{orphan}); err == nil {
+		t.Error("unreachable want accepted")
+	}
+	if r := git_upload_reaches[path]; r == nil || !r.found[file.Hash] || len(r.queue) != 0 {
+		t.Error("walk not kept for the next fetch")
+	}
+	// A new ref starts a new walk
+	repo.Storer.SetReference(plumbing.NewHashReference("refs/tags/orphan", orphan))
+	if err := git_upload_reachable(repo.Storer, path, []plumbing.Hash{orphan}); err != nil {
+		t.Errorf("want reachable from a new ref refused: %v", err)
+	}
+
+	// blob:none leaves out every file
+	req = packp.NewUploadPackRequest()
+	req.Wants = []plumbing.Hash{head}
+	f, _ := git_upload_filter_parse("blob:none")
+	send, _, _, _ = git_upload_objects(repo.Storer, req, f)
+	for _, h := range send {
+		if _, err := repo.BlobObject(h); err == nil {
+			t.Errorf("blob %s sent despite the filter", h)
+		}
+	}
+}
+
+func TestGitUploadClone(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	user, tmp, cleanup := create_git_test_env(t)
+	defer cleanup()
+	if err := git_init(user, test_app, "ci"); err != nil {
+		t.Fatal(err)
+	}
+	repo, _ := git_open(user, test_app, "ci")
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		proposal_test_commit(t, repo, name, strings.Repeat(name, 1000))
+	}
+	server := git_upload_test_server(git_repo_path(user, test_app, "ci"))
+	defer server.Close()
+	url := server.URL + "/repo"
+
+	shallow := filepath.Join(tmp, "shallow")
+	git_upload_test_run(t, tmp, "clone", "--depth", "1", url, shallow)
+	if n := git_upload_test_run(t, shallow, "rev-list", "--count", "HEAD"); n != "1" {
+		t.Errorf("shallow clone has %s commits, want 1", n)
+	}
+	git_upload_test_run(t, shallow, "fetch", "--deepen", "2")
+	if n := git_upload_test_run(t, shallow, "rev-list", "--count", "HEAD"); n != "3" {
+		t.Errorf("deepened clone has %s commits, want 3", n)
+	}
+	git_upload_test_run(t, shallow, "fetch", "--unshallow")
+	if n := git_upload_test_run(t, shallow, "rev-list", "--count", "HEAD"); n != "5" {
+		t.Errorf("unshallowed clone has %s commits, want 5", n)
+	}
+
+	// A partial clone fetches file contents only when checking them out
+	partial := filepath.Join(tmp, "partial")
+	git_upload_test_run(t, tmp, "clone", "--filter=blob:none", "--no-checkout", url, partial)
+	missing := git_upload_test_run(t, partial, "rev-list", "--objects", "--missing=print", "HEAD")
+	if !strings.Contains(missing, "?") {
+		t.Error("partial clone holds every blob")
+	}
+	git_upload_test_run(t, partial, "checkout", "main")
+	if data, err := os.ReadFile(filepath.Join(partial, "d.txt")); err != nil || len(data) != 5000 {
+		t.Errorf("checked out file %d bytes, %v", len(data), err)
+	}
+}
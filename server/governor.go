@@ -0,0 +1,191 @@
+// Mochi server: Resource governor
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The governor samples the machine's CPU and memory use every few seconds,
+// so a small server in the middle of a big sync stays responsive to people
+// using it. Web requests are never held back; background work gives way:
+//
+//   - above [governor] cpu_elevated or memory_elevated percent, the number
+//     of app event handlers running at once is capped at twice the CPUs,
+//     and queue sends at governor_queue_elevated
+//   - above [governor] cpu_high or memory_high percent, handlers are capped
+//     at half the CPUs and queue sends at governor_queue_high, and low
+//     priority background work - scheduled app events and git maintenance -
+//     waits until the pressure eases
+//
+// The gates are soft: work waiting longer than governor_wait goes ahead
+// anyway, so a stuck handler can slow the server but never wedge it. Going
+// back down a level needs the use to fall governor_hysteresis points below
+// the threshold, so the server doesn't flap. The level and measurements are
+// served in /_/health and as Prometheus metrics.
+
+const (
+	governor_interval       = 5 * time.Second
+	governor_wait           = 5 * time.Second
+	governor_poll           = 20 * time.Millisecond
+	governor_hysteresis     = 10
+	governor_queue_elevated = 16
+	governor_queue_high     = 4
+	governor_normal         = 0
+	governor_elevated       = 1
+	governor_high           = 2
+)
+
+var governor_names = []string{"normal", "elevated", "high"}
+
+// governor_report is the result of a sample
+type governor_report struct {
+	Checked int64   `json:"checked"`
+	Level   string  `json:"level"`
+	CPU     float64 `json:"cpu"`
+	Memory  float64 `json:"memory"`
+	Problem string  `json:"problem"`
+}
+
+// governor_gate limits how many of one kind of work run at once, to a
+// limit set by the level
+type governor_gate struct {
+	active atomic.Int64
+	limit  func(level int32) int64
+}
+
+var (
+	governor_level   atomic.Int32
+	governor_last    = &governor_report{Level: "normal"}
+	governor_lock    sync.Mutex
+	governor_running sync.Mutex
+
+	// governor_sample is governor_statistics behind a var so tests can
+	// load the machine
+	governor_sample = governor_statistics
+
+	// App event handlers, which run Starlark
+	governor_workers = &governor_gate{limit: func(level int32) int64 {
+		cpus := int64(runtime.NumCPU())
+		switch level {
+		case governor_elevated:
+			return 2 * cpus
+		case governor_high:
+			return max(1, cpus/2)
+		}
+		return 0
+	}}
+
+	// Sends from the outgoing queue
+	governor_queue = &governor_gate{limit: func(level int32) int64 {
+		switch level {
+		case governor_elevated:
+			return governor_queue_elevated
+		case governor_high:
+			return governor_queue_high
+		}
+		return 0
+	}}
+)
+
+// governor_manager samples periodically
+func governor_manager() {
+	if !ini_bool("governor", "enabled", true) {
+		return
+	}
+	for range time.Tick(governor_interval) {
+		governor_check()
+	}
+}
+
+// governor_measure returns the level CPU and memory use call for, with the
+// thresholds lowered by slack
+func governor_measure(cpu, memory float64, slack int) int32 {
+	threshold := func(key string, def int) float64 {
+		return float64(ini_int("governor", key, def) - slack)
+	}
+	switch {
+	case cpu >= threshold("cpu_high", 90) || memory >= threshold("memory_high", 90):
+		return governor_high
+	case cpu >= threshold("cpu_elevated", 75) || memory >= threshold("memory_elevated", 80):
+		return governor_elevated
+	}
+	return governor_normal
+}
+
+// governor_check samples the machine, sets the level, and keeps the report
+func governor_check() *governor_report {
+	governor_running.Lock()
+	defer governor_running.Unlock()
+	r := &governor_report{Checked: now()}
+	previous := governor_level.Load()
+	level := previous
+
+	cpu, memory, err := governor_sample()
+	if err != nil {
+		r.Problem = err.Error()
+		level = governor_normal
+	} else {
+		r.CPU, r.Memory = cpu, memory
+		level = governor_measure(cpu, memory, 0)
+		if level < previous {
+			level = max(level, min(previous, governor_measure(cpu, memory, governor_hysteresis)))
+		}
+	}
+	r.Level = governor_names[level]
+
+	governor_lock.Lock()
+	governor_last = r
+	governor_lock.Unlock()
+
+	governor_level.Store(level)
+	if level != previous {
+		if level == governor_normal {
+			info("Governor: load eased, background work running normally")
+		} else {
+			warn("Governor: load %s (CPU %.0f%%, memory %.0f%%), holding back background work", r.Level, cpu, memory)
+		}
+	}
+	return r
+}
+
+// governor_report_get returns the last report
+func governor_report_get() *governor_report {
+	governor_lock.Lock()
+	defer governor_lock.Unlock()
+	return governor_last
+}
+
+// governor_busy returns whether low priority background work should wait
+func governor_busy() bool {
+	return governor_level.Load() == governor_high
+}
+
+// enter waits for room at the gate, or until governor_wait has passed.
+// Each enter must be followed by a leave.
+func (g *governor_gate) enter() {
+	deadline := time.Now().Add(governor_wait)
+	for {
+		limit := g.limit(governor_level.Load())
+		active := g.active.Load()
+		if limit == 0 || active < limit || time.Now().After(deadline) {
+			if g.active.CompareAndSwap(active, active+1) {
+				return
+			}
+			continue
+		}
+		time.Sleep(governor_poll)
+	}
+}
+
+// leave makes room at the gate
+func (g *governor_gate) leave() {
+	g.active.Add(-1)
+}
@@ -0,0 +1,89 @@
+// Mochi server: CPU and memory use on Linux
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The CPU counters from the previous sample, so each sample reports the use
+// since the last
+var governor_cpu_busy, governor_cpu_total uint64
+
+// governor_statistics returns the percentage of CPU time spent busy since
+// the last call, and of memory in use, from /proc
+func governor_statistics() (float64, float64, error) {
+	busy, total, err := governor_cpu_counters()
+	if err != nil {
+		return 0, 0, err
+	}
+	cpu := 0.0
+	if total > governor_cpu_total && governor_cpu_total > 0 {
+		cpu = 100 * float64(busy-governor_cpu_busy) / float64(total-governor_cpu_total)
+	}
+	governor_cpu_busy, governor_cpu_total = busy, total
+
+	memory, err := governor_memory_used()
+	if err != nil {
+		return 0, 0, err
+	}
+	return cpu, memory, nil
+}
+
+// governor_cpu_counters returns the jiffies all CPUs have spent busy, and
+// in total
+func governor_cpu_counters() (uint64, uint64, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, fmt.Errorf("unexpected /proc/stat")
+	}
+	var total, idle uint64
+	for i, f := range fields[1:] {
+		n, _ := strconv.ParseUint(f, 10, 64)
+		total += n
+		// Idle and iowait
+		if i == 3 || i == 4 {
+			idle += n
+		}
+	}
+	return total - idle, total, nil
+}
+
+// governor_memory_used returns the percentage of memory not available to
+// new work
+func governor_memory_used() (float64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	values := map[string]float64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 {
+			n, _ := strconv.ParseFloat(fields[1], 64)
+			values[strings.TrimSuffix(fields[0], ":")] = n
+		}
+	}
+	total, available := values["MemTotal"], values["MemAvailable"]
+	if total == 0 {
+		return 0, fmt.Errorf("unexpected /proc/meminfo")
+	}
+	return 100 * (1 - available/total), nil
+}
@@ -0,0 +1,16 @@
+// Mochi server: CPU and memory use on other platforms
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+// governor_statistics isn't available here, so the governor stays at normal
+func governor_statistics() (float64, float64, error) {
+	return 0, 0, errors.New("CPU and memory use are not measured on this platform")
+}
@@ -0,0 +1,90 @@
+// Mochi server: Resource governor tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// governor_test_load makes the governor see a given load until the test ends
+func governor_test_load(t *testing.T) *[2]float64 {
+	load := &[2]float64{}
+	sample := governor_sample
+	governor_sample = func() (float64, float64, error) { return load[0], load[1], nil }
+	t.Cleanup(func() {
+		governor_sample = sample
+		governor_level.Store(governor_normal)
+	})
+	return load
+}
+
+func TestGovernorLevels(t *testing.T) {
+	load := governor_test_load(t)
+
+	for _, step := range []struct {
+		cpu, memory float64
+		level       string
+	}{
+		{10, 20, "normal"},
+		{80, 20, "elevated"},
+		{95, 20, "high"},
+		{85, 20, "high"}, // Within the hysteresis of high
+		{70, 20, "elevated"},
+		{70, 85, "elevated"},
+		{60, 50, "normal"},
+		{10, 95, "high"},
+	} {
+		load[0], load[1] = step.cpu, step.memory
+		if r := governor_check(); r.Level != step.level {
+			t.Errorf("CPU %.0f%%, memory %.0f%%: level %q, want %q", step.cpu, step.memory, r.Level, step.level)
+		}
+	}
+	if !governor_busy() {
+		t.Error("not busy at high")
+	}
+}
+
+func TestGovernorGate(t *testing.T) {
+	load := governor_test_load(t)
+	gate := &governor_gate{limit: func(level int32) int64 {
+		if level == governor_high {
+			return 1
+		}
+		return 0
+	}}
+
+	// At normal there is no limit
+	gate.enter()
+	gate.enter()
+	gate.leave()
+	gate.leave()
+
+	load[0] = 100
+	governor_check()
+	gate.enter()
+	entered := make(chan struct{})
+	go func() {
+		gate.enter()
+		close(entered)
+	}()
+	select {
+	case <-entered:
+		t.Fatal("entered a full gate")
+	case <-time.After(100 * time.Millisecond):
+	}
+	gate.leave()
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("not let in once there was room")
+	}
+	gate.leave()
+	if gate.active.Load() != 0 {
+		t.Errorf("%d still active", gate.active.Load())
+	}
+}
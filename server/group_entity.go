@@ -0,0 +1,526 @@
+// Mochi server: Group entities
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Any entity can be a group: a forum, a chat room, a feed. Its membership is
+// kept by core rather than by each app, as one record per (group, member)
+// with a role and a status, signed by the group entity's key. The server
+// that owns the group entity is the authority: it decides every change,
+// signs the new record, and sends it to the member as a "record" event on
+// the membership service. Members' servers keep the records they receive,
+// after checking the signature, so a member can show what it belongs to and
+// prove it to a third party without asking the group.
+//
+// Members act on a remote group by sending it events: request (to join),
+// accept (an invitation), leave, and, for administrators, set and remove.
+// The group's server applies them only if the sender's current record
+// allows it. Records are never deleted; leaving or removal is a record with
+// status "removed", so the change reaches the member like any other.
+//
+// Records live in db/groups.db, shared by every app, so the forum, chat, and
+// feeds apps see one membership model. Changing a group's membership from an
+// app requires that the app declares the group entity's class.
+
+const group_member_domain = "mochi-group-member-1"
+
+var group_roles = map[string]int{
+	"member":        1,
+	"moderator":     2,
+	"administrator": 3,
+	"owner":         4,
+}
+
+var group_statuses = map[string]bool{
+	"member":    true,
+	"invited":   true,
+	"requested": true,
+	"removed":   true,
+}
+
+type Membership struct {
+	Group     string `db:"group_entity" json:"group"`
+	Member    string `db:"member" json:"member"`
+	Role      string `db:"role" json:"role"`
+	Status    string `db:"status" json:"status"`
+	Updated   int64  `db:"updated" json:"updated"`
+	Signature string `db:"signature" json:"signature"`
+}
+
+var api_group_entity = sls.FromStringDict(sl.String("mochi.group.entity"), sl.StringDict{
+	"accept":      sl.NewBuiltin("mochi.group.entity.accept", api_group_entity_accept),
+	"invite":      sl.NewBuiltin("mochi.group.entity.invite", api_group_entity_invite),
+	"leave":       sl.NewBuiltin("mochi.group.entity.leave", api_group_entity_leave),
+	"member":      sl.NewBuiltin("mochi.group.entity.member", api_group_entity_member),
+	"members":     sl.NewBuiltin("mochi.group.entity.members", api_group_entity_members),
+	"memberships": sl.NewBuiltin("mochi.group.entity.memberships", api_group_entity_memberships),
+	"remove":      sl.NewBuiltin("mochi.group.entity.remove", api_group_entity_remove),
+	"request":     sl.NewBuiltin("mochi.group.entity.request", api_group_entity_request),
+	"set":         sl.NewBuiltin("mochi.group.entity.set", api_group_entity_set),
+})
+
+func init() {
+	a := app("membership")
+	a.service("membership")
+	a.event("record", group_record_event)
+	a.event("request", group_request_event)
+	a.event("accept", group_accept_event)
+	a.event("leave", group_leave_event)
+	a.event("set", group_set_event)
+	a.event("remove", group_remove_event)
+}
+
+// groups_db opens the server-wide membership records
+func groups_db() *DB {
+	return db_open_setup("db/groups.db", func(db *DB) {
+		db.exec("create table if not exists members (group_entity text not null, member text not null, role text not null, status text not null, updated integer not null, signature text not null, primary key (group_entity, member))")
+		db.exec("create index if not exists members_member on members(member)")
+	})
+}
+
+// signable returns the canonical bytes the group signs for a record
+func (m *Membership) signable() ([]byte, error) {
+	return canonical_encoder.Marshal(map[string]any{
+		"v":       group_member_domain,
+		"group":   m.Group,
+		"member":  m.Member,
+		"role":    m.Role,
+		"status":  m.Status,
+		"updated": i64toa(m.Updated),
+	})
+}
+
+// verify checks a record's signature against the group entity's key
+func (m *Membership) verify() bool {
+	public := base58_decode(m.Group, "")
+	if len(public) != ed25519.PublicKeySize {
+		return false
+	}
+	sig := base58_decode(m.Signature, "")
+	if len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	signable, err := m.signable()
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(public, signable, sig)
+}
+
+// record returns a membership as sent to members and returned to apps
+func (m *Membership) record() map[string]any {
+	return map[string]any{"group": m.Group, "member": m.Member, "role": m.Role, "status": m.Status, "updated": m.Updated, "signature": m.Signature}
+}
+
+// group_member_get returns the record for a member of a group, or nil
+func group_member_get(group, member string) *Membership {
+	var m Membership
+	if !groups_db().scan(&m, "select * from members where group_entity=? and member=?", group, member) {
+		return nil
+	}
+	return &m
+}
+
+// group_member_rank returns a member's role rank in a group, 0 unless they
+// are a current member. The group entity itself ranks as owner.
+func group_member_rank(group, member string) int {
+	if member == group {
+		return group_roles["owner"]
+	}
+	m := group_member_get(group, member)
+	if m == nil || m.Status != "member" {
+		return 0
+	}
+	return group_roles[m.Role]
+}
+
+// group_member_store keeps a record unless a newer one is already held
+func group_member_store(m *Membership) bool {
+	db := groups_db()
+	result, err := db.internal.Exec("insert into members (group_entity, member, role, status, updated, signature) values (?, ?, ?, ?, ?, ?) on conflict (group_entity, member) do update set role=excluded.role, status=excluded.status, updated=excluded.updated, signature=excluded.signature where excluded.updated >= members.updated", m.Group, m.Member, m.Role, m.Status, m.Updated, m.Signature)
+	if err != nil {
+		warn("Group membership store failed for %q in %q: %v", m.Member, m.Group, err)
+		return false
+	}
+	changed, _ := result.RowsAffected()
+	return changed > 0
+}
+
+// group_member_put decides a change on the group's own server: signs the
+// new record, stores it, and sends it to the member
+func group_member_put(group, member, role, status string) *Membership {
+	m := &Membership{Group: group, Member: member, Role: role, Status: status, Updated: now()}
+	if old := group_member_get(group, member); old != nil && old.Updated >= m.Updated {
+		m.Updated = old.Updated + 1
+	}
+	signable, err := m.signable()
+	if err != nil {
+		return nil
+	}
+	m.Signature = entity_sign(group, string(signable))
+	if m.Signature == "" {
+		return nil
+	}
+	group_member_store(m)
+
+	msg := message(group, member, "membership", "record")
+	msg.content = m.record()
+	msg.send()
+	return m
+}
+
+// group_owned returns a group entity the user owns, or nil
+func group_owned(u *User, group string) *Entity {
+	var e Entity
+	if !db_open("db/users.db").scan(&e, "select * from entities where id=? and user=?", group, u.UID) {
+		return nil
+	}
+	return &e
+}
+
+// group_acting returns the entity a user acts as: from if given and owned,
+// else their identity
+func group_acting(u *User, from string) string {
+	if from == "" {
+		if u.Identity == nil {
+			return ""
+		}
+		return u.Identity.ID
+	}
+	owned, _ := db_open("db/users.db").exists("select id from entities where id=? and user=?", from, u.UID)
+	if !owned {
+		return ""
+	}
+	return from
+}
+
+// group_change applies a role change by actor, who must outrank both the
+// member's current role and the new one, except that the group's owner may
+// do anything. Returns the new record, or nil if not allowed.
+func group_change(group, actor, member, role, status string) *Membership {
+	rank := group_member_rank(group, actor)
+	if rank < group_roles["administrator"] {
+		return nil
+	}
+	if rank < group_roles["owner"] {
+		if group_roles[role] >= rank || group_member_rank(group, member) >= rank {
+			return nil
+		}
+	}
+	return group_member_put(group, member, role, status)
+}
+
+// group_record_event receives a membership record from a group
+func group_record_event(e *Event) {
+	m := &Membership{
+		Group:     e.get("group", ""),
+		Member:    e.get("member", ""),
+		Role:      e.get("role", ""),
+		Status:    e.get("status", ""),
+		Updated:   event_int64(e.content["updated"]),
+		Signature: e.get("signature", ""),
+	}
+	if m.Group != e.from || m.Member != e.to || group_roles[m.Role] == 0 || !group_statuses[m.Status] {
+		info("Group membership dropping invalid record from %q", e.from)
+		return
+	}
+	if !m.verify() {
+		info("Group membership dropping record from %q with bad signature", e.from)
+		return
+	}
+	if group_member_store(m) && e.user != nil {
+		websockets_send(e.user, "membership", m.record())
+	}
+}
+
+// group_request_event receives a request to join a group
+func group_request_event(e *Event) {
+	if e.from == "" {
+		return
+	}
+	old := group_member_get(e.to, e.from)
+	if old != nil && old.Status != "removed" {
+		return
+	}
+	group_member_put(e.to, e.from, "member", "requested")
+}
+
+// group_accept_event receives acceptance of an invitation
+func group_accept_event(e *Event) {
+	old := group_member_get(e.to, e.from)
+	if e.from == "" || old == nil || old.Status != "invited" {
+		return
+	}
+	group_member_put(e.to, e.from, old.Role, "member")
+}
+
+// group_leave_event receives a member leaving, or declining or withdrawing
+func group_leave_event(e *Event) {
+	old := group_member_get(e.to, e.from)
+	if e.from == "" || old == nil || old.Status == "removed" || old.Role == "owner" {
+		return
+	}
+	group_member_put(e.to, e.from, old.Role, "removed")
+}
+
+// group_set_event receives a role change from a group administrator
+func group_set_event(e *Event) {
+	member := e.get("member", "")
+	role := e.get("role", "")
+	status := e.get("status", "member")
+	if e.from == "" || !valid(member, "entity") || group_roles[role] == 0 || (status != "member" && status != "invited") {
+		return
+	}
+	if group_change(e.to, e.from, member, role, status) == nil {
+		info("Group membership refusing change by %q in %q", e.from, e.to)
+	}
+}
+
+// group_remove_event receives a removal from a group administrator
+func group_remove_event(e *Event) {
+	old := group_member_get(e.to, e.get("member", ""))
+	if e.from == "" || old == nil || old.Status == "removed" {
+		return
+	}
+	if group_change(e.to, e.from, old.Member, old.Role, "removed") == nil {
+		info("Group membership refusing removal by %q in %q", e.from, e.to)
+	}
+}
+
+// group_entity_caller returns the user and app a builtin acts for
+func group_entity_caller(t *sl.Thread) (*User, *App, error) {
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return nil, nil, fmt.Errorf("no user")
+	}
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return nil, nil, fmt.Errorf("no app")
+	}
+	return user, app, nil
+}
+
+// group_manage applies a change to a group the caller owns, or sends it to
+// the group's server to apply on the caller's authority. Returns the new
+// record if applied here.
+func group_manage(t *sl.Thread, fn *sl.Builtin, group, member, role, status, from string) (sl.Value, error) {
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(group, "entity") || !valid(member, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+	if group_roles[role] == 0 {
+		return sl_error(fn, "invalid role %q", role)
+	}
+
+	if g := group_owned(user, group); g != nil {
+		if !app_declares_class(app, user, g.Class) {
+			return sl_error(fn, "app does not control class %q", g.Class)
+		}
+		if role == "owner" {
+			return sl_error(fn, "a group has one owner")
+		}
+		m := group_member_put(group, member, role, status)
+		if m == nil {
+			return sl_error(fn, "unable to sign membership")
+		}
+		return sl_encode(m.record()), nil
+	}
+
+	actor := group_acting(user, from)
+	if actor == "" {
+		return sl_error(fn, "invalid from")
+	}
+	event := "set"
+	if status == "removed" {
+		event = "remove"
+	}
+	m := message(actor, group, "membership", event)
+	m.FromApp = app.id
+	m.set("member", member, "role", role, "status", status)
+	m.send()
+	return sl.None, nil
+}
+
+// group_member_send sends a member's own request, acceptance, or departure
+// to a group
+func group_member_send(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple, event string) (sl.Value, error) {
+	var group, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "group", &group, "from?", &from); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(group, "entity") {
+		return sl_error(fn, "invalid group")
+	}
+	actor := group_acting(user, from)
+	if actor == "" {
+		return sl_error(fn, "invalid from")
+	}
+	m := message(actor, group, "membership", event)
+	m.FromApp = app.id
+	m.send()
+	return sl.None, nil
+}
+
+// group_visible reports whether a user may read a group's membership: they
+// own the group, or one of their entities is a current member
+func group_visible(u *User, group string) bool {
+	if group_owned(u, group) != nil {
+		return true
+	}
+	rows, _ := db_open("db/users.db").rows("select id from entities where user=?", u.UID)
+	for _, r := range rows {
+		id, _ := r["id"].(string)
+		if group_member_rank(group, id) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// mochi.group.entity.invite(group, member, role?, from?) -> dict | None: Invite
+// an entity to a group, as "member" unless role is given
+func api_group_entity_invite(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var group, member, from string
+	role := "member"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "group", &group, "member", &member, "role?", &role, "from?", &from); err != nil {
+		return nil, err
+	}
+	return group_manage(t, fn, group, member, role, "invited", from)
+}
+
+// mochi.group.entity.set(group, member, role, from?) -> dict | None: Make an
+// entity a member of a group with a role, approving a join request or
+// changing an existing member's role. On a group this server does not own,
+// the change is sent to the group to apply on the caller's authority and
+// None is returned.
+func api_group_entity_set(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var group, member, role, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "group", &group, "member", &member, "role", &role, "from?", &from); err != nil {
+		return nil, err
+	}
+	return group_manage(t, fn, group, member, role, "member", from)
+}
+
+// mochi.group.entity.remove(group, member, from?) -> dict | None: Remove a
+// member, invitation, or join request from a group
+func api_group_entity_remove(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var group, member, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "group", &group, "member", &member, "from?", &from); err != nil {
+		return nil, err
+	}
+	role := "member"
+	if old := group_member_get(group, member); old != nil {
+		role = old.Role
+	}
+	return group_manage(t, fn, group, member, role, "removed", from)
+}
+
+// mochi.group.entity.request(group, from?) -> None: Ask to join a group
+func api_group_entity_request(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	return group_member_send(t, fn, args, kwargs, "request")
+}
+
+// mochi.group.entity.accept(group, from?) -> None: Accept an invitation to a group
+func api_group_entity_accept(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	return group_member_send(t, fn, args, kwargs, "accept")
+}
+
+// mochi.group.entity.leave(group, from?) -> None: Leave a group, or decline
+// an invitation or withdraw a join request
+func api_group_entity_leave(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	return group_member_send(t, fn, args, kwargs, "leave")
+}
+
+// mochi.group.entity.member(group, member) -> dict | None: A member's record
+// in a group: {group, member, role, status, updated, signature}
+func api_group_entity_member(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var group, member string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "group", &group, "member", &member); err != nil {
+		return nil, err
+	}
+	user, _, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	m := group_member_get(group, member)
+	if m == nil {
+		return sl.None, nil
+	}
+	if group_acting(user, member) == "" && !group_visible(user, group) {
+		return sl.None, nil
+	}
+	return sl_encode(m.record()), nil
+}
+
+// mochi.group.entity.members(group, status?) -> list: Records of a group's
+// members, or with status, its invitations ("invited") or join requests
+// ("requested"). Readable by the group's owner and its members.
+func api_group_entity_members(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var group string
+	status := "member"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "group", &group, "status?", &status); err != nil {
+		return nil, err
+	}
+	user, _, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !group_statuses[status] {
+		return sl_error(fn, "invalid status %q", status)
+	}
+	if !group_visible(user, group) {
+		return sl_error(fn, "not a member of group")
+	}
+	rows, err := groups_db().rows("select group_entity as 'group', member, role, status, updated, signature from members where group_entity=? and status=? order by updated", group, status)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.group.entity.memberships(status?) -> list: Records of the groups the
+// current user's entities belong to, or with status, are invited to or have
+// asked to join
+func api_group_entity_memberships(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	status := "member"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "status?", &status); err != nil {
+		return nil, err
+	}
+	user, _, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !group_statuses[status] {
+		return sl_error(fn, "invalid status %q", status)
+	}
+
+	entities, _ := db_open("db/users.db").rows("select id from entities where user=?", user.UID)
+	results := []map[string]any{}
+	db := groups_db()
+	for _, e := range entities {
+		rows, err := db.rows("select group_entity as 'group', member, role, status, updated, signature from members where member=? and status=? order by updated", e["id"], status)
+		if err != nil {
+			return sl_error(fn, "database error: %v", err)
+		}
+		results = append(results, rows...)
+	}
+	return sl_encode(results), nil
+}
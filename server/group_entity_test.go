@@ -0,0 +1,127 @@
+// Mochi server: Group entity tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+)
+
+const (
+	group_test_admin  = "1GroupTestAdministratorEntityXXXXXXXXXXXXXXXXXXXX"
+	group_test_member = "1GroupTestMemberEntityXXXXXXXXXXXXXXXXXXXXXXXXXXX"
+)
+
+// group_test_setup creates a user owning a private group entity
+func group_test_setup(t *testing.T) (*User, string) {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	user := create_permission_test_user(t, "u1")
+	db_open("db/users.db").exec("insert into users (uid, username) values (?, ?)", user.UID, user.Username)
+	g, err := entity_create(user, "forum", "Test forum", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, g.ID
+}
+
+// group_test_record signs and stores a record without sending it
+func group_test_record(t *testing.T, group, member, role, status string, updated int64) *Membership {
+	t.Helper()
+	m := &Membership{Group: group, Member: member, Role: role, Status: status, Updated: updated}
+	signable, err := m.signable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Signature = entity_sign(group, string(signable))
+	group_member_store(m)
+	return m
+}
+
+func TestGroupMembershipSignature(t *testing.T) {
+	_, group := group_test_setup(t)
+	m := group_test_record(t, group, group_test_member, "member", "member", 100)
+	if !m.verify() {
+		t.Fatal("record signed by the group does not verify")
+	}
+	forged := *m
+	forged.Role = "administrator"
+	if forged.verify() {
+		t.Error("record with altered role verifies")
+	}
+	stolen := *m
+	stolen.Group = group_test_admin
+	if stolen.verify() {
+		t.Error("record verifies against another group's key")
+	}
+}
+
+func TestGroupMembershipStoreNewest(t *testing.T) {
+	_, group := group_test_setup(t)
+	group_test_record(t, group, group_test_member, "moderator", "member", 200)
+	group_test_record(t, group, group_test_member, "member", "removed", 100)
+	m := group_member_get(group, group_test_member)
+	if m == nil || m.Role != "moderator" || m.Status != "member" {
+		t.Fatalf("older record replaced newer: %+v", m)
+	}
+	if group_member_rank(group, group_test_member) != group_roles["moderator"] {
+		t.Error("moderator rank not reported")
+	}
+	if group_member_rank(group, group) != group_roles["owner"] {
+		t.Error("group entity does not rank as owner")
+	}
+}
+
+func TestGroupMembershipChangeAuthority(t *testing.T) {
+	_, group := group_test_setup(t)
+	group_test_record(t, group, group_test_admin, "administrator", "member", 100)
+	group_test_record(t, group, group_test_member, "moderator", "member", 100)
+
+	// Non-members, and members below administrator, may change nothing
+	if group_change(group, "1GroupTestStrangerEntityXXXXXXXXXXXXXXXXXXXXXXXXX", group_test_member, "member", "removed") != nil {
+		t.Error("stranger changed membership")
+	}
+	if group_change(group, group_test_member, group_test_admin, "member", "removed") != nil {
+		t.Error("moderator removed an administrator")
+	}
+
+	// An administrator may not raise anyone to their own rank, or touch a peer
+	if group_change(group, group_test_admin, group_test_member, "administrator", "member") != nil {
+		t.Error("administrator promoted a member to administrator")
+	}
+	group_test_record(t, group, group_test_member, "administrator", "member", 200)
+	if group_change(group, group_test_admin, group_test_member, "member", "removed") != nil {
+		t.Error("administrator removed another administrator")
+	}
+}
+
+func TestGroupRecordEventChecks(t *testing.T) {
+	_, group := group_test_setup(t)
+	m := &Membership{Group: group, Member: group_test_member, Role: "member", Status: "member", Updated: 100}
+	signable, _ := m.signable()
+	m.Signature = entity_sign(group, string(signable))
+
+	// A record must come from its group, to its member
+	group_record_event(&Event{from: group_test_admin, to: group_test_member, content: m.record()})
+	if group_member_get(group, group_test_member) != nil {
+		t.Error("record accepted from an entity other than the group")
+	}
+
+	bad := m.record()
+	bad["role"] = "owner"
+	group_record_event(&Event{from: group, to: group_test_member, content: bad})
+	if group_member_get(group, group_test_member) != nil {
+		t.Error("record with bad signature accepted")
+	}
+
+	content := m.record()
+	group_record_event(&Event{from: group, to: group_test_member, content: content})
+	if got := group_member_get(group, group_test_member); got == nil || got.Signature != m.Signature {
+		t.Errorf("valid record not stored: %+v", got)
+	}
+}
@@ -33,6 +33,7 @@ var api_group = sls.FromStringDict(sl.String("mochi.group"), sl.StringDict{
 	"list":        sl.NewBuiltin("mochi.group.list", api_group_list),
 	"update":      sl.NewBuiltin("mochi.group.update", api_group_update),
 	"delete":      sl.NewBuiltin("mochi.group.delete", api_group_delete),
+	"entity":      api_group_entity,
 	"add":         sl.NewBuiltin("mochi.group.add", api_group_add),
 	"remove":      sl.NewBuiltin("mochi.group.remove", api_group_remove),
 	"members":     sl.NewBuiltin("mochi.group.members", apigroup_members),
@@ -0,0 +1,150 @@
+// Mochi server: Guest sessions
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With the guests_enabled setting on, an anonymous visitor can take part
+// in public entities, commenting on a public forum say, without an
+// account. POST /_/auth/guest makes them a guest: a user with role "guest",
+// a private identity, and the ordinary session cookie, but no email
+// address or login factor. A guest's actions are rate limited far more
+// tightly than an account's; it can't create entities, nor use anything
+// guarded by a permission, in any app; it isn't listed or counted among
+// the server's users; and it is deleted guest_lifetime after it was
+// created. If the visitor signs in or signs up in the same browser first,
+// guest_upgrade moves the guest's identity and app data into the account:
+// what they contributed as a guest was signed by that identity, so it
+// stays theirs.
+
+const guest_lifetime = 30 * 86400
+
+// user_guest reports whether a user is a guest
+func user_guest(u *User) bool {
+	return u != nil && u.Role == "guest"
+}
+
+// setting_guests_enabled returns whether anonymous visitors may become guests
+func setting_guests_enabled() bool {
+	return setting_get("guests_enabled", "false") == "true"
+}
+
+// guest_create makes a guest user with an identity of the given name
+func guest_create(name string) (*User, error) {
+	id := uid()
+	db := db_open("db/users.db")
+	db.exec("insert into users (uid, username, role, methods) values (?, ?, 'guest', '')", id, "guest:"+id)
+	db.exec("insert into guests (user, created) values (?, ?)", id, now())
+
+	u := &User{UID: id, Username: "guest:" + id, Role: "guest", Status: "active"}
+	e, err := entity_create(u, "person", name, "private", "")
+	if err != nil {
+		user_delete(id)
+		return nil, err
+	}
+	u.Identity = e
+	u.Preferences = user_preferences_load(u)
+	return u, nil
+}
+
+// guest_upgrade moves a guest's identity and app data into an account, and
+// deletes the guest. An account without an identity yet, as at signup,
+// takes the guest's as its own; otherwise it becomes one of the account's
+// further entities. App data is moved only for apps the account has none
+// for, as two databases of one app can't be merged in general.
+func guest_upgrade(guest, user *User) {
+	if !user_guest(guest) || user_guest(user) || guest.UID == user.UID {
+		return
+	}
+	db := db_open("db/users.db")
+	parent := ""
+	if identity := user.identity(); identity != nil {
+		parent = identity.ID
+	}
+	db.exec("update entities set user=?, parent=? where user=? and parent=''", user.UID, parent, guest.UID)
+	db.exec("update entities set user=? where user=?", user.UID, guest.UID)
+	entity_invalidate()
+
+	from := filepath.Join(data_dir, "users", guest.UID)
+	to := filepath.Join(data_dir, "users", user.UID)
+	db_purge_prefix(filepath.Join("users", guest.UID))
+	if entries, err := os.ReadDir(from); err == nil {
+		os.MkdirAll(to, 0755)
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			if file_exists(filepath.Join(to, entry.Name())) {
+				info("Guest %q upgrade to user %q leaving %q, which the user already has", guest.UID, user.UID, entry.Name())
+				continue
+			}
+			if err := os.Rename(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+				warn("Guest %q upgrade to user %q unable to move %q: %v", guest.UID, user.UID, entry.Name(), err)
+			}
+		}
+	}
+
+	// The entities are the account's now, so deleting the guest leaves them
+	user_purge_local(guest.UID, false)
+	user.Identity = user.identity()
+	info("Guest %q upgraded to user %q", guest.UID, user.UID)
+}
+
+// guests_cleanup deletes guests older than guest_lifetime
+func guests_cleanup() {
+	rows, _ := db_open("db/users.db").rows("select user from guests where created < ?", now()-guest_lifetime)
+	for _, r := range rows {
+		if id, _ := r["user"].(string); id != "" {
+			user_delete(id)
+		}
+	}
+}
+
+// web_auth_guest signs an anonymous visitor in as a new guest. A visitor
+// already signed in, as a guest or not, stays as they are.
+func web_auth_guest(c *gin.Context) {
+	if !setting_guests_enabled() {
+		respond_error(c, http.StatusForbidden, "guests_disabled", "errors.guests_disabled", nil)
+		return
+	}
+	if u := web_auth(c); u != nil && u.Identity != nil {
+		c.JSON(http.StatusOK, gin.H{"guest": user_guest(u), "name": u.Identity.Name, "identity": u.Identity.ID})
+		return
+	}
+
+	var input struct {
+		Name string `json:"name"`
+	}
+	c.ShouldBindJSON(&input)
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		name = fmt.Sprintf("Guest %s", random_unambiguous(4))
+	}
+	if !valid(name, "name") {
+		respond_error(c, http.StatusBadRequest, "invalid_name", "errors.invalid_name", nil)
+		return
+	}
+
+	guest, err := guest_create(name)
+	if err != nil {
+		info("Guest creation error: %v", err)
+		respond_error(c, http.StatusInternalServerError, "server_error", "errors.server_error", nil)
+		return
+	}
+	session := login_create(guest.UID, c.ClientIP(), c.GetHeader("User-Agent"))
+	db_open("db/sessions.db").exec("update sessions set expires=? where code=?", now()+guest_lifetime, session)
+	web_cookie_set(c, "session", session)
+	c.JSON(http.StatusOK, gin.H{"guest": true, "name": guest.Identity.Name, "identity": guest.Identity.ID})
+}
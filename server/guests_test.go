@@ -0,0 +1,121 @@
+// Mochi server: Guest session tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestGuestUpgradeSignup(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	guest, err := guest_create("Visitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user_guest(guest) || guest.Identity == nil || guest.Identity.Privacy != "private" {
+		t.Fatalf("guest %+v", guest)
+	}
+	os.MkdirAll(filepath.Join(data_dir, "users", guest.UID, "forums", "db"), 0755)
+	os.WriteFile(filepath.Join(data_dir, "users", guest.UID, "forums", "db", "forums.db"), []byte("data"), 0644)
+
+	// A guest doesn't count as the first user, who becomes administrator
+	user, reason := user_create("visitor@example.com")
+	if user == nil || !user.administrator() {
+		t.Fatalf("first user %+v, %q", user, reason)
+	}
+
+	guest_upgrade(guest, user)
+	if user.Identity == nil || user.Identity.ID != guest.Identity.ID {
+		t.Errorf("account identity %+v, want the guest's %q", user.Identity, guest.Identity.ID)
+	}
+	if !file_exists(filepath.Join(data_dir, "users", user.UID, "forums", "db", "forums.db")) {
+		t.Error("guest app data not moved")
+	}
+	if user_by_uid(guest.UID) != nil || file_exists(filepath.Join(data_dir, "users", guest.UID)) {
+		t.Error("guest not deleted")
+	}
+	if has, _ := db_open("db/users.db").exists("select 1 from guests where user=?", guest.UID); has {
+		t.Error("guest still listed")
+	}
+}
+
+func TestGuestUpgradeExisting(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	user, _ := user_create("member@example.com")
+	identity, err := entity_create(user, "person", "Member", "public", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest, err := guest_create("Visitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guest_upgrade(guest, user)
+	if user.Identity == nil || user.Identity.ID != identity.ID {
+		t.Errorf("account identity changed to %+v", user.Identity)
+	}
+	moved := user_owning_entity(guest.Identity.ID)
+	if moved == nil || moved.UID != user.UID {
+		t.Errorf("guest identity owned by %+v", moved)
+	}
+	if e := entity_by_any(guest.Identity.ID); e == nil || e.Parent != identity.ID {
+		t.Errorf("guest identity %+v, want parent %q", e, identity.ID)
+	}
+}
+
+func TestGuestsCleanup(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	old, _ := guest_create("Old")
+	recent, _ := guest_create("Recent")
+	db_open("db/users.db").exec("update guests set created=? where user=?", now()-guest_lifetime-1, old.UID)
+
+	guests_cleanup()
+	if has, _ := db_open("db/users.db").exists("select 1 from users where uid=?", old.UID); has {
+		t.Error("expired guest kept")
+	}
+	if user_by_uid(recent.UID) == nil {
+		t.Error("recent guest deleted")
+	}
+}
+
+func TestGuestRestricted(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	user_create("member@example.com")
+	guest, err := guest_create("Visitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread := create_test_thread(guest, create_external_app("forums"))
+	if err := require_permission(thread, nil, "presence/manage"); err == nil {
+		t.Error("guest passed a permission check")
+	}
+	create := sl.NewBuiltin("mochi.entity.create", api_entity_create)
+	if _, err := api_entity_create(thread, create, sl.Tuple{sl.String("forum"), sl.String("Forum"), sl.String("public")}, nil); err == nil {
+		t.Error("guest created an entity")
+	}
+	setting_set("statistics_publish", "true")
+	if n := metadata_users(); n != 1 {
+		t.Errorf("%d users counted, want the account only", n)
+	}
+}
@@ -56,6 +56,9 @@ func health_status() (gin.H, int) {
 		"uptime":      uptime,
 		"database":    database_status,
 		"network":     network_status,
+		"disk":        disk_report_get().Status, // degrades service, but isn't a failure
+		"governor":    governor_report_get().Level,
+		"managers":    supervisor_status(),
 	}, overall
 }
 
@@ -0,0 +1,435 @@
+// Mochi server: History
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	zstd "github.com/klauspost/compress/zstd"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Revision history for any app's editable objects: wiki pages, documents,
+// descriptions. The app records each saved version with
+// mochi.history.record(object, content), and can then list revisions, get
+// or diff them, and revert to an earlier one, which records its content
+// again as a new revision for the app to write back.
+//
+// Revisions are stored compressed, most as zstd frames using the previous
+// revision as the dictionary, so an edit costs about the size of the edit.
+// Every history_keyframe revisions one is stored whole, bounding how many
+// frames must be decoded to rebuild any revision.
+//
+// History lives in the owner's users/<uid>/history.db, keyed by app.
+
+const (
+	history_keyframe      = 20
+	history_content_limit = 4 * 1024 * 1024
+	history_message_limit = 1000
+	history_diff_limit    = 1000000
+)
+
+type Revision struct {
+	App      string `db:"app"`
+	Object   string `db:"object"`
+	Revision int64  `db:"revision"`
+	Delta    int64  `db:"delta"`
+	Data     []byte `db:"data"`
+	Hash     string `db:"hash"`
+	Size     int64  `db:"size"`
+	Author   string `db:"author"`
+	Message  string `db:"message"`
+	Created  int64  `db:"created"`
+}
+
+var api_history = sls.FromStringDict(sl.String("mochi.history"), sl.StringDict{
+	"delete": sl.NewBuiltin("mochi.history.delete", api_history_delete),
+	"diff":   sl.NewBuiltin("mochi.history.diff", api_history_diff),
+	"get":    sl.NewBuiltin("mochi.history.get", api_history_get),
+	"list":   sl.NewBuiltin("mochi.history.list", api_history_list),
+	"record": sl.NewBuiltin("mochi.history.record", api_history_record),
+	"revert": sl.NewBuiltin("mochi.history.revert", api_history_revert),
+})
+
+// history_db opens a user's history, creating its table if needed
+func history_db(u *User) *DB {
+	db := db_user(u, "history")
+	db.exec("create table if not exists revisions (app text not null, object text not null, revision integer not null, delta integer not null default 0, data blob not null, hash text not null, size integer not null, author text not null default '', message text not null default '', created integer not null, primary key (app, object, revision))")
+	return db
+}
+
+// history_hash returns the hash identifying a revision's content
+func history_hash(content string) string {
+	h := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(h[:])
+}
+
+// history_compress compresses content, against a previous revision's
+// content if given
+func history_compress(content, previous []byte) ([]byte, error) {
+	options := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedBetterCompression)}
+	if len(previous) > 0 {
+		options = append(options, zstd.WithEncoderDictRaw(1, previous))
+	}
+	e, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+	return e.EncodeAll(content, nil), nil
+}
+
+// history_decompress reverses history_compress
+func history_decompress(data, previous []byte) ([]byte, error) {
+	options := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(history_content_limit * 2)}
+	if len(previous) > 0 {
+		options = append(options, zstd.WithDecoderDictRaw(1, previous))
+	}
+	d, err := zstd.NewReader(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.DecodeAll(data, nil)
+}
+
+// history_get returns a revision of an object, or the latest if revision
+// is 0, or nil
+func history_get(u *User, app, object string, revision int64) *Revision {
+	var r Revision
+	db := history_db(u)
+	if revision == 0 {
+		if !db.scan(&r, "select * from revisions where app=? and object=? order by revision desc limit 1", app, object) {
+			return nil
+		}
+	} else if !db.scan(&r, "select * from revisions where app=? and object=? and revision=?", app, object, revision) {
+		return nil
+	}
+	return &r
+}
+
+// history_content rebuilds a revision's content from the nearest whole
+// revision at or before it
+func history_content(u *User, r *Revision) ([]byte, error) {
+	var chain []Revision
+	if err := history_db(u).scans(&chain, "select * from revisions where app=? and object=? and revision<=? and revision>=(select max(revision) from revisions where app=? and object=? and revision<=? and delta=0) order by revision", r.App, r.Object, r.Revision, r.App, r.Object, r.Revision); err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 || chain[0].Delta != 0 {
+		return nil, fmt.Errorf("history for %q broken before revision %d", r.Object, r.Revision)
+	}
+	var content []byte
+	for _, c := range chain {
+		previous := content
+		if c.Delta == 0 {
+			previous = nil
+		}
+		next, err := history_decompress(c.Data, previous)
+		if err != nil {
+			return nil, fmt.Errorf("history revision %d of %q: %v", c.Revision, c.Object, err)
+		}
+		content = next
+	}
+	return content, nil
+}
+
+// history_record stores content as the next revision of an object, unless
+// it is unchanged from the latest. Returns the revision holding the content.
+func history_record(u *User, app, object, content, author, message string) (*Revision, error) {
+	hash := history_hash(content)
+	latest := history_get(u, app, object, 0)
+	if latest != nil && latest.Hash == hash {
+		return latest, nil
+	}
+
+	r := &Revision{App: app, Object: object, Revision: 1, Hash: hash, Size: int64(len(content)), Author: author, Message: message, Created: now()}
+	var previous []byte
+	if latest != nil {
+		r.Revision = latest.Revision + 1
+		if r.Revision%history_keyframe != 1 {
+			p, err := history_content(u, latest)
+			if err != nil {
+				return nil, err
+			}
+			previous = p
+		}
+	}
+	if len(previous) > 0 {
+		r.Delta = 1
+	}
+	data, err := history_compress([]byte(content), previous)
+	if err != nil {
+		return nil, err
+	}
+	r.Data = data
+	history_db(u).exec("insert into revisions (app, object, revision, delta, data, hash, size, author, message, created) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", r.App, r.Object, r.Revision, r.Delta, r.Data, r.Hash, r.Size, r.Author, r.Message, r.Created)
+	return r, nil
+}
+
+// info returns a revision as seen by its app, without its content
+func (r *Revision) info() map[string]any {
+	return map[string]any{"revision": r.Revision, "size": r.Size, "hash": r.Hash, "author": r.Author, "message": r.Message, "created": r.Created}
+}
+
+// history_diff compares two texts line by line, returning a list of
+// {op, text} where op is "=" for a kept line, "-" for a removed one and "+"
+// for an added one. Once their common start and end are set aside, texts
+// whose line counts multiply past history_diff_limit are reported as
+// entirely replaced, as the comparison's table grows with that product.
+func history_diff(a, b string) []map[string]any {
+	x := strings.Split(a, "\n")
+	y := strings.Split(b, "\n")
+	if a == "" {
+		x = nil
+	}
+	if b == "" {
+		y = nil
+	}
+
+	var head, tail []map[string]any
+	for len(x) > 0 && len(y) > 0 && x[0] == y[0] {
+		head = append(head, map[string]any{"op": "=", "text": x[0]})
+		x, y = x[1:], y[1:]
+	}
+	for len(x) > 0 && len(y) > 0 && x[len(x)-1] == y[len(y)-1] {
+		tail = append([]map[string]any{{"op": "=", "text": x[len(x)-1]}}, tail...)
+		x, y = x[:len(x)-1], y[:len(y)-1]
+	}
+
+	result := head
+	if len(x)*len(y) > history_diff_limit {
+		for _, l := range x {
+			result = append(result, map[string]any{"op": "-", "text": l})
+		}
+		for _, l := range y {
+			result = append(result, map[string]any{"op": "+", "text": l})
+		}
+		return append(result, tail...)
+	}
+
+	// Longest common subsequence of the remaining lines, then walk it
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			result = append(result, map[string]any{"op": "=", "text": x[i]})
+			i++
+			j++
+		case j < len(y) && (i == len(x) || lcs[i][j+1] >= lcs[i+1][j]):
+			result = append(result, map[string]any{"op": "+", "text": y[j]})
+			j++
+		default:
+			result = append(result, map[string]any{"op": "-", "text": x[i]})
+			i++
+		}
+	}
+	return append(result, tail...)
+}
+
+// history_caller returns the user whose history the calling app uses, the
+// app, and the calling user's identity as the author
+func history_caller(t *sl.Thread) (*User, *App, string, error) {
+	owner, app, err := trash_caller(t)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	author := ""
+	if user, _ := t.Local("user").(*User); user != nil && user.Identity != nil {
+		author = user.Identity.ID
+	}
+	return owner, app, author, nil
+}
+
+// mochi.history.record(object, content, message?) -> dict: Record a
+// version of an object's content, a string. Content unchanged from the
+// latest revision records nothing. Returns the revision holding it.
+func api_history_record(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object, content, message string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object, "content", &content, "message?", &message); err != nil {
+		return nil, err
+	}
+	owner, app, author, err := history_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(object, "path") {
+		return sl_error(fn, "invalid object")
+	}
+	if len(content) > history_content_limit {
+		return sl_error(fn, "content too large")
+	}
+	if len(message) > history_message_limit {
+		return sl_error(fn, "message too long")
+	}
+	r, err := history_record(owner, app.id, object, content, author, message)
+	if err != nil {
+		return sl_error(fn, "unable to record revision: %v", err)
+	}
+	return sl_encode(r.info()), nil
+}
+
+// mochi.history.list(object, limit?, before?) -> list: List an object's
+// revisions, newest first, without their content
+func api_history_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	limit := 100
+	before := 0
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object, "limit?", &limit, "before?", &before); err != nil {
+		return nil, err
+	}
+	owner, app, _, err := history_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if limit < 1 || limit > 1000 {
+		return sl_error(fn, "invalid limit")
+	}
+
+	var revisions []Revision
+	query := "select app, object, revision, delta, x'' as data, hash, size, author, message, created from revisions where app=? and object=?"
+	values := []any{app.id, object}
+	if before > 0 {
+		query += " and revision<?"
+		values = append(values, before)
+	}
+	values = append(values, limit)
+	if err := history_db(owner).scans(&revisions, query+" order by revision desc limit ?", values...); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	results := make([]any, len(revisions))
+	for i := range revisions {
+		results[i] = revisions[i].info()
+	}
+	return sl_encode(results), nil
+}
+
+// mochi.history.get(object, revision?) -> dict | None: Get a revision of an
+// object with its content, the latest unless revision is given
+func api_history_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	revision := 0
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object, "revision?", &revision); err != nil {
+		return nil, err
+	}
+	owner, app, _, err := history_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	r := history_get(owner, app.id, object, int64(revision))
+	if r == nil {
+		return sl.None, nil
+	}
+	content, err := history_content(owner, r)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	info := r.info()
+	info["content"] = string(content)
+	return sl_encode(info), nil
+}
+
+// mochi.history.diff(object, from, to?) -> list: Compare two revisions of
+// an object line by line, to the latest unless to is given. Returns a list
+// of {op, text}, op being "=", "-" or "+".
+func api_history_diff(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	var from int
+	to := 0
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object, "from", &from, "to?", &to); err != nil {
+		return nil, err
+	}
+	owner, app, _, err := history_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	a := history_get(owner, app.id, object, int64(from))
+	b := history_get(owner, app.id, object, int64(to))
+	if a == nil || b == nil || from == 0 {
+		return sl_error(fn, "revision not found")
+	}
+	x, err := history_content(owner, a)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	y, err := history_content(owner, b)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl_encode(history_diff(string(x), string(y))), nil
+}
+
+// mochi.history.revert(object, revision, message?) -> dict: Record an
+// earlier revision's content again as the newest revision. Returns that
+// revision with its content, for the app to write back to the object.
+func api_history_revert(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object, message string
+	var revision int
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object, "revision", &revision, "message?", &message); err != nil {
+		return nil, err
+	}
+	owner, app, author, err := history_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	old := history_get(owner, app.id, object, int64(revision))
+	if old == nil || revision == 0 {
+		return sl_error(fn, "revision not found")
+	}
+	content, err := history_content(owner, old)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if message == "" {
+		message = fmt.Sprintf("Revert to revision %d", revision)
+	}
+	if len(message) > history_message_limit {
+		return sl_error(fn, "message too long")
+	}
+	r, err := history_record(owner, app.id, object, string(content), author, message)
+	if err != nil {
+		return sl_error(fn, "unable to record revision: %v", err)
+	}
+	info := r.info()
+	info["content"] = string(content)
+	return sl_encode(info), nil
+}
+
+// mochi.history.delete(object) -> int: Delete an object's history. Returns
+// the number of revisions deleted.
+func api_history_delete(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object); err != nil {
+		return nil, err
+	}
+	owner, app, _, err := history_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	result, err := history_db(owner).internal.Exec("delete from revisions where app=? and object=?", app.id, object)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return sl.MakeInt64(n), nil
+}
@@ -0,0 +1,113 @@
+// Mochi server: History tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func history_test_setup(t *testing.T) *User {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	return create_permission_test_user(t, "u1")
+}
+
+func TestHistoryReconstruct(t *testing.T) {
+	user := history_test_setup(t)
+	var versions []string
+	page := strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 200)
+	for i := 0; i < history_keyframe*2+5; i++ {
+		page += fmt.Sprintf("Line %d\n", i)
+		versions = append(versions, page)
+		if _, err := history_record(user, "wikis", "page/1", page, "", ""); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+
+	for i, want := range versions {
+		r := history_get(user, "wikis", "page/1", int64(i+1))
+		if r == nil {
+			t.Fatalf("revision %d missing", i+1)
+		}
+		if (r.Delta == 0) != (r.Revision%history_keyframe == 1) {
+			t.Errorf("revision %d stored with delta=%d", r.Revision, r.Delta)
+		}
+		got, err := history_content(user, r)
+		if err != nil || string(got) != want {
+			t.Fatalf("revision %d rebuilt wrongly: %v", i+1, err)
+		}
+	}
+
+	// Deltas should be far smaller than the page
+	r := history_get(user, "wikis", "page/1", 2)
+	if len(r.Data) > 200 {
+		t.Errorf("delta revision stored in %d bytes", len(r.Data))
+	}
+}
+
+func TestHistoryUnchanged(t *testing.T) {
+	user := history_test_setup(t)
+	a, _ := history_record(user, "wikis", "page/1", "one", "", "")
+	b, _ := history_record(user, "wikis", "page/1", "one", "", "")
+	if a.Revision != 1 || b.Revision != 1 {
+		t.Errorf("unchanged content recorded: %d, %d", a.Revision, b.Revision)
+	}
+	if c, _ := history_record(user, "notes", "page/1", "one", "", ""); c.Revision != 1 {
+		t.Errorf("apps share history: %d", c.Revision)
+	}
+}
+
+func TestHistoryDiff(t *testing.T) {
+	got := history_diff("a\nb\nc\nd", "a\nc\nx\nd")
+	var ops []string
+	for _, l := range got {
+		ops = append(ops, l["op"].(string)+l["text"].(string))
+	}
+	if want := "=a -b =c +x =d"; strings.Join(ops, " ") != want {
+		t.Errorf("diff %q, want %q", strings.Join(ops, " "), want)
+	}
+	if got := history_diff("", "a"); len(got) != 1 || got[0]["op"] != "+" {
+		t.Errorf("diff from empty: %v", got)
+	}
+
+	// Past the limit the middle is replaced outright
+	x := strings.Repeat("x\n", 2000)
+	y := strings.Repeat("y\n", 2000)
+	if got := history_diff("a\n"+x+"z", "a\n"+y+"z"); len(got) != 4002 || got[1]["op"] != "-" || got[2001]["op"] != "+" {
+		t.Errorf("large diff has %d lines", len(got))
+	}
+}
+
+func TestHistoryRevert(t *testing.T) {
+	user := history_test_setup(t)
+	app := create_external_app("wikis")
+	thread := create_test_thread(user, app)
+	thread.SetLocal("owner", user)
+	record, _ := api_history.Attr("record")
+	revert, _ := api_history.Attr("revert")
+
+	sl.Call(thread, record, sl.Tuple{sl.String("page/1"), sl.String("first")}, nil)
+	sl.Call(thread, record, sl.Tuple{sl.String("page/1"), sl.String("second")}, nil)
+	v, err := sl.Call(thread, revert, sl.Tuple{sl.String("page/1"), sl.MakeInt(1)}, nil)
+	if err != nil {
+		t.Fatalf("revert: %v", err)
+	}
+	d := v.(*sl.Dict)
+	content, _, _ := d.Get(sl.String("content"))
+	revision, _, _ := d.Get(sl.String("revision"))
+	if content != sl.String("first") || revision.String() != "3" {
+		t.Errorf("revert returned %v", v)
+	}
+	if _, err := sl.Call(thread, revert, sl.Tuple{sl.String("page/1"), sl.MakeInt(9)}, nil); err == nil {
+		t.Error("revert to missing revision accepted")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/disintegration/imaging"
 	"github.com/nfnt/resize"
 	"github.com/rwcarlsen/goexif/exif"
+	"hash/fnv"
 	"image"
 	"image/gif"
 	"image/jpeg"
@@ -19,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 func is_image(file string) bool {
@@ -48,27 +50,202 @@ const (
 	preview_size   = 1280
 )
 
+// Size presets beside thumbnail and preview, for apps that want more than
+// two sizes. An app may set its own sizes in app.json "thumbnails", e.g.
+// {"small": 200, "large": 1600}; the presets it names there are generated
+// in the background on upload along with the thumbnail and preview.
+var variant_presets = map[string]uint{
+	"small":  250,
+	"medium": 640,
+	"large":  1280,
+}
+
+const (
+	variant_size_max = 4096 // Largest preset size an app may set
+	variant_workers  = 2    // Background generation workers
+)
+
+var (
+	variant_queue = make(chan func(), 1000)
+	// Generating a variant in the background and on request at once must
+	// not share a temp file; lock by path, striped so the set stays bounded
+	variant_locks [64]sync.Mutex
+)
+
+// variant_valid reports whether a variant name is known
+func variant_valid(variant string) bool {
+	if variant == "thumbnail" || variant == "preview" {
+		return true
+	}
+	if _, found := variant_presets[variant]; found {
+		return true
+	}
+	_, _, _, crop := variant_crop(variant)
+	return crop
+}
+
 func variant_size(variant string) uint {
 	if variant == "preview" {
 		return preview_size
 	}
+	if size, found := variant_presets[variant]; found {
+		return size
+	}
 	return thumbnail_size
 }
 
-// variant_create generates a downscaled copy of an image ("thumbnail" or
-// "preview") on demand, storing it beside the original in a per-variant
-// subdirectory ("thumbnails/", "previews/") with a matching filename suffix.
+// app_variant_size returns the size of a variant for an app, using its
+// app.json preset sizes where set
+func app_variant_size(app *App, variant string) uint {
+	if app != nil {
+		if _, preset := variant_presets[variant]; preset {
+			if av := app.active(nil); av != nil {
+				if size := av.Thumbnails[variant]; size > 0 && size <= variant_size_max {
+					return uint(size)
+				}
+			}
+		}
+	}
+	return variant_size(variant)
+}
+
+// variant_dir returns the subdirectory of the files directory a variant is
+// stored in. Thumbnails and previews predate the presets.
+func variant_dir(variant string) string {
+	if variant == "thumbnail" || variant == "preview" {
+		return variant + "s"
+	}
+	if _, _, _, crop := variant_crop(variant); crop {
+		return "crops/" + variant
+	}
+	return "presets/" + variant
+}
+
+// variant_pregenerate returns the variants generated on upload for an app
+func variant_pregenerate(app *App) []string {
+	variants := []string{"thumbnail", "preview"}
+	if app == nil {
+		return variants
+	}
+	if av := app.active(nil); av != nil {
+		for name := range av.Thumbnails {
+			if _, preset := variant_presets[name]; preset {
+				variants = append(variants, name)
+			}
+		}
+	}
+	return variants
+}
+
+// variant_enqueue queues work for the background variant workers, returning
+// false if the queue is full
+func variant_enqueue(task func()) bool {
+	select {
+	case variant_queue <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// variant_enqueue_image queues an image's variants for background
+// generation. If the queue is full they are left for the first request.
+func variant_enqueue_image(app *App, path string) {
+	for _, v := range variant_pregenerate(app) {
+		size := app_variant_size(app, v)
+		if !variant_enqueue(func() { variant_create_size(path, v, size) }) {
+			debug("Image variant queue full; %s of %q left for first request", v, path)
+			return
+		}
+	}
+}
+
+// variant_manager runs the background variant generation workers
+func variant_manager() {
+	for i := 0; i < variant_workers; i++ {
+		go func() {
+			for task := range variant_queue {
+				task()
+			}
+		}()
+	}
+}
+
+// variant_lock returns the lock serialising generation of a variant file
+func variant_lock(path string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return &variant_locks[h.Sum32()%uint32(len(variant_locks))]
+}
+
+// variant_cleanup removes variants whose original image has been deleted
+// from an app's files directory, returning the number removed
+func variant_cleanup() int {
+	removed := 0
+	patterns := []string{"thumbnails/*", "previews/*", "presets/*/*", "crops/*/*"}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(data_dir, "users", "*", "*", "files", pattern))
+		for _, variant := range matches {
+			if strings.HasSuffix(variant, ".tmp") {
+				continue
+			}
+			dir, file := filepath.Dir(variant), filepath.Base(variant)
+			name := filepath.Base(dir)
+			files := filepath.Dir(filepath.Dir(dir))
+			if name == "thumbnails" || name == "previews" {
+				name = strings.TrimSuffix(name, "s")
+				files = filepath.Dir(dir)
+			}
+			ext := filepath.Ext(file)
+			stem, found := strings.CutSuffix(strings.TrimSuffix(file, ext), "_"+name)
+			// PDF previews are PNGs named after the PDF
+			if !found || file_exists(filepath.Join(files, stem+ext)) || (ext == ".png" && file_exists(filepath.Join(files, stem+".pdf"))) {
+				continue
+			}
+			if os.Remove(variant) == nil {
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// variant_create generates a downscaled copy of an image ("thumbnail",
+// "preview" or a preset) at its default size
 func variant_create(path string, variant string) (string, error) {
+	return variant_create_size(path, variant, variant_size(variant))
+}
+
+// variant_create_size generates a downscaled copy of an image, no larger
+// than size on its longest side, storing it beside the original in the
+// variant's subdirectory with a matching filename suffix. An existing copy
+// is reused.
+func variant_create_size(path string, variant string, size uint) (string, error) {
+	return variant_generate(path, variant, func(i image.Image) image.Image {
+		return resize.Thumbnail(size, size, i, resize.Lanczos3)
+	})
+}
+
+// variant_generate stores transform's output from an image, the right way
+// up, as one of its variants, reusing an existing copy
+func variant_generate(path string, variant string, transform func(image.Image) image.Image) (string, error) {
 	dir, file := filepath.Split(path)
-	thumb := dir + variant + "s/" + variant_name(file, variant)
+	thumb := dir + variant_dir(variant) + "/" + variant_name(file, variant)
 	tmp := thumb + ".tmp"
 
+	l := variant_lock(thumb)
+	l.Lock()
+	defer l.Unlock()
+
 	// Clean up any leftover temp file from a previous failed attempt
 	_ = os.Remove(tmp)
 
 	if file_exists(thumb) {
 		return thumb, nil
 	}
+	if !file_exists(path) {
+		return "", os.ErrNotExist
+	}
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -108,8 +285,7 @@ func variant_create(path string, variant string) (string, error) {
 		i = fix_orientation(i, orientation)
 	}
 
-	size := variant_size(variant)
-	t := resize.Thumbnail(size, size, i, resize.Lanczos3)
+	t := transform(i)
 
 	if err := os.MkdirAll(filepath.Dir(thumb), 0755); err != nil {
 		warn("Unable to create %s variant directory %q: %v", variant, filepath.Dir(thumb), err)
@@ -257,6 +257,7 @@ func TestVariantCreate(t *testing.T) {
 	}{
 		{"thumbnail", "thumbnails", "_thumbnail", 250},
 		{"preview", "previews", "_preview", 1280},
+		{"medium", "presets/medium", "_medium", 640},
 	} {
 		thumb_path, err := variant_create(img_path, tt.variant)
 		if err != nil {
@@ -312,6 +313,44 @@ func TestVariantCreate(t *testing.T) {
 	}
 }
 
+func TestAppVariantSize(t *testing.T) {
+	app := &App{id: "photos", internal: &AppVersion{Thumbnails: map[string]int{"small": 120, "large": 99999, "thumbnail": 10}}}
+	if got := app_variant_size(app, "small"); got != 120 {
+		t.Errorf("small %d, want the app's 120", got)
+	}
+	if got := app_variant_size(app, "large"); got != variant_presets["large"] {
+		t.Errorf("oversized large %d, want the default", got)
+	}
+	if got := app_variant_size(app, "thumbnail"); got != thumbnail_size {
+		t.Errorf("thumbnail %d resized by the app", got)
+	}
+	pregenerate := variant_pregenerate(app)
+	if len(pregenerate) != 4 {
+		t.Errorf("pregenerated %v, want thumbnail, preview, small and large", pregenerate)
+	}
+}
+
+func TestVariantCleanup(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	files := filepath.Join(data_dir, "users", "u1", "photos", "files")
+	for _, p := range []string{
+		"kept_a.png", "thumbnails/kept_a_thumbnail.png", "presets/small/kept_a_small.png",
+		"thumbnails/gone_b_thumbnail.png", "previews/gone_b_preview.png", "presets/large/gone_b_large.png",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(files, p)), 0755)
+		os.WriteFile(filepath.Join(files, p), []byte("x"), 0644)
+	}
+	if n := variant_cleanup(); n != 3 {
+		t.Errorf("removed %d variants, want 3", n)
+	}
+	for _, p := range []string{"thumbnails/kept_a_thumbnail.png", "presets/small/kept_a_small.png"} {
+		if !file_exists(filepath.Join(files, p)) {
+			t.Errorf("%s of a kept image removed", p)
+		}
+	}
+}
+
 // Benchmark variant_name
 func BenchmarkVariantName(b *testing.B) {
 	inputs := []string{
@@ -0,0 +1,243 @@
+// Mochi server: Administrators acting as another user
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// An administrator can open a session as another user to help them, with
+// mochi.user.impersonation.start(). It needs a fresh re-authentication
+// proof from the administrator and a reason, and can't be used on another
+// administrator. The administrator's browser is switched to a new session
+// of the user's, which lasts impersonation_minutes, and switched back by
+// mochi.user.impersonation.stop() or /_/auth/impersonation/stop.
+//
+// While it lasts, the User apps are given has its impersonator set, and
+// /_/identity reports it, so apps can say so plainly. It can't be used to
+// change how the user signs in. Its start, each action it runs, and its
+// end are written to the audit log, and the impersonations table of
+// sessions.db keeps a record of each for impersonation_history.
+
+const impersonation_history = 90 * 86400
+
+var api_user_impersonation = sls.FromStringDict(sl.String("mochi.user.impersonation"), sl.StringDict{
+	"get":   sl.NewBuiltin("mochi.user.impersonation.get", api_user_impersonation_get),
+	"list":  sl.NewBuiltin("mochi.user.impersonation.list", api_user_impersonation_list),
+	"start": sl.NewBuiltin("mochi.user.impersonation.start", api_user_impersonation_start),
+	"stop":  sl.NewBuiltin("mochi.user.impersonation.stop", api_user_impersonation_stop),
+})
+
+// impersonation_minutes returns how long an impersonation lasts, or 0 if
+// they are disabled
+func impersonation_minutes() int64 {
+	return atoi(setting_get("impersonation_minutes", "30"), 30)
+}
+
+// impersonation_mark sets the impersonator of a user signed in with a
+// session, if that session is an impersonation
+func impersonation_mark(user *User, session string) {
+	if user == nil || session == "" {
+		return
+	}
+	row, _ := db_open("db/sessions.db").row("select administrator from impersonations where session=? and ended=0 and expires>=?", session, now())
+	if row != nil {
+		user.Impersonator = as_string(row["administrator"])
+	}
+}
+
+// jwt_login returns the session an already verified JWT was issued for
+func jwt_login(token string) string {
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &mochi_claims{})
+	if err != nil {
+		return ""
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+// impersonation_start opens a session as a user for an administrator, who
+// is signed in with origin. Returns the new session.
+func impersonation_start(administrator, user *User, origin, reason, address, agent string) (string, error) {
+	minutes := impersonation_minutes()
+	if minutes <= 0 {
+		return "", fmt.Errorf("impersonation is disabled")
+	}
+	if user.UID == administrator.UID {
+		return "", fmt.Errorf("can't impersonate yourself")
+	}
+	if user.administrator() {
+		return "", fmt.Errorf("can't impersonate an administrator")
+	}
+	if administrator.Impersonator != "" {
+		return "", fmt.Errorf("already impersonating")
+	}
+
+	session := login_create(user.UID, address, agent)
+	expires := now() + minutes*60
+	db := db_open("db/sessions.db")
+	db.exec("update sessions set expires=? where code=?", expires, session)
+	db.exec("insert into impersonations ( session, user, administrator, origin, reason, address, created, expires ) values ( ?, ?, ?, ?, ?, ?, ?, ? )", session, user.UID, administrator.UID, origin, reason, address, now(), expires)
+	audit_impersonation_started(administrator.Username, user.Username, address, reason)
+	return session, nil
+}
+
+// impersonation_stop ends an impersonation, returning the session of the
+// administrator's to switch back to, or "" if it has gone
+func impersonation_stop(session, address string) string {
+	db := db_open("db/sessions.db")
+	row, _ := db.row("select user, administrator, origin from impersonations where session=? and ended=0", session)
+	if row == nil {
+		return ""
+	}
+	db.exec("update impersonations set ended=? where session=?", now(), session)
+	login_delete(session)
+
+	administrator := user_by_uid(as_string(row["administrator"]))
+	user := user_by_uid(as_string(row["user"]))
+	if administrator != nil && user != nil {
+		audit_impersonation_ended(administrator.Username, user.Username, address)
+	}
+	origin := as_string(row["origin"])
+	if exists, _ := db.exists("select 1 from sessions where code=? and user=? and expires>=?", origin, row["administrator"], now()); !exists {
+		return ""
+	}
+	return origin
+}
+
+// impersonations_expire records the end of impersonations that have run
+// out
+func impersonations_expire() {
+	db := db_open("db/sessions.db")
+	rows, _ := db.rows("select session, user, administrator, expires from impersonations where ended=0 and expires<?", now())
+	for _, row := range rows {
+		db.exec("update impersonations set ended=? where session=?", row["expires"], row["session"])
+		administrator := user_by_uid(as_string(row["administrator"]))
+		user := user_by_uid(as_string(row["user"]))
+		if administrator != nil && user != nil {
+			audit_impersonation_ended(administrator.Username, user.Username, "expired")
+		}
+	}
+}
+
+// impersonation_switch ends the impersonation a browser is in, and signs it
+// back in as the administrator if their session is still valid. Returns
+// whether there was an impersonation.
+func impersonation_switch(c *gin.Context) bool {
+	session := web_cookie_get(c, "session", "")
+	if exists, _ := db_open("db/sessions.db").exists("select 1 from impersonations where session=? and ended=0", session); !exists {
+		return false
+	}
+	origin := impersonation_stop(session, rate_limit_client_ip(c))
+	if origin == "" {
+		web_cookie_unset(c, "session")
+	} else {
+		web_cookie_set(c, "session", origin)
+	}
+	return true
+}
+
+// POST /_/auth/impersonation/stop - Stop acting as another user
+func web_impersonation_stop(c *gin.Context) {
+	if !impersonation_switch(c) {
+		respond_error(c, http.StatusBadRequest, "not_impersonating", "errors.not_impersonating", nil)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"stopped": true})
+}
+
+// mochi.user.impersonation.start(user, reason, proof) -> dict: Act as
+// another user, switching this browser to a session of theirs. Needs a
+// re-authentication proof earned in the calling app with purpose
+// "impersonation". Returns the Unix timestamp the impersonation expires at.
+func api_user_impersonation_start(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "users/impersonate"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	administrator, _ := t.Local("user").(*User)
+	if administrator == nil || !administrator.administrator() {
+		return sl_error(fn, "access denied")
+	}
+	var uid, reason, proof string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "user", &uid, "reason", &reason, "proof", &proof); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" || len(reason) > 500 {
+		return sl_error(fn, "a reason is required")
+	}
+	action, ok := t.Local("action").(*Action)
+	if !ok || action.web == nil {
+		return sl_error(fn, "impersonation needs a browser")
+	}
+	user := user_by_uid(uid)
+	if user == nil {
+		return sl_error(fn, "user not found")
+	}
+	if !reauthentication_consume(administrator, reauthentication_app(t), "impersonation", proof) {
+		return sl_error(fn, "re-authentication required")
+	}
+
+	c := action.web
+	session, err := impersonation_start(administrator, user, web_cookie_get(c, "session", ""), reason, rate_limit_client_ip(c), c.GetHeader("User-Agent"))
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	web_cookie_set(c, "session", session)
+	return sl_encode(map[string]any{"expires": now() + impersonation_minutes()*60}), nil
+}
+
+// mochi.user.impersonation.stop() -> bool: Stop acting as another user,
+// switching this browser back to the administrator's session
+func api_user_impersonation_stop(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	action, ok := t.Local("action").(*Action)
+	if !ok || action.web == nil {
+		return sl.False, nil
+	}
+	return sl.Bool(impersonation_switch(action.web)), nil
+}
+
+// mochi.user.impersonation.get() -> dict or None: The impersonation the
+// current user is being acted as in, with the administrator's uid and
+// username, the reason, and the Unix timestamp it expires at
+func api_user_impersonation_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, _ := t.Local("user").(*User)
+	if user == nil || user.Impersonator == "" {
+		return sl.None, nil
+	}
+	row, _ := db_open("db/sessions.db").row("select administrator, reason, expires from impersonations where user=? and administrator=? and ended=0 and expires>=? order by created desc limit 1", user.UID, user.Impersonator, now())
+	if row == nil {
+		return sl.None, nil
+	}
+	if administrator := user_by_uid(user.Impersonator); administrator != nil {
+		row["username"] = administrator.Username
+	}
+	return sl_encode(row), nil
+}
+
+// mochi.user.impersonation.list() -> list: Impersonations from the last 90
+// days, newest first, for administrators. Each has the user, administrator,
+// reason, address, and the Unix timestamps it was created, expires or
+// expired at, and was ended at, or 0 if it wasn't ended early.
+func api_user_impersonation_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "users/impersonate"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || !user.administrator() {
+		return sl_error(fn, "access denied")
+	}
+	rows, _ := db_open("db/sessions.db").rows("select user, administrator, reason, address, created, expires, ended from impersonations where created>=? order by created desc", now()-impersonation_history)
+	return sl_encode(rows), nil
+}
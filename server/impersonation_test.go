@@ -0,0 +1,149 @@
+// Mochi server: Impersonation tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+// impersonation_test_context returns a request context signed in with a
+// session, and its recorder
+func impersonation_test_context(session string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/_/auth/impersonation/stop", nil)
+	c.Request.AddCookie(&http.Cookie{Name: "session", Value: session})
+	return c, w
+}
+
+// impersonation_test_session returns the session a response set
+func impersonation_test_session(w *httptest.ResponseRecorder) string {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "session" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func TestImpersonation(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	load_core_labels()
+	gin.SetMode(gin.TestMode)
+
+	people := map[string]*User{}
+	for _, name := range []string{"admin", "other", "user"} {
+		u, _ := user_create(name + "@example.com")
+		if _, err := entity_create(u, "person", name, "public", ""); err != nil {
+			t.Fatal(err)
+		}
+		people[name] = user_by_uid(u.UID)
+	}
+	admin, user := people["admin"], people["user"]
+	origin := login_create(admin.UID, "192.0.2.1", "Browser")
+
+	start := func(caller *User, target *User, proof string) (*httptest.ResponseRecorder, error) {
+		c, w := impersonation_test_context(origin)
+		thread := &sl.Thread{}
+		thread.SetLocal("user", caller)
+		thread.SetLocal("app", &App{id: "administrator", internal: &AppVersion{}})
+		thread.SetLocal("action", &Action{web: c})
+		f, _ := api_user_impersonation.Attr("start")
+		_, err := sl.Call(thread, f, sl.Tuple{sl.String(target.UID), sl.String("Ticket 42"), sl.String(proof)}, nil)
+		return w, err
+	}
+	proof := func() string {
+		token, _ := reauthentication_advance(admin, "administrator", "impersonation", "email")
+		return token
+	}
+
+	if _, err := start(people["other"], user, proof()); err == nil {
+		t.Error("impersonated by a user")
+	}
+	if _, err := start(admin, admin, proof()); err == nil {
+		t.Error("impersonated self")
+	}
+	if _, err := start(admin, user, "forged"); err == nil {
+		t.Error("impersonated without re-authentication")
+	}
+	if token, _ := reauthentication_advance(admin, "administrator", "export", "email"); token == "" {
+		t.Fatal("no proof for export")
+	} else if _, err := start(admin, user, token); err == nil {
+		t.Error("impersonated with a proof given for another purpose")
+	}
+
+	w, err := start(admin, user, proof())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := impersonation_test_session(w)
+	acting := user_by_login(session)
+	if acting == nil || acting.UID != user.UID || acting.Impersonator != admin.UID {
+		t.Fatalf("impersonated session %v", acting)
+	}
+	if v, _ := acting.Attr("impersonator"); v != sl.String(admin.UID) {
+		t.Errorf("impersonator attribute %v", v)
+	}
+	if v, _ := user.Attr("impersonator"); v != sl.None {
+		t.Errorf("impersonator of the user's own session %v", v)
+	}
+
+	// It can't change how the user signs in
+	thread := &sl.Thread{}
+	thread.SetLocal("user", acting)
+	thread.SetLocal("app", &App{id: "settings", internal: &AppVersion{}})
+	if err := require_permission(thread, nil, "user/authentication/write"); err == nil || !strings.Contains(err.Error(), "impersonating") {
+		t.Errorf("authentication changed while impersonating: %v", err)
+	}
+
+	// Stopping switches back to the administrator's session
+	c, w := impersonation_test_context(session)
+	web_impersonation_stop(c)
+	if w.Code != http.StatusOK || impersonation_test_session(w) != origin {
+		t.Fatalf("stop: %d %q", w.Code, impersonation_test_session(w))
+	}
+	if user_by_login(session) != nil {
+		t.Error("impersonated session still signed in")
+	}
+	c, w = impersonation_test_context(session)
+	if web_impersonation_stop(c); w.Code != http.StatusBadRequest {
+		t.Errorf("stopped twice: %d", w.Code)
+	}
+	row, _ := db_open("db/sessions.db").row("select reason, ended from impersonations where session=?", session)
+	if row == nil || row["reason"] != "Ticket 42" || as_int64(row["ended"]) == 0 {
+		t.Errorf("record %v", row)
+	}
+
+	// Impersonations end by themselves
+	w, _ = start(admin, user, proof())
+	session = impersonation_test_session(w)
+	db_open("db/sessions.db").exec("update impersonations set expires=? where session=?", now()-1, session)
+	if acting = user_by_login(session); acting != nil && acting.Impersonator != "" {
+		t.Error("expired impersonation still marked")
+	}
+	db_open("db/sessions.db").exec("update sessions set expires=? where code=?", now()-1, session)
+	if user_by_login(session) != nil {
+		t.Error("expired impersonated session still signed in")
+	}
+	impersonations_expire()
+	if row, _ = db_open("db/sessions.db").row("select ended from impersonations where session=?", session); as_int64(row["ended"]) == 0 {
+		t.Error("expired impersonation not ended")
+	}
+
+	setting_set("impersonation_minutes", "0")
+	if _, err := start(admin, user, proof()); err == nil {
+		t.Error("impersonated while disabled")
+	}
+}
@@ -0,0 +1,588 @@
+// Mochi server: Importer
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Imports from external services run as jobs. An app starts one with
+// mochi.importer.start(event, source, state), and core then calls the app's
+// event handler repeatedly, one batch at a time, each call within the usual
+// handler limits. The handler gets the job in event.data as {job, source,
+// state}, imports a batch, and returns the state for the next batch, or None
+// when the import is finished. Jobs survive restarts, a failing batch is
+// retried a few times before the job fails, and the user may cancel a job
+// at any time.
+//
+// While running, a handler reports progress with mochi.importer.progress,
+// which is pushed to the user's browsers on the "import" websocket key;
+// fetches pages with mochi.importer.fetch, rate limited per host so an
+// import does not hammer the service it reads from; copies media into
+// attachments with mochi.importer.sideload; and records which local object
+// each source item became with mochi.importer.map, so a retried batch or a
+// later import of the same source does not import it twice, and later items
+// can refer to earlier ones.
+//
+// Jobs live in db/imports.db.
+
+const (
+	import_concurrency   = 2               // Jobs running at once
+	import_attempts      = 3               // Tries of a failing batch
+	import_retry_delay   = 60              // Seconds before a failed batch is retried
+	import_state_limit   = 1024 * 1024     // Bytes of state kept between batches
+	import_fetch_limit   = 8 * 1024 * 1024 // Bytes returned by a fetch
+	import_message_limit = 1000
+)
+
+type ImportJob struct {
+	ID       string `db:"id"`
+	User     string `db:"user"`
+	App      string `db:"app"`
+	Event    string `db:"event"`
+	Source   string `db:"source"`
+	State    []byte `db:"state"`
+	Status   string `db:"status"`
+	Done     int64  `db:"done"`
+	Total    int64  `db:"total"`
+	Message  string `db:"message"`
+	Error    string `db:"error"`
+	Failures int64  `db:"failures"`
+	Due      int64  `db:"due"`
+	Created  int64  `db:"created"`
+	Updated  int64  `db:"updated"`
+}
+
+var (
+	import_lock    sync.Mutex
+	import_running = map[string]bool{} // Job ID -> batch in progress
+	import_wake    = make(chan struct{}, 1)
+)
+
+var api_importer = sls.FromStringDict(sl.String("mochi.importer"), sl.StringDict{
+	"cancel":   sl.NewBuiltin("mochi.importer.cancel", api_importer_cancel),
+	"fetch":    sl.NewBuiltin("mochi.importer.fetch", api_importer_fetch),
+	"get":      sl.NewBuiltin("mochi.importer.get", api_importer_get),
+	"issues":   sl.NewBuiltin("mochi.importer.issues", api_importer_issues),
+	"list":     sl.NewBuiltin("mochi.importer.list", api_importer_list),
+	"map":      sl.NewBuiltin("mochi.importer.map", api_importer_map),
+	"mirror":   sl.NewBuiltin("mochi.importer.mirror", api_importer_mirror),
+	"progress": sl.NewBuiltin("mochi.importer.progress", api_importer_progress),
+	"sideload": sl.NewBuiltin("mochi.importer.sideload", api_importer_sideload),
+	"start":    sl.NewBuiltin("mochi.importer.start", api_importer_start),
+})
+
+// imports_db opens the import jobs database, creating its tables if needed
+func imports_db() *DB {
+	db := db_open("db/imports.db")
+	db.exec("create table if not exists jobs (id text not null primary key, user text not null, app text not null, event text not null, source text not null default '', state blob not null, status text not null, done integer not null default 0, total integer not null default 0, message text not null default '', error text not null default '', failures integer not null default 0, due integer not null default 0, created integer not null, updated integer not null)")
+	db.exec("create index if not exists jobs_status_due on jobs(status, due)")
+	db.exec("create index if not exists jobs_user_app on jobs(user, app, created)")
+	db.exec("create table if not exists items (user text not null, app text not null, source text not null, key text not null, target text not null, created integer not null, primary key (user, app, source, key))")
+	return db
+}
+
+// import_get returns a job, or nil
+func import_get(id string) *ImportJob {
+	var j ImportJob
+	if !imports_db().scan(&j, "select * from jobs where id=?", id) {
+		return nil
+	}
+	return &j
+}
+
+// info returns a job as seen by its app
+func (j *ImportJob) info() map[string]any {
+	return map[string]any{"id": j.ID, "event": j.Event, "source": j.Source, "status": j.Status, "done": j.Done, "total": j.Total, "message": j.Message, "error": j.Error, "created": j.Created, "updated": j.Updated}
+}
+
+// import_start queues a new job
+func import_start(u *User, app, event, source string, state any) *ImportJob {
+	t := now()
+	j := &ImportJob{ID: uid(), User: u.UID, App: app, Event: event, Source: source, State: cbor_encode(state), Status: "queued", Due: t, Created: t, Updated: t}
+	imports_db().exec("insert into jobs (id, user, app, event, source, state, status, due, created, updated) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", j.ID, j.User, j.App, j.Event, j.Source, j.State, j.Status, j.Due, j.Created, j.Updated)
+	import_notify()
+	return j
+}
+
+// import_notify wakes the import manager
+func import_notify() {
+	select {
+	case import_wake <- struct{}{}:
+	default:
+	}
+}
+
+// import_publish pushes a job's progress to its user's browsers
+func import_publish(j *ImportJob) {
+	if u := user_by_uid(j.User); u != nil {
+		websockets_send(u, "import", j.info())
+	}
+}
+
+// import_manager runs due batches of queued jobs, a few jobs at a time.
+// Jobs left running by a previous process are queued again.
+func import_manager() {
+	imports_db().exec("update jobs set status='queued' where status='running'")
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		import_dispatch()
+		select {
+		case <-import_wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// import_dispatch starts batches for due jobs while there is capacity
+func import_dispatch() {
+	var jobs []ImportJob
+	imports_db().scans(&jobs, "select * from jobs where status='queued' and due<=? order by due limit ?", now(), import_concurrency*4)
+	for i := range jobs {
+		j := jobs[i]
+		import_lock.Lock()
+		if import_running[j.ID] || len(import_running) >= import_concurrency {
+			import_lock.Unlock()
+			continue
+		}
+		import_running[j.ID] = true
+		import_lock.Unlock()
+
+		go func() {
+			defer func() {
+				import_lock.Lock()
+				delete(import_running, j.ID)
+				import_lock.Unlock()
+				import_notify()
+			}()
+			import_step(&j)
+		}()
+	}
+}
+
+// import_step runs one batch of a job and records the outcome
+func import_step(j *ImportJob) {
+	db := imports_db()
+	result, err := db.internal.Exec("update jobs set status='running', updated=? where id=? and status='queued'", now(), j.ID)
+	if err != nil {
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+
+	state, err := import_run(j)
+	j = import_get(j.ID)
+	if j == nil || j.Status != "running" {
+		// Cancelled while the batch ran
+		return
+	}
+	t := now()
+	switch {
+	case err != nil:
+		j.Failures++
+		j.Error = err.Error()
+		if j.Failures >= import_attempts {
+			info("Import job %q for app %q failed: %v", j.ID, j.App, err)
+			db.exec("update jobs set status='failed', error=?, failures=?, updated=? where id=?", j.Error, j.Failures, t, j.ID)
+			j.Status = "failed"
+		} else {
+			db.exec("update jobs set status='queued', error=?, failures=?, due=?, updated=? where id=?", j.Error, j.Failures, t+import_retry_delay, t, j.ID)
+			j.Status = "queued"
+		}
+
+	case state == nil:
+		db.exec("update jobs set status='done', error='', updated=? where id=?", t, j.ID)
+		j.Status = "done"
+
+	default:
+		data := cbor_encode(state)
+		if len(data) > import_state_limit {
+			db.exec("update jobs set status='failed', error='state too large', updated=? where id=?", t, j.ID)
+			j.Status = "failed"
+			break
+		}
+		db.exec("update jobs set status='queued', state=?, error='', failures=0, due=?, updated=? where id=?", data, t, t, j.ID)
+		j.Status = "queued"
+	}
+	j.Updated = t
+	import_publish(j)
+}
+
+// import_run calls the job's handler for one batch, returning the state for
+// the next batch or nil if the import is finished
+func import_run(j *ImportJob) (any, error) {
+	user := user_by_uid(j.User)
+	if user == nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	app := app_by_id(j.App)
+	if app == nil {
+		return nil, fmt.Errorf("app not found")
+	}
+	av := app.active(user)
+	if av == nil {
+		return nil, fmt.Errorf("app has no active version")
+	}
+	apps_lock.Lock()
+	ae, found := av.Events[j.Event]
+	apps_lock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("app has no event %q", j.Event)
+	}
+
+	var state any
+	cbor_decode_mode.Unmarshal(j.State, &state)
+	sew := &ScheduledEventWrapper{
+		se:     &ScheduledEvent{User: j.User, App: j.App, Event: j.Event, Due: j.Due, Created: j.Created},
+		data:   map[string]any{"job": j.ID, "source": j.Source, "state": state},
+		source: "import",
+		user:   user,
+	}
+	s := av.starlark()
+	s.set("event", sew)
+	s.set("app", app)
+	s.set("user", user)
+	s.set("owner", user)
+	v, err := s.call(ae.Function, sl.Tuple{sew})
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || v == sl.None {
+		return nil, nil
+	}
+	next := sl_decode(v)
+	if next == nil {
+		return nil, nil
+	}
+	return next, nil
+}
+
+// import_caller returns the running job of the calling app and its user
+func import_caller(t *sl.Thread, id string) (*ImportJob, *User, *App, error) {
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	j := import_get(id)
+	if j == nil || j.User != user.UID || j.App != app.id {
+		return nil, nil, nil, fmt.Errorf("job not found")
+	}
+	return j, user, app, nil
+}
+
+// import_host_allow applies the per-host fetch rate limit
+func import_host_allow(rawurl string) bool {
+	u, err := neturl.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return rate_limit_import.allow(strings.ToLower(u.Hostname()))
+}
+
+// import_wait waits for the per-host fetch rate limit, as long as the
+// thread's context allows
+func import_wait(t *sl.Thread, rawurl string) error {
+	ctx := starlark_context(t)
+	for !import_host_allow(rawurl) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return nil
+}
+
+// mochi.importer.start(event, source?, state?) -> string: Start an import
+// job for the current user. Core calls the app's event handler for each
+// batch with event.data {job, source, state}; the handler returns the state
+// for the next batch, or None when finished. Returns the job id.
+func api_importer_start(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var event, source string
+	var state sl.Value = sl.None
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "event", &event, "source?", &source, "state?", &state); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(event, "constant") {
+		return sl_error(fn, "invalid event")
+	}
+	if len(source) > import_message_limit {
+		return sl_error(fn, "source too long")
+	}
+	if len(cbor_encode(sl_decode(state))) > import_state_limit {
+		return sl_error(fn, "state too large")
+	}
+	return sl.String(import_start(user, app.id, event, source, sl_decode(state)).ID), nil
+}
+
+// mochi.importer.get(job) -> dict | None: Get one of the app's jobs for the
+// current user
+func api_importer_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "job", &id); err != nil {
+		return nil, err
+	}
+	j, _, _, err := import_caller(t, id)
+	if err != nil {
+		return sl.None, nil
+	}
+	return sl_encode(j.info()), nil
+}
+
+// mochi.importer.list() -> list: List the app's jobs for the current user,
+// newest first
+func api_importer_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	var jobs []ImportJob
+	if err := imports_db().scans(&jobs, "select * from jobs where user=? and app=? order by created desc", user.UID, app.id); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	results := make([]any, len(jobs))
+	for i := range jobs {
+		results[i] = jobs[i].info()
+	}
+	return sl_encode(results), nil
+}
+
+// mochi.importer.cancel(job) -> bool: Cancel a job that has not finished.
+// A batch already running completes, but its result is discarded.
+func api_importer_cancel(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "job", &id); err != nil {
+		return nil, err
+	}
+	j, _, _, err := import_caller(t, id)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	result, err := imports_db().internal.Exec("update jobs set status='cancelled', updated=? where id=? and status in ('queued', 'running')", now(), j.ID)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	if n > 0 {
+		j.Status = "cancelled"
+		import_publish(j)
+	}
+	return sl.Bool(n > 0), nil
+}
+
+// mochi.importer.progress(job, done, total?, message?) -> None: Report how
+// many items of a job are done, of how many if known
+func api_importer_progress(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, message string
+	var done int
+	total := -1
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "job", &id, "done", &done, "total?", &total, "message?", &message); err != nil {
+		return nil, err
+	}
+	j, _, _, err := import_caller(t, id)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if done < 0 {
+		return sl_error(fn, "invalid done")
+	}
+	if len(message) > import_message_limit {
+		return sl_error(fn, "message too long")
+	}
+	j.Done = int64(done)
+	if total >= 0 {
+		j.Total = int64(total)
+	}
+	j.Message = message
+	j.Updated = now()
+	imports_db().exec("update jobs set done=?, total=?, message=?, updated=? where id=?", j.Done, j.Total, j.Message, j.Updated, j.ID)
+	import_publish(j)
+	return sl.None, nil
+}
+
+// mochi.importer.map(job, key, target?) -> string | None: Record that the
+// source item key was imported as the local object target, or with no
+// target, look up what it was imported as
+func api_importer_map(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, key, target string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "job", &id, "key", &key, "target?", &target); err != nil {
+		return nil, err
+	}
+	j, _, _, err := import_caller(t, id)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if key == "" || len(key) > import_message_limit || len(target) > import_message_limit {
+		return sl_error(fn, "invalid key")
+	}
+	db := imports_db()
+	if target != "" {
+		db.exec("replace into items (user, app, source, key, target, created) values (?, ?, ?, ?, ?, ?)", j.User, j.App, j.Source, key, target, now())
+		return sl.String(target), nil
+	}
+	row, _ := db.row("select target from items where user=? and app=? and source=? and key=?", j.User, j.App, j.Source, key)
+	if row == nil {
+		return sl.None, nil
+	}
+	s, _ := row["target"].(string)
+	return sl.String(s), nil
+}
+
+// mochi.importer.fetch(job, url, headers?) -> dict: Fetch a URL for a job,
+// waiting for the per-host rate limit and retrying transient failures.
+// Requires the url: permission for the host. Returns {status, headers, body,
+// truncated}; status 0 with "error" if the request failed.
+func api_importer_fetch(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, url string
+	var headers_value sl.Value = sl.None
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "job", &id, "url", &url, "headers?", &headers_value); err != nil {
+		return nil, err
+	}
+	if _, _, _, err := import_caller(t, id); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if err := require_permission_url(t, fn, url); err != nil {
+		return sl_encode(map[string]any{"status": 403, "headers": map[string]string{}, "body": ""}), nil
+	}
+	headers := sl_decode_strings(headers_value)
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	if err := import_wait(t, url); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	r, err := url_request_retry(starlark_context(t), "get", url, nil, headers, func() (any, error) { return nil, nil }, url_max_retries, url_domains_granted(t)...)
+	if err != nil {
+		return sl_encode(map[string]any{"status": 0, "headers": map[string]string{}, "body": "", "error": err.Error()}), nil
+	}
+	defer r.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(r.Body, import_fetch_limit+1))
+	truncated := len(data) > import_fetch_limit
+	if truncated {
+		data = data[:import_fetch_limit]
+	}
+	return sl_encode(map[string]any{"status": r.StatusCode, "headers": header_to_map(r.Header), "body": string(data), "truncated": truncated}), nil
+}
+
+// mochi.importer.sideload(job, url, object, name?, caption?) -> dict: Copy
+// the media at a URL into an attachment on an object, once per source
+// however often it is asked for. Requires the url: permission for the host. Returns
+// the attachment.
+func api_importer_sideload(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, url, object, name, caption string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "job", &id, "url", &url, "object", &object, "name?", &name, "caption?", &caption); err != nil {
+		return nil, err
+	}
+	j, user, app, err := import_caller(t, id)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(object, "path") {
+		return sl_error(fn, "invalid object")
+	}
+	if name == "" {
+		if u, err := neturl.Parse(url); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	if !valid(name, "filename") {
+		name = "file"
+	}
+	db := db_app_system(user, app)
+	if db == nil {
+		return sl_error(fn, "no database")
+	}
+	db.attachments_setup()
+
+	// Already sideloaded from this source
+	key := "sideload:" + url
+	if row, _ := imports_db().row("select target from items where user=? and app=? and source=? and key=?", j.User, j.App, j.Source, key); row != nil {
+		var att Attachment
+		if db.scan(&att, "select * from attachments where id=?", row["target"]) {
+			return sl_encode(att.to_map(app.url_path(user))), nil
+		}
+	}
+
+	if err := require_permission_url(t, fn, url); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if err := import_wait(t, url); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	r, err := url_request_retry(starlark_context(t), "get", url, nil, map[string]string{}, func() (any, error) { return nil, nil }, url_max_retries, url_domains_granted(t)...)
+	if err != nil {
+		return sl_error(fn, "unable to fetch %q: %v", url, err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != 200 {
+		return sl_error(fn, "unable to fetch %q: status %d", url, r.StatusCode)
+	}
+
+	remaining, err := user_storage_remaining(user)
+	if err != nil {
+		return sl_error(fn, "unable to measure storage: %v", err)
+	}
+	limit := min(remaining, attachment_max_size_default)
+
+	att := Attachment{ID: uid(), Object: object, Name: name, ContentType: attachment_content_type(name), Caption: caption, Rank: db.attachment_next_rank(object), Created: now()}
+	if ct := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0]); ct != "" && ct != "application/octet-stream" {
+		att.ContentType = ct
+	}
+	if user.Identity != nil {
+		att.Creator = user.Identity.ID
+	}
+
+	base := attachment_files_base(user.UID, app.id)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return sl_error(fn, "unable to create files directory: %v", err)
+	}
+	root, err := os.OpenRoot(base)
+	if err != nil {
+		return sl_error(fn, "unable to access files directory")
+	}
+	defer root.Close()
+	filename := attachment_filename(att.ID, att.Name)
+	f, err := root.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return sl_error(fn, "unable to write file")
+	}
+	size, err := io.Copy(f, io.LimitReader(r.Body, limit+1))
+	f.Close()
+	if err != nil || size > limit {
+		root.Remove(filename)
+		if err == nil {
+			return sl_error(fn, "file too large or storage limit exceeded")
+		}
+		return sl_error(fn, "unable to fetch %q: %v", url, err)
+	}
+	att.Size = size
+
+	attachment_record_write(db, &att)
+	attachment_variants_queue(app, user, &att)
+	imports_db().exec("replace into items (user, app, source, key, target, created) values (?, ?, ?, ?, ?, ?)", j.User, j.App, j.Source, key, att.ID, now())
+	return sl_encode(att.to_map(app.url_path(user))), nil
+}
@@ -0,0 +1,92 @@
+// Mochi server: Importer tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func importer_test_setup(t *testing.T) *User {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	return create_permission_test_user(t, "u1")
+}
+
+func TestImportFailingBatchRetried(t *testing.T) {
+	user := importer_test_setup(t)
+
+	// The app is not installed, so every batch fails
+	j := import_start(user, "missing", "import", "https://example.com", map[string]any{"page": int64(1)})
+	for i := 1; i <= import_attempts; i++ {
+		import_step(j)
+		j = import_get(j.ID)
+		if i < import_attempts && (j.Status != "queued" || j.Due <= now()) {
+			t.Fatalf("attempt %d left job %q due %d", i, j.Status, j.Due)
+		}
+		imports_db().exec("update jobs set due=0 where id=?", j.ID)
+	}
+	if j.Status != "failed" || j.Error == "" {
+		t.Errorf("job %q after %d failures, error %q", j.Status, import_attempts, j.Error)
+	}
+}
+
+func TestImportCancelledNotRun(t *testing.T) {
+	user := importer_test_setup(t)
+	j := import_start(user, "missing", "import", "", nil)
+	imports_db().exec("update jobs set status='cancelled' where id=?", j.ID)
+	import_step(j)
+	if got := import_get(j.ID); got.Status != "cancelled" || got.Failures != 0 {
+		t.Errorf("cancelled job ran: %q, %d failures", got.Status, got.Failures)
+	}
+}
+
+func TestImportMap(t *testing.T) {
+	user := importer_test_setup(t)
+	app := create_external_app("wikis")
+	j := import_start(user, app.id, "import", "https://wiki.example.com", nil)
+	imports_db().exec("update jobs set status='done' where id=?", j.ID)
+	thread := create_test_thread(user, app)
+	f, _ := api_importer.Attr("map")
+
+	sl.Call(thread, f, sl.Tuple{sl.String(j.ID), sl.String("page:Main"), sl.String("page/1")}, nil)
+
+	// A later import of the same source sees the earlier mapping
+	again := import_start(user, app.id, "import", "https://wiki.example.com", nil)
+	v, err := sl.Call(thread, f, sl.Tuple{sl.String(again.ID), sl.String("page:Main")}, nil)
+	if err != nil || v != sl.String("page/1") {
+		t.Errorf("mapping not found: %v, %v", v, err)
+	}
+	other := import_start(user, app.id, "import", "https://other.example.com", nil)
+	if v, _ := sl.Call(thread, f, sl.Tuple{sl.String(other.ID), sl.String("page:Main")}, nil); v != sl.None {
+		t.Errorf("mapping leaked to another source: %v", v)
+	}
+
+	// Another app cannot use the job
+	if _, err := sl.Call(create_test_thread(user, create_external_app("feeds")), f, sl.Tuple{sl.String(j.ID), sl.String("page:Main")}, nil); err == nil {
+		t.Error("job usable by another app")
+	}
+}
+
+func TestImportHostLimit(t *testing.T) {
+	rate_limit_import.reset("import.example.com")
+	t.Cleanup(func() { rate_limit_import.reset("import.example.com") })
+	for i := 0; i < rate_limit_import.limit; i++ {
+		if !import_host_allow("https://IMPORT.example.com/page") {
+			t.Fatalf("fetch %d refused", i)
+		}
+	}
+	if import_host_allow("https://import.example.com/other") {
+		t.Error("fetch allowed over the host limit")
+	}
+	if import_host_allow("not a url") {
+		t.Error("fetch allowed without a host")
+	}
+}
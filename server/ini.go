@@ -8,6 +8,7 @@ package main
 
 import (
 	"core/common/ini"
+	"io"
 )
 
 func ini_bool(section string, key string, def bool) bool {
@@ -26,6 +27,10 @@ func ini_loaded() bool {
 	return ini.Loaded()
 }
 
+func ini_print(w io.Writer) error {
+	return ini.Print(w)
+}
+
 func ini_string(section string, key string, def string) string {
 	return ini.String(section, key, def)
 }
@@ -0,0 +1,357 @@
+// Mochi server: Invitations
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// An invite lets someone sign up while signup_enabled is off. Its code is
+// the invite's ID and an HMAC of the ID under the server's invite secret,
+// so a guessed or mistyped code is refused before the database is asked.
+// Administrators may invite with any role and any number of uses; other
+// users may invite up to invites_quota people, one each, with the role
+// "user". The Login app presents the code to POST /_/auth/invite, which
+// keeps it in the invite cookie; every signup path then admits the visitor
+// and redeems the invite, recording the inviter in the referrals table.
+
+const (
+	invite_id_length = 12
+	invite_columns   = "id, user, role, uses, maximum, expires, created, revoked"
+)
+
+// Invite is an invitation, without its code
+type Invite struct {
+	ID      string `db:"id"`
+	User    string `db:"user"`
+	Role    string `db:"role"`
+	Uses    int64  `db:"uses"`
+	Maximum int64  `db:"maximum"`
+	Expires int64  `db:"expires"`
+	Created int64  `db:"created"`
+	Revoked int64  `db:"revoked"`
+}
+
+var api_invite = sls.FromStringDict(sl.String("mochi.invite"), sl.StringDict{
+	"check":     sl.NewBuiltin("mochi.invite.check", api_invite_check),
+	"create":    sl.NewBuiltin("mochi.invite.create", api_invite_create),
+	"list":      sl.NewBuiltin("mochi.invite.list", api_invite_list),
+	"referrals": sl.NewBuiltin("mochi.invite.referrals", api_invite_referrals),
+	"revoke":    sl.NewBuiltin("mochi.invite.revoke", api_invite_revoke),
+})
+
+// invites_db opens the invitation database, creating its tables if needed
+func invites_db() *DB {
+	db := db_open("db/invites.db")
+	db.exec("create table if not exists invites (id text not null primary key, user text not null, role text not null default 'user', uses integer not null default 0, maximum integer not null default 1, expires integer not null default 0, created integer not null, revoked integer not null default 0)")
+	db.exec("create index if not exists invites_user on invites(user)")
+	db.exec("create table if not exists referrals (user text not null primary key, inviter text not null, invite text not null, created integer not null)")
+	db.exec("create index if not exists referrals_inviter on referrals(inviter)")
+	return db
+}
+
+// setting_invites_quota returns how many people a user who isn't an
+// administrator may invite
+func setting_invites_quota() int64 {
+	return atoi(setting_get("invites_quota", "0"), 0)
+}
+
+// invite_secret returns the key invite codes are signed with, creating it
+// on first use
+func invite_secret() string {
+	secret := setting_get("invite_secret", "")
+	if secret == "" {
+		secret = random_alphanumeric(32)
+		setting_set("invite_secret", secret)
+	}
+	return secret
+}
+
+// invite_signature returns the signature for an invite ID
+func invite_signature(id string) string {
+	mac := hmac.New(sha256.New, []byte(invite_secret()))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))[:20]
+}
+
+// code returns the invite's code
+func (i *Invite) code() string {
+	return i.ID + "-" + invite_signature(i.ID)
+}
+
+// active reports whether an invite may still be redeemed
+func (i *Invite) active() bool {
+	return i.Revoked == 0 && (i.Expires == 0 || i.Expires > now()) && (i.Maximum == 0 || i.Uses < i.Maximum)
+}
+
+// info returns the invite for an app. The code is included, as the
+// inviter may want to pass it on again.
+func (i *Invite) info() map[string]any {
+	return map[string]any{
+		"id":      i.ID,
+		"code":    i.code(),
+		"link":    "/login/?invite=" + i.code(),
+		"role":    i.Role,
+		"uses":    i.Uses,
+		"maximum": i.Maximum,
+		"expires": i.Expires,
+		"created": i.Created,
+		"revoked": i.Revoked,
+		"active":  i.active(),
+	}
+}
+
+// invite_create makes an invite from a user
+func invite_create(user, role string, maximum, expires int64) *Invite {
+	i := &Invite{ID: random_alphanumeric(invite_id_length), User: user, Role: role, Maximum: maximum, Expires: expires, Created: now()}
+	invites_db().exec("insert into invites (id, user, role, maximum, expires, created) values (?, ?, ?, ?, ?, ?)", i.ID, i.User, i.Role, i.Maximum, i.Expires, i.Created)
+	return i
+}
+
+// invite_get returns an invite by ID
+func invite_get(id string) *Invite {
+	var i Invite
+	if !invites_db().scan(&i, "select "+invite_columns+" from invites where id=?", id) {
+		return nil
+	}
+	return &i
+}
+
+// invite_check returns the active invite a code is for, or nil
+func invite_check(code string) *Invite {
+	id, signature, found := strings.Cut(strings.TrimSpace(code), "-")
+	if !found || len(id) != invite_id_length || !hmac.Equal([]byte(signature), []byte(invite_signature(id))) {
+		return nil
+	}
+	i := invite_get(id)
+	if i == nil || !i.active() {
+		return nil
+	}
+	return i
+}
+
+// invite_from_request returns the active invite presented by a visitor
+func invite_from_request(c *gin.Context) *Invite {
+	if c == nil {
+		return nil
+	}
+	code := web_cookie_get(c, "invite", "")
+	if code == "" {
+		return nil
+	}
+	return invite_check(code)
+}
+
+// signup_allowed reports whether a visitor may sign up: anyone may if
+// signup is enabled, and otherwise only with an invite
+func signup_allowed(c *gin.Context) bool {
+	return setting_signup_enabled() || invite_from_request(c) != nil
+}
+
+// invite_redeem uses the visitor's invite, if any, for a user who has just
+// signed up: the user takes the invite's role, unless they became the
+// first administrator, and the inviter is recorded as having referred them
+func invite_redeem(c *gin.Context, u *User) {
+	i := invite_from_request(c)
+	if i == nil || u == nil {
+		return
+	}
+	web_cookie_unset(c, "invite")
+
+	db := invites_db()
+	// Counted in the update itself, so a last use can't be taken twice
+	if r, _ := db.row("update invites set uses=uses+1 where id=? and revoked=0 and (maximum=0 or uses<maximum) returning id", i.ID); r == nil {
+		return
+	}
+	db.exec("insert or ignore into referrals (user, inviter, invite, created) values (?, ?, ?, ?)", u.UID, i.User, i.ID, now())
+	if i.Role != u.Role && u.Role != "administrator" {
+		db_open("db/users.db").exec("update users set role=? where uid=?", i.Role, u.UID)
+		u.Role = i.Role
+	}
+	info("User %q signed up with invite %q from %q", u.Username, i.ID, i.User)
+}
+
+// POST /_/auth/invite - Present an invite code before signing up
+func web_auth_invite(c *gin.Context) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Code == "" {
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+	i := invite_check(input.Code)
+	if i == nil {
+		respond_error(c, http.StatusNotFound, "invalid_invite", "errors.invalid_invite", nil)
+		return
+	}
+	web_cookie_set(c, "invite", i.code())
+
+	inviter := ""
+	if u := user_by_uid(i.User); u != nil && u.Identity != nil {
+		inviter = u.Identity.Name
+	}
+	c.JSON(http.StatusOK, gin.H{"role": i.Role, "expires": i.Expires, "inviter": inviter})
+}
+
+// mochi.invite.create(role?, uses?, expires?) -> dict: Create an invite.
+// Only administrators, through an app granted users/invite, may choose a role
+// other than "user" or a number of uses other than 1, where 0 is unlimited. expires is a Unix timestamp, or
+// 0 for never. Returns the invite, including its code and login link.
+func api_invite_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	role := "user"
+	uses := 1
+	var expires int
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "role?", &role, "uses?", &uses, "expires?", &expires); err != nil {
+		return nil, err
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil || user_guest(user) {
+		return sl_error(fn, "no user")
+	}
+	if role != "user" && role != "administrator" {
+		return sl_error(fn, "invalid role")
+	}
+	if uses < 0 {
+		return sl_error(fn, "invalid uses")
+	}
+	if expires != 0 && int64(expires) <= now() {
+		return sl_error(fn, "expiry is in the past")
+	}
+
+	if role != "user" || uses != 1 {
+		if err := require_permission(t, fn, "users/invite"); err != nil {
+			return sl_error(fn, "%v", err)
+		}
+	} else if !user.administrator() {
+		used := invites_db().integer64("select count(*) from invites where user=? and revoked=0", user.UID)
+		if used >= setting_invites_quota() {
+			return sl_error(fn, "invite quota reached")
+		}
+	}
+
+	i := invite_create(user.UID, role, int64(uses), int64(expires))
+	return sl_encode(i.info()), nil
+}
+
+// mochi.invite.list(all?) -> list: List the user's invites, newest first.
+// Administrators may list everyone's with all=True, through an app granted
+// users/read.
+func api_invite_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var all bool
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "all?", &all); err != nil {
+		return nil, err
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	if all {
+		if err := require_permission(t, fn, "users/read"); err != nil {
+			return sl_error(fn, "%v", err)
+		}
+	}
+
+	var invites []Invite
+	var err error
+	if all {
+		err = invites_db().scans(&invites, "select "+invite_columns+" from invites order by created desc")
+	} else {
+		err = invites_db().scans(&invites, "select "+invite_columns+" from invites where user=? order by created desc", user.UID)
+	}
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+
+	results := make([]any, len(invites))
+	for n := range invites {
+		info := invites[n].info()
+		if all {
+			info["user"] = invites[n].User
+		}
+		results[n] = info
+	}
+	return sl_encode(results), nil
+}
+
+// mochi.invite.revoke(id) -> bool: Revoke one of the user's invites, or
+// anyone's for an administrator. Returns False if it was already revoked.
+func api_invite_revoke(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	i := invite_get(id)
+	if i == nil || (i.User != user.UID && !user.administrator()) {
+		return sl_error(fn, "invite not found")
+	}
+	if i.Revoked != 0 {
+		return sl.False, nil
+	}
+	invites_db().exec("update invites set revoked=? where id=?", now(), id)
+	return sl.True, nil
+}
+
+// mochi.invite.check(code) -> dict or None: Get the role and expiry of the
+// invite a code is for, or None if it isn't valid
+func api_invite_check(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var code string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "code", &code); err != nil {
+		return nil, err
+	}
+	i := invite_check(code)
+	if i == nil {
+		return sl.None, nil
+	}
+	return sl_encode(map[string]any{"role": i.Role, "expires": i.Expires}), nil
+}
+
+// mochi.invite.referrals() -> list: List the people the user has invited
+// who signed up, newest first. Each is a dict of user, username, invite
+// and created.
+func api_invite_referrals(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	if err := require_permission(t, fn, "users/read"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	rows, err := invites_db().rows("select user, invite, created from referrals where inviter=? order by created desc", user.UID)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	for _, r := range rows {
+		username := ""
+		if id, _ := r["user"].(string); id != "" {
+			if u := user_by_uid(id); u != nil {
+				username = u.Username
+			}
+		}
+		r["username"] = username
+	}
+	return sl_encode(rows), nil
+}
@@ -0,0 +1,136 @@
+// Mochi server: Invitation tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+// invite_test_request builds a request context presenting an invite code
+func invite_test_request(code string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/_/auth/verify", nil)
+	if code != "" {
+		c.Request.AddCookie(&http.Cookie{Name: "invite", Value: code})
+	}
+	return c, w
+}
+
+func TestInviteCheck(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	i := invite_create("u1", "user", 1, 0)
+	if got := invite_check(i.code()); got == nil || got.ID != i.ID {
+		t.Fatalf("valid code refused: %v", got)
+	}
+	if invite_check(i.ID+"-"+strings.Repeat("0", 20)) != nil {
+		t.Error("code with a forged signature accepted")
+	}
+	if invite_check(i.ID) != nil || invite_check("") != nil {
+		t.Error("code without a signature accepted")
+	}
+
+	expired := invite_create("u1", "user", 1, now()-1)
+	if invite_check(expired.code()) != nil {
+		t.Error("expired invite accepted")
+	}
+	revoked := invite_create("u1", "user", 1, 0)
+	invites_db().exec("update invites set revoked=? where id=?", now(), revoked.ID)
+	if invite_check(revoked.code()) != nil {
+		t.Error("revoked invite accepted")
+	}
+}
+
+func TestInviteSignup(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	setting_set("signup_enabled", "false")
+
+	admin, _ := user_create("admin@example.com")
+	i := invite_create(admin.UID, "administrator", 1, 0)
+
+	if c, _ := invite_test_request(""); signup_allowed(c) {
+		t.Error("signup allowed without an invite")
+	}
+	c, w := invite_test_request(i.code())
+	if !signup_allowed(c) {
+		t.Fatal("signup refused with an invite")
+	}
+
+	user, _ := user_create("invited@example.com")
+	invite_redeem(c, user)
+	if user.Role != "administrator" || user_by_username("invited@example.com").Role != "administrator" {
+		t.Errorf("invited role %q, want the invite's", user.Role)
+	}
+	if inviter := invites_db().integer("select count(*) from referrals where user=? and inviter=?", user.UID, admin.UID); inviter != 1 {
+		t.Error("referral not recorded")
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), "invite=;") {
+		t.Error("invite cookie not cleared")
+	}
+
+	// The only use is taken, so the invite lets nobody else in
+	c, _ = invite_test_request(i.code())
+	if signup_allowed(c) {
+		t.Error("used invite still allows signup")
+	}
+}
+
+func TestInviteQuota(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	user := create_permission_test_user(t, "u1")
+	app := create_external_app("invites-test")
+	thread := create_test_thread(user, app)
+	create := sl.NewBuiltin("mochi.invite.create", api_invite_create)
+
+	if _, err := api_invite_create(thread, create, nil, nil); err == nil {
+		t.Error("invite created without a quota")
+	}
+	setting_set("invites_quota", "1")
+	if _, err := api_invite_create(thread, create, nil, []sl.Tuple{{sl.String("role"), sl.String("administrator")}}); err == nil {
+		t.Error("user invited an administrator")
+	}
+	if _, err := api_invite_create(thread, create, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api_invite_create(thread, create, nil, nil); err == nil {
+		t.Error("invite created beyond the quota")
+	}
+
+	admin := create_test_admin(t, "a1")
+	thread.SetLocal("user", admin)
+	unlimited := []sl.Tuple{{sl.String("uses"), sl.MakeInt(0)}}
+	if _, err := api_invite_create(thread, create, nil, unlimited); err == nil {
+		t.Error("unlimited invite created without users/invite")
+	}
+	permission_grant(admin, app.id, "users/invite")
+	if _, err := api_invite_create(thread, create, nil, unlimited); err != nil {
+		t.Errorf("administrator refused an unlimited invite: %v", err)
+	}
+
+	list := sl.NewBuiltin("mochi.invite.list", api_invite_list)
+	if _, err := api_invite_list(thread, list, nil, []sl.Tuple{{sl.String("all"), sl.True}}); err == nil {
+		t.Error("all invites listed without users/read")
+	}
+	referrals := sl.NewBuiltin("mochi.invite.referrals", api_invite_referrals)
+	if _, err := api_invite_referrals(thread, referrals, nil, nil); err == nil {
+		t.Error("referrals listed without users/read")
+	}
+}
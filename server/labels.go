@@ -15,6 +15,7 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gotnospirit/makeplural/plural"
 	"github.com/gotnospirit/messageformat"
 	"gopkg.in/ini.v1"
 )
@@ -63,7 +64,7 @@ var variant_redirects = map[string]string{
 //	"fr"         -> ["fr", "en"]
 //	"en"         -> ["en"]
 func language_fallbacks(lang string) []string {
-	lang = strings.ToLower(strings.TrimSpace(lang))
+	lang = language_normalize(lang)
 	if lang == "" || lang == "en" {
 		return []string{"en"}
 	}
@@ -87,6 +88,17 @@ func language_fallbacks(lang string) []string {
 	return chain
 }
 
+// language_normalize brings a tag from a labels file name, cookie, header or
+// preference into the lowercase hyphenated form catalogs are keyed by. POSIX
+// locale names are accepted too, so "pt_BR.UTF-8" and "pt-BR" are "pt-br".
+func language_normalize(lang string) string {
+	lang = strings.TrimSpace(lang)
+	if i := strings.IndexAny(lang, ".@"); i >= 0 {
+		lang = lang[:i]
+	}
+	return strings.ToLower(strings.ReplaceAll(lang, "_", "-"))
+}
+
 // strip_subtag removes the final hyphen-separated subtag.
 // "zh-hant-hk" -> "zh-hant" -> "zh" -> ""
 func strip_subtag(lang string) string {
@@ -108,6 +120,52 @@ func plural_locale(lang string) string {
 	return lang
 }
 
+// plural_category returns the CLDR plural category ("zero", "one", "two",
+// "few", "many" or "other") of a count in a language. Languages missing from
+// makeplural's table use the English rules.
+func plural_category(lang string, count any) string {
+	count = normalize_args(map[string]any{"count": count})["count"]
+	fn, err := plural.GetFunc(plural_locale(lang))
+	if err != nil {
+		fn, _ = plural.GetFunc("en")
+	}
+	return fn(count, false)
+}
+
+// label_keys returns the keys to try for a label in one catalog. With a
+// count in args, the form for the count's plural category comes first
+// ("files.few"), then "files.other", then the bare key, so catalogs can give
+// languages with more plural forms than English their own keys without the
+// English catalog having to carry them.
+func label_keys(tag, key string, args map[string]any) []string {
+	count, found := args["count"]
+	if !found {
+		return []string{key}
+	}
+	keys := []string{key + "." + plural_category(tag, count)}
+	if keys[0] != key+".other" {
+		keys = append(keys, key+".other")
+	}
+	return append(keys, key)
+}
+
+// label_find walks the fallback chain across a set of catalogs and returns
+// the first matching format, and the tag of the catalog it came from.
+func label_find(catalogs map[string]map[string]string, language, key string, args map[string]any) (string, string) {
+	for _, tag := range language_fallbacks(language) {
+		labels := catalogs[tag]
+		if labels == nil {
+			continue
+		}
+		for _, k := range label_keys(tag, key, args) {
+			if format := labels[k]; format != "" {
+				return format, tag
+			}
+		}
+	}
+	return "", ""
+}
+
 // format_message applies ICU MessageFormat substitution to a label format
 // string. If args is nil/empty or the format has no placeholders, returns the
 // format unchanged. Errors are logged and the unformatted format string is
@@ -189,7 +247,7 @@ func parse_accept_language(header string) []string {
 	var entries []entry
 	for _, raw := range strings.Split(header, ",") {
 		parts := strings.SplitN(strings.TrimSpace(raw), ";", 2)
-		tag := strings.ToLower(strings.TrimSpace(parts[0]))
+		tag := language_normalize(parts[0])
 		if tag == "" || tag == "*" {
 			continue
 		}
@@ -232,23 +290,18 @@ func parse_accept_language(header string) []string {
 // have no `c`, but they still need a sensible language for label lookup —
 // they read this preference via user_language(u).
 func request_language(c *gin.Context, u *User) string {
-	pref := ""
 	if u != nil {
 		// "auto" is the explicit "detect from browser" option in the settings
 		// picker — treated as if no preference were set, falling through to
 		// the cookie / Accept-Language chain below.
-		pref = strings.ToLower(user_preference_get(u, "language", ""))
-		if pref != "" && pref != "auto" {
+		if pref := user_preference_language(u); pref != "" {
 			return pref
 		}
 	}
 	resolved := "en"
 	if c != nil {
-		if cookie, err := c.Cookie("mochi_language"); err == nil && cookie != "" {
-			tag := strings.ToLower(cookie)
-			if valid(tag, "locale") {
-				resolved = tag
-			}
+		if cookie := request_cookie_language(c); cookie != "" {
+			resolved = cookie
 		}
 		if resolved == "en" {
 			tags := parse_accept_language(c.GetHeader("Accept-Language"))
@@ -261,13 +314,57 @@ func request_language(c *gin.Context, u *User) string {
 	// actually changes — `user_preference_set` is a per-user-DB write, not
 	// free, so don't pay it on every request.
 	if u != nil {
-		if last := strings.ToLower(user_preference_get(u, "last_language", "")); last != resolved {
+		if last := language_normalize(user_preference_get(u, "last_language", "")); last != resolved {
 			user_preference_set(u, "last_language", resolved)
 		}
 	}
 	return resolved
 }
 
+// request_languages returns every language a request would accept, most
+// preferred first, for negotiating against one app's catalogs rather than
+// the union request_language picks from. A user's explicit preference is
+// the only entry; otherwise the cookie comes first, then Accept-Language.
+func request_languages(c *gin.Context, u *User) []string {
+	if u != nil {
+		if pref := user_preference_language(u); pref != "" {
+			return []string{pref}
+		}
+	}
+	if c == nil {
+		return nil
+	}
+	var tags []string
+	if cookie := request_cookie_language(c); cookie != "" {
+		tags = append(tags, cookie)
+	}
+	return append(tags, parse_accept_language(c.GetHeader("Accept-Language"))...)
+}
+
+// user_preference_language returns a user's explicit language preference,
+// or "" if they have none or chose "auto"
+func user_preference_language(u *User) string {
+	pref := language_normalize(user_preference_get(u, "language", ""))
+	if pref == "auto" {
+		return ""
+	}
+	return pref
+}
+
+// request_cookie_language returns the valid language in the request's
+// `mochi_language` cookie, or ""
+func request_cookie_language(c *gin.Context) string {
+	cookie, err := c.Cookie("mochi_language")
+	if err != nil {
+		return ""
+	}
+	tag := language_normalize(cookie)
+	if !valid(tag, "locale") {
+		return ""
+	}
+	return tag
+}
+
 // user_language resolves a language for an async caller that has no
 // gin.Context — email/push notification composers, queued jobs. Priority:
 //  1. The user's stored `language` preference (skips the "auto" sentinel).
@@ -278,10 +375,10 @@ func user_language(u *User) string {
 	if u == nil {
 		return "en"
 	}
-	if lang := strings.ToLower(user_preference_get(u, "language", "")); lang != "" && lang != "auto" {
+	if lang := user_preference_language(u); lang != "" {
 		return lang
 	}
-	if last := strings.ToLower(user_preference_get(u, "last_language", "")); last != "" {
+	if last := language_normalize(user_preference_get(u, "last_language", "")); last != "" {
 		return last
 	}
 	return "en"
@@ -302,9 +399,24 @@ func negotiate_language(tags []string) string {
 	for _, tag := range installed_languages() {
 		installed[tag] = struct{}{}
 	}
+	return negotiate_catalog(tags, func(tag string) bool {
+		_, ok := installed[tag]
+		return ok
+	})
+}
+
+// negotiate_catalog picks the first tag, or a parent of it, for which
+// installed is true. The trailing "en" of each chain is only a match for
+// English tags; every other tag's chain stops short of it so later, lower-q
+// tags get their turn before English is settled on.
+func negotiate_catalog(tags []string, installed func(string) bool) string {
 	for _, tag := range tags {
+		english := plural_locale(language_normalize(tag)) == "en"
 		for _, candidate := range language_fallbacks(tag) {
-			if _, ok := installed[candidate]; ok {
+			if candidate == "en" && !english {
+				break
+			}
+			if installed(candidate) {
 				return candidate
 			}
 		}
@@ -384,22 +496,15 @@ func web_serve_labels(c *gin.Context, av *AppVersion, suffix string) bool {
 }
 
 // resolve_label walks the fallback chain and returns the first matching label,
-// substituted with args via MessageFormat. Returns the literal key if nothing
-// resolves (developer bug — log it).
+// substituted with args via MessageFormat. With a count in args, the key's
+// plural forms are tried before the key itself; see label_keys. Returns the
+// literal key if nothing resolves (developer bug — log it).
 func resolve_label(av *AppVersion, language, key string, args map[string]any) string {
 	if av == nil || av.labels == nil {
 		return key
 	}
 
-	for _, tag := range language_fallbacks(language) {
-		labels := av.labels[tag]
-		if labels == nil {
-			continue
-		}
-		format := labels[key]
-		if format == "" {
-			continue
-		}
+	if format, tag := label_find(av.labels, language, key, args); format != "" {
 		return format_message(format, tag, args)
 	}
 
@@ -407,19 +512,29 @@ func resolve_label(av *AppVersion, language, key string, args map[string]any) st
 	return key
 }
 
+// app_language picks the language an app's labels are resolved in: the
+// first of the languages a request accepts that the app has a catalog for,
+// else the language the request or user resolved to
+func app_language(av *AppVersion, languages []string, language string) string {
+	if av != nil {
+		pick := negotiate_catalog(languages, func(tag string) bool {
+			return av.labels[tag] != nil
+		})
+		if pick != "" {
+			return pick
+		}
+	}
+	if language == "" {
+		return "en"
+	}
+	return language
+}
+
 // resolve_core_label walks the fallback chain across core_labels and returns
 // the first matching label, substituted with args. Returns the literal key
 // if nothing resolves.
 func resolve_core_label(language, key string, args map[string]any) string {
-	for _, tag := range language_fallbacks(language) {
-		labels := core_labels[tag]
-		if labels == nil {
-			continue
-		}
-		format := labels[key]
-		if format == "" {
-			continue
-		}
+	if format, tag := label_find(core_labels, language, key, args); format != "" {
 		return format_message(format, tag, args)
 	}
 	info("Core label %q in language %q not set", key, language)
@@ -438,7 +553,7 @@ func load_core_labels() {
 		if ent.IsDir() || !strings.HasSuffix(ent.Name(), ".conf") {
 			continue
 		}
-		tag := strings.ToLower(strings.TrimSuffix(ent.Name(), ".conf"))
+		tag := language_normalize(strings.TrimSuffix(ent.Name(), ".conf"))
 		if !valid(tag, "locale") {
 			info("Core labels: skipping %q (invalid locale tag)", ent.Name())
 			continue
@@ -448,7 +563,9 @@ func load_core_labels() {
 			info("Core labels: cannot read %q: %v", ent.Name(), err)
 			continue
 		}
-		cfg, err := ini.Load(data)
+		// Values are MessageFormat, where "#" is the plural count, and prose,
+		// where ";" is punctuation, so neither starts a comment
+		cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, data)
 		if err != nil {
 			info("Core labels: cannot parse %q: %v", ent.Name(), err)
 			continue
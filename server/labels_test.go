@@ -26,6 +26,7 @@ func TestParseAcceptLanguage(t *testing.T) {
 		{"wildcard dropped", "*,en;q=0.5", []string{"en"}},
 		{"whitespace tolerated", " fr , en ; q=0.8 ", []string{"fr", "en"}},
 		{"malformed q ignored treated as 1", "fr;q=invalid,en;q=0.5", []string{"fr", "en"}},
+		{"posix form normalised", "pt_BR", []string{"pt-br"}},
 	}
 
 	for _, tt := range tests {
@@ -48,6 +49,7 @@ func TestLanguageFallbacks(t *testing.T) {
 		{"en", []string{"en"}},
 		{"EN", []string{"en"}}, // normalised to lowercase
 		{" en ", []string{"en"}},
+		{"pt_BR.UTF-8", []string{"pt-br", "pt", "en"}}, // POSIX locale name
 
 		// English variants -> en directly (source is Commonwealth-flavoured)
 		{"en-gb", []string{"en-gb", "en"}},
@@ -153,3 +155,69 @@ func TestFormatMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestNegotiateCatalog(t *testing.T) {
+	installed := map[string]bool{"en": true, "fr": true, "pt": true, "zh-hant": true}
+	has := func(tag string) bool { return installed[tag] }
+	tests := []struct {
+		tags     []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"pt-br"}, "pt"},
+		{[]string{"zz", "fr"}, "fr"},
+		{[]string{"de", "fr"}, "fr"},
+		{[]string{"de"}, ""},
+		{[]string{"en-gb", "fr"}, "en"},
+		{[]string{"zh-hk"}, "zh-hant"},
+	}
+	for _, tt := range tests {
+		if got := negotiate_catalog(tt.tags, has); got != tt.expected {
+			t.Errorf("negotiate_catalog(%v) = %q, want %q", tt.tags, got, tt.expected)
+		}
+	}
+}
+
+func TestResolveLabelPlural(t *testing.T) {
+	av := &AppVersion{labels: map[string]map[string]string{
+		"en": {
+			"files.one":   "{count} file",
+			"files.other": "{count} files",
+			"greeting":    "Hello, {name}",
+		},
+		"ru": {
+			"files.one":  "{count} файл",
+			"files.few":  "{count} файла",
+			"files.many": "{count} файлов",
+		},
+		"pt": {"greeting": "Olá, {name}"},
+	}}
+	tests := []struct {
+		language string
+		key      string
+		args     map[string]any
+		expected string
+	}{
+		{"en", "files", map[string]any{"count": int64(1)}, "1 file"},
+		{"en", "files", map[string]any{"count": int64(3)}, "3 files"},
+		{"ru", "files", map[string]any{"count": int64(21)}, "21 файл"},
+		{"ru", "files", map[string]any{"count": int64(3)}, "3 файла"},
+		{"ru", "files", map[string]any{"count": int64(5)}, "5 файлов"},
+		{"ru", "files", map[string]any{"count": 1.5}, "1.5 files"}, // "other" falls back to en
+		{"pt-br", "greeting", map[string]any{"name": "Ana"}, "Olá, Ana"},
+		{"pt-br", "greeting", map[string]any{"name": "Ana", "count": int64(2)}, "Olá, Ana"},
+		{"de", "greeting", map[string]any{"name": "Ana"}, "Hello, Ana"},
+	}
+	for _, tt := range tests {
+		if got := resolve_label(av, tt.language, tt.key, tt.args); got != tt.expected {
+			t.Errorf("resolve_label(%q, %q, %v) = %q, want %q", tt.language, tt.key, tt.args, got, tt.expected)
+		}
+	}
+
+	if got := app_language(av, []string{"de", "pt-br"}, "de"); got != "pt" {
+		t.Errorf("app_language = %q, want pt", got)
+	}
+	if got := app_language(av, []string{"de"}, "de"); got != "de" {
+		t.Errorf("app_language without a catalog = %q, want de", got)
+	}
+}
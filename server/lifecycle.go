@@ -0,0 +1,244 @@
+// Mochi server: User lifecycle
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+// An administrator suspends a user with mochi.user.suspend(). The user's
+// status in users.db becomes "suspended", which everything else keys off:
+// their sessions are revoked and they can't sign in; events for their
+// entities are refused as transient, so senders hold and retry them; their
+// own outbound messages are held in queue.db (status='held', outside every
+// claim path); and their entities' pages serve a suspension notice instead
+// of the app. mochi.user.activate() reverses all of it.
+//
+// mochi.user.offboard() also suspends the user, and schedules them for
+// deletion once a grace period has passed. Given a passphrase, it first
+// exports the account to data_dir/retention/<uid>/, where the bundle is
+// kept for [account] retention days after the user is deleted, so it can
+// be handed back or restored. Reactivating the user during the grace period
+// cancels the deletion.
+
+// users_suspended holds the entities of suspended users, for the checks
+// on the message paths
+var (
+	users_suspended        = map[string]bool{}
+	users_suspended_loaded bool
+	users_suspended_lock   sync.Mutex
+)
+
+// users_suspended_load reloads the entities of suspended users
+func users_suspended_load() {
+	rows, _ := db_open("db/users.db").rows("select e.id from entities e join users u on u.uid=e.user where u.status='suspended'")
+	entities := make(map[string]bool, len(rows))
+	for _, r := range rows {
+		if id, _ := r["id"].(string); id != "" {
+			entities[id] = true
+		}
+	}
+	users_suspended_lock.Lock()
+	users_suspended = entities
+	users_suspended_loaded = true
+	users_suspended_lock.Unlock()
+}
+
+// entity_suspended reports whether an entity belongs to a suspended user
+func entity_suspended(id string) bool {
+	if id == "" {
+		return false
+	}
+	users_suspended_lock.Lock()
+	loaded := users_suspended_loaded
+	users_suspended_lock.Unlock()
+	if !loaded {
+		users_suspended_load()
+	}
+	users_suspended_lock.Lock()
+	defer users_suspended_lock.Unlock()
+	return users_suspended[id]
+}
+
+// user_entities returns the IDs of a user's entities
+func user_entities(uid string) []string {
+	rows, _ := db_open("db/users.db").rows("select id from entities where user=?", uid)
+	ids := make([]string, 0, len(rows))
+	for _, r := range rows {
+		if id, _ := r["id"].(string); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// user_suspend suspends a user, revoking their sessions and holding their
+// queued messages
+func user_suspend(uid string) {
+	db_open("db/users.db").exec("update users set status='suspended' where uid=?", uid)
+	sessions_revoke_all(uid)
+	users_suspended_load()
+	queue := db_open("db/queue.db")
+	for _, id := range user_entities(uid) {
+		queue.exec("update queue set status='held' where from_entity=? and status in ('pending', 'scheduled')", id)
+	}
+}
+
+// user_reactivate makes a user active again, cancelling any scheduled
+// deletion and releasing their held messages
+func user_reactivate(uid string) {
+	db_open("db/users.db").exec("update users set status='active', purge=0 where uid=?", uid)
+	users_suspended_load()
+	compliance_cancel(uid)
+	// Released as scheduled, so due rows go out on the next queue tick
+	// and the rest keep their delivery time
+	queue := db_open("db/queue.db")
+	for _, id := range user_entities(uid) {
+		queue.exec("update queue set status='scheduled' where from_entity=? and status='held'", id)
+	}
+	queue_wake()
+}
+
+// user_offboard suspends a user and schedules their deletion in days days,
+// first exporting the account if a passphrase is given. Returns the purge
+// timestamp and the path of the export, relative to the data directory.
+func user_offboard(uid string, days int, passphrase string) (int64, string, error) {
+	if days < 1 {
+		days = account_closing_days()
+	}
+	export := ""
+	if passphrase != "" {
+		dir := filepath.Join(data_dir, "retention", uid)
+		path, err := user_export_to(uid, passphrase, "", dir)
+		if err != nil {
+			return 0, "", fmt.Errorf("export failed: %v", err)
+		}
+		export, _ = filepath.Rel(data_dir, path)
+		export = filepath.ToSlash(export)
+	}
+
+	purge := now() + int64(days)*86400
+	user_suspend(uid)
+	db_open("db/users.db").exec("update users set purge=? where uid=?", purge, uid)
+	return purge, export, nil
+}
+
+// account_retention_days is how long, in days, the export made when a user
+// is offboarded is kept after they are deleted. Operator-tunable via
+// [account] retention; 0 deletes it along with the account.
+func account_retention_days() int {
+	days := ini_int("account", "retention", 90)
+	if days < 0 {
+		days = 0
+	}
+	return days
+}
+
+// retention_prune deletes the offboarding exports of users deleted more
+// than the retention period ago, and of users since reactivated. The
+// directory's modification time is when its user was deleted; see
+// retention_mark.
+func retention_prune(t int64) {
+	root := filepath.Join(data_dir, "retention")
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	cutoff := t - int64(account_retention_days())*86400
+	udb := db_open("db/users.db")
+	for _, e := range entries {
+		dir := filepath.Join(root, e.Name())
+		r, _ := udb.row("select status from users where uid=?", e.Name())
+		if r != nil {
+			if r["status"] == "active" {
+				os.RemoveAll(dir)
+			}
+			continue
+		}
+		if stat, err := e.Info(); err == nil && stat.ModTime().Unix() <= cutoff {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// retention_mark starts the retention period of a deleted user's export
+func retention_mark(uid string) {
+	dir := filepath.Join(data_dir, "retention", uid)
+	if file_exists(dir) {
+		t := time.Now()
+		os.Chtimes(dir, t, t)
+	}
+}
+
+// web_suspended_notice tells a visitor that the owner of the entity they
+// asked for is suspended. Browsers get a page; everything else an error.
+func web_suspended_notice(c *gin.Context) {
+	accept := c.GetHeader("Accept")
+	if !strings.Contains(accept, "text/html") || strings.Contains(accept, "application/json") {
+		respond_error(c, http.StatusForbidden, "entity_suspended", "errors.entity_suspended", nil)
+		return
+	}
+	lang := request_language(c, nil)
+	heading := html.EscapeString(resolve_core_label(lang, "suspended.heading", nil))
+	body := html.EscapeString(resolve_core_label(lang, "suspended.body", nil))
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusForbidden, "text/html; charset=utf-8", []byte("<!doctype html><meta charset=utf-8><meta name=viewport content=\"width=device-width, initial-scale=1\"><title>"+heading+"</title><h1>"+heading+"</h1><p>"+body+"</p>"))
+	c.Abort()
+}
+
+// mochi.user.offboard(id, days?, passphrase?) -> dict: Suspend a user and
+// delete them once days days have passed, [account] closing by default.
+// With a passphrase the account is exported first, and the bundle kept for
+// [account] retention days. Returns a dict of purge, the Unix timestamp the
+// user will be deleted, and export, the bundle's path relative to the data
+// directory or "" (admin only).
+func api_user_offboard(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, passphrase string
+	var days int
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "days?", &days, "passphrase?", &passphrase); err != nil {
+		return nil, err
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	if !user.administrator() {
+		return sl_error(fn, "not administrator")
+	}
+	if id == user.UID {
+		return sl_error(fn, "cannot offboard self")
+	}
+	if days < 0 {
+		return sl_error(fn, "invalid days")
+	}
+
+	var target User
+	if !db_open("db/users.db").scan(&target, "select uid, username, role, methods, disabled, status from users where uid=?", id) {
+		return sl_error(fn, "user not found")
+	}
+	if target.Status != "active" && target.Status != "suspended" {
+		return sl_error(fn, "user is %s", target.Status)
+	}
+
+	purge, export, err := user_offboard(id, days, passphrase)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	audit_user_offboarded(user.Username, target.Username, purge)
+	return sl_encode(map[string]any{"purge": purge, "export": export}), nil
+}
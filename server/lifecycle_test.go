@@ -0,0 +1,134 @@
+// Mochi server: User lifecycle tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lifecycle_test_user creates a user with an identity and a session
+func lifecycle_test_user(t *testing.T, username string) (*User, *Entity) {
+	t.Helper()
+	u, _ := user_create(username)
+	e, err := entity_create(u, "person", "Member", "public", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	login_create(u.UID, "192.0.2.1", "test")
+	return u, e
+}
+
+func lifecycle_test_status(t *testing.T, id string) string {
+	t.Helper()
+	r, _ := db_open("db/queue.db").row("select status from queue where id=?", id)
+	if r == nil {
+		return ""
+	}
+	status, _ := r["status"].(string)
+	return status
+}
+
+func TestUserSuspend(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	u, e := lifecycle_test_user(t, "member@example.com")
+	queue_add_direct("before", "peer-A", e.ID, "", "test", "msg", "", nil, nil, nil, "", 0)
+
+	user_suspend(u.UID)
+	if n := db_open("db/sessions.db").integer("select count(*) from sessions where user=?", u.UID); n != 0 {
+		t.Errorf("%d sessions left", n)
+	}
+	if !entity_suspended(e.ID) {
+		t.Error("entity not suspended")
+	}
+	if got := lifecycle_test_status(t, "before"); got != "held" {
+		t.Errorf("queued message %q, want held", got)
+	}
+	queue_add_direct("during", "peer-A", e.ID, "", "test", "msg", "", nil, nil, nil, "", 0)
+	if got := lifecycle_test_status(t, "during"); got != "held" {
+		t.Errorf("message queued while suspended %q, want held", got)
+	}
+
+	ev := &Event{to: e.ID, service: "test", event: "msg"}
+	if err := ev.route(); err == nil || !strings.HasPrefix(err.Error(), "suspended user") {
+		t.Errorf("event to suspended user routed: %v", err)
+	}
+
+	user_reactivate(u.UID)
+	if entity_suspended(e.ID) {
+		t.Error("entity still suspended")
+	}
+	if got := lifecycle_test_status(t, "during"); got != "scheduled" {
+		t.Errorf("released message %q, want scheduled", got)
+	}
+}
+
+func TestUserOffboard(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	lifecycle_test_user(t, "admin@example.com")
+	u, _ := lifecycle_test_user(t, "leaving@example.com")
+	purge, export, err := user_offboard(u.UID, 7, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purge < now()+7*86400-5 || !strings.HasPrefix(export, "retention/"+u.UID+"/") || !file_exists(filepath.Join(data_dir, export)) {
+		t.Fatalf("offboard purge %d, export %q", purge, export)
+	}
+	if r, _ := db_open("db/users.db").row("select status from users where uid=?", u.UID); r == nil || r["status"] != "suspended" {
+		t.Errorf("offboarded user %v", r)
+	}
+
+	// Not yet due
+	closure_run_due(purge - 1)
+	if exists, _ := db_open("db/users.db").exists("select 1 from users where uid=?", u.UID); !exists {
+		t.Fatal("user deleted before the grace period ended")
+	}
+
+	// Due, with the export kept for a day after deletion
+	t.Setenv("MOCHI_ACCOUNT_RETENTION", "1")
+	db_open("db/users.db").exec("update users set purge=? where uid=?", now()-1, u.UID)
+	closure_run_due(now())
+	if exists, _ := db_open("db/users.db").exists("select 1 from users where uid=?", u.UID); exists {
+		t.Fatal("user not deleted")
+	}
+	if !file_exists(filepath.Join(data_dir, export)) {
+		t.Fatal("export deleted with the user")
+	}
+
+	retention_prune(now() + 86400)
+	if file_exists(filepath.Join(data_dir, "retention", u.UID)) {
+		t.Error("export kept past the retention period")
+	}
+}
+
+func TestRetentionReactivated(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	u, _ := lifecycle_test_user(t, "member@example.com")
+	dir := filepath.Join(data_dir, "retention", u.UID)
+	os.MkdirAll(dir, 0700)
+	user_suspend(u.UID)
+	retention_prune(now())
+	if !file_exists(dir) {
+		t.Fatal("export of suspended user deleted")
+	}
+	user_reactivate(u.UID)
+	retention_prune(now())
+	if file_exists(dir) {
+		t.Error("export of reactivated user kept")
+	}
+}
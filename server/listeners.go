@@ -0,0 +1,357 @@
+// Mochi server: Web listeners
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/netutil"
+)
+
+// The web server listens on each entry of [web] bind, a comma-separated
+// list of listeners:
+//
+//	http://[::]:80            plain HTTP, on every IPv6 and IPv4 interface
+//	http://0.0.0.0:80?redirect=true
+//	                          redirect to HTTPS, answering ACME challenges
+//	https://192.0.2.1:443     HTTPS with certificates from the Domains UI
+//	https://[::1]:8443?cert=/etc/ssl/web.pem&key=/etc/ssl/web.key&min=1.3
+//	                          HTTPS with a fixed certificate
+//	unix:/run/mochi/web.sock?mode=0660
+//	                          plain HTTP on a socket, for a reverse proxy
+//
+// Without [web] bind, the listeners are built from [web] ports and
+// [web] listen as before: each port on each listen address, with 443
+// serving HTTPS and implying a redirecting listener on 80. Every entry is
+// checked at startup, and the ones that can't be used are reported and
+// skipped rather than stopping the server.
+
+type web_listener struct {
+	scheme   string      // "http", "https" or "unix"
+	address  string      // host:port, or the socket's path
+	redirect bool        // http: redirect to HTTPS
+	cert     string      // https: fixed certificate, instead of managed ones
+	key      string      // https: the fixed certificate's key
+	min      uint16      // https: lowest TLS version accepted
+	mode     os.FileMode // unix: socket permissions
+}
+
+// String describes a listener for the log
+func (l web_listener) String() string {
+	switch {
+	case l.scheme == "unix":
+		return "unix:" + l.address
+	case l.redirect:
+		return "http://" + l.address + " (redirecting to HTTPS)"
+	case l.cert != "":
+		return "https://" + l.address + " (certificate " + l.cert + ")"
+	}
+	return l.scheme + "://" + l.address
+}
+
+// port returns the listener's TCP port, or "" for a socket
+func (l web_listener) port() string {
+	if l.scheme == "unix" {
+		return ""
+	}
+	_, port, _ := net.SplitHostPort(l.address)
+	return port
+}
+
+// managed returns whether the listener serves certificates from the Domains UI
+func (l web_listener) managed() bool {
+	return l.scheme == "https" && l.cert == ""
+}
+
+// web_listener_parse reads one [web] bind entry
+func web_listener_parse(spec string) (web_listener, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return web_listener{}, fmt.Errorf("%q is not a listener: %v", spec, err)
+	}
+	l := web_listener{scheme: u.Scheme}
+	query := u.Query()
+	known := map[string]bool{}
+
+	switch u.Scheme {
+	case "http", "https":
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return l, fmt.Errorf("%q needs an address and port: %v", spec, err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return l, fmt.Errorf("%q has invalid port %q", spec, port)
+		}
+		if !web_listener_host(host) {
+			return l, fmt.Errorf("%q has invalid address %q", spec, host)
+		}
+		if u.Path != "" && u.Path != "/" {
+			return l, fmt.Errorf("%q can't have a path", spec)
+		}
+		l.address = net.JoinHostPort(host, port)
+
+	case "unix":
+		l.address = u.Path
+		if l.address == "" {
+			l.address = u.Opaque
+		}
+		if !strings.HasPrefix(l.address, "/") {
+			return l, fmt.Errorf("%q needs an absolute socket path", spec)
+		}
+		l.mode = 0660
+		known["mode"] = true
+		if mode := query.Get("mode"); mode != "" {
+			n, err := strconv.ParseUint(mode, 8, 32)
+			if err != nil || n > 0777 {
+				return l, fmt.Errorf("%q has invalid mode %q", spec, mode)
+			}
+			l.mode = os.FileMode(n)
+		}
+
+	default:
+		return l, fmt.Errorf("%q has unknown scheme %q; use http, https or unix", spec, u.Scheme)
+	}
+
+	if l.scheme == "http" {
+		known["redirect"] = true
+		l.redirect = query.Get("redirect") == "true"
+	}
+	if l.scheme == "https" {
+		known["cert"], known["key"], known["min"] = true, true, true
+		l.cert, l.key = query.Get("cert"), query.Get("key")
+		if (l.cert == "") != (l.key == "") {
+			return l, fmt.Errorf("%q needs both cert and key, or neither", spec)
+		}
+		switch query.Get("min") {
+		case "":
+		case "1.2":
+			l.min = tls.VersionTLS12
+		case "1.3":
+			l.min = tls.VersionTLS13
+		default:
+			return l, fmt.Errorf("%q has invalid min %q; use 1.2 or 1.3", spec, query.Get("min"))
+		}
+	}
+	for option := range query {
+		if !known[option] {
+			return l, fmt.Errorf("%q has unknown option %q", spec, option)
+		}
+	}
+	return l, nil
+}
+
+// web_listeners returns the configured listeners, and a problem for each
+// entry that can't be used
+func web_listeners() ([]web_listener, []string) {
+	specs := ini_strings_commas("web", "bind")
+	if len(specs) == 0 {
+		ports := ini_ints_commas("web", "ports")
+		if len(ports) == 0 {
+			// Fallback to legacy single port config
+			port := ini_int("web", "port", 80)
+			if port == 0 {
+				return nil, nil
+			}
+			ports = []int{port}
+		}
+		return web_listeners_legacy(ports, ini_strings_commas("web", "listen"), len(domain_list()) > 0)
+	}
+
+	var listeners []web_listener
+	var problems []string
+	for _, spec := range specs {
+		l, err := web_listener_parse(spec)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	return web_listeners_unique(listeners, problems)
+}
+
+// web_listener_host returns whether an address can be listened on: empty
+// for every interface, an IP address, or a host name
+func web_listener_host(host string) bool {
+	if host == "" || net.ParseIP(host) != nil {
+		return !strings.Contains(host, "%")
+	}
+	return valid(host, "constant") && !strings.Contains(host, "/")
+}
+
+// web_listeners_legacy builds listeners from [web] ports on each [web]
+// listen address. HTTPS on 443 needs a domain, and has always redirected
+// plain HTTP on 80.
+func web_listeners_legacy(ports []int, addresses []string, domains bool) ([]web_listener, []string) {
+	var problems []string
+	if len(addresses) == 0 {
+		addresses = []string{""}
+	}
+	for _, address := range addresses {
+		if !web_listener_host(address) {
+			problems = append(problems, fmt.Sprintf("listen address %q is not valid", address))
+		}
+	}
+	https := domains && slices.Contains(ports, 443)
+	if https && !slices.Contains(ports, 80) {
+		ports = append(ports, 80)
+	}
+
+	var listeners []web_listener
+	for _, port := range ports {
+		if port == 443 && !domains {
+			problems = append(problems, "port 443 configured but no domains in database, skipping HTTPS")
+			continue
+		}
+		for _, address := range addresses {
+			if !web_listener_host(address) {
+				continue
+			}
+			l := web_listener{scheme: "http", address: net.JoinHostPort(address, strconv.Itoa(port))}
+			if port == 443 {
+				l.scheme = "https"
+			} else if port == 80 && https {
+				l.redirect = true
+			}
+			listeners = append(listeners, l)
+		}
+	}
+	return web_listeners_unique(listeners, problems)
+}
+
+// web_listeners_unique drops listeners on an address already listened on
+func web_listeners_unique(listeners []web_listener, problems []string) ([]web_listener, []string) {
+	var unique []web_listener
+	seen := map[string]bool{}
+	for _, l := range listeners {
+		if seen[l.address] {
+			problems = append(problems, fmt.Sprintf("%s is listed more than once", l.address))
+			continue
+		}
+		seen[l.address] = true
+		unique = append(unique, l)
+	}
+	return unique, problems
+}
+
+// web_listener_open opens a listener bounded by the connection ceiling. A
+// socket left behind by an earlier run is replaced.
+func web_listener_open(l web_listener, maximum int) (net.Listener, error) {
+	if l.scheme != "unix" {
+		return web_listen(l.address, maximum)
+	}
+	if fi, err := os.Lstat(l.address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", l.address)
+		}
+		os.Remove(l.address)
+	}
+	listener, err := net.Listen("unix", l.address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(l.address, l.mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if maximum <= 0 {
+		return listener, nil
+	}
+	return netutil.LimitListener(listener, maximum), nil
+}
+
+// web_listener_tls builds an HTTPS listener's TLS configuration, from
+// web_tls_config unless it has a fixed certificate
+func web_listener_tls(l web_listener) (*tls.Config, error) {
+	config := web_tls_config()
+	config.MinVersion = l.min
+	if l.cert != "" {
+		pair, err := tls.LoadX509KeyPair(l.cert, l.key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load certificate: %v", err)
+		}
+		config.GetCertificate = nil
+		config.Certificates = []tls.Certificate{pair}
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return config, nil
+}
+
+// web_listener_handler returns what a listener serves. While any listener
+// has managed certificates, plain HTTP ones also answer ACME HTTP-01
+// challenges.
+func web_listener_handler(l web_listener, router http.Handler, acme bool) http.Handler {
+	handler := router
+	if l.redirect {
+		handler = http.HandlerFunc(web_redirect_https)
+	}
+	if l.scheme == "http" && acme && domains_acme_manager != nil {
+		handler = domains_acme_manager.HTTPHandler(handler)
+	}
+	return handler
+}
+
+// web_serve_listeners opens each listener, reporting any that can't be,
+// and serves on them until they stop
+func web_serve_listeners(router http.Handler, listeners []web_listener) {
+	acme := false
+	for _, l := range listeners {
+		if l.scheme == "https" {
+			web_https = true
+		}
+		acme = acme || l.managed()
+	}
+
+	maximum := web_connections_maximum()
+	errors := make(chan error, len(listeners))
+	serving := 0
+	for _, l := range listeners {
+		s := web_server(l.address, web_listener_handler(l, router, acme))
+		if l.scheme == "https" {
+			config, err := web_listener_tls(l)
+			if err != nil {
+				warn("Web unable to listen on %s: %v", l, err)
+				continue
+			}
+			s.TLSConfig = config
+		}
+		listener, err := web_listener_open(l, maximum)
+		if err != nil {
+			warn("Web unable to listen on %s: %v", l, err)
+			continue
+		}
+		info("Web listening on %s", l)
+		serving++
+		go func() {
+			// The bound counts connections from accept, so one stalled in
+			// the TLS handshake occupies a slot exactly as a completed one does
+			if s.TLSConfig != nil {
+				errors <- s.ServeTLS(listener, "", "")
+			} else {
+				errors <- s.Serve(listener)
+			}
+		}()
+	}
+
+	if serving == 0 {
+		warn("Web has no listeners")
+		return
+	}
+	for range serving {
+		if err := <-errors; err != nil && err != http.ErrServerClosed {
+			warn("Web listener stopped: %v", err)
+		}
+	}
+}
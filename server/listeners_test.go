@@ -0,0 +1,159 @@
+// Mochi server: Web listener tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWebListenerParse(t *testing.T) {
+	for spec, want := range map[string]web_listener{
+		"http://[::]:80":                        {scheme: "http", address: "[::]:80"},
+		"http://:8080":                          {scheme: "http", address: ":8080"},
+		"http://0.0.0.0:80?redirect=true":       {scheme: "http", address: "0.0.0.0:80", redirect: true},
+		"https://192.0.2.1:443":                 {scheme: "https", address: "192.0.2.1:443"},
+		"https://[::1]:8443?min=1.3":            {scheme: "https", address: "[::1]:8443", min: tls.VersionTLS13},
+		"https://localhost:8443?cert=/c&key=/k": {scheme: "https", address: "localhost:8443", cert: "/c", key: "/k"},
+		"unix:/run/mochi/web.sock":              {scheme: "unix", address: "/run/mochi/web.sock", mode: 0660},
+		"unix:///run/web.sock?mode=0600":        {scheme: "unix", address: "/run/web.sock", mode: 0600},
+	} {
+		l, err := web_listener_parse(spec)
+		if err != nil || l != want {
+			t.Errorf("%q parsed as %+v, %v", spec, l, err)
+		}
+	}
+
+	for _, spec := range []string{
+		"[::]:80",
+		"ftp://[::]:21",
+		"http://[::]",
+		"http://[::]:0",
+		"http://[::]:70000",
+		"http://[::]:80/path",
+		"http://[fe80::1%eth0]:80",
+		"http://[::]:80?min=1.3",
+		"https://[::]:443?cert=/c",
+		"https://[::]:443?min=1.1",
+		"unix:web.sock",
+		"unix:/run/web.sock?mode=999",
+	} {
+		if l, err := web_listener_parse(spec); err == nil {
+			t.Errorf("%q accepted as %+v", spec, l)
+		}
+	}
+}
+
+func TestWebListenersLegacy(t *testing.T) {
+	listeners, problems := web_listeners_legacy([]int{443}, []string{"127.0.0.1", "::1"}, true)
+	var got []string
+	for _, l := range listeners {
+		got = append(got, l.String())
+	}
+	want := "https://127.0.0.1:443, https://[::1]:443, http://127.0.0.1:80 (redirecting to HTTPS), http://[::1]:80 (redirecting to HTTPS)"
+	if strings.Join(got, ", ") != want || len(problems) != 0 {
+		t.Errorf("listeners %v, problems %v", got, problems)
+	}
+
+	// Without a domain there is no HTTPS, and plain HTTP isn't redirected
+	listeners, problems = web_listeners_legacy([]int{80, 443}, nil, false)
+	if len(listeners) != 1 || listeners[0] != (web_listener{scheme: "http", address: ":80"}) || len(problems) != 1 {
+		t.Errorf("listeners %+v, problems %v", listeners, problems)
+	}
+
+	listeners, problems = web_listeners_legacy([]int{8080, 8080}, []string{"not/an address"}, false)
+	if len(listeners) != 0 || len(problems) != 1 {
+		t.Errorf("listeners %+v, problems %v", listeners, problems)
+	}
+	listeners, problems = web_listeners_legacy([]int{8080, 8080}, nil, false)
+	if len(listeners) != 1 || len(problems) != 1 {
+		t.Errorf("duplicate listeners %+v, problems %v", listeners, problems)
+	}
+}
+
+func TestWebListenersBind(t *testing.T) {
+	t.Setenv("MOCHI_WEB_BIND", "http://127.0.0.1:8080, https://[::]:443, gopher://x:70")
+	t.Setenv("MOCHI_WEB_PORTS", "9999")
+	listeners, problems := web_listeners()
+	if len(listeners) != 2 || listeners[0].address != "127.0.0.1:8080" || !listeners[1].managed() || listeners[1].port() != "443" {
+		t.Errorf("listeners %+v", listeners)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "gopher") {
+		t.Errorf("problems %v", problems)
+	}
+}
+
+func TestWebListenerUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions are not supported on Windows")
+	}
+	// Socket paths are short, so not under a deep test directory
+	dir, err := os.MkdirTemp("", "mochi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "web.sock")
+	l := web_listener{scheme: "unix", address: path, mode: 0600}
+
+	// A socket left behind by an earlier run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := stale.(*net.UnixListener); ok {
+		u.SetUnlinkOnClose(false)
+	}
+	stale.Close()
+
+	listener, err := web_listener_open(l, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket %v, %v", fi, err)
+	}
+
+	// Anything other than a socket is left alone
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, []byte("keep"), 0644)
+	if _, err := web_listener_open(web_listener{scheme: "unix", address: file, mode: 0600}, 0); err == nil {
+		t.Error("file replaced by a socket")
+	}
+}
+
+func TestWebListenerTLS(t *testing.T) {
+	config, err := web_listener_tls(web_listener{scheme: "https", address: ":443", min: tls.VersionTLS13})
+	if err != nil || config.GetCertificate == nil || config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("managed config %+v, %v", config, err)
+	}
+	if _, err := web_listener_tls(web_listener{scheme: "https", address: ":443", cert: "/missing.pem", key: "/missing.key"}); err == nil {
+		t.Error("missing certificate accepted")
+	}
+}
+
+func TestNetListenAddresses(t *testing.T) {
+	listen, problems := net_listen_addresses(1443, nil)
+	if len(listen) != 4 || listen[0] != "/ip4/0.0.0.0/tcp/1443" || listen[3] != "/ip6/::/udp/1443/quic-v1" || len(problems) != 0 {
+		t.Errorf("default %v, %v", listen, problems)
+	}
+	listen, problems = net_listen_addresses(4001, []string{"192.0.2.1", "2001:db8::1", "eth0"})
+	if strings.Join(listen, " ") != "/ip4/192.0.2.1/tcp/4001 /ip4/192.0.2.1/udp/4001/quic-v1 /ip6/2001:db8::1/tcp/4001 /ip6/2001:db8::1/udp/4001/quic-v1" || len(problems) != 1 {
+		t.Errorf("listen %v, %v", listen, problems)
+	}
+	listen, problems = net_listen_addresses(4001, []string{"eth0"})
+	if len(listen) != 4 || len(problems) != 2 {
+		t.Errorf("invalid only %v, %v", listen, problems)
+	}
+}
@@ -19,20 +19,22 @@ import (
 type Map map[string]any
 
 var (
-	build_version    string
-	build_platform   string
-	cache_dir        string
-	config_file      string
-	data_dir         string
-	dev_apps_dir     string
-	dev_reload       bool
-	web_cache        bool
-	web_compress     string
-	web_gzip_level   int
-	web_brotli_level int
-	email_host       string
-	email_port       int
-	email_tls        bool
+	build_version       string
+	build_platform      string
+	cache_dir           string
+	config_file         string
+	data_dir            string
+	dev_apps_dir        string
+	dev_reload          bool
+	web_cache           bool
+	web_compress        string
+	web_sendfile        string
+	web_sendfile_prefix string
+	web_gzip_level      int
+	web_brotli_level    int
+	email_host          string
+	email_port          int
+	email_tls           bool
 
 	server_started_at time.Time
 )
@@ -70,12 +72,20 @@ func main_serve(ready func()) int {
 	default_data := paths.Data()
 
 	flag.StringVar(&config_file, "f", default_config, "Configuration file")
+	check_config := flag.Bool("check-config", false, "Check the configuration, print the effective configuration, and exit")
 	flag.Parse()
 	err := ini_load(config_file)
 	if err != nil {
 		warn("Unable to read configuration file: %v", err)
 		return 1
 	}
+	if *check_config {
+		if err := ini_print(os.Stdout); err != nil {
+			warn("Unable to print configuration: %v", err)
+			return 1
+		}
+		return 0
+	}
 
 	cache_dir = ini_string("directories", "cache", default_cache)
 	data_dir = ini_string("directories", "data", default_data)
@@ -134,6 +144,14 @@ func main_serve(ready func()) int {
 		warn("Invalid web.compress value %q; disabling compression", web_compress)
 		web_compress = "none"
 	}
+	web_sendfile = ini_string("web", "sendfile", "none")
+	web_sendfile_prefix = ini_string("web", "sendfile_prefix", "/_mochi")
+	switch web_sendfile {
+	case "none", "nginx", "apache":
+	default:
+		warn("Invalid web.sendfile value %q; serving files directly", web_sendfile)
+		web_sendfile = "none"
+	}
 	if web_gzip_level < 1 || web_gzip_level > 9 {
 		warn("Invalid web.gzip level %d; using default (6)", web_gzip_level)
 		web_gzip_level = 6
@@ -145,45 +163,49 @@ func main_serve(ready func()) int {
 
 	load_core_labels()
 	starlark_configure()
+	url_configure()
+	web_body_configure()
+	mirror_configure()
+	if err := secrets_configure(); err != nil {
+		warn("Unable to open secrets provider: %v", err)
+		return 1
+	}
 	db_start()
+	supervisor_ready("db")
+	secrets_migrate()
 	passkey_init()
 	if err := domains_load_certs(); err != nil {
 		warn("Failed to load domain certificates: %v", err)
 	}
 	domains_init_acme()
 	apps_start()
-	net_start()
-	// setting_set replicates to every pair member via system-set ops
-	// (#68). Must run after net_start so the spawned send_peer
-	// goroutines don't dereference a nil net_me on a server that
-	// already has pair members from a prior run.
-	setting_set("server_started", itoa(int(now())))
+	supervisor_ready("apps")
+	setup_start()
+	maintenance_load()
+	if err := cluster_configure(); err != nil {
+		warn("Unable to start clustering: %v", err)
+		return 1
+	}
+	main_stops()
+	supervisor_ready("cluster")
+	cluster_start(main_lead)
 	if err := admin_start(); err != nil {
 		warn("admin listener disabled: %v", err)
 	}
-	go cache_manager()
-	go closure_manager()
-	go entities_manager()
-	go directory_manager()
-	go directory_cleanup_manager()
-	go peers_manager()
-	go peer_reconnect_manager()
-	go peers_publish()
-	go queue_manager()
-	go queue_ack_batcher()
-	go self_loop_drain()
-	go ratelimit_manager()
-	go broadcast_manager()
-	go restore_cleanup_orphans()
-	go db_app_system_sweep()
-	go sessions_manager()
-	go update_manager()
+	supervise("cache", cache_manager, "db")
+	supervise("disk", disk_manager)
+	supervise("governor", governor_manager)
+	supervise("git", git_maintenance_manager, "apps")
+	supervise("variants", variant_manager, "apps")
+	supervise("bus", bus_manager, "apps")
+	supervise("ratelimit", ratelimit_manager)
+	supervise("presence", presence_manager, "db")
+	supervise("transfer", transfer_manager, "db")
+	supervise("analytics", analytics_manager, "db")
 	// Register the configured [web] domain (if any) before the web server
 	// starts, so a fresh server can serve HTTPS on first boot.
 	domains_seed_config()
-	go web_start()
-	go apps_manager()
-	go schedule_start()
+	supervise("web", web_start, "apps")
 
 	if ready != nil {
 		ready()
@@ -220,8 +242,8 @@ loop:
 
 	audit_server_stop()
 
-	// Run the drain + close sequence under an overall deadline. queue_drain
-	// and peers_shutdown are individually bounded, but on a busy PUBLIC host
+	// Run the stop hooks under an overall deadline. queue_drain and
+	// peers_shutdown are individually bounded, but on a busy PUBLIC host
 	// libp2p's host Close (and the relay/transport shutdown beneath it) can
 	// block indefinitely when a connection or listener won't quiesce —
 	// observed on yuzu hanging the full systemd TimeoutStopSec (90s) before
@@ -233,8 +255,37 @@ loop:
 	const shutdown_grace = 30 * time.Second
 	done := make(chan struct{})
 	go func() {
-		queue_drain(10 * time.Second) // outbound queue (bounded)
-		peers_shutdown()              // bye to connected peers (bounded)
+		supervisor_shutdown()
+		audit_close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		info("Shutdown complete")
+	case <-time.After(shutdown_grace):
+		// Backstop only: the libp2p teardown is individually bounded in
+		// main_stops, so reaching here means queue_drain / peers_shutdown /
+		// audit_close itself overran — rare. info, not warn: the forced exit is the designed, safe
+		// fallback (SQLite is crash-safe; the alternative was the 90s SIGKILL),
+		// so it's not operator-actionable — log it, don't email a "Mochi error".
+		info("Shutdown exceeded %s; forcing exit", shutdown_grace)
+		os.Exit(exit_code)
+	}
+	return exit_code
+}
+
+// main_stops adds the shutdown hooks for each startup stage, which run the
+// latest stage first: the network is closed, then the cluster lease given
+// up, then this minute's transfer totals saved
+func main_stops() {
+	supervisor_on_stop("db", transfer_save)
+	supervisor_on_stop("cluster", cluster_release) // let a follower take over, once the host is closed
+	supervisor_on_stop("p2p", func() {
+		if !cluster_following.Load() {
+			queue_drain(10 * time.Second) // outbound queue (bounded)
+			peers_shutdown()              // bye to connected peers (bounded)
+		}
 		// relay_shutdown (relay_service.Close) and net_me.Close (the libp2p host
 		// close) are BOTH unbounded libp2p teardowns, and on a busy PUBLIC host
 		// they reliably never quiesce: the web server is still accepting on the
@@ -256,21 +307,43 @@ loop:
 		case <-time.After(2 * time.Second):
 			info("libp2p teardown did not quiesce within 2s; proceeding to exit")
 		}
-		audit_close()
-		close(done)
-	}()
+	})
+}
 
-	select {
-	case <-done:
-		info("Shutdown complete")
-	case <-time.After(shutdown_grace):
-		// Backstop only: the libp2p teardown is individually bounded above, so
-		// reaching here means queue_drain / peers_shutdown / audit_close itself
-		// overran — rare. info, not warn: the forced exit is the designed, safe
-		// fallback (SQLite is crash-safe; the alternative was the 90s SIGKILL),
-		// so it's not operator-actionable — log it, don't email a "Mochi error".
-		info("Shutdown exceeded %s; forcing exit", shutdown_grace)
-		os.Exit(exit_code)
-	}
-	return exit_code
+// main_lead starts the libp2p host and the background managers that run on
+// one node of a cluster, the leader, or always on a server that isn't
+// clustered
+func main_lead() {
+	net_start()
+	supervisor_ready("p2p")
+	// setting_set replicates to every pair member via system-set ops
+	// (#68). Must run after net_start so the spawned send_peer
+	// goroutines don't dereference a nil net_me on a server that
+	// already has pair members from a prior run.
+	setting_set("server_started", itoa(int(now())))
+	supervise("closure", closure_manager, "p2p")
+	supervise("entities", entities_manager, "p2p")
+	supervise("directory", directory_manager, "p2p")
+	supervise("directory_cleanup", directory_cleanup_manager, "p2p")
+	supervise("peers", peers_manager, "p2p")
+	supervise("peer_reconnect", peer_reconnect_manager, "p2p")
+	supervise("peer_pool", peer_pool_manager, "p2p")
+	supervise("peers_publish", peers_publish, "p2p")
+	supervise("queue", queue_manager, "p2p")
+	supervise("queue_acks", queue_ack_batcher, "p2p")
+	supervise("self_loop", self_loop_drain, "p2p")
+	supervise("broadcast", broadcast_manager, "p2p")
+	supervise("restore_cleanup", restore_cleanup_orphans, "apps")
+	supervise("system_sweep", db_app_system_sweep, "apps")
+	supervise("sessions", sessions_manager, "db")
+	supervise("notifications", notifications_manager, "db")
+	supervise("email_bounces", email_bounce_manager, "db")
+	supervise("trash", trash_manager, "apps")
+	supervise("retention", retention_manager, "db")
+	supervise("activity", activity_manager, "db")
+	supervise("import", import_manager, "apps")
+	supervise("update", update_manager, "apps")
+	supervise("expiry", expiry_manager, "db")
+	supervise("apps", apps_manager, "apps", "p2p")
+	supervise("schedule", schedule_start, "apps", "p2p")
 }
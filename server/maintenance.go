@@ -0,0 +1,316 @@
+// Mochi server: Maintenance mode
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// While the server is in maintenance mode, for a long migration or disk
+// work, web requests get a 503 page unless they come from an administrator,
+// and sign-in stays open so an administrator can get in. Events arriving
+// from other servers are accepted, so their senders don't keep retrying,
+// and held in db/events.db without running any app. When maintenance ends
+// they're handled in the order they arrived. Streams, which need an answer
+// there and then, are refused until it ends. The state is kept in the
+// "maintenance" setting, so it survives a restart.
+
+const (
+	maintenance_batch = 100    // Held events released per query
+	maintenance_limit = 100000 // Events held at most; beyond it they're refused
+	maintenance_retry = "60"   // Retry-After, in seconds, on the 503 page
+)
+
+type maintenance_state struct {
+	Since   int64  `json:"since"`
+	Message string `json:"message"`
+}
+
+var (
+	maintenance_on        atomic.Bool
+	maintenance_lock      sync.Mutex
+	maintenance_current   maintenance_state
+	maintenance_releasing atomic.Bool
+)
+
+// Paths served in maintenance to everyone: sign-in and its app, and what
+// monitors and peers poll
+var maintenance_open = []string{"/_/auth/", "/_/identity", "/_/logout", "/_/ping", "/_/health", "/_/metrics", "/_/p2p/info", "/_/languages", "/login"}
+
+// maintenance_load reads the maintenance state at startup, and releases
+// events held before a restart if maintenance has since ended
+func maintenance_load() {
+	var s maintenance_state
+	if value := setting_get("maintenance", ""); value != "" {
+		if err := json.Unmarshal([]byte(value), &s); err != nil {
+			warn("Maintenance state %q unreadable: %v", value, err)
+		}
+	}
+	maintenance_lock.Lock()
+	maintenance_current = s
+	maintenance_on.Store(s.Since > 0)
+	maintenance_lock.Unlock()
+	if s.Since > 0 {
+		info("Server is in maintenance mode")
+		return
+	}
+	go maintenance_release()
+}
+
+// maintenance_active reports whether the server is in maintenance mode
+func maintenance_active() bool {
+	return maintenance_on.Load()
+}
+
+// maintenance_get returns the maintenance state, with Since 0 if off
+func maintenance_get() maintenance_state {
+	maintenance_lock.Lock()
+	defer maintenance_lock.Unlock()
+	return maintenance_current
+}
+
+// maintenance_set turns maintenance mode on, with a message for visitors,
+// or off, releasing the events held meanwhile
+func maintenance_set(on bool, message string) maintenance_state {
+	maintenance_lock.Lock()
+	if on {
+		if maintenance_current.Since == 0 {
+			maintenance_current.Since = now()
+		}
+		maintenance_current.Message = message
+		value, _ := json.Marshal(maintenance_current)
+		setting_set("maintenance", string(value))
+	} else {
+		maintenance_current = maintenance_state{}
+		setting_set("maintenance", "")
+	}
+	maintenance_on.Store(on)
+	s := maintenance_current
+	maintenance_lock.Unlock()
+
+	if on {
+		info("Maintenance mode on")
+	} else {
+		info("Maintenance mode off")
+		go maintenance_release()
+	}
+	return s
+}
+
+// maintenance_held returns how many events are held
+func maintenance_held() int64 {
+	return db_open("db/events.db").integer64("select count(*) from held")
+}
+
+// maintenance_hold keeps an event received in maintenance to be handled
+// when it ends, returning false if the event should be handled now.
+// Acknowledgements are for the outbound queue, not an app, so are never held.
+// Once maintenance_limit events are held, further ones are refused with an
+// error so their senders try again later.
+func maintenance_hold(e *Event, data []byte) (bool, error) {
+	if !maintenance_active() || e.event == event_ack_event {
+		return false, nil
+	}
+	db := db_open("db/events.db")
+	if db.integer64("select count(*) from held") >= maintenance_limit {
+		return true, fmt.Errorf("too many events held in maintenance")
+	}
+	content, _ := cbor.Marshal(e.content)
+	if data == nil {
+		data = []byte{}
+	}
+	db.exec(`insert into held
+		(id, from_entity, to_entity, service, event, from_app, from_services, peer, origin, key, content, data, received)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.msg_id, e.from, e.to, e.service, e.event, e.sender_app, strings.Join(e.sender_services, ","), e.peer, e.origin, e.key, content, data, now())
+	debug("Maintenance holding event %q from %q for service %q event %q", e.msg_id, e.from, e.service, e.event)
+	return true, nil
+}
+
+// maintenance_release handles the held events in the order they arrived,
+// stopping if maintenance is turned on again
+func maintenance_release() {
+	if !maintenance_releasing.CompareAndSwap(false, true) {
+		return
+	}
+	defer maintenance_releasing.Store(false)
+
+	db := db_open("db/events.db")
+	released := 0
+	for !maintenance_active() {
+		rows, err := db.rows("select * from held order by sequence limit ?", maintenance_batch)
+		if err != nil {
+			info("Maintenance release select error: %v", err)
+			return
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, r := range rows {
+			if maintenance_active() {
+				return
+			}
+			str := func(key string) string {
+				v, _ := r[key].(string)
+				return v
+			}
+			// db.rows returns blobs as strings
+			content := map[string]any{}
+			if b := str("content"); b != "" {
+				_ = cbor.Unmarshal([]byte(b), &content)
+			}
+			data := []byte(str("data"))
+			e := &Event{
+				id:              event_id(),
+				msg_id:          str("id"),
+				from:            str("from_entity"),
+				to:              str("to_entity"),
+				service:         str("service"),
+				event:           str("event"),
+				sender_app:      str("from_app"),
+				sender_services: split_services(str("from_services")),
+				peer:            str("peer"),
+				origin:          str("origin"),
+				content:         content,
+				key:             str("key"),
+			}
+			if len(data) > 0 {
+				e.stream = stream_rw(io.NopCloser(bytes.NewReader(data)), nil)
+			}
+
+			err := e.route_recover()
+			e.log(data, err)
+			if err == nil {
+				e.key_mark()
+			} else {
+				debug("Maintenance released event %q failed: %v", e.msg_id, err)
+			}
+			db.exec("delete from held where sequence=?", row_int(r, "sequence"))
+			released++
+		}
+	}
+	if released > 0 {
+		info("Maintenance released %d held events", released)
+	}
+}
+
+// maintenance_user returns the user a request is signed in as, by session
+// cookie, API token or the shell's JWT, without the side effects of web_auth
+func maintenance_user(c *gin.Context) *User {
+	if u := user_by_login(web_cookie_get(c, "session", "")); u != nil {
+		return u
+	}
+	bearer, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if bearer == "" {
+		bearer = c.Query("token")
+	}
+	if bearer == "" {
+		return nil
+	}
+	if strings.HasPrefix(bearer, "mochi-") {
+		if t := token_validate(bearer); t != nil {
+			return user_by_uid(t.User)
+		}
+		return nil
+	}
+	if uid, _, err := jwt_verify(bearer); err == nil && uid != "" {
+		return user_by_uid(uid)
+	}
+	return nil
+}
+
+// maintenance_middleware answers web requests with a 503 while the server
+// is in maintenance, except sign-in and requests from administrators
+func maintenance_middleware(c *gin.Context) {
+	if !maintenance_active() {
+		c.Next()
+		return
+	}
+	path := c.Request.URL.Path
+	for _, open := range maintenance_open {
+		if path == open || strings.HasPrefix(path, strings.TrimSuffix(open, "/")+"/") {
+			c.Next()
+			return
+		}
+	}
+	if u := maintenance_user(c); u != nil && u.administrator() {
+		c.Next()
+		return
+	}
+
+	c.Header("Retry-After", maintenance_retry)
+	c.Header("Cache-Control", "no-store")
+	accept := c.GetHeader("Accept")
+	if !strings.Contains(accept, "text/html") || strings.Contains(accept, "application/json") {
+		respond_error(c, http.StatusServiceUnavailable, "maintenance", "errors.maintenance", nil)
+		return
+	}
+	maintenance_page(c)
+	c.Abort()
+}
+
+// maintenance_page writes the page visitors see in maintenance
+func maintenance_page(c *gin.Context) {
+	lang := request_language(c, nil)
+	label := func(key string) string {
+		return html.EscapeString(resolve_core_label(lang, "maintenance."+key, nil))
+	}
+
+	var b strings.Builder
+	b.WriteString(`<!doctype html><html lang="` + html.EscapeString(lang) + `" dir="` + language_direction(lang) + `"><meta charset=utf-8><meta name=viewport content="width=device-width, initial-scale=1"><title>` + label("title") + `</title>`)
+	b.WriteString(`<style>body{font-family:system-ui,sans-serif;max-width:32em;margin:4em auto;padding:0 1em;color:#333;text-align:center}.message{white-space:pre-line}a{color:inherit}</style>`)
+	b.WriteString(`<h1>` + label("title") + `</h1><p>` + label("body") + `</p>`)
+	if message := maintenance_get().Message; message != "" {
+		b.WriteString(`<p class=message>` + html.EscapeString(message) + `</p>`)
+	}
+	b.WriteString(`<p><a href="/login/">` + label("login") + `</a></p>`)
+	c.Data(http.StatusServiceUnavailable, "text/html; charset=utf-8", []byte(b.String()))
+}
+
+// maintenance_map returns the maintenance state for the admin API
+func maintenance_map() gin.H {
+	s := maintenance_get()
+	return gin.H{"enabled": s.Since > 0, "since": s.Since, "message": s.Message, "held": maintenance_held()}
+}
+
+// admin_maintenance is GET /_/admin/maintenance
+func admin_maintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, maintenance_map())
+}
+
+// admin_maintenance_set is POST /_/admin/maintenance.
+//
+// Query params: ?enabled=true or false, and ?message= shown to visitors.
+func admin_maintenance_set(c *gin.Context) {
+	var on bool
+	switch c.Query("enabled") {
+	case "true":
+		on = true
+	case "false":
+	default:
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+	message := strings.TrimSpace(c.Query("message"))
+	if message != "" && !valid(message, "text") {
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+	maintenance_set(on, message)
+	c.JSON(http.StatusOK, maintenance_map())
+}
@@ -0,0 +1,115 @@
+// Mochi server: Maintenance mode tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMaintenance(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	load_core_labels()
+	t.Cleanup(func() { maintenance_on.Store(false) })
+
+	admin, _ := user_create("admin@example.com")
+	user, _ := user_create("user@example.com")
+	if admin == nil || user == nil || !admin.administrator() || user.administrator() {
+		t.Fatal("users")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(maintenance_middleware)
+	r.GET("/_/auth/methods", func(c *gin.Context) { c.String(http.StatusOK, "methods") })
+	r.NoRoute(func(c *gin.Context) { c.String(http.StatusOK, "app") })
+	get := func(path, accept, session string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("/feeds", "text/html", ""); w.Code != http.StatusOK {
+		t.Fatalf("before maintenance: %d", w.Code)
+	}
+
+	maintenance_set(true, "Moving to a new disk")
+	if w := get("/feeds", "text/html", ""); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Moving to a new disk") || w.Header().Get("Retry-After") == "" {
+		t.Errorf("visitor page: %d %s", w.Code, w.Body.String())
+	}
+	if w := get("/feeds/-/posts", "application/json", ""); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"maintenance"`) {
+		t.Errorf("visitor API: %d %s", w.Code, w.Body.String())
+	}
+	if w := get("/_/auth/methods", "application/json", ""); w.Code != http.StatusOK {
+		t.Errorf("sign-in: %d", w.Code)
+	}
+	if w := get("/feeds", "text/html", login_create(user.UID, "", "")); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("user: %d", w.Code)
+	}
+	if w := get("/feeds", "text/html", login_create(admin.UID, "", "")); w.Code != http.StatusOK {
+		t.Errorf("administrator: %d", w.Code)
+	}
+
+	// Survives a restart
+	maintenance_on.Store(false)
+	maintenance_load()
+	if !maintenance_active() || maintenance_get().Message != "Moving to a new disk" {
+		t.Fatalf("reloaded %+v", maintenance_get())
+	}
+
+	// Events are held, except acknowledgements
+	e := &Event{msg_id: "m1", from: "sender", to: "nobody", service: "feeds", event: "post/create", content: map[string]any{"title": "Hello"}}
+	if held, err := maintenance_hold(e, []byte{1, 2}); !held || err != nil {
+		t.Fatalf("event not held: %v", err)
+	}
+	if held, _ := maintenance_hold(&Event{msg_id: "m2", event: event_ack_event}, nil); held {
+		t.Error("acknowledgement held")
+	}
+	if n := maintenance_held(); n != 1 {
+		t.Fatalf("held %d", n)
+	}
+	rows, _ := db_open("db/events.db").rows("select * from held")
+	if rows[0]["id"] != "m1" || rows[0]["to_entity"] != "nobody" || rows[0]["data"] != "\x01\x02" {
+		t.Errorf("held row %v", rows[0])
+	}
+
+	// Refused once the limit is held
+	events := db_open("db/events.db")
+	events.exec("with recursive n(i) as (select 1 union all select i+1 from n where i < ?) insert into held (id, from_entity, to_entity, service, event, received) select 'x' || i, 'sender', 'nobody', 'feeds', 'post/create', 0 from n", maintenance_limit)
+	if held, err := maintenance_hold(&Event{msg_id: "m3", service: "feeds", event: "post/create"}, nil); !held || err == nil {
+		t.Error("event held past the limit")
+	}
+	events.exec("delete from held where id like 'x%'")
+
+	// Released when maintenance ends
+	maintenance_set(false, "")
+	deadline := time.Now().Add(5 * time.Second)
+	for (maintenance_held() > 0 || maintenance_releasing.Load()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := maintenance_held(); n != 0 {
+		t.Errorf("held %d after maintenance", n)
+	}
+	if setting_get("maintenance", "x") != "" {
+		t.Error("state not cleared")
+	}
+	if w := get("/feeds", "text/html", ""); w.Code != http.StatusOK {
+		t.Errorf("after maintenance: %d", w.Code)
+	}
+}
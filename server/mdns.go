@@ -0,0 +1,165 @@
+// Mochi server: Local network discovery
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	p2p_peer "github.com/libp2p/go-libp2p/core/peer"
+	sl "go.starlark.net/starlark"
+)
+
+// Servers on the same local network, such as a family NAS and a laptop,
+// find each other over multicast DNS without public DNS, port forwarding
+// or the bootstrap peers. Each server found is remembered in the nearby
+// table. With [p2p] mdns = true, the default, it is connected to straight
+// away. With [p2p] mdns = confirm the administrators are notified instead,
+// and it is only connected to once one of them accepts it in the Settings
+// app; an accepted server is reconnected whenever it is found again, and a
+// declined one is ignored. [p2p] mdns = false turns discovery off.
+
+// mdns_mode returns [p2p] mdns: "true", "confirm" or "false"
+func mdns_mode() string {
+	switch mode := strings.ToLower(strings.TrimSpace(ini_string("p2p", "mdns", "true"))); mode {
+	case "confirm", "false":
+		return mode
+	case "true", "":
+	default:
+		warn("Unknown [p2p] mdns %q; using true", mode)
+	}
+	return "true"
+}
+
+// mdns_found records a server found on the local network, connecting to
+// it if it's accepted. mDNS is link-scoped, so every address it carries —
+// including loopback from a same-host sibling — is valid for us to store
+// and dial.
+func mdns_found(id string, addresses []string) {
+	if id == net_id {
+		return
+	}
+	db := db_open("db/peers.db")
+	status := ""
+	if r, _ := db.row("select status from nearby where id=?", id); r != nil {
+		status, _ = r["status"].(string)
+	}
+	found := status == ""
+	if found {
+		status = "accepted"
+		if mdns_mode() == "confirm" {
+			status = "pending"
+		}
+	}
+	db.exec("replace into nearby ( id, addresses, found, status ) values ( ?, ?, ?, ? )", id, strings.Join(addresses, " "), now(), status)
+
+	switch {
+	case status == "accepted":
+		mdns_connect(id, addresses)
+	case status == "pending" && found:
+		info("Net found server %q on the local network, waiting for an administrator to accept it", id)
+		administrators_notify("nearby/found", "/settings/system/nearby", "nearby.notification", map[string]any{"peer": fingerprint(id)})
+	}
+}
+
+// mdns_connect dials a nearby server at the addresses it was found at.
+// Package-level var so tests can accept servers without dialling them.
+var mdns_connect = func(id string, addresses []string) {
+	for _, a := range addresses {
+		peer_discovered_address(id, a)
+	}
+	peer_connect(id)
+}
+
+// mdns_decide accepts or declines a nearby server. Declining also drops
+// any connection to it.
+func mdns_decide(id string, accept bool) error {
+	db := db_open("db/peers.db")
+	r, err := db.row("select addresses from nearby where id=?", id)
+	if err != nil || r == nil {
+		return fmt.Errorf("server %q has not been found on the local network", id)
+	}
+	if !accept {
+		db.exec("update nearby set status='declined' where id=?", id)
+		if pid, err := p2p_peer.Decode(id); err == nil && net_me != nil {
+			net_me.Network().ClosePeer(pid)
+		}
+		return nil
+	}
+	db.exec("update nearby set status='accepted' where id=?", id)
+	addresses, _ := r["addresses"].(string)
+	go mdns_connect(id, strings.Fields(addresses))
+	return nil
+}
+
+// mochi.server.nearby.list() -> list: Servers found on the local network,
+// most recently found first. Each is a dict of:
+//
+//	peer         string — the server's peer ID
+//	name         string — its claimed display name, if any
+//	fingerprint  string — 9-character fingerprint of the peer ID
+//	addresses    list   — the addresses it was last found at
+//	found        int    — Unix timestamp it was last found
+//	status       string — "pending", "accepted" or "declined"
+//	connected    bool   — currently connected at the libp2p level
+func api_server_nearby_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "settings/write"); err != nil {
+		return nil, err
+	}
+	rows, err := db_open("db/peers.db").rows("select id, addresses, found, status from nearby order by found desc")
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	out := make([]map[string]any, 0, len(rows))
+	for _, r := range rows {
+		id, _ := r["id"].(string)
+		addresses, _ := r["addresses"].(string)
+		connected := false
+		if pid, err := p2p_peer.Decode(id); err == nil && net_me != nil {
+			connected = len(net_me.Network().ConnsToPeer(pid)) > 0
+		}
+		out = append(out, map[string]any{
+			"peer":        id,
+			"name":        peer_name(id),
+			"fingerprint": fingerprint(id),
+			"addresses":   strings.Fields(addresses),
+			"found":       row_int(r, "found"),
+			"status":      r["status"],
+			"connected":   connected,
+		})
+	}
+	return sl_encode(out), nil
+}
+
+// mochi.server.nearby.accept(peer) -> None: Connect to a server found on
+// the local network, now and whenever it is found again
+func api_server_nearby_accept(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	return api_server_nearby_decide(t, fn, args, kwargs, true)
+}
+
+// mochi.server.nearby.decline(peer) -> None: Ignore a server found on the
+// local network, disconnecting from it
+func api_server_nearby_decline(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	return api_server_nearby_decide(t, fn, args, kwargs, false)
+}
+
+func api_server_nearby_decide(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple, accept bool) (sl.Value, error) {
+	if err := require_permission(t, fn, "settings/write"); err != nil {
+		return nil, err
+	}
+	var peer string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "peer", &peer); err != nil {
+		return nil, err
+	}
+	if _, err := p2p_peer.Decode(peer); err != nil {
+		return sl_error(fn, "invalid peer %q", peer)
+	}
+	if err := mdns_decide(peer, accept); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.None, nil
+}
@@ -0,0 +1,69 @@
+// Mochi server: Local network discovery tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+)
+
+func mdns_test_status(t *testing.T, id string) string {
+	t.Helper()
+	r, err := db_open("db/peers.db").row("select status from nearby where id=?", id)
+	if err != nil || r == nil {
+		return ""
+	}
+	status, _ := r["status"].(string)
+	return status
+}
+
+func TestMDNSMode(t *testing.T) {
+	for value, want := range map[string]string{"": "true", "true": "true", "Confirm": "confirm", "false": "false", "maybe": "true"} {
+		t.Setenv("MOCHI_P2P_MDNS", value)
+		if got := mdns_mode(); got != want {
+			t.Errorf("[p2p] mdns %q is %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestMDNSConfirm(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	t.Setenv("MOCHI_P2P_MDNS", "confirm")
+	connected := make(chan string, 1)
+	original := mdns_connect
+	t.Cleanup(func() { mdns_connect = original })
+	mdns_connect = func(id string, addresses []string) { connected <- id }
+
+	// Found servers wait for an administrator, and stay waiting when found again
+	mdns_found(dns_test_peer, nil)
+	mdns_found(dns_test_peer, nil)
+	if status := mdns_test_status(t, dns_test_peer); status != "pending" {
+		t.Fatalf("found server is %q", status)
+	}
+
+	if err := mdns_decide(dns_test_peer, false); err != nil {
+		t.Fatal(err)
+	}
+	mdns_found(dns_test_peer, nil)
+	if status := mdns_test_status(t, dns_test_peer); status != "declined" {
+		t.Errorf("declined server found again is %q", status)
+	}
+	if err := mdns_decide(dns_test_peer, true); err != nil {
+		t.Fatal(err)
+	}
+	if status := mdns_test_status(t, dns_test_peer); status != "accepted" {
+		t.Errorf("accepted server is %q", status)
+	}
+	if id := <-connected; id != dns_test_peer {
+		t.Errorf("accepting connected to %q", id)
+	}
+
+	if err := mdns_decide("12D3KooWRbpjpRmFiK7v6wRXA6yvAtTXXfvSE6xjbHVFFSaxN8SH", true); err == nil {
+		t.Error("server never found was accepted")
+	}
+}
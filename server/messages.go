@@ -76,6 +76,7 @@ func message_seen_cleanup() {
 }
 
 var api_message = sls.FromStringDict(sl.String("mochi.message"), sl.StringDict{
+	"read": sl.NewBuiltin("mochi.message.read", api_message_read),
 	"send": &message_send_module{},
 })
 
@@ -116,6 +117,9 @@ type Message struct {
 	file      string
 	target    string // specific peer to send to (optional)
 	expires   int64  // expiry timestamp (0 = no expiry)
+	after     int64  // delivery timestamp for a scheduled message (0 = now)
+	priority  int    // queue priority (0 = derived from service and event)
+	key       string // idempotency key, applied once per sender and service by the receiver
 }
 
 // Create a new message
@@ -181,10 +185,10 @@ func (m *Message) send_peer(peer string) {
 		m.ID = uid()
 	}
 	content := cbor_encode(m.content)
-	if message_self_loop_dispatch(m, content) {
+	if !m.scheduled() && message_self_loop_dispatch(m, content) {
 		return
 	}
-	queue_add_direct(m.ID, m.target, m.From, m.To, m.Service, m.Event, m.FromApp, m.Services, content, m.data, m.file, m.expires)
+	m.enqueue(m.ID, m.target, content)
 	queue_wake()
 }
 
@@ -193,16 +197,24 @@ func (m *Message) send_peer(peer string) {
 // priority_replay lane so they overtake live broadcast traffic in
 // wasabi's outbound queue. See task #96.
 func (m *Message) send_peer_priority(peer string, priority int) {
-	m.target = peer
-	if m.ID == "" {
-		m.ID = uid()
-	}
-	content := cbor_encode(m.content)
-	if message_self_loop_dispatch(m, content) {
-		return
+	m.priority = priority
+	m.send_peer(peer)
+}
+
+// enqueue adds a row for this message to the queue, addressed to a peer,
+// at its priority and on its schedule
+func (m *Message) enqueue(id, peer string, content []byte) {
+	priority := m.priority
+	if priority == 0 {
+		priority = queue_priority(m.Service, m.Event)
 	}
-	queue_add_direct_priority(m.ID, m.target, m.From, m.To, m.Service, m.Event, m.FromApp, m.Services, content, m.data, m.file, m.expires, priority)
-	queue_wake()
+	queue_add_direct_at(id, peer, m.From, m.To, m.Service, m.Event, m.FromApp, m.Services, content, m.data, m.file, m.expires, priority, m.after, m.key)
+}
+
+// scheduled reports whether the message is due later, so must wait in the
+// queue rather than be sent or dispatched now
+func (m *Message) scheduled() bool {
+	return m.after > now()
 }
 
 // Do the work of sending (queue-first, read challenge before sending, wait for ACK)
@@ -229,11 +241,32 @@ func (m *Message) send_work() {
 	}
 	content := cbor_encode(m.content)
 
+	if m.scheduled() {
+		// Queue a row for each of the recipient's peers, sent when due
+		if m.target != "" {
+			m.enqueue(m.ID, m.target, content)
+			return
+		}
+		peers := entity_peers_for(m.From, m.To)
+		if len(peers) == 0 {
+			m.enqueue(m.ID, "", content)
+			return
+		}
+		for i, peer := range peers {
+			id := m.ID
+			if i > 0 {
+				id = uid()
+			}
+			m.enqueue(id, peer, content)
+		}
+		return
+	}
+
 	if m.target != "" {
 		if message_self_loop_dispatch(m, content) {
 			return
 		}
-		queue_add_direct(m.ID, m.target, m.From, m.To, m.Service, m.Event, m.FromApp, m.Services, content, m.data, m.file, m.expires)
+		m.enqueue(m.ID, m.target, content)
 		if m.target == net_id {
 			// Self-loop dispatch fell back to queue.db (no worker yet,
 			// or inbox full). Don't inline-attempt: message_attempt_send
@@ -252,7 +285,7 @@ func (m *Message) send_work() {
 	if len(peers) == 0 {
 		// Unknown entity — queue one row with empty target so the
 		// retry loop can re-resolve later. Same as before.
-		queue_add_direct(m.ID, "", m.From, m.To, m.Service, m.Event, m.FromApp, m.Services, content, m.data, m.file, m.expires)
+		m.enqueue(m.ID, "", content)
 		return
 	}
 
@@ -281,7 +314,7 @@ func (m *Message) send_work() {
 			// Dispatch fell back to queue.db. Queue a self-loop row for
 			// self_loop_drain, but never make net_id the inline primary
 			// — message_attempt_send(net_id) would self-dial and fail.
-			queue_add_direct(uid(), peer, m.From, m.To, m.Service, m.Event, m.FromApp, m.Services, content, m.data, m.file, m.expires)
+			m.enqueue(uid(), peer, content)
 			self_queued = true
 			continue
 		}
@@ -289,7 +322,7 @@ func (m *Message) send_work() {
 		if primary_peer != "" {
 			id = uid()
 		}
-		queue_add_direct(id, peer, m.From, m.To, m.Service, m.Event, m.FromApp, m.Services, content, m.data, m.file, m.expires)
+		m.enqueue(id, peer, content)
 		if primary_peer == "" {
 			primary_peer = peer
 		}
@@ -339,7 +372,15 @@ func (m *Message) set(in ...string) *Message {
 	}
 }
 
-// mochi.message.send(headers, content?, data?, expires=seconds) -> None: Send a Net message
+// mochi.message.send(headers, content?, data?, expires=seconds, after=seconds, priority=class, key=string, ack=level) -> string | None: Send a Net message.
+// With after, the message is held in the queue and sent that many seconds from
+// now (at most 30 days). priority is "interactive" (the default) or "bulk",
+// which is delivered after interactive traffic to the same peer.
+// With key, the recipient handles at most one message from this sender to the
+// same service with that key within eight days, so a send repeated after a
+// crash or retry is not applied twice.
+// With ack="delivered" or "read", returns the message id, and the app receives
+// event/delivered, and for "read" event/read, when the recipient acknowledges it.
 func api_message_send(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) < 1 || len(args) > 3 {
 		return sl_error(fn, "syntax: <headers: dictionary>, [content: dictionary], [data: bytes]")
@@ -413,20 +454,63 @@ func api_message_send(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.T
 		m.add(sl_decode(args[2]))
 	}
 
-	// Parse expires kwarg (seconds from now)
+	// Parse expires kwarg (seconds from now), and ack kwarg
+	ack := ""
 	for _, kw := range kwargs {
-		if string(kw[0].(sl.String)) == "expires" {
+		switch string(kw[0].(sl.String)) {
+		case "expires":
 			if v, ok := kw[1].(sl.Int); ok {
 				m.expires = now() + v.BigInt().Int64()
 			}
+		case "after":
+			v, ok := kw[1].(sl.Int)
+			if !ok || v.BigInt().Int64() < 0 || v.BigInt().Int64() > queue_after_max {
+				return sl_error(fn, "invalid after")
+			}
+			if v.BigInt().Int64() > 0 {
+				m.after = now() + v.BigInt().Int64()
+			}
+		case "priority":
+			priority, _ := sl.AsString(kw[1])
+			switch priority {
+			case "interactive":
+				m.priority = priority_interactive
+			case "bulk":
+				m.priority = priority_bulk
+			default:
+				return sl_error(fn, "invalid priority %q", priority)
+			}
+		case "key":
+			key, _ := sl.AsString(kw[1])
+			if !valid(key, "constant") {
+				return sl_error(fn, "invalid key %q", key)
+			}
+			m.key = key
+		case "ack":
+			ack, _ = sl.AsString(kw[1])
+			if !event_ack_valid(ack) {
+				return sl_error(fn, "invalid ack %q", ack)
+			}
+			if app == nil {
+				return sl_error(fn, "ack requires an app")
+			}
 		}
 	}
+	if m.after > 0 && m.expires > 0 && m.expires <= m.after {
+		return sl_error(fn, "message expires before it is due")
+	}
+	if ack != "" {
+		event_ack_request(m, user, app, ack)
+	}
 
 	m.send()
+	if ack != "" {
+		return sl.String(m.ID), nil
+	}
 	return sl.None, nil
 }
 
-// mochi.message.send.peer(peer, headers, content?, data?, expires=seconds) -> None: Send a Net message to a specific peer
+// mochi.message.send.peer(peer, headers, content?, data?, expires=seconds, after=seconds, priority=class, key=string, ack=level) -> string | None: Send a Net message to a specific peer
 func api_message_send_peer(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if len(args) < 2 || len(args) > 4 {
 		return sl_error(fn, "syntax: <peer: string>, <headers: dictionary>, [content: dictionary], [data: bytes]")
@@ -504,15 +588,58 @@ func api_message_send_peer(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 		m.add(sl_decode(args[3]))
 	}
 
-	// Parse expires kwarg (seconds from now)
+	// Parse expires kwarg (seconds from now), and ack kwarg
+	ack := ""
 	for _, kw := range kwargs {
-		if string(kw[0].(sl.String)) == "expires" {
+		switch string(kw[0].(sl.String)) {
+		case "expires":
 			if v, ok := kw[1].(sl.Int); ok {
 				m.expires = now() + v.BigInt().Int64()
 			}
+		case "after":
+			v, ok := kw[1].(sl.Int)
+			if !ok || v.BigInt().Int64() < 0 || v.BigInt().Int64() > queue_after_max {
+				return sl_error(fn, "invalid after")
+			}
+			if v.BigInt().Int64() > 0 {
+				m.after = now() + v.BigInt().Int64()
+			}
+		case "priority":
+			priority, _ := sl.AsString(kw[1])
+			switch priority {
+			case "interactive":
+				m.priority = priority_interactive
+			case "bulk":
+				m.priority = priority_bulk
+			default:
+				return sl_error(fn, "invalid priority %q", priority)
+			}
+		case "key":
+			key, _ := sl.AsString(kw[1])
+			if !valid(key, "constant") {
+				return sl_error(fn, "invalid key %q", key)
+			}
+			m.key = key
+		case "ack":
+			ack, _ = sl.AsString(kw[1])
+			if !event_ack_valid(ack) {
+				return sl_error(fn, "invalid ack %q", ack)
+			}
+			if app == nil {
+				return sl_error(fn, "ack requires an app")
+			}
 		}
 	}
+	if m.after > 0 && m.expires > 0 && m.expires <= m.after {
+		return sl_error(fn, "message expires before it is due")
+	}
+	if ack != "" {
+		event_ack_request(m, user, app, ack)
+	}
 
 	m.send_peer(peer)
+	if ack != "" {
+		return sl.String(m.ID), nil
+	}
 	return sl.None, nil
 }
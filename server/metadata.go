@@ -0,0 +1,214 @@
+// Mochi server: Server metadata document
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+//
+// /.well-known/mochi describes this server: its version, the protocols and
+// protocol versions it speaks, its registration policy and the public
+// services its installed apps provide. A peer or crawler can fetch it over plain HTTP
+// before opening any stream, to check compatibility or count the network.
+// The document is signed with the host key, so a copy relayed by anyone
+// else can still be checked against the peer id it names.
+//
+// The same facts are offered as NodeInfo 2.1, found through
+// /.well-known/nodeinfo, for the fediverse's statistics tools. The user
+// count is left out of both unless statistics_publish is on.
+
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Domain separator for the metadata signable. Any schema change MUST bump it.
+const metadata_domain = "mochi/2/metadata"
+
+// How long a built document is served before it's rebuilt and re-signed
+const metadata_lifetime = 300
+
+const nodeinfo_schema = "http://nodeinfo.diaspora.software/ns/schema/2.1"
+
+var (
+	metadata_cached       map[string]any
+	metadata_cached_built int64
+	metadata_lock         sync.Mutex
+)
+
+// metadata_services returns the public services of installed apps: those
+// declared by an app's default version, which doesn't require a role
+func metadata_services() []string {
+	apps_lock.Lock()
+	x := app_index_locked()
+	services := make([]string, 0, len(x.services))
+	for s, candidates := range x.services {
+		for _, a := range app_index_declaring(nil, candidates, app_version_services, s) {
+			if a.active_locked(nil).user_allowed(nil) {
+				services = append(services, s)
+				break
+			}
+		}
+	}
+	apps_lock.Unlock()
+	slices.Sort(services)
+	return services
+}
+
+// metadata_registration is how new users can join: "open" for anyone, or
+// "invite" for those invited
+func metadata_registration() string {
+	if setting_signup_enabled() {
+		return "open"
+	}
+	return "invite"
+}
+
+// metadata_users returns the number of active users, not counting guests,
+// or -1 if it isn't published
+func metadata_users() int {
+	if setting_get("statistics_publish", "false") != "true" {
+		return -1
+	}
+	return db_open("db/users.db").integer("select count(*) from users where status='active' and role != 'guest'")
+}
+
+// metadata_versions returns the protocol versions spoken, as strings
+func metadata_versions() []string {
+	versions := make([]string, 0, len(protocol_versions))
+	for _, v := range protocol_versions {
+		versions = append(versions, itoa(v))
+	}
+	return versions
+}
+
+// metadata_signable returns the canonical CBOR the host signs over a
+// document. Values are all strings, booleans or lists of strings, so the
+// document decoded from JSON re-encodes to the same bytes.
+func metadata_signable(document map[string]any) ([]byte, error) {
+	return canonical_encoder.Marshal(map[string]any{
+		"v":        metadata_domain,
+		"document": document,
+	})
+}
+
+// metadata_document builds and signs this server's metadata document
+func metadata_document() map[string]any {
+	document := map[string]any{
+		"software":     "mochi",
+		"version":      build_version,
+		"peer":         net_id,
+		"hostname":     peer_names_announce(),
+		"protocols":    []string{protocol_messages, protocol_stream},
+		"versions":     metadata_versions(),
+		"codecs":       receiver_codecs(),
+		"features":     receiver_features(),
+		"registration": metadata_registration(),
+		"guests":       setting_get("guests_enabled", "false") == "true",
+		"services":     metadata_services(),
+		"issued":       i64toa(now()),
+	}
+	if users := metadata_users(); users >= 0 {
+		document["users"] = itoa(users)
+	}
+
+	signable, err := metadata_signable(document)
+	if err != nil {
+		warn("Metadata canonical encode failed: %v", err)
+		return document
+	}
+	document["signature"] = base58_encode(server_sign(signable))
+	return document
+}
+
+// metadata_current returns the signed document, rebuilt when stale
+func metadata_current() map[string]any {
+	metadata_lock.Lock()
+	defer metadata_lock.Unlock()
+	if metadata_cached == nil || now()-metadata_cached_built >= metadata_lifetime {
+		metadata_cached = metadata_document()
+		metadata_cached_built = now()
+	}
+	return metadata_cached
+}
+
+// metadata_verify checks a fetched document's signature against the peer
+// it names
+func metadata_verify(document map[string]any) bool {
+	peer, _ := document["peer"].(string)
+	signature, _ := document["signature"].(string)
+	if peer == "" || signature == "" {
+		return false
+	}
+	unsigned := make(map[string]any, len(document))
+	for k, v := range document {
+		if k != "signature" {
+			unsigned[k] = v
+		}
+	}
+	signable, err := metadata_signable(unsigned)
+	if err != nil {
+		return false
+	}
+	return server_verify(peer, signable, base58_decode(signature, ""))
+}
+
+// metadata_compatible reports whether a verified document's server speaks a
+// protocol version this one does
+func metadata_compatible(document map[string]any) bool {
+	versions, _ := document["versions"].([]any)
+	for _, v := range versions {
+		if s, ok := v.(string); ok && slices.Contains(protocol_versions, int(atoi(s, 0))) {
+			return true
+		}
+	}
+	return false
+}
+
+// web_metadata is GET /.well-known/mochi
+func web_metadata(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, metadata_current())
+}
+
+// web_nodeinfo_links is GET /.well-known/nodeinfo, pointing to the NodeInfo
+// document
+func web_nodeinfo_links(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.JSON(http.StatusOK, gin.H{
+		"links": []gin.H{{"rel": nodeinfo_schema, "href": request_origin(c) + "/_/nodeinfo/2.1"}},
+	})
+}
+
+// web_nodeinfo is GET /_/nodeinfo/2.1
+func web_nodeinfo(c *gin.Context) {
+	m := metadata_current()
+	usage := gin.H{"users": gin.H{}}
+	if users, found := m["users"].(string); found {
+		usage["users"] = gin.H{"total": atoi(users, 0)}
+	}
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Header("Content-Type", "application/json; profile=\""+nodeinfo_schema+"#\"")
+	c.JSON(http.StatusOK, gin.H{
+		"version": "2.1",
+		"software": gin.H{
+			"name":       "mochi",
+			"version":    build_version,
+			"repository": "https://github.com/mochi-os/core",
+			"homepage":   "https://mochi-os.org",
+		},
+		"protocols":         []string{"mochi"},
+		"services":          gin.H{"inbound": []string{}, "outbound": []string{}},
+		"openRegistrations": m["registration"] == "open",
+		"usage":             usage,
+		"metadata": gin.H{
+			"peer":     m["peer"],
+			"services": m["services"],
+		},
+	})
+}
@@ -0,0 +1,98 @@
+// Mochi server: Server metadata document tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	p2p_crypto "github.com/libp2p/go-libp2p/core/crypto"
+	p2p_peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestMetadata(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	protocol2_init()
+	setup_users_test_schema()
+	db_open("db/settings.db").exec("create table if not exists settings (name text primary key, value text not null)")
+	db_open("db/users.db").exec("insert into users (uid, username) values ('u1', 'alice@example.com'), ('u2', 'bob@example.com')")
+	setting_set("statistics_publish", "true")
+
+	// Only services of apps open to everyone are listed
+	orig_apps := apps
+	apps = map[string]*App{
+		"chat":  {id: "chat", internal: &AppVersion{Services: []string{"chat"}}},
+		"admin": {id: "admin", internal: &AppVersion{Services: []string{"admin"}}},
+	}
+	apps["admin"].internal.Require.Role = "administrator"
+	resolution_invalidate()
+	t.Cleanup(func() {
+		apps = orig_apps
+		resolution_invalidate()
+	})
+
+	private, _, _ := p2p_crypto.GenerateKeyPairWithReader(p2p_crypto.Ed25519, 256, rand.Reader)
+	id, _ := p2p_peer.IDFromPrivateKey(private)
+	orig_private, orig_id := net_private, net_id
+	net_private, net_id = private, id.String()
+	t.Cleanup(func() { net_private, net_id = orig_private, orig_id })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/.well-known/mochi", web_metadata)
+	r.GET("/.well-known/nodeinfo", web_nodeinfo_links)
+	r.GET("/_/nodeinfo/2.1", web_nodeinfo)
+	get := func(path string) map[string]any {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d", path, w.Code)
+		}
+		var out map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return out
+	}
+
+	// The document verifies as fetched, and not once altered
+	document := get("/.well-known/mochi")
+	if document["peer"] != net_id || document["registration"] != "open" || document["users"] != "2" || fmt.Sprint(document["services"]) != "[chat]" {
+		t.Errorf("document %v", document)
+	}
+	if !metadata_verify(document) || !metadata_compatible(document) {
+		t.Error("fetched document does not verify")
+	}
+	document["registration"] = "closed"
+	if metadata_verify(document) {
+		t.Error("altered document verifies")
+	}
+
+	links := get("/.well-known/nodeinfo")["links"].([]any)
+	if href := links[0].(map[string]any)["href"]; href != "http://example.com/_/nodeinfo/2.1" {
+		t.Errorf("nodeinfo link %v", href)
+	}
+	nodeinfo := get("/_/nodeinfo/2.1")
+	if nodeinfo["version"] != "2.1" || nodeinfo["openRegistrations"] != true {
+		t.Errorf("nodeinfo %v", nodeinfo)
+	}
+
+	// Without statistics, there's no user count
+	setting_delete("statistics_publish")
+	setting_set("signup_enabled", "false")
+	metadata_cached = nil
+	document = get("/.well-known/mochi")
+	if _, found := document["users"]; found || document["registration"] != "invite" || !metadata_verify(document) {
+		t.Errorf("document without statistics %v", document)
+	}
+}
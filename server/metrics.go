@@ -0,0 +1,119 @@
+// Mochi server: Prometheus metrics
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics are written in the Prometheus text format. They're always served
+// on the admin socket, at /_/admin/metrics. A scraper that can't reach the
+// socket can use /_/metrics on the web listeners instead, which is only
+// served with [metrics] token set, and only to requests bearing it.
+
+// metrics_label escapes a label value
+var metrics_label = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics_write writes every metric
+func metrics_write(w io.Writer) {
+	gauge := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("mochi_build_info", "Version of the running server.")
+	fmt.Fprintf(w, "mochi_build_info{version=\"%s\"} 1\n", metrics_label.Replace(build_version))
+	gauge("mochi_start_time_seconds", "When the server started, in seconds since the epoch.")
+	fmt.Fprintf(w, "mochi_start_time_seconds %d\n", server_started_at.Unix())
+
+	r := expiry_report_get()
+	gauge("mochi_expiry_checked_timestamp_seconds", "When certificates and keys were last checked.")
+	fmt.Fprintf(w, "mochi_expiry_checked_timestamp_seconds %d\n", r.Checked)
+	gauge("mochi_certificate_expiry_timestamp_seconds", "When each served certificate expires, or 0 if it is missing.")
+	for _, c := range r.Certificates {
+		fmt.Fprintf(w, "mochi_certificate_expiry_timestamp_seconds{domain=\"%s\",source=\"%s\"} %d\n", metrics_label.Replace(c.Domain), c.Source, c.Expires)
+	}
+	gauge("mochi_certificate_renewal_failures", "Consecutive failures to issue each ACME certificate.")
+	for _, c := range r.Certificates {
+		if c.Source == "acme" {
+			fmt.Fprintf(w, "mochi_certificate_renewal_failures{domain=\"%s\"} %d\n", metrics_label.Replace(c.Domain), c.Failures)
+		}
+	}
+	gauge("mochi_passkeys", "Registered passkeys.")
+	fmt.Fprintf(w, "mochi_passkeys %d\n", r.Passkeys)
+	gauge("mochi_passkeys_stale", "Passkeys not used for [expiry] passkeys days.")
+	fmt.Fprintf(w, "mochi_passkeys_stale %d\n", r.Stale)
+	gauge("mochi_entity_keys", "Entity keys held by the server.")
+	fmt.Fprintf(w, "mochi_entity_keys %d\n", r.Keys)
+	gauge("mochi_entity_keys_old", "Entity keys older than [expiry] keys days.")
+	fmt.Fprintf(w, "mochi_entity_keys_old %d\n", r.Old)
+	gauge("mochi_entity_key_oldest_timestamp_seconds", "When the oldest entity key was created.")
+	fmt.Fprintf(w, "mochi_entity_key_oldest_timestamp_seconds %d\n", r.Oldest)
+
+	d := disk_report_get()
+	gauge("mochi_disk_free_bytes", "Bytes free on the filesystem holding each directory.")
+	for _, v := range d.Volumes {
+		fmt.Fprintf(w, "mochi_disk_free_bytes{directory=\"%s\",path=\"%s\"} %d\n", v.Directory, metrics_label.Replace(v.Path), v.Free)
+	}
+	gauge("mochi_disk_size_bytes", "Size of the filesystem holding each directory.")
+	for _, v := range d.Volumes {
+		fmt.Fprintf(w, "mochi_disk_size_bytes{directory=\"%s\",path=\"%s\"} %d\n", v.Directory, metrics_label.Replace(v.Path), v.Size)
+	}
+	gauge("mochi_disk_uploads_paused", "1 if uploads and app installs are refused for lack of disk space.")
+	paused := 0
+	if disk_paused.Load() {
+		paused = 1
+	}
+	fmt.Fprintf(w, "mochi_disk_uploads_paused %d\n", paused)
+
+	g := governor_report_get()
+	gauge("mochi_governor_level", "Load the governor is holding back background work for: 0 normal, 1 elevated, 2 high.")
+	fmt.Fprintf(w, "mochi_governor_level %d\n", governor_level.Load())
+	gauge("mochi_governor_cpu_percent", "CPU use at the governor's last sample.")
+	fmt.Fprintf(w, "mochi_governor_cpu_percent %.1f\n", g.CPU)
+	gauge("mochi_governor_memory_percent", "Memory use at the governor's last sample.")
+	fmt.Fprintf(w, "mochi_governor_memory_percent %.1f\n", g.Memory)
+
+	open, idle, connections := db_pool_stats()
+	gauge("mochi_databases_open", "Databases held open.")
+	fmt.Fprintf(w, "mochi_databases_open %d\n", open)
+	gauge("mochi_databases_idle", "Databases held open that nothing is using.")
+	fmt.Fprintf(w, "mochi_databases_idle %d\n", idle)
+	gauge("mochi_database_connections", "Connections open to the databases held open.")
+	fmt.Fprintf(w, "mochi_database_connections %d\n", connections)
+	fmt.Fprintf(w, "# HELP mochi_databases_closed_total Databases closed for being idle or over [database] open.\n# TYPE mochi_databases_closed_total counter\n")
+	fmt.Fprintf(w, "mochi_databases_closed_total %d\n", db_evicted.Load())
+}
+
+// metrics_serve writes the metrics as a response
+func metrics_serve(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	metrics_write(c.Writer)
+}
+
+// admin_metrics serves the metrics on the admin socket
+func admin_metrics(c *gin.Context) {
+	metrics_serve(c)
+}
+
+// web_metrics serves the metrics to a scraper bearing [metrics] token
+func web_metrics(c *gin.Context) {
+	token := ini_string("metrics", "token", "")
+	given, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" || !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	metrics_serve(c)
+}
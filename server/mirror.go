@@ -0,0 +1,403 @@
+// Mochi server: Mirror nodes
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A mirror is a small server, say a VPS, put in front of a primary server
+// hosted at home, that serves the primary's public pages and attachments
+// without holding any of its data. With [mirror] primary set to the
+// primary's peer ID, the mirror answers every web request except its own
+// health checks by asking the primary over P2P: it opens a stream to the
+// "get" event of the "mirror" service, and the primary runs the request
+// through its own router as an anonymous visitor, answering with a header
+// segment of {status, headers} and then the raw body. Responses the
+// primary lets be cached are kept in the cache directory for [mirror] ttl
+// seconds, and served stale if the primary can't be reached.
+//
+// Nothing private passes through a mirror. Requests carrying a session or
+// other credentials, and anything other than GET or HEAD, are redirected
+// to [mirror] origin if it's set, and otherwise refused. The primary only
+// answers peers listed in its [mirror] allow, and never returns cookies.
+
+const (
+	mirror_ttl_default = 300                // Seconds a response is cached by default
+	mirror_max         = 100 * 1024 * 1024  // Largest response cached
+	mirror_stale       = 7 * 24 * time.Hour // Longest a cached response is served while the primary is unreachable
+	mirror_uri_max     = 8000               // Longest request URI forwarded
+)
+
+var (
+	mirror_primary string
+	mirror_origin  string
+	mirror_ttl     int64
+	web_router     http.Handler
+)
+
+// Headers not passed between primary, mirror and client
+var mirror_headers_dropped = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Set-Cookie":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// Paths a mirror answers itself
+var mirror_local = map[string]bool{
+	"/_/health":   true,
+	"/_/ping":     true,
+	"/_/p2p/info": true,
+}
+
+// Context key marking a request run for a mirror
+type mirror_context struct{}
+
+type mirror_head struct {
+	Status  int                 `cbor:"status" json:"status"`
+	Headers map[string][]string `cbor:"headers" json:"headers"`
+	Expires int64               `cbor:"-" json:"expires"`
+}
+
+func init() {
+	a := app("mirror")
+	a.service("mirror")
+	a.event_anonymous("get", mirror_get_event)
+}
+
+// mirror_configure reads [mirror]
+func mirror_configure() {
+	mirror_primary = ini_string("mirror", "primary", "")
+	mirror_origin = strings.TrimSuffix(ini_string("mirror", "origin", ""), "/")
+	mirror_ttl = int64(ini_int("mirror", "ttl", mirror_ttl_default))
+	if mirror_primary != "" {
+		info("Mirroring public content of primary %q", mirror_primary)
+	}
+}
+
+// mirror_allowed returns whether a peer may mirror this server
+func mirror_allowed(peer string) bool {
+	return peer != "" && string_in_slice(peer, ini_strings_commas("mirror", "allow"))
+}
+
+// Answer a request from a mirror by running it through the web router as
+// an anonymous visitor
+func mirror_get_event(e *Event) {
+	if e.stream == nil {
+		return
+	}
+	if !mirror_allowed(e.peer) {
+		info("Mirror request from peer %q refused; not in [mirror] allow", e.peer)
+		e.stream.write(mirror_head{Status: http.StatusForbidden})
+		return
+	}
+	r := mirror_request(e)
+	if r == nil || web_router == nil {
+		e.stream.write(mirror_head{Status: http.StatusBadRequest})
+		return
+	}
+
+	w := &mirror_writer{stream: e.stream, header: http.Header{}}
+	web_router.ServeHTTP(w, r)
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		debug("Mirror answer to peer %q interrupted: %v", e.peer, w.err)
+	}
+}
+
+// mirror_request builds the anonymous request a mirror asked for
+func mirror_request(e *Event) *http.Request {
+	uri := e.get("uri", "")
+	host := e.get("host", "")
+	if len(uri) > mirror_uri_max || !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") || !valid(uri, "line") {
+		return nil
+	}
+	if host != "" && (!valid(host, "line") || strings.ContainsAny(host, "/ ")) {
+		return nil
+	}
+	r, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil
+	}
+	r = r.WithContext(context.WithValue(r.Context(), mirror_context{}, true))
+	r.RequestURI = uri
+	r.Host = host
+	r.RemoteAddr = "127.0.0.1:0"
+	if ip := net.ParseIP(e.get("ip", "")); ip != nil {
+		r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+	}
+	for field, header := range map[string]string{"accept": "Accept", "language": "Accept-Language", "dest": "Sec-Fetch-Dest", "agent": "User-Agent"} {
+		if v := e.get(field, ""); v != "" && valid(v, "line") {
+			r.Header.Set(header, v)
+		}
+	}
+	return r
+}
+
+// mirror_requested returns whether a request is being run for a mirror, so
+// must have its body sent through the stream rather than by a front-end
+// proxy
+func mirror_requested(r *http.Request) bool {
+	return r.Context().Value(mirror_context{}) != nil
+}
+
+// mirror_writer sends a response to a mirror: a header segment once the
+// status is known, then the body as raw bytes
+type mirror_writer struct {
+	stream  *Stream
+	header  http.Header
+	started bool
+	err     error
+}
+
+func (w *mirror_writer) Header() http.Header {
+	return w.header
+}
+
+func (w *mirror_writer) WriteHeader(status int) {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.err = w.stream.write(mirror_head{Status: status, Headers: mirror_headers(w.header)})
+}
+
+func (w *mirror_writer) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.stream.write_raw(b); err != nil {
+		w.err = err
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush is a no-op; each write is already sent
+func (w *mirror_writer) Flush() {}
+
+// mirror_headers copies the headers that may pass between servers
+func mirror_headers(h http.Header) map[string][]string {
+	out := map[string][]string{}
+	for k, v := range h {
+		if !mirror_headers_dropped[http.CanonicalHeaderKey(k)] {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// mirror_middleware answers every request on a mirror from its cache or
+// from the primary
+func mirror_middleware(c *gin.Context) {
+	if mirror_local[c.Request.URL.Path] {
+		c.Next()
+		return
+	}
+	c.Abort()
+
+	if !mirror_public(c.Request) {
+		if mirror_origin != "" {
+			c.Redirect(http.StatusTemporaryRedirect, mirror_origin+c.Request.URL.RequestURI())
+			return
+		}
+		respond_error(c, http.StatusForbidden, "access_denied", "errors.access_denied", nil)
+		return
+	}
+
+	key := mirror_key(c.Request)
+	file := filepath.Join(cache_dir, "mirror", key)
+	head, fresh := mirror_cached(file)
+	if fresh {
+		mirror_serve(c, head, file)
+		return
+	}
+
+	if mirror_fetch(c, file) {
+		return
+	}
+	if head != nil && time.Since(time.Unix(head.Expires, 0)) < mirror_stale {
+		debug("Mirror serving stale %q; primary unreachable", c.Request.URL.Path)
+		mirror_serve(c, head, file)
+		return
+	}
+	respond_error(c, http.StatusBadGateway, "source_unreachable", "errors.source_unreachable", nil)
+}
+
+// mirror_public returns whether a request can be answered by a mirror
+func mirror_public(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if _, err := r.Cookie("session"); err == nil {
+		return false
+	}
+	return len(r.URL.RequestURI()) <= mirror_uri_max
+}
+
+// mirror_key identifies a cached response by everything the primary's
+// answer depends on
+func mirror_key(r *http.Request) string {
+	html := "0"
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		html = "1"
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{r.Host, r.URL.RequestURI(), r.Header.Get("Accept-Language"), r.Header.Get("Sec-Fetch-Dest"), html}, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// mirror_cached reads a cached response's header, and whether it is fresh
+func mirror_cached(file string) (*mirror_head, bool) {
+	data, err := os.ReadFile(file + ".json")
+	if err != nil {
+		return nil, false
+	}
+	var head mirror_head
+	if json.Unmarshal(data, &head) != nil {
+		return nil, false
+	}
+	if _, err := os.Stat(file); err != nil {
+		return nil, false
+	}
+	return &head, now() < head.Expires
+}
+
+// mirror_serve sends a cached response, with ranges and conditional
+// requests handled here
+func mirror_serve(c *gin.Context, head *mirror_head, file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		respond_error(c, http.StatusBadGateway, "source_unreachable", "errors.source_unreachable", nil)
+		return
+	}
+	defer f.Close()
+	for k, v := range head.Headers {
+		c.Writer.Header()[k] = v
+	}
+	var modified time.Time
+	if t, err := http.ParseTime(c.Writer.Header().Get("Last-Modified")); err == nil {
+		modified = t
+	}
+	http.ServeContent(c.Writer, c.Request, "", modified, f)
+}
+
+// mirror_cacheable returns whether a response from the primary may be
+// cached. Every response was made for an anonymous visitor, so "private",
+// which the primary sets on attachments to keep shared caches from holding
+// files it serves to signed in users, doesn't stop a mirror caching it.
+func mirror_cacheable(head *mirror_head) bool {
+	if head.Status != http.StatusOK || mirror_ttl <= 0 {
+		return false
+	}
+	control := strings.ToLower(strings.Join(head.Headers["Cache-Control"], ","))
+	return !strings.Contains(control, "no-store")
+}
+
+// mirror_fetch asks the primary for a response, caching it if allowed.
+// Returns false if the primary couldn't be reached, having sent nothing.
+func mirror_fetch(c *gin.Context, file string) bool {
+	peer := remote_reach([]string{mirror_primary})
+	if peer == "" {
+		return false
+	}
+	s, err := stream_to_peer(peer, "", "", "mirror", "get", "", nil)
+	if err != nil {
+		debug("Mirror unable to open stream to primary: %v", err)
+		return false
+	}
+	defer s.close()
+
+	r := c.Request
+	if err := s.write(map[string]string{"uri": r.URL.RequestURI(), "host": r.Host, "accept": r.Header.Get("Accept"), "language": r.Header.Get("Accept-Language"), "dest": r.Header.Get("Sec-Fetch-Dest"), "agent": r.UserAgent(), "ip": c.ClientIP()}); err != nil {
+		debug("Mirror unable to send request to primary: %v", err)
+		return false
+	}
+	var head mirror_head
+	if err := s.read(&head); err != nil || head.Status == 0 {
+		debug("Mirror received no answer from primary: %v", err)
+		return false
+	}
+	if head.Status == http.StatusForbidden && len(head.Headers) == 0 {
+		warn("Mirror refused by primary %q; add this server's peer ID %q to its [mirror] allow", mirror_primary, net_id)
+	}
+	body := s.raw_reader()
+
+	if mirror_cacheable(&head) {
+		partial, ok := mirror_store(file, &head, body)
+		if ok {
+			mirror_serve(c, &head, file)
+			return true
+		}
+		// Too large to cache, or the cache couldn't be written, so send
+		// what was read and then the rest
+		if f, err := os.Open(partial); err == nil {
+			defer f.Close()
+			os.Remove(partial)
+			body = io.MultiReader(f, body)
+		}
+	}
+
+	for k, v := range head.Headers {
+		c.Writer.Header()[k] = v
+	}
+	c.Status(head.Status)
+	if r.Method != http.MethodHead {
+		io.Copy(c.Writer, body)
+	}
+	return true
+}
+
+// mirror_store writes a response to the cache, returning false if it is
+// larger than mirror_max or couldn't be written, along with the file
+// holding whatever was read of it
+func mirror_store(file string, head *mirror_head, body io.Reader) (string, bool) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		warn("Mirror unable to create cache directory: %v", err)
+		return "", false
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), "partial-*")
+	if err != nil {
+		warn("Mirror unable to create cache file: %v", err)
+		return "", false
+	}
+	partial := f.Name()
+	n, err := io.Copy(f, io.LimitReader(body, mirror_max+1))
+	f.Close()
+	if err != nil || n > mirror_max {
+		return partial, false
+	}
+
+	head.Expires = now() + mirror_ttl
+	if err := os.WriteFile(file+".json", []byte(json_encode(head)), 0644); err != nil {
+		return partial, false
+	}
+	if err := os.Rename(partial, file); err != nil {
+		return partial, false
+	}
+	return "", true
+}
@@ -0,0 +1,180 @@
+// Mochi server: Mirror node tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mirror_test_ask runs a mirror request through mirror_get_event as peer,
+// returning the header and body the mirror would receive
+func mirror_test_ask(t *testing.T, peer string, content map[string]any) (mirror_head, string) {
+	t.Helper()
+	r, w := io.Pipe()
+	e := &Event{peer: peer, content: content, stream: stream_rw(&pipe_reader{PipeReader: r}, &pipe_writer{PipeWriter: w})}
+	go func() {
+		mirror_get_event(e)
+		e.stream.close()
+	}()
+
+	var head mirror_head
+	if err := e.stream.read(&head); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(e.stream.raw_reader())
+	return head, string(body)
+}
+
+func TestMirrorAnswer(t *testing.T) {
+	saved := web_router
+	t.Cleanup(func() { web_router = saved })
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/page", func(c *gin.Context) {
+		c.SetCookie("session", "leak", 60, "/", "", false, true)
+		c.Header("Cache-Control", "public, max-age=60")
+		c.String(200, "host=%s language=%s ip=%s mirror=%v cookie=%q", c.Request.Host, c.GetHeader("Accept-Language"), c.ClientIP(), mirror_requested(c.Request), c.GetHeader("Cookie"))
+	})
+	web_router = router
+
+	content := map[string]any{"uri": "/page?x=1", "host": "example.com", "language": "fr", "ip": "203.0.113.9"}
+	if head, _ := mirror_test_ask(t, "12D3KooWMirror", content); head.Status != http.StatusForbidden {
+		t.Fatalf("unlisted peer answered with %d", head.Status)
+	}
+
+	t.Setenv("MOCHI_MIRROR_ALLOW", "12D3KooWOther, 12D3KooWMirror")
+	head, body := mirror_test_ask(t, "12D3KooWMirror", content)
+	if head.Status != http.StatusOK || body != `host=example.com language=fr ip=203.0.113.9 mirror=true cookie=""` {
+		t.Fatalf("answer %d %q", head.Status, body)
+	}
+	if _, found := head.Headers["Set-Cookie"]; found {
+		t.Error("cookie passed to mirror")
+	}
+	if head.Headers["Cache-Control"][0] != "public, max-age=60" {
+		t.Errorf("headers %v", head.Headers)
+	}
+
+	for _, uri := range []string{"page", "//elsewhere/page", "/page\nInjected: 1"} {
+		if head, _ := mirror_test_ask(t, "12D3KooWMirror", map[string]any{"uri": uri}); head.Status != http.StatusBadRequest {
+			t.Errorf("uri %q answered with %d", uri, head.Status)
+		}
+	}
+}
+
+func TestMirrorPublic(t *testing.T) {
+	request := func(method string, headers ...string) *http.Request {
+		r := httptest.NewRequest(method, "/page", nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		return r
+	}
+	if !mirror_public(request("GET")) || !mirror_public(request("HEAD", "Cookie", "theme=dark")) {
+		t.Error("anonymous request not public")
+	}
+	for name, r := range map[string]*http.Request{
+		"POST":          request("POST"),
+		"session":       request("GET", "Cookie", "session=abc"),
+		"authorization": request("GET", "Authorization", "Bearer abc"),
+		"websocket":     request("GET", "Upgrade", "websocket"),
+	} {
+		if mirror_public(r) {
+			t.Errorf("%s request public", name)
+		}
+	}
+
+	// Private requests go to the origin if there is one
+	saved := mirror_origin
+	t.Cleanup(func() { mirror_origin = saved })
+	mirror_origin = "https://home.example.com"
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = request("POST")
+	mirror_middleware(c)
+	if c.Writer.Status() != http.StatusTemporaryRedirect || w.Header().Get("Location") != "https://home.example.com/page" {
+		t.Errorf("private request answered %d %q", c.Writer.Status(), w.Header().Get("Location"))
+	}
+}
+
+func TestMirrorKey(t *testing.T) {
+	base := httptest.NewRequest("GET", "http://example.com/page", nil)
+	key := mirror_key(base)
+	for name, change := range map[string]func(r *http.Request){
+		"host":     func(r *http.Request) { r.Host = "other.example.com" },
+		"query":    func(r *http.Request) { r.URL.RawQuery = "x=1" },
+		"language": func(r *http.Request) { r.Header.Set("Accept-Language", "de") },
+		"shell":    func(r *http.Request) { r.Header.Set("Accept", "text/html") },
+	} {
+		r := base.Clone(base.Context())
+		change(r)
+		if mirror_key(r) == key {
+			t.Errorf("%s change kept the key", name)
+		}
+	}
+	r := base.Clone(base.Context())
+	r.Header.Set("User-Agent", "other")
+	if mirror_key(r) != key {
+		t.Error("user agent changed the key")
+	}
+}
+
+func TestMirrorCache(t *testing.T) {
+	saved_dir, saved_ttl := cache_dir, mirror_ttl
+	t.Cleanup(func() { cache_dir, mirror_ttl = saved_dir, saved_ttl })
+	cache_dir = t.TempDir()
+	mirror_ttl = 60
+	file := filepath.Join(cache_dir, "mirror", "key")
+
+	for control, cacheable := range map[string]bool{"": true, "private, must-revalidate": true, "no-store": false} {
+		head := &mirror_head{Status: 200, Headers: map[string][]string{"Cache-Control": {control}}}
+		if mirror_cacheable(head) != cacheable {
+			t.Errorf("Cache-Control %q cacheable %v", control, !cacheable)
+		}
+	}
+	if mirror_cacheable(&mirror_head{Status: 404}) {
+		t.Error("404 cacheable")
+	}
+
+	if _, fresh := mirror_cached(file); fresh {
+		t.Fatal("cached before stored")
+	}
+	head := &mirror_head{Status: 200, Headers: map[string][]string{"Content-Type": {"text/plain"}}}
+	if _, ok := mirror_store(file, head, strings.NewReader("0123456789")); !ok {
+		t.Fatal("store failed")
+	}
+	cached, fresh := mirror_cached(file)
+	if !fresh || cached.Headers["Content-Type"][0] != "text/plain" {
+		t.Fatalf("cached %+v fresh %v", cached, fresh)
+	}
+
+	// Served from the cache with ranges
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/page", nil)
+	c.Request.Header.Set("Range", "bytes=2-4")
+	mirror_serve(c, cached, file)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("served %d %q %q", w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+	}
+
+	// Expired responses are kept, to serve while the primary is unreachable
+	cached.Expires = now() - 1
+	os.WriteFile(file+".json", []byte(json_encode(cached)), 0644)
+	if stale, fresh := mirror_cached(file); fresh || stale == nil {
+		t.Errorf("expired response cached %+v fresh %v", stale, fresh)
+	}
+}
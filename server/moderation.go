@@ -0,0 +1,453 @@
+// Mochi server: Moderation
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Users report abusive entities, and optionally one of their objects, from
+// any app. Reports wait in db/moderation.db for the server's administrators
+// to triage, and as they accumulate may trigger actions automatically: the
+// moderation_*_reports settings give how many distinct users must report
+// before an object is hidden, an entity's inbound events are rate limited,
+// or the peers serving an entity are blocked. Zero turns a rule off.
+// Administrators can take or lift the same actions directly.
+//
+// Separately, each user keeps their own block list, which drops events from
+// the blocked entities to them. When blocking, an app may pass the user's
+// contacts, who are each told of the decision as an advisory they can act
+// on; core never blocks on someone else's word.
+
+const (
+	moderation_reason_limit = 100
+	moderation_detail_limit = 10000
+	moderation_limit_period = 86400
+	moderation_block_period = 7 * 86400
+)
+
+var moderation_kinds = map[string]bool{
+	"hide":  true, // target is an object of an app
+	"limit": true, // target is an entity
+	"block": true, // target is a peer
+}
+
+var (
+	moderation_peers      map[string]int64
+	moderation_peers_lock sync.Mutex
+)
+
+var api_moderation = sls.FromStringDict(sl.String("mochi.moderation"), sl.StringDict{
+	"act":        sl.NewBuiltin("mochi.moderation.act", api_moderation_act),
+	"actions":    sl.NewBuiltin("mochi.moderation.actions", api_moderation_actions),
+	"advisories": sl.NewBuiltin("mochi.moderation.advisories", api_moderation_advisories),
+	"block":      sl.NewBuiltin("mochi.moderation.block", api_moderation_block),
+	"blocks":     sl.NewBuiltin("mochi.moderation.blocks", api_moderation_blocks),
+	"hidden":     sl.NewBuiltin("mochi.moderation.hidden", api_moderation_hidden),
+	"lift":       sl.NewBuiltin("mochi.moderation.lift", api_moderation_lift),
+	"report":     sl.NewBuiltin("mochi.moderation.report", api_moderation_report),
+	"reports":    sl.NewBuiltin("mochi.moderation.reports", api_moderation_reports),
+	"resolve":    sl.NewBuiltin("mochi.moderation.resolve", api_moderation_resolve),
+	"unblock":    sl.NewBuiltin("mochi.moderation.unblock", api_moderation_unblock),
+})
+
+func init() {
+	a := app("moderation")
+	a.service("moderation")
+	a.event("advisory", moderation_advisory_event)
+}
+
+// moderation_db opens the server's reports and actions
+func moderation_db() *DB {
+	return db_open_setup("db/moderation.db", func(db *DB) {
+		db.exec("create table if not exists reports (id text not null primary key, user text not null, reporter text not null, app text not null, target text not null, object text not null default '', reason text not null, detail text not null default '', status text not null default 'open', action text not null default '', created integer not null, resolved integer not null default 0, resolver text not null default '', unique (user, app, target, object))")
+		db.exec("create index if not exists reports_status_created on reports(status, created)")
+		db.exec("create table if not exists actions (kind text not null, app text not null default '', target text not null, reason text not null default '', created integer not null, expires integer not null default 0, primary key (kind, app, target))")
+	})
+}
+
+// moderation_setup creates a user's block list and received advisories
+func (db *DB) moderation_setup() {
+	db.exec("create table if not exists blocks (entity text not null primary key, created integer not null)")
+	db.exec("create table if not exists advisories (entity text not null, from_entity text not null, reason text not null default '', created integer not null, primary key (entity, from_entity))")
+}
+
+// moderation_action records an action, replacing any on the same target
+func moderation_action(kind, app, target, reason string, period int64) {
+	expires := int64(0)
+	if period > 0 {
+		expires = now() + period
+	}
+	moderation_db().exec("replace into actions (kind, app, target, reason, created, expires) values (?, ?, ?, ?, ?, ?)", kind, app, target, reason, now(), expires)
+	if kind == "block" {
+		moderation_peers_reload()
+	}
+}
+
+// moderation_active reports whether an action is in force on a target
+func moderation_active(kind, app, target string) bool {
+	found, _ := moderation_db().exists("select 1 from actions where kind=? and app=? and target=? and (expires=0 or expires>?)", kind, app, target, now())
+	return found
+}
+
+// moderation_peers_reload refreshes the cached set of blocked peers
+func moderation_peers_reload() {
+	peers := map[string]int64{}
+	rows, _ := moderation_db().rows("select target, expires from actions where kind='block'")
+	for _, r := range rows {
+		if peer, _ := r["target"].(string); peer != "" {
+			peers[peer] = event_int64(r["expires"])
+		}
+	}
+	moderation_peers_lock.Lock()
+	moderation_peers = peers
+	moderation_peers_lock.Unlock()
+}
+
+// moderation_peer_blocked reports whether a peer is blocked by this server
+func moderation_peer_blocked(peer string) bool {
+	moderation_peers_lock.Lock()
+	loaded := moderation_peers != nil
+	moderation_peers_lock.Unlock()
+	if !loaded {
+		moderation_peers_reload()
+	}
+	moderation_peers_lock.Lock()
+	defer moderation_peers_lock.Unlock()
+	expires, found := moderation_peers[peer]
+	return found && (expires == 0 || expires > now())
+}
+
+// moderation_refuse returns why an inbound event should be dropped: its
+// peer is blocked, its sender is rate limited and over the limit, or its
+// recipient has blocked the sender
+func (e *Event) moderation_refuse() error {
+	if e.peer != "" && e.peer != net_id && moderation_peer_blocked(e.peer) {
+		return fmt.Errorf("peer %q blocked", e.peer)
+	}
+	if e.from == "" {
+		return nil
+	}
+	if moderation_active("limit", "", e.from) && !rate_limit_moderation.allow(e.from) {
+		return fmt.Errorf("sender %q rate limited", e.from)
+	}
+	if e.user != nil {
+		if blocked, _ := db_user(e.user, "user").exists("select 1 from blocks where entity=?", e.from); blocked {
+			return fmt.Errorf("sender %q blocked by recipient", e.from)
+		}
+	}
+	return nil
+}
+
+// moderation_threshold returns a report-count setting, 0 if off
+func moderation_threshold(name string) int {
+	return int(atoi(setting_get(name, system_settings[name].Default), 0))
+}
+
+// moderation_automate takes any actions a new report brings to its threshold
+func moderation_automate(app, target, object string) {
+	db := moderation_db()
+	if n := moderation_threshold("moderation_hide_reports"); n > 0 && object != "" {
+		if db.integer("select count(distinct user) from reports where app=? and object=? and status='open'", app, object) >= n && !moderation_active("hide", app, object) {
+			info("Moderation hiding %q in app %q after reports", object, app)
+			moderation_action("hide", app, object, "reports", 0)
+		}
+	}
+
+	reporters := db.integer("select count(distinct user) from reports where target=? and status='open'", target)
+	if n := moderation_threshold("moderation_limit_reports"); n > 0 && reporters >= n && !moderation_active("limit", "", target) {
+		info("Moderation rate limiting %q after reports", target)
+		moderation_action("limit", "", target, "reports", moderation_limit_period)
+	}
+	if n := moderation_threshold("moderation_block_reports"); n > 0 && reporters >= n {
+		for _, peer := range entity_peers_for("", target) {
+			if peer != net_id && !moderation_active("block", "", peer) {
+				info("Moderation blocking peer %q serving %q after reports", peer, target)
+				moderation_action("block", "", peer, "reports", moderation_block_period)
+			}
+		}
+	}
+}
+
+// moderation_advisory_event receives a contact's decision to block an entity
+func moderation_advisory_event(e *Event) {
+	entity := e.get("entity", "")
+	reason := e.get("reason", "")
+	if e.user == nil || e.from == "" || !valid(entity, "entity") || len(reason) > moderation_reason_limit {
+		return
+	}
+	db_user(e.user, "user").exec("replace into advisories (entity, from_entity, reason, created) values (?, ?, ?, ?)", entity, e.from, reason, now())
+	websockets_send(e.user, "moderation", map[string]any{"entity": entity, "from": e.from, "reason": reason})
+}
+
+// moderation_admin checks the caller may triage reports
+func moderation_admin(t *sl.Thread, fn *sl.Builtin) (*User, error) {
+	if err := require_permission(t, fn, "moderation/manage"); err != nil {
+		return nil, err
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || !user.administrator() {
+		return nil, fmt.Errorf("not administrator")
+	}
+	return user, nil
+}
+
+// mochi.moderation.report(target, reason, object?, detail?, from?) -> string:
+// Report an entity, or one of its objects in the calling app, to this
+// server's administrators. Reporting the same thing again replaces the
+// earlier report. Returns the report id.
+func api_moderation_report(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var target, reason, object, detail, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "target", &target, "reason", &reason, "object?", &object, "detail?", &detail, "from?", &from); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(target, "entity") {
+		return sl_error(fn, "invalid target")
+	}
+	if !valid(reason, "constant") || len(reason) > moderation_reason_limit {
+		return sl_error(fn, "invalid reason %q", reason)
+	}
+	if len(object) > comment_object_limit || len(detail) > moderation_detail_limit {
+		return sl_error(fn, "report too large")
+	}
+	reporter := group_acting(user, from)
+	if reporter == "" {
+		return sl_error(fn, "invalid from")
+	}
+
+	db := moderation_db()
+	id := uid()
+	if row, _ := db.row("select id from reports where user=? and app=? and target=? and object=?", user.UID, app.id, target, object); row != nil {
+		id, _ = row["id"].(string)
+	}
+	db.exec("replace into reports (id, user, reporter, app, target, object, reason, detail, status, created) values (?, ?, ?, ?, ?, ?, ?, ?, 'open', ?)", id, user.UID, reporter, app.id, target, object, reason, detail, now())
+	moderation_automate(app.id, target, object)
+	return sl.String(id), nil
+}
+
+// mochi.moderation.hidden(object) -> bool: Whether this server has hidden
+// an object of the calling app
+func api_moderation_hidden(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object); err != nil {
+		return nil, err
+	}
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+	return sl.Bool(moderation_active("hide", app.id, object)), nil
+}
+
+// mochi.moderation.block(entity, contacts?, reason?) -> bool: Block an
+// entity from sending you events, telling each of the given contacts
+func api_moderation_block(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity, reason string
+	var contacts *sl.List
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "contacts?", &contacts, "reason?", &reason); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(entity, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+	if len(reason) > moderation_reason_limit {
+		return sl_error(fn, "reason too long")
+	}
+	db_user(user, "user").exec("insert or ignore into blocks (entity, created) values (?, ?)", entity, now())
+
+	if contacts != nil && user.Identity != nil {
+		for i := 0; i < contacts.Len(); i++ {
+			to, ok := sl.AsString(contacts.Index(i))
+			if !ok || !valid(to, "entity") || to == entity {
+				continue
+			}
+			m := message(user.Identity.ID, to, "moderation", "advisory")
+			m.set("entity", entity, "reason", reason)
+			m.FromApp = app.id
+			m.send()
+		}
+	}
+	return sl.True, nil
+}
+
+// mochi.moderation.unblock(entity) -> bool: Unblock an entity
+func api_moderation_unblock(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity); err != nil {
+		return nil, err
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	db_user(user, "user").exec("delete from blocks where entity=?", entity)
+	return sl.True, nil
+}
+
+// mochi.moderation.blocks() -> list: List the entities you have blocked
+func api_moderation_blocks(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	rows, err := db_user(user, "user").rows("select entity, created from blocks order by created desc")
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.moderation.advisories() -> list: List entities your contacts have
+// told you they blocked, as {entity, from, reason, created}
+func api_moderation_advisories(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	rows, err := db_user(user, "user").rows("select entity, from_entity as \"from\", reason, created from advisories order by created desc")
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.moderation.reports(status?) -> list: List reports, "open" unless
+// status is given. Administrators only.
+func api_moderation_reports(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	status := "open"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "status?", &status); err != nil {
+		return nil, err
+	}
+	if _, err := moderation_admin(t, fn); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	rows, err := moderation_db().rows("select id, reporter, app, target, object, reason, detail, status, action, created, resolved, resolver from reports where status=? order by created", status)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.moderation.resolve(id, status, action?) -> bool: Close a report as
+// "resolved" or "dismissed", optionally taking an action on what it
+// reported: "hide" its object, "limit" its target, or "block" the target's
+// peers. Administrators only.
+func api_moderation_resolve(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, status, action string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "status", &status, "action?", &action); err != nil {
+		return nil, err
+	}
+	user, err := moderation_admin(t, fn)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if status != "resolved" && status != "dismissed" {
+		return sl_error(fn, "invalid status %q", status)
+	}
+	if action != "" && !moderation_kinds[action] {
+		return sl_error(fn, "invalid action %q", action)
+	}
+
+	db := moderation_db()
+	row, _ := db.row("select app, target, object, reason from reports where id=?", id)
+	if row == nil {
+		return sl_error(fn, "report not found")
+	}
+	app, _ := row["app"].(string)
+	target, _ := row["target"].(string)
+	object, _ := row["object"].(string)
+	reason, _ := row["reason"].(string)
+
+	switch action {
+	case "hide":
+		if object == "" {
+			return sl_error(fn, "report has no object")
+		}
+		moderation_action("hide", app, object, reason, 0)
+	case "limit":
+		moderation_action("limit", "", target, reason, moderation_limit_period)
+	case "block":
+		for _, peer := range entity_peers_for("", target) {
+			if peer != net_id {
+				moderation_action("block", "", peer, reason, 0)
+			}
+		}
+	}
+
+	db.exec("update reports set status=?, action=?, resolved=?, resolver=? where id=?", status, action, now(), user.UID, id)
+	return sl.True, nil
+}
+
+// mochi.moderation.act(kind, target, app?, period?, reason?) -> bool: Take
+// an action directly: "hide" an object of an app, "limit" an entity, or
+// "block" a peer, for period seconds or until lifted. Administrators only.
+func api_moderation_act(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var kind, target, app, reason string
+	var period int
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "kind", &kind, "target", &target, "app?", &app, "period?", &period, "reason?", &reason); err != nil {
+		return nil, err
+	}
+	if _, err := moderation_admin(t, fn); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !moderation_kinds[kind] {
+		return sl_error(fn, "invalid kind %q", kind)
+	}
+	if target == "" || (kind == "limit" && !valid(target, "entity")) || (kind == "hide" && app == "") {
+		return sl_error(fn, "invalid target")
+	}
+	if kind != "hide" {
+		app = ""
+	}
+	if kind == "block" && target == net_id {
+		return sl_error(fn, "cannot block this server")
+	}
+	moderation_action(kind, app, target, reason, int64(period))
+	return sl.True, nil
+}
+
+// mochi.moderation.lift(kind, target, app?) -> bool: Lift an action.
+// Administrators only.
+func api_moderation_lift(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var kind, target, app string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "kind", &kind, "target", &target, "app?", &app); err != nil {
+		return nil, err
+	}
+	if _, err := moderation_admin(t, fn); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	moderation_db().exec("delete from actions where kind=? and app=? and target=?", kind, app, target)
+	if kind == "block" {
+		moderation_peers_reload()
+	}
+	return sl.True, nil
+}
+
+// mochi.moderation.actions() -> list: List actions in force.
+// Administrators only.
+func api_moderation_actions(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if _, err := moderation_admin(t, fn); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	rows, err := moderation_db().rows("select kind, app, target, reason, created, expires from actions where expires=0 or expires>? order by created desc", now())
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
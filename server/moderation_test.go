@@ -0,0 +1,110 @@
+// Mochi server: Moderation tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+)
+
+const (
+	moderation_test_target = "1ModerationTestTargetEntityXXXXXXXXXXXXXXXXXXXXXX"
+	moderation_test_friend = "1ModerationTestFriendEntityXXXXXXXXXXXXXXXXXXXXXX"
+)
+
+func moderation_test_setup(t *testing.T) {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() {
+		moderation_peers_lock.Lock()
+		moderation_peers = nil
+		moderation_peers_lock.Unlock()
+		cleanup_test_data_dir(t)
+	})
+	db_create()
+}
+
+// moderation_test_report files a report as if from a user
+func moderation_test_report(user, object string) {
+	moderation_db().exec("replace into reports (id, user, reporter, app, target, object, reason, created) values (?, ?, ?, 'feeds', ?, ?, 'spam', ?)", uid(), user, user, moderation_test_target, object, now())
+	moderation_automate("feeds", moderation_test_target, object)
+}
+
+func TestModerationAutomatedActions(t *testing.T) {
+	moderation_test_setup(t)
+
+	// Repeat reports by one user count once
+	for i := 0; i < 3; i++ {
+		moderation_test_report("u1", "post/1")
+	}
+	if moderation_active("hide", "feeds", "post/1") {
+		t.Fatal("object hidden on one user's reports")
+	}
+	moderation_test_report("u2", "post/1")
+	moderation_test_report("u3", "post/1")
+	if !moderation_active("hide", "feeds", "post/1") {
+		t.Error("object not hidden after three users reported it")
+	}
+	if moderation_active("hide", "notes", "post/1") {
+		t.Error("hide applied to another app's object")
+	}
+	if moderation_active("limit", "", moderation_test_target) {
+		t.Error("sender limited before threshold")
+	}
+
+	moderation_test_report("u4", "post/2")
+	moderation_test_report("u5", "")
+	if !moderation_active("limit", "", moderation_test_target) {
+		t.Error("sender not limited after five users reported it")
+	}
+}
+
+func TestModerationRefuse(t *testing.T) {
+	moderation_test_setup(t)
+	user := create_permission_test_user(t, "u1")
+
+	e := &Event{from: moderation_test_target, peer: "12D3KooWModerationTestPeer", user: user}
+	if err := e.moderation_refuse(); err != nil {
+		t.Fatalf("event refused with nothing blocked: %v", err)
+	}
+
+	db_user(user, "user").exec("insert into blocks (entity, created) values (?, ?)", moderation_test_target, now())
+	if e.moderation_refuse() == nil {
+		t.Error("event accepted from entity the recipient blocked")
+	}
+	db_user(user, "user").exec("delete from blocks")
+
+	moderation_action("block", "", "12D3KooWModerationTestPeer", "", 0)
+	if e.moderation_refuse() == nil {
+		t.Error("event accepted from blocked peer")
+	}
+	moderation_db().exec("delete from actions")
+	moderation_peers_reload()
+	if moderation_peer_blocked("12D3KooWModerationTestPeer") {
+		t.Error("lifted peer block still cached")
+	}
+}
+
+func TestModerationAdvisoryEvent(t *testing.T) {
+	moderation_test_setup(t)
+	user := create_permission_test_user(t, "u1")
+
+	moderation_advisory_event(&Event{from: moderation_test_friend, user: user, content: map[string]any{"entity": "bad"}})
+	if n := db_user(user, "user").integer("select count(*) from advisories"); n != 0 {
+		t.Error("advisory with invalid entity stored")
+	}
+
+	moderation_advisory_event(&Event{from: moderation_test_friend, user: user, content: map[string]any{"entity": moderation_test_target, "reason": "spam"}})
+	row, _ := db_user(user, "user").row("select from_entity, reason from advisories where entity=?", moderation_test_target)
+	if row == nil || row["from_entity"] != moderation_test_friend || row["reason"] != "spam" {
+		t.Errorf("advisory not stored: %v", row)
+	}
+
+	// An advisory never blocks by itself
+	if blocked, _ := db_user(user, "user").exists("select 1 from blocks"); blocked {
+		t.Error("advisory blocked the entity")
+	}
+}
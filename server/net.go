@@ -48,16 +48,14 @@ var (
 	net_pinger  *p2p_ping.PingService
 )
 
-// Peer discovered using multicast DNS. mDNS is link-scoped, so every
-// address it carries — including loopback from a same-host sibling — is
-// valid for us to store and dial; one connect attempt per event, not
-// per address.
+// Peer discovered using multicast DNS; see mdns.go
 func (n *mdns_notifee) HandlePeerFound(p p2p_peer.AddrInfo) {
+	var addresses []string
 	for _, pa := range p.Addrs {
 		debug("Net received mDNS event from %q at %q", p.ID.String(), pa.String()+"/p2p/"+p.ID.String())
-		peer_discovered_address(p.ID.String(), pa.String()+"/p2p/"+p.ID.String())
+		addresses = append(addresses, pa.String()+"/p2p/"+p.ID.String())
 	}
-	peer_connect(p.ID.String())
+	mdns_found(p.ID.String(), addresses)
 }
 
 // Connect to a peer
@@ -134,21 +132,14 @@ func net_drop_rotated_addresses(peer string, dialErr error) {
 	}
 }
 
-// Start p2p
-func net_start() {
-	// Load bootstrap peers and the default publisher from mochi.conf
-	// (or the hardcoded defaults if unset). Must run before peer code
-	// reads peers_bootstrap.
-	peers_bootstrap_load()
+// net_identity reads or creates the server's key pair, and sets net_id
+// from it. Cluster followers call it without starting the host.
+func net_identity() {
+	if net_private != nil {
+		return
+	}
 
-	// Read or create private/public key pair
-	net_dir := filepath.Join(data_dir, "p2p")
-	key_path := filepath.Join(net_dir, "private.key")
-	if file_exists(key_path) {
-		key_bytes, err := os.ReadFile(key_path)
-		if err != nil {
-			panic(fmt.Sprintf("Net failed to read private key: %v", err))
-		}
+	if key_bytes := net_key_read(); key_bytes != nil {
 		net_private = must(p2p_crypto.UnmarshalPrivateKey(key_bytes))
 	} else {
 		var err error
@@ -160,13 +151,68 @@ func net_start() {
 		if err != nil {
 			panic(fmt.Sprintf("Net failed to marshal private key: %v", err))
 		}
-		if err := os.MkdirAll(net_dir, 0755); err != nil {
-			panic(fmt.Sprintf("Net failed to create directory: %v", err))
+		net_key_write(p)
+	}
+	net_id = must(p2p_peer.IDFromPrivateKey(net_private)).String()
+}
+
+// net_key_read reads the server's marshalled private key, or nil if it has
+// none yet. A key file left from before a secrets provider was configured
+// is moved into the provider.
+func net_key_read() []byte {
+	key_path := filepath.Join(data_dir, "p2p", "private.key")
+	if secrets_enabled() {
+		key_bytes, err := secret_get("p2p")
+		if err == nil {
+			return key_bytes
+		}
+		if !errors.Is(err, secrets_missing) {
+			panic(fmt.Sprintf("Net failed to read private key from secrets provider: %v", err))
 		}
-		if err := os.WriteFile(key_path, p, 0600); err != nil {
-			panic(fmt.Sprintf("Net failed to write private key: %v", err))
+	}
+	if !file_exists(key_path) {
+		return nil
+	}
+
+	key_bytes, err := os.ReadFile(key_path)
+	if err != nil {
+		panic(fmt.Sprintf("Net failed to read private key: %v", err))
+	}
+	if secrets_enabled() {
+		net_key_write(key_bytes)
+		if err := os.Remove(key_path); err != nil {
+			warn("Net unable to remove private key file moved into secrets provider: %v", err)
 		}
+		info("Net private key moved into secrets provider")
 	}
+	return key_bytes
+}
+
+// net_key_write stores the server's marshalled private key
+func net_key_write(p []byte) {
+	if secrets_enabled() {
+		if err := secret_set("p2p", p); err != nil {
+			panic(fmt.Sprintf("Net failed to write private key to secrets provider: %v", err))
+		}
+		return
+	}
+	net_dir := filepath.Join(data_dir, "p2p")
+	if err := os.MkdirAll(net_dir, 0755); err != nil {
+		panic(fmt.Sprintf("Net failed to create directory: %v", err))
+	}
+	if err := os.WriteFile(filepath.Join(net_dir, "private.key"), p, 0600); err != nil {
+		panic(fmt.Sprintf("Net failed to write private key: %v", err))
+	}
+}
+
+// Start p2p
+func net_start() {
+	// Load bootstrap peers and the default publisher from mochi.conf
+	// (or the hardcoded defaults if unset). Must run before peer code
+	// reads peers_bootstrap.
+	peers_bootstrap_load()
+
+	net_identity()
 
 	// Configure resource manager with higher limits
 	limits := p2p_rcmgr.DefaultLimits
@@ -193,12 +239,12 @@ func net_start() {
 
 	// Create p2p instance
 	port := ini_int("p2p", "port", 1443)
+	listen, problems := net_listen_addresses(port, ini_strings_commas("p2p", "listen"))
+	for _, p := range problems {
+		warn("Net listen address skipped: %s", p)
+	}
 	opts := []p2p.Option{
-		p2p.ListenAddrStrings(
-			fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port),
-			fmt.Sprintf("/ip6/::/tcp/%d", port),
-			fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic-v1", port),
-			fmt.Sprintf("/ip6/::/udp/%d/quic-v1", port)),
+		p2p.ListenAddrStrings(listen...),
 		p2p.Identity(net_private),
 		p2p.ResourceManager(rm),
 		p2p.NATPortMap(),
@@ -209,8 +255,19 @@ func net_start() {
 		p2p.EnableHolePunching(holepunch.WithTracer(holepunch_tracer{})),
 		// Rewrite advertised addresses for the 443 fallback (no-op when
 		// off): drop the loopback WebSocket listener, inject the public
-		// WSS address. See fallback.go.
-		p2p.AddrsFactory(fallback_addrs_factory),
+		// WSS address. See fallback.go. Then add the onion address, if
+		// published; see tor.go.
+		p2p.AddrsFactory(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return tor_addrs_factory(fallback_addrs_factory(addrs))
+		}),
+	}
+
+	// Onion service, and dialing peers' onion addresses through Tor. Off
+	// unless [tor] enabled is set; see tor.go.
+	tor_configure()
+	if tor_enabled {
+		tor_start(port)
+		opts = append(opts, p2p.DefaultTransports, p2p.Transport(tor_transport_new))
 	}
 
 	// Hostile-network reachability: also accept libp2p on 443 (QUIC over
@@ -231,7 +288,7 @@ func net_start() {
 
 	net_me = must(p2p.New(opts...))
 	net_id = net_me.ID().String()
-	info("Net listening on port %d with id %q", port, net_id)
+	info("Net listening on %s with id %q", strings.Join(listen, ", "), net_id)
 
 	// Record the loopback WebSocket port for the web server's 443 bridge.
 	fallback_capture()
@@ -275,6 +332,9 @@ func net_start() {
 	// while the higher-priority bootstraps are unavailable.
 	go bootstrap_manager()
 
+	// Connect to peers published in DNS under the [p2p] dns zones
+	go dns_manager()
+
 	// Add peers from database, along with their claimed display names
 	// and signed records
 	peers_add_from_db(100)
@@ -286,7 +346,9 @@ func net_start() {
 	// multicast interface (containers under qemu, certain k8s CNI plugins,
 	// firewalled networks) still reach peers via the DHT and bootstrap nodes,
 	// so a startup failure here shouldn't take the server down.
-	if err := mdns.NewMdnsService(net_me, "mochi", &mdns_notifee{h: net_me}).Start(); err != nil {
+	if mdns_mode() == "false" {
+		info("mDNS peer discovery disabled by [p2p] mdns")
+	} else if err := mdns.NewMdnsService(net_me, "mochi", &mdns_notifee{h: net_me}).Start(); err != nil {
 		warn("mDNS peer discovery disabled: %v", err)
 	}
 
@@ -630,3 +692,33 @@ func server_verify(peer string, data, sig []byte) bool {
 	ok, err := pub.Verify(data, sig)
 	return err == nil && ok
 }
+
+// net_listen_addresses returns the libp2p listen multiaddrs for TCP and
+// QUIC on port at each [p2p] listen address, by default every IPv4 and IPv6
+// interface, and a problem for each address that can't be used. If none
+// can, every interface is used rather than leaving the server unreachable.
+func net_listen_addresses(port int, addresses []string) ([]string, []string) {
+	if len(addresses) == 0 {
+		addresses = []string{"0.0.0.0", "::"}
+	}
+	var listen, problems []string
+	for _, address := range addresses {
+		ip := gonet.ParseIP(address)
+		if ip == nil {
+			problems = append(problems, fmt.Sprintf("%q is not an IP address", address))
+			continue
+		}
+		family := "ip6"
+		if ip.To4() != nil {
+			family = "ip4"
+		}
+		listen = append(listen,
+			fmt.Sprintf("/%s/%s/tcp/%d", family, ip, port),
+			fmt.Sprintf("/%s/%s/udp/%d/quic-v1", family, ip, port))
+	}
+	if len(listen) == 0 {
+		problems = append(problems, "no valid listen addresses; listening on every interface")
+		listen, _ = net_listen_addresses(port, nil)
+	}
+	return listen, problems
+}
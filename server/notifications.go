@@ -0,0 +1,395 @@
+// Mochi server: Notification center
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Notifications are kept per user in the notifications database, one row per
+// notification with the app that raised it. Delivery to the user's connected
+// accounts is governed by a digest mode per app, optionally per category:
+//
+//	immediate  deliver each notification as it is created (the default)
+//	hourly     collect, and deliver one summary at most once an hour
+//	daily      collect, and deliver one summary at most once a day
+//	off        store only; the notification is listed but never pushed
+//
+// High urgency notifications skip hourly and daily batching. Pending digests
+// are tracked per user and mode in db/notifications.db so the digest loop
+// touches only the users who have something waiting, not every user database,
+// and an hourly digest never flushes notifications batched daily.
+
+const (
+	notification_list_maximum = 1000
+	notification_digest_shown = 10 // Titles listed in a digest body
+)
+
+var notification_digest_periods = map[string]int64{
+	"hourly": 3600,
+	"daily":  86400,
+}
+
+var api_notification = sls.FromStringDict(sl.String("mochi.notification"), sl.StringDict{
+	"create": sl.NewBuiltin("mochi.notification.create", api_notification_create),
+	"digest": sl.NewBuiltin("mochi.notification.digest", api_notification_digest),
+	"list":   sl.NewBuiltin("mochi.notification.list", api_notification_list),
+	"mark":   sl.NewBuiltin("mochi.notification.mark", api_notification_mark),
+})
+
+// notifications_setup creates the notification tables in a user's
+// notifications database
+func (db *DB) notifications_setup() {
+	db.exec("create table if not exists notifications (id text not null primary key, app text not null, category text not null default '', object text not null default '', title text not null, body text not null default '', link text not null default '', urgency text not null default 'normal', created integer not null, read integer not null default 0, delivered integer not null default 0)")
+	db.exec("create index if not exists notifications_app_created on notifications(app, created)")
+	db.exec("create index if not exists notifications_delivered on notifications(delivered)")
+	db.exec("create table if not exists notifications_digest (app text not null, category text not null default '', mode text not null, primary key (app, category))")
+}
+
+// notifications_db opens the server-wide record of pending digests
+func notifications_db() *DB {
+	db := db_open("db/notifications.db")
+	db.exec("create table if not exists digests (user text not null, mode text not null, due integer not null, primary key (user, mode))")
+	return db
+}
+
+// notification_mode returns the digest mode for an app and category: the
+// category's own setting, else the app's, else immediate
+func notification_mode(db *DB, app, category string) string {
+	row, _ := db.row("select mode from notifications_digest where app=? and category in (?, '') order by category desc limit 1", app, category)
+	if row != nil {
+		if mode, ok := row["mode"].(string); ok {
+			return mode
+		}
+	}
+	return "immediate"
+}
+
+// notification_create stores a notification and routes it for delivery,
+// returning its id
+func notification_create(u *User, app, category, object, title, body, link, urgency string) string {
+	db := db_user(u, "notifications")
+	id := uid()
+	created := now()
+	db.exec("insert into notifications (id, app, category, object, title, body, link, urgency, created) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", id, app, category, object, title, body, link, urgency, created)
+
+	mode := notification_mode(db, app, category)
+	switch {
+	case mode == "off":
+		db.exec("update notifications set delivered=? where id=?", created, id)
+
+	case mode == "immediate" || urgency == "high":
+		db.exec("update notifications set delivered=? where id=?", created, id)
+		go func() {
+			if _, _, err := account_notify(u, app, category, object, title, body, link, "", id); err != nil {
+				info("Notification delivery failed for user %q: %v", u.UID, err)
+			}
+		}()
+
+	default:
+		// Keep the earliest due time, so a busy app cannot postpone a digest
+		// forever by notifying again before it is sent
+		due := created + notification_digest_periods[mode]
+		notifications_db().exec("insert into digests (user, mode, due) values (?, ?, ?) on conflict (user, mode) do update set due=min(due, excluded.due)", u.UID, mode, due)
+	}
+	return id
+}
+
+// notifications_manager sends digests as they fall due
+func notifications_manager() {
+	for range time.Tick(time.Minute) {
+		notifications_digest_run()
+	}
+}
+
+// notifications_digest_run sends every digest that is due. A digest stays
+// pending until it is sent, so one that fails is retried on the next run.
+func notifications_digest_run() {
+	db := notifications_db()
+	rows, err := db.rows("select user, mode from digests where due <= ?", now())
+	if err != nil {
+		return
+	}
+	for _, row := range rows {
+		uid, _ := row["user"].(string)
+		mode, _ := row["mode"].(string)
+		u := user_by_uid(uid)
+		if u == nil {
+			db.exec("delete from digests where user=?", uid)
+			continue
+		}
+		if err := notification_digest_send(u, mode); err != nil {
+			info("Notification digest failed for user %q: %v", uid, err)
+			continue
+		}
+		db.exec("delete from digests where user=? and mode=?", uid, mode)
+	}
+}
+
+// notification_digest_send delivers one summary of a user's undelivered
+// notifications in a digest mode, and marks them delivered. Undelivered
+// notifications whose app or category is no longer batched go in whichever
+// digest is sent next, so changing the mode never strands them.
+func notification_digest_send(u *User, mode string) error {
+	db := db_user(u, "notifications")
+	rows, err := db.rows("select id, app, category, title from notifications where delivered=0 order by created")
+	if err != nil {
+		return err
+	}
+	var pending []map[string]any
+	for _, r := range rows {
+		app, _ := r["app"].(string)
+		category, _ := r["category"].(string)
+		current := notification_mode(db, app, category)
+		if _, batched := notification_digest_periods[current]; current == mode || !batched {
+			pending = append(pending, r)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var titles []string
+	for i, p := range pending {
+		if i == notification_digest_shown {
+			titles = append(titles, "…")
+			break
+		}
+		title, _ := p["title"].(string)
+		titles = append(titles, title)
+	}
+	title := resolve_core_label(user_language(u), "notifications.digest.title", map[string]any{"count": len(pending)})
+	if _, _, err := account_notify(u, "", "digest", "", title, strings.Join(titles, "\n"), "", "", ""); err != nil {
+		return err
+	}
+
+	done := now()
+	for _, p := range pending {
+		db.exec("update notifications set delivered=? where id=? and delivered=0", done, p["id"])
+	}
+	return nil
+}
+
+// notification_caller returns the user and app a notification builtin acts
+// for
+func notification_caller(t *sl.Thread) (*User, *App, error) {
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return nil, nil, fmt.Errorf("no user")
+	}
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return nil, nil, fmt.Errorf("no app")
+	}
+	return user, app, nil
+}
+
+// notification_scope returns the app whose notifications a call may see:
+// its own, unless it holds notifications/manage and names another or none
+func notification_scope(t *sl.Thread, fn *sl.Builtin, app *App, requested string, given bool) (string, error) {
+	if given && requested == app.id {
+		return requested, nil
+	}
+	if err := require_permission(t, fn, "notifications/manage"); err != nil {
+		if given {
+			return "", err
+		}
+		return app.id, nil
+	}
+	return requested, nil
+}
+
+// mochi.notification.create(category, object, title, body?, link?, urgency?) -> string:
+// Create a notification for the current user from the calling app and route
+// it for delivery according to the user's digest settings. urgency is "low",
+// "normal" (default) or "high". Returns the notification id.
+func api_notification_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "notifications/send"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, app, err := notification_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	var category, object, title, body, link string
+	urgency := "normal"
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs,
+		"category", &category,
+		"object", &object,
+		"title", &title,
+		"body?", &body,
+		"link?", &link,
+		"urgency?", &urgency,
+	); err != nil {
+		return nil, err
+	}
+	if category != "" && !valid(category, "constant") {
+		return sl_error(fn, "invalid category")
+	}
+	if title == "" {
+		return sl_error(fn, "title required")
+	}
+	switch urgency {
+	case "low", "normal", "high":
+	default:
+		return sl_error(fn, "invalid urgency %q", urgency)
+	}
+
+	return sl.String(notification_create(user, app.id, category, object, title, body, link, urgency)), nil
+}
+
+// mochi.notification.list(app?, unread?, limit?, before?) -> list: Notifications
+// for the current user, newest first. Apps see their own notifications;
+// with notifications/manage, all of them, or those of the app named.
+func api_notification_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, app, err := notification_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	var requested sl.Value = sl.None
+	unread := false
+	limit := 100
+	before := 0
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs,
+		"app?", &requested,
+		"unread?", &unread,
+		"limit?", &limit,
+		"before?", &before,
+	); err != nil {
+		return nil, err
+	}
+	name, given := sl.AsString(requested)
+	scope, err := notification_scope(t, fn, app, name, given)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if limit < 1 || limit > notification_list_maximum {
+		return sl_error(fn, "invalid limit")
+	}
+
+	query := "select id, app, category, object, title, body, link, urgency, created, read from notifications where 1=1"
+	var params []any
+	if scope != "" {
+		query += " and app=?"
+		params = append(params, scope)
+	}
+	if unread {
+		query += " and read=0"
+	}
+	if before > 0 {
+		query += " and created<?"
+		params = append(params, before)
+	}
+	query += " order by created desc, id desc limit ?"
+	params = append(params, limit)
+
+	rows, err := db_user(user, "notifications").rows(query, params...)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.notification.mark(id?, object?, read?, app?) -> int: Mark notifications
+// read (default) or unread, by id, by object, or all of the app's if neither
+// is given. Returns the number changed. Scoped as mochi.notification.list.
+func api_notification_mark(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, app, err := notification_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	var id, object string
+	var requested sl.Value = sl.None
+	read := true
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs,
+		"id?", &id,
+		"object?", &object,
+		"read?", &read,
+		"app?", &requested,
+	); err != nil {
+		return nil, err
+	}
+	name, given := sl.AsString(requested)
+	scope, err := notification_scope(t, fn, app, name, given)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	var value int64
+	if read {
+		value = now()
+	}
+	query := "update notifications set read=? where 1=1"
+	params := []any{value}
+	if scope != "" {
+		query += " and app=?"
+		params = append(params, scope)
+	}
+	if id != "" {
+		query += " and id=?"
+		params = append(params, id)
+	}
+	if object != "" {
+		query += " and object=?"
+		params = append(params, object)
+	}
+
+	db := db_user(user, "notifications")
+	result, err := db.internal.Exec(query, params...)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	changed, _ := result.RowsAffected()
+	return sl.MakeInt64(changed), nil
+}
+
+// mochi.notification.digest(app?, category?, mode?) -> string: Get, or with
+// mode set, the user's digest mode ("immediate", "hourly", "daily" or "off")
+// for an app's notifications, or one category of them. Apps may read their
+// own mode; setting a mode, or reading another app's, needs
+// notifications/manage, since the choice is the user's.
+func api_notification_digest(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, app, err := notification_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	target := app.id
+	var category, mode string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs,
+		"app?", &target,
+		"category?", &category,
+		"mode?", &mode,
+	); err != nil {
+		return nil, err
+	}
+	if target != app.id || mode != "" {
+		if err := require_permission(t, fn, "notifications/manage"); err != nil {
+			return sl_error(fn, "%v", err)
+		}
+	}
+
+	db := db_user(user, "notifications")
+	if mode == "" {
+		return sl.String(notification_mode(db, target, category)), nil
+	}
+	switch mode {
+	case "immediate", "hourly", "daily", "off":
+	default:
+		return sl_error(fn, "invalid mode %q", mode)
+	}
+	db.exec("replace into notifications_digest (app, category, mode) values (?, ?, ?)", target, category, mode)
+	return sl.String(mode), nil
+}
@@ -0,0 +1,201 @@
+// Mochi server: Notification center tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+// notification_test_call calls a mochi.notification builtin with keyword
+// arguments on a thread for user and app
+func notification_test_call(t *testing.T, thread *sl.Thread, name string, kwargs map[string]sl.Value) (sl.Value, error) {
+	t.Helper()
+	f, err := api_notification.Attr(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kw []sl.Tuple
+	for k, v := range kwargs {
+		kw = append(kw, sl.Tuple{sl.String(k), v})
+	}
+	return sl.Call(thread, f, nil, kw)
+}
+
+func notification_test_setup(t *testing.T) (*User, *sl.Thread) {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	user := create_permission_test_user(t, "u1")
+	app := create_external_app("chat")
+	permission_grant(user, app.id, "notifications/send")
+	// Batch hourly so tests never start a background delivery
+	db_user(user, "notifications").exec("insert into notifications_digest (app, category, mode) values ('chat', '', 'hourly')")
+	return user, create_test_thread(user, app)
+}
+
+func TestNotificationCreateAndList(t *testing.T) {
+	user, thread := notification_test_setup(t)
+	stranger := create_test_thread(user, create_external_app("stranger"))
+	if _, err := notification_test_call(t, stranger, "create", map[string]sl.Value{"object": sl.String("a"), "title": sl.String("Spam")}); err == nil {
+		t.Error("notification created without notifications/send")
+	}
+	for _, object := range []string{"a", "b"} {
+		_, err := notification_test_call(t, thread, "create", map[string]sl.Value{
+			"category": sl.String("message"),
+			"object":   sl.String(object),
+			"title":    sl.String("New message"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v, err := notification_test_call(t, thread, "list", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sl.Len(v); n != 2 {
+		t.Fatalf("listed %d notifications, want 2", n)
+	}
+
+	// Another app sees none of them, and may not ask for chat's
+	other := create_test_thread(thread.Local("user").(*User), create_external_app("feeds"))
+	v, err = notification_test_call(t, other, "list", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sl.Len(v); n != 0 {
+		t.Errorf("other app listed %d notifications", n)
+	}
+	if _, err := notification_test_call(t, other, "list", map[string]sl.Value{"app": sl.String("chat")}); err == nil {
+		t.Error("listing another app's notifications without notifications/manage should fail")
+	}
+}
+
+func TestNotificationMark(t *testing.T) {
+	_, thread := notification_test_setup(t)
+	for _, object := range []string{"a", "b", "b"} {
+		notification_test_call(t, thread, "create", map[string]sl.Value{
+			"category": sl.String("message"),
+			"object":   sl.String(object),
+			"title":    sl.String("New message"),
+		})
+	}
+
+	v, err := notification_test_call(t, thread, "mark", map[string]sl.Value{"object": sl.String("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := sl.AsInt32(v); n != 2 {
+		t.Errorf("marked %d, want 2", n)
+	}
+	v, _ = notification_test_call(t, thread, "list", map[string]sl.Value{"unread": sl.True})
+	if n := sl.Len(v); n != 1 {
+		t.Errorf("%d unread after marking object b, want 1", n)
+	}
+}
+
+func TestNotificationCreateInvalid(t *testing.T) {
+	_, thread := notification_test_setup(t)
+	if _, err := notification_test_call(t, thread, "create", map[string]sl.Value{
+		"category": sl.String("message"),
+		"object":   sl.String("a"),
+		"title":    sl.String("x"),
+		"urgency":  sl.String("urgent"),
+	}); err == nil {
+		t.Error("invalid urgency accepted")
+	}
+	if _, err := notification_test_call(t, thread, "create", map[string]sl.Value{
+		"category": sl.String("message"),
+		"object":   sl.String("a"),
+		"title":    sl.String(""),
+	}); err == nil {
+		t.Error("empty title accepted")
+	}
+}
+
+func TestNotificationDigestMode(t *testing.T) {
+	user, thread := notification_test_setup(t)
+	db := db_user(user, "notifications")
+	if mode := notification_mode(db, "chat", "message"); mode != "hourly" {
+		t.Errorf("app mode %q, want hourly", mode)
+	}
+	db.exec("insert into notifications_digest (app, category, mode) values ('chat', 'message', 'off')")
+	if mode := notification_mode(db, "chat", "message"); mode != "off" {
+		t.Errorf("category mode %q, want off", mode)
+	}
+	if mode := notification_mode(db, "feeds", ""); mode != "immediate" {
+		t.Errorf("default mode %q, want immediate", mode)
+	}
+
+	// Reading is allowed, setting is the user's choice
+	v, err := notification_test_call(t, thread, "digest", nil)
+	if err != nil || v != sl.String("hourly") {
+		t.Errorf("digest() = %v, %v", v, err)
+	}
+	if _, err := notification_test_call(t, thread, "digest", map[string]sl.Value{"mode": sl.String("daily")}); err == nil {
+		t.Error("setting a digest mode without notifications/manage should fail")
+	}
+}
+
+func TestNotificationDigestSend(t *testing.T) {
+	user, thread := notification_test_setup(t)
+	for _, object := range []string{"a", "b"} {
+		notification_test_call(t, thread, "create", map[string]sl.Value{
+			"category": sl.String("message"),
+			"object":   sl.String(object),
+			"title":    sl.String("New message"),
+		})
+	}
+	pending, _ := notifications_db().exists("select 1 from digests where user=? and mode='hourly'", user.UID)
+	if !pending {
+		t.Fatal("hourly notification did not schedule a digest")
+	}
+
+	if err := notification_digest_send(user, "hourly"); err != nil {
+		t.Fatal(err)
+	}
+	waiting, _ := db_user(user, "notifications").exists("select 1 from notifications where delivered=0")
+	if waiting {
+		t.Error("digest left notifications undelivered")
+	}
+}
+
+func TestNotificationDigestModes(t *testing.T) {
+	user, thread := notification_test_setup(t)
+	db_user(user, "notifications").exec("insert into notifications_digest (app, category, mode) values ('chat', 'daily', 'daily')")
+	for _, category := range []string{"message", "daily"} {
+		notification_test_call(t, thread, "create", map[string]sl.Value{
+			"category": sl.String(category),
+			"object":   sl.String(category),
+			"title":    sl.String("New message"),
+		})
+	}
+	if n := notifications_db().integer("select count(*) from digests where user=?", user.UID); n != 2 {
+		t.Fatalf("%d digests pending, want one hourly and one daily", n)
+	}
+
+	if err := notification_digest_send(user, "hourly"); err != nil {
+		t.Fatal(err)
+	}
+	db := db_user(user, "notifications")
+	if waiting, _ := db.exists("select 1 from notifications where category='message' and delivered=0"); waiting {
+		t.Error("hourly digest left its notification undelivered")
+	}
+	if waiting, _ := db.exists("select 1 from notifications where category='daily' and delivered=0"); !waiting {
+		t.Error("hourly digest delivered a daily notification")
+	}
+
+	if err := notification_digest_send(user, "daily"); err != nil {
+		t.Fatal(err)
+	}
+	if waiting, _ := db.exists("select 1 from notifications where delivered=0"); waiting {
+		t.Error("daily digest left its notification undelivered")
+	}
+}
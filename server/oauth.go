@@ -62,6 +62,8 @@ type oauth_state struct {
 	Scheme    string `json:"scheme,omitempty"`    // app deep-link scheme (mobile)
 	Challenge string `json:"challenge,omitempty"` // S256(verifier) for app exchange (mobile)
 	Email     string `json:"email,omitempty"`     // address the email-login flow is verifying
+	App       string `json:"app,omitempty"`       // app a step-up proof is bound to
+	Purpose   string `json:"purpose,omitempty"`   // purpose a step-up proof is bound to
 }
 
 var api_user_oauth = sls.FromStringDict(sl.String("mochi.user.oauth"), sl.StringDict{
@@ -291,7 +293,7 @@ func web_oauth_begin(c *gin.Context) {
 		link_user = user.UID
 	}
 
-	auth_url, err := oauth_begin_ceremony(c, provider, name, link_user, body.Target, body.Mode, body.Scheme, body.Challenge, body.Email)
+	auth_url, err := oauth_begin_ceremony(c, provider, name, link_user, oauth_state{Target: body.Target, Mode: body.Mode, Scheme: body.Scheme, Challenge: body.Challenge, Email: body.Email})
 	if err != nil {
 		warn("OAuth begin: %v", err)
 		respond_error(c, http.StatusServiceUnavailable, "provider_unavailable", "errors.provider_unavailable", nil)
@@ -304,7 +306,7 @@ func web_oauth_begin(c *gin.Context) {
 // ceremony - carrying user_id for the link and step-up flows, and the caller's
 // result challenge for the app/popup exchange - and returns the provider auth
 // URL. Shared by the web begin handler and the step-up verify.begin builtin.
-func oauth_begin_ceremony(c *gin.Context, provider *oauth_provider, name, user_id, target, mode, scheme, challenge, email string) (string, error) {
+func oauth_begin_ceremony(c *gin.Context, provider *oauth_provider, name, user_id string, st oauth_state) (string, error) {
 	verifier, oauth_challenge := oauth_pkce()
 	state := random_alphanumeric(32)
 	nonce := random_alphanumeric(32)
@@ -315,17 +317,11 @@ func oauth_begin_ceremony(c *gin.Context, provider *oauth_provider, name, user_i
 		return "", fmt.Errorf("provider config error (%s): %w", name, err)
 	}
 
-	data, err := json.Marshal(oauth_state{
-		Provider:  name,
-		Verifier:  verifier,
-		Nonce:     nonce,
-		Target:    target,
-		Redirect:  redirect,
-		Mode:      mode,
-		Scheme:    scheme,
-		Challenge: challenge,
-		Email:     email,
-	})
+	st.Provider = name
+	st.Verifier = verifier
+	st.Nonce = nonce
+	st.Redirect = redirect
+	data, err := json.Marshal(st)
 	if err != nil {
 		return "", err
 	}
@@ -431,7 +427,7 @@ func web_oauth_callback(c *gin.Context) {
 
 	if st.Mode == "reauthentication" && link_user != "" {
 		if user := user_by_uid(link_user); user != nil {
-			oauth_reauthenticate(c, name, profile, user, st.Challenge)
+			oauth_reauthenticate(c, name, profile, user, st)
 		} else {
 			oauth_reauthenticate_page(c)
 		}
@@ -569,7 +565,7 @@ func oauth_login(c *gin.Context, provider string, p *oauth_profile, target, expe
 	}
 
 	// Unknown identity — attempt signup.
-	if !setting_signup_enabled() {
+	if !signup_allowed(c) {
 		audit_login_failed(p.Email, rate_limit_client_ip(c), "oauth_signup_disabled")
 		oauth_error_redirect(c, "signup_disabled", nil)
 		return
@@ -598,6 +594,7 @@ func oauth_login(c *gin.Context, provider string, p *oauth_profile, target, expe
 		oauth_error_redirect(c, "provider_error", nil)
 		return
 	}
+	invite_redeem(c, user)
 
 	db.exec("insert into oauth (user, provider, subject, email, verified, name, created) values (?, ?, ?, ?, ?, ?, ?)",
 		user.UID, provider, p.Subject, p.Email, boolint(p.Verified), p.Name, now())
@@ -870,9 +867,10 @@ func api_user_oauth_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []s
 }
 
 // api_user_oauth_verify_begin is mochi.user.oauth.verify.begin(provider,
-// challenge) -> {url}: start a popup OAuth re-authentication for the current
-// user. challenge is base64url(sha256(verifier)) the caller holds; the proof
-// is retrieved afterwards with verify.finish(verifier).
+// challenge, purpose?) -> {url}: start a popup OAuth re-authentication for the
+// current user. challenge is base64url(sha256(verifier)) the caller holds; the
+// proof is retrieved afterwards with verify.finish(verifier), and is bound to
+// the calling app and purpose.
 func api_user_oauth_verify_begin(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if err := require_permission(t, fn, "user/authentication/write"); err != nil {
 		return sl_error(fn, "%v", err)
@@ -886,8 +884,8 @@ func api_user_oauth_verify_begin(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kw
 		return sl_error(fn, "no request context")
 	}
 
-	var name, challenge string
-	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "provider", &name, "challenge", &challenge); err != nil {
+	var name, challenge, purpose string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "provider", &name, "challenge", &challenge, "purpose?", &purpose); err != nil {
 		return sl_error(fn, "%v", err)
 	}
 	if len(challenge) < 32 || len(challenge) > 128 {
@@ -903,7 +901,7 @@ func api_user_oauth_verify_begin(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kw
 		return sl_error(fn, "provider not linked")
 	}
 
-	url, err := oauth_begin_ceremony(action.web, provider, name, user.UID, "", "reauthentication", "", challenge, "")
+	url, err := oauth_begin_ceremony(action.web, provider, name, user.UID, oauth_state{Mode: "reauthentication", Challenge: challenge, App: reauthentication_app(t), Purpose: purpose})
 	if err != nil {
 		return sl_error(fn, "%v", err)
 	}
@@ -952,7 +950,7 @@ func api_user_oauth_verify_finish(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, k
 // remaining factors) keyed by the caller's challenge for verify.finish to
 // retrieve. Always renders the auto-close page; a mismatched account simply
 // stores nothing, so finish returns None.
-func oauth_reauthenticate(c *gin.Context, provider string, p *oauth_profile, user *User, challenge string) {
+func oauth_reauthenticate(c *gin.Context, provider string, p *oauth_profile, user *User, st oauth_state) {
 	users := db_open("db/users.db")
 	owner := ""
 	if row, _ := users.row("select user from oauth where provider=? and subject=?", provider, p.Subject); row != nil {
@@ -963,7 +961,7 @@ func oauth_reauthenticate(c *gin.Context, provider string, p *oauth_profile, use
 		oauth_update_profile(users, provider, p)
 		oauth_verification_record(users, provider, p.Subject, user.UID)
 
-		token, remaining := reauthentication_advance(user, "oauth")
+		token, remaining := reauthentication_advance(user, st.App, st.Purpose, "oauth")
 		result := map[string]any{}
 		if token != "" {
 			result["token"] = token
@@ -973,7 +971,7 @@ func oauth_reauthenticate(c *gin.Context, provider string, p *oauth_profile, use
 		if body, err := json.Marshal(result); err == nil {
 			db_open("db/sessions.db").exec(
 				"insert into ceremonies (id, type, user, challenge, data, expires) values (?, 'reauthentication_oauth', ?, '', ?, ?)",
-				challenge, user.UID, string(body), now()+120)
+				st.Challenge, user.UID, string(body), now()+120)
 		}
 	}
 
@@ -1078,7 +1076,7 @@ func user_has_other_login(user *User, leaving string) bool {
 		return true
 	}
 	db := db_open("db/users.db")
-	if exists, _ := db.exists("select 1 from credentials where user=?", user.UID); exists {
+	if exists, _ := db.exists("select 1 from credentials where user=? and revoked=0", user.UID); exists {
 		return true
 	}
 	if row, _ := db.row("select verified from totp where user=?", user.UID); row != nil {
@@ -1260,7 +1258,7 @@ func oauth_mobile_login(c *gin.Context, provider string, p *oauth_profile, st *o
 	}
 
 	// New user signup path.
-	if !setting_signup_enabled() {
+	if !signup_allowed(c) {
 		audit_login_failed(p.Email, rate_limit_client_ip(c), "oauth_signup_disabled")
 		oauth_mobile_error(c, st, "signup_disabled", nil)
 		return
@@ -1282,6 +1280,7 @@ func oauth_mobile_login(c *gin.Context, provider string, p *oauth_profile, st *o
 		oauth_mobile_error(c, st, "provider_error", nil)
 		return
 	}
+	invite_redeem(c, user)
 
 	db.exec("insert into oauth (user, provider, subject, email, verified, name, created) values (?, ?, ?, ?, ?, ?, ?)",
 		user.UID, provider, p.Subject, p.Email, boolint(p.Verified), p.Name, now())
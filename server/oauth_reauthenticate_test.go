@@ -28,7 +28,7 @@ func TestOauthReauthenticate(t *testing.T) {
 	users.exec("create table oauth (id integer primary key, user text not null, provider text not null, subject text not null, email text not null default '', verified integer not null default 0, name text not null default '', created integer not null, unique(provider, subject))")
 	sessions := db_open("db/sessions.db")
 	sessions.exec("create table ceremonies (id text primary key, type text not null, user text not null default '', challenge blob not null, data text not null default '', expires integer not null)")
-	sessions.exec("create table reauthentication (id text primary key, user text not null, methods text not null default '', expires integer not null)")
+	sessions.exec("create table reauthentication (id text primary key, user text not null, app text not null default '', purpose text not null default '', methods text not null default '', expires integer not null)")
 	sessions.exec("create table verifications (oauth integer not null, user text not null, last integer not null, primary key (oauth, user))")
 
 	users.exec("insert into users (uid, username) values ('u-x', 'x@example.com')")
@@ -45,7 +45,7 @@ func TestOauthReauthenticate(t *testing.T) {
 
 	// Linked identity -> a single-use proof is stored, scoped to the user.
 	v1 := random_alphanumeric(64)
-	oauth_reauthenticate(c, "google", &oauth_profile{Subject: "sub-123", Email: "x@example.com", Verified: true}, user, challenge(v1))
+	oauth_reauthenticate(c, "google", &oauth_profile{Subject: "sub-123", Email: "x@example.com", Verified: true}, user, oauth_state{Challenge: challenge(v1)})
 	row, _ := sessions.row("select data, user from ceremonies where id=? and type='reauthentication_oauth' and expires>?", challenge(v1), now())
 	if row == nil {
 		t.Fatal("linked identity stored no proof")
@@ -61,7 +61,7 @@ func TestOauthReauthenticate(t *testing.T) {
 
 	// Unlinked provider account -> nothing minted (the stolen-session defence).
 	v2 := random_alphanumeric(64)
-	oauth_reauthenticate(c, "google", &oauth_profile{Subject: "attacker-sub", Email: "evil@example.com", Verified: true}, user, challenge(v2))
+	oauth_reauthenticate(c, "google", &oauth_profile{Subject: "attacker-sub", Email: "evil@example.com", Verified: true}, user, oauth_state{Challenge: challenge(v2)})
 	if r, _ := sessions.row("select 1 from ceremonies where id=? and type='reauthentication_oauth'", challenge(v2)); r != nil {
 		t.Error("unlinked provider account minted a proof")
 	}
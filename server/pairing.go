@@ -0,0 +1,249 @@
+// Mochi server: Pairing a phone with a signed in device
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// A signed in device signs in a phone without the phone needing any login
+// factor of its own:
+//
+//  1. The Login app calls mochi.user.pairing.create() and shows the URL it
+//     returns as a QR code.
+//  2. The phone scans it, and the Login app there posts the code to
+//     /_/auth/pair/claim. This returns a claim token and a short phrase.
+//  3. The original device sees the claim through mochi.user.pairing.status(),
+//     with the phone's address, browser and phrase, and the user confirms or
+//     declines it there.
+//  4. The phone polls /_/auth/pair/finish with its claim token, and once
+//     confirmed is given a session.
+//
+// A code can be claimed once, and each step must follow the last within
+// pairing_lifetime. A pairing created as trusted links the phone as a named
+// device of the user's, listed with their sessions.
+
+const pairing_lifetime = 120
+
+var api_user_pairing = sls.FromStringDict(sl.String("mochi.user.pairing"), sl.StringDict{
+	"confirm": sl.NewBuiltin("mochi.user.pairing.confirm", api_user_pairing_confirm),
+	"create":  sl.NewBuiltin("mochi.user.pairing.create", api_user_pairing_create),
+	"decline": sl.NewBuiltin("mochi.user.pairing.decline", api_user_pairing_decline),
+	"status":  sl.NewBuiltin("mochi.user.pairing.status", api_user_pairing_status),
+})
+
+// pairing_create starts a pairing for a user, returning its code
+func pairing_create(user *User, trusted bool, name string) string {
+	code := random_alphanumeric(32)
+	t := 0
+	if trusted {
+		t = 1
+	}
+	db_open("db/sessions.db").exec("insert into pairings ( code, user, trusted, name, status, expires ) values ( ?, ?, ?, ?, 'pending', ? )", code, user.UID, t, name, now()+pairing_lifetime)
+	return code
+}
+
+// pairing_claim claims a pending pairing for the device presenting its
+// code, returning the claim token and phrase, or "" if the code is not
+// pending.
+func pairing_claim(code, address, agent string) (string, string, string) {
+	db := db_open("db/sessions.db")
+	claim := random_alphanumeric(32)
+	phrase := random_unambiguous(4)
+	db.exec("update pairings set status='claimed', claim=?, phrase=?, address=?, agent=?, expires=? where code=? and status='pending' and expires>=?", claim, phrase, address, agent, now()+pairing_lifetime, code, now())
+	row, _ := db.row("select user from pairings where code=? and claim=?", code, claim)
+	if row == nil {
+		return "", "", ""
+	}
+	return claim, phrase, as_string(row["user"])
+}
+
+// pairing_decide confirms or declines a claimed pairing of a user's.
+// Returns false if there is no such claim.
+func pairing_decide(user *User, code string, confirm bool) bool {
+	db := db_open("db/sessions.db")
+	exists, _ := db.exists("select 1 from pairings where code=? and user=? and status='claimed' and expires>=?", code, user.UID, now())
+	if !exists {
+		return false
+	}
+	if confirm {
+		db.exec("update pairings set status='confirmed', expires=? where code=?", now()+pairing_lifetime, code)
+	} else {
+		db.exec("update pairings set status='declined' where code=?", code)
+	}
+	return true
+}
+
+// POST /_/auth/pair/claim - Claim a pairing from the phone that scanned it
+func web_pairing_claim(c *gin.Context) {
+	if !auth_method_allowed("pairing") {
+		respond_error(c, http.StatusForbidden, "pairing_disabled", "errors.pairing_disabled", nil)
+		return
+	}
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Code == "" {
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+
+	claim, phrase, uid := pairing_claim(input.Code, c.ClientIP(), c.GetHeader("User-Agent"))
+	user := user_by_uid(uid)
+	if claim == "" || user == nil {
+		respond_error(c, http.StatusGone, "pairing_expired", "errors.pairing_expired", nil)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"claim": claim, "phrase": phrase, "name": user.Identity.Name})
+}
+
+// POST /_/auth/pair/finish - Sign in the phone once the pairing is confirmed
+func web_pairing_finish(c *gin.Context) {
+	if !auth_method_allowed("pairing") {
+		respond_error(c, http.StatusForbidden, "pairing_disabled", "errors.pairing_disabled", nil)
+		return
+	}
+	var input struct {
+		Claim string `json:"claim"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Claim == "" {
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+
+	db := db_open("db/sessions.db")
+	row, _ := db.row("select code, user, trusted, name, status from pairings where claim=? and expires>=?", input.Claim, now())
+	if row == nil {
+		respond_error(c, http.StatusGone, "pairing_expired", "errors.pairing_expired", nil)
+		return
+	}
+	switch as_string(row["status"]) {
+	case "claimed":
+		c.JSON(http.StatusAccepted, gin.H{"status": "claimed"})
+		return
+	case "declined":
+		db.exec("delete from pairings where code=?", row["code"])
+		respond_error(c, http.StatusForbidden, "pairing_declined", "errors.pairing_declined", nil)
+		return
+	}
+	db.exec("delete from pairings where code=?", row["code"])
+
+	user := user_by_uid(as_string(row["user"]))
+	if user == nil {
+		respond_error(c, http.StatusForbidden, "suspended", "errors.suspended", nil)
+		return
+	}
+	session := auth_complete_login(c, user)
+	if as_int64(row["trusted"]) == 1 {
+		name := as_string(row["name"])
+		if name == "" {
+			name = c.GetHeader("User-Agent")
+		}
+		db.exec("replace into devices ( session, user, name, linked ) values ( ?, ?, ?, ? )", session, user.UID, name, now())
+	}
+}
+
+// pairing_user returns the signed in user of a pairing API call, and the
+// code given as its argument
+func pairing_user(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (*User, string, error) {
+	if err := require_permission(t, fn, "user/authentication/write"); err != nil {
+		_, err = sl_error(fn, "%v", err)
+		return nil, "", err
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		_, err := sl_error(fn, "no user")
+		return nil, "", err
+	}
+	var code string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "code", &code); err != nil {
+		return nil, "", err
+	}
+	return user, code, nil
+}
+
+// mochi.user.pairing.create(trusted=False, name="") -> dict: Start pairing
+// a phone with this device. Returns the code, the URL to show as a QR code,
+// and the Unix timestamp it expires at. If trusted, the phone is linked
+// as a device of the user's, called name.
+func api_user_pairing_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "user/authentication/write"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || user_guest(user) {
+		return sl_error(fn, "no user")
+	}
+	if !auth_method_allowed("pairing") {
+		return sl_error(fn, "pairing is disabled")
+	}
+	var trusted bool
+	var name string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "trusted?", &trusted, "name?", &name); err != nil {
+		return nil, err
+	}
+	name = strings.TrimSpace(name)
+	if name != "" && !valid(name, "name") {
+		return sl_error(fn, "invalid name")
+	}
+
+	origin := ""
+	if action, ok := t.Local("action").(*Action); ok && action.web != nil {
+		origin = request_origin(action.web)
+	}
+	code := pairing_create(user, trusted, name)
+	return sl_encode(map[string]any{
+		"code":    code,
+		"url":     origin + "/login/pair#" + code,
+		"expires": now() + pairing_lifetime,
+	}), nil
+}
+
+// mochi.user.pairing.status(code) -> dict or None: A pairing's progress.
+// The dict has:
+//
+//	status   string — "pending", "claimed", "confirmed" or "declined"
+//	phrase   string — shown on the phone once claimed, for the user to compare
+//	address  string — the phone's IP address, once claimed
+//	agent    string — the phone's browser, once claimed
+//	expires  int    — Unix timestamp the current step must finish by
+func api_user_pairing_status(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, code, err := pairing_user(t, fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	row, _ := db_open("db/sessions.db").row("select status, phrase, address, agent, expires from pairings where code=? and user=? and expires>=?", code, user.UID, now())
+	if row == nil {
+		return sl.None, nil
+	}
+	return sl_encode(row), nil
+}
+
+// mochi.user.pairing.confirm(code) -> bool: Let the phone that claimed a
+// pairing sign in
+func api_user_pairing_confirm(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, code, err := pairing_user(t, fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return sl.Bool(pairing_decide(user, code, true)), nil
+}
+
+// mochi.user.pairing.decline(code) -> bool: Refuse the phone that claimed
+// a pairing
+func api_user_pairing_decline(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, code, err := pairing_user(t, fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return sl.Bool(pairing_decide(user, code, false)), nil
+}
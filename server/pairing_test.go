@@ -0,0 +1,106 @@
+// Mochi server: Pairing tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pairing_test_post posts a JSON body to a pairing handler, returning the
+// response
+func pairing_test_post(handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/_/auth/pair", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.Header.Set("User-Agent", "Phone")
+	handler(c)
+	return w
+}
+
+func TestPairing(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	load_core_labels()
+	gin.SetMode(gin.TestMode)
+
+	user, _ := user_create("owner@example.com")
+	if _, err := entity_create(user, "person", "Owner", "public", ""); err != nil {
+		t.Fatal(err)
+	}
+	user = user_by_uid(user.UID)
+	code := pairing_create(user, true, "My phone")
+
+	w := pairing_test_post(web_pairing_claim, `{"code":"`+code+`"}`)
+	var claimed struct {
+		Claim  string `json:"claim"`
+		Phrase string `json:"phrase"`
+		Name   string `json:"name"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &claimed)
+	if w.Code != http.StatusOK || claimed.Claim == "" || claimed.Phrase == "" || claimed.Name != "Owner" {
+		t.Fatalf("claim: %d %s", w.Code, w.Body)
+	}
+	if w = pairing_test_post(web_pairing_claim, `{"code":"`+code+`"}`); w.Code != http.StatusGone {
+		t.Errorf("second claim: %d", w.Code)
+	}
+
+	// The phone waits until the original device confirms
+	finish := `{"claim":"` + claimed.Claim + `"}`
+	if w = pairing_test_post(web_pairing_finish, finish); w.Code != http.StatusAccepted {
+		t.Errorf("unconfirmed finish: %d", w.Code)
+	}
+	if pairing_decide(&User{UID: "someone"}, code, true) {
+		t.Error("confirmed by another user")
+	}
+	if !pairing_decide(user, code, true) {
+		t.Fatal("not confirmed")
+	}
+	w = pairing_test_post(web_pairing_finish, finish)
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Set-Cookie"), "session=") {
+		t.Fatalf("finish: %d %v", w.Code, w.Header())
+	}
+	row, _ := db_open("db/sessions.db").row("select d.name, s.agent from devices d join sessions s on s.code=d.session where d.user=?", user.UID)
+	if row == nil || row["name"] != "My phone" || row["agent"] != "Phone" {
+		t.Errorf("device %v", row)
+	}
+	if w = pairing_test_post(web_pairing_finish, finish); w.Code != http.StatusGone {
+		t.Errorf("finish twice: %d", w.Code)
+	}
+
+	// A declined pairing signs nothing in
+	code = pairing_create(user, false, "")
+	claim, _, _ := pairing_claim(code, "192.0.2.1", "Stranger")
+	pairing_decide(user, code, false)
+	if w = pairing_test_post(web_pairing_finish, `{"claim":"`+claim+`"}`); w.Code != http.StatusForbidden {
+		t.Errorf("declined finish: %d", w.Code)
+	}
+
+	// Nor does one finished once pairing is disabled
+	code = pairing_create(user, false, "")
+	claim, _, _ = pairing_claim(code, "192.0.2.1", "Phone")
+	pairing_decide(user, code, true)
+	setting_set("auth_pairing", "disabled")
+	if w = pairing_test_post(web_pairing_finish, `{"claim":"`+claim+`"}`); w.Code != http.StatusForbidden {
+		t.Errorf("finish while disabled: %d", w.Code)
+	}
+	setting_delete("auth_pairing")
+
+	// Nor does an expired one
+	code = pairing_create(user, false, "")
+	db_open("db/sessions.db").exec("update pairings set expires=? where code=?", now()-1, code)
+	if claim, _, _ = pairing_claim(code, "192.0.2.1", "Phone"); claim != "" {
+		t.Error("expired pairing claimed")
+	}
+}
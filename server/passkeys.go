@@ -12,12 +12,14 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
 	sl "go.starlark.net/starlark"
 	sls "go.starlark.net/starlarkstruct"
 )
@@ -31,7 +33,9 @@ var api_user_passkey = sls.FromStringDict(sl.String("mochi.user.passkey"), sl.St
 	"count":  sl.NewBuiltin("mochi.user.passkey.count", api_user_passkey_count),
 	"delete": sl.NewBuiltin("mochi.user.passkey.delete", api_user_passkey_delete),
 	"list":   sl.NewBuiltin("mochi.user.passkey.list", api_user_passkey_list),
+	"policy": sl.NewBuiltin("mochi.user.passkey.policy", api_user_passkey_policy),
 	"rename": sl.NewBuiltin("mochi.user.passkey.rename", api_user_passkey_rename),
+	"revoke": sl.NewBuiltin("mochi.user.passkey.revoke", api_user_passkey_revoke),
 	"register": sls.FromStringDict(sl.String("mochi.user.passkey.register"), sl.StringDict{
 		"begin":  sl.NewBuiltin("mochi.user.passkey.register.begin", api_user_passkey_register_begin),
 		"finish": sl.NewBuiltin("mochi.user.passkey.register.finish", api_user_passkey_register_finish),
@@ -130,7 +134,7 @@ func (u *WebAuthnUser) WebAuthnDisplayName() string {
 // WebAuthnCredentials returns all credentials for this user
 func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
 	db := db_open("db/users.db")
-	rows, _ := db.rows("select id, public_key, sign_count, transports, backup_eligible, backup_state from credentials where user=?", u.user.UID)
+	rows, _ := db.rows("select id, public_key, sign_count, transports, backup_eligible, backup_state, attestation from credentials where user=? and revoked=0", u.user.UID)
 
 	var creds []webauthn.Credential
 	for _, row := range rows {
@@ -156,10 +160,15 @@ func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
 			public_key = []byte(v)
 		}
 
+		attestation, _ := row["attestation"].(string)
+		if attestation == "" {
+			attestation = "none"
+		}
+
 		creds = append(creds, webauthn.Credential{
 			ID:              id,
 			PublicKey:       public_key,
-			AttestationType: "none",
+			AttestationType: attestation,
 			Transport:       transports,
 			Flags: webauthn.CredentialFlags{
 				BackupEligible: row["backup_eligible"].(int64) != 0,
@@ -195,6 +204,61 @@ func passkey_lasts(user_id string) map[string]int64 {
 	return out
 }
 
+// passkey_verification returns whether passkeys must verify the user, by
+// PIN or biometric, as set by the administrator
+func passkey_verification() protocol.UserVerificationRequirement {
+	switch setting_get("passkey_verification", "preferred") {
+	case "required":
+		return protocol.VerificationRequired
+	case "discouraged":
+		return protocol.VerificationDiscouraged
+	}
+	return protocol.VerificationPreferred
+}
+
+// passkey_authenticators returns the AAGUIDs of the authenticator models
+// passkeys may be registered with, or nil if any may be
+func passkey_authenticators() []string {
+	var out []string
+	for _, a := range strings.Split(setting_get("passkey_authenticators", ""), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			out = append(out, strings.ToLower(a))
+		}
+	}
+	return out
+}
+
+// passkey_aaguid formats the authenticator model a credential reports, or
+// "" if it reports none
+func passkey_aaguid(credential *webauthn.Credential) string {
+	a, err := uuid.FromBytes(credential.Authenticator.AAGUID)
+	if err != nil || a == uuid.Nil {
+		return ""
+	}
+	return a.String()
+}
+
+// passkey_policy_check checks a newly created credential against the
+// administrator's policy. User verification is checked by the library, as
+// the ceremony asks for it. A list of authenticators needs the authenticator
+// to attest its model with a certificate; the go-webauthn library checks the
+// statement's signature, but without a metadata service not the issuer of
+// the certificate, so this stops the wrong kind of passkey being registered
+// by mistake rather than by a determined user.
+func passkey_policy_check(credential *webauthn.Credential, parsed *protocol.ParsedCredentialCreationData) error {
+	allowed := passkey_authenticators()
+	if len(allowed) == 0 {
+		return nil
+	}
+	if _, ok := parsed.Response.AttestationObject.AttStatement["x5c"]; !ok || credential.AttestationType == "none" {
+		return errors.New("passkey did not attest its authenticator")
+	}
+	if !slices.Contains(allowed, passkey_aaguid(credential)) {
+		return errors.New("this kind of passkey is not allowed")
+	}
+	return nil
+}
+
 // ============================================================================
 // System Endpoints (unauthenticated login flows)
 // ============================================================================
@@ -212,7 +276,7 @@ func web_passkey_login_begin(c *gin.Context) {
 		return
 	}
 
-	options, session, err := wa.BeginDiscoverableLogin()
+	options, session, err := wa.BeginDiscoverableLogin(webauthn.WithUserVerification(passkey_verification()))
 	if err != nil {
 		respond_error(c, http.StatusInternalServerError, "webauthn_error", "errors.webauthn_error", nil)
 		return
@@ -301,7 +365,7 @@ func web_passkey_login_finish(c *gin.Context) {
 	// Find user from credential first (we need the user id for the passkeys
 	// upsert below, and an unknown credential should short-circuit anyway).
 	users := db_open("db/users.db")
-	row, _ = users.row("select user from credentials where id=?", credential.ID)
+	row, _ = users.row("select user from credentials where id=? and revoked=0", credential.ID)
 	if row == nil {
 		respond_error(c, http.StatusUnauthorized, "credential_not_found", "errors.credential_not_found", nil)
 		return
@@ -394,7 +458,7 @@ func api_user_passkey_verify_begin(t *sl.Thread, fn *sl.Builtin, args sl.Tuple,
 	}
 
 	wu := &WebAuthnUser{user: user}
-	options, session, err := wa.BeginLogin(wu)
+	options, session, err := wa.BeginLogin(wu, webauthn.WithUserVerification(passkey_verification()))
 	if err != nil {
 		return sl_error(fn, "webauthn error: %v", err)
 	}
@@ -411,8 +475,8 @@ func api_user_passkey_verify_begin(t *sl.Thread, fn *sl.Builtin, args sl.Tuple,
 	}), nil
 }
 
-// mochi.user.passkey.verify.finish(ceremony, assertion) -> dict: complete a
-// step-up passkey assertion. Returns the re-authentication result
+// mochi.user.passkey.verify.finish(ceremony, assertion, purpose?) -> dict:
+// complete a step-up passkey assertion for the calling app and purpose. Returns the re-authentication result
 // ({"token": ...} or {"remaining": [...]}), or None if the assertion fails
 // (the action maps None to a translated error). Creates no session.
 func api_user_passkey_verify_finish(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
@@ -483,10 +547,33 @@ func api_user_passkey_verify_finish(t *sl.Thread, fn *sl.Builtin, args sl.Tuple,
 	}
 	passkey_credential_finalize(user, credential)
 
-	return reauthentication_result(user, "passkey"), nil
+	return reauthentication_result(t, user, reauthentication_purpose(kwargs), "passkey"), nil
+}
+
+// passkey_target returns the user whose passkeys an API call manages: the
+// caller, or for an administrator the user given
+func passkey_target(user *User, uid string) (string, error) {
+	if uid == "" || uid == user.UID {
+		return user.UID, nil
+	}
+	if !user.administrator() {
+		return "", errors.New("access denied")
+	}
+	return uid, nil
 }
 
-// mochi.user.passkey.list() -> list: List user's passkeys
+// mochi.user.passkey.list(user?) -> list: List passkeys of the current user,
+// or of the specified user (admin). Each is a dict of:
+//
+//	id           string — base64 credential ID
+//	name         string — the user's name for it
+//	transports   string — comma-separated, such as "internal,hybrid"
+//	aaguid       string — the authenticator model, as reported, or ""
+//	attestation  string — the attestation format given at registration
+//	verified     bool   — whether the user was verified at registration
+//	created      int    — Unix timestamp of registration
+//	last_used    int    — Unix timestamp of last sign in, or 0
+//	revoked      int    — Unix timestamp it was revoked, or 0
 func api_user_passkey_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if err := require_permission(t, fn, "user/authentication/read"); err != nil {
 		return sl_error(fn, "%v", err)
@@ -497,13 +584,22 @@ func api_user_passkey_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 		return sl_error(fn, "no user")
 	}
 
+	var uid string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "user?", &uid); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	target, err := passkey_target(user, uid)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
 	db := db_open("db/users.db")
-	rows, err := db.rows("select id, name, transports, created from credentials where user=? order by created desc", user.UID)
+	rows, err := db.rows("select id, name, transports, aaguid, attestation, verified, revoked, created from credentials where user=? order by revoked, created desc", target)
 	if err != nil {
 		return sl_error(fn, "database error")
 	}
 
-	lasts := passkey_lasts(user.UID)
+	lasts := passkey_lasts(target)
 
 	// Convert blob IDs to base64 for Starlark
 	credentials := make([]map[string]any, len(rows))
@@ -517,18 +613,22 @@ func api_user_passkey_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 			idBytes = []byte(id)
 		}
 		credentials[i] = map[string]any{
-			"id":         base64.URLEncoding.EncodeToString(idBytes),
-			"name":       row["name"],
-			"transports": row["transports"],
-			"created":    row["created"],
-			"last_used":  lasts[string(idBytes)],
+			"id":          base64.URLEncoding.EncodeToString(idBytes),
+			"name":        row["name"],
+			"transports":  row["transports"],
+			"aaguid":      row["aaguid"],
+			"attestation": row["attestation"],
+			"verified":    as_int64(row["verified"]) != 0,
+			"created":     row["created"],
+			"last_used":   lasts[string(idBytes)],
+			"revoked":     row["revoked"],
 		}
 	}
 
 	return sl_encode(credentials), nil
 }
 
-// mochi.user.passkey.count() -> int: Count user's passkeys
+// mochi.user.passkey.count() -> int: Count user's passkeys that are not revoked
 func api_user_passkey_count(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if err := require_permission(t, fn, "user/authentication/read"); err != nil {
 		return sl_error(fn, "%v", err)
@@ -540,7 +640,7 @@ func api_user_passkey_count(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 	}
 
 	db := db_open("db/users.db")
-	row, _ := db.row("select count(*) as count from credentials where user=?", user.UID)
+	row, _ := db.row("select count(*) as count from credentials where user=? and revoked=0", user.UID)
 	if row == nil {
 		return sl.MakeInt(0), nil
 	}
@@ -569,8 +669,14 @@ func api_user_passkey_register_begin(t *sl.Thread, fn *sl.Builtin, args sl.Tuple
 	}
 
 	wu := &WebAuthnUser{user: user}
+	conveyance := protocol.PreferNoAttestation
+	if len(passkey_authenticators()) > 0 {
+		conveyance = protocol.PreferDirectAttestation
+	}
 	options, session, err := wa.BeginRegistration(wu,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{UserVerification: passkey_verification()}),
 		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithConveyancePreference(conveyance),
 	)
 	if err != nil {
 		return sl_error(fn, "webauthn error: %v", err)
@@ -664,6 +770,9 @@ func api_user_passkey_register_finish(t *sl.Thread, fn *sl.Builtin, args sl.Tupl
 	if err != nil {
 		return sl_error(fn, "registration failed: %v", err)
 	}
+	if err := passkey_policy_check(credential, parsed); err != nil {
+		return sl_error(fn, "%v", err)
+	}
 
 	// Build transports string
 	transports := ""
@@ -684,11 +793,12 @@ func api_user_passkey_register_finish(t *sl.Thread, fn *sl.Builtin, args sl.Tupl
 	// sessions.db, populated lazily on first assertion.
 	users := db_open("db/users.db")
 	created := now()
-	users.exec(`insert into credentials (id, user, public_key, sign_count, name, transports, backup_eligible, backup_state, created)
-             values (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	users.exec(`insert into credentials (id, user, public_key, sign_count, name, transports, backup_eligible, backup_state, aaguid, attestation, verified, created)
+             values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		credential.ID, user.UID, credential.PublicKey,
 		credential.Authenticator.SignCount, name, transports,
-		credential.Flags.BackupEligible, credential.Flags.BackupState, created)
+		credential.Flags.BackupEligible, credential.Flags.BackupState,
+		passkey_aaguid(credential), credential.AttestationType, credential.Flags.UserVerified, created)
 	db_open("db/sessions.db").exec("insert into passkeys (credential, user, last) values (?, ?, 0)",
 		credential.ID, user.UID)
 
@@ -764,8 +874,12 @@ func api_user_passkey_delete(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 	db := db_open("db/users.db")
 
 	// Refuse if deleting the last passkey would leave no way to sign in.
-	row, _ := db.row("select count(*) as count from credentials where user=?", user.UID)
-	if row != nil && row["count"].(int64) <= 1 {
+	// A revoked passkey is no way to sign in, so may always be deleted.
+	row, _ := db.row("select revoked from credentials where id=? and user=?", id, user.UID)
+	if row == nil {
+		return sl_error(fn, "credential not found")
+	}
+	if as_int64(row["revoked"]) == 0 && passkey_last(user) {
 		switch user_factor_removal_blocked(user, "passkey") {
 		case "required":
 			return sl_error(fn, "cannot delete the last passkey while it is a required method")
@@ -774,17 +888,95 @@ func api_user_passkey_delete(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 		}
 	}
 
-	exists, _ := db.exists("select id from credentials where id=? and user=?", id, user.UID)
-	if !exists {
-		return sl_error(fn, "credential not found")
-	}
-
 	db.exec("delete from credentials where id=? and user=?", id, user.UID)
 	db_open("db/sessions.db").exec("delete from passkeys where credential=?", id)
 	audit_password_changed(user.Username, "passkey_deleted")
 	return sl.True, nil
 }
 
+// passkey_last returns whether a user has only one passkey that is not
+// revoked
+func passkey_last(user *User) bool {
+	row, _ := db_open("db/users.db").row("select count(*) as count from credentials where user=? and revoked=0", user.UID)
+	return row != nil && as_int64(row["count"]) <= 1
+}
+
+// mochi.user.passkey.revoke(id, user?) -> bool: Revoke a passkey of the
+// current user, or of the specified user (admin), so it can no longer sign
+// in. Unlike delete, the passkey stays listed, marked as revoked. An
+// administrator may revoke a user's last passkey, as when it is lost or
+// stolen; a user may not revoke their own only way to sign in.
+func api_user_passkey_revoke(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "user/authentication/write"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	user := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+
+	var encoded, uid string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &encoded, "user?", &uid); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	target, err := passkey_target(user, uid)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	id, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil || encoded == "" {
+		return sl_error(fn, "invalid id")
+	}
+
+	db := db_open("db/users.db")
+	row, _ := db.row("select revoked from credentials where id=? and user=?", id, target)
+	if row == nil {
+		return sl_error(fn, "credential not found")
+	}
+	if as_int64(row["revoked"]) != 0 {
+		return sl.False, nil
+	}
+	if target == user.UID && passkey_last(user) {
+		switch user_factor_removal_blocked(user, "passkey") {
+		case "required":
+			return sl_error(fn, "cannot revoke the last passkey while it is a required method")
+		case "last":
+			return sl_error(fn, "cannot revoke your only remaining sign-in method")
+		}
+	}
+
+	db.exec("update credentials set revoked=? where id=? and user=?", now(), id, target)
+	if target == user.UID {
+		audit_password_changed(user.Username, "passkey_revoked")
+	} else {
+		audit_admin_escalation(user.Username, target, "passkey_revoked")
+	}
+	return sl.True, nil
+}
+
+// mochi.user.passkey.policy() -> dict: The administrator's policy for
+// passkeys, for the Settings app to explain it when registering one:
+//
+//	verification    string — "required", "preferred" or "discouraged"
+//	authenticators  list   — AAGUIDs of the allowed authenticator models, or empty for any
+//
+// Administrators set it with the passkey_verification and
+// passkey_authenticators system settings.
+func api_user_passkey_policy(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "user/authentication/read"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	authenticators := passkey_authenticators()
+	if authenticators == nil {
+		authenticators = []string{}
+	}
+	return sl_encode(map[string]any{
+		"verification":   string(passkey_verification()),
+		"authenticators": authenticators,
+	}), nil
+}
+
 // ============================================================================
 // Helper functions
 // ============================================================================
@@ -0,0 +1,141 @@
+// Mochi server: Passkey management tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	sl "go.starlark.net/starlark"
+)
+
+func TestPasskeyPolicy(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	if passkey_verification() != protocol.VerificationPreferred || passkey_authenticators() != nil {
+		t.Errorf("default policy %q %v", passkey_verification(), passkey_authenticators())
+	}
+
+	model := uuid.MustParse("ee882879-721c-4913-9775-3dfcce97072a")
+	credential := func(format string, aaguid uuid.UUID, x5c bool) (*webauthn.Credential, *protocol.ParsedCredentialCreationData) {
+		parsed := &protocol.ParsedCredentialCreationData{}
+		parsed.Response.AttestationObject.AttStatement = map[string]any{}
+		if x5c {
+			parsed.Response.AttestationObject.AttStatement["x5c"] = []any{[]byte("certificate")}
+		}
+		return &webauthn.Credential{AttestationType: format, Authenticator: webauthn.Authenticator{AAGUID: aaguid[:]}}, parsed
+	}
+
+	// Without a list of authenticators, anything goes
+	if err := passkey_policy_check(credential("none", uuid.Nil, false)); err != nil {
+		t.Error(err)
+	}
+
+	setting_set("passkey_verification", "required")
+	setting_set("passkey_authenticators", strings.ToUpper(model.String())+", ")
+	if passkey_verification() != protocol.VerificationRequired || len(passkey_authenticators()) != 1 {
+		t.Errorf("policy %q %v", passkey_verification(), passkey_authenticators())
+	}
+	if err := passkey_policy_check(credential("packed", model, true)); err != nil {
+		t.Errorf("allowed authenticator: %v", err)
+	}
+	for name, c := range map[string][]any{
+		"unattested":      {"none", model, false},
+		"self attested":   {"packed", model, false},
+		"other model":     {"packed", uuid.MustParse("08987058-cadc-4b81-b6e1-30de50dcbe96"), true},
+		"no model at all": {"packed", uuid.Nil, true},
+	} {
+		if err := passkey_policy_check(credential(c[0].(string), c[1].(uuid.UUID), c[2].(bool))); err == nil {
+			t.Errorf("%s authenticator allowed", name)
+		}
+	}
+}
+
+func TestPasskeyRevoke(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	admin, _ := user_create("admin@example.com")
+	user, _ := user_create("user@example.com")
+	users := db_open("db/users.db")
+	users.exec("update users set methods='passkey', disabled='email' where uid=?", user.UID)
+	user.Methods, user.Disabled = "passkey", "email"
+	users.exec("insert into credentials (id, user, public_key, name, created) values (?, ?, x'00', 'Phone', 1)", []byte("phone"), user.UID)
+	users.exec("insert into credentials (id, user, public_key, name, created) values (?, ?, x'00', 'Laptop', 2)", []byte("laptop"), user.UID)
+	phone := base64.URLEncoding.EncodeToString([]byte("phone"))
+	laptop := base64.URLEncoding.EncodeToString([]byte("laptop"))
+
+	call := func(caller *User, name string, args ...sl.Value) (sl.Value, error) {
+		thread := &sl.Thread{}
+		thread.SetLocal("user", caller)
+		thread.SetLocal("app", &App{id: "settings", internal: &AppVersion{}})
+		f, _ := api_user_passkey.Attr(name)
+		return sl.Call(thread, f, sl.Tuple(args), nil)
+	}
+
+	if v, err := call(user, "revoke", sl.String(phone)); err != nil || v != sl.True {
+		t.Fatalf("revoke: %v %v", v, err)
+	}
+	if creds := (&WebAuthnUser{user: user}).WebAuthnCredentials(); len(creds) != 1 || string(creds[0].ID) != "laptop" {
+		t.Errorf("credentials after revoking %v", creds)
+	}
+	if v, _ := call(user, "count"); v != sl.MakeInt(1) {
+		t.Errorf("count %v", v)
+	}
+	if v, _ := call(user, "revoke", sl.String(phone)); v != sl.False {
+		t.Errorf("revoked twice: %v", v)
+	}
+
+	// The user can't revoke their only way to sign in, but an administrator can
+	if _, err := call(user, "revoke", sl.String(laptop)); err == nil {
+		t.Error("revoked the last passkey")
+	}
+	if _, err := call(user, "list", sl.String(admin.UID)); err == nil {
+		t.Error("listed another user's passkeys")
+	}
+	if _, err := call(admin, "revoke", sl.String(laptop), sl.String(user.UID)); err != nil {
+		t.Fatal(err)
+	}
+	v, err := call(admin, "list", sl.String(user.UID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := sl_decode(v).([]any)
+	if len(list) != 2 || as_int64(list[0].(map[string]any)["revoked"]) == 0 || as_int64(list[1].(map[string]any)["revoked"]) == 0 {
+		t.Errorf("list %v", list)
+	}
+	if user_method_available(user, "passkey") {
+		t.Error("revoked passkeys still available")
+	}
+
+	// A revoked passkey can be deleted even though it is the last
+	if v, err := call(user, "delete", sl.String(laptop)); err != nil || v != sl.True {
+		t.Errorf("delete revoked: %v %v", v, err)
+	}
+}
+
+func TestPasskeyUpgrade(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	users := db_open("db/users.db")
+	users.exec("create table credentials (id blob primary key, user text not null, public_key blob not null, sign_count integer not null default 0, name text not null default '', transports text not null default '', backup_eligible integer not null default 0, backup_state integer not null default 0, created integer not null)")
+	users.exec("insert into credentials (id, user, public_key, created) values (x'01', 'u1', x'00', 1)")
+
+	db_upgrade_11()
+	db_upgrade_11()
+	row, _ := users.row("select aaguid, attestation, verified, revoked from credentials")
+	if row == nil || row["aaguid"] != "" || as_int64(row["revoked"]) != 0 {
+		t.Errorf("upgraded row %v", row)
+	}
+}
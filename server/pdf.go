@@ -0,0 +1,214 @@
+// Mochi server: PDF previews
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PDF attachments get a PNG of their first page as their thumbnail and
+// preview variants, and a page count in their metadata. Rendering uses
+// poppler's pdftoppm, found on the PATH or set with [files] pdftoppm; without
+// it PDFs get a page count but no previews. The page count is read from the
+// document's page tree here, without rendering.
+
+const (
+	pdf_parse_max      = 64 << 20 // Bytes of a PDF read to count pages
+	pdf_stream_max     = 16 << 20 // Bytes an object stream may inflate to
+	pdf_pages_max      = 100000
+	pdf_render_timeout = 30 * time.Second
+)
+
+var (
+	pdf_type_pages  = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdf_type_objstm = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	pdf_count       = regexp.MustCompile(`/Count\s+(\d+)`)
+
+	pdf_renderer_once sync.Once
+	pdf_renderer_path string
+)
+
+func is_pdf(file string) bool {
+	return strings.ToLower(filepath.Ext(file)) == ".pdf"
+}
+
+// pdf_renderer returns the path of pdftoppm, or "" if it is not available
+func pdf_renderer() string {
+	pdf_renderer_once.Do(func() {
+		pdf_renderer_path = ini_string("files", "pdftoppm", "")
+		if pdf_renderer_path == "" {
+			pdf_renderer_path, _ = exec.LookPath("pdftoppm")
+		}
+	})
+	return pdf_renderer_path
+}
+
+// pdf_variant_name returns the file name of a PDF's rendered variant
+func pdf_variant_name(name string, variant string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "_" + variant + ".png"
+}
+
+// pdf_variant_create renders the first page of a PDF to a PNG no larger than
+// size on its longest side, stored beside the PDF like an image variant.
+// Returns "" without error if no renderer is available.
+func pdf_variant_create(path string, variant string, size uint) (string, error) {
+	dir, file := filepath.Split(path)
+	out := dir + variant_dir(variant) + "/" + pdf_variant_name(file, variant)
+
+	l := variant_lock(out)
+	l.Lock()
+	defer l.Unlock()
+
+	if file_exists(out) {
+		return out, nil
+	}
+	renderer := pdf_renderer()
+	if renderer == "" {
+		return "", nil
+	}
+	if !file_exists(path) {
+		return "", os.ErrNotExist
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		warn("Unable to create %s variant directory %q: %v", variant, filepath.Dir(out), err)
+		return "", err
+	}
+
+	// pdftoppm -singlefile writes <prefix>.png
+	prefix := out + ".tmp"
+	tmp := prefix + ".png"
+	_ = os.Remove(tmp)
+	ctx, cancel := context.WithTimeout(context.Background(), pdf_render_timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, renderer, "-png", "-singlefile", "-f", "1", "-l", "1", "-scale-to", strconv.Itoa(int(size)), path, prefix)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(tmp)
+		// Like an undecodable image, a PDF that fails to render reflects its
+		// bytes, not a server fault
+		info("Unable to render PDF %q to create %s variant: %v %s", path, variant, err, strings.TrimSpace(string(output)))
+		return "", err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		_ = os.Remove(tmp)
+		info("Unable to move %s variant into place %q: %v", variant, out, err)
+		return "", err
+	}
+	return out, nil
+}
+
+// pdf_pages returns the number of pages in a PDF, or 0 if it can't be read
+func pdf_pages(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, pdf_parse_max))
+	if err != nil {
+		return 0
+	}
+
+	if n := pdf_pages_in(data); n > 0 {
+		return n
+	}
+
+	// PDF 1.5 and later may keep the page tree in compressed object streams
+	best := 0
+	for _, loc := range pdf_type_objstm.FindAllIndex(data, -1) {
+		_, end := pdf_dict(data, loc[0])
+		if end < 0 {
+			continue
+		}
+		stream := bytes.Index(data[end:], []byte("stream"))
+		if stream < 0 {
+			continue
+		}
+		start := end + stream + len("stream")
+		for start < len(data) && (data[start] == '\r' || data[start] == '\n') {
+			start++
+		}
+		stop := bytes.Index(data[start:], []byte("endstream"))
+		if stop < 0 {
+			continue
+		}
+		z, err := zlib.NewReader(bytes.NewReader(data[start : start+stop]))
+		if err != nil {
+			continue
+		}
+		inflated, _ := io.ReadAll(io.LimitReader(z, pdf_stream_max))
+		z.Close()
+		if n := pdf_pages_in(inflated); n > best {
+			best = n
+		}
+	}
+	return best
+}
+
+// pdf_pages_in returns the largest /Count of the page tree nodes in some PDF
+// bytes, which is the root's and so the document's page count
+func pdf_pages_in(data []byte) int {
+	best := 0
+	for _, loc := range pdf_type_pages.FindAllIndex(data, -1) {
+		start, end := pdf_dict(data, loc[0])
+		if start < 0 || end < 0 {
+			continue
+		}
+		if m := pdf_count.FindSubmatch(data[start:end]); m != nil {
+			if n, err := strconv.Atoi(string(m[1])); err == nil && n > best && n <= pdf_pages_max {
+				best = n
+			}
+		}
+	}
+	return best
+}
+
+// pdf_dict returns the bounds of the dictionary enclosing an offset, or -1
+// for a bound not found within 64KB
+func pdf_dict(data []byte, at int) (int, int) {
+	const reach = 64 << 10
+	start, end := -1, -1
+	depth := 0
+	for i := at - 1; i > 0 && i > at-reach; i-- {
+		if data[i-1] == '>' && data[i] == '>' {
+			depth++
+			i--
+		} else if data[i-1] == '<' && data[i] == '<' {
+			if depth == 0 {
+				start = i - 1
+				break
+			}
+			depth--
+			i--
+		}
+	}
+	depth = 0
+	for i := at; i+1 < len(data) && i < at+reach; i++ {
+		if data[i] == '<' && data[i+1] == '<' {
+			depth++
+			i++
+		} else if data[i] == '>' && data[i+1] == '>' {
+			if depth == 0 {
+				end = i + 2
+				break
+			}
+			depth--
+			i++
+		}
+	}
+	return start, end
+}
@@ -0,0 +1,79 @@
+// Mochi server: PDF previews tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPdfPages(t *testing.T) {
+	dir := t.TempDir()
+
+	plain := "%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 5 >>\nendobj\n" +
+		"3 0 obj\n<< /Type /Pages /Parent 2 0 R /Kids [5 0 R] /Count 2 >>\nendobj\n" +
+		"5 0 obj\n<< /Type /Page /Parent 3 0 R /Resources << /Font << >> >> >>\nendobj\n%%EOF\n"
+
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write([]byte("2 0 << /Type /Pages /Kids [3 0 R] /Count 12 >>"))
+	w.Close()
+	compressed := "%PDF-1.5\n1 0 obj\n<< /Type /ObjStm /N 1 /First 4 /Filter /FlateDecode /Length " + itoa(z.Len()) + " >>\nstream\n" +
+		z.String() + "\nendstream\nendobj\n%%EOF\n"
+
+	tests := []struct {
+		name string
+		data string
+		want int
+	}{
+		{"plain", plain, 5},
+		{"object stream", compressed, 12},
+		{"not a pdf", "hello", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".pdf")
+			os.WriteFile(path, []byte(tt.data), 0644)
+			if got := pdf_pages(path); got != tt.want {
+				t.Errorf("pdf_pages() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if got := pdf_pages(filepath.Join(dir, "missing.pdf")); got != 0 {
+		t.Errorf("pdf_pages(missing) = %d, want 0", got)
+	}
+}
+
+func TestPdfVariantName(t *testing.T) {
+	if got := pdf_variant_name("abc_report.PDF", "thumbnail"); got != "abc_report_thumbnail.png" {
+		t.Errorf("pdf_variant_name() = %q", got)
+	}
+	if !is_pdf("a.Pdf") || is_pdf("a.png") {
+		t.Error("is_pdf() wrong")
+	}
+}
+
+// A PDF's PNG previews are kept while the PDF exists
+func TestVariantCleanupPdf(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	files := filepath.Join(data_dir, "users", "u1", "documents", "files")
+	for _, p := range []string{"kept_a.pdf", "thumbnails/kept_a_thumbnail.png", "previews/gone_b_preview.png"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(files, p)), 0755)
+		os.WriteFile(filepath.Join(files, p), []byte("x"), 0644)
+	}
+	if n := variant_cleanup(); n != 1 {
+		t.Errorf("removed %d variants, want 1", n)
+	}
+	if !file_exists(filepath.Join(files, "thumbnails/kept_a_thumbnail.png")) {
+		t.Error("preview of a kept PDF removed")
+	}
+}
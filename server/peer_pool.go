@@ -0,0 +1,279 @@
+// Mochi server: Warm connections to frequently contacted peers.
+//
+// Every stream() call and every Sender rides a libp2p connection, which
+// multiplexes any number of streams over it. Opening a stream on a live
+// connection costs one round trip for the handshake; opening one after
+// the connection was trimmed or dropped costs a fresh dial as well —
+// address lookup, transport and security handshakes, often seconds on
+// a relayed or NAT'd path, paid during a federated action the user is
+// waiting on.
+//
+// So peers contacted often are kept warm: a peer opened at least
+// peer_pool_uses times within peer_pool_idle is protected from the
+// connection manager's trimming, and peer_pool_manager redials it in
+// the background if its connection drops, so the next stream finds a
+// connection waiting. A warm peer unused for peer_pool_idle is released.
+// At most peer_pool_size peers are warm; past that the least recently
+// used is released first.
+//
+// The pool also keeps each peer's stream statistics — opens, failures,
+// dials and a smoothed handshake round trip — served by
+// /_/admin/peers/stats for `mochictl peers stats`. In memory only; a
+// restart starts every peer afresh, and a peer that isn't warm is
+// forgotten once it's gone peer_pool_forget without an open or failure.
+//
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	p2p_network "github.com/libp2p/go-libp2p/core/network"
+	p2p_peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	peer_pool_tag          = "mochi-pool"
+	peer_pool_tick         = 30 * time.Second
+	peer_pool_uses_default = 3
+	peer_pool_idle_default = 600
+	peer_pool_size_default = 32
+	peer_pool_forget       = 86400
+)
+
+// PeerStats is one peer's row in the stats response
+type PeerStats struct {
+	Peer      string  `json:"peer"`
+	Connected bool    `json:"connected"`
+	Warm      bool    `json:"warm"`
+	Opens     int64   `json:"opens"`    // streams opened
+	Failures  int64   `json:"failures"` // stream opens that failed
+	Dials     int64   `json:"dials"`    // opens that needed a new connection
+	RTT       float64 `json:"rtt"`      // smoothed handshake round trip, milliseconds; 0 until measured
+	Used      int64   `json:"used"`     // unix time of the last open
+	Failed    int64   `json:"failed"`   // unix time of the last failure, 0 if none
+	uses      []int64 // recent opens, for warming
+}
+
+var (
+	peer_pool      = map[string]*PeerStats{}
+	peer_pool_lock sync.Mutex
+)
+
+// peer_pool_uses is how many opens within peer_pool_idle warm a peer
+func peer_pool_uses() int { return ini_int("peer", "pool_uses", peer_pool_uses_default) }
+
+// peer_pool_idle is how long, in seconds, a warm peer stays warm unused
+func peer_pool_idle() int { return ini_int("peer", "pool_idle", peer_pool_idle_default) }
+
+// peer_pool_size is the most peers kept warm at once; 0 turns warming off
+func peer_pool_size() int { return ini_int("peer", "pool_size", peer_pool_size_default) }
+
+// peer_pool_stats returns a peer's stats, creating them. Must be called
+// with peer_pool_lock held.
+func peer_pool_stats(peer string) *PeerStats {
+	p := peer_pool[peer]
+	if p == nil {
+		p = &PeerStats{Peer: peer}
+		peer_pool[peer] = p
+	}
+	return p
+}
+
+// peer_pool_connected reports whether there's a live connection to peer
+func peer_pool_connected(peer string) bool {
+	if net_me == nil {
+		return false
+	}
+	pid, err := p2p_peer.Decode(peer)
+	if err != nil {
+		return false
+	}
+	return net_me.Network().Connectedness(pid) == p2p_network.Connected
+}
+
+// peer_pool_protect marks a peer's connection as kept, or no longer kept,
+// by the connection manager
+func peer_pool_protect(peer string, keep bool) {
+	if net_me == nil {
+		return
+	}
+	pid, err := p2p_peer.Decode(peer)
+	if err != nil {
+		return
+	}
+	if keep {
+		net_me.ConnManager().Protect(pid, peer_pool_tag)
+	} else {
+		net_me.ConnManager().Unprotect(pid, peer_pool_tag)
+	}
+}
+
+// peer_pool_opened records a stream opened to peer, warming it once it's
+// been opened often enough. dialed is whether the open needed a new
+// connection.
+func peer_pool_opened(peer string, dialed bool) {
+	if peer == "" || peer == net_id {
+		return
+	}
+	t := now()
+	idle := int64(peer_pool_idle())
+	peer_pool_lock.Lock()
+	p := peer_pool_stats(peer)
+	p.Opens++
+	if dialed {
+		p.Dials++
+	}
+	p.Used = t
+	p.uses = append(slices.DeleteFunc(p.uses, func(u int64) bool { return t-u >= idle }), t)
+	warm := !p.Warm && len(p.uses) >= peer_pool_uses() && peer_pool_size() > 0
+	if warm {
+		p.Warm = true
+		p.uses = nil
+	}
+	peer_pool_lock.Unlock()
+
+	if warm {
+		debug("Peer pool: keeping peer %q warm", peer)
+		peer_pool_protect(peer, true)
+		peer_pool_trim()
+	}
+}
+
+// peer_pool_failed records a stream open to peer that failed
+func peer_pool_failed(peer string) {
+	if peer == "" || peer == net_id {
+		return
+	}
+	peer_pool_lock.Lock()
+	p := peer_pool_stats(peer)
+	p.Failures++
+	p.Failed = now()
+	peer_pool_lock.Unlock()
+}
+
+// peer_pool_rtt folds one handshake round trip, from the open starting
+// to the hello arriving, into the peer's smoothed RTT. Only opens on an
+// existing connection are measured, so dial time isn't counted.
+func peer_pool_rtt(peer string, start time.Time) {
+	if peer == "" || peer == net_id {
+		return
+	}
+	ms := float64(time.Since(start).Microseconds()) / 1000
+	peer_pool_lock.Lock()
+	p := peer_pool_stats(peer)
+	if p.RTT == 0 {
+		p.RTT = ms
+	} else {
+		p.RTT = 0.8*p.RTT + 0.2*ms
+	}
+	peer_pool_lock.Unlock()
+}
+
+// peer_pool_trim releases the least recently used warm peers past
+// peer_pool_size
+func peer_pool_trim() {
+	peer_pool_lock.Lock()
+	var warm []*PeerStats
+	for _, p := range peer_pool {
+		if p.Warm {
+			warm = append(warm, p)
+		}
+	}
+	slices.SortFunc(warm, func(a, b *PeerStats) int { return cmp.Compare(b.Used, a.Used) })
+	var released []string
+	for _, p := range warm[min(len(warm), max(peer_pool_size(), 0)):] {
+		p.Warm = false
+		released = append(released, p.Peer)
+	}
+	peer_pool_lock.Unlock()
+
+	for _, peer := range released {
+		debug("Peer pool: releasing peer %q, pool full", peer)
+		peer_pool_protect(peer, false)
+	}
+}
+
+// peer_pool_check releases warm peers unused for peer_pool_idle, forgets
+// other peers not heard of for peer_pool_forget, and returns the warm peers
+// whose connection has dropped
+func peer_pool_check() []string {
+	t := now()
+	idle := int64(peer_pool_idle())
+	var released, warm []string
+	peer_pool_lock.Lock()
+	for peer, p := range peer_pool {
+		if !p.Warm {
+			if t-max(p.Used, p.Failed) >= peer_pool_forget {
+				delete(peer_pool, peer)
+			}
+			continue
+		}
+		if t-p.Used >= idle {
+			p.Warm = false
+			released = append(released, p.Peer)
+		} else {
+			warm = append(warm, p.Peer)
+		}
+	}
+	peer_pool_lock.Unlock()
+
+	for _, peer := range released {
+		debug("Peer pool: releasing idle peer %q", peer)
+		peer_pool_protect(peer, false)
+	}
+	var dropped []string
+	for _, peer := range warm {
+		if !peer_pool_connected(peer) {
+			dropped = append(dropped, peer)
+		}
+	}
+	return dropped
+}
+
+// peer_pool_manager keeps warm peers connected, redialing any whose
+// connection dropped before the next stream needs it
+func peer_pool_manager() {
+	for range time.Tick(peer_pool_tick) {
+		for _, peer := range peer_pool_check() {
+			if peer_is_silent(peer) {
+				continue // peer_reconnect_manager is probing it
+			}
+			if peer_connect(peer) {
+				debug("Peer pool: redialed warm peer %q", peer)
+			}
+		}
+	}
+}
+
+// peer_pool_list returns every peer's stats, most recently used first
+func peer_pool_list() []PeerStats {
+	peer_pool_lock.Lock()
+	out := make([]PeerStats, 0, len(peer_pool))
+	for _, p := range peer_pool {
+		s := *p
+		s.uses = nil
+		out = append(out, s)
+	}
+	peer_pool_lock.Unlock()
+
+	for i := range out {
+		out[i].Connected = peer_pool_connected(out[i].Peer)
+	}
+	slices.SortFunc(out, func(a, b PeerStats) int { return cmp.Compare(b.Used, a.Used) })
+	return out
+}
+
+// admin_peers_stats is GET /_/admin/peers/stats
+func admin_peers_stats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"peers": peer_pool_list()})
+}
@@ -0,0 +1,72 @@
+// Mochi server: Warm peer connection tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerPool(t *testing.T) {
+	orig := peer_pool
+	peer_pool = map[string]*PeerStats{}
+	t.Cleanup(func() { peer_pool = orig })
+	t.Setenv("MOCHI_PEER_POOL_SIZE", "1")
+
+	// A peer is warmed once it's opened often enough
+	peer_pool_opened("alpha", true)
+	peer_pool_opened("alpha", false)
+	if peer_pool["alpha"].Warm {
+		t.Fatal("warm after two opens")
+	}
+	peer_pool_opened("alpha", false)
+	if p := peer_pool["alpha"]; !p.Warm || p.Opens != 3 || p.Dials != 1 {
+		t.Fatalf("after three opens %+v", p)
+	}
+
+	// Failures and round trips are counted
+	peer_pool_failed("alpha")
+	peer_pool_rtt("alpha", time.Now().Add(-100*time.Millisecond))
+	peer_pool_rtt("alpha", time.Now().Add(-200*time.Millisecond))
+	if p := peer_pool["alpha"]; p.Failures != 1 || p.RTT < 110 || p.RTT > 150 {
+		t.Errorf("failures %d, rtt %.1f", p.Failures, p.RTT)
+	}
+
+	// Past the pool size, the least recently used is released
+	peer_pool["alpha"].Used = now() - 10
+	for i := 0; i < 3; i++ {
+		peer_pool_opened("beta", false)
+	}
+	if peer_pool["alpha"].Warm || !peer_pool["beta"].Warm {
+		t.Errorf("pool of one kept alpha %v, beta %v", peer_pool["alpha"].Warm, peer_pool["beta"].Warm)
+	}
+
+	// Unused, a warm peer is released; one still in use whose connection
+	// dropped is returned for redialing
+	peer_pool_opened("alpha", false)
+	peer_pool["beta"].Used = now() - int64(peer_pool_idle())
+	t.Setenv("MOCHI_PEER_POOL_SIZE", "2")
+	for i := 0; i < 3; i++ {
+		peer_pool_opened("gamma", false)
+	}
+	dropped := peer_pool_check()
+	if peer_pool["beta"].Warm || len(dropped) != 1 || dropped[0] != "gamma" {
+		t.Errorf("beta warm %v, dropped %v", peer_pool["beta"].Warm, dropped)
+	}
+
+	if list := peer_pool_list(); len(list) != 3 || list[2].Peer != "beta" {
+		t.Errorf("list %+v", list)
+	}
+
+	// A peer no longer warm is forgotten once long unheard of
+	peer_pool["beta"].Used = now() - peer_pool_forget
+	peer_pool["beta"].Failed = 0
+	peer_pool_check()
+	if _, found := peer_pool["beta"]; found {
+		t.Error("idle peer kept")
+	}
+}
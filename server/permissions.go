@@ -50,6 +50,7 @@ var permissions = []Permission{
 	{"accounts/mcp", false, false},
 	{"groups/manage", false, false},
 	{"microphone", false, false},
+	{"presence/manage", false, false},
 	{"interests/read", false, false},
 	{"interests/write", false, false},
 	{"user/authentication/read", false, false},
@@ -60,12 +61,20 @@ var permissions = []Permission{
 
 	// Restricted permissions
 	{"accounts/notify", true, false},
+	{"activity/manage", true, false},
+	{"apps/purge", true, true},
+	{"moderation/manage", true, true},
+	{"notifications/manage", true, false},
 	{"notifications/send", true, false},
 	{"permissions/manage", true, false},
+	{"retention/manage", true, false},
 	{"server/update", true, true},
 	{"settings/write", true, true},
 	{"user/export", true, false},
+	{"users/impersonate", true, true},
+	{"users/invite", true, true},
 	{"users/read", true, true},
+	{"users/write", true, true},
 	{"webpush/send", true, false},
 }
 
@@ -444,12 +453,22 @@ func require_permission(t *sl.Thread, fn *sl.Builtin, permission string) error {
 		return fmt.Errorf("no app context")
 	}
 
+	// An administrator acting as a user can't change how they sign in
+	user, _ := t.Local("user").(*User)
+	if user != nil && user.Impersonator != "" && permission == "user/authentication/write" {
+		return fmt.Errorf("not while impersonating")
+	}
+
+	// Guests have none of what permissions guard, in any app
+	if user_guest(user) {
+		return fmt.Errorf("not available to guests")
+	}
+
 	// Internal Go apps bypass permission checks
 	if app_is_internal(app) {
 		return nil
 	}
 
-	user, _ := t.Local("user").(*User)
 	if user == nil {
 		return fmt.Errorf("no user context")
 	}
@@ -495,12 +514,16 @@ func api_permission_check(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []
 		return sl.False, nil
 	}
 
+	user, _ := t.Local("user").(*User)
+	if user_guest(user) {
+		return sl.False, nil
+	}
+
 	// Internal apps always have all permissions
 	if app_is_internal(app) {
 		return sl.True, nil
 	}
 
-	user, _ := t.Local("user").(*User)
 	if user == nil {
 		return sl.False, nil
 	}
@@ -0,0 +1,388 @@
+// Mochi server: Presence
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Presence is derived from a user's authenticated web requests: online while
+// active in the last five minutes, away for up to half an hour, then offline.
+// A user may set an explicit status of away or busy, which holds while they
+// are active, or invisible, which always reads as offline.
+//
+// Presence is private by default. It is published, as a signed "update"
+// event on the presence service, only to the entities in the user's presence
+// audience, on every change and as a heartbeat while online. Received updates
+// are held in memory per local user, read as offline once a heartbeat is
+// overdue, and pushed to the user's browsers on the "presence" websocket key.
+
+const (
+	presence_away_after    = 5 * 60
+	presence_offline_after = 30 * 60
+	presence_heartbeat     = 15 * 60
+	presence_stale         = 2 * presence_heartbeat
+	presence_message_limit = 200
+	presence_remote_limit  = 10000 // Remote entities remembered per user
+)
+
+type presence_state struct {
+	Status  string
+	Message string
+	Seen    int64
+	Updated int64
+}
+
+var (
+	presence_lock      sync.Mutex
+	presence_activity  = map[string]int64{}                     // User UID -> last activity
+	presence_published = map[string]presence_state{}            // User UID -> last published state
+	presence_remote    = map[string]map[string]presence_state{} // User UID -> entity -> state
+)
+
+var api_presence = sls.FromStringDict(sl.String("mochi.presence"), sl.StringDict{
+	"audience": sl.NewBuiltin("mochi.presence.audience", api_presence_audience),
+	"get":      sl.NewBuiltin("mochi.presence.get", api_presence_get),
+	"set":      sl.NewBuiltin("mochi.presence.set", api_presence_set),
+	"share":    sl.NewBuiltin("mochi.presence.share", api_presence_share),
+})
+
+func init() {
+	a := app("presence")
+	a.service("presence")
+	a.event("update", presence_update_event)
+}
+
+// presence_setup creates the presence audience table in a user database
+func (db *DB) presence_setup() {
+	db.exec("create table if not exists presence_audience (entity text not null primary key, created integer not null)")
+}
+
+// presence_touch records activity by a user, publishing if it changes their
+// status
+func presence_touch(u *User) {
+	if u == nil {
+		return
+	}
+	t := now()
+	presence_lock.Lock()
+	previous := presence_activity[u.UID]
+	presence_activity[u.UID] = t
+	presence_lock.Unlock()
+
+	// Only a return from away or offline can change the status
+	if t-previous >= presence_away_after {
+		go presence_publish(u, false)
+	}
+}
+
+// presence_explicit returns the status and message the user has set, if any
+func presence_explicit(u *User) (string, string) {
+	row, _ := db_user(u, "user").row("select text from settings where key='presence'")
+	message, _ := db_user(u, "user").row("select text from settings where key='presence_message'")
+	status, text := "", ""
+	if row != nil {
+		status, _ = row["text"].(string)
+	}
+	if message != nil {
+		text, _ = message["text"].(string)
+	}
+	return status, text
+}
+
+// presence_status returns a local user's current presence
+func presence_status(u *User) presence_state {
+	presence_lock.Lock()
+	seen := presence_activity[u.UID]
+	presence_lock.Unlock()
+
+	explicit, message := presence_explicit(u)
+	if explicit == "invisible" {
+		return presence_state{Status: "offline"}
+	}
+
+	idle := now() - seen
+	state := presence_state{Status: "offline", Message: message, Seen: seen}
+	switch {
+	case seen == 0 || idle >= presence_offline_after:
+		return state
+	case idle >= presence_away_after:
+		state.Status = "away"
+	default:
+		state.Status = "online"
+	}
+	if explicit == "away" || explicit == "busy" {
+		state.Status = explicit
+	}
+	return state
+}
+
+// presence_publish sends a user's presence to their audience if it has
+// changed since last published, a heartbeat is due, or force is set
+func presence_publish(u *User, force bool) {
+	if u == nil || u.Identity == nil {
+		return
+	}
+	state := presence_status(u)
+	state.Updated = now()
+
+	presence_lock.Lock()
+	last, found := presence_published[u.UID]
+	if !force && found && last.Status == state.Status && last.Message == state.Message {
+		if state.Status == "offline" || state.Updated-last.Updated < presence_heartbeat {
+			presence_lock.Unlock()
+			return
+		}
+	}
+	if !found && state.Status == "offline" && !force {
+		presence_lock.Unlock()
+		return
+	}
+	presence_published[u.UID] = state
+	presence_lock.Unlock()
+
+	rows, err := db_user(u, "user").rows("select entity from presence_audience")
+	if err != nil {
+		return
+	}
+	for _, row := range rows {
+		entity, _ := row["entity"].(string)
+		presence_send(u, entity, state)
+	}
+}
+
+// presence_send sends one presence update to an entity
+func presence_send(u *User, entity string, state presence_state) {
+	m := message(u.Identity.ID, entity, "presence", "update")
+	m.content["status"] = state.Status
+	m.content["message"] = state.Message
+	m.content["seen"] = i64toa(state.Seen)
+	m.send()
+}
+
+// presence_manager publishes transitions caused by inactivity, and
+// heartbeats for users who remain online
+func presence_manager() {
+	for range time.Tick(time.Minute) {
+		presence_lock.Lock()
+		var uids []string
+		for uid := range presence_activity {
+			uids = append(uids, uid)
+		}
+		presence_lock.Unlock()
+
+		for _, uid := range uids {
+			u := user_by_uid(uid)
+			if u == nil {
+				presence_forget(uid)
+				continue
+			}
+			presence_publish(u, false)
+
+			// Once offline has been published there is nothing more to
+			// send until the user is next active
+			presence_lock.Lock()
+			if presence_published[uid].Status == "offline" {
+				delete(presence_activity, uid)
+				delete(presence_published, uid)
+			}
+			presence_lock.Unlock()
+		}
+	}
+}
+
+// presence_forget drops local state for a user
+func presence_forget(uid string) {
+	presence_lock.Lock()
+	delete(presence_activity, uid)
+	delete(presence_published, uid)
+	delete(presence_remote, uid)
+	presence_lock.Unlock()
+}
+
+// presence_update_event receives a presence update from an entity
+func presence_update_event(e *Event) {
+	if e.user == nil || e.from == "" {
+		return
+	}
+	state := presence_state{
+		Status:  e.get("status", ""),
+		Message: e.get("message", ""),
+		Seen:    atoi(e.get("seen", ""), 0),
+		Updated: now(),
+	}
+	switch state.Status {
+	case "online", "away", "busy", "offline":
+	default:
+		info("Presence dropping update from %q with invalid status %q", e.from, state.Status)
+		return
+	}
+	if len(state.Message) > presence_message_limit {
+		state.Message = state.Message[:presence_message_limit]
+	}
+
+	presence_lock.Lock()
+	remote := presence_remote[e.user.UID]
+	if remote == nil {
+		remote = map[string]presence_state{}
+		presence_remote[e.user.UID] = remote
+	}
+	if _, found := remote[e.from]; !found && len(remote) >= presence_remote_limit {
+		presence_lock.Unlock()
+		return
+	}
+	remote[e.from] = state
+	presence_lock.Unlock()
+
+	websockets_send(e.user, "presence", map[string]any{"entity": e.from, "status": state.Status, "message": state.Message, "seen": state.Seen})
+}
+
+// presence_shared returns whether a user shares their presence with an entity
+func presence_shared(u *User, entity string) bool {
+	shared, _ := db_user(u, "user").exists("select 1 from presence_audience where entity=?", entity)
+	return shared
+}
+
+// presence_of returns the presence of an entity as known to a user, or false
+// if it is unknown or not shared with them
+func presence_of(u *User, entity string) (presence_state, bool) {
+	if u.Identity != nil && entity == u.Identity.ID {
+		return presence_status(u), true
+	}
+
+	// Another user on this server
+	if owner := user_owning_entity(entity); owner != nil {
+		if owner.UID == u.UID {
+			return presence_status(u), true
+		}
+		if u.Identity == nil || !presence_shared(owner, u.Identity.ID) {
+			return presence_state{}, false
+		}
+		return presence_status(owner), true
+	}
+
+	presence_lock.Lock()
+	state, found := presence_remote[u.UID][entity]
+	presence_lock.Unlock()
+	if !found {
+		return presence_state{}, false
+	}
+	if now()-state.Updated >= presence_stale {
+		state.Status = "offline"
+	}
+	return state, true
+}
+
+// mochi.presence.get(entity) -> dict | None: Presence of an entity as
+// {status, message, seen}, where status is "online", "away", "busy" or
+// "offline" and seen is the time last active. None if the entity does not
+// share its presence with the current user.
+func api_presence_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity); err != nil {
+		return nil, err
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	if !valid(entity, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+
+	state, found := presence_of(user, entity)
+	if !found {
+		return sl.None, nil
+	}
+	return sl_encode(map[string]any{"status": state.Status, "message": state.Message, "seen": state.Seen}), nil
+}
+
+// mochi.presence.set(status, message?) -> string: Set the current user's
+// status: "online" or "auto" to follow activity, "away", "busy", or
+// "invisible" to appear offline. Publishes the change to the user's audience.
+func api_presence_set(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var status, message string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "status", &status, "message?", &message); err != nil {
+		return nil, err
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	switch status {
+	case "online", "auto":
+		status = ""
+	case "away", "busy", "invisible":
+	default:
+		return sl_error(fn, "invalid status %q", status)
+	}
+	if len(message) > presence_message_limit {
+		return sl_error(fn, "message too long")
+	}
+
+	db := db_user(user, "user")
+	db.exec("replace into settings (key, text, number) values ('presence', ?, ?)", status, now())
+	db.exec("replace into settings (key, text, number) values ('presence_message', ?, ?)", message, now())
+	go presence_publish(user, false)
+	return sl.String(presence_status(user).Status), nil
+}
+
+// mochi.presence.share(entity, allow?) -> bool: Allow (default) or stop an
+// entity seeing the current user's presence. Requires presence/manage.
+func api_presence_share(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity string
+	allow := true
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "allow?", &allow); err != nil {
+		return nil, err
+	}
+	if err := require_permission(t, fn, "presence/manage"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	if !valid(entity, "entity") {
+		return sl_error(fn, "invalid entity")
+	}
+
+	db := db_user(user, "user")
+	if !allow {
+		db.exec("delete from presence_audience where entity=?", entity)
+		if user.Identity != nil {
+			// Tell the entity it can no longer see us
+			go presence_send(user, entity, presence_state{Status: "offline"})
+		}
+		return sl.False, nil
+	}
+	db.exec("insert or ignore into presence_audience (entity, created) values (?, ?)", entity, now())
+	if user.Identity != nil {
+		go presence_send(user, entity, presence_status(user))
+	}
+	return sl.True, nil
+}
+
+// mochi.presence.audience() -> list: Entities the current user shares their
+// presence with. Requires presence/manage.
+func api_presence_audience(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "presence/manage"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	rows, err := db_user(user, "user").rows("select entity, created from presence_audience order by created")
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
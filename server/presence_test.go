@@ -0,0 +1,140 @@
+// Mochi server: Presence tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+const presence_test_entity = "1PresenceTestRemoteEntityXXXXXXXXXXXXXXXXXXXXXXXX"
+
+func presence_test_setup(t *testing.T) (*User, *sl.Thread) {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	user := create_permission_test_user(t, "u1")
+	t.Cleanup(func() { presence_forget(user.UID) })
+	return user, create_test_thread(user, create_external_app("chat"))
+}
+
+// presence_test_active sets how many seconds ago a user was last active
+func presence_test_active(u *User, ago int64) {
+	presence_lock.Lock()
+	presence_activity[u.UID] = now() - ago
+	presence_lock.Unlock()
+}
+
+func TestPresenceStatus(t *testing.T) {
+	user, _ := presence_test_setup(t)
+	if s := presence_status(user).Status; s != "offline" {
+		t.Errorf("never active: %q, want offline", s)
+	}
+	for _, c := range []struct {
+		ago  int64
+		want string
+	}{
+		{10, "online"},
+		{presence_away_after + 1, "away"},
+		{presence_offline_after + 1, "offline"},
+	} {
+		presence_test_active(user, c.ago)
+		if s := presence_status(user).Status; s != c.want {
+			t.Errorf("active %ds ago: %q, want %q", c.ago, s, c.want)
+		}
+	}
+
+	// Explicit status holds while active; invisible hides activity
+	presence_test_active(user, 10)
+	db := db_user(user, "user")
+	db.exec("replace into settings (key, text) values ('presence', 'busy')")
+	if s := presence_status(user).Status; s != "busy" {
+		t.Errorf("busy while active: %q", s)
+	}
+	db.exec("replace into settings (key, text) values ('presence', 'invisible')")
+	if state := presence_status(user); state.Status != "offline" || state.Seen != 0 {
+		t.Errorf("invisible: %+v, want offline with no last seen", state)
+	}
+}
+
+func TestPresenceSet(t *testing.T) {
+	user, thread := presence_test_setup(t)
+	presence_test_active(user, 10)
+	set, _ := api_presence.Attr("set")
+	if _, err := sl.Call(thread, set, sl.Tuple{sl.String("asleep")}, nil); err == nil {
+		t.Error("invalid status accepted")
+	}
+	v, err := sl.Call(thread, set, sl.Tuple{sl.String("away"), sl.String("lunch")}, nil)
+	if err != nil || v != sl.String("away") {
+		t.Fatalf("set(away) = %v, %v", v, err)
+	}
+	if state := presence_status(user); state.Message != "lunch" {
+		t.Errorf("message %q, want lunch", state.Message)
+	}
+	v, _ = sl.Call(thread, set, sl.Tuple{sl.String("auto")}, nil)
+	if v != sl.String("online") {
+		t.Errorf("set(auto) = %v, want online", v)
+	}
+}
+
+func TestPresenceRemote(t *testing.T) {
+	user, thread := presence_test_setup(t)
+	get, _ := api_presence.Attr("get")
+	v, err := sl.Call(thread, get, sl.Tuple{sl.String(presence_test_entity)}, nil)
+	if err != nil || v != sl.None {
+		t.Fatalf("unknown entity: %v, %v", v, err)
+	}
+
+	presence_update_event(&Event{from: presence_test_entity, user: user, content: map[string]any{"status": "busy", "seen": "100"}})
+	v, err = sl.Call(thread, get, sl.Tuple{sl.String(presence_test_entity)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _, _ := v.(*sl.Dict).Get(sl.String("status"))
+	if status != sl.String("busy") {
+		t.Errorf("status %v, want busy", status)
+	}
+
+	// Without a heartbeat the entity reads as offline
+	presence_lock.Lock()
+	state := presence_remote[user.UID][presence_test_entity]
+	state.Updated -= presence_stale
+	presence_remote[user.UID][presence_test_entity] = state
+	presence_lock.Unlock()
+	if state, _ := presence_of(user, presence_test_entity); state.Status != "offline" {
+		t.Errorf("stale status %q, want offline", state.Status)
+	}
+
+	// Invalid statuses are dropped
+	presence_update_event(&Event{from: presence_test_entity, user: user, content: map[string]any{"status": "hacked"}})
+	if state, _ := presence_of(user, presence_test_entity); state.Status == "hacked" {
+		t.Error("invalid status stored")
+	}
+}
+
+func TestPresenceShare(t *testing.T) {
+	user, thread := presence_test_setup(t)
+	share, _ := api_presence.Attr("share")
+	if _, err := sl.Call(thread, share, sl.Tuple{sl.String(presence_test_entity)}, nil); err == nil {
+		t.Fatal("share without presence/manage should fail")
+	}
+
+	permission_grant(user, "chat", "presence/manage")
+	if _, err := sl.Call(thread, share, sl.Tuple{sl.String(presence_test_entity)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !presence_shared(user, presence_test_entity) {
+		t.Error("entity not added to audience")
+	}
+	if _, err := sl.Call(thread, share, sl.Tuple{sl.String(presence_test_entity), sl.False}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if presence_shared(user, presence_test_entity) {
+		t.Error("entity still in audience after removal")
+	}
+}
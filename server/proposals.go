@@ -0,0 +1,501 @@
+// Mochi server: Merge proposals
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	sl "go.starlark.net/starlark"
+)
+
+// A merge proposal offers a branch of a contributor's repository to another
+// repository, usually the one it was forked from, on the owner's server.
+// The contributor's server opens a _proposal/submit stream to the owner's
+// repository, on the app's service. The owner answers with the heads of its
+// refs, and the contributor sends a pack of only the objects reachable from
+// the branch and not from those heads, so a branch of a few commits costs a
+// few commits however large the repository. The owner stores the objects,
+// points refs/proposals/<id> at the branch's head so they're kept, and opens
+// a ticket of kind "proposal" with the proposal's id, authored by the
+// contributor.
+//
+// The owner's app reviews the proposal with mochi.git.merge.check() and
+// merge.perform() on the head, or refs/proposals/<id>, and discusses and
+// closes or merges it as a ticket; the ticket is sent back to the
+// contributor as it changes. The contributor may send the branch again with
+// mochi.git.proposal.update() while the proposal is open.
+//
+// Proposals are recorded in db/proposals.db on both servers: the owner's
+// with the repository it was proposed to, the contributor's also with the
+// fork it came from. A contributor may have at most proposal_open_limit
+// proposals open on a repository, and send at most rate_limit_proposal
+// proposals or updates from another server.
+
+const (
+	proposal_haves_limit = 1000
+	proposal_open_limit  = 20
+)
+
+type Proposal struct {
+	ID          string `db:"id"`
+	App         string `db:"app"`
+	Repository  string `db:"repository"`
+	Contributor string `db:"contributor"`
+	Fork        string `db:"fork"`
+	Source      string `db:"source"`
+	Branch      string `db:"branch"`
+	Head        string `db:"head"`
+	Created     int64  `db:"created"`
+	Updated     int64  `db:"updated"`
+}
+
+// proposals_db opens the server-wide proposals, creating the table if needed
+func proposals_db() *DB {
+	db := db_open("db/proposals.db")
+	db.exec("create table if not exists proposals (id text not null primary key, app text not null, repository text not null, contributor text not null, fork text not null default '', source text not null default '', branch text not null default '', head text not null, created integer not null, updated integer not null)")
+	db.exec("create index if not exists proposals_repository on proposals(repository, app)")
+	return db
+}
+
+// proposal_get returns a proposal, or nil
+func proposal_get(id string) *Proposal {
+	var p Proposal
+	if !proposals_db().scan(&p, "select * from proposals where id=?", id) {
+		return nil
+	}
+	return &p
+}
+
+// proposal_ref names the ref keeping a proposal's objects in the repository
+// it was proposed to
+func proposal_ref(id string) plumbing.ReferenceName {
+	return plumbing.ReferenceName("refs/proposals/" + id)
+}
+
+// view returns a proposal as seen by an app, with its ticket if held
+func (p *Proposal) view() map[string]any {
+	v := map[string]any{
+		"id":          p.ID,
+		"repository":  p.Repository,
+		"contributor": p.Contributor,
+		"fork":        p.Fork,
+		"source":      p.Source,
+		"branch":      p.Branch,
+		"head":        p.Head,
+		"created":     p.Created,
+		"updated":     p.Updated,
+	}
+	if user_owning_entity(p.Repository) != nil {
+		v["ref"] = string(proposal_ref(p.ID))
+	}
+	if t := ticket_get(p.ID); t != nil {
+		v["ticket"] = t.view()
+	}
+	return v
+}
+
+// proposal_haves returns the heads of a repository's refs, which a
+// contributor needn't send objects reachable from
+func proposal_haves(repo *git.Repository) []string {
+	haves := []string{}
+	refs, err := repo.References()
+	if err != nil {
+		return haves
+	}
+	refs.ForEach(func(r *plumbing.Reference) error {
+		if r.Type() == plumbing.HashReference && len(haves) < proposal_haves_limit {
+			haves = append(haves, r.Hash().String())
+		}
+		return nil
+	})
+	return haves
+}
+
+// proposal_pack writes a pack of the objects reachable from head and not
+// from any of the haves this repository also holds. Returns the number of
+// objects packed; none are written if there are none.
+func proposal_pack(repo *git.Repository, head plumbing.Hash, haves []string, w io.Writer) (int, error) {
+	var ignore []plumbing.Hash
+	for _, h := range haves {
+		hash := plumbing.NewHash(h)
+		if hash.IsZero() {
+			continue
+		}
+		if _, err := repo.CommitObject(hash); err == nil {
+			ignore = append(ignore, hash)
+		}
+	}
+	objects, err := revlist.Objects(repo.Storer, []plumbing.Hash{head}, ignore)
+	if err != nil {
+		return 0, err
+	}
+	if len(objects) == 0 {
+		return 0, nil
+	}
+	if _, err := packfile.NewEncoder(w, repo.Storer, false).Encode(objects, 10); err != nil {
+		return 0, err
+	}
+	return len(objects), nil
+}
+
+// proposal_unpack stores a pack's objects in a repository, and checks the
+// head commit is then present
+func proposal_unpack(repo *git.Repository, r io.Reader, size int64, head plumbing.Hash) error {
+	if size > 0 {
+		// Parse rather than copy the pack, so deltas against objects the
+		// repository already has are resolved, as for a push
+		if err := packfile.UpdateObjectStorage(&git_storage{repo.Storer}, io.LimitReader(r, size)); err != nil {
+			return fmt.Errorf("invalid pack: %v", err)
+		}
+	}
+	if _, err := repo.CommitObject(head); err != nil {
+		return fmt.Errorf("head %s not sent", head)
+	}
+	return nil
+}
+
+// proposal_open_count returns how many proposals a contributor has open on
+// a repository
+func proposal_open_count(app *App, repository, contributor string) int {
+	rows, _ := proposals_db().rows("select id from proposals where repository=? and app=? and contributor=?", repository, app.id, contributor)
+	open := 0
+	for _, r := range rows {
+		if t := ticket_get(r["id"].(string)); t != nil && t.State == "open" {
+			open++
+		}
+	}
+	return open
+}
+
+// proposal_accept stores a proposal sent to a repository on this server,
+// reading the pack from r, and opens or updates its ticket
+func proposal_accept(owner *User, app *App, repository, contributor string, content map[string]any, r io.Reader, size int64) error {
+	str := func(key string) string {
+		s, _ := content[key].(string)
+		return s
+	}
+	id := str("id")
+	head := plumbing.NewHash(str("head"))
+	if !valid(id, "id") || head.IsZero() {
+		return fmt.Errorf("invalid proposal")
+	}
+	if size < 0 || size > git_request_maximum("git-receive-pack", owner) {
+		return fmt.Errorf("proposal too large")
+	}
+
+	existing := proposal_get(id)
+	if existing != nil {
+		if existing.Repository != repository || existing.App != app.id || existing.Contributor != contributor {
+			return fmt.Errorf("proposal already exists")
+		}
+		if t := ticket_get(id); t == nil || t.State != "open" {
+			return fmt.Errorf("proposal not open")
+		}
+	} else if proposal_open_count(app, repository, contributor) >= proposal_open_limit {
+		return fmt.Errorf("too many open proposals")
+	}
+
+	repo, err := git_open(owner, app, repository)
+	if err != nil {
+		return fmt.Errorf("repository not found")
+	}
+	defer git_replicate_after(owner, app, repository)()
+	if err := proposal_unpack(repo, r, size, head); err != nil {
+		return err
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(proposal_ref(id), head)); err != nil {
+		return fmt.Errorf("unable to keep proposal: %v", err)
+	}
+
+	db := proposals_db()
+	n := now()
+	if existing != nil {
+		db.exec("update proposals set source=?, head=?, updated=? where id=?", str("source"), head.String(), n, id)
+		if t := ticket_get(id); t != nil {
+			ticket_event(t, contributor, "updated", map[string]any{"head": head.String()})
+			t.touch()
+			ticket_store(t)
+			ticket_publish(t)
+		}
+		return nil
+	}
+
+	branch := str("branch")
+	title := strings.TrimSpace(str("title"))
+	if title == "" {
+		title = "Merge " + str("source")
+	}
+	if len(title) > ticket_title_limit {
+		title = title[:ticket_title_limit]
+	}
+	db.exec("insert into proposals (id, app, repository, contributor, source, branch, head, created, updated) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", id, app.id, repository, contributor, str("source"), branch, head.String(), n, n)
+	t, err := ticket_open(id, app.id, repository, "proposal", title, str("body"), contributor, nil)
+	if err != nil {
+		return err
+	}
+	ticket_event(t, contributor, "proposed", map[string]any{"head": head.String(), "branch": branch, "source": str("source")})
+	return nil
+}
+
+// Event handler: _proposal/submit, a contributor proposing a branch to a
+// repository here
+func (e *Event) proposal_event_submit() {
+	s := e.stream
+	repo, err := git_open(e.user, e.app, e.to)
+	if err != nil {
+		s.write(map[string]string{"status": "404"})
+		return
+	}
+	db := db_app_system(e.user, e.app)
+	if db == nil || !db.access_check(e.user, e.from, "", "repository/"+e.to, "read") {
+		s.write(map[string]string{"status": "403"})
+		return
+	}
+	if !rate_limit_proposal.allow(e.from) {
+		s.write(map[string]string{"status": "429", "error": "too many proposals"})
+		return
+	}
+	s.write(map[string]any{"status": "200", "haves": proposal_haves(repo)})
+
+	header, err := s.read_content()
+	if err != nil {
+		return
+	}
+	size := int64(-1)
+	if v, ok := header["size"].(string); ok {
+		size = atoi(v, -1)
+	}
+	if err := proposal_accept(e.user, e.app, e.to, e.from, e.content, s.raw_reader(), size); err != nil {
+		info("Proposal from %q to %q refused: %v", e.from, e.to, err)
+		s.write(map[string]string{"status": "400", "error": err.Error()})
+		return
+	}
+	s.write(map[string]string{"status": "200"})
+}
+
+// proposal_send sends a branch of a local repository to the repository it's
+// proposed to, on this server or another
+func proposal_send(owner *User, app *App, p *Proposal, title, body string) error {
+	repo, err := git_open(owner, app, p.Fork)
+	if err != nil {
+		return fmt.Errorf("repository not found")
+	}
+	head, err := git_resolve_ref(repo, p.Source)
+	if err != nil {
+		return err
+	}
+	p.Head = head.String()
+	content := map[string]any{"id": p.ID, "source": p.Source, "branch": p.Branch, "head": p.Head, "title": title, "body": body}
+
+	if target := user_owning_entity(p.Repository); target != nil {
+		upstream, err := git_open(target, app, p.Repository)
+		if err != nil {
+			return fmt.Errorf("target repository not found")
+		}
+		db := db_app_system(target, app)
+		if db == nil || !db.access_check(target, p.Contributor, "", "repository/"+p.Repository, "read") {
+			return fmt.Errorf("not allowed")
+		}
+		var pack bytes.Buffer
+		if _, err := proposal_pack(repo, *head, proposal_haves(upstream), &pack); err != nil {
+			return err
+		}
+		return proposal_accept(target, app, p.Repository, p.Contributor, content, &pack, int64(pack.Len()))
+	}
+
+	service := app.id
+	if av := app.active(nil); av != nil && len(av.Services) > 0 {
+		service = av.Services[0]
+	}
+	s, err := stream(p.Contributor, p.Repository, service, "_proposal/submit", app.id, app_services(app, nil))
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	s.write(content)
+
+	status, err := s.read_content()
+	if err != nil {
+		return err
+	}
+	if status["status"] != "200" {
+		return fmt.Errorf("refused with status %v", status["status"])
+	}
+	var haves []string
+	if list, ok := status["haves"].([]any); ok {
+		for _, h := range list {
+			if s, ok := h.(string); ok {
+				haves = append(haves, s)
+			}
+		}
+	}
+
+	// Pack to a file first, so the owner knows how much to read
+	f, err := os.CreateTemp(cache_dir, "proposal-*.pack")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := proposal_pack(repo, *head, haves, f); err != nil {
+		return err
+	}
+	size, _ := f.Seek(0, io.SeekCurrent)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.write_content("size", i64toa(size)); err != nil {
+		return err
+	}
+	if _, err := io.Copy(s.writer, f); err != nil {
+		return err
+	}
+
+	result, err := s.read_content()
+	if err != nil {
+		return err
+	}
+	if result["status"] != "200" {
+		return fmt.Errorf("refused: %v", result["error"])
+	}
+	return nil
+}
+
+// mochi.git.proposal.create(entity, source, target, branch?, title?, body?,
+// from?) -> string: Propose a branch or other ref of a repository to
+// another repository, to be merged into one of its branches, by default
+// its default branch. Title defaults to the head commit's summary. Returns
+// the proposal's id, which is also its ticket's.
+func api_git_proposal_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entity, source, target, branch, title, body, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entity", &entity, "source", &source, "target", &target, "branch?", &branch, "title?", &title, "body?", &body, "from?", &from); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	owner, _ := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+	if !valid(entity, "entity") || !valid(target, "entity") || entity == target {
+		return sl_error(fn, "invalid entity")
+	}
+	if source == "" {
+		return sl_error(fn, "invalid source")
+	}
+	if !git_can_read(t, owner, app, entity) {
+		return sl_error(fn, "access denied")
+	}
+	actor := group_acting(user, from)
+	if actor == "" {
+		return sl_error(fn, "invalid from")
+	}
+
+	if title == "" {
+		if repo, err := git_open(owner, app, entity); err == nil {
+			if head, err := git_resolve_ref(repo, source); err == nil {
+				if c, err := repo.CommitObject(*head); err == nil {
+					title, _, _ = strings.Cut(strings.TrimSpace(c.Message), "\n")
+				}
+			}
+		}
+	}
+
+	p := &Proposal{ID: uid(), App: app.id, Repository: target, Contributor: actor, Fork: entity, Source: source, Branch: branch}
+	if err := proposal_send(owner, app, p, title, body); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if user_owning_entity(target) == nil {
+		n := now()
+		proposals_db().exec("insert into proposals (id, app, repository, contributor, fork, source, branch, head, created, updated) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", p.ID, p.App, p.Repository, p.Contributor, p.Fork, p.Source, p.Branch, p.Head, n, n)
+	} else {
+		proposals_db().exec("update proposals set fork=? where id=?", p.Fork, p.ID)
+	}
+	return sl.String(p.ID), nil
+}
+
+// mochi.git.proposal.update(id, source?) -> dict: Send a proposal's branch
+// again, with any commits added since, optionally from another ref. Returns
+// the proposal.
+func api_git_proposal_update(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, source string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "source?", &source); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	owner, _ := t.Local("owner").(*User)
+	p := proposal_get(id)
+	if owner == nil || p == nil || p.App != app.id || p.Fork == "" || group_acting(user, p.Contributor) == "" {
+		return sl_error(fn, "proposal not found")
+	}
+	if !git_can_read(t, owner, app, p.Fork) {
+		return sl_error(fn, "access denied")
+	}
+	if source != "" {
+		p.Source = source
+	}
+	if err := proposal_send(owner, app, p, "", ""); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	proposals_db().exec("update proposals set source=?, head=?, updated=? where id=?", p.Source, p.Head, now(), p.ID)
+	return sl_encode(proposal_get(id).view()), nil
+}
+
+// mochi.git.proposal.get(id) -> dict | None: Get a proposal: its
+// repository, contributor, fork (on the contributor's server), source and
+// target branch, head commit, ref (on the owner's server), and ticket
+func api_git_proposal_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+	_, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	p := proposal_get(id)
+	if p == nil || p.App != app.id {
+		return sl.None, nil
+	}
+	return sl_encode(p.view()), nil
+}
+
+// mochi.git.proposal.list(repository) -> list: Get the proposals to a
+// repository, newest first. For a repository on another server, only those
+// made from here are held.
+func api_git_proposal_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var repository string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "repository", &repository); err != nil {
+		return nil, err
+	}
+	_, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	var proposals []Proposal
+	if err := proposals_db().scans(&proposals, "select * from proposals where repository=? and app=? order by created desc", repository, app.id); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	results := make([]any, 0, len(proposals))
+	for i := range proposals {
+		results = append(results, proposals[i].view())
+	}
+	return sl_encode(results), nil
+}
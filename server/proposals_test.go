@@ -0,0 +1,159 @@
+// Mochi server: Merge proposals tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// proposal_test_commit adds a commit of one file to a repository's main
+// branch, returning its hash
+func proposal_test_commit(t *testing.T, repo *git.Repository, name, content string) plumbing.Hash {
+	t.Helper()
+	blob := repo.Storer.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, _ := blob.Writer()
+	w.Write([]byte(content))
+	w.Close()
+	blob_hash, err := repo.Storer.SetEncodedObject(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := &object.Tree{Entries: []object.TreeEntry{{Name: name, Mode: filemode.Regular, Hash: blob_hash}}}
+	tree_obj := repo.Storer.NewEncodedObject()
+	tree.Encode(tree_obj)
+	tree_hash, _ := repo.Storer.SetEncodedObject(tree_obj)
+
+	parent, err := git_resolve_ref(repo, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := object.Signature{Name: "Contributor", Email: "contributor@example.com", When: time.Now()}
+	commit := &object.Commit{Author: sig, Committer: sig, Message: "Add " + name + "\n", TreeHash: tree_hash, ParentHashes: []plumbing.Hash{*parent}}
+	commit_obj := repo.Storer.NewEncodedObject()
+	commit.Encode(commit_obj)
+	hash, _ := repo.Storer.SetEncodedObject(commit_obj)
+	repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("main"), hash))
+	return hash
+}
+
+// proposal_test_fork creates a repository and a copy of it
+func proposal_test_fork(t *testing.T, user *User, upstream, fork string) (*git.Repository, *git.Repository) {
+	t.Helper()
+	if err := git_init(user, test_app, upstream); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("cp", "-r", git_repo_path(user, test_app, upstream), git_repo_path(user, test_app, fork)).CombinedOutput(); err != nil {
+		t.Fatalf("copy repository: %v %s", err, out)
+	}
+	u, _ := git_open(user, test_app, upstream)
+	f, _ := git_open(user, test_app, fork)
+	return u, f
+}
+
+func TestProposalPack(t *testing.T) {
+	user, _, cleanup := create_git_test_env(t)
+	defer cleanup()
+	upstream, fork := proposal_test_fork(t, user, "upstream", "fork")
+	head := proposal_test_commit(t, fork, "fix.txt", "fixed")
+
+	// Only the new commit, its tree and its file are sent
+	var pack bytes.Buffer
+	n, err := proposal_pack(fork, head, proposal_haves(upstream), &pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("packed %d objects, want 3", n)
+	}
+	if err := proposal_unpack(upstream, &pack, int64(pack.Len()), head); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the owner has the head, nothing more is sent
+	upstream.Storer.SetReference(plumbing.NewHashReference(proposal_ref("p1"), head))
+	pack.Reset()
+	if n, _ := proposal_pack(fork, head, proposal_haves(upstream), &pack); n != 0 || pack.Len() != 0 {
+		t.Errorf("packed %d objects for a head already held", n)
+	}
+	if got, err := git_resolve_ref(upstream, "refs/proposals/p1"); err != nil || *got != head {
+		t.Errorf("proposal ref resolved to %v, %v", got, err)
+	}
+
+	// A head the pack doesn't carry is refused
+	missing := proposal_test_commit(t, fork, "other.txt", "other")
+	if err := proposal_unpack(upstream, &bytes.Buffer{}, 0, missing); err == nil {
+		t.Error("proposal accepted without its head")
+	}
+}
+
+func TestProposalAccept(t *testing.T) {
+	user, repository, contributor := comment_test_setup(t)
+	upstream, fork := proposal_test_fork(t, user, repository, contributor)
+	head := proposal_test_commit(t, fork, "fix.txt", "fixed")
+
+	var pack bytes.Buffer
+	proposal_pack(fork, head, proposal_haves(upstream), &pack)
+	id := uid()
+	content := map[string]any{"id": id, "source": "main", "branch": "main", "head": head.String(), "title": "Fix"}
+	if err := proposal_accept(user, test_app, repository, contributor, content, &pack, int64(pack.Len())); err != nil {
+		t.Fatal(err)
+	}
+	ticket := ticket_get(id)
+	if ticket == nil || ticket.Kind != "proposal" || ticket.Author != contributor || ticket.Owner != repository {
+		t.Fatalf("proposal ticket %+v", ticket)
+	}
+	if p := proposal_get(id); p == nil || p.Head != head.String() {
+		t.Fatalf("proposal %+v", p)
+	}
+
+	// Another entity may not send to the same proposal
+	if err := proposal_accept(user, test_app, repository, ticket_test_remote, content, &bytes.Buffer{}, 0); err == nil {
+		t.Error("proposal updated by someone other than its contributor")
+	}
+
+	// The contributor sends more commits while it's open
+	next := proposal_test_commit(t, fork, "more.txt", "more")
+	pack.Reset()
+	proposal_pack(fork, next, proposal_haves(upstream), &pack)
+	content["head"] = next.String()
+	if err := proposal_accept(user, test_app, repository, contributor, content, &pack, int64(pack.Len())); err != nil {
+		t.Fatal(err)
+	}
+	if p := proposal_get(id); p.Head != next.String() {
+		t.Errorf("updated head %s, want %s", p.Head, next)
+	}
+
+	// and not once it's merged
+	if _, err := ticket_apply(ticket_get(id), repository, "state", map[string]any{"state": "merged"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := proposal_accept(user, test_app, repository, contributor, content, &bytes.Buffer{}, 0); err == nil {
+		t.Error("merged proposal updated")
+	}
+
+	// A contributor may only have so many open at once
+	for i := 0; i < proposal_open_limit; i++ {
+		content["id"] = uid()
+		if err := proposal_accept(user, test_app, repository, contributor, content, &bytes.Buffer{}, 0); err != nil {
+			t.Fatalf("proposal %d: %v", i, err)
+		}
+	}
+	content["id"] = uid()
+	if err := proposal_accept(user, test_app, repository, contributor, content, &bytes.Buffer{}, 0); err == nil {
+		t.Error("proposal accepted past the open limit")
+	}
+}
@@ -118,10 +118,12 @@ type Frame struct {
 	Priority byte           `cbor:"priority,omitempty"`
 	Content  map[string]any `cbor:"content,omitempty"` // message frames only — /mochi/2/stream ships content as the first post-ack CBOR segment instead
 	Data     []byte         `cbor:"data,omitempty"`    // message frames only — packed post-content CBOR segments (handler reads via e.segment)
+	Key      string         `cbor:"key,omitempty"`     // message frames only — sender's idempotency key; receivers apply one (from, to, service, key) once
 
 	// Handshake-only fields.
 	Challenge []byte   `cbor:"challenge,omitempty"`
-	Version   int      `cbor:"version,omitempty"`
+	Version   int      `cbor:"version,omitempty"` // also on caps, message and open frames: the stream's negotiated version
+	Versions  []int    `cbor:"versions,omitempty"` // hello: every version the receiver speaks; see protocol2_version.go
 	Session   string   `cbor:"session,omitempty"`
 	Codecs    []string `cbor:"codecs,omitempty"`
 	Features  []string `cbor:"features,omitempty"`
@@ -337,7 +339,7 @@ func claim_sign(entity string, challenge []byte) []byte {
 		info("claim_sign entity %q not found", entity)
 		return nil
 	}
-	private := base58_decode(e.Private, "")
+	private := base58_decode(entity_private_resolve(e.Private), "")
 	if len(private) != ed25519.PrivateKeySize {
 		warn("claim_sign entity %q invalid private key length %d", entity, len(private))
 		return nil
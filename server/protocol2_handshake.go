@@ -4,9 +4,10 @@
 // sequence:
 //
 //   1. Receiver writes a `hello` frame with a fresh per-stream
-//      challenge, the protocol version, a session ID for log
+//      challenge, the protocol versions it speaks, a session ID for log
 //      correlation, and its supported codecs + features.
-//   2. Sender writes a `caps` frame with its own codecs + features.
+//   2. Sender writes a `caps` frame with the version it chose and its
+//      own codecs + features (protocol2_version.go).
 //   3. Sender writes one or more `claim` frames — one per local entity
 //      that will send on the stream. Receiver verifies the per-(stream,
 //      entity) signature and caches `claimed[From]=true`.
@@ -71,7 +72,9 @@ func hello_write(w io.Writer, version int, session string, challenge []byte,
 }
 
 // hello_read decodes the receiver's hello frame and runs the
-// rejection tests demanded by Challenge generation. The sender treats
+// rejection tests demanded by Challenge generation, requiring exactly
+// `version` — the check made by senders from before negotiation, which
+// hello_negotiate replaces. The sender treats
 // a rejected hello (bad challenge, wrong version) as a protocol
 // negotiation failure.
 func hello_read(r io.Reader, version int) (*Frame, error) {
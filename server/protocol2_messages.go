@@ -33,6 +33,10 @@ const (
 	// here and gated by intersection checks.
 	receiver_features_default = ""
 
+	// feature_capabilities — the receiver answers the "capabilities"
+	// service (see capabilities.go).
+	feature_capabilities = "capabilities"
+
 	// receiver_replies_buffer — depth of the per-stream replies
 	// channel. Drain-and-batch will coalesce whatever's queued into
 	// one ack frame; smaller depth = smaller batches but less risk of
@@ -49,9 +53,8 @@ func receiver_codecs() []string {
 }
 
 // receiver_features returns the capability flags this build supports.
-// Empty for now; future features get added here.
 func receiver_features() []string {
-	return nil
+	return []string{feature_capabilities}
 }
 
 // wire_stream is the subset of p2p_network.Stream the /mochi/2
@@ -73,6 +76,7 @@ type Receiver struct {
 	challenge []byte
 	codecs    []string // sender's advertised codecs from caps
 	features  []string // sender's advertised features from caps
+	version   int      // protocol version settled by caps
 	caps_seen atomic.Bool
 	replies   chan *Frame
 	claimed   map[string]bool
@@ -92,6 +96,11 @@ func receive_messages(s p2p_network.Stream) {
 		s.Reset()
 		return
 	}
+	if moderation_peer_blocked(peer) {
+		debug("Messages refusing blocked peer %q", peer)
+		s.Reset()
+		return
+	}
 
 	challenge, err := hello_challenge()
 	if err != nil {
@@ -110,7 +119,7 @@ func receive_messages(s p2p_network.Stream) {
 		claimed:   map[string]bool{},
 	}
 
-	if err := hello_write(s, 2, session, challenge, receiver_codecs(), receiver_features()); err != nil {
+	if err := hello_offer(s, session, challenge, receiver_codecs(), receiver_features()); err != nil {
 		info("Messages: hello write failed for peer %q session=%s: %v", peer, session, err)
 		s.Reset()
 		return
@@ -153,8 +162,15 @@ func (r *Receiver) read_loop() {
 				r.stream.Reset()
 				return
 			}
+			version, err := caps_version(f)
+			if err != nil {
+				info("Messages: protocol violation peer=%q session=%s — %v", r.peer, r.session, err)
+				r.stream.Reset()
+				return
+			}
 			r.codecs = f.Codecs
 			r.features = f.Features
+			r.version = version
 			r.caps_seen.Store(true)
 			continue
 		}
@@ -189,6 +205,7 @@ func (r *Receiver) handle(f *Frame) bool {
 		return true
 
 	case frame_type_message:
+		frame_translate_in(f, r.version)
 		r.dispatch_message(f)
 		return true
 
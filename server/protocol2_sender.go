@@ -97,6 +97,7 @@ type Sender struct {
 	challenge    []byte
 	codecs       []string // sender's effective codec set after intersection
 	features     []string // sender's effective feature set after intersection
+	version      int      // protocol version chosen from the receiver's hello
 	outbox       chan *outbound
 	inflight     map[string]*pending
 	pings        map[string]int64
@@ -138,6 +139,21 @@ func senders_has(peer string) bool {
 	return s != nil && !s.closed.Load()
 }
 
+// sender_features returns the features negotiated with `peer` by its open
+// Sender. ok is false if there is none, so nothing is known about the peer.
+func sender_features(peer string) (features []string, ok bool) {
+	if peer == "" {
+		return nil, false
+	}
+	senders_lock.Lock()
+	s := senders[peer]
+	senders_lock.Unlock()
+	if s == nil || s.closed.Load() {
+		return nil, false
+	}
+	return s.features, true
+}
+
 // peer_send is the entry point for /mochi/2/messages outbound. Looks
 // up (or creates) the Sender for `peer` and enqueues `frame` on its
 // outbox. Returns errSenderUnreachable / errSenderFull on failure so
@@ -176,6 +192,7 @@ func sender_for(peer string) (*Sender, error) {
 // per-Sender goroutines. Returns errSenderUnreachable if the peer
 // can't be reached or doesn't speak /mochi/2/messages.
 func sender_open(peer string) (*Sender, error) {
+	start, connected := time.Now(), peer_pool_connected(peer)
 	stream, err := peer_protocol_open(peer, protocol_messages)
 	if err != nil {
 		return nil, fmt.Errorf("sender: stream open failed: %w", err)
@@ -184,17 +201,20 @@ func sender_open(peer string) (*Sender, error) {
 		return nil, errSenderUnreachable
 	}
 
-	hello, err := hello_read(stream, 2)
+	hello, version, err := hello_negotiate(stream)
 	if err != nil {
 		stream.Reset()
 		return nil, fmt.Errorf("sender: hello read failed peer=%q: %w", peer, err)
 	}
+	if connected {
+		peer_pool_rtt(peer, start)
+	}
 
 	// Compute effective codec / feature sets.
 	codecs := codec_intersect(receiver_codecs(), hello.Codecs)
 	features := features_intersect(receiver_features(), hello.Features)
 
-	if err := caps_write(stream, codecs, features); err != nil {
+	if err := caps_write_version(stream, version, codecs, features); err != nil {
 		stream.Reset()
 		return nil, fmt.Errorf("sender: caps write failed peer=%q: %w", peer, err)
 	}
@@ -206,6 +226,7 @@ func sender_open(peer string) (*Sender, error) {
 		challenge: hello.Challenge,
 		codecs:    codecs,
 		features:  features,
+		version:   version,
 		outbox:    make(chan *outbound, peer_outbox()),
 		inflight:  map[string]*pending{},
 		pings:     map[string]int64{},
@@ -224,8 +245,8 @@ func sender_open(peer string) (*Sender, error) {
 	senders[peer] = s
 	senders_lock.Unlock()
 
-	debug("Sender: stream open peer=%q session=%s codecs=%v features=%v",
-		peer, s.session, codecs, features)
+	debug("Sender: stream open peer=%q session=%s version=%d codecs=%v features=%v",
+		peer, s.session, version, codecs, features)
 
 	go s.write_loop()
 	go s.read_loop()
@@ -260,6 +281,9 @@ func (s *Sender) write_loop() {
 // goroutine always finds the entry.
 func (s *Sender) write_one(ob *outbound) error {
 	f := ob.frame
+	if f.Type == frame_type_message {
+		f = frame_translate_out(f, s.version)
+	}
 
 	// Outbound rate limit (peer.rate, default unlimited). Per-Sender
 	// 1-second bucket. Ping frames also consume budget so a ping flood
@@ -387,6 +411,7 @@ func (s *Sender) handle_inbound(f *Frame) {
 		// deferred backlog resumes (peer_progress.go).
 		if acked {
 			peer_mark_progress(s.peer)
+			queue_backoff_clear(s.peer)
 		}
 
 	case frame_type_fail:
@@ -785,12 +810,14 @@ func peer_protocol_open(peer string, prefer string) (p2p_network.Stream, error)
 	if peer_is_silent(peer) {
 		return nil, errSenderUnreachable
 	}
+	dialed := peer != net_id && !peer_pool_connected(peer)
 	if peer != net_id && !peer_connect(peer) {
 		// Unknown or stale-addressed peer: ask the mesh for its current
 		// addresses (rate limited). A reply re-wakes the queue via
 		// peer_discovered_address, so the failed row retries promptly.
 		peer_request_addresses(peer)
 		peer_mark_send_failed(peer)
+		peer_pool_failed(peer)
 		return nil, errSenderUnreachable
 	}
 
@@ -803,6 +830,7 @@ func peer_protocol_open(peer string, prefer string) (p2p_network.Stream, error)
 	defer cancel()
 	s, err := net_me.NewStream(sctx, pid, p2p_protocol.ID(prefer))
 	if err != nil {
+		peer_pool_failed(peer)
 		if is_protocol_not_supported(err) {
 			debug("Protocol: peer %q does not support %q — treating as unreachable (peer never upgraded past /mochi/1?)", peer, prefer)
 			peer_mark_send_failed(peer)
@@ -812,6 +840,7 @@ func peer_protocol_open(peer string, prefer string) (p2p_network.Stream, error)
 		return nil, fmt.Errorf("protocol: NewStream peer=%q proto=%q: %w", peer, prefer, err)
 	}
 	peer_mark_send_success(peer)
+	peer_pool_opened(peer, dialed)
 	return s, nil
 }
 
@@ -881,6 +910,7 @@ func frame_for_queue(q *QueueEntry) (*Frame, error) {
 		Priority: frame_priority_for(q.Priority),
 		Content:  content,
 		Data:     q.Data,
+		Key:      q.Key,
 	}, nil
 }
 
@@ -893,6 +923,10 @@ func frame_for_message(m *Message, content []byte) (*Frame, error) {
 			return nil, err
 		}
 	}
+	priority := m.priority
+	if priority == 0 {
+		priority = queue_priority(m.Service, m.Event)
+	}
 	return &Frame{
 		Type:     frame_type_message,
 		ID:       m.ID,
@@ -902,8 +936,9 @@ func frame_for_message(m *Message, content []byte) (*Frame, error) {
 		Event:    m.Event,
 		FromApp:  m.FromApp,
 		Services: m.Services,
-		Priority: frame_priority_for(queue_priority(m.Service, m.Event)),
+		Priority: frame_priority_for(priority),
 		Content:  contentMap,
 		Data:     m.data,
+		Key:      m.key,
 	}, nil
 }
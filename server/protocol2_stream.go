@@ -44,6 +44,11 @@ func receive_stream(s p2p_network.Stream) {
 		s.Reset()
 		return
 	}
+	if moderation_peer_blocked(peer) {
+		debug("Stream refusing blocked peer %q", peer)
+		s.Reset()
+		return
+	}
 
 	challenge, err := hello_challenge()
 	if err != nil {
@@ -54,7 +59,7 @@ func receive_stream(s p2p_network.Stream) {
 	session := session_id()
 	// debug("Stream: open peer=%q session=%s", peer, session)
 
-	if err := hello_write(s, 2, session, challenge, receiver_codecs(), receiver_features()); err != nil {
+	if err := hello_offer(s, session, challenge, receiver_codecs(), receiver_features()); err != nil {
 		info("Stream: hello write failed peer=%q session=%s: %v", peer, session, err)
 		s.Reset()
 		return
@@ -66,7 +71,13 @@ func receive_stream(s p2p_network.Stream) {
 		s.Reset()
 		return
 	}
-	_ = caps // sender features not used by app-stream handlers today
+	// Sender features are not used by app-stream handlers today
+	version, err := caps_version(caps)
+	if err != nil {
+		info("Stream: protocol violation peer=%q session=%s — %v", peer, session, err)
+		s.Reset()
+		return
+	}
 
 	claimed := map[string]bool{}
 	var open *Frame
@@ -88,6 +99,7 @@ func receive_stream(s p2p_network.Stream) {
 			}
 			claimed[f.From] = true
 		case frame_type_open:
+			frame_translate_in(f, version)
 			open = f
 		default:
 			info("Stream: protocol violation peer=%q session=%s — %q before open", peer, session, f.Type)
@@ -129,6 +141,15 @@ func receive_stream(s p2p_network.Stream) {
 
 	st := stream_rw(s, s)
 	st.remote = s.Conn().RemoteMultiaddr().String()
+	if user != nil {
+		app := ""
+		if a := app_for_service(user, open.Service); a != nil {
+			app = a.id
+		}
+		st.account(peer, app, user.UID)
+	} else {
+		st.account(peer, "", "")
+	}
 
 	// Hand off to the shared post-handshake dispatch (reads the first
 	// content segment, builds the Event, routes it, closes).
@@ -200,6 +221,13 @@ func stream_dispatch(st *Stream, open *Frame, user *User, to, peer string) {
 		user:            user,
 	}
 
+	// A stream wants its answer now, so can't be held for after maintenance
+	if maintenance_active() {
+		stream_answer_error(st, map[string]any{"error": "server in maintenance", "code": 503, "transport": true})
+		st.close()
+		return
+	}
+
 	if err := e.route(); err != nil {
 		info("Stream dispatch: handler error service=%q event=%q: %v",
 			open.Service, open.Event, err)
@@ -289,6 +317,7 @@ func stream_self_loop(from, to, service, event, from_app string, services []stri
 func stream_open(peer, from, to, service, event, from_app string,
 	services []string, content map[string]any) (*Stream, string, error) {
 
+	start, connected := time.Now(), peer_pool_connected(peer)
 	rawstream, err := peer_protocol_open(peer, protocol_stream)
 	if err != nil {
 		return nil, "", err
@@ -297,16 +326,19 @@ func stream_open(peer, from, to, service, event, from_app string,
 		return nil, "", errSenderUnreachable
 	}
 
-	hello, err := hello_read(rawstream, 2)
+	hello, version, err := hello_negotiate(rawstream)
 	if err != nil {
 		rawstream.Reset()
 		return nil, "", fmt.Errorf("stream: hello read failed peer=%q: %w", peer, err)
 	}
+	if connected {
+		peer_pool_rtt(peer, start)
+	}
 
 	codecs := codec_intersect(receiver_codecs(), hello.Codecs)
 	features := features_intersect(receiver_features(), hello.Features)
 
-	if err := caps_write(rawstream, codecs, features); err != nil {
+	if err := caps_write_version(rawstream, version, codecs, features); err != nil {
 		rawstream.Reset()
 		return nil, "", fmt.Errorf("stream: caps write failed peer=%q: %w", peer, err)
 	}
@@ -337,7 +369,7 @@ func stream_open(peer, from, to, service, event, from_app string,
 		FromApp:  from_app,
 		Services: services,
 	}
-	if err := frame_write(rawstream, open); err != nil {
+	if err := frame_write(rawstream, frame_translate_out(open, version)); err != nil {
 		rawstream.Reset()
 		return nil, "", fmt.Errorf("stream: open write failed peer=%q: %w", peer, err)
 	}
@@ -351,6 +383,7 @@ func stream_open(peer, from, to, service, event, from_app string,
 	case frame_type_ack:
 		// Handshake complete; raw bytes from here on.
 		st := stream_rw(io.ReadCloser(rawstream), io.WriteCloser(rawstream))
+		st.account(peer, from_app, transfer_entity_user(from))
 		// If the caller passed a content map, ship it as the first
 		// post-ack segment so receive_stream's read picks it up as
 		// e.content. nil-content callers (stream_to_peer) write their
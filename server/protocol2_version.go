@@ -0,0 +1,173 @@
+// Mochi server: Protocol 2 — version negotiation.
+//
+// The protocol IDs name the protocol family (/mochi/2/*); the version
+// spoken on a stream is agreed in-band, so a server can be upgraded to a
+// new major version without cutting it off from peers still on the one
+// before:
+//
+//   1. The receiver's hello lists every version it speaks in Versions,
+//      and carries the oldest in Version — what a sender from before
+//      negotiation checks for.
+//   2. The sender picks the newest version both sides speak and names it
+//      in its caps Version. A caps without one is from a sender that
+//      predates negotiation, and speaks the hello's Version.
+//   3. Message and open frames carry the stream's version in Version.
+//
+// Handlers only ever see frames in the current version. A stream agreed
+// at the previous version passes its frames through that version's
+// translator: inbound frames are rewritten to the current shape before
+// dispatch, outbound frames to the old shape before they're written. One
+// previous major version is kept; /mochi/1 predates negotiation and was
+// retired before it, so for now protocol_versions holds 2 alone and there
+// is nothing to translate. A version 3 lists {3, 2} and registers the
+// translator for 2.
+//
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// protocol_versions are the versions this build speaks, newest first.
+// The first is the current version; any other must have a translator.
+var protocol_versions = []int{2}
+
+// protocol_translator rewrites frames between a previous version and the
+// current one
+type protocol_translator struct {
+	inbound  func(f *Frame) // previous → current, before dispatch
+	outbound func(f *Frame) // current → previous, before writing
+}
+
+// protocol_translators holds the translator for each previous version
+// in protocol_versions
+var protocol_translators = map[int]protocol_translator{}
+
+// protocol_version_current is the version this build prefers
+func protocol_version_current() int {
+	return protocol_versions[0]
+}
+
+// protocol_version_oldest is the oldest version this build speaks
+func protocol_version_oldest() int {
+	return protocol_versions[len(protocol_versions)-1]
+}
+
+// protocol_version_choose returns the newest version in both the offered
+// list and protocol_versions
+func protocol_version_choose(offered []int) (int, bool) {
+	for _, v := range protocol_versions {
+		if slices.Contains(offered, v) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// hello_versions returns the versions a hello offers. A hello from
+// before negotiation offers only its Version.
+func hello_versions(f *Frame) []int {
+	if len(f.Versions) > 0 {
+		return f.Versions
+	}
+	return []int{f.Version}
+}
+
+// hello_offer writes the receiver's hello frame, offering every version
+// this build speaks
+func hello_offer(w io.Writer, session string, challenge []byte, codecs, features []string) error {
+	return frame_write(w, &Frame{
+		Type:      frame_type_hello,
+		Version:   protocol_version_oldest(),
+		Versions:  protocol_versions,
+		Session:   session,
+		Challenge: challenge,
+		Codecs:    codecs,
+		Features:  features,
+	})
+}
+
+// hello_negotiate reads the receiver's hello frame as hello_read does,
+// and returns it with the version to speak. No version in common is a
+// negotiation failure.
+func hello_negotiate(r io.Reader) (*Frame, int, error) {
+	f, err := frame_read(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("hello: %w", err)
+	}
+	if f.Type != frame_type_hello {
+		return nil, 0, fmt.Errorf("hello: unexpected type %q", f.Type)
+	}
+	version, ok := protocol_version_choose(hello_versions(f))
+	if !ok {
+		return nil, 0, fmt.Errorf("hello: no common version, offered %v, speak %v", hello_versions(f), protocol_versions)
+	}
+	if err := frame_reject_challenge(f.Challenge); err != nil {
+		return nil, 0, err
+	}
+	return f, version, nil
+}
+
+// caps_write_version writes the sender's caps frame naming the version
+// chosen from the hello
+func caps_write_version(w io.Writer, version int, codecs, features []string) error {
+	return frame_write(w, &Frame{
+		Type:     frame_type_caps,
+		Version:  version,
+		Codecs:   codecs,
+		Features: features,
+	})
+}
+
+// caps_version returns the version a caps frame settles on, checked
+// against the versions this receiver offered
+func caps_version(f *Frame) (int, error) {
+	version := f.Version
+	if version == 0 {
+		version = protocol_version_oldest()
+	}
+	if !slices.Contains(protocol_versions, version) {
+		return 0, fmt.Errorf("caps: version %d not offered", version)
+	}
+	return version, nil
+}
+
+// frame_translate_in rewrites an inbound frame from the version it was
+// sent in to the current version. The frame's own Version wins over the
+// stream's.
+func frame_translate_in(f *Frame, stream int) {
+	version := f.Version
+	if version == 0 {
+		version = stream
+	}
+	if version != protocol_version_current() {
+		if t, found := protocol_translators[version]; found && t.inbound != nil {
+			t.inbound(f)
+		}
+	}
+	f.Version = protocol_version_current()
+}
+
+// frame_translate_out returns a frame to write on a stream of the given
+// version: the frame itself marked with the version, or for a previous
+// version a translated copy, so a frame retried on another stream is
+// translated afresh.
+func frame_translate_out(f *Frame, version int) *Frame {
+	if version == protocol_version_current() {
+		f.Version = version
+		return f
+	}
+	out := *f
+	out.Version = version
+	if t, found := protocol_translators[version]; found && t.outbound != nil {
+		t.outbound(&out)
+	}
+	return &out
+}
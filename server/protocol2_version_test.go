@@ -0,0 +1,132 @@
+// Mochi server: Protocol 2 version negotiation tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// test_protocol_versions stands in a build speaking versions, with a
+// translator for 2 that renames the content key "name" to "title"
+func test_protocol_versions(t *testing.T, versions ...int) {
+	t.Helper()
+	orig_versions, orig_translators := protocol_versions, protocol_translators
+	protocol_versions = versions
+	protocol_translators = map[int]protocol_translator{
+		2: {
+			inbound: func(f *Frame) {
+				f.Content = map[string]any{"title": f.Content["name"]}
+			},
+			outbound: func(f *Frame) {
+				f.Content = map[string]any{"name": f.Content["title"]}
+			},
+		},
+	}
+	t.Cleanup(func() { protocol_versions, protocol_translators = orig_versions, orig_translators })
+}
+
+// test_hello returns an offered hello, as written by the receiver
+func test_hello(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	challenge, err := hello_challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := hello_offer(&buf, "sess", challenge, receiver_codecs(), receiver_features()); err != nil {
+		t.Fatalf("hello_offer: %v", err)
+	}
+	return &buf
+}
+
+// TestVersionNegotiate: the sender takes the newest version both sides
+// speak, a hello from before negotiation offers its Version alone, and a
+// hello with nothing in common is refused.
+func TestVersionNegotiate(t *testing.T) {
+	if _, version, err := hello_negotiate(test_hello(t)); err != nil || version != 2 {
+		t.Fatalf("current build: version %d, %v", version, err)
+	}
+
+	challenge, _ := hello_challenge()
+	var buf bytes.Buffer
+	hello_write(&buf, 2, "sess", challenge, nil, nil)
+	if _, version, err := hello_negotiate(&buf); err != nil || version != 2 {
+		t.Errorf("hello from before negotiation: version %d, %v", version, err)
+	}
+	buf.Reset()
+	hello_write(&buf, 3, "sess", challenge, nil, nil)
+	if _, _, err := hello_negotiate(&buf); err == nil {
+		t.Error("hello offering only an unknown version was accepted")
+	}
+
+	// A build speaking 3 and 2: a sender from before negotiation still
+	// finds the 2 it checks for, a 2-only sender settles on 2, and another
+	// 3 on 3
+	test_protocol_versions(t, 3, 2)
+	if _, err := hello_read(test_hello(t), 2); err != nil {
+		t.Errorf("sender from before negotiation refused the hello: %v", err)
+	}
+	hello := test_hello(t)
+	test_protocol_versions(t, 2)
+	if _, version, err := hello_negotiate(hello); err != nil || version != 2 {
+		t.Errorf("2-only sender: version %d, %v", version, err)
+	}
+	test_protocol_versions(t, 3, 2)
+	if _, version, err := hello_negotiate(test_hello(t)); err != nil || version != 3 {
+		t.Errorf("3 to 3: version %d, %v", version, err)
+	}
+}
+
+// TestCapsVersion: caps names the version; one without is from a sender
+// that predates negotiation and speaks the oldest; one not offered fails.
+func TestCapsVersion(t *testing.T) {
+	test_protocol_versions(t, 3, 2)
+	var buf bytes.Buffer
+	caps_write(&buf, nil, nil)
+	caps, _ := caps_read(&buf)
+	if v, err := caps_version(caps); err != nil || v != 2 {
+		t.Errorf("caps without version: %d, %v", v, err)
+	}
+	caps_write_version(&buf, 3, nil, nil)
+	caps, _ = caps_read(&buf)
+	if v, err := caps_version(caps); err != nil || v != 3 {
+		t.Errorf("caps naming 3: %d, %v", v, err)
+	}
+	caps_write_version(&buf, 4, nil, nil)
+	caps, _ = caps_read(&buf)
+	if _, err := caps_version(caps); err == nil {
+		t.Error("caps naming a version not offered was accepted")
+	}
+}
+
+// TestFrameTranslate: frames for a previous version are translated on a
+// copy going out and back to the current shape coming in; current-version
+// frames pass through marked.
+func TestFrameTranslate(t *testing.T) {
+	test_protocol_versions(t, 3, 2)
+	f := &Frame{Type: frame_type_message, Content: map[string]any{"title": "Hello"}}
+
+	old := frame_translate_out(f, 2)
+	if old == f || old.Version != 2 || old.Content["name"] != "Hello" || f.Content["title"] != "Hello" {
+		t.Fatalf("outbound to 2: %+v, original %+v", old, f)
+	}
+	frame_translate_in(old, 3)
+	if old.Version != 3 || old.Content["title"] != "Hello" {
+		t.Errorf("inbound from 2: %+v", old)
+	}
+	if same := frame_translate_out(f, 3); same != f || f.Version != 3 {
+		t.Errorf("outbound to 3: %+v", same)
+	}
+
+	// An unmarked frame takes the stream's version
+	unmarked := &Frame{Type: frame_type_message, Content: map[string]any{"name": "Hi"}}
+	frame_translate_in(unmarked, 2)
+	if unmarked.Content["title"] != "Hi" {
+		t.Errorf("unmarked frame on a 2 stream: %+v", unmarked)
+	}
+}
@@ -179,7 +179,9 @@ func (w *app_worker) run() {
 	for wf := range w.inbox {
 		w.last_used.Store(now())
 		w.in_flight.Store(1)
+		governor_workers.enter()
 		w.handle(wf)
+		governor_workers.leave()
 		w.in_flight.Store(0)
 	}
 }
@@ -229,13 +231,27 @@ func (w *app_worker) handle(wf *worker_frame) {
 		peer:            wf.peer, // originating peer, NOT net_id
 		content:         content,
 		stream:          event_stream,
+		key:             f.Key,
 	}
 
-	if err := e.route(); err != nil {
+	// Accepted in maintenance, and handled when it ends
+	if held, err := maintenance_hold(e, f.Data); held {
+		if err != nil {
+			wf.reply.fail(fail_transient)
+			return
+		}
+		wf.reply.ack()
+		return
+	}
+
+	err := e.route()
+	e.log(f.Data, err)
+	if err != nil {
 		reason := worker_failure_reason(err)
 		wf.reply.fail(reason)
 		return
 	}
+	e.key_mark()
 	wf.reply.ack()
 }
 
@@ -265,6 +281,9 @@ func worker_failure_reason(err error) string {
 		// the verdict. Drop instead of retrying forever (this is what wedged
 		// the stuck _attachment/* self-loop rows at ~62 retries).
 		strings.HasPrefix(msg, "sender does not handle service"),
+		// Content breaking the event's declared schema is refused the same
+		// way however often it is sent
+		strings.HasPrefix(msg, "invalid content"),
 		strings.HasPrefix(msg, "unsigned attachment event"):
 		return fail_unsupported
 	case strings.HasPrefix(msg, "handler panic"):
@@ -564,6 +583,7 @@ func message_self_loop_dispatch(m *Message, content []byte) bool {
 			Priority: frame_priority_for(queue_priority(m.Service, m.Event)),
 			Content:  body,
 			Data:     m.data,
+			Key:      m.key,
 		},
 		peer:  net_id,
 		reply: local_reply{id: m.ID, service: m.Service, event: m.Event, to: to},
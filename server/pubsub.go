@@ -197,6 +197,9 @@ func pubsub_receive(f *Frame, peer, origin string) {
 		}
 	}
 
+	// Checked as sent; handlers see the current version
+	frame_translate_in(f, protocol_version_oldest())
+
 	// Deduplicate atomically, coalescing a re-flooded or multi-path
 	// delivery without racing the direct-stream workers that share the
 	// dedup map.
@@ -205,6 +208,9 @@ func pubsub_receive(f *Frame, peer, origin string) {
 	}
 
 	e := Event{id: event_id(), msg_id: f.ID, from: f.From, to: f.To, service: f.Service, event: f.Event, peer: peer, origin: origin, content: f.Content}
+	if held, _ := maintenance_hold(&e, nil); held {
+		return
+	}
 	if err := e.route(); err != nil {
 		debug("Pubsub frame route error for service %q event %q from peer %q: %v", f.Service, f.Event, peer, err)
 	}
@@ -264,20 +270,21 @@ func pubsub_publish(from, to, service, event, id string, content, data []byte) {
 
 	expires := i64toa(now() + pubsub_expires_ttl)
 
-	var sig []byte
+	// A flood reaches peers of every version, so it goes out in the
+	// oldest this build speaks, translated before it's signed
+	f := frame_translate_out(&Frame{
+		Type: frame_type_message, From: from, To: to,
+		Service: service, Event: event, ID: id,
+		Expires: expires, Content: cmap,
+	}, protocol_version_oldest())
+
 	if from != "" {
-		strcontent, ok := pubsub_string_content(cmap)
+		strcontent, ok := pubsub_string_content(f.Content)
 		if !ok {
 			warn("Pubsub refusing to sign non-string content for %q", from)
 			return
 		}
-		sig = pubsub_sign(from, service, event, expires, strcontent)
-	}
-
-	f := &Frame{
-		Type: frame_type_message, From: from, To: to,
-		Service: service, Event: event, ID: id,
-		Expires: expires, Content: cmap, Signature: sig,
+		f.Signature = pubsub_sign(from, service, event, expires, strcontent)
 	}
 	if len(data) > 0 {
 		f.Data = data
@@ -0,0 +1,300 @@
+// Mochi server: Installable web apps
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Each app can be installed to a phone's home screen or a computer's app
+// launcher as a web app. Its pages link to a manifest core makes from its
+// label and icons, and to a script registering a service worker for the
+// app's path:
+//
+//	/<app>/_/manifest.webmanifest
+//	/<app>/_/pwa.js
+//	/<app>/_/sw.js
+//
+// The worker keeps the scripts, styles, images and fonts the app's pages
+// load in a cache, answering from it and refreshing it behind. Pages are
+// left to the network, apart from the routes the app lists as working
+// offline, which are fetched when the worker is installed and served from
+// the cache when the network fails. An app declares these, and optionally
+// its colours, with "pwa" in app.json:
+//
+//	"pwa": {"offline": ["", "notes"], "theme": "#3b82f6", "background": "#ffffff"}
+//
+// An app that shouldn't be installed, such as one only ever reached from
+// another, sets "install": false.
+
+// AppPwa is how an app installs as a web app
+type AppPwa struct {
+	Install    *bool    `json:"install,omitempty"`    // Default true
+	Offline    []string `json:"offline,omitempty"`    // Routes relative to the app's path
+	Theme      string   `json:"theme,omitempty"`      // Colour of the title bar
+	Background string   `json:"background,omitempty"` // Colour of the splash screen
+}
+
+const pwa_offline_maximum = 50
+
+var pwa_colour_re = regexp.MustCompile(`^#([0-9a-fA-F]{3}){1,2}$`)
+
+func pwa_validate(p *AppPwa) error {
+	if len(p.Offline) > pwa_offline_maximum {
+		return fmt.Errorf("App has more than %d pwa offline routes", pwa_offline_maximum)
+	}
+	for _, route := range p.Offline {
+		if !valid(route, "path") || strings.HasPrefix(route, "/") || strings.HasPrefix(route, "_/") {
+			return fmt.Errorf("App bad pwa offline route %q", route)
+		}
+	}
+	for _, colour := range []string{p.Theme, p.Background} {
+		if colour != "" && !pwa_colour_re.MatchString(colour) {
+			return fmt.Errorf("App bad pwa colour %q", colour)
+		}
+	}
+	return nil
+}
+
+// pwa_installable reports whether an app version may be installed
+func pwa_installable(av *AppVersion) bool {
+	return av != nil && (av.Pwa == nil || av.Pwa.Install == nil || *av.Pwa.Install)
+}
+
+// pwa_tags returns the tags linking an app's pages at a path to its
+// manifest and service worker
+func pwa_tags(user *User, path string) []string {
+	a := app_for_path(user, path)
+	if a == nil {
+		return nil
+	}
+	av := a.active(user)
+	if !pwa_installable(av) || !av.user_allowed(user) {
+		return nil
+	}
+	base := "/" + escape_attr(path) + "/_/"
+	tags := []string{
+		`<link rel="manifest" href="` + base + `manifest.webmanifest" crossorigin="use-credentials">`,
+		`<script src="` + base + `pwa.js" defer></script>`,
+	}
+	if av.Pwa != nil && av.Pwa.Theme != "" {
+		tags = append(tags, `<meta name="theme-color" content="`+escape_attr(av.Pwa.Theme)+`">`)
+	}
+	return tags
+}
+
+// pwa_serve serves one of the files for installing an app at a path
+func pwa_serve(c *gin.Context, a *App, user *User, path, file string) {
+	av := a.active(user)
+	if !pwa_installable(av) || !av.user_allowed(user) {
+		respond_error(c, http.StatusNotFound, "not_found", "errors.not_found", nil)
+		return
+	}
+	scope := "/" + path + "/"
+
+	// Each reflects the app's current version and the user's language, so
+	// browsers check them whenever they're used
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Vary", "Cookie")
+
+	switch file {
+	case "manifest.webmanifest":
+		c.Data(http.StatusOK, "application/manifest+json", []byte(json_encode(pwa_manifest(a, av, user, scope))))
+
+	case "pwa.js":
+		c.Data(http.StatusOK, "text/javascript; charset=utf-8", []byte(fmt.Sprintf(pwa_register_js, json_encode(scope+"_/sw.js"), json_encode(scope))))
+
+	case "sw.js":
+		offline := []string{}
+		if av.Pwa != nil && av.Pwa.Offline != nil {
+			offline = av.Pwa.Offline
+		}
+		// The worker lives under /<app>/_/, but controls the whole app
+		c.Header("Service-Worker-Allowed", scope)
+		c.Data(http.StatusOK, "text/javascript; charset=utf-8", []byte(fmt.Sprintf(pwa_worker_js, json_encode("mochi:"+a.id+":"), json_encode(av.Version), json_encode(scope), json_encode(offline))))
+
+	default:
+		respond_error(c, http.StatusNotFound, "not_found", "errors.not_found", nil)
+	}
+}
+
+// pwa_manifest returns the web app manifest of an app at a scope
+func pwa_manifest(a *App, av *AppVersion, user *User, scope string) map[string]any {
+	label := a.label(user, av, av.Label)
+	manifest := map[string]any{
+		"id":         scope,
+		"name":       label,
+		"short_name": label,
+		"start_url":  scope,
+		"scope":      scope,
+		"display":    "standalone",
+		"icons":      pwa_icons(av, scope),
+	}
+	if av.Pwa != nil {
+		if av.Pwa.Theme != "" {
+			manifest["theme_color"] = av.Pwa.Theme
+		}
+		if av.Pwa.Background != "" {
+			manifest["background_color"] = av.Pwa.Background
+		}
+	}
+	return manifest
+}
+
+// pwa_icons lists an app's own icons for its manifest, with the sizes of
+// those whose files can be read
+func pwa_icons(av *AppVersion, scope string) []map[string]string {
+	var files []string
+	if f := av.icon(); f != "" {
+		files = append(files, f)
+	}
+	for _, i := range av.Icons {
+		if i.Action == "" && !slices.Contains(files, i.File) {
+			files = append(files, i.File)
+		}
+	}
+
+	icons := []map[string]string{}
+	for _, f := range files {
+		icon := map[string]string{"src": scope + f}
+		ext := strings.ToLower(filepath.Ext(f))
+		if t := mime.TypeByExtension(ext); t != "" {
+			icon["type"] = t
+		}
+		if ext == ".svg" {
+			icon["sizes"] = "any"
+		} else if size := pwa_icon_size(av, f); size != "" {
+			icon["sizes"] = size
+		}
+		icons = append(icons, icon)
+	}
+	return icons
+}
+
+// pwa_icon_size returns the dimensions of an icon served by one of an app's
+// file actions, or "" if it can't be read
+func pwa_icon_size(av *AppVersion, name string) string {
+	aa := av.find_action(name)
+	if aa == nil {
+		return ""
+	}
+	var root, path string
+	switch {
+	case aa.File != "":
+		root, path = av.base, av.base+"/"+aa.File
+	case aa.Files != "":
+		root = av.base + "/" + aa.Files
+		path = root + "/" + aa.filepath
+	default:
+		return ""
+	}
+	path, _, ok := web_static_path(root, path)
+	if !ok {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", config.Width, config.Height)
+}
+
+const pwa_register_js = `// Mochi app service worker registration
+if ('serviceWorker' in navigator) {
+  navigator.serviceWorker.register(%s, { scope: %s }).catch(function() {});
+}
+`
+
+const pwa_worker_js = `// Mochi app service worker
+const prefix = %s;
+const cache_name = prefix + %s;
+const scope = %s;
+const offline = %s;
+const assets = ['script', 'style', 'image', 'font'];
+
+self.addEventListener('install', function(event) {
+  event.waitUntil(
+    caches.open(cache_name).then(function(cache) {
+      return Promise.all(offline.map(function(route) {
+        return cache.add(new Request(scope + route, { credentials: 'include' })).catch(function() {});
+      }));
+    }).then(function() {
+      return self.skipWaiting();
+    })
+  );
+});
+
+// Drop the caches of the app's earlier versions
+self.addEventListener('activate', function(event) {
+  event.waitUntil(
+    caches.keys().then(function(names) {
+      return Promise.all(names.filter(function(name) {
+        return name.startsWith(prefix) && name !== cache_name;
+      }).map(function(name) {
+        return caches.delete(name);
+      }));
+    }).then(function() {
+      return self.clients.claim();
+    })
+  );
+});
+
+self.addEventListener('fetch', function(event) {
+  const request = event.request;
+  const url = new URL(request.url);
+  if (request.method !== 'GET' || url.origin !== self.location.origin || url.pathname.startsWith('/_/')) return;
+
+  // Offline routes: the network, then what the route last showed
+  if (request.mode === 'navigate') {
+    if (!url.pathname.startsWith(scope) || !offline.includes(url.pathname.slice(scope.length))) return;
+    event.respondWith(
+      fetch(request).then(function(response) {
+        if (response.ok) {
+          const copy = response.clone();
+          caches.open(cache_name).then(function(cache) { cache.put(request, copy); });
+        }
+        return response;
+      }).catch(function() {
+        return caches.match(request).then(function(cached) { return cached || Response.error(); });
+      })
+    );
+    return;
+  }
+
+  // Static assets: the cache, refreshed behind. Attachments are the user's
+  // own and aren't kept.
+  if (!assets.includes(request.destination) || url.pathname.includes('/-/attachments/')) return;
+  event.respondWith(
+    caches.open(cache_name).then(function(cache) {
+      return cache.match(request).then(function(cached) {
+        const fresh = fetch(request).then(function(response) {
+          if (response.ok) cache.put(request, response.clone());
+          return response;
+        });
+        if (!cached) return fresh;
+        fresh.catch(function() {});
+        return cached;
+      });
+    })
+  );
+});
+`
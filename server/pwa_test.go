@@ -0,0 +1,90 @@
+// Mochi server: Installable web app tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPwa(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(base, "images", "notes.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 192, 192)))
+	f.Close()
+
+	av := &AppVersion{Version: "1.2", Label: "Notes", base: base, Pwa: &AppPwa{Offline: []string{"", "recent"}, Theme: "#336699"}}
+	av.Icons = []Icon{{Label: "Notes", File: "images/notes.png"}, {Label: "Notes", File: "images/notes.svg"}, {Action: "new", Label: "New", File: "images/new.png"}}
+	av.Actions = map[string]AppAction{"images": {Files: "images"}}
+	a := &App{id: "pwatest", internal: av}
+	av.app = a
+
+	serve := func(file string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/notes/_/"+file, nil)
+		pwa_serve(c, a, nil, "notes", file)
+		return w
+	}
+
+	w := serve("manifest.webmanifest")
+	var manifest struct {
+		Name, Scope, Display string
+		Theme                string `json:"theme_color"`
+		Icons                []map[string]string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &manifest); err != nil || w.Header().Get("Content-Type") != "application/manifest+json" {
+		t.Fatalf("manifest %q %q: %v", w.Header().Get("Content-Type"), w.Body.String(), err)
+	}
+	if manifest.Name != "Notes" || manifest.Scope != "/notes/" || manifest.Display != "standalone" || manifest.Theme != "#336699" {
+		t.Errorf("manifest %+v", manifest)
+	}
+	if len(manifest.Icons) != 2 || manifest.Icons[0]["src"] != "/notes/images/notes.png" || manifest.Icons[0]["sizes"] != "192x192" || manifest.Icons[1]["sizes"] != "any" || manifest.Icons[1]["type"] != "image/svg+xml" {
+		t.Errorf("icons %v", manifest.Icons)
+	}
+
+	w = serve("sw.js")
+	if w.Header().Get("Service-Worker-Allowed") != "/notes/" || !strings.Contains(w.Body.String(), `const offline = ["","recent"];`) || !strings.Contains(w.Body.String(), `const cache_name = prefix + "1.2";`) {
+		t.Errorf("worker %v %q", w.Header(), w.Body.String())
+	}
+	if w = serve("pwa.js"); !strings.Contains(w.Body.String(), `register("/notes/_/sw.js", { scope: "/notes/" })`) {
+		t.Errorf("registration %q", w.Body.String())
+	}
+	if w = serve("other.js"); w.Code != http.StatusNotFound {
+		t.Errorf("other file %d", w.Code)
+	}
+
+	off := false
+	av.Pwa.Install = &off
+	if w = serve("manifest.webmanifest"); w.Code != http.StatusNotFound {
+		t.Errorf("uninstallable app served manifest %d", w.Code)
+	}
+
+	for _, p := range []AppPwa{{Offline: []string{"../x"}}, {Offline: []string{"/x"}}, {Offline: []string{"_/sw.js"}}, {Theme: "blue"}, {Background: "#12345"}} {
+		if pwa_validate(&p) == nil {
+			t.Errorf("accepted %+v", p)
+		}
+	}
+	if err := pwa_validate(&AppPwa{Offline: []string{"", "notes/recent"}, Theme: "#fff", Background: "#ffffff"}); err != nil {
+		t.Error(err)
+	}
+}
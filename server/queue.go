@@ -46,6 +46,14 @@ const (
 	priority_bulk        = 10 // replication data: sql/op, system/set, system/row
 )
 
+// Scheduled messages (mochi.message.send with after=) are queued with
+// status='scheduled', outside every claim path, and next_retry and created
+// both set to their delivery time, so their age budget starts when they
+// become due. queue_release_scheduled moves them to 'pending' once due.
+// queue_after_max keeps a scheduled row's data from sitting in queue.db
+// indefinitely.
+const queue_after_max = 30 * 86400 // 30 days
+
 // queue_silent_defer is how long to push a row's next_retry forward
 // when the target peer is in the silent-failure cache. Recovery is via
 // queue_resurrect_peer when the peer reconnects. With pick-by-peer +
@@ -98,6 +106,7 @@ type QueueEntry struct {
 	LastError    string `db:"last_error"`
 	Created      int64  `db:"created"`
 	Priority     int    `db:"priority"`
+	Key          string `db:"key"`
 }
 
 const (
@@ -188,7 +197,7 @@ func queue_claim_for_peer(peer string, limit int) []QueueEntry {
 		)
 		returning id, type, target, from_entity, to_entity, service, event,
 			from_app, from_services, content, data, file, expires, status,
-			attempts, next_retry, created, priority`,
+			attempts, next_retry, created, priority, key`,
 		peer, now(), limit)
 	if err != nil {
 		info("queue_claim_for_peer error peer=%q: %v", peer, err)
@@ -222,7 +231,7 @@ func queue_claim_for_self(limit int) []QueueEntry {
 		)
 		returning id, type, target, from_entity, to_entity, service, event,
 			from_app, from_services, content, data, file, expires, status,
-			attempts, next_retry, created, priority`,
+			attempts, next_retry, created, priority, key`,
 		net_id, now(), limit)
 	if err != nil {
 		info("queue_claim_for_self error: %v", err)
@@ -245,6 +254,64 @@ func queue_next_retry(attempts int) int64 {
 	return now() + delay + jitter
 }
 
+// Per-destination backoff. Each row backs off on its own attempts, but a
+// peer that is failing fails every row queued for it, and rows new to the
+// queue would each retry it from the bottom of the ladder. queue_backoff
+// keeps a failure streak per target peer: a failure after the current
+// backoff has passed climbs the same ladder, failures inside it (the other
+// rows in flight) don't compound it, and queue_fail schedules no row for
+// the target before it ends. A delivery to the peer, or its reconnecting,
+// clears the streak; so does an hour past the backoff without a failure.
+type queue_backoff_state struct {
+	lock     sync.Mutex
+	failures int
+	until    int64
+}
+
+var queue_backoff sync.Map // target -> *queue_backoff_state
+
+// queue_backoff_fail records a failed delivery to a target and returns the
+// time before which no row for it should be retried
+func queue_backoff_fail(target string) int64 {
+	if target == "" {
+		return 0
+	}
+	v, _ := queue_backoff.LoadOrStore(target, &queue_backoff_state{})
+	s := v.(*queue_backoff_state)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t := now()
+	if t >= s.until {
+		if t-s.until > retry_delays[len(retry_delays)-1] {
+			s.failures = 0
+		}
+		idx := min(s.failures, len(retry_delays)-1)
+		s.failures++
+		delay := retry_delays[idx]
+		s.until = t + delay + rand.Int63n(delay/4)
+	}
+	return s.until
+}
+
+// queue_backoff_clear ends a target's failure streak
+func queue_backoff_clear(target string) {
+	if target != "" {
+		queue_backoff.Delete(target)
+	}
+}
+
+// queue_release_scheduled moves scheduled rows that have become due into
+// the ready set, waking the senders if there were any
+func queue_release_scheduled() {
+	db := db_open("db/queue.db")
+	t := now()
+	if due, _ := db.exists("select 1 from queue where status = 'scheduled' and next_retry <= ?", t); !due {
+		return
+	}
+	db.exec_bg("queue release scheduled", "update queue set status = 'pending' where status = 'scheduled' and next_retry <= ?", t)
+	queue_wake()
+}
+
 // queue_warn_rows / queue_warn_age / queue_warn_attempts are the
 // pending-backlog thresholds past which queue_watchdog warns for a
 // (target, service) bucket. The News feed self-loop wedge (2026-07-06
@@ -531,22 +598,40 @@ func queue_add_direct(id, target, from_entity, to_entity, service, event, from_a
 // (currently only broadcast_resync, which marks replies priority_replay)
 // pass it directly; the (service, event) default is bypassed.
 func queue_add_direct_priority(id, target, from_entity, to_entity, service, event, from_app string, services []string, content, data []byte, file string, expires int64, priority int) {
+	queue_add_direct_at(id, target, from_entity, to_entity, service, event, from_app, services, content, data, file, expires, priority, 0, "")
+}
+
+// queue_add_direct_at is queue_add_direct_priority with a delivery time and
+// idempotency key. A row due in the future is queued as scheduled and
+// released by the queue manager when it comes due.
+func queue_add_direct_at(id, target, from_entity, to_entity, service, event, from_app string, services []string, content, data []byte, file string, expires int64, priority int, after int64, key string) {
 	db := db_open("db/queue.db")
 	from_services := strings.Join(services, ",")
+	status, t := "pending", now()
+	if after > t {
+		status, t = "scheduled", after
+	}
+	if entity_suspended(from_entity) {
+		status = "held"
+	}
 	db.exec(`insert or replace into queue
-		(id, type, target, from_entity, to_entity, service, event, from_app, from_services, content, data, file, expires, status, attempts, next_retry, created, priority)
-		values (?, 'direct', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'pending', 0, ?, ?, ?)`,
-		id, target, from_entity, to_entity, service, event, from_app, from_services, content, data, file, expires, now(), now(), priority)
+		(id, type, target, from_entity, to_entity, service, event, from_app, from_services, content, data, file, expires, status, attempts, next_retry, created, priority, key)
+		values (?, 'direct', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?)`,
+		id, target, from_entity, to_entity, service, event, from_app, from_services, content, data, file, expires, status, t, t, priority, key)
 }
 
 // Add a broadcast message to the queue
 func queue_add_broadcast(id, from_entity, to_entity, service, event, from_app string, services []string, content, data []byte, expires int64) {
 	db := db_open("db/queue.db")
 	from_services := strings.Join(services, ",")
+	status := "pending"
+	if entity_suspended(from_entity) {
+		status = "held"
+	}
 	db.exec(`insert or replace into queue
 		(id, type, target, from_entity, to_entity, service, event, from_app, from_services, content, data, file, expires, status, attempts, next_retry, created, priority)
-		values (?, 'broadcast', 'pubsub', ?, ?, ?, ?, ?, ?, ?, ?, '', ?, 'pending', 0, ?, ?, ?)`,
-		id, from_entity, to_entity, service, event, from_app, from_services, content, data, expires, now(), now(), queue_priority(service, event))
+		values (?, 'broadcast', 'pubsub', ?, ?, ?, ?, ?, ?, ?, ?, '', ?, ?, 0, ?, ?, ?)`,
+		id, from_entity, to_entity, service, event, from_app, from_services, content, data, expires, status, now(), now(), queue_priority(service, event))
 }
 
 // Mark a message as acknowledged (remove from queue). A successful
@@ -559,6 +644,7 @@ func queue_ack(id string) {
 	var q QueueEntry
 	if db.scan(&q, "select from_entity, to_entity, target from queue where id = ?", id) {
 		health_success(q.ToEntity)
+		queue_backoff_clear(q.Target)
 		if q.Target != "" {
 			if user := user_owning_entity(q.FromEntity); user != nil {
 				directory_user_confirm(user, q.ToEntity, q.Target)
@@ -737,6 +823,7 @@ func queue_drop(id, reason string) {
 			health_denial(q.ToEntity)
 		}
 		if code, errReason, ok := error_code_for_nack(reason); ok {
+			queue_dead(&q, reason)
 			queue_error_dispatch(&q, code, errReason)
 		}
 	}
@@ -860,6 +947,7 @@ func queue_resurrect_peer(target string) {
 	if target == "" {
 		return
 	}
+	queue_backoff_clear(target)
 	db := db_open("db/queue.db")
 	t := now()
 	db.exec_bg("queue resurrect peer", "update queue set next_retry = ? where target = ? and status = 'pending' and next_retry > ?", t, target, t)
@@ -885,6 +973,8 @@ func queue_fail(id string, err string) {
 
 	if age > queue_max_age {
 		//warn("Queue dropping message after %d attempts: id=%q type=%q from=%q to=%q service=%q event=%q error=%q", attempts, q.ID, q.Type, q.FromEntity, q.ToEntity, q.Service, q.Event, err)
+		q.LastError = err
+		queue_dead(&q, "timeout")
 		db.exec_bg("queue fail drop aged", "delete from queue where id = ?", id)
 		// The retry budget is exhausted: the learned route (if any) is
 		// proven dead, not merely old — evict it so future sends surface
@@ -920,8 +1010,8 @@ func queue_fail(id string, err string) {
 			info("Queue parked a delivery for (target=%q, service=%q) after %d failed attempts (latest: %s); rows keep their data, revive if the peer reconnects, and are reaped after %d days.", q.Target, q.Service, attempts, err, queue_max_age/86400)
 		}
 	} else {
-		// Schedule retry
-		next := queue_next_retry(attempts)
+		// Schedule retry, no sooner than the target's own backoff
+		next := max(queue_next_retry(attempts), queue_backoff_fail(q.Target))
 		db.exec_bg("queue fail retry reschedule", "update queue set status = 'pending', attempts = ?, next_retry = ?, last_error = ? where id = ?", attempts, next, err, id)
 		//debug("Queue message %q scheduled for retry %d at %d: %s", id, attempts, next, err)
 	}
@@ -1074,6 +1164,7 @@ func queue_send_self_loop_fast(q *QueueEntry) (ok bool) {
 		Priority: frame_priority_for(q.Priority),
 		Content:  content,
 		Data:     q.Data,
+		Key:      q.Key,
 	}
 
 	// Mark sending so queue_process knows the resolver owns this row.
@@ -1150,7 +1241,7 @@ func queue_select(db *DB) []QueueEntry {
 		with ranked as (
 			select id, type, target, from_entity, to_entity, service, event,
 				from_app, from_services, content, data, file, expires,
-				status, attempts, next_retry, last_error, created, priority,
+				status, attempts, next_retry, last_error, created, priority, key,
 				row_number() over (partition by target order by priority desc, next_retry asc) as rn
 			from queue
 			where status = 'pending' and next_retry <= ?
@@ -1158,7 +1249,7 @@ func queue_select(db *DB) []QueueEntry {
 		)
 		select id, type, target, from_entity, to_entity, service, event,
 			from_app, from_services, content, data, file, expires,
-			status, attempts, next_retry, last_error, created, priority
+			status, attempts, next_retry, last_error, created, priority, key
 		from ranked
 		where rn = 1
 		order by priority desc, next_retry asc
@@ -1171,7 +1262,7 @@ func queue_select(db *DB) []QueueEntry {
 	var other []QueueEntry
 	if err := db.scans(&other, `select id, type, target, from_entity, to_entity, service, event,
 			from_app, from_services, content, data, file, expires,
-			status, attempts, next_retry, last_error, created, priority
+			status, attempts, next_retry, last_error, created, priority, key
 		from queue
 		where status = 'pending' and next_retry <= ?
 			and (type != 'direct' or target = '')
@@ -1216,6 +1307,12 @@ func queue_process() int {
 				processed++
 				continue
 			}
+			// Queued just before its user was suspended
+			if entity_suspended(q.FromEntity) {
+				db.exec_bg("queue hold suspended", "update queue set status = 'held' where id = ? and status = 'pending'", q.ID)
+				processed++
+				continue
+			}
 		}
 		// Silent-peer pre-filter: defer rows whose target is in the
 		// in-memory silent-failure cache (peer_is_silent) so they
@@ -1322,9 +1419,11 @@ func queue_process() int {
 		}
 		sem := get_sem(bucket, cap)
 		sem <- struct{}{}
+		governor_queue.enter()
 		go func(q QueueEntry, sem chan struct{}) {
 			defer wg.Done()
 			defer func() { <-sem }()
+			defer governor_queue.leave()
 
 			var ok bool
 			switch {
@@ -1401,6 +1500,7 @@ func queue_cleanup() {
 		warn("Database error loading expired queue entries: %v", err)
 		return
 	}
+	queue_dead_aged(db, aged, repl_cutoff, gen_cutoff)
 	db.exec_bg("queue cleanup", "delete from queue where "+aged, repl_cutoff, gen_cutoff)
 
 	// Surface each aged-out send as message/timeout to its sending app,
@@ -1442,6 +1542,10 @@ func queue_cleanup() {
 	// them, so no fan-out consults the row again. If the host ever
 	// returns, inbound contact rebuilds state from scratch anyway.
 	db.exec_bg("health cleanup", "delete from health where suspended != 0 and suspended < ?", now()-2*queue_evict_age)
+
+	// Acknowledgements never answered, and receipts never read
+	db.exec_bg("ack cleanup", "delete from acks where created < ?", now()-event_ack_retention)
+	db.exec_bg("receipt cleanup", "delete from receipts where created < ?", now()-event_ack_retention)
 }
 
 // Drain queue before shutdown (wait for pending sends to complete)
@@ -1535,7 +1639,12 @@ func queue_manager() {
 	tick := time.NewTicker(time.Second)
 	defer tick.Stop()
 	go func() {
+		var released time.Time
 		for {
+			if time.Since(released) >= time.Second {
+				queue_release_scheduled()
+				released = time.Now()
+			}
 			n := queue_process()
 			queue_check_ack_timeout()
 			if n > 0 {
@@ -1555,6 +1664,8 @@ func queue_manager() {
 	// Cleanup runs less frequently
 	for range time.Tick(time.Hour) {
 		queue_cleanup()
+		queue_dead_cleanup()
 		message_seen_cleanup()
+		event_log_cleanup()
 	}
 }
@@ -0,0 +1,154 @@
+// Mochi server: Dead letters
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// A direct message the queue gives up on, because it outlived its retry
+// budget or the recipient's host rejected it, is kept in queue.db's dead
+// table rather than deleted, so an operator can see what failed and why,
+// and requeue it once the cause is fixed (mochictl queue dead, mochictl
+// queue requeue). Requeueing keeps the message ID, so a recipient that did
+// receive it after all discards the copy. Replication ops are not kept —
+// replicas converge through their own resync — nor are broadcasts, whose
+// subscribers catch up through the floor and resync paths, nor messages
+// that expired as their sender asked.
+
+const (
+	queue_dead_age = 30 * 86400 // Seconds dead letters are kept
+	queue_dead_max = 10000      // Dead letters kept at most
+)
+
+var (
+	ErrDeadLetterMissing = errors.New("dead letter not found")
+	ErrDeadLetterExpired = errors.New("dead letter has expired")
+)
+
+type DeadLetter struct {
+	ID         string `db:"id" json:"id"`
+	Target     string `db:"target" json:"target"`
+	FromEntity string `db:"from_entity" json:"from"`
+	ToEntity   string `db:"to_entity" json:"to"`
+	Service    string `db:"service" json:"service"`
+	Event      string `db:"event" json:"event"`
+	FromApp    string `db:"from_app" json:"app"`
+	Attempts   int    `db:"attempts" json:"attempts"`
+	LastError  string `db:"last_error" json:"error"`
+	Reason     string `db:"reason" json:"reason"`
+	Created    int64  `db:"created" json:"created"`
+	Died       int64  `db:"died" json:"died"`
+}
+
+// queue_dead_kept reports whether a failed row is kept as a dead letter
+func queue_dead_kept(q *QueueEntry) bool {
+	return q.Type == "direct" && q.Service != "replication"
+}
+
+// queue_dead keeps a row the queue is giving up on. Call before the row is
+// deleted from the queue.
+func queue_dead(q *QueueEntry, reason string) {
+	if !queue_dead_kept(q) {
+		return
+	}
+	db := db_open("db/queue.db")
+	db.exec_bg("queue dead letter", `insert or replace into dead
+		(id, target, from_entity, to_entity, service, event, from_app, from_services, content, data, file, expires, attempts, last_error, reason, priority, created, died, key)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		q.ID, q.Target, q.FromEntity, q.ToEntity, q.Service, q.Event, q.FromApp, q.FromServices, q.Content, q.Data, q.File, q.Expires, q.Attempts, q.LastError, reason, q.Priority, q.Created, now(), q.Key)
+}
+
+// queue_dead_aged keeps the rows queue_cleanup is about to reap for age, in
+// one statement. where is the cleanup's age condition and args its values.
+func queue_dead_aged(db *DB, where string, args ...any) {
+	db.exec_bg("queue dead letter aged", `insert or replace into dead
+		(id, target, from_entity, to_entity, service, event, from_app, from_services, content, data, file, expires, attempts, last_error, reason, priority, created, died, key)
+		select id, target, from_entity, to_entity, service, event, from_app, from_services, content, data, file, expires, attempts, last_error, 'timeout', priority, created, ?, key
+		from queue where type = 'direct' and service != 'replication' and (expires = 0 or expires > ?) and `+where+` limit ?`,
+		append(append([]any{now(), now()}, args...), queue_dead_max)...)
+}
+
+// queue_dead_cleanup drops dead letters past their age, and the oldest past
+// the count limit
+func queue_dead_cleanup() {
+	db := db_open("db/queue.db")
+	db.exec_bg("queue dead cleanup", "delete from dead where died < ?", now()-queue_dead_age)
+	db.exec_bg("queue dead trim", "delete from dead where id not in (select id from dead order by died desc limit ?)", queue_dead_max)
+}
+
+// queue_dead_list returns dead letters, newest first, optionally only those
+// of one service
+func queue_dead_list(service string, limit int) ([]DeadLetter, int64) {
+	db := db_open("db/queue.db")
+	where, args := "", []any{}
+	if service != "" {
+		where, args = " where service = ?", []any{service}
+	}
+	var out []DeadLetter
+	if err := db.scans(&out, "select id, target, from_entity, to_entity, service, event, from_app, attempts, last_error, reason, created, died from dead"+where+" order by died desc limit ?", append(args, limit)...); err != nil {
+		info("Queue dead letter list error: %v", err)
+	}
+	total := db.integer64("select count(*) from dead"+where, args...)
+	return out, total
+}
+
+// queue_requeue returns a dead letter to the queue for delivery, with a
+// fresh retry and age budget
+func queue_requeue(id string) error {
+	db := db_open("db/queue.db")
+	row, err := db.row("select * from dead where id = ?", id)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return ErrDeadLetterMissing
+	}
+	expires := row_int(row, "expires")
+	if expires > 0 && expires < now() {
+		return ErrDeadLetterExpired
+	}
+	str := func(key string) string {
+		v, _ := row[key].(string)
+		return v
+	}
+	blob := func(key string) []byte {
+		// db.row returns blobs as strings
+		if s := str(key); s != "" {
+			return []byte(s)
+		}
+		return nil
+	}
+	var services []string
+	if s := str("from_services"); s != "" {
+		services = strings.Split(s, ",")
+	}
+	queue_add_direct_at(id, str("target"), str("from_entity"), str("to_entity"), str("service"), str("event"), str("from_app"), services, blob("content"), blob("data"), str("file"), expires, int(row_int(row, "priority")), 0, str("key"))
+	db.exec("delete from dead where id = ?", id)
+	queue_backoff_clear(str("target"))
+	queue_wake()
+	return nil
+}
+
+// queue_requeue_all requeues every dead letter, or those of one service,
+// returning how many were requeued
+func queue_requeue_all(service string) int {
+	db := db_open("db/queue.db")
+	query, args := "select id from dead", []any{}
+	if service != "" {
+		query, args = query+" where service = ?", []any{service}
+	}
+	rows, _ := db.rows(query, args...)
+	n := 0
+	for _, r := range rows {
+		if id, _ := r["id"].(string); id != "" && queue_requeue(id) == nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,86 @@
+// Mochi server: Dead letters tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// A row aged out of queue_fail becomes a dead letter, and requeueing it
+// puts it back in the queue with a fresh budget under the same ID
+func TestQueueDeadRequeue(t *testing.T) {
+	cleanup := setup_replication_test(t)
+	defer cleanup()
+	db := queue_test_table()
+	var calls []error_call
+	defer error_test_capture(&calls)()
+
+	old := now() - queue_max_age - 100
+	error_test_queue_insert(db, "d1", "owner", "feeds", "gone", "feeds", "post/create", old)
+	db.exec("update queue set content=?, key='k1' where id='d1'", cbor_encode(map[string]any{"post": "p1"}))
+	queue_fail("d1", "dial failed")
+
+	rows, total := queue_dead_list("", 10)
+	if total != 1 || len(rows) != 1 {
+		t.Fatalf("dead letters = %d (%d listed), want 1", total, len(rows))
+	}
+	if rows[0].ID != "d1" || rows[0].Reason != "timeout" || rows[0].LastError != "dial failed" {
+		t.Errorf("dead letter = %+v", rows[0])
+	}
+	if n := db.integer("select count(*) from queue where id='d1'"); n != 0 {
+		t.Errorf("dead row left in queue")
+	}
+
+	if err := queue_requeue("d1"); err != nil {
+		t.Fatalf("queue_requeue: %v", err)
+	}
+	row, _ := db.row("select status, attempts, created, content, key from queue where id='d1'")
+	if row == nil || row["status"] != "pending" || row_int(row, "attempts") != 0 || row_int(row, "created") < now()-5 {
+		t.Errorf("requeued row = %v", row)
+	}
+	if row["content"] != string(cbor_encode(map[string]any{"post": "p1"})) || row["key"] != "k1" {
+		t.Errorf("requeued row lost its content or key: %v", row)
+	}
+	if _, total := queue_dead_list("", 10); total != 0 {
+		t.Errorf("dead letter kept after requeue")
+	}
+	if err := queue_requeue("d1"); !errors.Is(err, ErrDeadLetterMissing) {
+		t.Errorf("requeue of a missing dead letter = %v", err)
+	}
+}
+
+// Aged replication ops and expired messages are not kept
+func TestQueueDeadCleanup(t *testing.T) {
+	cleanup := setup_replication_test(t)
+	defer cleanup()
+	db := queue_test_table()
+	var calls []error_call
+	defer error_test_capture(&calls)()
+
+	old := now() - replication_op_retention - 100
+	error_test_queue_insert(db, "app", "owner", "feeds", "gone", "feeds", "post/create", old)
+	error_test_queue_insert(db, "repl", "owner", "", "gone", "replication", "sql/op", old)
+	error_test_queue_insert(db, "expired", "owner", "feeds", "gone", "feeds", "post/create", old)
+	db.exec("update queue set type='direct'")
+	db.exec("update queue set expires=? where id='expired'", now()-10)
+	queue_cleanup()
+
+	rows, _ := queue_dead_list("", 10)
+	if len(rows) != 1 || rows[0].ID != "app" {
+		t.Errorf("dead letters = %+v, want only the app message", rows)
+	}
+	if rows, _ := queue_dead_list("chat", 10); len(rows) != 0 {
+		t.Errorf("service filter returned %d rows", len(rows))
+	}
+
+	db.exec("update dead set died=?", now()-queue_dead_age-1)
+	queue_dead_cleanup()
+	if _, total := queue_dead_list("", 10); total != 0 {
+		t.Errorf("dead letter kept past its age")
+	}
+}
@@ -48,7 +48,7 @@ func TestQueuePriority(t *testing.T) {
 // exists` keeps this safe to call regardless).
 func queue_test_table() *DB {
 	db := db_open("db/queue.db")
-	db.exec("create table if not exists queue ( id text primary key, type text not null default 'direct', target text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', content blob not null default '', data blob not null default '', file text not null default '', expires integer not null default 0, status text not null default 'pending', attempts integer not null default 0, next_retry integer not null, last_error text not null default '', created integer not null, priority integer not null default 20 )")
+	db.exec("create table if not exists queue ( id text primary key, type text not null default 'direct', target text not null, from_entity text not null, to_entity text not null, service text not null, event text not null, from_app text not null default '', from_services text not null default '', content blob not null default '', data blob not null default '', file text not null default '', expires integer not null default 0, status text not null default 'pending', attempts integer not null default 0, next_retry integer not null, last_error text not null default '', created integer not null, priority integer not null default 20, key text not null default '' )")
 	return db
 }
 
@@ -540,3 +540,58 @@ func TestQueueProcessReturnsCount(t *testing.T) {
 		t.Errorf("3 expired rows: got %d, want 3", n)
 	}
 }
+
+// TestQueueScheduled: a row queued for later is outside every claim path
+// until it comes due and queue_release_scheduled returns it to pending.
+func TestQueueScheduled(t *testing.T) {
+	cleanup := setup_replication_test(t)
+	defer cleanup()
+
+	db := queue_test_table()
+	queue_add_direct_at("later", "peer-S", "", "", "test", "msg", "", nil, nil, nil, "", 0, priority_interactive, now()+3600, "")
+	row, _ := db.row("select status, next_retry, created from queue where id='later'")
+	if row == nil || row["status"] != "scheduled" || row_int(row, "next_retry") != row_int(row, "created") {
+		t.Fatalf("scheduled row = %v", row)
+	}
+	if rows := queue_claim_for_peer("peer-S", 10); len(rows) != 0 {
+		t.Errorf("scheduled row claimed before it was due")
+	}
+
+	queue_release_scheduled()
+	if s, _ := db.row("select status from queue where id='later'"); s["status"] != "scheduled" {
+		t.Errorf("row released before it was due")
+	}
+	db.exec("update queue set next_retry=? where id='later'", now()-1)
+	queue_release_scheduled()
+	if rows := queue_claim_for_peer("peer-S", 10); len(rows) != 1 {
+		t.Errorf("due scheduled row not claimable after release")
+	}
+}
+
+// TestQueueBackoffTarget: failures while a target is backing off share its
+// backoff rather than compounding it, and a success clears it.
+func TestQueueBackoffTarget(t *testing.T) {
+	defer queue_backoff_clear("peer-B")
+	first := queue_backoff_fail("peer-B")
+	if first < now()+retry_delays[0] || first > now()+retry_delays[0]+retry_delays[0]/4 {
+		t.Errorf("first backoff ends in %ds, want %ds plus jitter", first-now(), retry_delays[0])
+	}
+	if again := queue_backoff_fail("peer-B"); again != first {
+		t.Errorf("failure inside backoff moved it from %d to %d", first, again)
+	}
+
+	// Once the backoff has passed, the next failure climbs the ladder
+	v, _ := queue_backoff.Load("peer-B")
+	v.(*queue_backoff_state).until = now() - 1
+	if second := queue_backoff_fail("peer-B"); second < now()+retry_delays[1] {
+		t.Errorf("second backoff ends in %ds, want at least %ds", second-now(), retry_delays[1])
+	}
+
+	queue_backoff_clear("peer-B")
+	if after := queue_backoff_fail("peer-B"); after > now()+retry_delays[0]+retry_delays[0]/4 {
+		t.Errorf("backoff not reset by clear")
+	}
+	if queue_backoff_fail("") != 0 {
+		t.Errorf("empty target backed off")
+	}
+}
@@ -118,6 +118,53 @@ var (
 		limit:   1000,
 		window:  1,
 	}
+
+	// Import fetch rate limiter: 60 requests per minute per remote host,
+	// across all import jobs
+	rate_limit_import = &rate_limiter{
+		entries: make(map[string]*rate_limit_entry),
+		limit:   60,
+		window:  60,
+	}
+
+	// Guest action rate limiter: 30 changing requests per 10 minutes per
+	// guest, enough to take part in a discussion but not to flood one
+	rate_limit_guest = &rate_limiter{
+		entries: make(map[string]*rate_limit_entry),
+		limit:   30,
+		window:  600,
+	}
+
+	// Web push quota: 120 sends per hour per user and app
+	rate_limit_webpush = &rate_limiter{
+		entries: make(map[string]*rate_limit_entry),
+		limit:   120,
+		window:  3600,
+	}
+
+	// Merge proposal rate limiter: 10 proposals or updates per hour per
+	// contributor, as each carries a pack the owner's server must store
+	rate_limit_proposal = &rate_limiter{
+		entries: make(map[string]*rate_limit_entry),
+		limit:   10,
+		window:  3600,
+	}
+
+	// Ticket rate limiter: 30 tickets opened per hour per entity on
+	// another server
+	rate_limit_ticket = &rate_limiter{
+		entries: make(map[string]*rate_limit_entry),
+		limit:   30,
+		window:  3600,
+	}
+
+	// Moderated sender rate limiter: 10 inbound events per minute per
+	// entity, for entities a moderation "limit" action is in force on
+	rate_limit_moderation = &rate_limiter{
+		entries: make(map[string]*rate_limit_entry),
+		limit:   10,
+		window:  60,
+	}
 )
 
 // Check if request is allowed; returns true if allowed, false if rate limited
@@ -404,5 +451,10 @@ func ratelimit_manager() {
 		rate_limit_entry_withdraw.cleanup()
 		rate_limit_url.cleanup()
 		rate_limit_net_send.cleanup()
+		rate_limit_moderation.cleanup()
+		rate_limit_webpush.cleanup()
+		rate_limit_import.cleanup()
+		rate_limit_proposal.cleanup()
+		rate_limit_ticket.cleanup()
 	}
 }
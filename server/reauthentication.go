@@ -14,6 +14,10 @@
 // and the action consumes it with reauthentication_consume before doing
 // its work.
 //
+// A proof is bound to the app it was earned in and the purpose that app
+// gave when verifying, so one app can't spend a proof the user gave another,
+// and a proof given for one action can't be spent on a more sensitive one.
+//
 // The required factor set is the user's login methods (user.Methods), with
 // recovery excluded (break-glass, not a routine re-auth) - so the proof is
 // never below the user's own login bar. OAuth re-verifies as its own oauth
@@ -35,6 +39,8 @@ import (
 type Reauthentication struct {
 	Id      string
 	User    string
+	App     string
+	Purpose string
 	Methods string
 	Expires int64
 }
@@ -84,14 +90,15 @@ func reauthentication_remaining(user *User, completed string) []string {
 }
 
 // reauthentication_advance records that factor was just verified for the
-// user's in-progress step-up and returns the proof token once every
-// required factor is satisfied, else "" and the still-remaining factors.
-func reauthentication_advance(user *User, factor string) (string, []string) {
+// user's in-progress step-up in an app for a purpose, and returns the proof
+// token once every required factor is satisfied, else "" and the
+// still-remaining factors.
+func reauthentication_advance(user *User, app, purpose, factor string) (string, []string) {
 	sessions := db_open("db/sessions.db")
 	expires := now() + 300
 
 	var r Reauthentication
-	have := sessions.scan(&r, "select id, user, methods, expires from reauthentication where user=? and expires>=? order by expires desc limit 1", user.UID, now())
+	have := sessions.scan(&r, "select id, user, app, purpose, methods, expires from reauthentication where user=? and app=? and purpose=? and expires>=? order by expires desc limit 1", user.UID, app, purpose, now())
 	id := ""
 	methods := ""
 	if have {
@@ -110,7 +117,7 @@ func reauthentication_advance(user *User, factor string) (string, []string) {
 		sessions.exec("update reauthentication set methods=?, expires=? where id=?", methods, expires, id)
 	} else {
 		id = uid()
-		sessions.exec("insert into reauthentication ( id, user, methods, expires ) values ( ?, ?, ?, ? )", id, user.UID, methods, expires)
+		sessions.exec("insert into reauthentication ( id, user, app, purpose, methods, expires ) values ( ?, ?, ?, ?, ?, ? )", id, user.UID, app, purpose, methods, expires)
 	}
 
 	if remaining := reauthentication_remaining(user, methods); len(remaining) > 0 {
@@ -121,15 +128,16 @@ func reauthentication_advance(user *User, factor string) (string, []string) {
 
 // reauthentication_consume verifies and consumes a completed step-up proof
 // for the user, returning true if the token was valid, unexpired, matched
-// the user, and covered the user's required factors. Mirrors code_consume,
-// including the peer fan-out so a second host drops the token too.
-func reauthentication_consume(user *User, token string) bool {
+// the user, the app and the purpose, and covered the user's required
+// factors. Mirrors code_consume, including the peer fan-out so a second host
+// drops the token too.
+func reauthentication_consume(user *User, app, purpose, token string) bool {
 	if user == nil || token == "" {
 		return false
 	}
 	sessions := db_open("db/sessions.db")
 	var r Reauthentication
-	if !sessions.scan(&r, "delete from reauthentication where id=? and user=? and expires>=? returning id, user, methods, expires", token, user.UID, now()) {
+	if !sessions.scan(&r, "delete from reauthentication where id=? and user=? and app=? and purpose=? and expires>=? returning id, user, app, purpose, methods, expires", token, user.UID, app, purpose, now()) {
 		return false
 	}
 	if len(reauthentication_remaining(user, r.Methods)) != 0 {
@@ -149,12 +157,33 @@ func reauthentication_contains(completed, factor string) bool {
 	return false
 }
 
+// reauthentication_app returns the id of the app a thread runs for, which
+// proofs are bound to
+func reauthentication_app(t *sl.Thread) string {
+	if app, _ := t.Local("app").(*App); app != nil {
+		return app.id
+	}
+	return ""
+}
+
+// reauthentication_purpose returns the optional purpose keyword argument of
+// a verify builtin that takes its other arguments positionally
+func reauthentication_purpose(kwargs []sl.Tuple) string {
+	for _, kw := range kwargs {
+		if name, _ := sl.AsString(kw[0]); name == "purpose" {
+			purpose, _ := sl.AsString(kw[1])
+			return purpose
+		}
+	}
+	return ""
+}
+
 // reauthentication_result advances the accrual for a just-verified factor
 // and returns the Starlark result a verify builtin hands back: a dict
 // {"token": ...} once the step-up is complete, or {"remaining": [...]}
 // when more factors are still needed.
-func reauthentication_result(user *User, factor string) sl.Value {
-	token, remaining := reauthentication_advance(user, factor)
+func reauthentication_result(t *sl.Thread, user *User, purpose, factor string) sl.Value {
+	token, remaining := reauthentication_advance(user, reauthentication_app(t), purpose, factor)
 	if token != "" {
 		return sl_encode(map[string]any{"token": token})
 	}
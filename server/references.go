@@ -0,0 +1,290 @@
+// Mochi server: Object references
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Apps link to each other's objects, such as a chat message linking to a
+// wiki page. An object is named by its app and an ID the app chooses. The
+// linking app registers each link with mochi.ref.register(app, object,
+// source), where source is its own object holding the link, and the app
+// owning the object says when it moves or is deleted with mochi.ref.moved()
+// or mochi.ref.deleted(). Each app with links to it is then sent a bus
+// message on "ref/moved" or "ref/deleted", listing its objects holding
+// them, so it can mend or mark them. mochi.ref.resolve() follows moves to
+// where an object is now, and says if it was deleted.
+//
+// References are kept per user, in user.db. Links to a moved object follow
+// it; links to a deleted object are dropped once their apps are told, but
+// the record of the deletion stays for resolve, until the app has more than
+// ref_objects_max such records and its oldest are forgotten.
+
+const (
+	ref_object_max  = 500    // Bytes of an object ID
+	ref_moves_max   = 20     // Moves followed by resolve
+	ref_links_max   = 100000 // Links registered per app per user
+	ref_objects_max = 100000 // Moves and deletions remembered per app per user
+)
+
+var api_ref = sls.FromStringDict(sl.String("mochi.ref"), sl.StringDict{
+	"deleted":    sl.NewBuiltin("mochi.ref.deleted", api_ref_deleted),
+	"moved":      sl.NewBuiltin("mochi.ref.moved", api_ref_moved),
+	"referrers":  sl.NewBuiltin("mochi.ref.referrers", api_ref_referrers),
+	"register":   sl.NewBuiltin("mochi.ref.register", api_ref_register),
+	"resolve":    sl.NewBuiltin("mochi.ref.resolve", api_ref_resolve),
+	"unregister": sl.NewBuiltin("mochi.ref.unregister", api_ref_unregister),
+})
+
+// references_setup creates the reference tables in a user database
+func (db *DB) references_setup() {
+	db.exec("create table if not exists refs (app text not null, object text not null, target_app text not null, target text not null, created integer not null, primary key (app, object, target_app, target))")
+	db.exec("create index if not exists refs_target on refs (target_app, target)")
+	db.exec("create table if not exists ref_objects (app text not null, object text not null, status text not null, to_app text not null default '', to_object text not null default '', updated integer not null, primary key (app, object))")
+}
+
+// ref_object_record remembers that an app's object has moved or been
+// deleted, forgetting the app's oldest records beyond ref_objects_max
+func ref_object_record(db *DB, app, object, status, to_app, to string) {
+	db.exec("replace into ref_objects (app, object, status, to_app, to_object, updated) values (?, ?, ?, ?, ?, ?)", app, object, status, to_app, to, now())
+	if excess := db.integer("select count(*) from ref_objects where app=?", app) - ref_objects_max; excess > 0 {
+		db.exec("delete from ref_objects where app=? and object in (select object from ref_objects where app=? order by updated, object limit ?)", app, app, excess)
+	}
+}
+
+// ref_object_valid reports whether an object ID can be referenced
+func ref_object_valid(object string) bool {
+	return len(object) <= ref_object_max && valid(object, "line")
+}
+
+// ref_resolve follows an object's moves to where it is now, returning its
+// app, ID, and status of "current", "moved" or "deleted"
+func ref_resolve(db *DB, app string, object string) (string, string, string) {
+	status := "current"
+	for i := 0; i < ref_moves_max; i++ {
+		var o struct {
+			Status    string
+			To_app    string
+			To_object string
+		}
+		if !db.scan(&o, "select status, to_app, to_object from ref_objects where app=? and object=?", app, object) {
+			return app, object, status
+		}
+		if o.Status == "deleted" {
+			return app, object, "deleted"
+		}
+		app, object, status = o.To_app, o.To_object, "moved"
+	}
+	return app, object, status
+}
+
+// ref_notify tells each app with links to an object what happened to it
+func ref_notify(user *User, publisher string, topic string, app string, object string, data map[string]any, depth int) {
+	rows, err := db_user(user, "user").rows("select app, object from refs where target_app=? and target=? order by app, object", app, object)
+	if err != nil {
+		warn("References for %q in app %q not listed: %v", object, app, err)
+		return
+	}
+	sources := map[string][]string{}
+	for _, r := range rows {
+		a, _ := r["app"].(string)
+		o, _ := r["object"].(string)
+		sources[a] = append(sources[a], o)
+	}
+	for a, objects := range sources {
+		message := map[string]any{"app": app, "object": object, "references": objects}
+		for k, v := range data {
+			message[k] = v
+		}
+		bus_send(user, publisher, a, topic, message, depth)
+	}
+}
+
+// ref_result describes where a referenced object is now
+func ref_result(app, object, status string) sl.Value {
+	return sl_encode(map[string]any{"app": app, "object": object, "status": status})
+}
+
+// ref_thread returns the calling app and its owner
+func ref_thread(t *sl.Thread) (*App, *User) {
+	app, _ := t.Local("app").(*App)
+	owner, _ := t.Local("owner").(*User)
+	return app, owner
+}
+
+// mochi.ref.register(app, object, source) -> dict: Record that the calling app's
+// object source links to an object of an app, returning where that object is now
+// as {app, object, status}. A link to a moved object is recorded against where it
+// moved to, and none is recorded to a deleted object.
+func api_ref_register(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var target_app, target, source string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "app", &target_app, "object", &target, "source", &source); err != nil {
+		return nil, err
+	}
+	if !valid(target_app, "constant") {
+		return sl_error(fn, "invalid app")
+	}
+	if !ref_object_valid(target) || !ref_object_valid(source) {
+		return sl_error(fn, "invalid object")
+	}
+
+	app, owner := ref_thread(t)
+	if app == nil || owner == nil {
+		return sl_error(fn, "no app or owner")
+	}
+
+	db := db_user(owner, "user")
+	target_app, target, status := ref_resolve(db, target_app, target)
+	if status == "deleted" {
+		return ref_result(target_app, target, status), nil
+	}
+	if db.integer("select count(*) from refs where app=?", app.id) >= ref_links_max {
+		return sl_error(fn, "more than %d references", ref_links_max)
+	}
+	db.exec("insert or ignore into refs (app, object, target_app, target, created) values (?, ?, ?, ?, ?)", app.id, source, target_app, target, now())
+	return ref_result(target_app, target, status), nil
+}
+
+// mochi.ref.unregister(source, app?, object?) -> int: Forget the calling app's
+// links from its object source, to one object or to all, returning how many.
+func api_ref_unregister(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var source, target_app, target string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "source", &source, "app?", &target_app, "object?", &target); err != nil {
+		return nil, err
+	}
+	if !ref_object_valid(source) {
+		return sl_error(fn, "invalid object")
+	}
+
+	app, owner := ref_thread(t)
+	if app == nil || owner == nil {
+		return sl_error(fn, "no app or owner")
+	}
+
+	db := db_user(owner, "user")
+	if target_app == "" {
+		n := db.integer("select count(*) from refs where app=? and object=?", app.id, source)
+		db.exec("delete from refs where app=? and object=?", app.id, source)
+		return sl.MakeInt(n), nil
+	}
+	target_app, target, _ = ref_resolve(db, target_app, target)
+	n := db.integer("select count(*) from refs where app=? and object=? and target_app=? and target=?", app.id, source, target_app, target)
+	db.exec("delete from refs where app=? and object=? and target_app=? and target=?", app.id, source, target_app, target)
+	return sl.MakeInt(n), nil
+}
+
+// mochi.ref.resolve(app, object) -> dict: Where an object is now, following its
+// moves, as {app, object, status}, with status "current", "moved" or "deleted".
+func api_ref_resolve(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var target_app, target string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "app", &target_app, "object", &target); err != nil {
+		return nil, err
+	}
+	if !valid(target_app, "constant") || !ref_object_valid(target) {
+		return sl_error(fn, "invalid object")
+	}
+
+	_, owner := ref_thread(t)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+	return ref_result(ref_resolve(db_user(owner, "user"), target_app, target)), nil
+}
+
+// mochi.ref.moved(object, to, app?) -> int: Say the calling app's object has
+// moved to a new ID, in the app given or its own. Links to the object follow it,
+// and each app linking to it is sent a "ref/moved" bus message of {app, object,
+// to: {app, object}, references}. Returns how many links moved.
+func api_ref_moved(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object, to, to_app string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object, "to", &to, "app?", &to_app); err != nil {
+		return nil, err
+	}
+	if !ref_object_valid(object) || !ref_object_valid(to) {
+		return sl_error(fn, "invalid object")
+	}
+	if to_app != "" && !valid(to_app, "constant") {
+		return sl_error(fn, "invalid app")
+	}
+
+	app, owner := ref_thread(t)
+	if app == nil || owner == nil {
+		return sl_error(fn, "no app or owner")
+	}
+	if to_app == "" {
+		to_app = app.id
+	}
+	if to_app == app.id && to == object {
+		return sl.MakeInt(0), nil
+	}
+
+	db := db_user(owner, "user")
+	depth, _ := t.Local("bus_depth").(int)
+	ref_notify(owner, app.id, "ref/moved", app.id, object, map[string]any{"to": map[string]any{"app": to_app, "object": to}}, depth)
+
+	n := db.integer("select count(*) from refs where target_app=? and target=?", app.id, object)
+	db.exec("update or replace refs set target_app=?, target=? where target_app=? and target=?", to_app, to, app.id, object)
+	ref_object_record(db, app.id, object, "moved", to_app, to)
+	if to_app == app.id {
+		// The object moved onto one of the app's own that was itself moved
+		// or deleted, which is now current again
+		db.exec("delete from ref_objects where app=? and object=?", app.id, to)
+	}
+	return sl.MakeInt(n), nil
+}
+
+// mochi.ref.deleted(object) -> int: Say the calling app's object has been
+// deleted. Each app linking to it is sent a "ref/deleted" bus message of {app,
+// object, references}, and the links are dropped. Returns how many were dropped.
+func api_ref_deleted(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object); err != nil {
+		return nil, err
+	}
+	if !ref_object_valid(object) {
+		return sl_error(fn, "invalid object")
+	}
+
+	app, owner := ref_thread(t)
+	if app == nil || owner == nil {
+		return sl_error(fn, "no app or owner")
+	}
+
+	db := db_user(owner, "user")
+	depth, _ := t.Local("bus_depth").(int)
+	ref_notify(owner, app.id, "ref/deleted", app.id, object, nil, depth)
+
+	n := db.integer("select count(*) from refs where target_app=? and target=?", app.id, object)
+	db.exec("delete from refs where target_app=? and target=?", app.id, object)
+	ref_object_record(db, app.id, object, "deleted", "", "")
+	return sl.MakeInt(n), nil
+}
+
+// mochi.ref.referrers(object) -> list: The links to the calling app's object,
+// as a list of {app, object, created}.
+func api_ref_referrers(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object); err != nil {
+		return nil, err
+	}
+	if !ref_object_valid(object) {
+		return sl_error(fn, "invalid object")
+	}
+
+	app, owner := ref_thread(t)
+	if app == nil || owner == nil {
+		return sl_error(fn, "no app or owner")
+	}
+
+	rows, err := db_user(owner, "user").rows("select app, object, created from refs where target_app=? and target=? order by created", app.id, object)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
@@ -0,0 +1,114 @@
+// Mochi server: Object reference tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+// A chat message links to a wiki page, which moves and is then deleted
+func TestReferences(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	user := create_permission_test_user(t, "u1")
+
+	received := make(chan *BusMessage, 4)
+	chat := &App{id: "reftestchat", internal: &AppVersion{}}
+	chat.internal.app = chat
+	chat.subscribe("ref/*", func(m *BusMessage) { received <- m })
+	apps_lock.Lock()
+	apps[chat.id] = chat
+	apps_lock.Unlock()
+	defer func() {
+		apps_lock.Lock()
+		delete(apps, chat.id)
+		apps_lock.Unlock()
+	}()
+	bus_manager()
+
+	call := func(app *App, f func(*sl.Thread, *sl.Builtin, sl.Tuple, []sl.Tuple) (sl.Value, error), args ...string) any {
+		t.Helper()
+		tuple := sl.Tuple{}
+		for _, a := range args {
+			tuple = append(tuple, sl.String(a))
+		}
+		v, err := f(create_test_thread(user, app), sl.NewBuiltin("mochi.ref", f), tuple, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sl_decode(v)
+	}
+	status := func(v any) string {
+		m, _ := v.(map[string]any)
+		return m["app"].(string) + " " + m["object"].(string) + " " + m["status"].(string)
+	}
+	message := func(topic string) map[string]any {
+		t.Helper()
+		select {
+		case m := <-received:
+			if m.Topic != topic || m.App != "reftestwiki" {
+				t.Fatalf("message %+v", m)
+			}
+			data, _ := m.Data.(map[string]any)
+			return data
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no %q message", topic)
+			return nil
+		}
+	}
+
+	wiki := create_external_app("reftestwiki")
+	if s := status(call(chat, api_ref_register, "reftestwiki", "pages/home", "m1")); s != "reftestwiki pages/home current" {
+		t.Errorf("registered %s", s)
+	}
+	call(chat, api_ref_register, "reftestwiki", "pages/home", "m2")
+	call(chat, api_ref_register, "reftestwiki", "pages/other", "m2")
+	if referrers, _ := call(wiki, api_ref_referrers, "pages/home").([]any); len(referrers) != 2 {
+		t.Errorf("referrers %v", referrers)
+	}
+
+	if n := call(wiki, api_ref_moved, "pages/home", "pages/start"); n != int64(2) {
+		t.Errorf("moved %v links", n)
+	}
+	data := message("ref/moved")
+	to, _ := data["to"].(map[string]any)
+	if references, _ := data["references"].([]string); data["object"] != "pages/home" || to["object"] != "pages/start" || len(references) != 2 {
+		t.Errorf("moved message %v", data)
+	}
+	if s := status(call(chat, api_ref_resolve, "reftestwiki", "pages/home")); s != "reftestwiki pages/start moved" {
+		t.Errorf("resolved %s", s)
+	}
+	if s := status(call(chat, api_ref_register, "reftestwiki", "pages/home", "m3")); s != "reftestwiki pages/start moved" {
+		t.Errorf("registered to a moved page %s", s)
+	}
+	if n := call(chat, api_ref_unregister, "m3"); n != int64(1) {
+		t.Errorf("unregistered %v", n)
+	}
+
+	if n := call(wiki, api_ref_deleted, "pages/start"); n != int64(2) {
+		t.Errorf("deleted %v links", n)
+	}
+	if data := message("ref/deleted"); data["object"] != "pages/start" {
+		t.Errorf("deleted message %v", data)
+	}
+	if s := status(call(chat, api_ref_resolve, "reftestwiki", "pages/home")); s != "reftestwiki pages/start deleted" {
+		t.Errorf("resolved %s", s)
+	}
+	if referrers, _ := call(wiki, api_ref_referrers, "pages/other").([]any); len(referrers) != 1 {
+		t.Errorf("links to another page %v", referrers)
+	}
+
+	// An app can't clear another's record by moving an object onto it
+	call(chat, api_ref_deleted, "m9")
+	call(wiki, api_ref_moved, "pages/other", "m9", "reftestchat")
+	if s := status(call(chat, api_ref_resolve, "reftestchat", "m9")); s != "reftestchat m9 deleted" {
+		t.Errorf("resolved another app's object %s", s)
+	}
+}
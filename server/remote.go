@@ -20,10 +20,12 @@ import (
 )
 
 var api_remote = sls.FromStringDict(sl.String("mochi.remote"), sl.StringDict{
-	"peer":    sl.NewBuiltin("mochi.remote.peer", api_remote_peer),
-	"request": sl.NewBuiltin("mochi.remote.request", api_remote_request),
-	"stream":  sl.NewBuiltin("mochi.remote.stream", api_remote_stream),
-	"ping":    sl.NewBuiltin("mochi.remote.ping", api_remote_ping),
+	"peer":         sl.NewBuiltin("mochi.remote.peer", api_remote_peer),
+	"request":      sl.NewBuiltin("mochi.remote.request", api_remote_request),
+	"stream":       sl.NewBuiltin("mochi.remote.stream", api_remote_stream),
+	"ping":         sl.NewBuiltin("mochi.remote.ping", api_remote_ping),
+	"query":        sl.NewBuiltin("mochi.remote.query", api_remote_query),
+	"capabilities": sl.NewBuiltin("mochi.remote.capabilities", api_remote_capabilities),
 })
 
 // mochi.remote.peer(url) -> string|None: Resolve a server URL to a peer ID, or None on failure
@@ -124,6 +126,11 @@ func remote_reach(candidates []string) string {
 			return p
 		}
 	}
+	// A cluster follower has no host to reach other peers with, so waiting
+	// for their addresses is pointless
+	if cluster_following.Load() {
+		return ""
+	}
 	requested := false
 	for _, p := range candidates {
 		if peer_request_addresses(p) {
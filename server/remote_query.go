@@ -0,0 +1,206 @@
+// Mochi server: Federated query
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+// mochi.remote.query sends one query to many entities at once, such as a
+// search to each of the user's contacts, and gathers their answers. Each
+// entity gets a stream to the "query" event of the named service, whose
+// content is {nonce, query}. Its handler answers with e.answer(result),
+// which signs the result with the entity's key over the nonce, both
+// entities and the service, so an answer cannot be forged by the peer
+// relaying it or replayed from another query. Entities that do not answer
+// in time, or whose answer does not verify, are reported as errors.
+
+const (
+	query_domain      = "mochi-query-1"
+	query_entities    = 100 // Entities per query
+	query_concurrency = 16  // Streams open at once per query
+	query_timeout     = 10  // Default seconds to wait
+	query_timeout_max = 60
+)
+
+// query_signable returns the canonical bytes an entity signs for an answer
+func query_signable(nonce, from, to, service string, data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	return canonical_encoder.Marshal(map[string]any{
+		"v":       query_domain,
+		"nonce":   nonce,
+		"from":    from,
+		"to":      to,
+		"service": service,
+		"data":    hash[:],
+	})
+}
+
+// query_verify checks an answer's signature against the answering entity
+func query_verify(nonce, from, to, service string, data []byte, signature string) bool {
+	public := base58_decode(to, "")
+	if len(public) != ed25519.PublicKeySize {
+		return false
+	}
+	sig := base58_decode(signature, "")
+	if len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	signable, err := query_signable(nonce, from, to, service, data)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(public, signable, sig)
+}
+
+// query_one sends a query to one entity and returns its verified result
+func query_one(from, to, service, from_app string, services []string, payload any, deadline time.Time) (any, error) {
+	peer, err := remote_connect(from, to, "")
+	if err != nil {
+		return nil, err
+	}
+	s, err := stream_to_peer(peer, from, to, service, "query", from_app, services)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing the stream at the deadline unblocks the read below
+	timer := time.AfterFunc(time.Until(deadline), s.close)
+	defer timer.Stop()
+	defer s.close()
+
+	nonce := uid()
+	if err := s.write(map[string]any{"nonce": nonce, "query": payload}); err != nil {
+		return nil, fmt.Errorf("failed to send: %v", err)
+	}
+	var answer map[string]any
+	if err := s.read(&answer); err != nil {
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("timed out")
+		}
+		return nil, fmt.Errorf("no answer: %v", err)
+	}
+	data, _ := answer["data"].([]byte)
+	signature, _ := answer["signature"].(string)
+	if !query_verify(nonce, from, to, service, data, signature) {
+		return nil, fmt.Errorf("answer not signed by entity")
+	}
+	var result any
+	if err := cbor_decode_mode.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid answer: %v", err)
+	}
+	return result, nil
+}
+
+// mochi.remote.query(entities, service, payload, timeout?) -> dict: Send a
+// query to the "query" event of a service on each of a list of entities at
+// once, waiting up to timeout seconds (default 10, at most 60) for their
+// signed answers. Returns {results, errors}: results a list of {entity,
+// result} in the order answers arrived, errors a list of {entity, error}.
+func api_remote_query(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var entities *sl.List
+	var service string
+	var payload sl.Value
+	timeout := query_timeout
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "entities", &entities, "service", &service, "payload", &payload, "timeout?", &timeout); err != nil {
+		return nil, err
+	}
+	if !valid(service, "constant") {
+		return sl_error(fn, "invalid service")
+	}
+	if timeout < 1 || timeout > query_timeout_max {
+		return sl_error(fn, "invalid timeout")
+	}
+	targets := sl_decode_string_list(entities)
+	if len(targets) > query_entities {
+		return sl_error(fn, "too many entities")
+	}
+	for _, e := range targets {
+		if !valid(e, "entity") {
+			return sl_error(fn, "invalid entity %q", e)
+		}
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || user.Identity == nil {
+		return sl_error(fn, "no user identity")
+	}
+	from_app := ""
+	var services []string
+	if app, _ := t.Local("app").(*App); app != nil {
+		from_app = app.id
+		services = app_services(app, user)
+	}
+
+	var (
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+		results = []map[string]any{}
+		errors  = []map[string]any{}
+		slots   = make(chan struct{}, query_concurrency)
+		seen    = map[string]bool{}
+	)
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	content := sl_decode(payload)
+	for _, entity := range targets {
+		if seen[entity] {
+			continue
+		}
+		seen[entity] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			var result any
+			err := fmt.Errorf("timed out")
+			if time.Now().Before(deadline) {
+				result, err = query_one(user.Identity.ID, entity, service, from_app, services, content, deadline)
+			}
+			lock.Lock()
+			if err != nil {
+				errors = append(errors, map[string]any{"entity": entity, "error": err.Error()})
+			} else {
+				results = append(results, map[string]any{"entity": entity, "result": result})
+			}
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	return sl_encode(map[string]any{"results": results, "errors": errors}), nil
+}
+
+// e.answer(result) -> bool: Answer a query from mochi.remote.query with a
+// result signed by the entity queried
+func (e *Event) sl_answer(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var result sl.Value
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "result", &result); err != nil {
+		return nil, err
+	}
+	nonce, _ := e.content["nonce"].(string)
+	if e.stream == nil || e.event != "query" || nonce == "" {
+		return sl_error(fn, "event is not a query")
+	}
+	data := cbor_encode(sl_decode(result))
+	signable, err := query_signable(nonce, e.from, e.to, e.service, data)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	signature := entity_sign(e.to, string(signable))
+	if signature == "" {
+		return sl_error(fn, "unable to sign answer")
+	}
+	if err := e.stream.write(map[string]any{"data": data, "signature": signature}); err != nil {
+		return sl.False, nil
+	}
+	return sl.True, nil
+}
@@ -0,0 +1,79 @@
+// Mochi server: Federated query tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestQueryAnswerSignature(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	user := create_permission_test_user(t, "u1")
+	db_open("db/users.db").exec("insert into users (uid, username) values (?, ?)", user.UID, user.Username)
+	e, err := entity_create(user, "person", "Answering", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := entity_create(user, "person", "Other", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := group_test_member
+
+	data := cbor_encode(map[string]any{"hits": []string{"a", "b"}})
+	signable, _ := query_signable("nonce1", from, e.ID, "search", data)
+	signature := entity_sign(e.ID, string(signable))
+	if !query_verify("nonce1", from, e.ID, "search", data, signature) {
+		t.Fatal("answer signed by the entity does not verify")
+	}
+
+	if query_verify("nonce1", from, e.ID, "search", cbor_encode(map[string]any{"hits": []string{"a"}}), signature) {
+		t.Error("tampered result verified")
+	}
+	if query_verify("nonce2", from, e.ID, "search", data, signature) {
+		t.Error("answer replayed to another query verified")
+	}
+	if query_verify("nonce1", from, e.ID, "feeds", data, signature) {
+		t.Error("answer for another service verified")
+	}
+	forged, _ := query_signable("nonce1", from, e.ID, "search", data)
+	if query_verify("nonce1", from, e.ID, "search", data, entity_sign(other.ID, string(forged))) {
+		t.Error("answer signed by another entity verified")
+	}
+	if query_verify("nonce1", from, e.ID, "search", data, "") {
+		t.Error("unsigned answer verified")
+	}
+}
+
+func TestQueryArguments(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	user := create_permission_test_user(t, "u1")
+	thread := create_test_thread(user, create_external_app("search"))
+	f, _ := api_remote.Attr("query")
+
+	many := sl.NewList(nil)
+	for i := 0; i <= query_entities; i++ {
+		many.Append(sl.String(group_test_member))
+	}
+	cases := map[string]sl.Tuple{
+		"too many entities": {many, sl.String("search"), sl.None},
+		"invalid entity":    {sl.NewList([]sl.Value{sl.String("not an entity")}), sl.String("search"), sl.None},
+		"invalid service":   {sl.NewList(nil), sl.String("bad service!"), sl.None},
+		"invalid timeout":   {sl.NewList(nil), sl.String("search"), sl.None, sl.MakeInt(query_timeout_max + 1)},
+	}
+	for name, args := range cases {
+		if _, err := sl.Call(thread, f, args, nil); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Mochi server: Retention policies
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// An app declares the categories of its data that can be deleted once
+// they're old in app.json:
+//
+//	"retention": {
+//		"media": {"label": "retention.media", "table": "media", "column": "created", "default": 365},
+//		"posts": {"label": "retention.posts", "function": "retention_posts"}
+//	}
+//
+// A category either names a table of the app's database and the column
+// holding each row's Unix creation time, and rows older than the retention
+// period are deleted; or a function, called with the category and the
+// cutoff time, which deletes what it must itself. Default is the number of
+// days the app suggests keeping the data; absent or 0 keeps it forever, so
+// declaring a category deletes nothing until someone chooses a period.
+//
+// An administrator can set a server default for each category with
+// mochi.retention.default(), and each user their own period with
+// mochi.retention.set(); the user's choice wins, then the server's, then
+// the app's. Expired data is purged hourly.
+
+const retention_days_maximum = 36500
+
+// AppRetention is a category of an app's data with a retention period
+type AppRetention struct {
+	Label    string `json:"label"`
+	Table    string `json:"table"`
+	Column   string `json:"column"`
+	Function string `json:"function"`
+	Default  int    `json:"default"`
+}
+
+var api_retention = sls.FromStringDict(sl.String("mochi.retention"), sl.StringDict{
+	"default": sl.NewBuiltin("mochi.retention.default", api_retention_default),
+	"list":    sl.NewBuiltin("mochi.retention.list", api_retention_list),
+	"set":     sl.NewBuiltin("mochi.retention.set", api_retention_set),
+})
+
+// validate checks a category declared in app.json
+func (r *AppRetention) validate(category string) error {
+	if !valid(category, "constant") {
+		return fmt.Errorf("App bad retention category %q", category)
+	}
+	if r.Label != "" && !valid(r.Label, "constant") {
+		return fmt.Errorf("App bad retention label %q", r.Label)
+	}
+	if r.Function != "" {
+		if !valid(r.Function, "function") {
+			return fmt.Errorf("App bad retention function %q", r.Function)
+		}
+	} else if !valid(r.Table, "function") || !valid(r.Column, "function") {
+		return fmt.Errorf("App retention category %q needs a function, or a table and column", category)
+	}
+	if r.Default < 0 || r.Default > retention_days_maximum {
+		return fmt.Errorf("App bad retention default %d for category %q", r.Default, category)
+	}
+	return nil
+}
+
+// retention_key names a category's period in the server and user settings
+func retention_key(app, category string) string {
+	return "retention:" + app + ":" + category
+}
+
+// retention_server returns the server's period for a category, or -1 if
+// the administrator hasn't set one
+func retention_server(app, category string) int64 {
+	return atoi(setting_get(retention_key(app, category), ""), -1)
+}
+
+// retention_user returns a user's period for a category, or -1 if they
+// haven't chosen one
+func retention_user(u *User, app, category string) int64 {
+	row, _ := db_user(u, "user").row("select number from settings where key=?", retention_key(app, category))
+	if row == nil {
+		return -1
+	}
+	return event_int64(row["number"])
+}
+
+// retention_days returns how many days a user's data in a category is kept,
+// 0 for forever
+func retention_days(u *User, app string, category string, r AppRetention) int64 {
+	if days := retention_user(u, app, category); days >= 0 {
+		return days
+	}
+	if days := retention_server(app, category); days >= 0 {
+		return days
+	}
+	return int64(r.Default)
+}
+
+// retention_purge deletes a user's data in one category of an app created
+// before a time. Returns the number of rows deleted, or -1 if the app's
+// function did the deleting.
+func retention_purge(u *User, a *App, av *AppVersion, category string, r AppRetention, before int64) (int64, error) {
+	if r.Function != "" {
+		s := av.starlark()
+		s.set("app", a)
+		s.set("user", u)
+		s.set("owner", u)
+		if _, err := s.call(r.Function, sl.Tuple{sl.String(category), sl.MakeInt64(before)}); err != nil {
+			return 0, err
+		}
+		return -1, nil
+	}
+
+	if av.Database.File == "" || !file_exists(filepath.Join(data_dir, "users", u.UID, a.id, "db", av.Database.File)) {
+		return 0, nil
+	}
+	db := db_app(u, a)
+	if db == nil {
+		return 0, nil
+	}
+	result, err := db.internal.Exec(fmt.Sprintf("delete from %q where %q < ?", r.Table, r.Column), before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// retention_expire purges a user's expired data in every app that declares
+// retention
+func retention_expire(u *User, t int64) {
+	apps_lock.Lock()
+	list := make([]*App, 0, len(apps))
+	for _, a := range apps {
+		list = append(list, a)
+	}
+	apps_lock.Unlock()
+
+	for _, a := range list {
+		if !file_exists(filepath.Join(data_dir, "users", u.UID, a.id)) {
+			continue
+		}
+		av := a.active(u)
+		if av == nil || len(av.Retention) == 0 {
+			continue
+		}
+		for category, r := range av.Retention {
+			days := retention_days(u, a.id, category, r)
+			if days <= 0 {
+				continue
+			}
+			n, err := retention_purge(u, a, av, category, r, t-days*86400)
+			if err != nil {
+				warn("Retention purge of %q in app %q for user %q failed: %v", category, a.id, u.UID, err)
+			} else if n > 0 {
+				debug("Retention purged %d rows of %q in app %q for user %q", n, category, a.id, u.UID)
+			}
+		}
+	}
+}
+
+// retention_manager purges expired data hourly
+func retention_manager() {
+	for range time.Tick(time.Hour) {
+		rows, _ := db_open("db/users.db").rows("select uid from users")
+		for _, r := range rows {
+			id, _ := r["uid"].(string)
+			if u := user_by_uid(id); u != nil {
+				retention_expire(u, now())
+			}
+		}
+	}
+}
+
+// retention_target returns the app whose retention the caller is asking
+// about: its own, or with retention/manage, the one it names
+func retention_target(t *sl.Thread, fn *sl.Builtin, id string) (*User, *App, error) {
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id == "" || id == app.id {
+		return user, app, nil
+	}
+	if err := require_permission(t, fn, "retention/manage"); err != nil {
+		return nil, nil, err
+	}
+	target := app_by_id(id)
+	if target == nil {
+		return nil, nil, fmt.Errorf("app not found")
+	}
+	return user, target, nil
+}
+
+// retention_category returns a category an app declares for a user
+func retention_category(u *User, a *App, category string) (*AppVersion, AppRetention, bool) {
+	av := a.active(u)
+	if av == nil {
+		return nil, AppRetention{}, false
+	}
+	r, found := av.Retention[category]
+	return av, r, found
+}
+
+// retention_info describes a category as returned to apps
+func retention_info(u *User, a *App, av *AppVersion, category string, r AppRetention) map[string]any {
+	label := category
+	if r.Label != "" {
+		label = a.label(u, av, r.Label)
+	}
+	info := map[string]any{"app": a.id, "category": category, "label": label, "default": r.Default, "days": retention_days(u, a.id, category, r)}
+	if days := retention_server(a.id, category); days >= 0 {
+		info["server"] = days
+	}
+	if days := retention_user(u, a.id, category); days >= 0 {
+		info["user"] = days
+	}
+	return info
+}
+
+// mochi.retention.list(app?) -> list: The calling app's retention
+// categories; with retention/manage, those of the app given, or of every
+// app if app is "*". Each is a dict of app, category, label, default (the
+// app's suggestion), server and user (the periods chosen, if any), and
+// days, the period in force. Periods are in days, 0 for forever.
+func api_retention_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "app?", &id); err != nil {
+		return nil, err
+	}
+
+	var list []*App
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if id == "*" {
+		if err := require_permission(t, fn, "retention/manage"); err != nil {
+			return nil, err
+		}
+		apps_lock.Lock()
+		for _, a := range apps {
+			list = append(list, a)
+		}
+		apps_lock.Unlock()
+	} else {
+		_, app, err = retention_target(t, fn, id)
+		if err != nil {
+			return sl_error(fn, "%v", err)
+		}
+		list = []*App{app}
+	}
+
+	results := []any{}
+	for _, a := range list {
+		av := a.active(user)
+		if av == nil {
+			continue
+		}
+		for category, r := range av.Retention {
+			results = append(results, retention_info(user, a, av, category, r))
+		}
+	}
+	return sl_encode(results), nil
+}
+
+// mochi.retention.set(category, days?, app?) -> dict: Choose how many days
+// the current user's data in one of the calling app's categories is kept,
+// 0 for forever, or with days omitted go back to the server's default.
+// With retention/manage, a category of the app given. Returns the
+// category as listed.
+func api_retention_set(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var category, id string
+	days := -1
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "category", &category, "days?", &days, "app?", &id); err != nil {
+		return nil, err
+	}
+	user, app, err := retention_target(t, fn, id)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	av, r, found := retention_category(user, app, category)
+	if !found {
+		return sl_error(fn, "category not found")
+	}
+	if days < -1 || days > retention_days_maximum {
+		return sl_error(fn, "invalid days")
+	}
+
+	db := db_user(user, "user")
+	if days < 0 {
+		db.exec("delete from settings where key=?", retention_key(app.id, category))
+	} else {
+		db.exec("replace into settings (key, number) values (?, ?)", retention_key(app.id, category), days)
+	}
+	return sl_encode(retention_info(user, app, av, category, r)), nil
+}
+
+// mochi.retention.default(app, category, days?) -> dict: Set the server's
+// default period for a category, in days, 0 for forever, or with days
+// omitted go back to the app's. Returns the category as listed. Requires
+// settings/write (admin only).
+func api_retention_default(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, category string
+	days := -1
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "app", &id, "category", &category, "days?", &days); err != nil {
+		return nil, err
+	}
+	if err := require_permission(t, fn, "settings/write"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	app := app_by_id(id)
+	if app == nil {
+		return sl_error(fn, "app not found")
+	}
+	av, r, found := retention_category(user, app, category)
+	if !found {
+		return sl_error(fn, "category not found")
+	}
+	if days < -1 || days > retention_days_maximum {
+		return sl_error(fn, "invalid days")
+	}
+
+	if days < 0 {
+		setting_delete(retention_key(app.id, category))
+	} else {
+		setting_set(retention_key(app.id, category), itoa(days))
+	}
+	return sl_encode(retention_info(user, app, av, category, r)), nil
+}
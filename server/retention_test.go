@@ -6,7 +6,11 @@
 
 package main
 
-import "testing"
+import (
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
 
 // TestQueueRetentionByClass: queue_cleanup keeps replication ops for
 // replication_op_retention (30d) and every other message class for
@@ -71,3 +75,124 @@ func TestRetentionOrderingInvariant(t *testing.T) {
 			seen_messages_ttl, maxRetry)
 	}
 }
+
+// retention_test_app creates an app keeping media for a year and posts
+// forever, installed as the only app
+func retention_test_app(t *testing.T) *App {
+	t.Helper()
+	av := &AppVersion{Retention: map[string]AppRetention{
+		"media": {Table: "media", Column: "created", Default: 365},
+		"posts": {Table: "posts", Column: "created"},
+	}}
+	av.Database.File = "notes.db"
+	av.Database.create_function = func(db *DB) {
+		db.exec("create table media (id text primary key, created integer not null)")
+		db.exec("create table posts (id text primary key, created integer not null)")
+	}
+	a := &App{id: "notes", internal: av}
+	av.app = a
+
+	saved := apps
+	apps = map[string]*App{a.id: a}
+	t.Cleanup(func() { apps = saved })
+	return a
+}
+
+func TestRetentionExpire(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	user := create_permission_test_user(t, "u1")
+	a := retention_test_app(t)
+	db := db_app(user, a)
+	old := now() - 400*86400
+	db.exec("insert into media (id, created) values ('old', ?), ('new', ?)", old, now())
+	db.exec("insert into posts (id, created) values ('old', ?)", old)
+
+	retention_expire(user, now())
+	if n := db.integer("select count(*) from media"); n != 1 {
+		t.Errorf("%d media left, want the new one", n)
+	}
+	if n := db.integer("select count(*) from posts"); n != 1 {
+		t.Error("posts kept forever were deleted")
+	}
+
+	// The user's choice of forever overrides the app's year
+	db.exec("insert into media (id, created) values ('older', ?)", old)
+	thread := &sl.Thread{}
+	thread.SetLocal("user", user)
+	thread.SetLocal("app", a)
+	set := sl.NewBuiltin("mochi.retention.set", api_retention_set)
+	if _, err := api_retention_set(thread, set, sl.Tuple{sl.String("media"), sl.MakeInt(0)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	retention_expire(user, now())
+	if n := db.integer("select count(*) from media"); n != 2 {
+		t.Errorf("%d media left, want both kept", n)
+	}
+}
+
+func TestRetentionDays(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	user := create_permission_test_user(t, "u1")
+	r := AppRetention{Table: "media", Column: "created", Default: 365}
+	if days := retention_days(user, "notes", "media", r); days != 365 {
+		t.Errorf("default %d days, want the app's", days)
+	}
+	setting_set(retention_key("notes", "media"), "30")
+	if days := retention_days(user, "notes", "media", r); days != 30 {
+		t.Errorf("server default %d days, want 30", days)
+	}
+	db_user(user, "user").exec("replace into settings (key, number) values (?, 7)", retention_key("notes", "media"))
+	if days := retention_days(user, "notes", "media", r); days != 7 {
+		t.Errorf("user's choice %d days, want 7", days)
+	}
+}
+
+func TestRetentionDefault(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	retention_test_app(t)
+	admin := create_test_admin(t, "a1")
+	thread := create_test_thread(admin, create_external_app("settingstest"))
+	set := sl.NewBuiltin("mochi.retention.default", api_retention_default)
+	args := sl.Tuple{sl.String("notes"), sl.String("media"), sl.MakeInt(30)}
+	if _, err := api_retention_default(thread, set, args, nil); err == nil {
+		t.Error("server default set without settings/write")
+	}
+	permission_grant(admin, "settingstest", "settings/write")
+	if _, err := api_retention_default(thread, set, args, nil); err != nil {
+		t.Fatal(err)
+	}
+	if days := setting_get(retention_key("notes", "media"), ""); days != "30" {
+		t.Errorf("server default %q, want 30", days)
+	}
+	if !permission_restricted("retention/manage") {
+		t.Error("retention/manage is not restricted")
+	}
+}
+
+func TestRetentionValidate(t *testing.T) {
+	bad := []AppRetention{
+		{},
+		{Table: "media"},
+		{Table: "media; drop table posts", Column: "created"},
+		{Table: "media", Column: "created", Default: -1},
+		{Function: "purge media"},
+	}
+	for _, r := range bad {
+		if r.validate("media") == nil {
+			t.Errorf("retention %+v accepted", r)
+		}
+	}
+	good := AppRetention{Function: "retention_media", Default: 30}
+	if err := good.validate("media"); err != nil {
+		t.Error(err)
+	}
+}
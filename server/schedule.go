@@ -220,6 +220,9 @@ func schedule_manager() {
 			} else {
 				sleep_duration = 1 * time.Minute
 			}
+			if governor_busy() {
+				sleep_duration = governor_interval
+			}
 
 			// Wait for either the timer or a wake signal
 			if sleep_duration > 0 {
@@ -247,6 +250,10 @@ func schedule_notify() {
 
 // schedule_run_due executes all due events
 func schedule_run_due(t time.Time) {
+	// Under heavy load they wait, and run once it eases
+	if governor_busy() {
+		return
+	}
 	items := schedule_due(t.Unix())
 	for _, item := range items {
 		// Claim the event before spawning a goroutine
@@ -0,0 +1,458 @@
+// Mochi server: Secret storage
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Private keys are kept by a secrets provider, chosen by [secrets] provider:
+//
+//   - "none", the default, leaves them where they have always been: entity
+//     keys in users.db, the p2p key in data_dir/p2p/private.key, and ACME
+//     account keys and certificates in the certificates directory
+//   - "file" encrypts each under data_dir/secrets/ with a key derived from
+//     [secrets] passphrase
+//   - "vault" puts them in a HashiCorp Vault KV version 2 secrets engine
+//
+// With a provider other than "none", the entity's row in users.db holds a
+// reference to its key rather than the key. Keys held the old way are
+// moved into the provider at startup.
+
+// secrets_reference prefixes a reference to a secret held by the provider
+const secrets_reference = "secret:"
+
+// secrets_missing is returned for a secret the provider doesn't hold
+var secrets_missing = errors.New("secret not found")
+
+// secrets_provider holds named secrets
+type secrets_provider interface {
+	get(name string) ([]byte, error)
+	set(name string, value []byte) error
+	delete(name string) error
+}
+
+var (
+	secrets       secrets_provider
+	secrets_cache = map[string][]byte{}
+	secrets_lock  sync.Mutex
+	match_secret  = regexp.MustCompile(`^[A-Za-z0-9_+-][A-Za-z0-9._+-]*(/[A-Za-z0-9_+-][A-Za-z0-9._+-]*)*$`)
+)
+
+// secrets_configure sets up the provider named in the configuration
+func secrets_configure() error {
+	provider, err := secrets_open(ini_string("secrets", "provider", "none"))
+	if err != nil {
+		return err
+	}
+	secrets_lock.Lock()
+	secrets = provider
+	secrets_cache = map[string][]byte{}
+	secrets_lock.Unlock()
+	return nil
+}
+
+// secrets_open opens a provider by name, nil for "none"
+func secrets_open(name string) (secrets_provider, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "file":
+		return secrets_file_open()
+	case "vault":
+		return secrets_vault_open()
+	}
+	return nil, fmt.Errorf("unknown secrets provider %q", name)
+}
+
+// secrets_enabled reports whether a provider holds secrets
+func secrets_enabled() bool {
+	secrets_lock.Lock()
+	defer secrets_lock.Unlock()
+	return secrets != nil
+}
+
+// secrets_provider_get returns the provider, and a secret's cached value
+// if it has one. The lock covers only the cache; providers are called
+// without it, so a slow Vault doesn't hold up every other secret.
+func secrets_provider_get(name string) (secrets_provider, []byte, bool) {
+	secrets_lock.Lock()
+	defer secrets_lock.Unlock()
+	value, found := secrets_cache[name]
+	return secrets, value, found
+}
+
+// secret_get reads a secret. Secrets are used often, for each signature,
+// so they're cached once read.
+func secret_get(name string) ([]byte, error) {
+	if !match_secret.MatchString(name) {
+		return nil, fmt.Errorf("invalid secret name %q", name)
+	}
+	provider, value, found := secrets_provider_get(name)
+	if provider == nil {
+		return nil, fmt.Errorf("no secrets provider")
+	}
+	if found {
+		return value, nil
+	}
+	value, err := provider.get(name)
+	if err != nil {
+		return nil, err
+	}
+	secrets_lock.Lock()
+	secrets_cache[name] = value
+	secrets_lock.Unlock()
+	return value, nil
+}
+
+// secret_set writes a secret
+func secret_set(name string, value []byte) error {
+	if !match_secret.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	provider, _, _ := secrets_provider_get(name)
+	if provider == nil {
+		return fmt.Errorf("no secrets provider")
+	}
+	if err := provider.set(name, value); err != nil {
+		return err
+	}
+	secrets_lock.Lock()
+	secrets_cache[name] = value
+	secrets_lock.Unlock()
+	return nil
+}
+
+// secret_delete removes a secret. Removing one that isn't there isn't an
+// error.
+func secret_delete(name string) error {
+	secrets_lock.Lock()
+	provider := secrets
+	delete(secrets_cache, name)
+	secrets_lock.Unlock()
+	if provider == nil {
+		return fmt.Errorf("no secrets provider")
+	}
+	if err := provider.delete(name); err != nil && !errors.Is(err, secrets_missing) {
+		return err
+	}
+	return nil
+}
+
+// entity_private_store returns what to store in an entity's private column
+// for a base58 key: a reference to the key in the provider, or the key
+func entity_private_store(id, private string) (string, error) {
+	if !secrets_enabled() || private == "" {
+		return private, nil
+	}
+	name := "entity/" + id
+	if err := secret_set(name, []byte(private)); err != nil {
+		return "", fmt.Errorf("store key of entity %q: %w", id, err)
+	}
+	return secrets_reference + name, nil
+}
+
+// entity_private_resolve returns the base58 key for the value of an
+// entity's private column, or "" if it can't be read
+func entity_private_resolve(stored string) string {
+	name, found := strings.CutPrefix(stored, secrets_reference)
+	if !found {
+		return stored
+	}
+	value, err := secret_get(name)
+	if err != nil {
+		warn("Secrets unable to read %q: %v", name, err)
+		return ""
+	}
+	return string(value)
+}
+
+// entity_private_forget removes an entity's key from the provider, if it
+// is held there
+func entity_private_forget(id string) {
+	row, _ := db_open("db/users.db").row("select private from entities where id=?", id)
+	if row == nil {
+		return
+	}
+	stored, _ := row["private"].(string)
+	if name, found := strings.CutPrefix(stored, secrets_reference); found {
+		if err := secret_delete(name); err != nil {
+			warn("Secrets unable to delete %q: %v", name, err)
+		}
+	}
+}
+
+// secrets_migrate moves entity keys still held in users.db into the
+// provider
+func secrets_migrate() {
+	if !secrets_enabled() {
+		return
+	}
+	db := db_open("db/users.db")
+	rows, _ := db.rows("select id, private from entities where private != '' and private not like 'secret:%'")
+	moved := 0
+	for _, row := range rows {
+		id, _ := row["id"].(string)
+		private, _ := row["private"].(string)
+		stored, err := entity_private_store(id, private)
+		if err != nil {
+			warn("Secrets migration stopped: %v", err)
+			return
+		}
+		db.exec("update entities set private=? where id=? and private=?", stored, id, private)
+		moved++
+	}
+	entity_invalidate()
+	if moved > 0 {
+		info("Secrets moved %d entity keys into the provider", moved)
+	}
+}
+
+// Encrypted files
+
+// secrets_file holds secrets in files, each encrypted with AES-256-GCM
+type secrets_file struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+// secrets_file_open opens the configured directory
+func secrets_file_open() (*secrets_file, error) {
+	passphrase := ini_string("secrets", "passphrase", "")
+	if passphrase == "" {
+		return nil, fmt.Errorf("secrets provider \"file\" needs [secrets] passphrase")
+	}
+	return secrets_file_new(ini_string("secrets", "directory", filepath.Join(data_dir, "secrets")), passphrase)
+}
+
+// secrets_file_new derives the key from the passphrase and the directory's
+// salt, creating the salt the first time
+func secrets_file_new(dir, passphrase string) (*secrets_file, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create secrets directory: %w", err)
+	}
+
+	salt_path := filepath.Join(dir, "salt")
+	salt, err := os.ReadFile(salt_path)
+	if errors.Is(err, os.ErrNotExist) {
+		salt = make([]byte, 16)
+		rand.Read(salt)
+		err = os.WriteFile(salt_path, salt, 0o600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secrets salt: %w", err)
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A check value catches a changed passphrase before it does any harm
+	s := &secrets_file{dir: dir, aead: aead}
+	check, err := s.get(".check")
+	switch {
+	case errors.Is(err, secrets_missing):
+		if err := s.set(".check", []byte("mochi")); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("secrets passphrase doesn't match the one the secrets were written with")
+	case string(check) != "mochi":
+		return nil, fmt.Errorf("secrets check value is corrupt")
+	}
+	return s, nil
+}
+
+// path is the file of a secret. Names can't leave the directory, since the
+// characters they're allowed can't make ".." a component.
+func (s *secrets_file) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name)+".secret")
+}
+
+func (s *secrets_file) get(name string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, secrets_missing
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := s.aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("secret %q is corrupt", name)
+	}
+	// The name is authenticated, so one secret's file can't stand in for
+	// another's
+	value, err := s.aead.Open(nil, data[:size], data[size:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("secret %q can't be decrypted: %w", name, err)
+	}
+	return value, nil
+}
+
+func (s *secrets_file) set(name string, value []byte) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, s.aead.Seal(nonce, nonce, value, []byte(name)), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+func (s *secrets_file) delete(name string) error {
+	err := os.Remove(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return secrets_missing
+	}
+	return err
+}
+
+// HashiCorp Vault
+
+// secrets_vault holds secrets in a Vault KV version 2 engine, one secret
+// per Vault path with the value base64 encoded in its "value" field
+type secrets_vault struct {
+	address string
+	token   string
+	mount   string
+	path    string
+	client  *http.Client
+}
+
+// secrets_vault_open reads the Vault configuration. The token falls back
+// to VAULT_TOKEN, as Vault's own tools do.
+func secrets_vault_open() (*secrets_vault, error) {
+	v := &secrets_vault{
+		address: strings.TrimRight(ini_string("secrets", "address", os.Getenv("VAULT_ADDR")), "/"),
+		token:   ini_string("secrets", "token", os.Getenv("VAULT_TOKEN")),
+		mount:   strings.Trim(ini_string("secrets", "mount", "secret"), "/"),
+		path:    strings.Trim(ini_string("secrets", "path", "mochi"), "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if v.address == "" || v.token == "" {
+		return nil, fmt.Errorf("secrets provider \"vault\" needs [secrets] address and token")
+	}
+	if !strings.HasPrefix(v.address, "https://") && !strings.HasPrefix(v.address, "http://") {
+		return nil, fmt.Errorf("invalid Vault address %q", v.address)
+	}
+	return v, nil
+}
+
+// request makes a request to Vault, returning the status and body
+func (v *secrets_vault) request(method, kind, name string, body any) (int, []byte, error) {
+	var in io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		in = bytes.NewReader(data)
+	}
+	location := v.address + "/v1/" + v.mount + "/" + kind + "/"
+	if v.path != "" {
+		location += v.path + "/"
+	}
+	req, err := http.NewRequest(method, location+name, in)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, nil, fmt.Errorf("vault: %w", err)
+	}
+	return resp.StatusCode, data, nil
+}
+
+func (v *secrets_vault) get(name string) ([]byte, error) {
+	status, data, err := v.request(http.MethodGet, "data", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, secrets_missing
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("vault read %q: status %d", name, status)
+	}
+	var result struct {
+		Data struct {
+			Data struct {
+				Value string `json:"value"`
+			} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("vault read %q: %w", name, err)
+	}
+	return base64.StdEncoding.DecodeString(result.Data.Data.Value)
+}
+
+func (v *secrets_vault) set(name string, value []byte) error {
+	body := map[string]any{"data": map[string]string{"value": base64.StdEncoding.EncodeToString(value)}}
+	status, _, err := v.request(http.MethodPost, "data", name, body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNoContent {
+		return fmt.Errorf("vault write %q: status %d", name, status)
+	}
+	return nil
+}
+
+// delete removes every version of a secret, not just the latest
+func (v *secrets_vault) delete(name string) error {
+	status, _, err := v.request(http.MethodDelete, "metadata", name, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return secrets_missing
+	}
+	if status != http.StatusOK && status != http.StatusNoContent {
+		return fmt.Errorf("vault delete %q: status %d", name, status)
+	}
+	return nil
+}
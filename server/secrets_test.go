@@ -0,0 +1,177 @@
+// Mochi server: Secret storage tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// secrets_test_use makes a provider the server's for the rest of a test
+func secrets_test_use(t *testing.T, p secrets_provider) {
+	t.Helper()
+	secrets_lock.Lock()
+	secrets = p
+	secrets_cache = map[string][]byte{}
+	secrets_lock.Unlock()
+	t.Cleanup(func() {
+		secrets_lock.Lock()
+		secrets = nil
+		secrets_cache = map[string][]byte{}
+		secrets_lock.Unlock()
+	})
+}
+
+func TestSecretsFile(t *testing.T) {
+	dir := t.TempDir()
+	s, err := secrets_file_new(dir, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.get("entity/a"); !errors.Is(err, secrets_missing) {
+		t.Fatalf("missing secret: %v", err)
+	}
+	if err := s.set("entity/a", []byte("key a")); err != nil {
+		t.Fatal(err)
+	}
+	s.set("entity/b", []byte("key b"))
+	if value, err := s.get("entity/a"); err != nil || string(value) != "key a" {
+		t.Fatalf("get %q, %v", value, err)
+	}
+	content, _ := os.ReadFile(s.path("entity/a"))
+	if strings.Contains(string(content), "key a") {
+		t.Error("secret stored in the clear")
+	}
+
+	// One secret's file can't be passed off as another's
+	os.WriteFile(s.path("entity/b"), content, 0o600)
+	if _, err := s.get("entity/b"); err == nil {
+		t.Error("swapped secret decrypted")
+	}
+
+	if _, err := secrets_file_new(dir, "wrong"); err == nil {
+		t.Error("opened with the wrong passphrase")
+	}
+	again, err := secrets_file_new(dir, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := again.get("entity/a"); string(value) != "key a" {
+		t.Errorf("reopened get %q", value)
+	}
+	if err := again.delete("entity/a"); err != nil || file_exists(s.path("entity/a")) {
+		t.Errorf("delete: %v", err)
+	}
+}
+
+func TestSecretsVault(t *testing.T) {
+	var lock sync.Mutex
+	store := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/secret/data/mochi/"), "/v1/secret/metadata/mochi/")
+		switch r.Method {
+		case http.MethodGet:
+			value, found := store[name]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": map[string]string{"value": value}}})
+		case http.MethodPost:
+			var body struct {
+				Data map[string]string `json:"data"`
+			}
+			data, _ := io.ReadAll(r.Body)
+			json.Unmarshal(data, &body)
+			store[name] = body.Data["value"]
+			w.Write([]byte(`{"data":{}}`))
+		case http.MethodDelete:
+			delete(store, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	v := &secrets_vault{address: server.URL, token: "token", mount: "secret", path: "mochi", client: server.Client()}
+	if err := v.set("p2p", []byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := v.get("p2p"); err != nil || string(value) != "\x00\x01\x02" {
+		t.Fatalf("get %q, %v", value, err)
+	}
+	if err := v.delete("p2p"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.get("p2p"); !errors.Is(err, secrets_missing) {
+		t.Errorf("deleted secret: %v", err)
+	}
+	v.token = "wrong"
+	if _, err := v.get("p2p"); err == nil || errors.Is(err, secrets_missing) {
+		t.Errorf("refused read: %v", err)
+	}
+}
+
+func TestSecretsEntityKeys(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	db := db_open("db/users.db")
+	u, _ := user_create("alice@example.com")
+	if u == nil {
+		t.Fatal("no user")
+	}
+
+	// Created before a provider is configured, so held in users.db
+	e, err := entity_create(u, "person", "Alice", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := entity_sign(e.ID, "hello")
+	if signature == "" {
+		t.Fatal("no signature")
+	}
+
+	s, err := secrets_file_new(t.TempDir(), "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets_test_use(t, s)
+	secrets_migrate()
+	row, _ := db.row("select private from entities where id=?", e.ID)
+	if row["private"] != secrets_reference+"entity/"+e.ID {
+		t.Fatalf("not migrated: %v", row["private"])
+	}
+	if entity_sign(e.ID, "hello") != signature {
+		t.Error("signature changed after migration")
+	}
+
+	// Created with the provider configured
+	f, err := entity_create(u, "person", "Bob", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(f.Private, secrets_reference) || entity_sign(f.ID, "hello") == "" {
+		t.Errorf("new entity key %q", f.Private)
+	}
+	f.delete()
+	if _, err := s.get("entity/" + f.ID); !errors.Is(err, secrets_missing) {
+		t.Errorf("key of deleted entity: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+// Mochi server: Service call capabilities
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	gotime "time"
+
+	sl "go.starlark.net/starlark"
+)
+
+// When one app calls another's service, core mints a capability saying who
+// is calling, for which user, and what it may do: the one function called,
+// under the permission that function requires. The called app finds it with
+// mochi.service.capability(), or as a signed token in its context dict, which
+// it can hand on and check later with mochi.service.verify().
+//
+// A capability also records the apps the call came through. An app handling
+// another's call may call further services, and without this it would lend
+// them its own permissions: A, lacking a permission, asks B, which has it, to
+// call C. So a function that requires a permission requires it of every app
+// the call came through as well as the one making it, and calls to such
+// functions are written to the audit log with their capability.
+
+const capability_min_lifetime = 60 // Seconds a capability lasts at least
+
+// Capability is what core vouches for about a service call
+type Capability struct {
+	ID         string   `json:"id"`
+	Caller     string   `json:"caller"`          // App making the call, or "" for the server
+	Chain      []string `json:"chain,omitempty"` // Apps the call came through before the caller, first the one it started from
+	User       string   `json:"user"`
+	Service    string   `json:"service"`
+	Function   string   `json:"function"`
+	Permission string   `json:"permission,omitempty"`
+	Expires    int64    `json:"expires"`
+}
+
+var (
+	capability_secret_lock  sync.Mutex
+	capability_secret_value string
+)
+
+// capability_secret returns the key capabilities are signed with, creating it
+// on first use. It's kept in memory, as every service call needs it.
+func capability_secret() string {
+	capability_secret_lock.Lock()
+	defer capability_secret_lock.Unlock()
+	if capability_secret_value == "" {
+		capability_secret_value = setting_get("capability_secret", "")
+		if capability_secret_value == "" {
+			capability_secret_value = random_alphanumeric(32)
+			setting_set("capability_secret", capability_secret_value)
+		}
+	}
+	return capability_secret_value
+}
+
+// capability_signature returns the signature for an encoded capability
+func capability_signature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(capability_secret()))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// capability_create mints the capability for a call, made from a thread that
+// may itself be handling one
+func capability_create(t *sl.Thread, caller string, user *User, service string, function string, permission string) *Capability {
+	c := &Capability{Caller: caller, Service: service, Function: function, Permission: permission}
+	c.ID, _ = ulid(gotime.Now())
+	if user != nil {
+		c.User = user.UID
+	}
+	if parent, ok := t.Local("capability").(*Capability); ok && parent != nil {
+		c.Chain = append(slices.Clone(parent.Chain), parent.Caller)
+	}
+	lifetime := int64(starlark_remaining(t) / gotime.Second)
+	c.Expires = now() + max(lifetime, capability_min_lifetime)
+	return c
+}
+
+// origin returns the app a call started from
+func (c *Capability) origin() string {
+	for _, app := range c.Chain {
+		if app != "" {
+			return app
+		}
+	}
+	return c.Caller
+}
+
+// apps returns the apps a call came through, then the one making it,
+// leaving out the server
+func (c *Capability) apps() []string {
+	var apps []string
+	for _, app := range append(slices.Clone(c.Chain), c.Caller) {
+		if app != "" && !slices.Contains(apps, app) {
+			apps = append(apps, app)
+		}
+	}
+	return apps
+}
+
+// token returns the capability signed, as payload.signature
+func (c *Capability) token() string {
+	data, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + capability_signature(payload)
+}
+
+// capability_verify returns the capability in a token, or nil if it isn't
+// one core signed or it has expired
+func capability_verify(token string) *Capability {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(capability_signature(payload))) {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil
+	}
+	var c Capability
+	if json.Unmarshal(data, &c) != nil || c.Expires < now() {
+		return nil
+	}
+	return &c
+}
+
+// audit records a call to a function that requires a permission
+func (c *Capability) audit(allowed bool) {
+	via := strings.Join(c.Chain, ",")
+	if allowed {
+		audit_service_call(c.ID, c.Caller, via, c.User, c.Service+"/"+c.Function, c.Permission)
+	} else {
+		audit_service_denied(c.ID, c.Caller, via, c.User, c.Service+"/"+c.Function, c.Permission)
+	}
+}
+
+func (c *Capability) to_map() map[string]any {
+	chain := c.Chain
+	if chain == nil {
+		chain = []string{}
+	}
+	return map[string]any{"id": c.ID, "caller": c.Caller, "chain": chain, "origin": c.origin(), "user": c.User, "service": c.Service, "function": c.Function, "permission": c.Permission, "expires": c.Expires}
+}
+
+// mochi.service.capability() -> dict or None: The capability of the service call being handled,
+// with its id, caller, chain of apps the call came through, origin, user, service, function,
+// permission and expiry. None outside a service call.
+func api_service_capability(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 0 {
+		return sl_error(fn, "syntax: no arguments")
+	}
+	c, ok := t.Local("capability").(*Capability)
+	if !ok || c == nil {
+		return sl.None, nil
+	}
+	return sl_encode(c.to_map()), nil
+}
+
+// mochi.service.verify(token) -> dict or None: Check a capability token, as passed in a service
+// call's context, returning the capability if core issued it and it hasn't expired.
+func api_service_verify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 1 {
+		return sl_error(fn, "syntax: <token: string>")
+	}
+	token, ok := sl.AsString(args[0])
+	if !ok {
+		return sl_error(fn, "invalid token")
+	}
+	c := capability_verify(token)
+	if c == nil {
+		return sl.None, nil
+	}
+	return sl_encode(c.to_map()), nil
+}
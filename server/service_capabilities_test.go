@@ -0,0 +1,113 @@
+// Mochi server: Service call capability tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestCapabilityToken(t *testing.T) {
+	previous := capability_secret_value
+	capability_secret_value = "test"
+	t.Cleanup(func() { capability_secret_value = previous })
+
+	c := &Capability{ID: "c1", Caller: "b", Chain: []string{"", "a"}, User: "u1", Service: "files", Function: "read", Expires: now() + 60}
+	token := c.token()
+	v := capability_verify(token)
+	if v == nil || v.Caller != "b" || v.origin() != "a" || v.Function != "read" {
+		t.Fatalf("verified %+v", v)
+	}
+	if apps := (&Capability{Caller: "c", Chain: []string{"", "a", "b", "a"}}).apps(); !slices.Equal(apps, []string{"a", "b", "c"}) {
+		t.Errorf("apps %v", apps)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	forged := (&Capability{ID: "c1", Caller: "a", User: "u1", Service: "files", Function: "delete", Expires: now() + 60}).token()
+	forged_payload, _, _ := strings.Cut(forged, ".")
+	for _, bad := range []string{forged_payload + "." + signature, payload, payload + ".x", ""} {
+		if capability_verify(bad) != nil {
+			t.Errorf("verified %q", bad)
+		}
+	}
+
+	c.Expires = now() - 1
+	if capability_verify(c.token()) != nil {
+		t.Error("verified an expired capability")
+	}
+}
+
+// A function that requires a permission requires it of the app a call
+// started from, not only of the app that relays it
+func TestServiceCallDeputy(t *testing.T) {
+	guarded, gv, cleanup := lifecycle_test_app(t, `
+def secret(context):
+    c = mochi.service.capability()
+    return {"caller": c["caller"], "chain": c["chain"], "origin": c["origin"], "token": mochi.service.verify(context["capability"])["id"] == c["id"]}
+`)
+	defer cleanup()
+	db_open("db/settings.db").exec("create table if not exists settings (name text primary key, value text not null)")
+	gv.Database.File = ""
+	gv.Architecture.Engine = "starlark"
+	gv.Architecture.Version = 3
+	gv.Functions = map[string]AppFunction{"secret": {Function: "secret", Permission: "vault/read"}}
+
+	star := filepath.Join(data_dir, "relay.star")
+	os.WriteFile(star, []byte("def relay(context):\n    return mochi.service.call('vaulttest', 'secret')\n"), 0644)
+	rv := &AppVersion{Version: "1.0", Execute: []string{star}}
+	rv.Architecture.Engine = "starlark"
+	rv.Architecture.Version = 3
+	rv.Functions = map[string]AppFunction{"relay": {Function: "relay"}}
+	relay := &App{id: "relaytest", internal: rv}
+	rv.app = relay
+
+	apps_lock.Lock()
+	apps[guarded.id] = guarded
+	apps[relay.id] = relay
+	apps_lock.Unlock()
+	guarded.service("vaulttest")
+	relay.service("relaytest")
+	defer func() {
+		apps_lock.Lock()
+		delete(apps, guarded.id)
+		delete(apps, relay.id)
+		delete(internal_services, "vaulttest")
+		delete(internal_services, "relaytest")
+		apps_lock.Unlock()
+	}()
+
+	user := create_permission_test_user(t, "u1")
+	permission_grant(user, relay.id, "vault/read")
+	thread := create_test_thread(user, create_external_app("callertest"))
+	fn := sl.NewBuiltin("mochi.service.call", api_service_call)
+	call := func(service, function string) (sl.Value, error) {
+		return api_service_call(thread, fn, sl.Tuple{sl.String(service), sl.String(function)}, nil)
+	}
+
+	if _, err := call("vaulttest", "secret"); err == nil || !strings.Contains(err.Error(), `permission "vault/read" required`) {
+		t.Errorf("direct call without the permission: %v", err)
+	}
+	if _, err := call("relaytest", "relay"); err == nil || !strings.Contains(err.Error(), `app "callertest" the call came through lacks`) {
+		t.Errorf("relayed call without the permission: %v", err)
+	}
+
+	permission_grant(user, "callertest", "vault/read")
+	v, err := call("relaytest", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _ := sl_decode(v).(map[string]any)
+	chain, _ := result["chain"].([]any)
+	if result["caller"] != "relaytest" || result["origin"] != "callertest" || len(chain) != 1 || chain[0] != "callertest" || result["token"] != true {
+		t.Errorf("capability %v", result)
+	}
+}
@@ -46,6 +46,15 @@ var system_settings = map[string]SystemSetting{
 		ReadOnly:     false,
 		Public:       true,
 	},
+	"apps_default_skip": {
+		Name:         "apps_default_skip",
+		Pattern:      "^[0-9a-zA-Z,]{0,2000}$",
+		Default:      "",
+		Description:  "Default apps not to install, comma-separated, as chosen in first-run setup",
+		UserReadable: false,
+		ReadOnly:     false,
+		Public:       false,
+	},
 	"auth_email": {
 		Name:         "auth_email",
 		Pattern:      "^(required|allowed|disabled)$",
@@ -64,6 +73,24 @@ var system_settings = map[string]SystemSetting{
 		ReadOnly:     false,
 		Public:       true,
 	},
+	"passkey_verification": {
+		Name:         "passkey_verification",
+		Pattern:      "^(required|preferred|discouraged)$",
+		Default:      "preferred",
+		Description:  "Whether passkeys must verify the user, by PIN or biometric, when registered and used: required, preferred or discouraged",
+		UserReadable: true,
+		ReadOnly:     false,
+		Public:       true,
+	},
+	"passkey_authenticators": {
+		Name:         "passkey_authenticators",
+		Pattern:      "^[0-9A-Fa-f, -]{0,2000}$",
+		Default:      "",
+		Description:  "Comma-separated AAGUIDs of the authenticator models passkeys may be registered with, attested by the authenticator. Empty allows any.",
+		UserReadable: true,
+		ReadOnly:     false,
+		Public:       false,
+	},
 	"auth_totp": {
 		Name:         "auth_totp",
 		Pattern:      "^(allowed|disabled)$",
@@ -82,6 +109,42 @@ var system_settings = map[string]SystemSetting{
 		ReadOnly:     false,
 		Public:       true,
 	},
+	"auth_pairing": {
+		Name:         "auth_pairing",
+		Pattern:      "^(allowed|disabled)$",
+		Default:      "allowed",
+		Description:  "Signing in a phone by scanning a QR code on a signed in device: allowed or disabled",
+		UserReadable: true,
+		ReadOnly:     false,
+		Public:       true,
+	},
+	"email_reverify": {
+		Name:         "email_reverify",
+		Pattern:      "^[0-9]{1,5}$",
+		Default:      "365",
+		Description:  "Days after which users are asked to verify their email address again, or 0 for never",
+		UserReadable: true,
+		ReadOnly:     false,
+		Public:       false,
+	},
+	"impersonation_minutes": {
+		Name:         "impersonation_minutes",
+		Pattern:      "^[0-9]{1,4}$",
+		Default:      "30",
+		Description:  "Minutes an administrator's session as another user lasts, or 0 to disable impersonation",
+		UserReadable: true,
+		ReadOnly:     false,
+		Public:       false,
+	},
+	"login_alerts": {
+		Name:         "login_alerts",
+		Pattern:      "^(off|notification|email|all)$",
+		Default:      "all",
+		Description:  "How users are told of sign ins from new devices or networks: off, notification, email or all",
+		UserReadable: true,
+		ReadOnly:     false,
+		Public:       false,
+	},
 	"auth_oauth": {
 		Name:         "auth_oauth",
 		Pattern:      "^(allowed|disabled)$",
@@ -115,6 +178,30 @@ var system_settings = map[string]SystemSetting{
 		UserReadable: false,
 		ReadOnly:     false,
 	},
+	"email_brand_name": {
+		Name:         "email_brand_name",
+		Pattern:      "^[^<>\r\n]{0,100}$",
+		Default:      "Mochi",
+		Description:  "Server name shown at the foot of system emails",
+		UserReadable: false,
+		ReadOnly:     false,
+	},
+	"email_brand_logo": {
+		Name:         "email_brand_logo",
+		Pattern:      "^(https://[\\w\\-\\/:%@.+?&;=~]{1,1000})?$",
+		Default:      "",
+		Description:  "HTTPS URL of a logo shown above system emails; empty for none",
+		UserReadable: false,
+		ReadOnly:     false,
+	},
+	"email_brand_colour": {
+		Name:         "email_brand_colour",
+		Pattern:      "^#[0-9a-fA-F]{6}$",
+		Default:      "#18181b",
+		Description:  "Accent colour of buttons and the card edge in system emails, as #rrggbb",
+		UserReadable: false,
+		ReadOnly:     false,
+	},
 	"hostname_publish": {
 		Name:         "hostname_publish",
 		Pattern:      "^(true|false)$",
@@ -131,6 +218,38 @@ var system_settings = map[string]SystemSetting{
 		UserReadable: false,
 		ReadOnly:     false,
 	},
+	"statistics_publish": {
+		Name:         "statistics_publish",
+		Pattern:      "^(true|false)$",
+		Default:      "false",
+		Description:  "Whether to include the number of users in the server metadata published at /.well-known/mochi",
+		UserReadable: false,
+		ReadOnly:     false,
+	},
+	"moderation_hide_reports": {
+		Name:         "moderation_hide_reports",
+		Pattern:      "integer",
+		Default:      "3",
+		Description:  "Number of users whose reports of an object hide it automatically, or 0 to wait for an administrator",
+		UserReadable: false,
+		ReadOnly:     false,
+	},
+	"moderation_limit_reports": {
+		Name:         "moderation_limit_reports",
+		Pattern:      "integer",
+		Default:      "5",
+		Description:  "Number of users whose reports of an entity rate limit its inbound events for a day, or 0 to wait for an administrator",
+		UserReadable: false,
+		ReadOnly:     false,
+	},
+	"moderation_block_reports": {
+		Name:         "moderation_block_reports",
+		Pattern:      "integer",
+		Default:      "0",
+		Description:  "Number of users whose reports of an entity block the peers serving it for a week, or 0 to wait for an administrator",
+		UserReadable: false,
+		ReadOnly:     false,
+	},
 	"relay": {
 		Name:         "relay",
 		Pattern:      "^(true|false)$",
@@ -199,6 +318,24 @@ var system_settings = map[string]SystemSetting{
 		ReadOnly:     false,
 		Public:       true,
 	},
+	"guests_enabled": {
+		Name:         "guests_enabled",
+		Pattern:      "^(true|false)$",
+		Default:      "false",
+		Description:  "Whether anonymous visitors may take part in public entities as guests",
+		UserReadable: false,
+		ReadOnly:     false,
+		Public:       true,
+	},
+	"invites_quota": {
+		Name:         "invites_quota",
+		Pattern:      "natural",
+		Default:      "0",
+		Description:  "How many people each user who isn't an administrator may invite",
+		UserReadable: true,
+		ReadOnly:     false,
+		Public:       false,
+	},
 	"oauth_public_url": {
 		Name:         "oauth_public_url",
 		Pattern:      "url",
@@ -318,6 +455,54 @@ var system_settings = map[string]SystemSetting{
 		UserReadable: false,
 		ReadOnly:     false,
 	},
+	"analytics_enabled": {
+		Name:         "analytics_enabled",
+		Pattern:      "^(true|false)$",
+		Default:      "true",
+		Description:  "Whether views of public entities are counted for their owners",
+		UserReadable: true,
+		ReadOnly:     false,
+	},
+	"analytics_retention": {
+		Name:         "analytics_retention",
+		Pattern:      "^[1-9][0-9]{0,3}$",
+		Default:      "365",
+		Description:  "Number of days daily view counts are kept",
+		UserReadable: false,
+		ReadOnly:     false,
+	},
+	"activity_retention": {
+		Name:         "activity_retention",
+		Pattern:      "^[1-9][0-9]{0,3}$",
+		Default:      "365",
+		Description:  "Number of days activity stream items are kept, unless a user chooses otherwise",
+		UserReadable: true,
+		ReadOnly:     false,
+	},
+	"event_log_retention": {
+		Name:         "event_log_retention",
+		Pattern:      "^[0-9]{1,3}$",
+		Default:      "3",
+		Description:  "Number of days events received by apps are kept so they can be replayed; 0 to keep none",
+		UserReadable: true,
+		ReadOnly:     false,
+	},
+	"transfer_cap": {
+		Name:         "transfer_cap",
+		Pattern:      "^[0-9]{1,9}$",
+		Default:      "0",
+		Description:  "Monthly network transfer budget in megabytes, after which low-priority sync pauses until the next month; 0 for no limit",
+		UserReadable: true,
+		ReadOnly:     false,
+	},
+	"trash_retention": {
+		Name:         "trash_retention",
+		Pattern:      "^[1-9][0-9]{0,3}$",
+		Default:      "30",
+		Description:  "Number of days deleted items are kept in the trash before being purged",
+		UserReadable: true,
+		ReadOnly:     false,
+	},
 	"help_users_forum": {
 		Name:         "help_users_forum",
 		Pattern:      "entity",
@@ -0,0 +1,228 @@
+// Mochi server: First-run setup
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/subtle"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A new server has no users, and until the Login and Home apps are
+// installed it has nothing to sign one up with. First-run setup is built
+// into the server instead, at /_/setup, for as long as no users exist: the
+// operator creates the administrator account and its identity, and can
+// choose the server's domain, the address email is sent from, and which of
+// the optional default apps to install. The account is signed in at once,
+// and the rest of setup then happens in the apps. Until then only the
+// essential default apps are installed, so the ones setup leaves out never
+// are.
+//
+// Anyone who can reach a new server could finish its setup first, so it
+// takes a code, [setup] code or else a random one written to the log at
+// startup.
+
+var (
+	setup_code         string
+	setup_lock         sync.Mutex
+	match_setup_domain = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+)
+
+// setup_essential are the default apps setup doesn't offer to leave out
+var setup_essential = map[string]bool{"Login": true, "Menu": true, "Home": true, "Apps": true, "Settings": true}
+
+// setup_needed reports whether the server has no users yet
+func setup_needed() bool {
+	has_users, _ := db_open("db/users.db").exists("select uid from users where role != 'guest' limit 1")
+	return !has_users
+}
+
+// setup_start picks the setup code, if setup is needed
+func setup_start() {
+	if !setup_needed() {
+		return
+	}
+	setup_lock.Lock()
+	setup_code = strings.TrimSpace(ini_string("setup", "code", ""))
+	if setup_code == "" {
+		setup_code = random_alphanumeric(12)
+	}
+	setup_lock.Unlock()
+	info("First-run setup: open /_/setup and enter code %s", setup_code)
+}
+
+// setup_open reports whether setup is waiting to be done
+func setup_open() bool {
+	setup_lock.Lock()
+	defer setup_lock.Unlock()
+	return setup_code != "" && setup_needed()
+}
+
+// setup_optional lists the default apps setup offers to leave out
+func setup_optional() []DefaultApp {
+	var list []DefaultApp
+	for _, a := range apps_default {
+		if is_entity_id(a.ID) && !setup_essential[a.Name] {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// setup_skipped returns the default apps setup chose to leave out
+func setup_skipped() map[string]bool {
+	skip := map[string]bool{}
+	for _, id := range strings.Split(setting_get("apps_default_skip", ""), ",") {
+		if id != "" {
+			skip[id] = true
+		}
+	}
+	return skip
+}
+
+// setup_deferred reports whether installing a default app waits for
+// first-run setup to be done
+func setup_deferred(a DefaultApp) bool {
+	return !setup_essential[a.Name] && setup_open()
+}
+
+// web_setup serves the setup form
+func web_setup(c *gin.Context) {
+	if !setup_open() {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	web_setup_page(c, http.StatusOK, "")
+}
+
+// web_setup_page writes the setup form, with an error if there is one
+func web_setup_page(c *gin.Context, status int, problem string) {
+	lang := request_language(c, nil)
+	label := func(key string) string {
+		return html.EscapeString(resolve_core_label(lang, "setup."+key, nil))
+	}
+	field := func(name, kind string, required bool) string {
+		attributes := ""
+		if kind != "password" {
+			attributes = ` value="` + html.EscapeString(c.PostForm(name)) + `"`
+		}
+		if required {
+			attributes += " required"
+		}
+		return `<label>` + label(name) + `<input name="` + name + `" type="` + kind + `"` + attributes + `></label>`
+	}
+
+	var b strings.Builder
+	b.WriteString(`<!doctype html><meta charset=utf-8><meta name=viewport content="width=device-width, initial-scale=1"><title>` + label("heading") + `</title>`)
+	b.WriteString(`<style>body{font-family:system-ui,sans-serif;max-width:32em;margin:2em auto;padding:0 1em;color:#333}label{display:block;margin:1em 0}input[type=text],input[type=email],input[type=password]{display:block;width:100%;padding:.4em;box-sizing:border-box}fieldset label{margin:.3em 0}.error{color:#b00}</style>`)
+	b.WriteString(`<h1>` + label("heading") + `</h1><p>` + label("body") + `</p>`)
+	if problem != "" {
+		b.WriteString(`<p class=error>` + label("error."+problem) + `</p>`)
+	}
+	b.WriteString(`<form method=post action="/_/setup">`)
+	b.WriteString(field("code", "password", true))
+	b.WriteString(field("username", "email", true))
+	b.WriteString(field("name", "text", true))
+	b.WriteString(field("domain", "text", false))
+	b.WriteString(field("email_from", "email", false))
+	b.WriteString(`<fieldset><legend>` + label("apps") + `</legend>`)
+	chosen := map[string]bool{}
+	for _, id := range c.PostFormArray("apps") {
+		chosen[id] = true
+	}
+	for _, a := range setup_optional() {
+		checked := " checked"
+		if c.Request.Method == http.MethodPost && !chosen[a.ID] {
+			checked = ""
+		}
+		b.WriteString(`<label><input type=checkbox name=apps value="` + a.ID + `"` + checked + `> ` + html.EscapeString(a.Name) + `</label>`)
+	}
+	b.WriteString(`</fieldset><button type=submit>` + label("submit") + `</button></form>`)
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(status, "text/html; charset=utf-8", []byte(b.String()))
+}
+
+// web_setup_submit completes setup
+func web_setup_submit(c *gin.Context) {
+	setup_lock.Lock()
+	defer setup_lock.Unlock()
+	if !setup_needed() || setup_code == "" {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(c.PostForm("code")), []byte(setup_code)) != 1 {
+		web_setup_page(c, http.StatusForbidden, "code")
+		return
+	}
+	username := strings.TrimSpace(c.PostForm("username"))
+	if !email_valid(username) {
+		web_setup_page(c, http.StatusBadRequest, "username")
+		return
+	}
+	name := strings.TrimSpace(c.PostForm("name"))
+	if !valid(name, "name") {
+		web_setup_page(c, http.StatusBadRequest, "name")
+		return
+	}
+	domain := strings.ToLower(strings.TrimSpace(c.PostForm("domain")))
+	if domain != "" && !match_setup_domain.MatchString(domain) {
+		web_setup_page(c, http.StatusBadRequest, "domain")
+		return
+	}
+	from := strings.TrimSpace(c.PostForm("email_from"))
+	if from != "" && !email_valid(from) {
+		web_setup_page(c, http.StatusBadRequest, "email_from")
+		return
+	}
+
+	u, reason := user_create(username)
+	if u == nil {
+		warn("Setup unable to create user: %s", reason)
+		web_setup_page(c, http.StatusInternalServerError, "failed")
+		return
+	}
+	if _, err := entity_create(u, "person", name, "public", ""); err != nil {
+		warn("Setup unable to create identity: %v", err)
+	}
+
+	if from != "" {
+		setting_set("email_from", from)
+	}
+	if domain != "" && domain_get(domain) == nil {
+		if _, err := domain_register(domain); err != nil {
+			warn("Setup unable to register domain %s: %v", domain, err)
+		} else {
+			// Named by the operator, as with [web] domain in domains_seed_config
+			domain_update(domain, map[string]any{"verified": 1})
+		}
+	}
+	chosen := map[string]bool{}
+	for _, id := range c.PostFormArray("apps") {
+		chosen[id] = true
+	}
+	var skip []string
+	for _, a := range setup_optional() {
+		if !chosen[a.ID] {
+			skip = append(skip, a.ID)
+		}
+	}
+	setting_set("apps_default_skip", strings.Join(skip, ","))
+
+	setup_code = ""
+	apps_manager_signal()
+	audit_user_created("setup", u.Username, u.Role)
+	info("First-run setup completed by %q", u.Username)
+	auth_establish_session(c, u)
+	c.Redirect(http.StatusFound, "/")
+}
@@ -0,0 +1,90 @@
+// Mochi server: First-run setup tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSetup(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	setup_code = "code123"
+	t.Cleanup(func() { setup_code = "" })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/_/setup", web_setup)
+	r.POST("/_/setup", web_setup_submit)
+	submit := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/_/setup", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_/setup", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name=apps`) {
+		t.Fatalf("form: %d %s", w.Code, w.Body.String())
+	}
+
+	optional := setup_optional()
+	if !setup_deferred(optional[0]) || setup_deferred(apps_default[0]) {
+		t.Error("optional apps not deferred until setup is done")
+	}
+	form := url.Values{"code": {"wrong"}, "username": {"admin@example.com"}, "name": {"Admin"}, "domain": {"mochi.example.com"}, "apps": {optional[0].ID}}
+	if w := submit(form); w.Code != http.StatusForbidden {
+		t.Errorf("wrong code: %d", w.Code)
+	}
+	form.Set("code", "code123")
+	form.Set("domain", "not a domain")
+	if w := submit(form); w.Code != http.StatusBadRequest {
+		t.Errorf("bad domain: %d", w.Code)
+	}
+	if !setup_needed() {
+		t.Fatal("user created by a refused setup")
+	}
+
+	form.Set("domain", "mochi.example.com")
+	w = submit(form)
+	if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Set-Cookie"), "session=") {
+		t.Fatalf("setup: %d, cookie %q", w.Code, w.Header().Get("Set-Cookie"))
+	}
+	u := user_by_username("admin@example.com")
+	if u == nil || !u.administrator() || u.identity() == nil || u.identity().Name != "Admin" {
+		t.Fatalf("administrator %+v", u)
+	}
+	if d := domain_get("mochi.example.com"); d == nil || d.Verified != 1 {
+		t.Errorf("domain %+v", d)
+	}
+	skip := setup_skipped()
+	if skip[optional[0].ID] || len(skip) != len(optional)-1 {
+		t.Errorf("skipped %v", skip)
+	}
+	if setup_deferred(optional[0]) {
+		t.Error("optional apps still deferred after setup")
+	}
+
+	// Once done, setup is closed
+	if w := submit(form); w.Code != http.StatusFound || w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("second setup: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_/setup", nil))
+	if w.Code != http.StatusFound {
+		t.Errorf("form after setup: %d", w.Code)
+	}
+}
@@ -0,0 +1,336 @@
+// Mochi server: Share links
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A share link is a capability URL: an app mints one for an object it
+// defines (a post, an album, a document), naming the actions the link may
+// call. Anyone holding the token may then call those actions anonymously,
+// as if they were public, until the link expires or is revoked. Only the
+// token's hash is stored, and each use is logged. The log is kept for
+// share_log_retention, and to at most share_log_max entries.
+//
+// The token is presented as the "share" query parameter or the Mochi-Share
+// header, and the password, if the link has one, as "share_password" or
+// Mochi-Share-Password. The action learns which object it was shared for
+// from mochi.share.current().
+
+const (
+	share_token_length  = 32
+	share_log_limit     = 1000
+	share_log_max       = 100000
+	share_log_retention = 90 * 86400
+	share_columns       = "id, user, app, object, operations, password, expires, created, revoked, uses, last"
+)
+
+// Share is a share link, without its token
+type Share struct {
+	ID         string `db:"id"`
+	User       string `db:"user"`
+	App        string `db:"app"`
+	Object     string `db:"object"`
+	Operations string `db:"operations"`
+	Password   string `db:"password"`
+	Expires    int64  `db:"expires"`
+	Created    int64  `db:"created"`
+	Revoked    int64  `db:"revoked"`
+	Uses       int64  `db:"uses"`
+	Last       int64  `db:"last"`
+}
+
+var api_share = sls.FromStringDict(sl.String("mochi.share"), sl.StringDict{
+	"create":  sl.NewBuiltin("mochi.share.create", api_share_create),
+	"current": sl.NewBuiltin("mochi.share.current", api_share_current),
+	"list":    sl.NewBuiltin("mochi.share.list", api_share_list),
+	"log":     sl.NewBuiltin("mochi.share.log", api_share_log),
+	"revoke":  sl.NewBuiltin("mochi.share.revoke", api_share_revoke),
+})
+
+// shares_db opens the share link database, creating its tables if needed
+func shares_db() *DB {
+	db := db_open("db/shares.db")
+	db.exec("create table if not exists shares (id text not null primary key, token text not null unique, user text not null, app text not null, object text not null, operations text not null, password text not null default '', expires integer not null default 0, created integer not null, revoked integer not null default 0, uses integer not null default 0, last integer not null default 0)")
+	db.exec("create index if not exists shares_user_app_object on shares(user, app, object)")
+	db.exec("create table if not exists log (share text not null, time integer not null, operation text not null, address text not null default '')")
+	db.exec("create index if not exists log_share_time on log(share, time)")
+	return db
+}
+
+// operations returns the actions a share may call
+func (s *Share) operations() []string {
+	return strings.Split(s.Operations, ",")
+}
+
+// allows reports whether a share may call an action
+func (s *Share) allows(action string) bool {
+	for _, o := range s.operations() {
+		if o == action {
+			return true
+		}
+	}
+	return false
+}
+
+// active reports whether a share is neither revoked nor expired
+func (s *Share) active() bool {
+	return s.Revoked == 0 && (s.Expires == 0 || s.Expires > now())
+}
+
+// info returns the share for an app, without its token or password
+func (s *Share) info() map[string]any {
+	return map[string]any{
+		"id":         s.ID,
+		"object":     s.Object,
+		"operations": s.operations(),
+		"password":   s.Password != "",
+		"expires":    s.Expires,
+		"created":    s.Created,
+		"revoked":    s.Revoked,
+		"uses":       s.Uses,
+		"last":       s.Last,
+	}
+}
+
+// share_get returns a share belonging to a user and app
+func share_get(user, app, id string) *Share {
+	var s Share
+	if !shares_db().scan(&s, "select "+share_columns+" from shares where id=? and user=? and app=?", id, user, app) {
+		return nil
+	}
+	return &s
+}
+
+// share_create mints a share link, returning the share and its token
+func share_create(user, app, object string, operations []string, expires int64, password string) (*Share, string, error) {
+	hash := ""
+	if password != "" {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, "", err
+		}
+		hash = string(h)
+	}
+	token := random_alphanumeric(share_token_length)
+	s := &Share{ID: uid(), User: user, App: app, Object: object, Operations: strings.Join(operations, ","), Password: hash, Expires: expires, Created: now()}
+	shares_db().exec("insert into shares (id, token, user, app, object, operations, password, expires, created) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", s.ID, token_hash(token), s.User, s.App, s.Object, s.Operations, s.Password, s.Expires, s.Created)
+	return s, token, nil
+}
+
+// share_authorize checks the share link presented with a request for an
+// app action, returning the share, or nil if none was presented, and whether
+// the request may go ahead. A link that was presented but does not grant the
+// action refuses the request.
+func share_authorize(c *gin.Context, app, action string) (*Share, bool) {
+	token := c.Query("share")
+	if token == "" {
+		token = c.GetHeader("Mochi-Share")
+	}
+	if token == "" {
+		return nil, true
+	}
+
+	db := shares_db()
+	var s Share
+	if !db.scan(&s, "select "+share_columns+" from shares where token=?", token_hash(token)) {
+		return nil, false
+	}
+	if s.App != app || !s.active() || !s.allows(action) {
+		return nil, false
+	}
+	if s.Password != "" {
+		password := c.Query("share_password")
+		if password == "" {
+			password = c.GetHeader("Mochi-Share-Password")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(s.Password), []byte(password)) != nil {
+			return nil, false
+		}
+	}
+
+	at := now()
+	db.exec("update shares set uses=uses+1, last=? where id=?", at, s.ID)
+	db.exec("insert into log (share, time, operation, address) values (?, ?, ?, ?)", s.ID, at, action, rate_limit_client_ip(c))
+	s.Uses++
+	s.Last = at
+	return &s, true
+}
+
+// shares_cleanup drops share link log entries past retention, and the
+// oldest past the count limit
+func shares_cleanup() {
+	db := shares_db()
+	db.exec("delete from log where time < ?", now()-share_log_retention)
+	db.exec("delete from log where rowid <= (select rowid from log order by rowid desc limit 1 offset ?)", share_log_max)
+}
+
+// share_refuse responds to a request presenting an unusable share link
+func share_refuse(c *gin.Context) {
+	respond_error(c, http.StatusForbidden, "share_invalid", "errors.share_invalid", nil)
+}
+
+// mochi.share.create(object, operations, expires?, password?) -> dict: Create
+// a share link granting anonymous access to the listed actions for an object.
+// expires is a Unix time, or 0 for never. Returns {id, token}; the token is
+// shown only once.
+func api_share_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object, password string
+	var operations *sl.List
+	var expires int
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object, "operations", &operations, "expires?", &expires, "password?", &password); err != nil {
+		return nil, err
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+	if object == "" || len(object) > 1000 {
+		return sl_error(fn, "invalid object")
+	}
+	if expires != 0 && int64(expires) <= now() {
+		return sl_error(fn, "expiry is in the past")
+	}
+
+	av := app.active(user)
+	var ops []string
+	for i := 0; i < operations.Len(); i++ {
+		op, ok := sl.AsString(operations.Index(i))
+		if !ok || op == "" || strings.Contains(op, ",") {
+			return sl_error(fn, "invalid operation %v", operations.Index(i))
+		}
+		if av != nil {
+			if _, found := av.Actions[op]; !found {
+				return sl_error(fn, "unknown action %q", op)
+			}
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return sl_error(fn, "no operations")
+	}
+
+	s, token, err := share_create(user.UID, app.id, object, ops, int64(expires), password)
+	if err != nil {
+		return sl_error(fn, "unable to create share: %v", err)
+	}
+	return sl_encode(map[string]any{"id": s.ID, "token": token}), nil
+}
+
+// mochi.share.current() -> dict or None: Get the share link the current
+// anonymous request was authorised by
+func api_share_current(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	s, _ := t.Local("share").(*Share)
+	if s == nil {
+		return sl.None, nil
+	}
+	return sl_encode(s.info()), nil
+}
+
+// mochi.share.list(object?) -> list: List the app's share links, optionally
+// for one object
+func api_share_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object?", &object); err != nil {
+		return nil, err
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+
+	var shares []Share
+	var err error
+	if object == "" {
+		err = shares_db().scans(&shares, "select "+share_columns+" from shares where user=? and app=? order by created desc", user.UID, app.id)
+	} else {
+		err = shares_db().scans(&shares, "select "+share_columns+" from shares where user=? and app=? and object=? order by created desc", user.UID, app.id, object)
+	}
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+
+	results := make([]any, len(shares))
+	for i := range shares {
+		results[i] = shares[i].info()
+	}
+	return sl_encode(results), nil
+}
+
+// mochi.share.log(id) -> list: List the most recent uses of a share link
+func api_share_log(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+	if share_get(user.UID, app.id, id) == nil {
+		return sl_error(fn, "share not found")
+	}
+
+	rows, err := shares_db().rows("select time, operation, address from log where share=? order by time desc limit ?", id, share_log_limit)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.share.revoke(id) -> bool: Revoke a share link. Returns False if it
+// was already revoked.
+func api_share_revoke(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+	s := share_get(user.UID, app.id, id)
+	if s == nil {
+		return sl_error(fn, "share not found")
+	}
+	if s.Revoked != 0 {
+		return sl.False, nil
+	}
+
+	shares_db().exec("update shares set revoked=? where id=?", now(), id)
+	return sl.True, nil
+}
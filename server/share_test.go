@@ -0,0 +1,99 @@
+// Mochi server: Share link tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// share_test_request builds a request context for a URL
+func share_test_request(url string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", url, nil)
+	return c
+}
+
+func share_test_setup(t *testing.T) {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+}
+
+func TestShareAuthorize(t *testing.T) {
+	share_test_setup(t)
+	s, token, err := share_create("u1", "photos", "album/1", []string{"view", "download"}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No token leaves the request to the usual checks
+	if got, ok := share_authorize(share_test_request("/photos/view"), "photos", "view"); got != nil || !ok {
+		t.Errorf("request without share = %v, %v", got, ok)
+	}
+
+	got, ok := share_authorize(share_test_request("/photos/view?share="+token), "photos", "view")
+	if !ok || got == nil || got.ID != s.ID || got.Object != "album/1" {
+		t.Fatalf("valid share refused: %v, %v", got, ok)
+	}
+	if _, ok := share_authorize(share_test_request("/photos/edit?share="+token), "photos", "edit"); ok {
+		t.Error("share used for an action it does not list")
+	}
+	if _, ok := share_authorize(share_test_request("/notes/view?share="+token), "notes", "view"); ok {
+		t.Error("share used for another app")
+	}
+	if _, ok := share_authorize(share_test_request("/photos/view?share=guess"), "photos", "view"); ok {
+		t.Error("unknown token accepted")
+	}
+
+	if n, _ := shares_db().exists("select 1 from log where share=? and operation='view'", s.ID); !n {
+		t.Error("use not logged")
+	}
+}
+
+func TestShareExpiryRevocationPassword(t *testing.T) {
+	share_test_setup(t)
+	expired, token, _ := share_create("u1", "photos", "album/1", []string{"view"}, now()-1, "")
+	if _, ok := share_authorize(share_test_request("/photos/view?share="+token), "photos", "view"); ok {
+		t.Errorf("expired share %s accepted", expired.ID)
+	}
+
+	revoked, token, _ := share_create("u1", "photos", "album/1", []string{"view"}, 0, "")
+	shares_db().exec("update shares set revoked=? where id=?", now(), revoked.ID)
+	if _, ok := share_authorize(share_test_request("/photos/view?share="+token), "photos", "view"); ok {
+		t.Error("revoked share accepted")
+	}
+
+	_, token, _ = share_create("u1", "photos", "album/1", []string{"view"}, 0, "secret")
+	if _, ok := share_authorize(share_test_request("/photos/view?share="+token), "photos", "view"); ok {
+		t.Error("password share accepted without password")
+	}
+	if _, ok := share_authorize(share_test_request("/photos/view?share="+token+"&share_password=wrong"), "photos", "view"); ok {
+		t.Error("password share accepted with wrong password")
+	}
+	c := share_test_request("/photos/view?share=" + token)
+	c.Request.Header.Set("Mochi-Share-Password", "secret")
+	if got, ok := share_authorize(c, "photos", "view"); !ok || got == nil {
+		t.Error("password share refused with right password")
+	}
+}
+
+func TestSharesCleanup(t *testing.T) {
+	share_test_setup(t)
+	s, token, _ := share_create("u1", "photos", "album/1", []string{"view"}, 0, "")
+	if _, ok := share_authorize(share_test_request("/photos/view?share="+token), "photos", "view"); !ok {
+		t.Fatal("share refused")
+	}
+	db := shares_db()
+	db.exec("insert into log (share, time, operation) values (?, ?, 'view')", s.ID, now()-share_log_retention-1)
+	shares_cleanup()
+	if n := db.integer("select count(*) from log where share=?", s.ID); n != 1 {
+		t.Errorf("%d log entries after cleanup, want the recent one", n)
+	}
+}
@@ -210,6 +210,11 @@ func web_serve_shell(c *gin.Context, app_id string) {
 		"{{MENU_JS}}", menu_js,
 		"{{MENU_CSS}}", menu_css,
 	).Replace(shell_html)
+	if app_id != "" {
+		if tags := pwa_tags(user, app_id); len(tags) > 0 {
+			page = strings.Replace(page, "<head>", "<head>"+strings.Join(tags, ""), 1)
+		}
+	}
 
 	// Clear stale mochi-theme cookie (no longer used)
 	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
@@ -389,7 +394,11 @@ func web_shell_init(c *gin.Context) {
 	// Active i18n language for the user (BCP 47). Logged-in users use their
 	// `language` preference; falls through to Accept-Language for the brief
 	// anonymous-public window before login completes.
-	result["language"] = request_language(c, user)
+	// The direction it's written in lets the shell set <html dir> before any
+	// app loads.
+	language := request_language(c, user)
+	result["language"] = language
+	result["direction"] = language_direction(language)
 
 	// Source-server cleanup banner: set when this account arrived via a
 	// server-move restore. Carried here so home/settings render the banner
@@ -0,0 +1,409 @@
+// Mochi server: Server-sent events
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// A live page can follow changes over server-sent events rather than a
+// websocket: a plain GET the browser's EventSource reconnects by itself.
+// An action declared with "stream": true in app.json gets a.stream, whose
+// send() writes an event to the client straight away and whose subscribe()
+// keeps the response open once the action returns, passing on whatever the
+// app later sends to that key for the action's owner with mochi.sse.send.
+// A comment is written every 25 seconds so proxies don't time out an idle
+// stream, and a client that has gone is noticed at the next write.
+//
+// Each event sent to a key gets an ID, and the last 64 sent to each key in
+// the past 5 minutes are kept, so a client reconnecting with Last-Event-ID
+// is first sent the events it missed. An action's concurrency limit caps
+// how many of its streams can be open at once. In a cluster, events are
+// relayed to the other nodes over the same bus as websocket messages.
+
+const (
+	sse_heartbeat  = 25 * time.Second
+	sse_retry      = 3000 // Default milliseconds a client waits to reconnect
+	sse_replay     = 64
+	sse_replay_age = 5 * time.Minute
+	sse_queue      = 64 // Events waiting for a slow client before it's cut off
+	sse_bus_prefix = "sse:"
+)
+
+type sse_event struct {
+	id    string
+	event string
+	data  string
+	sent  time.Time
+}
+
+// sse_subscriber is one open stream's interest in one or more channels
+type sse_subscriber struct {
+	events   chan *sse_event
+	channels []string
+	closed   bool
+}
+
+// sse_channel is a key's subscribers and recent events, for one owner and app
+type sse_channel struct {
+	subscribers map[*sse_subscriber]bool
+	recent      []*sse_event
+}
+
+var (
+	api_sse = sls.FromStringDict(sl.String("mochi.sse"), sl.StringDict{
+		"send": sl.NewBuiltin("mochi.sse.send", api_sse_send),
+	})
+
+	sse_channels = map[string]*sse_channel{}
+	sse_lock     sync.Mutex
+	// IDs start from the time the server started, so they keep increasing
+	// across restarts and an ID from before one can't replay the wrong events
+	sse_epoch    = time.Now().UnixMilli() * 1000
+	sse_sequence atomic.Int64
+	sse_swept    time.Time
+)
+
+// sse_channel_name returns the channel for an owner, app and key
+func sse_channel_name(uid, app, key string) string {
+	return uid + "/" + app + "/" + key
+}
+
+// sse_publish sends an event to a channel's subscribers on this node and
+// keeps it for clients that reconnect. Events for a channel no stream has
+// subscribed to, or none has for the past five minutes, go nowhere.
+func sse_publish(name, event, data string) {
+	e := &sse_event{id: strconv.FormatInt(sse_epoch+sse_sequence.Add(1), 10), event: event, data: data, sent: time.Now()}
+	sse_lock.Lock()
+	defer sse_lock.Unlock()
+	ch := sse_channels[name]
+	if ch == nil {
+		return
+	}
+	ch.recent = append(ch.recent, e)
+	sse_trim(ch)
+	for s := range ch.subscribers {
+		select {
+		case s.events <- e:
+		default:
+			// Too far behind to catch up; it reconnects and replays
+			sse_unsubscribe_locked(s)
+		}
+	}
+}
+
+// sse_trim drops events too old to replay. Must be called with sse_lock held.
+func sse_trim(ch *sse_channel) {
+	cutoff := time.Now().Add(-sse_replay_age)
+	drop := max(0, len(ch.recent)-sse_replay)
+	for drop < len(ch.recent) && ch.recent[drop].sent.Before(cutoff) {
+		drop++
+	}
+	ch.recent = ch.recent[drop:]
+}
+
+// sse_subscribe adds a subscriber to a channel, returning the events kept
+// since the last one the client saw, if it gave one
+func sse_subscribe(s *sse_subscriber, name, last string) []*sse_event {
+	sse_lock.Lock()
+	defer sse_lock.Unlock()
+	if time.Since(sse_swept) > time.Minute {
+		sse_sweep_locked()
+	}
+	ch := sse_channels[name]
+	if ch == nil {
+		ch = &sse_channel{subscribers: map[*sse_subscriber]bool{}}
+		sse_channels[name] = ch
+	}
+	ch.subscribers[s] = true
+	s.channels = append(s.channels, name)
+
+	after, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || after < sse_epoch {
+		return nil
+	}
+	sse_trim(ch)
+	var replay []*sse_event
+	for _, e := range ch.recent {
+		if id, _ := strconv.ParseInt(e.id, 10, 64); id > after {
+			replay = append(replay, e)
+		}
+	}
+	return replay
+}
+
+// sse_sweep_locked drops the channels left with no subscribers once their
+// events are too old to replay. Must be called with sse_lock held.
+func sse_sweep_locked() {
+	sse_swept = time.Now()
+	for name, ch := range sse_channels {
+		if len(ch.subscribers) == 0 {
+			sse_trim(ch)
+			if len(ch.recent) == 0 {
+				delete(sse_channels, name)
+			}
+		}
+	}
+}
+
+// sse_unsubscribe_locked removes a subscriber from its channels, dropping
+// channels left with nothing to replay. Must be called with sse_lock held.
+func sse_unsubscribe_locked(s *sse_subscriber) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.events)
+	for _, name := range s.channels {
+		if ch := sse_channels[name]; ch != nil {
+			delete(ch.subscribers, s)
+			sse_trim(ch)
+			if len(ch.subscribers) == 0 && len(ch.recent) == 0 {
+				delete(sse_channels, name)
+			}
+		}
+	}
+}
+
+// sse_stream is an action's event stream response
+type sse_stream struct {
+	c          *gin.Context
+	opened     bool
+	subscriber *sse_subscriber
+}
+
+// open starts the response, if it hasn't been started
+func (s *sse_stream) open() error {
+	if s.opened {
+		return nil
+	}
+	if s.c.Writer.Written() {
+		return fmt.Errorf("response already written")
+	}
+	s.opened = true
+	h := s.c.Writer.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	s.c.Status(200)
+	return s.write(fmt.Sprintf("retry: %d\n\n", sse_retry))
+}
+
+// write sends text to the client now
+func (s *sse_stream) write(text string) error {
+	web_write_deadline(s.c, 0)
+	if _, err := s.c.Writer.WriteString(text); err != nil {
+		return err
+	}
+	s.c.Writer.Flush()
+	return nil
+}
+
+// send writes an event
+func (s *sse_stream) send(e *sse_event) error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	var b strings.Builder
+	if e.id != "" {
+		b.WriteString("id: " + e.id + "\n")
+	}
+	if e.event != "" && e.event != "message" {
+		b.WriteString("event: " + e.event + "\n")
+	}
+	data := strings.ReplaceAll(strings.ReplaceAll(e.data, "\r\n", "\n"), "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// serve passes on the events for the stream's subscriptions once the action
+// has returned, until the client goes
+func (s *sse_stream) serve() {
+	if !s.opened || s.subscriber == nil {
+		return
+	}
+	heartbeat := time.NewTicker(sse_heartbeat)
+	defer heartbeat.Stop()
+	done := s.c.Request.Context().Done()
+	for {
+		select {
+		case <-done:
+			return
+		case e, ok := <-s.subscriber.events:
+			if !ok || s.send(e) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if s.write(": heartbeat\n\n") != nil {
+				return
+			}
+		}
+	}
+}
+
+// close ends the stream's subscriptions
+func (s *sse_stream) close() {
+	if s.subscriber != nil {
+		sse_lock.Lock()
+		sse_unsubscribe_locked(s.subscriber)
+		sse_lock.Unlock()
+	}
+}
+
+// sse_data encodes an event's data: strings as they are, anything else as
+// JSON
+func sse_data(v sl.Value) string {
+	if s, ok := sl.AsString(v); ok {
+		return s
+	}
+	return json_encode(sl_decode(v))
+}
+
+// ActionStream is a.stream, for actions declared as event streams
+type ActionStream struct {
+	action *Action
+}
+
+func (as *ActionStream) String() string        { return "Action.stream" }
+func (as *ActionStream) Type() string          { return "module" }
+func (as *ActionStream) Freeze()               {}
+func (as *ActionStream) Truth() sl.Bool        { return sl.True }
+func (as *ActionStream) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: module") }
+func (as *ActionStream) AttrNames() []string {
+	return []string{"last", "send", "subscribe"}
+}
+func (as *ActionStream) Attr(name string) (sl.Value, error) {
+	switch name {
+	case "last":
+		if id := as.action.web.GetHeader("Last-Event-ID"); id != "" {
+			return sl.String(id), nil
+		}
+		return sl.None, nil
+	case "send":
+		return sl.NewBuiltin("stream.send", as.sl_send), nil
+	case "subscribe":
+		return sl.NewBuiltin("stream.subscribe", as.sl_subscribe), nil
+	}
+	return nil, nil
+}
+
+// stream returns the action's stream, or an error if it isn't declared as one
+func (as *ActionStream) stream(fn *sl.Builtin) (*sse_stream, error) {
+	if as.action.stream == nil {
+		return nil, fmt.Errorf("%s: action is not declared as a stream", fn.Name())
+	}
+	return as.action.stream, nil
+}
+
+// a.stream.send(event, data, id=None) -> None: Send an event to the client
+// now. Data that isn't a string is sent as JSON.
+func (as *ActionStream) sl_send(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var event, id string
+	var data sl.Value
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "event", &event, "data", &data, "id?", &id); err != nil {
+		return nil, err
+	}
+	s, err := as.stream(fn)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(event, "\r\n") || strings.ContainsAny(id, "\r\n") {
+		return sl_error(fn, "invalid event or id")
+	}
+	if err := s.send(&sse_event{id: id, event: event, data: sse_data(data)}); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	return sl.None, nil
+}
+
+// a.stream.subscribe(key) -> None: Keep the stream open after the action
+// returns, sending the client the events sent to key with mochi.sse.send.
+// A reconnecting client is first sent those it missed.
+func (as *ActionStream) sl_subscribe(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var key string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "key", &key); err != nil {
+		return nil, err
+	}
+	s, err := as.stream(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !valid(key, "constant") {
+		return sl_error(fn, "invalid key %q", key)
+	}
+	owner := as.action.owner
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+	if err := s.open(); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if s.subscriber == nil {
+		s.subscriber = &sse_subscriber{events: make(chan *sse_event, sse_queue)}
+	}
+	for _, e := range sse_subscribe(s.subscriber, sse_channel_name(owner.UID, as.action.app.id, key), as.action.web.GetHeader("Last-Event-ID")) {
+		if err := s.send(e); err != nil {
+			return sl_error(fn, "%v", err)
+		}
+	}
+	return sl.None, nil
+}
+
+// mochi.sse.send(key, event, data) -> None: Send an event to the app's
+// streams subscribed to key for the current owner. Data that isn't a
+// string is sent as JSON.
+func api_sse_send(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var key, event string
+	var data sl.Value
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "event", &event, "data", &data); err != nil {
+		return nil, err
+	}
+	if !valid(key, "constant") {
+		return sl_error(fn, "invalid key %q", key)
+	}
+	if strings.ContainsAny(event, "\r\n") {
+		return sl_error(fn, "invalid event %q", event)
+	}
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return sl_error(fn, "no app")
+	}
+	owner, _ := t.Local("owner").(*User)
+	if owner == nil {
+		return sl_error(fn, "no owner")
+	}
+
+	encoded := sse_data(data)
+	sse_publish(sse_channel_name(owner.UID, app.id, key), event, encoded)
+	cluster_relay(owner.UID, sse_bus_prefix+app.id+"/"+key, map[string]string{"event": event, "data": encoded})
+	return sl.None, nil
+}
+
+// sse_bus_deliver publishes an event another node relayed
+func sse_bus_deliver(uid, key, content string) {
+	var e struct {
+		Event string `json:"event"`
+		Data  string `json:"data"`
+	}
+	if json.Unmarshal([]byte(content), &e) != nil {
+		return
+	}
+	sse_publish(uid+"/"+strings.TrimPrefix(key, sse_bus_prefix), e.Event, e.Data)
+}
@@ -0,0 +1,129 @@
+// Mochi server: Server-sent events tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+// sse_test_server runs an action that sends a greeting and subscribes to
+// "feed"
+func sse_test_server(t *testing.T) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/live", func(c *gin.Context) {
+		a := &Action{web: c, owner: &User{UID: "alice"}, app: &App{id: "live"}, stream: &sse_stream{c: c}}
+		defer a.stream.close()
+		stream := &ActionStream{action: a}
+		thread := &sl.Thread{}
+		send, _ := stream.Attr("send")
+		subscribe, _ := stream.Attr("subscribe")
+		if _, err := sl.Call(thread, send, sl.Tuple{sl.String("hello"), sl.String("one\ntwo")}, nil); err != nil {
+			t.Error(err)
+		}
+		if _, err := sl.Call(thread, subscribe, sl.Tuple{sl.String("feed")}, nil); err != nil {
+			t.Error(err)
+		}
+		a.stream.serve()
+	})
+	s := httptest.NewServer(r)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// sse_test_read reads events from a stream until it has n, returning each
+// as its lines
+func sse_test_read(t *testing.T, r *bufio.Reader, n int) []string {
+	t.Helper()
+	var events []string
+	var lines []string
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v, after %q", err, events)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line != "" {
+			lines = append(lines, line)
+			continue
+		}
+		if len(lines) > 0 && !strings.HasPrefix(lines[0], "retry:") {
+			events = append(events, strings.Join(lines, "|"))
+		}
+		lines = nil
+	}
+	return events
+}
+
+func TestSSE(t *testing.T) {
+	s := sse_test_server(t)
+	channel := sse_channel_name("alice", "live", "feed")
+
+	connect := func(last string) (*http.Response, *bufio.Reader) {
+		req, _ := http.NewRequest("GET", s.URL+"/live", nil)
+		if last != "" {
+			req.Header.Set("Last-Event-ID", last)
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("content type %q", ct)
+		}
+		return r, bufio.NewReader(r.Body)
+	}
+
+	r, body := connect("")
+	if events := sse_test_read(t, body, 1); events[0] != "event: hello|data: one|data: two" {
+		t.Errorf("greeting %q", events[0])
+	}
+	sse_publish(channel, "update", `{"n":1}`)
+	events := sse_test_read(t, body, 1)
+	if !strings.HasPrefix(events[0], "id: ") || !strings.HasSuffix(events[0], `|event: update|data: {"n":1}`) {
+		t.Errorf("published %q", events[0])
+	}
+	first := strings.TrimPrefix(strings.Split(events[0], "|")[0], "id: ")
+	r.Body.Close()
+
+	// Wait for the stream to notice the client has gone, then send what it
+	// misses
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		sse_lock.Lock()
+		ch := sse_channels[channel]
+		open := ch != nil && len(ch.subscribers) > 0
+		sse_lock.Unlock()
+		if !open {
+			break
+		}
+	}
+	sse_publish(channel, "update", "2")
+	sse_publish(channel, "update", "3")
+
+	r, body = connect(first)
+	defer r.Body.Close()
+	events = sse_test_read(t, body, 3)
+	if !strings.HasSuffix(events[1], "data: 2") || !strings.HasSuffix(events[2], "data: 3") {
+		t.Errorf("replayed %q", events)
+	}
+}
+
+func TestSSENotStream(t *testing.T) {
+	stream := &ActionStream{action: &Action{}}
+	send, _ := stream.Attr("send")
+	if _, err := sl.Call(&sl.Thread{}, send, sl.Tuple{sl.String("x"), sl.String("y")}, nil); err == nil || !strings.Contains(err.Error(), "not declared as a stream") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	rd "runtime/debug"
 	"sync/atomic"
 	"time"
 
@@ -77,11 +78,56 @@ func starlark_configure() {
 		file_secs = secs
 	}
 	starlark_file_timeout = time.Duration(file_secs) * time.Second
+
+	starlark_pool_size = ini_int("starlark", "pool", 1)
 }
 
 type Starlark struct {
-	thread  *sl.Thread
-	globals sl.StringDict
+	thread   *sl.Thread
+	globals  sl.StringDict
+	pool     *starlark_pool // If set, globals are taken from here per call
+	timeout  time.Duration  // If set, overrides starlark_default_timeout
+	finished func()         // If set, run once the next call's work has ended
+}
+
+// TimeoutError is returned by Starlark.call when the call ran past its
+// deadline and was cancelled, so callers can answer 504 rather than 500
+type TimeoutError struct {
+	After time.Duration
+	File  bool  // The call was streaming a file when it timed out
+	Err   error // The interpreter's cancellation error, if it stopped in time
+}
+
+// Error implements the error interface
+func (e *TimeoutError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	if e.File {
+		return fmt.Sprintf("starlark: file serving timeout after %s", e.After)
+	}
+	return fmt.Sprintf("starlark: timeout after %s", e.After)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// starlark_remaining returns the time left before the deadline of the call
+// running on a thread, for nested calls that must finish within it. A thread
+// with no deadline returns zero, meaning the default timeout.
+func starlark_remaining(t *sl.Thread) time.Duration {
+	deadline, ok := t.Local("deadline").(time.Time)
+	if !ok {
+		return 0
+	}
+	remaining := time.Until(deadline)
+	if remaining < time.Millisecond {
+		// Already past: leave the nested call a moment to fail cleanly
+		// rather than treating zero as "use the default"
+		remaining = time.Millisecond
+	}
+	return remaining
 }
 
 // Create a new Starlark interpreter for a set of files
@@ -100,7 +146,13 @@ func starlark(files []string) *Starlark {
 
 	for _, file := range files {
 		//debug("Starlark reading file %q", file)
-		defined, err := sl.ExecFile(s.thread, file, nil, s.globals)
+		program, err := starlark_program(file, s.globals)
+		if err != nil {
+			info("Starlark error reading file %v", err)
+			continue
+		}
+		defined, err := program.Init(s.thread, s.globals)
+		defined.Freeze()
 		if err != nil {
 			info("Starlark error reading file %v", err)
 			continue
@@ -427,15 +479,39 @@ func starlark_serving_get(t *sl.Thread) bool {
 // context cancellation, so this is what actually stops it.
 //
 // Falls back to a background context for calls made outside Starlark.call.
+// Either way it names the calling app, so outbound requests made with it
+// follow that app's egress policy.
 func starlark_context(t *sl.Thread) context.Context {
-	if ctx, ok := t.Local("context").(context.Context); ok && ctx != nil {
-		return ctx
+	ctx, ok := t.Local("context").(context.Context)
+	if !ok || ctx == nil {
+		ctx = context.Background()
+	}
+	if app, ok := t.Local("app").(*App); ok && app != nil {
+		ctx = url_egress_context(ctx, app.id)
 	}
-	return context.Background()
+	return ctx
 }
 
 // Call a Starlark function
 func (s *Starlark) call(function string, args sl.Tuple, kwargs ...[]sl.Tuple) (sl.Value, error) {
+	// finished runs when the work ends: on return if the call never starts,
+	// otherwise when its goroutine exits, which for an abandoned call is
+	// after it has returned
+	finished := s.finished
+	s.finished = nil
+	if finished == nil {
+		finished = func() {}
+	}
+	started := false
+	defer func() {
+		if !started {
+			finished()
+		}
+	}()
+
+	if s.pool != nil {
+		s.globals = s.pool.get(starlark_pool_key(s.thread))
+	}
 	f, found := s.globals[function]
 	if !found {
 		return nil, fmt.Errorf("Starlark app function %q not found", function)
@@ -488,6 +564,16 @@ func (s *Starlark) call(function string, args sl.Tuple, kwargs ...[]sl.Tuple) (s
 	serving := &atomic.Bool{}
 	s.thread.SetLocal("file_serving", serving)
 
+	timeout := starlark_default_timeout
+	if s.timeout > 0 {
+		timeout = s.timeout
+	}
+	file_timeout := starlark_file_timeout
+	if file_timeout < timeout {
+		file_timeout = timeout
+	}
+	s.thread.SetLocal("deadline", time.Now().Add(timeout))
+
 	// Reset cancel state from any previous timeout
 	s.thread.Uncancel()
 
@@ -498,6 +584,7 @@ func (s *Starlark) call(function string, args sl.Tuple, kwargs ...[]sl.Tuple) (s
 	// a goroutine we have already abandoned can always send and exit.
 	done := make(chan starlark_result, 1)
 
+	started = true
 	go func() {
 		// Recover panics so a fault in one Starlark call (a malformed
 		// SQLite DB, a nil deref in a Go-side API, etc.) becomes an
@@ -510,7 +597,7 @@ func (s *Starlark) call(function string, args sl.Tuple, kwargs ...[]sl.Tuple) (s
 		var out starlark_result
 		defer func() {
 			if r := recover(); r != nil {
-				out = starlark_result{err: fmt.Errorf("Starlark call %q panicked: %v", function, r)}
+				out = starlark_result{err: &PanicError{Function: function, Value: r, Stack: rd.Stack()}}
 			}
 			// Cleanup belongs to the goroutine that owns this thread, not to
 			// the caller. Doing it in the caller raced with a timed-out call
@@ -525,6 +612,7 @@ func (s *Starlark) call(function string, args sl.Tuple, kwargs ...[]sl.Tuple) (s
 				s.thread.SetLocal("streams", nil)
 			}
 			transaction_close(s.thread)
+			finished()
 			done <- out
 		}()
 		value, err := sl.Call(s.thread, f, args, kw)
@@ -542,7 +630,7 @@ func (s *Starlark) call(function string, args sl.Tuple, kwargs ...[]sl.Tuple) (s
 			}
 		}
 		return out.value, out.err
-	case <-time.After(starlark_default_timeout):
+	case <-time.After(timeout):
 		// A call that has handed the response to the client has finished its
 		// Starlark work and is only streaming bytes, so cancelling it at the
 		// compute timeout would truncate a legitimate download. Give it the
@@ -552,10 +640,10 @@ func (s *Starlark) call(function string, args sl.Tuple, kwargs ...[]sl.Tuple) (s
 			select {
 			case out := <-done:
 				return out.value, out.err
-			case <-time.After(starlark_file_timeout):
+			case <-time.After(file_timeout):
 				s.thread.Cancel("timeout")
-				debug("Starlark %s() file serving timed out after %s", function, starlark_file_timeout)
-				return nil, fmt.Errorf("starlark: file serving timeout after %s", starlark_file_timeout)
+				debug("Starlark %s() file serving timed out after %s", function, file_timeout)
+				return nil, &TimeoutError{After: file_timeout, File: true}
 			}
 		}
 		s.thread.Cancel("timeout")
@@ -565,6 +653,9 @@ func (s *Starlark) call(function string, args sl.Tuple, kwargs ...[]sl.Tuple) (s
 		// raced with a call still running inside a built-in.
 		select {
 		case out := <-done:
+			if out.err != nil {
+				return out.value, &TimeoutError{After: timeout, Err: out.err}
+			}
 			return out.value, out.err
 		case <-time.After(starlark_cancel_grace):
 		}
@@ -572,8 +663,8 @@ func (s *Starlark) call(function string, args sl.Tuple, kwargs ...[]sl.Tuple) (s
 		// for cancellation. Abandon it. The goroutine runs its own cleanup and
 		// frees its semaphore slot when it eventually exits; touching the
 		// thread, its streams or its transaction from here would race with it.
-		debug("Starlark %s() timed out after %s", function, starlark_default_timeout)
-		return nil, fmt.Errorf("starlark: timeout after %s", starlark_default_timeout)
+		debug("Starlark %s() timed out after %s", function, timeout)
+		return nil, &TimeoutError{After: timeout}
 	}
 }
 
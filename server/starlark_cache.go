@@ -0,0 +1,124 @@
+// Mochi server: Starlark compiled program cache
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Parsing and compiling every installed app's Starlark on each start is the
+// bulk of first-request latency, so compiled programs are kept in
+// cache_dir/starlark. An entry is keyed by a hash of everything compilation
+// depends on: the file name (embedded in positions), the source, the set of
+// predeclared names (which decides global versus predeclared resolution),
+// and the dialect options. A changed file therefore simply misses, and the
+// stale entry ages out through cache_cleanup; hits refresh the mtime so
+// entries in use never do. An entry written by a different compiler version
+// fails to decode and is recompiled and replaced.
+//
+// With dev_reload the cache is bypassed: sources are re-read on every call,
+// and caching each edit would only fill the directory.
+
+func starlark_cache_dir() string {
+	return filepath.Join(cache_dir, "starlark")
+}
+
+// starlark_cache_key hashes the inputs that determine a compiled program
+func starlark_cache_key(opts *syntax.FileOptions, file string, source []byte, predeclared sl.StringDict) string {
+	h := sha256.New()
+	h.Write([]byte(file))
+	h.Write([]byte{0})
+	h.Write(source)
+	h.Write([]byte{0})
+	names := predeclared.Keys()
+	sort.Strings(names)
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+	}
+	for _, flag := range []bool{opts.Set, opts.While, opts.TopLevelControl, opts.GlobalReassign, opts.LoadBindsGlobally, opts.Recursion} {
+		if flag {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// starlark_program returns the compiled program for a file, from the cache if
+// possible, compiling and storing it otherwise
+func starlark_program(file string, predeclared sl.StringDict) (*sl.Program, error) {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	opts := syntax.LegacyFileOptions()
+	if dev_reload || cache_dir == "" {
+		_, program, err := sl.SourceProgramOptions(opts, file, source, predeclared.Has)
+		return program, err
+	}
+
+	path := filepath.Join(starlark_cache_dir(), starlark_cache_key(opts, file, source, predeclared)+".compiled")
+	if data, err := os.ReadFile(path); err == nil {
+		program, err := sl.CompiledProgram(bytes.NewReader(data))
+		if err == nil {
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			return program, nil
+		}
+		debug("Starlark discarding cached program for %q: %v", file, err)
+	}
+
+	_, program, err := sl.SourceProgramOptions(opts, file, source, predeclared.Has)
+	if err != nil {
+		return nil, err
+	}
+	starlark_cache_store(path, program)
+	return program, nil
+}
+
+// starlark_cache_store writes a compiled program through a temporary file, so
+// a concurrent reader or a crash never sees a partial entry. Failure only
+// costs a recompile next time, so it is logged and otherwise ignored.
+func starlark_cache_store(path string, program *sl.Program) {
+	var buf bytes.Buffer
+	if err := program.Write(&buf); err != nil {
+		debug("Starlark unable to encode program: %v", err)
+		return
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		debug("Starlark unable to create program cache %q: %v", dir, err)
+		return
+	}
+	tmp, err := os.CreateTemp(dir, ".partial-*")
+	if err != nil {
+		debug("Starlark unable to write program cache: %v", err)
+		return
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		debug("Starlark unable to write program cache: %v", err)
+	}
+}
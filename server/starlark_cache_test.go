@@ -0,0 +1,101 @@
+// Mochi server: Starlark compiled program cache tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func starlark_cache_test_setup(t *testing.T) string {
+	t.Helper()
+	original_cache, original_reload := cache_dir, dev_reload
+	cache_dir = t.TempDir()
+	dev_reload = false
+	t.Cleanup(func() {
+		cache_dir, dev_reload = original_cache, original_reload
+	})
+	file := filepath.Join(t.TempDir(), "app.star")
+	if err := os.WriteFile(file, []byte("def answer():\n    return 42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func starlark_cache_entries(t *testing.T) []string {
+	t.Helper()
+	entries, _ := filepath.Glob(filepath.Join(starlark_cache_dir(), "*.compiled"))
+	return entries
+}
+
+func starlark_cache_answer(t *testing.T, file string) {
+	t.Helper()
+	s := starlark([]string{file})
+	f, ok := s.globals["answer"].(sl.Callable)
+	if !ok {
+		t.Fatal("answer not defined")
+	}
+	v, err := sl.Call(s.thread, f, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := sl.AsInt32(v); n != 42 {
+		t.Errorf("answer() = %v, want 42", v)
+	}
+}
+
+func TestStarlarkCacheStoresAndReuses(t *testing.T) {
+	file := starlark_cache_test_setup(t)
+	starlark_cache_answer(t, file)
+	entries := starlark_cache_entries(t)
+	if len(entries) != 1 {
+		t.Fatalf("expected one cache entry, found %d", len(entries))
+	}
+
+	starlark_cache_answer(t, file)
+	if again := starlark_cache_entries(t); len(again) != 1 || again[0] != entries[0] {
+		t.Errorf("unchanged source should reuse its entry, found %v", again)
+	}
+
+	// A changed source must not load the old program
+	if err := os.WriteFile(file, []byte("def answer():\n    return 40 + 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	starlark_cache_answer(t, file)
+	if len(starlark_cache_entries(t)) != 2 {
+		t.Error("changed source should compile to a new entry")
+	}
+}
+
+func TestStarlarkCacheCorruptEntry(t *testing.T) {
+	file := starlark_cache_test_setup(t)
+	starlark_cache_answer(t, file)
+	entries := starlark_cache_entries(t)
+	if len(entries) != 1 {
+		t.Fatalf("expected one cache entry, found %d", len(entries))
+	}
+	if err := os.WriteFile(entries[0], []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	starlark_cache_answer(t, file)
+	data, _ := os.ReadFile(entries[0])
+	if string(data) == "garbage" {
+		t.Error("corrupt entry should be replaced")
+	}
+}
+
+func TestStarlarkCacheDevReload(t *testing.T) {
+	file := starlark_cache_test_setup(t)
+	dev_reload = true
+	starlark_cache_answer(t, file)
+	if n := len(starlark_cache_entries(t)); n != 0 {
+		t.Errorf("dev_reload should bypass the cache, found %d entries", n)
+	}
+}
@@ -0,0 +1,107 @@
+// Mochi server: Starlark interpreter pool
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+// Each call already runs on its own thread, so calls to one app version never
+// queue behind each other; the only shared state is the module globals loaded
+// from the app's files, which are frozen after loading. A pool goes further:
+// it keeps several independently loaded copies of those globals and pins each
+// user to one, so values built at load time are never shared between users
+// who land on different copies, and a copy that goes idle is released.
+//
+// [starlark] pool sets the number of copies per app version. The default of
+// 1 is one shared copy, as before pools; larger values trade memory (one full
+// load of the app per copy) for isolation.
+
+const starlark_pool_idle = 10 * time.Minute
+
+var starlark_pool_size = 1
+
+type starlark_pool struct {
+	mu      sync.Mutex
+	load    func() sl.StringDict
+	entries []starlark_pool_entry
+}
+
+type starlark_pool_entry struct {
+	globals sl.StringDict
+	used    time.Time
+}
+
+func starlark_pool_new(size int, load func() sl.StringDict) *starlark_pool {
+	if size < 1 {
+		size = 1
+	}
+	return &starlark_pool{load: load, entries: make([]starlark_pool_entry, size)}
+}
+
+// starlark_pool_key identifies the caller a thread runs for, for affinity.
+// Calls with no user (public actions, system events) share the first entry.
+func starlark_pool_key(t *sl.Thread) string {
+	if u, ok := t.Local("user").(*User); ok && u != nil {
+		return u.UID
+	}
+	return ""
+}
+
+// get returns the globals for a caller, loading its entry if necessary and
+// releasing any others that have been idle too long
+func (p *starlark_pool) get(key string) sl.StringDict {
+	index := 0
+	if key != "" && len(p.entries) > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		index = int(h.Sum32() % uint32(len(p.entries)))
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	for i := range p.entries {
+		if i != index && p.entries[i].globals != nil && now.Sub(p.entries[i].used) > starlark_pool_idle {
+			p.entries[i].globals = nil
+		}
+	}
+	e := &p.entries[index]
+	e.used = now
+	globals := e.globals
+	p.mu.Unlock()
+	if globals != nil {
+		return globals
+	}
+
+	// Load outside the lock: it runs the app's top-level code, which can be
+	// slow, and other entries stay usable meanwhile. Two callers racing here
+	// both load; the first to finish wins and the other copy is dropped.
+	globals = p.load()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.globals == nil {
+		e.globals = globals
+	}
+	return e.globals
+}
+
+// loaded reports how many entries currently hold globals
+func (p *starlark_pool) loaded() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, e := range p.entries {
+		if e.globals != nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+// Mochi server: Starlark interpreter pool tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+func starlark_pool_test(size int) (*starlark_pool, *int) {
+	loads := 0
+	p := starlark_pool_new(size, func() sl.StringDict {
+		loads++
+		return sl.StringDict{"copy": sl.MakeInt(loads)}
+	})
+	return p, &loads
+}
+
+func TestStarlarkPoolAffinity(t *testing.T) {
+	p, loads := starlark_pool_test(4)
+	first := p.get("alice")["copy"]
+	for i := 0; i < 10; i++ {
+		if got := p.get("alice")["copy"]; got != first {
+			t.Fatalf("same user got copy %v then %v", first, got)
+		}
+	}
+	if *loads != 1 {
+		t.Errorf("repeated calls for one user loaded %d copies", *loads)
+	}
+
+	// Enough distinct users spread across every entry
+	for i := 0; i < 100; i++ {
+		p.get(fmt.Sprintf("user%d", i))
+	}
+	if n := p.loaded(); n != 4 {
+		t.Errorf("expected all 4 entries in use, have %d", n)
+	}
+}
+
+func TestStarlarkPoolSingle(t *testing.T) {
+	p, loads := starlark_pool_test(0)
+	p.get("alice")
+	p.get("bob")
+	p.get("")
+	if *loads != 1 {
+		t.Errorf("pool of one loaded %d copies", *loads)
+	}
+}
+
+func TestStarlarkPoolEviction(t *testing.T) {
+	p, _ := starlark_pool_test(2)
+	for i := 0; i < 20; i++ {
+		p.get(fmt.Sprintf("user%d", i))
+	}
+	if p.loaded() != 2 {
+		t.Fatalf("expected both entries loaded")
+	}
+	p.mu.Lock()
+	for i := range p.entries {
+		p.entries[i].used = time.Now().Add(-2 * starlark_pool_idle)
+	}
+	p.mu.Unlock()
+	p.get("")
+	if n := p.loaded(); n != 1 {
+		t.Errorf("idle entry should have been released, %d loaded", n)
+	}
+}
@@ -0,0 +1,204 @@
+// Mochi server: Supervisor for background managers
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	rd "runtime/debug"
+	"sync"
+	"time"
+)
+
+// Startup goes through stages - "db", "apps", "cluster" and "p2p" - each
+// marked ready by supervisor_ready once it has finished. A manager started
+// with supervise declares the stages it needs, and waits for them before it
+// runs. A manager that panics is logged and started again, after a delay
+// that doubles from supervisor_backoff_minimum to supervisor_backoff_maximum
+// and resets once it has run for supervisor_backoff_reset; a manager that
+// returns has finished, as one-off jobs do. Each manager's state is served
+// in /_/health.
+//
+// Shutdown runs the hooks given to supervisor_on_stop for each stage that
+// became ready, the latest stage first, so the network is closed before
+// the cluster lease is given up and the databases are last. No manager is
+// started or restarted once shutdown has begun.
+
+const (
+	supervisor_backoff_minimum = time.Second
+	supervisor_backoff_maximum = 5 * time.Minute
+	supervisor_backoff_reset   = 10 * time.Minute
+)
+
+// supervised is one manager
+type supervised struct {
+	name     string
+	run      func()
+	after    []string
+	state    string // "waiting", "running", "restarting", "finished" or "stopped"
+	started  int64
+	restarts int
+	problem  string
+}
+
+var (
+	supervisor_lock     sync.Mutex
+	supervisor_changed  = sync.NewCond(&supervisor_lock)
+	supervisor_managers = map[string]*supervised{}
+	supervisor_stages   []string
+	supervisor_stops    = map[string][]func(){}
+	supervisor_stopping bool
+)
+
+// supervise starts a manager once the stages it comes after are ready, and
+// keeps it running. A manager already supervised is left alone.
+func supervise(name string, run func(), after ...string) {
+	supervisor_lock.Lock()
+	if m := supervisor_managers[name]; m != nil && m.state != "finished" && m.state != "stopped" {
+		supervisor_lock.Unlock()
+		return
+	}
+	m := &supervised{name: name, run: run, after: after, state: "waiting"}
+	supervisor_managers[name] = m
+	supervisor_lock.Unlock()
+	go m.supervise()
+}
+
+// supervisor_ready marks a startup stage as finished, letting managers that
+// wait for it start
+func supervisor_ready(stage string) {
+	supervisor_lock.Lock()
+	defer supervisor_lock.Unlock()
+	if supervisor_stage_ready(stage) {
+		return
+	}
+	supervisor_stages = append(supervisor_stages, stage)
+	supervisor_changed.Broadcast()
+}
+
+// supervisor_stage_ready returns whether a stage is ready. Must be called
+// with supervisor_lock held.
+func supervisor_stage_ready(stage string) bool {
+	for _, s := range supervisor_stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// supervisor_on_stop adds a hook to run at shutdown, if the stage became
+// ready. Hooks for a stage run in the order they were added.
+func supervisor_on_stop(stage string, stop func()) {
+	supervisor_lock.Lock()
+	defer supervisor_lock.Unlock()
+	supervisor_stops[stage] = append(supervisor_stops[stage], stop)
+}
+
+// supervisor_shutdown stops starting managers, and runs the stop hooks of
+// the ready stages, latest first
+func supervisor_shutdown() {
+	supervisor_lock.Lock()
+	supervisor_stopping = true
+	stages := append([]string(nil), supervisor_stages...)
+	for _, m := range supervisor_managers {
+		if m.state == "waiting" || m.state == "restarting" {
+			m.state = "stopped"
+		}
+	}
+	supervisor_changed.Broadcast()
+	supervisor_lock.Unlock()
+
+	for i := len(stages) - 1; i >= 0; i-- {
+		supervisor_lock.Lock()
+		stops := supervisor_stops[stages[i]]
+		supervisor_lock.Unlock()
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// supervise runs the manager, restarting it if it panics
+func (m *supervised) supervise() {
+	supervisor_lock.Lock()
+	for !supervisor_stopping && !m.ready() {
+		supervisor_changed.Wait()
+	}
+	supervisor_lock.Unlock()
+
+	backoff := supervisor_backoff_minimum
+	for {
+		supervisor_lock.Lock()
+		if supervisor_stopping {
+			m.state = "stopped"
+			supervisor_lock.Unlock()
+			return
+		}
+		m.state = "running"
+		m.started = now()
+		supervisor_lock.Unlock()
+
+		started := time.Now()
+		problem := m.call()
+
+		supervisor_lock.Lock()
+		if problem == "" {
+			m.state = "finished"
+			supervisor_lock.Unlock()
+			return
+		}
+		m.state = "restarting"
+		m.problem = problem
+		m.restarts++
+		supervisor_lock.Unlock()
+
+		if time.Since(started) >= supervisor_backoff_reset {
+			backoff = supervisor_backoff_minimum
+		}
+		warn("Manager %q stopped: %s; restarting in %v", m.name, problem, backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, supervisor_backoff_maximum)
+	}
+}
+
+// ready returns whether the stages the manager comes after are ready. Must
+// be called with supervisor_lock held.
+func (m *supervised) ready() bool {
+	for _, stage := range m.after {
+		if !supervisor_stage_ready(stage) {
+			return false
+		}
+	}
+	return true
+}
+
+// call runs the manager once, returning what it panicked with, or ""
+func (m *supervised) call() (problem string) {
+	defer func() {
+		if r := recover(); r != nil {
+			problem = fmt.Sprintf("panic: %v", r)
+			debug("Manager %q panic stack:\n%s", m.name, rd.Stack())
+		}
+	}()
+	m.run()
+	return ""
+}
+
+// supervisor_status returns each manager's state, for /_/health
+func supervisor_status() map[string]any {
+	supervisor_lock.Lock()
+	defer supervisor_lock.Unlock()
+	out := make(map[string]any, len(supervisor_managers))
+	for name, m := range supervisor_managers {
+		status := map[string]any{"state": m.state, "started": m.started, "restarts": m.restarts}
+		if m.problem != "" {
+			status["problem"] = m.problem
+		}
+		out[name] = status
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+// Mochi server: Supervisor tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// supervisor_test_reset gives the test a supervisor of its own
+func supervisor_test_reset(t *testing.T) {
+	supervisor_lock.Lock()
+	supervisor_managers = map[string]*supervised{}
+	supervisor_stages = nil
+	supervisor_stops = map[string][]func(){}
+	supervisor_stopping = false
+	supervisor_lock.Unlock()
+	t.Cleanup(func() {
+		supervisor_lock.Lock()
+		supervisor_stopping = true
+		supervisor_changed.Broadcast()
+		supervisor_lock.Unlock()
+	})
+}
+
+// supervisor_test_state waits for a manager to reach a state
+func supervisor_test_state(t *testing.T, name string, state string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, ok := supervisor_status()[name].(map[string]any); ok && status["state"] == state {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("manager %q not %s: %v", name, state, supervisor_status()[name])
+	return nil
+}
+
+func TestSupervisorStages(t *testing.T) {
+	supervisor_test_reset(t)
+
+	ran := make(chan struct{})
+	supervise("test", func() { close(ran) }, "db", "apps")
+	supervisor_ready("db")
+	select {
+	case <-ran:
+		t.Fatal("started before its stages were ready")
+	case <-time.After(50 * time.Millisecond):
+	}
+	supervisor_test_state(t, "test", "waiting")
+
+	supervisor_ready("apps")
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("not started once its stages were ready")
+	}
+	supervisor_test_state(t, "test", "finished")
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	supervisor_test_reset(t)
+
+	var lock sync.Mutex
+	runs := 0
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	supervise("test", func() {
+		lock.Lock()
+		runs++
+		first := runs == 1
+		lock.Unlock()
+		if first {
+			panic("broken")
+		}
+		<-block
+	})
+
+	status := supervisor_test_state(t, "test", "running")
+	for status["restarts"] != 1 {
+		status = supervisor_test_state(t, "test", "running")
+	}
+	if status["problem"] != "panic: broken" {
+		t.Errorf("problem %v", status["problem"])
+	}
+
+	// A running manager isn't started twice
+	supervise("test", func() { t.Error("started twice") })
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestSupervisorShutdown(t *testing.T) {
+	supervisor_test_reset(t)
+
+	var order []string
+	for _, stage := range []string{"db", "cluster", "p2p"} {
+		supervisor_on_stop(stage, func() { order = append(order, stage) })
+	}
+	supervisor_ready("db")
+	supervisor_ready("cluster")
+	supervise("test", func() { t.Error("started after shutdown") }, "p2p")
+
+	supervisor_shutdown()
+	if want := []string{"cluster", "db"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("stopped %v, want %v", order, want)
+	}
+	supervisor_test_state(t, "test", "stopped")
+}
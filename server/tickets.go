@@ -0,0 +1,1292 @@
+// Mochi server: Tickets
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// Tickets are a core service so that a forge, or any app that tracks work
+// against an entity, gets issues and merge proposals that federate without
+// inventing its own protocol. A ticket belongs to an owner entity, such as
+// a repository, and is numbered in order per owner and app. It has a kind,
+// "issue" or "proposal", a title and body, labels, assignees, a milestone,
+// references to other tickets, and a timeline of what happened to it. Its
+// discussion is the comments service's, on the object ticket.object().
+//
+// A ticket is open, closed, or for a proposal merged. Its author may close
+// and reopen it; the owner entity, and for a group entity its moderators,
+// the triagers, may also merge, label, assign and plan it, and define the
+// owner's labels and milestones.
+//
+// As with comments, the owner's server is the authority. Tickets opened and
+// changes made by other servers' entities are sent to the owner as events
+// on the tickets service, applied there if allowed, and the resulting
+// ticket is sent as a "record" event to every remote entity taking part -
+// its author, assignees, those in its timeline, and those commenting - whose
+// servers keep a copy. Comments on a ticket are also sent to its
+// participants.
+//
+// A user sees the tickets their entities take part in. They see all of an
+// owner's tickets if one of their entities is the owner or a member of it,
+// or if the app's access rules on the owner's server grant it "read" on
+// "tickets/<owner>".
+//
+// Tickets live in db/tickets.db, shared by every app and keyed by app.
+
+const (
+	ticket_title_limit       = 256
+	ticket_body_limit        = 65536
+	ticket_label_limit       = 64
+	ticket_description_limit = 1000
+	ticket_timeline_limit    = 500
+)
+
+var ticket_kinds = map[string]bool{
+	"issue":    true,
+	"proposal": true,
+}
+
+// ticket_transitions lists the states each state may move to
+var ticket_transitions = map[string]map[string]bool{
+	"open":   {"closed": true, "merged": true},
+	"closed": {"open": true},
+	"merged": {},
+}
+
+var ticket_reasons = map[string]bool{
+	"":          true,
+	"completed": true,
+	"declined":  true,
+	"duplicate": true,
+}
+
+var ticket_mention_match = regexp.MustCompile(`(?:^|[^\w&/])#([0-9]{1,9})\b`)
+var ticket_colour_match = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// ticket_number_lock serialises numbering of new tickets
+var ticket_number_lock sync.Mutex
+
+type Ticket struct {
+	ID        string `db:"id"`
+	App       string `db:"app"`
+	Owner     string `db:"owner"`
+	Number    int64  `db:"number"`
+	Kind      string `db:"kind"`
+	Title     string `db:"title"`
+	Body      string `db:"body"`
+	Author    string `db:"author"`
+	State     string `db:"state"`
+	Reason    string `db:"reason"`
+	Milestone string `db:"milestone"`
+	Created   int64  `db:"created"`
+	Updated   int64  `db:"updated"`
+}
+
+var api_ticket = sls.FromStringDict(sl.String("mochi.ticket"), sl.StringDict{
+	"assignee": sls.FromStringDict(sl.String("mochi.ticket.assignee"), sl.StringDict{
+		"add":    sl.NewBuiltin("mochi.ticket.assignee.add", api_ticket_assignee_add),
+		"remove": sl.NewBuiltin("mochi.ticket.assignee.remove", api_ticket_assignee_remove),
+	}),
+	"create": sl.NewBuiltin("mochi.ticket.create", api_ticket_create),
+	"edit":   sl.NewBuiltin("mochi.ticket.edit", api_ticket_edit),
+	"get":    sl.NewBuiltin("mochi.ticket.get", api_ticket_get),
+	"label": sls.FromStringDict(sl.String("mochi.ticket.label"), sl.StringDict{
+		"add":    sl.NewBuiltin("mochi.ticket.label.add", api_ticket_label_add),
+		"define": sl.NewBuiltin("mochi.ticket.label.define", api_ticket_label_define),
+		"delete": sl.NewBuiltin("mochi.ticket.label.delete", api_ticket_label_delete),
+		"list":   sl.NewBuiltin("mochi.ticket.label.list", api_ticket_label_list),
+		"remove": sl.NewBuiltin("mochi.ticket.label.remove", api_ticket_label_remove),
+	}),
+	"list": sl.NewBuiltin("mochi.ticket.list", api_ticket_list),
+	"milestone": sls.FromStringDict(sl.String("mochi.ticket.milestone"), sl.StringDict{
+		"create": sl.NewBuiltin("mochi.ticket.milestone.create", api_ticket_milestone_create),
+		"edit":   sl.NewBuiltin("mochi.ticket.milestone.edit", api_ticket_milestone_edit),
+		"list":   sl.NewBuiltin("mochi.ticket.milestone.list", api_ticket_milestone_list),
+		"set":    sl.NewBuiltin("mochi.ticket.milestone.set", api_ticket_milestone_set),
+	}),
+	"reference": sl.NewBuiltin("mochi.ticket.reference", api_ticket_reference),
+	"state":     sl.NewBuiltin("mochi.ticket.state", api_ticket_state),
+})
+
+func init() {
+	a := app("tickets")
+	a.service("tickets")
+	a.event("record", ticket_record_event)
+	a.event("open", ticket_open_event)
+	a.event("edit", ticket_edit_event)
+	a.event("state", ticket_state_event)
+	a.event("label", ticket_label_event)
+	a.event("assign", ticket_assign_event)
+	a.event("milestone", ticket_milestone_event)
+	a.event("reference", ticket_reference_event)
+	a.event("referenced", ticket_referenced_event)
+
+	comment_watchers = append(comment_watchers, ticket_comment_watchers)
+}
+
+// tickets_db opens the server-wide tickets, creating their tables if needed
+func tickets_db() *DB {
+	db := db_open("db/tickets.db")
+	db.exec("create table if not exists tickets (id text not null primary key, app text not null, owner text not null, number integer not null, kind text not null, title text not null, body text not null default '', author text not null, state text not null, reason text not null default '', milestone text not null default '', created integer not null, updated integer not null)")
+	db.exec("create unique index if not exists tickets_owner_app_number on tickets(owner, app, number)")
+	db.exec("create table if not exists labels (owner text not null, app text not null, name text not null, colour text not null default '', description text not null default '', created integer not null, primary key (owner, app, name))")
+	db.exec("create table if not exists milestones (id text not null primary key, owner text not null, app text not null, title text not null, description text not null default '', due integer not null default 0, state text not null, created integer not null, updated integer not null)")
+	db.exec("create index if not exists milestones_owner_app on milestones(owner, app)")
+	db.exec("create table if not exists ticket_labels (ticket text not null, label text not null, primary key (ticket, label))")
+	db.exec("create table if not exists assignees (ticket text not null, assignee text not null, primary key (ticket, assignee))")
+	db.exec("create table if not exists refs (source text not null, target text not null, owner text not null, created integer not null, primary key (source, target))")
+	db.exec("create table if not exists timeline (id text not null primary key, ticket text not null, actor text not null, action text not null, detail text not null default '', created integer not null)")
+	db.exec("create index if not exists timeline_ticket_created on timeline(ticket, created)")
+	return db
+}
+
+// ticket_label_valid checks a label name is short and printable
+func ticket_label_valid(name string) bool {
+	if name == "" || len(name) > ticket_label_limit || strings.TrimSpace(name) != name {
+		return false
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// ticket_get returns a ticket, or nil
+func ticket_get(id string) *Ticket {
+	var t Ticket
+	if !tickets_db().scan(&t, "select * from tickets where id=?", id) {
+		return nil
+	}
+	return &t
+}
+
+// ticket_by_number returns an owner's ticket in an app by number, or nil
+func ticket_by_number(owner, app string, number int64) *Ticket {
+	var t Ticket
+	if !tickets_db().scan(&t, "select * from tickets where owner=? and app=? and number=?", owner, app, number) {
+		return nil
+	}
+	return &t
+}
+
+// ticket_triager reports whether an entity may triage an owner's tickets:
+// the owner itself, or a moderator of a group entity
+func ticket_triager(owner, actor string) bool {
+	return group_member_rank(owner, actor) >= group_roles["moderator"]
+}
+
+// object returns the comments service object for a ticket's discussion
+func (t *Ticket) object() string {
+	return "ticket/" + t.ID
+}
+
+// labels returns a ticket's labels as [name, colour] pairs
+func (t *Ticket) labels() [][]string {
+	rows, _ := tickets_db().rows("select tl.label, coalesce(l.colour, '') as colour from ticket_labels tl left join labels l on l.owner=? and l.app=? and l.name=tl.label where tl.ticket=? order by tl.label", t.Owner, t.App, t.ID)
+	pairs := make([][]string, 0, len(rows))
+	for _, r := range rows {
+		name, _ := r["label"].(string)
+		colour, _ := r["colour"].(string)
+		pairs = append(pairs, []string{name, colour})
+	}
+	return pairs
+}
+
+// assignees returns the entities a ticket is assigned to
+func (t *Ticket) assignees() []string {
+	rows, _ := tickets_db().rows("select assignee from assignees where ticket=? order by assignee", t.ID)
+	list := make([]string, 0, len(rows))
+	for _, r := range rows {
+		if a, _ := r["assignee"].(string); a != "" {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// references returns the tickets a ticket refers to as [id, owner] pairs
+func (t *Ticket) references() [][]string {
+	rows, _ := tickets_db().rows("select target, owner from refs where source=? order by created", t.ID)
+	pairs := make([][]string, 0, len(rows))
+	for _, r := range rows {
+		target, _ := r["target"].(string)
+		owner, _ := r["owner"].(string)
+		pairs = append(pairs, []string{target, owner})
+	}
+	return pairs
+}
+
+// timeline returns a ticket's most recent events, oldest first, as
+// [id, actor, action, detail, created] lists with detail as JSON
+func (t *Ticket) timeline() []any {
+	rows, _ := tickets_db().rows("select * from (select * from timeline where ticket=? order by created desc, id desc limit ?) order by created, id", t.ID, ticket_timeline_limit)
+	list := make([]any, 0, len(rows))
+	for _, r := range rows {
+		list = append(list, []any{r["id"], r["actor"], r["action"], r["detail"], event_int64(r["created"])})
+	}
+	return list
+}
+
+// milestone_record returns a ticket's milestone as [id, title, state, due],
+// or nil
+func (t *Ticket) milestone_record() []any {
+	if t.Milestone == "" {
+		return nil
+	}
+	r, _ := tickets_db().row("select * from milestones where id=?", t.Milestone)
+	if r == nil {
+		return nil
+	}
+	return []any{r["id"], r["title"], r["state"], event_int64(r["due"])}
+}
+
+// record returns a ticket as sent to other servers
+func (t *Ticket) record() map[string]any {
+	return map[string]any{
+		"id":         t.ID,
+		"app":        t.App,
+		"owner":      t.Owner,
+		"number":     t.Number,
+		"kind":       t.Kind,
+		"title":      t.Title,
+		"body":       t.Body,
+		"author":     t.Author,
+		"state":      t.State,
+		"reason":     t.Reason,
+		"milestone":  t.milestone_record(),
+		"created":    t.Created,
+		"updated":    t.Updated,
+		"labels":     t.labels(),
+		"assignees":  t.assignees(),
+		"references": t.references(),
+		"timeline":   t.timeline(),
+	}
+}
+
+// view returns a ticket as seen by an app
+func (t *Ticket) view() map[string]any {
+	labels := []any{}
+	for _, p := range t.labels() {
+		labels = append(labels, map[string]any{"name": p[0], "colour": p[1]})
+	}
+	references := []any{}
+	for _, p := range t.references() {
+		ref := map[string]any{"id": p[0], "owner": p[1]}
+		if target := ticket_get(p[0]); target != nil {
+			ref["number"] = target.Number
+			ref["title"] = target.Title
+			ref["state"] = target.State
+		}
+		references = append(references, ref)
+	}
+	var milestone any
+	if m := t.milestone_record(); m != nil {
+		milestone = map[string]any{"id": m[0], "title": m[1], "state": m[2], "due": m[3]}
+	}
+	timeline := []any{}
+	for _, e := range t.timeline() {
+		row := e.([]any)
+		detail := map[string]any{}
+		if s, _ := row[3].(string); s != "" {
+			json.Unmarshal([]byte(s), &detail)
+		}
+		timeline = append(timeline, map[string]any{"id": row[0], "actor": row[1], "action": row[2], "detail": detail, "created": row[4]})
+	}
+	return map[string]any{
+		"id":         t.ID,
+		"owner":      t.Owner,
+		"number":     t.Number,
+		"kind":       t.Kind,
+		"title":      t.Title,
+		"body":       t.Body,
+		"author":     t.Author,
+		"state":      t.State,
+		"reason":     t.Reason,
+		"milestone":  milestone,
+		"labels":     labels,
+		"assignees":  t.assignees(),
+		"references": references,
+		"timeline":   timeline,
+		"object":     t.object(),
+		"created":    t.Created,
+		"updated":    t.Updated,
+	}
+}
+
+// ticket_store keeps a ticket unless a newer copy is already held
+func ticket_store(t *Ticket) bool {
+	result, err := tickets_db().internal.Exec("insert into tickets (id, app, owner, number, kind, title, body, author, state, reason, milestone, created, updated) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict (id) do update set title=excluded.title, body=excluded.body, state=excluded.state, reason=excluded.reason, milestone=excluded.milestone, updated=excluded.updated where excluded.updated > tickets.updated and excluded.owner = tickets.owner", t.ID, t.App, t.Owner, t.Number, t.Kind, t.Title, t.Body, t.Author, t.State, t.Reason, t.Milestone, t.Created, t.Updated)
+	if err != nil {
+		warn("Ticket store failed for %q: %v", t.ID, err)
+		return false
+	}
+	changed, _ := result.RowsAffected()
+	return changed > 0
+}
+
+// touch advances a ticket's update time past its last change
+func (t *Ticket) touch() {
+	n := now()
+	if n <= t.Updated {
+		n = t.Updated + 1
+	}
+	t.Updated = n
+}
+
+// ticket_event adds an event to a ticket's timeline
+func ticket_event(t *Ticket, actor, action string, detail map[string]any) {
+	data := ""
+	if len(detail) > 0 {
+		if b, err := json.Marshal(detail); err == nil {
+			data = string(b)
+		}
+	}
+	tickets_db().exec("insert into timeline (id, ticket, actor, action, detail, created) values (?, ?, ?, ?, ?, ?)", uid(), t.ID, actor, action, data, now())
+}
+
+// ticket_participants returns the entities taking part in a ticket
+func ticket_participants(t *Ticket) []string {
+	seen := map[string]bool{}
+	var list []string
+	add := func(e string) {
+		if e != "" && !seen[e] {
+			seen[e] = true
+			list = append(list, e)
+		}
+	}
+	add(t.Author)
+	for _, a := range t.assignees() {
+		add(a)
+	}
+	rows, _ := tickets_db().rows("select distinct actor from timeline where ticket=?", t.ID)
+	for _, r := range rows {
+		actor, _ := r["actor"].(string)
+		add(actor)
+	}
+	rows, _ = comments_db().rows("select distinct author from comments where owner=? and app=? and object=?", t.Owner, t.App, t.object())
+	for _, r := range rows {
+		author, _ := r["author"].(string)
+		add(author)
+	}
+	return list
+}
+
+// ticket_reader reports whether any of a user's entities may see all of an
+// owner's tickets through an app
+func ticket_reader(app *App, owner string, viewers map[string]bool) bool {
+	for v := range viewers {
+		if group_member_rank(owner, v) > 0 {
+			return true
+		}
+	}
+	u := user_owning_entity(owner)
+	db := db_app_system(u, app)
+	if db == nil {
+		return false
+	}
+	for v := range viewers {
+		if db.access_check(u, v, "", "tickets/"+owner, "read") {
+			return true
+		}
+	}
+	return false
+}
+
+// ticket_taking_part reports whether any of a user's entities takes part
+// in a ticket
+func ticket_taking_part(t *Ticket, viewers map[string]bool) bool {
+	for _, p := range ticket_participants(t) {
+		if viewers[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// ticket_publish sends a changed ticket on the owner's server to every
+// remote entity taking part, and to the owner's browsers
+func ticket_publish(t *Ticket) {
+	record := t.record()
+	if u := user_owning_entity(t.Owner); u != nil {
+		websockets_send(u, "tickets", record)
+	}
+	for _, p := range ticket_participants(t) {
+		if p == t.Owner || comment_local(p) {
+			continue
+		}
+		m := message(t.Owner, p, "tickets", "record")
+		m.content = record
+		m.send()
+	}
+}
+
+// ticket_comment_watchers returns the participants of the ticket a comment
+// is on, so they receive its discussion even if they haven't commented
+func ticket_comment_watchers(c *Comment) []string {
+	id, found := strings.CutPrefix(c.Object, "ticket/")
+	if !found {
+		return nil
+	}
+	t := ticket_get(id)
+	if t == nil || t.Owner != c.Owner || t.App != c.App {
+		return nil
+	}
+	return ticket_participants(t)
+}
+
+// ticket_open adds a ticket on the owner's server, numbering it, and
+// returns it. Labels are applied if the author may triage.
+func ticket_open(id, app, owner, kind, title, body, author string, labels []string) (*Ticket, error) {
+	if !ticket_kinds[kind] {
+		return nil, fmt.Errorf("invalid kind %q", kind)
+	}
+	if title == "" || len(title) > ticket_title_limit {
+		return nil, fmt.Errorf("invalid title")
+	}
+	if len(body) > ticket_body_limit {
+		return nil, fmt.Errorf("invalid body")
+	}
+	if ticket_get(id) != nil {
+		return nil, fmt.Errorf("ticket already exists")
+	}
+
+	ticket_number_lock.Lock()
+	db := tickets_db()
+	number := db.integer64("select coalesce(max(number), 0) + 1 from tickets where owner=? and app=?", owner, app)
+	n := now()
+	t := &Ticket{ID: id, App: app, Owner: owner, Number: number, Kind: kind, Title: title, Body: body, Author: author, State: "open", Created: n, Updated: n}
+	stored := ticket_store(t)
+	ticket_number_lock.Unlock()
+	if !stored {
+		return nil, fmt.Errorf("ticket not stored")
+	}
+
+	ticket_event(t, author, "opened", nil)
+	if ticket_triager(owner, author) {
+		for _, l := range labels {
+			if exists, _ := db.exists("select 1 from labels where owner=? and app=? and name=?", owner, app, l); exists {
+				db.exec("insert or ignore into ticket_labels (ticket, label) values (?, ?)", t.ID, l)
+			}
+		}
+	}
+	ticket_mentions(t, author, title+"\n"+body)
+	ticket_publish(t)
+	return t, nil
+}
+
+// ticket_mentions references the tickets of the same owner that text
+// mentions as #number
+func ticket_mentions(t *Ticket, actor, text string) {
+	for _, m := range ticket_mention_match.FindAllStringSubmatch(text, -1) {
+		target := ticket_by_number(t.Owner, t.App, atoi(m[1], 0))
+		if target != nil && target.ID != t.ID {
+			ticket_reference(t, target.ID, target.Owner, actor)
+		}
+	}
+}
+
+// ticket_reference records that a ticket refers to another, and tells the
+// other's owner so it appears in the other's timeline. Returns whether the
+// reference is new.
+func ticket_reference(t *Ticket, target, owner, actor string) bool {
+	db := tickets_db()
+	if exists, _ := db.exists("select 1 from refs where source=? and target=?", t.ID, target); exists {
+		return false
+	}
+	db.exec("insert into refs (source, target, owner, created) values (?, ?, ?, ?)", t.ID, target, owner, now())
+
+	if comment_local(owner) {
+		ticket_referenced(target, owner, actor, t)
+		return true
+	}
+	m := message(t.Owner, owner, "tickets", "referenced")
+	m.set("id", target, "source", t.ID, "actor", actor, "number", i64toa(t.Number), "title", t.Title)
+	m.FromApp = t.App
+	m.send()
+	return true
+}
+
+// ticket_referenced adds to a ticket's timeline that another refers to it
+func ticket_referenced(id, owner, actor string, source *Ticket) {
+	target := ticket_get(id)
+	if target == nil || target.Owner != owner {
+		return
+	}
+	ticket_event(target, actor, "referenced", map[string]any{"source": source.ID, "owner": source.Owner, "number": source.Number, "title": source.Title})
+	target.touch()
+	ticket_store(target)
+	ticket_publish(target)
+}
+
+// ticket_apply makes a change to a ticket on the owner's server on an
+// entity's authority, returning the changed ticket or an error
+func ticket_apply(t *Ticket, actor, event string, content map[string]any) (*Ticket, error) {
+	db := tickets_db()
+	triager := ticket_triager(t.Owner, actor)
+	str := func(key string) string {
+		s, _ := content[key].(string)
+		return s
+	}
+	remove, _ := content["remove"].(bool)
+	if s := str("remove"); s == "true" {
+		remove = true
+	}
+
+	switch event {
+	case "edit":
+		if actor != t.Author && !triager {
+			return nil, fmt.Errorf("not allowed")
+		}
+		title := strings.TrimSpace(str("title"))
+		body := str("body")
+		if _, found := content["title"]; found {
+			if title == "" || len(title) > ticket_title_limit {
+				return nil, fmt.Errorf("invalid title")
+			}
+			if title != t.Title {
+				ticket_event(t, actor, "renamed", map[string]any{"from": t.Title, "to": title})
+				t.Title = title
+			}
+		}
+		if _, found := content["body"]; found {
+			if len(body) > ticket_body_limit {
+				return nil, fmt.Errorf("invalid body")
+			}
+			t.Body = body
+		}
+		ticket_mentions(t, actor, t.Title+"\n"+t.Body)
+
+	case "state":
+		state := str("state")
+		reason := str("reason")
+		if !ticket_transitions[t.State][state] {
+			return nil, fmt.Errorf("cannot move from %s to %s", t.State, state)
+		}
+		if state == "merged" && t.Kind != "proposal" {
+			return nil, fmt.Errorf("only proposals can be merged")
+		}
+		if !triager && (actor != t.Author || state == "merged") {
+			return nil, fmt.Errorf("not allowed")
+		}
+		if state != "closed" {
+			reason = ""
+		}
+		if !ticket_reasons[reason] {
+			return nil, fmt.Errorf("invalid reason %q", reason)
+		}
+		t.State = state
+		t.Reason = reason
+		action := map[string]string{"open": "reopened", "closed": "closed", "merged": "merged"}[state]
+		detail := map[string]any{}
+		if reason != "" {
+			detail["reason"] = reason
+		}
+		ticket_event(t, actor, action, detail)
+
+	case "label":
+		name := str("label")
+		if !triager {
+			return nil, fmt.Errorf("not allowed")
+		}
+		if remove {
+			db.exec("delete from ticket_labels where ticket=? and label=?", t.ID, name)
+			ticket_event(t, actor, "unlabelled", map[string]any{"label": name})
+			break
+		}
+		if exists, _ := db.exists("select 1 from labels where owner=? and app=? and name=?", t.Owner, t.App, name); !exists {
+			return nil, fmt.Errorf("label not found")
+		}
+		db.exec("insert or ignore into ticket_labels (ticket, label) values (?, ?)", t.ID, name)
+		ticket_event(t, actor, "labelled", map[string]any{"label": name})
+
+	case "assign":
+		assignee := str("assignee")
+		if !triager {
+			return nil, fmt.Errorf("not allowed")
+		}
+		if !valid(assignee, "entity") {
+			return nil, fmt.Errorf("invalid assignee")
+		}
+		if remove {
+			db.exec("delete from assignees where ticket=? and assignee=?", t.ID, assignee)
+			ticket_event(t, actor, "unassigned", map[string]any{"assignee": assignee})
+		} else {
+			db.exec("insert or ignore into assignees (ticket, assignee) values (?, ?)", t.ID, assignee)
+			ticket_event(t, actor, "assigned", map[string]any{"assignee": assignee})
+		}
+
+	case "milestone":
+		milestone := str("milestone")
+		if !triager {
+			return nil, fmt.Errorf("not allowed")
+		}
+		if milestone != "" {
+			if exists, _ := db.exists("select 1 from milestones where id=? and owner=? and app=?", milestone, t.Owner, t.App); !exists {
+				return nil, fmt.Errorf("milestone not found")
+			}
+		}
+		t.Milestone = milestone
+		ticket_event(t, actor, "planned", map[string]any{"milestone": milestone})
+
+	case "reference":
+		target := str("target")
+		owner := str("target_owner")
+		if actor != t.Author && !triager {
+			return nil, fmt.Errorf("not allowed")
+		}
+		if !valid(target, "id") || target == t.ID || !valid(owner, "entity") {
+			return nil, fmt.Errorf("invalid target")
+		}
+		ticket_reference(t, target, owner, actor)
+
+	default:
+		return nil, fmt.Errorf("unknown change %q", event)
+	}
+
+	t.touch()
+	ticket_store(t)
+	ticket_publish(t)
+	return t, nil
+}
+
+// ticket_record_event receives a ticket from the server that owns it
+func ticket_record_event(e *Event) {
+	t := &Ticket{
+		ID:      e.get("id", ""),
+		App:     e.get("app", ""),
+		Owner:   e.get("owner", ""),
+		Number:  event_int64(e.content["number"]),
+		Kind:    e.get("kind", ""),
+		Title:   e.get("title", ""),
+		Body:    e.get("body", ""),
+		Author:  e.get("author", ""),
+		State:   e.get("state", ""),
+		Reason:  e.get("reason", ""),
+		Created: event_int64(e.content["created"]),
+		Updated: event_int64(e.content["updated"]),
+	}
+	if t.Owner != e.from || comment_local(t.Owner) || !valid(t.ID, "id") || !valid(t.App, "constant") || t.Number <= 0 || !ticket_kinds[t.Kind] || ticket_transitions[t.State] == nil || !valid(t.Author, "entity") {
+		info("Tickets dropping invalid record from %q", e.from)
+		return
+	}
+
+	m, _ := e.content["milestone"].([]any)
+	if len(m) == 4 {
+		if id, _ := m[0].(string); valid(id, "id") {
+			t.Milestone = id
+		}
+	}
+	if !ticket_store(t) {
+		return
+	}
+
+	db := tickets_db()
+	if t.Milestone != "" {
+		title, _ := m[1].(string)
+		state, _ := m[2].(string)
+		db.exec("insert into milestones (id, owner, app, title, state, due, created, updated) values (?, ?, ?, ?, ?, ?, ?, ?) on conflict (id) do update set title=excluded.title, state=excluded.state, due=excluded.due, updated=excluded.updated where milestones.owner=excluded.owner", t.Milestone, t.Owner, t.App, title, state, event_int64(m[3]), t.Updated, t.Updated)
+	}
+
+	db.exec("delete from ticket_labels where ticket=?", t.ID)
+	labels, _ := e.content["labels"].([]any)
+	for _, l := range labels {
+		pair, _ := l.([]any)
+		if len(pair) != 2 {
+			continue
+		}
+		name, _ := pair[0].(string)
+		colour, _ := pair[1].(string)
+		if !ticket_label_valid(name) {
+			continue
+		}
+		db.exec("insert or ignore into ticket_labels (ticket, label) values (?, ?)", t.ID, name)
+		db.exec("insert into labels (owner, app, name, colour, created) values (?, ?, ?, ?, ?) on conflict (owner, app, name) do update set colour=excluded.colour", t.Owner, t.App, name, colour, t.Updated)
+	}
+
+	db.exec("delete from assignees where ticket=?", t.ID)
+	assignees, _ := e.content["assignees"].([]any)
+	for _, a := range assignees {
+		if s, _ := a.(string); valid(s, "entity") {
+			db.exec("insert or ignore into assignees (ticket, assignee) values (?, ?)", t.ID, s)
+		}
+	}
+
+	db.exec("delete from refs where source=?", t.ID)
+	refs, _ := e.content["references"].([]any)
+	for _, r := range refs {
+		pair, _ := r.([]any)
+		if len(pair) != 2 {
+			continue
+		}
+		target, _ := pair[0].(string)
+		owner, _ := pair[1].(string)
+		if valid(target, "id") && valid(owner, "entity") {
+			db.exec("insert or ignore into refs (source, target, owner, created) values (?, ?, ?, ?)", t.ID, target, owner, t.Updated)
+		}
+	}
+
+	db.exec("delete from timeline where ticket=?", t.ID)
+	timeline, _ := e.content["timeline"].([]any)
+	for _, v := range timeline {
+		row, _ := v.([]any)
+		if len(row) != 5 {
+			continue
+		}
+		id, _ := row[0].(string)
+		actor, _ := row[1].(string)
+		action, _ := row[2].(string)
+		detail, _ := row[3].(string)
+		if valid(id, "id") && valid(action, "constant") {
+			db.exec("insert or ignore into timeline (id, ticket, actor, action, detail, created) values (?, ?, ?, ?, ?, ?)", id, t.ID, actor, action, detail, event_int64(row[4]))
+		}
+	}
+
+	if e.user != nil {
+		websockets_send(e.user, "tickets", t.record())
+	}
+}
+
+// ticket_open_event receives a new ticket for an owner this server holds
+func ticket_open_event(e *Event) {
+	id := e.get("id", "")
+	app := e.get("app", "")
+	if e.from == "" || !valid(id, "id") || !valid(app, "constant") {
+		return
+	}
+	if !rate_limit_ticket.allow(e.from) {
+		debug("Tickets refused ticket from %q: rate limited", e.from)
+		return
+	}
+	var labels []string
+	if list, ok := e.content["labels"].([]any); ok {
+		for _, l := range list {
+			if s, _ := l.(string); ticket_label_valid(s) {
+				labels = append(labels, s)
+			}
+		}
+	}
+	if _, err := ticket_open(id, app, e.to, e.get("kind", "issue"), strings.TrimSpace(e.get("title", "")), e.get("body", ""), e.from, labels); err != nil {
+		debug("Tickets refused ticket from %q: %v", e.from, err)
+	}
+}
+
+// ticket_change_event receives a change to a ticket this server owns
+func ticket_change_event(e *Event, event string) {
+	t := ticket_get(e.get("id", ""))
+	if e.from == "" || t == nil || t.Owner != e.to {
+		return
+	}
+	if _, err := ticket_apply(t, e.from, event, e.content); err != nil {
+		debug("Tickets refused %s of %q by %q: %v", event, t.ID, e.from, err)
+	}
+}
+
+func ticket_edit_event(e *Event)      { ticket_change_event(e, "edit") }
+func ticket_state_event(e *Event)     { ticket_change_event(e, "state") }
+func ticket_label_event(e *Event)     { ticket_change_event(e, "label") }
+func ticket_assign_event(e *Event)    { ticket_change_event(e, "assign") }
+func ticket_milestone_event(e *Event) { ticket_change_event(e, "milestone") }
+func ticket_reference_event(e *Event) { ticket_change_event(e, "reference") }
+
+// ticket_referenced_event receives word from another owner that one of its
+// tickets refers to one of this server's
+func ticket_referenced_event(e *Event) {
+	source := &Ticket{ID: e.get("source", ""), Owner: e.from, Number: atoi(e.get("number", ""), 0), Title: e.get("title", "")}
+	if e.from == "" || !valid(source.ID, "id") {
+		return
+	}
+	ticket_referenced(e.get("id", ""), e.to, e.from, source)
+}
+
+// ticket_change makes a change to a ticket, here if this server owns it,
+// otherwise by sending it to the owner. Returns the changed ticket, or None
+// if sent.
+func ticket_change(t *sl.Thread, fn *sl.Builtin, id, from, event string, content map[string]any) (sl.Value, error) {
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	ticket := ticket_get(id)
+	if ticket == nil || ticket.App != app.id {
+		return sl_error(fn, "ticket not found")
+	}
+	actor := group_acting(user, from)
+	if actor == "" {
+		return sl_error(fn, "invalid from")
+	}
+
+	if comment_local(ticket.Owner) {
+		ticket, err = ticket_apply(ticket, actor, event, content)
+		if err != nil {
+			return sl_error(fn, "%v", err)
+		}
+		return sl_encode(ticket.view()), nil
+	}
+
+	m := message(actor, ticket.Owner, "tickets", event)
+	m.content = content
+	m.content["id"] = ticket.ID
+	m.FromApp = app.id
+	m.send()
+	return sl.None, nil
+}
+
+// ticket_triaging returns the calling user's acting entity if it may triage
+// an owner on this server
+func ticket_triaging(t *sl.Thread, owner, from string) (*App, string, error) {
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return nil, "", err
+	}
+	if !comment_local(owner) {
+		return nil, "", fmt.Errorf("owner not on this server")
+	}
+	actor := group_acting(user, from)
+	if actor == "" {
+		return nil, "", fmt.Errorf("invalid from")
+	}
+	if !ticket_triager(owner, actor) {
+		return nil, "", fmt.Errorf("not allowed")
+	}
+	return app, actor, nil
+}
+
+// mochi.ticket.create(owner, title, body?, kind?, labels?, from?) -> string:
+// Open a ticket, an "issue" by default or a "proposal", on an owner entity.
+// Labels are applied if you may triage the owner's tickets. Returns the new
+// ticket's id; its number is assigned by the owner's server.
+func api_ticket_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var owner, title, body, from string
+	kind := "issue"
+	var labels *sl.List
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "owner", &owner, "title", &title, "body?", &body, "kind?", &kind, "labels?", &labels, "from?", &from); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(owner, "entity") {
+		return sl_error(fn, "invalid owner")
+	}
+	title = strings.TrimSpace(title)
+	if title == "" || len(title) > ticket_title_limit {
+		return sl_error(fn, "invalid title")
+	}
+	if len(body) > ticket_body_limit {
+		return sl_error(fn, "invalid body")
+	}
+	if !ticket_kinds[kind] {
+		return sl_error(fn, "invalid kind %q", kind)
+	}
+	var names []string
+	if labels != nil {
+		for _, name := range sl_decode_string_list(labels) {
+			if !ticket_label_valid(name) {
+				return sl_error(fn, "invalid label %q", name)
+			}
+			names = append(names, name)
+		}
+	}
+	actor := group_acting(user, from)
+	if actor == "" {
+		return sl_error(fn, "invalid from")
+	}
+
+	id := uid()
+	if comment_local(owner) {
+		if _, err := ticket_open(id, app.id, owner, kind, title, body, actor, names); err != nil {
+			return sl_error(fn, "%v", err)
+		}
+		return sl.String(id), nil
+	}
+
+	m := message(actor, owner, "tickets", "open")
+	m.set("id", id, "app", app.id, "kind", kind, "title", title, "body", body)
+	m.content["labels"] = names
+	m.FromApp = app.id
+	m.send()
+	return sl.String(id), nil
+}
+
+// mochi.ticket.get(id) -> dict | None: Get a ticket, with its labels,
+// assignees, milestone, references and timeline
+func api_ticket_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	ticket := ticket_get(id)
+	if ticket == nil || ticket.App != app.id {
+		return sl.None, nil
+	}
+	viewers := comment_viewers(user)
+	if !ticket_taking_part(ticket, viewers) && !ticket_reader(app, ticket.Owner, viewers) {
+		return sl.None, nil
+	}
+	return sl_encode(ticket.view()), nil
+}
+
+// mochi.ticket.list(owner, state?, kind?, label?, assignee?, milestone?) ->
+// list: Get an owner's tickets, newest first, optionally only those in a
+// state, of a kind, with a label, assigned to an entity, or in a milestone.
+// Unless the user may see all of the owner's tickets, only those they take
+// part in are listed; for an owner on another server, only those are held
+// here.
+func api_ticket_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var owner, state, kind, label, assignee, milestone string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "owner", &owner, "state?", &state, "kind?", &kind, "label?", &label, "assignee?", &assignee, "milestone?", &milestone); err != nil {
+		return nil, err
+	}
+	user, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	query := "select * from tickets where owner=? and app=?"
+	values := []any{owner, app.id}
+	if state != "" {
+		query += " and state=?"
+		values = append(values, state)
+	}
+	if kind != "" {
+		query += " and kind=?"
+		values = append(values, kind)
+	}
+	if label != "" {
+		query += " and id in (select ticket from ticket_labels where label=?)"
+		values = append(values, label)
+	}
+	if assignee != "" {
+		query += " and id in (select ticket from assignees where assignee=?)"
+		values = append(values, assignee)
+	}
+	if milestone != "" {
+		query += " and milestone=?"
+		values = append(values, milestone)
+	}
+	query += " order by number desc"
+
+	var tickets []Ticket
+	if err := tickets_db().scans(&tickets, query, values...); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	viewers := comment_viewers(user)
+	all := ticket_reader(app, owner, viewers)
+	results := make([]any, 0, len(tickets))
+	for i := range tickets {
+		if all || ticket_taking_part(&tickets[i], viewers) {
+			results = append(results, tickets[i].view())
+		}
+	}
+	return sl_encode(results), nil
+}
+
+// mochi.ticket.edit(id, title?, body?, from?) -> dict | None: Change a
+// ticket's title or body, as its author or a triager. Returns the ticket,
+// or None if sent to its owner's server.
+func api_ticket_edit(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, from string
+	var title, body sl.Value = sl.None, sl.None
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "title?", &title, "body?", &body, "from?", &from); err != nil {
+		return nil, err
+	}
+	content := map[string]any{}
+	if s, ok := sl.AsString(title); ok {
+		content["title"] = strings.TrimSpace(s)
+	}
+	if s, ok := sl.AsString(body); ok {
+		content["body"] = s
+	}
+	return ticket_change(t, fn, id, from, "edit", content)
+}
+
+// mochi.ticket.state(id, state, reason?, from?) -> dict | None: Move a
+// ticket to "open", "closed" or, for a proposal, "merged". A closed
+// ticket may give a reason: "completed", "declined" or "duplicate". Its
+// author may close and reopen it; triagers may do anything.
+func api_ticket_state(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, state, reason, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "state", &state, "reason?", &reason, "from?", &from); err != nil {
+		return nil, err
+	}
+	if ticket_transitions[state] == nil {
+		return sl_error(fn, "invalid state %q", state)
+	}
+	if !ticket_reasons[reason] {
+		return sl_error(fn, "invalid reason %q", reason)
+	}
+	return ticket_change(t, fn, id, from, "state", map[string]any{"state": state, "reason": reason})
+}
+
+// mochi.ticket.reference(id, target, from?) -> dict | None: Record that a
+// ticket refers to another, which shows it in the other's timeline. Tickets
+// of the same owner mentioned as #number in a title or body are referred to
+// automatically.
+func api_ticket_reference(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, target, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "target", &target, "from?", &from); err != nil {
+		return nil, err
+	}
+	other := ticket_get(target)
+	if other == nil {
+		return sl_error(fn, "target not found")
+	}
+	return ticket_change(t, fn, id, from, "reference", map[string]any{"target": other.ID, "target_owner": other.Owner})
+}
+
+// mochi.ticket.label.add(id, label, from?) -> dict | None: Label a ticket
+// with one of its owner's labels, as a triager
+func api_ticket_label_add(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, label, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "label", &label, "from?", &from); err != nil {
+		return nil, err
+	}
+	return ticket_change(t, fn, id, from, "label", map[string]any{"label": label, "remove": false})
+}
+
+// mochi.ticket.label.remove(id, label, from?) -> dict | None: Remove a
+// label from a ticket, as a triager
+func api_ticket_label_remove(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, label, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "label", &label, "from?", &from); err != nil {
+		return nil, err
+	}
+	return ticket_change(t, fn, id, from, "label", map[string]any{"label": label, "remove": true})
+}
+
+// mochi.ticket.label.define(owner, name, colour?, description?, from?) ->
+// dict: Create or change one of an owner's labels, as a triager, for an
+// owner on this server. Colour is "#rrggbb".
+func api_ticket_label_define(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var owner, name, colour, description, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "owner", &owner, "name", &name, "colour?", &colour, "description?", &description, "from?", &from); err != nil {
+		return nil, err
+	}
+	app, _, err := ticket_triaging(t, owner, from)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !ticket_label_valid(name) {
+		return sl_error(fn, "invalid name")
+	}
+	if colour != "" && !ticket_colour_match.MatchString(colour) {
+		return sl_error(fn, "invalid colour")
+	}
+	if len(description) > ticket_description_limit {
+		return sl_error(fn, "invalid description")
+	}
+
+	tickets_db().exec("insert into labels (owner, app, name, colour, description, created) values (?, ?, ?, ?, ?, ?) on conflict (owner, app, name) do update set colour=excluded.colour, description=excluded.description", owner, app.id, name, colour, description, now())
+	return sl_encode(map[string]any{"name": name, "colour": colour, "description": description}), nil
+}
+
+// mochi.ticket.label.delete(owner, name, from?) -> None: Delete one of an
+// owner's labels, removing it from every ticket, as a triager
+func api_ticket_label_delete(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var owner, name, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "owner", &owner, "name", &name, "from?", &from); err != nil {
+		return nil, err
+	}
+	app, actor, err := ticket_triaging(t, owner, from)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	db := tickets_db()
+	var tickets []Ticket
+	db.scans(&tickets, "select * from tickets where owner=? and app=? and id in (select ticket from ticket_labels where label=?)", owner, app.id, name)
+	for i := range tickets {
+		ticket_apply(&tickets[i], actor, "label", map[string]any{"label": name, "remove": true})
+	}
+	db.exec("delete from labels where owner=? and app=? and name=?", owner, app.id, name)
+	return sl.None, nil
+}
+
+// mochi.ticket.label.list(owner) -> list: Get an owner's labels, each a
+// dict of name, colour and description. For an owner on another server,
+// only labels seen on tickets held here are known.
+func api_ticket_label_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var owner string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "owner", &owner); err != nil {
+		return nil, err
+	}
+	_, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	rows, err := tickets_db().rows("select name, colour, description from labels where owner=? and app=? order by name", owner, app.id)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
+
+// mochi.ticket.assignee.add(id, assignee, from?) -> dict | None: Assign a
+// ticket to an entity, as a triager
+func api_ticket_assignee_add(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, assignee, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "assignee", &assignee, "from?", &from); err != nil {
+		return nil, err
+	}
+	if !valid(assignee, "entity") {
+		return sl_error(fn, "invalid assignee")
+	}
+	return ticket_change(t, fn, id, from, "assign", map[string]any{"assignee": assignee, "remove": false})
+}
+
+// mochi.ticket.assignee.remove(id, assignee, from?) -> dict | None:
+// Unassign an entity from a ticket, as a triager
+func api_ticket_assignee_remove(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, assignee, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "assignee", &assignee, "from?", &from); err != nil {
+		return nil, err
+	}
+	if !valid(assignee, "entity") {
+		return sl_error(fn, "invalid assignee")
+	}
+	return ticket_change(t, fn, id, from, "assign", map[string]any{"assignee": assignee, "remove": true})
+}
+
+// mochi.ticket.milestone.set(id, milestone, from?) -> dict | None: Put a
+// ticket in one of its owner's milestones, or none if milestone is "", as
+// a triager
+func api_ticket_milestone_set(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, milestone, from string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "milestone", &milestone, "from?", &from); err != nil {
+		return nil, err
+	}
+	return ticket_change(t, fn, id, from, "milestone", map[string]any{"milestone": milestone})
+}
+
+// mochi.ticket.milestone.create(owner, title, description?, due?, from?) ->
+// string: Create a milestone for an owner on this server, as a triager.
+// Due is a Unix time, or 0 for none. Returns the milestone's id.
+func api_ticket_milestone_create(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var owner, title, description, from string
+	var due int64
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "owner", &owner, "title", &title, "description?", &description, "due?", &due, "from?", &from); err != nil {
+		return nil, err
+	}
+	app, _, err := ticket_triaging(t, owner, from)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	title = strings.TrimSpace(title)
+	if title == "" || len(title) > ticket_title_limit {
+		return sl_error(fn, "invalid title")
+	}
+	if len(description) > ticket_description_limit {
+		return sl_error(fn, "invalid description")
+	}
+
+	id := uid()
+	n := now()
+	tickets_db().exec("insert into milestones (id, owner, app, title, description, due, state, created, updated) values (?, ?, ?, ?, ?, ?, 'open', ?, ?)", id, owner, app.id, title, description, due, n, n)
+	return sl.String(id), nil
+}
+
+// mochi.ticket.milestone.edit(id, title?, description?, due?, state?,
+// from?) -> dict: Change a milestone, or set its state to "open" or
+// "closed", as a triager of its owner. Returns the milestone.
+func api_ticket_milestone_edit(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id, from string
+	var title, description, state sl.Value = sl.None, sl.None, sl.None
+	due := int64(-1)
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id, "title?", &title, "description?", &description, "due?", &due, "state?", &state, "from?", &from); err != nil {
+		return nil, err
+	}
+	db := tickets_db()
+	m, _ := db.row("select * from milestones where id=?", id)
+	if m == nil {
+		return sl_error(fn, "milestone not found")
+	}
+	owner, _ := m["owner"].(string)
+	app, _, err := ticket_triaging(t, owner, from)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if m["app"] != app.id {
+		return sl_error(fn, "milestone not found")
+	}
+
+	if s, ok := sl.AsString(title); ok {
+		s = strings.TrimSpace(s)
+		if s == "" || len(s) > ticket_title_limit {
+			return sl_error(fn, "invalid title")
+		}
+		m["title"] = s
+	}
+	if s, ok := sl.AsString(description); ok {
+		if len(s) > ticket_description_limit {
+			return sl_error(fn, "invalid description")
+		}
+		m["description"] = s
+	}
+	if due >= 0 {
+		m["due"] = due
+	}
+	if s, ok := sl.AsString(state); ok {
+		if s != "open" && s != "closed" {
+			return sl_error(fn, "invalid state %q", s)
+		}
+		m["state"] = s
+	}
+	m["updated"] = now()
+	db.exec("update milestones set title=?, description=?, due=?, state=?, updated=? where id=?", m["title"], m["description"], m["due"], m["state"], m["updated"], id)
+
+	// Tickets in the milestone carry it, so are sent again
+	var tickets []Ticket
+	db.scans(&tickets, "select * from tickets where milestone=?", id)
+	for i := range tickets {
+		tickets[i].touch()
+		ticket_store(&tickets[i])
+		ticket_publish(&tickets[i])
+	}
+	return sl_encode(m), nil
+}
+
+// mochi.ticket.milestone.list(owner, state?) -> list: Get an owner's
+// milestones, soonest due first, each a dict of id, title, description,
+// due, state and the numbers of open and closed tickets in it
+func api_ticket_milestone_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var owner, state string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "owner", &owner, "state?", &state); err != nil {
+		return nil, err
+	}
+	_, app, err := group_entity_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	query := "select m.id, m.title, m.description, m.due, m.state, (select count(*) from tickets t where t.milestone=m.id and t.state='open') as open, (select count(*) from tickets t where t.milestone=m.id and t.state!='open') as closed from milestones m where m.owner=? and m.app=?"
+	values := []any{owner, app.id}
+	if state != "" {
+		query += " and m.state=?"
+		values = append(values, state)
+	}
+	query += " order by m.due=0, m.due, m.created"
+	rows, err := tickets_db().rows(query, values...)
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	return sl_encode(rows), nil
+}
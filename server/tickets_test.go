@@ -0,0 +1,228 @@
+// Mochi server: Tickets tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+const ticket_test_remote = "1TicketTestRemoteEntityXXXXXXXXXXXXXXXXXXXXXXXXXXX"
+
+func TestTicketNumbering(t *testing.T) {
+	_, repo, person := comment_test_setup(t)
+	first, err := ticket_open(uid(), "repositories", repo, "issue", "Crash on start", "", person, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := ticket_open(uid(), "repositories", repo, "proposal", "Fix crash", "Fixes #1", person, nil)
+	other, _ := ticket_open(uid(), "wikis", repo, "issue", "Typo", "", person, nil)
+	if first.Number != 1 || second.Number != 2 || other.Number != 1 {
+		t.Errorf("numbers %d, %d, %d; want 1, 2 and 1 in another app", first.Number, second.Number, other.Number)
+	}
+	if _, err := ticket_open(first.ID, "repositories", repo, "issue", "Again", "", person, nil); err == nil {
+		t.Error("ticket accepted with an id already taken")
+	}
+	if _, err := ticket_open(uid(), "repositories", repo, "task", "Kind", "", person, nil); err == nil {
+		t.Error("ticket accepted of an unknown kind")
+	}
+
+	// Mentioning #1 refers to it, and shows in its timeline
+	if refs := second.references(); len(refs) != 1 || refs[0][0] != first.ID {
+		t.Errorf("references %v, want #1", refs)
+	}
+	found := false
+	for _, e := range ticket_get(first.ID).view()["timeline"].([]any) {
+		if e.(map[string]any)["action"] == "referenced" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("referenced ticket's timeline does not show the reference")
+	}
+}
+
+func TestTicketStates(t *testing.T) {
+	_, repo, person := comment_test_setup(t)
+	issue, _ := ticket_open(uid(), "repositories", repo, "issue", "Bug", "", person, nil)
+	proposal, _ := ticket_open(uid(), "repositories", repo, "proposal", "Fix", "", person, nil)
+
+	if _, err := ticket_apply(issue, repo, "state", map[string]any{"state": "merged"}); err == nil {
+		t.Error("issue merged")
+	}
+	if _, err := ticket_apply(proposal, person, "state", map[string]any{"state": "merged"}); err == nil {
+		t.Error("author merged their own proposal")
+	}
+	if _, err := ticket_apply(issue, ticket_test_remote, "state", map[string]any{"state": "closed"}); err == nil {
+		t.Error("stranger closed a ticket")
+	}
+	if _, err := ticket_apply(issue, person, "state", map[string]any{"state": "closed", "reason": "completed"}); err != nil {
+		t.Errorf("author could not close: %v", err)
+	}
+	if got := ticket_get(issue.ID); got.State != "closed" || got.Reason != "completed" {
+		t.Errorf("closed ticket %+v", got)
+	}
+	if _, err := ticket_apply(issue, person, "state", map[string]any{"state": "open"}); err != nil {
+		t.Errorf("author could not reopen: %v", err)
+	}
+	if _, err := ticket_apply(proposal, repo, "state", map[string]any{"state": "merged"}); err != nil {
+		t.Errorf("owner could not merge: %v", err)
+	}
+	if _, err := ticket_apply(proposal, repo, "state", map[string]any{"state": "open"}); err == nil {
+		t.Error("merged proposal reopened")
+	}
+}
+
+func TestTicketTriage(t *testing.T) {
+	user, repo, person := comment_test_setup(t)
+	helper, err := entity_create(user, "person", "Helper", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := tickets_db()
+	db.exec("insert into labels (owner, app, name, colour, created) values (?, 'repositories', 'bug', '#ff0000', ?)", repo, now())
+	milestone := uid()
+	db.exec("insert into milestones (id, owner, app, title, state, created, updated) values (?, ?, 'repositories', 'Release 1', 'open', ?, ?)", milestone, repo, now(), now())
+
+	// Labels given by an author who may not triage are ignored
+	ticket, _ := ticket_open(uid(), "repositories", repo, "issue", "Bug", "", person, []string{"bug"})
+	if len(ticket.labels()) != 0 {
+		t.Error("author who may not triage labelled their ticket")
+	}
+	if _, err := ticket_apply(ticket, person, "label", map[string]any{"label": "bug"}); err == nil {
+		t.Error("author labelled their ticket")
+	}
+	if _, err := ticket_apply(ticket, repo, "label", map[string]any{"label": "feature"}); err == nil {
+		t.Error("undefined label applied")
+	}
+	for _, change := range []struct {
+		event   string
+		content map[string]any
+	}{
+		{"label", map[string]any{"label": "bug"}},
+		{"assign", map[string]any{"assignee": helper.ID}},
+		{"milestone", map[string]any{"milestone": milestone}},
+	} {
+		if _, err := ticket_apply(ticket, repo, change.event, change.content); err != nil {
+			t.Errorf("owner could not %s: %v", change.event, err)
+		}
+	}
+
+	record := ticket_get(ticket.ID).record()
+	if labels := record["labels"].([][]string); len(labels) != 1 || labels[0][1] != "#ff0000" {
+		t.Errorf("labels %v", labels)
+	}
+	if m := record["milestone"].([]any); m[1] != "Release 1" {
+		t.Errorf("milestone %v", m)
+	}
+
+	// The assignee takes part, so receives the ticket's discussion
+	c := &Comment{App: "repositories", Owner: repo, Object: ticket.object()}
+	watchers := ticket_comment_watchers(c)
+	found := false
+	for _, w := range watchers {
+		if w == helper.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("watchers %v, want the assignee", watchers)
+	}
+}
+
+func TestTicketRecordEvent(t *testing.T) {
+	_, repo, person := comment_test_setup(t)
+	milestone := uid()
+	record := map[string]any{"id": uid(), "app": "repositories", "owner": ticket_test_remote, "number": int64(7), "kind": "issue", "title": "Remote", "body": "", "author": person, "state": "open", "created": int64(100), "updated": int64(100),
+		"labels":     []any{[]any{"bug", "#ff0000"}},
+		"assignees":  []any{person},
+		"milestone":  []any{milestone, "Release 1", "open", int64(0)},
+		"references": []any{},
+		"timeline":   []any{[]any{uid(), person, "opened", "", int64(100)}},
+	}
+
+	// Records are accepted only from their owner, and never for a local owner
+	ticket_record_event(&Event{from: person, content: record})
+	if ticket_get(record["id"].(string)) != nil {
+		t.Error("record accepted from an entity other than its owner")
+	}
+	local := map[string]any{}
+	for k, v := range record {
+		local[k] = v
+	}
+	local["id"] = uid()
+	local["owner"] = repo
+	ticket_record_event(&Event{from: repo, content: local})
+	if ticket_get(local["id"].(string)) != nil {
+		t.Error("record accepted for an owner on this server")
+	}
+
+	ticket_record_event(&Event{from: ticket_test_remote, content: record})
+	got := ticket_get(record["id"].(string))
+	if got == nil || got.Number != 7 || got.Milestone != milestone || len(got.labels()) != 1 || len(got.assignees()) != 1 || len(got.timeline()) != 1 {
+		t.Fatalf("valid record not stored: %+v", got)
+	}
+
+	// An older copy does not replace a newer one
+	record["title"] = "Old"
+	record["updated"] = int64(50)
+	ticket_record_event(&Event{from: ticket_test_remote, content: record})
+	if ticket_get(got.ID).Title != "Remote" {
+		t.Error("older record replaced newer")
+	}
+}
+
+func TestTicketAccess(t *testing.T) {
+	_, repo, person := comment_test_setup(t)
+	other := create_permission_test_user(t, "u2")
+	db_open("db/users.db").exec("insert into users (uid, username) values (?, ?)", other.UID, "stranger@example.com")
+	stranger, err := entity_create(other, "person", "Stranger", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := create_external_app("repositories")
+	mine, _ := ticket_open(uid(), app.id, repo, "issue", "Owner's", "", person, nil)
+	theirs, _ := ticket_open(uid(), app.id, repo, "issue", "Stranger's", "", stranger.ID, nil)
+
+	thread := create_test_thread(other, app)
+	get := sl.NewBuiltin("mochi.ticket.get", api_ticket_get)
+	if v, _ := api_ticket_get(thread, get, sl.Tuple{sl.String(mine.ID)}, nil); v != sl.None {
+		t.Error("stranger read a ticket they take no part in")
+	}
+	if v, _ := api_ticket_get(thread, get, sl.Tuple{sl.String(theirs.ID)}, nil); v == sl.None {
+		t.Error("author could not read their own ticket")
+	}
+	list := sl.NewBuiltin("mochi.ticket.list", api_ticket_list)
+	v, err := api_ticket_list(thread, list, sl.Tuple{sl.String(repo)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tickets, _ := sl_decode(v).([]any); len(tickets) != 1 {
+		t.Errorf("stranger listed %d tickets, want their own", len(tickets))
+	}
+
+	// The owner's app may let anyone read them
+	db_app_system(user_owning_entity(repo), app).access_set("+", "tickets/"+repo, "read", true, repo)
+	if v, _ := api_ticket_get(thread, get, sl.Tuple{sl.String(mine.ID)}, nil); v == sl.None {
+		t.Error("ticket not readable once granted")
+	}
+
+	// A reference names the owner that sent it, whatever it claims. The
+	// sender is local, so the ticket isn't published to a remote entity
+	// after the test has finished.
+	ticket_referenced_event(&Event{from: person, to: repo, content: map[string]any{"id": mine.ID, "source": uid(), "actor": stranger.ID}})
+	found := false
+	for _, e := range ticket_get(mine.ID).timeline() {
+		if row := e.([]any); row[2] == "referenced" {
+			found = row[1] == person
+		}
+	}
+	if !found {
+		t.Error("reference not recorded as by its sender")
+	}
+}
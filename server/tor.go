@@ -0,0 +1,414 @@
+// Mochi server: Tor onion services
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	p2p_peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"golang.org/x/net/proxy"
+)
+
+// For networks where a server can't be reached, or can't be seen to run,
+// [tor] enabled publishes it as an onion service through a local Tor
+// daemon. Over Tor's control port the server adds an ephemeral service
+// with the P2P port, and port 80 for the first plain-HTTP web listener,
+// forwarded to the local listeners. The service's key is kept in
+// data_dir/tor/onion.key so the onion address survives restarts, and the
+// service lasts as long as the control connection: it goes when the
+// server stops.
+//
+// The onion address is advertised alongside the others as
+// /onion3/<service>:<port>, and peers with [tor] enabled dial such
+// addresses through Tor's SOCKS port. Inbound onion connections arrive on
+// the ordinary listeners from loopback, so nothing else changes.
+
+const tor_timeout = 30 * time.Second // For control commands and SOCKS dials
+
+var (
+	tor_enabled bool
+	tor_socks   string
+	tor_onion   string       // This server's onion service, without ".onion"; "" until published
+	tor_control *tor_session // Kept open, as closing it removes the service
+)
+
+// tor_configure reads [tor], before the P2P host is created
+func tor_configure() {
+	tor_enabled = ini_bool("tor", "enabled", false)
+	tor_socks = ini_string("tor", "socks", "127.0.0.1:9050")
+}
+
+// tor_start publishes this server's onion service. Failure is reported
+// and leaves the server on its other addresses.
+func tor_start(port int) {
+	if !tor_enabled {
+		return
+	}
+	ports := []string{fmt.Sprintf("%d,%s", port, tor_target(ini_strings_commas("p2p", "listen"), port))}
+	if ini_bool("tor", "web", true) {
+		if target := tor_web_target(); target != "" {
+			ports = append(ports, "80,"+target)
+		} else {
+			warn("Tor has no plain HTTP web listener to publish")
+		}
+	}
+
+	c, err := tor_session_open(ini_string("tor", "control", "127.0.0.1:9051"), ini_string("tor", "password", ""))
+	if err != nil {
+		warn("Tor unable to connect to control port: %v", err)
+		return
+	}
+	path := filepath.Join(data_dir, "tor", "onion.key")
+	key := ""
+	if data, err := os.ReadFile(path); err == nil {
+		key = strings.TrimSpace(string(data))
+	}
+	id, created, err := c.add_onion(key, ports)
+	if err != nil {
+		c.close()
+		warn("Tor unable to publish onion service: %v", err)
+		return
+	}
+	if created != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			warn("Tor unable to create directory: %v", err)
+		} else if err := os.WriteFile(path, []byte(created+"\n"), 0600); err != nil {
+			warn("Tor unable to save onion key: %v", err)
+		}
+	}
+	tor_control = c
+	tor_onion = id
+	info("Tor publishing onion service %s.onion on ports %s", id, strings.Join(ports, ", "))
+}
+
+// tor_target is the local address an onion port forwards to: the first
+// listen address, with loopback standing in for every interface
+func tor_target(addresses []string, port int) string {
+	host := "127.0.0.1"
+	for _, a := range addresses {
+		ip := net.ParseIP(strings.TrimSpace(a))
+		if ip == nil {
+			continue
+		}
+		if !ip.IsUnspecified() {
+			host = ip.String()
+		} else if ip.To4() == nil {
+			host = "::1"
+		}
+		break
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// tor_web_target is the local address of the first plain-HTTP web
+// listener, or "" if there is none
+func tor_web_target() string {
+	listeners, _ := web_listeners()
+	for _, l := range listeners {
+		if l.scheme != "http" || l.redirect {
+			continue
+		}
+		host, port, err := net.SplitHostPort(l.address)
+		if err != nil {
+			continue
+		}
+		n, _ := strconv.Atoi(port)
+		if host == "" {
+			return tor_target(nil, n)
+		}
+		return tor_target([]string{host}, n)
+	}
+	return ""
+}
+
+// tor_addrs_factory adds the onion address to the ones advertised
+func tor_addrs_factory(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	if tor_onion == "" {
+		return addrs
+	}
+	onion, err := multiaddr.NewMultiaddr(fmt.Sprintf("/onion3/%s:%d", tor_onion, ini_int("p2p", "port", 1443)))
+	if err != nil {
+		return addrs
+	}
+	return append(addrs, onion)
+}
+
+// tor_session is a connection to Tor's control port
+type tor_session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// tor_session_open connects to the control port and authenticates, with
+// the password if there is one, otherwise the cookie or no authentication
+// as Tor offers
+func tor_session_open(address, password string) (*tor_session, error) {
+	conn, err := net.DialTimeout("tcp", address, tor_timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &tor_session{conn: conn, reader: bufio.NewReader(conn)}
+	if err := c.authenticate(password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *tor_session) close() {
+	c.conn.Close()
+}
+
+// command sends a command and returns the text of each reply line
+func (c *tor_session) command(line string) ([]string, error) {
+	c.conn.SetDeadline(time.Now().Add(tor_timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for {
+		reply, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		reply = strings.TrimRight(reply, "\r\n")
+		if len(reply) < 4 {
+			return nil, fmt.Errorf("malformed reply %q", reply)
+		}
+		code, separator, text := reply[:3], reply[3], reply[4:]
+		if separator == '+' {
+			// Data follows, up to a line holding only "."
+			for {
+				data, err := c.reader.ReadString('\n')
+				if err != nil {
+					return nil, err
+				}
+				if strings.TrimRight(data, "\r\n") == "." {
+					break
+				}
+			}
+		}
+		if separator != ' ' {
+			if code == "250" {
+				lines = append(lines, text)
+			}
+			continue
+		}
+		if code != "250" {
+			return nil, fmt.Errorf("%s %s", code, text)
+		}
+		return append(lines, text), nil
+	}
+}
+
+// authenticate chooses how to authenticate from PROTOCOLINFO
+func (c *tor_session) authenticate(password string) error {
+	if password != "" {
+		_, err := c.command("AUTHENTICATE " + tor_quote(password))
+		return err
+	}
+	lines, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	methods, cookie := tor_protocolinfo(lines)
+	switch {
+	case methods["NULL"]:
+		_, err = c.command("AUTHENTICATE")
+	case methods["COOKIE"] && cookie != "":
+		data, err := os.ReadFile(cookie)
+		if err != nil {
+			return fmt.Errorf("unable to read authentication cookie: %v", err)
+		}
+		_, err = c.command("AUTHENTICATE " + hex.EncodeToString(data))
+		return err
+	default:
+		return fmt.Errorf("no supported authentication method; set [tor] password")
+	}
+	return err
+}
+
+// add_onion adds the onion service with the given key, or a new one. It
+// returns the service ID, and the new key if one was created.
+func (c *tor_session) add_onion(key string, ports []string) (string, string, error) {
+	line := "ADD_ONION NEW:ED25519-V3"
+	if key != "" {
+		line = "ADD_ONION " + key + " Flags=DiscardPK"
+	}
+	for _, p := range ports {
+		line += " Port=" + p
+	}
+	lines, err := c.command(line)
+	if err != nil {
+		return "", "", err
+	}
+	id, created := "", ""
+	for _, l := range lines {
+		if v, found := strings.CutPrefix(l, "ServiceID="); found {
+			id = v
+		} else if v, found := strings.CutPrefix(l, "PrivateKey="); found {
+			created = v
+		}
+	}
+	if id == "" {
+		return "", "", fmt.Errorf("no service ID in reply")
+	}
+	return id, created, nil
+}
+
+// tor_protocolinfo reads the authentication methods and cookie file from
+// a PROTOCOLINFO reply
+func tor_protocolinfo(lines []string) (map[string]bool, string) {
+	methods := map[string]bool{}
+	cookie := ""
+	for _, l := range lines {
+		rest, found := strings.CutPrefix(l, "AUTH METHODS=")
+		if !found {
+			continue
+		}
+		list, rest, _ := strings.Cut(rest, " ")
+		for _, m := range strings.Split(list, ",") {
+			methods[m] = true
+		}
+		if file, found := strings.CutPrefix(rest, "COOKIEFILE="); found {
+			cookie = tor_unquote(file)
+		}
+	}
+	return methods, cookie
+}
+
+// tor_quote makes a control protocol quoted string
+func tor_quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// tor_unquote reads a control protocol quoted string
+func tor_unquote(s string) string {
+	if !strings.HasPrefix(s, `"`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String()
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// tor_transport dials /onion3 addresses through Tor's SOCKS port. It
+// doesn't listen: onion connections reach the TCP listener.
+type tor_transport struct {
+	upgrader transport.Upgrader
+	rcmgr    network.ResourceManager
+}
+
+// tor_conn is a connection through Tor, with the onion address it reached
+type tor_conn struct {
+	net.Conn
+	local  multiaddr.Multiaddr
+	remote multiaddr.Multiaddr
+}
+
+func (c *tor_conn) LocalMultiaddr() multiaddr.Multiaddr  { return c.local }
+func (c *tor_conn) RemoteMultiaddr() multiaddr.Multiaddr { return c.remote }
+
+func tor_transport_new(upgrader transport.Upgrader, rcmgr network.ResourceManager) (*tor_transport, error) {
+	if rcmgr == nil {
+		rcmgr = &network.NullResourceManager{}
+	}
+	return &tor_transport{upgrader: upgrader, rcmgr: rcmgr}, nil
+}
+
+// tor_onion_address returns the host:port to ask the SOCKS proxy for, or
+// "" if the multiaddr isn't a bare onion address
+func tor_onion_address(addr multiaddr.Multiaddr) string {
+	if len(addr) != 1 || addr[0].Code() != multiaddr.P_ONION3 {
+		return ""
+	}
+	host, port, found := strings.Cut(addr[0].Value(), ":")
+	if !found {
+		return ""
+	}
+	return host + ".onion:" + port
+}
+
+func (t *tor_transport) CanDial(addr multiaddr.Multiaddr) bool {
+	return tor_onion_address(addr) != ""
+}
+
+func (t *tor_transport) Dial(ctx context.Context, raddr multiaddr.Multiaddr, p p2p_peer.ID) (transport.CapableConn, error) {
+	scope, err := t.rcmgr.OpenConnection(network.DirOutbound, true, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := t.dial(ctx, raddr, p, scope)
+	if err != nil {
+		scope.Done()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *tor_transport) dial(ctx context.Context, raddr multiaddr.Multiaddr, p p2p_peer.ID, scope network.ConnManagementScope) (transport.CapableConn, error) {
+	if err := scope.SetPeer(p); err != nil {
+		return nil, err
+	}
+	address := tor_onion_address(raddr)
+	if address == "" {
+		return nil, fmt.Errorf("not an onion address: %s", raddr)
+	}
+	socks, err := proxy.SOCKS5("tcp", tor_socks, nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, tor_timeout)
+	defer cancel()
+	conn, err := socks.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	local, err := manet.FromNetAddr(conn.LocalAddr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return t.upgrader.Upgrade(ctx, t, &tor_conn{Conn: conn, local: local, remote: raddr}, network.DirOutbound, p, scope)
+}
+
+func (t *tor_transport) Listen(laddr multiaddr.Multiaddr) (transport.Listener, error) {
+	return nil, fmt.Errorf("tor transport does not listen; onion services forward to the TCP listener")
+}
+
+func (t *tor_transport) Protocols() []int {
+	return []int{multiaddr.P_ONION3}
+}
+
+func (t *tor_transport) Proxy() bool {
+	return false
+}
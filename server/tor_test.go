@@ -0,0 +1,135 @@
+// Mochi server: Tor onion service tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+const tor_test_service = "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad"
+
+// tor_test_control answers control commands from a script of command
+// prefixes and replies, recording the commands it was sent
+func tor_test_control(t *testing.T, script [][2]string) (string, *[]string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	sent := &[]string{}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for _, step := range script {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			*sent = append(*sent, line)
+			if !strings.HasPrefix(line, step[0]) {
+				conn.Write([]byte("510 Unrecognized command\r\n"))
+				return
+			}
+			conn.Write([]byte(step[1]))
+		}
+	}()
+	return listener.Addr().String(), sent
+}
+
+func TestTorSession(t *testing.T) {
+	address, sent := tor_test_control(t, [][2]string{
+		{"PROTOCOLINFO 1", "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=NULL\r\n250-VERSION Tor=\"0.4.8.10\"\r\n250 OK\r\n"},
+		{"AUTHENTICATE", "250 OK\r\n"},
+		{"ADD_ONION NEW:ED25519-V3 Port=1443,127.0.0.1:1443", "250-ServiceID=" + tor_test_service + "\r\n250-PrivateKey=ED25519-V3:c2VjcmV0\r\n250 OK\r\n"},
+		{"ADD_ONION ED25519-V3:c2VjcmV0 Flags=DiscardPK", "250-ServiceID=" + tor_test_service + "\r\n250 OK\r\n"},
+		{"ADD_ONION", "512 Invalid argument\r\n"},
+	})
+	c, err := tor_session_open(address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	id, key, err := c.add_onion("", []string{"1443,127.0.0.1:1443"})
+	if err != nil || id != tor_test_service || key != "ED25519-V3:c2VjcmV0" {
+		t.Errorf("new service %q, key %q, %v", id, key, err)
+	}
+	id, key, err = c.add_onion(key, []string{"1443,127.0.0.1:1443", "80,127.0.0.1:8080"})
+	if err != nil || id != tor_test_service || key != "" {
+		t.Errorf("saved service %q, key %q, %v", id, key, err)
+	}
+	if _, _, err := c.add_onion("", nil); err == nil || !strings.Contains(err.Error(), "512") {
+		t.Errorf("error reply gave %v", err)
+	}
+	if len(*sent) != 5 || (*sent)[1] != "AUTHENTICATE" || !strings.HasSuffix((*sent)[3], "Port=80,127.0.0.1:8080") {
+		t.Errorf("sent %q", *sent)
+	}
+}
+
+func TestTorSessionPassword(t *testing.T) {
+	address, sent := tor_test_control(t, [][2]string{
+		{"AUTHENTICATE", "515 Authentication failed\r\n"},
+	})
+	if _, err := tor_session_open(address, `pass "word"`); err == nil {
+		t.Error("failed authentication accepted")
+	}
+	if len(*sent) != 1 || (*sent)[0] != `AUTHENTICATE "pass \"word\""` {
+		t.Errorf("sent %q", *sent)
+	}
+}
+
+func TestTorProtocolinfo(t *testing.T) {
+	methods, cookie := tor_protocolinfo([]string{"PROTOCOLINFO 1", `AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/run/tor/control\\auth\"cookie"`, "OK"})
+	if !methods["COOKIE"] || !methods["SAFECOOKIE"] || methods["NULL"] || cookie != `/run/tor/control\auth"cookie` {
+		t.Errorf("methods %v, cookie %q", methods, cookie)
+	}
+}
+
+func TestTorTarget(t *testing.T) {
+	for _, test := range []struct {
+		addresses []string
+		want      string
+	}{
+		{nil, "127.0.0.1:1443"},
+		{[]string{"0.0.0.0"}, "127.0.0.1:1443"},
+		{[]string{"eth0", "::"}, "[::1]:1443"},
+		{[]string{"192.0.2.1", "0.0.0.0"}, "192.0.2.1:1443"},
+	} {
+		if got := tor_target(test.addresses, 1443); got != test.want {
+			t.Errorf("tor_target(%v) = %q, want %q", test.addresses, got, test.want)
+		}
+	}
+}
+
+func TestTorOnionAddress(t *testing.T) {
+	onion := multiaddr.StringCast("/onion3/" + tor_test_service + ":1443")
+	if got := tor_onion_address(onion); got != tor_test_service+".onion:1443" {
+		t.Errorf("onion address %q", got)
+	}
+	for _, a := range []string{"/ip4/192.0.2.1/tcp/1443", "/onion3/" + tor_test_service + ":1443/p2p/" + dns_test_peer} {
+		if got := tor_onion_address(multiaddr.StringCast(a)); got != "" {
+			t.Errorf("%s dialed as %q", a, got)
+		}
+	}
+
+	tor_onion = tor_test_service
+	t.Cleanup(func() { tor_onion = "" })
+	addrs := tor_addrs_factory([]multiaddr.Multiaddr{multiaddr.StringCast("/ip4/192.0.2.1/tcp/1443")})
+	if len(addrs) != 2 || addrs[1].String() != "/onion3/"+tor_test_service+":1443" {
+		t.Errorf("advertised %v", addrs)
+	}
+}
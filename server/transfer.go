@@ -0,0 +1,287 @@
+// Mochi server: Transfer accounting
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sl "go.starlark.net/starlark"
+)
+
+// Bytes sent and received over P2P streams are counted per stream and
+// aggregated by calendar month (UTC) per peer, app and local user. Counts
+// collect in memory and are written to db/transfer.db once a minute, so a
+// busy stream costs an atomic add per read or write, not a database write.
+// Attachment federation runs over streams, so its transfers are included.
+//
+// When the transfer_cap setting is non-zero and this month's total reaches
+// it, transfer_paused reports true and low-priority sync (such as pushing
+// attachments to recipients) stops until the next month or until the cap is
+// raised. Interactive traffic is never refused.
+
+const (
+	transfer_flush  = 1 << 20 // Bytes a stream counts before adding to the totals
+	transfer_months = 13      // Months of history kept
+)
+
+type transfer_key struct {
+	month string
+	peer  string
+	app   string
+	user  string
+}
+
+type TransferTotal struct {
+	Month    string `json:"month"`
+	Peer     string `json:"peer,omitempty"`
+	App      string `json:"app,omitempty"`
+	User     string `json:"user,omitempty"`
+	Sent     int64  `json:"sent"`
+	Received int64  `json:"received"`
+}
+
+var (
+	transfer_lock    sync.Mutex
+	transfer_pending = map[transfer_key]*TransferTotal{}
+)
+
+// transfer_meter counts the bytes of one stream
+type transfer_meter struct {
+	peer     string
+	app      string
+	user     string
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// transfer_reader and transfer_writer count bytes on their way through a
+// stream. They keep the deadline and half-close methods stream code probes
+// for, falling back to what that code does when the underlying end lacks them.
+type transfer_reader struct {
+	io.ReadCloser
+	meter *transfer_meter
+}
+
+type transfer_writer struct {
+	io.WriteCloser
+	meter *transfer_meter
+}
+
+func transfer_db() *DB {
+	db := db_open("db/transfer.db")
+	db.exec("create table if not exists transfer (month text not null, peer text not null, app text not null, user text not null, sent integer not null default 0, received integer not null default 0, primary key (month, peer, app, user))")
+	return db
+}
+
+// transfer_month returns the accounting month of a time
+func transfer_month(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// account counts a stream's bytes against a peer, app and local user
+func (s *Stream) account(peer, app, user string) {
+	if s == nil || peer == "" || peer == net_id {
+		return
+	}
+	m := &transfer_meter{peer: peer, app: app, user: user}
+	if s.reader != nil {
+		s.reader = &transfer_reader{ReadCloser: s.reader, meter: m}
+	}
+	if s.writer != nil {
+		s.writer = &transfer_writer{WriteCloser: s.writer, meter: m}
+	}
+}
+
+func (r *transfer_reader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.meter.received.Add(int64(n)) >= transfer_flush {
+		r.meter.flush()
+	}
+	return n, err
+}
+
+func (r *transfer_reader) Close() error {
+	r.meter.flush()
+	return r.ReadCloser.Close()
+}
+
+func (r *transfer_reader) CloseRead() error {
+	if cr, ok := r.ReadCloser.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return r.Close()
+}
+
+func (r *transfer_reader) SetReadDeadline(t time.Time) error {
+	if d, ok := r.ReadCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (w *transfer_writer) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if w.meter.sent.Add(int64(n)) >= transfer_flush {
+		w.meter.flush()
+	}
+	return n, err
+}
+
+func (w *transfer_writer) Close() error {
+	w.meter.flush()
+	return w.WriteCloser.Close()
+}
+
+func (w *transfer_writer) CloseWrite() error {
+	w.meter.flush()
+	if cw, ok := w.WriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return w.WriteCloser.Close()
+}
+
+func (w *transfer_writer) SetWriteDeadline(t time.Time) error {
+	if d, ok := w.WriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// flush adds what the meter has counted since its last flush to the totals
+func (m *transfer_meter) flush() {
+	sent := m.sent.Swap(0)
+	received := m.received.Swap(0)
+	if sent == 0 && received == 0 {
+		return
+	}
+	k := transfer_key{month: transfer_month(time.Now()), peer: m.peer, app: m.app, user: m.user}
+	transfer_lock.Lock()
+	t := transfer_pending[k]
+	if t == nil {
+		t = &TransferTotal{Month: k.month, Peer: k.peer, App: k.app, User: k.user}
+		transfer_pending[k] = t
+	}
+	t.Sent += sent
+	t.Received += received
+	transfer_lock.Unlock()
+}
+
+// transfer_save writes the pending totals to the database
+func transfer_save() {
+	transfer_lock.Lock()
+	pending := transfer_pending
+	transfer_pending = map[transfer_key]*TransferTotal{}
+	transfer_lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	db := transfer_db()
+	for _, t := range pending {
+		db.exec("insert into transfer (month, peer, app, user, sent, received) values (?, ?, ?, ?, ?, ?) on conflict(month, peer, app, user) do update set sent = transfer.sent + excluded.sent, received = transfer.received + excluded.received", t.Month, t.Peer, t.App, t.User, t.Sent, t.Received)
+	}
+}
+
+// transfer_manager saves totals each minute and drops months past retention
+func transfer_manager() {
+	for range time.Tick(time.Minute) {
+		transfer_save()
+		oldest := transfer_month(time.Now().AddDate(0, -transfer_months+1, 0))
+		transfer_db().exec("delete from transfer where month < ?", oldest)
+	}
+}
+
+// transfer_totals returns a month's totals, grouped by "peer", "app" or
+// "user", or as a single total if by is empty
+func transfer_totals(month, by string) []TransferTotal {
+	transfer_save()
+	group := ""
+	switch by {
+	case "peer", "app", "user":
+		group = ", " + by
+	}
+	var out []TransferTotal
+	rows, _ := transfer_db().rows("select month"+group+", sum(sent) as sent, sum(received) as received from transfer where month=? group by month"+group+" order by sum(sent) + sum(received) desc", month)
+	for _, r := range rows {
+		t := TransferTotal{Month: month, Sent: row_int(r, "sent"), Received: row_int(r, "received")}
+		switch by {
+		case "peer":
+			t.Peer, _ = r["peer"].(string)
+		case "app":
+			t.App, _ = r["app"].(string)
+		case "user":
+			t.User, _ = r["user"].(string)
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// transfer_used returns the bytes sent and received so far this month
+func transfer_used() int64 {
+	month := transfer_month(time.Now())
+	used := transfer_db().integer64("select coalesce(sum(sent) + sum(received), 0) from transfer where month=?", month)
+	transfer_lock.Lock()
+	for k, t := range transfer_pending {
+		if k.month == month {
+			used += t.Sent + t.Received
+		}
+	}
+	transfer_lock.Unlock()
+	return used
+}
+
+// transfer_cap returns the monthly transfer budget in bytes, or 0 if none
+func transfer_cap() int64 {
+	mb, _ := strconv.ParseInt(setting_get("transfer_cap", system_settings["transfer_cap"].Default), 10, 64)
+	return mb << 20
+}
+
+// transfer_paused reports whether low-priority sync should wait because this
+// month's transfer budget is used up
+func transfer_paused() bool {
+	limit := transfer_cap()
+	return limit > 0 && transfer_used() >= limit
+}
+
+// transfer_entity_user returns the local user owning an entity, or ""
+func transfer_entity_user(entity string) string {
+	if entity == "" {
+		return ""
+	}
+	row, _ := db_open("db/users.db").row("select user from entities where id=?", entity)
+	if row == nil {
+		return ""
+	}
+	user, _ := row["user"].(string)
+	return user
+}
+
+// mochi.server.transfer() -> dict: This month's network transfer. Returns
+// {month, sent, received, cap, paused}: bytes sent and received over P2P
+// streams, the monthly budget in bytes (0 if none), and whether low-priority
+// sync is paused because the budget is used up. Apps doing bulk background
+// sync should wait while paused is true.
+func api_server_transfer(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	month := transfer_month(time.Now())
+	total := TransferTotal{Month: month}
+	if totals := transfer_totals(month, ""); len(totals) > 0 {
+		total = totals[0]
+	}
+	limit := transfer_cap()
+	return sl_encode(map[string]any{
+		"month":    month,
+		"sent":     total.Sent,
+		"received": total.Received,
+		"cap":      limit,
+		"paused":   limit > 0 && total.Sent+total.Received >= limit,
+	}), nil
+}
@@ -0,0 +1,86 @@
+// Mochi server: Transfer accounting tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func transfer_test_setup(t *testing.T) {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	transfer_lock.Lock()
+	transfer_pending = map[transfer_key]*TransferTotal{}
+	transfer_lock.Unlock()
+}
+
+func TestTransferStreamCounted(t *testing.T) {
+	transfer_test_setup(t)
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	near := stream_rw(&pipe_reader{PipeReader: r2}, &pipe_writer{PipeWriter: w1})
+	far := stream_rw(&pipe_reader{PipeReader: r1}, &pipe_writer{PipeWriter: w2})
+	near.account("12D3KooWTransferPeer", "feeds", "u1")
+
+	go func() {
+		var v map[string]any
+		far.read(&v)
+		far.write(map[string]any{"answer": "0123456789"})
+		far.close()
+	}()
+	if err := near.write(map[string]any{"question": "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	var answer map[string]any
+	if err := near.read(&answer); err != nil {
+		t.Fatal(err)
+	}
+	near.close()
+
+	rows := transfer_totals(transfer_month(time.Now()), "app")
+	if len(rows) != 1 || rows[0].App != "feeds" || rows[0].Sent == 0 || rows[0].Received <= rows[0].Sent {
+		t.Fatalf("totals %+v", rows)
+	}
+	if rows := transfer_totals(transfer_month(time.Now()), "user"); len(rows) != 1 || rows[0].User != "u1" {
+		t.Errorf("user totals %+v", rows)
+	}
+}
+
+func TestTransferSelfNotCounted(t *testing.T) {
+	transfer_test_setup(t)
+	r, w := io.Pipe()
+	s := stream_rw(&pipe_reader{PipeReader: r}, &pipe_writer{PipeWriter: w})
+	s.account(net_id, "feeds", "u1")
+	if _, ok := s.writer.(*transfer_writer); ok {
+		t.Error("loopback stream counted")
+	}
+	s.close()
+}
+
+func TestTransferCapPauses(t *testing.T) {
+	transfer_test_setup(t)
+	if transfer_paused() {
+		t.Fatal("paused without a cap")
+	}
+	setting_set("transfer_cap", "1")
+	m := &transfer_meter{peer: "12D3KooWTransferPeer"}
+	m.received.Store(1 << 19)
+	m.flush()
+	if transfer_paused() {
+		t.Fatal("paused below the cap")
+	}
+	m.sent.Store(1 << 19)
+	m.flush()
+	transfer_save()
+	if !transfer_paused() {
+		t.Error("not paused at the cap")
+	}
+}
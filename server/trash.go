@@ -0,0 +1,308 @@
+// Mochi server: Trash
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// When an app deletes an object it can first put it in the trash with
+// mochi.trash.put(object, payload), passing whatever it needs to recreate
+// the object. The item is kept for the trash_retention setting's number of
+// days, or as many as the app asks for, and until then the app can list it
+// and restore it, getting the payload back. The object's attachments move
+// into the trash with it, their files left in place, and return on restore;
+// so an app should put an object in the trash before clearing its
+// attachments. Expired items are purged hourly, and their attachment files
+// deleted then.
+//
+// Items live in the owner's users/<uid>/trash.db, keyed by app.
+
+type TrashItem struct {
+	ID      string `db:"id"`
+	App     string `db:"app"`
+	Object  string `db:"object"`
+	Payload []byte `db:"payload"`
+	Created int64  `db:"created"`
+	Expires int64  `db:"expires"`
+}
+
+var api_trash = sls.FromStringDict(sl.String("mochi.trash"), sl.StringDict{
+	"empty":   sl.NewBuiltin("mochi.trash.empty", api_trash_empty),
+	"get":     sl.NewBuiltin("mochi.trash.get", api_trash_get),
+	"list":    sl.NewBuiltin("mochi.trash.list", api_trash_list),
+	"purge":   sl.NewBuiltin("mochi.trash.purge", api_trash_purge),
+	"put":     sl.NewBuiltin("mochi.trash.put", api_trash_put),
+	"restore": sl.NewBuiltin("mochi.trash.restore", api_trash_restore),
+})
+
+// trash_db opens a user's trash, creating its tables if needed
+func trash_db(u *User) *DB {
+	db := db_user(u, "trash")
+	db.exec("create table if not exists items (id text not null primary key, app text not null, object text not null, payload blob not null, created integer not null, expires integer not null)")
+	db.exec("create index if not exists items_app_created on items(app, created)")
+	db.exec("create index if not exists items_expires on items(expires)")
+	db.exec("create table if not exists attachments (item text not null, id text not null, object text not null, entity text not null default '', name text not null, size integer not null, content_type text not null default '', creator text not null default '', caption text not null default '', description text not null default '', rank integer not null default 0, created integer not null, primary key (item, id))")
+	return db
+}
+
+// trash_retention returns how long items are kept by default, in seconds
+func trash_retention() int64 {
+	days := atoi(setting_get("trash_retention", system_settings["trash_retention"].Default), 30)
+	if days < 1 {
+		days = 1
+	}
+	return days * 86400
+}
+
+// info returns an item as seen by its app
+func (i *TrashItem) info() map[string]any {
+	var payload any
+	if err := cbor_decode_mode.Unmarshal(i.Payload, &payload); err != nil {
+		payload = nil
+	}
+	return map[string]any{"id": i.ID, "object": i.Object, "payload": payload, "created": i.Created, "expires": i.Expires}
+}
+
+// trash_get returns an item of an app, or nil
+func trash_get(u *User, app, id string) *TrashItem {
+	var i TrashItem
+	if !trash_db(u).scan(&i, "select * from items where id=? and app=?", id, app) {
+		return nil
+	}
+	return &i
+}
+
+// trash_put puts an object in a user's trash for an app, moving its
+// attachments with it
+func trash_put(u *User, app *App, object string, payload any, period int64) *TrashItem {
+	t := now()
+	i := &TrashItem{ID: uid(), App: app.id, Object: object, Payload: cbor_encode(payload), Created: t, Expires: t + period}
+	db := trash_db(u)
+	db.exec("insert into items (id, app, object, payload, created, expires) values (?, ?, ?, ?, ?, ?)", i.ID, i.App, i.Object, i.Payload, i.Created, i.Expires)
+
+	if system := db_app_system(u, app); system != nil {
+		var attachments []Attachment
+		system.scans(&attachments, "select * from attachments where object=?", object)
+		for _, a := range attachments {
+			db.exec("insert into attachments (item, id, object, entity, name, size, content_type, creator, caption, description, rank, created) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", i.ID, a.ID, a.Object, a.Entity, a.Name, a.Size, a.ContentType, a.Creator, a.Caption, a.Description, a.Rank, a.Created)
+			system.row_remove(reg_attachments, map[string]any{"id": a.ID})
+		}
+	}
+	return i
+}
+
+// trash_restore takes an item out of the trash, returning its attachments
+// to the object
+func trash_restore(u *User, app *App, i *TrashItem) {
+	db := trash_db(u)
+	if system := db_app_system(u, app); system != nil {
+		var attachments []Attachment
+		db.scans(&attachments, "select id, object, entity, name, size, content_type, creator, caption, description, rank, created from attachments where item=?", i.ID)
+		for _, a := range attachments {
+			attachment_record_write(system, &a)
+		}
+	}
+	db.exec("delete from attachments where item=?", i.ID)
+	db.exec("delete from items where id=?", i.ID)
+}
+
+// trash_purge deletes an item for good, with its attachment files
+func trash_purge(u *User, i *TrashItem) {
+	db := trash_db(u)
+	rows, _ := db.rows("select id, name from attachments where item=?", i.ID)
+	if len(rows) > 0 {
+		if root, err := os.OpenRoot(attachment_files_base(u.UID, i.App)); err == nil {
+			for _, r := range rows {
+				id, _ := r["id"].(string)
+				name, _ := r["name"].(string)
+				attachment_files_remove(root, id, name)
+			}
+			root.Close()
+		}
+	}
+	db.exec("delete from attachments where item=?", i.ID)
+	db.exec("delete from items where id=?", i.ID)
+}
+
+// trash_expire purges a user's expired items, returning how many
+func trash_expire(u *User) int {
+	var items []TrashItem
+	trash_db(u).scans(&items, "select * from items where expires<=?", now())
+	for i := range items {
+		trash_purge(u, &items[i])
+	}
+	return len(items)
+}
+
+// trash_manager purges expired items hourly
+func trash_manager() {
+	for range time.Tick(time.Hour) {
+		rows, _ := db_open("db/users.db").rows("select uid from users")
+		for _, r := range rows {
+			id, _ := r["uid"].(string)
+			if id == "" || !file_exists(filepath.Join(data_dir, "users", id, "trash.db")) {
+				continue
+			}
+			if u := user_by_uid(id); u != nil {
+				if n := trash_expire(u); n > 0 {
+					debug("Trash purged %d expired items for user %q", n, id)
+				}
+			}
+		}
+	}
+}
+
+// trash_caller returns the user whose trash the calling app uses, and the app
+func trash_caller(t *sl.Thread) (*User, *App, error) {
+	app, _ := t.Local("app").(*App)
+	if app == nil {
+		return nil, nil, fmt.Errorf("no app")
+	}
+	owner, _ := t.Local("owner").(*User)
+	if owner == nil {
+		return nil, nil, fmt.Errorf("no owner")
+	}
+	return owner, app, nil
+}
+
+// mochi.trash.put(object, payload, days?) -> string: Put a deleted object
+// in the trash with the payload needed to restore it, and move its
+// attachments with it. Kept for days, or the server's trash_retention.
+// Returns the item id.
+func api_trash_put(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	var payload sl.Value
+	var days int
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object", &object, "payload", &payload, "days?", &days); err != nil {
+		return nil, err
+	}
+	owner, app, err := trash_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if !valid(object, "path") {
+		return sl_error(fn, "invalid object")
+	}
+	if days < 0 || days > 3650 {
+		return sl_error(fn, "invalid days")
+	}
+	period := trash_retention()
+	if days > 0 {
+		period = int64(days) * 86400
+	}
+	return sl.String(trash_put(owner, app, object, sl_decode(payload), period).ID), nil
+}
+
+// mochi.trash.list(object?) -> list: List the app's items in the trash,
+// newest first, optionally for one object
+func api_trash_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var object string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "object?", &object); err != nil {
+		return nil, err
+	}
+	owner, app, err := trash_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	var items []TrashItem
+	if object == "" {
+		err = trash_db(owner).scans(&items, "select * from items where app=? and expires>? order by created desc", app.id, now())
+	} else {
+		err = trash_db(owner).scans(&items, "select * from items where app=? and object=? and expires>? order by created desc", app.id, object, now())
+	}
+	if err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	results := make([]any, len(items))
+	for i := range items {
+		results[i] = items[i].info()
+	}
+	return sl_encode(results), nil
+}
+
+// mochi.trash.get(id) -> dict | None: Get an item in the trash
+func api_trash_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+	owner, app, err := trash_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	i := trash_get(owner, app.id, id)
+	if i == nil {
+		return sl.None, nil
+	}
+	return sl_encode(i.info()), nil
+}
+
+// mochi.trash.restore(id) -> dict | None: Take an item out of the trash and
+// return its attachments to its object. Returns the item, whose payload the
+// app uses to recreate the object, or None if it is not in the trash.
+func api_trash_restore(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+	owner, app, err := trash_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	i := trash_get(owner, app.id, id)
+	if i == nil {
+		return sl.None, nil
+	}
+	trash_restore(owner, app, i)
+	return sl_encode(i.info()), nil
+}
+
+// mochi.trash.purge(id) -> bool: Delete an item from the trash for good
+func api_trash_purge(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+	owner, app, err := trash_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	i := trash_get(owner, app.id, id)
+	if i == nil {
+		return sl.False, nil
+	}
+	trash_purge(owner, i)
+	return sl.True, nil
+}
+
+// mochi.trash.empty() -> int: Delete all the app's items from the trash for
+// good. Returns how many were deleted.
+func api_trash_empty(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	owner, app, err := trash_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	var items []TrashItem
+	if err := trash_db(owner).scans(&items, "select * from items where app=?", app.id); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	for i := range items {
+		trash_purge(owner, &items[i])
+	}
+	return sl.MakeInt(len(items)), nil
+}
@@ -0,0 +1,90 @@
+// Mochi server: Trash tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+// trash_test_setup creates a user and app with one attachment on note/1
+func trash_test_setup(t *testing.T) (*User, *App, string) {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	user := create_permission_test_user(t, "u1")
+	app := create_external_app("notes")
+	att := &Attachment{ID: uid(), Object: "note/1", Name: "photo.jpg", Size: 5, Created: now()}
+	attachment_record_write(db_app_system(user, app), att)
+	base := attachment_files_base(user.UID, app.id)
+	os.MkdirAll(base, 0755)
+	file := filepath.Join(base, attachment_filename(att.ID, att.Name))
+	os.WriteFile(file, []byte("hello"), 0644)
+	return user, app, file
+}
+
+func TestTrashRestore(t *testing.T) {
+	user, app, file := trash_test_setup(t)
+	i := trash_put(user, app, "note/1", map[string]any{"title": "Shopping", "pinned": int64(1)}, 86400)
+	system := db_app_system(user, app)
+	if n := system.integer("select count(*) from attachments where object='note/1'"); n != 0 {
+		t.Fatalf("attachment still on trashed object: %d", n)
+	}
+	if !file_exists(file) {
+		t.Fatal("attachment file deleted on put")
+	}
+
+	if trash_get(user, "other", i.ID) != nil {
+		t.Error("item visible to another app")
+	}
+	got := trash_get(user, app.id, i.ID)
+	trash_restore(user, app, got)
+	payload, _ := got.info()["payload"].(map[any]any)
+	if payload["title"] != "Shopping" {
+		t.Errorf("payload not returned: %v", got.info())
+	}
+	if n := system.integer("select count(*) from attachments where object='note/1'"); n != 1 {
+		t.Errorf("attachment not restored: %d", n)
+	}
+	if trash_get(user, app.id, i.ID) != nil {
+		t.Error("restored item still in trash")
+	}
+}
+
+func TestTrashExpire(t *testing.T) {
+	user, app, file := trash_test_setup(t)
+	keep := trash_put(user, create_external_app("other"), "note/2", "keep", 86400)
+	i := trash_put(user, app, "note/1", "gone", 86400)
+	trash_db(user).exec("update items set expires=? where id=?", now()-1, i.ID)
+
+	if n := trash_expire(user); n != 1 {
+		t.Fatalf("expired %d items, want 1", n)
+	}
+	if file_exists(file) {
+		t.Error("attachment file kept after purge")
+	}
+	if trash_get(user, "other", keep.ID) == nil {
+		t.Error("unexpired item purged")
+	}
+}
+
+func TestTrashPutValidation(t *testing.T) {
+	user, app, _ := trash_test_setup(t)
+	thread := create_test_thread(user, app)
+	thread.SetLocal("owner", user)
+	put, _ := api_trash.Attr("put")
+
+	if _, err := sl.Call(thread, put, sl.Tuple{sl.String("../escape"), sl.None}, nil); err == nil {
+		t.Error("invalid object accepted")
+	}
+	if _, err := sl.Call(thread, put, sl.Tuple{sl.String("note/1"), sl.None}, []sl.Tuple{{sl.String("days"), sl.MakeInt(-1)}}); err == nil {
+		t.Error("negative days accepted")
+	}
+}
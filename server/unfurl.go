@@ -0,0 +1,346 @@
+// Mochi server: Link previews
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	sl "go.starlark.net/starlark"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// mochi.unfurl fetches a linked page server-side and returns what a link
+// card shows: its title, description, image, site name and icon, from its
+// Open Graph and Twitter meta tags, falling back to its <title> and
+// description. A page that links to an oEmbed endpoint, as YouTube and
+// others do, adds the provider's details from it, though never its embed
+// HTML, which would run in the app's page. The page and the endpoint are
+// fetched under the app's url: permissions, and outbound requests can't
+// reach private addresses whatever the permissions. Cards are cached for
+// everyone on the server for unfurl_ttl, and failures for unfurl_fail_ttl
+// so a dead link isn't fetched again for every viewer.
+
+const (
+	unfurl_ttl         = 6 * 3600
+	unfurl_fail_ttl    = 600
+	unfurl_page_max    = 16 << 20 // Bytes of a page read for its <head>
+	unfurl_oembed_max  = 1 << 20
+	unfurl_text_max    = 1000 // Longest description kept
+	unfurl_title_max   = 300
+	unfurl_user_agent  = "Mozilla/5.0 (compatible; MochiBot/1.0; +https://mochi-os.org)"
+	unfurl_accept_html = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+)
+
+// unfurl_page holds what was read from a page's <head>
+type unfurl_page struct {
+	meta   map[string]string
+	title  string
+	icon   string
+	oembed string
+}
+
+// unfurl_text tidies text from a page for display: whitespace collapsed,
+// and cut to at most limit runes
+func unfurl_text(s string, limit int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > limit {
+		s = strings.TrimSpace(string(r[:limit-1])) + "…"
+	}
+	return s
+}
+
+// unfurl_resolve resolves a link from a page against its address, keeping
+// it only if it's http or https
+func unfurl_resolve(base *url.URL, link string) string {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return ""
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	u := base.ResolveReference(ref)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
+
+// unfurl_read reads the meta tags, title, icon and oEmbed link from a page's
+// <head>, stopping at its <body>
+func unfurl_read(body io.Reader) unfurl_page {
+	page := unfurl_page{meta: map[string]string{}}
+	z := html.NewTokenizer(body)
+	in_title := false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return page
+
+		case html.TextToken:
+			if in_title {
+				page.title += string(z.Text())
+			}
+
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "head":
+				return page
+			case "title":
+				in_title = false
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, more := z.TagName()
+			tag := string(name)
+			if tag == "body" {
+				return page
+			}
+			if tag == "title" && tt == html.StartTagToken {
+				in_title = page.title == ""
+				continue
+			}
+			attrs := map[string]string{}
+			for more {
+				var k, v []byte
+				k, v, more = z.TagAttr()
+				attrs[string(k)] = string(v)
+			}
+			switch tag {
+			case "meta":
+				key := strings.ToLower(attrs["property"])
+				if key == "" {
+					key = strings.ToLower(attrs["name"])
+				}
+				if _, found := page.meta[key]; key != "" && !found && attrs["content"] != "" {
+					page.meta[key] = attrs["content"]
+				}
+			case "link":
+				rel := strings.Fields(strings.ToLower(attrs["rel"]))
+				switch {
+				case page.icon == "" && (slices.Contains(rel, "icon") || slices.Contains(rel, "apple-touch-icon")):
+					page.icon = attrs["href"]
+				case page.oembed == "" && slices.Contains(rel, "alternate") && strings.EqualFold(attrs["type"], "application/json+oembed"):
+					page.oembed = attrs["href"]
+				}
+			}
+		}
+	}
+}
+
+// unfurl_card builds a link card from a page at address
+func unfurl_card(page unfurl_page, address *url.URL) map[string]any {
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := strings.TrimSpace(page.meta[k]); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	card := map[string]any{"url": address.String(), "type": "website"}
+	// A page may name its canonical address, but not one on another site
+	if canonical := unfurl_resolve(address, first("og:url")); canonical != "" {
+		if u, _ := url.Parse(canonical); u != nil && strings.EqualFold(u.Hostname(), address.Hostname()) {
+			card["url"] = canonical
+		}
+	}
+	if t := unfurl_text(first("og:type"), 50); t != "" {
+		card["type"] = t
+	}
+	fields := []struct {
+		key   string
+		value string
+		limit int
+	}{
+		{"title", first("og:title", "twitter:title"), unfurl_title_max},
+		{"description", first("og:description", "twitter:description", "description"), unfurl_text_max},
+		{"site", first("og:site_name", "application-name"), unfurl_title_max},
+	}
+	if fields[0].value == "" {
+		fields[0].value = page.title
+	}
+	for _, f := range fields {
+		if v := unfurl_text(f.value, f.limit); v != "" {
+			card[f.key] = v
+		}
+	}
+	if image := unfurl_resolve(address, first("og:image:secure_url", "og:image", "og:image:url", "twitter:image", "twitter:image:src")); image != "" {
+		card["image"] = image
+		if alt := unfurl_text(first("og:image:alt", "twitter:image:alt"), unfurl_text_max); alt != "" {
+			card["image_alt"] = alt
+		}
+	}
+	if icon := unfurl_resolve(address, page.icon); icon != "" {
+		card["icon"] = icon
+	}
+	return card
+}
+
+// unfurl_oembed adds the details of a page's oEmbed response to its card
+func unfurl_oembed(card map[string]any, body io.Reader) {
+	var o map[string]any
+	if json.NewDecoder(io.LimitReader(body, unfurl_oembed_max)).Decode(&o) != nil {
+		return
+	}
+	text := func(key string) string {
+		s, _ := o[key].(string)
+		return unfurl_text(s, unfurl_title_max)
+	}
+	embed := map[string]any{}
+	for key, name := range map[string]string{"type": "type", "provider_name": "provider", "author_name": "author", "title": "title"} {
+		if v := text(key); v != "" {
+			embed[name] = v
+		}
+	}
+	base, _ := url.Parse(card["url"].(string))
+	for key, name := range map[string]string{"provider_url": "provider_url", "author_url": "author_url", "thumbnail_url": "thumbnail"} {
+		if s, ok := o[key].(string); ok {
+			if v := unfurl_resolve(base, s); v != "" {
+				embed[name] = v
+			}
+		}
+	}
+	for _, key := range []string{"width", "height"} {
+		if n, ok := o[key].(float64); ok && n > 0 {
+			embed[key] = int(n)
+		}
+	}
+	if len(embed) == 0 {
+		return
+	}
+	card["oembed"] = embed
+	if card["title"] == nil && embed["title"] != nil {
+		card["title"] = embed["title"]
+	}
+	if card["image"] == nil && embed["thumbnail"] != nil {
+		card["image"] = embed["thumbnail"]
+	}
+	if card["site"] == nil && embed["provider"] != nil {
+		card["site"] = embed["provider"]
+	}
+}
+
+// unfurl_cache_path returns where the card for an address is cached
+func unfurl_cache_path(address string) string {
+	h := sha256.Sum256([]byte(address))
+	return filepath.Join(cache_dir, "unfurl", hex.EncodeToString(h[:]))
+}
+
+// mochi.unfurl(url) -> dict or None: A link card for a web page, with its url, type, and where
+// the page has them title, description, site, image, image_alt, icon and oembed. None if the page
+// can't be fetched.
+func api_unfurl(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 1 {
+		return sl_error(fn, "syntax: <url: string>")
+	}
+
+	rawurl, ok := sl.AsString(args[0])
+	if !ok {
+		return sl_error(fn, "invalid URL")
+	}
+	address, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+		return sl_error(fn, "invalid URL")
+	}
+	address.Fragment = ""
+
+	if err := require_permission_url(t, fn, address.String()); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	path := unfurl_cache_path(address.String())
+	if v, found := cache_value_get(path); found {
+		if m, ok := v.(map[any]any); ok && len(m) > 0 {
+			return sl_encode(m), nil
+		}
+		return sl.None, nil
+	}
+
+	app, _ := t.Local("app").(*App)
+	if app != nil && !rate_limit_url.allow(app.id) {
+		return sl.None, nil
+	}
+
+	card := unfurl_fetch(t, fn, address)
+	ttl := int64(unfurl_ttl)
+	if card == nil {
+		ttl = unfurl_fail_ttl
+	}
+	cache_value_set(path, cbor_encode(card), ttl)
+	if card == nil {
+		return sl.None, nil
+	}
+	return sl_encode(card), nil
+}
+
+// unfurl_fetch fetches a page, and its oEmbed response if it has one and
+// the app may fetch it, and returns its card or nil
+func unfurl_fetch(t *sl.Thread, fn *sl.Builtin, address *url.URL) map[string]any {
+	domains := url_domains_granted(t)
+	headers := map[string]string{"User-Agent": unfurl_user_agent, "Accept": unfurl_accept_html}
+	r, err := url_request(starlark_context(t), "GET", address.String(), map[string]string{"timeout": "10"}, headers, nil, domains...)
+	if err != nil {
+		return nil
+	}
+	// Finish with the page before fetching oEmbed, so its connection is
+	// free to be reused
+	card, endpoint := unfurl_response(r, address)
+	r.Body.Close()
+
+	if card != nil && endpoint != "" && require_permission_url(t, fn, endpoint) == nil {
+		o, err := url_request(starlark_context(t), "GET", endpoint, map[string]string{"timeout": "10"}, map[string]string{"User-Agent": unfurl_user_agent, "Accept": "application/json"}, nil, domains...)
+		if err == nil {
+			if o.StatusCode >= 200 && o.StatusCode < 300 {
+				unfurl_oembed(card, o.Body)
+			}
+			o.Body.Close()
+		}
+	}
+	return card
+}
+
+// unfurl_response reads a fetched page, returning its card or nil, and the
+// oEmbed endpoint it links to if any
+func unfurl_response(r *http.Response, address *url.URL) (map[string]any, string) {
+	if r.StatusCode < 200 || r.StatusCode >= 300 {
+		return nil, ""
+	}
+	if r.Request != nil && r.Request.URL != nil {
+		address = r.Request.URL
+	}
+
+	// A link straight to an image or other file is its own card
+	content_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if content_type != "" && content_type != "text/html" && content_type != "application/xhtml+xml" {
+		card := map[string]any{"url": address.String(), "type": content_type}
+		if strings.HasPrefix(content_type, "image/") && content_type != "image/svg+xml" {
+			card["image"] = address.String()
+		}
+		return card, ""
+	}
+
+	body, err := charset.NewReader(io.LimitReader(r.Body, unfurl_page_max), r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, ""
+	}
+	page := unfurl_read(body)
+	return unfurl_card(page, address), unfurl_resolve(address, page.oembed)
+}
@@ -0,0 +1,137 @@
+// Mochi server: Link preview tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	sl "go.starlark.net/starlark"
+)
+
+func TestUnfurlCard(t *testing.T) {
+	page := unfurl_read(strings.NewReader(`<html><head>
+<title>  Fallback
+  title </title>
+<meta property="og:title" content="Cats &amp; dogs">
+<meta name="description" content="All about pets">
+<meta property="og:image" content="/images/cat.jpg">
+<meta property="og:url" content="https://elsewhere.example/phish">
+<meta name="twitter:image" content="javascript:alert(1)">
+<link rel="shortcut icon" href="favicon.png">
+<link rel="alternate" type="application/json+oembed" href="/oembed?url=x">
+</head><body><meta property="og:description" content="Not in the head"></body></html>`))
+
+	base, _ := url.Parse("https://pets.example/articles/1")
+	card := unfurl_card(page, base)
+	want := map[string]any{
+		"url":         "https://pets.example/articles/1",
+		"type":        "website",
+		"title":       "Cats & dogs",
+		"description": "All about pets",
+		"image":       "https://pets.example/images/cat.jpg",
+		"icon":        "https://pets.example/articles/favicon.png",
+	}
+	for k, v := range want {
+		if card[k] != v {
+			t.Errorf("%s %q, want %q", k, card[k], v)
+		}
+	}
+	if page.oembed != "/oembed?url=x" {
+		t.Errorf("oEmbed link %q", page.oembed)
+	}
+
+	card = unfurl_card(unfurl_read(strings.NewReader(`<title>Only a title</title><meta name="twitter:image" content="javascript:alert(1)">`)), base)
+	if card["title"] != "Only a title" || card["image"] != nil {
+		t.Errorf("card %v", card)
+	}
+
+	unfurl_oembed(card, strings.NewReader(`{"type": "video", "provider_name": "Tube", "thumbnail_url": "https://img.example/t.jpg", "width": 640, "html": "<iframe src=x>"}`))
+	embed, _ := card["oembed"].(map[string]any)
+	if embed["type"] != "video" || embed["width"] != 640 || embed["html"] != nil || card["site"] != "Tube" || card["image"] != "https://img.example/t.jpg" {
+		t.Errorf("oEmbed card %v", card)
+	}
+
+	if s := unfurl_text(strings.Repeat("a", 20), 10); s != strings.Repeat("a", 9)+"…" {
+		t.Errorf("shortened %q", s)
+	}
+}
+
+func TestUnfurl(t *testing.T) {
+	allow_private_for_test(t)
+	// Drop pooled connections before the guard is restored under them
+	t.Cleanup(url_transport.CloseIdleConnections)
+	original := cache_dir
+	cache_dir = t.TempDir()
+	t.Cleanup(func() { cache_dir = original })
+
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+			w.Write([]byte("<head><title>Caf\xe9</title><link rel=alternate type=application/json+oembed href=/oembed></head>"))
+		case "/oembed":
+			w.Write([]byte(`{"type": "rich", "author_name": "Jo"}`))
+		case "/photo":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	thread := &sl.Thread{}
+	thread.SetLocal("app", &App{id: "chat", internal: &AppVersion{}})
+	unfurl := sl.NewBuiltin("mochi.unfurl", api_unfurl)
+	call := func(address string) *sl.Dict {
+		t.Helper()
+		v, err := sl.Call(thread, unfurl, sl.Tuple{sl.String(address)}, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+		d, _ := v.(*sl.Dict)
+		return d
+	}
+	field := func(d *sl.Dict, key string) string {
+		v, _, _ := d.Get(sl.String(key))
+		s, _ := sl.AsString(v)
+		return s
+	}
+
+	card := call(server.URL + "/page#top")
+	if card == nil || field(card, "title") != "Café" || field(card, "url") != server.URL+"/page" {
+		t.Fatalf("card %v", card)
+	}
+	if embed, _, _ := card.Get(sl.String("oembed")); embed == nil {
+		t.Errorf("no oEmbed details in %v", card)
+	}
+	if card := call(server.URL + "/photo"); field(card, "image") != server.URL+"/photo" || field(card, "type") != "image/png" {
+		t.Errorf("image card %v", card)
+	}
+
+	// Cards, and failures, come from the cache the second time
+	if card := call(server.URL + "/missing"); card != nil {
+		t.Errorf("card for a missing page %v", card)
+	}
+	before := fetches.Load()
+	call(server.URL + "/page")
+	call(server.URL + "/missing")
+	if fetches.Load() != before {
+		t.Errorf("fetched %d times again", fetches.Load()-before)
+	}
+
+	if _, err := sl.Call(thread, unfurl, sl.Tuple{sl.String("file:///etc/passwd")}, nil); err == nil {
+		t.Error("unfurled a file URL")
+	}
+}
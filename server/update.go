@@ -450,25 +450,28 @@ func update_install_download(url, dest string, release update_release) error {
 	return nil
 }
 
-// update_notify_admins dispatches one Mochi notification per administrator
-// for the new version. The notifications service is invoked with app="" so
-// the receiving user sees the sender as "Mochi server". Title and body are
-// resolved per-recipient against core labels so each admin sees the
-// notification in their own language.
+// update_notify_admins tells each administrator about the new version
 func update_notify_admins(latest string) {
+	administrators_notify("upgrade/available", "/settings/system/status", "update.notification", map[string]any{"version": latest, "current": build_version})
+}
+
+// administrators_notify dispatches one Mochi notification per administrator.
+// The notifications service is invoked with app="" so the receiving user
+// sees the sender as "Mochi server". The title, body and topic label are
+// the core labels <key>.title, <key>.body and <key>.topic, resolved
+// per-recipient so each admin sees the notification in their own language.
+func administrators_notify(topic, link, key string, values map[string]any) {
 	db := db_open("db/users.db")
 	rows, err := db.rows("select uid, username from users where role = ?", "administrator")
 	if err != nil {
-		warn("Server update: list admins: %v", err)
+		warn("Notify administrators %q: list admins: %v", topic, err)
 		return
 	}
 	if len(rows) == 0 {
-		info("Server update: no administrators to notify")
+		info("Notify administrators %q: no administrators to notify", topic)
 		return
 	}
 
-	link := "/settings/system/status"
-
 	for _, row := range rows {
 		id, _ := row["uid"].(string)
 		if id == "" {
@@ -479,21 +482,17 @@ func update_notify_admins(latest string) {
 			continue
 		}
 		lang := user_language(user)
-		title := resolve_core_label(lang, "update.notification.title", map[string]any{"version": latest})
-		body := resolve_core_label(lang, "update.notification.body", map[string]any{"current": build_version})
-		topic_label := resolve_core_label(lang, "update.notification.topic", nil)
-
 		args := Map{
-			"topic":  "upgrade/available",
+			"topic":  topic,
 			"object": "",
-			"title":  title,
-			"body":   body,
+			"title":  resolve_core_label(lang, key+".title", values),
+			"body":   resolve_core_label(lang, key+".body", values),
 			"url":    link,
-			"label":  topic_label,
+			"label":  resolve_core_label(lang, key+".topic", nil),
 			"count":  int64(1),
 		}
 		if err := service_call_as_server(id, "notifications", "send", args); err != nil {
-			info("Server update: notify user %q: %v", id, err)
+			info("Notify administrators %q: notify user %q: %v", topic, id, err)
 		}
 	}
 }
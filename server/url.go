@@ -0,0 +1,745 @@
+// Mochi server: Outbound HTTP client options
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	"golang.org/x/net/proxy"
+)
+
+// Retry bounds. An app may ask for a few retries of a flaky upstream, but not
+// enough to turn one call into a sustained load on it, and the wait between
+// attempts is capped so a hostile Retry-After cannot park the call.
+const (
+	url_max_retries     = 5
+	url_retry_max_delay = 30 * time.Second
+)
+
+// First retry delay, doubled for each further attempt. A variable so tests
+// need not wait whole seconds.
+var url_retry_base = 1 * time.Second
+
+var (
+	// url_insecure_hosts lists the hosts an app may reach with
+	// tls="insecure", skipping certificate verification. Only an
+	// administrator can add to it, through [url] insecure in mochi.conf;
+	// it exists for internal services with self-signed certificates.
+	url_insecure_hosts []string
+
+	url_transport_insecure      *http.Transport
+	url_transport_insecure_once sync.Once
+
+	// url_proxy is the proxy from [url] proxy that outbound requests go
+	// through, unless an app has its own in [egress]
+	url_proxy url_egress
+
+	// url_egress_apps caches each app's [egress] policy, read when first
+	// needed
+	url_egress_apps      = map[string]*url_egress{}
+	url_egress_apps_lock sync.Mutex
+
+	// url_private_networks are the non-public networks the administrator
+	// lets outbound requests reach, from [url] private
+	url_private_networks []*net.IPNet
+
+	// url_redirects_max is how many redirects a request follows, from
+	// [url] redirects
+	url_redirects_max = 10
+)
+
+// url_configure applies the [url] section: an extra CA bundle trusted for
+// every outbound request, and the hosts that may skip verification. Call
+// after ini_load.
+func url_configure() {
+	if !ini_loaded() {
+		return
+	}
+	url_insecure_hosts = nil
+	for _, host := range ini_strings_commas("url", "insecure") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			url_insecure_hosts = append(url_insecure_hosts, host)
+		}
+	}
+	url_proxy_configure(ini_string("url", "proxy", ""))
+	url_private_networks = url_networks(ini_strings_commas("url", "private"))
+	url_redirects_max = max(0, min(ini_int("url", "redirects", 10), 20))
+
+	ca := ini_string("url", "ca", "")
+	if ca == "" {
+		return
+	}
+	pem, err := os.ReadFile(ca)
+	if err != nil {
+		warn("Unable to read [url] ca %q: %v", ca, err)
+		return
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		warn("No certificates found in [url] ca %q", ca)
+		return
+	}
+	url_transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	info("Outbound HTTP trusting additional certificate authorities from %q", ca)
+}
+
+// url_egress is where an app's outbound requests may go, and what they go
+// through to get there. Each app's policy has its own transports, so a
+// connection made through one proxy is never reused by a request that
+// should have gone directly or through another.
+type url_egress struct {
+	domains   []string            // Hosts the app may reach, or nil for any its url: permissions allow
+	http      *neturl.URL         // HTTP or HTTPS proxy
+	socks     proxy.ContextDialer // SOCKS proxy
+	name      string              // Proxy host, for logging
+	transport *http.Transport     // Connections following this policy
+	insecure  *http.Transport     // The same, skipping certificate verification
+}
+
+// url_egress_key carries the app making a request in its context
+type url_egress_key struct{}
+
+// url_egress_context marks a context as an app's, so requests made with it
+// follow the app's policy
+func url_egress_context(ctx context.Context, app string) context.Context {
+	return context.WithValue(ctx, url_egress_key{}, app)
+}
+
+// url_proxy_parse reads a proxy URL: http:// or https:// for an HTTP proxy,
+// which is sent CONNECT for https URLs, or socks5:// for a SOCKS one
+func url_proxy_parse(raw string) (url_egress, error) {
+	u, err := neturl.Parse(raw)
+	if err != nil || u.Host == "" {
+		return url_egress{}, fmt.Errorf("use http://, https:// or socks5://host:port")
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return url_egress{http: u, name: u.Host}, nil
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return url_egress{}, err
+		}
+		return url_egress{socks: d.(proxy.ContextDialer), name: u.Host}, nil
+	}
+	return url_egress{}, fmt.Errorf("use http://, https:// or socks5://host:port")
+}
+
+// url_proxy_configure sends outbound requests through a proxy, given as
+// http://, https:// or socks5://[user:password@]host:port
+func url_proxy_configure(raw string) {
+	url_proxy = url_egress{}
+	url_egress_apps_lock.Lock()
+	for _, e := range url_egress_apps {
+		e.transport.CloseIdleConnections()
+		e.insecure.CloseIdleConnections()
+	}
+	clear(url_egress_apps)
+	url_egress_apps_lock.Unlock()
+	url_transport.CloseIdleConnections()
+	if raw == "" {
+		return
+	}
+	p, err := url_proxy_parse(raw)
+	if err != nil {
+		warn("Ignoring [url] proxy %q: %v", raw, err)
+		return
+	}
+	url_proxy = p
+	info("Outbound HTTP through proxy %s", p.name)
+}
+
+// url_egress_for returns the policy for requests made with ctx: the app's
+// from [egress] "<app>" and "<app>.proxy", falling back to [url] proxy.
+// Requests without an app follow [url] proxy through url_transport.
+func url_egress_for(ctx context.Context) *url_egress {
+	app, _ := ctx.Value(url_egress_key{}).(string)
+	if app == "" {
+		return &url_proxy
+	}
+	url_egress_apps_lock.Lock()
+	defer url_egress_apps_lock.Unlock()
+	if e, found := url_egress_apps[app]; found {
+		return e
+	}
+	e := url_egress{http: url_proxy.http, socks: url_proxy.socks, name: url_proxy.name}
+	for _, domain := range ini_strings_commas("egress", app) {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			e.domains = append(e.domains, domain)
+		}
+	}
+	if raw := ini_string("egress", app+".proxy", ""); raw != "" {
+		p, err := url_proxy_parse(raw)
+		if err != nil {
+			warn("Ignoring [egress] %s.proxy %q: %v", app, raw, err)
+		} else {
+			e.http, e.socks, e.name = p.http, p.socks, p.name
+		}
+	}
+	e.transport = url_transport.Clone()
+	e.transport.Proxy = e.select_proxy
+	e.transport.DialContext = e.dial
+	e.insecure = e.transport.Clone()
+	e.insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	url_egress_apps[app] = &e
+	return &e
+}
+
+// url_proxy_select is url_transport's Proxy, following [url] proxy
+func url_proxy_select(r *http.Request) (*neturl.URL, error) {
+	return url_proxy.select_proxy(r)
+}
+
+// select_proxy is the Proxy of a policy's transports. The transport asks it
+// for every request, redirects included, so it's where an app's egress
+// allowlist is applied, on top of its url: permissions. For an HTTP proxy it
+// applies the destination guard too, since the dialer then only sees the
+// proxy's address.
+func (e *url_egress) select_proxy(r *http.Request) (*neturl.URL, error) {
+	host := strings.ToLower(r.URL.Hostname())
+	if e.domains != nil && !slices.ContainsFunc(e.domains, func(d string) bool { return domain_matches(d, host) }) {
+		return nil, fmt.Errorf("%s is not allowed by the server's egress policy for this app", host)
+	}
+	if e.http == nil {
+		return nil, nil
+	}
+	if _, err := url_proxy_allowed(r.Context(), url_address(r.URL)); err != nil {
+		return nil, err
+	}
+	return e.http, nil
+}
+
+// url_address returns the host and port a URL connects to
+func url_address(u *neturl.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if strings.EqualFold(u.Scheme, "https") {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// url_dial is url_transport's dialer, following [url] proxy
+func url_dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return url_proxy.dial(ctx, network, address)
+}
+
+// dial is the dialer of a policy's transports. Without a proxy it connects
+// directly, refusing non-public destinations. Through an HTTP proxy the only
+// connection is to the proxy, which is allowed wherever it is, as the
+// administrator chose it. Through a SOCKS proxy each destination passes the
+// guard first.
+func (e *url_egress) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	switch {
+	case e.http != nil:
+		if address != url_address(e.http) {
+			return nil, fmt.Errorf("blocked outbound request to %q bypassing the proxy", address)
+		}
+		return url_proxy_dialer.DialContext(ctx, network, address)
+	case e.socks != nil:
+		pinned, err := url_proxy_allowed(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		return e.socks.DialContext(ctx, network, pinned)
+	}
+	return url_dialer.DialContext(ctx, network, address)
+}
+
+// url_proxy_dialer connects to an HTTP proxy
+var url_proxy_dialer = &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+
+// url_proxy_allowed applies the destination guard to an address about to
+// be sent to a proxy, returning the address to send. The proxy is handed
+// the host name only for .onion names; any other name is resolved here,
+// refused if an address it has isn't public, and sent as the address that
+// was checked, so a name that resolves differently a second time can't
+// slip past. An HTTP proxy is always given the name, as CONNECT needs it.
+func url_proxy_allowed(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("blocked outbound request to invalid address %q", address)
+	}
+	if strings.HasSuffix(strings.ToLower(host), ".onion") {
+		return address, nil
+	}
+	if net.ParseIP(host) != nil {
+		return address, url_address_allowed(address)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("blocked outbound request to unresolvable address %q", address)
+	}
+	for _, ip := range ips {
+		if err := url_address_allowed(net.JoinHostPort(ip.IP.String(), port)); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+// url_networks parses the networks in [url] private, given as CIDR
+// ranges or single addresses
+func url_networks(entries []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			warn("Ignoring [url] private %q; use an address or CIDR range", entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// url_scheme_allowed reports whether an outbound request may use a URL's
+// scheme. Only http and https are fetched, whatever the caller.
+func url_scheme_allowed(rawurl string) bool {
+	u, err := neturl.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return (scheme == "http" || scheme == "https") && u.Host != ""
+}
+
+// url_redirect_check returns the redirect policy for an outbound request.
+// The dialer already refuses non-public destinations on each hop; this adds
+// the metadata-name, scheme, hop-count and granted-domain limits on top. It
+// applies to every caller, not only those that pass allowed domains: RSS
+// fetching, link previews and peer discovery supply none.
+func url_redirect_check(options map[string]string, allowed_domains []string) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if url_is_cloud_metadata(req.URL.String()) {
+			return fmt.Errorf("redirect to cloud metadata service is blocked")
+		}
+		if !url_scheme_allowed(req.URL.String()) {
+			return fmt.Errorf("redirect to unsupported URL scheme %q", req.URL.Scheme)
+		}
+		if len(via) > url_redirects_max {
+			return fmt.Errorf("too many redirects")
+		}
+		// The insecure transport applies to every hop, so each one must be
+		// an approved host, not just the first
+		if options["tls"] == "insecure" && !url_host_insecure(req.URL.String()) {
+			return fmt.Errorf("redirect to %s not permitted without TLS verification", req.URL.Hostname())
+		}
+		if len(allowed_domains) == 0 {
+			return nil
+		}
+		redirect_host := strings.ToLower(req.URL.Hostname())
+		for _, domain := range allowed_domains {
+			if domain_matches(domain, redirect_host) {
+				return nil
+			}
+		}
+		return fmt.Errorf("redirect to %s not allowed by granted url permissions", redirect_host)
+	}
+}
+
+// url_client returns a client with the outbound guard, for server-side
+// requests to user-supplied addresses that don't go through url_request,
+// such as notification webhooks
+func url_client(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: url_transport, CheckRedirect: url_redirect_check(nil, nil)}
+}
+
+// url_host_insecure reports whether the administrator has allowed
+// unverified TLS to the host of rawurl
+func url_host_insecure(rawurl string) bool {
+	u, err := neturl.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range url_insecure_hosts {
+		if domain_matches(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// url_transport_for picks the transport for a request made with ctx: its
+// app's egress policy's, or url_transport. The insecure variants are clones,
+// so they keep the dialer's destination guard.
+func url_transport_for(ctx context.Context, options map[string]string) *http.Transport {
+	if e := url_egress_for(ctx); e != &url_proxy {
+		if options["tls"] == "insecure" {
+			return e.insecure
+		}
+		return e.transport
+	}
+	if options["tls"] != "insecure" {
+		return url_transport
+	}
+	url_transport_insecure_once.Do(func() {
+		url_transport_insecure = url_transport.Clone()
+		url_transport_insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	})
+	return url_transport_insecure
+}
+
+// url_retries reads the retry count from options, clamped to url_max_retries
+func url_retries(options map[string]string) int {
+	n, err := strconv.Atoi(options["retries"])
+	if err != nil || n < 0 {
+		return 0
+	}
+	if n > url_max_retries {
+		n = url_max_retries
+	}
+	return n
+}
+
+// url_retryable reports whether an attempt that failed this way is worth
+// repeating: transport errors, rate limiting and the gateway statuses that
+// mean the upstream was briefly unavailable. Anything else is an answer.
+func url_retryable(r *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch r.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// url_idempotent reports whether a method may be retried without risking a
+// repeated side effect. POST and PATCH are retried only when the caller
+// supplies an idempotency key.
+func url_idempotent(method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// url_retry_delay is the wait before retry number attempt (from 0): the
+// server's Retry-After when it gives one in seconds, exponential otherwise,
+// capped either way.
+func url_retry_delay(r *http.Response, attempt int) time.Duration {
+	delay := url_retry_base << attempt
+	if r != nil {
+		if seconds, err := strconv.Atoi(r.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+	}
+	if delay > url_retry_max_delay {
+		delay = url_retry_max_delay
+	}
+	return delay
+}
+
+// url_request_retry runs url_request, repeating it up to retries times while
+// the outcome is retryable. body is called once per attempt so a streamed
+// body (a file, a multipart form) is rebuilt rather than replayed from a
+// reader the previous attempt drained. The final response is returned even
+// when it is itself a retryable failure, so the app sees the real status.
+func url_request_retry(ctx context.Context, method string, url string, options map[string]string, headers map[string]string, body func() (any, error), retries int, allowed_domains ...string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		b, err := body()
+		if err != nil {
+			return nil, err
+		}
+		r, err := url_request(ctx, method, url, options, headers, b, allowed_domains...)
+		if attempt >= retries || !url_retryable(r, err) {
+			return r, err
+		}
+		delay := url_retry_delay(r, attempt)
+		if r != nil {
+			io.Copy(io.Discard, io.LimitReader(r.Body, 64*1024))
+			r.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// url_multipart streams body as multipart/form-data and returns the reader
+// and its Content-Type. String values become form fields; a dictionary value
+// {"file": path, "name": filename, "type": content type} becomes a file part
+// read from the app's file storage. The form is written through a pipe, so a
+// large upload is never held in memory.
+func url_multipart(u *User, a *App, body map[string]any) (io.Reader, string, error) {
+	// Open every file up front so a bad path fails the call instead of
+	// surfacing as a truncated upload
+	type part struct {
+		field, name, kind string
+		value             string
+		file              *os.File
+	}
+	var parts []part
+	fail := func(err error) (io.Reader, string, error) {
+		for _, p := range parts {
+			if p.file != nil {
+				p.file.Close()
+			}
+		}
+		return nil, "", err
+	}
+	for field, value := range body {
+		switch v := value.(type) {
+		case map[string]any:
+			path, _ := v["file"].(string)
+			f, err := url_file_open(u, a, path)
+			if err != nil {
+				return fail(err)
+			}
+			name, _ := v["name"].(string)
+			if name == "" {
+				name = filepath.Base(path)
+			}
+			kind, _ := v["type"].(string)
+			if kind == "" {
+				kind = "application/octet-stream"
+			}
+			parts = append(parts, part{field: field, name: name, kind: kind, file: f})
+		case nil:
+		default:
+			parts = append(parts, part{field: field, value: any_to_string(v)})
+		}
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		var err error
+		for _, p := range parts {
+			if err != nil {
+				if p.file != nil {
+					p.file.Close()
+				}
+				continue
+			}
+			if p.file == nil {
+				err = mw.WriteField(p.field, p.value)
+				continue
+			}
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, url_quote(p.field), url_quote(p.name)))
+			h.Set("Content-Type", p.kind)
+			var w io.Writer
+			if w, err = mw.CreatePart(h); err == nil {
+				_, err = io.Copy(w, p.file)
+			}
+			p.file.Close()
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, mw.FormDataContentType(), nil
+}
+
+var url_quote = strings.NewReplacer("\\", "\\\\", `"`, "\\\"", "\r", "", "\n", "").Replace
+
+// url_form encodes body as application/x-www-form-urlencoded
+func url_form(body map[string]any) string {
+	values := neturl.Values{}
+	for k, v := range body {
+		switch x := v.(type) {
+		case nil:
+		case []any:
+			for _, item := range x {
+				values.Add(k, any_to_string(item))
+			}
+		default:
+			values.Set(k, any_to_string(x))
+		}
+	}
+	return values.Encode()
+}
+
+// url_file_open opens a file in the app's storage, confined to it by os.Root
+func url_file_open(u *User, a *App, file string) (*os.File, error) {
+	if u == nil || a == nil {
+		return nil, fmt.Errorf("file access requires a user and app")
+	}
+	if !valid(file, "filepath") {
+		return nil, fmt.Errorf("invalid file %q", file)
+	}
+	root, err := os.OpenRoot(api_file_base(u, a))
+	if err != nil {
+		return nil, fmt.Errorf("file %q not found", file)
+	}
+	defer root.Close()
+	f, err := root.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("file %q not found", file)
+	}
+	return f, nil
+}
+
+// url_file_save streams a response body into a file in the app's storage,
+// stopping at limit bytes and at the user's storage quota. It writes to a
+// temporary name and renames on success, so a failed download never leaves
+// a partial file in place of a good one. Returns the bytes written and
+// whether the body was cut short.
+func url_file_save(u *User, a *App, file string, body io.Reader, limit int64) (int64, bool, error) {
+	if u == nil || a == nil {
+		return 0, false, fmt.Errorf("file access requires a user and app")
+	}
+	if !valid(file, "filepath") {
+		return 0, false, fmt.Errorf("invalid file %q", file)
+	}
+	remaining, err := user_storage_remaining(u)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to measure storage: %v", err)
+	}
+	quota := remaining < limit
+	if quota {
+		limit = remaining
+	}
+
+	base := api_file_base(u, a)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return 0, false, fmt.Errorf("unable to create files directory")
+	}
+	root, err := os.OpenRoot(base)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to access files directory")
+	}
+	defer root.Close()
+	if dir := filepath.Dir(file); dir != "." && dir != "" {
+		if err := root_mkdir_all(root, dir); err != nil {
+			return 0, false, fmt.Errorf("unable to create directory")
+		}
+	}
+
+	partial := file + ".partial-" + random_alphanumeric(8)
+	f, err := root.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to write file")
+	}
+	n, err := io.Copy(f, io.LimitReader(body, limit))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	// Probe for a byte beyond the limit to tell a body that fitted exactly
+	// from one that was cut short
+	truncated := false
+	if err == nil && n == limit {
+		var probe [1]byte
+		if m, _ := body.Read(probe[:]); m > 0 {
+			truncated = true
+		}
+	}
+	if truncated && quota {
+		err = fmt.Errorf("storage limit exceeded")
+	}
+	if err == nil {
+		err = root.Rename(partial, file)
+	}
+	if err != nil {
+		root.Remove(partial)
+		return 0, false, err
+	}
+	return n, truncated, nil
+}
+
+// url_max_size reads the response size cap from options. Apps may lower the
+// server's cap but not raise it.
+func url_max_size(options map[string]string) int64 {
+	n, err := strconv.ParseInt(options["max_size"], 10, 64)
+	if err != nil || n <= 0 || n > url_max_response_size {
+		return url_max_response_size
+	}
+	return n
+}
+
+// url_body_factory builds the per-attempt body for mochi.url.* from the
+// app's body argument and options, setting Content-Type in headers where the
+// encoding determines it.
+func url_body_factory(t *sl.Thread, options map[string]string, headers map[string]string, body any) (func() (any, error), error) {
+	user, _ := t.Local("user").(*User)
+	app, _ := t.Local("app").(*App)
+
+	if file := options["upload"]; file != "" {
+		// Fail now on a bad path rather than on the first attempt
+		f, err := url_file_open(user, app, file)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		return func() (any, error) {
+			return url_file_open(user, app, file)
+		}, nil
+	}
+
+	switch options["encoding"] {
+	case "", "json":
+		return func() (any, error) { return body, nil }, nil
+	case "form":
+		fields, ok := body.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("form encoding requires a dictionary body")
+		}
+		headers["Content-Type"] = "application/x-www-form-urlencoded"
+		encoded := url_form(fields)
+		return func() (any, error) { return encoded, nil }, nil
+	case "multipart":
+		fields, ok := body.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("multipart encoding requires a dictionary body")
+		}
+		// The boundary differs per attempt, so the header is set per attempt
+		return func() (any, error) {
+			r, kind, err := url_multipart(user, app, fields)
+			if err != nil {
+				return nil, err
+			}
+			headers["Content-Type"] = kind
+			return r, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", options["encoding"])
+}
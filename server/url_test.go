@@ -0,0 +1,303 @@
+// Mochi server: Outbound HTTP client option tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Retryable statuses are repeated up to the limit, and the final response is
+// what the caller sees
+func TestURLRequestRetry(t *testing.T) {
+	allow_private_for_test(t)
+	previous := url_retry_base
+	url_retry_base = time.Millisecond
+	t.Cleanup(func() { url_retry_base = previous })
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	body := func() (any, error) { return nil, nil }
+	r, err := url_request_retry(context.Background(), "GET", server.URL, nil, map[string]string{}, body, 5)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	r.Body.Close()
+	if r.StatusCode != 200 || calls.Load() != 3 {
+		t.Errorf("status %d after %d calls, want 200 after 3", r.StatusCode, calls.Load())
+	}
+
+	calls.Store(0)
+	r, err = url_request_retry(context.Background(), "GET", server.URL, nil, map[string]string{}, body, 1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusServiceUnavailable || calls.Load() != 2 {
+		t.Errorf("status %d after %d calls, want 503 after 2", r.StatusCode, calls.Load())
+	}
+}
+
+func TestURLRetryDelay(t *testing.T) {
+	r := &http.Response{Header: http.Header{"Retry-After": []string{"3600"}}}
+	if d := url_retry_delay(r, 0); d != url_retry_max_delay {
+		t.Errorf("Retry-After should be capped, got %s", d)
+	}
+	if d := url_retry_delay(nil, 2); d != url_retry_base*4 {
+		t.Errorf("backoff for third attempt = %s", d)
+	}
+	if url_retries(map[string]string{"retries": "99"}) != url_max_retries {
+		t.Error("retries should be clamped")
+	}
+}
+
+// Multipart bodies carry fields and stream files from the app's storage
+func TestURLMultipart(t *testing.T) {
+	tmp := t.TempDir()
+	previous := data_dir
+	data_dir = tmp
+	t.Cleanup(func() { data_dir = previous })
+
+	u := &User{UID: "u1"}
+	a := &App{id: "app1"}
+	base := api_file_base(u, a)
+	os.MkdirAll(base, 0755)
+	os.WriteFile(filepath.Join(base, "photo.jpg"), []byte("JPEGDATA"), 0644)
+
+	reader, kind, err := url_multipart(u, a, map[string]any{
+		"title": "Holiday",
+		"image": map[string]any{"file": "photo.jpg", "type": "image/jpeg"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/", reader)
+	req.Header.Set("Content-Type", kind)
+	if err := req.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if req.FormValue("title") != "Holiday" {
+		t.Errorf("title = %q", req.FormValue("title"))
+	}
+	f, h, err := req.FormFile("image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	if string(data) != "JPEGDATA" || h.Filename != "photo.jpg" || h.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("file part = %q %q %q", data, h.Filename, h.Header.Get("Content-Type"))
+	}
+
+	if _, _, err := url_multipart(u, a, map[string]any{"x": map[string]any{"file": "../../etc/passwd"}}); err == nil {
+		t.Error("path outside the app's storage should be refused")
+	}
+
+	// A request refused before it starts closes the form, so its writer
+	// stops and the file is released
+	reader, _, err = url_multipart(u, a, map[string]any{"image": map[string]any{"file": "photo.jpg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := url_request(context.Background(), "POST", "ftp://example.com/", nil, map[string]string{}, reader); err == nil {
+		t.Error("unsupported scheme should be refused")
+	}
+	if _, err := reader.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("form left open after a refused request: %v", err)
+	}
+}
+
+// Saved responses respect the size cap and never leave partial files
+func TestURLFileSave(t *testing.T) {
+	tmp := t.TempDir()
+	previous := data_dir
+	data_dir = tmp
+	t.Cleanup(func() { data_dir = previous })
+
+	u := &User{UID: "u1"}
+	a := &App{id: "app1"}
+	os.MkdirAll(user_storage_dir(u), 0755)
+	n, truncated, err := url_file_save(u, a, "downloads/a.txt", strings.NewReader("hello"), 100)
+	if err != nil || n != 5 || truncated {
+		t.Fatalf("save = %d %v %v", n, truncated, err)
+	}
+	n, truncated, err = url_file_save(u, a, "b.txt", strings.NewReader("hello world"), 5)
+	if err != nil || n != 5 || !truncated {
+		t.Fatalf("capped save = %d %v %v", n, truncated, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(api_file_base(u, a), "b.txt"))
+	if string(data) != "hello" {
+		t.Errorf("capped file = %q", data)
+	}
+	entries, _ := os.ReadDir(api_file_base(u, a))
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".partial-") {
+			t.Errorf("partial file left behind: %s", e.Name())
+		}
+	}
+}
+
+// tls=insecure is refused unless the administrator listed the host
+func TestURLInsecureHosts(t *testing.T) {
+	previous := url_insecure_hosts
+	url_insecure_hosts = []string{"internal.example"}
+	t.Cleanup(func() { url_insecure_hosts = previous })
+
+	if !url_host_insecure("https://git.internal.example/x") {
+		t.Error("subdomain of approved host should be allowed")
+	}
+	if url_host_insecure("https://example.com/") {
+		t.Error("unlisted host should not be allowed")
+	}
+	_, err := url_request(context.Background(), "GET", "https://example.com/", map[string]string{"tls": "insecure"}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("insecure request to unlisted host: %v", err)
+	}
+}
+
+func TestURLProxy(t *testing.T) {
+	t.Cleanup(func() { url_proxy_configure("") })
+
+	url_proxy_configure("ftp://proxy.example:21")
+	if url_proxy.http != nil || url_proxy.socks != nil {
+		t.Error("FTP proxy accepted")
+	}
+	url_proxy_configure("http://proxy.example:3128")
+	if url_proxy.http == nil || url_address(url_proxy.http) != "proxy.example:3128" {
+		t.Error("HTTP proxy ignored")
+	}
+	url_proxy_configure("socks5://127.0.0.1:9050")
+	if url_proxy.socks == nil {
+		t.Fatal("SOCKS proxy ignored")
+	}
+
+	ctx := context.Background()
+	for _, address := range []string{"127.0.0.1:80", "[::1]:443", "169.254.169.254:80"} {
+		if _, err := url_proxy_allowed(ctx, address); err == nil {
+			t.Errorf("%s allowed through the proxy", address)
+		}
+	}
+	for _, address := range []string{"1.1.1.1:443", "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion:80"} {
+		if pinned, err := url_proxy_allowed(ctx, address); err != nil || pinned != address {
+			t.Errorf("%s refused: %q, %v", address, pinned, err)
+		}
+	}
+	if pinned, err := url_proxy_allowed(ctx, "localhost:80"); err == nil {
+		t.Errorf("localhost allowed through the proxy as %q", pinned)
+	}
+}
+
+// An app's [egress] policy limits where it may go, and sends it through its
+// own proxy
+func TestURLEgress(t *testing.T) {
+	t.Cleanup(func() { url_proxy_configure("") })
+	var proxied atomic.Value
+	inspector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		w.Write([]byte("inspected"))
+	}))
+	defer inspector.Close()
+	t.Setenv("MOCHI_EGRESS_FEEDS", "93.184.216.34, news.example")
+	t.Setenv("MOCHI_EGRESS_FEEDS.PROXY", inspector.URL)
+	url_proxy_configure("")
+
+	ctx := url_egress_context(context.Background(), "feeds")
+	r, err := url_request(ctx, "GET", "http://93.184.216.34/page", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(r.Body)
+	r.Body.Close()
+	if string(body) != "inspected" || proxied.Load() != "http://93.184.216.34/page" {
+		t.Errorf("proxied %v, got %q", proxied.Load(), body)
+	}
+
+	if _, err := url_request(ctx, "GET", "http://1.1.1.1/", nil, nil, nil); err == nil || !strings.Contains(err.Error(), "egress policy") {
+		t.Errorf("request outside the allowlist: %v", err)
+	}
+	t.Setenv("MOCHI_EGRESS_FEEDS", "")
+	url_proxy_configure("")
+	if _, err := url_request(ctx, "GET", "http://127.0.0.1:1/", nil, nil, nil); err == nil || !strings.Contains(err.Error(), "non-public") {
+		t.Errorf("request to loopback through the proxy: %v", err)
+	}
+
+	// Other apps connect directly
+	e := url_egress_for(url_egress_context(context.Background(), "notes"))
+	if e.http != nil || e.domains != nil {
+		t.Errorf("policy for an app without one %+v", e)
+	}
+
+	// Each policy keeps its own connections
+	proxied_transport := url_transport_for(ctx, nil)
+	if proxied_transport == url_transport || proxied_transport == e.transport || url_transport_for(context.Background(), nil) != url_transport {
+		t.Error("transport shared between egress policies")
+	}
+}
+
+func TestURLPolicy(t *testing.T) {
+	previous := url_private_networks
+	t.Cleanup(func() { url_private_networks = previous })
+	url_private_networks = url_networks([]string{"10.0.5.0/24", " 192.168.1.7", "fd00::/8", "nonsense"})
+	if len(url_private_networks) != 3 {
+		t.Fatalf("networks %v", url_private_networks)
+	}
+	for _, address := range []string{"10.0.5.9:80", "192.168.1.7:443", "[fd00::1]:80"} {
+		if err := url_address_allowed(address); err != nil {
+			t.Errorf("%s refused: %v", address, err)
+		}
+	}
+	for _, address := range []string{"10.0.6.1:80", "192.168.1.8:80", "127.0.0.1:80"} {
+		if url_address_allowed(address) == nil {
+			t.Errorf("%s allowed", address)
+		}
+	}
+
+	for rawurl, want := range map[string]bool{"https://example.com/": true, "HTTP://example.com": true, "file:///etc/passwd": false, "gopher://example.com/": false, "http:///path": false} {
+		if url_scheme_allowed(rawurl) != want {
+			t.Errorf("scheme of %q allowed %v", rawurl, !want)
+		}
+	}
+	if _, err := url_request(context.Background(), "GET", "ftp://example.com/", nil, nil, nil); err == nil {
+		t.Error("fetched an ftp URL")
+	}
+
+	check := url_redirect_check(nil, []string{"example.com"})
+	hop := func(rawurl string, via int) error {
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		return check(req, make([]*http.Request, via))
+	}
+	if err := hop("https://www.example.com/next", url_redirects_max); err != nil {
+		t.Errorf("redirect within the limit: %v", err)
+	}
+	if hop("https://www.example.com/next", url_redirects_max+1) == nil {
+		t.Error("redirect past the limit followed")
+	}
+	if hop("https://other.example/", 1) == nil || hop("file:///etc/passwd", 1) == nil {
+		t.Error("redirect off the granted domains or to a file followed")
+	}
+
+	// Webhooks and push endpoints get the same guard
+	c := url_client(time.Second)
+	if _, err := c.Get("http://127.0.0.1:1/"); err == nil || !strings.Contains(err.Error(), "blocked") {
+		t.Errorf("webhook client reached loopback: %v", err)
+	}
+}
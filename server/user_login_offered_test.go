@@ -21,7 +21,7 @@ func TestUserLoginOffered(t *testing.T) {
 	defer cleanup()
 
 	users := db_open("db/users.db")
-	users.exec("create table credentials (id blob primary key, user text not null, public_key blob not null, sign_count integer not null default 0, name text not null default '', transports text not null default '', backup_eligible integer not null default 0, backup_state integer not null default 0, created integer not null)")
+	users.exec("create table credentials (id blob primary key, user text not null, public_key blob not null, sign_count integer not null default 0, name text not null default '', transports text not null default '', backup_eligible integer not null default 0, backup_state integer not null default 0, aaguid text not null default '', attestation text not null default '', verified integer not null default 0, revoked integer not null default 0, created integer not null)")
 	users.exec("create table totp (user text primary key, secret text not null, verified integer not null default 0, created integer not null)")
 	users.exec("create table oauth (id integer primary key, user text not null, provider text not null, subject text not null, email text not null default '', verified integer not null default 0, name text not null default '', created integer not null, unique(provider, subject))")
 	settings := db_open("db/settings.db")
@@ -49,7 +49,8 @@ type User struct {
 	RestorePasskeys bool   `db:"restore_passkeys"`
 	Preferences     map[string]string
 	Identity        *Entity
-	db              *DB // Used by actions
+	Impersonator    string // Administrator acting as this user, if any
+	db              *DB    // Used by actions
 }
 
 // user_pending reports whether the user is mid-bootstrap — either a
@@ -73,17 +74,22 @@ var api_user = sls.FromStringDict(sl.String("mochi.user"), sl.StringDict{
 	"count":  sl.NewBuiltin("mochi.user.count", api_user_count),
 	"create": sl.NewBuiltin("mochi.user.create", api_user_create),
 	"delete": sl.NewBuiltin("mochi.user.delete", api_user_delete),
+	"email":  api_user_email,
 	"export": sl.NewBuiltin("mochi.user.export", api_user_export),
 	"get":    &user_get_module{},
 	"identity": sls.FromStringDict(sl.String("mochi.user.identity"), sl.StringDict{
 		"update": sl.NewBuiltin("mochi.user.identity.update", api_user_identity_update),
 	}),
-	"list":     sl.NewBuiltin("mochi.user.list", api_user_list),
-	"methods":  api_user_methods,
-	"oauth":    api_user_oauth,
-	"passkey":  api_user_passkey,
-	"recovery": api_user_recovery,
-	"search":   sl.NewBuiltin("mochi.user.search", api_user_search),
+	"list":          sl.NewBuiltin("mochi.user.list", api_user_list),
+	"impersonation": api_user_impersonation,
+	"login":         api_user_login,
+	"methods":       api_user_methods,
+	"oauth":         api_user_oauth,
+	"offboard":      sl.NewBuiltin("mochi.user.offboard", api_user_offboard),
+	"pairing":       api_user_pairing,
+	"passkey":       api_user_passkey,
+	"recovery":      api_user_recovery,
+	"search":        sl.NewBuiltin("mochi.user.search", api_user_search),
 	"session": sls.FromStringDict(sl.String("mochi.user.session"), sl.StringDict{
 		"list":           sl.NewBuiltin("mochi.user.session.list", api_user_session_list),
 		"reauthenticate": sl.NewBuiltin("mochi.user.session.reauthenticate", api_user_session_reauthenticate),
@@ -141,7 +147,7 @@ func code_send(email string, c *gin.Context) string {
 	// Check if user exists; if not, check signup_enabled
 	db := db_open("db/users.db")
 	exists, _ := db.exists("select 1 from users where username=?", email)
-	if !exists && !setting_signup_enabled() {
+	if !exists && !signup_allowed(c) {
 		return "signup_disabled"
 	}
 
@@ -197,9 +203,9 @@ func api_user_code_send(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl
 	return sl.None, nil
 }
 
-// api_user_code_verify is mochi.user.code.verify(code): verify+consume an
-// emailed login code as the email factor of a step-up re-authentication,
-// advancing the accrual. Returns a dict {"token": ...} once every required
+// api_user_code_verify is mochi.user.code.verify(code, purpose?): verify+consume
+// an emailed login code as the email factor of a step-up re-authentication,
+// advancing the accrual for the calling app and purpose. Returns a dict {"token": ...} once every required
 // factor is satisfied, {"remaining": [...]} if more are needed, or None if
 // the code is wrong/expired (the action maps None to a translated error).
 func api_user_code_verify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
@@ -210,8 +216,8 @@ func api_user_code_verify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []
 	if user == nil {
 		return sl_error(fn, "no user")
 	}
-	var code string
-	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "code", &code); err != nil {
+	var code, purpose string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "code", &code, "purpose?", &purpose); err != nil {
 		return sl_error(fn, "%v", err)
 	}
 	// A user who turned email off as a login factor cannot use it for
@@ -222,12 +228,13 @@ func api_user_code_verify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []
 	if !code_consume(user, code) {
 		return sl.None, nil
 	}
-	return reauthentication_result(user, "email"), nil
+	return reauthentication_result(t, user, purpose, "email"), nil
 }
 
-// api_user_session_reauthenticate is mochi.user.session.reauthenticate(token):
-// spend a step-up re-authentication proof for the current user, returning
-// True if it was valid (and consuming it), else False. A settings action
+// api_user_session_reauthenticate is mochi.user.session.reauthenticate(token, purpose?):
+// spend a step-up re-authentication proof the calling app earned for the
+// current user and purpose, returning True if it was valid (and consuming
+// it), else False. A settings action
 // calls this before a sensitive mutation (data export, replication
 // approval, an account-security change); the proof is earned by
 // re-verifying the user's login factor(s) via mochi.user.code.verify /
@@ -240,11 +247,11 @@ func api_user_session_reauthenticate(t *sl.Thread, fn *sl.Builtin, args sl.Tuple
 	if user == nil {
 		return sl_error(fn, "no user")
 	}
-	var token string
-	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "token", &token); err != nil {
+	var token, purpose string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "token", &token, "purpose?", &purpose); err != nil {
 		return sl_error(fn, "%v", err)
 	}
-	return sl.Bool(reauthentication_consume(user, token)), nil
+	return sl.Bool(reauthentication_consume(user, reauthentication_app(t), purpose, token)), nil
 }
 
 func login_create(user string, address string, agent string) string {
@@ -267,10 +274,12 @@ func login_delete(code string) {
 func sessions_manager() {
 	for range time.Tick(time.Hour) {
 		sessions_cleanup()
+		shares_cleanup()
 	}
 }
 
-// sessions_cleanup deletes expired sessions, codes, ceremonies, and partial auth sessions
+// sessions_cleanup deletes expired sessions, codes, ceremonies, partial auth
+// sessions and guests
 func sessions_cleanup() {
 	db := db_open("db/sessions.db")
 	t := now()
@@ -279,6 +288,12 @@ func sessions_cleanup() {
 	db.exec("delete from ceremonies where expires < ?", t)
 	db.exec("delete from partial where expires < ?", t)
 	db.exec("delete from reauthentication where expires < ?", t)
+	db.exec("delete from pairings where expires < ?", t)
+	db.exec("delete from devices where session not in ( select code from sessions )")
+	db.exec("delete from alerts where created < ?", t-login_alert_lifetime)
+	impersonations_expire()
+	db.exec("delete from impersonations where created < ?", t-impersonation_history)
+	guests_cleanup()
 }
 
 func user_by_uid(uid string) *User {
@@ -360,23 +375,24 @@ func user_by_login(login string) *User {
 
 	u.Preferences = user_preferences_load(&u)
 	u.Identity = u.identity()
+	impersonation_mark(&u, login)
 	return &u
 }
 
 // user_from_code exchanges a login code for a user. Returns the user and an
 // error reason. Error reason is empty on success, "invalid" for bad/expired
 // code, "suspended" for suspended users, or "signup_disabled" if the code was
-// valid but signups are disabled.
-func user_from_code(code string) (*User, string) {
-	var c Code
+// valid but signups are disabled and the visitor has no invite.
+func user_from_code(code string, c *gin.Context) (*User, string) {
+	var lc Code
 	sessions := db_open("db/sessions.db")
-	if !sessions.scan(&c, "delete from codes where code=? and expires>=? returning *", code, now()) {
+	if !sessions.scan(&lc, "delete from codes where code=? and expires>=? returning *", code, now()) {
 		return nil, "invalid"
 	}
 
 	db := db_open("db/users.db")
 	var u User
-	if db.scan(&u, "select uid, username, role, methods, disabled, status from users where username=?", c.Username) {
+	if db.scan(&u, "select uid, username, role, methods, disabled, status from users where username=?", lc.Username) {
 		if u.Status == "suspended" {
 			return nil, "suspended"
 		}
@@ -385,12 +401,14 @@ func user_from_code(code string) (*User, string) {
 		return &u, ""
 	}
 
-	// New user - check if signups are enabled
-	if !setting_signup_enabled() {
+	// New user - check if signups are enabled, or the visitor was invited
+	if !signup_allowed(c) {
 		return nil, "signup_disabled"
 	}
 
-	return user_create(c.Username)
+	user, reason := user_create(lc.Username)
+	invite_redeem(c, user)
+	return user, reason
 }
 
 // user_create inserts a new user with the given username (email), applies the
@@ -404,7 +422,7 @@ func user_create(username string) (*User, string) {
 	db := db_open("db/users.db")
 
 	role := "user"
-	has_users, _ := db.exists("select uid from users limit 1")
+	has_users, _ := db.exists("select uid from users where role != 'guest' limit 1")
 	if !has_users {
 		role = "administrator"
 	}
@@ -588,7 +606,8 @@ func api_user_get_id(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 		return sl.None, nil
 	}
 
-	return sl_encode(map[string]any{"uid": u.UID, "username": u.Username, "role": u.Role, "methods": u.Methods, "status": u.Status}), nil
+	deliverability := email_deliverability([]string{u.Username})[strings.ToLower(u.Username)]
+	return sl_encode(map[string]any{"uid": u.UID, "username": u.Username, "role": u.Role, "methods": u.Methods, "status": u.Status, "deliverability": deliverability}), nil
 }
 
 // mochi.user.get.username(username) -> dict | None: Get a user by username (admin only)
@@ -767,11 +786,12 @@ func api_user_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tupl
 	// in memory. ATTACH is blocked at the driver level so we can't join across
 	// DBs, and admin user counts are small enough that in-memory is fine.
 	db := db_open("db/users.db")
-	rows, err := db.rows("select uid, username, role, methods, status from users")
+	rows, err := db.rows("select uid, username, role, methods, status from users where role != 'guest'")
 	if err != nil {
 		return sl_error(fn, "database error: %v", err)
 	}
 	users_attach_last(rows)
+	users_attach_deliverability(rows)
 	users_sort(rows, sort, order)
 
 	if offset >= len(rows) {
@@ -861,7 +881,7 @@ func users_attach_last(rows []map[string]any) {
 	}
 }
 
-// mochi.user.count() -> int: Count all users (admin only)
+// mochi.user.count() -> int: Count all users, other than guests (admin only)
 func api_user_count(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	// Check users/read permission
 	if err := require_permission(t, fn, "users/read"); err != nil {
@@ -877,7 +897,7 @@ func api_user_count(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tup
 	}
 
 	db := db_open("db/users.db")
-	row, err := db.row("select count(*) as count from users")
+	row, err := db.row("select count(*) as count from users where role != 'guest'")
 	if err != nil {
 		return sl_error(fn, "database error: %v", err)
 	}
@@ -935,7 +955,7 @@ func api_user_search(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 	}
 
 	db := db_open("db/users.db")
-	rows, err := db.rows("select uid, username, role, methods, status from users where username like ? order by username collate nocase limit ?", "%"+query+"%", limit)
+	rows, err := db.rows("select uid, username, role, methods, status from users where username like ? and role != 'guest' order by username collate nocase limit ?", "%"+query+"%", limit)
 	if err != nil {
 		return sl_error(fn, "database error: %v", err)
 	}
@@ -1027,6 +1047,10 @@ func api_user_update(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 		db.exec("update users set username=? where uid=?", username, id)
 		if old != username {
 			audit_email_changed(user.Username, id, old, username)
+			db.exec("update emails set verified=0, pending='', requested=0 where user=?", id)
+			if changed := user_by_uid(id); changed != nil {
+				email_changed(changed, old, username)
+			}
 		}
 	}
 
@@ -1162,6 +1186,13 @@ func user_purge_local(id string, accountGone bool) (string, error) {
 		}
 	}
 
+	// Ask the holders of copies of the account's data to erase them, while
+	// its entities can still sign the requests
+	holders := 0
+	if accountGone {
+		holders = erasure_notify(&User{UID: id})
+	}
+
 	var entities []Entity
 	db.scans(&entities, "select * from entities where user=?", id)
 	for _, e := range entities {
@@ -1170,6 +1201,7 @@ func user_purge_local(id string, accountGone bool) (string, error) {
 		} else {
 			e.delete_local() // this host only; entity survives on other hosts
 		}
+		analytics_forget(e.ID)
 	}
 
 	sdb := db_open("db/sessions.db")
@@ -1177,6 +1209,7 @@ func user_purge_local(id string, accountGone bool) (string, error) {
 	sdb.exec("delete from ceremonies where user=?", id)
 	sdb.exec("delete from partial where user=?", id)
 	sdb.exec("delete from logins where user=?", id)
+	db.exec("delete from guests where user=?", id)
 	sdb.exec("delete from accesses where user=?", id)
 	sdb.exec("delete from passkeys where user=?", id)
 	sdb.exec("delete from verifications where user=?", id)
@@ -1193,6 +1226,13 @@ func user_purge_local(id string, accountGone bool) (string, error) {
 	db_purge_prefix(fmt.Sprintf("users/%s", id))
 	os.RemoveAll(fmt.Sprintf("%s/users/%s", data_dir, id))
 
+	if accountGone {
+		ids := make([]string, len(entities))
+		for i, e := range entities {
+			ids[i] = e.ID
+		}
+		erasure_complete(id, ids, holders)
+	}
 	return target.Username, nil
 }
 
@@ -1281,7 +1321,7 @@ func user_files_dir_has_any(dir string) bool {
 	return false
 }
 
-// mochi.user.suspend(id) -> bool: Suspend a user (admin only)
+// mochi.user.suspend(id) -> bool: Suspend a user, see lifecycle.go (admin only)
 func api_user_suspend(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	user := t.Local("user").(*User)
 	if user == nil {
@@ -1304,17 +1344,18 @@ func api_user_suspend(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.T
 		return sl_error(fn, "cannot suspend self")
 	}
 
-	db := db_open("db/users.db")
-	exists, _ := db.exists("select 1 from users where uid=?", id)
-	if !exists {
+	r, _ := db_open("db/users.db").row("select username from users where uid=?", id)
+	if r == nil {
 		return sl_error(fn, "user not found")
 	}
 
-	db.exec("update users set status='suspended' where uid=?", id)
+	user_suspend(id)
+	audit_user_suspended(user.Username, r["username"].(string))
 	return sl.True, nil
 }
 
-// mochi.user.activate(uid) -> bool: Activate a suspended user (admin only)
+// mochi.user.activate(uid) -> bool: Activate a suspended user, cancelling
+// any scheduled deletion (admin only)
 func api_user_activate(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	user := t.Local("user").(*User)
 	if user == nil {
@@ -1333,17 +1374,18 @@ func api_user_activate(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.
 		return sl_error(fn, "invalid uid")
 	}
 
-	db := db_open("db/users.db")
-	exists, _ := db.exists("select 1 from users where uid=?", id)
-	if !exists {
+	r, _ := db_open("db/users.db").row("select username from users where uid=?", id)
+	if r == nil {
 		return sl_error(fn, "user not found")
 	}
 
-	db.exec("update users set status='active' where uid=?", id)
+	user_reactivate(id)
+	audit_user_reactivated(user.Username, r["username"].(string))
 	return sl.True, nil
 }
 
 // mochi.user.session.list(user?) -> list: List active sessions for current user or specified user (admin)
+// Sessions of phones linked as trusted devices by pairing have the device's name.
 func api_user_session_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
 	if err := require_permission(t, fn, "user/sessions/read"); err != nil {
 		return sl_error(fn, "%v", err)
@@ -1367,7 +1409,7 @@ func api_user_session_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs [
 	}
 
 	db := db_open("db/sessions.db")
-	rows, err := db.rows("select code, expires, created, accessed, address, agent from sessions where user=? and expires>=? order by accessed desc", target, now())
+	rows, err := db.rows("select s.code, s.expires, s.created, s.accessed, s.address, s.agent, coalesce(d.name, '') as device from sessions s left join devices d on d.session=s.code where s.user=? and s.expires>=? order by s.accessed desc", target, now())
 	if err != nil {
 		return sl_error(fn, "database error")
 	}
@@ -1459,10 +1501,40 @@ func sessions_revoke_all(uid string) int {
 	return len(codes)
 }
 
+// user_event sends an event about a user to each of their apps that
+// declares it
+func user_event(user *User, event string, content map[string]any) {
+	if user.Identity == nil {
+		return
+	}
+	apps_lock.Lock()
+	list := make([]*App, 0, len(apps))
+	for _, a := range apps {
+		list = append(list, a)
+	}
+	apps_lock.Unlock()
+	for _, a := range list {
+		av := a.active(user)
+		if av == nil {
+			continue
+		}
+		if _, found := av.Events[event]; !found {
+			continue
+		}
+		services := app_services(a, user)
+		if len(services) == 0 {
+			continue
+		}
+		m := message(user.Identity.ID, user.Identity.ID, services[0], event)
+		m.content = content
+		m.send()
+	}
+}
+
 func (u *User) identity() *Entity {
 	db := db_open("db/users.db")
 	var i Entity
-	if db.scan(&i, "select * from entities where user=? and class='person' order by id limit 1", u.UID) {
+	if db.scan(&i, "select * from entities where user=? and class='person' order by parent != '', id limit 1", u.UID) {
 		return &i
 	}
 	return nil
@@ -1470,7 +1542,7 @@ func (u *User) identity() *Entity {
 
 // Starlark methods
 func (u *User) AttrNames() []string {
-	return []string{"app", "id", "identity", "methods", "preference", "role", "status", "uid", "username"}
+	return []string{"app", "id", "identity", "impersonator", "methods", "preference", "role", "status", "uid", "username"}
 }
 
 func (u *User) Attr(name string) (sl.Value, error) {
@@ -1483,6 +1555,11 @@ func (u *User) Attr(name string) (sl.Value, error) {
 		return sl.String(u.UID), nil
 	case "identity":
 		return u.Identity, nil
+	case "impersonator":
+		if u.Impersonator == "" {
+			return sl.None, nil
+		}
+		return sl.String(u.Impersonator), nil
 	case "methods":
 		return sl.String(u.Methods), nil
 	case "preference":
@@ -1575,6 +1652,9 @@ func (p *UserPreference) set(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs
 	if !ok {
 		return sl_error(fn, "invalid value")
 	}
+	if name == "timezone" && !valid_timezone(value) {
+		return sl_error(fn, "invalid timezone %q", value)
+	}
 	user_preference_set(p.user, name, value)
 	return sl.String(value), nil
 }
@@ -296,7 +296,11 @@ func create_test_sessions_db(t *testing.T) func() {
 	db.exec("create table codes (code text not null, username text not null, expires integer not null, primary key (code, username))")
 	db.exec("create table ceremonies (id text primary key, type text not null, user text not null default '', challenge blob not null, data text not null default '', expires integer not null)")
 	db.exec("create table partial (id text primary key, user text not null, completed text not null default '', remaining text not null, expires integer not null)")
-	db.exec("create table reauthentication (id text primary key, user text not null, methods text not null default '', expires integer not null)")
+	db.exec("create table reauthentication (id text primary key, user text not null, app text not null default '', purpose text not null default '', methods text not null default '', expires integer not null)")
+	db.exec("create table pairings (code text primary key, user text not null, trusted integer not null default 0, name text not null default '', status text not null, claim text not null default '', phrase text not null default '', address text not null default '', agent text not null default '', expires integer not null)")
+	db.exec("create table impersonations (session text primary key, user text not null, administrator text not null, origin text not null default '', reason text not null, address text not null default '', created integer not null, expires integer not null, ended integer not null default 0)")
+	db.exec("create table devices (session text primary key, user text not null, name text not null, linked integer not null)")
+	db.exec("create table alerts (id text primary key, user text not null, session text not null, device text not null, region text not null, address text not null default '', agent text not null default '', reason text not null, created integer not null, denied integer not null default 0)")
 
 	cleanup := func() {
 		data_dir = orig_data_dir
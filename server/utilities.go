@@ -31,6 +31,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -262,23 +263,38 @@ func root_mkdir_all(root *os.Root, path string) error {
 }
 
 func time_local(u *User, t int64) string {
-	timezone := "UTC"
-	if u != nil {
-		timezone = user_preference_get(u, "timezone", "UTC")
+	return time.Unix(t, 0).In(user_location(u)).Format(time.DateTime)
+}
+
+// user_location returns a user's timezone preference, or UTC if they have
+// none, chose "auto", or it isn't a timezone. Never the server's own zone,
+// so timestamps read the same whichever host of an account renders them.
+func user_location(u *User) *time.Location {
+	if u == nil {
+		return time.UTC
+	}
+	timezone := user_preference_get(u, "timezone", "UTC")
+	if timezone == "auto" || !valid_timezone(timezone) {
+		return time.UTC
+	}
+	l, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.UTC
 	}
+	return l
+}
 
-	// Handle "auto" timezone by falling back to UTC
+// valid_timezone reports whether a timezone preference is "auto" or an IANA
+// timezone such as "Europe/Berlin"
+func valid_timezone(timezone string) bool {
 	if timezone == "auto" {
-		timezone = "UTC"
+		return true
 	}
-
-	l, err := time.LoadLocation(timezone)
-	if err == nil {
-		return time.Unix(t, 0).In(l).Format(time.DateTime)
-	} else {
-		warn("Invalid time zone %q:", err)
-		return time.Unix(t, 0).Format(time.DateTime)
+	if timezone == "" || timezone == "Local" {
+		return false
 	}
+	_, err := time.LoadLocation(timezone)
+	return err == nil
 }
 
 func uid() string {
@@ -286,6 +302,31 @@ func uid() string {
 	return match_hyphens.ReplaceAllLiteralString(u.String(), "")
 }
 
+// ulid returns a ULID for the given time: a 48-bit millisecond timestamp
+// followed by 80 random bits, in Crockford base32 (26 characters).
+func ulid(at time.Time) (string, error) {
+	const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	var b [16]byte
+	ms := uint64(at.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	// 128 bits in 26 five-bit groups: the leading group holds the top 3 bits
+	out := make([]byte, 26)
+	hi := uint64(b[0])<<56 | uint64(b[1])<<48 | uint64(b[2])<<40 | uint64(b[3])<<32 | uint64(b[4])<<24 | uint64(b[5])<<16 | uint64(b[6])<<8 | uint64(b[7])
+	lo := uint64(b[8])<<56 | uint64(b[9])<<48 | uint64(b[10])<<40 | uint64(b[11])<<32 | uint64(b[12])<<24 | uint64(b[13])<<16 | uint64(b[14])<<8 | uint64(b[15])
+	for i := 25; i >= 0; i-- {
+		out[i] = alphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out), nil
+}
+
 func unzip(file string, destination string) error {
 	r, err := zip.OpenReader(file)
 	if err != nil {
@@ -359,9 +400,10 @@ func url_is_cloud_metadata(url string) bool {
 // unrestricted client is an SSRF pivot into whatever the host can reach.
 // Peer-to-peer traffic is unaffected — libp2p dials multiaddrs directly and
 // never goes through url_request — so this only constrains app-driven HTTP.
-// Tests that serve from httptest (127.0.0.1) set it, as may a deployment that
-// genuinely federates over a LAN.
-var url_allow_private = false
+// Tests that serve from httptest (127.0.0.1) set it, atomically, as a dial
+// a transport started during one test may finish after it; a deployment
+// that genuinely federates over a LAN lists those networks in [url] private.
+var url_allow_private atomic.Bool
 
 // url_address_allowed reports whether a resolved dial address is a permitted
 // outbound destination. It is called from the dialer with the address actually
@@ -378,9 +420,14 @@ func url_address_allowed(address string) error {
 	if ip == nil {
 		return fmt.Errorf("blocked outbound request to unresolvable address %q", address)
 	}
-	if url_allow_private {
+	if url_allow_private.Load() {
 		return nil
 	}
+	for _, block := range url_private_networks {
+		if block.Contains(ip) {
+			return nil
+		}
+	}
 	// IsPrivate covers RFC 1918 and RFC 4193 unique-local; IsLinkLocalUnicast
 	// covers 169.254.0.0/16 (so the cloud metadata service, whatever hostname
 	// or notation reaches it) and fe80::/10. Each of these handles the
@@ -431,23 +478,29 @@ var url_blocked_networks = func() []*net.IPNet {
 	return blocks
 }()
 
-// url_transport is the shared outbound transport for every app-driven HTTP
-// request. The dialer's Control hook runs per connection, so the check applies
-// to the initial request and to every redirect hop on the same client.
+// url_dialer connects directly, refusing non-public destinations
+var url_dialer = &net.Dialer{
+	Timeout:   10 * time.Second,
+	KeepAlive: 30 * time.Second,
+	Control: func(network string, address string, _ syscall.RawConn) error {
+		return url_address_allowed(address)
+	},
+}
+
+// url_transport is the outbound transport for HTTP requests following [url]
+// proxy; apps with an [egress] policy get clones of it, made in
+// url_egress_for. The dialer's Control hook runs per connection, so the check
+// applies to the initial request and to every redirect hop on the same client.
 var url_transport = &http.Transport{
-	// No proxy, deliberately. With one configured the dialer connects to the
-	// proxy and the Control hook below sees the proxy's address, not the
+	// No environment proxy, deliberately. With one the dialer connects to
+	// the proxy and the Control hook below sees the proxy's address, not the
 	// destination — so HTTP_PROXY in the server's environment would silently
-	// void the whole guard and hand apps a route to any internal host. Mochi
-	// has no egress-proxy configuration, so nothing legitimately relies on it.
-	Proxy: nil,
-	DialContext: (&net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 30 * time.Second,
-		Control: func(network string, address string, _ syscall.RawConn) error {
-			return url_address_allowed(address)
-		},
-	}).DialContext,
+	// void the whole guard and hand apps a route to any internal host. The
+	// only proxies are [url] proxy and an app's [egress] proxy, which check
+	// each destination before handing it over; see url_proxy_select and
+	// url_dial.
+	Proxy:                 url_proxy_select,
+	DialContext:           url_dial,
 	MaxIdleConns:          100,
 	IdleConnTimeout:       90 * time.Second,
 	TLSHandshakeTimeout:   10 * time.Second,
@@ -483,12 +536,33 @@ func url_timeout(options map[string]string) time.Duration {
 // cancellation — accumulating. Non-Starlark callers pass context.Background().
 //
 // If allowed_domains is non-empty, redirect targets are validated against them.
+// A body may be a string, bytes, a reader (streamed, see url_body_factory) or
+// any other value, which is sent as JSON.
 func url_request(ctx context.Context, method string, url string, options map[string]string, headers map[string]string, body any, allowed_domains ...string) (*http.Response, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	// A streamed body holds a file or a multipart writer's goroutine open
+	// until it's read or closed; close it when the request never starts.
+	// Once it does, the client closes it.
+	fail := func(err error) (*http.Response, error) {
+		switch b := body.(type) {
+		case *io.PipeReader:
+			b.CloseWithError(err)
+		case io.Closer:
+			b.Close()
+		}
+		return nil, err
+	}
 	if url_is_cloud_metadata(url) {
-		return nil, fmt.Errorf("access to cloud metadata service is blocked")
+		return fail(fmt.Errorf("access to cloud metadata service is blocked"))
+	}
+	if !url_scheme_allowed(url) {
+		return fail(fmt.Errorf("unsupported URL scheme"))
+	}
+
+	if options["tls"] == "insecure" && !url_host_insecure(url) {
+		return fail(fmt.Errorf("unverified TLS to this host is not permitted by the server administrator"))
 	}
 
 	if method == "" {
@@ -504,6 +578,9 @@ func url_request(ctx context.Context, method string, url string, options map[str
 		case []byte:
 			br = bytes.NewReader(b)
 
+		case io.Reader:
+			br = b
+
 		default:
 			br = strings.NewReader(json_encode(b))
 			_, found := headers["Content-Type"]
@@ -515,39 +592,14 @@ func url_request(ctx context.Context, method string, url string, options map[str
 
 	r, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), url, br)
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 
 	for k, v := range headers {
 		r.Header.Set(k, v)
 	}
 
-	c := &http.Client{Timeout: url_timeout(options), Transport: url_transport}
-
-	// Redirects are validated for every caller, not only those that passed
-	// allowed domains: RSS fetching, link previews and peer discovery supply
-	// none, and previously followed redirects entirely unchecked. The dialer
-	// already refuses non-public destinations on each hop; these checks add the
-	// metadata-name, hop-count and granted-domain limits on top.
-	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		if url_is_cloud_metadata(req.URL.String()) {
-			return fmt.Errorf("redirect to cloud metadata service is blocked")
-		}
-		if len(via) >= 10 {
-			return fmt.Errorf("too many redirects")
-		}
-		if len(allowed_domains) == 0 {
-			return nil
-		}
-		redirect_host := strings.ToLower(req.URL.Hostname())
-		for _, domain := range allowed_domains {
-			if domain_matches(domain, redirect_host) {
-				return nil
-			}
-		}
-		return fmt.Errorf("redirect to %s not allowed by granted url permissions", redirect_host)
-	}
-
+	c := &http.Client{Timeout: url_timeout(options), Transport: url_transport_for(ctx, options), CheckRedirect: url_redirect_check(options, allowed_domains)}
 	return c.Do(r)
 }
 
@@ -637,14 +689,32 @@ func valid(s string, match string) bool {
 }
 
 func regex_cached(pattern string) *regexp.Regexp {
+	return must(regex_compile(pattern))
+}
+
+// Patterns from mochi.regex are app-supplied rather than literals in server
+// code, so the cache is bounded; it is cleared wholesale when full, since the
+// working set is small and a reset is cheaper than tracking recency.
+const regex_cache_max = 1024
+
+// regex_compile returns the compiled pattern, from the cache when it has been
+// seen before. Unlike regex_cached it reports an invalid pattern instead of
+// panicking.
+func regex_compile(pattern string) (*regexp.Regexp, error) {
 	regex_cache_mu.Lock()
 	defer regex_cache_mu.Unlock()
 	if re, ok := regex_cache[pattern]; ok {
-		return re
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(regex_cache) >= regex_cache_max {
+		regex_cache = map[string]*regexp.Regexp{}
 	}
-	re := regexp.MustCompile(pattern)
 	regex_cache[pattern] = re
-	return re
+	return re, nil
 }
 
 // path_scrub removes the server's filesystem prefix from a message bound for
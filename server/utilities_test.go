@@ -595,9 +595,9 @@ func TestUrlIsCloudMetadata(t *testing.T) {
 // to the calling test so the SSRF guard stays on everywhere else.
 func allow_private_for_test(t *testing.T) {
 	t.Helper()
-	previous := url_allow_private
-	url_allow_private = true
-	t.Cleanup(func() { url_allow_private = previous })
+	previous := url_allow_private.Load()
+	url_allow_private.Store(true)
+	t.Cleanup(func() { url_allow_private.Store(previous) })
 }
 
 // TestURLAddressBlocked pins the SSRF guard: app-supplied URLs must not be able
@@ -670,3 +670,34 @@ func TestPathScrub(t *testing.T) {
 		})
 	}
 }
+
+// Test user_location honours valid timezone preferences only
+func TestUserLocation(t *testing.T) {
+	user, cleanup := create_test_user(t)
+	defer cleanup()
+
+	tests := map[string]string{
+		"Europe/Berlin": "Europe/Berlin",
+		"auto":          "UTC",
+		"Local":         "UTC",
+		"Mars/Olympus":  "UTC",
+		"":              "UTC",
+	}
+	for timezone, want := range tests {
+		user.Preferences = map[string]string{"timezone": timezone}
+		if got := user_location(user).String(); got != want {
+			t.Errorf("user_location(%q) = %q, want %q", timezone, got, want)
+		}
+	}
+	if got := user_location(nil).String(); got != "UTC" {
+		t.Errorf("user_location(nil) = %q, want UTC", got)
+	}
+
+	user.Preferences = map[string]string{"timezone": "Asia/Tokyo"}
+	if got := time_local(user, 0); got != "1970-01-01 09:00:00" {
+		t.Errorf("time_local = %q", got)
+	}
+	if valid_timezone("Local") || valid_timezone("") || !valid_timezone("auto") || !valid_timezone("America/New_York") {
+		t.Error("valid_timezone")
+	}
+}
@@ -0,0 +1,314 @@
+// Mochi server: Email address verification and changes
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// A user's email address is their username. It counts as verified when
+// they last signed in with a code sent to it, or followed a verification
+// link sent to it; the emails table of users.db records when. An address
+// not verified for email_reverify days is due to be verified again, which
+// the Settings app prompts for.
+//
+// Changing the address sets a pending address, and sends a link to it.
+// The username changes only once the link is followed, and the old address
+// is told. Each link carries a token signed under the server's verification
+// secret, naming its user, purpose and expiry, and binding the address it
+// was sent to; a link for an address since replaced is refused.
+//
+// When a user's address changes, their apps that declare the "user/email"
+// event are sent it, with the old and new addresses.
+
+const email_verification_lifetime = 86400
+
+var api_user_email = sls.FromStringDict(sl.String("mochi.user.email"), sl.StringDict{
+	"cancel":       sl.NewBuiltin("mochi.user.email.cancel", api_user_email_cancel),
+	"change":       sl.NewBuiltin("mochi.user.email.change", api_user_email_change),
+	"get":          sl.NewBuiltin("mochi.user.email.get", api_user_email_get),
+	"suppressions": sl.NewBuiltin("mochi.user.email.suppressions", api_user_email_suppressions),
+	"unsuppress":   sl.NewBuiltin("mochi.user.email.unsuppress", api_user_email_unsuppress),
+	"verify":       sl.NewBuiltin("mochi.user.email.verify", api_user_email_verify),
+})
+
+var (
+	email_verification_secret_lock  sync.Mutex
+	email_verification_secret_value string
+)
+
+// email_verification_secret returns the key verification tokens are signed
+// with, creating it on first use
+func email_verification_secret() string {
+	email_verification_secret_lock.Lock()
+	defer email_verification_secret_lock.Unlock()
+	if email_verification_secret_value == "" {
+		email_verification_secret_value = setting_get("email_verification_secret", "")
+		if email_verification_secret_value == "" {
+			email_verification_secret_value = random_alphanumeric(32)
+			setting_set("email_verification_secret", email_verification_secret_value)
+		}
+	}
+	return email_verification_secret_value
+}
+
+// email_token_signature returns the signature for a token's fields and the
+// address it was sent to
+func email_token_signature(purpose, uid, address string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(email_verification_secret()))
+	mac.Write([]byte(purpose + "\n" + uid + "\n" + strings.ToLower(address) + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// email_token creates a token to verify an address for a user. Purpose is
+// "verify" for the current address or "change" for a pending one.
+func email_token(purpose, uid, address string) string {
+	expires := now() + email_verification_lifetime
+	return purpose + "." + uid + "." + strconv.FormatInt(expires, 10) + "." + email_token_signature(purpose, uid, address, expires)
+}
+
+// email_state returns when a user's address was last verified, and any
+// pending change with when it was requested
+func email_state(uid string) (int64, string, int64) {
+	row, _ := db_open("db/users.db").row("select verified, pending, requested from emails where user=?", uid)
+	if row == nil {
+		return 0, "", 0
+	}
+	return as_int64(row["verified"]), as_string(row["pending"]), as_int64(row["requested"])
+}
+
+// email_verified_mark records that a user has just verified their address
+func email_verified_mark(uid string) {
+	db_open("db/users.db").exec("insert into emails ( user, verified ) values ( ?, ? ) on conflict ( user ) do update set verified=excluded.verified", uid, now())
+}
+
+// email_reverify_due returns whether an address verified at a time is
+// due to be verified again
+func email_reverify_due(verified int64) bool {
+	days := atoi(setting_get("email_reverify", "365"), 365)
+	if verified == 0 {
+		return true
+	}
+	return days > 0 && now()-verified > days*86400
+}
+
+// email_verification_send emails a link to verify an address. Origin is the
+// scheme and host the user is using this server at.
+func email_verification_send(user *User, purpose, address, origin, language string) {
+	link := origin + "/login/email#" + email_token(purpose, user.UID, address)
+	email_send_message(address, EmailMessage{
+		Language: language,
+		Subject:  resolve_core_label(language, "email.address.subject", nil),
+		Heading:  resolve_core_label(language, "email.address.heading", nil),
+		Tagline:  resolve_core_label(language, "email.address.tagline", map[string]any{"address": address}),
+		Button:   resolve_core_label(language, "email.address.button", nil),
+		Link:     link,
+		Footer:   resolve_core_label(language, "email.address.ignore", nil),
+		Required: true,
+	})
+}
+
+// email_change_request sets a pending address for a user, returning an
+// error if it can't be used
+func email_change_request(user *User, address string) error {
+	address = strings.TrimSpace(address)
+	if !email_valid(address) {
+		return fmt.Errorf("invalid email address")
+	}
+	if strings.EqualFold(address, user.Username) {
+		return fmt.Errorf("that is already your address")
+	}
+	db := db_open("db/users.db")
+	if taken, _ := db.exists("select 1 from users where username=? collate nocase", address); taken {
+		return fmt.Errorf("address in use")
+	}
+	db.exec("insert into emails ( user, pending, requested ) values ( ?, ?, ? ) on conflict ( user ) do update set pending=excluded.pending, requested=excluded.requested", user.UID, address, now())
+	return nil
+}
+
+// email_confirm checks a verification token and applies it: marking the
+// current address verified, or changing to the pending address. Returns
+// the user and, for a change, the old address.
+func email_confirm(token string) (*User, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || (parts[0] != "verify" && parts[0] != "change") {
+		return nil, "", fmt.Errorf("invalid token")
+	}
+	purpose, uid := parts[0], parts[1]
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || expires < now() {
+		return nil, "", fmt.Errorf("expired token")
+	}
+	user := user_by_uid(uid)
+	if user == nil {
+		return nil, "", fmt.Errorf("invalid token")
+	}
+	_, pending, _ := email_state(uid)
+	address := user.Username
+	if purpose == "change" {
+		address = pending
+	}
+	if address == "" || !hmac.Equal([]byte(parts[3]), []byte(email_token_signature(purpose, uid, address, expires))) {
+		return nil, "", fmt.Errorf("invalid token")
+	}
+
+	if purpose == "verify" {
+		email_verified_mark(uid)
+		return user, "", nil
+	}
+
+	db := db_open("db/users.db")
+	if taken, _ := db.exists("select 1 from users where username=? collate nocase and uid!=?", address, uid); taken {
+		return nil, "", fmt.Errorf("address in use")
+	}
+	old := user.Username
+	db.exec("update users set username=? where uid=?", address, uid)
+	db.exec("update emails set verified=?, pending='', requested=0 where user=?", now(), uid)
+	user.Username = address
+	email_changed(user, old, user.Username)
+	return user, old, nil
+}
+
+// email_changed finishes a change of a user's address: forgetting login
+// codes sent to the old one, telling the old address, and sending the
+// "user/email" event to the user's apps that declare it
+func email_changed(user *User, old, address string) {
+	db_open("db/sessions.db").exec("delete from codes where username=?", old)
+
+	language := user_language(user)
+	subject := resolve_core_label(language, "email.address.changed.subject", nil)
+	email_send_message(old, EmailMessage{
+		Language: language,
+		Subject:  subject,
+		Heading:  subject,
+		Body:     resolve_core_label(language, "email.address.changed.body", map[string]any{"address": address}),
+	})
+
+	user_event(user, "user/email", map[string]any{"old": old, "address": address})
+}
+
+// POST /_/auth/email/verify - Follow a link to verify an email address
+func web_email_verify(c *gin.Context) {
+	var input struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Token == "" {
+		respond_error(c, http.StatusBadRequest, "invalid_request", "errors.invalid_request", nil)
+		return
+	}
+	user, old, err := email_confirm(input.Token)
+	if err != nil {
+		if err.Error() == "address in use" {
+			respond_error(c, http.StatusConflict, "email_in_use", "errors.email_in_use", nil)
+			return
+		}
+		respond_error(c, http.StatusGone, "email_link_expired", "errors.email_link_expired", nil)
+		return
+	}
+	if old != "" {
+		audit_email_changed(user.Username, user.UID, old, user.Username)
+	}
+	c.JSON(http.StatusOK, gin.H{"address": user.Username, "changed": old != ""})
+}
+
+// email_origin returns the scheme and host of the request an API call is
+// handling, for links back to this server
+func email_origin(t *sl.Thread) (string, string) {
+	user, _ := t.Local("user").(*User)
+	if action, ok := t.Local("action").(*Action); ok && action.web != nil {
+		return request_origin(action.web), request_language(action.web, user)
+	}
+	return "", user_language(user)
+}
+
+// mochi.user.email.get() -> dict: The user's email address and its
+// verification:
+//
+//	address    string — the current address
+//	verified   int    — Unix timestamp it was last verified, or 0
+//	reverify   bool   — whether it is due to be verified again
+//	pending    string — an address being changed to, not yet verified, or ""
+//	requested  int    — Unix timestamp the change was requested, or 0
+func api_user_email_get(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "user/authentication/read"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || user_guest(user) {
+		return sl_error(fn, "no user")
+	}
+	verified, pending, requested := email_state(user.UID)
+	return sl_encode(map[string]any{
+		"address":   user.Username,
+		"verified":  verified,
+		"reverify":  email_reverify_due(verified),
+		"pending":   pending,
+		"requested": requested,
+	}), nil
+}
+
+// mochi.user.email.verify() -> None: Email a link to verify the current
+// address
+func api_user_email_verify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "user/authentication/write"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || user_guest(user) {
+		return sl_error(fn, "no user")
+	}
+	origin, language := email_origin(t)
+	email_verification_send(user, "verify", user.Username, origin, language)
+	return sl.None, nil
+}
+
+// mochi.user.email.change(address) -> None: Start changing the user's
+// address, by emailing a link to the new one. The address changes once the
+// link is followed.
+func api_user_email_change(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "user/authentication/write"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil || user_guest(user) {
+		return sl_error(fn, "no user")
+	}
+	var address string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "address", &address); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	if err := email_change_request(user, address); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	origin, language := email_origin(t)
+	email_verification_send(user, "change", strings.TrimSpace(address), origin, language)
+	return sl.None, nil
+}
+
+// mochi.user.email.cancel() -> None: Abandon a pending change of address
+func api_user_email_cancel(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "user/authentication/write"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, _ := t.Local("user").(*User)
+	if user == nil {
+		return sl_error(fn, "no user")
+	}
+	db_open("db/users.db").exec("update emails set pending='', requested=0 where user=?", user.UID)
+	return sl.None, nil
+}
@@ -0,0 +1,120 @@
+// Mochi server: Email address verification tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	sl "go.starlark.net/starlark"
+)
+
+func TestEmailChange(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+	load_core_labels()
+	gin.SetMode(gin.TestMode)
+
+	user, _ := user_create("old@example.com")
+	if _, err := entity_create(user, "person", "Owner", "public", ""); err != nil {
+		t.Fatal(err)
+	}
+	user = user_by_uid(user.UID)
+	user_create("taken@example.com")
+
+	call := func(name string, args ...sl.Value) (map[string]any, error) {
+		thread := &sl.Thread{}
+		thread.SetLocal("user", user)
+		thread.SetLocal("app", &App{id: "settings", internal: &AppVersion{}})
+		f, _ := api_user_email.Attr(name)
+		v, err := sl.Call(thread, f, sl.Tuple(args), nil)
+		if err != nil {
+			return nil, err
+		}
+		decoded, _ := sl_decode(v).(map[string]any)
+		return decoded, nil
+	}
+
+	state, _ := call("get")
+	if state["address"] != "old@example.com" || as_int64(state["verified"]) != 0 || state["reverify"] != true {
+		t.Errorf("initial state %v", state)
+	}
+	verify := email_token("verify", user.UID, "old@example.com")
+	if _, _, err := email_confirm(verify); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ = call("get"); as_int64(state["verified"]) == 0 || state["reverify"] != false {
+		t.Errorf("verified state %v", state)
+	}
+
+	for _, address := range []string{"not an address", "taken@example.com", "OLD@example.com"} {
+		if _, err := call("change", sl.String(address)); err == nil {
+			t.Errorf("changed to %q", address)
+		}
+	}
+	if _, err := call("change", sl.String("first@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	first := email_token("change", user.UID, "first@example.com")
+	if _, err := call("change", sl.String("new@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ = call("get"); state["pending"] != "new@example.com" || state["address"] != "old@example.com" {
+		t.Errorf("pending state %v", state)
+	}
+
+	// A link for a replaced address, or with a forged signature, is refused
+	if _, _, err := email_confirm(first); err == nil {
+		t.Error("replaced address confirmed")
+	}
+	token := email_token("change", user.UID, "new@example.com")
+	if _, _, err := email_confirm(token[:len(token)-1] + "0"); err == nil {
+		t.Error("forged token confirmed")
+	}
+
+	w := pairing_test_post(web_email_verify, `{"token":"`+token+`"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"changed":true`) {
+		t.Fatalf("verify: %d %s", w.Code, w.Body)
+	}
+	changed := user_by_uid(user.UID)
+	if changed.Username != "new@example.com" {
+		t.Errorf("username %q", changed.Username)
+	}
+	if state, _ = call("get"); state["pending"] != "" {
+		t.Errorf("changed state %v", state)
+	}
+	if w = pairing_test_post(web_email_verify, `{"token":"`+token+`"}`); w.Code != http.StatusGone {
+		t.Errorf("used twice: %d", w.Code)
+	}
+	if _, _, err := email_confirm(verify); err == nil {
+		t.Error("old address verified after change")
+	}
+
+	// Cancelling forgets the pending address
+	call("change", sl.String("later@example.com"))
+	call("cancel")
+	if _, pending, _ := email_state(user.UID); pending != "" {
+		t.Errorf("pending after cancel %q", pending)
+	}
+}
+
+func TestEmailReverify(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_create()
+
+	if email_reverify_due(now()) || !email_reverify_due(now()-366*86400) || !email_reverify_due(0) {
+		t.Error("default reverification period")
+	}
+	setting_set("email_reverify", "0")
+	if email_reverify_due(now() - 3650*86400) {
+		t.Error("reverification due when disabled")
+	}
+}
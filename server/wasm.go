@@ -0,0 +1,402 @@
+// Mochi server: WebAssembly app engine
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	sl "go.starlark.net/starlark"
+)
+
+// Apps with "architecture": {"engine": "wasm"} ship a WASI module — the first
+// file in "execute" — instead of Starlark source. The engine does not
+// duplicate the host API: each exported function of the module is presented
+// to the rest of the server as a Starlark builtin in the app's globals, so
+// actions, events, service functions, database create/upgrade and commit
+// hooks all dispatch through Starlark.call exactly as they do for a Starlark
+// app, with the same concurrency slots, timeouts and cleanup. In the other
+// direction the module reaches the host API through a single import that
+// calls any mochi.* builtin by name, so every API a Starlark app has is
+// available to a wasm app, under the same permissions.
+//
+// The interface, in WIT notation:
+//
+//	interface mochi {
+//	    // Call a host function by dotted name ("mochi.db.rows", or
+//	    // "$0.input" for an attribute of handle 0). args is a JSON array;
+//	    // the result is JSON {"result": value} or {"error": message},
+//	    // written to memory obtained from the guest's mochi_alloc.
+//	    call: func(name: string, args: string) -> string
+//	}
+//
+//	world app {
+//	    import mochi
+//	    export mochi_alloc: func(size: u32) -> u32
+//	    // One export per handler named in app.json, taking the handler's
+//	    // arguments as a JSON array and returning a JSON value ("" for None)
+//	    export handler: func(args: string) -> string
+//	}
+//
+// Strings cross the boundary as (pointer, length) pairs into the guest's
+// exported memory; a returned string is packed into an i64 as
+// pointer<<32 | length. Values JSON cannot carry are passed by handle:
+// {"$handle": n} refers to the nth Starlark value of the current call — the
+// action or event argument, a transaction — and {"$bytes": base64} carries
+// bytes. Every handler call runs in a fresh instance of the module, so no
+// state leaks between calls or users; persistent state belongs in mochi.db.
+
+// Upper bound on a module instance's linear memory: 256 MiB in 64 KiB pages
+const wasm_memory_pages = 4096
+
+var (
+	wasm_runtime      wazero.Runtime
+	wasm_runtime_once sync.Once
+)
+
+// wasm_call is the per-call state the host import needs: the Starlark
+// thread whose locals (user, app, owner, action) identify the caller, and
+// the handles issued so far.
+type wasm_call struct {
+	thread  *sl.Thread
+	handles []sl.Value
+}
+
+type wasm_call_key struct{}
+
+// wasm_runtime_get creates the shared runtime on first use. One runtime serves
+// every wasm app: compiled modules are cached per app version, and
+// CloseOnContextDone makes a cancelled Starlark call (timeout, client gone)
+// stop the guest at its next instruction boundary.
+func wasm_runtime_get() wazero.Runtime {
+	wasm_runtime_once.Do(func() {
+		ctx := context.Background()
+		config := wazero.NewRuntimeConfig().WithCloseOnContextDone(true).WithMemoryLimitPages(wasm_memory_pages)
+		wasm_runtime = wazero.NewRuntimeWithConfig(ctx, config)
+		wasi_snapshot_preview1.MustInstantiate(ctx, wasm_runtime)
+		_, err := wasm_runtime.NewHostModuleBuilder("mochi").
+			NewFunctionBuilder().WithFunc(wasm_host_call).Export("call").
+			Instantiate(ctx)
+		if err != nil {
+			panic(fmt.Sprintf("wasm host module: %v", err))
+		}
+	})
+	return wasm_runtime
+}
+
+// wasm_globals compiles an app version's module and returns its exports as
+// Starlark builtins, in place of the globals a Starlark app would define
+func wasm_globals(av *AppVersion) sl.StringDict {
+	globals := make(sl.StringDict)
+	if len(av.Execute) == 0 {
+		info("Wasm app has no module in execute")
+		return globals
+	}
+	file := av.Execute[0]
+	code, err := os.ReadFile(file)
+	if err != nil {
+		info("Wasm error reading module %v", err)
+		return globals
+	}
+	compiled, err := wasm_runtime_get().CompileModule(context.Background(), code)
+	if err != nil {
+		info("Wasm error compiling module %q: %v", file, err)
+		return globals
+	}
+	exports := compiled.ExportedFunctions()
+	alloc, ok := exports["mochi_alloc"]
+	if !ok {
+		info("Wasm module %q does not export mochi_alloc", file)
+		return globals
+	}
+	if !slices.Equal(alloc.ParamTypes(), []api.ValueType{api.ValueTypeI32}) || !slices.Equal(alloc.ResultTypes(), []api.ValueType{api.ValueTypeI32}) {
+		info("Wasm module %q exports mochi_alloc with the wrong signature; it must take and return an i32", file)
+		return globals
+	}
+	if len(compiled.ExportedMemories()) == 0 {
+		info("Wasm module %q does not export its memory", file)
+		return globals
+	}
+	for name := range exports {
+		switch name {
+		case "mochi_alloc", "_start", "_initialize":
+			continue
+		}
+		function := name
+		globals[name] = sl.NewBuiltin(name, func(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+			return wasm_invoke(t, compiled, function, args)
+		})
+	}
+	return globals
+}
+
+// wasm_invoke runs one exported handler in a fresh instance of the module
+func wasm_invoke(t *sl.Thread, compiled wazero.CompiledModule, function string, args sl.Tuple) (sl.Value, error) {
+	call := &wasm_call{thread: t}
+	input := make([]any, len(args))
+	for i, a := range args {
+		input[i] = call.out(a)
+	}
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("wasm %s(): unable to encode arguments: %v", function, err)
+	}
+
+	ctx := context.WithValue(starlark_context(t), wasm_call_key{}, call)
+	// Reactor modules (TinyGo, Rust cdylib, Go -buildmode=c-shared) set
+	// themselves up in _initialize rather than _start; a missing start
+	// function is skipped
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize")
+	module, err := wasm_runtime_get().InstantiateModule(ctx, compiled, config)
+	if err != nil {
+		return nil, fmt.Errorf("wasm %s(): unable to instantiate module: %v", function, err)
+	}
+	defer module.Close(context.Background())
+
+	ptr, err := wasm_write(ctx, module, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("wasm %s(): %v", function, err)
+	}
+	results, err := module.ExportedFunction(function).Call(ctx, uint64(ptr), uint64(len(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("wasm %s(): %v", function, err)
+	}
+	if len(results) == 0 || results[0] == 0 {
+		return sl.None, nil
+	}
+	output, ok := module.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, fmt.Errorf("wasm %s(): result out of bounds", function)
+	}
+	return call.in_json(output)
+}
+
+// wasm_write copies data into guest memory obtained from mochi_alloc
+func wasm_write(ctx context.Context, module api.Module, data []byte) (uint32, error) {
+	results, err := module.ExportedFunction("mochi_alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, fmt.Errorf("mochi_alloc failed: %v", err)
+	}
+	ptr := uint32(results[0])
+	if !module.Memory().Write(ptr, data) {
+		return 0, fmt.Errorf("mochi_alloc returned out of bounds memory")
+	}
+	return ptr, nil
+}
+
+// wasm_host_call implements mochi.call. Failures are reported to the guest
+// in the result envelope rather than trapping, so the guest decides whether
+// an error is fatal; only an unusable call state or memory traps.
+func wasm_host_call(ctx context.Context, module api.Module, name_ptr, name_len, args_ptr, args_len uint32) uint64 {
+	call, ok := ctx.Value(wasm_call_key{}).(*wasm_call)
+	if !ok {
+		panic("mochi.call outside a handler")
+	}
+	respond := func(envelope map[string]any) uint64 {
+		encoded, err := json.Marshal(envelope)
+		if err != nil {
+			encoded, _ = json.Marshal(map[string]any{"error": err.Error()})
+		}
+		ptr, err := wasm_write(ctx, module, encoded)
+		if err != nil {
+			panic(err)
+		}
+		return uint64(ptr)<<32 | uint64(len(encoded))
+	}
+
+	name, ok := module.Memory().Read(name_ptr, name_len)
+	if !ok {
+		panic("mochi.call name out of bounds")
+	}
+	raw, ok := module.Memory().Read(args_ptr, args_len)
+	if !ok {
+		panic("mochi.call arguments out of bounds")
+	}
+
+	target, err := call.resolve(string(name))
+	if err != nil {
+		return respond(map[string]any{"error": err.Error()})
+	}
+	var args sl.Tuple
+	if len(raw) > 0 {
+		decoded, err := call.in_json(raw)
+		if err != nil {
+			return respond(map[string]any{"error": err.Error()})
+		}
+		list, ok := decoded.(*sl.List)
+		if !ok {
+			return respond(map[string]any{"error": "arguments must be a JSON array"})
+		}
+		for i := 0; i < list.Len(); i++ {
+			args = append(args, list.Index(i))
+		}
+	}
+	result, err := sl.Call(call.thread, target, args, nil)
+	if err != nil {
+		return respond(map[string]any{"error": err.Error()})
+	}
+	return respond(map[string]any{"result": call.out(result)})
+}
+
+// resolve finds the callable for a dotted name: a path through the mochi
+// module, or through the attributes of a handle ("$0.input")
+func (c *wasm_call) resolve(name string) (sl.Callable, error) {
+	parts := strings.Split(name, ".")
+	var v sl.Value
+	if strings.HasPrefix(parts[0], "$") {
+		n, err := strconv.Atoi(parts[0][1:])
+		if err != nil || n < 0 || n >= len(c.handles) {
+			return nil, fmt.Errorf("unknown handle %q", parts[0])
+		}
+		v = c.handles[n]
+	} else {
+		v = api_globals[parts[0]]
+		if v == nil {
+			return nil, fmt.Errorf("unknown function %q", name)
+		}
+	}
+	for _, part := range parts[1:] {
+		attrs, ok := v.(sl.HasAttrs)
+		if !ok {
+			return nil, fmt.Errorf("unknown function %q", name)
+		}
+		next, err := attrs.Attr(part)
+		if err != nil || next == nil {
+			return nil, fmt.Errorf("unknown function %q", name)
+		}
+		v = next
+	}
+	callable, ok := v.(sl.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a function", name)
+	}
+	return callable, nil
+}
+
+// out converts a Starlark value to its JSON form for the guest, issuing a
+// handle for anything JSON cannot represent
+func (c *wasm_call) out(v sl.Value) any {
+	switch x := v.(type) {
+	case nil, sl.NoneType:
+		return nil
+	case sl.Bool:
+		return bool(x)
+	case sl.Int:
+		if i, ok := x.Int64(); ok {
+			return i
+		}
+		return x.String()
+	case sl.Float:
+		return float64(x)
+	case sl.String:
+		return string(x)
+	case sl.Bytes:
+		return map[string]any{"$bytes": base64.StdEncoding.EncodeToString([]byte(x))}
+	case *sl.List:
+		out := make([]any, x.Len())
+		for i := range out {
+			out[i] = c.out(x.Index(i))
+		}
+		return out
+	case sl.Tuple:
+		out := make([]any, len(x))
+		for i, e := range x {
+			out[i] = c.out(e)
+		}
+		return out
+	case *sl.Dict:
+		out := make(map[string]any, x.Len())
+		for _, item := range x.Items() {
+			key, ok := sl.AsString(item[0])
+			if !ok {
+				key = item[0].String()
+			}
+			out[key] = c.out(item[1])
+		}
+		return out
+	}
+	c.handles = append(c.handles, v)
+	return map[string]any{"$handle": len(c.handles) - 1}
+}
+
+// in_json decodes JSON from the guest into a Starlark value
+func (c *wasm_call) in_json(data []byte) (sl.Value, error) {
+	d := json.NewDecoder(strings.NewReader(string(data)))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON from module: %v", err)
+	}
+	return c.in(v)
+}
+
+func (c *wasm_call) in(v any) (sl.Value, error) {
+	switch x := v.(type) {
+	case nil:
+		return sl.None, nil
+	case bool:
+		return sl.Bool(x), nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return sl.MakeInt64(i), nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", x)
+		}
+		return sl.Float(f), nil
+	case string:
+		return sl.String(x), nil
+	case []any:
+		out := make([]sl.Value, len(x))
+		for i, e := range x {
+			ev, err := c.in(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = ev
+		}
+		return sl.NewList(out), nil
+	case map[string]any:
+		if len(x) == 1 {
+			if n, ok := x["$handle"].(json.Number); ok {
+				i, err := n.Int64()
+				if err != nil || i < 0 || int(i) >= len(c.handles) {
+					return nil, fmt.Errorf("unknown handle %v", n)
+				}
+				return c.handles[i], nil
+			}
+			if s, ok := x["$bytes"].(string); ok {
+				b, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return nil, fmt.Errorf("invalid bytes: %v", err)
+				}
+				return sl.Bytes(b), nil
+			}
+		}
+		d := sl.NewDict(len(x))
+		for k, e := range x {
+			ev, err := c.in(e)
+			if err != nil {
+				return nil, err
+			}
+			d.SetKey(sl.String(k), ev)
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("unsupported value %T", v)
+}
@@ -0,0 +1,209 @@
+// Mochi server: WebAssembly app engine tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sl "go.starlark.net/starlark"
+	sls "go.starlark.net/starlarkstruct"
+)
+
+// wasm_test_vec encodes a vector: a count followed by its entries
+func wasm_test_vec(n int, entries ...[]byte) []byte {
+	out := []byte{byte(n)}
+	for _, e := range entries {
+		out = append(out, e...)
+	}
+	return out
+}
+
+func wasm_test_name(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func wasm_test_section(id byte, body []byte) []byte {
+	return append([]byte{id, byte(len(body))}, body...)
+}
+
+// wasm_test_module assembles a minimal app module by hand, so the test needs
+// no toolchain. It imports mochi.call and exports:
+//
+//	mochi_alloc(size) - bump allocator over a global starting at 1024
+//	echo(args)        - returns its argument JSON unchanged
+//	rand(args)        - returns mochi.call("mochi.random.integer", "[3,3]")
+func wasm_test_module() []byte {
+	out := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	i32, i64 := byte(0x7f), byte(0x7e)
+
+	out = append(out, wasm_test_section(1, wasm_test_vec(3,
+		[]byte{0x60, 4, i32, i32, i32, i32, 1, i64},
+		[]byte{0x60, 1, i32, 1, i32},
+		[]byte{0x60, 2, i32, i32, 1, i64},
+	))...)
+	out = append(out, wasm_test_section(2, wasm_test_vec(1,
+		append(append(wasm_test_name("mochi"), wasm_test_name("call")...), 0x00, 0),
+	))...)
+	out = append(out, wasm_test_section(3, wasm_test_vec(3, []byte{1}, []byte{2}, []byte{2}))...)
+	out = append(out, wasm_test_section(5, wasm_test_vec(1, []byte{0x00, 1}))...)
+	out = append(out, wasm_test_section(6, wasm_test_vec(1, []byte{i32, 0x01, 0x41, 0x80, 0x08, 0x0b}))...)
+	out = append(out, wasm_test_section(7, wasm_test_vec(4,
+		append(wasm_test_name("memory"), 0x02, 0),
+		append(wasm_test_name("mochi_alloc"), 0x00, 1),
+		append(wasm_test_name("echo"), 0x00, 2),
+		append(wasm_test_name("rand"), 0x00, 3),
+	))...)
+
+	name := "mochi.random.integer"
+	args := "[3,3]"
+	body := func(code ...byte) []byte {
+		code = append([]byte{0}, code...)
+		return append([]byte{byte(len(code))}, code...)
+	}
+	out = append(out, wasm_test_section(10, wasm_test_vec(3,
+		// global.get 0; global.get 0; local.get 0; i32.add; global.set 0
+		body(0x23, 0, 0x23, 0, 0x20, 0, 0x6a, 0x24, 0, 0x0b),
+		// i64(local 0) << 32 | i64(local 1)
+		body(0x20, 0, 0xad, 0x42, 32, 0x86, 0x20, 1, 0xad, 0x84, 0x0b),
+		// call mochi.call(0, len(name), 32, len(args))
+		body(0x41, 0, 0x41, byte(len(name)), 0x41, 32, 0x41, byte(len(args)), 0x10, 0, 0x0b),
+	))...)
+	out = append(out, wasm_test_section(11, wasm_test_vec(2,
+		append(append([]byte{0, 0x41, 0, 0x0b}, byte(len(name))), name...),
+		append(append([]byte{0, 0x41, 32, 0x0b}, byte(len(args))), args...),
+	))...)
+	return out
+}
+
+// wasm_test_alloc_module assembles a module exporting one function of the
+// given type as both mochi_alloc and a handler, and its memory if memory is
+// set
+func wasm_test_alloc_module(alloc []byte, memory bool) []byte {
+	out := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	out = append(out, wasm_test_section(1, wasm_test_vec(1, alloc))...)
+	out = append(out, wasm_test_section(3, wasm_test_vec(1, []byte{0}))...)
+	exports := [][]byte{append(wasm_test_name("mochi_alloc"), 0x00, 0), append(wasm_test_name("handler"), 0x00, 0)}
+	if memory {
+		out = append(out, wasm_test_section(5, wasm_test_vec(1, []byte{0x00, 1}))...)
+		exports = append(exports, append(wasm_test_name("memory"), 0x02, 0))
+	}
+	out = append(out, wasm_test_section(7, wasm_test_vec(len(exports), exports...))...)
+	// Drop the arguments, and return 0 if there is a result
+	code := []byte{0}
+	for range int(alloc[1]) {
+		code = append(code, 0x20, 0, 0x1a)
+	}
+	if alloc[len(alloc)-1] != 0 {
+		code = append(code, 0x41, 0)
+	}
+	code = append(code, 0x0b)
+	return append(out, wasm_test_section(10, wasm_test_vec(1, append([]byte{byte(len(code))}, code...)))...)
+}
+
+func wasm_test_app(t *testing.T) *AppVersion {
+	t.Helper()
+	if starlark_sem == nil {
+		starlark_sem = make(chan struct{}, 32)
+		starlark_default_timeout = 90 * time.Second
+	}
+	file := filepath.Join(t.TempDir(), "app.wasm")
+	if err := os.WriteFile(file, wasm_test_module(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	av := &AppVersion{Execute: []string{file}}
+	av.Architecture.Engine = "wasm"
+	return av
+}
+
+func TestWasmExports(t *testing.T) {
+	s := wasm_test_app(t).starlark()
+	for _, name := range []string{"echo", "rand"} {
+		if _, ok := s.globals[name]; !ok {
+			t.Errorf("export %q missing from globals", name)
+		}
+	}
+	if _, ok := s.globals["mochi_alloc"]; ok {
+		t.Error("mochi_alloc should not be callable as a handler")
+	}
+}
+
+func TestWasmEcho(t *testing.T) {
+	s := wasm_test_app(t).starlark()
+	handle := sls.FromStringDict(sl.String("thing"), sl.StringDict{})
+	result, err := s.call("echo", sl.Tuple{sl.String("hi"), sl.MakeInt(7), sl.Bytes("\x00\x01"), handle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, ok := result.(*sl.List)
+	if !ok || list.Len() != 4 {
+		t.Fatalf("echo returned %v", result)
+	}
+	if list.Index(0) != sl.String("hi") {
+		t.Errorf("string round trip gave %v", list.Index(0))
+	}
+	if n, _ := sl.AsInt32(list.Index(1)); n != 7 {
+		t.Errorf("integer round trip gave %v", list.Index(1))
+	}
+	if list.Index(2) != sl.Bytes("\x00\x01") {
+		t.Errorf("bytes round trip gave %v", list.Index(2))
+	}
+	if list.Index(3) != handle {
+		t.Errorf("handle round trip gave %v", list.Index(3))
+	}
+}
+
+func TestWasmHostCall(t *testing.T) {
+	s := wasm_test_app(t).starlark()
+	result, err := s.call("rand", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok := result.(*sl.Dict)
+	if !ok {
+		t.Fatalf("rand returned %v", result)
+	}
+	v, _, _ := d.Get(sl.String("result"))
+	if n, _ := sl.AsInt32(v); n != 3 {
+		t.Errorf("mochi.random.integer(3, 3) via host call gave %v", result)
+	}
+}
+
+func TestWasmBadModule(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.wasm")
+	if err := os.WriteFile(file, []byte("not wasm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	av := wasm_test_app(t)
+	av.Execute = []string{file}
+	if _, err := av.starlark().call("echo", nil); err == nil {
+		t.Error("expected an error calling into an invalid module")
+	}
+}
+
+func TestWasmModuleRefused(t *testing.T) {
+	i32 := byte(0x7f)
+	modules := map[string][]byte{
+		"valid":         wasm_test_alloc_module([]byte{0x60, 1, i32, 1, i32}, true),
+		"no result":     wasm_test_alloc_module([]byte{0x60, 1, i32, 0}, true),
+		"no parameters": wasm_test_alloc_module([]byte{0x60, 0, 1, i32}, true),
+		"no memory":     wasm_test_alloc_module([]byte{0x60, 1, i32, 1, i32}, false),
+	}
+	for name, module := range modules {
+		file := filepath.Join(t.TempDir(), "app.wasm")
+		if err := os.WriteFile(file, module, 0644); err != nil {
+			t.Fatal(err)
+		}
+		av := wasm_test_app(t)
+		av.Execute = []string{file}
+		if _, loaded := wasm_globals(av)["handler"]; loaded != (name == "valid") {
+			t.Errorf("%s module loaded %v", name, loaded)
+		}
+	}
+}
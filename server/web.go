@@ -15,11 +15,14 @@ import (
 	"html"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -51,7 +54,9 @@ var (
 // takes a long time: git pack upload/receive, restore-bundle uploads, large
 // attachment transfers, and websocket upgrades that stay open for the life of
 // the session. ReadHeaderTimeout bounds only the header phase and IdleTimeout
-// only the gap between keep-alive requests, so neither touches those.
+// only the gap between keep-alive requests, so neither touches those. Slow
+// request bodies and unread responses are bounded per request instead; see
+// web_body.go.
 func web_server(addr string, handler http.Handler) *http.Server {
 	return &http.Server{
 		Addr:              addr,
@@ -105,53 +110,9 @@ func web_connections_maximum() int {
 	return ini_int("web", "connections", web_connections_default)
 }
 
-// web_serve_tls serves HTTPS on :443 and ACME/redirect on :80. It replaces
-// autotls.RunWithManagerAndTLSConfig, which overwrote the tls.Config's
-// GetCertificate with the bare autocert manager's — silently discarding
-// domains_get_certificate and with it every manually installed certificate.
-// Wildcards can only ever be manual (ACME issues none over TLS-ALPN-01 or
-// HTTP-01), so those domains fell through to autocert and failed to serve.
-// The domain, verification and TLS-enabled checks were not lost with it: the
-// manager's HostPolicy (domains_host_policy) already enforces all three.
-//
-// Ports match autotls exactly (:443 and :80, all interfaces) so the listener
-// topology is unchanged; the only differences are the retained GetCertificate
-// and the connection limits from web_server.
-func web_serve_tls(handler http.Handler) error {
-	tls_config := web_tls_config()
-
-	errors := make(chan error, 2)
-
-	// HTTP-01 challenges and the plain-HTTP redirect, as autotls served them.
-	go func() {
-		s := web_server(":80", domains_acme_manager.HTTPHandler(http.HandlerFunc(web_redirect_https)))
-		listener, err := web_listen(":80", web_connections_maximum())
-		if err != nil {
-			errors <- err
-			return
-		}
-		errors <- s.Serve(listener)
-	}()
-
-	go func() {
-		s := web_server(":443", handler)
-		s.TLSConfig = tls_config
-		listener, err := web_listen(":443", web_connections_maximum())
-		if err != nil {
-			errors <- err
-			return
-		}
-		// The bound counts connections from accept, so one stalled in the TLS
-		// handshake occupies a slot exactly as a completed one does.
-		errors <- s.ServeTLS(listener, "", "")
-	}()
-
-	return <-errors
-}
-
-// web_tls_config builds the TLS configuration the HTTPS listener serves with.
-// Separated from web_serve_tls so a test can exercise the configuration the
-// server actually uses, rather than a copy of it that could drift.
+// web_tls_config builds the TLS configuration HTTPS listeners serve with.
+// Separated from web_serve_listeners so a test can exercise the configuration
+// the server actually uses, rather than a copy of it that could drift.
 func web_tls_config() *tls.Config {
 	return &tls.Config{
 		// Retaining domains_get_certificate is the whole point: it tries a
@@ -211,6 +172,7 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 			if uid, app, err := jwt_verify(query_token); err == nil && uid != "" {
 				user = user_by_uid(uid)
 				if user != nil {
+					impersonation_mark(user, jwt_login(query_token))
 					jwt_app = app
 					has_bearer = true // treat as bearer-authenticated
 				}
@@ -249,6 +211,7 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 				jwt_app = app
 				if user == nil {
 					if u := user_by_uid(uid); u != nil {
+						impersonation_mark(u, jwt_login(bearer))
 						user = u
 					} else {
 						debug("API JWT token valid but user %q not found", uid)
@@ -329,6 +292,13 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 		return true
 	}
 
+	// Guests may use apps, but change things far less often than accounts
+	if user_guest(user) && c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead && !rate_limit_guest.allow(user.UID) {
+		respond_error(c, http.StatusTooManyRequests, "rate_limit_exceeded_please_try_again_later", "errors.rate_limit_exceeded", nil)
+		c.Abort()
+		return true
+	}
+
 	// Run first-time setup for this user and app (grants default permissions)
 	app_user_setup(user, a.id)
 
@@ -379,12 +349,23 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 		return false
 	}
 
+	// Requests from another origin the app declares, including preflights,
+	// which carry no credentials and so are answered before authentication
+	if web_cors(c, a, av) {
+		return true
+	}
+
 	// Compute owner based on entity, domain route owner, or authenticated user
 	var owner *User = user
 	if e != nil {
 		if o := user_owning_entity(e.ID); o != nil {
 			owner = o
 		}
+		// Only administrators see past a suspended user's notice
+		if owner != nil && owner.Status == "suspended" && (user == nil || !user.administrator()) {
+			web_suspended_notice(c)
+			return true
+		}
 	} else if owner == nil {
 		// Fall back to domain route owner for anonymous requests without entity
 		if route_owner, ok := c.Get("domain_owner"); ok {
@@ -403,6 +384,27 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 		}
 	}
 
+	// An anonymous request for an action that is not public may carry a
+	// share link granting it, which runs it as the user who shared it
+	var share *Share
+	if user == nil && !aa.Public {
+		var ok bool
+		share, ok = share_authorize(c, a.id, aa.name)
+		if !ok {
+			share_refuse(c)
+			return true
+		}
+		if share != nil {
+			if o := user_by_uid(share.User); o != nil && (e == nil || owner == nil || owner.UID == o.UID) {
+				owner = o
+			} else {
+				share_refuse(c)
+				return true
+			}
+		}
+	}
+	shared := aa.Public || share != nil
+
 	// Handle git Smart HTTP protocol for domain-routed repository entities.
 	// Git clients send requests to /info/refs, /git-upload-pack, /git-receive-pack
 	// directly under the entity URL, bypassing standard app action routing.
@@ -419,7 +421,7 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 	shell_static := aa.File != "" || (aa.Files != "" && aa.filepath != "") || (web_is_iframe_request(c) && (aa.File != "" || aa.Files != ""))
 
 	// Require authentication for non-public actions
-	if user == nil && !aa.Public {
+	if user == nil && !shared {
 		// Top-level browser navigations: redirect to login page at /
 		// This applies even for file-serving actions (shell_static) — only iframe
 		// requests should bypass auth for static file loading.
@@ -475,6 +477,11 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 		return true
 	}
 
+	// Count page loads of an entity's public actions for its owner
+	if e != nil && aa.Public && prefer_html {
+		analytics_view(c, e, aa.name, user, owner)
+	}
+
 	// Handle git Smart HTTP protocol
 	if aa.Feature == "git" {
 		repo := aa.parameters["repository"]
@@ -508,12 +515,7 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 				web_serve_html(c, a, av, aa, e, file)
 				return true
 			}
-			web_cache_static(c, file, aa.Cache)
-			if strings.HasSuffix(strings.ToLower(aa.File), ".svg") {
-				web_serve_svg(c, file)
-				return true
-			}
-			c.File(file)
+			web_serve_static(c, av.base, file, aa.Cache)
 			return true
 		}
 	}
@@ -525,14 +527,9 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 				respond_error(c, http.StatusBadRequest, "invalid_file", "errors.invalid_file", nil)
 				return true
 			}
-			file := av.base + "/" + aa.Files + "/" + aa.filepath
-			//debug("Serving file from directory for app %q: %q", a.id, file)
-			web_cache_static(c, file, aa.Cache)
-			if strings.HasSuffix(strings.ToLower(aa.filepath), ".svg") {
-				web_serve_svg(c, file)
-			} else {
-				c.File(file)
-			}
+			root := av.base + "/" + aa.Files
+			//debug("Serving file from directory for app %q: %q", a.id, root+"/"+aa.filepath)
+			web_serve_static(c, root, root+"/"+aa.filepath, aa.Cache)
 		} else {
 			respond_error(c, http.StatusBadRequest, "no_file_specified", "errors.no_file_specified", nil)
 		}
@@ -540,7 +537,7 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 	}
 
 	// Require authentication for database-backed apps (unless action is public)
-	if av.Database.File != "" && user == nil && owner == nil && !aa.Public {
+	if av.Database.File != "" && user == nil && owner == nil && !shared {
 		respond_error(c, http.StatusUnauthorized, "authentication_required_for_database_access", "errors.auth_required_db", nil)
 		return true
 	}
@@ -566,6 +563,13 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 		}
 	}
 
+	// Every action run while an administrator acts as the user is audited
+	if user != nil && user.Impersonator != "" {
+		if administrator := user_by_uid(user.Impersonator); administrator != nil {
+			audit_impersonation_action(administrator.Username, user.Username, a.id, name)
+		}
+	}
+
 	// Create action
 	action := Action{
 		id:    action_id(),
@@ -598,9 +602,15 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 	// bytes. Restore Request.Body so downstream code (multipart upload,
 	// form parsing) can still read it — io.ReadAll otherwise leaves the
 	// body at EOF and breaks every non-JSON action.
+	if !web_body_action(c, aa) {
+		return true
+	}
 	content_type := c.Request.Header.Get("Content-Type")
 	if c.Request.Body != nil && (strings.HasPrefix(content_type, "application/json") || strings.HasPrefix(content_type, "text/")) {
 		raw, err := io.ReadAll(c.Request.Body)
+		if err != nil && web_body_error(c, err) {
+			return true
+		}
 		if err == nil {
 			action.body = string(raw)
 			c.Request.Body.Close()
@@ -616,6 +626,13 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 		}
 	}
 
+	// Forms posted with the session cookie must carry a CSRF token. This is
+	// checked before a multipart body is parsed, so a forged upload isn't
+	// read and spooled first.
+	if csrf_check(&action, aa, has_bearer || api_token != nil) {
+		return true
+	}
+
 	// Read the entire multipart body BEFORE running the action: uploads
 	// arrive at the client's network speed, and parsing them lazily inside
 	// a.file() charged the transfer time against the Starlark timeout — a
@@ -630,18 +647,19 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 		// controls, so it only saves us reading a body we already know is too
 		// big; MaxBytesReader is what actually enforces the ceiling.
 		maximum := web_multipart_maximum(user)
+		if declared := web_body_declared(aa); declared > 0 {
+			maximum = min(maximum, declared+web_multipart_framing)
+		}
 		if c.Request.ContentLength > maximum {
 			respond_error(c, http.StatusRequestEntityTooLarge, "body_too_large", "errors.body_too_large", nil)
 			return true
 		}
 		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maximum)
 		if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
-			// Only the size failure is answered here. Every other parse error
-			// is still left for the handler's own a.file()/form call to
-			// surface, preserving existing behaviour.
-			var exceeded *http.MaxBytesError
-			if errors.As(err, &exceeded) {
-				respond_error(c, http.StatusRequestEntityTooLarge, "body_too_large", "errors.body_too_large", nil)
+			// Only the size and slow client failures are answered here.
+			// Every other parse error is still left for the handler's own
+			// a.file()/form call to surface, preserving existing behaviour.
+			if web_body_error(c, err) {
 				return true
 			}
 			debug("Multipart parse: %v", err)
@@ -656,17 +674,40 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 			return true
 		}
 
-		aa.internal_function(&action)
+		if err := fault_recover(name, func() { aa.internal_function(&action) }); err != nil {
+			app_fault(c, a, av, err)
+			return true
+		}
 		c.JSON(http.StatusOK, nil)
 
-	case "starlark":
+	case "starlark", "wasm":
 		if aa.Function == "" {
 			respond_error(c, http.StatusInternalServerError, "action_has_no_function", "errors.action_has_no_function", nil)
 			return true
 		}
 
-		// Call Starlark function
+		release, ok := action_acquire(av, aa)
+		if !ok {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "action_busy"})
+			return true
+		}
+
+		// Call Starlark function. The slot is released when the call's work
+		// ends, not when it returns: a call abandoned at its timeout still
+		// counts against the cap until it winds down.
 		s := av.starlark()
+		s.finished = release
+		s.timeout = time.Duration(aa.Timeout) * time.Second
+		timeout := s.timeout
+		if timeout <= 0 {
+			timeout = starlark_default_timeout
+		}
+		web_write_deadline(c, starlark_queue_timeout+timeout)
+		if aa.Stream {
+			action.stream = &sse_stream{c: c}
+			defer action.stream.close()
+		}
 		s.set("action", &action)
 		s.set("app", a)
 		s.set("host", c.Request.Host)
@@ -677,24 +718,42 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 		// that anonymous invocation is the design. Run such requests as the
 		// app's owner, the same way every CGI/FastCGI/PHP-FPM system runs
 		// scripts as a fixed user. Authenticated requests are unaffected.
+		// A request granted by a share link runs as the user who shared it.
 		effective := user
-		if effective == nil && aa.Public {
+		if effective == nil && shared {
 			effective = owner
 		}
 		s.set("user", effective)
 		s.set("owner", owner)
 		s.set("language", request_language(c, user))
+		s.set("languages", request_languages(c, user))
 		if e != nil {
 			s.set("route_entity", e.ID)
 		}
+		if share != nil {
+			s.set("share", share)
+		}
 
 		result, err := s.call(aa.Function, sl.Tuple{&action})
 		if err != nil {
+			// A panic is logged for the app's developer whether or not the
+			// response has started
+			if app_fault(c, a, av, err) {
+				return true
+			}
 			// If the response has already been written (e.g. file serving),
 			// we can't send an error response
 			if c.Writer.Written() {
 				return true
 			}
+			// A call cancelled at its deadline is the server giving up, not
+			// the app failing: say so, and when to try again
+			var timeout *TimeoutError
+			if errors.As(err, &timeout) {
+				c.Header("Retry-After", strconv.Itoa(int(timeout.After.Seconds())))
+				c.JSON(http.StatusGatewayTimeout, gin.H{"error": "timeout"})
+				return true
+			}
 			// Check for permission error and return structured response
 			var permErr *PermissionError
 			if errors.As(err, &permErr) {
@@ -723,6 +782,9 @@ func web_action(c *gin.Context, a *App, name string, e *Entity) bool {
 				c.Status(http.StatusOK)
 			}
 		}
+		if action.stream != nil {
+			action.stream.serve()
+		}
 
 	default:
 		info("Action unknown engine %q version %q", av.Architecture.Engine, av.Architecture.Version)
@@ -738,6 +800,7 @@ func web_auth(c *gin.Context) *User {
 	if user != nil {
 		// Refresh cookie to reset browser expiry limits
 		web_cookie_set(c, "session", session)
+		presence_touch(user)
 	}
 	return user
 }
@@ -760,6 +823,90 @@ func web_serve_svg(c *gin.Context, path string) {
 	c.Data(http.StatusOK, "image/svg+xml", svg_sanitize(data))
 }
 
+// Content types of the files apps serve, so they don't depend on the
+// host's MIME tables, which often lack the newer ones
+var web_static_types = map[string]string{
+	".css":         "text/css; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".ico":         "image/x-icon",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".mjs":         "text/javascript; charset=utf-8",
+	".otf":         "font/otf",
+	".png":         "image/png",
+	".ttf":         "font/ttf",
+	".txt":         "text/plain; charset=utf-8",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xml":         "application/xml",
+}
+
+// web_static_path resolves an app file under root, following symbolic links,
+// and returns it if it's a regular file that stays under root
+func web_static_path(root, path string) (string, os.FileInfo, bool) {
+	base, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", nil, false
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, false
+	}
+	if rel, err := filepath.Rel(base, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", nil, false
+	}
+	fi, err := os.Stat(resolved)
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", nil, false
+	}
+	return resolved, fi, true
+}
+
+// web_serve_static serves a file from an app's directory under the cache
+// policy of its action, with an ETag and Last-Modified for each file so
+// browsers can revalidate it and get 304 if it hasn't changed. Files that
+// aren't regular files under root, such as directories or links out of it,
+// are not found.
+func web_serve_static(c *gin.Context, root, path, cache string) {
+	file, fi, ok := web_static_path(root, path)
+	if !ok {
+		respond_error(c, http.StatusNotFound, "file_not_found", "errors.file_not_found", nil)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+	web_cache_static(c, path, cache)
+	c.Header("ETag", etag)
+
+	extension := strings.ToLower(filepath.Ext(path))
+	if extension == ".svg" {
+		if web_not_modified(c.Request, etag, fi.ModTime()) {
+			c.AbortWithStatus(http.StatusNotModified)
+			return
+		}
+		c.Header("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+		web_serve_svg(c, file)
+		return
+	}
+	if t, found := web_static_types[extension]; found {
+		c.Header("Content-Type", t)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		respond_error(c, http.StatusNotFound, "file_not_found", "errors.file_not_found", nil)
+		return
+	}
+	defer f.Close()
+	// ServeContent answers If-None-Match against the ETag set above and
+	// If-Modified-Since against the file's time, as well as Range requests
+	http.ServeContent(c.Writer, c.Request, fi.Name(), fi.ModTime(), f)
+}
+
 func web_cache_static(c *gin.Context, path string, cache string) {
 	if !web_cache {
 		c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -774,13 +921,6 @@ func web_cache_static(c *gin.Context, path string, cache string) {
 			c.Header("Cache-Control", "public, max-age=300")
 		case "revalidate":
 			c.Header("Cache-Control", "no-cache, must-revalidate")
-			if info, err := os.Stat(path); err == nil {
-				etag := fmt.Sprintf(`"%x"`, info.ModTime().UnixNano())
-				c.Header("ETag", etag)
-				if match := c.GetHeader("If-None-Match"); match == etag {
-					c.AbortWithStatus(http.StatusNotModified)
-				}
-			}
 		case "none":
 			c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
 		}
@@ -788,18 +928,9 @@ func web_cache_static(c *gin.Context, path string, cache string) {
 	}
 	// Auto-detect cache policy from file path
 	if strings.HasSuffix(path, ".html") {
-		// HTML files should revalidate on every request
-		// Add ETag based on file modification time for proper cache validation
+		// HTML files should revalidate on every request, against the
+		// validators web_serve_static sets
 		c.Header("Cache-Control", "no-cache, must-revalidate")
-		if info, err := os.Stat(path); err == nil {
-			etag := fmt.Sprintf(`"%x"`, info.ModTime().UnixNano())
-			c.Header("ETag", etag)
-			// Check If-None-Match header for conditional request
-			if match := c.GetHeader("If-None-Match"); match == etag {
-				c.AbortWithStatus(http.StatusNotModified)
-				return
-			}
-		}
 	} else if match_react.MatchString(path) {
 		// debug("Web asking browser to long term cache %q", path)
 		c.Header("Cache-Control", "public, max-age=31536000, immutable")
@@ -854,18 +985,24 @@ func web_security_headers(c *gin.Context) {
 	c.Header("Access-Control-Expose-Headers", "Content-Disposition")
 	// Handle CORS preflight requests from sandboxed iframes.
 	// When the iframe sends requests with Authorization header,
-	// browsers send an OPTIONS preflight first.
-	if c.Request.Method == "OPTIONS" {
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, PATCH, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept")
-		c.Header("Access-Control-Max-Age", "86400")
-		c.AbortWithStatus(204)
+	// browsers send an OPTIONS preflight first. A preflight from an origin
+	// an app has been allowed is left for the app's policy; see cors.go.
+	if c.Request.Method == "OPTIONS" && !(web_preflight(c) && cors_accepted(c.GetHeader("Origin"))) {
+		web_preflight_default(c)
 		return
 	}
 	c.Header("Referrer-Policy", "strict-origin-when-cross-origin")
 	c.Next()
 }
 
+// Answer a CORS preflight for any origin, without credentials
+func web_preflight_default(c *gin.Context) {
+	c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, PATCH, OPTIONS")
+	c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept")
+	c.Header("Access-Control-Max-Age", "86400")
+	c.AbortWithStatus(204)
+}
+
 // The ceiling on a request body that carries no file upload. Multipart and git
 // pack bodies are exempt here because uploads legitimately exceed it; they are
 // bounded separately, by web_multipart_maximum and the git RPC respectively.
@@ -879,8 +1016,8 @@ const web_multipart_framing = 64 << 10 // 64KB
 // Request body size limit middleware (skip multipart/form-data for file uploads
 // and git pack data for push operations)
 func web_body_limit(c *gin.Context) {
-	ct := c.GetHeader("Content-Type")
-	if !strings.HasPrefix(ct, "multipart/form-data") && !strings.HasPrefix(ct, "application/x-git-") {
+	web_body_guard(c)
+	if web_body_limited(c) {
 		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, web_body_maximum)
 	}
 	c.Next()
@@ -950,6 +1087,7 @@ func web_serve_file_with_opengraph(c *gin.Context, a *App, av *AppVersion, aa *A
 	// previews). Use Accept-Language to drive the meta-tag language; a
 	// logged-in viewer's specific preference can be wired in later if needed.
 	s.set("language", request_language(c, nil))
+	s.set("languages", request_languages(c, nil))
 
 	// Build parameters dict for the function
 	params := sl.NewDict(len(aa.parameters))
@@ -1086,6 +1224,9 @@ func web_inject_meta_tags(c *gin.Context, e *Entity, content string) string {
 
 	if app != "" {
 		tags = append(tags, `<meta name="mochi:app" content="`+escape_attr(app)+`">`)
+		if dm != "entity" && dm != "app" {
+			tags = append(tags, pwa_tags(web_auth(c), app)...)
+		}
 	}
 	if e != nil {
 		tags = append(tags, `<meta name="mochi:class" content="`+escape_attr(e.Class)+`">`)
@@ -1230,8 +1371,8 @@ func web_login_begin(c *gin.Context) {
 	user := user_by_username(input.Email)
 
 	if user == nil {
-		// User doesn't exist - check if signup is enabled
-		if !setting_signup_enabled() {
+		// User doesn't exist - check if signup is enabled, or they were invited
+		if !signup_allowed(c) {
 			respond_error(c, http.StatusForbidden, "signup_disabled", "errors.signup_disabled", nil)
 			return
 		}
@@ -1338,6 +1479,7 @@ func web_identity_get(c *gin.Context) {
 				// JWT authentication
 				if uid, _, err := jwt_verify(bearer); err == nil && uid != "" {
 					if user := user_by_id_allow_no_identity(uid); user != nil {
+						impersonation_mark(user, jwt_login(bearer))
 						u = user
 					}
 				}
@@ -1355,8 +1497,21 @@ func web_identity_get(c *gin.Context) {
 			"email":  u.Username,
 			"name":   "", // Will be populated below if identity exists
 			"status": u.Status,
+			"guest":  user_guest(u),
 		},
 	}
+	if user_guest(u) {
+		response["user"].(gin.H)["email"] = ""
+	}
+
+	// An administrator acting as the user is shown, so apps can say so
+	if u.Impersonator != "" {
+		impersonator := gin.H{"uid": u.Impersonator}
+		if administrator := user_by_uid(u.Impersonator); administrator != nil {
+			impersonator["username"] = administrator.Username
+		}
+		response["impersonator"] = impersonator
+	}
 
 	// A closing account carries the purge timestamp so the reactivation
 	// interstitial can show the deletion date.
@@ -1568,7 +1723,12 @@ func web_path(c *gin.Context) {
 	// Get user for path-based routing preferences
 	user := web_auth(c)
 
-	// During bootstrap, show setup page until Login and Home are installed
+	// During bootstrap, show setup page until Login and Home are installed,
+	// or the first-run setup form if there are no users yet
+	if !apps_bootstrap_ready && setup_open() {
+		c.Redirect(http.StatusFound, "/_/setup")
+		return
+	}
 	if !apps_bootstrap_ready {
 		c.Header("Refresh", "2")
 		c.Data(http.StatusOK, "text/html", []byte(`<!DOCTYPE html>
@@ -1686,6 +1846,12 @@ func web_path(c *gin.Context) {
 			second = segments[1]
 		}
 
+		// Route on /<app>/_/<file> for installing the app
+		if second == "_" && len(segments) == 3 {
+			pwa_serve(c, a, user, first, segments[2])
+			return
+		}
+
 		// Route on /<app>/<entity>[/<action...>]
 		e := entity_by_any(second)
 		if e != nil {
@@ -1771,15 +1937,12 @@ func web_sitemap(c *gin.Context) {
 
 // Start the web server
 func web_start() {
-	listen := ini_string("web", "listen", "")
-	ports := ini_ints_commas("web", "ports")
-	if len(ports) == 0 {
-		// Fallback to legacy single port config
-		port := ini_int("web", "port", 80)
-		if port == 0 {
-			return
-		}
-		ports = []int{port}
+	listeners, problems := web_listeners()
+	for _, p := range problems {
+		warn("Web listener skipped: %s", p)
+	}
+	if len(listeners) == 0 && len(problems) == 0 {
+		return
 	}
 
 	if !ini_bool("web", "debug", false) {
@@ -1791,6 +1954,7 @@ func web_start() {
 	// libp2p WebSocket upgrade to the loopback libp2p listener. No-op
 	// unless the 443 fallback is enabled and the request is exactly that.
 	r.Use(fallback_middleware)
+	r.Use(web_request_id)
 	r.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
 		status := fmt.Sprintf("%d", param.StatusCode)
 		if log_color && param.StatusCode >= 400 {
@@ -1804,7 +1968,7 @@ func web_start() {
 			param.Latency,
 		)
 	}))
-	r.Use(gin.Recovery())
+	r.Use(gin.CustomRecovery(web_recovery))
 	r.Use(web_security_headers)
 	r.Use(web_sticky_session)
 	r.Use(web_body_limit)
@@ -1812,7 +1976,11 @@ func web_start() {
 	if web_compress != "none" {
 		r.Use(web_compress_middleware)
 	}
+	if mirror_primary != "" {
+		r.Use(mirror_middleware)
+	}
 	r.Use(domains_middleware())
+	r.Use(maintenance_middleware)
 	r.RedirectTrailingSlash = false
 
 	// Auth endpoints (grouped under /_/auth/)
@@ -1824,6 +1992,11 @@ func web_start() {
 	r.POST("/_/auth/passkey/begin", rate_limit_login_middleware, web_passkey_login_begin)
 	r.POST("/_/auth/passkey/finish", rate_limit_login_middleware, web_passkey_login_finish)
 	r.POST("/_/auth/recovery", rate_limit_login_middleware, web_recovery_login)
+	r.POST("/_/auth/pair/claim", rate_limit_login_middleware, web_pairing_claim)
+	r.POST("/_/auth/pair/finish", web_pairing_finish)
+	r.POST("/_/auth/email/verify", rate_limit_login_middleware, web_email_verify)
+	r.POST("/_/auth/login/denied", rate_limit_login_middleware, web_login_denied)
+	r.POST("/_/auth/impersonation/stop", web_impersonation_stop)
 	r.POST("/_/auth/restore", rate_limit_login_middleware, web_auth_restore)
 	r.GET("/_/auth/restore/progress", web_auth_restore_progress)
 	r.POST("/_/auth/oauth/:provider/begin", rate_limit_login_middleware, web_oauth_begin)
@@ -1832,6 +2005,8 @@ func web_start() {
 	r.GET("/_/auth/methods", web_auth_methods)
 	r.GET("/_/auth/partial", web_auth_partial)
 	r.POST("/_/auth/close/cancel", web_auth_close_cancel)
+	r.POST("/_/auth/guest", rate_limit_login_middleware, web_auth_guest)
+	r.POST("/_/auth/invite", rate_limit_login_middleware, web_auth_invite)
 
 	// Other system endpoints
 	r.GET("/_/identity", web_identity_get)
@@ -1840,7 +2015,12 @@ func web_start() {
 	r.POST("/_/abandon", web_abandon)
 	r.GET("/_/ping", web_ping)
 	r.GET("/_/health", web_health)
+	r.GET("/_/metrics", web_metrics)
+	r.POST("/_/email/bounce", web_email_bounce)
 	r.GET("/_/p2p/info", web_p2p_info)
+	r.GET("/.well-known/mochi", web_metadata)
+	r.GET("/.well-known/nodeinfo", web_nodeinfo_links)
+	r.GET("/_/nodeinfo/2.1", web_nodeinfo)
 	r.GET("/sw.js", webpush_service_worker)
 	r.GET("/robots.txt", web_robots)
 	r.GET("/sitemap.xml", web_sitemap)
@@ -1848,60 +2028,18 @@ func web_start() {
 	r.POST("/_/token", web_shell_token)
 	r.POST("/_/shell", web_shell_init)
 	r.GET("/_/languages", web_languages)
+	r.GET("/_/setup", web_setup)
+	r.POST("/_/setup", rate_limit_login_middleware, web_setup_submit)
 
 	// All other paths are handled by web_path()
 	r.NoRoute(web_path)
+	web_router = r
 
-	// Check if HTTPS should be enabled (port 443 with domains configured)
-	domains := domain_list()
-	https := false
-	for _, port := range ports {
-		if port == 443 && len(domains) > 0 {
-			https = true
-			break
-		}
-	}
-
-	// Start listeners for each port
-	for i, port := range ports {
-		last := i == len(ports)-1
-
-		if port == 443 {
-			if len(domains) == 0 {
-				warn("Port 443 configured but no domains in database, skipping HTTPS")
-				continue
-			}
-			web_https = true
-			info("Web listening on %s:443 (HTTPS)", listen)
-			if last {
-				must(web_serve_tls(r))
-			} else {
-				go must(web_serve_tls(r))
-			}
-		} else {
-			addr := fmt.Sprintf("%s:%d", listen, port)
-			if https {
-				info("Web listening on %s (HTTP, ACME challenges)", addr)
-			} else {
-				info("Web listening on %s (HTTP)", addr)
-			}
-			s := web_server(addr, r)
-			listener, err := web_listen(addr, web_connections_maximum())
-			if err != nil {
-				warn("Unable to listen on %s: %v", addr, err)
-				continue
-			}
-			if last {
-				must(s.Serve(listener))
-			} else {
-				go must(s.Serve(listener))
-			}
-		}
-	}
+	web_serve_listeners(r, listeners)
 }
 
-// Serve an attachment or one of its image variants ("thumbnail" or "preview";
-// "" serves the original bytes)
+// Serve an attachment or one of its image variants ("thumbnail", "preview" or
+// a size preset; "" serves the original bytes)
 func web_serve_attachment(c *gin.Context, app *App, user *User, entity, id string, variant string) bool {
 	if !valid(id, "id") {
 		respond_error(c, http.StatusBadRequest, "invalid_attachment_id", "errors.invalid_attachment_id", nil)
@@ -1967,20 +2105,12 @@ func web_serve_attachment(c *gin.Context, app *App, user *User, entity, id strin
 		}
 	}
 
-	// Use ETag for cache validation so deleted files don't persist in browser cache
-	etag := fmt.Sprintf(`"%s"`, att.ID)
-	c.Header("ETag", etag)
-	c.Header("Cache-Control", "private, must-revalidate")
-
-	// Check If-None-Match for conditional requests
-	if match := c.GetHeader("If-None-Match"); match == etag {
-		c.Status(http.StatusNotModified)
-		return true
-	}
-
-	if variant != "" && is_image(att.Name) {
-		if thumb, err := variant_create(path, variant); err == nil && thumb != "" {
-			c.File(thumb)
+	// Use ETag for cache validation so deleted files don't persist in browser
+	// cache. Variants get their own, matching the remote path below. A PDF
+	// without a renderer falls through to the PDF itself.
+	if variant != "" {
+		if thumb, err := attachment_variant_file(app, path, &att, variant); err == nil && thumb != "" {
+			web_serve_file(c, thumb, attachment_etag(att.ID, focus_etag(variant, att.Focus)))
 			return true
 		}
 	}
@@ -1999,8 +2129,9 @@ func web_serve_attachment(c *gin.Context, app *App, user *User, entity, id strin
 		// clear the middleware's header for these responses.
 		c.Header("X-Frame-Options", "")
 	}
+	c.Header("Content-Type", ct)
 	c.Header("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, att.Name))
-	c.File(path)
+	web_serve_file(c, path, attachment_etag(att.ID, ""))
 	return true
 }
 
@@ -2017,24 +2148,6 @@ func web_serve_attachment_remote(c *gin.Context, app *App, user *User, entity, i
 		return true
 	}
 
-	// ETag cache validation ("-thumb" predates the preview variant and is kept
-	// so browser caches of existing thumbnails stay valid)
-	suffix := ""
-	switch variant {
-	case "thumbnail":
-		suffix = "-thumb"
-	case "preview":
-		suffix = "-preview"
-	}
-	etag := fmt.Sprintf(`"%s%s"`, id, suffix)
-	c.Header("ETag", etag)
-	c.Header("Cache-Control", "private, must-revalidate")
-
-	if match := c.GetHeader("If-None-Match"); match == etag {
-		c.Status(http.StatusNotModified)
-		return true
-	}
-
 	// The remote fetch gives us bytes with no filename/extension, so the cache
 	// path carries no type hint and c.File would let Go sniff the content —
 	// labelling an HTML/SVG payload text/html and rendering it inline in this
@@ -2051,10 +2164,125 @@ func web_serve_attachment_remote(c *gin.Context, app *App, user *User, entity, i
 	}
 	c.Header("Content-Type", ct)
 	c.Header("Content-Disposition", disposition)
-	c.File(path)
+	web_serve_file(c, path, attachment_etag(id, variant))
 	return true
 }
 
+// attachment_etag returns the ETag of an attachment or one of its variants.
+// Attachment content never changes under an ID, so the ID and variant name
+// are enough ("-thumb" predates the other variants and is kept so browser
+// caches of existing thumbnails stay valid).
+func attachment_etag(id, variant string) string {
+	switch variant {
+	case "thumbnail":
+		return fmt.Sprintf(`"%s-thumb"`, id)
+	case "":
+		return fmt.Sprintf(`"%s"`, id)
+	}
+	return fmt.Sprintf(`"%s-%s"`, id, variant)
+}
+
+// web_serve_file serves a stored file with the validators and byte ranges
+// browsers need to cache it and to seek in audio and video. A request whose
+// If-None-Match or If-Modified-Since still matches gets 304; a Range request
+// gets 206 with just those bytes, or the whole file if If-Range no longer
+// matches. Behind a front-end proxy configured with web.sendfile, the body
+// is handed to the proxy to send instead of being copied through this process.
+func web_serve_file(c *gin.Context, path, etag string) {
+	f, err := os.Open(path)
+	if err != nil {
+		respond_error(c, http.StatusNotFound, "file_not_found", "errors.file_not_found", nil)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		respond_error(c, http.StatusNotFound, "file_not_found", "errors.file_not_found", nil)
+		return
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, must-revalidate")
+
+	if target := web_sendfile_target(path); target != "" && !mirror_requested(c.Request) {
+		if web_not_modified(c.Request, etag, fi.ModTime()) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		if c.Writer.Header().Get("Content-Type") == "" {
+			ct := mime.TypeByExtension(filepath.Ext(path))
+			if ct == "" {
+				ct = file_content_type(path)
+			}
+			c.Header("Content-Type", ct)
+		}
+		c.Header("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+		if web_sendfile == "nginx" {
+			c.Header("X-Accel-Redirect", target)
+		} else {
+			c.Header("X-Sendfile", target)
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// ServeContent handles Range, If-Range, If-None-Match against the ETag
+	// set above, and If-Modified-Since against the file's time
+	http.ServeContent(c.Writer, c.Request, fi.Name(), fi.ModTime(), f)
+}
+
+// web_not_modified reports whether a request's validators match, so the
+// response can be 304. If-None-Match takes precedence over If-Modified-Since
+// and compares weakly, as RFC 9110 requires for GET.
+func web_not_modified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		want := strings.TrimPrefix(etag, "W/")
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+				return true
+			}
+		}
+		return false
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" {
+		if t, err := http.ParseTime(since); err == nil {
+			return !modified.Truncate(time.Second).After(t)
+		}
+	}
+	return false
+}
+
+// web_sendfile_target returns the location a front-end proxy should send a
+// file from, or "" to serve it from this process. nginx gets an internal
+// URI under web.sendfile_prefix (data files under <prefix>/data/, cached
+// files under <prefix>/cache/), escaped so nginx decodes it back to the
+// file; apache and lighttpd get the absolute path. A path that can't be put
+// in a header is served from this process.
+func web_sendfile_target(path string) string {
+	if web_sendfile == "" || web_sendfile == "none" {
+		return ""
+	}
+	absolute, err := filepath.Abs(path)
+	if err != nil || strings.ContainsAny(absolute, "\r\n") {
+		return ""
+	}
+	if web_sendfile != "nginx" {
+		return absolute
+	}
+	for _, root := range []struct{ dir, name string }{{data_dir, "data"}, {cache_dir, "cache"}} {
+		base, err := filepath.Abs(root.dir)
+		if err != nil || root.dir == "" {
+			continue
+		}
+		if rel, err := filepath.Rel(base, absolute); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			u := url.URL{Path: strings.TrimSuffix(web_sendfile_prefix, "/") + "/" + root.name + "/" + filepath.ToSlash(rel)}
+			return u.EscapedPath()
+		}
+	}
+	return ""
+}
+
 // file_content_type sniffs a file's content type from its leading bytes, used
 // when no filename/extension is available to guide it (remote attachments).
 func file_content_type(path string) string {
@@ -0,0 +1,155 @@
+// Mochi server: Request body limits and slow clients
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// web_server sets no ReadTimeout or WriteTimeout, since a whole request or
+// response can legitimately take a long time. That left a client free to
+// send a body one byte at a time, or stop reading the response, and hold a
+// goroutine, a connection and often a Starlark slot for as long as it liked.
+//
+// Instead, a request body must arrive at an average of at least [web]
+// body_rate kilobytes a second after the first [web] body_grace seconds, so
+// a large upload over a slow but working link completes and a trickle is
+// cut off. The read deadline is moved on as the body arrives, and cleared
+// once it has all been read so it can't affect the rest of the request.
+// An app's response must be written within [web] write_timeout seconds of
+// its action's own timeout.
+//
+// Bodies other than multipart uploads and git packs are limited to
+// web_body_maximum. An action can declare its own limit in kilobytes with
+// "body" in app.json, as a webhook receiving large JSON documents might, up
+// to the server's [web] body_ceiling megabytes. For a multipart upload the
+// declared limit can only lower what web_multipart_maximum allows.
+
+var (
+	web_body_ceiling  = int64(64 << 20)
+	web_body_rate     = int64(4 << 10)
+	web_body_grace    = 30 * time.Second
+	web_write_timeout = 60 * time.Second
+
+	web_body_slow = errors.New("request body arriving too slowly")
+)
+
+// web_body_configure reads the [web] body and timeout settings
+func web_body_configure() {
+	web_body_ceiling = int64(ini_int("web", "body_ceiling", 64)) << 20
+	web_body_rate = int64(ini_int("web", "body_rate", 4)) << 10
+	web_body_grace = time.Duration(ini_int("web", "body_grace", 30)) * time.Second
+	web_write_timeout = time.Duration(ini_int("web", "write_timeout", 60)) * time.Second
+	if web_body_ceiling < web_body_maximum {
+		warn("Invalid web.body_ceiling %d MB; using 1", web_body_ceiling>>20)
+		web_body_ceiling = web_body_maximum
+	}
+	if web_body_grace <= 0 {
+		web_body_grace = 30 * time.Second
+	}
+}
+
+// web_slow_reader enforces the minimum rate on a request body
+type web_slow_reader struct {
+	body    io.ReadCloser
+	control *http.ResponseController
+	started time.Time
+	read    int64
+}
+
+func (r *web_slow_reader) Read(p []byte) (int, error) {
+	allowed := web_body_grace + time.Duration(float64(r.read)/float64(web_body_rate)*float64(time.Second))
+	_ = r.control.SetReadDeadline(r.started.Add(allowed))
+	n, err := r.body.Read(p)
+	r.read += int64(n)
+	if err != nil {
+		_ = r.control.SetReadDeadline(time.Time{})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, web_body_slow
+		}
+	}
+	return n, err
+}
+
+func (r *web_slow_reader) Close() error {
+	return r.body.Close()
+}
+
+// web_body_guard wraps a request's body in the minimum rate, if it has one
+// and the rate is enabled, and keeps it so an action can set its own limit
+func web_body_guard(c *gin.Context) {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return
+	}
+	if web_body_rate > 0 {
+		c.Request.Body = &web_slow_reader{body: c.Request.Body, control: http.NewResponseController(c.Writer), started: time.Now()}
+	}
+	c.Set("web_body", c.Request.Body)
+}
+
+// web_body_action applies an action's declared body limit, replacing
+// web_body_maximum. Returns false, having responded, if the request
+// announces a larger body.
+func web_body_action(c *gin.Context, aa *AppAction) bool {
+	body, ok := c.Get("web_body")
+	if !ok || aa.Body <= 0 || !web_body_limited(c) {
+		return true
+	}
+	maximum := web_body_declared(aa)
+	if c.Request.ContentLength > maximum {
+		respond_error(c, http.StatusRequestEntityTooLarge, "body_too_large", "errors.body_too_large", nil)
+		return false
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, body.(io.ReadCloser), maximum)
+	return true
+}
+
+// web_body_limited returns whether a request's body is held to
+// web_body_maximum, rather than being an upload bounded elsewhere
+func web_body_limited(c *gin.Context) bool {
+	ct := c.GetHeader("Content-Type")
+	return !strings.HasPrefix(ct, "multipart/form-data") && !strings.HasPrefix(ct, "application/x-git-")
+}
+
+// web_body_declared returns an action's declared body limit within the
+// server's ceiling, or 0 if it declares none
+func web_body_declared(aa *AppAction) int64 {
+	if aa.Body <= 0 {
+		return 0
+	}
+	return min(int64(aa.Body)<<10, web_body_ceiling)
+}
+
+// web_body_error responds to a failure reading the body of a request, if
+// it was too large or too slow. Returns whether it responded.
+func web_body_error(c *gin.Context, err error) bool {
+	var exceeded *http.MaxBytesError
+	if errors.As(err, &exceeded) {
+		respond_error(c, http.StatusRequestEntityTooLarge, "body_too_large", "errors.body_too_large", nil)
+		return true
+	}
+	if errors.Is(err, web_body_slow) {
+		respond_error(c, http.StatusRequestTimeout, "body_too_slow", "errors.body_too_slow", nil)
+		return true
+	}
+	return false
+}
+
+// web_write_deadline bounds writing a response that should be complete
+// within after, plus [web] write_timeout
+func web_write_deadline(c *gin.Context, after time.Duration) {
+	if web_write_timeout > 0 {
+		_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(after + web_write_timeout))
+	}
+}
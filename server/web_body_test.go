@@ -0,0 +1,111 @@
+// Mochi server: Request body limit and slow client tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// web_body_server runs the body middleware in front of a handler that
+// applies an action's limit and reads the body
+func web_body_server(t *testing.T, aa *AppAction) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(web_body_limit)
+	r.POST("/", func(c *gin.Context) {
+		if !web_body_action(c, aa) {
+			return
+		}
+		raw, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			if !web_body_error(c, err) {
+				c.Status(http.StatusBadRequest)
+			}
+			return
+		}
+		c.String(http.StatusOK, "%d", len(raw))
+	})
+	s := httptest.NewServer(r)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestWebBodyLimits(t *testing.T) {
+	post := func(s *httptest.Server, size int) int {
+		r, err := http.Post(s.URL, "application/json", bytes.NewReader(make([]byte, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	plain := web_body_server(t, &AppAction{})
+	if status := post(plain, web_body_maximum+1); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("over the default: %d", status)
+	}
+
+	// An action can raise the limit, but not past the ceiling
+	declared := web_body_server(t, &AppAction{Body: 4096})
+	if status := post(declared, 2<<20); status != http.StatusOK {
+		t.Errorf("within the declared limit: %d", status)
+	}
+	if status := post(declared, 5<<20); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("over the declared limit: %d", status)
+	}
+	ceiling := web_body_ceiling
+	web_body_ceiling = 1 << 20
+	defer func() { web_body_ceiling = ceiling }()
+	if status := post(declared, 2<<20); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("over the ceiling: %d", status)
+	}
+
+	// And lower it
+	small := web_body_server(t, &AppAction{Body: 1})
+	if status := post(small, 2048); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("over a lowered limit: %d", status)
+	}
+}
+
+func TestWebBodySlow(t *testing.T) {
+	grace := web_body_grace
+	web_body_grace = 200 * time.Millisecond
+	defer func() { web_body_grace = grace }()
+
+	s := web_body_server(t, &AppAction{})
+	body, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte("{"))
+		time.Sleep(2 * time.Second)
+		writer.Close()
+	}()
+	r, err := http.Post(s.URL, "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("trickled body: %d", r.StatusCode)
+	}
+
+	// A body arriving promptly is unaffected
+	r, err = http.Post(s.URL, "application/json", bytes.NewReader(make([]byte, 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		t.Errorf("prompt body: %d", r.StatusCode)
+	}
+}
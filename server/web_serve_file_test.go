@@ -0,0 +1,160 @@
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serve_file_request serves path through web_serve_file with the given headers
+func serve_file_request(t *testing.T, path string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/attachment", nil)
+	for k, v := range headers {
+		c.Request.Header.Set(k, v)
+	}
+	web_serve_file(c, path, `"abc"`)
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+func serve_file_setup(t *testing.T) string {
+	t.Helper()
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	path := filepath.Join(data_dir, "users", "u1", "video.mp4")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServeFileRange(t *testing.T) {
+	path := serve_file_setup(t)
+	w := serve_file_request(t, path, map[string]string{"Range": "bytes=2-5"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Fatalf("range: %d %q %q", w.Code, w.Body.String(), w.Header().Get("Content-Range"))
+	}
+	if w.Header().Get("ETag") != `"abc"` || w.Header().Get("Last-Modified") == "" || w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("validators: %v", w.Header())
+	}
+
+	// A stale If-Range gets the whole file
+	w = serve_file_request(t, path, map[string]string{"Range": "bytes=2-5", "If-Range": `"old"`})
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("stale if-range: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestServeFileConditional(t *testing.T) {
+	path := serve_file_setup(t)
+	for _, match := range []string{`"abc"`, `"other", W/"abc"`, `*`} {
+		if w := serve_file_request(t, path, map[string]string{"If-None-Match": match}); w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: %d", match, w.Code)
+		}
+	}
+	if w := serve_file_request(t, path, map[string]string{"If-None-Match": `"other"`}); w.Code != http.StatusOK {
+		t.Errorf("mismatched If-None-Match: %d", w.Code)
+	}
+	modified := serve_file_request(t, path, nil).Header().Get("Last-Modified")
+	if w := serve_file_request(t, path, map[string]string{"If-Modified-Since": modified}); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: %d", w.Code)
+	}
+}
+
+func TestServeFileSendfile(t *testing.T) {
+	path := serve_file_setup(t)
+	web_sendfile, web_sendfile_prefix = "nginx", "/_mochi"
+	t.Cleanup(func() { web_sendfile = "none" })
+
+	w := serve_file_request(t, path, nil)
+	if got := w.Header().Get("X-Accel-Redirect"); got != "/_mochi/data/users/u1/video.mp4" {
+		t.Errorf("X-Accel-Redirect %q", got)
+	}
+	if w.Body.Len() != 0 || w.Header().Get("Content-Type") != "video/mp4" {
+		t.Errorf("handoff body %d bytes, type %q", w.Body.Len(), w.Header().Get("Content-Type"))
+	}
+	if w := serve_file_request(t, path, map[string]string{"If-None-Match": `"abc"`}); w.Code != http.StatusNotModified || w.Header().Get("X-Accel-Redirect") != "" {
+		t.Errorf("conditional handoff: %d", w.Code)
+	}
+	if got := web_sendfile_target("/etc/passwd"); got != "" {
+		t.Errorf("file outside data and cache handed off as %q", got)
+	}
+	for name, want := range map[string]string{"a?b.mp4": "/_mochi/data/users/u1/a%3Fb.mp4", "100%.mp4": "/_mochi/data/users/u1/100%25.mp4", "a b.mp4": "/_mochi/data/users/u1/a%20b.mp4", "a\nb.mp4": ""} {
+		if got := web_sendfile_target(filepath.Join(filepath.Dir(path), name)); got != want {
+			t.Errorf("%q handed off as %q, want %q", name, got, want)
+		}
+	}
+}
+
+// web_static_request serves an app file through web_serve_static
+func web_static_request(t *testing.T, root, path, cache string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/app/assets/file", nil)
+	for k, v := range headers {
+		c.Request.Header.Set(k, v)
+	}
+	web_serve_static(c, root, path, cache)
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+func TestServeStatic(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	root := filepath.Join(data_dir, "apps", "static", "web")
+	os.MkdirAll(filepath.Join(root, "assets"), 0755)
+	os.WriteFile(filepath.Join(root, "assets", "app.js"), []byte("console.log(1)"), 0644)
+	os.WriteFile(filepath.Join(root, "icon.svg"), []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>x</script></svg>`), 0644)
+	os.WriteFile(filepath.Join(data_dir, "secret.txt"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(data_dir, "secret.txt"), filepath.Join(root, "leak.txt"))
+
+	js := filepath.Join(root, "assets", "app.js")
+	w := web_static_request(t, root, js, "", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "console.log(1)" || etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("file %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w.Header().Get("Content-Type") != "text/javascript; charset=utf-8" || w.Header().Get("Cache-Control") == "" {
+		t.Errorf("headers %v", w.Header())
+	}
+	if w := web_static_request(t, root, js, "revalidate", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match %d %q", w.Code, w.Body.String())
+	}
+	if w := web_static_request(t, root, js, "", map[string]string{"If-Modified-Since": w.Header().Get("Last-Modified")}); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since %d", w.Code)
+	}
+	if w := web_static_request(t, root, js, "", map[string]string{"If-None-Match": `"stale"`}); w.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match %d", w.Code)
+	}
+
+	svg := filepath.Join(root, "icon.svg")
+	w = web_static_request(t, root, svg, "", nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "script") || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Errorf("svg %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w := web_static_request(t, root, svg, "", map[string]string{"If-None-Match": w.Header().Get("ETag")}); w.Code != http.StatusNotModified {
+		t.Errorf("svg If-None-Match %d", w.Code)
+	}
+
+	for _, path := range []string{filepath.Join(root, "assets"), filepath.Join(root, "leak.txt"), filepath.Join(root, "..", "..", "..", "secret.txt"), filepath.Join(root, "missing.js")} {
+		if w := web_static_request(t, root, path, "", nil); w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("%s: %d %q", path, w.Code, w.Body.String())
+		}
+	}
+}
@@ -9,8 +9,13 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	webpush "github.com/SherClockHolmes/webpush-go"
 	"github.com/gin-gonic/gin"
@@ -32,7 +37,9 @@ var webpush_allowed = []string{
 // distinguishes subscriptions without exposing the token.
 func webpush_endpoint_redact(endpoint string) string {
 	host := endpoint
-	if i := strings.Index(host, "://"); i >= 0 {
+	if gateway, _, native := webpush_native(endpoint); native {
+		host = gateway
+	} else if i := strings.Index(host, "://"); i >= 0 {
 		host = host[i+3:]
 	}
 	if i := strings.IndexByte(host, '/'); i >= 0 {
@@ -67,10 +74,190 @@ func webpush_ensure() {
 	})
 }
 
+// Apps keep the browsers a user allows notifications on as subscriptions
+// held by core, each for the app that made it, optionally with a label such
+// as the device's name, and topics the user chose. mochi.webpush.notify()
+// sends to each of the user's subscriptions to the app whose topics match,
+// or to all of them if it names no topic, and subscriptions the push
+// service says have expired are removed. Sends count against a quota for
+// each user and app, so a misbehaving app can't flood the user's devices.
+//
+// Companion mobile apps register their devices the same way, with endpoints
+// of "fcm:<token>" or "apns:<token>" and no keys, when the server has
+// credentials for that gateway (fcm.go, apns.go). Their notifications go
+// out through it, with the fields of a JSON object payload, such as title,
+// body and link, as the message's data.
+
+var webpush_token_re = regexp.MustCompile(`^[0-9a-zA-Z:_-]{1,400}$`)
+
+const (
+	webpush_subscriptions_maximum = 20 // Per user and app
+	webpush_topics_maximum        = 50 // Per subscription
+)
+
+// Subscription is a browser or device an app may send a user's notifications to
+type Subscription struct {
+	ID       string
+	App      string
+	Endpoint string
+	Auth     string
+	P256dh   string
+	Label    string
+	Topics   string
+	Created  int64
+	Used     int64
+}
+
+func (db *DB) webpush_setup() {
+	db.exec("create table if not exists webpush_subscriptions (id text not null primary key, app text not null, endpoint text not null, auth text not null, p256dh text not null, label text not null default '', topics text not null default '[]', created integer not null, used integer not null default 0, unique (app, endpoint))")
+	db.exec("create index if not exists webpush_subscriptions_endpoint on webpush_subscriptions(endpoint)")
+}
+
+// topics returns the topic patterns a subscription wants
+func (s *Subscription) topics() []string {
+	var topics []string
+	json.Unmarshal([]byte(s.Topics), &topics)
+	return topics
+}
+
+// wants reports whether a subscription should receive a notification on a
+// topic. Without topics it receives everything, and a notification without
+// a topic goes to every subscription.
+func (s *Subscription) wants(topic string) bool {
+	topics := s.topics()
+	if topic == "" || len(topics) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(topics, func(pattern string) bool { return bus_match(pattern, topic) })
+}
+
+// webpush_endpoint_allowed reports whether an endpoint is at a known push service
+func webpush_endpoint_allowed(endpoint string) bool {
+	for _, base := range webpush_allowed {
+		if strings.HasPrefix(endpoint, base) {
+			return true
+		}
+	}
+	return false
+}
+
+// webpush_deliver sends a payload to a subscription, returning the push
+// service's response status
+func webpush_deliver(endpoint, auth, p256dh string, payload []byte) (int, error) {
+	resp, err := webpush.SendNotification(payload, &webpush.Subscription{Endpoint: endpoint, Keys: webpush.Keys{Auth: auth, P256dh: p256dh}}, &webpush.Options{
+		// Bounded, as the push service may hang
+		HTTPClient:      url_client(15 * time.Second),
+		Subscriber:      "mailto:webpush@localhost",
+		VAPIDPublicKey:  webpush_public,
+		VAPIDPrivateKey: webpush_private,
+		TTL:             86400,
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// webpush_native splits the endpoint of a mobile device into its gateway,
+// "fcm" or "apns", and token
+func webpush_native(endpoint string) (string, string, bool) {
+	gateway, token, found := strings.Cut(endpoint, ":")
+	if !found || (gateway != "fcm" && gateway != "apns") || token == "" {
+		return "", "", false
+	}
+	return gateway, token, true
+}
+
+// webpush_gateway_configured reports whether the server can send through a
+// mobile push gateway
+func webpush_gateway_configured(gateway string) bool {
+	switch gateway {
+	case "fcm":
+		return fcm_credentials() != ""
+	case "apns":
+		return apns_configured()
+	}
+	return false
+}
+
+// webpush_fields returns the fields of a payload for a mobile push
+// gateway: those of a JSON object, or the payload as the body otherwise
+func webpush_fields(payload []byte) map[string]string {
+	var object map[string]any
+	if json.Unmarshal(payload, &object) != nil || object == nil {
+		return map[string]string{"body": string(payload)}
+	}
+	fields := map[string]string{}
+	for k, v := range object {
+		if text, ok := v.(string); ok {
+			fields[k] = text
+		} else {
+			fields[k] = json_encode(v)
+		}
+	}
+	return fields
+}
+
+// deliver sends a payload to a subscription through its push service or
+// gateway, returning whether it was taken and whether the subscription has
+// expired
+func (s *Subscription) deliver(payload []byte) (bool, bool) {
+	if gateway, token, native := webpush_native(s.Endpoint); native {
+		var ok, retire bool
+		if gateway == "fcm" {
+			ok, retire, _ = fcm_send(token, webpush_fields(payload))
+		} else {
+			ok, retire, _ = apns_send(token, webpush_fields(payload))
+		}
+		return ok, retire
+	}
+
+	webpush_ensure()
+	if webpush_public == "" || webpush_private == "" {
+		return false, false
+	}
+	status, err := webpush_deliver(s.Endpoint, s.Auth, s.P256dh, payload)
+	if err != nil {
+		debug("webpush: send to %q failed: %v", webpush_endpoint_redact(s.Endpoint), err)
+		return false, false
+	}
+	return status == http.StatusCreated, webpush_expired(status)
+}
+
+// webpush_expired reports whether a push service status means the
+// subscription is gone for good
+func webpush_expired(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusGone
+}
+
+// webpush_prune removes a user's subscriptions at an endpoint that has expired
+func webpush_prune(u *User, endpoint string) {
+	db := db_user(u, "notifications")
+	if exists, _ := db.exists("select 1 from webpush_subscriptions where endpoint=?", endpoint); exists {
+		db.exec("delete from webpush_subscriptions where endpoint=?", endpoint)
+		debug("webpush: removed expired subscription %q for user %s", webpush_endpoint_redact(endpoint), u.UID)
+	}
+}
+
+// webpush_quota reports whether an app may send another of a user's
+// notifications
+func webpush_quota(u *User, app *App) bool {
+	if rate_limit_webpush.allow(u.UID + " " + app.id) {
+		return true
+	}
+	info("webpush: app %q over its send quota for user %s", app.id, u.UID)
+	return false
+}
+
 // Starlark API
 var api_webpush = sls.FromStringDict(sl.String("mochi.webpush"), sl.StringDict{
-	"key":  sl.NewBuiltin("mochi.webpush.key", api_webpush_key),
-	"send": sl.NewBuiltin("mochi.webpush.send", api_webpush_send),
+	"key":       sl.NewBuiltin("mochi.webpush.key", api_webpush_key),
+	"list":      sl.NewBuiltin("mochi.webpush.list", api_webpush_list),
+	"notify":    sl.NewBuiltin("mochi.webpush.notify", api_webpush_notify),
+	"remove":    sl.NewBuiltin("mochi.webpush.remove", api_webpush_remove),
+	"send":      sl.NewBuiltin("mochi.webpush.send", api_webpush_send),
+	"subscribe": sl.NewBuiltin("mochi.webpush.subscribe", api_webpush_subscribe),
 })
 
 // mochi.webpush.key() -> string: Get VAPID public key for browser subscription
@@ -79,6 +266,177 @@ func api_webpush_key(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tu
 	return sl.String(webpush_public), nil
 }
 
+// mochi.webpush.subscribe(endpoint, auth, p256dh, label?, topics?) -> string: Keep
+// a browser's push subscription for the calling app and user, returning its
+// id. Subscribing an endpoint again updates its keys, label and topics.
+// Topics are patterns as in mochi.bus, such as "chat/*".
+func api_webpush_subscribe(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, app, err := notification_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	var endpoint, auth, p256dh, label string
+	var given sl.Value = sl.None
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs,
+		"endpoint", &endpoint,
+		"auth?", &auth,
+		"p256dh?", &p256dh,
+		"label?", &label,
+		"topics?", &given,
+	); err != nil {
+		return nil, err
+	}
+	if gateway, token, native := webpush_native(endpoint); native {
+		if !webpush_gateway_configured(gateway) {
+			return sl_error(fn, "%s not configured on this server", gateway)
+		}
+		if !webpush_token_re.MatchString(token) {
+			return sl_error(fn, "invalid device token")
+		}
+		auth, p256dh = "", ""
+	} else {
+		if !webpush_endpoint_allowed(endpoint) || !valid(endpoint, "url") {
+			return sl_error(fn, "endpoint not at a known push service")
+		}
+		if !valid(auth, "constant") || !valid(p256dh, "constant") {
+			return sl_error(fn, "invalid keys")
+		}
+	}
+	if label != "" && !valid(label, "name") {
+		return sl_error(fn, "invalid label")
+	}
+	topics := []string{}
+	if given != sl.None {
+		list, ok := sl_decode(given).([]any)
+		if !ok {
+			return sl_error(fn, "topics must be a list")
+		}
+		if len(list) > webpush_topics_maximum {
+			return sl_error(fn, "more than %d topics", webpush_topics_maximum)
+		}
+		for _, v := range list {
+			topic, ok := v.(string)
+			if !ok || !bus_pattern_valid(topic) {
+				return sl_error(fn, "invalid topic %v", v)
+			}
+			topics = append(topics, topic)
+		}
+	}
+
+	db := db_user(user, "notifications")
+	var s Subscription
+	if db.scan(&s, "select * from webpush_subscriptions where app=? and endpoint=?", app.id, endpoint) {
+		db.exec("update webpush_subscriptions set auth=?, p256dh=?, label=?, topics=? where id=?", auth, p256dh, label, json_encode(topics), s.ID)
+		return sl.String(s.ID), nil
+	}
+	if db.integer("select count(*) from webpush_subscriptions where app=?", app.id) >= webpush_subscriptions_maximum {
+		return sl_error(fn, "more than %d subscriptions", webpush_subscriptions_maximum)
+	}
+	id := uid()
+	db.exec("insert into webpush_subscriptions (id, app, endpoint, auth, p256dh, label, topics, created) values (?, ?, ?, ?, ?, ?, ?, ?)", id, app.id, endpoint, auth, p256dh, label, json_encode(topics), now())
+	return sl.String(id), nil
+}
+
+// mochi.webpush.list() -> list: The calling app's subscriptions for the user,
+// each with its id, label, topics, push service, and when it was created
+// and last sent to. Endpoints and keys aren't returned.
+func api_webpush_list(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if len(args) != 0 || len(kwargs) != 0 {
+		return sl_error(fn, "syntax: no arguments")
+	}
+	user, app, err := notification_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	var subscriptions []Subscription
+	if err := db_user(user, "notifications").scans(&subscriptions, "select * from webpush_subscriptions where app=? order by created, id", app.id); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	list := []map[string]any{}
+	for _, s := range subscriptions {
+		service, _, _ := strings.Cut(webpush_endpoint_redact(s.Endpoint), "#")
+		list = append(list, map[string]any{"id": s.ID, "label": s.Label, "topics": s.topics(), "service": service, "created": s.Created, "used": s.Used})
+	}
+	return sl_encode(list), nil
+}
+
+// mochi.webpush.remove(id) -> bool: Remove one of the calling app's
+// subscriptions, returning whether it existed
+func api_webpush_remove(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	user, app, err := notification_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	var id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs, "id", &id); err != nil {
+		return nil, err
+	}
+
+	db := db_user(user, "notifications")
+	exists, _ := db.exists("select 1 from webpush_subscriptions where id=? and app=?", id, app.id)
+	if exists {
+		db.exec("delete from webpush_subscriptions where id=? and app=?", id, app.id)
+	}
+	return sl.Bool(exists), nil
+}
+
+// mochi.webpush.notify(payload, topic?, event_id?) -> int: Send a notification
+// to the calling app's subscriptions for the user that want its topic,
+// returning how many took it. Expired subscriptions are removed. event_id
+// dedups as in mochi.webpush.send.
+func api_webpush_notify(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.Tuple) (sl.Value, error) {
+	if err := require_permission(t, fn, "webpush/send"); err != nil {
+		return sl_error(fn, "%v", err)
+	}
+	user, app, err := notification_caller(t)
+	if err != nil {
+		return sl_error(fn, "%v", err)
+	}
+
+	var payload, topic, event_id string
+	if err := sl.UnpackArgs(fn.Name(), args, kwargs,
+		"payload", &payload,
+		"topic?", &topic,
+		"event_id?", &event_id,
+	); err != nil {
+		return nil, err
+	}
+	if topic != "" && !bus_topic_valid(topic) {
+		return sl_error(fn, "invalid topic %q", topic)
+	}
+
+	db := db_user(user, "notifications")
+	var subscriptions []Subscription
+	if err := db.scans(&subscriptions, "select * from webpush_subscriptions where app=?", app.id); err != nil {
+		return sl_error(fn, "database error: %v", err)
+	}
+	targets := slices.DeleteFunc(subscriptions, func(s Subscription) bool {
+		return !s.wants(topic) || (event_id != "" && webpush_already_delivered(user, s.Endpoint, event_id))
+	})
+	if len(targets) == 0 || !webpush_quota(user, app) {
+		return sl.MakeInt(0), nil
+	}
+
+	sent := 0
+	for _, s := range targets {
+		ok, expired := s.deliver([]byte(payload))
+		if expired {
+			webpush_prune(user, s.Endpoint)
+		}
+		if !ok {
+			continue
+		}
+		sent++
+		db.exec("update webpush_subscriptions set used=? where id=?", now(), s.ID)
+		if event_id != "" {
+			webpush_mark_delivered(user, s.Endpoint, event_id)
+		}
+	}
+	return sl.MakeInt(sent), nil
+}
+
 // mochi.webpush.send(endpoint, auth, p256dh, payload, event_id="...") -> bool: Send push notification.
 //
 // `event_id` is an optional caller-supplied stable id for the logical
@@ -114,14 +472,7 @@ func api_webpush_send(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.T
 	}
 
 	// Validate endpoint is a known push service (whitelist)
-	valid := false
-	for _, base := range webpush_allowed {
-		if strings.HasPrefix(endpoint, base) {
-			valid = true
-			break
-		}
-	}
-	if !valid {
+	if !webpush_endpoint_allowed(endpoint) {
 		return sl.Bool(false), nil
 	}
 
@@ -135,32 +486,23 @@ func api_webpush_send(t *sl.Thread, fn *sl.Builtin, args sl.Tuple, kwargs []sl.T
 		}
 	}
 
-	sub := webpush.Subscription{
-		Endpoint: endpoint,
-		Keys: webpush.Keys{
-			Auth:   auth,
-			P256dh: p256dh,
-		},
+	if app, _ := t.Local("app").(*App); user != nil && app != nil && !webpush_quota(user, app) {
+		return sl.Bool(false), nil
 	}
 
-	resp, err := webpush.SendNotification([]byte(payload), &sub, &webpush.Options{
-		Subscriber:      "mailto:webpush@localhost",
-		VAPIDPublicKey:  webpush_public,
-		VAPIDPrivateKey: webpush_private,
-		TTL:             86400,
-	})
-
+	status, err := webpush_deliver(endpoint, auth, p256dh, []byte(payload))
 	if err != nil {
 		return sl.Bool(false), nil
 	}
-	resp.Body.Close()
 
-	ok := resp.StatusCode == 201
+	// 201 = success, 404/410 = subscription expired
+	if webpush_expired(status) && user != nil {
+		webpush_prune(user, endpoint)
+	}
+	ok := status == http.StatusCreated
 	if ok && event_id != "" && user != nil {
 		webpush_mark_delivered(user, endpoint, event_id)
 	}
-
-	// 201 = success, 404/410 = subscription expired
 	return sl.Bool(ok), nil
 }
 
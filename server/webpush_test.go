@@ -0,0 +1,130 @@
+// Mochi server: Web Push subscription tests
+// Copyright © 2026 Mochisoft OÜ
+// SPDX-License-Identifier: AGPL-3.0-only
+// This file is part of Mochi, licensed under the GNU AGPL v3 with the
+// Mochi Application Interface Exception - see license.txt and license-exception.md.
+
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+	sl "go.starlark.net/starlark"
+)
+
+func TestWebpushSubscriptions(t *testing.T) {
+	setup_test_data_dir(t)
+	t.Cleanup(func() { cleanup_test_data_dir(t) })
+	db_open("db/settings.db").exec("create table if not exists settings (name text primary key, value text not null)")
+	webpush_ensure()
+	if webpush_public == "" {
+		// Another test ensured the keys without a settings database
+		webpush_private, webpush_public, _ = webpush.GenerateVAPIDKeys()
+	}
+
+	// A push service taking notifications for /live and saying /gone has expired
+	var received atomic.Int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/gone") {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		received.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(service.Close)
+	previous := webpush_allowed
+	webpush_allowed = []string{service.URL + "/"}
+	t.Cleanup(func() { webpush_allowed = previous })
+	networks := url_private_networks
+	url_private_networks = url_networks([]string{"127.0.0.1"})
+	t.Cleanup(func() { url_private_networks = networks })
+
+	user := create_permission_test_user(t, "u1")
+	app := create_external_app("chat")
+	permission_grant(user, app.id, "webpush/send")
+	thread := create_test_thread(user, app)
+	other := create_test_thread(user, create_external_app("feeds"))
+
+	call := func(thread *sl.Thread, name string, args ...any) sl.Value {
+		t.Helper()
+		f, _ := api_webpush.Attr(name)
+		var kw []sl.Tuple
+		for i := 0; i < len(args); i += 2 {
+			kw = append(kw, sl.Tuple{sl.String(args[i].(string)), sl_encode(args[i+1])})
+		}
+		v, err := sl.Call(thread, f, nil, kw)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return v
+	}
+	subscribe := func(thread *sl.Thread, endpoint string, topics []any) string {
+		t.Helper()
+		key, _ := ecdh.P256().GenerateKey(rand.Reader)
+		auth := make([]byte, 16)
+		rand.Read(auth)
+		id, _ := sl.AsString(call(thread, "subscribe", "endpoint", service.URL+endpoint, "auth", base64.RawURLEncoding.EncodeToString(auth), "p256dh", base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), "label", "Phone", "topics", topics))
+		return id
+	}
+
+	phone := subscribe(thread, "/live/phone", []any{"chat/*"})
+	laptop := subscribe(thread, "/live/laptop", nil)
+	subscribe(thread, "/gone/tablet", nil)
+	subscribe(other, "/live/other", nil)
+	if again := subscribe(thread, "/live/phone", []any{"chat/mentions"}); again != phone {
+		t.Errorf("subscribing again made %q, not %q", again, phone)
+	}
+
+	list := sl_decode(call(thread, "list")).([]any)
+	if len(list) != 3 {
+		t.Fatalf("list %v", list)
+	}
+	first := list[0].(map[string]any)
+	if first["id"] != phone || first["label"] != "Phone" || first["service"] != strings.TrimPrefix(service.URL, "http://") || first["endpoint"] != nil {
+		t.Errorf("first %v", first)
+	}
+	if topics, _ := first["topics"].([]any); len(topics) != 1 || topics[0] != "chat/mentions" {
+		t.Errorf("topics %v", first["topics"])
+	}
+
+	// The phone wants only mentions; the tablet has expired and is removed
+	if sent := call(thread, "notify", "payload", "{}", "topic", "chat/general"); sent != sl.MakeInt(1) || received.Load() != 1 {
+		t.Errorf("sent %v, received %d", sent, received.Load())
+	}
+	if n := len(sl_decode(call(thread, "list")).([]any)); n != 2 {
+		t.Errorf("%d subscriptions left", n)
+	}
+	if sent := call(thread, "notify", "payload", "{}", "topic", "chat/mentions", "event_id", "e1"); sent != sl.MakeInt(2) {
+		t.Errorf("sent %v to mentions", sent)
+	}
+	if sent := call(thread, "notify", "payload", "{}", "topic", "chat/mentions", "event_id", "e1"); sent != sl.MakeInt(0) {
+		t.Errorf("sent %v again", sent)
+	}
+
+	if call(thread, "remove", "id", laptop) != sl.True || call(other, "remove", "id", phone) != sl.False {
+		t.Error("remove")
+	}
+
+	// Sends stop at the quota
+	for i := 0; i < rate_limit_webpush.limit; i++ {
+		call(thread, "notify", "payload", "{}")
+	}
+	if sent := call(thread, "notify", "payload", "{}"); sent != sl.MakeInt(0) {
+		t.Errorf("sent %v over the quota", sent)
+	}
+	rate_limit_webpush.reset(user.UID + " " + app.id)
+
+	f, _ := api_webpush.Attr("subscribe")
+	if _, err := sl.Call(thread, f, nil, []sl.Tuple{{sl.String("endpoint"), sl.String("https://push.example.com/x")}, {sl.String("auth"), sl.String("a")}, {sl.String("p256dh"), sl.String("b")}}); err == nil {
+		t.Error("subscribed at an unknown push service")
+	}
+}
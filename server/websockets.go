@@ -80,7 +80,7 @@ func websocket_connection(c *gin.Context) {
 	}
 	key := c.Query("key")
 	id := uid()
-	defer websocket_terminate(ws, u, key, id)
+	defer websocket_terminate(ws, u.UID, key, id)
 
 	websockets_lock.Lock()
 	_, found := websockets[u.UID]
@@ -98,7 +98,7 @@ func websocket_connection(c *gin.Context) {
 	for {
 		t, j, err := ws.Read(websocket_context)
 		if err != nil {
-			websocket_terminate(ws, u, key, id)
+			websocket_terminate(ws, u.UID, key, id)
 			return
 		}
 		if t != websocket.MessageText {
@@ -110,12 +110,18 @@ func websocket_connection(c *gin.Context) {
 }
 
 func websockets_send(u *User, key string, content any) {
-	// debug("Websocket sending to user %d, key %q: %+v", u.UID, key, content)
+	websockets_deliver(u.UID, key, content)
+	cluster_relay(u.UID, key, content)
+}
+
+// websockets_deliver sends content to this process's clients for a user and key
+func websockets_deliver(uid string, key string, content any) {
+	// debug("Websocket sending to user %d, key %q: %+v", uid, key, content)
 	j := ""
 	var failed []string
 
 	websockets_lock.RLock()
-	for id, ws := range websockets[u.UID][key] {
+	for id, ws := range websockets[uid][key] {
 		if j == "" {
 			j = json_encode(content)
 		}
@@ -128,23 +134,23 @@ func websockets_send(u *User, key string, content any) {
 
 	for _, id := range failed {
 		websockets_lock.RLock()
-		ws := websockets[u.UID][key][id]
+		ws := websockets[uid][key][id]
 		websockets_lock.RUnlock()
-		websocket_terminate(ws, u, key, id)
+		websocket_terminate(ws, uid, key, id)
 	}
 }
 
-func websocket_terminate(ws *websocket.Conn, u *User, key string, id string) {
+func websocket_terminate(ws *websocket.Conn, uid string, key string, id string) {
 	ws.CloseNow()
 	websockets_lock.Lock()
-	delete(websockets[u.UID][key], id)
+	delete(websockets[uid][key], id)
 
-	if len(websockets[u.UID][key]) == 0 {
-		delete(websockets[u.UID], key)
+	if len(websockets[uid][key]) == 0 {
+		delete(websockets[uid], key)
 	}
 
-	if len(websockets[u.UID]) == 0 {
-		delete(websockets, u.UID)
+	if len(websockets[uid]) == 0 {
+		delete(websockets, uid)
 	}
 	websockets_lock.Unlock()
 }